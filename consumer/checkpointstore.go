@@ -0,0 +1,116 @@
+// Copyright 2015-2016 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumer
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sync"
+)
+
+// checkpointStore persists the position of the last message processed per
+// partition, e.g. a Kinesis shard, and decides which partitions are
+// processed by this consumer.
+type checkpointStore interface {
+	// checkpoints returns the stored position of all known partitions.
+	checkpoints() (map[string]string, error)
+
+	// store persists the position of a partition. An error is returned if
+	// the partition is not leased to this consumer anymore.
+	store(partitionID, position string) error
+
+	// lease returns the subset of the given partitions to be processed by
+	// this consumer. It is called periodically and is expected to renew
+	// leases.
+	lease(partitionIDs []string) (map[string]bool, error)
+
+	// release gives up all leases held by this consumer.
+	release()
+}
+
+// fileCheckpointStore stores checkpoints in a JSON file. All partitions
+// are processed by this consumer. If no file is given checkpoints are only kept
+// in memory.
+type fileCheckpointStore struct {
+	fileName string
+	offsets  map[string]string
+	guard    *sync.Mutex
+}
+
+func newFileCheckpointStore(fileName string) (*fileCheckpointStore, error) {
+	store := &fileCheckpointStore{
+		fileName: fileName,
+		offsets:  make(map[string]string),
+		guard:    new(sync.Mutex),
+	}
+
+	if fileName != "" {
+		fileContents, err := ioutil.ReadFile(fileName)
+		switch {
+		case os.IsNotExist(err):
+			// Start with the default offset
+		case err != nil:
+			return nil, err
+		default:
+			if err := json.Unmarshal(fileContents, &store.offsets); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return store, nil
+}
+
+func (store *fileCheckpointStore) checkpoints() (map[string]string, error) {
+	store.guard.Lock()
+	defer store.guard.Unlock()
+
+	offsets := make(map[string]string, len(store.offsets))
+	for partitionID, position := range store.offsets {
+		offsets[partitionID] = position
+	}
+	return offsets, nil
+}
+
+func (store *fileCheckpointStore) store(partitionID, position string) error {
+	store.guard.Lock()
+	defer store.guard.Unlock()
+
+	store.offsets[partitionID] = position
+	if store.fileName == "" {
+		return nil // ### return, memory only ###
+	}
+
+	fileContents, err := json.Marshal(store.offsets)
+	if err != nil {
+		return err
+	}
+	tmpFileName := store.fileName + ".tmp"
+	if err := ioutil.WriteFile(tmpFileName, fileContents, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpFileName, store.fileName)
+}
+
+func (store *fileCheckpointStore) lease(partitionIDs []string) (map[string]bool, error) {
+	owned := make(map[string]bool, len(partitionIDs))
+	for _, partitionID := range partitionIDs {
+		owned[partitionID] = true
+	}
+	return owned, nil
+}
+
+func (store *fileCheckpointStore) release() {
+}
@@ -0,0 +1,451 @@
+// Copyright 2015-2016 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumer
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/core/log"
+	"github.com/trivago/gollum/shared"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	dockerMetadataID     = "container_id"
+	dockerMetadataName   = "container_name"
+	dockerMetadataImage  = "container_image"
+	dockerMetadataStream = "container_stream"
+	dockerMetadataLabel  = "container_label."
+	dockerStreamStdout   = byte(1)
+	dockerStreamStderr   = byte(2)
+)
+
+// Docker consumer plugin
+// The docker consumer reads the output of docker containers through the
+// docker engine API. All running containers matching the configured filters
+// are attached to and containers started later on are followed automatically.
+// Each line written to stdout or stderr of a container is sent as a message.
+// The container is attached to each message as "container_id",
+// "container_name" and "container_image" metadata. The output stream is
+// stored as "container_stream" ("stdout" or "stderr") and each container
+// label is stored as "container_label.<name>".
+// When attached to a fuse, this consumer will stop reading container output
+// in case that fuse is burned.
+// Configuration example
+//
+//  - "consumer.Docker":
+//    Endpoint: "unix:///var/run/docker.sock"
+//    ContainerNames:
+//      - "^web-"
+//    ContainerLabels:
+//      "logging": "enabled"
+//    Stdout: true
+//    Stderr: true
+//    DefaultOffset: "newest"
+//    RetryDelayMs: 3000
+//
+// Endpoint defines the address of the docker engine API. This can either be
+// a unix socket like "unix:///var/run/docker.sock" or a tcp address like
+// "tcp://localhost:2375". By default this is set to
+// "unix:///var/run/docker.sock".
+//
+// ContainerNames defines a list of regular expressions matched against the
+// container names. A container is read if any of these expressions matches.
+// By default this list is empty, which matches all containers.
+//
+// ContainerLabels defines a map of labels a container must have to be read.
+// An empty value only requires the label to exist. By default this map is
+// empty, which matches all containers.
+//
+// Stdout can be set to false to ignore the standard output of containers.
+// By default this is set to true.
+//
+// Stderr can be set to false to ignore the standard error output of
+// containers. By default this is set to true.
+//
+// DefaultOffset defines where to start reading the output of containers that
+// are already running when the consumer is started. Valid values are "oldest"
+// and "newest". Containers started while the consumer is running are always
+// read from their start. By default this is set to "newest".
+//
+// RetryDelayMs defines the number of milliseconds to wait before reconnecting
+// to the docker engine after the connection has been lost.
+// By default this is set to 3000.
+type Docker struct {
+	core.ConsumerBase
+	client     *http.Client
+	baseURL    string
+	names      []*regexp.Regexp
+	labels     map[string]string
+	stdout     bool
+	stderr     bool
+	seekOldest bool
+	retryDelay time.Duration
+	attached   map[string]bool
+	bodies     map[io.Closer]bool
+	guard      *sync.Mutex
+	sequence   uint64
+}
+
+type dockerContainer struct {
+	ID     string `json:"Id"`
+	Name   string `json:"Name"`
+	Config struct {
+		Image  string            `json:"Image"`
+		Labels map[string]string `json:"Labels"`
+		Tty    bool              `json:"Tty"`
+	} `json:"Config"`
+}
+
+type dockerEvent struct {
+	Status string `json:"status"`
+	ID     string `json:"id"`
+}
+
+func init() {
+	shared.TypeRegistry.Register(Docker{})
+}
+
+// Configure initializes this consumer with values from a plugin config.
+func (cons *Docker) Configure(conf core.PluginConfig) error {
+	err := cons.ConsumerBase.Configure(conf)
+	if err != nil {
+		return err
+	}
+
+	address, protocol := shared.ParseAddress(conf.GetString("Endpoint", "unix:///var/run/docker.sock"))
+	switch protocol {
+	case "unix":
+		cons.baseURL = "http://docker"
+		cons.client = &http.Client{
+			Transport: &http.Transport{
+				Dial: func(network, addr string) (net.Conn, error) {
+					return net.Dial("unix", address)
+				},
+			},
+		}
+	case "tcp", "http":
+		cons.baseURL = "http://" + address
+		cons.client = &http.Client{Transport: &http.Transport{}}
+	default:
+		return fmt.Errorf("Docker does not support %s endpoints", protocol)
+	}
+
+	for _, pattern := range conf.GetStringArray("ContainerNames", []string{}) {
+		expression, err := regexp.Compile(pattern)
+		if err != nil {
+			return err
+		}
+		cons.names = append(cons.names, expression)
+	}
+
+	cons.labels = conf.GetStringMap("ContainerLabels", map[string]string{})
+	cons.stdout = conf.GetBool("Stdout", true)
+	cons.stderr = conf.GetBool("Stderr", true)
+	cons.seekOldest = strings.ToLower(conf.GetString("DefaultOffset", fileOffsetEnd)) == fileOffsetStart
+	cons.retryDelay = time.Duration(conf.GetInt("RetryDelayMs", 3000)) * time.Millisecond
+	cons.attached = make(map[string]bool)
+	cons.bodies = make(map[io.Closer]bool)
+	cons.guard = new(sync.Mutex)
+
+	if !cons.stdout && !cons.stderr {
+		return fmt.Errorf("Docker requires Stdout or Stderr to be enabled")
+	}
+
+	return nil
+}
+
+// get sends a GET request to the docker engine API. The body of the response
+// is closed when the consumer is stopped.
+func (cons *Docker) get(path string, query url.Values) (io.ReadCloser, error) {
+	requestURL := cons.baseURL + path
+	if len(query) > 0 {
+		requestURL += "?" + query.Encode()
+	}
+
+	response, err := cons.client.Get(requestURL)
+	if err != nil {
+		return nil, err // ### return, request failed ###
+	}
+
+	if response.StatusCode != http.StatusOK {
+		message, _ := ioutil.ReadAll(io.LimitReader(response.Body, 1024))
+		response.Body.Close()
+		return nil, fmt.Errorf("%s returned %s: %s", path, response.Status, strings.TrimSpace(string(message)))
+	}
+
+	cons.guard.Lock()
+	defer cons.guard.Unlock()
+	if !cons.IsActive() {
+		response.Body.Close()
+		return nil, fmt.Errorf("Consumer is stopping")
+	}
+	cons.bodies[response.Body] = true
+	return response.Body, nil
+}
+
+// release closes a response body returned by get.
+func (cons *Docker) release(body io.ReadCloser) {
+	cons.guard.Lock()
+	defer cons.guard.Unlock()
+	delete(cons.bodies, body)
+	body.Close()
+}
+
+func (cons *Docker) getJSON(path string, query url.Values, value interface{}) error {
+	body, err := cons.get(path, query)
+	if err != nil {
+		return err // ### return, request failed ###
+	}
+	defer cons.release(body)
+	return json.NewDecoder(body).Decode(value)
+}
+
+// matches returns true if a container passes the name and label filters.
+func (cons *Docker) matches(container dockerContainer) bool {
+	for label, value := range cons.labels {
+		if containerValue, exists := container.Config.Labels[label]; !exists || (value != "" && value != containerValue) {
+			return false // ### return, label missing ###
+		}
+	}
+
+	if len(cons.names) == 0 {
+		return true // ### return, no name filter ###
+	}
+
+	name := strings.TrimPrefix(container.Name, "/")
+	for _, expression := range cons.names {
+		if expression.MatchString(name) {
+			return true // ### return, name matches ###
+		}
+	}
+	return false
+}
+
+// attach starts reading the output of a container if it matches the filters
+// and is not read yet.
+func (cons *Docker) attach(containerID string, fromStart bool) {
+	container := dockerContainer{}
+	if err := cons.getJSON("/containers/"+url.QueryEscape(containerID)+"/json", nil, &container); err != nil {
+		Log.Error.Printf("Docker failed to inspect container %s: %s", containerID, err.Error())
+		return // ### return, inspect failed ###
+	}
+
+	if !cons.matches(container) {
+		return // ### return, filtered ###
+	}
+
+	cons.guard.Lock()
+	defer cons.guard.Unlock()
+	if cons.attached[container.ID] {
+		return // ### return, already attached ###
+	}
+	cons.attached[container.ID] = true
+
+	cons.AddWorker()
+	go shared.DontPanic(func() { cons.readLogs(container, fromStart) })
+}
+
+func (cons *Docker) detach(containerID string) {
+	cons.guard.Lock()
+	defer cons.guard.Unlock()
+	delete(cons.attached, containerID)
+}
+
+func (cons *Docker) newMessage(data []byte, container dockerContainer, stream string) core.Message {
+	msg := core.NewMessage(cons, data, atomic.AddUint64(&cons.sequence, 1)-1)
+	msg.SetMetadata(dockerMetadataID, container.ID)
+	msg.SetMetadata(dockerMetadataName, strings.TrimPrefix(container.Name, "/"))
+	msg.SetMetadata(dockerMetadataImage, container.Config.Image)
+	msg.SetMetadata(dockerMetadataStream, stream)
+	for label, value := range container.Config.Labels {
+		msg.SetMetadata(dockerMetadataLabel+label, value)
+	}
+	return msg
+}
+
+// readLogs follows the output of a container until the container stops or
+// the consumer is stopped.
+func (cons *Docker) readLogs(container dockerContainer, fromStart bool) {
+	defer cons.WorkerDone()
+	defer cons.detach(container.ID)
+
+	query := url.Values{}
+	query.Set("follow", "1")
+	if cons.stdout {
+		query.Set("stdout", "1")
+	}
+	if cons.stderr {
+		query.Set("stderr", "1")
+	}
+	if !fromStart {
+		query.Set("tail", "0")
+	}
+
+	body, err := cons.get("/containers/"+url.QueryEscape(container.ID)+"/logs", query)
+	if err != nil {
+		if cons.IsActive() {
+			Log.Error.Printf("Docker failed to read logs of %s: %s", container.Name, err.Error())
+		}
+		return // ### return, request failed ###
+	}
+	defer cons.release(body)
+
+	Log.Note.Printf("Docker reading logs of %s", strings.TrimPrefix(container.Name, "/"))
+	readers := map[byte]*shared.BufferedReader{
+		dockerStreamStdout: shared.NewBufferedReader(fileBufferGrowSize, 0, 0, "\n"),
+		dockerStreamStderr: shared.NewBufferedReader(fileBufferGrowSize, 0, 0, "\n"),
+	}
+
+	onFrame := func(streamType byte, payload []byte) {
+		cons.WaitOnFuse()
+		buffer, known := readers[streamType]
+		if !known {
+			return // ### return, stdin or unknown stream ###
+		}
+		stream := "stdout"
+		if streamType == dockerStreamStderr {
+			stream = "stderr"
+		}
+		buffer.ReadAll(bytes.NewReader(payload), func(data []byte, seq uint64) {
+			cons.EnqueueMessage(cons.newMessage(data, container, stream))
+		})
+	}
+
+	if container.Config.Tty {
+		// Containers with a terminal send their output without framing
+		payload := make([]byte, fileBufferGrowSize)
+		for {
+			size, err := body.Read(payload)
+			if size > 0 {
+				onFrame(dockerStreamStdout, payload[:size])
+			}
+			if err != nil {
+				break // ### break, stream closed ###
+			}
+		}
+	} else {
+		err = readDockerFrames(body, onFrame)
+	}
+
+	if err != nil && err != io.EOF && cons.IsActive() {
+		Log.Warning.Printf("Docker stopped reading logs of %s: %s", container.Name, err.Error())
+	}
+}
+
+// readDockerFrames reads a multiplexed output stream as returned by the logs
+// endpoint of the docker engine API. Each frame consists of an 8 byte header
+// holding the stream type and the big endian payload size followed by the
+// payload.
+func readDockerFrames(reader io.Reader, onFrame func(streamType byte, payload []byte)) error {
+	header := make([]byte, 8)
+	for {
+		if _, err := io.ReadFull(reader, header); err != nil {
+			return err // ### return, stream closed ###
+		}
+		payload := make([]byte, binary.BigEndian.Uint32(header[4:]))
+		if _, err := io.ReadFull(reader, payload); err != nil {
+			return err // ### return, stream closed ###
+		}
+		onFrame(header[0], payload)
+	}
+}
+
+// watch attaches to all running containers and follows container start
+// events until the consumer is stopped.
+func (cons *Docker) watch() {
+	defer cons.WorkerDone()
+
+	initial := true
+	for {
+		err := cons.watchEvents(initial)
+		if !cons.IsActive() {
+			return // ### return, stopped ###
+		}
+		if err != nil {
+			Log.Error.Print("Docker connection error: ", err)
+		}
+		initial = false
+		time.Sleep(cons.retryDelay)
+	}
+}
+
+func (cons *Docker) watchEvents(initial bool) error {
+	filters, _ := json.Marshal(map[string][]string{
+		"type":  {"container"},
+		"event": {"start"},
+	})
+
+	// Subscribe to events before listing containers so that no container
+	// start is missed.
+	events, err := cons.get("/events", url.Values{"filters": {string(filters)}})
+	if err != nil {
+		return err // ### return, request failed ###
+	}
+	defer cons.release(events)
+
+	containers := []struct {
+		ID string `json:"Id"`
+	}{}
+	if err := cons.getJSON("/containers/json", nil, &containers); err != nil {
+		return err // ### return, request failed ###
+	}
+	for _, container := range containers {
+		cons.attach(container.ID, cons.seekOldest || !initial)
+	}
+
+	decoder := json.NewDecoder(events)
+	for cons.IsActive() {
+		event := dockerEvent{}
+		if err := decoder.Decode(&event); err != nil {
+			return err // ### return, stream closed ###
+		}
+		if event.Status == "start" && event.ID != "" {
+			cons.attach(event.ID, true)
+		}
+	}
+	return nil
+}
+
+func (cons *Docker) close() {
+	cons.guard.Lock()
+	defer cons.guard.Unlock()
+	for body := range cons.bodies {
+		body.Close()
+	}
+}
+
+// Consume attaches to the docker engine API.
+func (cons *Docker) Consume(workers *sync.WaitGroup) {
+	cons.SetWorkerWaitGroup(workers)
+	cons.SetStopCallback(cons.close)
+
+	cons.AddWorker()
+	go shared.DontPanic(cons.watch)
+
+	cons.ControlLoop()
+}
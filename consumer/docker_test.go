@@ -0,0 +1,148 @@
+// Copyright 2015-2016 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumer
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/shared"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func writeDockerFrame(writer *bytes.Buffer, streamType byte, payload string) {
+	header := make([]byte, 8)
+	header[0] = streamType
+	binary.BigEndian.PutUint32(header[4:], uint32(len(payload)))
+	writer.Write(header)
+	writer.WriteString(payload)
+}
+
+func TestReadDockerFrames(t *testing.T) {
+	expect := shared.NewExpect(t)
+
+	stream := &bytes.Buffer{}
+	writeDockerFrame(stream, dockerStreamStdout, "out")
+	writeDockerFrame(stream, dockerStreamStderr, "err")
+	stream.Write([]byte{1, 0, 0})
+
+	frames := []string{}
+	err := readDockerFrames(stream, func(streamType byte, payload []byte) {
+		frames = append(frames, fmt.Sprintf("%d:%s", streamType, payload))
+	})
+	expect.NotNil(err)
+	expect.Equal([]string{"1:out", "2:err"}, frames)
+}
+
+func TestDockerContainers(t *testing.T) {
+	expect := shared.NewExpect(t)
+
+	stopEvents := make(chan bool)
+	defer close(stopEvents)
+	logQueries := make(chan string, 2)
+
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/events":
+			writer.WriteHeader(http.StatusOK)
+			writer.(http.Flusher).Flush()
+			fmt.Fprint(writer, `{"status":"start","id":"c2"}`)
+			writer.(http.Flusher).Flush()
+			select {
+			case <-stopEvents:
+			case <-req.Context().Done():
+			}
+
+		case "/containers/json":
+			fmt.Fprint(writer, `[{"Id":"c1"},{"Id":"c3"}]`)
+
+		case "/containers/c1/json":
+			fmt.Fprint(writer, `{"Id":"c1","Name":"/web-1","Config":{"Image":"nginx","Labels":{"logging":"on"}}}`)
+
+		case "/containers/c2/json":
+			fmt.Fprint(writer, `{"Id":"c2","Name":"/web-2","Config":{"Image":"app","Labels":{"logging":"on"},"Tty":true}}`)
+
+		case "/containers/c3/json":
+			fmt.Fprint(writer, `{"Id":"c3","Name":"/db","Config":{"Image":"postgres","Labels":{"logging":"on"}}}`)
+
+		case "/containers/c1/logs":
+			logQueries <- "c1:" + req.URL.Query().Get("tail")
+			frames := &bytes.Buffer{}
+			writeDockerFrame(frames, dockerStreamStdout, "hel")
+			writeDockerFrame(frames, dockerStreamStderr, "error\n")
+			writeDockerFrame(frames, dockerStreamStdout, "lo\n")
+			writer.Write(frames.Bytes())
+
+		case "/containers/c2/logs":
+			logQueries <- "c2:" + req.URL.Query().Get("tail")
+			fmt.Fprint(writer, "tty\n")
+
+		default:
+			http.NotFound(writer, req)
+		}
+	}))
+	defer server.Close()
+
+	stream := &mockHTTPStream{}
+	core.StreamRegistry.Register(stream, core.GetStreamID("dockerContainers"))
+	conf := core.NewPluginConfig("")
+	conf.Stream = []string{"dockerContainers"}
+	conf.Override("Endpoint", strings.Replace(server.URL, "http://", "tcp://", 1))
+	conf.Override("ContainerNames", []string{"^web-"})
+	conf.Override("ContainerLabels", map[string]string{"logging": ""})
+	conf.Override("RetryDelayMs", 10)
+	plugin, err := core.NewPluginWithType("consumer.Docker", conf)
+	expect.NoError(err)
+	cons := plugin.(*Docker)
+
+	workers := new(sync.WaitGroup)
+	go cons.Consume(workers)
+
+	expect.NonBlocking(2*time.Second, func() {
+		for stream.count() < 3 {
+			time.Sleep(10 * time.Millisecond)
+		}
+	})
+
+	queries := []string{<-logQueries, <-logQueries}
+	sort.Strings(queries)
+	expect.Equal([]string{"c1:0", "c2:"}, queries)
+
+	cons.Control() <- core.PluginControlStopConsumer
+	expect.NonBlocking(2*time.Second, workers.Wait)
+	expect.Equal(3, len(stream.messages))
+
+	messages := map[string]core.Message{}
+	for _, msg := range stream.messages {
+		messages[string(msg.Data)] = msg
+	}
+	expect.Equal(core.MessageMetadata{
+		"container_id":            "c1",
+		"container_name":          "web-1",
+		"container_image":         "nginx",
+		"container_stream":        "stdout",
+		"container_label.logging": "on",
+	}, messages["hello"].Metadata)
+	expect.Equal("stderr", messages["error"].Metadata["container_stream"])
+	expect.Equal("stdout", messages["tty"].Metadata["container_stream"])
+	expect.Equal("web-2", messages["tty"].Metadata["container_name"])
+}
@@ -0,0 +1,511 @@
+// Copyright 2015-2016 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumer
+
+import (
+	"fmt"
+	"github.com/Azure/go-amqp"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/core/log"
+	"github.com/trivago/gollum/shared"
+	"net"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	eventhubsMetadataPartition      = "eventhubs_partition"
+	eventhubsMetadataPartitionKey   = "eventhubs_partition_key"
+	eventhubsMetadataEnqueuedTime   = "eventhubs_enqueued_time"
+	eventhubsMetadataOffset         = "eventhubs_offset"
+	eventhubsMetadataSequenceNumber = "eventhubs_sequence_number"
+	eventhubsMetadataProperty       = "eventhubs_property."
+	eventhubsOffsetNewest           = "newest"
+	eventhubsOffsetOldest           = "oldest"
+	eventhubsStoreFile              = "file"
+	eventhubsStoreBlob              = "blob"
+	eventhubsPartitionRefresh       = 5 * time.Minute
+)
+
+// EventHubs consumer plugin
+// The EventHubs consumer reads events from all partitions of an Azure Event
+// Hub using AMQP 1.0. The offset of the last event read from each partition
+// is stored as checkpoint, so reading continues after that event when gollum
+// is restarted. Checkpoints can be stored in a file or in an Azure Blob
+// Storage container. When using blob storage, the partitions of an event hub
+// are distributed between all consumers sharing the same container and
+// consumer group, using the same ownership blobs as the Azure SDKs.
+// The partition id, offset and sequence number of an event are attached as
+// "eventhubs_partition", "eventhubs_offset" and "eventhubs_sequence_number"
+// metadata. The partition key and enqueue time are stored as
+// "eventhubs_partition_key" and "eventhubs_enqueued_time" (RFC 3339) if set.
+// Each application property is stored as "eventhubs_property.<name>".
+// When attached to a fuse, this consumer will stop processing events in case
+// that fuse is burned.
+// Configuration example
+//
+//  - "consumer.EventHubs":
+//    ConnectionString: ""
+//    Address: ""
+//    EventHub: "default"
+//    ConsumerGroup: "$Default"
+//    Partitions: []
+//    DefaultOffset: "newest"
+//    Prefetch: 300
+//    CheckpointStore: "file"
+//    OffsetFile: ""
+//    StorageConnectionString: ""
+//    StorageContainer: "gollum"
+//    WorkerID: ""
+//    LeaseTimeoutSec: 30
+//    CheckpointIntervalSec: 10
+//    RetryDelayMs: 3000
+//
+// ConnectionString defines the connection string of the Event Hubs
+// namespace or event hub as shown in the Azure portal, e.g.
+// "Endpoint=sb://<namespace>.servicebus.windows.net/;SharedAccessKeyName=<name>;SharedAccessKey=<key>".
+// The shared access key is used for SASL PLAIN authentication. If the
+// connection string contains an EntityPath it is used as EventHub.
+// By default this is set to "".
+//
+// Address defines the URI of the AMQP endpoint, e.g. "amqp://localhost:5672"
+// for a local emulator. The scheme "amqps" enables TLS. By default this is
+// set to "", which uses port 5671 of the Endpoint given by ConnectionString.
+//
+// EventHub defines the name of the event hub to read from.
+// By default this is set to "default".
+//
+// ConsumerGroup defines the consumer group used to read from the event hub.
+// By default this is set to "$Default".
+//
+// Partitions defines the ids of the partitions to read from. By default
+// this is set to an empty list, which reads all partitions of the event hub.
+// The list of partitions is refreshed every five minutes in that case.
+//
+// DefaultOffset defines where to start reading if no checkpoint has been
+// stored for a partition. Valid values are "newest" and "oldest".
+// By default this is set to "newest".
+//
+// Prefetch defines the number of events requested from each partition in
+// advance. Values are limited to 1 to 1000. By default this is set to 300.
+//
+// CheckpointStore defines where checkpoints are stored. Valid values are
+// "file" and "blob". By default this is set to "file".
+//
+// OffsetFile defines a file to store the current offset per partition if
+// CheckpointStore is set to "file". By default this is set to "", i.e. it is
+// disabled.
+//
+// StorageConnectionString defines the connection string of the Azure Storage
+// account if CheckpointStore is set to "blob", e.g.
+// "DefaultEndpointsProtocol=https;AccountName=<name>;AccountKey=<key>".
+// Requests are authorized with the AccountKey or the SharedAccessSignature
+// of the connection string. BlobEndpoint can be set to use e.g. a local
+// storage emulator. By default this is set to "".
+//
+// StorageContainer defines the blob container used to store checkpoints and
+// ownership. The container has to exist. By default this is set to "gollum".
+//
+// WorkerID defines the name this consumer uses to claim partitions if
+// CheckpointStore is set to "blob". Each consumer reading the same event hub
+// and consumer group needs a unique id. By default this is set to "", which
+// uses the hostname and the process id.
+//
+// LeaseTimeoutSec defines the number of seconds after which the ownership of
+// a partition expires if it is not renewed, e.g. because the consumer
+// holding it died. Ownership is renewed every third of this interval.
+// By default this is set to 30.
+//
+// CheckpointIntervalSec defines the number of seconds between storing the
+// offsets of all partitions. Offsets are always stored when reading a
+// partition stops. By default this is set to 10.
+//
+// RetryDelayMs defines the number of milliseconds to wait before
+// reconnecting to a partition after the connection has been lost.
+// By default this is set to 3000.
+type EventHubs struct {
+	core.ConsumerBase
+	address            string
+	hostname           string
+	keyName            string
+	key                string
+	connect            func() (eventHubsConnection, error)
+	eventHub           string
+	consumerGroup      string
+	defaultOffset      string
+	prefetch           uint32
+	store              checkpointStore
+	leaseInterval      time.Duration
+	checkpointInterval time.Duration
+	retryDelay         time.Duration
+	partitions         []string
+	fixedPartitions    bool
+	running            map[string]chan struct{}
+	partitionWorkers   *sync.WaitGroup
+	guard              *sync.Mutex
+	stop               chan struct{}
+	sequence           uint64
+}
+
+func init() {
+	shared.TypeRegistry.Register(EventHubs{})
+}
+
+// parseAzureConnectionString splits a connection string of the form
+// "key1=value1;key2=value2" into its values.
+func parseAzureConnectionString(connectionString string) map[string]string {
+	values := make(map[string]string)
+	for _, part := range strings.Split(connectionString, ";") {
+		if keyValue := strings.SplitN(part, "=", 2); len(keyValue) == 2 {
+			values[strings.TrimSpace(keyValue[0])] = strings.TrimSpace(keyValue[1])
+		}
+	}
+	return values
+}
+
+// Configure initializes this consumer with values from a plugin config.
+func (cons *EventHubs) Configure(conf core.PluginConfig) error {
+	err := cons.ConsumerBase.Configure(conf)
+	if err != nil {
+		return err
+	}
+
+	connection := parseAzureConnectionString(conf.GetString("ConnectionString", ""))
+	cons.keyName = connection["SharedAccessKeyName"]
+	cons.key = connection["SharedAccessKey"]
+
+	address := conf.GetString("Address", "")
+	if address == "" {
+		address = "amqp://localhost:5672"
+		if endpoint, err := url.Parse(connection["Endpoint"]); err == nil && endpoint.Host != "" {
+			address = "amqps://" + endpoint.Host
+		}
+	}
+	endpoint, err := url.Parse(address)
+	if err != nil {
+		return fmt.Errorf("Invalid Address: %s", err)
+	}
+	cons.hostname = endpoint.Hostname()
+	port := endpoint.Port()
+	switch endpoint.Scheme {
+	case "amqp":
+		if port == "" {
+			port = "5672"
+		}
+	case "amqps":
+		if port == "" {
+			port = "5671"
+		}
+	default:
+		return fmt.Errorf("Address must use the amqp or amqps scheme")
+	}
+	cons.address = endpoint.Scheme + "://" + net.JoinHostPort(cons.hostname, port)
+	cons.connect = func() (eventHubsConnection, error) {
+		return dialEventHubs(cons.address, cons.keyName, cons.key)
+	}
+
+	entityPath := connection["EntityPath"]
+	if entityPath == "" {
+		entityPath = "default"
+	}
+	cons.eventHub = conf.GetString("EventHub", entityPath)
+	cons.consumerGroup = conf.GetString("ConsumerGroup", "$Default")
+	cons.partitions = conf.GetStringArray("Partitions", []string{})
+	cons.fixedPartitions = len(cons.partitions) > 0
+	cons.prefetch = uint32(shared.MinI(shared.MaxI(conf.GetInt("Prefetch", 300), 1), 1000))
+	cons.checkpointInterval = time.Duration(shared.MaxI(conf.GetInt("CheckpointIntervalSec", 10), 1)) * time.Second
+	cons.retryDelay = time.Duration(conf.GetInt("RetryDelayMs", 3000)) * time.Millisecond
+	leaseTimeout := time.Duration(shared.MaxI(conf.GetInt("LeaseTimeoutSec", 30), 3)) * time.Second
+	cons.leaseInterval = leaseTimeout / 3
+
+	cons.defaultOffset = strings.ToLower(conf.GetString("DefaultOffset", eventhubsOffsetNewest))
+	if cons.defaultOffset != eventhubsOffsetNewest && cons.defaultOffset != eventhubsOffsetOldest {
+		return fmt.Errorf("DefaultOffset must be \"%s\" or \"%s\"", eventhubsOffsetNewest, eventhubsOffsetOldest)
+	}
+
+	cons.running = make(map[string]chan struct{})
+	cons.partitionWorkers = new(sync.WaitGroup)
+	cons.guard = new(sync.Mutex)
+	cons.stop = make(chan struct{})
+
+	// Checkpoints
+	storeType := strings.ToLower(conf.GetString("CheckpointStore", eventhubsStoreFile))
+	switch storeType {
+	case eventhubsStoreFile:
+		if cons.store, err = newFileCheckpointStore(conf.GetString("OffsetFile", "")); err != nil {
+			return err
+		}
+
+	case eventhubsStoreBlob:
+		workerID := conf.GetString("WorkerID", "")
+		if workerID == "" {
+			hostname, _ := os.Hostname()
+			workerID = fmt.Sprintf("%s-%d", hostname, os.Getpid())
+		}
+		storage := parseAzureConnectionString(conf.GetString("StorageConnectionString", ""))
+		prefix := fmt.Sprintf("%s/%s/%s", cons.hostname, cons.eventHub, cons.consumerGroup)
+		if cons.store, err = newEventHubsBlobStore(storage, conf.GetString("StorageContainer", "gollum"), prefix, workerID, leaseTimeout); err != nil {
+			return err
+		}
+
+	default:
+		return fmt.Errorf("Unknown CheckpointStore: %s", storeType)
+	}
+
+	return nil
+}
+
+// sleep waits for the given duration. False is returned if the consumer or
+// the given partition worker has been stopped in the meantime.
+func (cons *EventHubs) sleep(duration time.Duration, stop chan struct{}) bool {
+	select {
+	case <-cons.stop:
+		return false
+	case <-stop:
+		return false
+	case <-time.After(duration):
+		return true
+	}
+}
+
+// updatePartitions requests the partition ids of the event hub from the
+// management node.
+func (cons *EventHubs) updatePartitions() error {
+	conn, err := cons.connect()
+	if err != nil {
+		return err
+	}
+	defer conn.close()
+
+	partitionIDs, err := conn.partitionIDs(cons.eventHub)
+	if err != nil {
+		return err
+	}
+	if len(partitionIDs) == 0 {
+		return fmt.Errorf("No partitions returned for event hub %s", cons.eventHub)
+	}
+
+	cons.partitions = append([]string{}, partitionIDs...)
+	sort.Strings(cons.partitions)
+	return nil
+}
+
+// filter returns the selector filter to start reading after the given
+// offset.
+func (cons *EventHubs) filter(offset string) string {
+	switch {
+	case offset != "":
+	case cons.defaultOffset == eventhubsOffsetOldest:
+		offset = "-1"
+	default:
+		offset = "@latest"
+	}
+	return fmt.Sprintf("amqp.annotation.x-opt-offset > '%s'", offset)
+}
+
+func (cons *EventHubs) newMessage(partitionID string, event *amqp.Message) (core.Message, string) {
+	annotations := event.Annotations
+	offset := eventHubsString(annotations["x-opt-offset"])
+	sequence := eventHubsString(annotations["x-opt-sequence-number"])
+
+	msg := core.NewMessage(cons, eventHubsBody(event), atomic.AddUint64(&cons.sequence, 1))
+	msg.SetMetadata(eventhubsMetadataPartition, partitionID)
+	msg.SetMetadata(eventhubsMetadataOffset, offset)
+	msg.SetMetadata(eventhubsMetadataSequenceNumber, sequence)
+
+	if partitionKey := eventHubsString(annotations["x-opt-partition-key"]); partitionKey != "" {
+		msg.SetMetadata(eventhubsMetadataPartitionKey, partitionKey)
+	}
+	if enqueued, isTime := annotations["x-opt-enqueued-time"].(time.Time); isTime {
+		msg.SetMetadata(eventhubsMetadataEnqueuedTime, enqueued.Format(time.RFC3339Nano))
+	}
+	for name, value := range event.ApplicationProperties {
+		msg.SetMetadata(eventhubsMetadataProperty+name, eventHubsString(value))
+	}
+	return msg, offset
+}
+
+// readPartition reads events from a partition until the connection is lost
+// or closed. The offset of the last event read is returned.
+func (cons *EventHubs) readPartition(conn eventHubsConnection, partitionID, offset string) (string, error) {
+	address := fmt.Sprintf("%s/ConsumerGroups/%s/Partitions/%s", cons.eventHub, cons.consumerGroup, partitionID)
+	name := fmt.Sprintf("gollum-%s-%s", cons.consumerGroup, partitionID)
+	receiver, err := conn.newReceiver(name, address, cons.filter(offset), cons.prefetch)
+	if err != nil {
+		return offset, err
+	}
+
+	lastCheckpoint := time.Now()
+	for cons.IsActive() {
+		event, err := receiver.next()
+		if err != nil {
+			return offset, err
+		}
+
+		cons.WaitOnFuse()
+		msg, eventOffset := cons.newMessage(partitionID, event)
+		cons.EnqueueMessage(msg)
+		offset = eventOffset
+
+		if time.Since(lastCheckpoint) >= cons.checkpointInterval {
+			if err := cons.store.store(partitionID, offset); err != nil {
+				return offset, err
+			}
+			lastCheckpoint = time.Now()
+		}
+	}
+	return offset, nil
+}
+
+func (cons *EventHubs) processPartition(partitionID, offset string, stop chan struct{}) {
+	defer cons.partitionDone(partitionID, stop)
+
+	for cons.IsActive() {
+		conn, err := cons.connect()
+		if err == nil {
+			// Closing the connection interrupts reading
+			closed := make(chan struct{})
+			go func() {
+				select {
+				case <-cons.stop:
+				case <-stop:
+				case <-closed:
+				}
+				conn.close()
+			}()
+
+			var lastOffset string
+			lastOffset, err = cons.readPartition(conn, partitionID, offset)
+			close(closed)
+
+			if lastOffset != offset {
+				offset = lastOffset
+				if err := cons.store.store(partitionID, offset); err != nil {
+					Log.Warning.Printf("EventHubs stopped reading partition %s/%s - %s", cons.eventHub, partitionID, err.Error())
+					return // ### return, ownership lost ###
+				}
+			}
+		}
+
+		select {
+		case <-stop:
+			return // ### return, stopped ###
+		default:
+		}
+		if !cons.IsActive() {
+			return // ### return, stopped ###
+		}
+
+		Log.Error.Printf("EventHubs failed to read partition %s/%s - %s", cons.eventHub, partitionID, err.Error())
+		if !cons.sleep(cons.retryDelay, stop) {
+			return // ### return, stopped ###
+		}
+	}
+}
+
+func (cons *EventHubs) partitionDone(partitionID string, stop chan struct{}) {
+	cons.guard.Lock()
+	if cons.running[partitionID] == stop {
+		delete(cons.running, partitionID)
+	}
+	cons.guard.Unlock()
+	cons.partitionWorkers.Done()
+}
+
+// balance starts workers for all partitions owned by this consumer and stops
+// workers for partitions that are not owned anymore.
+func (cons *EventHubs) balance() {
+	checkpoints, err := cons.store.checkpoints()
+	if err != nil {
+		Log.Error.Print("EventHubs failed to read checkpoints: ", err)
+		return // ### return, retry later ###
+	}
+
+	owned, err := cons.store.lease(cons.partitions)
+	if err != nil {
+		Log.Error.Print("EventHubs failed to claim partitions: ", err)
+		return // ### return, retry later ###
+	}
+
+	cons.guard.Lock()
+	defer cons.guard.Unlock()
+
+	for partitionID, stop := range cons.running {
+		if !owned[partitionID] {
+			Log.Debug.Printf("Stopping EventHubs consumer for %s/%s", cons.eventHub, partitionID)
+			close(stop)
+			delete(cons.running, partitionID)
+		}
+	}
+
+	for partitionID := range owned {
+		if _, isRunning := cons.running[partitionID]; isRunning || !cons.IsActive() {
+			continue // ### continue, nothing to do ###
+		}
+		Log.Debug.Printf("Starting EventHubs consumer for %s/%s", cons.eventHub, partitionID)
+		stop := make(chan struct{})
+		cons.running[partitionID] = stop
+		cons.partitionWorkers.Add(1)
+		go shared.DontPanic(func(partitionID string) func() {
+			return func() { cons.processPartition(partitionID, checkpoints[partitionID], stop) }
+		}(partitionID))
+	}
+}
+
+func (cons *EventHubs) coordinate() {
+	defer cons.WorkerDone()
+	defer cons.store.release()
+	defer cons.partitionWorkers.Wait()
+
+	lastUpdate := time.Time{}
+	for cons.IsActive() {
+		if !cons.fixedPartitions && time.Since(lastUpdate) >= eventhubsPartitionRefresh {
+			if err := cons.updatePartitions(); err != nil {
+				Log.Error.Print("EventHubs failed to list partitions: ", err)
+			} else {
+				lastUpdate = time.Now()
+			}
+		}
+
+		if len(cons.partitions) > 0 {
+			cons.balance()
+		}
+
+		select {
+		case <-cons.stop:
+		case <-time.After(cons.leaseInterval):
+		}
+	}
+}
+
+func (cons *EventHubs) close() {
+	close(cons.stop)
+}
+
+// Consume starts reading from all partitions owned by this consumer.
+func (cons *EventHubs) Consume(workers *sync.WaitGroup) {
+	cons.SetWorkerWaitGroup(workers)
+	cons.SetStopCallback(cons.close)
+
+	cons.AddWorker()
+	go shared.DontPanic(cons.coordinate)
+
+	cons.ControlLoop()
+}
@@ -0,0 +1,307 @@
+// Copyright 2015-2016 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumer
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"github.com/Azure/go-amqp"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/shared"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeEventHubs serves the given events per partition and records the
+// selector filters used by receivers.
+type fakeEventHubs struct {
+	events  map[string][]*amqp.Message
+	filters map[string]string
+	guard   sync.Mutex
+}
+
+type fakeEventHubsConnection struct {
+	hub       *fakeEventHubs
+	closed    chan struct{}
+	closeOnce *sync.Once
+}
+
+type fakeEventHubsReceiver struct {
+	conn   *fakeEventHubsConnection
+	events []*amqp.Message
+}
+
+func fakeEventHubsEvent(partitionID string, index int) *amqp.Message {
+	return &amqp.Message{
+		Annotations: amqp.Annotations{
+			"x-opt-offset":          fmt.Sprintf("%s%d", partitionID, 100+index),
+			"x-opt-sequence-number": int64(index),
+			"x-opt-enqueued-time":   time.Unix(1451606400, 0).UTC(),
+			"x-opt-partition-key":   "key",
+		},
+		ApplicationProperties: map[string]interface{}{"source": "test"},
+	}
+}
+
+func (fake *fakeEventHubs) filter(address string) string {
+	fake.guard.Lock()
+	defer fake.guard.Unlock()
+	return fake.filters[address]
+}
+
+func (fake *fakeEventHubs) connect() (eventHubsConnection, error) {
+	return &fakeEventHubsConnection{
+		hub:       fake,
+		closed:    make(chan struct{}),
+		closeOnce: new(sync.Once),
+	}, nil
+}
+
+func (conn *fakeEventHubsConnection) partitionIDs(eventHub string) ([]string, error) {
+	if eventHub != "hub" {
+		return nil, fmt.Errorf("Unknown event hub %s", eventHub)
+	}
+	return []string{"1", "0"}, nil
+}
+
+func (conn *fakeEventHubsConnection) newReceiver(name, address, filter string, prefetch uint32) (eventHubsReceiver, error) {
+	conn.hub.guard.Lock()
+	defer conn.hub.guard.Unlock()
+	conn.hub.filters[address] = filter
+	partitionID := address[strings.LastIndex(address, "/")+1:]
+	return &fakeEventHubsReceiver{conn: conn, events: conn.hub.events[partitionID]}, nil
+}
+
+func (conn *fakeEventHubsConnection) close() {
+	conn.closeOnce.Do(func() {
+		close(conn.closed)
+	})
+}
+
+func (recv *fakeEventHubsReceiver) next() (*amqp.Message, error) {
+	if len(recv.events) > 0 {
+		event := recv.events[0]
+		recv.events = recv.events[1:]
+		return event, nil
+	}
+	<-recv.conn.closed
+	return nil, fmt.Errorf("Connection closed")
+}
+
+func TestEventHubs(t *testing.T) {
+	expect := shared.NewExpect(t)
+
+	dir, err := ioutil.TempDir("", "gollum_eventhubs")
+	expect.NoError(err)
+	defer os.RemoveAll(dir)
+	offsetFile := filepath.Join(dir, "offsets.json")
+	expect.NoError(ioutil.WriteFile(offsetFile, []byte(`{"1":"42"}`), 0644))
+
+	first, second, third := fakeEventHubsEvent("0", 0), fakeEventHubsEvent("0", 1), fakeEventHubsEvent("1", 0)
+	first.Data = [][]byte{[]byte("first")}
+	second.Data = [][]byte{[]byte("sec"), []byte("ond")}
+	third.Value = "third"
+	fake := &fakeEventHubs{
+		events:  map[string][]*amqp.Message{"0": {first, second}, "1": {third}},
+		filters: make(map[string]string),
+	}
+
+	stream := &mockHTTPStream{}
+	core.StreamRegistry.Register(stream, core.GetStreamID("eventhubs"))
+
+	conf := core.NewPluginConfig("")
+	conf.Stream = []string{"eventhubs"}
+	conf.Override("ConnectionString", "Endpoint=sb://test.servicebus.windows.net/;SharedAccessKeyName=gollum;SharedAccessKey=secret;EntityPath=hub")
+	conf.Override("Address", "amqp://localhost")
+	conf.Override("OffsetFile", offsetFile)
+
+	plugin, err := core.NewPluginWithType("consumer.EventHubs", conf)
+	expect.NoError(err)
+	cons, casted := plugin.(*EventHubs)
+	expect.True(casted)
+	expect.Equal("hub", cons.eventHub)
+	expect.Equal("amqp://localhost:5672", cons.address)
+	expect.Equal("gollum", cons.keyName)
+	cons.connect = fake.connect
+
+	workers := new(sync.WaitGroup)
+	go cons.Consume(workers)
+
+	expect.NonBlocking(2*time.Second, func() {
+		for stream.count() < 3 {
+			time.Sleep(10 * time.Millisecond)
+		}
+	})
+	cons.Control() <- core.PluginControlStopConsumer
+	expect.NonBlocking(2*time.Second, workers.Wait)
+
+	expect.Equal("amqp.annotation.x-opt-offset > '@latest'", fake.filter("hub/ConsumerGroups/$Default/Partitions/0"))
+	expect.Equal("amqp.annotation.x-opt-offset > '42'", fake.filter("hub/ConsumerGroups/$Default/Partitions/1"))
+
+	stream.guard.Lock()
+	defer stream.guard.Unlock()
+	messages := map[string]core.Message{}
+	for _, msg := range stream.messages {
+		messages[string(msg.Data)] = msg
+	}
+	expect.Equal(3, len(messages))
+
+	msg := messages["second"]
+	expect.Equal("0", msg.Metadata[eventhubsMetadataPartition])
+	expect.Equal("0101", msg.Metadata[eventhubsMetadataOffset])
+	expect.Equal("1", msg.Metadata[eventhubsMetadataSequenceNumber])
+	expect.Equal("key", msg.Metadata[eventhubsMetadataPartitionKey])
+	expect.Equal("2016-01-01T00:00:00Z", msg.Metadata[eventhubsMetadataEnqueuedTime])
+	expect.Equal("test", msg.Metadata[eventhubsMetadataProperty+"source"])
+	expect.Equal("1", messages["third"].Metadata[eventhubsMetadataPartition])
+
+	offsets := map[string]string{}
+	fileContents, err := ioutil.ReadFile(offsetFile)
+	expect.NoError(err)
+	expect.NoError(json.Unmarshal(fileContents, &offsets))
+	expect.Equal(map[string]string{"0": "0101", "1": "1100"}, offsets)
+}
+
+// fakeBlobContainer implements listing and conditional uploads of empty
+// blobs with metadata.
+type fakeBlobContainer struct {
+	blobs map[string]*fakeBlob
+	etag  int
+	now   time.Time
+	guard sync.Mutex
+}
+
+type fakeBlob struct {
+	etag     string
+	modified time.Time
+	metadata map[string]string
+}
+
+func (fake *fakeBlobContainer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	fake.guard.Lock()
+	defer fake.guard.Unlock()
+
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "SharedKey account:") || r.Header.Get("x-ms-version") == "" {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	name := strings.TrimPrefix(r.URL.Path, "/container/")
+	switch {
+	case r.Method == "GET" && r.URL.Query().Get("comp") == "list":
+		prefix := r.URL.Query().Get("prefix")
+		result := bytes.NewBufferString("<EnumerationResults><Blobs>")
+		for blobName, blob := range fake.blobs {
+			if !strings.HasPrefix(blobName, prefix) {
+				continue
+			}
+			fmt.Fprintf(result, "<Blob><Name>%s</Name><Properties><Last-Modified>%s</Last-Modified><Etag>%s</Etag></Properties><Metadata>",
+				blobName, blob.modified.Format(http.TimeFormat), blob.etag)
+			for key, value := range blob.metadata {
+				fmt.Fprintf(result, "<%s>", key)
+				xml.EscapeText(result, []byte(value))
+				fmt.Fprintf(result, "</%s>", key)
+			}
+			result.WriteString("</Metadata></Blob>")
+		}
+		result.WriteString("</Blobs><NextMarker /></EnumerationResults>")
+		w.Write(result.Bytes())
+
+	case r.Method == "PUT":
+		blob, exists := fake.blobs[name]
+		if match := r.Header.Get("If-Match"); match != "" && (!exists || blob.etag != match) ||
+			r.Header.Get("If-None-Match") == "*" && exists {
+			w.WriteHeader(http.StatusPreconditionFailed)
+			return
+		}
+
+		fake.etag++
+		blob = &fakeBlob{etag: fmt.Sprintf("\"%d\"", fake.etag), modified: fake.now, metadata: map[string]string{}}
+		for key := range r.Header {
+			if strings.HasPrefix(strings.ToLower(key), "x-ms-meta-") {
+				blob.metadata[strings.ToLower(key[len("x-ms-meta-"):])] = r.Header.Get(key)
+			}
+		}
+		fake.blobs[name] = blob
+		w.Header().Set("ETag", blob.etag)
+		w.WriteHeader(http.StatusCreated)
+
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func TestEventHubsBlobOwnership(t *testing.T) {
+	expect := shared.NewExpect(t)
+
+	now := time.Unix(1451606400, 0)
+	fake := &fakeBlobContainer{blobs: map[string]*fakeBlob{}, now: now}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	storage := parseAzureConnectionString("BlobEndpoint=" + server.URL + ";AccountName=account;AccountKey=c2VjcmV0")
+	newStore := func(ownerID string) *eventhubsBlobStore {
+		store, err := newEventHubsBlobStore(storage, "container", "ns/Hub/$Default", ownerID, 30*time.Second)
+		expect.NoError(err)
+		store.now = func() time.Time { return now }
+		return store
+	}
+	first, second := newStore("first"), newStore("second")
+	partitions := []string{"0", "1", "2", "3"}
+
+	owned, err := first.lease(partitions)
+	expect.NoError(err)
+	expect.Equal(4, len(owned))
+	expect.NoError(first.store("0", "100"))
+	expect.NotNil(second.store("0", "200"))
+
+	// The second consumer steals one partition per round until balanced
+	owned, err = second.lease(partitions)
+	expect.NoError(err)
+	expect.Equal(1, len(owned))
+	owned, err = second.lease(partitions)
+	expect.NoError(err)
+	expect.Equal(2, len(owned))
+	owned, err = first.lease(partitions)
+	expect.NoError(err)
+	expect.Equal(2, len(owned))
+
+	checkpoints, err := second.checkpoints()
+	expect.NoError(err)
+	expect.Equal(map[string]string{"0": "100"}, checkpoints)
+	expect.Equal("second", fake.blobs["ns/hub/$default/ownership/0"].metadata["ownerid"])
+	expect.Equal("first", fake.blobs["ns/hub/$default/ownership/3"].metadata["ownerid"])
+
+	// Partitions of consumers that stopped renewing are taken over
+	now = now.Add(time.Minute)
+	fake.now = now
+	owned, err = second.lease(partitions)
+	expect.NoError(err)
+	expect.Equal(4, len(owned))
+
+	second.release()
+	owned, err = first.lease(partitions)
+	expect.NoError(err)
+	expect.Equal(4, len(owned))
+}
@@ -0,0 +1,393 @@
+// Copyright 2015-2016 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumer
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"github.com/trivago/gollum/core/log"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	eventhubsBlobVersion = "2019-12-12"
+	eventhubsOwnership   = "ownership"
+	eventhubsCheckpoint  = "checkpoint"
+)
+
+// eventhubsBlobStore stores checkpoints and partition ownership in an Azure
+// Blob Storage container, using the same layout as the Azure SDKs. The
+// ownership blob "<namespace>/<event hub>/<consumer group>/ownership/<id>"
+// stores the owner of a partition as "ownerid" metadata, the checkpoint blob
+// ".../checkpoint/<id>" stores the offset as "offset" metadata. Ownership
+// expires if it has not been renewed within the lease timeout. Concurrent
+// claims are resolved by conditional requests using the ETag of the
+// ownership blob. Partitions are balanced so that each consumer owns at most
+// ceil(partitions / consumers) partitions.
+type eventhubsBlobStore struct {
+	client       *http.Client
+	container    string
+	account      string
+	key          []byte
+	sasToken     string
+	prefix       string
+	ownerID      string
+	leaseTimeout time.Duration
+	owned        map[string]string
+	guard        *sync.Mutex
+	now          func() time.Time
+}
+
+// eventhubsBlob holds the properties of a listed blob.
+type eventhubsBlob struct {
+	Name       string `xml:"Name"`
+	Properties struct {
+		LastModified string `xml:"Last-Modified"`
+		ETag         string `xml:"Etag"`
+	} `xml:"Properties"`
+	Metadata struct {
+		Entries []struct {
+			XMLName xml.Name
+			Value   string `xml:",chardata"`
+		} `xml:",any"`
+	} `xml:"Metadata"`
+}
+
+func (blob eventhubsBlob) metadata(name string) string {
+	for _, entry := range blob.Metadata.Entries {
+		if strings.EqualFold(entry.XMLName.Local, name) {
+			return entry.Value
+		}
+	}
+	return ""
+}
+
+func newEventHubsBlobStore(storage map[string]string, container, prefix, ownerID string, leaseTimeout time.Duration) (*eventhubsBlobStore, error) {
+	store := &eventhubsBlobStore{
+		client:       &http.Client{Timeout: 30 * time.Second},
+		account:      storage["AccountName"],
+		sasToken:     strings.TrimPrefix(storage["SharedAccessSignature"], "?"),
+		prefix:       strings.ToLower(prefix) + "/",
+		ownerID:      ownerID,
+		leaseTimeout: leaseTimeout,
+		owned:        make(map[string]string),
+		guard:        new(sync.Mutex),
+		now:          time.Now,
+	}
+
+	endpoint := storage["BlobEndpoint"]
+	if endpoint == "" {
+		if store.account == "" {
+			return nil, fmt.Errorf("StorageConnectionString requires AccountName or BlobEndpoint")
+		}
+		protocol, suffix := storage["DefaultEndpointsProtocol"], storage["EndpointSuffix"]
+		if protocol == "" {
+			protocol = "https"
+		}
+		if suffix == "" {
+			suffix = "core.windows.net"
+		}
+		endpoint = fmt.Sprintf("%s://%s.blob.%s", protocol, store.account, suffix)
+	}
+	store.container = strings.TrimSuffix(endpoint, "/") + "/" + container
+
+	if accountKey := storage["AccountKey"]; accountKey != "" {
+		key, err := base64.StdEncoding.DecodeString(accountKey)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid AccountKey: %s", err)
+		}
+		store.key = key
+	} else if store.sasToken == "" {
+		return nil, fmt.Errorf("StorageConnectionString requires AccountKey or SharedAccessSignature")
+	}
+	return store, nil
+}
+
+// sign adds a SharedKey authorization header to the request.
+// See https://docs.microsoft.com/rest/api/storageservices/authorize-with-shared-key
+func (store *eventhubsBlobStore) sign(req *http.Request) {
+	headers := []string{}
+	for name := range req.Header {
+		if lowerName := strings.ToLower(name); strings.HasPrefix(lowerName, "x-ms-") {
+			headers = append(headers, lowerName+":"+strings.TrimSpace(req.Header.Get(name))+"\n")
+		}
+	}
+	sort.Strings(headers)
+
+	resource := "/" + store.account + req.URL.EscapedPath()
+	query := req.URL.Query()
+	params := make([]string, 0, len(query))
+	for name, values := range query {
+		sort.Strings(values)
+		params = append(params, "\n"+strings.ToLower(name)+":"+strings.Join(values, ","))
+	}
+	sort.Strings(params)
+
+	contentLength := ""
+	if req.ContentLength > 0 {
+		contentLength = fmt.Sprint(req.ContentLength)
+	}
+
+	stringToSign := strings.Join([]string{
+		req.Method,
+		req.Header.Get("Content-Encoding"),
+		req.Header.Get("Content-Language"),
+		contentLength,
+		req.Header.Get("Content-MD5"),
+		req.Header.Get("Content-Type"),
+		"", // Date, x-ms-date is used instead
+		req.Header.Get("If-Modified-Since"),
+		req.Header.Get("If-Match"),
+		req.Header.Get("If-None-Match"),
+		req.Header.Get("If-Unmodified-Since"),
+		req.Header.Get("Range"),
+		strings.Join(headers, "") + resource + strings.Join(params, ""),
+	}, "\n")
+
+	mac := hmac.New(sha256.New, store.key)
+	mac.Write([]byte(stringToSign))
+	req.Header.Set("Authorization", "SharedKey "+store.account+":"+base64.StdEncoding.EncodeToString(mac.Sum(nil)))
+}
+
+// do sends a request for the given blob (or the container if name is
+// empty). An error is returned for all status codes but 2xx and the ones
+// given as accepted.
+func (store *eventhubsBlobStore) do(method, name string, query url.Values, headers map[string]string, accepted ...int) (*http.Response, error) {
+	location := store.container
+	if name != "" {
+		location += "/" + (&url.URL{Path: name}).EscapedPath()
+	}
+	if encoded := query.Encode(); encoded != "" || store.sasToken != "" {
+		location += "?" + strings.Trim(encoded+"&"+store.sasToken, "&")
+	}
+
+	req, err := http.NewRequest(method, location, nil)
+	if err != nil {
+		return nil, err
+	}
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+	req.Header.Set("x-ms-date", store.now().UTC().Format(http.TimeFormat))
+	req.Header.Set("x-ms-version", eventhubsBlobVersion)
+	if store.key != nil {
+		store.sign(req)
+	}
+
+	response, err := store.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode/100 == 2 {
+		return response, nil
+	}
+	for _, status := range accepted {
+		if response.StatusCode == status {
+			return response, nil
+		}
+	}
+
+	defer response.Body.Close()
+	message, _ := ioutil.ReadAll(io.LimitReader(response.Body, 1024))
+	return nil, fmt.Errorf("%s %s returned %s: %s", method, name, response.Status, strings.TrimSpace(string(message)))
+}
+
+// list returns all blobs of the given kind (ownership or checkpoint) by
+// partition id.
+func (store *eventhubsBlobStore) list(kind string) (map[string]eventhubsBlob, error) {
+	blobs := make(map[string]eventhubsBlob)
+	prefix := store.prefix + kind + "/"
+	query := url.Values{
+		"restype": {"container"},
+		"comp":    {"list"},
+		"prefix":  {prefix},
+		"include": {"metadata"},
+	}
+
+	for {
+		response, err := store.do("GET", "", query, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		result := struct {
+			Blobs      []eventhubsBlob `xml:"Blobs>Blob"`
+			NextMarker string          `xml:"NextMarker"`
+		}{}
+		err = xml.NewDecoder(response.Body).Decode(&result)
+		response.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, blob := range result.Blobs {
+			blobs[strings.TrimPrefix(blob.Name, prefix)] = blob
+		}
+		if result.NextMarker == "" {
+			return blobs, nil // ### return, all blobs listed ###
+		}
+		query.Set("marker", result.NextMarker)
+	}
+}
+
+// put writes an empty blob with the given metadata. The ETag of the new blob
+// is returned or an empty string if a condition given by headers failed.
+func (store *eventhubsBlobStore) put(name string, metadata map[string]string, headers map[string]string) (string, error) {
+	if headers == nil {
+		headers = make(map[string]string)
+	}
+	headers["x-ms-blob-type"] = "BlockBlob"
+	for key, value := range metadata {
+		headers["x-ms-meta-"+key] = value
+	}
+
+	response, err := store.do("PUT", name, nil, headers, http.StatusPreconditionFailed, http.StatusConflict)
+	if err != nil {
+		return "", err
+	}
+	response.Body.Close()
+	if response.StatusCode/100 != 2 {
+		return "", nil // ### return, claimed by another consumer ###
+	}
+	return response.Header.Get("ETag"), nil
+}
+
+func (store *eventhubsBlobStore) checkpoints() (map[string]string, error) {
+	blobs, err := store.list(eventhubsCheckpoint)
+	if err != nil {
+		return nil, err
+	}
+	offsets := make(map[string]string, len(blobs))
+	for partitionID, blob := range blobs {
+		if offset := blob.metadata("offset"); offset != "" {
+			offsets[partitionID] = offset
+		}
+	}
+	return offsets, nil
+}
+
+func (store *eventhubsBlobStore) store(partitionID, offset string) error {
+	store.guard.Lock()
+	_, isOwned := store.owned[partitionID]
+	store.guard.Unlock()
+	if !isOwned {
+		return fmt.Errorf("Partition %s is not owned by %s anymore", partitionID, store.ownerID)
+	}
+
+	_, err := store.put(store.prefix+eventhubsCheckpoint+"/"+partitionID, map[string]string{"offset": offset}, nil)
+	return err
+}
+
+// claim writes the ownership blob if its ETag matches. An empty ETag
+// requires the blob to not exist yet.
+func (store *eventhubsBlobStore) claim(partitionID, etag string) (string, error) {
+	condition := map[string]string{"If-Match": etag}
+	if etag == "" {
+		condition = map[string]string{"If-None-Match": "*"}
+	}
+	return store.put(store.prefix+eventhubsOwnership+"/"+partitionID, map[string]string{"ownerid": store.ownerID}, condition)
+}
+
+func (store *eventhubsBlobStore) lease(partitionIDs []string) (map[string]bool, error) {
+	ownerships, err := store.list(eventhubsOwnership)
+	if err != nil {
+		return nil, err
+	}
+
+	// Owners of unexpired ownerships are considered alive
+	now := store.now()
+	owners := map[string][]string{store.ownerID: nil}
+	free := []string{}
+	for _, partitionID := range partitionIDs {
+		blob, exists := ownerships[partitionID]
+		modified, _ := time.Parse(http.TimeFormat, blob.Properties.LastModified)
+		owner := blob.metadata("ownerid")
+		if !exists || owner == "" || (owner != store.ownerID && now.Sub(modified) > store.leaseTimeout) {
+			free = append(free, partitionID)
+			continue // ### continue, partition is free ###
+		}
+		owners[owner] = append(owners[owner], partitionID)
+	}
+	target := int(math.Ceil(float64(len(partitionIDs)) / float64(len(owners))))
+
+	store.guard.Lock()
+	defer store.guard.Unlock()
+	owned := make(map[string]string)
+
+	tryClaim := func(partitionID string) {
+		etag, err := store.claim(partitionID, ownerships[partitionID].Properties.ETag)
+		switch {
+		case err != nil:
+			Log.Warning.Printf("EventHubs failed to claim partition %s: %s", partitionID, err)
+		case etag != "":
+			owned[partitionID] = etag
+		}
+	}
+
+	// Renew own partitions, free partitions are claimed until the target is
+	// reached. Afterwards one partition is stolen from the busiest consumer.
+	for _, partitionID := range owners[store.ownerID] {
+		tryClaim(partitionID)
+	}
+	for _, partitionID := range free {
+		if len(owned) >= target {
+			break // ### break, enough partitions ###
+		}
+		tryClaim(partitionID)
+	}
+
+	if len(owned) < target {
+		busiest := ""
+		for owner, partitions := range owners {
+			if owner != store.ownerID && len(partitions) > target && (busiest == "" || len(partitions) > len(owners[busiest])) {
+				busiest = owner
+			}
+		}
+		if busiest != "" {
+			tryClaim(owners[busiest][0])
+		}
+	}
+
+	store.owned = owned
+	result := make(map[string]bool, len(owned))
+	for partitionID := range owned {
+		result[partitionID] = true
+	}
+	return result, nil
+}
+
+func (store *eventhubsBlobStore) release() {
+	store.guard.Lock()
+	defer store.guard.Unlock()
+
+	for partitionID, etag := range store.owned {
+		name := store.prefix + eventhubsOwnership + "/" + partitionID
+		if _, err := store.put(name, map[string]string{"ownerid": ""}, map[string]string{"If-Match": etag}); err != nil {
+			Log.Warning.Printf("EventHubs failed to release partition %s: %s", partitionID, err)
+		}
+	}
+	store.owned = make(map[string]string)
+}
@@ -0,0 +1,180 @@
+// Copyright 2015-2016 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumer
+
+import (
+	"context"
+	"fmt"
+	"github.com/Azure/go-amqp"
+	"time"
+)
+
+const (
+	eventhubsTimeout = 30 * time.Second
+	eventhubsReplyTo = "gollum-management-reply"
+)
+
+// eventHubsConnection is an AMQP connection to an Event Hubs namespace.
+// Closing the connection interrupts all pending calls.
+type eventHubsConnection interface {
+	partitionIDs(eventHub string) ([]string, error)
+	newReceiver(name, address, filter string, prefetch uint32) (eventHubsReceiver, error)
+	close()
+}
+
+// eventHubsReceiver returns the events of a partition.
+type eventHubsReceiver interface {
+	next() (*amqp.Message, error)
+}
+
+type amqpEventHubsConnection struct {
+	conn    *amqp.Conn
+	session *amqp.Session
+}
+
+type amqpEventHubsReceiver struct {
+	receiver *amqp.Receiver
+}
+
+// dialEventHubs connects to the given AMQP URI. The shared access key is
+// used for SASL PLAIN authentication, ANONYMOUS is used if no key is set.
+func dialEventHubs(address, keyName, key string) (eventHubsConnection, error) {
+	options := &amqp.ConnOptions{SASLType: amqp.SASLTypeAnonymous()}
+	if keyName != "" {
+		options.SASLType = amqp.SASLTypePlain(keyName, key)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), eventhubsTimeout)
+	defer cancel()
+
+	conn, err := amqp.Dial(ctx, address, options)
+	if err != nil {
+		return nil, err // ### return, connection failed ###
+	}
+	session, err := conn.NewSession(ctx, nil)
+	if err != nil {
+		conn.Close()
+		return nil, err // ### return, session rejected ###
+	}
+	return &amqpEventHubsConnection{conn: conn, session: session}, nil
+}
+
+// partitionIDs requests the partition ids of an event hub from the
+// $management node.
+func (conn *amqpEventHubsConnection) partitionIDs(eventHub string) ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), eventhubsTimeout)
+	defer cancel()
+
+	sender, err := conn.session.NewSender(ctx, "$management", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer sender.Close(ctx)
+
+	receiver, err := conn.session.NewReceiver(ctx, "$management", &amqp.ReceiverOptions{TargetAddress: eventhubsReplyTo})
+	if err != nil {
+		return nil, err
+	}
+	defer receiver.Close(ctx)
+
+	replyTo := eventhubsReplyTo
+	request := &amqp.Message{
+		Properties: &amqp.MessageProperties{MessageID: "1", ReplyTo: &replyTo},
+		ApplicationProperties: map[string]interface{}{
+			"operation": "READ",
+			"name":      eventHub,
+			"type":      "com.microsoft:eventhub",
+		},
+	}
+	if err := sender.Send(ctx, request, nil); err != nil {
+		return nil, err
+	}
+
+	response, err := receiver.Receive(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	receiver.AcceptMessage(ctx, response)
+
+	if status := fmt.Sprint(response.ApplicationProperties["status-code"]); status != "200" {
+		return nil, fmt.Errorf("AMQP management request failed with status %s: %v", status, response.ApplicationProperties["status-description"])
+	}
+	info, _ := response.Value.(map[string]interface{})
+	partitionIDs, _ := info["partition_ids"].([]string)
+	return partitionIDs, nil
+}
+
+// newReceiver attaches a receiver link to the given partition address. The
+// filter is a selector on the message annotations, e.g. the offset.
+func (conn *amqpEventHubsConnection) newReceiver(name, address, filter string, prefetch uint32) (eventHubsReceiver, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), eventhubsTimeout)
+	defer cancel()
+
+	receiver, err := conn.session.NewReceiver(ctx, address, &amqp.ReceiverOptions{
+		Name:    name,
+		Credit:  int32(prefetch),
+		Filters: []amqp.LinkFilter{amqp.NewSelectorFilter(filter)},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &amqpEventHubsReceiver{receiver: receiver}, nil
+}
+
+func (conn *amqpEventHubsConnection) close() {
+	conn.conn.Close()
+}
+
+// next blocks until the next event has been received. Events are accepted
+// right away so that the link credit is renewed, the position in the
+// partition is tracked by the offset.
+func (recv *amqpEventHubsReceiver) next() (*amqp.Message, error) {
+	event, err := recv.receiver.Receive(context.Background(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := recv.receiver.AcceptMessage(context.Background(), event); err != nil {
+		return nil, err
+	}
+	return event, nil
+}
+
+// eventHubsString converts an AMQP value to a string. Nil is converted to an
+// empty string.
+func eventHubsString(value interface{}) string {
+	switch value := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return value
+	case []byte:
+		return string(value)
+	default:
+		return fmt.Sprint(value)
+	}
+}
+
+// eventHubsBody returns the data sections of an event. Events sent with an
+// AMQP value body are converted to a string.
+func eventHubsBody(event *amqp.Message) []byte {
+	var body []byte
+	for _, data := range event.Data {
+		body = append(body, data...)
+	}
+	if body == nil && event.Value != nil {
+		body = []byte(eventHubsString(event.Value))
+	}
+	return body
+}
@@ -0,0 +1,426 @@
+// Copyright 2015-2016 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumer
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/core/log"
+	"github.com/trivago/gollum/shared"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+const (
+	execModeOnce     = "once"
+	execModeInterval = "interval"
+	execModeRestart  = "restart"
+
+	execMetadataSource = "exec_source"
+	execMetadataPID    = "exec_pid"
+)
+
+// Exec consumer plugin
+// The Exec consumer runs a command and generates messages from its output.
+// The command can be run once, in a fixed interval or be restarted whenever
+// it exits. This allows existing scripts that collect data to be used with
+// gollum without rewriting them.
+// Each line written to stdout or stderr is converted to one message.
+// After the command exited an exit event is sent as a JSON message, e.g.
+// {"command":"collect.sh","pid":1234,"exit_code":0,"duration_ms":1500}.
+// If the command could not be started, the exit code is set to -1 and the
+// reason is added as "error".
+// The source of each message ("stdout", "stderr" or "exit") is attached as
+// "exec_source" metadata, the process id as "exec_pid" metadata.
+// When the consumer is stopped, the command receives a SIGTERM and is killed
+// if it does not exit in time.
+// When attached to a fuse, commands are not started while that fuse is
+// burned.
+// Configuration example
+//
+//  - "consumer.Exec":
+//    Command: ["/usr/bin/vmstat", "-n", "1"]
+//    Mode: "restart"
+//    IntervalSec: 60
+//    RestartDelayMs: 1000
+//    Delimiter: "\n"
+//    MaxMessageSizeByte: 1048576
+//    Environment: {}
+//    WorkingDir: ""
+//    Stderr: true
+//    StderrStream: ""
+//    ExitEvents: true
+//    ExitStream: ""
+//    StopTimeoutSec: 5
+//
+// Command defines the command to run. If set to a list, the first element is
+// the executable and all other elements are passed as arguments. If set to a
+// string, the command is run by "/bin/sh -c" or "cmd /C" on Windows.
+// By default this is set to "", which disables this consumer.
+//
+// Mode defines when the command is run.
+// By default this is set to "once".
+//  * "once" runs the command once after the consumer has been started.
+//  * "interval" runs the command every IntervalSec seconds. If the command
+//    runs longer than that, the next run is started as soon as it exited.
+//  * "restart" runs the command again RestartDelayMs milliseconds after it
+//    exited.
+//
+// IntervalSec defines the time in seconds between two runs in "interval"
+// mode. By default this is set to 60.
+//
+// RestartDelayMs defines the time in milliseconds to wait before restarting
+// the command in "restart" mode. By default this is set to 1000.
+//
+// Delimiter defines the string that separates messages in the output.
+// The delimiter is removed from the message. By default this is set to "\n".
+//
+// MaxMessageSizeByte defines the maximum size of a message in bytes. If a
+// message exceeds this size the remaining output of that run is discarded.
+// By default this is set to 1048576 (1 MB).
+//
+// Environment defines a map of environment variables that are set in
+// addition to the environment of gollum. By default this is set to {}.
+//
+// WorkingDir defines the directory the command is run in. By default this is
+// set to "", i.e. the working directory of gollum is used.
+//
+// Stderr can be set to false to discard the output written to stderr.
+// By default this is set to true.
+//
+// StderrStream defines the stream messages read from stderr are sent to.
+// By default this is set to "", i.e. the streams set by Stream are used.
+//
+// ExitEvents can be set to false to not send exit events.
+// By default this is set to true.
+//
+// ExitStream defines the stream exit events are sent to.
+// By default this is set to "", i.e. the streams set by Stream are used.
+//
+// StopTimeoutSec defines the time in seconds to wait for the command to exit
+// after the consumer has been stopped. The command is killed after that time.
+// By default this is set to 5.
+type Exec struct {
+	core.ConsumerBase
+	command        []string
+	environment    []string
+	workingDir     string
+	mode           string
+	interval       time.Duration
+	restartDelay   time.Duration
+	stopTimeout    time.Duration
+	delimiter      []byte
+	maxMessageSize int
+	stderrStreams  []core.MappedStream
+	exitStreams    []core.MappedStream
+	process        *os.Process
+	processGuard   *sync.Mutex
+	stop           chan struct{}
+	sequence       uint64
+	captureStderr  bool
+	exitEvents     bool
+}
+
+func init() {
+	shared.TypeRegistry.Register(Exec{})
+}
+
+// Configure initializes this consumer with values from a plugin config.
+func (cons *Exec) Configure(conf core.PluginConfig) error {
+	err := cons.ConsumerBase.Configure(conf)
+	if err != nil {
+		return err
+	}
+
+	switch command := conf.GetValue("Command", "").(type) {
+	case string:
+		if command != "" {
+			if runtime.GOOS == "windows" {
+				cons.command = []string{"cmd", "/C", command}
+			} else {
+				cons.command = []string{"/bin/sh", "-c", command}
+			}
+		}
+	case []interface{}:
+		for _, arg := range command {
+			cons.command = append(cons.command, fmt.Sprint(arg))
+		}
+	default:
+		return fmt.Errorf("Command must be a string or a list")
+	}
+
+	cons.mode = strings.ToLower(conf.GetString("Mode", execModeOnce))
+	switch cons.mode {
+	case execModeOnce, execModeInterval, execModeRestart:
+	default:
+		return fmt.Errorf("Unknown mode: %s", cons.mode)
+	}
+
+	for name, value := range conf.GetStringMap("Environment", map[string]string{}) {
+		cons.environment = append(cons.environment, name+"="+value)
+	}
+
+	if streamName := conf.GetString("StderrStream", ""); streamName != "" {
+		cons.stderrStreams = core.NewMappedStreams([]string{streamName})
+	}
+	if streamName := conf.GetString("ExitStream", ""); streamName != "" {
+		cons.exitStreams = core.NewMappedStreams([]string{streamName})
+	}
+
+	cons.workingDir = conf.GetString("WorkingDir", "")
+	cons.interval = time.Duration(shared.MaxI(conf.GetInt("IntervalSec", 60), 1)) * time.Second
+	cons.restartDelay = time.Duration(conf.GetInt("RestartDelayMs", 1000)) * time.Millisecond
+	cons.stopTimeout = time.Duration(conf.GetInt("StopTimeoutSec", 5)) * time.Second
+	cons.delimiter = []byte(shared.Unescape(conf.GetString("Delimiter", "\n")))
+	cons.maxMessageSize = shared.MaxI(conf.GetInt("MaxMessageSizeByte", 1<<20), 1)
+	cons.captureStderr = conf.GetBool("Stderr", true)
+	cons.exitEvents = conf.GetBool("ExitEvents", true)
+	cons.processGuard = new(sync.Mutex)
+	cons.stop = make(chan struct{})
+
+	if len(cons.delimiter) == 0 {
+		return fmt.Errorf("Delimiter must not be empty")
+	}
+	return nil
+}
+
+// splitDelimiter is a bufio.SplitFunc that splits data at the configured
+// delimiter. Data remaining at the end of the output is returned as the last
+// message.
+func (cons *Exec) splitDelimiter(data []byte, atEOF bool) (int, []byte, error) {
+	if idx := bytes.Index(data, cons.delimiter); idx >= 0 {
+		return idx + len(cons.delimiter), data[:idx], nil
+	}
+	if atEOF && len(data) > 0 {
+		return len(data), data, nil
+	}
+	return 0, nil, nil
+}
+
+func (cons *Exec) sendMessage(data []byte, source string, pid int, streams []core.MappedStream) {
+	msg := core.NewMessage(cons, data, atomic.AddUint64(&cons.sequence, 1))
+	msg.SetMetadata(execMetadataSource, source)
+	if pid > 0 {
+		msg.SetMetadata(execMetadataPID, fmt.Sprint(pid))
+	}
+
+	if streams != nil {
+		cons.EnqueueMessageTo(msg, streams)
+	} else {
+		cons.EnqueueMessage(msg)
+	}
+}
+
+func (cons *Exec) readOutput(output io.Reader, source string, pid int, streams []core.MappedStream) {
+	scanner := bufio.NewScanner(output)
+	scanner.Buffer(make([]byte, 0, shared.MinI(cons.maxMessageSize, 4096)), cons.maxMessageSize)
+	scanner.Split(cons.splitDelimiter)
+
+	for scanner.Scan() {
+		data := make([]byte, len(scanner.Bytes()))
+		copy(data, scanner.Bytes())
+		cons.sendMessage(data, source, pid, streams)
+	}
+
+	if err := scanner.Err(); err != nil {
+		// Drain the output so that the command does not block
+		Log.Warning.Print("Exec discarded ", source, " of ", cons.command[0], ": ", err)
+		io.Copy(ioutil.Discard, output)
+	}
+}
+
+func (cons *Exec) sendExitEvent(pid int, exitCode int, start time.Time, err error) {
+	if !cons.exitEvents {
+		return // ### return, disabled ###
+	}
+
+	event := map[string]interface{}{
+		"command":     strings.Join(cons.command, " "),
+		"exit_code":   exitCode,
+		"duration_ms": int64(time.Since(start) / time.Millisecond),
+	}
+	if pid > 0 {
+		event["pid"] = pid
+	}
+	if err != nil {
+		event["error"] = err.Error()
+	}
+
+	data, _ := json.Marshal(event)
+	cons.sendMessage(data, "exit", pid, cons.exitStreams)
+}
+
+// run starts the command and blocks until it exited.
+func (cons *Exec) run() {
+	start := time.Now()
+	cmd := exec.Command(cons.command[0], cons.command[1:]...)
+	cmd.Dir = cons.workingDir
+	if len(cons.environment) > 0 {
+		cmd.Env = append(os.Environ(), cons.environment...)
+	}
+
+	stdout, err := cmd.StdoutPipe()
+	var stderr io.ReadCloser
+	if err == nil && cons.captureStderr {
+		stderr, err = cmd.StderrPipe()
+	}
+	if err == nil {
+		err = cmd.Start()
+	}
+	if err != nil {
+		Log.Error.Print("Exec failed to start ", cons.command[0], ": ", err)
+		cons.sendExitEvent(0, -1, start, err)
+		return // ### return, not started ###
+	}
+
+	pid := cmd.Process.Pid
+	cons.processGuard.Lock()
+	cons.process = cmd.Process
+	cons.processGuard.Unlock()
+
+	readers := new(sync.WaitGroup)
+	readers.Add(1)
+	go shared.DontPanic(func() {
+		defer readers.Done()
+		cons.readOutput(stdout, "stdout", pid, nil)
+	})
+	if stderr != nil {
+		readers.Add(1)
+		go shared.DontPanic(func() {
+			defer readers.Done()
+			cons.readOutput(stderr, "stderr", pid, cons.stderrStreams)
+		})
+	}
+
+	// Wait must be called after all output has been read
+	readers.Wait()
+	err = cmd.Wait()
+
+	cons.processGuard.Lock()
+	cons.process = nil
+	cons.processGuard.Unlock()
+
+	exitCode := 0
+	if err != nil {
+		exitCode = -1
+		if exitErr, isExitErr := err.(*exec.ExitError); isExitErr {
+			exitCode = exitErr.ExitCode()
+			err = nil
+		}
+	}
+	cons.sendExitEvent(pid, exitCode, start, err)
+}
+
+// wait blocks for the given duration and returns false if the consumer has
+// been stopped in the meantime.
+func (cons *Exec) wait(duration time.Duration) bool {
+	timer := time.NewTimer(duration)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return true
+	case <-cons.stop:
+		return false
+	}
+}
+
+func (cons *Exec) runLoop() {
+	defer cons.WorkerDone()
+
+	for cons.IsActive() {
+		if cons.IsFuseBurned() {
+			if !cons.wait(time.Second) {
+				return // ### return, stopped ###
+			}
+			continue // ### continue, fuse burned ###
+		}
+
+		start := time.Now()
+		cons.run()
+
+		var delay time.Duration
+		switch cons.mode {
+		case execModeOnce:
+			return // ### return, done ###
+		case execModeInterval:
+			delay = cons.interval - time.Since(start)
+		case execModeRestart:
+			delay = cons.restartDelay
+		}
+
+		if !cons.wait(delay) {
+			return // ### return, stopped ###
+		}
+	}
+}
+
+func (cons *Exec) isRunning() bool {
+	cons.processGuard.Lock()
+	defer cons.processGuard.Unlock()
+	return cons.process != nil
+}
+
+func (cons *Exec) close() {
+	close(cons.stop)
+
+	cons.processGuard.Lock()
+	defer cons.processGuard.Unlock()
+	if cons.process == nil {
+		return // ### return, not running ###
+	}
+
+	process := cons.process
+	if err := process.Signal(syscall.SIGTERM); err != nil {
+		process.Kill()
+		return // ### return, killed ###
+	}
+
+	time.AfterFunc(cons.stopTimeout, func() {
+		cons.processGuard.Lock()
+		defer cons.processGuard.Unlock()
+		if cons.process == process {
+			Log.Warning.Print("Exec killed ", cons.command[0], " after stop timeout")
+			process.Kill()
+		}
+	})
+}
+
+// Consume runs the configured command.
+func (cons *Exec) Consume(workers *sync.WaitGroup) {
+	if len(cons.command) == 0 {
+		Log.Error.Print("Exec has no command set")
+		return // ### return, nothing to do ###
+	}
+
+	cons.SetWorkerWaitGroup(workers)
+	cons.SetStopCallback(cons.close)
+
+	cons.AddWorker()
+	go shared.DontPanic(cons.runLoop)
+
+	cons.ControlLoop()
+}
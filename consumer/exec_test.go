@@ -0,0 +1,122 @@
+// Copyright 2015-2016 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumer
+
+import (
+	"encoding/json"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/shared"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestExec(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("requires /bin/sh")
+	}
+	expect := shared.NewExpect(t)
+
+	stream := &mockHTTPStream{}
+	core.StreamRegistry.Register(stream, core.GetStreamID("exec"))
+	errorStream := &mockHTTPStream{}
+	core.StreamRegistry.Register(errorStream, core.GetStreamID("execStderr"))
+
+	conf := core.NewPluginConfig("")
+	conf.Stream = []string{"exec"}
+	conf.Override("Command", "echo first; echo \"$EXEC_TEST\" >&2; printf last; exit 3")
+	conf.Override("Environment", map[interface{}]interface{}{"EXEC_TEST": "err"})
+	conf.Override("StderrStream", "execStderr")
+	plugin, err := core.NewPluginWithType("consumer.Exec", conf)
+	expect.NoError(err)
+	cons := plugin.(*Exec)
+
+	workers := new(sync.WaitGroup)
+	go cons.Consume(workers)
+
+	expect.NonBlocking(2*time.Second, func() {
+		for stream.count() < 3 || errorStream.count() < 1 {
+			time.Sleep(10 * time.Millisecond)
+		}
+	})
+	cons.Control() <- core.PluginControlStopConsumer
+	expect.NonBlocking(2*time.Second, workers.Wait)
+
+	expect.Equal(3, stream.count())
+	expect.Equal("first", string(stream.messages[0].Data))
+	expect.Equal("stdout", stream.messages[0].Metadata[execMetadataSource])
+	expect.Equal("last", string(stream.messages[1].Data))
+	expect.Equal("err", string(errorStream.messages[0].Data))
+	expect.Equal("stderr", errorStream.messages[0].Metadata[execMetadataSource])
+
+	exitEvent := stream.messages[2]
+	expect.Equal("exit", exitEvent.Metadata[execMetadataSource])
+	expect.Equal(stream.messages[0].Metadata[execMetadataPID], exitEvent.Metadata[execMetadataPID])
+	event := map[string]interface{}{}
+	expect.NoError(json.Unmarshal(exitEvent.Data, &event))
+	expect.Equal(3.0, event["exit_code"])
+}
+
+func TestExecRestart(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("requires /bin/sh")
+	}
+	expect := shared.NewExpect(t)
+
+	stream := &mockHTTPStream{}
+	core.StreamRegistry.Register(stream, core.GetStreamID("execRestart"))
+	conf := core.NewPluginConfig("")
+	conf.Stream = []string{"execRestart"}
+	conf.Override("Command", []interface{}{"echo", "run"})
+	conf.Override("Mode", "restart")
+	conf.Override("RestartDelayMs", 10)
+	conf.Override("ExitEvents", false)
+	plugin, err := core.NewPluginWithType("consumer.Exec", conf)
+	expect.NoError(err)
+	cons := plugin.(*Exec)
+
+	workers := new(sync.WaitGroup)
+	go cons.Consume(workers)
+	expect.NonBlocking(2*time.Second, func() {
+		for stream.count() < 3 {
+			time.Sleep(10 * time.Millisecond)
+		}
+	})
+	cons.Control() <- core.PluginControlStopConsumer
+	expect.NonBlocking(2*time.Second, workers.Wait)
+	expect.Equal("run", string(stream.messages[2].Data))
+
+	// Stopping terminates a running command
+	conf.Override("Command", []interface{}{"sleep", "10"})
+	plugin, err = core.NewPluginWithType("consumer.Exec", conf)
+	expect.NoError(err)
+	cons = plugin.(*Exec)
+
+	workers = new(sync.WaitGroup)
+	go cons.Consume(workers)
+	expect.NonBlocking(2*time.Second, func() {
+		for !cons.isRunning() {
+			time.Sleep(10 * time.Millisecond)
+		}
+	})
+	cons.Control() <- core.PluginControlStopConsumer
+	expect.NonBlocking(2*time.Second, workers.Wait)
+
+	conf = core.NewPluginConfig("")
+	conf.Override("Mode", "never")
+	_, err = core.NewPluginWithType("consumer.Exec", conf)
+	expect.NotNil(err)
+}
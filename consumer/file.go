@@ -15,6 +15,8 @@
 package consumer
 
 import (
+	"encoding/json"
+	"fmt"
 	"github.com/trivago/gollum/core"
 	"github.com/trivago/gollum/core/log"
 	"github.com/trivago/gollum/shared"
@@ -22,9 +24,11 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"regexp"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -44,10 +48,20 @@ const (
 
 // File consumer plugin
 // The file consumer allows to read from files while looking for a delimiter
-// that marks the end of a message. If the file is part of e.g. a log rotation
-// the file consumer can be set to a symbolic link of the latest file and
-// (optionally) be told to reopen the file by sending a SIGHUP. A symlink to
+// that marks the end of a message. The file to read can be given as a glob
+// pattern, in which case all matching files are read in parallel and files
+// created after startup are picked up automatically.
+// Files are followed across rotations: if a file is renamed or replaced (e.g.
+// by logrotate) the consumer finishes reading it and continues with the new
+// file from the beginning. If a file is truncated (e.g. by logrotate's
+// copytruncate) reading restarts at the beginning of the file. A symlink to
 // a file will automatically be reopened if the underlying file is changed.
+// Sending a SIGHUP forces the consumer to check all files for rotation and
+// to look for new files immediately.
+// Lines belonging together, like the lines of a Java stack trace or a Python
+// traceback, can be merged into a single message by the Multiline settings.
+// The path of the file a message was read from is attached to each message as
+// "file_name" metadata.
 // When attached to a fuse, this consumer will stop accepting messages in case
 // that fuse is burned.
 // Configuration example
@@ -56,34 +70,103 @@ const (
 //    File: "/var/run/system.log"
 //    DefaultOffset: "Newest"
 //    OffsetFile: ""
+//    ScanIntervalMs: 3000
 //    Delimiter: "\n"
+//    Partitioner: "delimiter"
+//    Pattern: ""
+//    MultilineContinuation: ""
+//    MultilineIndented: false
+//    MultilineTimeoutMs: 1000
+//    MultilineMaxLines: 1000
 //
-// File is a mandatory setting and contains the file to read. The file will be
-// read from beginning to end and the reader will stay attached until the
-// consumer is stopped. I.e. appends to the attached file will be recognized
-// automatically.
+// File is a mandatory setting and contains the file to read. This can be a
+// glob pattern like "/var/log/app/*.log" to read all matching files. The
+// files will be read from beginning to end and the reader will stay attached
+// until the consumer is stopped. I.e. appends to the attached files will be
+// recognized automatically.
 //
-// DefaultOffset defines where to start reading the file. Valid values are
-// "oldest" and "newest". If OffsetFile is defined the DefaultOffset setting
-// will be ignored unless the file does not exist.
+// DefaultOffset defines where to start reading files that exist when the
+// consumer is started. Valid values are "oldest" and "newest". Files that are
+// created or rotated while the consumer is running are always read from the
+// beginning. If OffsetFile is defined the DefaultOffset setting will be
+// ignored for all files that have a stored offset.
 // By default this is set to "newest".
 //
-// OffsetFile defines the path to a file that stores the current offset inside
-// the given file. If the consumer is restarted that offset is used to continue
-// reading. By default this is set to "" which disables the offset file.
+// OffsetFile defines the path to a file that stores the current offset of
+// every file read by this consumer. If the consumer is restarted these offsets
+// are used to continue reading. Offsets are stored after each read and always
+// point to the end of the last complete message. If a file is smaller than its
+// stored offset it is considered as truncated and read from the beginning.
+// By default this is set to "" which disables the offset file.
+//
+// ScanIntervalMs defines the number of milliseconds between two checks for new
+// files matching the File pattern. Files that do not match the pattern
+// anymore, e.g. because they were deleted, are closed during these checks,
+// too. By default this is set to 3000.
 //
 // Delimiter defines the end of a message inside the file. By default this is
 // set to "\n".
+//
+// Partitioner defines the algorithm used to read messages from the file.
+// By default this is set to "delimiter".
+//  * "delimiter" separates messages by looking for the Delimiter string.
+//  * "regex" starts a new message whenever the regular expression given by
+//    Pattern matches. A message is complete once the start of the next message
+//    has been read, i.e. the last message of a file is sent as soon as a new
+//    message is appended or the file is rotated, truncated or deleted.
+//
+// Pattern defines the regular expression used by the regex partitioner to
+// find the start of a message, e.g. ^\d{4}-\d{2}-\d{2} for log lines starting
+// with a date. The expression is matched in multi-line mode, i.e. "^" matches
+// the start of any line, and must not match across lines. This setting is
+// mandatory for the regex partitioner.
+//
+// MultilineContinuation defines a regular expression matching lines that
+// continue the preceding line. Matching lines are appended to the previous
+// message, separated by Delimiter. E.g. ^(\s|Caused by:) merges Java stack
+// traces and ^(\s|Traceback|\w+(Error|Exception)\b) merges Python
+// tracebacks. Merging requires the delimiter partitioner. By default this is
+// set to "" which disables this check.
+//
+// MultilineIndented can be set to true to treat all lines starting with a
+// whitespace character as continuation lines. This can be combined with
+// MultilineContinuation. By default this is set to false.
+//
+// MultilineTimeoutMs defines the number of milliseconds to wait for further
+// continuation lines. A merged message is sent once the next message starts
+// or this timeout has passed since its last line was read. By default this is
+// set to 1000.
+//
+// MultilineMaxLines defines the maximum number of lines merged into a single
+// message. Further continuation lines start a new message. Set to 0 to
+// disable this limit. By default this is set to 1000.
 type File struct {
 	core.ConsumerBase
-	file           *os.File
 	fileName       string
 	offsetFileName string
 	delimiter      string
+	flags          shared.BufferedReaderFlags
 	seek           int
-	seekOnRotate   int
-	seekOffset     int64
+	scanInterval   time.Duration
+	tails          map[string]*fileTail
+	offsets        map[string]int64
+	openFailed     map[string]bool
+	offsetsChanged bool
+	sequence       uint64
 	state          fileState
+	continuation   *regexp.Regexp
+	indented       bool
+	mergeTimeout   time.Duration
+	mergeMaxLines  int
+}
+
+// fileTail holds the read state of a single file.
+type fileTail struct {
+	path      string
+	file      *os.File
+	buffer    *shared.BufferedReader
+	multiline *multilineBuffer
+	offset    int64
 }
 
 func init() {
@@ -99,85 +182,401 @@ func (cons *File) Configure(conf core.PluginConfig) error {
 
 	cons.SetRollCallback(cons.onRoll)
 
-	cons.file = nil
 	cons.fileName = conf.GetString("File", "/var/run/system.log")
 	cons.offsetFileName = conf.GetString("OffsetFile", "")
+	cons.scanInterval = time.Duration(shared.MaxI(conf.GetInt("ScanIntervalMs", 3000), 1)) * time.Millisecond
 	cons.delimiter = shared.Unescape(conf.GetString("Delimiter", "\n"))
+	cons.flags = 0
+	cons.tails = make(map[string]*fileTail)
+	cons.offsets = make(map[string]int64)
+	cons.openFailed = make(map[string]bool)
+
+	if _, err := filepath.Match(cons.fileName, ""); err != nil {
+		return fmt.Errorf("Invalid file pattern %s: %s", cons.fileName, err.Error())
+	}
+
+	partitioner := strings.ToLower(conf.GetString("Partitioner", "delimiter"))
+	switch partitioner {
+	case "regex":
+		cons.flags |= shared.BufferedReaderFlagRegex
+		if cons.delimiter, err = compileStartPattern(conf); err != nil {
+			return err
+		}
+
+	case "delimiter":
+		// Nothing to add
+
+	default:
+		return fmt.Errorf("Unknown partitioner: %s", partitioner)
+	}
+
+	if pattern := conf.GetString("MultilineContinuation", ""); pattern != "" {
+		if cons.continuation, err = regexp.Compile(pattern); err != nil {
+			return err
+		}
+	}
+	cons.indented = conf.GetBool("MultilineIndented", false)
+	cons.mergeTimeout = time.Duration(conf.GetInt("MultilineTimeoutMs", 1000)) * time.Millisecond
+	cons.mergeMaxLines = shared.MaxI(conf.GetInt("MultilineMaxLines", 1000), 0)
+
+	if cons.isMultiline() && partitioner != "delimiter" {
+		return fmt.Errorf("Multiline merging requires the delimiter partitioner")
+	}
 
 	switch strings.ToLower(conf.GetString("DefaultOffset", fileOffsetEnd)) {
 	default:
 		fallthrough
 	case fileOffsetEnd:
 		cons.seek = 2
-		cons.seekOnRotate = 2
-		cons.seekOffset = 0
 
 	case fileOffsetStart:
-		cons.seek = 1
-		cons.seekOnRotate = 1
-		cons.seekOffset = 0
+		cons.seek = 0
 	}
 
 	return nil
 }
 
-func (cons *File) storeOffset() {
-	ioutil.WriteFile(cons.offsetFileName, []byte(strconv.FormatInt(cons.seekOffset, 10)), 0644)
+func (cons *File) getState() fileState {
+	return fileState(atomic.LoadInt32((*int32)(&cons.state)))
+}
+
+func (cons *File) setState(state fileState) {
+	atomic.StoreInt32((*int32)(&cons.state), int32(state))
+}
+
+// resetState sets the given state unless the consumer has been stopped.
+func (cons *File) resetState(state fileState) {
+	for {
+		current := cons.getState()
+		if current == fileStateDone || atomic.CompareAndSwapInt32((*int32)(&cons.state), int32(current), int32(state)) {
+			return // ### return, stopped or done ###
+		}
+	}
+}
+
+func (cons *File) isMultiline() bool {
+	return cons.continuation != nil || cons.indented
 }
 
-func (cons *File) enqueueAndPersist(data []byte, sequence uint64) {
-	cons.seekOffset, _ = cons.file.Seek(0, 1)
-	cons.Enqueue(data, sequence)
-	cons.storeOffset()
+func absFileName(fileName string) string {
+	if absName, err := filepath.Abs(fileName); err == nil {
+		return absName
+	}
+	return fileName
 }
 
-func (cons *File) realFileName() string {
-	baseFileName, err := filepath.EvalSymlinks(cons.fileName)
+func (cons *File) loadOffsets() {
+	fileContents, err := ioutil.ReadFile(cons.offsetFileName)
 	if err != nil {
-		baseFileName = cons.fileName
+		return // ### return, no offsets stored ###
 	}
 
-	baseFileName, err = filepath.Abs(baseFileName)
+	if err := json.Unmarshal(fileContents, &cons.offsets); err != nil {
+		// Older versions stored a single number for the configured file
+		offset, parseErr := strconv.ParseInt(strings.TrimSpace(string(fileContents)), 10, 64)
+		if parseErr != nil {
+			Log.Error.Print("Error reading offset file: ", err)
+			return // ### return, invalid offset file ###
+		}
+		cons.offsets = map[string]int64{absFileName(cons.fileName): offset}
+	}
+}
+
+func (cons *File) storeOffsets() {
+	if cons.offsetFileName == "" || !cons.offsetsChanged {
+		return // ### return, nothing to store ###
+	}
+
+	fileContents, err := json.Marshal(cons.offsets)
 	if err != nil {
-		baseFileName = cons.fileName
+		Log.Error.Print("Error storing offsets: ", err)
+		return // ### return, marshalling failed ###
 	}
 
-	return baseFileName
+	// Write to a temporary file first so that the offset file is never left
+	// in an incomplete state.
+	tempFileName := cons.offsetFileName + ".tmp"
+	if err := ioutil.WriteFile(tempFileName, fileContents, 0644); err != nil {
+		Log.Error.Print("Error writing offset file: ", err)
+		return // ### return, write failed ###
+	}
+	if err := os.Rename(tempFileName, cons.offsetFileName); err != nil {
+		Log.Error.Print("Error writing offset file: ", err)
+		return // ### return, rename failed ###
+	}
+	cons.offsetsChanged = false
 }
 
-func (cons *File) setState(state fileState) {
-	cons.state = state
+func (cons *File) setOffset(tail *fileTail, offset int64) {
+	if tail.offset != offset {
+		tail.offset = offset
+		cons.offsetsChanged = true
+	}
+	cons.offsets[tail.path] = offset
 }
 
-func (cons *File) initFile() {
-	defer cons.setState(fileStateRead)
+// openTail opens the file at the given path and seeks to the given offset.
+// If the offset is not inside the file the file is read from the beginning.
+func (cons *File) openTail(path string, offset int64, whence int) (*fileTail, error) {
+	file, err := os.OpenFile(path, os.O_RDONLY, 0666)
+	if err != nil {
+		return nil, err // ### return, open failed ###
+	}
 
-	if cons.file != nil {
-		cons.file.Close()
-		cons.file = nil
-		cons.seek = cons.seekOnRotate
-		cons.seekOffset = 0
-		if cons.offsetFileName != "" {
-			cons.storeOffset()
+	if whence == 0 {
+		if stat, err := file.Stat(); err == nil && stat.Size() < offset {
+			Log.Note.Printf("File %s is smaller than its stored offset, reading from start", path)
+			offset = 0
 		}
 	}
 
-	if cons.offsetFileName != "" {
-		fileContents, err := ioutil.ReadFile(cons.offsetFileName)
-		if err == nil {
-			cons.seek = 1
-			cons.seekOffset, err = strconv.ParseInt(string(fileContents), 10, 64)
-			if err != nil {
-				Log.Error.Print("Error reading offset file: ", err)
+	if offset, err = file.Seek(offset, whence); err != nil {
+		file.Close()
+		return nil, err // ### return, seek failed ###
+	}
+
+	tail := &fileTail{
+		path:   path,
+		file:   file,
+		buffer: shared.NewBufferedReader(fileBufferGrowSize, cons.flags, 0, cons.delimiter),
+		offset: -1,
+	}
+	if cons.isMultiline() {
+		tail.multiline = newMultilineBuffer(cons.continuation, cons.indented, cons.delimiter, cons.mergeMaxLines)
+	}
+	cons.setOffset(tail, offset)
+	return tail, nil
+}
+
+// dropTail stops reading a tail. If forget is set the stored offset is
+// removed, too.
+func (cons *File) dropTail(tail *fileTail, forget bool) {
+	tail.file.Close()
+	if current, isOpen := cons.tails[tail.path]; isOpen && current != tail {
+		return // ### return, path is used by another file ###
+	}
+	delete(cons.tails, tail.path)
+	if forget {
+		delete(cons.offsets, tail.path)
+		cons.offsetsChanged = true
+	}
+}
+
+// renameTail moves a tail to a new path, e.g. after a file has been renamed
+// to a name that is still matched by the file pattern.
+func (cons *File) renameTail(tail *fileTail, path string) {
+	Log.Note.Printf("File %s has been renamed to %s", tail.path, path)
+	if current, isOpen := cons.tails[tail.path]; !isOpen || current == tail {
+		delete(cons.tails, tail.path)
+		delete(cons.offsets, tail.path)
+	}
+	tail.path = path
+	cons.tails[path] = tail
+	cons.offsets[path] = tail.offset
+	cons.offsetsChanged = true
+}
+
+// isDetached returns true if the file read by a tail cannot be found at the
+// path of the tail anymore, i.e. if it has been moved, replaced or removed.
+func (tail *fileTail) isDetached() bool {
+	newStat, newStatErr := os.Stat(tail.path)
+	oldStat, oldStatErr := tail.file.Stat()
+	return newStatErr != nil || oldStatErr != nil || !os.SameFile(newStat, oldStat)
+}
+
+// scan looks for files matching the file pattern. New files are opened,
+// renamed files are followed and files that are not matched anymore are read
+// to the end and closed. If initial is set, new files are read from the
+// configured default offset instead of their beginning.
+func (cons *File) scan(initial bool) {
+	matches, err := filepath.Glob(cons.fileName)
+	if err != nil {
+		Log.Error.Print("File pattern error - ", err)
+		return // ### return, invalid pattern ###
+	}
+	if len(matches) == 0 && !strings.ContainsAny(cons.fileName, "*?[\\") {
+		matches = []string{cons.fileName}
+	}
+
+	detached := []*fileTail{}
+	for _, tail := range cons.tails {
+		if tail.isDetached() {
+			detached = append(detached, tail)
+		}
+	}
+
+	matched := make(map[string]bool)
+	for _, match := range matches {
+		path := absFileName(match)
+		matched[path] = true
+		if tail, isOpen := cons.tails[path]; isOpen && !tail.isDetached() {
+			continue // ### continue, already open ###
+		}
+
+		stat, err := os.Stat(path)
+		switch {
+		case err != nil:
+			if !cons.openFailed[path] {
+				Log.Warning.Print("File open failed - ", err)
+				cons.openFailed[path] = true
+			}
+			continue // ### continue, retry on next scan ###
+
+		case stat.IsDir():
+			continue // ### continue, not a file ###
+		}
+
+		// A file that has been replaced is handled like the other detached
+		// files, i.e. it is either followed to its new name or closed.
+		if _, isOpen := cons.tails[path]; isOpen {
+			Log.Note.Printf("File rotation detected for %s", path)
+			delete(cons.tails, path)
+			delete(cons.offsets, path)
+		}
+
+		// Continue reading files that have been renamed
+		renamed := false
+		for i, tail := range detached {
+			if tailStat, err := tail.file.Stat(); err == nil && os.SameFile(stat, tailStat) {
+				cons.renameTail(tail, path)
+				detached = append(detached[:i], detached[i+1:]...)
+				renamed = true
+				break // ### break, found ###
+			}
+		}
+		if renamed {
+			continue // ### continue, renamed ###
+		}
+
+		offset, whence := int64(0), 0
+		if storedOffset, isStored := cons.offsets[path]; isStored {
+			offset = storedOffset
+		} else if initial {
+			whence = cons.seek
+		}
+
+		tail, err := cons.openTail(path, offset, whence)
+		if err != nil {
+			if !cons.openFailed[path] {
+				Log.Warning.Print("File open failed - ", err)
+				cons.openFailed[path] = true
 			}
+			continue // ### continue, retry on next scan ###
+		}
+
+		delete(cons.openFailed, path)
+		cons.tails[path] = tail
+	}
+
+	for _, tail := range detached {
+		cons.readTail(tail)
+		cons.finishTail(tail)
+		cons.dropTail(tail, true)
+	}
+
+	for path, tail := range cons.tails {
+		if _, isMatched := matched[path]; !isMatched {
+			cons.readTail(tail)
+			cons.finishTail(tail)
+			cons.dropTail(tail, true)
+		}
+	}
+}
+
+// checkTruncation restarts a tail at the beginning of its file if the file
+// has been truncated.
+func (cons *File) checkTruncation(tail *fileTail) {
+	stat, err := tail.file.Stat()
+	if err != nil {
+		return // ### return, file unavailable ###
+	}
+
+	if position, err := tail.file.Seek(0, 1); err == nil && stat.Size() < position {
+		Log.Note.Printf("File truncation detected for %s", tail.path)
+		if _, err := tail.file.Seek(0, 0); err != nil {
+			Log.Error.Print("Error reading file - ", err)
+			cons.dropTail(tail, false)
+			return // ### return, seek failed ###
+		}
+		cons.finishTail(tail)
+		tail.buffer.Reset(0)
+		cons.setOffset(tail, 0)
+	}
+}
+
+func (cons *File) sendMessage(tail *fileTail, data []byte) {
+	msg := core.NewMessage(cons, data, cons.sequence)
+	msg.SetMetadata(core.MetadataFileName, tail.path)
+	cons.sequence++
+	cons.EnqueueMessage(msg)
+}
+
+// updateOffset sets the offset of a tail to the end of the last message sent.
+func (cons *File) updateOffset(tail *fileTail) {
+	position, err := tail.file.Seek(0, 1)
+	if err != nil {
+		return // ### return, file unavailable ###
+	}
+	position -= int64(tail.buffer.Buffered())
+	if tail.multiline != nil {
+		position -= tail.multiline.size
+	}
+	cons.setOffset(tail, position)
+}
+
+// flushTail sends the message currently merged by a tail, if any.
+func (cons *File) flushTail(tail *fileTail) {
+	if tail.multiline == nil {
+		return // ### return, no merging ###
+	}
+	if data := tail.multiline.flush(); data != nil {
+		cons.sendMessage(tail, data)
+		cons.updateOffset(tail)
+	}
+}
+
+// finishTail sends all messages buffered for a tail that is not read any
+// further, including the last message read by the regex partitioner.
+func (cons *File) finishTail(tail *fileTail) {
+	tail.buffer.Flush(func(data []byte, sequence uint64) {
+		cons.sendMessage(tail, data)
+	})
+	cons.flushTail(tail)
+}
+
+// readTail reads all messages currently available from a tail. It returns
+// false if the end of the file has been reached.
+func (cons *File) readTail(tail *fileTail) bool {
+	delimiterLen := int64(len(cons.delimiter))
+	err := tail.buffer.ReadAll(tail.file, func(data []byte, sequence uint64) {
+		if tail.multiline == nil {
+			cons.sendMessage(tail, data)
+		} else if complete := tail.multiline.add(data, int64(len(data))+delimiterLen, time.Now()); complete != nil {
+			cons.sendMessage(tail, complete)
 		}
+	})
+	cons.updateOffset(tail)
+
+	switch {
+	case err == nil:
+		return true
+
+	case err == io.EOF:
+		return false
+
+	default:
+		Log.Error.Print("Error reading file - ", err)
+		cons.dropTail(tail, false)
+		return false
 	}
 }
 
 func (cons *File) close() {
-	if cons.file != nil {
-		cons.file.Close()
+	for _, tail := range cons.tails {
+		cons.flushTail(tail)
+		tail.file.Close()
 	}
+	cons.storeOffsets()
 	cons.setState(fileStateDone)
 	cons.WorkerDone()
 }
@@ -185,87 +584,64 @@ func (cons *File) close() {
 func (cons *File) read() {
 	defer cons.close()
 
-	sendFunction := cons.Enqueue
 	if cons.offsetFileName != "" {
-		sendFunction = cons.enqueueAndPersist
+		cons.loadOffsets()
 	}
 
 	spin := shared.NewSpinner(shared.SpinPriorityLow)
-	buffer := shared.NewBufferedReader(fileBufferGrowSize, 0, 0, cons.delimiter)
-	printFileOpenError := true
-
-	for cons.state != fileStateDone {
-
-		// Initialize the seek state if requested
-		// Try to read the remains of the file first
-		if cons.state == fileStateOpen {
-			if cons.file != nil {
-				buffer.ReadAll(cons.file, sendFunction)
-			}
-			cons.initFile()
-			buffer.Reset(uint64(cons.seekOffset))
+	cons.scan(true)
+	nextScan := time.Now().Add(cons.scanInterval)
+
+	for cons.getState() != fileStateDone {
+		// Look for new or rotated files if requested
+		if cons.getState() == fileStateOpen {
+			cons.resetState(fileStateRead)
+			nextScan = time.Time{}
 		}
 
-		// Try to open the file to read from
-		if cons.state == fileStateRead && cons.file == nil {
-			file, err := os.OpenFile(cons.realFileName(), os.O_RDONLY, 0666)
+		if time.Now().After(nextScan) {
+			cons.scan(false)
+			nextScan = time.Now().Add(cons.scanInterval)
+		}
 
+		hasMoreData := false
+		for _, tail := range cons.tails {
 			switch {
-			case err != nil:
-				if printFileOpenError {
-					Log.Warning.Print("File open failed - ", err)
-					printFileOpenError = false
-				}
-				time.Sleep(3 * time.Second)
-				continue // ### continue, retry ###
+			case cons.readTail(tail):
+				hasMoreData = true
+
+			case cons.tails[tail.path] != tail:
+				// Tail has been dropped
+
+			case tail.isDetached():
+				nextScan = time.Time{}
 
 			default:
-				cons.file = file
-				cons.seekOffset, _ = cons.file.Seek(cons.seekOffset, cons.seek)
-				printFileOpenError = true
+				cons.checkTruncation(tail)
+				if tail.multiline != nil && tail.multiline.expired(time.Now(), cons.mergeTimeout) {
+					cons.flushTail(tail)
+				}
 			}
 		}
 
-		// Try to read from the file
-		if cons.state == fileStateRead && cons.file != nil {
-			err := buffer.ReadAll(cons.file, sendFunction)
-			cons.WaitOnFuse()
+		cons.storeOffsets()
+		cons.WaitOnFuse()
 
-			switch {
-			case err == nil: // ok
-				spin.Reset()
-
-			case err == io.EOF:
-				if cons.file.Name() != cons.realFileName() {
-					Log.Note.Print("File rotation detected")
-					cons.onRoll()
-				} else {
-					newStat, newStatErr := os.Stat(cons.realFileName())
-					oldStat, oldStatErr := cons.file.Stat()
-
-					if newStatErr == nil && oldStatErr == nil && !os.SameFile(newStat, oldStat) {
-						Log.Note.Print("File rotation detected")
-						cons.onRoll()
-					}
-				}
-				spin.Yield()
-
-			case cons.state == fileStateRead:
-				Log.Error.Print("Error reading file - ", err)
-				cons.file.Close()
-				cons.file = nil
-			}
+		if hasMoreData {
+			spin.Reset()
+		} else {
+			spin.Yield()
 		}
 	}
 }
 
 func (cons *File) onRoll() {
-	cons.setState(fileStateOpen)
+	cons.resetState(fileStateOpen)
 }
 
 // Consume listens to stdin.
 func (cons *File) Consume(workers *sync.WaitGroup) {
-	cons.setState(fileStateOpen)
+	cons.setState(fileStateRead)
 	defer cons.setState(fileStateDone)
 
 	go shared.DontPanic(func() {
@@ -0,0 +1,267 @@
+// Copyright 2015-2016 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumer
+
+import (
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/shared"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+)
+
+func readTestFiles(cons *File, stream *mockHTTPStream) []string {
+	stream.messages = stream.messages[:0]
+	for _, tail := range cons.tails {
+		cons.readTail(tail)
+	}
+	messages := []string{}
+	for _, msg := range stream.messages {
+		messages = append(messages, filepath.Base(msg.Metadata[core.MetadataFileName])+":"+string(msg.Data))
+	}
+	return messages
+}
+
+func closeTestFiles(cons *File) {
+	for _, tail := range cons.tails {
+		tail.file.Close()
+	}
+	cons.storeOffsets()
+}
+
+func appendTestFile(expect shared.Expect, path string, data string) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	expect.NoError(err)
+	_, err = file.WriteString(data)
+	expect.NoError(err)
+	expect.NoError(file.Close())
+}
+
+func TestFileGlobAndOffsets(t *testing.T) {
+	expect := shared.NewExpect(t)
+
+	dir, err := ioutil.TempDir("", "gollum_file")
+	expect.NoError(err)
+	defer os.RemoveAll(dir)
+
+	appendTestFile(expect, filepath.Join(dir, "a.log"), "1\n2\n")
+	appendTestFile(expect, filepath.Join(dir, "b.txt"), "ignored\n")
+
+	stream := &mockHTTPStream{}
+	core.StreamRegistry.Register(stream, core.GetStreamID("fileGlob"))
+	conf := core.NewPluginConfig("")
+	conf.Stream = []string{"fileGlob"}
+	conf.Override("File", filepath.Join(dir, "*.log"))
+	conf.Override("OffsetFile", filepath.Join(dir, "offsets"))
+	conf.Override("DefaultOffset", "oldest")
+	plugin, err := core.NewPluginWithType("consumer.File", conf)
+	expect.NoError(err)
+	cons, casted := plugin.(*File)
+	expect.True(casted)
+	cons.scan(true)
+	expect.Equal([]string{"a.log:1", "a.log:2"}, readTestFiles(cons, stream))
+
+	// Incomplete messages are not part of the stored offset
+	appendTestFile(expect, filepath.Join(dir, "a.log"), "3")
+	expect.Equal([]string{}, readTestFiles(cons, stream))
+	cons.storeOffsets()
+	offsets, err := ioutil.ReadFile(filepath.Join(dir, "offsets"))
+	expect.NoError(err)
+	expect.Equal(`{"`+filepath.Join(dir, "a.log")+`":4}`, string(offsets))
+
+	// Files created later are read from the beginning
+	appendTestFile(expect, filepath.Join(dir, "c.log"), "x\n")
+	cons.scan(false)
+	expect.Equal([]string{"c.log:x"}, readTestFiles(cons, stream))
+	closeTestFiles(cons)
+
+	// A restarted consumer continues at the stored offsets
+	appendTestFile(expect, filepath.Join(dir, "a.log"), "\n4\n")
+	plugin, err = core.NewPluginWithType("consumer.File", conf)
+	expect.NoError(err)
+	cons, casted = plugin.(*File)
+	expect.True(casted)
+	cons.loadOffsets()
+	cons.scan(true)
+	expect.Equal([]string{"a.log:3", "a.log:4"}, readTestFiles(cons, stream))
+}
+
+func TestFileRotation(t *testing.T) {
+	expect := shared.NewExpect(t)
+
+	dir, err := ioutil.TempDir("", "gollum_file")
+	expect.NoError(err)
+	defer os.RemoveAll(dir)
+
+	fileName := filepath.Join(dir, "app.log")
+	appendTestFile(expect, fileName, "old\n")
+	stream := &mockHTTPStream{}
+	core.StreamRegistry.Register(stream, core.GetStreamID("fileRotation"))
+	conf := core.NewPluginConfig("")
+	conf.Stream = []string{"fileRotation"}
+	conf.Override("File", fileName)
+	plugin, err := core.NewPluginWithType("consumer.File", conf)
+	expect.NoError(err)
+	cons, casted := plugin.(*File)
+	expect.True(casted)
+	cons.scan(true)
+	expect.Equal([]string{}, readTestFiles(cons, stream))
+
+	// Data written to the old file after the rename is read before the new file
+	expect.NoError(os.Rename(fileName, fileName+".1"))
+	appendTestFile(expect, fileName+".1", "1\n")
+	appendTestFile(expect, fileName, "2\n")
+	tail := cons.tails[fileName]
+	expect.True(tail.isDetached())
+
+	stream.messages = stream.messages[:0]
+	cons.scan(false)
+	expect.Equal(1, len(stream.messages))
+	expect.Equal("1", string(stream.messages[0].Data))
+	expect.Equal([]string{"app.log:2"}, readTestFiles(cons, stream))
+
+	// Truncated files are read from the beginning
+	expect.NoError(os.Truncate(fileName, 0))
+	cons.checkTruncation(cons.tails[fileName])
+	appendTestFile(expect, fileName, "3\n")
+	expect.Equal([]string{"app.log:3"}, readTestFiles(cons, stream))
+	closeTestFiles(cons)
+}
+
+func TestFileRenameInsidePattern(t *testing.T) {
+	expect := shared.NewExpect(t)
+
+	dir, err := ioutil.TempDir("", "gollum_file")
+	expect.NoError(err)
+	defer os.RemoveAll(dir)
+
+	fileName := filepath.Join(dir, "app.log")
+	appendTestFile(expect, fileName, "1\n")
+	stream := &mockHTTPStream{}
+	core.StreamRegistry.Register(stream, core.GetStreamID("fileRename"))
+	conf := core.NewPluginConfig("")
+	conf.Stream = []string{"fileRename"}
+	conf.Override("File", filepath.Join(dir, "app.log*"))
+	conf.Override("DefaultOffset", "oldest")
+	plugin, err := core.NewPluginWithType("consumer.File", conf)
+	expect.NoError(err)
+	cons, casted := plugin.(*File)
+	expect.True(casted)
+	cons.scan(true)
+	expect.Equal([]string{"app.log:1"}, readTestFiles(cons, stream))
+
+	// Renamed files are followed instead of being read again
+	expect.NoError(os.Rename(fileName, fileName+".1"))
+	appendTestFile(expect, fileName+".1", "2\n")
+	appendTestFile(expect, fileName, "3\n")
+	cons.scan(false)
+	expect.Equal(2, len(cons.tails))
+
+	messages := readTestFiles(cons, stream)
+	sort.Strings(messages)
+	expect.Equal([]string{"app.log.1:2", "app.log:3"}, messages)
+	closeTestFiles(cons)
+}
+
+func TestFileLegacyOffset(t *testing.T) {
+	expect := shared.NewExpect(t)
+
+	dir, err := ioutil.TempDir("", "gollum_file")
+	expect.NoError(err)
+	defer os.RemoveAll(dir)
+
+	fileName := filepath.Join(dir, "app.log")
+	appendTestFile(expect, fileName, "1\n2\n")
+	expect.NoError(ioutil.WriteFile(filepath.Join(dir, "offset"), []byte("2"), 0644))
+
+	stream := &mockHTTPStream{}
+	core.StreamRegistry.Register(stream, core.GetStreamID("fileLegacy"))
+	conf := core.NewPluginConfig("")
+	conf.Stream = []string{"fileLegacy"}
+	conf.Override("File", fileName)
+	conf.Override("OffsetFile", filepath.Join(dir, "offset"))
+	plugin, err := core.NewPluginWithType("consumer.File", conf)
+	expect.NoError(err)
+	cons, casted := plugin.(*File)
+	expect.True(casted)
+	cons.loadOffsets()
+	cons.scan(true)
+	expect.Equal([]string{"app.log:2"}, readTestFiles(cons, stream))
+	closeTestFiles(cons)
+}
+
+func TestFileMultiline(t *testing.T) {
+	expect := shared.NewExpect(t)
+
+	dir, err := ioutil.TempDir("", "gollum_file")
+	expect.NoError(err)
+	defer os.RemoveAll(dir)
+
+	fileName := filepath.Join(dir, "app.log")
+	appendTestFile(expect, fileName, "")
+	stream := &mockHTTPStream{}
+	core.StreamRegistry.Register(stream, core.GetStreamID("fileMultiline"))
+	conf := core.NewPluginConfig("")
+	conf.Stream = []string{"fileMultiline"}
+	conf.Override("File", fileName)
+	conf.Override("OffsetFile", filepath.Join(dir, "offsets"))
+	conf.Override("MultilineContinuation", `^Caused by:`)
+	conf.Override("MultilineIndented", true)
+	plugin, err := core.NewPluginWithType("consumer.File", conf)
+	expect.NoError(err)
+	cons, casted := plugin.(*File)
+	expect.True(casted)
+	cons.scan(true)
+
+	appendTestFile(expect, fileName, "start\nerror\n\tat a\nCaused by: b\n\tat c\nnext\n")
+	expect.Equal([]string{"app.log:start", "app.log:error\n\tat a\nCaused by: b\n\tat c"}, readTestFiles(cons, stream))
+
+	// The offset does not contain lines that have not been sent yet
+	tail := cons.tails[fileName]
+	expect.Equal(int64(len("start\nerror\n\tat a\nCaused by: b\n\tat c\n")), tail.offset)
+
+	// Merged messages are sent once the timeout has passed
+	expect.False(tail.multiline.expired(time.Now(), time.Second))
+	expect.True(tail.multiline.expired(time.Now().Add(time.Second), time.Second))
+	stream.messages = stream.messages[:0]
+	cons.flushTail(tail)
+	expect.Equal(1, len(stream.messages))
+	expect.Equal("next", string(stream.messages[0].Data))
+	expect.Equal(int64(len("start\nerror\n\tat a\nCaused by: b\n\tat c\nnext\n")), tail.offset)
+	closeTestFiles(cons)
+
+	conf = core.NewPluginConfig("")
+	conf.Override("Partitioner", "regex")
+	conf.Override("Pattern", "^a")
+	conf.Override("MultilineIndented", true)
+	_, err = core.NewPluginWithType("consumer.File", conf)
+	expect.NotNil(err)
+}
+
+func TestMultilineBufferMaxLines(t *testing.T) {
+	expect := shared.NewExpect(t)
+	buffer := newMultilineBuffer(nil, true, "\n", 2)
+	now := time.Now()
+
+	expect.Nil(buffer.add([]byte("a"), 2, now))
+	expect.Nil(buffer.add([]byte(" b"), 3, now))
+	expect.Equal([]byte("a\n b"), buffer.add([]byte(" c"), 3, now))
+	expect.Equal(int64(3), buffer.size)
+	expect.Equal([]byte(" c"), buffer.flush())
+	expect.Nil(buffer.flush())
+}
@@ -0,0 +1,95 @@
+// Copyright 2015-2016 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumer
+
+import (
+	"regexp"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// multilineBuffer merges continuation lines into the line preceding them,
+// e.g. to keep the lines of a stack trace in a single message.
+type multilineBuffer struct {
+	continuation *regexp.Regexp
+	indented     bool
+	delimiter    []byte
+	maxLines     int
+	data         []byte
+	lines        int
+	size         int64
+	lastAdd      time.Time
+}
+
+func newMultilineBuffer(continuation *regexp.Regexp, indented bool, delimiter string, maxLines int) *multilineBuffer {
+	return &multilineBuffer{
+		continuation: continuation,
+		indented:     indented,
+		delimiter:    []byte(delimiter),
+		maxLines:     maxLines,
+	}
+}
+
+// isContinuation returns true if the given line belongs to the preceding
+// line.
+func (buffer *multilineBuffer) isContinuation(line []byte) bool {
+	if buffer.indented && len(line) > 0 {
+		if char, _ := utf8.DecodeRune(line); unicode.IsSpace(char) {
+			return true
+		}
+	}
+	return buffer.continuation != nil && buffer.continuation.Match(line)
+}
+
+// add appends a line to the buffered message. If the line starts a new
+// message the previously buffered message is returned. A line also starts a
+// new message if the buffered message already has the maximum number of
+// lines. Size defines the number of bytes the line occupies in the source.
+func (buffer *multilineBuffer) add(line []byte, size int64, now time.Time) []byte {
+	var complete []byte
+	isFull := buffer.maxLines > 0 && buffer.lines >= buffer.maxLines
+	if buffer.lines > 0 && (isFull || !buffer.isContinuation(line)) {
+		complete = buffer.flush()
+	}
+
+	if buffer.lines > 0 {
+		buffer.data = append(buffer.data, buffer.delimiter...)
+	}
+	buffer.data = append(buffer.data, line...)
+	buffer.lines++
+	buffer.size += size
+	buffer.lastAdd = now
+	return complete
+}
+
+// flush returns the buffered message and clears the buffer. If no message
+// is buffered nil is returned.
+func (buffer *multilineBuffer) flush() []byte {
+	if buffer.lines == 0 {
+		return nil // ### return, nothing buffered ###
+	}
+	data := buffer.data
+	buffer.data = nil
+	buffer.lines = 0
+	buffer.size = 0
+	return data
+}
+
+// expired returns true if a message is buffered and no line has been added
+// for the given duration.
+func (buffer *multilineBuffer) expired(now time.Time, timeout time.Duration) bool {
+	return buffer.lines > 0 && now.Sub(buffer.lastAdd) >= timeout
+}
@@ -0,0 +1,461 @@
+// Copyright 2015-2016 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumer
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/core/log"
+	"github.com/trivago/gollum/shared"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	fsEventCreate = "create"
+	fsEventModify = "modify"
+	fsEventDelete = "delete"
+	fsEventRename = "rename"
+	fsEventAttrib = "attrib"
+
+	fsEventsMethodAuto    = "auto"
+	fsEventsMethodInotify = "inotify"
+	fsEventsMethodPoll    = "poll"
+
+	fsEventsMetadataEvent = "fs_event"
+)
+
+// FSEvents consumer plugin
+// The FSEvents consumer watches files and directories and emits one JSON
+// message per change. Each message holds the fields "timestamp", "event",
+// "path" and "type". The event is one of "create", "modify", "delete",
+// "rename" or "attrib" (permissions, ownership or timestamps changed).
+// Renames also set "old_path". Files moved into a watched directory from
+// outside are reported as "create", files moved out as "delete". The type is
+// one of "file", "directory", "symlink" or "other". Except for deleted files
+// the fields "size", "mode" and "mod_time" are set, too.
+// Directories added to a watched tree are watched as well. Their contents at
+// that time are reported as "create", so files created right after the
+// directory may be reported twice.
+// On Linux changes are reported by inotify. Other platforms compare the
+// contents of all watched directories in regular intervals. This cannot tell
+// a rename from a delete followed by a create and misses files that exist
+// only for a short time.
+// The path of the changed file is attached to each message as "file_name"
+// metadata and the event as "fs_event" metadata.
+// When attached to a fuse, this consumer will stop reporting events in case
+// that fuse is burned. Inotify queues events in the meantime, which may get
+// lost if too many changes occur. This is logged as a warning.
+// Configuration example
+//
+//  - "consumer.FSEvents":
+//    Paths:
+//      - "/etc"
+//    Recursive: true
+//    Events:
+//      - "create"
+//      - "modify"
+//      - "delete"
+//      - "rename"
+//    Include: []
+//    Exclude: []
+//    Method: "auto"
+//    PollIntervalMs: 1000
+//    ModifyIntervalMs: 1000
+//    RetryDelayMs: 3000
+//
+// Paths defines the files and directories to watch. Paths that do not exist
+// yet are watched as soon as they are created. Symbolic links are followed
+// for these paths only. By default this is set to an empty list.
+//
+// Recursive can be set to false to only watch the direct contents of the
+// given directories. By default this is set to true.
+//
+// Events defines the events to report. By default this is set to "create",
+// "modify", "delete" and "rename".
+//
+// Include defines a list of patterns like "*.conf" matched against the name
+// of a changed file. If set, only changes to files matching any of these
+// patterns are reported. A rename is reported if either the old or the new
+// name matches. By default this is set to an empty list, i.e. all changes are
+// reported.
+//
+// Exclude defines a list of patterns like ".git" or "*.swp" matched against
+// the name of a changed file. Changes to matching files are not reported and
+// matching directories are not watched. By default this is set to an empty
+// list.
+//
+// Method defines how changes are detected. By default this is set to "auto".
+//  * "inotify" uses inotify and is only supported on Linux.
+//  * "poll" compares the contents of the watched directories in regular
+//    intervals.
+//  * "auto" uses inotify on Linux and polling on all other platforms.
+//
+// PollIntervalMs defines the number of milliseconds between two comparisons
+// of the "poll" method. By default this is set to 1000.
+//
+// ModifyIntervalMs defines the number of milliseconds in which at most one
+// "modify" event is reported per file. Files are often written in many small
+// chunks which would otherwise cause one event for each write. Set to 0 to
+// report every write. By default this is set to 1000.
+//
+// RetryDelayMs defines the number of milliseconds to wait before missing
+// paths are tried to be watched or the watch is restarted after an error.
+// By default this is set to 3000.
+type FSEvents struct {
+	core.ConsumerBase
+	paths          []string
+	recursive      bool
+	events         map[string]bool
+	include        []string
+	exclude        []string
+	method         string
+	pollInterval   time.Duration
+	modifyInterval time.Duration
+	retryDelay     time.Duration
+	lastModify     map[string]time.Time
+	modifyCleanup  time.Time
+	sequence       uint64
+	watcher        fsWatcher
+	guard          *sync.Mutex
+	ctx            context.Context
+	cancel         context.CancelFunc
+}
+
+// fsEvent is a change reported by a filesystem watcher.
+type fsEvent struct {
+	op      string
+	path    string
+	oldPath string
+	isDir   bool
+}
+
+// fsEventMessage is the JSON representation of an fsEvent.
+type fsEventMessage struct {
+	Timestamp string `json:"timestamp"`
+	Event     string `json:"event"`
+	Path      string `json:"path"`
+	OldPath   string `json:"old_path,omitempty"`
+	Type      string `json:"type"`
+	Size      *int64 `json:"size,omitempty"`
+	Mode      string `json:"mode,omitempty"`
+	ModTime   string `json:"mod_time,omitempty"`
+}
+
+// fsWatchConfig defines what a filesystem watcher observes.
+type fsWatchConfig struct {
+	roots      []string
+	recursive  bool
+	skip       func(path string) bool
+	retryDelay time.Duration
+}
+
+// fsWatcher reports changes to files and directories.
+type fsWatcher interface {
+	// run passes all changes to handle until close is called or an error
+	// occurs.
+	run(handle func(event fsEvent)) error
+
+	// close stops run. It can be called from any go routine.
+	close()
+}
+
+func init() {
+	shared.TypeRegistry.Register(FSEvents{})
+}
+
+// Configure initializes this consumer with values from a plugin config.
+func (cons *FSEvents) Configure(conf core.PluginConfig) error {
+	err := cons.ConsumerBase.Configure(conf)
+	if err != nil {
+		return err
+	}
+
+	cons.paths = conf.GetStringArray("Paths", []string{})
+	for i, path := range cons.paths {
+		cons.paths[i] = filepath.Clean(path)
+	}
+	cons.recursive = conf.GetBool("Recursive", true)
+
+	cons.events = make(map[string]bool)
+	for _, event := range conf.GetStringArray("Events", []string{fsEventCreate, fsEventModify, fsEventDelete, fsEventRename}) {
+		switch event = strings.ToLower(event); event {
+		case fsEventCreate, fsEventModify, fsEventDelete, fsEventRename, fsEventAttrib:
+			cons.events[event] = true
+		default:
+			return fmt.Errorf("Unknown event: %s", event)
+		}
+	}
+
+	cons.include = conf.GetStringArray("Include", []string{})
+	cons.exclude = conf.GetStringArray("Exclude", []string{})
+	for _, pattern := range append(append([]string{}, cons.include...), cons.exclude...) {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return fmt.Errorf("Invalid pattern %s: %s", pattern, err.Error())
+		}
+	}
+
+	switch cons.method = strings.ToLower(conf.GetString("Method", fsEventsMethodAuto)); cons.method {
+	case fsEventsMethodAuto:
+		cons.method = fsEventsMethodPoll
+		if fsNotifySupported {
+			cons.method = fsEventsMethodInotify
+		}
+	case fsEventsMethodInotify:
+		if !fsNotifySupported {
+			return fmt.Errorf("Method inotify is not supported on this platform")
+		}
+	case fsEventsMethodPoll:
+	default:
+		return fmt.Errorf("Unknown method: %s", cons.method)
+	}
+
+	cons.pollInterval = time.Duration(shared.MaxI(conf.GetInt("PollIntervalMs", 1000), 1)) * time.Millisecond
+	cons.modifyInterval = time.Duration(shared.MaxI(conf.GetInt("ModifyIntervalMs", 1000), 0)) * time.Millisecond
+	cons.retryDelay = time.Duration(shared.MaxI(conf.GetInt("RetryDelayMs", 3000), 1)) * time.Millisecond
+	cons.lastModify = make(map[string]time.Time)
+	cons.guard = new(sync.Mutex)
+	cons.ctx, cons.cancel = context.WithCancel(context.Background())
+	return nil
+}
+
+// matchesAny returns true if the name of the given path matches one of the
+// given patterns.
+func matchesAny(path string, patterns []string) bool {
+	name := filepath.Base(path)
+	for _, pattern := range patterns {
+		if matched, _ := filepath.Match(pattern, name); matched {
+			return true
+		}
+	}
+	return false
+}
+
+func (cons *FSEvents) isExcluded(path string) bool {
+	return matchesAny(path, cons.exclude)
+}
+
+func (cons *FSEvents) isIncluded(path string) bool {
+	return path != "" && !cons.isExcluded(path) && (len(cons.include) == 0 || matchesAny(path, cons.include))
+}
+
+// allowModify returns false if a modify event for the given path has been
+// reported within the modify interval. Paths not modified for a whole
+// interval are forgotten.
+func (cons *FSEvents) allowModify(path string, now time.Time) bool {
+	if cons.modifyInterval <= 0 {
+		return true // ### return, every write is reported ###
+	}
+
+	if now.Sub(cons.modifyCleanup) >= cons.modifyInterval {
+		for name, last := range cons.lastModify {
+			if now.Sub(last) >= cons.modifyInterval {
+				delete(cons.lastModify, name)
+			}
+		}
+		cons.modifyCleanup = now
+	}
+
+	if last, exists := cons.lastModify[path]; exists && now.Sub(last) < cons.modifyInterval {
+		return false // ### return, reported recently ###
+	}
+	cons.lastModify[path] = now
+	return true
+}
+
+// fsEventType returns the type name of the given file mode.
+func fsEventType(mode os.FileMode) string {
+	switch {
+	case mode.IsRegular():
+		return "file"
+	case mode.IsDir():
+		return "directory"
+	case mode&os.ModeSymlink != 0:
+		return "symlink"
+	default:
+		return "other"
+	}
+}
+
+// newFSEventMessage converts an event to JSON. The file is examined for all
+// events but delete, which only knows whether a directory was removed.
+func newFSEventMessage(event fsEvent, now time.Time) ([]byte, error) {
+	message := fsEventMessage{
+		Timestamp: now.UTC().Format(time.RFC3339Nano),
+		Event:     event.op,
+		Path:      event.path,
+		OldPath:   event.oldPath,
+		Type:      "file",
+	}
+	if event.isDir {
+		message.Type = "directory"
+	}
+
+	if event.op != fsEventDelete {
+		if info, err := os.Lstat(event.path); err == nil {
+			size := info.Size()
+			message.Type = fsEventType(info.Mode())
+			message.Size = &size
+			message.Mode = fmt.Sprintf("%04o", info.Mode().Perm())
+			message.ModTime = info.ModTime().UTC().Format(time.RFC3339Nano)
+		}
+	}
+	return json.Marshal(message)
+}
+
+// handle filters an event and sends it as a message. This is called by the
+// watcher only, so no locking is required.
+func (cons *FSEvents) handle(event fsEvent) {
+	if !cons.events[event.op] || (!cons.isIncluded(event.path) && !cons.isIncluded(event.oldPath)) {
+		return // ### return, not reported ###
+	}
+
+	now := time.Now()
+	switch event.op {
+	case fsEventModify:
+		if !cons.allowModify(event.path, now) {
+			return // ### return, reported recently ###
+		}
+	case fsEventDelete, fsEventRename:
+		delete(cons.lastModify, event.path)
+		delete(cons.lastModify, event.oldPath)
+	}
+
+	data, err := newFSEventMessage(event, now)
+	if err != nil {
+		Log.Error.Print("FSEvents failed to encode event for ", event.path, ": ", err)
+		return // ### return, invalid event ###
+	}
+
+	cons.WaitOnFuse()
+	msg := core.NewMessage(cons, data, atomic.AddUint64(&cons.sequence, 1))
+	msg.SetMetadata(core.MetadataFileName, event.path)
+	msg.SetMetadata(fsEventsMetadataEvent, event.op)
+	cons.EnqueueMessage(msg)
+}
+
+func (cons *FSEvents) sleep(duration time.Duration) {
+	select {
+	case <-cons.ctx.Done():
+	case <-time.After(duration):
+	}
+}
+
+// connect starts a new watcher. The watcher is kept so that it can be closed
+// when the consumer is stopped.
+func (cons *FSEvents) connect() (fsWatcher, error) {
+	config := fsWatchConfig{
+		roots:      cons.paths,
+		recursive:  cons.recursive,
+		skip:       cons.isExcluded,
+		retryDelay: cons.retryDelay,
+	}
+
+	var watcher fsWatcher
+	if cons.method == fsEventsMethodInotify {
+		var err error
+		if watcher, err = newFSNotifyWatcher(config); err != nil {
+			return nil, err // ### return, inotify failed ###
+		}
+	} else {
+		watcher = newFSPollWatcher(config, cons.pollInterval)
+	}
+
+	cons.guard.Lock()
+	defer cons.guard.Unlock()
+	if !cons.IsActive() {
+		watcher.close()
+		return nil, context.Canceled // ### return, consumer stopped ###
+	}
+	cons.watcher = watcher
+	return watcher, nil
+}
+
+func (cons *FSEvents) disconnect() {
+	cons.guard.Lock()
+	defer cons.guard.Unlock()
+	if cons.watcher != nil {
+		cons.watcher.close()
+		cons.watcher = nil
+	}
+}
+
+func (cons *FSEvents) watch() {
+	defer cons.WorkerDone()
+
+	for cons.IsActive() {
+		watcher, err := cons.connect()
+		if err != nil {
+			if cons.IsActive() {
+				Log.Error.Print("FSEvents failed to start watching: ", err)
+				cons.sleep(cons.retryDelay)
+			}
+			continue // ### continue, retry ###
+		}
+
+		if err := watcher.run(cons.handle); err != nil && cons.IsActive() {
+			Log.Error.Print("FSEvents watch failed: ", err)
+		}
+		cons.disconnect()
+
+		if cons.IsActive() {
+			cons.sleep(cons.retryDelay)
+		}
+	}
+}
+
+func (cons *FSEvents) close() {
+	cons.cancel()
+	cons.disconnect()
+}
+
+// Consume starts watching the configured paths.
+func (cons *FSEvents) Consume(workers *sync.WaitGroup) {
+	cons.SetWorkerWaitGroup(workers)
+	cons.SetStopCallback(cons.close)
+
+	cons.AddWorker()
+	go shared.DontPanic(cons.watch)
+
+	cons.ControlLoop()
+}
+
+// walkFSTree calls visit for all entries of the given directory and, if
+// recursive is set, of all directories below. Directories are visited before
+// their contents. Symbolic links are not followed and entries matching skip
+// are left out. Directories that cannot be read are ignored.
+func walkFSTree(dir string, recursive bool, skip func(string) bool, visit func(string, os.FileInfo)) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return // ### return, not readable ###
+	}
+	for _, info := range entries {
+		path := filepath.Join(dir, info.Name())
+		if skip(path) {
+			continue // ### continue, excluded ###
+		}
+		visit(path, info)
+		if recursive && info.IsDir() {
+			walkFSTree(path, recursive, skip, visit)
+		}
+	}
+}
@@ -0,0 +1,365 @@
+// Copyright 2015-2016 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build linux
+// +build linux
+
+package consumer
+
+import (
+	"github.com/trivago/gollum/core/log"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+const (
+	fsNotifySupported = true
+
+	fsNotifyMask = syscall.IN_CREATE | syscall.IN_DELETE | syscall.IN_MODIFY |
+		syscall.IN_ATTRIB | syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO |
+		syscall.IN_DELETE_SELF | syscall.IN_MOVE_SELF
+	fsNotifyBufferSize = 64 * 1024
+
+	// fsNotifyMoveTimeout is the time to wait for the second half of a
+	// rename. Both halves are usually returned by the same read.
+	fsNotifyMoveTimeout = 50 * time.Millisecond
+)
+
+// fsNotifyMove is the first half of a rename waiting for its second half.
+type fsNotifyMove struct {
+	cookie uint32
+	path   string
+	isDir  bool
+}
+
+// fsNotifyRoot is a watched root. Events of the root itself do not tell
+// whether it is a directory.
+type fsNotifyRoot struct {
+	wd    int32
+	isDir bool
+}
+
+// fsNotifyWatcher reports changes using inotify. Directories are watched
+// one by one, each event refers to a file inside a watched directory or to
+// the watched file itself.
+type fsNotifyWatcher struct {
+	config      fsWatchConfig
+	file        *os.File
+	watches     map[int32]string
+	roots       map[string]fsNotifyRoot
+	missing     []string
+	nextRetry   time.Time
+	pendingMove *fsNotifyMove
+}
+
+// newFSNotifyWatcher creates an inotify instance and watches all roots.
+// Roots that cannot be watched are retried in run.
+func newFSNotifyWatcher(config fsWatchConfig) (fsWatcher, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, os.NewSyscallError("inotify_init1", err)
+	}
+
+	// Non-blocking descriptors are handled by the runtime's poller, which
+	// allows read deadlines and interrupting reads by closing the file.
+	watcher := &fsNotifyWatcher{
+		config:  config,
+		file:    os.NewFile(uintptr(fd), "inotify"),
+		watches: make(map[int32]string),
+		roots:   make(map[string]fsNotifyRoot),
+	}
+
+	for _, root := range config.roots {
+		if err := watcher.addTree(root, true, nil); err != nil {
+			Log.Warning.Print("FSEvents cannot watch ", root, " yet: ", err)
+			watcher.setMissing(root)
+		}
+	}
+	return watcher, nil
+}
+
+// control runs the given function with the inotify descriptor. The
+// descriptor cannot be closed while the function runs.
+func (watcher *fsNotifyWatcher) control(function func(fd int) error) error {
+	raw, err := watcher.file.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var callErr error
+	if err := raw.Control(func(fd uintptr) { callErr = function(int(fd)) }); err != nil {
+		return err
+	}
+	return callErr
+}
+
+func (watcher *fsNotifyWatcher) addWatch(path string, follow bool) (int32, error) {
+	mask := uint32(fsNotifyMask)
+	if !follow {
+		mask |= syscall.IN_DONT_FOLLOW
+	}
+
+	var wd int
+	err := watcher.control(func(fd int) error {
+		var err error
+		wd, err = syscall.InotifyAddWatch(fd, path, mask)
+		return err
+	})
+	if err != nil {
+		return 0, os.NewSyscallError("inotify_add_watch", err)
+	}
+	watcher.watches[int32(wd)] = path
+	return int32(wd), nil
+}
+
+// addTree watches the given path and, if recursive is set, all directories
+// below. If handle is given, all entries found are reported as created.
+func (watcher *fsNotifyWatcher) addTree(path string, isRoot bool, handle func(fsEvent)) error {
+	stat := os.Lstat
+	if isRoot {
+		stat = os.Stat
+	}
+	info, err := stat(path)
+	if err != nil {
+		return err // ### return, not found ###
+	}
+
+	wd, err := watcher.addWatch(path, isRoot)
+	if err != nil {
+		return err // ### return, watch failed ###
+	}
+	if isRoot {
+		watcher.roots[path] = fsNotifyRoot{wd: wd, isDir: info.IsDir()}
+	}
+	if !info.IsDir() {
+		return nil // ### return, single file ###
+	}
+
+	walkFSTree(path, watcher.config.recursive, watcher.config.skip, func(child string, info os.FileInfo) {
+		if handle != nil {
+			handle(fsEvent{op: fsEventCreate, path: child, isDir: info.IsDir()})
+		}
+		if watcher.config.recursive && info.IsDir() {
+			if _, err := watcher.addWatch(child, false); err != nil {
+				Log.Warning.Print("FSEvents cannot watch ", child, ": ", err)
+			}
+		}
+	})
+	return nil
+}
+
+// removeTree stops watching the given directory and all directories below.
+func (watcher *fsNotifyWatcher) removeTree(path string) {
+	for wd, watched := range watcher.watches {
+		if watched == path || strings.HasPrefix(watched, path+string(filepath.Separator)) {
+			watcher.control(func(fd int) error {
+				_, err := syscall.InotifyRmWatch(fd, uint32(wd))
+				return err
+			})
+			delete(watcher.watches, wd)
+		}
+	}
+}
+
+// moveTree updates the paths of all watches below a renamed directory.
+func (watcher *fsNotifyWatcher) moveTree(oldPath, newPath string) {
+	for wd, watched := range watcher.watches {
+		if watched == oldPath || strings.HasPrefix(watched, oldPath+string(filepath.Separator)) {
+			watcher.watches[wd] = newPath + watched[len(oldPath):]
+		}
+	}
+}
+
+func (watcher *fsNotifyWatcher) setMissing(root string) {
+	if len(watcher.missing) == 0 {
+		watcher.nextRetry = time.Now().Add(watcher.config.retryDelay)
+	}
+	watcher.missing = append(watcher.missing, root)
+}
+
+// retryMissing watches all roots that have become available. Watching a
+// root that appeared reports the root and its contents as created.
+func (watcher *fsNotifyWatcher) retryMissing(handle func(fsEvent)) {
+	missing := watcher.missing
+	watcher.missing = nil
+	for _, root := range missing {
+		info, err := os.Stat(root)
+		if err == nil {
+			handle(fsEvent{op: fsEventCreate, path: root, isDir: info.IsDir()})
+			err = watcher.addTree(root, true, handle)
+		}
+		if err != nil {
+			watcher.setMissing(root)
+		}
+	}
+	watcher.nextRetry = time.Now().Add(watcher.config.retryDelay)
+}
+
+// flushMove reports a rename without second half, i.e. the file has been
+// moved out of the watched tree.
+func (watcher *fsNotifyWatcher) flushMove(handle func(fsEvent)) {
+	if move := watcher.pendingMove; move != nil {
+		watcher.pendingMove = nil
+		handle(fsEvent{op: fsEventDelete, path: move.path, isDir: move.isDir})
+		if move.isDir {
+			watcher.removeTree(move.path)
+		}
+	}
+}
+
+// processSelf handles events of a watched path itself. Only roots are
+// reported as changes of other paths are reported by their parent.
+func (watcher *fsNotifyWatcher) processSelf(wd int32, path string, mask uint32, handle func(fsEvent)) {
+	root, isRoot := watcher.roots[path]
+	if !isRoot || root.wd != wd {
+		return // ### return, reported by parent ###
+	}
+
+	isDir := root.isDir
+	switch {
+	case mask&syscall.IN_MODIFY != 0:
+		handle(fsEvent{op: fsEventModify, path: path})
+	case mask&syscall.IN_ATTRIB != 0:
+		handle(fsEvent{op: fsEventAttrib, path: path, isDir: isDir})
+	case mask&syscall.IN_DELETE_SELF != 0:
+		handle(fsEvent{op: fsEventDelete, path: path, isDir: isDir})
+	case mask&syscall.IN_MOVE_SELF != 0:
+		// The new name is unknown, so the root is treated as deleted and
+		// watched again once it reappears, e.g. after a log rotation.
+		handle(fsEvent{op: fsEventDelete, path: path, isDir: isDir})
+		delete(watcher.roots, path)
+		watcher.removeTree(path)
+		watcher.setMissing(path)
+	}
+}
+
+// process handles a single inotify event.
+func (watcher *fsNotifyWatcher) process(wd int32, mask uint32, cookie uint32, name string, handle func(fsEvent)) {
+	if mask&syscall.IN_Q_OVERFLOW != 0 {
+		Log.Warning.Print("FSEvents inotify queue overflowed, events have been lost")
+		return // ### return, no event ###
+	}
+	if move := watcher.pendingMove; move != nil && (mask&syscall.IN_MOVED_TO == 0 || cookie != move.cookie) {
+		watcher.flushMove(handle)
+	}
+
+	dir, known := watcher.watches[wd]
+	if !known {
+		return // ### return, watch already removed ###
+	}
+	if mask&syscall.IN_IGNORED != 0 {
+		delete(watcher.watches, wd)
+		if root, isRoot := watcher.roots[dir]; isRoot && root.wd == wd {
+			delete(watcher.roots, dir)
+			watcher.setMissing(dir)
+		}
+		return // ### return, watch removed ###
+	}
+	if name == "" {
+		watcher.processSelf(wd, dir, mask, handle)
+		return // ### return, event of watched path ###
+	}
+
+	path := filepath.Join(dir, name)
+	isDir := mask&syscall.IN_ISDIR != 0
+	watchDir := isDir && watcher.config.recursive && !watcher.config.skip(path)
+
+	switch {
+	case mask&syscall.IN_CREATE != 0:
+		handle(fsEvent{op: fsEventCreate, path: path, isDir: isDir})
+		if watchDir {
+			watcher.addTree(path, false, handle)
+		}
+
+	case mask&syscall.IN_MOVED_FROM != 0:
+		watcher.pendingMove = &fsNotifyMove{cookie: cookie, path: path, isDir: isDir}
+
+	case mask&syscall.IN_MOVED_TO != 0:
+		move := watcher.pendingMove
+		watcher.pendingMove = nil
+		switch {
+		case move == nil:
+			handle(fsEvent{op: fsEventCreate, path: path, isDir: isDir})
+			if watchDir {
+				watcher.addTree(path, false, handle)
+			}
+		case isDir:
+			handle(fsEvent{op: fsEventRename, path: path, oldPath: move.path, isDir: true})
+			watcher.moveTree(move.path, path)
+		default:
+			handle(fsEvent{op: fsEventRename, path: path, oldPath: move.path})
+		}
+
+	case mask&syscall.IN_DELETE != 0:
+		handle(fsEvent{op: fsEventDelete, path: path, isDir: isDir})
+
+	case mask&syscall.IN_MODIFY != 0:
+		handle(fsEvent{op: fsEventModify, path: path})
+
+	case mask&syscall.IN_ATTRIB != 0:
+		handle(fsEvent{op: fsEventAttrib, path: path, isDir: isDir})
+	}
+}
+
+// setDeadline wakes up run to complete a pending rename or to retry missing
+// roots.
+func (watcher *fsNotifyWatcher) setDeadline() {
+	deadline := time.Time{}
+	if len(watcher.missing) > 0 {
+		deadline = watcher.nextRetry
+	}
+	if watcher.pendingMove != nil {
+		if moveDeadline := time.Now().Add(fsNotifyMoveTimeout); deadline.IsZero() || moveDeadline.Before(deadline) {
+			deadline = moveDeadline
+		}
+	}
+	watcher.file.SetReadDeadline(deadline)
+}
+
+func (watcher *fsNotifyWatcher) run(handle func(fsEvent)) error {
+	buffer := make([]byte, fsNotifyBufferSize)
+	for {
+		watcher.setDeadline()
+		size, err := watcher.file.Read(buffer)
+		if os.IsTimeout(err) {
+			watcher.flushMove(handle)
+			if len(watcher.missing) > 0 && !time.Now().Before(watcher.nextRetry) {
+				watcher.retryMissing(handle)
+			}
+			continue // ### continue, deadline reached ###
+		}
+		if err != nil {
+			return err // ### return, closed ###
+		}
+
+		for offset := 0; offset+syscall.SizeofInotifyEvent <= size; {
+			event := (*syscall.InotifyEvent)(unsafe.Pointer(&buffer[offset]))
+			nameStart := offset + syscall.SizeofInotifyEvent
+			nameEnd := nameStart + int(event.Len)
+			if nameEnd > size {
+				break // ### break, truncated event ###
+			}
+			name := strings.TrimRight(string(buffer[nameStart:nameEnd]), "\x00")
+			watcher.process(event.Wd, event.Mask, event.Cookie, name, handle)
+			offset = nameEnd
+		}
+	}
+}
+
+func (watcher *fsNotifyWatcher) close() {
+	watcher.file.Close()
+}
@@ -0,0 +1,305 @@
+// Copyright 2015-2016 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumer
+
+import (
+	"encoding/json"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/shared"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testFSEvents returns "<event> <path>[ <old_path>]" for all messages
+// received, with paths relative to dir.
+func testFSEvents(expect shared.Expect, stream *mockHTTPStream, dir string) []string {
+	stream.guard.Lock()
+	defer stream.guard.Unlock()
+
+	events := []string{}
+	for _, msg := range stream.messages {
+		event := fsEventMessage{}
+		expect.NoError(json.Unmarshal(msg.Data, &event))
+		expect.Equal(event.Event, msg.Metadata[fsEventsMetadataEvent])
+		expect.Equal(event.Path, msg.Metadata[core.MetadataFileName])
+
+		path, _ := filepath.Rel(dir, event.Path)
+		text := event.Event + " " + path
+		if event.OldPath != "" {
+			oldPath, _ := filepath.Rel(dir, event.OldPath)
+			text += " " + oldPath
+		}
+		events = append(events, text)
+	}
+	return events
+}
+
+func TestFSEventsFilter(t *testing.T) {
+	expect := shared.NewExpect(t)
+
+	conf := core.NewPluginConfig("")
+	conf.Override("Include", []string{"*.conf"})
+	conf.Override("Exclude", []string{".git", "skip.conf"})
+	plugin, err := core.NewPluginWithType("consumer.FSEvents", conf)
+	expect.NoError(err)
+	cons := plugin.(*FSEvents)
+
+	expect.True(cons.isIncluded("/etc/app.conf"))
+	expect.False(cons.isIncluded("/etc/app.txt"))
+	expect.False(cons.isIncluded("/etc/skip.conf"))
+	expect.True(cons.isExcluded("/srv/.git"))
+	expect.False(cons.isExcluded("/srv/.gitignore"))
+
+	now := time.Now()
+	expect.True(cons.allowModify("/etc/app.conf", now))
+	expect.False(cons.allowModify("/etc/app.conf", now.Add(500*time.Millisecond)))
+	expect.True(cons.allowModify("/etc/other.conf", now))
+	expect.True(cons.allowModify("/etc/app.conf", now.Add(time.Second)))
+}
+
+func TestFSPollWatcherCompare(t *testing.T) {
+	expect := shared.NewExpect(t)
+
+	modTime := time.Now()
+	previous := map[string]fsPollEntry{
+		"/a":     {isDir: true, mode: os.ModeDir | 0755},
+		"/a/b":   {size: 1, mode: 0644, modTime: modTime},
+		"/a/c":   {size: 1, mode: 0644, modTime: modTime},
+		"/a/d":   {isDir: true, mode: os.ModeDir | 0755},
+		"/a/d/e": {size: 1, mode: 0644, modTime: modTime},
+	}
+	current := map[string]fsPollEntry{
+		"/a":   {isDir: true, mode: os.ModeDir | 0755, modTime: modTime},
+		"/a/b": {size: 2, mode: 0644, modTime: modTime},
+		"/a/c": {size: 1, mode: 0600, modTime: modTime},
+		"/a/f": {size: 1, mode: 0644, modTime: modTime},
+	}
+
+	events := []fsEvent{}
+	watcher := newFSPollWatcher(fsWatchConfig{}, time.Second)
+	watcher.compare(previous, current, func(event fsEvent) {
+		events = append(events, event)
+	})
+	expect.Equal([]fsEvent{
+		{op: fsEventModify, path: "/a/b"},
+		{op: fsEventAttrib, path: "/a/c"},
+		{op: fsEventCreate, path: "/a/f"},
+		{op: fsEventDelete, path: "/a/d/e"},
+		{op: fsEventDelete, path: "/a/d", isDir: true},
+	}, events)
+}
+
+func TestFSEvents(t *testing.T) {
+	expect := shared.NewExpect(t)
+	if !fsNotifySupported {
+		t.Skip("requires inotify")
+	}
+
+	dir, err := ioutil.TempDir("", "gollum_fsevents")
+	expect.NoError(err)
+	defer os.RemoveAll(dir)
+	watched := filepath.Join(dir, "watched")
+	expect.NoError(os.Mkdir(watched, 0755))
+
+	stream := &mockHTTPStream{}
+	core.StreamRegistry.Register(stream, core.GetStreamID("fsEvents"))
+	conf := core.NewPluginConfig("")
+	conf.Stream = []string{"fsEvents"}
+	conf.Override("Paths", []string{watched})
+	conf.Override("Events", []string{"create", "modify", "delete", "rename", "attrib"})
+	conf.Override("Exclude", []string{"*.tmp"})
+	conf.Override("ModifyIntervalMs", 0)
+	plugin, err := core.NewPluginWithType("consumer.FSEvents", conf)
+	expect.NoError(err)
+	cons, casted := plugin.(*FSEvents)
+	expect.True(casted)
+
+	workers := new(sync.WaitGroup)
+	go cons.Consume(workers)
+	time.Sleep(100 * time.Millisecond)
+
+	expect.NoError(ioutil.WriteFile(filepath.Join(watched, "a.txt"), []byte("a"), 0644))
+	expect.NoError(ioutil.WriteFile(filepath.Join(watched, "a.tmp"), []byte("a"), 0644))
+	waitForTestMessages(expect, stream, 2)
+
+	expect.NoError(os.Rename(filepath.Join(watched, "a.txt"), filepath.Join(watched, "b.txt")))
+	expect.NoError(os.Chmod(filepath.Join(watched, "b.txt"), 0600))
+	expect.NoError(os.Mkdir(filepath.Join(watched, "sub"), 0755))
+	waitForTestMessages(expect, stream, 5)
+
+	expect.NoError(ioutil.WriteFile(filepath.Join(watched, "sub", "c.txt"), []byte("c"), 0644))
+	waitForTestMessages(expect, stream, 7)
+
+	expect.NoError(os.Rename(filepath.Join(watched, "sub"), filepath.Join(watched, "moved")))
+	expect.NoError(os.Remove(filepath.Join(watched, "moved", "c.txt")))
+	expect.NoError(os.Rename(filepath.Join(watched, "moved"), filepath.Join(dir, "outside")))
+	expect.NoError(os.Remove(filepath.Join(watched, "b.txt")))
+	waitForTestMessages(expect, stream, 11)
+
+	cons.Control() <- core.PluginControlStopConsumer
+	expect.NonBlocking(2*time.Second, workers.Wait)
+
+	expect.Equal([]string{
+		"create a.txt",
+		"modify a.txt",
+		"rename b.txt a.txt",
+		"attrib b.txt",
+		"create sub",
+		"create sub/c.txt",
+		"modify sub/c.txt",
+		"rename moved sub",
+		"delete moved/c.txt",
+		"delete moved",
+		"delete b.txt",
+	}, testFSEvents(expect, stream, watched))
+
+	stream.guard.Lock()
+	event := fsEventMessage{}
+	expect.NoError(json.Unmarshal(stream.messages[3].Data, &event))
+	stream.guard.Unlock()
+	expect.Equal("file", event.Type)
+	expect.Equal("0600", event.Mode)
+	expect.Equal(int64(1), *event.Size)
+}
+
+func TestFSEventsRotation(t *testing.T) {
+	expect := shared.NewExpect(t)
+	if !fsNotifySupported {
+		t.Skip("requires inotify")
+	}
+
+	dir, err := ioutil.TempDir("", "gollum_fsevents")
+	expect.NoError(err)
+	defer os.RemoveAll(dir)
+	logFile := filepath.Join(dir, "app.log")
+
+	stream := &mockHTTPStream{}
+	core.StreamRegistry.Register(stream, core.GetStreamID("fsEventsRotation"))
+	conf := core.NewPluginConfig("")
+	conf.Stream = []string{"fsEventsRotation"}
+	conf.Override("Paths", []string{logFile})
+	conf.Override("ModifyIntervalMs", 0)
+	conf.Override("RetryDelayMs", 20)
+	plugin, err := core.NewPluginWithType("consumer.FSEvents", conf)
+	expect.NoError(err)
+	cons, casted := plugin.(*FSEvents)
+	expect.True(casted)
+
+	workers := new(sync.WaitGroup)
+	go cons.Consume(workers)
+	time.Sleep(100 * time.Millisecond)
+
+	expect.NoError(ioutil.WriteFile(logFile, nil, 0644))
+	waitForTestMessages(expect, stream, 1)
+	file, err := os.OpenFile(logFile, os.O_WRONLY|os.O_APPEND, 0644)
+	expect.NoError(err)
+	_, err = file.Write([]byte("line\n"))
+	expect.NoError(err)
+	file.Close()
+	waitForTestMessages(expect, stream, 2)
+
+	expect.NoError(os.Rename(logFile, logFile+".1"))
+	waitForTestMessages(expect, stream, 3)
+	expect.NoError(ioutil.WriteFile(logFile, nil, 0644))
+	waitForTestMessages(expect, stream, 4)
+
+	cons.Control() <- core.PluginControlStopConsumer
+	expect.NonBlocking(2*time.Second, workers.Wait)
+
+	expect.Equal([]string{
+		"create app.log",
+		"modify app.log",
+		"delete app.log",
+		"create app.log",
+	}, testFSEvents(expect, stream, dir))
+}
+
+func TestFSEventsPoll(t *testing.T) {
+	expect := shared.NewExpect(t)
+
+	dir, err := ioutil.TempDir("", "gollum_fsevents")
+	expect.NoError(err)
+	defer os.RemoveAll(dir)
+	watched := filepath.Join(dir, "watched")
+	later := filepath.Join(dir, "later")
+	expect.NoError(os.Mkdir(watched, 0755))
+
+	stream := &mockHTTPStream{}
+	core.StreamRegistry.Register(stream, core.GetStreamID("fsEventsPoll"))
+	conf := core.NewPluginConfig("")
+	conf.Stream = []string{"fsEventsPoll"}
+	conf.Override("Paths", []string{watched, later})
+	conf.Override("Recursive", false)
+	conf.Override("Method", "poll")
+	conf.Override("PollIntervalMs", 20)
+	conf.Override("ModifyIntervalMs", 0)
+	plugin, err := core.NewPluginWithType("consumer.FSEvents", conf)
+	expect.NoError(err)
+	cons, casted := plugin.(*FSEvents)
+	expect.True(casted)
+
+	workers := new(sync.WaitGroup)
+	go cons.Consume(workers)
+	time.Sleep(100 * time.Millisecond)
+
+	expect.NoError(ioutil.WriteFile(filepath.Join(watched, "a.txt"), []byte("a"), 0644))
+	waitForTestMessages(expect, stream, 1)
+	expect.NoError(ioutil.WriteFile(filepath.Join(watched, "a.txt"), []byte("ab"), 0644))
+	waitForTestMessages(expect, stream, 2)
+	expect.NoError(os.Remove(filepath.Join(watched, "a.txt")))
+	waitForTestMessages(expect, stream, 3)
+
+	// Missing paths are watched once they appear, subdirectories are not
+	// watched as Recursive is disabled
+	expect.NoError(os.Mkdir(later, 0755))
+	waitForTestMessages(expect, stream, 4)
+	expect.NoError(os.MkdirAll(filepath.Join(later, "sub", "deep"), 0755))
+	waitForTestMessages(expect, stream, 5)
+	expect.NoError(ioutil.WriteFile(filepath.Join(later, "b.txt"), []byte("b"), 0644))
+	waitForTestMessages(expect, stream, 6)
+
+	cons.Control() <- core.PluginControlStopConsumer
+	expect.NonBlocking(2*time.Second, workers.Wait)
+
+	expect.Equal([]string{
+		"create watched/a.txt",
+		"modify watched/a.txt",
+		"delete watched/a.txt",
+		"create later",
+		"create later/sub",
+		"create later/b.txt",
+	}, testFSEvents(expect, stream, dir))
+}
+
+func TestFSEventsConfigure(t *testing.T) {
+	expect := shared.NewExpect(t)
+
+	for _, settings := range []map[string]interface{}{
+		{"Events": []string{"open"}},
+		{"Include": []string{"["}},
+		{"Method": "kqueue"},
+	} {
+		conf := core.NewPluginConfig("")
+		for key, value := range settings {
+			conf.Override(key, value)
+		}
+		_, err := core.NewPluginWithType("consumer.FSEvents", conf)
+		expect.NotNil(err)
+	}
+}
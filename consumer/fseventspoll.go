@@ -0,0 +1,133 @@
+// Copyright 2015-2016 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumer
+
+import (
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// fsPollEntry is the state of a file at the time of a scan.
+type fsPollEntry struct {
+	isDir   bool
+	mode    os.FileMode
+	size    int64
+	modTime time.Time
+}
+
+// fsPollWatcher detects changes by comparing the contents of all watched
+// directories in regular intervals.
+type fsPollWatcher struct {
+	config    fsWatchConfig
+	interval  time.Duration
+	stop      chan struct{}
+	closeOnce *sync.Once
+}
+
+func newFSPollWatcher(config fsWatchConfig, interval time.Duration) *fsPollWatcher {
+	return &fsPollWatcher{
+		config:    config,
+		interval:  interval,
+		stop:      make(chan struct{}),
+		closeOnce: new(sync.Once),
+	}
+}
+
+func newFSPollEntry(info os.FileInfo) fsPollEntry {
+	return fsPollEntry{
+		isDir:   info.IsDir(),
+		mode:    info.Mode(),
+		size:    info.Size(),
+		modTime: info.ModTime(),
+	}
+}
+
+// scan returns the state of all watched files. Missing roots are left out.
+func (watcher *fsPollWatcher) scan() map[string]fsPollEntry {
+	entries := make(map[string]fsPollEntry)
+	for _, root := range watcher.config.roots {
+		info, err := os.Stat(root)
+		if err != nil {
+			continue // ### continue, root missing ###
+		}
+		entries[root] = newFSPollEntry(info)
+		if info.IsDir() {
+			walkFSTree(root, watcher.config.recursive, watcher.config.skip, func(path string, info os.FileInfo) {
+				entries[path] = newFSPollEntry(info)
+			})
+		}
+	}
+	return entries
+}
+
+// compare reports the differences between two scans. Created files are
+// reported parents first, deleted files children first.
+func (watcher *fsPollWatcher) compare(previous, current map[string]fsPollEntry, handle func(fsEvent)) {
+	paths := make([]string, 0, len(current))
+	for path := range current {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	for _, path := range paths {
+		entry := current[path]
+		old, exists := previous[path]
+		switch {
+		case !exists || old.isDir != entry.isDir:
+			if exists {
+				handle(fsEvent{op: fsEventDelete, path: path, isDir: old.isDir})
+			}
+			handle(fsEvent{op: fsEventCreate, path: path, isDir: entry.isDir})
+		case !entry.isDir && (old.size != entry.size || !old.modTime.Equal(entry.modTime)):
+			handle(fsEvent{op: fsEventModify, path: path})
+		case old.mode != entry.mode:
+			handle(fsEvent{op: fsEventAttrib, path: path, isDir: entry.isDir})
+		}
+	}
+
+	removed := make([]string, 0)
+	for path := range previous {
+		if _, exists := current[path]; !exists {
+			removed = append(removed, path)
+		}
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(removed)))
+	for _, path := range removed {
+		handle(fsEvent{op: fsEventDelete, path: path, isDir: previous[path].isDir})
+	}
+}
+
+func (watcher *fsPollWatcher) run(handle func(fsEvent)) error {
+	previous := watcher.scan()
+	for {
+		select {
+		case <-watcher.stop:
+			return nil // ### return, closed ###
+		case <-time.After(watcher.interval):
+		}
+
+		current := watcher.scan()
+		watcher.compare(previous, current, handle)
+		previous = current
+	}
+}
+
+func (watcher *fsPollWatcher) close() {
+	watcher.closeOnce.Do(func() {
+		close(watcher.stop)
+	})
+}
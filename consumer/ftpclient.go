@@ -0,0 +1,193 @@
+// Copyright 2015-2016 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumer
+
+import (
+	"crypto/tls"
+	"fmt"
+	"github.com/jlaffaye/ftp"
+	"io"
+	"net"
+	"path"
+	"sync"
+	"time"
+)
+
+// ftpClient provides access to an FTP server. Explicit TLS (RFC 4217) is
+// used if a TLS config is given. All connections are opened by dial, so
+// close can interrupt blocking transfers.
+type ftpClient struct {
+	conn      *ftp.ServerConn
+	tlsConfig *tls.Config
+	timeout   time.Duration
+	guard     *sync.Mutex
+	control   net.Conn
+	data      net.Conn
+	closed    bool
+}
+
+// ftpDeadlineConn extends the deadline of a connection with each read and
+// write. FTP connections are only read while waiting for a response.
+type ftpDeadlineConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+// dialFTP connects and logs in to an FTP server.
+func dialFTP(address string, user, password string, tlsConfig *tls.Config, timeout time.Duration) (*ftpClient, error) {
+	client := &ftpClient{
+		timeout: timeout,
+		guard:   new(sync.Mutex),
+	}
+	options := []ftp.DialOption{ftp.DialWithDialFunc(client.dial)}
+
+	if tlsConfig != nil {
+		tlsConfig = tlsConfig.Clone()
+		if tlsConfig.ServerName == "" {
+			tlsConfig.ServerName, _, _ = net.SplitHostPort(address)
+		}
+		if tlsConfig.ClientSessionCache == nil {
+			// Many servers require data connections to resume the TLS
+			// session of the control connection
+			tlsConfig.ClientSessionCache = tls.NewLRUClientSessionCache(4)
+		}
+		client.tlsConfig = tlsConfig
+		options = append(options, ftp.DialWithExplicitTLS(tlsConfig))
+	}
+
+	conn, err := ftp.Dial(address, options...)
+	if err != nil {
+		client.close()
+		return nil, err
+	}
+	client.conn = conn
+
+	if user == "" {
+		user = "anonymous"
+	}
+	if err := conn.Login(user, password); err != nil {
+		client.close()
+		return nil, err
+	}
+	return client, nil
+}
+
+// dial opens the control connection and all data connections. The ftp
+// package does not encrypt data connections opened by a custom dial
+// function, so this is done here.
+func (client *ftpClient) dial(network, address string) (net.Conn, error) {
+	conn, err := net.DialTimeout(network, address, client.timeout)
+	if err != nil {
+		return nil, err
+	}
+	var wrapped net.Conn = &ftpDeadlineConn{Conn: conn, timeout: client.timeout}
+
+	client.guard.Lock()
+	defer client.guard.Unlock()
+	switch {
+	case client.closed:
+		conn.Close()
+		return nil, fmt.Errorf("Connection closed")
+	case client.control == nil:
+		client.control = conn
+	default:
+		client.data = conn
+		if client.tlsConfig != nil {
+			wrapped = tls.Client(wrapped, client.tlsConfig)
+		}
+	}
+	return wrapped, nil
+}
+
+func (conn *ftpDeadlineConn) extendDeadline() {
+	if conn.timeout > 0 {
+		conn.SetDeadline(time.Now().Add(conn.timeout))
+	}
+}
+
+func (conn *ftpDeadlineConn) Read(data []byte) (int, error) {
+	conn.extendDeadline()
+	return conn.Conn.Read(data)
+}
+
+func (conn *ftpDeadlineConn) Write(data []byte) (int, error) {
+	conn.extendDeadline()
+	return conn.Conn.Write(data)
+}
+
+func (client *ftpClient) list(directory string) ([]remoteFile, error) {
+	entries, err := client.conn.List(directory)
+	if err != nil {
+		return nil, err
+	}
+
+	// LIST only returns times with a precision of minutes or days, so MDTM
+	// is used if MLSD is not supported.
+	queryTime := !client.conn.IsTimePreciseInList() && client.conn.IsGetTimeSupported()
+
+	files := []remoteFile{}
+	for _, entry := range entries {
+		if entry.Type != ftp.EntryTypeFile {
+			continue // ### continue, no regular file ###
+		}
+		name := path.Base(entry.Name)
+		file := remoteFile{
+			path:    path.Join(directory, name),
+			name:    name,
+			size:    int64(entry.Size),
+			modTime: entry.Time,
+		}
+		if queryTime {
+			if modTime, err := client.conn.GetTime(file.path); err == nil {
+				file.modTime = modTime
+			}
+		}
+		files = append(files, file)
+	}
+	return files, nil
+}
+
+func (client *ftpClient) download(filePath string, offset int64, writer io.Writer) error {
+	response, err := client.conn.RetrFrom(filePath, uint64(offset))
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(writer, response)
+	if closeErr := response.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func (client *ftpClient) remove(filePath string) error {
+	return client.conn.Delete(filePath)
+}
+
+func (client *ftpClient) rename(filePath, newPath string) error {
+	return client.conn.Rename(filePath, newPath)
+}
+
+func (client *ftpClient) close() error {
+	client.guard.Lock()
+	defer client.guard.Unlock()
+	client.closed = true
+	if client.data != nil {
+		client.data.Close()
+	}
+	if client.control == nil {
+		return nil
+	}
+	return client.control.Close()
+}
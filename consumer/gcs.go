@@ -0,0 +1,568 @@
+// Copyright 2015-2016 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumer
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/core/log"
+	"github.com/trivago/gollum/shared"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	gcsMetadataBucket     = "gcs_bucket"
+	gcsMetadataObject     = "gcs_object"
+	gcsMetadataGeneration = "gcs_generation"
+	gcsScope              = "https://www.googleapis.com/auth/devstorage.read_only"
+	gcsModeList           = "list"
+	gcsModePubSub         = "pubsub"
+	gcsOffsetNewest       = "newest"
+	gcsOffsetOldest       = "oldest"
+)
+
+// GCS consumer plugin
+// The GCS consumer reads objects from a Google Cloud Storage bucket. New
+// objects are either found by listing the bucket periodically or by
+// consuming the notifications of the bucket from a Pub/Sub subscription.
+// Each object is downloaded and split into messages by the configured
+// partitioner. Objects compressed with gzip are decompressed automatically.
+// The generation of each object read is stored, so objects are not read
+// twice unless they are overwritten. Notifications are acknowledged only
+// after the object has been read completely.
+// The bucket, name and generation of the object are attached to each
+// message as "gcs_bucket", "gcs_object" and "gcs_generation" metadata.
+// When attached to a fuse, this consumer will stop reading objects in case
+// that fuse is burned.
+// Configuration example
+//
+//  - "consumer.GCS":
+//    Bucket: ""
+//    Prefix: ""
+//    Mode: "list"
+//    PollIntervalSec: 60
+//    DefaultOffset: "oldest"
+//    StateFile: ""
+//    Project: ""
+//    Subscription: ""
+//    MaxMessagesPerPull: 10
+//    Endpoint: "https://storage.googleapis.com"
+//    PubSubEndpoint: "https://pubsub.googleapis.com"
+//    CredentialType: "auto"
+//    CredentialFile: ""
+//    Partitioner: "delimiter"
+//    Delimiter: "\n"
+//    Offset: 0
+//    Size: 1
+//    Compression: "auto"
+//    MaxObjectSizeByte: 67108864
+//    RetryDelayMs: 3000
+//
+// Bucket defines the name of the bucket to read from. In "pubsub" mode this
+// can be left empty to accept notifications of all buckets. By default this
+// is set to "".
+//
+// Prefix defines the prefix of all objects to read. Other objects are
+// ignored. By default this is set to "".
+//
+// Mode defines how new objects are found. By default this is set to "list".
+//  * "list" lists all objects in Bucket starting with Prefix every
+//    PollIntervalSec seconds.
+//  * "pubsub" reads "OBJECT_FINALIZE" notifications from the Pub/Sub
+//    subscription given by Subscription. Notifications of other events are
+//    ignored.
+//
+// PollIntervalSec defines the number of seconds between two listings of the
+// bucket in "list" mode. By default this is set to 60.
+//
+// DefaultOffset defines which objects are read in "list" mode when no state
+// is known. If set to "oldest" all objects are read, if set to "newest"
+// only objects created after the first listing are read. By default this is
+// set to "oldest".
+//
+// StateFile defines the path to a file storing the generation of all
+// objects read. If no file is given, the state is only kept in memory and
+// objects are read again after a restart. By default this is set to "".
+//
+// Project defines the Google Cloud project of the subscription. By default
+// this is set to the value of the environment variable GOOGLE_CLOUD_PROJECT
+// or the project of the service account if CredentialFile is used.
+//
+// Subscription defines the name of the Pub/Sub subscription receiving the
+// notifications in "pubsub" mode. This can either be the short name of a
+// subscription in Project or the full name, e.g.
+// "projects/my-project/subscriptions/uploads". By default this is set to "".
+//
+// MaxMessagesPerPull defines the maximum number of notifications requested
+// with each pull request. The ack deadline of the subscription should be
+// larger than the time it takes to read these objects. By default this is
+// set to 10.
+//
+// Endpoint defines the base URL of the Cloud Storage API. If the environment
+// variable STORAGE_EMULATOR_HOST is set, the emulator running at that address
+// is used instead. By default this is set to "https://storage.googleapis.com".
+//
+// PubSubEndpoint defines the base URL of the Pub/Sub API. If the environment
+// variable PUBSUB_EMULATOR_HOST is set, the emulator running at that address
+// is used instead. By default this is set to "https://pubsub.googleapis.com".
+//
+// CredentialType defines how to authenticate against the Google Cloud APIs.
+// By default this is set to "auto".
+//  * "serviceaccount" signs access tokens with the service account key
+//    given by CredentialFile.
+//  * "metadata" requests access tokens from the metadata server of the
+//    instance. This also covers workload identity on Kubernetes Engine.
+//  * "none" disables authentication, e.g. for an emulator.
+//  * "auto" uses "serviceaccount" if CredentialFile is set, "none" if
+//    STORAGE_EMULATOR_HOST is set and "metadata" otherwise.
+//
+// CredentialFile defines the path to the JSON key file of a service account.
+// By default this is set to the value of the environment variable
+// GOOGLE_APPLICATION_CREDENTIALS.
+//
+// Partitioner defines the algorithm used to read messages from an object.
+// By default this is set to "delimiter".
+//  * "delimiter" separates messages by looking for a delimiter string.
+//    The delimiter is removed from the message. A missing delimiter at the
+//    end of an object is tolerated.
+//  * "object" treats each object as exactly one message.
+//  * "ascii" reads an ASCII number at a given offset until a given delimiter is found.
+//    Everything to the right of and including the delimiter is removed from the message.
+//  * "binary" reads a binary number at a given offset and size.
+//  * "binary_le" is an alias for "binary".
+//  * "binary_be" is the same as "binary" but uses big endian encoding.
+//  * "varint" reads an unsigned varint (as used by protocol buffers) at a given
+//    offset.
+//    The offset and the varint are removed from the message.
+//  * "fixed" assumes fixed size messages.
+//
+// Delimiter defines the delimiter used by the text and delimiter partitioner.
+// By default this is set to "\n".
+//
+// Offset defines the offset used by the binary, varint and text partitioner.
+// By default this is set to 0. This setting is ignored by the fixed partitioner.
+//
+// Size defines the size in bytes used by the binary or fixed partitioner.
+// For binary this can be set to 1,2,4 or 8. By default 4 is chosen.
+// For fixed this defines the size of a message. By default 1 is chosen.
+//
+// Compression defines how objects are decompressed. "auto" decompresses
+// objects starting with the gzip magic bytes, "gzip" expects all objects to
+// be compressed and "none" disables decompression.
+// By default this is set to "auto".
+//
+// MaxObjectSizeByte defines the maximum size of objects read by the "object"
+// partitioner after decompression. Larger objects are not sent and reading them
+// fails. By default this is set to 67108864 (64 MB).
+//
+// RetryDelayMs defines the number of milliseconds to wait before retrying
+// after a request failed. By default this is set to 3000.
+type GCS struct {
+	core.ConsumerBase
+	endpoint       string
+	pubsubEndpoint string
+	bucket         string
+	prefix         string
+	mode           string
+	subscription   string
+	client         *http.Client
+	reader         *objectReader
+	state          *fileCheckpointStore
+	pollInterval   time.Duration
+	retryDelay     time.Duration
+	maxPull        int
+	skipExisting   bool
+	ctx            context.Context
+	cancel         context.CancelFunc
+	sequence       uint64
+}
+
+// gcsObject identifies a generation of an object.
+type gcsObject struct {
+	Bucket     string `json:"bucket"`
+	Name       string `json:"name"`
+	Generation string `json:"generation"`
+}
+
+func init() {
+	shared.TypeRegistry.Register(GCS{})
+}
+
+// Configure initializes this consumer with values from a plugin config.
+func (cons *GCS) Configure(conf core.PluginConfig) error {
+	err := cons.ConsumerBase.Configure(conf)
+	if err != nil {
+		return err
+	}
+
+	if cons.reader, err = newObjectReader(conf); err != nil {
+		return err
+	}
+	if cons.state, err = newFileCheckpointStore(conf.GetString("StateFile", "")); err != nil {
+		return err
+	}
+
+	cons.endpoint = strings.TrimSuffix(conf.GetString("Endpoint", "https://storage.googleapis.com"), "/")
+	emulatorHost := os.Getenv("STORAGE_EMULATOR_HOST")
+	if emulatorHost != "" {
+		cons.endpoint = strings.TrimSuffix(emulatorHost, "/")
+		if !strings.Contains(cons.endpoint, "://") {
+			cons.endpoint = "http://" + cons.endpoint
+		}
+	}
+	cons.pubsubEndpoint = strings.TrimSuffix(conf.GetString("PubSubEndpoint", "https://pubsub.googleapis.com"), "/")
+	if pubsubHost := os.Getenv("PUBSUB_EMULATOR_HOST"); pubsubHost != "" {
+		cons.pubsubEndpoint = "http://" + pubsubHost
+	}
+
+	cons.bucket = conf.GetString("Bucket", "")
+	cons.prefix = conf.GetString("Prefix", "")
+	cons.pollInterval = time.Duration(shared.MaxI(conf.GetInt("PollIntervalSec", 60), 1)) * time.Second
+	cons.retryDelay = time.Duration(conf.GetInt("RetryDelayMs", 3000)) * time.Millisecond
+	cons.maxPull = shared.MinI(shared.MaxI(conf.GetInt("MaxMessagesPerPull", 10), 1), pubsubMaxAckIDs)
+
+	switch offset := strings.ToLower(conf.GetString("DefaultOffset", gcsOffsetOldest)); offset {
+	case gcsOffsetOldest, gcsOffsetNewest:
+		cons.skipExisting = offset == gcsOffsetNewest
+	default:
+		return fmt.Errorf("DefaultOffset must be \"%s\" or \"%s\"", gcsOffsetNewest, gcsOffsetOldest)
+	}
+
+	scopes := []string{gcsScope}
+	cons.mode = strings.ToLower(conf.GetString("Mode", gcsModeList))
+	switch cons.mode {
+	case gcsModeList:
+	case gcsModePubSub:
+		scopes = append(scopes, pubsubScope)
+	default:
+		return fmt.Errorf("Unknown mode: %s", cons.mode)
+	}
+
+	project := conf.GetString("Project", os.Getenv("GOOGLE_CLOUD_PROJECT"))
+	credentialFile := conf.GetString("CredentialFile", os.Getenv("GOOGLE_APPLICATION_CREDENTIALS"))
+	credentialType := strings.ToLower(conf.GetString("CredentialType", "auto"))
+	if credentialType == "auto" {
+		switch {
+		case credentialFile != "":
+			credentialType = "serviceaccount"
+		case emulatorHost != "":
+			credentialType = "none"
+		default:
+			credentialType = "metadata"
+		}
+	}
+
+	client, accountProject, err := newGoogleClient(credentialType, credentialFile, scopes...)
+	if err != nil {
+		return err
+	}
+	cons.client = client
+	if project == "" {
+		project = accountProject
+	}
+
+	cons.subscription = conf.GetString("Subscription", "")
+	if cons.subscription != "" && !strings.Contains(cons.subscription, "/") && project != "" {
+		cons.subscription = fmt.Sprintf("projects/%s/subscriptions/%s", project, cons.subscription)
+	}
+
+	cons.ctx, cons.cancel = context.WithCancel(context.Background())
+	return nil
+}
+
+// send sends a request to the given URL and returns the response if the
+// request was successful. The response body has to be closed by the caller.
+func (cons *GCS) send(method, url string, request interface{}) (*http.Response, error) {
+	var body io.Reader
+	if request != nil {
+		data, err := json.Marshal(request)
+		if err != nil {
+			return nil, err
+		}
+		body = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(cons.ctx)
+	if request != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	response, err := cons.client.Do(req)
+	if err != nil {
+		return nil, err // ### return, request failed ###
+	}
+
+	if response.StatusCode != http.StatusOK {
+		defer response.Body.Close()
+		message, _ := ioutil.ReadAll(io.LimitReader(response.Body, 1024))
+		return response, fmt.Errorf("%s %s returned %s: %s", method, req.URL.Path, response.Status, strings.TrimSpace(string(message)))
+	}
+	return response, nil
+}
+
+// call sends a request and decodes the response into result.
+func (cons *GCS) call(method, url string, request interface{}, result interface{}) error {
+	response, err := cons.send(method, url, request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if result == nil {
+		return nil
+	}
+	return json.NewDecoder(response.Body).Decode(result)
+}
+
+func (cons *GCS) sleep(duration time.Duration) {
+	select {
+	case <-cons.ctx.Done():
+	case <-time.After(duration):
+	}
+}
+
+// isNew returns true if the given generation of an object has not been
+// read, yet.
+func (cons *GCS) isNew(object gcsObject, state map[string]string) bool {
+	return state[object.Bucket+"/"+object.Name] != object.Generation
+}
+
+func (cons *GCS) markRead(object gcsObject) {
+	if err := cons.state.store(object.Bucket+"/"+object.Name, object.Generation); err != nil {
+		Log.Error.Print("GCS failed to store state: ", err)
+	}
+}
+
+// readObject downloads the given generation of an object and enqueues its
+// messages. Objects that do not exist anymore are skipped.
+func (cons *GCS) readObject(object gcsObject) error {
+	query := url.Values{"alt": {"media"}}
+	if object.Generation != "" {
+		query.Set("generation", object.Generation)
+	}
+	objectURL := fmt.Sprintf("%s/storage/v1/b/%s/o/%s?%s", cons.endpoint,
+		url.PathEscape(object.Bucket), url.PathEscape(object.Name), query.Encode())
+
+	response, err := cons.send("GET", objectURL, nil)
+	if err != nil {
+		if response != nil && response.StatusCode == http.StatusNotFound {
+			Log.Warning.Printf("GCS skipped gs://%s/%s: object does not exist", object.Bucket, object.Name)
+			return nil // ### return, object has been deleted ###
+		}
+		return err
+	}
+	defer response.Body.Close()
+
+	err = cons.reader.read(response.Body, func(data []byte) {
+		msg := core.NewMessage(cons, data, atomic.AddUint64(&cons.sequence, 1))
+		msg.SetMetadata(gcsMetadataBucket, object.Bucket)
+		msg.SetMetadata(gcsMetadataObject, object.Name)
+		msg.SetMetadata(gcsMetadataGeneration, object.Generation)
+		cons.EnqueueMessage(msg)
+	})
+	if err == shared.BufferDataInvalid {
+		Log.Warning.Printf("GCS failed to parse parts of gs://%s/%s", object.Bucket, object.Name)
+		return nil
+	}
+	return err
+}
+
+// list returns all objects of the bucket starting with the configured
+// prefix.
+func (cons *GCS) list() ([]gcsObject, error) {
+	objects := []gcsObject{}
+	query := url.Values{
+		"prefix": {cons.prefix},
+		"fields": {"items(bucket,name,generation),nextPageToken"},
+	}
+
+	for {
+		response := struct {
+			Items         []gcsObject `json:"items"`
+			NextPageToken string      `json:"nextPageToken"`
+		}{}
+		listURL := fmt.Sprintf("%s/storage/v1/b/%s/o?%s", cons.endpoint, url.PathEscape(cons.bucket), query.Encode())
+		if err := cons.call("GET", listURL, nil, &response); err != nil {
+			return nil, err
+		}
+
+		objects = append(objects, response.Items...)
+		if response.NextPageToken == "" {
+			return objects, nil // ### return, last page ###
+		}
+		query.Set("pageToken", response.NextPageToken)
+	}
+}
+
+// poll lists the bucket periodically and reads all new objects.
+func (cons *GCS) poll() {
+	skipExisting := cons.skipExisting
+	for cons.IsActive() {
+		if cons.IsFuseBurned() {
+			cons.sleep(time.Second)
+			continue // ### continue, fuse burned ###
+		}
+
+		objects, err := cons.list()
+		if err != nil {
+			if cons.IsActive() {
+				Log.Error.Printf("GCS failed to list gs://%s/%s: %s", cons.bucket, cons.prefix, err)
+				cons.sleep(cons.retryDelay)
+			}
+			continue // ### continue, retry ###
+		}
+
+		state, _ := cons.state.checkpoints()
+		if skipExisting && len(state) == 0 {
+			for _, object := range objects {
+				cons.markRead(object)
+			}
+			objects = nil
+		}
+		skipExisting = false
+
+		for _, object := range objects {
+			if !cons.IsActive() || cons.IsFuseBurned() {
+				break // ### break, continue with next listing ###
+			}
+			if !cons.isNew(object, state) {
+				continue // ### continue, already read ###
+			}
+			if err := cons.readObject(object); err != nil {
+				if cons.IsActive() {
+					Log.Error.Printf("GCS failed to read gs://%s/%s: %s", object.Bucket, object.Name, err)
+				}
+				continue // ### continue, object will be read with the next listing ###
+			}
+			cons.markRead(object)
+		}
+
+		cons.sleep(cons.pollInterval)
+	}
+}
+
+// processNotification reads the object announced by a notification. If an
+// error is returned the notification is not acknowledged.
+func (cons *GCS) processNotification(received pubsubReceivedMessage) error {
+	attributes := received.Message.Attributes
+	if attributes["eventType"] != "OBJECT_FINALIZE" {
+		return nil // ### return, not a new object ###
+	}
+
+	object := gcsObject{
+		Bucket:     attributes["bucketId"],
+		Name:       attributes["objectId"],
+		Generation: attributes["objectGeneration"],
+	}
+	if cons.bucket != "" && object.Bucket != cons.bucket || !strings.HasPrefix(object.Name, cons.prefix) {
+		return nil // ### return, ignored object ###
+	}
+
+	state, _ := cons.state.checkpoints()
+	if !cons.isNew(object, state) {
+		return nil // ### return, duplicate notification ###
+	}
+	if err := cons.readObject(object); err != nil {
+		return fmt.Errorf("gs://%s/%s: %s", object.Bucket, object.Name, err)
+	}
+	cons.markRead(object)
+	return nil
+}
+
+// pull reads notifications from the subscription until the consumer is
+// stopped.
+func (cons *GCS) pull() {
+	subscriptionURL := fmt.Sprintf("%s/v1/%s", cons.pubsubEndpoint, cons.subscription)
+	for cons.IsActive() {
+		if cons.IsFuseBurned() {
+			cons.sleep(time.Second)
+			continue // ### continue, fuse burned ###
+		}
+
+		response := struct {
+			ReceivedMessages []pubsubReceivedMessage `json:"receivedMessages"`
+		}{}
+		err := cons.call("POST", subscriptionURL+":pull", map[string]int{"maxMessages": cons.maxPull}, &response)
+		if err != nil {
+			if cons.IsActive() {
+				Log.Error.Printf("GCS failed to pull from %s: %s", cons.subscription, err)
+				cons.sleep(cons.retryDelay)
+			}
+			continue // ### continue, retry ###
+		}
+
+		ackIDs := []string{}
+		for _, received := range response.ReceivedMessages {
+			if err := cons.processNotification(received); err != nil {
+				if cons.IsActive() {
+					Log.Error.Print("GCS failed to read ", err)
+				}
+				continue // ### continue, notification will be received again ###
+			}
+			ackIDs = append(ackIDs, received.AckID)
+		}
+
+		if len(ackIDs) > 0 {
+			if err := cons.call("POST", subscriptionURL+":acknowledge", map[string][]string{"ackIds": ackIDs}, nil); err != nil {
+				Log.Error.Print("GCS failed to acknowledge notifications: ", err)
+			}
+		}
+	}
+}
+
+func (cons *GCS) run() {
+	defer cons.WorkerDone()
+
+	switch {
+	case cons.mode == gcsModeList && cons.bucket == "":
+		Log.Error.Print("GCS requires a Bucket to read from")
+	case cons.mode == gcsModeList:
+		cons.poll()
+	case !strings.Contains(cons.subscription, "/"):
+		Log.Error.Print("GCS requires a Subscription and a Project to read notifications from")
+	default:
+		cons.pull()
+	}
+}
+
+func (cons *GCS) close() {
+	cons.cancel()
+}
+
+// Consume starts reading objects from the configured bucket.
+func (cons *GCS) Consume(workers *sync.WaitGroup) {
+	cons.SetWorkerWaitGroup(workers)
+	cons.SetStopCallback(cons.close)
+
+	cons.AddWorker()
+	go shared.DontPanic(cons.run)
+
+	cons.ControlLoop()
+}
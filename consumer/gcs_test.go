@@ -0,0 +1,253 @@
+// Copyright 2015-2016 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumer
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/shared"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeGCS serves the list and download methods of the Cloud Storage API and
+// the pull and acknowledge methods of a Pub/Sub subscription.
+type fakeGCS struct {
+	objects   map[string]string
+	pending   []pubsubReceivedMessage
+	acked     []string
+	downloads []string
+	guard     sync.Mutex
+}
+
+func (fake *fakeGCS) put(name, generation, data string) {
+	fake.guard.Lock()
+	defer fake.guard.Unlock()
+	fake.objects[name+"#"+generation] = data
+}
+
+func (fake *fakeGCS) notify(eventType, name, generation string) {
+	fake.guard.Lock()
+	defer fake.guard.Unlock()
+
+	message := pubsubReceivedMessage{AckID: fmt.Sprintf("ack%d", len(fake.pending)+len(fake.acked))}
+	message.Message.Attributes = map[string]string{
+		"eventType":        eventType,
+		"bucketId":         "bucket",
+		"objectId":         name,
+		"objectGeneration": generation,
+	}
+	fake.pending = append(fake.pending, message)
+}
+
+func (fake *fakeGCS) downloadCount() int {
+	fake.guard.Lock()
+	defer fake.guard.Unlock()
+	return len(fake.downloads)
+}
+
+func (fake *fakeGCS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	fake.guard.Lock()
+	defer fake.guard.Unlock()
+
+	switch {
+	case r.URL.Path == "/storage/v1/b/bucket/o":
+		items := []gcsObject{}
+		for key := range fake.objects {
+			parts := strings.SplitN(key, "#", 2)
+			if strings.HasPrefix(parts[0], r.URL.Query().Get("prefix")) {
+				items = append(items, gcsObject{Bucket: "bucket", Name: parts[0], Generation: parts[1]})
+			}
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"items": items})
+
+	case strings.HasPrefix(r.URL.Path, "/storage/v1/b/bucket/o/"):
+		name := strings.TrimPrefix(r.URL.Path, "/storage/v1/b/bucket/o/")
+		data, exists := fake.objects[name+"#"+r.URL.Query().Get("generation")]
+		if !exists || r.URL.Query().Get("alt") != "media" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		fake.downloads = append(fake.downloads, name+"#"+r.URL.Query().Get("generation"))
+		fmt.Fprint(w, data)
+
+	case r.URL.Path == "/v1/projects/test/subscriptions/uploads:pull":
+		json.NewEncoder(w).Encode(map[string]interface{}{"receivedMessages": fake.pending})
+		fake.pending = nil
+
+	case r.URL.Path == "/v1/projects/test/subscriptions/uploads:acknowledge":
+		request := struct {
+			AckIDs []string `json:"ackIds"`
+		}{}
+		json.NewDecoder(r.Body).Decode(&request)
+		fake.acked = append(fake.acked, request.AckIDs...)
+		fmt.Fprint(w, "{}")
+
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+	}
+}
+
+func gcsTestMessages(stream *mockHTTPStream) []string {
+	stream.guard.Lock()
+	defer stream.guard.Unlock()
+
+	messages := []string{}
+	for _, msg := range stream.messages {
+		messages = append(messages, fmt.Sprintf("%s#%s %s", msg.Metadata[gcsMetadataObject], msg.Metadata[gcsMetadataGeneration], msg.Data))
+	}
+	sort.Strings(messages)
+	return messages
+}
+
+func TestGCSList(t *testing.T) {
+	expect := shared.NewExpect(t)
+
+	dir, err := ioutil.TempDir("", "gollum_gcs")
+	expect.NoError(err)
+	defer os.RemoveAll(dir)
+	stateFile := filepath.Join(dir, "state.json")
+	expect.NoError(ioutil.WriteFile(stateFile, []byte(`{"bucket/logs/old.log":"1"}`), 0644))
+
+	compressed := new(bytes.Buffer)
+	gzipWriter := gzip.NewWriter(compressed)
+	gzipWriter.Write([]byte("b1\nb2\n"))
+	gzipWriter.Close()
+
+	fake := &fakeGCS{objects: map[string]string{}}
+	fake.put("logs/old.log", "1", "old")
+	fake.put("logs/a.log", "1", "a1\na2")
+	fake.put("logs/b.log.gz", "5", compressed.String())
+	fake.put("other/c.log", "1", "c")
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	stream := &mockHTTPStream{}
+	core.StreamRegistry.Register(stream, core.GetStreamID("gcsList"))
+	conf := core.NewPluginConfig("")
+	conf.Stream = []string{"gcsList"}
+	conf.Override("CredentialType", "none")
+	conf.Override("Bucket", "bucket")
+	conf.Override("Prefix", "logs/")
+	conf.Override("Endpoint", server.URL)
+	conf.Override("StateFile", stateFile)
+	conf.Override("PollIntervalSec", 1)
+	plugin, err := core.NewPluginWithType("consumer.GCS", conf)
+	expect.NoError(err)
+	cons, casted := plugin.(*GCS)
+	expect.True(casted)
+
+	workers := new(sync.WaitGroup)
+	go cons.Consume(workers)
+
+	expect.NonBlocking(5*time.Second, func() {
+		for stream.count() < 4 {
+			time.Sleep(10 * time.Millisecond)
+		}
+	})
+
+	// Overwritten objects are read again
+	fake.put("logs/a.log", "2", "a3")
+	expect.NonBlocking(5*time.Second, func() {
+		for stream.count() < 5 {
+			time.Sleep(10 * time.Millisecond)
+		}
+	})
+
+	cons.Control() <- core.PluginControlStopConsumer
+	expect.NonBlocking(2*time.Second, workers.Wait)
+
+	expect.Equal([]string{
+		"logs/a.log#1 a1",
+		"logs/a.log#1 a2",
+		"logs/a.log#2 a3",
+		"logs/b.log.gz#5 b1",
+		"logs/b.log.gz#5 b2",
+	}, gcsTestMessages(stream))
+	expect.Equal(3, fake.downloadCount())
+
+	state := map[string]string{}
+	fileContents, err := ioutil.ReadFile(stateFile)
+	expect.NoError(err)
+	expect.NoError(json.Unmarshal(fileContents, &state))
+	expect.Equal(map[string]string{
+		"bucket/logs/old.log":  "1",
+		"bucket/logs/a.log":    "2",
+		"bucket/logs/b.log.gz": "5",
+	}, state)
+}
+
+func TestGCSPubSub(t *testing.T) {
+	expect := shared.NewExpect(t)
+
+	fake := &fakeGCS{objects: map[string]string{}}
+	fake.put("logs/a.log", "1", "a1\na2\n")
+	fake.put("other/b.log", "1", "b")
+	fake.notify("OBJECT_FINALIZE", "logs/a.log", "1")
+	fake.notify("OBJECT_FINALIZE", "logs/a.log", "1")
+	fake.notify("OBJECT_DELETE", "logs/a.log", "1")
+	fake.notify("OBJECT_FINALIZE", "other/b.log", "1")
+	fake.notify("OBJECT_FINALIZE", "logs/missing.log", "1")
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	stream := &mockHTTPStream{}
+	core.StreamRegistry.Register(stream, core.GetStreamID("gcsPubSub"))
+	conf := core.NewPluginConfig("")
+	conf.Stream = []string{"gcsPubSub"}
+	conf.Override("CredentialType", "none")
+	conf.Override("Prefix", "logs/")
+	conf.Override("Mode", "pubsub")
+	conf.Override("Project", "test")
+	conf.Override("Subscription", "uploads")
+	conf.Override("Endpoint", server.URL)
+	conf.Override("PubSubEndpoint", server.URL)
+	plugin, err := core.NewPluginWithType("consumer.GCS", conf)
+	expect.NoError(err)
+	cons, casted := plugin.(*GCS)
+	expect.True(casted)
+
+	workers := new(sync.WaitGroup)
+	go cons.Consume(workers)
+
+	expect.NonBlocking(5*time.Second, func() {
+		for {
+			fake.guard.Lock()
+			done := len(fake.acked) == 5
+			fake.guard.Unlock()
+			if done {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	})
+
+	cons.Control() <- core.PluginControlStopConsumer
+	expect.NonBlocking(2*time.Second, workers.Wait)
+
+	expect.Equal([]string{"logs/a.log#1 a1", "logs/a.log#1 a2"}, gcsTestMessages(stream))
+	expect.Equal(1, fake.downloadCount())
+}
@@ -0,0 +1,74 @@
+// Copyright 2015-2016 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumer
+
+import (
+	"context"
+	"fmt"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+	"io/ioutil"
+	"net/http"
+)
+
+// newGoogleClient returns an HTTP client that authenticates requests to
+// Google Cloud APIs with OAuth2 access tokens for the given scopes. Tokens
+// are signed with the service account key stored in credentialFile for the
+// credential type "serviceaccount" and requested from the metadata server of
+// the instance for "metadata", which also covers workload identity on
+// Kubernetes Engine. The type "none" disables authentication. Tokens are
+// cached until shortly before they expire. The project of the service
+// account is returned if known.
+func newGoogleClient(credentialType, credentialFile string, scopes ...string) (*http.Client, string, error) {
+	source, project, err := newGoogleTokenSource(credentialType, credentialFile, scopes...)
+	if err != nil {
+		return nil, "", err
+	}
+	return newGoogleTokenClient(source, http.DefaultTransport), project, nil
+}
+
+// newGoogleTokenSource returns the token source used by newGoogleClient. The
+// source is nil for the credential type "none".
+func newGoogleTokenSource(credentialType, credentialFile string, scopes ...string) (oauth2.TokenSource, string, error) {
+	switch credentialType {
+	case "serviceaccount":
+		keyData, err := ioutil.ReadFile(credentialFile)
+		if err != nil {
+			return nil, "", err // ### return, file not readable ###
+		}
+		credentials, err := google.CredentialsFromJSONWithType(context.Background(), keyData, google.ServiceAccount, scopes...)
+		if err != nil {
+			return nil, "", fmt.Errorf("Failed to parse %s: %s", credentialFile, err)
+		}
+		return oauth2.ReuseTokenSource(nil, credentials.TokenSource), credentials.ProjectID, nil
+
+	case "metadata":
+		return google.ComputeTokenSource("", scopes...), "", nil
+
+	case "none":
+		return nil, "", nil
+	}
+
+	return nil, "", fmt.Errorf("Unknown CredentialType: %s", credentialType)
+}
+
+// newGoogleTokenClient returns an HTTP client sending requests through the
+// given transport with access tokens from source attached.
+func newGoogleTokenClient(source oauth2.TokenSource, transport http.RoundTripper) *http.Client {
+	if source == nil {
+		return &http.Client{Transport: transport}
+	}
+	return &http.Client{Transport: &oauth2.Transport{Source: source, Base: transport}}
+}
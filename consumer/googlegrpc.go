@@ -0,0 +1,221 @@
+// Copyright 2015-2016 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumer
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const (
+	grpcMaxMessageSize = 20 << 20
+	protoWireVarint    = 0
+	protoWireFixed64   = 1
+	protoWireBytes     = 2
+	protoWireFixed32   = 5
+)
+
+// protoWireField is a single field read from protocol buffer encoded data.
+// Value holds the value of varint and fixed size fields, data holds the
+// content of length delimited fields.
+type protoWireField struct {
+	number   uint64
+	wireType uint64
+	value    uint64
+	data     []byte
+}
+
+// newGRPCTransport returns a transport that only speaks HTTP/2 as required by
+// gRPC. Plain http:// URLs use HTTP/2 without TLS, which is what local
+// emulators expect.
+func newGRPCTransport() *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Protocols = new(http.Protocols)
+	transport.Protocols.SetHTTP2(true)
+	transport.Protocols.SetUnencryptedHTTP2(true)
+	return transport
+}
+
+// grpcCall starts a call of the gRPC method at the given URL, e.g.
+// "https://pubsub.googleapis.com/google.pubsub.v1.Subscriber/Pull". Request
+// messages are read from body, which may stay open for streaming calls.
+// The response is returned as soon as the server sent its headers, so
+// response messages can be read from its body with grpcReadMessage.
+func grpcCall(ctx context.Context, client *http.Client, url string, metadata map[string]string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequest("POST", url, body)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("Te", "trailers")
+	for key, value := range metadata {
+		req.Header.Set(key, value)
+	}
+
+	response, err := client.Do(req)
+	if err != nil {
+		return nil, err // ### return, request failed ###
+	}
+
+	if response.StatusCode != http.StatusOK {
+		message, _ := ioutil.ReadAll(io.LimitReader(response.Body, 1024))
+		response.Body.Close()
+		return nil, fmt.Errorf("gRPC call returned %s: %s", response.Status, strings.TrimSpace(string(message)))
+	}
+
+	// Calls failing right away only send headers
+	if response.Header.Get("Grpc-Status") != "" {
+		response.Body.Close()
+		return nil, grpcStatus(response.Header)
+	}
+	return response, nil
+}
+
+// grpcStatus returns the error reported by the status of a finished call.
+func grpcStatus(trailer http.Header) error {
+	switch code := trailer.Get("Grpc-Status"); code {
+	case "0":
+		return nil
+	case "":
+		return fmt.Errorf("gRPC call ended without status")
+	default:
+		message, _ := url.PathUnescape(trailer.Get("Grpc-Message"))
+		return fmt.Errorf("gRPC call failed with status %s: %s", code, message)
+	}
+}
+
+// grpcReadMessage reads the next length prefixed message of a call. io.EOF
+// is returned after the last message, the status of the call is available in
+// the response trailer afterwards.
+func grpcReadMessage(reader io.Reader) ([]byte, error) {
+	header := make([]byte, 5)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return nil, err // ### return, no more messages ###
+	}
+	if header[0] != 0 {
+		return nil, fmt.Errorf("gRPC message compression is not supported")
+	}
+
+	length := binary.BigEndian.Uint32(header[1:])
+	if length > grpcMaxMessageSize {
+		return nil, fmt.Errorf("gRPC message of %d bytes exceeds the limit of %d bytes", length, grpcMaxMessageSize)
+	}
+
+	message := make([]byte, length)
+	if _, err := io.ReadFull(reader, message); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return message, nil
+}
+
+// grpcAppendMessage appends an uncompressed, length prefixed message to the
+// given buffer.
+func grpcAppendMessage(buffer []byte, message []byte) []byte {
+	var header [5]byte
+	binary.BigEndian.PutUint32(header[1:], uint32(len(message)))
+	buffer = append(buffer, header[:]...)
+	return append(buffer, message...)
+}
+
+// protoReadFields splits protocol buffer encoded data into its fields.
+// Groups are not supported.
+func protoReadFields(data []byte) ([]protoWireField, error) {
+	fields := []protoWireField{}
+	for len(data) > 0 {
+		tag, size := binary.Uvarint(data)
+		if size <= 0 {
+			return nil, fmt.Errorf("Protobuf: invalid field tag")
+		}
+		data = data[size:]
+
+		field := protoWireField{number: tag >> 3, wireType: tag & 7}
+		if field.number == 0 {
+			return nil, fmt.Errorf("Protobuf: invalid field number 0")
+		}
+
+		switch field.wireType {
+		case protoWireVarint:
+			if field.value, size = binary.Uvarint(data); size <= 0 {
+				return nil, fmt.Errorf("Protobuf: invalid varint in field %d", field.number)
+			}
+
+		case protoWireFixed64:
+			if size = 8; len(data) < size {
+				return nil, fmt.Errorf("Protobuf: truncated field %d", field.number)
+			}
+			field.value = binary.LittleEndian.Uint64(data)
+
+		case protoWireFixed32:
+			if size = 4; len(data) < size {
+				return nil, fmt.Errorf("Protobuf: truncated field %d", field.number)
+			}
+			field.value = uint64(binary.LittleEndian.Uint32(data))
+
+		case protoWireBytes:
+			length, lengthSize := binary.Uvarint(data)
+			if lengthSize <= 0 || length > uint64(len(data)-lengthSize) {
+				return nil, fmt.Errorf("Protobuf: truncated field %d", field.number)
+			}
+			size = lengthSize + int(length)
+			field.data = data[lengthSize:size]
+
+		default:
+			return nil, fmt.Errorf("Protobuf: unsupported wire type %d in field %d", field.wireType, field.number)
+		}
+
+		data = data[size:]
+		fields = append(fields, field)
+	}
+	return fields, nil
+}
+
+// protoAppendTag appends the tag of a field to the given buffer.
+func protoAppendTag(buffer []byte, number uint64, wireType uint64) []byte {
+	return protoAppendVarint(buffer, number<<3|wireType)
+}
+
+// protoAppendVarint appends a varint to the given buffer.
+func protoAppendVarint(buffer []byte, value uint64) []byte {
+	var encoded [binary.MaxVarintLen64]byte
+	size := binary.PutUvarint(encoded[:], value)
+	return append(buffer, encoded[:size]...)
+}
+
+// protoAppendVarintField appends a varint field to the given buffer. Zero
+// values are omitted like proto3 does.
+func protoAppendVarintField(buffer []byte, number uint64, value uint64) []byte {
+	if value == 0 {
+		return buffer
+	}
+	buffer = protoAppendTag(buffer, number, protoWireVarint)
+	return protoAppendVarint(buffer, value)
+}
+
+// protoAppendBytes appends a length delimited field to the given buffer.
+func protoAppendBytes(buffer []byte, number uint64, data []byte) []byte {
+	buffer = protoAppendTag(buffer, number, protoWireBytes)
+	buffer = protoAppendVarint(buffer, uint64(len(data)))
+	return append(buffer, data...)
+}
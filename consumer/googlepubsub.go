@@ -0,0 +1,674 @@
+// Copyright 2015-2016 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumer
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/core/log"
+	"github.com/trivago/gollum/shared"
+	"hash/fnv"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	pubsubMetadataMessageID       = "pubsub_message_id"
+	pubsubMetadataPublishTime     = "pubsub_publish_time"
+	pubsubMetadataOrderingKey     = "pubsub_ordering_key"
+	pubsubMetadataDeliveryAttempt = "pubsub_delivery_attempt"
+	pubsubMetadataAttribute       = "pubsub_attribute."
+	pubsubScope                   = "https://www.googleapis.com/auth/pubsub"
+	pubsubMaxAckIDs               = 1000
+	pubsubKeepAliveInterval       = 30 * time.Second
+)
+
+// GooglePubSub consumer plugin
+// The GooglePubSub consumer reads messages from a Google Cloud Pub/Sub
+// subscription. Like the Google Cloud client libraries it uses the
+// StreamingPull method of the gRPC API, so Pub/Sub pushes messages through a
+// single long lived stream that is reopened if it breaks. Messages are leased
+// until they have been passed to the configured streams: the ack deadline of
+// all outstanding messages is extended periodically and messages are
+// acknowledged in batches afterwards. Messages that were not acknowledged
+// when gollum stops are redelivered by Pub/Sub.
+// The number and size of outstanding messages can be limited to control the
+// memory used by this consumer. Pub/Sub stops sending messages on the stream
+// while these limits are reached. Messages sharing an ordering key are always
+// processed by the same worker, so their order is preserved for
+// subscriptions with message ordering enabled.
+// The message id and publish time are attached as "pubsub_message_id" and
+// "pubsub_publish_time" metadata. The ordering key and delivery attempt are
+// stored as "pubsub_ordering_key" and "pubsub_delivery_attempt" if set. Each
+// message attribute is stored as "pubsub_attribute.<name>".
+// When attached to a fuse, this consumer will stop processing messages in
+// case that fuse is burned.
+// Configuration example
+//
+//  - "consumer.GooglePubSub":
+//    Project: ""
+//    Subscription: "default"
+//    Endpoint: "https://pubsub.googleapis.com"
+//    CredentialType: "auto"
+//    CredentialFile: ""
+//    MaxOutstandingMessages: 1000
+//    MaxOutstandingBytes: 0
+//    AckDeadlineSec: 60
+//    Workers: 1
+//    RetryDelayMs: 3000
+//
+// Project defines the Google Cloud project of the subscription. By default
+// this is set to the value of the environment variable GOOGLE_CLOUD_PROJECT
+// or the project of the service account if CredentialFile is used.
+//
+// Subscription defines the name of the subscription to read from. This can
+// either be the short name of a subscription in Project or the full name,
+// e.g. "projects/my-project/subscriptions/logs". By default this is set to
+// "default".
+//
+// Endpoint defines the base URL of the gRPC API of Pub/Sub. Plain http://
+// URLs use HTTP/2 without TLS. If the environment variable
+// PUBSUB_EMULATOR_HOST is set, the emulator running at that address is used
+// instead. By default this is set to "https://pubsub.googleapis.com".
+//
+// CredentialType defines how to authenticate against the Pub/Sub API.
+// By default this is set to "auto".
+//  * "serviceaccount" signs access tokens with the service account key
+//    given by CredentialFile.
+//  * "metadata" requests access tokens from the metadata server of the
+//    instance. This also covers workload identity on Kubernetes Engine.
+//  * "none" disables authentication, e.g. for the emulator.
+//  * "auto" uses "serviceaccount" if CredentialFile is set, "none" if
+//    PUBSUB_EMULATOR_HOST is set and "metadata" otherwise.
+//
+// CredentialFile defines the path to the JSON key file of a service account.
+// By default this is set to the value of the environment variable
+// GOOGLE_APPLICATION_CREDENTIALS.
+//
+// MaxOutstandingMessages defines the maximum number of messages that have
+// been received but not yet acknowledged. By default this is set to 1000.
+//
+// MaxOutstandingBytes defines the maximum total size of all messages that
+// have been received but not yet acknowledged. By default this is set to 0,
+// which disables the limit.
+//
+// AckDeadlineSec defines the number of seconds Pub/Sub waits for a message
+// to be acknowledged before redelivering it. The deadline of outstanding
+// messages is extended every AckDeadlineSec/2 seconds. Values are limited to
+// 10 to 600. By default this is set to 60.
+//
+// Workers defines the number of go routines processing messages in
+// parallel. Messages are received by a single go routine, so messages sharing
+// an ordering key keep their order. By default this is set to 1.
+//
+// RetryDelayMs defines the number of milliseconds to wait before reopening
+// the stream if it failed shortly after being opened. By default this is set
+// to 3000.
+type GooglePubSub struct {
+	core.ConsumerBase
+	endpoint     string
+	project      string
+	subscription string
+	client       *http.Client
+	clientID     string
+	maxMessages  int
+	maxBytes     int
+	ackDeadline  time.Duration
+	workers      int
+	retryDelay   time.Duration
+	leases       map[string]int
+	leaseBytes   int
+	leaseGuard   *sync.Mutex
+	released     *sync.Cond
+	acks         chan string
+	ctx          context.Context
+	cancel       context.CancelFunc
+	sequence     uint64
+	roundRobin   uint64
+}
+
+type pubsubReceivedMessage struct {
+	AckID           string
+	DeliveryAttempt int
+	Message         struct {
+		Data        []byte
+		Attributes  map[string]string
+		MessageID   string
+		PublishTime string
+		OrderingKey string
+	}
+}
+
+func init() {
+	shared.TypeRegistry.Register(GooglePubSub{})
+}
+
+// Configure initializes this consumer with values from a plugin config.
+func (cons *GooglePubSub) Configure(conf core.PluginConfig) error {
+	err := cons.ConsumerBase.Configure(conf)
+	if err != nil {
+		return err
+	}
+
+	cons.endpoint = strings.TrimSuffix(conf.GetString("Endpoint", "https://pubsub.googleapis.com"), "/")
+	emulatorHost := os.Getenv("PUBSUB_EMULATOR_HOST")
+	if emulatorHost != "" {
+		cons.endpoint = "http://" + emulatorHost
+	}
+
+	cons.project = conf.GetString("Project", os.Getenv("GOOGLE_CLOUD_PROJECT"))
+	credentialFile := conf.GetString("CredentialFile", os.Getenv("GOOGLE_APPLICATION_CREDENTIALS"))
+	credentialType := strings.ToLower(conf.GetString("CredentialType", "auto"))
+	if credentialType == "auto" {
+		switch {
+		case credentialFile != "":
+			credentialType = "serviceaccount"
+		case emulatorHost != "":
+			credentialType = "none"
+		default:
+			credentialType = "metadata"
+		}
+	}
+
+	source, accountProject, err := newGoogleTokenSource(credentialType, credentialFile, pubsubScope)
+	if err != nil {
+		return err
+	}
+	cons.client = newGoogleTokenClient(source, newGRPCTransport())
+	if cons.project == "" {
+		cons.project = accountProject
+	}
+
+	cons.subscription = conf.GetString("Subscription", "default")
+	if !strings.Contains(cons.subscription, "/") && cons.project != "" {
+		cons.subscription = fmt.Sprintf("projects/%s/subscriptions/%s", cons.project, cons.subscription)
+	}
+
+	cons.maxMessages = shared.MaxI(conf.GetInt("MaxOutstandingMessages", 1000), 1)
+	cons.maxBytes = conf.GetInt("MaxOutstandingBytes", 0)
+	cons.ackDeadline = time.Duration(shared.MinI(shared.MaxI(conf.GetInt("AckDeadlineSec", 60), 10), 600)) * time.Second
+	cons.workers = shared.MaxI(conf.GetInt("Workers", 1), 1)
+	cons.retryDelay = time.Duration(conf.GetInt("RetryDelayMs", 3000)) * time.Millisecond
+
+	// Pub/Sub uses the client id to route reopened streams to the same backend
+	clientID := make([]byte, 16)
+	if _, err := rand.Read(clientID); err != nil {
+		return err
+	}
+	cons.clientID = hex.EncodeToString(clientID)
+
+	cons.leases = make(map[string]int)
+	cons.leaseGuard = new(sync.Mutex)
+	cons.released = sync.NewCond(cons.leaseGuard)
+	cons.ctx, cons.cancel = context.WithCancel(context.Background())
+	return nil
+}
+
+// call starts a call of the given method of the Subscriber service.
+func (cons *GooglePubSub) call(ctx context.Context, method string, body io.Reader) (*http.Response, error) {
+	methodURL := fmt.Sprintf("%s/google.pubsub.v1.Subscriber/%s", cons.endpoint, method)
+	metadata := map[string]string{"X-Goog-Request-Params": "subscription=" + url.QueryEscape(cons.subscription)}
+	return grpcCall(ctx, cons.client, methodURL, metadata, body)
+}
+
+// callWithTimeout calls a unary method that has to succeed even while
+// stopping. The response is discarded.
+func (cons *GooglePubSub) callWithTimeout(method string, request []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	response, err := cons.call(ctx, method, bytes.NewReader(grpcAppendMessage(nil, request)))
+	if err != nil {
+		return fmt.Errorf("%s failed: %s", method, err)
+	}
+	defer response.Body.Close()
+
+	for {
+		if _, err := grpcReadMessage(response.Body); err != nil {
+			if err == io.EOF {
+				err = grpcStatus(response.Trailer)
+			}
+			if err != nil {
+				return fmt.Errorf("%s failed: %s", method, err)
+			}
+			return nil // ### return, call finished ###
+		}
+	}
+}
+
+// modifyAckDeadline sets the ack deadline of the given messages in batches
+// of pubsubMaxAckIDs.
+func (cons *GooglePubSub) modifyAckDeadline(ackIDs []string, deadline time.Duration) error {
+	for len(ackIDs) > 0 {
+		batch := ackIDs[:shared.MinI(len(ackIDs), pubsubMaxAckIDs)]
+		ackIDs = ackIDs[len(batch):]
+
+		// ModifyAckDeadlineRequest
+		request := protoAppendBytes(nil, 1, []byte(cons.subscription))
+		request = protoAppendVarintField(request, 3, uint64(deadline/time.Second))
+		for _, ackID := range batch {
+			request = protoAppendBytes(request, 4, []byte(ackID))
+		}
+		if err := cons.callWithTimeout("ModifyAckDeadline", request); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// waitForCapacity blocks until the flow control limits allow receiving new
+// messages. Not reading from the stream in the meantime makes Pub/Sub hold
+// back messages, too.
+func (cons *GooglePubSub) waitForCapacity() {
+	cons.leaseGuard.Lock()
+	defer cons.leaseGuard.Unlock()
+
+	for cons.IsActive() && (len(cons.leases) >= cons.maxMessages ||
+		cons.maxBytes > 0 && cons.leaseBytes >= cons.maxBytes) {
+		cons.released.Wait()
+	}
+}
+
+func (cons *GooglePubSub) lease(received []pubsubReceivedMessage) {
+	cons.leaseGuard.Lock()
+	defer cons.leaseGuard.Unlock()
+	for _, message := range received {
+		size := len(message.Message.Data)
+		cons.leases[message.AckID] = size
+		cons.leaseBytes += size
+	}
+}
+
+func (cons *GooglePubSub) release(ackIDs []string) {
+	cons.leaseGuard.Lock()
+	defer cons.leaseGuard.Unlock()
+	for _, ackID := range ackIDs {
+		cons.leaseBytes -= cons.leases[ackID]
+		delete(cons.leases, ackID)
+	}
+	cons.released.Broadcast()
+}
+
+func (cons *GooglePubSub) leasedAckIDs() []string {
+	cons.leaseGuard.Lock()
+	defer cons.leaseGuard.Unlock()
+	ackIDs := make([]string, 0, len(cons.leases))
+	for ackID := range cons.leases {
+		ackIDs = append(ackIDs, ackID)
+	}
+	return ackIDs
+}
+
+// writeRequests writes the initial request of a stream to requests and
+// keeps the stream alive until ctx is done.
+func (cons *GooglePubSub) writeRequests(ctx context.Context, requests *io.PipeWriter) {
+	defer requests.Close()
+
+	// StreamingPullRequest
+	request := protoAppendBytes(nil, 1, []byte(cons.subscription))
+	request = protoAppendVarintField(request, 5, uint64(cons.ackDeadline/time.Second))
+	request = protoAppendBytes(request, 6, []byte(cons.clientID))
+	request = protoAppendVarintField(request, 7, uint64(cons.maxMessages))
+	request = protoAppendVarintField(request, 8, uint64(cons.maxBytes))
+	if _, err := requests.Write(grpcAppendMessage(nil, request)); err != nil {
+		return // ### return, stream closed ###
+	}
+
+	keepAlive := time.NewTicker(pubsubKeepAliveInterval)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return // ### return, stream closed ###
+		case <-keepAlive.C:
+			if _, err := requests.Write(grpcAppendMessage(nil, nil)); err != nil {
+				return // ### return, stream closed ###
+			}
+		}
+	}
+}
+
+// streamingPull opens a stream on the subscription and dispatches all
+// messages received until the stream ends or the consumer is stopped.
+// Messages with an ordering key are always passed to the same processor.
+func (cons *GooglePubSub) streamingPull(processors []chan pubsubReceivedMessage) error {
+	ctx, cancel := context.WithCancel(cons.ctx)
+	defer cancel()
+
+	body, requests := io.Pipe()
+	defer body.Close()
+	go shared.DontPanic(func() { cons.writeRequests(ctx, requests) })
+
+	response, err := cons.call(ctx, "StreamingPull", body)
+	if err != nil {
+		return err // ### return, stream not opened ###
+	}
+	defer response.Body.Close()
+
+	for {
+		cons.waitForCapacity()
+		if !cons.IsActive() {
+			return nil // ### return, stopping ###
+		}
+
+		data, err := grpcReadMessage(response.Body)
+		if err == io.EOF {
+			return grpcStatus(response.Trailer) // ### return, stream closed ###
+		}
+		if err != nil {
+			return err // ### return, stream broken ###
+		}
+
+		received, err := decodePubsubStreamingPullResponse(data)
+		if err != nil {
+			return err // ### return, invalid response ###
+		}
+
+		cons.lease(received)
+		for _, message := range received {
+			var index uint64
+			if key := message.Message.OrderingKey; key != "" {
+				hash := fnv.New32a()
+				hash.Write([]byte(key))
+				index = uint64(hash.Sum32())
+			} else {
+				index = atomic.AddUint64(&cons.roundRobin, 1)
+			}
+			processors[index%uint64(len(processors))] <- message
+		}
+	}
+}
+
+// pull keeps a stream open until the consumer is stopped. Streams failing
+// right after being opened are retried after retryDelay.
+func (cons *GooglePubSub) pull(processors []chan pubsubReceivedMessage) {
+	for cons.IsActive() {
+		opened := time.Now()
+		err := cons.streamingPull(processors)
+		if !cons.IsActive() {
+			return // ### return, stopping ###
+		}
+		if err != nil {
+			Log.Error.Printf("GooglePubSub stream of %s failed: %s", cons.subscription, err)
+		}
+		if time.Since(opened) < cons.retryDelay {
+			time.Sleep(cons.retryDelay)
+		}
+	}
+}
+
+// decodePubsubStreamingPullResponse returns the messages of an encoded
+// StreamingPullResponse.
+func decodePubsubStreamingPullResponse(data []byte) ([]pubsubReceivedMessage, error) {
+	fields, err := protoReadFields(data)
+	if err != nil {
+		return nil, err
+	}
+
+	received := []pubsubReceivedMessage{}
+	for _, field := range fields {
+		if field.number != 1 || field.wireType != protoWireBytes {
+			continue // ### continue, unknown field ###
+		}
+		message, err := decodePubsubReceivedMessage(field.data)
+		if err != nil {
+			return nil, err
+		}
+		received = append(received, message)
+	}
+	return received, nil
+}
+
+// decodePubsubReceivedMessage decodes a ReceivedMessage and the PubsubMessage
+// it contains.
+func decodePubsubReceivedMessage(data []byte) (pubsubReceivedMessage, error) {
+	received := pubsubReceivedMessage{}
+	fields, err := protoReadFields(data)
+	if err != nil {
+		return received, err
+	}
+
+	for _, field := range fields {
+		switch {
+		case field.number == 1 && field.wireType == protoWireBytes:
+			received.AckID = string(field.data)
+		case field.number == 3 && field.wireType == protoWireVarint:
+			received.DeliveryAttempt = int(int32(field.value))
+		case field.number == 2 && field.wireType == protoWireBytes:
+			messageFields, err := protoReadFields(field.data)
+			if err != nil {
+				return received, err
+			}
+			if err := decodePubsubMessage(&received, messageFields); err != nil {
+				return received, err
+			}
+		}
+	}
+
+	if received.AckID == "" {
+		return received, fmt.Errorf("Received message %s without ack id", received.Message.MessageID)
+	}
+	return received, nil
+}
+
+func decodePubsubMessage(received *pubsubReceivedMessage, fields []protoWireField) error {
+	for _, field := range fields {
+		if field.wireType != protoWireBytes {
+			continue // ### continue, unknown field ###
+		}
+
+		switch field.number {
+		case 1:
+			received.Message.Data = field.data
+		case 3:
+			received.Message.MessageID = string(field.data)
+		case 5:
+			received.Message.OrderingKey = string(field.data)
+
+		case 2:
+			// Map entries are messages with the key in field 1 and the
+			// value in field 2
+			entry, err := protoReadFields(field.data)
+			if err != nil {
+				return err
+			}
+			var key, value string
+			for _, entryField := range entry {
+				switch {
+				case entryField.number == 1 && entryField.wireType == protoWireBytes:
+					key = string(entryField.data)
+				case entryField.number == 2 && entryField.wireType == protoWireBytes:
+					value = string(entryField.data)
+				}
+			}
+			if received.Message.Attributes == nil {
+				received.Message.Attributes = make(map[string]string)
+			}
+			received.Message.Attributes[key] = value
+
+		case 4:
+			// google.protobuf.Timestamp
+			timestamp, err := protoReadFields(field.data)
+			if err != nil {
+				return err
+			}
+			var seconds, nanos int64
+			for _, timeField := range timestamp {
+				switch {
+				case timeField.number == 1 && timeField.wireType == protoWireVarint:
+					seconds = int64(timeField.value)
+				case timeField.number == 2 && timeField.wireType == protoWireVarint:
+					nanos = int64(int32(timeField.value))
+				}
+			}
+			received.Message.PublishTime = time.Unix(seconds, nanos).UTC().Format(time.RFC3339Nano)
+		}
+	}
+	return nil
+}
+
+func (cons *GooglePubSub) newMessage(received pubsubReceivedMessage, data []byte) core.Message {
+	msg := core.NewMessage(cons, data, atomic.AddUint64(&cons.sequence, 1))
+	msg.SetMetadata(pubsubMetadataMessageID, received.Message.MessageID)
+	msg.SetMetadata(pubsubMetadataPublishTime, received.Message.PublishTime)
+	if received.Message.OrderingKey != "" {
+		msg.SetMetadata(pubsubMetadataOrderingKey, received.Message.OrderingKey)
+	}
+	if received.DeliveryAttempt > 0 {
+		msg.SetMetadata(pubsubMetadataDeliveryAttempt, fmt.Sprint(received.DeliveryAttempt))
+	}
+	for name, value := range received.Message.Attributes {
+		msg.SetMetadata(pubsubMetadataAttribute+name, value)
+	}
+	return msg
+}
+
+// process enqueues all messages passed by pull and hands them to the
+// acker afterwards.
+func (cons *GooglePubSub) process(messages <-chan pubsubReceivedMessage) {
+	for received := range messages {
+		cons.WaitOnFuse()
+		cons.EnqueueMessage(cons.newMessage(received, received.Message.Data))
+		cons.acks <- received.AckID
+	}
+}
+
+func (cons *GooglePubSub) acknowledge(ackIDs []string) {
+	if len(ackIDs) == 0 {
+		return // ### return, nothing to do ###
+	}
+	// AcknowledgeRequest
+	request := protoAppendBytes(nil, 1, []byte(cons.subscription))
+	for _, ackID := range ackIDs {
+		request = protoAppendBytes(request, 2, []byte(ackID))
+	}
+	if err := cons.callWithTimeout("Acknowledge", request); err != nil {
+		Log.Error.Print("GooglePubSub failed to acknowledge messages: ", err)
+	}
+	cons.release(ackIDs)
+}
+
+// ack sends acknowledgements in batches until the acks channel is closed.
+func (cons *GooglePubSub) ack() {
+	flush := time.NewTicker(100 * time.Millisecond)
+	defer flush.Stop()
+
+	batch := make([]string, 0, pubsubMaxAckIDs)
+	for {
+		select {
+		case ackID, isOpen := <-cons.acks:
+			if !isOpen {
+				cons.acknowledge(batch)
+				return // ### return, all messages processed ###
+			}
+			if batch = append(batch, ackID); len(batch) == pubsubMaxAckIDs {
+				cons.acknowledge(batch)
+				batch = make([]string, 0, pubsubMaxAckIDs)
+			}
+
+		case <-flush.C:
+			if len(batch) > 0 {
+				cons.acknowledge(batch)
+				batch = make([]string, 0, pubsubMaxAckIDs)
+			}
+		}
+	}
+}
+
+// extendLeases extends the ack deadline of all outstanding messages until
+// the consumer is stopped.
+func (cons *GooglePubSub) extendLeases() {
+	extend := time.NewTicker(cons.ackDeadline / 2)
+	defer extend.Stop()
+
+	for {
+		select {
+		case <-cons.ctx.Done():
+			return // ### return, stopping ###
+		case <-extend.C:
+			if err := cons.modifyAckDeadline(cons.leasedAckIDs(), cons.ackDeadline); err != nil {
+				Log.Warning.Print("GooglePubSub failed to extend ack deadline: ", err)
+			}
+		}
+	}
+}
+
+func (cons *GooglePubSub) run() {
+	defer cons.WorkerDone()
+
+	if !strings.Contains(cons.subscription, "/") {
+		Log.Error.Printf("GooglePubSub requires a Project to read from subscription %s", cons.subscription)
+		return // ### return, no project ###
+	}
+
+	cons.acks = make(chan string, pubsubMaxAckIDs)
+	acked := make(chan struct{})
+	go shared.DontPanic(func() {
+		defer close(acked)
+		cons.ack()
+	})
+	go shared.DontPanic(cons.extendLeases)
+
+	processors := make([]chan pubsubReceivedMessage, cons.workers)
+	processed := new(sync.WaitGroup)
+	for i := range processors {
+		processors[i] = make(chan pubsubReceivedMessage, shared.MinI(cons.maxMessages, pubsubMaxAckIDs))
+		processed.Add(1)
+		go shared.DontPanic(func(messages <-chan pubsubReceivedMessage) func() {
+			return func() {
+				defer processed.Done()
+				cons.process(messages)
+			}
+		}(processors[i]))
+	}
+
+	// Messages received before stopping are processed and acknowledged
+	cons.pull(processors)
+	for _, messages := range processors {
+		close(messages)
+	}
+	processed.Wait()
+	close(cons.acks)
+	<-acked
+}
+
+func (cons *GooglePubSub) close() {
+	cons.cancel()
+	cons.leaseGuard.Lock()
+	cons.released.Broadcast()
+	cons.leaseGuard.Unlock()
+}
+
+// Consume opens a stream on the configured subscription.
+func (cons *GooglePubSub) Consume(workers *sync.WaitGroup) {
+	cons.SetWorkerWaitGroup(workers)
+	cons.SetStopCallback(cons.close)
+
+	cons.AddWorker()
+	go shared.DontPanic(cons.run)
+
+	cons.ControlLoop()
+}
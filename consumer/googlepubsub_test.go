@@ -0,0 +1,354 @@
+// Copyright 2015-2016 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumer
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/shared"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakePubSub serves the StreamingPull, Acknowledge and ModifyAckDeadline
+// methods of a single subscription. The first stream fails right away and
+// the second one breaks after sending a single response.
+type fakePubSub struct {
+	pending        []pubsubReceivedMessage
+	acked          []string
+	tokens         int
+	streams        int
+	subscription   string
+	ackDeadline    uint64
+	maxOutstanding uint64
+	clientIDs      map[string]bool
+	guard          sync.Mutex
+}
+
+func (fake *fakePubSub) publish(data, orderingKey string, attributes map[string]string) {
+	fake.guard.Lock()
+	defer fake.guard.Unlock()
+
+	message := pubsubReceivedMessage{AckID: fmt.Sprintf("ack%d", len(fake.pending)+len(fake.acked))}
+	message.Message.Data = []byte(data)
+	message.Message.MessageID = "id-" + message.AckID
+	message.Message.PublishTime = "2016-01-01T00:00:00.5Z"
+	message.Message.OrderingKey = orderingKey
+	message.Message.Attributes = attributes
+	if orderingKey == "" {
+		message.DeliveryAttempt = 2
+	}
+	fake.pending = append(fake.pending, message)
+}
+
+func (fake *fakePubSub) ackCount() int {
+	fake.guard.Lock()
+	defer fake.guard.Unlock()
+	return len(fake.acked)
+}
+
+func (fake *fakePubSub) take(count int) []pubsubReceivedMessage {
+	fake.guard.Lock()
+	defer fake.guard.Unlock()
+	batch := fake.pending[:shared.MinI(count, len(fake.pending))]
+	fake.pending = fake.pending[len(batch):]
+	return batch
+}
+
+func encodeTestStreamingPullResponse(batch []pubsubReceivedMessage) []byte {
+	response := []byte{}
+	for _, received := range batch {
+		message := protoAppendBytes(nil, 1, received.Message.Data)
+		for key, value := range received.Message.Attributes {
+			entry := protoAppendBytes(nil, 1, []byte(key))
+			entry = protoAppendBytes(entry, 2, []byte(value))
+			message = protoAppendBytes(message, 2, entry)
+		}
+		message = protoAppendBytes(message, 3, []byte(received.Message.MessageID))
+		publishTime, _ := time.Parse(time.RFC3339Nano, received.Message.PublishTime)
+		timestamp := protoAppendVarintField(nil, 1, uint64(publishTime.Unix()))
+		timestamp = protoAppendVarintField(timestamp, 2, uint64(publishTime.Nanosecond()))
+		message = protoAppendBytes(message, 4, timestamp)
+		if received.Message.OrderingKey != "" {
+			message = protoAppendBytes(message, 5, []byte(received.Message.OrderingKey))
+		}
+
+		encoded := protoAppendBytes(nil, 1, []byte(received.AckID))
+		encoded = protoAppendBytes(encoded, 2, message)
+		encoded = protoAppendVarintField(encoded, 3, uint64(received.DeliveryAttempt))
+		response = protoAppendBytes(response, 1, encoded)
+	}
+	return response
+}
+
+func (fake *fakePubSub) streamingPull(w http.ResponseWriter, r *http.Request) {
+	request, err := grpcReadMessage(r.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	fields, _ := protoReadFields(request)
+
+	fake.guard.Lock()
+	fake.streams++
+	stream := fake.streams
+	for _, field := range fields {
+		switch field.number {
+		case 1:
+			fake.subscription = string(field.data)
+		case 5:
+			fake.ackDeadline = field.value
+		case 6:
+			fake.clientIDs[string(field.data)] = true
+		case 7:
+			fake.maxOutstanding = field.value
+		}
+	}
+	fake.guard.Unlock()
+
+	w.Header().Set("Content-Type", "application/grpc")
+	if stream == 1 {
+		w.Header().Set("Grpc-Status", "14")
+		w.Header().Set("Grpc-Message", "backend%20unavailable")
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+	w.WriteHeader(http.StatusOK)
+	for batch := fake.take(5); len(batch) > 0; batch = fake.take(5) {
+		w.Write(grpcAppendMessage(nil, encodeTestStreamingPullResponse(batch)))
+		w.(http.Flusher).Flush()
+		if stream == 2 {
+			w.Header().Set("Grpc-Status", "14")
+			w.Header().Set("Grpc-Message", "stream%20reset")
+			return
+		}
+	}
+	<-r.Context().Done()
+}
+
+func (fake *fakePubSub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/token" {
+		fake.guard.Lock()
+		fake.tokens++
+		fake.guard.Unlock()
+		fmt.Fprint(w, `{"access_token":"secret","expires_in":3600}`)
+		return
+	}
+
+	if r.Header.Get("Authorization") != "Bearer secret" || r.ProtoMajor != 2 ||
+		r.Header.Get("X-Goog-Request-Params") != "subscription=projects%2Ftest%2Fsubscriptions%2Flogs" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	switch r.URL.Path {
+	case "/google.pubsub.v1.Subscriber/StreamingPull":
+		fake.streamingPull(w, r)
+		return
+
+	case "/google.pubsub.v1.Subscriber/Acknowledge":
+		request, _ := grpcReadMessage(r.Body)
+		fields, _ := protoReadFields(request)
+		fake.guard.Lock()
+		for _, field := range fields {
+			if field.number == 2 {
+				fake.acked = append(fake.acked, string(field.data))
+			}
+		}
+		fake.guard.Unlock()
+
+	case "/google.pubsub.v1.Subscriber/ModifyAckDeadline":
+
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	// Unary calls return google.protobuf.Empty
+	w.Header().Set("Content-Type", "application/grpc")
+	w.Header().Set("Trailer", "Grpc-Status")
+	w.Write(grpcAppendMessage(nil, nil))
+	w.Header().Set("Grpc-Status", "0")
+}
+
+func writeTestServiceAccount(expect shared.Expect, dir, tokenURL string) (string, *rsa.PrivateKey) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	expect.NoError(err)
+
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	account, _ := json.Marshal(map[string]string{
+		"type":         "service_account",
+		"project_id":   "test",
+		"client_email": "gollum@test.iam.gserviceaccount.com",
+		"private_key":  string(keyPEM),
+		"token_uri":    tokenURL,
+	})
+
+	keyFile := filepath.Join(dir, "account.json")
+	expect.NoError(ioutil.WriteFile(keyFile, account, 0600))
+	return keyFile, key
+}
+
+func TestGoogleClient(t *testing.T) {
+	expect := shared.NewExpect(t)
+
+	dir, err := ioutil.TempDir("", "gollum_google")
+	expect.NoError(err)
+	defer os.RemoveAll(dir)
+
+	var key *rsa.PrivateKey
+	claims := map[string]interface{}{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/token" {
+			fmt.Fprint(w, r.Header.Get("Authorization"))
+			return
+		}
+
+		// The assertion has to be signed with the service account key
+		parts := strings.Split(r.FormValue("assertion"), ".")
+		if r.FormValue("grant_type") != "urn:ietf:params:oauth:grant-type:jwt-bearer" || len(parts) != 3 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		signature, _ := base64.RawURLEncoding.DecodeString(parts[2])
+		digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+		if rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA256, digest[:], signature) != nil {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		claimData, _ := base64.RawURLEncoding.DecodeString(parts[1])
+		json.Unmarshal(claimData, &claims)
+		fmt.Fprint(w, `{"access_token":"secret","token_type":"Bearer","expires_in":3600}`)
+	}))
+	defer server.Close()
+
+	keyFile, key := writeTestServiceAccount(expect, dir, server.URL+"/token")
+	client, project, err := newGoogleClient("serviceaccount", keyFile, pubsubScope)
+	expect.NoError(err)
+	expect.Equal("test", project)
+
+	response, err := client.Get(server.URL + "/api")
+	expect.NoError(err)
+	authorization, _ := ioutil.ReadAll(response.Body)
+	response.Body.Close()
+	expect.Equal("Bearer secret", string(authorization))
+	expect.Equal("gollum@test.iam.gserviceaccount.com", claims["iss"])
+	expect.Equal(pubsubScope, claims["scope"])
+	expect.Equal(server.URL+"/token", claims["aud"])
+
+	_, _, err = newGoogleClient("serviceaccount", filepath.Join(dir, "missing.json"), pubsubScope)
+	expect.NotNil(err)
+	_, _, err = newGoogleClient("apikey", "", pubsubScope)
+	expect.NotNil(err)
+}
+
+func TestGooglePubSub(t *testing.T) {
+	expect := shared.NewExpect(t)
+
+	dir, err := ioutil.TempDir("", "gollum_google")
+	expect.NoError(err)
+	defer os.RemoveAll(dir)
+
+	fake := &fakePubSub{clientIDs: make(map[string]bool)}
+	server := httptest.NewUnstartedServer(fake)
+	server.Config.Protocols = new(http.Protocols)
+	server.Config.Protocols.SetHTTP1(true)
+	server.Config.Protocols.SetUnencryptedHTTP2(true)
+	server.Start()
+	defer server.Close()
+
+	stream := &mockHTTPStream{}
+	core.StreamRegistry.Register(stream, core.GetStreamID("pubsub"))
+
+	keyFile, _ := writeTestServiceAccount(expect, dir, server.URL+"/token")
+	conf := core.NewPluginConfig("")
+	conf.Stream = []string{"pubsub"}
+	conf.Override("Endpoint", server.URL)
+	conf.Override("Subscription", "logs")
+	conf.Override("CredentialType", "serviceaccount")
+	conf.Override("CredentialFile", keyFile)
+	conf.Override("MaxOutstandingMessages", 3)
+	conf.Override("Workers", 4)
+	conf.Override("RetryDelayMs", 10)
+
+	plugin, err := core.NewPluginWithType("consumer.GooglePubSub", conf)
+	expect.NoError(err)
+	cons, casted := plugin.(*GooglePubSub)
+	expect.True(casted)
+
+	fake.publish("plain", "", map[string]string{"host": "web1"})
+	for i := 0; i < 20; i++ {
+		fake.publish(fmt.Sprint(i), "ordered", nil)
+	}
+
+	workers := new(sync.WaitGroup)
+	go cons.Consume(workers)
+
+	expect.NonBlocking(2*time.Second, func() {
+		for stream.count() < 21 || fake.ackCount() < 21 {
+			time.Sleep(10 * time.Millisecond)
+		}
+	})
+	cons.Control() <- core.PluginControlStopConsumer
+	expect.NonBlocking(2*time.Second, workers.Wait)
+
+	stream.guard.Lock()
+	defer stream.guard.Unlock()
+	fake.guard.Lock()
+	defer fake.guard.Unlock()
+
+	expect.Equal(21, len(stream.messages))
+	expect.Equal(21, len(fake.acked))
+	expect.Equal(1, fake.tokens)
+
+	// Streams are reopened with the same settings after failures
+	expect.Equal(3, fake.streams)
+	expect.Equal("projects/test/subscriptions/logs", fake.subscription)
+	expect.Equal(uint64(60), fake.ackDeadline)
+	expect.Equal(uint64(3), fake.maxOutstanding)
+	expect.Equal(1, len(fake.clientIDs))
+
+	next := 0
+	for _, msg := range stream.messages {
+		if msg.Metadata[pubsubMetadataOrderingKey] != "ordered" {
+			expect.Equal("plain", string(msg.Data))
+			expect.Equal("id-ack0", msg.Metadata[pubsubMetadataMessageID])
+			expect.Equal("2016-01-01T00:00:00.5Z", msg.Metadata[pubsubMetadataPublishTime])
+			expect.Equal("2", msg.Metadata[pubsubMetadataDeliveryAttempt])
+			expect.Equal("web1", msg.Metadata[pubsubMetadataAttribute+"host"])
+			continue
+		}
+		expect.Equal(fmt.Sprint(next), string(msg.Data))
+		next++
+	}
+	expect.Equal(20, next)
+}
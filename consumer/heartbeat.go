@@ -0,0 +1,193 @@
+// Copyright 2015-2016 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumer
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/core/log"
+	"github.com/trivago/gollum/shared"
+	"os"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// Heartbeat consumer plugin
+// The Heartbeat consumer generates a message in a fixed interval or on a cron
+// schedule. This can be used to send canary messages through a pipeline to
+// verify that it is working end to end.
+// When attached to a fuse, this consumer will not generate messages in case
+// that fuse is burned.
+// The payload is rendered from a text/template. The function "json" can be
+// used to write a value as JSON. The following values can be accessed from
+// within the template:
+//  * .Hostname is the name of the host gollum is running on.
+//  * .Timestamp is the time the message was generated (a time.Time).
+//  * .Counter is the number of the message, starting at 1.
+// Configuration example
+//
+//  - "consumer.Heartbeat":
+//    Payload: "{\"heartbeat\":{{ .Counter }},\"host\":{{ json .Hostname }},\"timestamp\":{{ .Timestamp.Unix }}}"
+//    IntervalMs: 10000
+//    Schedule: ""
+//    SendOnStart: false
+//
+// Payload defines the template rendered for each message. See the
+// documentation of the Go text/template package for the syntax. By default
+// this is set to a JSON object containing counter, hostname and timestamp as
+// shown above.
+//
+// IntervalMs defines the time in milliseconds between two messages.
+// By default this is set to 10000.
+//
+// Schedule defines a cron expression like "*/5 * * * *" that is evaluated in
+// local time. If set, IntervalMs is ignored. The macros "@hourly", "@daily",
+// "@weekly", "@monthly" and "@yearly" are supported, too. By default this is
+// set to "".
+//
+// SendOnStart can be set to true to send a message as soon as the consumer
+// has been started. By default this is set to false.
+type Heartbeat struct {
+	core.ConsumerBase
+	payload     *template.Template
+	schedule    *shared.CronSchedule
+	interval    time.Duration
+	hostname    string
+	counter     uint64
+	stop        chan struct{}
+	sendOnStart bool
+}
+
+// heartbeatData is the value passed to the payload template of a Heartbeat
+// consumer.
+type heartbeatData struct {
+	Hostname  string
+	Timestamp time.Time
+	Counter   uint64
+}
+
+func init() {
+	shared.TypeRegistry.Register(Heartbeat{})
+}
+
+// Configure initializes this consumer with values from a plugin config.
+func (cons *Heartbeat) Configure(conf core.PluginConfig) error {
+	err := cons.ConsumerBase.Configure(conf)
+	if err != nil {
+		return err
+	}
+
+	text := conf.GetString("Payload", `{"heartbeat":{{ .Counter }},"host":{{ json .Hostname }},"timestamp":{{ .Timestamp.Unix }}}`)
+	functions := template.FuncMap{
+		"json": heartbeatJSON,
+	}
+	if cons.payload, err = template.New("Payload").Funcs(functions).Parse(text); err != nil {
+		return err
+	}
+
+	if spec := conf.GetString("Schedule", ""); spec != "" {
+		if cons.schedule, err = shared.ParseCronSchedule(spec); err != nil {
+			return err
+		}
+	}
+
+	if cons.hostname, err = os.Hostname(); err != nil {
+		Log.Warning.Print("Heartbeat could not get hostname: ", err)
+	}
+
+	cons.interval = time.Duration(shared.MaxI(conf.GetInt("IntervalMs", 10000), 1)) * time.Millisecond
+	cons.sendOnStart = conf.GetBool("SendOnStart", false)
+	cons.stop = make(chan struct{})
+	return nil
+}
+
+// heartbeatJSON writes the given value as JSON.
+func heartbeatJSON(value interface{}) (string, error) {
+	buffer := bytes.NewBuffer(nil)
+	encoder := json.NewEncoder(buffer)
+	encoder.SetEscapeHTML(false)
+	err := encoder.Encode(value)
+	return string(bytes.TrimRight(buffer.Bytes(), "\n")), err
+}
+
+func (cons *Heartbeat) send(now time.Time) {
+	if cons.IsFuseBurned() {
+		return // ### return, fuse burned ###
+	}
+
+	cons.counter++
+	values := heartbeatData{
+		Hostname:  cons.hostname,
+		Timestamp: now,
+		Counter:   cons.counter,
+	}
+
+	var payload bytes.Buffer
+	if err := cons.payload.Execute(&payload, values); err != nil {
+		Log.Error.Print("Heartbeat failed to render payload: ", err)
+		return // ### return, template error ###
+	}
+	cons.Enqueue(payload.Bytes(), cons.counter)
+}
+
+// next returns the time the next message is due.
+func (cons *Heartbeat) next(now time.Time) time.Time {
+	if cons.schedule != nil {
+		return cons.schedule.Next(now)
+	}
+	return now.Add(cons.interval)
+}
+
+func (cons *Heartbeat) generate() {
+	defer cons.WorkerDone()
+
+	if cons.sendOnStart {
+		cons.send(time.Now())
+	}
+
+	due := cons.next(time.Now())
+	for !due.IsZero() {
+		timer := time.NewTimer(due.Sub(time.Now()))
+		select {
+		case now := <-timer.C:
+			cons.send(now)
+			// Missed messages are skipped instead of being sent at once
+			if due = cons.next(due); due.Before(now) {
+				due = cons.next(now)
+			}
+		case <-cons.stop:
+			timer.Stop()
+			return // ### return, stopped ###
+		}
+	}
+	Log.Warning.Print("Heartbeat schedule does not match any time")
+}
+
+func (cons *Heartbeat) close() {
+	close(cons.stop)
+}
+
+// Consume generates messages until the consumer is stopped.
+func (cons *Heartbeat) Consume(workers *sync.WaitGroup) {
+	cons.SetWorkerWaitGroup(workers)
+	cons.SetStopCallback(cons.close)
+
+	cons.AddWorker()
+	go shared.DontPanic(cons.generate)
+
+	cons.ControlLoop()
+}
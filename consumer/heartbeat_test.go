@@ -0,0 +1,87 @@
+// Copyright 2015-2016 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumer
+
+import (
+	"encoding/json"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/shared"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestHeartbeat(t *testing.T) {
+	expect := shared.NewExpect(t)
+
+	stream := &mockHTTPStream{}
+	core.StreamRegistry.Register(stream, core.GetStreamID("heartbeat"))
+	conf := core.NewPluginConfig("")
+	conf.Stream = []string{"heartbeat"}
+	conf.Override("IntervalMs", 20)
+	conf.Override("SendOnStart", true)
+	plugin, err := core.NewPluginWithType("consumer.Heartbeat", conf)
+	expect.NoError(err)
+	cons := plugin.(*Heartbeat)
+
+	workers := new(sync.WaitGroup)
+	go cons.Consume(workers)
+
+	expect.NonBlocking(2*time.Second, func() {
+		for stream.count() < 3 {
+			time.Sleep(10 * time.Millisecond)
+		}
+	})
+	cons.Control() <- core.PluginControlStopConsumer
+	expect.NonBlocking(2*time.Second, workers.Wait)
+
+	hostname, _ := os.Hostname()
+	for i, msg := range stream.messages[:3] {
+		record := map[string]interface{}{}
+		expect.NoError(json.Unmarshal(msg.Data, &record))
+		expect.Equal(float64(i+1), record["heartbeat"])
+		expect.Equal(hostname, record["host"])
+		expect.Equal(uint64(i+1), msg.Sequence)
+	}
+}
+
+func TestHeartbeatConfigure(t *testing.T) {
+	expect := shared.NewExpect(t)
+
+	conf := core.NewPluginConfig("")
+	conf.Override("Payload", "{{ .Host }}")
+	plugin, err := core.NewPluginWithType("consumer.Heartbeat", conf)
+	expect.NoError(err)
+	cons := plugin.(*Heartbeat)
+	cons.send(time.Now())
+	expect.Equal(uint64(1), cons.counter)
+
+	conf.Override("Payload", "{{ .Counter")
+	_, err = core.NewPluginWithType("consumer.Heartbeat", conf)
+	expect.NotNil(err)
+
+	conf = core.NewPluginConfig("")
+	conf.Override("Schedule", "@hourly")
+	plugin, err = core.NewPluginWithType("consumer.Heartbeat", conf)
+	expect.NoError(err)
+	cons = plugin.(*Heartbeat)
+	now := time.Date(2016, 8, 1, 10, 7, 0, 0, time.Local)
+	expect.Equal(time.Date(2016, 8, 1, 11, 0, 0, 0, time.Local), cons.next(now))
+
+	conf.Override("Schedule", "* * *")
+	_, err = core.NewPluginWithType("consumer.Heartbeat", conf)
+	expect.NotNil(err)
+}
@@ -16,11 +16,17 @@ package consumer
 
 import (
 	"bytes"
+	"compress/gzip"
+	"compress/zlib"
 	"crypto/tls"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net/http"
 	"os"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -31,19 +37,42 @@ import (
 	"github.com/trivago/gollum/shared"
 )
 
+const (
+	httpBodyRaw = iota
+	httpBodyLines
+	httpBodyJSON
+)
+
 // Http consumer plugin
 // This consumer opens up an HTTP 1.1 server and processes the contents of any
 // incoming HTTP request.
 // When attached to a fuse, this consumer will return error 503 in case that
 // fuse is burned.
+// The address of the client is attached to each message as "source_address"
+// metadata.
+// Requests are answered with status 200 if all messages have been accepted,
+// 400 if the body cannot be parsed, 401 if authentication failed, 404 if the
+// path is not a configured endpoint, 413 if the body is too large and 415 if
+// the body uses an unsupported Content-Encoding.
+// If more than one of Htpasswd, APIKeys and JWT verification is configured, a
+// request has to pass one of them.
 // Configuration example
 //
 //  - "consumer.Http":
 //    Address: ":80"
 //    ReadTimeoutSec: 3
 //    WithHeaders: true
+//    BodyFormat: "raw"
+//    MaxBodySizeByte: 10485760
+//    Endpoints: {}
 //    Htpasswd: ""
 //    BasicRealm: ""
+//    APIKeys: []
+//    APIKeyHeader: "X-API-Key"
+//    JWTSecretFile: ""
+//    JWTPublicKeyFile: ""
+//    JWTIssuer: ""
+//    JWTAudience: ""
 //    Certificate: ""
 //    PrivateKey: ""
 //
@@ -55,12 +84,51 @@ import (
 // the HTTP read request. By default this is set to 3 seconds.
 //
 // WithHeaders can be set to false to only read the HTTP body instead of passing
-// the whole HTTP message. By default this setting is set to true.
+// the whole HTTP message. This setting is only used if BodyFormat is set to
+// "raw". Compressed bodies are passed decompressed and without the
+// Content-Encoding header. By default this setting is set to true.
+//
+// BodyFormat defines how messages are read from the body of a request. Bodies
+// compressed with gzip or deflate are decompressed if the request sets the
+// corresponding Content-Encoding. By default this is set to "raw".
+//  * "raw" creates one message per request.
+//  * "lines" creates one message per line of newline-delimited data, e.g.
+//    NDJSON. Empty lines are ignored.
+//  * "json" creates one message per element of a JSON array. Other JSON values
+//    create a single message.
+//
+// MaxBodySizeByte defines the maximum size of a decompressed request body.
+// Larger requests are rejected. By default this is set to 10485760 (10 MB).
+//
+// Endpoints maps URL paths to streams, e.g. "/logs": "logs". Messages sent to
+// a mapped path are sent to the mapped stream instead of the streams set by
+// Stream. If set, requests to other paths are rejected. Empty by default.
 //
 // Htpasswd can be set to the htpasswd formatted file to enable HTTP BasicAuth
 //
 // BasicRealm can be set for HTTP BasicAuth
 //
+// APIKeys defines a list of keys that are accepted in the APIKeyHeader header
+// of a request. Empty by default.
+//
+// APIKeyHeader defines the header holding the API key. By default this is set
+// to "X-API-Key".
+//
+// JWTSecretFile defines a file containing the secret used to verify JSON web
+// tokens signed with HS256, HS384 or HS512. Tokens are read from the header
+// "Authorization: Bearer <token>". A trailing line break is ignored.
+// By default this is set to "".
+//
+// JWTPublicKeyFile defines a file containing a PEM encoded RSA public key used
+// to verify JSON web tokens signed with RS256, RS384 or RS512.
+// By default this is set to "".
+//
+// JWTIssuer defines the issuer ("iss") a token has to contain. By default this
+// is set to "" which accepts all issuers.
+//
+// JWTAudience defines the audience ("aud") a token has to contain. By default
+// this is set to "" which accepts all audiences.
+//
 // Certificate defines a path to a root certificate file to make this consumer
 // handle HTTPS connections. Left empty by default (disabled).
 // If a Certificate is given, a PrivateKey must be given, too.
@@ -75,9 +143,15 @@ type Http struct {
 	sequence       uint64
 	readTimeoutSec time.Duration
 	withHeaders    bool
+	bodyFormat     int
+	maxBodySize    int64
+	endpoints      map[string][]core.MappedStream
 	htpasswd       string
 	secrets        auth.SecretProvider
 	basicRealm     string
+	apiKeys        []string
+	apiKeyHeader   string
+	jwt            *httpJWTVerifier
 	certificate    *tls.Config
 }
 
@@ -95,6 +169,24 @@ func (cons *Http) Configure(conf core.PluginConfig) error {
 	cons.address = conf.GetString("Address", ":80")
 	cons.readTimeoutSec = time.Duration(conf.GetInt("ReadTimeoutSec", 3)) * time.Second
 	cons.withHeaders = conf.GetBool("WithHeaders", true)
+	cons.maxBodySize = int64(conf.GetInt("MaxBodySizeByte", 10<<20))
+
+	bodyFormat := strings.ToLower(conf.GetString("BodyFormat", "raw"))
+	switch bodyFormat {
+	case "raw":
+		cons.bodyFormat = httpBodyRaw
+	case "lines":
+		cons.bodyFormat = httpBodyLines
+	case "json":
+		cons.bodyFormat = httpBodyJSON
+	default:
+		return fmt.Errorf("Unknown BodyFormat: %s", bodyFormat)
+	}
+
+	cons.endpoints = make(map[string][]core.MappedStream)
+	for path, streamName := range conf.GetStringMap("Endpoints", map[string]string{}) {
+		cons.endpoints[path] = core.NewMappedStreams([]string{streamName})
+	}
 
 	cons.htpasswd = conf.GetString("Htpasswd", "")
 	cons.basicRealm = conf.GetString("BasicRealm", "")
@@ -106,6 +198,18 @@ func (cons *Http) Configure(conf core.PluginConfig) error {
 		cons.secrets = auth.HtpasswdFileProvider(cons.htpasswd)
 	}
 
+	cons.apiKeys = conf.GetStringArray("APIKeys", []string{})
+	cons.apiKeyHeader = conf.GetString("APIKeyHeader", "X-API-Key")
+
+	cons.jwt, err = newHTTPJWTVerifier(
+		conf.GetString("JWTSecretFile", ""),
+		conf.GetString("JWTPublicKeyFile", ""),
+		conf.GetString("JWTIssuer", ""),
+		conf.GetString("JWTAudience", ""))
+	if err != nil {
+		return err
+	}
+
 	certificateFile := conf.GetString("Certificate", "")
 	keyFile := conf.GetString("PrivateKey", "")
 
@@ -136,21 +240,156 @@ func (cons *Http) checkAuth(r *http.Request) bool {
 	return true
 }
 
+// isAuthorized returns true if a request passes one of the configured
+// authentication methods or if authentication is disabled.
+func (cons *Http) isAuthorized(req *http.Request) bool {
+	if cons.htpasswd == "" && len(cons.apiKeys) == 0 && cons.jwt == nil {
+		return true // ### return, no authentication ###
+	}
+
+	if cons.htpasswd != "" && cons.checkAuth(req) {
+		return true
+	}
+	if len(cons.apiKeys) > 0 && containsAPIKey(cons.apiKeys, req.Header.Get(cons.apiKeyHeader)) {
+		return true
+	}
+	if cons.jwt != nil {
+		authorization := req.Header.Get("Authorization")
+		if strings.HasPrefix(authorization, "Bearer ") {
+			err := cons.jwt.verify(strings.TrimPrefix(authorization, "Bearer "))
+			if err == nil {
+				return true
+			}
+			Log.Debug.Print("Http rejected token: ", err)
+		}
+	}
+	return false
+}
+
+// readBody returns the decompressed body of a request and the status code to
+// return if the body cannot be read.
+func (cons *Http) readBody(resp http.ResponseWriter, req *http.Request) ([]byte, int) {
+	if req.Body == nil {
+		return nil, http.StatusBadRequest // ### return, missing body ###
+	}
+	req.Body = http.MaxBytesReader(resp, req.Body, cons.maxBodySize)
+	defer req.Body.Close()
+
+	var reader io.Reader = req.Body
+	switch encoding := strings.ToLower(req.Header.Get("Content-Encoding")); encoding {
+	case "", "identity":
+	case "gzip", "x-gzip":
+		gzipReader, err := gzip.NewReader(req.Body)
+		if err != nil {
+			return nil, http.StatusBadRequest // ### return, invalid gzip ###
+		}
+		defer gzipReader.Close()
+		reader = gzipReader
+	case "deflate":
+		zlibReader, err := zlib.NewReader(req.Body)
+		if err != nil {
+			return nil, http.StatusBadRequest // ### return, invalid deflate ###
+		}
+		defer zlibReader.Close()
+		reader = zlibReader
+	default:
+		return nil, http.StatusUnsupportedMediaType
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(reader, cons.maxBodySize+1))
+	var tooLarge *http.MaxBytesError
+	switch {
+	case errors.As(err, &tooLarge):
+		return nil, http.StatusRequestEntityTooLarge
+	case err != nil:
+		Log.Error.Print("HttpRequest: ", err.Error())
+		return nil, http.StatusBadRequest
+	case int64(len(body)) > cons.maxBodySize:
+		return nil, http.StatusRequestEntityTooLarge
+	}
+	return body, http.StatusOK
+}
+
+// splitBody returns the messages contained in a request body
+func (cons *Http) splitBody(body []byte) ([][]byte, error) {
+	switch cons.bodyFormat {
+	case httpBodyLines:
+		messages := [][]byte{}
+		for _, line := range bytes.Split(body, []byte{'\n'}) {
+			if line = bytes.TrimRight(line, "\r"); len(line) > 0 {
+				messages = append(messages, line)
+			}
+		}
+		return messages, nil
+
+	case httpBodyJSON:
+		body = bytes.TrimSpace(body)
+		if !bytes.HasPrefix(body, []byte{'['}) {
+			if !json.Valid(body) {
+				return nil, fmt.Errorf("invalid JSON")
+			}
+			return [][]byte{body}, nil // ### return, single value ###
+		}
+		elements := []json.RawMessage{}
+		if err := json.Unmarshal(body, &elements); err != nil {
+			return nil, err
+		}
+		messages := make([][]byte, 0, len(elements))
+		for _, element := range elements {
+			messages = append(messages, []byte(element))
+		}
+		return messages, nil
+
+	default:
+		return [][]byte{body}, nil
+	}
+}
+
+func (cons *Http) sendMessage(data []byte, sourceAddress string, streams []core.MappedStream) {
+	msg := core.NewMessage(cons, data, atomic.AddUint64(&cons.sequence, 1))
+	msg.SetMetadata(core.MetadataSourceAddress, sourceAddress)
+	if streams != nil {
+		cons.EnqueueMessageTo(msg, streams)
+	} else {
+		cons.EnqueueMessage(msg)
+	}
+}
+
 // requestHandler will handle a single web request.
 func (cons *Http) requestHandler(resp http.ResponseWriter, req *http.Request) {
-	if cons.htpasswd != "" {
-		if !cons.checkAuth(req) {
-			resp.WriteHeader(http.StatusUnauthorized)
-			return
+	if !cons.isAuthorized(req) {
+		resp.WriteHeader(http.StatusUnauthorized)
+		return // ### return, not authorized ###
+	}
+
+	var streams []core.MappedStream
+	if len(cons.endpoints) > 0 {
+		var exists bool
+		if streams, exists = cons.endpoints[req.URL.Path]; !exists {
+			resp.WriteHeader(http.StatusNotFound)
+			return // ### return, unknown endpoint ###
 		}
 	}
+
 	if cons.IsFuseBurned() {
 		resp.WriteHeader(http.StatusServiceUnavailable)
 		return // ### return, service is down ###
 	}
 
-	if cons.withHeaders {
-		// Read the whole package
+	// Read only the message body
+	body, status := cons.readBody(resp, req)
+	if status != http.StatusOK {
+		resp.WriteHeader(status)
+		return // ### return, invalid body ###
+	}
+
+	if cons.withHeaders && cons.bodyFormat == httpBodyRaw {
+		// Read the whole package with the decompressed body
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+		req.ContentLength = int64(len(body))
+		req.TransferEncoding = nil
+		req.Header.Del("Content-Encoding")
+
 		requestBuffer := bytes.NewBuffer(nil)
 		if err := req.Write(requestBuffer); err != nil {
 			resp.WriteHeader(http.StatusBadRequest)
@@ -158,27 +397,22 @@ func (cons *Http) requestHandler(resp http.ResponseWriter, req *http.Request) {
 			return // ### return, missing body or bad write ###
 		}
 
-		cons.Enqueue(requestBuffer.Bytes(), atomic.AddUint64(&cons.sequence, 1))
+		cons.sendMessage(requestBuffer.Bytes(), req.RemoteAddr, streams)
 		resp.WriteHeader(http.StatusOK)
-	} else {
-		// Read only the message body
-		if req.Body == nil {
-			resp.WriteHeader(http.StatusBadRequest)
-			return // ### return, missing body ###
-		}
+		return
+	}
 
-		body := make([]byte, req.ContentLength)
-		length, err := req.Body.Read(body)
-		if err != nil && err != io.EOF {
-			resp.WriteHeader(http.StatusBadRequest)
-			Log.Error.Print("HttpRequest: ", err.Error())
-			return // ### return, missing body or bad write ###
-		}
-		defer req.Body.Close()
+	messages, err := cons.splitBody(body)
+	if err != nil {
+		resp.WriteHeader(http.StatusBadRequest)
+		Log.Debug.Print("HttpRequest: ", err.Error())
+		return // ### return, invalid batch ###
+	}
 
-		cons.Enqueue(body[:length], atomic.AddUint64(&cons.sequence, 1))
-		resp.WriteHeader(http.StatusOK)
+	for _, data := range messages {
+		cons.sendMessage(data, req.RemoteAddr, streams)
 	}
+	resp.WriteHeader(http.StatusOK)
 }
 
 func (cons *Http) serve() {
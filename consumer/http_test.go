@@ -0,0 +1,242 @@
+// Copyright 2015-2016 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumer
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/shared"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type mockHTTPStream struct {
+	messages []core.Message
+	guard    sync.Mutex
+}
+
+func (stream *mockHTTPStream) GetBoundStreamID() core.MessageStreamID { return 0 }
+func (stream *mockHTTPStream) Pause(capacity int)                     {}
+func (stream *mockHTTPStream) Resume()                                {}
+func (stream *mockHTTPStream) Flush()                                 {}
+func (stream *mockHTTPStream) AddProducer(producers ...core.Producer) {}
+func (stream *mockHTTPStream) GetProducers() []core.Producer          { return nil }
+func (stream *mockHTTPStream) Enqueue(msg core.Message) {
+	stream.guard.Lock()
+	defer stream.guard.Unlock()
+	stream.messages = append(stream.messages, msg)
+}
+
+func (stream *mockHTTPStream) count() int {
+	stream.guard.Lock()
+	defer stream.guard.Unlock()
+	return len(stream.messages)
+}
+
+func sendTestHTTPRequest(cons *Http, req *http.Request) int {
+	req.RemoteAddr = "10.0.0.1:1234"
+	recorder := httptest.NewRecorder()
+	cons.requestHandler(recorder, req)
+	return recorder.Code
+}
+
+func TestHttpBatches(t *testing.T) {
+	expect := shared.NewExpect(t)
+
+	defaultStream := &mockHTTPStream{}
+	core.StreamRegistry.Register(defaultStream, core.GetStreamID("httpDefault"))
+	logStream := &mockHTTPStream{}
+	core.StreamRegistry.Register(logStream, core.GetStreamID("httpLogs"))
+
+	conf := core.NewPluginConfig("")
+	conf.Stream = []string{"httpDefault"}
+	conf.Override("BodyFormat", "lines")
+	conf.Override("Endpoints", map[string]string{"/logs": "httpLogs", "/": "httpDefault"})
+	conf.Override("APIKeys", []string{"secret"})
+	plugin, err := core.NewPluginWithType("consumer.Http", conf)
+	expect.NoError(err)
+	cons, casted := plugin.(*Http)
+	expect.True(casted)
+
+	req := httptest.NewRequest("POST", "/logs", bytes.NewBufferString("a\r\n\nb\n"))
+	expect.Equal(http.StatusUnauthorized, sendTestHTTPRequest(cons, req))
+
+	req = httptest.NewRequest("POST", "/unknown", bytes.NewBufferString("a\n"))
+	req.Header.Set("X-API-Key", "secret")
+	expect.Equal(http.StatusNotFound, sendTestHTTPRequest(cons, req))
+
+	compressed := bytes.NewBuffer(nil)
+	writer := gzip.NewWriter(compressed)
+	writer.Write([]byte("a\r\n\nb\n"))
+	writer.Close()
+
+	req = httptest.NewRequest("POST", "/logs", compressed)
+	req.Header.Set("X-API-Key", "secret")
+	req.Header.Set("Content-Encoding", "gzip")
+	expect.Equal(http.StatusOK, sendTestHTTPRequest(cons, req))
+
+	expect.Equal(0, len(defaultStream.messages))
+	if expect.Equal(2, len(logStream.messages)) {
+		expect.Equal("a", logStream.messages[0].String())
+		expect.Equal("b", logStream.messages[1].String())
+		expect.Equal("10.0.0.1:1234", logStream.messages[0].Metadata[core.MetadataSourceAddress])
+	}
+
+	req = httptest.NewRequest("POST", "/logs", bytes.NewBufferString("a\n"))
+	req.Header.Set("X-API-Key", "secret")
+	req.Header.Set("Content-Encoding", "br")
+	expect.Equal(http.StatusUnsupportedMediaType, sendTestHTTPRequest(cons, req))
+}
+
+func TestHttpJSON(t *testing.T) {
+	expect := shared.NewExpect(t)
+
+	stream := &mockHTTPStream{}
+	core.StreamRegistry.Register(stream, core.GetStreamID("httpJSON"))
+
+	conf := core.NewPluginConfig("")
+	conf.Stream = []string{"httpJSON"}
+	conf.Override("BodyFormat", "json")
+	conf.Override("MaxBodySizeByte", 32)
+	plugin, err := core.NewPluginWithType("consumer.Http", conf)
+	expect.NoError(err)
+	cons, casted := plugin.(*Http)
+	expect.True(casted)
+
+	req := httptest.NewRequest("POST", "/", bytes.NewBufferString(`[{"a":1}, "b"]`))
+	expect.Equal(http.StatusOK, sendTestHTTPRequest(cons, req))
+
+	req = httptest.NewRequest("POST", "/", bytes.NewBufferString(`{"c":2}`))
+	expect.Equal(http.StatusOK, sendTestHTTPRequest(cons, req))
+
+	if expect.Equal(3, len(stream.messages)) {
+		expect.Equal(`{"a":1}`, stream.messages[0].String())
+		expect.Equal(`"b"`, stream.messages[1].String())
+		expect.Equal(`{"c":2}`, stream.messages[2].String())
+	}
+
+	req = httptest.NewRequest("POST", "/", bytes.NewBufferString(`[{"a":1}`))
+	expect.Equal(http.StatusBadRequest, sendTestHTTPRequest(cons, req))
+
+	req = httptest.NewRequest("POST", "/", bytes.NewBufferString(`["0123456789", "0123456789", "0123456789"]`))
+	expect.Equal(http.StatusRequestEntityTooLarge, sendTestHTTPRequest(cons, req))
+	expect.Equal(3, len(stream.messages))
+}
+
+func TestHttpWithHeaders(t *testing.T) {
+	expect := shared.NewExpect(t)
+
+	stream := &mockHTTPStream{}
+	core.StreamRegistry.Register(stream, core.GetStreamID("httpHeaders"))
+
+	conf := core.NewPluginConfig("")
+	conf.Stream = []string{"httpHeaders"}
+	conf.Override("MaxBodySizeByte", 64)
+	plugin, err := core.NewPluginWithType("consumer.Http", conf)
+	expect.NoError(err)
+	cons, casted := plugin.(*Http)
+	expect.True(casted)
+
+	compressed := bytes.NewBuffer(nil)
+	writer := gzip.NewWriter(compressed)
+	writer.Write([]byte("test"))
+	writer.Close()
+
+	req := httptest.NewRequest("POST", "/", compressed)
+	req.Header.Set("Content-Encoding", "gzip")
+	expect.Equal(http.StatusOK, sendTestHTTPRequest(cons, req))
+
+	if expect.Equal(1, len(stream.messages)) {
+		message := stream.messages[0].String()
+		expect.True(strings.HasSuffix(message, "\r\n\r\ntest"))
+		expect.True(strings.Contains(message, "Content-Length: 4\r\n"))
+		expect.False(strings.Contains(message, "Content-Encoding"))
+	}
+
+	// The limit applies to the decompressed body
+	compressed = bytes.NewBuffer(nil)
+	writer = gzip.NewWriter(compressed)
+	writer.Write(bytes.Repeat([]byte("a"), 1024))
+	writer.Close()
+
+	req = httptest.NewRequest("POST", "/", compressed)
+	req.Header.Set("Content-Encoding", "gzip")
+	expect.Equal(http.StatusRequestEntityTooLarge, sendTestHTTPRequest(cons, req))
+
+	req = httptest.NewRequest("POST", "/", bytes.NewBuffer(bytes.Repeat([]byte("a"), 65)))
+	expect.Equal(http.StatusRequestEntityTooLarge, sendTestHTTPRequest(cons, req))
+	expect.Equal(1, len(stream.messages))
+}
+
+func newTestJWT(secret string, payload string) string {
+	signed := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`)) + "." +
+		base64.RawURLEncoding.EncodeToString([]byte(payload))
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(signed))
+	return signed + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func TestHttpJWT(t *testing.T) {
+	expect := shared.NewExpect(t)
+
+	dir, err := ioutil.TempDir("", "gollum_http")
+	expect.NoError(err)
+	defer os.RemoveAll(dir)
+
+	secretFile := filepath.Join(dir, "secret")
+	expect.NoError(ioutil.WriteFile(secretFile, []byte("secret\n"), 0600))
+
+	stream := &mockHTTPStream{}
+	core.StreamRegistry.Register(stream, core.GetStreamID("httpJWT"))
+
+	conf := core.NewPluginConfig("")
+	conf.Stream = []string{"httpJWT"}
+	conf.Override("WithHeaders", false)
+	conf.Override("JWTSecretFile", secretFile)
+	conf.Override("JWTAudience", "gollum")
+	plugin, err := core.NewPluginWithType("consumer.Http", conf)
+	expect.NoError(err)
+	cons, casted := plugin.(*Http)
+	expect.True(casted)
+	cons.jwt.now = func() time.Time { return time.Unix(1500000000, 0) }
+
+	tokens := map[string]int{
+		newTestJWT("secret", `{"aud":"gollum","exp":1500000100}`): http.StatusOK,
+		newTestJWT("secret", `{"aud":["a","gollum"]}`):            http.StatusOK,
+		newTestJWT("secret", `{"aud":"gollum","exp":1400000000}`): http.StatusUnauthorized,
+		newTestJWT("secret", `{"aud":"other"}`):                   http.StatusUnauthorized,
+		newTestJWT("wrong", `{"aud":"gollum"}`):                   http.StatusUnauthorized,
+		newTestJWT("secret", `{"aud":"gollum","nbf":1500000100}`): http.StatusUnauthorized,
+		"invalid": http.StatusUnauthorized,
+	}
+
+	for token, status := range tokens {
+		req := httptest.NewRequest("POST", "/", bytes.NewBufferString("test"))
+		req.Header.Set("Authorization", "Bearer "+token)
+		expect.Equal(status, sendTestHTTPRequest(cons, req))
+	}
+	expect.Equal(2, len(stream.messages))
+}
@@ -0,0 +1,210 @@
+// Copyright 2015-2016 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumer
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"hash"
+	"io/ioutil"
+	"strings"
+	"time"
+)
+
+// httpJWTVerifier validates JSON web tokens signed with HMAC or RSA
+type httpJWTVerifier struct {
+	secret    []byte
+	publicKey *rsa.PublicKey
+	issuer    string
+	audience  string
+	now       func() time.Time
+}
+
+type httpJWTHeader struct {
+	Algorithm string `json:"alg"`
+}
+
+type httpJWTClaims struct {
+	Issuer    string          `json:"iss"`
+	Audience  json.RawMessage `json:"aud"`
+	ExpiresAt *float64        `json:"exp"`
+	NotBefore *float64        `json:"nbf"`
+}
+
+// newHTTPJWTVerifier creates a verifier for tokens signed with the secret
+// stored in secretFile (HS256, HS384, HS512) or with the private key matching
+// the PEM encoded RSA public key stored in publicKeyFile (RS256, RS384, RS512).
+func newHTTPJWTVerifier(secretFile string, publicKeyFile string, issuer string, audience string) (*httpJWTVerifier, error) {
+	verifier := &httpJWTVerifier{
+		issuer:   issuer,
+		audience: audience,
+		now:      time.Now,
+	}
+
+	switch {
+	case secretFile != "" && publicKeyFile != "":
+		return nil, fmt.Errorf("JWTSecretFile and JWTPublicKeyFile cannot be used together")
+
+	case secretFile != "":
+		secret, err := ioutil.ReadFile(secretFile)
+		if err != nil {
+			return nil, err
+		}
+		if verifier.secret = bytes.TrimRight(secret, "\r\n"); len(verifier.secret) == 0 {
+			return nil, fmt.Errorf("JWTSecretFile %s is empty", secretFile)
+		}
+
+	case publicKeyFile != "":
+		data, err := ioutil.ReadFile(publicKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return nil, fmt.Errorf("JWTPublicKeyFile %s does not contain a PEM block", publicKeyFile)
+		}
+		key, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		publicKey, isRSA := key.(*rsa.PublicKey)
+		if !isRSA {
+			return nil, fmt.Errorf("JWTPublicKeyFile %s does not contain an RSA key", publicKeyFile)
+		}
+		verifier.publicKey = publicKey
+
+	default:
+		return nil, nil // ### return, JWT disabled ###
+	}
+
+	return verifier, nil
+}
+
+// verify returns an error if the given token is not valid
+func (verifier *httpJWTVerifier) verify(token string) error {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return fmt.Errorf("malformed token")
+	}
+
+	header := httpJWTHeader{}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return err
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return err
+	}
+	if err := verifier.verifySignature(header.Algorithm, parts[0]+"."+parts[1], signature); err != nil {
+		return err
+	}
+
+	claims := httpJWTClaims{}
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return err
+	}
+	now := float64(verifier.now().Unix())
+	switch {
+	case claims.ExpiresAt != nil && now >= *claims.ExpiresAt:
+		return fmt.Errorf("token expired")
+	case claims.NotBefore != nil && now < *claims.NotBefore:
+		return fmt.Errorf("token not valid yet")
+	case verifier.issuer != "" && claims.Issuer != verifier.issuer:
+		return fmt.Errorf("invalid issuer")
+	case verifier.audience != "" && !claims.hasAudience(verifier.audience):
+		return fmt.Errorf("invalid audience")
+	}
+	return nil
+}
+
+func (verifier *httpJWTVerifier) verifySignature(algorithm string, signed string, signature []byte) error {
+	if len(algorithm) != 5 {
+		return fmt.Errorf("unsupported algorithm %s", algorithm)
+	}
+
+	var hashType crypto.Hash
+	var newHash func() hash.Hash
+	switch algorithm[2:] {
+	case "256":
+		hashType, newHash = crypto.SHA256, sha256.New
+	case "384":
+		hashType, newHash = crypto.SHA384, sha512.New384
+	case "512":
+		hashType, newHash = crypto.SHA512, sha512.New
+	default:
+		return fmt.Errorf("unsupported algorithm %s", algorithm)
+	}
+
+	switch {
+	case verifier.secret != nil && strings.HasPrefix(algorithm, "HS"):
+		mac := hmac.New(newHash, verifier.secret)
+		mac.Write([]byte(signed))
+		if !hmac.Equal(mac.Sum(nil), signature) {
+			return fmt.Errorf("invalid signature")
+		}
+		return nil
+
+	case verifier.publicKey != nil && strings.HasPrefix(algorithm, "RS"):
+		hasher := newHash()
+		hasher.Write([]byte(signed))
+		return rsa.VerifyPKCS1v15(verifier.publicKey, hashType, hasher.Sum(nil), signature)
+	}
+	return fmt.Errorf("unsupported algorithm %s", algorithm)
+}
+
+func decodeJWTPart(part string, value interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, value)
+}
+
+// hasAudience returns true if the audience claim, which is either a string or
+// a list of strings, contains the given audience
+func (claims httpJWTClaims) hasAudience(audience string) bool {
+	single := ""
+	if err := json.Unmarshal(claims.Audience, &single); err == nil {
+		return single == audience
+	}
+	list := []string{}
+	if err := json.Unmarshal(claims.Audience, &list); err == nil {
+		for _, entry := range list {
+			if entry == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// containsAPIKey compares the given key with all valid keys in constant time
+func containsAPIKey(keys []string, key string) bool {
+	found := 0
+	for _, validKey := range keys {
+		found |= subtle.ConstantTimeCompare([]byte(validKey), []byte(key))
+	}
+	return found == 1
+}
@@ -0,0 +1,642 @@
+// Copyright 2015-2016 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumer
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/jmespath/go-jmespath"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/core/log"
+	"github.com/trivago/gollum/shared"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	httpPollMetadataURL   = "http_url"
+	httpPollMetadataEvent = "sse_event"
+	httpPollMetadataID    = "sse_id"
+
+	httpPollModePoll = "poll"
+	httpPollModeSSE  = "sse"
+)
+
+// HTTPPoll consumer plugin
+// The HTTPPoll consumer pulls data from HTTP APIs. It either requests the
+// configured URLs periodically or keeps a connection to each URL open to
+// receive Server-Sent Events (SSE) as sent by many streaming APIs.
+// When polling, each response creates one message. Conditional requests
+// (ETag and Last-Modified) are used to skip responses that did not change
+// since the last request. When receiving Server-Sent Events, each event
+// creates one message. Lost streams are reestablished and resumed using the
+// id of the last event received.
+// A JSONPath expression can be used to extract values from JSON responses or
+// events. If the expression yields a list, each element creates one message.
+// The URL is attached to each message as "http_url" metadata. For
+// Server-Sent Events the event type and id are attached as "sse_event" and
+// "sse_id".
+// When attached to a fuse, this consumer will stop requesting data in case
+// that fuse is burned.
+// Configuration example
+//
+//  - "consumer.HTTPPoll":
+//    URLs:
+//      - "https://api.example.com/v1/items"
+//    Mode: "poll"
+//    IntervalSec: 60
+//    TimeoutSec: 10
+//    RetryDelayMs: 3000
+//    Headers:
+//      "Accept": "application/json"
+//    User: ""
+//    Password: ""
+//    BearerToken: ""
+//    BearerTokenFile: ""
+//    Conditional: true
+//    Expression: "$.items"
+//    SplitArrays: true
+//    Events: []
+//    MaxBodySizeByte: 10485760
+//    TlsKeyLocation: ""
+//    TlsCertificateLocation: ""
+//    TlsCaLocation: ""
+//    TlsServerName: ""
+//    TlsInsecureSkipVerify: false
+//
+// URLs defines a list of http or https URLs to request. By default this list
+// is empty.
+//
+// Mode defines how data is requested. By default this is set to "poll".
+//  * "poll" requests each URL every IntervalSec.
+//  * "sse" keeps a connection to each URL open and receives Server-Sent
+//    Events.
+//
+// IntervalSec defines the number of seconds between two requests of a URL
+// in "poll" mode. By default this is set to 60.
+//
+// TimeoutSec defines the number of seconds after which a request is aborted.
+// In "sse" mode this limits the time to wait for the response headers, the
+// stream itself may stay open indefinitely. By default this is set to 10.
+//
+// RetryDelayMs defines the number of milliseconds to wait before a lost
+// stream is reestablished in "sse" mode. The server may change this delay
+// with the "retry" field of an event. By default this is set to 3000.
+//
+// Headers defines a map of additional headers sent with each request.
+// By default this map is empty.
+//
+// User defines the user name used for basic authentication. By default this
+// is set to "", which disables basic authentication.
+//
+// Password defines the password used for basic authentication. By default
+// this is set to "".
+//
+// BearerToken defines a token sent as "Authorization: Bearer" header.
+// By default this is set to "", which disables token authentication.
+//
+// BearerTokenFile defines a file to read the token from instead. The file is
+// read for each request, so rotated tokens are picked up. A trailing line
+// break is ignored. By default this is set to "".
+//
+// Conditional can be set to false to disable conditional requests in "poll"
+// mode. If enabled, the ETag and Last-Modified headers of the last response
+// are sent as "If-None-Match" and "If-Modified-Since" with the next request.
+// Responses with status 304 (not modified) do not create messages.
+// By default this is set to true.
+//
+// Expression defines a JSONPath expression evaluated against each JSON
+// response or event, e.g. "$.data.items". JMESPath expressions like
+// "items[?active].id" are supported, too, as the leading "$" is removed
+// before the expression is compiled. Strings are written as is, all other
+// values as JSON. Results evaluating to null do not create messages.
+// By default this is set to "", which passes responses and events on
+// unchanged.
+//
+// SplitArrays can be set to false to create one message of an expression
+// yielding a list instead of one message per element. By default this is set
+// to true.
+//
+// Events defines a list of event types to create messages for in "sse"
+// mode. Events without type have the type "message". By default this list is
+// empty, which accepts all events.
+//
+// MaxBodySizeByte defines the maximum size of a response in "poll" mode and
+// of an event in "sse" mode. Larger responses are dropped, larger events
+// close the stream. By default this is set to 10485760 (10 MB).
+//
+// TlsKeyLocation defines the path to the client's private key (PEM) used
+// for authentication at https URLs. By default this is set to "".
+//
+// TlsCertificateLocation defines the path to the client's public key (PEM)
+// used for authentication at https URLs. By default this is set to "".
+//
+// TlsCaLocation defines the path to CA certificate(s) for verifying the
+// certificates of https URLs. By default this is set to "", which uses the
+// certificate authorities of the system.
+//
+// TlsServerName is used to verify the hostname on the certificates of https
+// URLs unless TlsInsecureSkipVerify is true. By default this is set to "",
+// which uses the host of each URL.
+//
+// TlsInsecureSkipVerify controls whether to verify the certificate chain
+// and host name of https URLs. By default this is set to false.
+type HTTPPoll struct {
+	core.ConsumerBase
+	urls            []string
+	mode            string
+	interval        time.Duration
+	timeout         time.Duration
+	retryDelay      time.Duration
+	headers         map[string]string
+	user            string
+	password        string
+	bearerToken     string
+	bearerTokenFile string
+	conditional     bool
+	expression      *jmespath.JMESPath
+	splitArrays     bool
+	events          map[string]bool
+	maxBodySize     int
+	client          *http.Client
+	ctx             context.Context
+	cancel          context.CancelFunc
+	sequence        uint64
+}
+
+// httpPollState holds the state kept between the requests of a URL.
+type httpPollState struct {
+	url          string
+	etag         string
+	lastModified string
+	lastEventID  string
+	retryDelay   time.Duration
+}
+
+func init() {
+	shared.TypeRegistry.Register(HTTPPoll{})
+}
+
+// Configure initializes this consumer with values from a plugin config.
+func (cons *HTTPPoll) Configure(conf core.PluginConfig) error {
+	err := cons.ConsumerBase.Configure(conf)
+	if err != nil {
+		return err
+	}
+
+	cons.urls = conf.GetStringArray("URLs", []string{})
+	for _, rawURL := range cons.urls {
+		parsedURL, err := url.Parse(rawURL)
+		if err != nil || (parsedURL.Scheme != "http" && parsedURL.Scheme != "https") || parsedURL.Host == "" {
+			return fmt.Errorf("Invalid URL %s", rawURL)
+		}
+	}
+
+	switch cons.mode = strings.ToLower(conf.GetString("Mode", httpPollModePoll)); cons.mode {
+	case httpPollModePoll, httpPollModeSSE:
+	default:
+		return fmt.Errorf("Unknown mode: %s", cons.mode)
+	}
+
+	cons.interval = time.Duration(shared.MaxI(conf.GetInt("IntervalSec", 60), 1)) * time.Second
+	cons.timeout = time.Duration(shared.MaxI(conf.GetInt("TimeoutSec", 10), 1)) * time.Second
+	cons.retryDelay = time.Duration(shared.MaxI(conf.GetInt("RetryDelayMs", 3000), 0)) * time.Millisecond
+	cons.headers = conf.GetStringMap("Headers", map[string]string{})
+	cons.user = conf.GetString("User", "")
+	cons.password = conf.GetString("Password", "")
+	cons.bearerToken = conf.GetString("BearerToken", "")
+	cons.bearerTokenFile = conf.GetString("BearerTokenFile", "")
+	if cons.bearerToken != "" && cons.bearerTokenFile != "" {
+		return fmt.Errorf("BearerToken and BearerTokenFile cannot be used together")
+	}
+	cons.conditional = conf.GetBool("Conditional", true)
+	cons.splitArrays = conf.GetBool("SplitArrays", true)
+	cons.maxBodySize = shared.MaxI(conf.GetInt("MaxBodySizeByte", 10485760), 1)
+
+	if expression := conf.GetString("Expression", ""); expression != "" {
+		if cons.expression, err = compileHTTPPollExpression(expression); err != nil {
+			return fmt.Errorf("Invalid Expression: %s", err)
+		}
+	}
+
+	cons.events = make(map[string]bool)
+	for _, event := range conf.GetStringArray("Events", []string{}) {
+		cons.events[event] = true
+	}
+
+	tlsConfig, err := shared.NewClientTLSConfig(
+		conf.GetString("TlsCertificateLocation", ""),
+		conf.GetString("TlsKeyLocation", ""),
+		conf.GetString("TlsCaLocation", ""),
+		conf.GetString("TlsServerName", ""),
+		conf.GetBool("TlsInsecureSkipVerify", false))
+	if err != nil {
+		return err
+	}
+
+	// Timeouts are set per request as streams must not time out
+	cons.client = &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig:       tlsConfig,
+			Proxy:                 http.ProxyFromEnvironment,
+			ResponseHeaderTimeout: cons.timeout,
+		},
+	}
+	cons.ctx, cons.cancel = context.WithCancel(context.Background())
+	return nil
+}
+
+// compileHTTPPollExpression compiles a JMESPath expression. A leading "$" as
+// used by JSONPath is removed.
+func compileHTTPPollExpression(expression string) (*jmespath.JMESPath, error) {
+	expression = strings.TrimSpace(expression)
+	if strings.HasPrefix(expression, "$") {
+		expression = strings.TrimPrefix(expression[1:], ".")
+		if expression == "" {
+			expression = "@"
+		}
+	}
+	return jmespath.Compile(expression)
+}
+
+// newRequest creates a GET request carrying the configured headers and
+// credentials.
+func (cons *HTTPPoll) newRequest(ctx context.Context, state *httpPollState) (*http.Request, error) {
+	req, err := http.NewRequest("GET", state.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	for name, value := range cons.headers {
+		req.Header.Set(name, value)
+	}
+	if cons.user != "" {
+		req.SetBasicAuth(cons.user, cons.password)
+	}
+
+	token := cons.bearerToken
+	if cons.bearerTokenFile != "" {
+		data, err := ioutil.ReadFile(cons.bearerTokenFile)
+		if err != nil {
+			return nil, err
+		}
+		token = strings.TrimRight(string(data), "\r\n")
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	return req, nil
+}
+
+// extract returns the payloads of the messages created from a response or
+// an event.
+func (cons *HTTPPoll) extract(data []byte) ([][]byte, error) {
+	if cons.expression == nil {
+		return [][]byte{data}, nil // ### return, passthrough ###
+	}
+
+	var document interface{}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(&document); err != nil {
+		return nil, err
+	}
+	result, err := cons.expression.Search(document)
+	if err != nil {
+		return nil, err
+	}
+
+	values := []interface{}{result}
+	if list, isList := result.([]interface{}); isList && cons.splitArrays {
+		values = list
+	}
+	payloads := [][]byte{}
+	for _, value := range values {
+		switch value := value.(type) {
+		case nil:
+			continue // ### continue, no value ###
+		case string:
+			payloads = append(payloads, []byte(value))
+		default:
+			payload, err := json.Marshal(value)
+			if err != nil {
+				return nil, err
+			}
+			payloads = append(payloads, payload)
+		}
+	}
+	return payloads, nil
+}
+
+// enqueue creates messages from a response or an event.
+func (cons *HTTPPoll) enqueue(data []byte, metadata core.MessageMetadata) error {
+	payloads, err := cons.extract(data)
+	if err != nil {
+		return err
+	}
+	for _, payload := range payloads {
+		msg := core.NewMessage(cons, payload, atomic.AddUint64(&cons.sequence, 1))
+		for key, value := range metadata {
+			msg.SetMetadata(key, value)
+		}
+		cons.EnqueueMessage(msg)
+	}
+	return nil
+}
+
+// poll requests a URL once.
+func (cons *HTTPPoll) poll(state *httpPollState) error {
+	ctx, cancel := context.WithTimeout(cons.ctx, cons.timeout)
+	defer cancel()
+
+	req, err := cons.newRequest(ctx, state)
+	if err != nil {
+		return err
+	}
+	if cons.conditional {
+		if state.etag != "" {
+			req.Header.Set("If-None-Match", state.etag)
+		}
+		if state.lastModified != "" {
+			req.Header.Set("If-Modified-Since", state.lastModified)
+		}
+	}
+
+	response, err := cons.client.Do(req)
+	if err != nil {
+		return err // ### return, request failed ###
+	}
+	defer response.Body.Close()
+
+	switch {
+	case response.StatusCode == http.StatusNotModified || response.StatusCode == http.StatusNoContent:
+		return nil // ### return, nothing new ###
+	case response.StatusCode < 200 || response.StatusCode > 299:
+		message, _ := ioutil.ReadAll(io.LimitReader(response.Body, 1024))
+		return fmt.Errorf("Request returned %s: %s", response.Status, strings.TrimSpace(string(message)))
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(response.Body, int64(cons.maxBodySize)+1))
+	if err != nil {
+		return err
+	}
+	if len(body) > cons.maxBodySize {
+		return fmt.Errorf("Response exceeds %d bytes", cons.maxBodySize)
+	}
+
+	// Validators are only stored once the response has been processed, so
+	// failed responses are requested again
+	if err := cons.enqueue(body, core.MessageMetadata{httpPollMetadataURL: state.url}); err != nil {
+		return err
+	}
+	state.etag = response.Header.Get("ETag")
+	state.lastModified = response.Header.Get("Last-Modified")
+	return nil
+}
+
+// stream receives Server-Sent Events from a URL until the connection is
+// closed.
+func (cons *HTTPPoll) stream(state *httpPollState) error {
+	req, err := cons.newRequest(cons.ctx, state)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "text/event-stream")
+	req.Header.Set("Cache-Control", "no-cache")
+	if state.lastEventID != "" {
+		req.Header.Set("Last-Event-ID", state.lastEventID)
+	}
+
+	response, err := cons.client.Do(req)
+	if err != nil {
+		return err // ### return, request failed ###
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		message, _ := ioutil.ReadAll(io.LimitReader(response.Body, 1024))
+		return fmt.Errorf("Request returned %s: %s", response.Status, strings.TrimSpace(string(message)))
+	}
+	if contentType := response.Header.Get("Content-Type"); !strings.HasPrefix(contentType, "text/event-stream") {
+		return fmt.Errorf("Expected an event stream, got %s", contentType)
+	}
+
+	reader := newSSEReader(response.Body, cons.maxBodySize, state)
+	for {
+		event, err := reader.next()
+		if err != nil {
+			return err
+		}
+		if len(cons.events) > 0 && !cons.events[event.eventType] {
+			continue // ### continue, event type not requested ###
+		}
+
+		cons.WaitOnFuse()
+		metadata := core.MessageMetadata{
+			httpPollMetadataURL:   state.url,
+			httpPollMetadataEvent: event.eventType,
+		}
+		if event.id != "" {
+			metadata[httpPollMetadataID] = event.id
+		}
+		if err := cons.enqueue(event.data, metadata); err != nil {
+			Log.Warning.Printf("HTTPPoll failed to extract event from %s: %s", state.url, err)
+		}
+	}
+}
+
+func (cons *HTTPPoll) runPoll(state *httpPollState) {
+	defer cons.WorkerDone()
+
+	ticker := time.NewTicker(cons.interval)
+	defer ticker.Stop()
+
+	for {
+		cons.WaitOnFuse()
+		if err := cons.poll(state); err != nil && cons.ctx.Err() == nil {
+			Log.Warning.Printf("HTTPPoll failed to poll %s: %s", state.url, err)
+		}
+
+		select {
+		case <-cons.ctx.Done():
+			return // ### return, stopped ###
+		case <-ticker.C:
+		}
+	}
+}
+
+func (cons *HTTPPoll) runStream(state *httpPollState) {
+	defer cons.WorkerDone()
+
+	for {
+		cons.WaitOnFuse()
+		err := cons.stream(state)
+		if cons.ctx.Err() != nil {
+			return // ### return, stopped ###
+		}
+		if err == io.EOF {
+			Log.Debug.Printf("HTTPPoll stream %s closed by server", state.url)
+		} else {
+			Log.Warning.Printf("HTTPPoll stream %s failed: %s", state.url, err)
+		}
+
+		select {
+		case <-cons.ctx.Done():
+			return // ### return, stopped ###
+		case <-time.After(state.retryDelay):
+		}
+	}
+}
+
+func (cons *HTTPPoll) close() {
+	cons.cancel()
+}
+
+// Consume starts polling or streaming all URLs.
+func (cons *HTTPPoll) Consume(workers *sync.WaitGroup) {
+	cons.SetWorkerWaitGroup(workers)
+	cons.SetStopCallback(cons.close)
+
+	if len(cons.urls) == 0 {
+		Log.Warning.Print("HTTPPoll has no URLs to request")
+	}
+	for _, rawURL := range cons.urls {
+		state := &httpPollState{url: rawURL, retryDelay: cons.retryDelay}
+		cons.AddWorker()
+		if cons.mode == httpPollModeSSE {
+			go shared.DontPanic(func() { cons.runStream(state) })
+		} else {
+			go shared.DontPanic(func() { cons.runPoll(state) })
+		}
+	}
+
+	cons.ControlLoop()
+}
+
+// sseEvent is an event received from an event stream.
+type sseEvent struct {
+	id        string
+	eventType string
+	data      []byte
+}
+
+// sseReader parses an event stream as defined by the HTML standard. The id
+// of the last event and the reconnection delay are stored in the state of
+// the stream, so they are kept when reconnecting.
+type sseReader struct {
+	scanner     *bufio.Scanner
+	maxSize     int
+	state       *httpPollState
+	idBuffer    string
+	isFirstLine bool
+}
+
+func newSSEReader(reader io.Reader, maxSize int, state *httpPollState) *sseReader {
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 4096), maxSize)
+	scanner.Split(scanSSELines)
+	return &sseReader{scanner: scanner, maxSize: maxSize, state: state, idBuffer: state.lastEventID, isFirstLine: true}
+}
+
+// scanSSELines splits lines ending in "\r\n", "\n" or "\r".
+func scanSSELines(data []byte, atEOF bool) (int, []byte, error) {
+	if end := bytes.IndexAny(data, "\r\n"); end >= 0 {
+		switch {
+		case data[end] == '\n':
+			return end + 1, data[:end], nil
+		case end+1 < len(data) && data[end+1] == '\n':
+			return end + 2, data[:end], nil
+		case end+1 < len(data) || atEOF:
+			return end + 1, data[:end], nil
+		}
+		return 0, nil, nil // ### return, "\r\n" might be split ###
+	}
+	if atEOF && len(data) > 0 {
+		return len(data), data, nil
+	}
+	return 0, nil, nil
+}
+
+// next returns the next event. Incomplete events at the end of the stream
+// are discarded and io.EOF is returned. Ids are only stored once an event is
+// complete, so incomplete events are sent again after reconnecting.
+func (reader *sseReader) next() (sseEvent, error) {
+	event := sseEvent{}
+	data := []byte{}
+	hasData := false
+
+	for reader.scanner.Scan() {
+		line := reader.scanner.Text()
+		if reader.isFirstLine {
+			line = strings.TrimPrefix(line, "\uFEFF")
+			reader.isFirstLine = false
+		}
+
+		if line == "" {
+			reader.state.lastEventID = reader.idBuffer
+			if !hasData {
+				event.eventType = ""
+				continue // ### continue, nothing to dispatch ###
+			}
+			if event.eventType == "" {
+				event.eventType = "message"
+			}
+			event.id = reader.idBuffer
+			event.data = bytes.TrimSuffix(data, []byte{'\n'})
+			return event, nil
+		}
+		if line[0] == ':' {
+			continue // ### continue, comment ###
+		}
+
+		field, value := line, ""
+		if colon := strings.IndexByte(line, ':'); colon >= 0 {
+			field, value = line[:colon], strings.TrimPrefix(line[colon+1:], " ")
+		}
+		switch field {
+		case "event":
+			event.eventType = value
+		case "data":
+			if len(data)+len(value) >= reader.maxSize {
+				return event, fmt.Errorf("Event exceeds %d bytes", reader.maxSize)
+			}
+			data = append(append(data, value...), '\n')
+			hasData = true
+		case "id":
+			if !strings.Contains(value, "\x00") {
+				reader.idBuffer = value
+			}
+		case "retry":
+			if delay, err := strconv.ParseUint(value, 10, 32); err == nil {
+				reader.state.retryDelay = time.Duration(delay) * time.Millisecond
+			}
+		}
+	}
+
+	if err := reader.scanner.Err(); err != nil {
+		return event, err
+	}
+	return event, io.EOF
+}
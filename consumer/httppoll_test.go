@@ -0,0 +1,306 @@
+// Copyright 2015-2016 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumer
+
+import (
+	"fmt"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/shared"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func httpPollTestMessages(stream *mockHTTPStream) []string {
+	stream.guard.Lock()
+	defer stream.guard.Unlock()
+
+	messages := []string{}
+	for _, msg := range stream.messages {
+		if event, isEvent := msg.Metadata[httpPollMetadataEvent]; isEvent {
+			messages = append(messages, fmt.Sprintf("%s/%s %s", event, msg.Metadata[httpPollMetadataID], msg.Data))
+		} else {
+			messages = append(messages, string(msg.Data))
+		}
+	}
+	return messages
+}
+
+func TestHTTPPoll(t *testing.T) {
+	expect := shared.NewExpect(t)
+
+	dir, err := ioutil.TempDir("", "gollum_httppoll")
+	expect.NoError(err)
+	defer os.RemoveAll(dir)
+	tokenFile := filepath.Join(dir, "token")
+	expect.NoError(ioutil.WriteFile(tokenFile, []byte("token1\n"), 0600))
+
+	requests := []string{}
+	body := `{"items": [{"id": 12345678901234567890, "name": "a"}, {"id": 2, "name": "b"}], "next": null}`
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, req *http.Request) {
+		requests = append(requests, fmt.Sprintf("%s %s %s %s", req.Header.Get("Authorization"), req.Header.Get("X-Api"),
+			req.Header.Get("If-None-Match"), req.Header.Get("If-Modified-Since")))
+		switch {
+		case req.URL.Path == "/error":
+			http.Error(writer, "broken", http.StatusInternalServerError)
+		case req.Header.Get("If-None-Match") == `"v1"`:
+			writer.WriteHeader(http.StatusNotModified)
+		default:
+			writer.Header().Set("ETag", `"v1"`)
+			writer.Header().Set("Last-Modified", "Wed, 14 Oct 2026 10:00:00 GMT")
+			io.WriteString(writer, body)
+		}
+	}))
+	defer server.Close()
+
+	stream := &mockHTTPStream{}
+	core.StreamRegistry.Register(stream, core.GetStreamID("httpPoll"))
+	conf := core.NewPluginConfig("")
+	conf.Stream = []string{"httpPoll"}
+	conf.Override("URLs", []string{server.URL + "/items"})
+	conf.Override("Headers", map[string]string{"X-Api": "1"})
+	conf.Override("BearerTokenFile", tokenFile)
+	conf.Override("Expression", "$.items")
+	plugin, err := core.NewPluginWithType("consumer.HTTPPoll", conf)
+	expect.NoError(err)
+	cons, casted := plugin.(*HTTPPoll)
+	expect.True(casted)
+
+	state := &httpPollState{url: server.URL + "/items"}
+	expect.NoError(cons.poll(state))
+	expect.NoError(ioutil.WriteFile(tokenFile, []byte("token2"), 0600))
+	expect.NoError(cons.poll(state))
+	expect.Equal([]string{
+		"Bearer token1 1  ",
+		`Bearer token2 1 "v1" Wed, 14 Oct 2026 10:00:00 GMT`,
+	}, requests)
+	expect.Equal([]string{`{"id":12345678901234567890,"name":"a"}`, `{"id":2,"name":"b"}`}, httpPollTestMessages(stream))
+	expect.Equal(server.URL+"/items", stream.messages[0].Metadata[httpPollMetadataURL])
+
+	err = cons.poll(&httpPollState{url: server.URL + "/error"})
+	expect.NotNil(err)
+	if err != nil {
+		expect.Equal("Request returned 500 Internal Server Error: broken", err.Error())
+	}
+
+	// Basic authentication and unconditional requests
+	requests = requests[:0]
+	stream = &mockHTTPStream{}
+	core.StreamRegistry.Register(stream, core.GetStreamID("httpPollBasic"))
+	conf = core.NewPluginConfig("")
+	conf.Stream = []string{"httpPollBasic"}
+	conf.Override("User", "user")
+	conf.Override("Password", "secret")
+	conf.Override("Conditional", false)
+	plugin, err = core.NewPluginWithType("consumer.HTTPPoll", conf)
+	expect.NoError(err)
+	cons, casted = plugin.(*HTTPPoll)
+	expect.True(casted)
+
+	state = &httpPollState{url: server.URL}
+	expect.NoError(cons.poll(state))
+	expect.NoError(cons.poll(state))
+	expect.Equal([]string{"Basic dXNlcjpzZWNyZXQ=   ", "Basic dXNlcjpzZWNyZXQ=   "}, requests)
+	expect.Equal([]string{body, body}, httpPollTestMessages(stream))
+
+	// Responses exceeding the maximum size are dropped
+	stream = &mockHTTPStream{}
+	core.StreamRegistry.Register(stream, core.GetStreamID("httpPollSize"))
+	conf = core.NewPluginConfig("")
+	conf.Stream = []string{"httpPollSize"}
+	conf.Override("MaxBodySizeByte", 10)
+	plugin, err = core.NewPluginWithType("consumer.HTTPPoll", conf)
+	expect.NoError(err)
+	cons, casted = plugin.(*HTTPPoll)
+	expect.True(casted)
+
+	expect.NotNil(cons.poll(&httpPollState{url: server.URL}))
+	expect.Equal(0, stream.count())
+}
+
+func TestHTTPPollExtract(t *testing.T) {
+	expect := shared.NewExpect(t)
+	document := []byte(`{"name": "gollum", "tags": ["a", "b"], "items": [{"id": 1, "active": true}, {"id": 2, "active": false}], "empty": null}`)
+
+	for expression, expected := range map[string][]string{
+		"$.name":                 {"gollum"},
+		"$.tags":                 {"a", "b"},
+		"$.tags[0]":              {"a"},
+		"$.empty":                {},
+		"$.missing":              {},
+		"items[?active].id":      {"1"},
+		"items[].{key: id}":      {`{"key":1}`, `{"key":2}`},
+		"$.items[1].active":      {"false"},
+		"length(items)":          {"2"},
+		"[name, empty, tags[1]]": {"gollum", "b"},
+	} {
+		conf := core.NewPluginConfig("")
+		conf.Override("Expression", expression)
+		plugin, err := core.NewPluginWithType("consumer.HTTPPoll", conf)
+		expect.NoError(err)
+		cons, casted := plugin.(*HTTPPoll)
+		expect.True(casted)
+
+		payloads, err := cons.extract(document)
+		expect.NoError(err)
+		results := []string{}
+		for _, payload := range payloads {
+			results = append(results, string(payload))
+		}
+		expect.Equal(expected, results)
+	}
+
+	conf := core.NewPluginConfig("")
+	conf.Override("Expression", "$")
+	plugin, err := core.NewPluginWithType("consumer.HTTPPoll", conf)
+	expect.NoError(err)
+	cons, casted := plugin.(*HTTPPoll)
+	expect.True(casted)
+
+	payloads, err := cons.extract([]byte(`{"b": 1, "a": [1, 2]}`))
+	expect.NoError(err)
+	expect.Equal([][]byte{[]byte(`{"a":[1,2],"b":1}`)}, payloads)
+
+	conf = core.NewPluginConfig("")
+	conf.Override("Expression", "$.tags")
+	conf.Override("SplitArrays", false)
+	plugin, err = core.NewPluginWithType("consumer.HTTPPoll", conf)
+	expect.NoError(err)
+	cons, casted = plugin.(*HTTPPoll)
+	expect.True(casted)
+
+	payloads, err = cons.extract(document)
+	expect.NoError(err)
+	expect.Equal(1, len(payloads))
+	expect.Equal(`["a","b"]`, string(payloads[0]))
+
+	_, err = cons.extract([]byte("no json"))
+	expect.NotNil(err)
+}
+
+func TestHTTPPollSSE(t *testing.T) {
+	expect := shared.NewExpect(t)
+
+	lastEventIDs := make(chan string, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, req *http.Request) {
+		select {
+		case lastEventIDs <- req.Header.Get("Last-Event-ID"):
+		default:
+		}
+		writer.Header().Set("Content-Type", "text/event-stream")
+		if req.Header.Get("Last-Event-ID") == "" {
+			io.WriteString(writer, "retry: 10\n: comment\n\nid: 1\ndata: {\"value\": 1}\n\n"+
+				"event: update\r\nid: 2\r\ndata: {\"value\": 2}\r\n\r\n"+
+				"event: ignored\ndata: {\"value\": 3}\n\n"+
+				"data: {\"value\"\ndata: : 4}\n\n"+
+				"id: 5\ndata: {\"value\": 5}")
+		} else {
+			io.WriteString(writer, "data: {\"value\": 6}\n\n")
+		}
+	}))
+	defer server.Close()
+
+	stream := &mockHTTPStream{}
+	core.StreamRegistry.Register(stream, core.GetStreamID("httpPollSSE"))
+	conf := core.NewPluginConfig("")
+	conf.Stream = []string{"httpPollSSE"}
+	conf.Override("URLs", []string{server.URL})
+	conf.Override("Mode", "sse")
+	conf.Override("Events", []string{"message", "update"})
+	conf.Override("Expression", "value")
+	conf.Override("RetryDelayMs", 60000)
+	plugin, err := core.NewPluginWithType("consumer.HTTPPoll", conf)
+	expect.NoError(err)
+	cons, casted := plugin.(*HTTPPoll)
+	expect.True(casted)
+
+	workers := new(sync.WaitGroup)
+	go cons.Consume(workers)
+
+	// The retry field overrides RetryDelayMs, so the stream is reestablished
+	// quickly
+	expect.NonBlocking(5*time.Second, func() {
+		expect.Equal("", <-lastEventIDs)
+		expect.Equal("2", <-lastEventIDs)
+	})
+	waitForTestMessages(expect, stream, 4)
+	cons.Control() <- core.PluginControlStopConsumer
+	expect.NonBlocking(2*time.Second, workers.Wait)
+
+	// The incomplete event 5 is not acknowledged
+	expect.Equal([]string{"message/1 1", "update/2 2", "message/2 4", "message/2 6"}, httpPollTestMessages(stream)[:4])
+}
+
+func TestSSEReader(t *testing.T) {
+	expect := shared.NewExpect(t)
+
+	state := &httpPollState{}
+	reader := newSSEReader(strings.NewReader("\uFEFFdata:a\r\rdata\rdata: b\r\revent: x\n\nid: 7\ndata:  c\n\nid\ndata: d\n\nid: 1\x002\ndata: e\n\nretry: x\ndata: f"), 100, state)
+	for _, expected := range []sseEvent{
+		{eventType: "message", data: []byte("a")},
+		{eventType: "message", data: []byte("\nb")},
+		{eventType: "message", id: "7", data: []byte(" c")},
+		{eventType: "message", data: []byte("d")},
+		{eventType: "message", data: []byte("e")},
+	} {
+		event, err := reader.next()
+		expect.NoError(err)
+		expect.Equal(expected, event)
+	}
+	_, err := reader.next()
+	expect.Equal(io.EOF, err)
+
+	reader = newSSEReader(strings.NewReader("retry: 250\ndata: "+strings.Repeat("x", 20)+"\n\n"), 10, state)
+	_, err = reader.next()
+	expect.NotNil(err)
+	expect.Equal(250*time.Millisecond, state.retryDelay)
+}
+
+func TestHTTPPollConfigure(t *testing.T) {
+	expect := shared.NewExpect(t)
+
+	conf := core.NewPluginConfig("")
+	plugin, err := core.NewPluginWithType("consumer.HTTPPoll", conf)
+	expect.NoError(err)
+	cons, casted := plugin.(*HTTPPoll)
+	expect.True(casted)
+
+	expect.Equal(httpPollModePoll, cons.mode)
+	expect.Equal(time.Minute, cons.interval)
+	expect.True(cons.conditional)
+	expect.Nil(cons.expression)
+
+	for _, options := range []map[string]interface{}{
+		{"URLs": []string{"ftp://example.com"}},
+		{"URLs": []string{"example.com/path"}},
+		{"Mode": "websocket"},
+		{"Expression": "items[?"},
+		{"BearerToken": "a", "BearerTokenFile": "b"},
+	} {
+		conf := core.NewPluginConfig("")
+		for key, value := range options {
+			conf.Override(key, value)
+		}
+		_, err := core.NewPluginWithType("consumer.HTTPPoll", conf)
+		expect.NotNil(err)
+	}
+}
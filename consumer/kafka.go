@@ -27,6 +27,8 @@ import (
 	"io/ioutil"
 	"os"
 	"path"
+	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -48,9 +50,14 @@ const (
 //
 //  - "consumer.Kafka":
 //    Topic: "default"
+//    TopicRegex: ""
 //    ClientId: "gollum"
 //    Version: "0.8.2"
 //    GroupId: ""
+//    GroupPartitionStrategy: "range"
+//    GroupSessionTimeoutMs: 30000
+//    GroupHeartbeatMs: 3000
+//    OffsetCommitIntervalMs: 1000
 //    DefaultOffset: "newest"
 //    OffsetFile: ""
 //    FolderPermissions: "0755"
@@ -79,12 +86,48 @@ const (
 //    Servers:
 //      - "localhost:9092"
 //
-// Topic defines the kafka topic to read from. By default this is set to "default".
+// Topic defines the kafka topic to read from. When using GroupId this can be a
+// list of topics. By default this is set to "default".
+//
+// TopicRegex defines a regular expression. All topics matching this expression
+// are read in addition to Topic. The list of topics is checked for changes
+// every MetadataRefreshMs. This requires GroupId to be set. By default this is
+// set to "".
 //
 // ClientId sets the client id of this consumer. By default this is "gollum".
 //
 // GroupId sets the consumer group of this consumer. By default this is "" which
 // disables consumer groups. This requires Version to be >= 0.9.
+// Consumers sharing the same GroupId split the partitions of all topics
+// between each other. Partitions are rebalanced automatically when consumers
+// join or leave the group. Offsets are stored by the brokers.
+// The "range" and "roundrobin" strategies use the eager rebalance protocol:
+// on every rebalance all consumers of the group stop reading and give up all
+// of their partitions before the partitions are assigned again. The
+// "cooperative-sticky" strategy uses incremental cooperative rebalancing
+// instead. Consumers keep reading their partitions during a rebalance and
+// only give up partitions that move to another consumer.
+//
+// GroupPartitionStrategy defines how partitions are assigned to the consumers
+// of a group. Valid values are "range", "roundrobin" and "cooperative-sticky".
+// When using "cooperative-sticky" partitions stay with their consumer as long
+// as the group is balanced. Partitions that move are committed and given up
+// by their current consumer first and assigned to the new consumer by a
+// second rebalance. This strategy is compatible with the cooperative-sticky
+// assignor of the Java client. All consumers of a group have to use the same
+// strategy. By default this is set to "range".
+//
+// GroupSessionTimeoutMs defines the time in milliseconds after which a
+// consumer that stopped sending heartbeats is removed from the group.
+// By default this is set to 30000.
+//
+// GroupHeartbeatMs defines the interval in milliseconds between heartbeats
+// sent to the group coordinator. This should be at most a third of
+// GroupSessionTimeoutMs. By default this is set to 3000.
+//
+// OffsetCommitIntervalMs defines the interval in milliseconds in which the
+// offsets of processed messages are committed when using GroupId.
+// By default this is set to 1000.
 //
 // Version defines the kafka protocol version to use. Common values are 0.8.2,
 // 0.9.0 or 0.10.0. Values of the form "A.B" are allowed as well as "A.B.C"
@@ -94,8 +137,9 @@ const (
 //
 // DefaultOffset defines where to start reading the topic. Valid values are
 // "oldest" and "newest". If OffsetFile is defined the DefaultOffset setting
-// will be ignored unless the file does not exist.
-// By default this is set to "newest". Ignored when using GroupId.
+// will be ignored unless the file does not exist. When using GroupId this is
+// only used for partitions without a committed offset.
+// By default this is set to "newest".
 //
 // OffsetFile defines the path to a file that stores the current offset inside
 // a given partition. If the consumer is restarted that offset is used to continue
@@ -181,9 +225,13 @@ type Kafka struct {
 	core.ConsumerBase
 	servers           []string
 	topic             string
+	topics            []string
+	topicRegex        *regexp.Regexp
 	group             string
 	groupClient       *cluster.Client
 	groupConfig       *cluster.Config
+	cooperative       bool
+	cooperativeGroup  *kafkaCooperativeGroup
 	client            kafka.Client
 	config            *kafka.Config
 	consumer          kafka.Consumer
@@ -211,7 +259,7 @@ func (cons *Kafka) Configure(conf core.PluginConfig) error {
 	}
 
 	cons.servers = conf.GetStringArray("Servers", []string{"localhost:9092"})
-	cons.topic = conf.GetString("Topic", "default")
+	cons.topics = conf.GetStringArray("Topic", []string{"default"})
 	cons.group = conf.GetString("GroupId", "")
 	cons.offsetFile = conf.GetString("OffsetFile", "")
 	cons.persistTimeout = time.Duration(conf.GetInt("PresistTimoutMs", 5000)) * time.Millisecond
@@ -222,6 +270,22 @@ func (cons *Kafka) Configure(conf core.PluginConfig) error {
 	cons.prependKey = conf.GetBool("PrependKey", false)
 	cons.sequence = new(uint64)
 
+	if topicRegex := conf.GetString("TopicRegex", ""); topicRegex != "" {
+		if cons.topicRegex, err = regexp.Compile(topicRegex); err != nil {
+			return err
+		}
+	}
+
+	switch {
+	case cons.group != "":
+	case len(cons.topics) != 1:
+		return fmt.Errorf("Reading multiple topics requires GroupId to be set")
+	case cons.topicRegex != nil:
+		return fmt.Errorf("TopicRegex requires GroupId to be set")
+	default:
+		cons.topic = cons.topics[0]
+	}
+
 	folderFlags, err := strconv.ParseInt(conf.GetString("FolderPermissions", "0755"), 8, 32)
 	cons.folderPermissions = os.FileMode(folderFlags)
 	if err != nil {
@@ -331,8 +395,6 @@ func (cons *Kafka) Configure(conf core.PluginConfig) error {
 			cons.config.Version = kafka.V0_9_0_1
 		}
 
-		cons.groupConfig = cluster.NewConfig()
-		cons.groupConfig.Config = *cons.config
 	}
 
 	offsetValue := strings.ToLower(conf.GetString("DefaultOffset", kafkaOffsetNewest))
@@ -347,6 +409,33 @@ func (cons *Kafka) Configure(conf core.PluginConfig) error {
 		cons.defaultOffset, _ = strconv.ParseInt(offsetValue, 10, 64)
 	}
 
+	if cons.group != "" {
+		cons.groupConfig = cluster.NewConfig()
+		cons.groupConfig.Config = *cons.config
+		cons.groupConfig.Group.Return.Notifications = true
+		cons.groupConfig.Group.Session.Timeout = time.Duration(conf.GetInt("GroupSessionTimeoutMs", 30000)) * time.Millisecond
+		cons.groupConfig.Group.Heartbeat.Interval = time.Duration(conf.GetInt("GroupHeartbeatMs", 3000)) * time.Millisecond
+		cons.groupConfig.Consumer.Offsets.CommitInterval = time.Duration(conf.GetInt("OffsetCommitIntervalMs", 1000)) * time.Millisecond
+
+		switch strategy := strings.ToLower(conf.GetString("GroupPartitionStrategy", "range")); strategy {
+		case "range":
+			cons.groupConfig.Group.PartitionStrategy = cluster.StrategyRange
+		case "roundrobin":
+			cons.groupConfig.Group.PartitionStrategy = cluster.StrategyRoundRobin
+		case kafkaCooperativeProtocol:
+			cons.cooperative = true
+		default:
+			return fmt.Errorf("Unknown GroupPartitionStrategy: %s", strategy)
+		}
+
+		switch cons.defaultOffset {
+		case kafka.OffsetNewest, kafka.OffsetOldest:
+			cons.groupConfig.Consumer.Offsets.Initial = cons.defaultOffset
+		default:
+			Log.Warning.Print("Kafka consumer groups only support DefaultOffset newest or oldest, defaulting to newest")
+		}
+	}
+
 	if cons.offsetFile != "" {
 		fileContents, err := ioutil.ReadFile(cons.offsetFile)
 		if err != nil {
@@ -392,24 +481,92 @@ func (cons *Kafka) keyedMessage(key []byte, value []byte) []byte {
 	return buffer
 }
 
+// groupTopics returns the sorted list of topics to read when using GroupId
+func (cons *Kafka) groupTopics(client kafka.Client) ([]string, error) {
+	topics := append([]string{}, cons.topics...)
+	if cons.topicRegex != nil {
+		available, err := client.Topics()
+		if err != nil {
+			return nil, err
+		}
+		topics = append(topics, kafkaMatchTopics(cons.topicRegex, available)...)
+	}
+	return kafkaUniqueTopics(topics), nil
+}
+
+// kafkaMatchTopics returns all topics matching the given expression
+func kafkaMatchTopics(exp *regexp.Regexp, topics []string) []string {
+	matches := []string{}
+	for _, topic := range topics {
+		if exp.MatchString(topic) {
+			matches = append(matches, topic)
+		}
+	}
+	return matches
+}
+
+// kafkaUniqueTopics returns a sorted list of topics without duplicates
+func kafkaUniqueTopics(topics []string) []string {
+	sort.Strings(topics)
+	unique := topics[:0]
+	for i, topic := range topics {
+		if i == 0 || topic != topics[i-1] {
+			unique = append(unique, topic)
+		}
+	}
+	return unique
+}
+
+func kafkaTopicsEqual(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
 // Main fetch loop for kafka events
 func (cons *Kafka) readFromGroup() {
-	consumer, err := cluster.NewConsumerFromClient(cons.groupClient, cons.group, []string{cons.topic})
+	topics, err := cons.groupTopics(cons.groupClient)
 	if err != nil {
 		defer cons.restartGroup()
-		Log.Error.Printf("Restarting kafka consumer (%s:%s) - %s", cons.topic, cons.group, err.Error())
+		Log.Error.Printf("Restarting kafka consumer (%s) - %s", cons.group, err.Error())
 		return // ### return, stop and retry ###
 	}
 
-	// Make sure we wait for all consumers to end
+	consumer, err := cluster.NewConsumerFromClient(cons.groupClient, cons.group, topics)
+	if err != nil {
+		defer cons.restartGroup()
+		Log.Error.Printf("Restarting kafka consumer (%s:%s) - %s", strings.Join(topics, ","), cons.group, err.Error())
+		return // ### return, stop and retry ###
+	}
+
+	// Make sure we wait for all consumers to end. The consumer has to be
+	// closed before restarting to leave the group.
+	restart := false
 	cons.AddWorker()
 	defer func() {
 		if !cons.groupClient.Closed() {
 			consumer.Close()
 		}
 		cons.WorkerDone()
+		if restart {
+			cons.restartGroup()
+		}
 	}()
 
+	// Regular expressions require checking for new or removed topics
+	var topicCheck <-chan time.Time
+	if cons.topicRegex != nil {
+		ticker := time.NewTicker(cons.config.Metadata.RefreshFrequency)
+		defer ticker.Stop()
+		topicCheck = ticker.C
+	}
+
 	// Loop over worker
 	spin := shared.NewSpinner(shared.SpinPriorityLow)
 
@@ -423,12 +580,28 @@ func (cons *Kafka) readFromGroup() {
 			} else {
 				cons.Enqueue(event.Value, sequence)
 			}
+			consumer.MarkOffset(event, "")
+
+		case notification := <-consumer.Notifications():
+			Log.Note.Printf("Kafka consumer group %s rebalanced, now reading %v", cons.group, notification.Current)
 
 		case err := <-consumer.Errors():
-			defer cons.restartGroup()
 			Log.Error.Print("Kafka consumer error:", err)
+			restart = true
 			return // ### return, try reconnect ###
 
+		case <-topicCheck:
+			newTopics, err := cons.groupTopics(cons.groupClient)
+			if err != nil {
+				Log.Error.Print("Kafka consumer failed to list topics: ", err)
+				continue // ### continue, keep current topics ###
+			}
+			if !kafkaTopicsEqual(topics, newTopics) {
+				Log.Note.Printf("Kafka consumer group %s topics changed to %s", cons.group, strings.Join(newTopics, ","))
+				restart = true
+				return // ### return, resubscribe ###
+			}
+
 		default:
 			spin.Yield()
 		}
@@ -579,14 +752,30 @@ func (cons *Kafka) startReadTopic(topic string) {
 func (cons *Kafka) startConsumers() error {
 	var err error
 
-	if cons.group != "" {
+	switch {
+	case cons.cooperative:
+		cons.client, err = kafka.NewClient(cons.servers, cons.config)
+		if err != nil {
+			return err
+		}
+
+		cons.cooperativeGroup, err = newKafkaCooperativeGroup(cons, cons.client)
+		if err != nil {
+			cons.client.Close()
+			return err
+		}
+
+		go cons.cooperativeGroup.run()
+
+	case cons.group != "":
 		cons.groupClient, err = cluster.NewClient(cons.servers, cons.groupConfig)
 		if err != nil {
 			return err
 		}
 
 		go cons.readFromGroup()
-	} else {
+
+	default:
 		cons.client, err = kafka.NewClient(cons.servers, cons.config)
 		if err != nil {
 			return err
@@ -636,7 +825,14 @@ func (cons *Kafka) Consume(workers *sync.WaitGroup) {
 	}
 
 	defer func() {
-		cons.client.Close()
+		if cons.cooperativeGroup != nil {
+			cons.cooperativeGroup.close()
+		}
+		if cons.groupClient != nil {
+			cons.groupClient.Close()
+		} else {
+			cons.client.Close()
+		}
 		cons.dumpIndex()
 	}()
 
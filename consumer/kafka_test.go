@@ -0,0 +1,66 @@
+// Copyright 2015-2016 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumer
+
+import (
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/shared"
+	"regexp"
+	"testing"
+)
+
+func TestKafkaGroupTopics(t *testing.T) {
+	expect := shared.NewExpect(t)
+
+	available := []string{"logs.app", "logs.web", "metrics", "logs"}
+	matches := kafkaMatchTopics(regexp.MustCompile(`^logs\.`), available)
+	expect.Equal([]string{"logs.app", "logs.web"}, matches)
+
+	topics := kafkaUniqueTopics(append([]string{"metrics", "logs.web"}, matches...))
+	expect.Equal([]string{"logs.app", "logs.web", "metrics"}, topics)
+	expect.True(kafkaTopicsEqual(topics, []string{"logs.app", "logs.web", "metrics"}))
+	expect.False(kafkaTopicsEqual(topics, []string{"logs.app", "metrics"}))
+}
+
+func TestKafkaConfigureTopics(t *testing.T) {
+	expect := shared.NewExpect(t)
+
+	conf := core.NewPluginConfig("")
+	conf.Override("Topic", []string{"a", "b"})
+	_, err := core.NewPluginWithType("consumer.Kafka", conf)
+	expect.NotNil(err)
+
+	conf.Override("GroupId", "gollum")
+	conf.Override("TopicRegex", "^logs\\.")
+	plugin, err := core.NewPluginWithType("consumer.Kafka", conf)
+	expect.NoError(err)
+
+	cons, casted := plugin.(*Kafka)
+	expect.True(casted)
+	expect.Equal([]string{"a", "b"}, cons.topics)
+	expect.NotNil(cons.topicRegex)
+
+	conf.Override("GroupPartitionStrategy", "sticky")
+	_, err = core.NewPluginWithType("consumer.Kafka", conf)
+	expect.NotNil(err)
+
+	conf.Override("GroupPartitionStrategy", "cooperative-sticky")
+	plugin, err = core.NewPluginWithType("consumer.Kafka", conf)
+	expect.NoError(err)
+
+	cons, casted = plugin.(*Kafka)
+	expect.True(casted)
+	expect.True(cons.cooperative)
+}
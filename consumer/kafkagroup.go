@@ -0,0 +1,844 @@
+// Copyright 2015-2016 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumer
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	kafka "github.com/Shopify/sarama"
+	"github.com/trivago/gollum/core/log"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// kafkaCooperativeProtocol is the name of the group protocol used for
+	// incremental cooperative rebalancing (KIP-429). Members are compatible
+	// with the "cooperative-sticky" assignor of the Java client.
+	kafkaCooperativeProtocol = "cooperative-sticky"
+	kafkaSubscriptionVersion = 1
+)
+
+// kafkaTopicPartition identifies a partition of a topic.
+type kafkaTopicPartition struct {
+	topic     string
+	partition int32
+}
+
+func (tp kafkaTopicPartition) String() string {
+	return fmt.Sprintf("%s:%d", tp.topic, tp.partition)
+}
+
+// kafkaGroupSubscription is the metadata a member sends when joining a
+// cooperative group. Besides the subscribed topics it contains the partitions
+// currently owned by the member and the generation they were assigned in.
+type kafkaGroupSubscription struct {
+	topics     []string
+	owned      map[string][]int32
+	generation int32
+}
+
+// kafkaProtocolReader reads primitive types of the kafka protocol. The first
+// error is stored and all following reads return zero values.
+type kafkaProtocolReader struct {
+	data []byte
+	err  error
+}
+
+func (reader *kafkaProtocolReader) fixed(size int) []byte {
+	if reader.err != nil {
+		return nil
+	}
+	if size < 0 || size > len(reader.data) {
+		reader.err = fmt.Errorf("Unexpected end of kafka group metadata")
+		return nil
+	}
+	value := reader.data[:size]
+	reader.data = reader.data[size:]
+	return value
+}
+
+func (reader *kafkaProtocolReader) int16() int16 {
+	if value := reader.fixed(2); value != nil {
+		return int16(binary.BigEndian.Uint16(value))
+	}
+	return 0
+}
+
+func (reader *kafkaProtocolReader) int32() int32 {
+	if value := reader.fixed(4); value != nil {
+		return int32(binary.BigEndian.Uint32(value))
+	}
+	return 0
+}
+
+func (reader *kafkaProtocolReader) string() string {
+	return string(reader.fixed(int(reader.int16())))
+}
+
+// bytes reads a nullable byte sequence
+func (reader *kafkaProtocolReader) bytes() []byte {
+	size := reader.int32()
+	if size < 0 {
+		return nil
+	}
+	return reader.fixed(int(size))
+}
+
+func kafkaPutString(buffer *bytes.Buffer, value string) {
+	binary.Write(buffer, binary.BigEndian, int16(len(value)))
+	buffer.WriteString(value)
+}
+
+// encode returns the binary representation of a version 1 consumer protocol
+// subscription. The generation is stored as user data like the Java client's
+// cooperative-sticky assignor does.
+func (sub kafkaGroupSubscription) encode() []byte {
+	buffer := new(bytes.Buffer)
+	binary.Write(buffer, binary.BigEndian, int16(kafkaSubscriptionVersion))
+
+	binary.Write(buffer, binary.BigEndian, int32(len(sub.topics)))
+	for _, topic := range sub.topics {
+		kafkaPutString(buffer, topic)
+	}
+
+	binary.Write(buffer, binary.BigEndian, int32(4))
+	binary.Write(buffer, binary.BigEndian, sub.generation)
+
+	topics := make([]string, 0, len(sub.owned))
+	for topic := range sub.owned {
+		topics = append(topics, topic)
+	}
+	sort.Strings(topics)
+
+	binary.Write(buffer, binary.BigEndian, int32(len(topics)))
+	for _, topic := range topics {
+		kafkaPutString(buffer, topic)
+		binary.Write(buffer, binary.BigEndian, int32(len(sub.owned[topic])))
+		for _, partition := range sub.owned[topic] {
+			binary.Write(buffer, binary.BigEndian, partition)
+		}
+	}
+	return buffer.Bytes()
+}
+
+// decodeKafkaGroupSubscription parses the subscription of a group member.
+// Version 0 subscriptions do not contain owned partitions, fields added by
+// versions newer than 2 are ignored.
+func decodeKafkaGroupSubscription(data []byte) (kafkaGroupSubscription, error) {
+	reader := &kafkaProtocolReader{data: data}
+	sub := kafkaGroupSubscription{
+		owned:      make(map[string][]int32),
+		generation: -1,
+	}
+
+	version := reader.int16()
+	for i := reader.int32(); i > 0 && reader.err == nil; i-- {
+		sub.topics = append(sub.topics, reader.string())
+	}
+	if userData := reader.bytes(); len(userData) == 4 {
+		sub.generation = int32(binary.BigEndian.Uint32(userData))
+	}
+
+	if version >= 1 {
+		for i := reader.int32(); i > 0 && reader.err == nil; i-- {
+			topic := reader.string()
+			for j := reader.int32(); j > 0 && reader.err == nil; j-- {
+				sub.owned[topic] = append(sub.owned[topic], reader.int32())
+			}
+		}
+	}
+	if version >= 2 {
+		if generation := reader.int32(); sub.generation < 0 {
+			sub.generation = generation
+		}
+	}
+
+	if reader.err != nil {
+		return sub, reader.err
+	}
+	return sub, nil
+}
+
+// kafkaCooperativeAssign distributes the given partitions between the members
+// of a group. Partitions stay with their current owner as long as the
+// assignment stays balanced. Partitions that have to move to another member
+// are only removed from their current owner. They are assigned to their new
+// owner by the rebalance that follows after the owner revoked them.
+func kafkaCooperativeAssign(members map[string]kafkaGroupSubscription, partitions map[string][]int32) map[string]map[string][]int32 {
+	memberIDs := make([]string, 0, len(members))
+	subscribed := make(map[string]map[string]bool)
+	for memberID, sub := range members {
+		memberIDs = append(memberIDs, memberID)
+		subscribed[memberID] = make(map[string]bool)
+		for _, topic := range sub.topics {
+			subscribed[memberID][topic] = true
+		}
+	}
+	sort.Strings(memberIDs)
+
+	all := []kafkaTopicPartition{}
+	exists := make(map[kafkaTopicPartition]bool)
+	for topic, ids := range partitions {
+		for _, partition := range ids {
+			tp := kafkaTopicPartition{topic, partition}
+			all = append(all, tp)
+			exists[tp] = true
+		}
+	}
+	sort.Slice(all, func(i, j int) bool {
+		if all[i].topic != all[j].topic {
+			return all[i].topic < all[j].topic
+		}
+		return all[i].partition < all[j].partition
+	})
+
+	// Collect the valid claims of all members. If a partition is claimed by
+	// more than one member the most recent generation wins.
+	owner := make(map[kafkaTopicPartition]string)
+	ownerGeneration := make(map[kafkaTopicPartition]int32)
+	for _, memberID := range memberIDs {
+		sub := members[memberID]
+		for topic, ids := range sub.owned {
+			if !subscribed[memberID][topic] {
+				continue // ### continue, no longer subscribed ###
+			}
+			for _, partition := range ids {
+				tp := kafkaTopicPartition{topic, partition}
+				if !exists[tp] {
+					continue // ### continue, partition was removed ###
+				}
+				if _, claimed := owner[tp]; claimed && ownerGeneration[tp] >= sub.generation {
+					continue // ### continue, owned by a more recent generation ###
+				}
+				owner[tp] = memberID
+				ownerGeneration[tp] = sub.generation
+			}
+		}
+	}
+
+	target := make(map[string][]kafkaTopicPartition)
+	for _, tp := range all {
+		if memberID, claimed := owner[tp]; claimed {
+			target[memberID] = append(target[memberID], tp)
+		}
+	}
+
+	leastLoaded := func(topic string) string {
+		candidate := ""
+		for _, memberID := range memberIDs {
+			if subscribed[memberID][topic] && (candidate == "" || len(target[memberID]) < len(target[candidate])) {
+				candidate = memberID
+			}
+		}
+		return candidate
+	}
+
+	for _, tp := range all {
+		if _, claimed := owner[tp]; !claimed {
+			if memberID := leastLoaded(tp.topic); memberID != "" {
+				target[memberID] = append(target[memberID], tp)
+			}
+		}
+	}
+
+	// Move partitions away from members that have more than one partition
+	// more than another member subscribed to the same topic. Unowned
+	// partitions were added last, so they are moved first.
+	for moved := true; moved; {
+		moved = false
+		for _, from := range memberIDs {
+			assigned := target[from]
+			for i := len(assigned) - 1; i >= 0 && !moved; i-- {
+				to := leastLoaded(assigned[i].topic)
+				if len(assigned) > len(target[to])+1 {
+					target[to] = append(target[to], assigned[i])
+					target[from] = append(assigned[:i:i], assigned[i+1:]...)
+					moved = true
+				}
+			}
+		}
+	}
+
+	assignments := make(map[string]map[string][]int32)
+	for _, memberID := range memberIDs {
+		assignments[memberID] = make(map[string][]int32)
+		for _, tp := range target[memberID] {
+			if current, claimed := owner[tp]; claimed && current != memberID {
+				continue // ### continue, has to be revoked by its owner first ###
+			}
+			assignments[memberID][tp.topic] = append(assignments[memberID][tp.topic], tp.partition)
+		}
+		for _, ids := range assignments[memberID] {
+			sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+		}
+	}
+	return assignments
+}
+
+// kafkaCooperativeGroup is a member of a kafka consumer group that uses
+// incremental cooperative rebalancing. In contrast to the eager protocol the
+// member keeps reading its partitions while the group rebalances. Only
+// partitions that are assigned to another member are revoked, after which
+// the member joins again so that these partitions can be assigned to their
+// new owner.
+type kafkaCooperativeGroup struct {
+	cons       *Kafka
+	client     kafka.Client
+	consumer   kafka.Consumer
+	memberID   string
+	generation int32
+	topics     []string
+	owned      map[kafkaTopicPartition]*kafkaGroupPartition
+	rejoin     bool
+	stop       chan struct{}
+	done       chan struct{}
+}
+
+// kafkaGroupPartition is a partition read by a kafkaCooperativeGroup.
+// offset is the next offset to read, committed the last offset that has been
+// committed to the group coordinator.
+type kafkaGroupPartition struct {
+	consumer  kafka.PartitionConsumer
+	offset    *int64
+	committed int64
+	stop      chan struct{}
+	done      chan struct{}
+}
+
+func newKafkaCooperativeGroup(cons *Kafka, client kafka.Client) (*kafkaCooperativeGroup, error) {
+	consumer, err := kafka.NewConsumerFromClient(client)
+	if err != nil {
+		return nil, err
+	}
+
+	return &kafkaCooperativeGroup{
+		cons:       cons,
+		client:     client,
+		consumer:   consumer,
+		generation: -1,
+		owned:      make(map[kafkaTopicPartition]*kafkaGroupPartition),
+		stop:       make(chan struct{}),
+		done:       make(chan struct{}),
+	}, nil
+}
+
+// run joins the group and reads the assigned partitions until close is
+// called.
+func (group *kafkaCooperativeGroup) run() {
+	group.cons.AddWorker()
+	defer func() {
+		group.revoke(group.ownedPartitions(), true)
+		group.leave()
+		group.consumer.Close()
+		group.cons.WorkerDone()
+		close(group.done)
+	}()
+
+	for !group.stopped() {
+		switch err := group.join(); err {
+		case nil:
+		case kafka.ErrRebalanceInProgress, kafka.ErrUnknownMemberId, kafka.ErrIllegalGeneration:
+			continue // ### continue, join again ###
+		default:
+			Log.Error.Printf("Kafka consumer group %s failed to rebalance - %s", group.cons.group, err.Error())
+			group.wait(group.cons.persistTimeout)
+			continue // ### continue, retry ###
+		}
+
+		if group.rejoin {
+			group.rejoin = false
+			continue // ### continue, partitions have been revoked ###
+		}
+		group.session()
+	}
+}
+
+// close leaves the group after committing the offsets of all partitions and
+// waits for run to return.
+func (group *kafkaCooperativeGroup) close() {
+	close(group.stop)
+	<-group.done
+}
+
+func (group *kafkaCooperativeGroup) stopped() bool {
+	select {
+	case <-group.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+func (group *kafkaCooperativeGroup) wait(duration time.Duration) {
+	select {
+	case <-group.stop:
+	case <-time.After(duration):
+	}
+}
+
+// ownedPartitions returns the sorted list of partitions currently read.
+func (group *kafkaCooperativeGroup) ownedPartitions() []kafkaTopicPartition {
+	partitions := make([]kafkaTopicPartition, 0, len(group.owned))
+	for tp := range group.owned {
+		partitions = append(partitions, tp)
+	}
+	sort.Slice(partitions, func(i, j int) bool {
+		if partitions[i].topic != partitions[j].topic {
+			return partitions[i].topic < partitions[j].topic
+		}
+		return partitions[i].partition < partitions[j].partition
+	})
+	return partitions
+}
+
+// join sends the subscription to the group coordinator, computes the
+// assignment if this member is the group leader and applies the assignment
+// received from the coordinator.
+func (group *kafkaCooperativeGroup) join() error {
+	topics, err := group.cons.groupTopics(group.client)
+	if err != nil {
+		return err
+	}
+	group.topics = topics
+
+	sub := kafkaGroupSubscription{
+		topics:     topics,
+		owned:      make(map[string][]int32),
+		generation: group.generation,
+	}
+	for _, tp := range group.ownedPartitions() {
+		sub.owned[tp.topic] = append(sub.owned[tp.topic], tp.partition)
+	}
+
+	joinRequest := &kafka.JoinGroupRequest{
+		GroupId:        group.cons.group,
+		SessionTimeout: int32(group.cons.groupConfig.Group.Session.Timeout / time.Millisecond),
+		MemberId:       group.memberID,
+		ProtocolType:   "consumer",
+	}
+	joinRequest.AddGroupProtocol(kafkaCooperativeProtocol, sub.encode())
+
+	broker, err := group.coordinator()
+	if err != nil {
+		return err
+	}
+
+	joinResponse, err := broker.JoinGroup(joinRequest)
+	if err == nil && joinResponse.Err != kafka.ErrNoError {
+		err = joinResponse.Err
+	}
+	if err != nil {
+		group.handleError(broker, err)
+		return err
+	}
+
+	group.memberID = joinResponse.MemberId
+	group.generation = joinResponse.GenerationId
+
+	syncRequest := &kafka.SyncGroupRequest{
+		GroupId:      group.cons.group,
+		GenerationId: group.generation,
+		MemberId:     group.memberID,
+	}
+
+	if joinResponse.LeaderId == joinResponse.MemberId {
+		assignments, err := group.assign(joinResponse.Members)
+		if err != nil {
+			return err
+		}
+		for memberID, topics := range assignments {
+			assignment := &kafka.ConsumerGroupMemberAssignment{Version: 1, Topics: topics}
+			if err := syncRequest.AddGroupAssignmentMember(memberID, assignment); err != nil {
+				return err
+			}
+		}
+	}
+
+	syncResponse, err := broker.SyncGroup(syncRequest)
+	if err == nil && syncResponse.Err != kafka.ErrNoError {
+		err = syncResponse.Err
+	}
+	if err != nil {
+		group.handleError(broker, err)
+		return err
+	}
+
+	assigned := make(map[kafkaTopicPartition]bool)
+	if len(syncResponse.MemberAssignment) > 0 {
+		assignment, err := syncResponse.GetMemberAssignment()
+		if err != nil {
+			return err
+		}
+		for topic, partitions := range assignment.Topics {
+			for _, partition := range partitions {
+				assigned[kafkaTopicPartition{topic, partition}] = true
+			}
+		}
+	}
+
+	revoked := []kafkaTopicPartition{}
+	for _, tp := range group.ownedPartitions() {
+		if !assigned[tp] {
+			revoked = append(revoked, tp)
+		}
+	}
+	added := []kafkaTopicPartition{}
+	for tp := range assigned {
+		if _, owned := group.owned[tp]; !owned {
+			added = append(added, tp)
+		}
+	}
+
+	if len(revoked) > 0 {
+		group.revoke(revoked, true)
+		group.rejoin = true
+	}
+	err = group.start(added)
+
+	Log.Note.Printf("Kafka consumer group %s rebalanced in generation %d, added %v, revoked %v, now reading %v",
+		group.cons.group, group.generation, added, revoked, group.ownedPartitions())
+	return err
+}
+
+// assign decodes the subscriptions of all members and computes the
+// assignment. This is only called on the group leader.
+func (group *kafkaCooperativeGroup) assign(members map[string][]byte) (map[string]map[string][]int32, error) {
+	subscriptions := make(map[string]kafkaGroupSubscription)
+	partitions := make(map[string][]int32)
+
+	for memberID, data := range members {
+		sub, err := decodeKafkaGroupSubscription(data)
+		if err != nil {
+			return nil, err
+		}
+		subscriptions[memberID] = sub
+
+		for _, topic := range sub.topics {
+			if _, known := partitions[topic]; known {
+				continue // ### continue, already known ###
+			}
+			ids, err := group.client.Partitions(topic)
+			if err != nil {
+				Log.Warning.Printf("Kafka consumer group %s cannot assign topic %s - %s", group.cons.group, topic, err.Error())
+			}
+			partitions[topic] = ids
+		}
+	}
+
+	return kafkaCooperativeAssign(subscriptions, partitions), nil
+}
+
+// session sends heartbeats and commits offsets until the group has to be
+// joined again.
+func (group *kafkaCooperativeGroup) session() {
+	config := group.cons.groupConfig
+
+	heartbeat := time.NewTicker(config.Group.Heartbeat.Interval)
+	defer heartbeat.Stop()
+	commit := time.NewTicker(config.Consumer.Offsets.CommitInterval)
+	defer commit.Stop()
+
+	// Regular expressions require checking for new or removed topics
+	var topicCheck <-chan time.Time
+	if group.cons.topicRegex != nil {
+		ticker := time.NewTicker(group.cons.config.Metadata.RefreshFrequency)
+		defer ticker.Stop()
+		topicCheck = ticker.C
+	}
+
+	for {
+		var err error
+		select {
+		case <-group.stop:
+			return // ### return, shutdown ###
+
+		case <-heartbeat.C:
+			err = group.heartbeat()
+
+		case <-commit.C:
+			err = group.commit(group.owned)
+
+		case <-topicCheck:
+			topics, err := group.cons.groupTopics(group.client)
+			if err != nil {
+				Log.Error.Print("Kafka consumer failed to list topics: ", err)
+				continue // ### continue, keep current topics ###
+			}
+			if !kafkaTopicsEqual(group.topics, topics) {
+				Log.Note.Printf("Kafka consumer group %s topics changed to %s", group.cons.group, strings.Join(topics, ","))
+				return // ### return, resubscribe ###
+			}
+			continue
+		}
+
+		switch err {
+		case nil:
+		case kafka.ErrRebalanceInProgress, kafka.ErrUnknownMemberId, kafka.ErrIllegalGeneration:
+			return // ### return, join again ###
+		default:
+			Log.Error.Print("Kafka consumer error:", err)
+		}
+	}
+}
+
+// start fetches the committed offsets of the given partitions and starts
+// reading them.
+func (group *kafkaCooperativeGroup) start(partitions []kafkaTopicPartition) error {
+	if len(partitions) == 0 {
+		return nil
+	}
+
+	offsets, err := group.fetchOffsets(partitions)
+	if err != nil {
+		return err
+	}
+
+	for _, tp := range partitions {
+		offset := offsets[tp]
+		consumer, err := group.consumer.ConsumePartition(tp.topic, tp.partition, offset)
+		if err == kafka.ErrOffsetOutOfRange {
+			offset = group.cons.groupConfig.Consumer.Offsets.Initial
+			consumer, err = group.consumer.ConsumePartition(tp.topic, tp.partition, offset)
+		}
+		if err != nil {
+			return err
+		}
+
+		partition := &kafkaGroupPartition{
+			consumer:  consumer,
+			offset:    new(int64),
+			committed: offset,
+			stop:      make(chan struct{}),
+			done:      make(chan struct{}),
+		}
+		*partition.offset = offset
+		group.owned[tp] = partition
+		go group.read(partition)
+	}
+	return nil
+}
+
+// read enqueues all messages of a partition until the partition is revoked.
+func (group *kafkaCooperativeGroup) read(partition *kafkaGroupPartition) {
+	defer close(partition.done)
+	cons := group.cons
+
+	for {
+		cons.WaitOnFuse()
+		select {
+		case event := <-partition.consumer.Messages():
+			sequence := atomic.AddUint64(cons.sequence, 1) - 1
+			if cons.prependKey {
+				cons.Enqueue(cons.keyedMessage(event.Key, event.Value), sequence)
+			} else {
+				cons.Enqueue(event.Value, sequence)
+			}
+			atomic.StoreInt64(partition.offset, event.Offset+1)
+
+		case err := <-partition.consumer.Errors():
+			Log.Error.Print("Kafka consumer error:", err)
+
+		case <-partition.stop:
+			return // ### return, revoked ###
+		}
+	}
+}
+
+// revoke stops reading the given partitions. If commit is set the offsets
+// of these partitions are committed, which is not possible if the member
+// has been removed from the group.
+func (group *kafkaCooperativeGroup) revoke(partitions []kafkaTopicPartition, commit bool) {
+	revoked := make(map[kafkaTopicPartition]*kafkaGroupPartition)
+	for _, tp := range partitions {
+		partition := group.owned[tp]
+		delete(group.owned, tp)
+		close(partition.stop)
+		<-partition.done
+		partition.consumer.Close()
+		revoked[tp] = partition
+	}
+
+	if commit {
+		if err := group.commit(revoked); err != nil {
+			Log.Error.Printf("Kafka consumer group %s failed to commit revoked partitions - %s", group.cons.group, err.Error())
+		}
+	}
+}
+
+// handleError refreshes the coordinator if necessary. If the member has been
+// removed from the group all partitions have already been assigned to other
+// members, so they are dropped without committing.
+func (group *kafkaCooperativeGroup) handleError(broker *kafka.Broker, err error) {
+	group.closeCoordinator(broker, err)
+
+	switch err {
+	case kafka.ErrUnknownMemberId, kafka.ErrIllegalGeneration:
+		Log.Warning.Printf("Kafka consumer group %s lost its partitions - %s", group.cons.group, err.Error())
+		group.revoke(group.ownedPartitions(), false)
+		group.memberID = ""
+		group.generation = -1
+	}
+}
+
+func (group *kafkaCooperativeGroup) coordinator() (*kafka.Broker, error) {
+	broker, err := group.client.Coordinator(group.cons.group)
+	if err != nil {
+		group.closeCoordinator(broker, err)
+	}
+	return broker, err
+}
+
+func (group *kafkaCooperativeGroup) closeCoordinator(broker *kafka.Broker, err error) {
+	if _, isKafkaError := err.(kafka.KError); !isKafkaError && broker != nil {
+		broker.Close() // connection error, reopened by Coordinator
+	}
+
+	switch err {
+	case kafka.ErrConsumerCoordinatorNotAvailable, kafka.ErrNotCoordinatorForConsumer:
+		group.client.RefreshCoordinator(group.cons.group)
+	}
+}
+
+func (group *kafkaCooperativeGroup) heartbeat() error {
+	broker, err := group.coordinator()
+	if err != nil {
+		return err
+	}
+
+	response, err := broker.Heartbeat(&kafka.HeartbeatRequest{
+		GroupId:      group.cons.group,
+		GenerationId: group.generation,
+		MemberId:     group.memberID,
+	})
+	if err == nil && response.Err != kafka.ErrNoError {
+		err = response.Err
+	}
+	if err != nil {
+		group.handleError(broker, err)
+	}
+	return err
+}
+
+// commit commits the offsets of all given partitions that changed since the
+// last commit.
+func (group *kafkaCooperativeGroup) commit(partitions map[kafkaTopicPartition]*kafkaGroupPartition) error {
+	request := &kafka.OffsetCommitRequest{
+		Version:                 2,
+		ConsumerGroup:           group.cons.group,
+		ConsumerGroupGeneration: group.generation,
+		ConsumerID:              group.memberID,
+		RetentionTime:           -1,
+	}
+
+	dirty := make(map[kafkaTopicPartition]int64)
+	for tp, partition := range partitions {
+		if offset := atomic.LoadInt64(partition.offset); offset >= 0 && offset != partition.committed {
+			request.AddBlock(tp.topic, tp.partition, offset, 0, "")
+			dirty[tp] = offset
+		}
+	}
+	if len(dirty) == 0 {
+		return nil // ### return, nothing to commit ###
+	}
+
+	broker, err := group.coordinator()
+	if err != nil {
+		return err
+	}
+
+	response, err := broker.CommitOffset(request)
+	if err != nil {
+		group.closeCoordinator(broker, err)
+		return err
+	}
+
+	for topic, errors := range response.Errors {
+		for partition, kerr := range errors {
+			tp := kafkaTopicPartition{topic, partition}
+			if kerr != kafka.ErrNoError {
+				err = kerr
+			} else if offset, isDirty := dirty[tp]; isDirty {
+				partitions[tp].committed = offset
+			}
+		}
+	}
+
+	if err != nil {
+		group.handleError(broker, err)
+	}
+	return err
+}
+
+// fetchOffsets returns the committed offsets of the given partitions.
+// Partitions without a committed offset start at the initial offset.
+func (group *kafkaCooperativeGroup) fetchOffsets(partitions []kafkaTopicPartition) (map[kafkaTopicPartition]int64, error) {
+	request := &kafka.OffsetFetchRequest{
+		Version:       1,
+		ConsumerGroup: group.cons.group,
+	}
+	for _, tp := range partitions {
+		request.AddPartition(tp.topic, tp.partition)
+	}
+
+	broker, err := group.coordinator()
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := broker.FetchOffset(request)
+	if err != nil {
+		group.closeCoordinator(broker, err)
+		return nil, err
+	}
+
+	offsets := make(map[kafkaTopicPartition]int64)
+	for _, tp := range partitions {
+		block := response.GetBlock(tp.topic, tp.partition)
+		switch {
+		case block == nil:
+			return nil, kafka.ErrIncompleteResponse
+		case block.Err != kafka.ErrNoError:
+			group.closeCoordinator(broker, block.Err)
+			return nil, block.Err
+		case block.Offset < 0:
+			offsets[tp] = group.cons.groupConfig.Consumer.Offsets.Initial
+		default:
+			offsets[tp] = block.Offset
+		}
+	}
+	return offsets, nil
+}
+
+func (group *kafkaCooperativeGroup) leave() {
+	if group.memberID == "" {
+		return // ### return, not a member ###
+	}
+
+	broker, err := group.coordinator()
+	if err != nil {
+		return // ### return, removed after the session timeout ###
+	}
+
+	if _, err := broker.LeaveGroup(&kafka.LeaveGroupRequest{
+		GroupId:  group.cons.group,
+		MemberId: group.memberID,
+	}); err != nil {
+		group.closeCoordinator(broker, err)
+	}
+}
@@ -0,0 +1,350 @@
+// Copyright 2015-2016 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumer
+
+import (
+	"bytes"
+	"encoding/binary"
+	kafka "github.com/Shopify/sarama"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/shared"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+// encodeTestKafkaAssignment returns a version 0 consumer protocol assignment.
+func encodeTestKafkaAssignment(topic string, partitions ...int32) []byte {
+	buffer := new(bytes.Buffer)
+	binary.Write(buffer, binary.BigEndian, int16(0))
+	binary.Write(buffer, binary.BigEndian, int32(1))
+	kafkaPutString(buffer, topic)
+	binary.Write(buffer, binary.BigEndian, int32(len(partitions)))
+	for _, partition := range partitions {
+		binary.Write(buffer, binary.BigEndian, partition)
+	}
+	binary.Write(buffer, binary.BigEndian, int32(-1))
+	return buffer.Bytes()
+}
+
+func TestKafkaGroupSubscription(t *testing.T) {
+	expect := shared.NewExpect(t)
+
+	sub := kafkaGroupSubscription{
+		topics:     []string{"a", "b"},
+		owned:      map[string][]int32{"b": {2}, "a": {0, 1}},
+		generation: 5,
+	}
+	decoded, err := decodeKafkaGroupSubscription(sub.encode())
+	expect.NoError(err)
+	expect.Equal(sub, decoded)
+
+	// Version 0 subscriptions have no owned partitions and no generation
+	buffer := new(bytes.Buffer)
+	binary.Write(buffer, binary.BigEndian, int16(0))
+	binary.Write(buffer, binary.BigEndian, int32(1))
+	kafkaPutString(buffer, "a")
+	binary.Write(buffer, binary.BigEndian, int32(-1))
+
+	decoded, err = decodeKafkaGroupSubscription(buffer.Bytes())
+	expect.NoError(err)
+	expect.Equal([]string{"a"}, decoded.topics)
+	expect.Equal(0, len(decoded.owned))
+	expect.Equal(int32(-1), decoded.generation)
+
+	// Fields of newer versions are ignored
+	data := append(sub.encode(), 0, 0, 0, 7, 0xff, 0xff)
+	data[1] = 3
+	decoded, err = decodeKafkaGroupSubscription(data)
+	expect.NoError(err)
+	expect.Equal(sub, decoded)
+
+	_, err = decodeKafkaGroupSubscription(sub.encode()[:10])
+	expect.NotNil(err)
+
+	_, err = decodeKafkaGroupSubscription([]byte{0, 1, 0x7f, 0xff, 0xff, 0xff})
+	expect.NotNil(err)
+}
+
+func TestKafkaCooperativeAssign(t *testing.T) {
+	expect := shared.NewExpect(t)
+	partitions := map[string][]int32{"a": {0, 1, 2, 3}}
+
+	// New group, all partitions are assigned right away
+	assignment := kafkaCooperativeAssign(map[string]kafkaGroupSubscription{
+		"m1": {topics: []string{"a"}, generation: -1},
+		"m2": {topics: []string{"a"}, generation: -1},
+	}, partitions)
+	expect.Equal(map[string][]int32{"a": {0, 2}}, assignment["m1"])
+	expect.Equal(map[string][]int32{"a": {1, 3}}, assignment["m2"])
+
+	// A new member joins. Owned partitions stay where they are and the
+	// partition that has to move is only taken from its owner.
+	members := map[string]kafkaGroupSubscription{
+		"m1": {topics: []string{"a"}, owned: assignment["m1"], generation: 1},
+		"m2": {topics: []string{"a"}, owned: assignment["m2"], generation: 1},
+		"m3": {topics: []string{"a"}, generation: -1},
+	}
+	assignment = kafkaCooperativeAssign(members, partitions)
+	expect.Equal(map[string][]int32{"a": {0}}, assignment["m1"])
+	expect.Equal(map[string][]int32{"a": {1, 3}}, assignment["m2"])
+	expect.Equal(map[string][]int32{}, assignment["m3"])
+
+	// After m1 revoked the partition it is assigned to m3
+	members["m1"] = kafkaGroupSubscription{topics: []string{"a"}, owned: assignment["m1"], generation: 2}
+	members["m2"] = kafkaGroupSubscription{topics: []string{"a"}, owned: assignment["m2"], generation: 2}
+	members["m3"] = kafkaGroupSubscription{topics: []string{"a"}, owned: assignment["m3"], generation: 2}
+	assignment = kafkaCooperativeAssign(members, partitions)
+	expect.Equal(map[string][]int32{"a": {0}}, assignment["m1"])
+	expect.Equal(map[string][]int32{"a": {1, 3}}, assignment["m2"])
+	expect.Equal(map[string][]int32{"a": {2}}, assignment["m3"])
+
+	// A member leaves, its partitions are assigned to the remaining members
+	delete(members, "m2")
+	members["m3"] = kafkaGroupSubscription{topics: []string{"a"}, owned: assignment["m3"], generation: 3}
+	assignment = kafkaCooperativeAssign(members, partitions)
+	expect.Equal(map[string][]int32{"a": {0, 1}}, assignment["m1"])
+	expect.Equal(map[string][]int32{"a": {2, 3}}, assignment["m3"])
+}
+
+func TestKafkaCooperativeAssignClaims(t *testing.T) {
+	expect := shared.NewExpect(t)
+	partitions := map[string][]int32{"a": {0, 1}, "b": {0, 1}}
+
+	// Claims of older generations, removed partitions and topics that are no
+	// longer subscribed are ignored. Members only get subscribed topics, so
+	// m2 has to give up a:1 to balance the group.
+	members := map[string]kafkaGroupSubscription{
+		"m1": {topics: []string{"a"}, owned: map[string][]int32{"a": {0, 1, 5}, "b": {0}}, generation: 3},
+		"m2": {topics: []string{"a", "b"}, owned: map[string][]int32{"a": {1}}, generation: 4},
+	}
+	assignment := kafkaCooperativeAssign(members, partitions)
+	expect.Equal(map[string][]int32{"a": {0}}, assignment["m1"])
+	expect.Equal(map[string][]int32{"b": {0, 1}}, assignment["m2"])
+
+	members["m1"] = kafkaGroupSubscription{topics: []string{"a"}, owned: assignment["m1"], generation: 5}
+	members["m2"] = kafkaGroupSubscription{topics: []string{"a", "b"}, owned: assignment["m2"], generation: 5}
+	assignment = kafkaCooperativeAssign(members, partitions)
+	expect.Equal(map[string][]int32{"a": {0, 1}}, assignment["m1"])
+	expect.Equal(map[string][]int32{"b": {0, 1}}, assignment["m2"])
+
+	// Partitions of topics nobody subscribed to are not assigned
+	assignment = kafkaCooperativeAssign(map[string]kafkaGroupSubscription{
+		"m1": {topics: []string{"a"}, generation: -1},
+	}, partitions)
+	expect.Equal(map[string][]int32{"a": {0, 1}}, assignment["m1"])
+}
+
+// newTestKafkaGroupBroker returns a mock broker for the group "gollum" that
+// serves two partitions of the topic "test". The given responses replace the
+// default responses.
+func newTestKafkaGroupBroker(t *testing.T, responses map[string]kafka.MockResponse) *kafka.MockBroker {
+	broker := kafka.NewMockBroker(t, 1)
+	sub := kafkaGroupSubscription{topics: []string{"test"}, generation: -1}
+
+	handlers := map[string]kafka.MockResponse{
+		"MetadataRequest": kafka.NewMockMetadataResponse(t).
+			SetBroker(broker.Addr(), broker.BrokerID()).
+			SetLeader("test", 0, broker.BrokerID()).
+			SetLeader("test", 1, broker.BrokerID()),
+		"ConsumerMetadataRequest": kafka.NewMockConsumerMetadataResponse(t).
+			SetCoordinator("gollum", broker),
+		"JoinGroupRequest": kafka.NewMockWrapper(&kafka.JoinGroupResponse{
+			GenerationId:  1,
+			GroupProtocol: kafkaCooperativeProtocol,
+			LeaderId:      "m1",
+			MemberId:      "m1",
+			Members:       map[string][]byte{"m1": sub.encode()},
+		}),
+		"SyncGroupRequest": kafka.NewMockWrapper(&kafka.SyncGroupResponse{
+			MemberAssignment: encodeTestKafkaAssignment("test", 0, 1),
+		}),
+		"OffsetFetchRequest": kafka.NewMockOffsetFetchResponse(t).
+			SetOffset("gollum", "test", 0, 5, "", kafka.ErrNoError).
+			SetOffset("gollum", "test", 1, -1, "", kafka.ErrNoError),
+		"OffsetRequest": kafka.NewMockOffsetResponse(t).
+			SetOffset("test", 0, kafka.OffsetOldest, 0).
+			SetOffset("test", 0, kafka.OffsetNewest, 7).
+			SetOffset("test", 1, kafka.OffsetOldest, 0).
+			SetOffset("test", 1, kafka.OffsetNewest, 2),
+		"FetchRequest": kafka.NewMockFetchResponse(t, 1).
+			SetMessage("test", 0, 5, kafka.StringEncoder("a")).
+			SetMessage("test", 0, 6, kafka.StringEncoder("b")).
+			SetMessage("test", 1, 0, kafka.StringEncoder("c")).
+			SetMessage("test", 1, 1, kafka.StringEncoder("d")),
+		"HeartbeatRequest":    kafka.NewMockWrapper(&kafka.HeartbeatResponse{}),
+		"OffsetCommitRequest": kafka.NewMockOffsetCommitResponse(t),
+		"LeaveGroupRequest":   kafka.NewMockWrapper(&kafka.LeaveGroupResponse{}),
+	}
+	for request, response := range responses {
+		handlers[request] = response
+	}
+
+	broker.SetHandlerByMap(handlers)
+	return broker
+}
+
+// newTestKafkaGroup creates a cooperative group consumer connected to the
+// given broker. The consumer is configured before the broker is created, as
+// Configure replaces the logger used by the broker.
+func newTestKafkaGroup(expect shared.Expect, t *testing.T, streamName string, responses map[string]kafka.MockResponse) (*Kafka, *mockHTTPStream, *kafka.MockBroker) {
+	stream := &mockHTTPStream{}
+	core.StreamRegistry.Register(stream, core.GetStreamID(streamName))
+	conf := core.NewPluginConfig("")
+	conf.Stream = []string{streamName}
+	conf.Override("Topic", "test")
+	conf.Override("GroupId", "gollum")
+	conf.Override("GroupPartitionStrategy", "cooperative-sticky")
+	conf.Override("GroupHeartbeatMs", 50)
+	conf.Override("OffsetCommitIntervalMs", 50)
+	conf.Override("DefaultOffset", "oldest")
+	plugin, err := core.NewPluginWithType("consumer.Kafka", conf)
+	expect.NoError(err)
+
+	cons := plugin.(*Kafka)
+	broker := newTestKafkaGroupBroker(t, responses)
+	cons.servers = []string{broker.Addr()}
+	return cons, stream, broker
+}
+
+func TestKafkaCooperativeGroup(t *testing.T) {
+	expect := shared.NewExpect(t)
+
+	cons, stream, broker := newTestKafkaGroup(expect, t, "kafkaCooperative", nil)
+	defer broker.Close()
+
+	workers := new(sync.WaitGroup)
+	go cons.Consume(workers)
+
+	payloads := waitForTestPayloads(expect, stream, 4)
+	sort.Strings(payloads)
+	expect.Equal([]string{"a", "b", "c", "d"}, payloads)
+
+	// Wait for offsets to be committed before shutting down
+	expect.NonBlocking(2*time.Second, func() {
+		for !hasTestKafkaCommit(broker) {
+			time.Sleep(10 * time.Millisecond)
+		}
+	})
+
+	cons.Control() <- core.PluginControlStopConsumer
+	expect.NonBlocking(5*time.Second, workers.Wait)
+
+	requests := map[string]bool{}
+	for _, exchange := range broker.History() {
+		switch request := exchange.Request.(type) {
+		case *kafka.JoinGroupRequest:
+			requests["join"] = true
+			expect.Equal(1, len(request.GroupProtocols))
+			joined, err := decodeKafkaGroupSubscription(request.GroupProtocols[kafkaCooperativeProtocol])
+			expect.NoError(err)
+			expect.Equal([]string{"test"}, joined.topics)
+
+		case *kafka.SyncGroupRequest:
+			requests["sync"] = true
+			expect.Equal(int32(1), request.GenerationId)
+			expect.Equal(1, len(request.GroupAssignments))
+
+		case *kafka.OffsetCommitRequest:
+			requests["commit"] = true
+			expect.Equal(int32(1), request.ConsumerGroupGeneration)
+			expect.Equal("m1", request.ConsumerID)
+
+		case *kafka.LeaveGroupRequest:
+			requests["leave"] = true
+			expect.Equal("m1", request.MemberId)
+		}
+	}
+	expect.Equal(map[string]bool{"join": true, "sync": true, "commit": true, "leave": true}, requests)
+}
+
+func TestKafkaCooperativeRebalance(t *testing.T) {
+	expect := shared.NewExpect(t)
+
+	// The first heartbeat starts a rebalance that takes away partition 1.
+	// The member has to revoke it and join again, while partition 0 is read
+	// without interruption.
+	joinResponse := func(generation int32) *kafka.JoinGroupResponse {
+		return &kafka.JoinGroupResponse{
+			GenerationId:  generation,
+			GroupProtocol: kafkaCooperativeProtocol,
+			LeaderId:      "m2",
+			MemberId:      "m1",
+		}
+	}
+	cons, _, broker := newTestKafkaGroup(expect, t, "kafkaRebalance", map[string]kafka.MockResponse{
+		"JoinGroupRequest": kafka.NewMockSequence(joinResponse(1), joinResponse(2), joinResponse(3)),
+		"SyncGroupRequest": kafka.NewMockSequence(
+			&kafka.SyncGroupResponse{MemberAssignment: encodeTestKafkaAssignment("test", 0, 1)},
+			&kafka.SyncGroupResponse{MemberAssignment: encodeTestKafkaAssignment("test", 0)}),
+		"HeartbeatRequest": kafka.NewMockSequence(
+			&kafka.HeartbeatResponse{Err: kafka.ErrRebalanceInProgress},
+			&kafka.HeartbeatResponse{}),
+	})
+	defer broker.Close()
+
+	workers := new(sync.WaitGroup)
+	go cons.Consume(workers)
+
+	expect.NonBlocking(2*time.Second, func() {
+		for countTestKafkaJoins(broker) < 3 {
+			time.Sleep(10 * time.Millisecond)
+		}
+	})
+
+	cons.Control() <- core.PluginControlStopConsumer
+	expect.NonBlocking(5*time.Second, workers.Wait)
+
+	owned := []map[string][]int32{}
+	fetches := 0
+	for _, exchange := range broker.History() {
+		switch request := exchange.Request.(type) {
+		case *kafka.JoinGroupRequest:
+			joined, err := decodeKafkaGroupSubscription(request.GroupProtocols[kafkaCooperativeProtocol])
+			expect.NoError(err)
+			owned = append(owned, joined.owned)
+		case *kafka.OffsetFetchRequest:
+			fetches++
+		}
+	}
+
+	expect.Equal(3, len(owned))
+	expect.Equal(map[string][]int32{}, owned[0])
+	expect.Equal(map[string][]int32{"test": {0, 1}}, owned[1])
+	expect.Equal(map[string][]int32{"test": {0}}, owned[2])
+
+	// Offsets are only fetched for the initial assignment
+	expect.Equal(1, fetches)
+}
+
+func countTestKafkaJoins(broker *kafka.MockBroker) int {
+	joins := 0
+	for _, exchange := range broker.History() {
+		if _, isJoin := exchange.Request.(*kafka.JoinGroupRequest); isJoin {
+			joins++
+		}
+	}
+	return joins
+}
+
+func hasTestKafkaCommit(broker *kafka.MockBroker) bool {
+	for _, exchange := range broker.History() {
+		if _, isCommit := exchange.Request.(*kafka.OffsetCommitRequest); isCommit {
+			return true
+		}
+	}
+	return false
+}
@@ -16,17 +16,17 @@ package consumer
 
 import (
 	"bytes"
-	"encoding/json"
 	"fmt"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
 	"github.com/aws/aws-sdk-go/service/kinesis"
 	"github.com/trivago/gollum/core"
 	"github.com/trivago/gollum/core/log"
 	"github.com/trivago/gollum/shared"
-	"io/ioutil"
+	"os"
 	"strconv"
 	"strings"
 	"sync"
@@ -40,10 +40,20 @@ const (
 	kinesisCredentialNone   = "none"
 	kinesisOffsetNewest     = "newest"
 	kinesisOffsetOldest     = "oldest"
+	kinesisStoreFile        = "file"
+	kinesisStoreDynamoDB    = "dynamodb"
 )
 
 // Kinesis consumer plugin
 // This consumer reads message from an AWS Kinesis stream.
+// The sequence number of the last record read from each shard is stored as
+// checkpoint after each query, so reading continues after that record when
+// gollum is restarted. Checkpoints can be stored in a file or in a DynamoDB
+// table. When using DynamoDB, the shards of a stream are distributed between
+// all consumers sharing the same table.
+// Shards created by splitting or merging shards are read after all of their
+// parent shards have been read completely, so the order of records per key is
+// preserved.
 // When attached to a fuse, this consumer will stop processing messages in case
 // that fuse is burned.
 // Configuration example
@@ -54,10 +64,16 @@ const (
 //    Endpoint: "kinesis.eu-west-1.amazonaws.com"
 //    DefaultOffset: "Newest"
 //    OffsetFile: ""
+//    CheckpointStore: "file"
+//    CheckpointTable: "gollum_kinesis"
+//    DynamoDBEndpoint: ""
+//    WorkerID: ""
+//    LeaseTimeoutSec: 30
 //    RecordsPerQuery: 100
 //    RecordMessageDelimiter: ""
 //    QuerySleepTimeMs: 1000
 //    RetrySleepTimeSec: 4
+//    CheckNewShardsSec: 0
 //    CredentialType: "none"
 //    CredentialId: ""
 //    CredentialToken: ""
@@ -83,15 +99,39 @@ const (
 // will pull the credentials from environmental settings.
 // By default this is set to none.
 //
-// DefaultOffset defines the message index to start reading from.
+// DefaultOffset defines the message index to start reading from if no
+// checkpoint has been stored for a shard.
 // Valid values are either "Newset", "Oldest", or a number.
-// The default value is "Newest".
+// Shards created by splitting or merging shards are always read from the
+// beginning. The default value is "Newest".
 //
-// OffsetFile defines a file to store the current offset per shard.
+// OffsetFile defines a file to store the current offset per shard if
+// CheckpointStore is set to "file".
 // By default this is set to "", i.e. it is disabled.
 // If a file is set and found consuming will start after the stored
 // offset.
 //
+// CheckpointStore defines where checkpoints are stored. Valid values are
+// "file" and "dynamodb". By default this is set to "file".
+//
+// CheckpointTable defines the DynamoDB table used to store checkpoints and
+// leases if CheckpointStore is set to "dynamodb". The table has to exist and
+// needs a hash key named "shard" of type string. One table can be shared by
+// multiple streams. By default this is set to "gollum_kinesis".
+//
+// DynamoDBEndpoint defines the amazon endpoint for DynamoDB. By default this
+// is set to "", which uses the default endpoint of Region.
+//
+// WorkerID defines the name this consumer uses to lease shards if
+// CheckpointStore is set to "dynamodb". Each consumer reading the same stream
+// needs a unique id. By default this is set to "", which uses the hostname
+// and the process id.
+//
+// LeaseTimeoutSec defines the number of seconds after which the lease of a
+// shard expires if it is not renewed, e.g. because the consumer holding it
+// died. Leases are renewed every third of this interval.
+// By default this is set to 30.
+//
 // RecordsPerQuery defines the number of records to pull per query.
 // By default this is set to 100.
 //
@@ -104,21 +144,30 @@ const (
 //
 // RetrySleepTimeSec defines the number of seconds to wait after trying to
 // reconnect to a shard. By default this is set to 4.
+//
+// CheckNewShardsSec defines the interval in seconds in which the list of
+// shards is refreshed. The list is always refreshed when a shard has been
+// read completely. By default this is set to 0, i.e. no periodic refresh.
 type Kinesis struct {
 	core.ConsumerBase
 	client          *kinesis.Kinesis
 	config          *aws.Config
-	offsets         map[string]string
+	store           checkpointStore
 	stream          string
 	offsetType      string
-	offsetFile      string
 	defaultOffset   string
 	recordsPerQuery int64
 	delimiter       []byte
 	sleepTime       time.Duration
 	retryTime       time.Duration
 	shardTime       time.Duration
-	running         bool
+	leaseInterval   time.Duration
+	shards          map[string]*kinesis.Shard
+	running         map[string]chan struct{}
+	shardWorkers    *sync.WaitGroup
+	guard           *sync.Mutex
+	refresh         chan struct{}
+	stop            chan struct{}
 }
 
 func init() {
@@ -132,22 +181,24 @@ func (cons *Kinesis) Configure(conf core.PluginConfig) error {
 		return err
 	}
 
-	cons.offsets = make(map[string]string)
 	cons.stream = conf.GetString("KinesisStream", "default")
-	cons.offsetFile = conf.GetString("OffsetFile", "")
 	cons.recordsPerQuery = int64(conf.GetInt("RecordsPerQuery", 1000))
 	cons.delimiter = []byte(conf.GetString("RecordMessageDelimiter", ""))
 	cons.sleepTime = time.Duration(conf.GetInt("QuerySleepTimeMs", 1000)) * time.Millisecond
 	cons.retryTime = time.Duration(conf.GetInt("RetrySleepTimeSec", 4)) * time.Second
 	// 0 means don't
 	cons.shardTime = time.Duration(conf.GetInt("CheckNewShardsSec", 0)) * time.Second
+	leaseTimeout := time.Duration(shared.MaxI(conf.GetInt("LeaseTimeoutSec", 30), 3)) * time.Second
+	cons.leaseInterval = leaseTimeout / 3
+
+	cons.running = make(map[string]chan struct{})
+	cons.shardWorkers = new(sync.WaitGroup)
+	cons.guard = new(sync.Mutex)
+	cons.refresh = make(chan struct{}, 1)
+	cons.stop = make(chan struct{})
 
 	// Config
 	cons.config = aws.NewConfig()
-	if endpoint := conf.GetString("Endpoint", "kinesis.eu-west-1.amazonaws.com"); endpoint != "" {
-		cons.config.WithEndpoint(endpoint)
-	}
-
 	if region := conf.GetString("Region", "eu-west-1"); region != "" {
 		cons.config.WithRegion(region)
 	}
@@ -176,6 +227,15 @@ func (cons *Kinesis) Configure(conf core.PluginConfig) error {
 		return fmt.Errorf("Unknown CredentialType: %s", credentialType)
 	}
 
+	// Endpoints are service specific, so the DynamoDB config is copied before
+	dynamoConfig := cons.config.Copy()
+	if endpoint := conf.GetString("DynamoDBEndpoint", ""); endpoint != "" {
+		dynamoConfig.WithEndpoint(endpoint)
+	}
+	if endpoint := conf.GetString("Endpoint", "kinesis.eu-west-1.amazonaws.com"); endpoint != "" {
+		cons.config.WithEndpoint(endpoint)
+	}
+
 	// Offset
 	offsetValue := strings.ToLower(conf.GetString("DefaultOffset", kinesisOffsetNewest))
 	switch offsetValue {
@@ -197,189 +257,322 @@ func (cons *Kinesis) Configure(conf core.PluginConfig) error {
 		cons.defaultOffset = offsetValue
 	}
 
-	if cons.offsetFile != "" {
-		fileContents, err := ioutil.ReadFile(cons.offsetFile)
-		if err != nil {
+	// Checkpoints
+	storeType := strings.ToLower(conf.GetString("CheckpointStore", kinesisStoreFile))
+	switch storeType {
+	case kinesisStoreFile:
+		if cons.store, err = newFileCheckpointStore(conf.GetString("OffsetFile", "")); err != nil {
 			return err
 		}
-		if err := json.Unmarshal(fileContents, &cons.offsets); err != nil {
-			return err
+
+	case kinesisStoreDynamoDB:
+		workerID := conf.GetString("WorkerID", "")
+		if workerID == "" {
+			hostname, _ := os.Hostname()
+			workerID = fmt.Sprintf("%s-%d", hostname, os.Getpid())
 		}
+		client := dynamodb.New(session.New(dynamoConfig))
+		cons.store = newKinesisDynamoStore(client, conf.GetString("CheckpointTable", "gollum_kinesis"), cons.stream, workerID, leaseTimeout)
+
+	default:
+		return fmt.Errorf("Unknown CheckpointStore: %s", storeType)
 	}
 
 	return nil
 }
 
-func (cons *Kinesis) storeOffsets() {
-	if cons.offsetFile != "" {
-		fileContents, err := json.Marshal(cons.offsets)
-		if err == nil {
-			ioutil.WriteFile(cons.offsetFile, fileContents, 0644)
-		}
+// sleep waits for the given duration. False is returned if the consumer or
+// the given shard worker has been stopped in the meantime.
+func (cons *Kinesis) sleep(duration time.Duration, stop chan struct{}) bool {
+	select {
+	case <-cons.stop:
+		return false
+	case <-stop:
+		return false
+	case <-time.After(duration):
+		return true
 	}
 }
 
-func (cons *Kinesis) processShard(shardID string) {
+func (cons *Kinesis) shardIterator(shardID, sequence string, hasParents bool) (*string, error) {
 	iteratorConfig := kinesis.GetShardIteratorInput{
-		ShardId:                aws.String(shardID),
-		ShardIteratorType:      aws.String(cons.offsetType),
-		StreamName:             aws.String(cons.stream),
-		StartingSequenceNumber: aws.String(cons.offsets[shardID]),
+		ShardId:           aws.String(shardID),
+		ShardIteratorType: aws.String(cons.offsetType),
+		StreamName:        aws.String(cons.stream),
 	}
-	if *iteratorConfig.StartingSequenceNumber == "" {
-		iteratorConfig.StartingSequenceNumber = nil
-	} else {
+
+	switch {
+	case sequence != "":
 		// starting sequence number requires ShardIteratorTypeAfterSequenceNumber
 		iteratorConfig.ShardIteratorType = aws.String(kinesis.ShardIteratorTypeAfterSequenceNumber)
+		iteratorConfig.StartingSequenceNumber = aws.String(sequence)
+
+	case hasParents:
+		// Records of resharded shards would be lost otherwise
+		iteratorConfig.ShardIteratorType = aws.String(kinesis.ShardIteratorTypeTrimHorizon)
+
+	case cons.defaultOffset != "":
+		iteratorConfig.StartingSequenceNumber = aws.String(cons.defaultOffset)
 	}
 
 	iterator, err := cons.client.GetShardIterator(&iteratorConfig)
-	if err != nil || iterator.ShardIterator == nil {
-		Log.Error.Printf("Failed to iterate shard %s:%s - %s", *iteratorConfig.StreamName, *iteratorConfig.ShardId, err.Error())
-		if cons.running {
-			time.AfterFunc(cons.retryTime, func() { cons.processShard(shardID) })
+	if err != nil {
+		return nil, err
+	}
+	if iterator.ShardIterator == nil {
+		return nil, fmt.Errorf("No shard iterator returned")
+	}
+	return iterator.ShardIterator, nil
+}
+
+func (cons *Kinesis) enqueueRecord(record *kinesis.Record) {
+	seq, _ := strconv.ParseInt(*record.SequenceNumber, 10, 64)
+	if len(cons.delimiter) > 0 {
+		messages := bytes.Split(record.Data, cons.delimiter)
+		for idx, msg := range messages {
+			cons.Enqueue([]byte(msg), uint64(seq)+uint64(idx))
+		}
+	} else {
+		cons.Enqueue(record.Data, uint64(seq))
+	}
+}
+
+func (cons *Kinesis) processShard(shardID, sequence string, hasParents bool, stop chan struct{}) {
+	defer cons.shardDone(shardID, stop)
+
+	var iterator *string
+	for iterator == nil {
+		var err error
+		if iterator, err = cons.shardIterator(shardID, sequence, hasParents); err != nil {
+			Log.Error.Printf("Failed to iterate shard %s:%s - %s", cons.stream, shardID, err.Error())
+			if !cons.sleep(cons.retryTime, stop) {
+				return // ### return, stopped ###
+			}
 		}
-		return // ### return, retry ###
 	}
 
 	recordConfig := kinesis.GetRecordsInput{
-		ShardIterator: iterator.ShardIterator,
+		ShardIterator: iterator,
 		Limit:         aws.Int64(cons.recordsPerQuery),
 	}
 
-	cons.AddWorker()
-	defer cons.WorkerDone()
-
-	for cons.running {
+	for cons.IsActive() {
 		cons.WaitOnFuse()
 		result, err := cons.client.GetRecords(&recordConfig)
 		if err != nil {
-			Log.Error.Printf("Failed to get records from shard %s:%s - %s", *iteratorConfig.StreamName, *iteratorConfig.ShardId, err.Error())
-			// Check if we reached throughput limit
+			Log.Error.Printf("Failed to get records from shard %s:%s - %s", cons.stream, shardID, err.Error())
+			delay := cons.retryTime
 			if AWSerr, isAWSerr := err.(awserr.Error); isAWSerr {
-				if AWSerr.Code() == "ProvisionedThroughputExceededException" {
-					time.Sleep(5 * time.Second)
+				switch AWSerr.Code() {
+				case "ProvisionedThroughputExceededException":
+					delay = 5 * time.Second
+
+				case "ExpiredIteratorException":
+					// Continue after the last record processed
+					if iterator, err := cons.shardIterator(shardID, sequence, hasParents); err == nil {
+						recordConfig.ShardIterator = iterator
+						continue // ### continue, retry with new iterator ###
+					}
 				}
 			}
-		} else {
-			if result.NextShardIterator == nil {
-				Log.Warning.Printf("Shard %s:%s has been closed", *iteratorConfig.StreamName, *iteratorConfig.ShardId)
-				return // ### return, closed ###
+			if !cons.sleep(delay, stop) {
+				return // ### return, stopped ###
 			}
+			continue // ### continue, retry ###
+		}
 
-			for _, record := range result.Records {
-				if record == nil {
-					continue // ### continue ###
-				}
+		for _, record := range result.Records {
+			if record == nil || record.SequenceNumber == nil {
+				continue // ### continue ###
+			}
+			cons.enqueueRecord(record)
+			sequence = *record.SequenceNumber
+		}
 
-				seq, _ := strconv.ParseInt(*record.SequenceNumber, 10, 64)
-				if len(cons.delimiter) > 0 {
-					messages := bytes.Split(record.Data, cons.delimiter)
-					for idx, msg := range messages {
-						cons.Enqueue([]byte(msg), uint64(seq)+uint64(idx))
-					}
-				} else {
-					cons.Enqueue(record.Data, uint64(seq))
-				}
-				cons.offsets[*iteratorConfig.ShardId] = *record.SequenceNumber
-				cons.storeOffsets()
+		if len(result.Records) > 0 {
+			if err := cons.store.store(shardID, sequence); err != nil {
+				Log.Warning.Printf("Stopped reading shard %s:%s - %s", cons.stream, shardID, err.Error())
+				return // ### return, lease lost ###
 			}
+		}
 
-			recordConfig.ShardIterator = result.NextShardIterator
+		if result.NextShardIterator == nil {
+			Log.Note.Printf("Shard %s:%s has been closed", cons.stream, shardID)
+			if err := cons.store.store(shardID, kinesisShardEnd); err != nil {
+				Log.Warning.Printf("Failed to store end of shard %s:%s - %s", cons.stream, shardID, err.Error())
+			}
+			cons.requestRefresh()
+			return // ### return, closed ###
+		}
+		recordConfig.ShardIterator = result.NextShardIterator
+
+		if len(result.Records) == 0 && !cons.sleep(cons.sleepTime, stop) {
+			return // ### return, stopped ###
 		}
-		time.Sleep(cons.sleepTime)
 	}
 }
 
-func (cons *Kinesis) connect() error {
-	cons.client = kinesis.New(session.New(cons.config))
+func (cons *Kinesis) shardDone(shardID string, stop chan struct{}) {
+	cons.guard.Lock()
+	if cons.running[shardID] == stop {
+		delete(cons.running, shardID)
+	}
+	cons.guard.Unlock()
+	cons.shardWorkers.Done()
+}
 
-	// Get shard ids for stream
+func (cons *Kinesis) requestRefresh() {
+	select {
+	case cons.refresh <- struct{}{}:
+	default:
+	}
+}
+
+func (cons *Kinesis) updateShards() error {
+	shards := make(map[string]*kinesis.Shard)
 	streamQuery := &kinesis.DescribeStreamInput{
 		StreamName: aws.String(cons.stream),
 	}
 
-	streamInfo, err := cons.client.DescribeStream(streamQuery)
-	if err != nil {
-		return err
+	for {
+		streamInfo, err := cons.client.DescribeStream(streamQuery)
+		if err != nil {
+			return err
+		}
+		if streamInfo.StreamDescription == nil {
+			return fmt.Errorf("StreamDescription could not be retrieved.")
+		}
+
+		for _, shard := range streamInfo.StreamDescription.Shards {
+			if shard.ShardId == nil {
+				return fmt.Errorf("ShardId could not be retrieved.")
+			}
+			shards[*shard.ShardId] = shard
+			streamQuery.ExclusiveStartShardId = shard.ShardId
+		}
+
+		if !aws.BoolValue(streamInfo.StreamDescription.HasMoreShards) {
+			break // ### break, all shards listed ###
+		}
 	}
 
-	if streamInfo.StreamDescription == nil {
-		return fmt.Errorf("StreamDescription could not be retrieved.")
+	cons.shards = shards
+	return nil
+}
+
+// shardParents returns the ids of the shards a shard has been created from.
+func shardParents(shard *kinesis.Shard) []string {
+	parents := []string{}
+	for _, parent := range []*string{shard.ParentShardId, shard.AdjacentParentShardId} {
+		if parent != nil && *parent != "" {
+			parents = append(parents, *parent)
+		}
 	}
+	return parents
+}
 
-	cons.running = true
-	for _, shard := range streamInfo.StreamDescription.Shards {
-		if shard.ShardId == nil {
-			return fmt.Errorf("ShardId could not be retrieved.")
+// readyShards returns all shards that have not been read completely and
+// whose parents have been read completely or are not available anymore.
+func (cons *Kinesis) readyShards(checkpoints map[string]string) []string {
+	ready := []string{}
+	for shardID, shard := range cons.shards {
+		if checkpoints[shardID] == kinesisShardEnd {
+			continue // ### continue, done ###
 		}
 
-		if _, offsetStored := cons.offsets[*shard.ShardId]; !offsetStored {
-			cons.offsets[*shard.ShardId] = cons.defaultOffset
+		parentsDone := true
+		for _, parent := range shardParents(shard) {
+			if _, exists := cons.shards[parent]; exists && checkpoints[parent] != kinesisShardEnd {
+				parentsDone = false
+			}
+		}
+		if parentsDone {
+			ready = append(ready, shardID)
 		}
 	}
+	return ready
+}
 
-	for shardID := range cons.offsets {
-		Log.Debug.Printf("Starting kinesis consumer for %s:%s", cons.stream, shardID)
-		go cons.processShard(shardID)
+// balance starts workers for all shards leased to this consumer and stops
+// workers for shards that are not leased anymore.
+func (cons *Kinesis) balance() {
+	checkpoints, err := cons.store.checkpoints()
+	if err != nil {
+		Log.Error.Print("Kinesis failed to read checkpoints: ", err)
+		return // ### return, retry later ###
 	}
 
-	if cons.shardTime > 0 {
-		cons.AddWorker()
-		time.AfterFunc(cons.shardTime, cons.updateShards)
+	owned, err := cons.store.lease(cons.readyShards(checkpoints))
+	if err != nil {
+		Log.Error.Print("Kinesis failed to lease shards: ", err)
+		return // ### return, retry later ###
 	}
 
-	return nil
-}
+	cons.guard.Lock()
+	defer cons.guard.Unlock()
 
-func (cons *Kinesis) updateShards() {
-	defer cons.WorkerDone()
-
-	streamQuery := &kinesis.DescribeStreamInput{
-		StreamName: aws.String(cons.stream),
+	for shardID, stop := range cons.running {
+		if !owned[shardID] {
+			Log.Debug.Printf("Stopping kinesis consumer for %s:%s", cons.stream, shardID)
+			close(stop)
+			delete(cons.running, shardID)
+		}
 	}
 
-	for cons.running {
-		streamInfo, err := cons.client.DescribeStream(streamQuery)
-		if err != nil {
-			Log.Warning.Printf("StreamInfo could not be retrieved.")
+	for shardID := range owned {
+		if _, isRunning := cons.running[shardID]; isRunning || !cons.IsActive() {
+			continue // ### continue, nothing to do ###
 		}
+		Log.Debug.Printf("Starting kinesis consumer for %s:%s", cons.stream, shardID)
+		stop := make(chan struct{})
+		cons.running[shardID] = stop
+		cons.shardWorkers.Add(1)
+		hasParents := len(shardParents(cons.shards[shardID])) > 0
+		go shared.DontPanic(func() { cons.processShard(shardID, checkpoints[shardID], hasParents, stop) })
+	}
+}
 
-		if streamInfo.StreamDescription == nil {
-			Log.Warning.Printf("StreamDescription could not be retrieved.")
-			continue
+func (cons *Kinesis) coordinate() {
+	defer cons.WorkerDone()
+	defer cons.store.release()
+	defer cons.shardWorkers.Wait()
+
+	lastUpdate := time.Time{}
+	needsUpdate := true
+	for cons.IsActive() {
+		if needsUpdate || (cons.shardTime > 0 && time.Since(lastUpdate) >= cons.shardTime) {
+			if err := cons.updateShards(); err != nil {
+				Log.Error.Print("Kinesis failed to list shards: ", err)
+			} else {
+				lastUpdate, needsUpdate = time.Now(), false
+			}
 		}
 
-		cons.running = true
-		for _, shard := range streamInfo.StreamDescription.Shards {
-			if shard.ShardId == nil {
-				Log.Warning.Printf("ShardId could not be retrieved.")
-				continue
-			}
+		if cons.shards != nil {
+			cons.balance()
+		}
 
-			if _, offsetStored := cons.offsets[*shard.ShardId]; !offsetStored {
-				cons.offsets[*shard.ShardId] = cons.defaultOffset
-				Log.Debug.Printf("Starting kinesis consumer for %s:%s", cons.stream, *shard.ShardId)
-				go cons.processShard(*shard.ShardId)
-			}
+		select {
+		case <-cons.stop:
+		case <-cons.refresh:
+			needsUpdate = true
+		case <-time.After(cons.leaseInterval):
 		}
-		time.Sleep(cons.shardTime)
 	}
 }
 
 func (cons *Kinesis) close() {
-	cons.running = false
-	cons.WorkerDone()
+	close(cons.stop)
 }
 
 // Consume listens to stdin.
 func (cons *Kinesis) Consume(workers *sync.WaitGroup) {
-	cons.AddMainWorker(workers)
-	defer cons.close()
+	cons.SetWorkerWaitGroup(workers)
+	cons.SetStopCallback(cons.close)
+	cons.client = kinesis.New(session.New(cons.config))
 
-	if err := cons.connect(); err != nil {
-		Log.Error.Print("Kinesis connection error: ", err)
-	} else {
-		cons.ControlLoop()
-	}
+	cons.AddWorker()
+	go shared.DontPanic(cons.coordinate)
+
+	cons.ControlLoop()
 }
@@ -0,0 +1,298 @@
+// Copyright 2015-2016 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumer
+
+import (
+	"encoding/json"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/shared"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newKinesisTestServer(handler func(action string, request map[string]interface{}) (int, interface{})) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, req *http.Request) {
+		target := req.Header.Get("X-Amz-Target")
+		action := target[strings.Index(target, ".")+1:]
+
+		request := map[string]interface{}{}
+		json.NewDecoder(req.Body).Decode(&request)
+
+		status, response := handler(action, request)
+		writer.Header().Set("Content-Type", "application/x-amz-json-1.1")
+		writer.WriteHeader(status)
+		json.NewEncoder(writer).Encode(response)
+	}))
+}
+
+func TestKinesisResharding(t *testing.T) {
+	expect := shared.NewExpect(t)
+
+	dir, err := ioutil.TempDir("", "gollum_kinesis")
+	expect.NoError(err)
+	defer os.RemoveAll(dir)
+	offsetFile := filepath.Join(dir, "offsets.json")
+	expect.NoError(ioutil.WriteFile(offsetFile, []byte(`{"shard-0":"1"}`), 0644))
+
+	guard := new(sync.Mutex)
+	iterators := []string{}
+	records := map[string][]map[string]string{
+		"shard-0": {{"SequenceNumber": "2", "Data": "Yg==", "PartitionKey": "k"}},
+		"shard-1": {{"SequenceNumber": "3", "Data": "Yw==", "PartitionKey": "k"}},
+		"shard-2": {{"SequenceNumber": "4", "Data": "ZA==", "PartitionKey": "k"}},
+	}
+
+	server := newKinesisTestServer(func(action string, request map[string]interface{}) (int, interface{}) {
+		guard.Lock()
+		defer guard.Unlock()
+
+		switch action {
+		case "DescribeStream":
+			return http.StatusOK, map[string]interface{}{
+				"StreamDescription": map[string]interface{}{
+					"StreamName":    "test",
+					"HasMoreShards": false,
+					"Shards": []map[string]interface{}{
+						{"ShardId": "shard-0"},
+						{"ShardId": "shard-1", "ParentShardId": "shard-0"},
+						{"ShardId": "shard-2", "ParentShardId": "shard-0"},
+					},
+				},
+			}
+
+		case "GetShardIterator":
+			shardID := request["ShardId"].(string)
+			iterator := shardID + " " + request["ShardIteratorType"].(string)
+			if sequence, isSet := request["StartingSequenceNumber"]; isSet {
+				iterator += " " + sequence.(string)
+			}
+			iterators = append(iterators, iterator)
+			return http.StatusOK, map[string]string{"ShardIterator": shardID}
+
+		case "GetRecords":
+			shardID := request["ShardIterator"].(string)
+			shardRecords := records[shardID]
+			records[shardID] = nil
+
+			response := map[string]interface{}{"Records": shardRecords}
+			if shardID != "shard-0" {
+				response["NextShardIterator"] = shardID
+			}
+			return http.StatusOK, response
+		}
+		return http.StatusBadRequest, map[string]string{"__type": "UnknownOperationException"}
+	})
+	defer server.Close()
+
+	stream := &mockHTTPStream{}
+	core.StreamRegistry.Register(stream, core.GetStreamID("kinesisResharding"))
+	conf := core.NewPluginConfig("")
+	conf.Stream = []string{"kinesisResharding"}
+	conf.Override("KinesisStream", "test")
+	conf.Override("Endpoint", server.URL)
+	conf.Override("CredentialType", "static")
+	conf.Override("CredentialId", "id")
+	conf.Override("CredentialSecret", "secret")
+	conf.Override("OffsetFile", offsetFile)
+	conf.Override("QuerySleepTimeMs", 10)
+	plugin, err := core.NewPluginWithType("consumer.Kinesis", conf)
+	expect.NoError(err)
+	cons := plugin.(*Kinesis)
+
+	workers := new(sync.WaitGroup)
+	go cons.Consume(workers)
+
+	expect.NonBlocking(5*time.Second, func() {
+		for stream.count() < 3 {
+			time.Sleep(10 * time.Millisecond)
+		}
+	})
+
+	cons.Control() <- core.PluginControlStopConsumer
+	expect.NonBlocking(2*time.Second, workers.Wait)
+
+	// The parent shard has to be read before its children
+	expect.Equal("b", string(stream.messages[0].Data))
+	children := []string{string(stream.messages[1].Data), string(stream.messages[2].Data)}
+	sort.Strings(children)
+	expect.Equal([]string{"c", "d"}, children)
+
+	guard.Lock()
+	sort.Strings(iterators)
+	expect.Equal([]string{
+		"shard-0 AFTER_SEQUENCE_NUMBER 1",
+		"shard-1 TRIM_HORIZON",
+		"shard-2 TRIM_HORIZON",
+	}, iterators)
+	guard.Unlock()
+
+	offsets := map[string]string{}
+	fileContents, err := ioutil.ReadFile(offsetFile)
+	expect.NoError(err)
+	expect.NoError(json.Unmarshal(fileContents, &offsets))
+	expect.Equal(map[string]string{"shard-0": kinesisShardEnd, "shard-1": "3", "shard-2": "4"}, offsets)
+}
+
+// fakeDynamoTable implements the DynamoDB requests sent by
+// kinesisDynamoStore on an in-memory table.
+type fakeDynamoTable struct {
+	items map[string]map[string]map[string]string
+	guard *sync.Mutex
+}
+
+func (table *fakeDynamoTable) handle(action string, request map[string]interface{}) (int, interface{}) {
+	table.guard.Lock()
+	defer table.guard.Unlock()
+
+	attributes := func(name string) map[string]map[string]string {
+		values := map[string]map[string]string{}
+		encoded, _ := json.Marshal(request[name])
+		json.Unmarshal(encoded, &values)
+		return values
+	}
+	values := attributes("ExpressionAttributeValues")
+
+	switch action {
+	case "PutItem":
+		item := attributes("Item")
+		table.items[item["shard"]["S"]] = item
+
+	case "DeleteItem":
+		delete(table.items, attributes("Key")["shard"]["S"])
+
+	case "Scan":
+		items := []map[string]map[string]string{}
+		for key, item := range table.items {
+			if strings.HasPrefix(key, values[":prefix"]["S"]) {
+				items = append(items, item)
+			}
+		}
+		return http.StatusOK, map[string]interface{}{"Items": items}
+
+	case "UpdateItem":
+		key := attributes("Key")["shard"]["S"]
+		item, exists := table.items[key]
+		if !exists {
+			item = map[string]map[string]string{"shard": {"S": key}}
+		}
+
+		owner, hasOwner := item["owner"]
+		isOwner := hasOwner && owner["S"] == values[":worker"]["S"]
+		conditionMet := isOwner
+		if request["ConditionExpression"] == "attribute_not_exists(#owner) OR #owner = :worker OR #expiry < :now" {
+			conditionMet = !hasOwner || isOwner || item["expiry"]["N"] < values[":now"]["N"]
+		}
+		if !conditionMet {
+			return http.StatusBadRequest, map[string]string{"__type": "com.amazonaws.dynamodb.v20120810#ConditionalCheckFailedException"}
+		}
+
+		switch request["UpdateExpression"] {
+		case "SET #checkpoint = :checkpoint":
+			item["checkpoint"] = values[":checkpoint"]
+		case "SET #owner = :worker, #expiry = :expiry":
+			item["owner"], item["expiry"] = values[":worker"], values[":expiry"]
+		case "REMOVE #owner, #expiry":
+			delete(item, "owner")
+			delete(item, "expiry")
+		}
+		table.items[key] = item
+	}
+	return http.StatusOK, map[string]string{}
+}
+
+func newTestDynamoStore(expect shared.Expect, url, workerID string, now *time.Time) *kinesisDynamoStore {
+	conf := core.NewPluginConfig("")
+	conf.Override("KinesisStream", "test")
+	conf.Override("CheckpointStore", "dynamodb")
+	conf.Override("DynamoDBEndpoint", url)
+	conf.Override("WorkerID", workerID)
+	conf.Override("CredentialType", "static")
+	conf.Override("CredentialId", "id")
+	conf.Override("CredentialSecret", "secret")
+	plugin, err := core.NewPluginWithType("consumer.Kinesis", conf)
+	expect.NoError(err)
+
+	store := plugin.(*Kinesis).store.(*kinesisDynamoStore)
+	store.now = func() time.Time { return *now }
+	return store
+}
+
+func leasedShards(owned map[string]bool) []string {
+	shards := []string{}
+	for shardID := range owned {
+		shards = append(shards, shardID)
+	}
+	sort.Strings(shards)
+	return shards
+}
+
+func TestKinesisDynamoLeases(t *testing.T) {
+	expect := shared.NewExpect(t)
+
+	table := &fakeDynamoTable{
+		items: make(map[string]map[string]map[string]string),
+		guard: new(sync.Mutex),
+	}
+	server := newKinesisTestServer(table.handle)
+	defer server.Close()
+
+	now := time.Now()
+	storeA := newTestDynamoStore(expect, server.URL, "a", &now)
+	storeB := newTestDynamoStore(expect, server.URL, "b", &now)
+	shards := []string{"shard-0", "shard-1", "shard-2", "shard-3"}
+
+	owned, err := storeA.lease(shards)
+	expect.NoError(err)
+	expect.Equal(shards, leasedShards(owned))
+	expect.NoError(storeA.store("shard-3", "42"))
+
+	// B joins, A releases half of its shards on the next renewal
+	owned, err = storeB.lease(shards)
+	expect.NoError(err)
+	expect.Equal(0, len(owned))
+
+	owned, err = storeA.lease(shards)
+	expect.NoError(err)
+	expect.Equal([]string{"shard-0", "shard-1"}, leasedShards(owned))
+
+	owned, err = storeB.lease(shards)
+	expect.NoError(err)
+	expect.Equal([]string{"shard-2", "shard-3"}, leasedShards(owned))
+	expect.NotNil(storeA.store("shard-3", "43"))
+	expect.NoError(storeB.store("shard-3", "43"))
+
+	checkpoints, err := storeA.checkpoints()
+	expect.NoError(err)
+	expect.Equal(map[string]string{"shard-3": "43"}, checkpoints)
+
+	// Leases of A expire if A stops renewing them
+	now = now.Add(time.Minute)
+	owned, err = storeB.lease(shards)
+	expect.NoError(err)
+	expect.Equal(shards, leasedShards(owned))
+
+	storeB.release()
+	owned, err = storeA.lease(shards)
+	expect.NoError(err)
+	expect.Equal(shards, leasedShards(owned))
+}
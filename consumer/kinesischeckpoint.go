@@ -0,0 +1,298 @@
+// Copyright 2015-2016 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumer
+
+import (
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/trivago/gollum/shared"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// kinesisShardEnd is stored as checkpoint of shards that have been read
+	// completely after being closed by a split or merge.
+	kinesisShardEnd = "SHARD_END"
+)
+
+// kinesisDynamoStore stores checkpoints in a DynamoDB table and distributes
+// the shards of a stream between all consumers using the same table.
+// Shard items use the key "<stream>/shard/<shard id>" and store the
+// attributes "checkpoint", "owner" and "expiry". Each consumer announces
+// itself with an item using the key "<stream>/worker/<worker id>". Shards are
+// balanced so that each consumer holds at most ceil(shards / consumers)
+// leases.
+type kinesisDynamoStore struct {
+	client       *dynamodb.DynamoDB
+	table        string
+	stream       string
+	workerID     string
+	leaseTimeout time.Duration
+	owned        map[string]bool
+	guard        *sync.Mutex
+	now          func() time.Time
+}
+
+// kinesisDynamoNames returns the placeholders "#<name>" for the given
+// attribute names, as some of them are reserved words in expressions.
+func kinesisDynamoNames(names ...string) map[string]*string {
+	placeholders := make(map[string]*string, len(names))
+	for _, name := range names {
+		placeholders["#"+name] = aws.String(name)
+	}
+	return placeholders
+}
+
+func newKinesisDynamoStore(client *dynamodb.DynamoDB, table, stream, workerID string, leaseTimeout time.Duration) *kinesisDynamoStore {
+	return &kinesisDynamoStore{
+		client:       client,
+		table:        table,
+		stream:       stream,
+		workerID:     workerID,
+		leaseTimeout: leaseTimeout,
+		owned:        make(map[string]bool),
+		guard:        new(sync.Mutex),
+		now:          time.Now,
+	}
+}
+
+func (store *kinesisDynamoStore) shardKey(shardID string) map[string]*dynamodb.AttributeValue {
+	return map[string]*dynamodb.AttributeValue{
+		"shard": {S: aws.String(store.stream + "/shard/" + shardID)},
+	}
+}
+
+func (store *kinesisDynamoStore) timestamp(t time.Time) *dynamodb.AttributeValue {
+	return &dynamodb.AttributeValue{N: aws.String(strconv.FormatInt(t.UnixNano()/int64(time.Millisecond), 10))}
+}
+
+func isConditionalCheckFailed(err error) bool {
+	awsErr, isAWSErr := err.(awserr.Error)
+	return isAWSErr && awsErr.Code() == "ConditionalCheckFailedException"
+}
+
+// items returns all shard and worker items of the stream.
+func (store *kinesisDynamoStore) items() ([]map[string]*dynamodb.AttributeValue, error) {
+	items := []map[string]*dynamodb.AttributeValue{}
+	input := &dynamodb.ScanInput{
+		TableName:                 aws.String(store.table),
+		ConsistentRead:            aws.Bool(true),
+		FilterExpression:          aws.String("begins_with(#shard, :prefix)"),
+		ExpressionAttributeNames:  kinesisDynamoNames("shard"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{":prefix": {S: aws.String(store.stream + "/")}},
+	}
+
+	for {
+		result, err := store.client.Scan(input)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, result.Items...)
+		if len(result.LastEvaluatedKey) == 0 {
+			return items, nil // ### return, last page ###
+		}
+		input.ExclusiveStartKey = result.LastEvaluatedKey
+	}
+}
+
+func itemString(item map[string]*dynamodb.AttributeValue, name string) string {
+	if value, exists := item[name]; exists && value.S != nil {
+		return *value.S
+	}
+	if value, exists := item[name]; exists && value.N != nil {
+		return *value.N
+	}
+	return ""
+}
+
+func (store *kinesisDynamoStore) checkpoints() (map[string]string, error) {
+	items, err := store.items()
+	if err != nil {
+		return nil, err
+	}
+
+	offsets := make(map[string]string)
+	prefix := store.stream + "/shard/"
+	for _, item := range items {
+		if key := itemString(item, "shard"); strings.HasPrefix(key, prefix) {
+			if checkpoint := itemString(item, "checkpoint"); checkpoint != "" {
+				offsets[strings.TrimPrefix(key, prefix)] = checkpoint
+			}
+		}
+	}
+	return offsets, nil
+}
+
+func (store *kinesisDynamoStore) store(shardID, sequence string) error {
+	_, err := store.client.UpdateItem(&dynamodb.UpdateItemInput{
+		TableName:                aws.String(store.table),
+		Key:                      store.shardKey(shardID),
+		UpdateExpression:         aws.String("SET #checkpoint = :checkpoint"),
+		ConditionExpression:      aws.String("#owner = :worker"),
+		ExpressionAttributeNames: kinesisDynamoNames("checkpoint", "owner"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":checkpoint": {S: aws.String(sequence)},
+			":worker":     {S: aws.String(store.workerID)},
+		},
+	})
+	if isConditionalCheckFailed(err) {
+		return fmt.Errorf("Lease of shard %s has been lost", shardID)
+	}
+	return err
+}
+
+// claim takes over or renews the lease of a shard. False is returned if the
+// shard is leased to another consumer.
+func (store *kinesisDynamoStore) claim(shardID string, now time.Time) (bool, error) {
+	_, err := store.client.UpdateItem(&dynamodb.UpdateItemInput{
+		TableName:                aws.String(store.table),
+		Key:                      store.shardKey(shardID),
+		UpdateExpression:         aws.String("SET #owner = :worker, #expiry = :expiry"),
+		ConditionExpression:      aws.String("attribute_not_exists(#owner) OR #owner = :worker OR #expiry < :now"),
+		ExpressionAttributeNames: kinesisDynamoNames("owner", "expiry"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":worker": {S: aws.String(store.workerID)},
+			":expiry": store.timestamp(now.Add(store.leaseTimeout)),
+			":now":    store.timestamp(now),
+		},
+	})
+	if isConditionalCheckFailed(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (store *kinesisDynamoStore) releaseShard(shardID string) error {
+	_, err := store.client.UpdateItem(&dynamodb.UpdateItemInput{
+		TableName:                aws.String(store.table),
+		Key:                      store.shardKey(shardID),
+		UpdateExpression:         aws.String("REMOVE #owner, #expiry"),
+		ConditionExpression:      aws.String("#owner = :worker"),
+		ExpressionAttributeNames: kinesisDynamoNames("owner", "expiry"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":worker": {S: aws.String(store.workerID)},
+		},
+	})
+	if isConditionalCheckFailed(err) {
+		return nil // ### return, not ours anymore ###
+	}
+	return err
+}
+
+func (store *kinesisDynamoStore) lease(shardIDs []string) (map[string]bool, error) {
+	store.guard.Lock()
+	defer store.guard.Unlock()
+
+	now := store.now()
+	_, err := store.client.PutItem(&dynamodb.PutItemInput{
+		TableName: aws.String(store.table),
+		Item: map[string]*dynamodb.AttributeValue{
+			"shard":  {S: aws.String(store.stream + "/worker/" + store.workerID)},
+			"expiry": store.timestamp(now.Add(store.leaseTimeout)),
+		},
+	})
+	if err != nil {
+		return nil, err // ### return, table not available ###
+	}
+
+	items, err := store.items()
+	if err != nil {
+		return nil, err // ### return, table not available ###
+	}
+
+	nowMs := now.UnixNano() / int64(time.Millisecond)
+	workers, leasedByOthers := 0, make(map[string]bool)
+	for _, item := range items {
+		key := itemString(item, "shard")
+		expiry, _ := strconv.ParseInt(itemString(item, "expiry"), 10, 64)
+		if expiry < nowMs {
+			continue // ### continue, expired ###
+		}
+		switch {
+		case strings.HasPrefix(key, store.stream+"/worker/"):
+			workers++
+		case strings.HasPrefix(key, store.stream+"/shard/") && itemString(item, "owner") != store.workerID:
+			leasedByOthers[strings.TrimPrefix(key, store.stream+"/shard/")] = true
+		}
+	}
+	target := int(math.Ceil(float64(len(shardIDs)) / float64(shared.MaxI(workers, 1))))
+
+	// Renew our leases first, then release or claim shards to reach the
+	// target. Shards are traversed in order so that released and claimed
+	// shards are stable between calls.
+	sorted := append([]string{}, shardIDs...)
+	sort.Strings(sorted)
+	owned := make(map[string]bool)
+	for _, shardID := range sorted {
+		if !store.owned[shardID] {
+			continue // ### continue, not ours ###
+		}
+		if len(owned) >= target {
+			if err := store.releaseShard(shardID); err != nil {
+				return nil, err
+			}
+			continue // ### continue, released for rebalancing ###
+		}
+		renewed, err := store.claim(shardID, now)
+		if err != nil {
+			return nil, err
+		}
+		if renewed {
+			owned[shardID] = true
+		}
+	}
+
+	for _, shardID := range sorted {
+		if len(owned) >= target {
+			break // ### break, target reached ###
+		}
+		if owned[shardID] || leasedByOthers[shardID] {
+			continue // ### continue, already assigned ###
+		}
+		claimed, err := store.claim(shardID, now)
+		if err != nil {
+			return nil, err
+		}
+		if claimed {
+			owned[shardID] = true
+		}
+	}
+
+	store.owned = owned
+	return owned, nil
+}
+
+func (store *kinesisDynamoStore) release() {
+	store.guard.Lock()
+	defer store.guard.Unlock()
+
+	for shardID := range store.owned {
+		store.releaseShard(shardID)
+	}
+	store.owned = make(map[string]bool)
+	store.client.DeleteItem(&dynamodb.DeleteItemInput{
+		TableName: aws.String(store.table),
+		Key: map[string]*dynamodb.AttributeValue{
+			"shard": {S: aws.String(store.stream + "/worker/" + store.workerID)},
+		},
+	})
+}
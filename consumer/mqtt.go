@@ -0,0 +1,309 @@
+// Copyright 2015-2016 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumer
+
+import (
+	"fmt"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/core/log"
+	"github.com/trivago/gollum/shared"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	mqttMetadataTopic       = "mqtt_topic"
+	mqttMetadataQoS         = "mqtt_qos"
+	mqttMetadataRetain      = "mqtt_retain"
+	mqttMetadataContentType = "mqtt_content_type"
+	mqttMetadataProperty    = "mqtt_property."
+)
+
+// MQTT consumer plugin
+// The MQTT consumer subscribes to topics of an MQTT broker using MQTT 3.1.1
+// or MQTT 5. Messages with QoS 1 and 2 are acknowledged after they have been
+// passed to the configured streams. Lost connections are reestablished
+// automatically.
+// The topic of a message is attached as "mqtt_topic" metadata, the QoS level
+// as "mqtt_qos". Retained messages have "mqtt_retain" set to "true". For
+// MQTT 5 the content type is stored as "mqtt_content_type" and each user
+// property is stored as "mqtt_property.<name>".
+// When attached to a fuse, this consumer will stop reading messages in case
+// that fuse is burned.
+// Configuration example
+//
+//  - "consumer.MQTT":
+//    Address: "tcp://localhost:1883"
+//    Version: "3.1.1"
+//    ClientID: ""
+//    Username: ""
+//    Password: ""
+//    Topics:
+//      - "sensors/+/temperature"
+//      - "devices/#"
+//    QoS: 1
+//    TopicStreams:
+//      "devices/#": "devices"
+//    PersistentSession: false
+//    SessionExpirySec: 86400
+//    KeepAliveSec: 30
+//    RetryDelayMs: 3000
+//    TlsEnable: false
+//    TlsKeyLocation: ""
+//    TlsCertificateLocation: ""
+//    TlsCaLocation: ""
+//    TlsServerName: ""
+//    TlsInsecureSkipVerify: false
+//
+// Address defines the address of the broker. The schemes "tcp://" and
+// "mqtt://" use a plain connection, "ssl://", "tls://" and "mqtts://"
+// enable TLS. By default this is set to "tcp://localhost:1883".
+//
+// Version defines the protocol version to use. Valid values are "3.1.1" and
+// "5". By default this is set to "3.1.1".
+//
+// ClientID defines the client identifier sent to the broker. A fixed id is
+// required for persistent sessions. By default this is set to "", which
+// generates an id from the hostname and the process id.
+//
+// Username defines the user name used for authentication. By default this is
+// set to "", which disables authentication.
+//
+// Password defines the password used for authentication. By default this is
+// set to "".
+//
+// Topics defines a list of topic filters to subscribe to. The wildcards "+"
+// and "#" as well as shared subscriptions ("$share/<group>/<filter>") are
+// supported. By default this is set to ["#"].
+//
+// QoS defines the maximum quality of service level requested for all
+// subscriptions. Valid values are 0, 1 and 2. By default this is set to 1.
+//
+// TopicStreams maps topic filters to streams. Messages with a topic matching
+// a filter are sent to the mapped stream instead of the streams set by
+// Stream. If several filters match, the longest filter is used.
+// By default this map is empty.
+//
+// PersistentSession can be set to true to keep the session on the broker
+// while disconnected, so that messages with QoS 1 and 2 published in the
+// meantime are delivered after reconnecting. Requires ClientID to be set.
+// By default this is set to false.
+//
+// SessionExpirySec defines the number of seconds the broker keeps a
+// persistent session after the connection has been lost. This setting is
+// only used with MQTT 5, MQTT 3.1.1 brokers use their own setting.
+// By default this is set to 86400.
+//
+// KeepAliveSec defines the keep alive interval in seconds. The connection
+// is considered lost if the broker does not answer a ping in time.
+// Set to 0 to disable keep alive. By default this is set to 30.
+//
+// RetryDelayMs defines the number of milliseconds to wait before reconnecting
+// after the connection to the broker has been lost.
+// By default this is set to 3000.
+//
+// TlsEnable defines whether to use TLS to communicate with the broker. This
+// is enabled automatically by the "ssl", "tls" and "mqtts" schemes.
+// By default this is set to false.
+//
+// TlsKeyLocation defines the path to the client's private key (PEM) used
+// for authentication. By default this is set to "".
+//
+// TlsCertificateLocation defines the path to the client's public key (PEM)
+// used for authentication. By default this is set to "".
+//
+// TlsCaLocation defines the path to CA certificate(s) for verifying the
+// broker's key. By default this is set to "", which uses the certificate
+// authorities of the system.
+//
+// TlsServerName is used to verify the hostname on the server's certificate
+// unless TlsInsecureSkipVerify is true. By default this is set to "".
+//
+// TlsInsecureSkipVerify controls whether to verify the server's certificate
+// chain and host name. By default this is set to false.
+type MQTT struct {
+	core.ConsumerBase
+	options      mqttOptions
+	topicStreams map[string][]core.MappedStream
+	retryDelay   time.Duration
+	client       mqttClient
+	stop         chan struct{}
+	stopOnce     *sync.Once
+	sequence     uint64
+}
+
+func init() {
+	shared.TypeRegistry.Register(MQTT{})
+}
+
+// Configure initializes this consumer with values from a plugin config.
+func (cons *MQTT) Configure(conf core.PluginConfig) error {
+	err := cons.ConsumerBase.Configure(conf)
+	if err != nil {
+		return err
+	}
+
+	if cons.options.address, cons.options.useTLS, err = parseMQTTURL(conf.GetString("Address", "tcp://localhost:1883")); err != nil {
+		return err
+	}
+
+	version := conf.GetString("Version", "3.1.1")
+	if version != "3.1.1" && version != "5" && version != "5.0" {
+		return fmt.Errorf("Unsupported MQTT version: %s", version)
+	}
+
+	cons.options.clientID = conf.GetString("ClientID", "")
+	cons.options.username = conf.GetString("Username", "")
+	cons.options.password = conf.GetString("Password", "")
+	cons.options.keepAlive = time.Duration(shared.MaxI(conf.GetInt("KeepAliveSec", 30), 0)) * time.Second
+	cons.options.cleanSession = !conf.GetBool("PersistentSession", false)
+	if !cons.options.cleanSession {
+		if cons.options.clientID == "" {
+			return fmt.Errorf("PersistentSession requires ClientID to be set")
+		}
+		cons.options.sessionExpiry = uint32(shared.MaxI(conf.GetInt("SessionExpirySec", 86400), 1))
+	}
+	if cons.options.clientID == "" {
+		hostname, _ := os.Hostname()
+		cons.options.clientID = fmt.Sprintf("gollum-%s-%d", hostname, os.Getpid())
+	}
+
+	cons.options.topics = conf.GetStringArray("Topics", []string{"#"})
+	if len(cons.options.topics) == 0 {
+		return fmt.Errorf("MQTT requires at least one topic")
+	}
+
+	qos := conf.GetInt("QoS", 1)
+	if qos < 0 || qos > 2 {
+		return fmt.Errorf("QoS must be 0, 1 or 2")
+	}
+	cons.options.qos = byte(qos)
+
+	cons.topicStreams = make(map[string][]core.MappedStream)
+	for filter, streamName := range conf.GetStringMap("TopicStreams", map[string]string{}) {
+		cons.topicStreams[filter] = core.NewMappedStreams([]string{streamName})
+	}
+
+	cons.retryDelay = time.Duration(conf.GetInt("RetryDelayMs", 3000)) * time.Millisecond
+	cons.stop = make(chan struct{})
+	cons.stopOnce = new(sync.Once)
+
+	if conf.GetBool("TlsEnable", false) || cons.options.useTLS {
+		cons.options.useTLS = true
+		cons.options.tlsConfig, err = shared.NewClientTLSConfig(
+			conf.GetString("TlsCertificateLocation", ""),
+			conf.GetString("TlsKeyLocation", ""),
+			conf.GetString("TlsCaLocation", ""),
+			conf.GetString("TlsServerName", ""),
+			conf.GetBool("TlsInsecureSkipVerify", false))
+		if err != nil {
+			return err
+		}
+	}
+
+	if version == "3.1.1" {
+		cons.client = newMQTT3Client(cons.options, cons.receive)
+	} else {
+		cons.client = newMQTT5Client(cons.options, cons.receive)
+	}
+	return nil
+}
+
+// streamsForTopic returns the streams mapped to the longest topic filter
+// matching the given topic or nil if the default streams should be used.
+func (cons *MQTT) streamsForTopic(topic string) []core.MappedStream {
+	var streams []core.MappedStream
+	bestMatch := -1
+	for filter, filterStreams := range cons.topicStreams {
+		if len(filter) > bestMatch && mqttTopicMatches(filter, topic) {
+			streams, bestMatch = filterStreams, len(filter)
+		}
+	}
+	return streams
+}
+
+func (cons *MQTT) sendMessage(mqttMsg mqttMessage) {
+	msg := core.NewMessage(cons, mqttMsg.payload, cons.sequence)
+	cons.sequence++
+
+	msg.SetMetadata(mqttMetadataTopic, mqttMsg.topic)
+	msg.SetMetadata(mqttMetadataQoS, strconv.Itoa(int(mqttMsg.qos)))
+	if mqttMsg.retain {
+		msg.SetMetadata(mqttMetadataRetain, "true")
+	}
+	if mqttMsg.contentType != "" {
+		msg.SetMetadata(mqttMetadataContentType, mqttMsg.contentType)
+	}
+	for name, value := range mqttMsg.properties {
+		msg.SetMetadata(mqttMetadataProperty+name, value)
+	}
+
+	if streams := cons.streamsForTopic(mqttMsg.topic); streams != nil {
+		cons.EnqueueMessageTo(msg, streams)
+	} else {
+		cons.EnqueueMessage(msg)
+	}
+}
+
+// receive is called by the client for each message. The message is
+// acknowledged after this function returns.
+func (cons *MQTT) receive(msg mqttMessage) {
+	cons.WaitOnFuse()
+	cons.sendMessage(msg)
+}
+
+func (cons *MQTT) consume() {
+	defer cons.WorkerDone()
+
+	for cons.IsActive() {
+		lost, err := cons.client.connect()
+		if err == nil {
+			select {
+			case err = <-lost:
+			case <-cons.stop:
+			}
+			cons.client.disconnect()
+		}
+
+		if !cons.IsActive() {
+			return // ### return, stopping ###
+		}
+		Log.Error.Printf("MQTT connection to %s failed: %s", cons.options.address, err)
+
+		select {
+		case <-time.After(cons.retryDelay):
+		case <-cons.stop:
+		}
+	}
+}
+
+func (cons *MQTT) close() {
+	cons.stopOnce.Do(func() {
+		close(cons.stop)
+	})
+}
+
+// Consume subscribes to the configured topics.
+func (cons *MQTT) Consume(workers *sync.WaitGroup) {
+	cons.SetWorkerWaitGroup(workers)
+	cons.SetStopCallback(cons.close)
+
+	cons.AddWorker()
+	go shared.DontPanic(cons.consume)
+
+	cons.ControlLoop()
+}
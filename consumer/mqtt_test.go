@@ -0,0 +1,227 @@
+// Copyright 2015-2016 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumer
+
+import (
+	"fmt"
+	"github.com/eclipse/paho.golang/packets"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/shared"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParseMQTTURL(t *testing.T) {
+	expect := shared.NewExpect(t)
+
+	address, useTLS, err := parseMQTTURL("localhost")
+	expect.NoError(err)
+	expect.Equal("tcp://localhost:1883", address)
+	expect.False(useTLS)
+
+	address, useTLS, err = parseMQTTURL("ssl://broker:1234")
+	expect.NoError(err)
+	expect.Equal("ssl://broker:1234", address)
+	expect.True(useTLS)
+
+	address, useTLS, err = parseMQTTURL("MQTTS://broker")
+	expect.NoError(err)
+	expect.Equal("mqtts://broker:8883", address)
+	expect.True(useTLS)
+
+	_, _, err = parseMQTTURL("http://broker")
+	expect.NotNil(err)
+}
+
+func TestMQTTTopicMatches(t *testing.T) {
+	expect := shared.NewExpect(t)
+
+	expect.True(mqttTopicMatches("sensors/+/temperature", "sensors/kitchen/temperature"))
+	expect.False(mqttTopicMatches("sensors/+/temperature", "sensors/kitchen/humidity"))
+	expect.False(mqttTopicMatches("sensors/+", "sensors/kitchen/temperature"))
+	expect.True(mqttTopicMatches("sensors/#", "sensors/kitchen/temperature"))
+	expect.True(mqttTopicMatches("sensors/#", "sensors"))
+	expect.True(mqttTopicMatches("#", "sensors"))
+	expect.False(mqttTopicMatches("#", "$SYS/uptime"))
+	expect.True(mqttTopicMatches("$SYS/#", "$SYS/uptime"))
+	expect.True(mqttTopicMatches("$share/group/sensors/+", "sensors/kitchen"))
+	expect.False(mqttTopicMatches("sensors", "sensors/kitchen"))
+}
+
+func TestMQTTConfigure(t *testing.T) {
+	expect := shared.NewExpect(t)
+
+	conf := core.NewPluginConfig("")
+	plugin, err := core.NewPluginWithType("consumer.MQTT", conf)
+	expect.NoError(err)
+	cons, casted := plugin.(*MQTT)
+	expect.True(casted)
+
+	_, isMQTT3 := cons.client.(*mqtt3Client)
+	expect.True(isMQTT3)
+	expect.Equal("tcp://localhost:1883", cons.options.address)
+	expect.True(cons.options.cleanSession)
+	expect.Equal(30*time.Second, cons.options.keepAlive)
+
+	conf = core.NewPluginConfig("")
+	conf.Override("Version", "5")
+	conf.Override("Address", "mqtts://broker")
+	plugin, err = core.NewPluginWithType("consumer.MQTT", conf)
+	expect.NoError(err)
+	cons, casted = plugin.(*MQTT)
+	expect.True(casted)
+
+	_, isMQTT5 := cons.client.(*mqtt5Client)
+	expect.True(isMQTT5)
+	expect.True(cons.options.useTLS)
+	expect.NotNil(cons.options.tlsConfig)
+
+	conf = core.NewPluginConfig("")
+	conf.Override("Version", "4")
+	_, err = core.NewPluginWithType("consumer.MQTT", conf)
+	expect.NotNil(err)
+
+	conf = core.NewPluginConfig("")
+	conf.Override("PersistentSession", true)
+	_, err = core.NewPluginWithType("consumer.MQTT", conf)
+	expect.NotNil(err)
+
+	conf = core.NewPluginConfig("")
+	conf.Override("QoS", 3)
+	_, err = core.NewPluginWithType("consumer.MQTT", conf)
+	expect.NotNil(err)
+}
+
+func writeMQTTPublish(conn net.Conn, topic string, qos byte, packetID uint16, payload string) {
+	publish := packets.NewControlPacket(packets.PUBLISH)
+	content := publish.Content.(*packets.Publish)
+	content.Topic = topic
+	content.QoS = qos
+	content.PacketID = packetID
+	content.Payload = []byte(payload)
+	content.Properties.ContentType = "text/plain"
+	content.Properties.User = []packets.User{{Key: "device", Value: "d1"}}
+	publish.WriteTo(conn)
+}
+
+func TestMQTTConsume(t *testing.T) {
+	expect := shared.NewExpect(t)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	expect.NoError(err)
+	defer listener.Close()
+
+	results := make(chan string, 10)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		packet, err := packets.ReadPacket(conn)
+		if err != nil {
+			return
+		}
+		connect := packet.Content.(*packets.Connect)
+		expiry := uint32(0)
+		if connect.Properties.SessionExpiryInterval != nil {
+			expiry = *connect.Properties.SessionExpiryInterval
+		}
+		results <- fmt.Sprintf("connect %s clean=%t expiry=%d", connect.ClientID, connect.CleanStart, expiry)
+		packets.NewControlPacket(packets.CONNACK).WriteTo(conn)
+
+		packet, err = packets.ReadPacket(conn)
+		if err != nil {
+			return
+		}
+		subscribe := packet.Content.(*packets.Subscribe)
+		results <- fmt.Sprintf("subscribe %s qos=%d", subscribe.Subscriptions[0].Topic, subscribe.Subscriptions[0].QoS)
+		suback := packets.NewControlPacket(packets.SUBACK)
+		suback.Content.(*packets.Suback).PacketID = subscribe.PacketID
+		suback.Content.(*packets.Suback).Reasons = []byte{2}
+		suback.WriteTo(conn)
+
+		writeMQTTPublish(conn, "sensors/kitchen/temperature", 1, 7, "21.5")
+		writeMQTTPublish(conn, "devices/d1/state", 2, 8, "on")
+
+		for {
+			packet, err := packets.ReadPacket(conn)
+			if err != nil {
+				return
+			}
+			results <- fmt.Sprintf("%s %d", packet.PacketType(), packet.PacketID())
+			if packet.Type == packets.PUBREC {
+				pubrel := packets.NewControlPacket(packets.PUBREL)
+				pubrel.Content.(*packets.Pubrel).PacketID = packet.PacketID()
+				pubrel.WriteTo(conn)
+			}
+		}
+	}()
+
+	defaultStream := &mockHTTPStream{}
+	core.StreamRegistry.Register(defaultStream, core.GetStreamID("mqttConsume"))
+	deviceStream := &mockHTTPStream{}
+	core.StreamRegistry.Register(deviceStream, core.GetStreamID("mqttDevices"))
+
+	conf := core.NewPluginConfig("")
+	conf.Stream = []string{"mqttConsume"}
+	conf.Override("Address", listener.Addr().String())
+	conf.Override("Version", "5")
+	conf.Override("ClientID", "gollum-test")
+	conf.Override("PersistentSession", true)
+	conf.Override("SessionExpirySec", 600)
+	conf.Override("KeepAliveSec", 0)
+	conf.Override("Topics", []string{"sensors/#"})
+	conf.Override("QoS", 2)
+	conf.Override("TopicStreams", map[string]string{"devices/#": "mqttDevices", "devices/+/state": "mqttDevices"})
+	conf.Override("RetryDelayMs", 10)
+	plugin, err := core.NewPluginWithType("consumer.MQTT", conf)
+	expect.NoError(err)
+	cons, casted := plugin.(*MQTT)
+	expect.True(casted)
+
+	workers := new(sync.WaitGroup)
+	go cons.Consume(workers)
+
+	expect.NonBlocking(2*time.Second, func() {
+		expect.Equal("connect gollum-test clean=false expiry=600", <-results)
+		expect.Equal("subscribe sensors/# qos=2", <-results)
+		expect.Equal("PUBACK 7", <-results)
+		expect.Equal("PUBREC 8", <-results)
+		expect.Equal("PUBCOMP 8", <-results)
+	})
+
+	cons.Control() <- core.PluginControlStopConsumer
+	expect.NonBlocking(2*time.Second, workers.Wait)
+	expect.NonBlocking(time.Second, func() {
+		expect.Equal("DISCONNECT 0", <-results)
+	})
+
+	expect.Equal(1, defaultStream.count())
+	expect.Equal(core.MessageMetadata{
+		"mqtt_topic":           "sensors/kitchen/temperature",
+		"mqtt_qos":             "1",
+		"mqtt_content_type":    "text/plain",
+		"mqtt_property.device": "d1",
+	}, defaultStream.messages[0].Metadata)
+	expect.Equal("21.5", string(defaultStream.messages[0].Data))
+
+	expect.Equal(1, deviceStream.count())
+	expect.Equal("on", string(deviceStream.messages[0].Data))
+	expect.Equal("2", deviceStream.messages[0].Metadata["mqtt_qos"])
+}
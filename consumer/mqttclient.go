@@ -0,0 +1,337 @@
+// Copyright 2015-2016 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumer
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"github.com/eclipse/paho.golang/packets"
+	"github.com/eclipse/paho.golang/paho"
+	"github.com/eclipse/paho.golang/paho/session/state"
+	"github.com/eclipse/paho.mqtt.golang"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// mqttTimeout is the time allowed to connect and subscribe
+const mqttTimeout = 10 * time.Second
+
+// mqttMessage is a message received by one of the client libraries.
+type mqttMessage struct {
+	topic       string
+	payload     []byte
+	qos         byte
+	retain      bool
+	contentType string
+	properties  map[string]string
+}
+
+// mqttOptions holds the settings shared by all protocol versions.
+type mqttOptions struct {
+	address       string
+	useTLS        bool
+	tlsConfig     *tls.Config
+	clientID      string
+	username      string
+	password      string
+	keepAlive     time.Duration
+	cleanSession  bool
+	sessionExpiry uint32
+	topics        []string
+	qos           byte
+}
+
+// mqttClient is a connection to a broker using one of the supported protocol
+// versions. Received messages are passed to a handler and acknowledged once
+// the handler returns. Clients are not safe for concurrent use.
+type mqttClient interface {
+	// connect connects to the broker and subscribes to all topics. The
+	// returned channel receives the reason once the connection is lost.
+	connect() (<-chan error, error)
+
+	// disconnect closes the connection.
+	disconnect()
+}
+
+// mqtt3Client uses github.com/eclipse/paho.mqtt.golang for MQTT 3.1.1. The
+// same client is reused for all connections to keep the session state.
+type mqtt3Client struct {
+	client  mqtt.Client
+	topics  map[string]byte
+	handler func(mqttMessage)
+	lost    chan error
+}
+
+// mqtt5Client uses github.com/eclipse/paho.golang for MQTT 5.
+type mqtt5Client struct {
+	options mqttOptions
+	session *state.State
+	handler func(mqttMessage)
+	client  *paho.Client
+}
+
+// parseMQTTURL returns the address of the broker including scheme and port
+// and whether the scheme requires TLS.
+func parseMQTTURL(address string) (string, bool, error) {
+	if !strings.Contains(address, "://") {
+		address = "tcp://" + address
+	}
+	parsed, err := url.Parse(address)
+	if err != nil {
+		return "", false, err // ### return, invalid URL ###
+	}
+
+	port, useTLS := "1883", false
+	switch strings.ToLower(parsed.Scheme) {
+	case "tcp", "mqtt":
+	case "ssl", "tls", "mqtts":
+		port, useTLS = "8883", true
+	default:
+		return "", false, fmt.Errorf("Unsupported MQTT scheme: %s", parsed.Scheme)
+	}
+
+	host := parsed.Host
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		host = net.JoinHostPort(strings.Trim(host, "[]"), port)
+	}
+	return strings.ToLower(parsed.Scheme) + "://" + host, useTLS, nil
+}
+
+// mqttTopicMatches returns true if topic matches the given topic filter.
+// Shared subscriptions ("$share/<group>/<filter>") are matched by filter.
+func mqttTopicMatches(filter, topic string) bool {
+	if strings.HasPrefix(filter, "$share/") {
+		if parts := strings.SplitN(filter, "/", 3); len(parts) == 3 {
+			filter = parts[2]
+		}
+	}
+
+	filterLevels := strings.Split(filter, "/")
+	topicLevels := strings.Split(topic, "/")
+	if strings.HasPrefix(topic, "$") && (filterLevels[0] == "+" || filterLevels[0] == "#") {
+		return false // ### return, wildcards do not match system topics ###
+	}
+
+	for i, level := range filterLevels {
+		switch {
+		case level == "#":
+			return true // ### return, matches all remaining levels ###
+		case i >= len(topicLevels):
+			return false // ### return, topic is shorter ###
+		case level != "+" && level != topicLevels[i]:
+			return false // ### return, level mismatch ###
+		}
+	}
+	return len(filterLevels) == len(topicLevels)
+}
+
+// notifyMQTTLost passes the reason of a lost connection to the given channel
+// unless a reason has already been passed.
+func notifyMQTTLost(lost chan error, err error) {
+	select {
+	case lost <- err:
+	default:
+	}
+}
+
+func newMQTT3Client(options mqttOptions, handler func(mqttMessage)) *mqtt3Client {
+	client := &mqtt3Client{
+		topics:  make(map[string]byte),
+		handler: handler,
+		lost:    make(chan error, 1),
+	}
+	for _, topic := range options.topics {
+		client.topics[topic] = options.qos
+	}
+
+	address := options.address
+	if options.useTLS {
+		address = "ssl://" + address[strings.Index(address, "://")+3:]
+	}
+
+	clientOptions := mqtt.NewClientOptions().
+		AddBroker(address).
+		SetClientID(options.clientID).
+		SetUsername(options.username).
+		SetPassword(options.password).
+		SetKeepAlive(options.keepAlive).
+		SetCleanSession(options.cleanSession).
+		SetConnectTimeout(mqttTimeout).
+		SetAutoReconnect(false).
+		SetOrderMatters(true).
+		SetAutoAckDisabled(true).
+		SetConnectionLostHandler(func(_ mqtt.Client, err error) {
+			notifyMQTTLost(client.lost, err)
+		})
+	if options.tlsConfig != nil {
+		clientOptions.SetTLSConfig(options.tlsConfig)
+	}
+	client.client = mqtt.NewClient(clientOptions)
+	return client
+}
+
+func (client *mqtt3Client) receive(_ mqtt.Client, msg mqtt.Message) {
+	client.handler(mqttMessage{
+		topic:   msg.Topic(),
+		payload: msg.Payload(),
+		qos:     msg.Qos(),
+		retain:  msg.Retained(),
+	})
+	msg.Ack()
+}
+
+func (client *mqtt3Client) connect() (<-chan error, error) {
+	// Drop the reason a previous connection has been lost for
+	select {
+	case <-client.lost:
+	default:
+	}
+
+	if token := client.client.Connect(); !token.WaitTimeout(mqttTimeout) {
+		client.client.Disconnect(0)
+		return nil, fmt.Errorf("Connect timed out")
+	} else if token.Error() != nil {
+		return nil, token.Error()
+	}
+
+	token := client.client.SubscribeMultiple(client.topics, client.receive)
+	if !token.WaitTimeout(mqttTimeout) {
+		client.client.Disconnect(0)
+		return nil, fmt.Errorf("Subscribe timed out")
+	}
+	if err := token.Error(); err != nil {
+		client.client.Disconnect(0)
+		return nil, err
+	}
+	return client.lost, nil
+}
+
+func (client *mqtt3Client) disconnect() {
+	client.client.Disconnect(250)
+}
+
+func newMQTT5Client(options mqttOptions, handler func(mqttMessage)) *mqtt5Client {
+	client := &mqtt5Client{
+		options: options,
+		handler: handler,
+	}
+	if !options.cleanSession {
+		client.session = state.NewInMemory()
+	}
+	return client
+}
+
+func (client *mqtt5Client) dial() (net.Conn, error) {
+	address := client.options.address[strings.Index(client.options.address, "://")+3:]
+	dialer := &net.Dialer{Timeout: mqttTimeout}
+	if client.options.useTLS {
+		tlsConfig := client.options.tlsConfig
+		if tlsConfig == nil {
+			tlsConfig = &tls.Config{}
+		}
+		return tls.DialWithDialer(dialer, "tcp", address, tlsConfig)
+	}
+	return dialer.Dial("tcp", address)
+}
+
+func (client *mqtt5Client) receive(received paho.PublishReceived) (bool, error) {
+	publish := received.Packet
+	msg := mqttMessage{
+		topic:   publish.Topic,
+		payload: publish.Payload,
+		qos:     publish.QoS,
+		retain:  publish.Retain,
+	}
+	if publish.Properties != nil {
+		msg.contentType = publish.Properties.ContentType
+		if len(publish.Properties.User) > 0 {
+			msg.properties = make(map[string]string)
+			for _, property := range publish.Properties.User {
+				msg.properties[property.Key] = property.Value
+			}
+		}
+	}
+
+	client.handler(msg)
+	return true, received.Client.Ack(publish)
+}
+
+func (client *mqtt5Client) connect() (<-chan error, error) {
+	conn, err := client.dial()
+	if err != nil {
+		return nil, err
+	}
+
+	lost := make(chan error, 1)
+	config := paho.ClientConfig{
+		ClientID:                   client.options.clientID,
+		Conn:                       packets.NewThreadSafeConn(conn),
+		OnPublishReceived:          []func(paho.PublishReceived) (bool, error){client.receive},
+		EnableManualAcknowledgment: true,
+		OnClientError:              func(err error) { notifyMQTTLost(lost, err) },
+		OnServerDisconnect: func(disconnect *paho.Disconnect) {
+			notifyMQTTLost(lost, fmt.Errorf("Disconnected by broker (reason %d)", disconnect.ReasonCode))
+		},
+	}
+	if client.session != nil {
+		config.Session = client.session
+	}
+	pahoClient := paho.NewClient(config)
+
+	connect := &paho.Connect{
+		ClientID:     client.options.clientID,
+		KeepAlive:    uint16(client.options.keepAlive / time.Second),
+		CleanStart:   client.options.cleanSession,
+		Username:     client.options.username,
+		UsernameFlag: client.options.username != "",
+		Password:     []byte(client.options.password),
+		PasswordFlag: client.options.password != "",
+	}
+	if !client.options.cleanSession {
+		connect.Properties = &paho.ConnectProperties{SessionExpiryInterval: &client.options.sessionExpiry}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), mqttTimeout)
+	defer cancel()
+	if connack, err := pahoClient.Connect(ctx, connect); err != nil {
+		if connack != nil && connack.Properties != nil && connack.Properties.ReasonString != "" {
+			err = fmt.Errorf("%s: %s", err, connack.Properties.ReasonString)
+		}
+		conn.Close()
+		return nil, err
+	}
+
+	subscribe := &paho.Subscribe{}
+	for _, topic := range client.options.topics {
+		subscribe.Subscriptions = append(subscribe.Subscriptions, paho.SubscribeOptions{Topic: topic, QoS: client.options.qos})
+	}
+	if _, err := pahoClient.Subscribe(ctx, subscribe); err != nil {
+		pahoClient.Disconnect(&paho.Disconnect{ReasonCode: 0})
+		return nil, err
+	}
+
+	client.client = pahoClient
+	return lost, nil
+}
+
+func (client *mqtt5Client) disconnect() {
+	if client.client != nil {
+		client.client.Disconnect(&paho.Disconnect{ReasonCode: 0})
+		client.client = nil
+	}
+}
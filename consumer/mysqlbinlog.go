@@ -0,0 +1,819 @@
+// Copyright 2015-2016 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumer
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"github.com/go-mysql-org/go-mysql/client"
+	"github.com/go-mysql-org/go-mysql/mysql"
+	"github.com/go-mysql-org/go-mysql/replication"
+	"github.com/shopspring/decimal"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/core/log"
+	"github.com/trivago/gollum/shared"
+	"hash/crc32"
+	"log/slog"
+	"net"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	mysqlMetadataGTID     = "mysql_gtid"
+	mysqlMetadataPosition = "mysql_binlog_position"
+	mysqlMetadataTable    = "mysql_table"
+	mysqlStateGTIDSet     = "gtid_set"
+	mysqlStatePosition    = "binlog_position"
+	mysqlStoreInterval    = time.Second
+	mysqlDialTimeout      = 30 * time.Second
+)
+
+// MySQLBinlog consumer plugin
+// The MySQLBinlog consumer connects to a MySQL server (version 5.6 or newer)
+// as a replica and streams row changes from the binary log. The server has
+// to use binlog_format=ROW. The binlog stream is read and decoded by the
+// replication package of github.com/go-mysql-org/go-mysql.
+// Each inserted, updated or deleted row is emitted as one JSON object with
+// the fields "gtid", "binlog_file", "binlog_pos", "timestamp", "schema",
+// "table", "op", "old" and "new". The operation "op" is one of "insert",
+// "update" or "delete". The old and new values of the row are stored as
+// objects mapping column names to values. Decimals are written as JSON
+// numbers without loss of precision, temporal types as strings and JSON
+// columns as nested JSON.
+// Column names are taken from the binlog if the server writes them
+// (binlog_row_metadata=FULL, MySQL 8.0.1 or newer). Otherwise they are read
+// from the information schema, which reflects the current table definition
+// and may not match changes written before an ALTER TABLE.
+// The position of a transaction is stored after all of its changes have been
+// passed to the configured streams, so changes that were not delivered when
+// gollum stops are sent again after a restart.
+// The GTID and binlog position of the change and the qualified name of the
+// table are attached to each message as "mysql_gtid",
+// "mysql_binlog_position" and "mysql_table" metadata.
+// When attached to a fuse, this consumer will stop reading changes in case
+// that fuse is burned.
+// Configuration example
+//
+//  - "consumer.MySQLBinlog":
+//    Address: "localhost:3306"
+//    User: "root"
+//    Password: ""
+//    ServerID: 0
+//    UseGTID: true
+//    StartGTIDSet: ""
+//    StartFile: ""
+//    StartPosition: 4
+//    DefaultOffset: "newest"
+//    StateFile: ""
+//    IncludeTables:
+//      - "shop.*"
+//    ExcludeTables:
+//      - "shop.sessions"
+//    HeartbeatSec: 30
+//    RetryDelayMs: 3000
+//    TlsEnable: false
+//    TlsKeyLocation: ""
+//    TlsCertificateLocation: ""
+//    TlsCaLocation: ""
+//    TlsServerName: ""
+//    TlsInsecureSkipVerify: false
+//
+// Address defines the host and port of the server.
+// By default this is set to "localhost:3306".
+//
+// User defines the user to connect as. The user requires the REPLICATION
+// SLAVE and REPLICATION CLIENT privileges as well as SELECT on the
+// information schema. By default this is set to "root".
+//
+// Password defines the password of User. The authentication plugins
+// mysql_native_password, caching_sha2_password and sha256_password are
+// supported.
+// By default this is set to "".
+//
+// ServerID defines the server id this consumer uses as a replica. The id has
+// to be unique among all replicas of the server. By default this is set to 0,
+// which derives an id from the host name and process id.
+//
+// UseGTID can be set to false to track the position by binlog file name and
+// position instead of global transaction identifiers. This is required if
+// gtid_mode is not enabled on the server. By default this is set to true.
+//
+// StartGTIDSet defines the set of transactions to skip when starting without
+// a stored position, e.g. "3E11FA47-71CA-11E1-9E33-C80AA9429562:1-5".
+// By default this is set to "", which uses DefaultOffset.
+//
+// StartFile and StartPosition define the binlog position to start from when
+// starting without a stored position and UseGTID is set to false.
+// By default StartFile is set to "", which uses DefaultOffset.
+//
+// DefaultOffset defines where to start if no position is known. This can be
+// "newest" to only read new changes or "oldest" to read all binlogs still
+// stored on the server. By default this is set to "newest".
+//
+// StateFile defines the path to a file storing the position of the last
+// transaction delivered. The file is updated at most once a second and when
+// the connection is closed. If no file is given, the position is only kept
+// in memory. By default this is set to "".
+//
+// IncludeTables defines a list of tables to stream changes of in the form
+// "schema.table". Shell patterns like "shop.*" are supported. By default
+// this is empty, which includes all tables.
+//
+// ExcludeTables defines a list of tables to ignore, using the same format as
+// IncludeTables. Exclusions take precedence. By default this is empty.
+//
+// HeartbeatSec defines the number of seconds after which the server sends a
+// heartbeat if there are no new events. The connection is considered lost if
+// nothing was received for three times this interval. Set to 0 to disable
+// heartbeats. By default this is set to 30.
+//
+// RetryDelayMs defines the number of milliseconds to wait before reconnecting
+// after the connection to the server has been lost.
+// By default this is set to 3000.
+//
+// TlsEnable defines whether to use TLS to communicate with the server.
+// By default this is set to false.
+//
+// TlsKeyLocation defines the path to the client's private key (PEM) used
+// for authentication. By default this is set to "".
+//
+// TlsCertificateLocation defines the path to the client's public key (PEM)
+// used for authentication. By default this is set to "".
+//
+// TlsCaLocation defines the path to CA certificate(s) for verifying the
+// server's key. By default this is set to "", which uses the certificate
+// authorities of the system.
+//
+// TlsServerName is used to verify the hostname on the server's certificate
+// unless TlsInsecureSkipVerify is true. By default this is set to "", which
+// uses the host of Address.
+//
+// TlsInsecureSkipVerify controls whether to verify the server's certificate
+// chain and host name. By default this is set to false.
+type MySQLBinlog struct {
+	core.ConsumerBase
+	address       string
+	user          string
+	password      string
+	serverID      uint32
+	useGTID       bool
+	defaultOffset string
+	include       []string
+	exclude       []string
+	heartbeat     time.Duration
+	retryDelay    time.Duration
+	tlsConfig     *tls.Config
+	state         *fileCheckpointStore
+	hasPosition   bool
+	gtidSet       mysql.GTIDSet
+	file          string
+	position      uint32
+	gtid          string
+	dirty         bool
+	lastStore     time.Time
+	columns       map[string]*mysqlColumns
+	syncer        *replication.BinlogSyncer
+	schemaConn    *client.Conn
+	guard         *sync.Mutex
+	sequence      uint64
+}
+
+// mysqlChange is a single row change emitted by the MySQLBinlog consumer.
+type mysqlChange struct {
+	GTID      string                 `json:"gtid,omitempty"`
+	File      string                 `json:"binlog_file"`
+	Position  uint32                 `json:"binlog_pos"`
+	Timestamp string                 `json:"timestamp"`
+	Schema    string                 `json:"schema"`
+	Table     string                 `json:"table"`
+	Op        string                 `json:"op"`
+	Old       map[string]interface{} `json:"old"`
+	New       map[string]interface{} `json:"new"`
+}
+
+// mysqlColumns holds the column names and signedness of a table as read
+// from the information schema.
+type mysqlColumns struct {
+	names    []string
+	unsigned map[int]bool
+}
+
+// mysqlNumber is a decimal number encoded without conversion to float.
+type mysqlNumber string
+
+// MarshalJSON writes the number as is.
+func (number mysqlNumber) MarshalJSON() ([]byte, error) {
+	return []byte(number), nil
+}
+
+func init() {
+	shared.TypeRegistry.Register(MySQLBinlog{})
+}
+
+// Configure initializes this consumer with values from a plugin config.
+func (cons *MySQLBinlog) Configure(conf core.PluginConfig) error {
+	err := cons.ConsumerBase.Configure(conf)
+	if err != nil {
+		return err
+	}
+
+	cons.address = conf.GetString("Address", "localhost:3306")
+	cons.user = conf.GetString("User", "root")
+	cons.password = conf.GetString("Password", "")
+	cons.useGTID = conf.GetBool("UseGTID", true)
+	cons.heartbeat = time.Duration(shared.MaxI(conf.GetInt("HeartbeatSec", 30), 0)) * time.Second
+	cons.retryDelay = time.Duration(conf.GetInt("RetryDelayMs", 3000)) * time.Millisecond
+	cons.guard = new(sync.Mutex)
+	cons.columns = make(map[string]*mysqlColumns)
+
+	cons.serverID = uint32(conf.GetInt("ServerID", 0))
+	if cons.serverID == 0 {
+		hostname, _ := os.Hostname()
+		cons.serverID = crc32.ChecksumIEEE([]byte(fmt.Sprintf("%s:%d", hostname, os.Getpid()))) | 1
+	}
+
+	cons.defaultOffset = strings.ToLower(conf.GetString("DefaultOffset", "newest"))
+	switch cons.defaultOffset {
+	case "newest", "oldest":
+	default:
+		return fmt.Errorf("Unknown DefaultOffset: %s", cons.defaultOffset)
+	}
+
+	cons.include = conf.GetStringArray("IncludeTables", []string{})
+	cons.exclude = conf.GetStringArray("ExcludeTables", []string{})
+	for _, pattern := range append(cons.include, cons.exclude...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("Invalid table pattern %s: %s", pattern, err)
+		}
+	}
+
+	if cons.state, err = newFileCheckpointStore(conf.GetString("StateFile", "")); err != nil {
+		return err
+	}
+	state, _ := cons.state.checkpoints()
+	startGTIDSet, startFile := conf.GetString("StartGTIDSet", ""), conf.GetString("StartFile", "")
+	startPosition := uint32(conf.GetInt("StartPosition", 4))
+
+	switch {
+	case cons.useGTID && state[mysqlStateGTIDSet] != "":
+		startGTIDSet = state[mysqlStateGTIDSet]
+	case !cons.useGTID && state[mysqlStatePosition] != "":
+		separator := strings.LastIndex(state[mysqlStatePosition], ":")
+		position, err := strconv.ParseUint(state[mysqlStatePosition][separator+1:], 10, 32)
+		if separator < 0 || err != nil {
+			return fmt.Errorf("Invalid binlog position in state file: %s", state[mysqlStatePosition])
+		}
+		startFile, startPosition = state[mysqlStatePosition][:separator], uint32(position)
+	}
+
+	if cons.useGTID && startGTIDSet != "" {
+		if cons.gtidSet, err = mysql.ParseMysqlGTIDSet(startGTIDSet); err != nil {
+			return fmt.Errorf("Invalid GTID set %s: %s", startGTIDSet, err)
+		}
+		cons.hasPosition = true
+	}
+	if !cons.useGTID && startFile != "" {
+		cons.file, cons.position = startFile, startPosition
+		cons.hasPosition = true
+	}
+
+	if conf.GetBool("TlsEnable", false) {
+		cons.tlsConfig, err = shared.NewClientTLSConfig(
+			conf.GetString("TlsCertificateLocation", ""),
+			conf.GetString("TlsKeyLocation", ""),
+			conf.GetString("TlsCaLocation", ""),
+			conf.GetString("TlsServerName", ""),
+			conf.GetBool("TlsInsecureSkipVerify", false))
+		if err != nil {
+			return err
+		}
+		if host, _, err := net.SplitHostPort(cons.address); err == nil && cons.tlsConfig.ServerName == "" && !cons.tlsConfig.InsecureSkipVerify {
+			cons.tlsConfig.ServerName = host
+		}
+	}
+
+	return nil
+}
+
+// isIncluded returns true if changes of the given table should be emitted.
+func (cons *MySQLBinlog) isIncluded(schema, table string) bool {
+	name := schema + "." + table
+	for _, pattern := range cons.exclude {
+		if match, _ := path.Match(pattern, name); match {
+			return false // ### return, excluded ###
+		}
+	}
+	if len(cons.include) == 0 {
+		return true // ### return, no include list ###
+	}
+	for _, pattern := range cons.include {
+		if match, _ := path.Match(pattern, name); match {
+			return true // ### return, included ###
+		}
+	}
+	return false
+}
+
+// schemaClient returns the connection used for queries, opening it if
+// required.
+func (cons *MySQLBinlog) schemaClient() (*client.Conn, error) {
+	cons.guard.Lock()
+	defer cons.guard.Unlock()
+	if cons.schemaConn != nil {
+		return cons.schemaConn, nil // ### return, already connected ###
+	}
+
+	dialer := &net.Dialer{Timeout: mysqlDialTimeout}
+	conn, err := client.ConnectWithDialer(context.Background(), "tcp", cons.address, cons.user, cons.password, "", dialer.DialContext,
+		func(conn *client.Conn) error {
+			conn.SetTLSConfig(cons.tlsConfig)
+			return nil
+		})
+	if err != nil {
+		return nil, err
+	}
+	cons.schemaConn = conn
+	return conn, nil
+}
+
+// mysqlQuery runs a query and returns the rows of the result. NULL values
+// are returned as empty strings.
+func mysqlQuery(conn *client.Conn, query string) ([][]string, error) {
+	result, err := conn.Execute(query)
+	if err != nil {
+		return nil, err
+	}
+	defer result.Close()
+
+	rows := [][]string{}
+	if result.Resultset == nil {
+		return rows, nil // ### return, no result set ###
+	}
+	for row := range result.Values {
+		values := make([]string, len(result.Values[row]))
+		for column := range values {
+			values[column], _ = result.GetString(row, column)
+		}
+		rows = append(rows, values)
+	}
+	return rows, nil
+}
+
+// quoteMySQLLiteral quotes a string to be used as a literal.
+func quoteMySQLLiteral(value string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, "'", "''").Replace(value) + "'"
+}
+
+// initPosition queries the position to start from if no position is known.
+func (cons *MySQLBinlog) initPosition() error {
+	if cons.defaultOffset == "oldest" {
+		cons.gtidSet, _ = mysql.ParseMysqlGTIDSet("")
+		cons.file, cons.position = "", 4
+		cons.hasPosition = true
+		return nil // ### return, start from the first binlog ###
+	}
+
+	conn, err := cons.schemaClient()
+	if err != nil {
+		return err
+	}
+
+	if cons.useGTID {
+		rows, err := mysqlQuery(conn, "SELECT @@GLOBAL.gtid_executed")
+		if err != nil {
+			return err
+		}
+		if len(rows) != 1 {
+			return fmt.Errorf("Failed to query executed GTIDs")
+		}
+		if cons.gtidSet, err = mysql.ParseMysqlGTIDSet(rows[0][0]); err != nil {
+			return err
+		}
+	} else {
+		rows, err := mysqlQuery(conn, "SHOW MASTER STATUS")
+		if err != nil {
+			// Renamed in MySQL 8.4
+			if rows, err = mysqlQuery(conn, "SHOW BINARY LOG STATUS"); err != nil {
+				return err
+			}
+		}
+		if len(rows) != 1 || len(rows[0]) < 2 {
+			return fmt.Errorf("Binary logging is not enabled on %s", cons.address)
+		}
+		position, err := strconv.ParseUint(rows[0][1], 10, 32)
+		if err != nil {
+			return err
+		}
+		cons.file, cons.position = rows[0][0], uint32(position)
+	}
+
+	cons.hasPosition = true
+	return nil
+}
+
+func (cons *MySQLBinlog) connect() (*replication.BinlogStreamer, error) {
+	if !cons.hasPosition {
+		if err := cons.initPosition(); err != nil {
+			return nil, err // ### return, no start position ###
+		}
+	}
+
+	dialer := &net.Dialer{Timeout: mysqlDialTimeout}
+	syncer := replication.NewBinlogSyncer(replication.BinlogSyncerConfig{
+		ServerID:                cons.serverID,
+		Flavor:                  mysql.MySQLFlavor,
+		Host:                    cons.address, // Port 0 uses Host as address
+		User:                    cons.user,
+		Password:                cons.password,
+		TLSConfig:               cons.tlsConfig,
+		HeartbeatPeriod:         cons.heartbeat,
+		ReadTimeout:             3 * cons.heartbeat,
+		UseDecimal:              true,
+		TimestampStringLocation: time.UTC,
+		VerifyChecksum:          true,
+		DisableRetrySync:        true,
+		Logger:                  slog.New(slog.NewTextHandler(Log.Debug.Writer(), nil)),
+		Dialer:                  dialer.DialContext,
+	})
+
+	// The guard makes sure that close() does not miss a new connection
+	cons.guard.Lock()
+	if !cons.IsActive() {
+		cons.guard.Unlock()
+		syncer.Close()
+		return nil, fmt.Errorf("MySQLBinlog consumer is stopping")
+	}
+	cons.syncer = syncer
+	cons.guard.Unlock()
+
+	if cons.useGTID {
+		return syncer.StartSyncGTID(cons.gtidSet.Clone())
+	}
+	return syncer.StartSync(mysql.Position{Name: cons.file, Pos: cons.position})
+}
+
+// columnNames returns the column names and signedness of a table. If the
+// binlog does not contain them they are read from the information schema.
+func (cons *MySQLBinlog) columnNames(table *replication.TableMapEvent) ([]string, map[int]bool, error) {
+	names, unsigned := table.ColumnNameString(), table.UnsignedMap()
+	hasSignedness := len(table.SignednessBitmap) > 0
+	if !hasSignedness {
+		hasSignedness = true
+		for column := range table.ColumnType {
+			if table.IsNumericColumn(column) {
+				hasSignedness = false
+				break
+			}
+		}
+	}
+	if len(names) == int(table.ColumnCount) && hasSignedness {
+		return names, unsigned, nil // ### return, full metadata ###
+	}
+
+	name := string(table.Schema) + "." + string(table.Table)
+	columns, isCached := cons.columns[name]
+	if !isCached {
+		conn, err := cons.schemaClient()
+		if err != nil {
+			return nil, nil, err
+		}
+
+		rows, err := mysqlQuery(conn, fmt.Sprintf(
+			"SELECT COLUMN_NAME, COLUMN_TYPE FROM information_schema.COLUMNS WHERE TABLE_SCHEMA = %s AND TABLE_NAME = %s ORDER BY ORDINAL_POSITION",
+			quoteMySQLLiteral(string(table.Schema)), quoteMySQLLiteral(string(table.Table))))
+		if err != nil {
+			return nil, nil, fmt.Errorf("Failed to query columns of %s: %s", name, err)
+		}
+
+		columns = &mysqlColumns{unsigned: make(map[int]bool)}
+		for column, row := range rows {
+			columns.names = append(columns.names, row[0])
+			columns.unsigned[column] = strings.Contains(strings.ToLower(row[1]), "unsigned")
+		}
+		if len(rows) != int(table.ColumnCount) {
+			Log.Warning.Printf("MySQLBinlog found %d columns for %s in the information schema, binlog contains %d", len(rows), name, table.ColumnCount)
+		}
+		cons.columns[name] = columns
+	}
+
+	if len(names) != int(table.ColumnCount) {
+		names = columns.names
+	}
+	if !hasSignedness {
+		unsigned = columns.unsigned
+	}
+	return names, unsigned, nil
+}
+
+// mysqlValue converts a value decoded by the replication package to the
+// value written to JSON.
+func mysqlValue(table *replication.TableMapEvent, column int, isUnsigned bool, value interface{}) interface{} {
+	switch value := value.(type) {
+	case int8:
+		if isUnsigned {
+			return uint64(uint8(value))
+		}
+		return int64(value)
+
+	case int16:
+		if isUnsigned {
+			return uint64(uint16(value))
+		}
+		return int64(value)
+
+	case int32:
+		switch {
+		case isUnsigned && table.ColumnType[column] == mysql.MYSQL_TYPE_INT24:
+			return uint64(uint32(value) & 0xffffff)
+		case isUnsigned:
+			return uint64(uint32(value))
+		}
+		return int64(value)
+
+	case int64:
+		switch {
+		case table.IsEnumColumn(column):
+			names := table.EnumStrValueMap()[column]
+			if value > 0 && int(value) <= len(names) {
+				return names[value-1]
+			}
+		case table.IsSetColumn(column):
+			names, isKnown := table.SetStrValueMap()[column]
+			if !isKnown {
+				return value
+			}
+			selected := []string{}
+			for bit, name := range names {
+				if value&(1<<uint(bit)) != 0 {
+					selected = append(selected, name)
+				}
+			}
+			return strings.Join(selected, ",")
+		case isUnsigned:
+			return uint64(value)
+		}
+		return value
+
+	case float32:
+		return float64(value)
+
+	case decimal.Decimal:
+		return mysqlNumber(value.String())
+
+	case []byte:
+		if table.ColumnType[column] == mysql.MYSQL_TYPE_JSON {
+			return nil // empty JSON documents are read as null
+		}
+		return string(value)
+
+	case string:
+		if table.ColumnType[column] == mysql.MYSQL_TYPE_JSON {
+			return json.RawMessage(value)
+		}
+	}
+	return value
+}
+
+// mysqlRow maps the values of a row to the column names of a table.
+func mysqlRow(table *replication.TableMapEvent, names []string, unsigned map[int]bool, skipped []int, values []interface{}) map[string]interface{} {
+	isSkipped := make(map[int]bool, len(skipped))
+	for _, column := range skipped {
+		isSkipped[column] = true
+	}
+
+	row := make(map[string]interface{}, len(values))
+	for column, value := range values {
+		if isSkipped[column] {
+			continue // not part of the row image
+		}
+		name := fmt.Sprintf("column%d", column)
+		if column < len(names) {
+			name = names[column]
+		}
+		row[name] = mysqlValue(table, column, unsigned[column], value)
+	}
+	return row
+}
+
+func (cons *MySQLBinlog) enqueue(change mysqlChange) {
+	data, err := json.Marshal(change)
+	if err != nil {
+		Log.Error.Printf("MySQLBinlog failed to encode change at %s:%d: %s", change.File, change.Position, err)
+		return
+	}
+
+	msg := core.NewMessage(cons, data, atomic.AddUint64(&cons.sequence, 1))
+	if change.GTID != "" {
+		msg.SetMetadata(mysqlMetadataGTID, change.GTID)
+	}
+	msg.SetMetadata(mysqlMetadataPosition, fmt.Sprintf("%s:%d", change.File, change.Position))
+	msg.SetMetadata(mysqlMetadataTable, change.Schema+"."+change.Table)
+	cons.EnqueueMessage(msg)
+}
+
+// commit marks the current transaction as delivered.
+func (cons *MySQLBinlog) commit(header *replication.EventHeader) error {
+	if cons.gtid != "" {
+		if err := cons.gtidSet.Update(cons.gtid); err != nil {
+			return err
+		}
+		cons.gtid = ""
+	}
+	if header.LogPos > 0 {
+		cons.position = header.LogPos
+	}
+	cons.dirty = true
+	cons.storePosition(false)
+	return nil
+}
+
+// storePosition writes the position to the state file. Unless force is set
+// the file is written at most once per mysqlStoreInterval.
+func (cons *MySQLBinlog) storePosition(force bool) {
+	if !cons.dirty || !force && time.Since(cons.lastStore) < mysqlStoreInterval {
+		return // ### return, nothing to store ###
+	}
+
+	var err error
+	if cons.useGTID {
+		err = cons.state.store(mysqlStateGTIDSet, cons.gtidSet.String())
+	} else {
+		err = cons.state.store(mysqlStatePosition, fmt.Sprintf("%s:%d", cons.file, cons.position))
+	}
+	if err != nil {
+		Log.Error.Print("MySQLBinlog failed to store position: ", err)
+		return
+	}
+	cons.dirty = false
+	cons.lastStore = time.Now()
+}
+
+func (cons *MySQLBinlog) handleRows(header *replication.EventHeader, event *replication.RowsEvent) error {
+	schema, table := string(event.Table.Schema), string(event.Table.Table)
+	if !cons.isIncluded(schema, table) {
+		return nil // ### return, filtered ###
+	}
+	names, unsigned, err := cons.columnNames(event.Table)
+	if err != nil {
+		return err
+	}
+
+	var op string
+	switch event.Type() {
+	case replication.EnumRowsEventTypeInsert:
+		op = "insert"
+	case replication.EnumRowsEventTypeUpdate:
+		op = "update"
+	case replication.EnumRowsEventTypeDelete:
+		op = "delete"
+	default:
+		return fmt.Errorf("Unknown rows event type %s at %s:%d", header.EventType, cons.file, header.LogPos)
+	}
+
+	// Updates contain the row before and after the change for each row
+	for row := 0; row < len(event.Rows); row++ {
+		change := mysqlChange{
+			GTID:      cons.gtid,
+			File:      cons.file,
+			Position:  header.LogPos,
+			Timestamp: time.Unix(int64(header.Timestamp), 0).UTC().Format(time.RFC3339),
+			Schema:    schema,
+			Table:     table,
+			Op:        op,
+		}
+		values := mysqlRow(event.Table, names, unsigned, event.SkippedColumns[row], event.Rows[row])
+		switch op {
+		case "insert":
+			change.New = values
+		case "delete":
+			change.Old = values
+		default:
+			if row++; row >= len(event.Rows) {
+				return fmt.Errorf("Update at %s:%d is missing the row after the change", cons.file, header.LogPos)
+			}
+			change.Old = values
+			change.New = mysqlRow(event.Table, names, unsigned, event.SkippedColumns[row], event.Rows[row])
+		}
+
+		cons.WaitOnFuse()
+		cons.enqueue(change)
+	}
+	return nil
+}
+
+func (cons *MySQLBinlog) handleEvent(event *replication.BinlogEvent) error {
+	switch data := event.Event.(type) {
+	case *replication.RotateEvent:
+		cons.file, cons.position = string(data.NextLogName), uint32(data.Position)
+
+	case *replication.GTIDEvent:
+		next, err := data.GTIDNext()
+		if err != nil {
+			return err
+		}
+		cons.gtid = next.String()
+
+	case *replication.QueryEvent:
+		query := strings.TrimSpace(string(data.Query))
+		if strings.EqualFold(query, "BEGIN") {
+			return nil // ### return, transaction start ###
+		}
+		if !strings.EqualFold(query, "COMMIT") {
+			// Schema changes may invalidate cached column names
+			cons.columns = make(map[string]*mysqlColumns)
+		}
+		return cons.commit(event.Header)
+
+	case *replication.RowsEvent:
+		if event.Header.EventType == replication.PARTIAL_UPDATE_ROWS_EVENT {
+			return fmt.Errorf("Partial JSON updates are not supported, binlog_row_value_options has to be empty")
+		}
+		return cons.handleRows(event.Header, data)
+
+	case *replication.XIDEvent:
+		return cons.commit(event.Header)
+
+	default:
+		// Heartbeats and events without row changes
+		cons.storePosition(false)
+	}
+	return nil
+}
+
+func (cons *MySQLBinlog) readEvents(streamer *replication.BinlogStreamer) error {
+	for cons.IsActive() {
+		event, err := streamer.GetEvent(context.Background())
+		if err != nil {
+			return err // ### return, connection lost ###
+		}
+		if err := cons.handleEvent(event); err != nil {
+			return fmt.Errorf("Failed to handle binlog event at %s:%d: %s", cons.file, event.Header.LogPos, err)
+		}
+	}
+	return nil
+}
+
+func (cons *MySQLBinlog) closeConnections() {
+	cons.guard.Lock()
+	defer cons.guard.Unlock()
+	if cons.syncer != nil {
+		cons.syncer.Close()
+	}
+	if cons.schemaConn != nil {
+		cons.schemaConn.Close()
+		cons.schemaConn = nil
+	}
+}
+
+func (cons *MySQLBinlog) consume() {
+	defer cons.WorkerDone()
+
+	for cons.IsActive() {
+		streamer, err := cons.connect()
+		if err == nil {
+			err = cons.readEvents(streamer)
+		}
+		cons.closeConnections()
+
+		// Changes of an incomplete transaction are sent again
+		cons.gtid = ""
+		cons.storePosition(true)
+
+		if !cons.IsActive() {
+			return // ### return, stopping ###
+		}
+		Log.Error.Printf("MySQLBinlog connection to %s failed: %s", cons.address, err)
+		time.Sleep(cons.retryDelay)
+	}
+}
+
+// Consume starts streaming changes from the binlog.
+func (cons *MySQLBinlog) Consume(workers *sync.WaitGroup) {
+	cons.SetWorkerWaitGroup(workers)
+	cons.SetStopCallback(cons.closeConnections)
+
+	cons.AddWorker()
+	go shared.DontPanic(cons.consume)
+
+	cons.ControlLoop()
+}
@@ -0,0 +1,334 @@
+// Copyright 2015-2016 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumer
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/json"
+	"github.com/go-mysql-org/go-mysql/mysql"
+	"github.com/go-mysql-org/go-mysql/packet"
+	"github.com/go-mysql-org/go-mysql/replication"
+	"github.com/shopspring/decimal"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/shared"
+	"hash/crc32"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const mysqlTestUUID = "3e11fa47-71ca-11e1-9e33-c80aa9429562"
+
+// Events written by MySQL 5.7.22 with binlog_checksum=CRC32, taken from the
+// tests of github.com/go-mysql-org/go-mysql. The table map describes db.tbl
+// with a single INT column, the rows event inserts the value 1 at 0xcf.
+var (
+	mysqlTestFormatDescription = []byte{0x64, 0x61, 0x72, 0x63, 0xf, 0xb, 0x0, 0x0, 0x0, 0x77, 0x0, 0x0, 0x0, 0x7b, 0x0, 0x0, 0x0, 0x1, 0x0, 0x4, 0x0, 0x35, 0x2e, 0x37, 0x2e, 0x32, 0x32, 0x2d, 0x6c, 0x6f, 0x67, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x64, 0x61, 0x72, 0x63, 0x13, 0x38, 0xd, 0x0, 0x8, 0x0, 0x12, 0x0, 0x4, 0x4, 0x4, 0x4, 0x12, 0x0, 0x0, 0x5f, 0x0, 0x4, 0x1a, 0x8, 0x0, 0x0, 0x0, 0x8, 0x8, 0x8, 0x2, 0x0, 0x0, 0x0, 0xa, 0xa, 0xa, 0x2a, 0x2a, 0x0, 0x12, 0x34, 0x0, 0x1, 0xb8, 0x78, 0x9d, 0xfe}
+	mysqlTestTableMap          = []byte{0x8d, 0x61, 0x72, 0x63, 0x13, 0xb, 0x0, 0x0, 0x0, 0x2c, 0x0, 0x0, 0x0, 0xa7, 0x0, 0x0, 0x0, 0x1, 0x0, 0x6c, 0x0, 0x0, 0x0, 0x0, 0x0, 0x1, 0x0, 0x2, 0x64, 0x62, 0x0, 0x3, 0x74, 0x62, 0x6c, 0x0, 0x1, 0x3, 0x0, 0x0, 0x63, 0x17, 0xe6, 0xf0}
+	mysqlTestWriteRows         = []byte{0xb6, 0x61, 0x72, 0x63, 0x1e, 0xb, 0x0, 0x0, 0x0, 0x28, 0x0, 0x0, 0x0, 0xcf, 0x0, 0x0, 0x0, 0x1, 0x0, 0x6c, 0x0, 0x0, 0x0, 0x0, 0x0, 0x1, 0x0, 0x2, 0x0, 0x1, 0xff, 0x0, 0x1, 0x0, 0x0, 0x0, 0xf9, 0xf7, 0x89, 0x2a}
+	mysqlTestOtherTableMap     = []byte{0x22, 0x6c, 0x72, 0x63, 0x13, 0xb, 0x0, 0x0, 0x0, 0x2e, 0x0, 0x0, 0x0, 0xfd, 0x0, 0x0, 0x0, 0x1, 0x0, 0x76, 0x0, 0x0, 0x0, 0x0, 0x0, 0x1, 0x0, 0x3, 0x64, 0x62, 0x31, 0x0, 0x4, 0x74, 0x62, 0x6c, 0x31, 0x0, 0x1, 0x1, 0x0, 0x0, 0x32, 0xec, 0x2f, 0x4}
+)
+
+// mysqlTestEvent encodes a binlog event. A CRC32 checksum is appended if
+// checksum is set.
+func mysqlTestEvent(eventType replication.EventType, logPos uint32, body []byte, checksum bool) []byte {
+	size := replication.EventHeaderSize + len(body)
+	if checksum {
+		size += replication.BinlogChecksumLength
+	}
+	event := make([]byte, replication.EventHeaderSize, size)
+	binary.LittleEndian.PutUint32(event, 1451606400)
+	event[4] = byte(eventType)
+	binary.LittleEndian.PutUint32(event[5:], 1)
+	binary.LittleEndian.PutUint32(event[9:], uint32(size))
+	binary.LittleEndian.PutUint32(event[13:], logPos)
+	event = append(event, body...)
+	if checksum {
+		event = binary.LittleEndian.AppendUint32(event, crc32.ChecksumIEEE(event))
+	}
+	return event
+}
+
+// mysqlTestWrite sends a packet, leaving room for the header.
+func mysqlTestWrite(conn *packet.Conn, body []byte) {
+	conn.WritePacket(append(make([]byte, 4), body...))
+}
+
+// mysqlTestOK sends an OK packet.
+func mysqlTestOK(conn *packet.Conn) {
+	mysqlTestWrite(conn, []byte{mysql.OK_HEADER, 0, 0, 2, 0, 0, 0})
+}
+
+// mysqlTestResult sends a text result set with string columns.
+func mysqlTestResult(conn *packet.Conn, rows ...[]string) {
+	numColumns := 1
+	if len(rows) > 0 {
+		numColumns = len(rows[0])
+	}
+	mysqlTestWrite(conn, []byte{byte(numColumns)})
+	for i := 0; i < numColumns; i++ {
+		field := mysql.Field{Name: []byte("value"), Type: mysql.MYSQL_TYPE_VAR_STRING}
+		mysqlTestWrite(conn, field.Dump())
+	}
+	mysqlTestWrite(conn, []byte{mysql.EOF_HEADER, 0, 0, 0, 0})
+	for _, row := range rows {
+		data := []byte{}
+		for _, value := range row {
+			data = append(data, mysql.PutLengthEncodedString([]byte(value))...)
+		}
+		mysqlTestWrite(conn, data)
+	}
+	mysqlTestWrite(conn, []byte{mysql.EOF_HEADER, 0, 0, 0, 0})
+}
+
+// fakeMySQL accepts connections authenticated with mysql_native_password,
+// answers the queries of the MySQLBinlog consumer and streams the given
+// events after receiving COM_BINLOG_DUMP_GTID. The requested GTID sets are
+// sent to dumps.
+func fakeMySQL(expect shared.Expect, events [][]byte, dumps chan<- string) net.Listener {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	expect.NoError(err)
+
+	serve := func(conn net.Conn) {
+		defer conn.Close()
+		server := packet.NewConn(conn)
+
+		nonce := []byte("abcdefghijklmnopqrst")
+		capabilities := uint32(mysql.CLIENT_PROTOCOL_41 | mysql.CLIENT_SECURE_CONNECTION | mysql.CLIENT_PLUGIN_AUTH)
+		greeting := append([]byte{10}, "5.7.22-log\x00"...)
+		greeting = binary.LittleEndian.AppendUint32(greeting, 1)
+		greeting = append(greeting, nonce[:8]...)
+		greeting = append(greeting, 0)
+		greeting = binary.LittleEndian.AppendUint16(greeting, uint16(capabilities))
+		greeting = append(greeting, mysql.DEFAULT_COLLATION_ID)
+		greeting = binary.LittleEndian.AppendUint16(greeting, 2)
+		greeting = binary.LittleEndian.AppendUint16(greeting, uint16(capabilities>>16))
+		greeting = append(greeting, 21)
+		greeting = append(greeting, make([]byte, 10)...)
+		greeting = append(greeting, nonce[8:]...)
+		greeting = append(greeting, 0)
+		greeting = append(greeting, mysql.AUTH_NATIVE_PASSWORD+"\x00"...)
+		mysqlTestWrite(server, greeting)
+
+		handshake, err := server.ReadPacket()
+		if err != nil || len(handshake) < 32 {
+			return
+		}
+		end := bytes.IndexByte(handshake[32:], 0)
+		if end < 0 {
+			return
+		}
+		user := string(handshake[32 : 32+end])
+		scramble, _, _, _ := mysql.LengthEncodedString(handshake[32+end+1:])
+		scramble = append([]byte{}, scramble...)
+
+		// SHA1(scramble XOR SHA1(nonce + stage2)) has to match stage2
+		stage1 := sha1.Sum([]byte("secret"))
+		stage2 := sha1.Sum(stage1[:])
+		hash := sha1.Sum(append(append([]byte{}, nonce...), stage2[:]...))
+		for i := range scramble {
+			scramble[i] ^= hash[i%sha1.Size]
+		}
+		if user != "gollum" || len(scramble) != sha1.Size || sha1.Sum(scramble) != stage2 {
+			mysqlTestWrite(server, append([]byte{mysql.ERR_HEADER, 0x15, 0x04, '#', '2', '8', '0', '0', '0'}, "Access denied"...))
+			return
+		}
+		mysqlTestOK(server)
+
+		for {
+			server.ResetSequence()
+			command, err := server.ReadPacket()
+			if err != nil || len(command) == 0 {
+				return
+			}
+
+			query := string(command[1:])
+			switch {
+			case command[0] == mysql.COM_REGISTER_SLAVE:
+				mysqlTestOK(server)
+
+			case command[0] == mysql.COM_BINLOG_DUMP_GTID:
+				// flags, server id, empty file name, position, size
+				set, err := mysql.DecodeMysqlGTIDSet(command[1+2+4+4+8+4:])
+				if err != nil {
+					return
+				}
+				dumps <- set.String()
+				for _, event := range events {
+					mysqlTestWrite(server, append([]byte{mysql.OK_HEADER}, event...))
+				}
+
+			case query == "SHOW GLOBAL VARIABLES LIKE 'BINLOG_CHECKSUM'":
+				mysqlTestResult(server, []string{"binlog_checksum", "CRC32"})
+
+			case query == "SELECT @@GLOBAL.gtid_executed":
+				mysqlTestResult(server, []string{mysqlTestUUID + ":1-10"})
+
+			case strings.HasPrefix(query, "SELECT COLUMN_NAME") && strings.Contains(query, "'tbl'"):
+				mysqlTestResult(server, []string{"id", "int(11) unsigned"})
+
+			case strings.HasPrefix(query, "SET "), strings.HasPrefix(query, "KILL "):
+				mysqlTestOK(server)
+
+			default:
+				mysqlTestWrite(server, append([]byte{mysql.ERR_HEADER, 0x28, 0x04, '#', '4', '2', '0', '0', '0'}, "Unknown query"...))
+			}
+		}
+	}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serve(conn)
+		}
+	}()
+	return listener
+}
+
+func TestMySQLValues(t *testing.T) {
+	expect := shared.NewExpect(t)
+
+	table := &replication.TableMapEvent{
+		ColumnCount: 7,
+		ColumnType: []byte{mysql.MYSQL_TYPE_INT24, mysql.MYSQL_TYPE_TINY, mysql.MYSQL_TYPE_STRING, mysql.MYSQL_TYPE_STRING,
+			mysql.MYSQL_TYPE_NEWDECIMAL, mysql.MYSQL_TYPE_JSON, mysql.MYSQL_TYPE_BLOB},
+		ColumnMeta:   []uint16{0, 0, uint16(mysql.MYSQL_TYPE_ENUM)<<8 | 1, uint16(mysql.MYSQL_TYPE_SET)<<8 | 1, 10<<8 | 2, 4, 2},
+		EnumStrValue: [][][]byte{{[]byte("small"), []byte("large")}},
+		SetStrValue:  [][][]byte{{[]byte("a"), []byte("b"), []byte("c")}},
+	}
+	names := []string{"id", "delta", "size", "flags", "price", "doc", "data"}
+	unsigned := map[int]bool{0: true, 1: false, 4: false}
+
+	row := mysqlRow(table, names, unsigned, []int{6}, []interface{}{
+		int32(-1),
+		int8(-1),
+		int64(2),
+		int64(5),
+		decimal.RequireFromString("-12.34"),
+		`{"a":[1,true]}`,
+		[]byte("skipped"),
+	})
+	expect.Equal(map[string]interface{}{
+		"id":    uint64(0xffffff),
+		"delta": int64(-1),
+		"size":  "large",
+		"flags": "a,c",
+		"price": mysqlNumber("-12.34"),
+		"doc":   json.RawMessage(`{"a":[1,true]}`),
+	}, row)
+
+	data, err := json.Marshal(row)
+	expect.NoError(err)
+	expect.Equal(`{"delta":-1,"doc":{"a":[1,true]},"flags":"a,c","id":16777215,"price":-12.34,"size":"large"}`, string(data))
+
+	// Without metadata enum and set values are written as numbers and empty
+	// JSON documents as null
+	table = &replication.TableMapEvent{
+		ColumnCount: table.ColumnCount,
+		ColumnType:  table.ColumnType,
+		ColumnMeta:  table.ColumnMeta,
+	}
+	expect.Equal(int64(2), mysqlValue(table, 2, false, int64(2)))
+	expect.Equal(int64(5), mysqlValue(table, 3, false, int64(5)))
+	expect.Nil(mysqlValue(table, 5, false, []byte{}))
+	expect.Equal("blob", mysqlValue(table, 6, false, []byte("blob")))
+	expect.Equal(map[string]interface{}{"column0": uint64(0xffffff)}, mysqlRow(table, nil, unsigned, nil, []interface{}{int32(-1)}))
+}
+
+func TestMySQLBinlog(t *testing.T) {
+	expect := shared.NewExpect(t)
+
+	dir, err := ioutil.TempDir("", "gollum_mysql")
+	expect.NoError(err)
+	defer os.RemoveAll(dir)
+	stateFile := filepath.Join(dir, "state.json")
+
+	rotate := binary.LittleEndian.AppendUint64(nil, 4)
+	gtid := append([]byte{1}, 0x3e, 0x11, 0xfa, 0x47, 0x71, 0xca, 0x11, 0xe1, 0x9e, 0x33, 0xc8, 0x0a, 0xa9, 0x42, 0x95, 0x62)
+	gtid = binary.LittleEndian.AppendUint64(gtid, 11)
+	xid := binary.LittleEndian.AppendUint64(nil, 1234)
+
+	dumps := make(chan string, 10)
+	listener := fakeMySQL(expect, [][]byte{
+		mysqlTestEvent(replication.ROTATE_EVENT, 0, append(rotate, "binlog.000003"...), false),
+		mysqlTestFormatDescription,
+		mysqlTestEvent(replication.GTID_EVENT, 0x7b, gtid, true),
+		mysqlTestTableMap,
+		mysqlTestOtherTableMap,
+		mysqlTestWriteRows,
+		mysqlTestEvent(replication.XID_EVENT, 0x120, xid, true),
+	}, dumps)
+	defer listener.Close()
+
+	stream := &mockHTTPStream{}
+	core.StreamRegistry.Register(stream, core.GetStreamID("mysql"))
+	conf := core.NewPluginConfig("")
+	conf.Stream = []string{"mysql"}
+	conf.Override("Address", listener.Addr().String())
+	conf.Override("User", "gollum")
+	conf.Override("Password", "secret")
+	conf.Override("StateFile", stateFile)
+	conf.Override("IncludeTables", []string{"db*.*"})
+	conf.Override("ExcludeTables", []string{"db1.tbl1"})
+	plugin, err := core.NewPluginWithType("consumer.MySQLBinlog", conf)
+	expect.NoError(err)
+	cons, casted := plugin.(*MySQLBinlog)
+	expect.True(casted)
+
+	workers := new(sync.WaitGroup)
+	go cons.Consume(workers)
+
+	expect.NonBlocking(5*time.Second, func() {
+		expect.Equal(mysqlTestUUID+":1-10", <-dumps)
+	})
+	expect.NonBlocking(5*time.Second, func() {
+		for {
+			if state, err := ioutil.ReadFile(stateFile); err == nil && strings.Contains(string(state), ":1-11") {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	})
+
+	cons.Control() <- core.PluginControlStopConsumer
+	expect.NonBlocking(5*time.Second, workers.Wait)
+
+	expect.Equal(1, stream.count())
+	msg := stream.messages[0]
+	expect.Equal(mysqlTestUUID+":11", msg.Metadata[mysqlMetadataGTID])
+	expect.Equal("binlog.000003:207", msg.Metadata[mysqlMetadataPosition])
+	expect.Equal("db.tbl", msg.Metadata[mysqlMetadataTable])
+
+	change := map[string]interface{}{}
+	expect.NoError(json.Unmarshal(msg.Data, &change))
+	expect.Equal("insert", change["op"])
+	expect.Equal("2022-11-14T15:41:42Z", change["timestamp"])
+	expect.Equal(map[string]interface{}{"id": float64(1)}, change["new"])
+	expect.Nil(change["old"])
+
+	state, err := ioutil.ReadFile(stateFile)
+	expect.NoError(err)
+	expect.Equal(`{"gtid_set":"`+mysqlTestUUID+`:1-11"}`, string(state))
+}
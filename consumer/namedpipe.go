@@ -0,0 +1,315 @@
+// Copyright 2015-2016 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumer
+
+import (
+	"context"
+	"fmt"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/core/log"
+	"github.com/trivago/gollum/shared"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const namedPipeBufferGrowSize = 1024
+
+// NamedPipe consumer plugin
+// The NamedPipe consumer reads messages from a named pipe (FIFO). Other
+// processes can write to the pipe like to a file, e.g. by using
+// "command > /var/run/gollum.pipe". The pipe is created if it does not exist.
+// Writers may open and close the pipe as often as they like, the consumer
+// keeps reading until it is stopped. Data written by different writers at
+// the same time may interleave, just like with all pipes. Data not
+// terminated by a delimiter when a writer closes the pipe is joined with the
+// data written next.
+// Messages are separated from the stream by using a specific partitioner
+// method. When attached to a fuse, this consumer will stop reading from the
+// pipe in case that fuse is burned. Writers block once the pipe's buffer is
+// full.
+// The path of the pipe is attached to each message as "file_name" metadata.
+// This consumer is only supported on Linux, macOS and BSD systems.
+// Configuration example
+//
+//  - "consumer.NamedPipe":
+//    Path: "/var/run/gollum.pipe"
+//    Create: true
+//    Permissions: "0620"
+//    Owner: ""
+//    Group: ""
+//    Partitioner: "delimiter"
+//    Delimiter: "\n"
+//    Pattern: ""
+//    Offset: 0
+//    Size: 1
+//    ReconnectAfterSec: 2
+//
+// Path defines the path of the named pipe to read from.
+// By default this is set to "/var/run/gollum.pipe".
+//
+// Create can be set to false to expect the pipe to be created by someone
+// else. The consumer waits for the pipe to appear in that case.
+// By default this is set to true.
+//
+// Permissions sets the file permissions of a pipe created by this consumer
+// as a four digit octal number string. Permissions of existing pipes are not
+// changed. By default this is set to "0620".
+//
+// Owner sets the user owning a pipe created by this consumer. Users can be
+// given by name or numeric id. By default this is set to "" which keeps the
+// user running gollum.
+//
+// Group sets the group owning a pipe created by this consumer. Groups can be
+// given by name or numeric id. By default this is set to "" which keeps the
+// primary group of the user running gollum.
+//
+// Partitioner defines the algorithm used to read messages from the pipe.
+// By default this is set to "delimiter".
+//  * "delimiter" separates messages by looking for a delimiter string.
+//    The delimiter is removed from the message.
+//  * "ascii" reads an ASCII number at a given offset until a given delimiter is found.
+//    Everything to the right of and including the delimiter is removed from the message.
+//  * "binary" reads a binary number at a given offset and size.
+//  * "binary_le" is an alias for "binary".
+//  * "binary_be" is the same as "binary" but uses big endian encoding.
+//  * "varint" reads an unsigned varint (as used by protocol buffers) at a given
+//    offset.
+//    The offset and the varint are removed from the message.
+//  * "fixed" assumes fixed size messages.
+//  * "regex" starts a new message whenever the regular expression given by
+//    Pattern matches. A message is complete once the start of the next message
+//    has been received or the writer closes the pipe.
+//
+// Delimiter defines the delimiter used by the text and delimiter partitioner.
+// By default this is set to "\n".
+//
+// Pattern defines the regular expression used by the regex partitioner to
+// find the start of a message. The expression is matched in multi-line mode,
+// i.e. "^" matches the start of any line, and must not match across lines.
+// This setting is mandatory for the regex partitioner.
+//
+// Offset defines the offset used by the binary, varint and text partitioner.
+// By default this is set to 0. This setting is ignored by the fixed partitioner.
+//
+// Size defines the size in bytes used by the binary or fixed partitioner.
+// For binary this can be set to 1,2,4 or 8. By default 4 is chosen.
+// For fixed this defines the size of a message. By default 1 is chosen.
+//
+// ReconnectAfterSec defines the number of seconds to wait before the pipe is
+// tried to be reopened after an error. By default this is set to 2.
+type NamedPipe struct {
+	core.ConsumerBase
+	path           string
+	create         bool
+	permissions    os.FileMode
+	owner          string
+	group          string
+	delimiter      string
+	flags          shared.BufferedReaderFlags
+	offset         int
+	reconnectDelay time.Duration
+	pipe           *os.File
+	guard          *sync.Mutex
+	ctx            context.Context
+	cancel         context.CancelFunc
+}
+
+func init() {
+	shared.TypeRegistry.Register(NamedPipe{})
+}
+
+// Configure initializes this consumer with values from a plugin config.
+func (cons *NamedPipe) Configure(conf core.PluginConfig) error {
+	err := cons.ConsumerBase.Configure(conf)
+	if err != nil {
+		return err
+	}
+
+	cons.path = conf.GetString("Path", "/var/run/gollum.pipe")
+	cons.create = conf.GetBool("Create", true)
+	permissions, err := strconv.ParseUint(conf.GetString("Permissions", "0620"), 8, 32)
+	if err != nil {
+		return fmt.Errorf("Invalid Permissions: %s", err)
+	}
+	cons.permissions = os.FileMode(permissions)
+	cons.owner = conf.GetString("Owner", "")
+	cons.group = conf.GetString("Group", "")
+	cons.reconnectDelay = time.Duration(conf.GetInt("ReconnectAfterSec", 2)) * time.Second
+	cons.guard = new(sync.Mutex)
+	cons.ctx, cons.cancel = context.WithCancel(context.Background())
+
+	cons.delimiter = shared.Unescape(conf.GetString("Delimiter", "\n"))
+	cons.offset = conf.GetInt("Offset", 0)
+	cons.flags = 0
+
+	partitioner := strings.ToLower(conf.GetString("Partitioner", "delimiter"))
+	switch partitioner {
+	case "binary_be":
+		cons.flags |= shared.BufferedReaderFlagBigEndian
+		fallthrough
+
+	case "binary", "binary_le":
+		cons.flags |= shared.BufferedReaderFlagEverything
+		switch conf.GetInt("Size", 4) {
+		case 1:
+			cons.flags |= shared.BufferedReaderFlagMLE8
+		case 2:
+			cons.flags |= shared.BufferedReaderFlagMLE16
+		case 4:
+			cons.flags |= shared.BufferedReaderFlagMLE32
+		case 8:
+			cons.flags |= shared.BufferedReaderFlagMLE64
+		default:
+			return fmt.Errorf("Size only supports the value 1,2,4 and 8")
+		}
+
+	case "varint":
+		cons.flags |= shared.BufferedReaderFlagMLEVarint
+
+	case "fixed":
+		cons.flags |= shared.BufferedReaderFlagMLEFixed
+		cons.offset = conf.GetInt("Size", 1)
+
+	case "ascii":
+		cons.flags |= shared.BufferedReaderFlagMLE
+
+	case "regex":
+		cons.flags |= shared.BufferedReaderFlagRegex
+		if cons.delimiter, err = compileStartPattern(conf); err != nil {
+			return err
+		}
+
+	case "delimiter":
+		// Nothing to add
+
+	default:
+		return fmt.Errorf("Unknown partitioner: %s", partitioner)
+	}
+
+	return nil
+}
+
+func (cons *NamedPipe) sleep(duration time.Duration) {
+	select {
+	case <-cons.ctx.Done():
+	case <-time.After(duration):
+	}
+}
+
+func (cons *NamedPipe) enqueue(data []byte, sequence uint64) {
+	msg := core.NewMessage(cons, data, sequence)
+	msg.SetMetadata(core.MetadataFileName, cons.path)
+	cons.EnqueueMessage(msg)
+}
+
+// connect opens the pipe, creating it if necessary. The pipe is kept so that
+// it can be closed when the consumer is stopped.
+func (cons *NamedPipe) connect() (*os.File, error) {
+	pipe, created, err := openNamedPipe(cons.path, cons.create)
+	if err != nil {
+		return nil, err // ### return, could not open pipe ###
+	}
+	if created {
+		if err := shared.SetUnixSocketPermissions(cons.path, cons.permissions, cons.owner, cons.group); err != nil {
+			pipe.Close()
+			return nil, err // ### return, could not set permissions ###
+		}
+	}
+
+	cons.guard.Lock()
+	defer cons.guard.Unlock()
+	if !cons.IsActive() {
+		pipe.Close()
+		return nil, io.EOF // ### return, consumer stopped ###
+	}
+	cons.pipe = pipe
+	return pipe, nil
+}
+
+func (cons *NamedPipe) disconnect() {
+	cons.guard.Lock()
+	defer cons.guard.Unlock()
+	if cons.pipe != nil {
+		cons.pipe.Close()
+		cons.pipe = nil
+	}
+}
+
+func (cons *NamedPipe) readPipe(pipe *os.File) {
+	buffer := shared.NewBufferedReader(namedPipeBufferGrowSize, cons.flags, cons.offset, cons.delimiter)
+	defer buffer.Flush(cons.enqueue)
+
+	for cons.IsActive() {
+		cons.WaitOnFuse()
+		err := buffer.ReadAll(pipe, cons.enqueue)
+		switch {
+		case err == nil:
+			continue // ### continue, all is well ###
+
+		case !cons.IsActive():
+			return // ### return, consumer stopped ###
+
+		case err == shared.BufferDataInvalid:
+			Log.Error.Print("NamedPipe failed to parse data from ", cons.path, ": ", err)
+			continue // ### continue, parser errors do not close the pipe ###
+
+		default:
+			Log.Error.Print("NamedPipe read from ", cons.path, " failed: ", err)
+			return // ### return, reopen pipe ###
+		}
+	}
+}
+
+func (cons *NamedPipe) read() {
+	defer cons.WorkerDone()
+
+	for cons.IsActive() {
+		pipe, err := cons.connect()
+		if err != nil {
+			if cons.IsActive() {
+				Log.Error.Print("NamedPipe failed to open ", cons.path, ": ", err)
+				cons.sleep(cons.reconnectDelay)
+			}
+			continue // ### continue, retry ###
+		}
+
+		cons.readPipe(pipe)
+		cons.disconnect()
+
+		if cons.IsActive() {
+			cons.sleep(cons.reconnectDelay)
+		}
+	}
+}
+
+func (cons *NamedPipe) close() {
+	cons.cancel()
+	cons.disconnect()
+}
+
+// Consume starts reading from the named pipe.
+func (cons *NamedPipe) Consume(workers *sync.WaitGroup) {
+	cons.SetWorkerWaitGroup(workers)
+	cons.SetStopCallback(cons.close)
+
+	cons.AddWorker()
+	go shared.DontPanic(cons.read)
+
+	cons.ControlLoop()
+}
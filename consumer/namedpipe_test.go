@@ -0,0 +1,146 @@
+// Copyright 2015-2016 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+// +build darwin dragonfly freebsd linux netbsd openbsd
+
+package consumer
+
+import (
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/shared"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func writeTestNamedPipe(expect shared.Expect, path string, data string) {
+	expect.NonBlocking(2*time.Second, func() {
+		writer, err := os.OpenFile(path, os.O_WRONLY, 0)
+		expect.NoError(err)
+		_, err = writer.WriteString(data)
+		expect.NoError(err)
+		expect.NoError(writer.Close())
+	})
+}
+
+func TestNamedPipe(t *testing.T) {
+	expect := shared.NewExpect(t)
+
+	dir, err := ioutil.TempDir("", "gollum_namedpipe")
+	expect.NoError(err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "gollum.pipe")
+
+	stream := &mockHTTPStream{}
+	core.StreamRegistry.Register(stream, core.GetStreamID("namedPipe"))
+	conf := core.NewPluginConfig("")
+	conf.Stream = []string{"namedPipe"}
+	conf.Override("Path", path)
+	conf.Override("Permissions", "0640")
+	plugin, err := core.NewPluginWithType("consumer.NamedPipe", conf)
+	expect.NoError(err)
+	cons, casted := plugin.(*NamedPipe)
+	expect.True(casted)
+
+	workers := new(sync.WaitGroup)
+	go cons.Consume(workers)
+
+	expect.NonBlocking(2*time.Second, func() {
+		for isOpen := false; !isOpen; time.Sleep(10 * time.Millisecond) {
+			cons.guard.Lock()
+			isOpen = cons.pipe != nil
+			cons.guard.Unlock()
+		}
+	})
+	stat, err := os.Stat(path)
+	expect.NoError(err)
+	expect.Equal(os.ModeNamedPipe|0640, stat.Mode())
+
+	// Writers closing the pipe do not interrupt reading
+	writeTestNamedPipe(expect, path, "first\nsecond\n")
+	writeTestNamedPipe(expect, path, "third\npar")
+	writeTestNamedPipe(expect, path, "tial\n")
+
+	waitForTestMessages(expect, stream, 4)
+	messages := []string{}
+	stream.guard.Lock()
+	for _, msg := range stream.messages {
+		messages = append(messages, string(msg.Data))
+		expect.Equal(path, msg.Metadata[core.MetadataFileName])
+	}
+	stream.guard.Unlock()
+	expect.Equal([]string{"first", "second", "third", "partial"}, messages)
+
+	cons.Control() <- core.PluginControlStopConsumer
+	expect.NonBlocking(2*time.Second, workers.Wait)
+
+	// Existing pipes are reused
+	pipe, created, err := openNamedPipe(path, true)
+	expect.NoError(err)
+	expect.False(created)
+	pipe.Close()
+}
+
+func TestNamedPipeOpen(t *testing.T) {
+	expect := shared.NewExpect(t)
+
+	dir, err := ioutil.TempDir("", "gollum_namedpipe")
+	expect.NoError(err)
+	defer os.RemoveAll(dir)
+
+	_, _, err = openNamedPipe(filepath.Join(dir, "missing.pipe"), false)
+	expect.True(os.IsNotExist(err))
+
+	fileName := filepath.Join(dir, "file")
+	expect.NoError(ioutil.WriteFile(fileName, []byte{}, 0600))
+	_, _, err = openNamedPipe(fileName, true)
+	expect.NotNil(err)
+
+	pipe, created, err := openNamedPipe(filepath.Join(dir, "new.pipe"), true)
+	expect.NoError(err)
+	expect.True(created)
+	pipe.Close()
+}
+
+func TestNamedPipeConfigure(t *testing.T) {
+	expect := shared.NewExpect(t)
+
+	conf := core.NewPluginConfig("")
+	plugin, err := core.NewPluginWithType("consumer.NamedPipe", conf)
+	expect.NoError(err)
+	cons, casted := plugin.(*NamedPipe)
+	expect.True(casted)
+
+	expect.Equal("/var/run/gollum.pipe", cons.path)
+	expect.True(cons.create)
+	expect.Equal(os.FileMode(0620), cons.permissions)
+
+	for _, options := range []map[string]interface{}{
+		{"Permissions": "rw-r--r--"},
+		{"Partitioner": "unknown"},
+		{"Partitioner": "regex"},
+		{"Partitioner": "binary", "Size": 3},
+	} {
+		conf := core.NewPluginConfig("")
+		for key, value := range options {
+			conf.Override(key, value)
+		}
+		_, err := core.NewPluginWithType("consumer.NamedPipe", conf)
+		expect.NotNil(err)
+	}
+}
@@ -0,0 +1,50 @@
+// Copyright 2015-2016 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+// +build darwin dragonfly freebsd linux netbsd openbsd
+
+package consumer
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// openNamedPipe opens a named pipe, creating it first if create is set. The
+// second value returned is true if the pipe has been created. The pipe is
+// opened for reading and writing, so reads block while no writer is
+// connected instead of returning EOF each time the last writer closes it.
+func openNamedPipe(path string, create bool) (*os.File, bool, error) {
+	created := false
+	if create {
+		err := syscall.Mkfifo(path, 0600)
+		if err != nil && err != syscall.EEXIST {
+			return nil, false, &os.PathError{Op: "mkfifo", Path: path, Err: err}
+		}
+		created = err == nil
+	}
+
+	stat, err := os.Stat(path)
+	if err != nil {
+		return nil, false, err
+	}
+	if stat.Mode()&os.ModeNamedPipe == 0 {
+		return nil, false, fmt.Errorf("%s is not a named pipe", path)
+	}
+
+	pipe, err := os.OpenFile(path, os.O_RDWR, 0)
+	return pipe, created, err
+}
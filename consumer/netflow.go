@@ -0,0 +1,174 @@
+// Copyright 2015-2016 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumer
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/core/log"
+	"github.com/trivago/gollum/shared"
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+// Netflow consumer plugin
+// The Netflow consumer receives NetFlow v5, NetFlow v9, IPFIX and sFlow v5
+// datagrams via UDP and converts each flow record to a JSON message. The
+// format of a datagram is detected automatically, so all protocols can be sent
+// to the same port.
+// Templates of NetFlow v9 and IPFIX are cached per exporter and observation
+// domain. Data records that refer to a template that has not been received yet
+// are discarded. Records of options templates are not converted to messages.
+// Only flow samples of sFlow datagrams are converted, counter samples are
+// ignored. Raw packet headers of sFlow samples are decoded to extract MAC and
+// IP addresses, VLAN, protocol and ports.
+// Each record contains the fields "flow_type" ("netflow_v5", "netflow_v9",
+// "ipfix" or "sflow_v5") and "exporter" (the address of the sender or the
+// sFlow agent). Known fields use names like "src_addr", "dst_addr",
+// "src_port", "dst_port", "protocol", "in_bytes" or "in_pkts". Unknown fields
+// are named "field_<id>" or "field_<enterprise>_<id>" for enterprise specific
+// IPFIX fields. Addresses are converted to strings, numbers with up to 8 bytes
+// to integers and all other values to hex strings.
+// The address of the sender is attached to each message as "source_address"
+// metadata.
+// When attached to a fuse, this consumer will discard all incoming datagrams
+// in case that fuse is burned.
+// Configuration example
+//
+//  - "consumer.Netflow":
+//    Address: ":2055"
+//    MaxDatagramSize: 65507
+//    ReadBufferSize: 0
+//
+// Address defines the host and port to bind to, e.g. "localhost:2055".
+// The protocol prefix "udp://", "udp4://" or "udp6://" is optional.
+// By default this is set to ":2055".
+//
+// MaxDatagramSize defines the maximum number of bytes read per datagram.
+// Larger datagrams are truncated. By default this is set to 65507.
+//
+// ReadBufferSize sets the size of the operating system's receive buffer
+// (SO_RCVBUF) in bytes. By default this is set to 0, which keeps the system
+// default.
+type Netflow struct {
+	core.ConsumerBase
+	conn            *net.UDPConn
+	decoder         *netflowDecoder
+	protocol        string
+	address         string
+	maxDatagramSize int
+	readBufferSize  int
+	sequence        uint64
+}
+
+func init() {
+	shared.TypeRegistry.Register(Netflow{})
+}
+
+// Configure initializes this consumer with values from a plugin config.
+func (cons *Netflow) Configure(conf core.PluginConfig) error {
+	err := cons.ConsumerBase.Configure(conf)
+	if err != nil {
+		return err
+	}
+
+	cons.address, cons.protocol = shared.ParseAddress(conf.GetString("Address", ":2055"))
+	switch cons.protocol {
+	case "tcp":
+		cons.protocol = "udp" // default returned by ParseAddress
+	case "udp", "udp4", "udp6":
+	default:
+		return fmt.Errorf("Netflow does not support %s", cons.protocol)
+	}
+
+	cons.maxDatagramSize = shared.MaxI(conf.GetInt("MaxDatagramSize", 65507), 1)
+	cons.readBufferSize = conf.GetInt("ReadBufferSize", 0)
+	cons.decoder = newNetflowDecoder()
+	return nil
+}
+
+func (cons *Netflow) processDatagram(data []byte, sender *net.UDPAddr) {
+	sourceAddress := sender.String()
+	records, err := cons.decoder.decode(sender.IP.String(), sourceAddress, data)
+	if err != nil {
+		Log.Debug.Print("Netflow failed to decode datagram from ", sourceAddress, ": ", err)
+	}
+
+	for _, record := range records {
+		payload, err := json.Marshal(record)
+		if err != nil {
+			Log.Error.Print("Netflow failed to encode record: ", err)
+			continue // ### continue, invalid record ###
+		}
+		msg := core.NewMessage(cons, payload, atomic.AddUint64(&cons.sequence, 1))
+		msg.SetMetadata(core.MetadataSourceAddress, sourceAddress)
+		cons.EnqueueMessage(msg)
+	}
+}
+
+func (cons *Netflow) readDatagrams() {
+	defer cons.WorkerDone()
+	datagram := make([]byte, cons.maxDatagramSize)
+
+	for cons.IsActive() {
+		size, sender, err := cons.conn.ReadFromUDP(datagram)
+		if err != nil {
+			if !cons.IsActive() || shared.IsDisconnectedError(err) {
+				return // ### return, socket closed ###
+			}
+			Log.Error.Print("Netflow read failed: ", err)
+			continue // ### continue, skip datagram ###
+		}
+
+		if size == 0 || cons.IsFuseBurned() {
+			continue // ### continue, nothing to do ###
+		}
+		cons.processDatagram(datagram[:size], sender)
+	}
+}
+
+func (cons *Netflow) close() {
+	if cons.conn != nil {
+		cons.conn.Close()
+	}
+}
+
+// Consume listens to the configured socket.
+func (cons *Netflow) Consume(workers *sync.WaitGroup) {
+	cons.SetWorkerWaitGroup(workers)
+
+	addr, err := net.ResolveUDPAddr(cons.protocol, cons.address)
+	if err == nil {
+		cons.conn, err = net.ListenUDP(cons.protocol, addr)
+	}
+	if err != nil {
+		Log.Error.Print("Netflow connection error: ", err)
+		return // ### return, could not bind ###
+	}
+
+	if cons.readBufferSize > 0 {
+		if err := cons.conn.SetReadBuffer(cons.readBufferSize); err != nil {
+			Log.Warning.Print("Netflow could not set read buffer size: ", err)
+		}
+	}
+
+	cons.SetStopCallback(cons.close)
+	cons.AddWorker()
+	go shared.DontPanic(cons.readDatagrams)
+
+	cons.ControlLoop()
+}
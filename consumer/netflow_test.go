@@ -0,0 +1,221 @@
+// Copyright 2015-2016 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumer
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/shared"
+	"net"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+)
+
+func netflowPacket(values ...interface{}) []byte {
+	buffer := new(bytes.Buffer)
+	for _, value := range values {
+		binary.Write(buffer, binary.BigEndian, value)
+	}
+	return buffer.Bytes()
+}
+
+func netflowTestV5() []byte {
+	header := netflowPacket(uint16(5), uint16(1), uint32(1000), uint32(1470000000), uint32(0), uint32(42), uint8(1), uint8(2), uint16(0x4000|100))
+	record := netflowPacket(
+		[]byte{10, 0, 0, 1}, []byte{10, 0, 0, 2}, []byte{10, 0, 0, 254},
+		uint16(3), uint16(4), uint32(10), uint32(1500), uint32(500), uint32(900),
+		uint16(1234), uint16(80), uint8(0), uint8(0x12), uint8(6), uint8(0),
+		uint16(65001), uint16(65002), uint8(24), uint8(16), uint16(0))
+	return netflowPacket(header, record)
+}
+
+func TestNetflowV5(t *testing.T) {
+	expect := shared.NewExpect(t)
+	decoder := newNetflowDecoder()
+
+	records, err := decoder.decode("192.168.0.1", "192.168.0.1:9995", netflowTestV5())
+	expect.NoError(err)
+	expect.Equal(1, len(records))
+
+	record := records[0]
+	expect.Equal("netflow_v5", record["flow_type"])
+	expect.Equal("192.168.0.1", record["exporter"])
+	expect.Equal(uint32(42), record["sequence"])
+	expect.Equal(uint16(100), record["sampling_interval"])
+	expect.Equal("10.0.0.1", record["src_addr"])
+	expect.Equal("10.0.0.2", record["dst_addr"])
+	expect.Equal("10.0.0.254", record["next_hop"])
+	expect.Equal(uint32(1500), record["in_bytes"])
+	expect.Equal(uint16(80), record["dst_port"])
+	expect.Equal(uint8(6), record["protocol"])
+	expect.Equal(uint16(65002), record["dst_as"])
+
+	_, err = decoder.decode("192.168.0.1", "192.168.0.1:9995", netflowTestV5()[:50])
+	expect.NotNil(err)
+}
+
+func TestNetflowV9(t *testing.T) {
+	expect := shared.NewExpect(t)
+	decoder := newNetflowDecoder()
+
+	header := netflowPacket(uint16(9), uint16(2), uint32(1000), uint32(1470000000), uint32(7), uint32(3))
+	template := netflowPacket(uint16(0), uint16(20), uint16(256), uint16(3), uint16(8), uint16(4), uint16(7), uint16(2), uint16(1), uint16(4))
+	data := netflowPacket(uint16(256), uint16(24), []byte{10, 0, 0, 1}, uint16(53), uint32(100), []byte{10, 0, 0, 2}, uint16(443), uint32(200))
+
+	// Data before template is discarded
+	records, err := decoder.decode("192.168.0.1", "192.168.0.1:2055", netflowPacket(header, data))
+	expect.NotNil(err)
+	expect.Equal(0, len(records))
+
+	packet := netflowPacket(header, template, data)
+	records, err = decoder.decode("192.168.0.1", "192.168.0.1:2055", packet)
+	expect.NoError(err)
+	expect.Equal(2, len(records))
+	expect.Equal("netflow_v9", records[0]["flow_type"])
+	expect.Equal(uint32(3), records[0]["source_id"])
+	expect.Equal("10.0.0.1", records[0]["src_addr"])
+	expect.Equal(uint64(53), records[0]["src_port"])
+	expect.Equal(uint64(200), records[1]["in_bytes"])
+
+	// Templates are cached per session
+	records, err = decoder.decode("192.168.0.1", "192.168.0.1:2055", netflowPacket(header, data))
+	expect.NoError(err)
+	expect.Equal(2, len(records))
+
+	_, err = decoder.decode("192.168.0.1", "192.168.0.1:2056", netflowPacket(header, data))
+	expect.NotNil(err)
+}
+
+func TestNetflowIPFIX(t *testing.T) {
+	expect := shared.NewExpect(t)
+	decoder := newNetflowDecoder()
+
+	template := netflowPacket(uint16(2), uint16(24), uint16(300), uint16(3),
+		uint16(27), uint16(16), uint16(96), uint16(0xFFFF), uint16(0x8000|1), uint16(2), uint32(29305))
+	optionsTemplate := netflowPacket(uint16(3), uint16(16), uint16(301), uint16(1), uint16(1), uint16(149), uint16(4), uint16(0))
+	data := netflowPacket(uint16(300), uint16(30), net.ParseIP("2001:db8::1").To16(), uint8(4), []byte("http"), uint16(7), []byte{0, 0, 0})
+	options := netflowPacket(uint16(301), uint16(8), uint32(1))
+
+	body := netflowPacket(template, optionsTemplate, data, options)
+	header := netflowPacket(uint16(10), uint16(16+len(body)), uint32(1470000000), uint32(9), uint32(5))
+
+	records, err := decoder.decode("192.168.0.1", "192.168.0.1:4739", netflowPacket(header, body, uint8(0xFF)))
+	expect.NoError(err)
+	expect.Equal(1, len(records))
+
+	record := records[0]
+	expect.Equal("ipfix", record["flow_type"])
+	expect.Equal(uint32(5), record["observation_domain_id"])
+	expect.Equal("2001:db8::1", record["src_addr"])
+	expect.Equal("http", record["application_name"])
+	expect.Equal(uint64(7), record["field_29305_1"])
+}
+
+func TestNetflowSflow(t *testing.T) {
+	expect := shared.NewExpect(t)
+	decoder := newNetflowDecoder()
+
+	frame := netflowPacket(
+		[]byte{0, 1, 2, 3, 4, 5}, []byte{6, 7, 8, 9, 10, 11}, uint16(0x8100), uint16(12), uint16(0x0800),
+		uint8(0x45), uint8(0), uint16(40), uint32(0), uint8(64), uint8(6), uint16(0), []byte{10, 0, 0, 1}, []byte{10, 0, 0, 2},
+		uint16(1234), uint16(443), uint32(0), uint32(0), uint8(0x50), uint8(0x02))
+	rawHeader := netflowPacket(uint32(1), uint32(64), uint32(4), uint32(len(frame)), frame, []byte{0, 0})
+	flowSample := netflowPacket(uint32(1), uint32(1), uint32(512), uint32(1024), uint32(0), uint32(3), uint32(4), uint32(1),
+		uint32(1), uint32(len(rawHeader)), rawHeader)
+	counterSample := netflowPacket(uint32(2), uint32(4), uint32(0))
+
+	packet := netflowPacket(uint32(5), uint32(1), []byte{192, 168, 0, 10}, uint32(0), uint32(1), uint32(1000), uint32(2),
+		uint32(1), uint32(len(flowSample)), flowSample, counterSample)
+
+	records, err := decoder.decode("192.168.0.1", "192.168.0.1:6343", packet)
+	expect.NoError(err)
+	expect.Equal(1, len(records))
+
+	record := records[0]
+	expect.Equal("sflow_v5", record["flow_type"])
+	expect.Equal("192.168.0.10", record["exporter"])
+	expect.Equal(uint32(512), record["sampling_rate"])
+	expect.Equal(uint32(3), record["input_snmp"])
+	expect.Equal(uint32(64), record["frame_length"])
+	expect.Equal("06:07:08:09:0a:0b", record["src_mac"])
+	expect.Equal(uint16(12), record["src_vlan"])
+	expect.Equal("10.0.0.2", record["dst_addr"])
+	expect.Equal(uint16(443), record["dst_port"])
+	expect.Equal(uint8(0x02), record["tcp_flags"])
+}
+
+func TestNetflowSflowTruncated(t *testing.T) {
+	expect := shared.NewExpect(t)
+	decoder := newNetflowDecoder()
+
+	// A single sample claiming to be almost 4 GB long must not be allocated
+	packet := netflowPacket(uint32(5), uint32(1), []byte{192, 168, 0, 10}, uint32(0), uint32(1), uint32(1000), uint32(1),
+		uint32(1), uint32(0xFFFFFFF0))
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	records, _ := decoder.decode("192.168.0.1", "192.168.0.1:6343", packet)
+	runtime.ReadMemStats(&after)
+
+	expect.Equal(0, len(records))
+	expect.Less(int(after.TotalAlloc-before.TotalAlloc), 1<<20)
+}
+
+func TestNetflow(t *testing.T) {
+	expect := shared.NewExpect(t)
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	expect.NoError(err)
+	address := conn.LocalAddr().String()
+	conn.Close()
+
+	stream := &mockHTTPStream{}
+	core.StreamRegistry.Register(stream, core.GetStreamID("netflow"))
+	conf := core.NewPluginConfig("")
+	conf.Stream = []string{"netflow"}
+	conf.Override("Address", address)
+	plugin, err := core.NewPluginWithType("consumer.Netflow", conf)
+	expect.NoError(err)
+	cons := plugin.(*Netflow)
+
+	workers := new(sync.WaitGroup)
+	go cons.Consume(workers)
+
+	client, err := net.Dial("udp", address)
+	expect.NoError(err)
+	defer client.Close()
+
+	expect.NonBlocking(2*time.Second, func() {
+		for stream.count() == 0 {
+			client.Write(netflowTestV5())
+			time.Sleep(50 * time.Millisecond)
+		}
+	})
+	cons.Control() <- core.PluginControlStopConsumer
+	expect.NonBlocking(2*time.Second, workers.Wait)
+
+	stream.guard.Lock()
+	defer stream.guard.Unlock()
+	record := map[string]interface{}{}
+	expect.NoError(json.Unmarshal(stream.messages[0].Data, &record))
+	expect.Equal("netflow_v5", record["flow_type"])
+	expect.Equal("127.0.0.1", record["exporter"])
+	expect.Equal(1500.0, record["in_bytes"])
+	expect.Equal(client.LocalAddr().String(), stream.messages[0].Metadata[core.MetadataSourceAddress])
+}
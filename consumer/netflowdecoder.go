@@ -0,0 +1,638 @@
+// Copyright 2015-2016 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumer
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"github.com/trivago/gollum/shared"
+	"net"
+	"strings"
+	"sync"
+)
+
+const (
+	netflowFieldVariableLength = 0xFFFF
+	netflowFieldAddress        = 1
+	netflowFieldMAC            = 2
+	netflowFieldString         = 3
+)
+
+// netflowFieldNames maps the field types of NetFlow v9 and IPFIX (IANA
+// information elements) to the names used in the generated JSON records.
+// The same names are used for the fields of NetFlow v5 and sFlow records.
+var netflowFieldNames = map[uint16]string{
+	1:   "in_bytes",
+	2:   "in_pkts",
+	3:   "flows",
+	4:   "protocol",
+	5:   "tos",
+	6:   "tcp_flags",
+	7:   "src_port",
+	8:   "src_addr",
+	9:   "src_mask",
+	10:  "input_snmp",
+	11:  "dst_port",
+	12:  "dst_addr",
+	13:  "dst_mask",
+	14:  "output_snmp",
+	15:  "next_hop",
+	16:  "src_as",
+	17:  "dst_as",
+	18:  "bgp_next_hop",
+	19:  "mul_dst_pkts",
+	20:  "mul_dst_bytes",
+	21:  "last_switched",
+	22:  "first_switched",
+	23:  "out_bytes",
+	24:  "out_pkts",
+	27:  "src_addr",
+	28:  "dst_addr",
+	29:  "src_mask",
+	30:  "dst_mask",
+	31:  "flow_label",
+	32:  "icmp_type",
+	34:  "sampling_interval",
+	35:  "sampling_algorithm",
+	38:  "engine_type",
+	39:  "engine_id",
+	56:  "src_mac",
+	57:  "out_dst_mac",
+	58:  "src_vlan",
+	59:  "dst_vlan",
+	60:  "ip_version",
+	61:  "direction",
+	62:  "next_hop",
+	63:  "bgp_next_hop",
+	80:  "dst_mac",
+	81:  "out_src_mac",
+	82:  "interface_name",
+	83:  "interface_description",
+	85:  "total_bytes",
+	86:  "total_pkts",
+	89:  "forwarding_status",
+	94:  "application_description",
+	95:  "application_id",
+	96:  "application_name",
+	130: "exporter_addr",
+	131: "exporter_addr",
+	136: "flow_end_reason",
+	148: "flow_id",
+	150: "flow_start_sec",
+	151: "flow_end_sec",
+	152: "flow_start_msec",
+	153: "flow_end_msec",
+	176: "icmp_type",
+	177: "icmp_code",
+	225: "post_nat_src_addr",
+	226: "post_nat_dst_addr",
+	227: "post_napt_src_port",
+	228: "post_napt_dst_port",
+	234: "ingress_vrf_id",
+	235: "egress_vrf_id",
+}
+
+// netflowFieldKinds defines the field types that are not decoded as numbers.
+var netflowFieldKinds = map[uint16]int{
+	8:   netflowFieldAddress,
+	12:  netflowFieldAddress,
+	15:  netflowFieldAddress,
+	18:  netflowFieldAddress,
+	27:  netflowFieldAddress,
+	28:  netflowFieldAddress,
+	62:  netflowFieldAddress,
+	63:  netflowFieldAddress,
+	130: netflowFieldAddress,
+	131: netflowFieldAddress,
+	225: netflowFieldAddress,
+	226: netflowFieldAddress,
+	56:  netflowFieldMAC,
+	57:  netflowFieldMAC,
+	80:  netflowFieldMAC,
+	81:  netflowFieldMAC,
+	82:  netflowFieldString,
+	83:  netflowFieldString,
+	94:  netflowFieldString,
+	96:  netflowFieldString,
+}
+
+// netflowRecord is a decoded flow that is converted to JSON.
+type netflowRecord map[string]interface{}
+
+type netflowField struct {
+	id         uint16
+	length     uint16
+	enterprise uint32
+}
+
+type netflowTemplate struct {
+	fields  []netflowField
+	options bool
+}
+
+type netflowTemplateKey struct {
+	session string
+	version uint16
+	domain  uint32
+	id      uint16
+}
+
+// netflowDecoder decodes NetFlow and sFlow datagrams. Templates of NetFlow v9
+// and IPFIX are cached per session (the address and port of the exporter),
+// version, source id (observation domain) and template id.
+type netflowDecoder struct {
+	templates map[netflowTemplateKey]netflowTemplate
+	guard     *sync.Mutex
+}
+
+// netflowReader reads big endian values from a byte slice. Reading past the
+// end of data sets the error flag and returns zero values.
+type netflowReader struct {
+	data []byte
+	err  bool
+}
+
+func newNetflowDecoder() *netflowDecoder {
+	return &netflowDecoder{
+		templates: make(map[netflowTemplateKey]netflowTemplate),
+		guard:     new(sync.Mutex),
+	}
+}
+
+func (reader *netflowReader) next(size int) []byte {
+	if reader.err || size < 0 || len(reader.data) < size {
+		reader.err = true
+		reader.data = nil
+		return make([]byte, 16) // zero value for all fixed size types and addresses
+	}
+	data := reader.data[:size]
+	reader.data = reader.data[size:]
+	return data
+}
+
+func (reader *netflowReader) uint8() uint8 {
+	return reader.next(1)[0]
+}
+
+func (reader *netflowReader) uint16() uint16 {
+	return binary.BigEndian.Uint16(reader.next(2))
+}
+
+func (reader *netflowReader) uint32() uint32 {
+	return binary.BigEndian.Uint32(reader.next(4))
+}
+
+func (reader *netflowReader) ip(size int) string {
+	return net.IP(reader.next(size)).String()
+}
+
+func netflowUint(data []byte) uint64 {
+	value := uint64(0)
+	for _, b := range data {
+		value = value<<8 | uint64(b)
+	}
+	return value
+}
+
+// netflowFieldValue converts the raw value of a NetFlow v9 or IPFIX field.
+// Addresses and MAC addresses are converted to strings, values of up to 8
+// bytes to numbers and all other values to hex strings.
+func netflowFieldValue(field netflowField, data []byte) interface{} {
+	if field.enterprise == 0 {
+		switch netflowFieldKinds[field.id] {
+		case netflowFieldAddress:
+			if len(data) == net.IPv4len || len(data) == net.IPv6len {
+				return net.IP(data).String()
+			}
+		case netflowFieldMAC:
+			if len(data) == 6 {
+				return net.HardwareAddr(data).String()
+			}
+		case netflowFieldString:
+			return strings.TrimRight(string(data), "\x00")
+		}
+	}
+	if len(data) <= 8 {
+		return netflowUint(data)
+	}
+	return hex.EncodeToString(data)
+}
+
+func netflowFieldName(field netflowField) string {
+	if field.enterprise != 0 {
+		return fmt.Sprintf("field_%d_%d", field.enterprise, field.id)
+	}
+	if name, known := netflowFieldNames[field.id]; known {
+		return name
+	}
+	return fmt.Sprintf("field_%d", field.id)
+}
+
+// decode parses a datagram sent by the given exporter and returns all flow
+// records contained in it. The session defines the address and port the
+// datagram has been sent from.
+func (dec *netflowDecoder) decode(exporter string, session string, data []byte) ([]netflowRecord, error) {
+	if len(data) < 4 {
+		return nil, fmt.Errorf("datagram too short")
+	}
+
+	switch version := binary.BigEndian.Uint16(data); version {
+	case 5:
+		return decodeNetflowV5(exporter, data)
+	case 9, 10:
+		return dec.decodeTemplated(exporter, session, version, data)
+	case 0:
+		if binary.BigEndian.Uint32(data) == 5 {
+			return decodeSflow(data)
+		}
+	}
+	return nil, fmt.Errorf("unsupported version %d", binary.BigEndian.Uint32(data))
+}
+
+func decodeNetflowV5(exporter string, data []byte) ([]netflowRecord, error) {
+	reader := &netflowReader{data: data}
+	reader.uint16() // version
+	count := int(reader.uint16())
+	uptime := reader.uint32()
+	exportTime := reader.uint32()
+	reader.uint32() // nanoseconds
+	sequence := reader.uint32()
+	engineType := reader.uint8()
+	engineID := reader.uint8()
+	samplingInterval := reader.uint16() & 0x3FFF
+
+	records := make([]netflowRecord, 0, count)
+	for i := 0; i < count; i++ {
+		record := netflowRecord{
+			"flow_type":         "netflow_v5",
+			"exporter":          exporter,
+			"sequence":          sequence + uint32(i),
+			"export_time":       exportTime,
+			"sys_uptime":        uptime,
+			"engine_type":       engineType,
+			"engine_id":         engineID,
+			"sampling_interval": samplingInterval,
+		}
+		record["src_addr"] = reader.ip(4)
+		record["dst_addr"] = reader.ip(4)
+		record["next_hop"] = reader.ip(4)
+		record["input_snmp"] = reader.uint16()
+		record["output_snmp"] = reader.uint16()
+		record["in_pkts"] = reader.uint32()
+		record["in_bytes"] = reader.uint32()
+		record["first_switched"] = reader.uint32()
+		record["last_switched"] = reader.uint32()
+		record["src_port"] = reader.uint16()
+		record["dst_port"] = reader.uint16()
+		reader.uint8() // padding
+		record["tcp_flags"] = reader.uint8()
+		record["protocol"] = reader.uint8()
+		record["tos"] = reader.uint8()
+		record["src_as"] = reader.uint16()
+		record["dst_as"] = reader.uint16()
+		record["src_mask"] = reader.uint8()
+		record["dst_mask"] = reader.uint8()
+		reader.uint16() // padding
+
+		if reader.err {
+			return records, fmt.Errorf("NetFlow v5 datagram truncated")
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+// decodeTemplated parses NetFlow v9 and IPFIX datagrams.
+func (dec *netflowDecoder) decodeTemplated(exporter string, session string, version uint16, data []byte) ([]netflowRecord, error) {
+	reader := &netflowReader{data: data}
+	header := netflowRecord{"exporter": exporter}
+	domain := uint32(0)
+	templateSet, optionsSet := uint16(0), uint16(1)
+
+	reader.uint16() // version
+	if version == 9 {
+		reader.uint16() // count
+		header["flow_type"] = "netflow_v9"
+		header["sys_uptime"] = reader.uint32()
+		header["export_time"] = reader.uint32()
+		header["sequence"] = reader.uint32()
+		domain = reader.uint32()
+		header["source_id"] = domain
+	} else {
+		if length := int(reader.uint16()); length >= 16 && length < len(data) {
+			reader.data = data[4:length]
+		}
+		header["flow_type"] = "ipfix"
+		header["export_time"] = reader.uint32()
+		header["sequence"] = reader.uint32()
+		domain = reader.uint32()
+		header["observation_domain_id"] = domain
+		templateSet, optionsSet = 2, 3
+	}
+
+	if reader.err {
+		return nil, fmt.Errorf("header truncated")
+	}
+
+	var err error
+	records := []netflowRecord{}
+	for len(reader.data) >= 4 {
+		setID := reader.uint16()
+		length := int(reader.uint16())
+		set := &netflowReader{data: reader.next(length - 4)}
+		if length < 4 || reader.err {
+			return records, fmt.Errorf("set %d truncated", setID)
+		}
+
+		key := netflowTemplateKey{session: session, version: version, domain: domain}
+		switch {
+		case setID == templateSet:
+			dec.parseTemplates(key, set, false)
+		case setID == optionsSet:
+			dec.parseTemplates(key, set, true)
+		case setID >= 256:
+			key.id = setID
+			dec.guard.Lock()
+			template, known := dec.templates[key]
+			dec.guard.Unlock()
+			if !known {
+				err = fmt.Errorf("unknown template %d", setID)
+				continue // ### continue, template not yet received ###
+			}
+			if !template.options {
+				records = append(records, parseNetflowDataSet(header, template, set)...)
+			}
+		}
+	}
+	return records, err
+}
+
+func (dec *netflowDecoder) parseTemplates(key netflowTemplateKey, set *netflowReader, options bool) {
+	ipfix := key.version == 10
+	for len(set.data) >= 4 {
+		key.id = set.uint16()
+		fieldCount := int(set.uint16())
+
+		switch {
+		case options && !ipfix:
+			// NetFlow v9 options templates define scope and option lengths in bytes
+			scopeLength := fieldCount
+			fieldCount = (scopeLength + int(set.uint16())) / 4
+		case options:
+			set.uint16() // scope field count
+		}
+
+		if key.id < 256 {
+			return // ### return, padding or invalid template ###
+		}
+
+		template := netflowTemplate{options: options}
+		for i := 0; i < fieldCount; i++ {
+			field := netflowField{id: set.uint16(), length: set.uint16()}
+			if ipfix && field.id&0x8000 != 0 {
+				field.id &= 0x7FFF
+				field.enterprise = set.uint32()
+			}
+			template.fields = append(template.fields, field)
+		}
+
+		if set.err {
+			return // ### return, template truncated ###
+		}
+
+		dec.guard.Lock()
+		if fieldCount == 0 {
+			delete(dec.templates, key) // IPFIX template withdrawal
+		} else {
+			dec.templates[key] = template
+		}
+		dec.guard.Unlock()
+	}
+}
+
+func parseNetflowDataSet(header netflowRecord, template netflowTemplate, set *netflowReader) []netflowRecord {
+	minLength := 0
+	for _, field := range template.fields {
+		if field.length == netflowFieldVariableLength {
+			minLength++
+		} else {
+			minLength += int(field.length)
+		}
+	}
+	if minLength == 0 {
+		return nil // ### return, empty records ###
+	}
+
+	records := []netflowRecord{}
+	for len(set.data) >= minLength {
+		record := netflowRecord{}
+		for key, value := range header {
+			record[key] = value
+		}
+
+		for _, field := range template.fields {
+			length := int(field.length)
+			if field.length == netflowFieldVariableLength {
+				if length = int(set.uint8()); length == 255 {
+					length = int(set.uint16())
+				}
+			}
+			value := set.next(length)
+			if set.err {
+				return records // ### return, record truncated ###
+			}
+			record[netflowFieldName(field)] = netflowFieldValue(field, value)
+		}
+		records = append(records, record)
+	}
+	return records
+}
+
+// decodeSflow parses sFlow v5 datagrams. Only flow samples are converted to
+// records, counter samples are ignored.
+func decodeSflow(data []byte) ([]netflowRecord, error) {
+	reader := &netflowReader{data: data}
+	reader.uint32() // version
+
+	header := netflowRecord{"flow_type": "sflow_v5"}
+	switch addressType := reader.uint32(); addressType {
+	case 1:
+		header["exporter"] = reader.ip(4)
+	case 2:
+		header["exporter"] = reader.ip(16)
+	default:
+		return nil, fmt.Errorf("unknown agent address type %d", addressType)
+	}
+	header["sub_agent_id"] = reader.uint32()
+	reader.uint32() // datagram sequence
+	header["sys_uptime"] = reader.uint32()
+	sampleCount := int(reader.uint32())
+
+	records := []netflowRecord{}
+	for i := 0; i < sampleCount && !reader.err; i++ {
+		format := reader.uint32()
+		sample := &netflowReader{data: reader.next(int(reader.uint32()))}
+		if reader.err {
+			break // ### break, sample truncated ###
+		}
+
+		record := netflowRecord{}
+		for key, value := range header {
+			record[key] = value
+		}
+
+		switch format {
+		case 1: // flow sample
+			record["sequence"] = sample.uint32()
+			sample.uint32() // source id
+			record["sampling_rate"] = sample.uint32()
+			record["sample_pool"] = sample.uint32()
+			record["drops"] = sample.uint32()
+			record["input_snmp"] = sample.uint32() & 0x3FFFFFFF
+			record["output_snmp"] = sample.uint32() & 0x3FFFFFFF
+
+		case 3: // expanded flow sample
+			record["sequence"] = sample.uint32()
+			sample.uint32() // source id type
+			sample.uint32() // source id index
+			record["sampling_rate"] = sample.uint32()
+			record["sample_pool"] = sample.uint32()
+			record["drops"] = sample.uint32()
+			sample.uint32() // input format
+			record["input_snmp"] = sample.uint32()
+			sample.uint32() // output format
+			record["output_snmp"] = sample.uint32()
+
+		default:
+			continue // ### continue, not a flow sample ###
+		}
+
+		recordCount := int(sample.uint32())
+		for j := 0; j < recordCount && !sample.err; j++ {
+			recordFormat := sample.uint32()
+			flow := &netflowReader{data: sample.next(int(sample.uint32()))}
+			if sample.err {
+				break // ### break, record truncated ###
+			}
+			decodeSflowRecord(record, recordFormat, flow)
+		}
+
+		if sample.err {
+			return records, fmt.Errorf("sFlow sample truncated")
+		}
+		records = append(records, record)
+	}
+
+	if reader.err {
+		return records, fmt.Errorf("sFlow datagram truncated")
+	}
+	return records, nil
+}
+
+func decodeSflowRecord(record netflowRecord, format uint32, flow *netflowReader) {
+	switch format {
+	case 1: // raw packet header
+		protocol := flow.uint32()
+		record["frame_length"] = flow.uint32()
+		flow.uint32() // stripped
+		headerLength := int(flow.uint32())
+		header := flow.next(headerLength)
+		if !flow.err && protocol == 1 {
+			decodeEthernetHeader(record, header)
+		}
+
+	case 3: // sampled IPv4
+		flow.uint32() // length
+		record["protocol"] = flow.uint32()
+		record["src_addr"] = flow.ip(4)
+		record["dst_addr"] = flow.ip(4)
+		record["src_port"] = flow.uint32()
+		record["dst_port"] = flow.uint32()
+		record["tcp_flags"] = flow.uint32()
+		record["tos"] = flow.uint32()
+
+	case 4: // sampled IPv6
+		flow.uint32() // length
+		record["protocol"] = flow.uint32()
+		record["src_addr"] = flow.ip(16)
+		record["dst_addr"] = flow.ip(16)
+		record["src_port"] = flow.uint32()
+		record["dst_port"] = flow.uint32()
+		record["tcp_flags"] = flow.uint32()
+		record["tos"] = flow.uint32()
+
+	case 1001: // extended switch
+		record["src_vlan"] = flow.uint32()
+		flow.uint32() // source priority
+		record["dst_vlan"] = flow.uint32()
+	}
+}
+
+// decodeEthernetHeader extracts addresses and ports of a sampled ethernet
+// frame.
+func decodeEthernetHeader(record netflowRecord, frame []byte) {
+	if len(frame) < 14 {
+		return // ### return, header too short ###
+	}
+	record["dst_mac"] = net.HardwareAddr(frame[0:6]).String()
+	record["src_mac"] = net.HardwareAddr(frame[6:12]).String()
+
+	etherType := binary.BigEndian.Uint16(frame[12:])
+	packet := frame[14:]
+	for (etherType == 0x8100 || etherType == 0x88A8) && len(packet) >= 4 {
+		if _, exists := record["src_vlan"]; !exists {
+			record["src_vlan"] = binary.BigEndian.Uint16(packet) & 0x0FFF
+		}
+		etherType = binary.BigEndian.Uint16(packet[2:])
+		packet = packet[4:]
+	}
+
+	var protocol uint8
+	switch {
+	case etherType == 0x0800 && len(packet) >= 20:
+		headerLength := int(packet[0]&0x0F) * 4
+		protocol = packet[9]
+		record["ip_version"] = 4
+		record["tos"] = packet[1]
+		record["protocol"] = protocol
+		record["src_addr"] = net.IP(packet[12:16]).String()
+		record["dst_addr"] = net.IP(packet[16:20]).String()
+		packet = packet[shared.MinI(headerLength, len(packet)):]
+
+	case etherType == 0x86DD && len(packet) >= 40:
+		protocol = packet[6]
+		record["ip_version"] = 6
+		record["tos"] = uint8(binary.BigEndian.Uint16(packet) >> 4)
+		record["protocol"] = protocol
+		record["src_addr"] = net.IP(packet[8:24]).String()
+		record["dst_addr"] = net.IP(packet[24:40]).String()
+		packet = packet[40:]
+
+	default:
+		return // ### return, not an IP packet ###
+	}
+
+	switch protocol {
+	case 6, 17, 132:
+		if len(packet) >= 4 {
+			record["src_port"] = binary.BigEndian.Uint16(packet)
+			record["dst_port"] = binary.BigEndian.Uint16(packet[2:])
+		}
+		if protocol == 6 && len(packet) >= 14 {
+			record["tcp_flags"] = packet[13]
+		}
+	}
+}
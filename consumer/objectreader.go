@@ -0,0 +1,195 @@
+// Copyright 2015-2016 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumer
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/shared"
+	"io"
+	"io/ioutil"
+	"strings"
+)
+
+const (
+	objectCompressionAuto = "auto"
+	objectCompressionGzip = "gzip"
+	objectCompressionNone = "none"
+	objectBufferGrowSize  = 1 << 16
+)
+
+// objectReader splits objects downloaded from a storage service into
+// messages. It reads the "Partitioner", "Delimiter", "Offset", "Size",
+// "Compression" and "MaxObjectSizeByte" options shared by the object storage
+// consumers.
+type objectReader struct {
+	delimiter   string
+	flags       shared.BufferedReaderFlags
+	offset      int
+	compression string
+	objectMode  bool
+	maxSize     int
+}
+
+// objectDelimitedReader appends a delimiter to the end of an object if it is
+// missing, so that the last message of an object is not discarded.
+type objectDelimitedReader struct {
+	reader    io.Reader
+	delimiter []byte
+	tail      []byte
+	pending   []byte
+	eof       bool
+}
+
+func newObjectReader(conf core.PluginConfig) (*objectReader, error) {
+	reader := &objectReader{
+		delimiter: shared.Unescape(conf.GetString("Delimiter", "\n")),
+		offset:    conf.GetInt("Offset", 0),
+		maxSize:   shared.MaxI(conf.GetInt("MaxObjectSizeByte", 64<<20), 1),
+	}
+
+	reader.compression = strings.ToLower(conf.GetString("Compression", objectCompressionAuto))
+	switch reader.compression {
+	case objectCompressionAuto, objectCompressionGzip, objectCompressionNone:
+	default:
+		return nil, fmt.Errorf("Unknown compression: %s", reader.compression)
+	}
+
+	partitioner := strings.ToLower(conf.GetString("Partitioner", "delimiter"))
+	switch partitioner {
+	case "object":
+		reader.objectMode = true
+
+	case "binary_be":
+		reader.flags |= shared.BufferedReaderFlagBigEndian
+		fallthrough
+
+	case "binary", "binary_le":
+		reader.flags |= shared.BufferedReaderFlagEverything
+		switch conf.GetInt("Size", 4) {
+		case 1:
+			reader.flags |= shared.BufferedReaderFlagMLE8
+		case 2:
+			reader.flags |= shared.BufferedReaderFlagMLE16
+		case 4:
+			reader.flags |= shared.BufferedReaderFlagMLE32
+		case 8:
+			reader.flags |= shared.BufferedReaderFlagMLE64
+		default:
+			return nil, fmt.Errorf("Size only supports the value 1,2,4 and 8")
+		}
+
+	case "varint":
+		reader.flags |= shared.BufferedReaderFlagMLEVarint
+
+	case "fixed":
+		reader.flags |= shared.BufferedReaderFlagMLEFixed
+		reader.offset = conf.GetInt("Size", 1)
+
+	case "ascii":
+		reader.flags |= shared.BufferedReaderFlagMLE
+
+	case "delimiter":
+		// Nothing to add
+
+	default:
+		return nil, fmt.Errorf("Unknown partitioner: %s", partitioner)
+	}
+
+	return reader, nil
+}
+
+// Read passes the data of the wrapped reader and appends the delimiter at the
+// end if necessary.
+func (reader *objectDelimitedReader) Read(data []byte) (int, error) {
+	if len(reader.pending) > 0 {
+		size := copy(data, reader.pending)
+		reader.pending = reader.pending[size:]
+		return size, nil
+	}
+	if reader.eof {
+		return 0, io.EOF
+	}
+
+	size, err := reader.reader.Read(data)
+	reader.tail = append(reader.tail, data[:size]...)
+	if len(reader.tail) > len(reader.delimiter) {
+		reader.tail = append(reader.tail[:0], reader.tail[len(reader.tail)-len(reader.delimiter):]...)
+	}
+
+	if err == io.EOF {
+		reader.eof = true
+		if len(reader.tail) > 0 && !bytes.HasSuffix(reader.tail, reader.delimiter) {
+			reader.pending = reader.delimiter
+		}
+		if size > 0 || len(reader.pending) > 0 {
+			return size, nil
+		}
+	}
+	return size, err
+}
+
+// read decompresses the given object if necessary and calls enqueue for each
+// message found. If parts of the object could not be parsed, reading
+// continues and shared.BufferDataInvalid is returned after the object has
+// been read completely.
+func (reader *objectReader) read(object io.Reader, enqueue func(data []byte)) error {
+	body := bufio.NewReader(object)
+	var source io.Reader = body
+	if reader.compression != objectCompressionNone {
+		magic, _ := body.Peek(2)
+		if reader.compression == objectCompressionGzip || bytes.Equal(magic, []byte{0x1f, 0x8b}) {
+			gzipReader, err := gzip.NewReader(body)
+			if err != nil {
+				return err
+			}
+			defer gzipReader.Close()
+			source = gzipReader
+		}
+	}
+
+	if reader.objectMode {
+		data, err := ioutil.ReadAll(io.LimitReader(source, int64(reader.maxSize)+1))
+		if err != nil {
+			return err
+		}
+		if len(data) > reader.maxSize {
+			return fmt.Errorf("Object exceeds %d bytes", reader.maxSize)
+		}
+		enqueue(data)
+		return nil
+	}
+
+	if reader.flags&shared.BufferedReaderFlagMaskMLE == 0 {
+		source = &objectDelimitedReader{reader: source, delimiter: []byte(reader.delimiter)}
+	}
+
+	var result error
+	buffer := shared.NewBufferedReader(objectBufferGrowSize, reader.flags, reader.offset, reader.delimiter)
+	for {
+		switch err := buffer.ReadAll(source, func(data []byte, sequence uint64) { enqueue(data) }); err {
+		case nil:
+		case io.EOF:
+			return result // ### return, object read ###
+		case shared.BufferDataInvalid:
+			result = err
+		default:
+			return err // ### return, read failed ###
+		}
+	}
+}
@@ -0,0 +1,53 @@
+// Copyright 2015-2016 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumer
+
+import (
+	"bytes"
+	"compress/gzip"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/shared"
+	"strings"
+	"testing"
+)
+
+func TestObjectReaderMaxSize(t *testing.T) {
+	expect := shared.NewExpect(t)
+
+	conf := core.NewPluginConfig("")
+	conf.Override("Partitioner", "object")
+	conf.Override("MaxObjectSizeByte", 8)
+	reader, err := newObjectReader(conf)
+	expect.NoError(err)
+
+	messages := []string{}
+	enqueue := func(data []byte) { messages = append(messages, string(data)) }
+
+	expect.NoError(reader.read(strings.NewReader("12345678"), enqueue))
+	expect.Equal([]string{"12345678"}, messages)
+
+	err = reader.read(strings.NewReader("123456789"), enqueue)
+	expect.NotNil(err)
+	expect.Equal(1, len(messages))
+
+	// The limit applies to the decompressed object
+	compressed := bytes.Buffer{}
+	writer := gzip.NewWriter(&compressed)
+	writer.Write(bytes.Repeat([]byte{'a'}, 1024))
+	writer.Close()
+	err = reader.read(&compressed, enqueue)
+	expect.NotNil(err)
+	expect.Equal(1, len(messages))
+}
@@ -0,0 +1,436 @@
+// Copyright 2015-2016 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumer
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/jackc/pglogrepl"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgproto3"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/core/log"
+	"github.com/trivago/gollum/shared"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	postgresMetadataLSN   = "postgres_lsn"
+	postgresMetadataTable = "postgres_table"
+	postgresDuplicateCode = "42710"
+	postgresTimeout       = 30 * time.Second
+)
+
+// PostgresCDC consumer plugin
+// The PostgresCDC consumer streams row changes from a logical replication
+// slot of a PostgreSQL server (version 10 or newer). Changes are decoded by
+// the pgoutput plugin built into PostgreSQL or by the wal2json plugin.
+// Each inserted, updated, deleted or truncated row is emitted as one JSON
+// object with the fields "lsn", "xid", "commit_time", "schema", "table",
+// "op", "old" and "new". The operation "op" is one of "insert", "update",
+// "delete" or "truncate". The old and new values of the row are stored as
+// objects mapping column names to values. Old values are only available if
+// the replica identity of the table provides them. Unchanged TOAST values
+// are not included in the new values.
+// The position of a transaction is confirmed to the server after all of its
+// changes have been passed to the configured streams, so changes that were
+// not delivered when gollum stops are sent again after a restart.
+// The LSN of the change and the qualified name of the table are attached to
+// each message as "postgres_lsn" and "postgres_table" metadata.
+// When attached to a fuse, this consumer will stop reading changes in case
+// that fuse is burned.
+// Configuration example
+//
+//  - "consumer.PostgresCDC":
+//    Address: "localhost:5432"
+//    Database: "postgres"
+//    User: "postgres"
+//    Password: ""
+//    Slot: "gollum"
+//    CreateSlot: true
+//    Plugin: "pgoutput"
+//    Publications:
+//      - "gollum"
+//    StartLSN: ""
+//    StatusIntervalSec: 10
+//    RetryDelayMs: 3000
+//    TlsEnable: false
+//    TlsKeyLocation: ""
+//    TlsCertificateLocation: ""
+//    TlsCaLocation: ""
+//    TlsServerName: ""
+//    TlsInsecureSkipVerify: false
+//
+// Address defines the host and port of the server.
+// By default this is set to "localhost:5432".
+//
+// Database defines the database to stream changes of. By default this is set
+// to "postgres".
+//
+// User defines the user to connect as. The user requires the REPLICATION
+// attribute. By default this is set to "postgres".
+//
+// Password defines the password of User. Cleartext, MD5 and SCRAM-SHA-256
+// authentication are supported. By default this is set to "".
+//
+// Slot defines the name of the logical replication slot to read from.
+// By default this is set to "gollum".
+//
+// CreateSlot can be set to false to fail if the slot does not exist instead
+// of creating it with the given Plugin. By default this is set to true.
+//
+// Plugin defines the output plugin of the slot. This can be "pgoutput" or
+// "wal2json". The wal2json plugin has to support format-version 2.
+// By default this is set to "pgoutput".
+//
+// Publications defines the publications to stream changes of when using the
+// pgoutput plugin. Publications have to be created with CREATE PUBLICATION
+// before. By default this is set to ["gollum"].
+//
+// StartLSN defines the position to start streaming from, e.g. "0/16B3748".
+// The server starts at the position last confirmed for the slot if StartLSN
+// lies before that position. By default this is set to "", which starts at
+// the last confirmed position.
+//
+// StatusIntervalSec defines the number of seconds between two status updates
+// sent to the server. By default this is set to 10.
+//
+// RetryDelayMs defines the number of milliseconds to wait before reconnecting
+// after the connection to the server has been lost.
+// By default this is set to 3000.
+//
+// TlsEnable defines whether to use TLS to communicate with the server.
+// By default this is set to false.
+//
+// TlsKeyLocation defines the path to the client's private key (PEM) used
+// for authentication. By default this is set to "".
+//
+// TlsCertificateLocation defines the path to the client's public key (PEM)
+// used for authentication. By default this is set to "".
+//
+// TlsCaLocation defines the path to CA certificate(s) for verifying the
+// server's key. By default this is set to "", which uses the certificate
+// authorities of the system.
+//
+// TlsServerName is used to verify the hostname on the server's certificate
+// unless TlsInsecureSkipVerify is true. By default this is set to "", which
+// uses the host of Address.
+//
+// TlsInsecureSkipVerify controls whether to verify the server's certificate
+// chain and host name. By default this is set to false.
+type PostgresCDC struct {
+	core.ConsumerBase
+	address        string
+	config         *pgconn.Config
+	slot           string
+	createSlot     bool
+	plugin         string
+	publications   []string
+	statusInterval time.Duration
+	retryDelay     time.Duration
+	confirmed      uint64
+	ctx            context.Context
+	cancel         context.CancelFunc
+	sequence       uint64
+}
+
+func init() {
+	shared.TypeRegistry.Register(PostgresCDC{})
+}
+
+// quotePostgresIdentifier quotes a name for use in a replication command.
+func quotePostgresIdentifier(name string) string {
+	return `"` + strings.Replace(name, `"`, `""`, -1) + `"`
+}
+
+// quotePostgresLiteral quotes a string for use in a replication command.
+func quotePostgresLiteral(value string) string {
+	return "'" + strings.Replace(value, "'", "''", -1) + "'"
+}
+
+// Configure initializes this consumer with values from a plugin config.
+func (cons *PostgresCDC) Configure(conf core.PluginConfig) error {
+	err := cons.ConsumerBase.Configure(conf)
+	if err != nil {
+		return err
+	}
+
+	cons.address = conf.GetString("Address", "localhost:5432")
+	host, port, err := net.SplitHostPort(cons.address)
+	if err != nil {
+		return fmt.Errorf("Invalid Address: %s", err)
+	}
+	portNumber, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return fmt.Errorf("Invalid Address: %s", err)
+	}
+
+	// Connection settings are not taken from the environment
+	if cons.config, err = pgconn.ParseConfig(""); err != nil {
+		return err
+	}
+	cons.config.Host = host
+	cons.config.Port = uint16(portNumber)
+	cons.config.User = conf.GetString("User", "postgres")
+	cons.config.Password = conf.GetString("Password", "")
+	cons.config.Database = conf.GetString("Database", "postgres")
+	cons.config.ConnectTimeout = postgresTimeout
+	cons.config.RuntimeParams = map[string]string{
+		"replication":      "database",
+		"application_name": "gollum",
+	}
+	cons.config.TLSConfig = nil
+	cons.config.Fallbacks = nil
+
+	cons.slot = conf.GetString("Slot", "gollum")
+	cons.createSlot = conf.GetBool("CreateSlot", true)
+	cons.publications = conf.GetStringArray("Publications", []string{"gollum"})
+	cons.plugin = strings.ToLower(conf.GetString("Plugin", postgresPluginPgoutput))
+	switch cons.plugin {
+	case postgresPluginPgoutput, postgresPluginWal2json:
+	default:
+		return fmt.Errorf("Unknown plugin: %s", cons.plugin)
+	}
+
+	if startLSN := conf.GetString("StartLSN", ""); startLSN != "" {
+		lsn, err := pglogrepl.ParseLSN(startLSN)
+		if err != nil {
+			return err
+		}
+		cons.confirmed = uint64(lsn)
+	}
+
+	cons.statusInterval = time.Duration(shared.MaxI(conf.GetInt("StatusIntervalSec", 10), 1)) * time.Second
+	cons.retryDelay = time.Duration(conf.GetInt("RetryDelayMs", 3000)) * time.Millisecond
+	cons.ctx, cons.cancel = context.WithCancel(context.Background())
+
+	if conf.GetBool("TlsEnable", false) {
+		tlsConfig, err := shared.NewClientTLSConfig(
+			conf.GetString("TlsCertificateLocation", ""),
+			conf.GetString("TlsKeyLocation", ""),
+			conf.GetString("TlsCaLocation", ""),
+			conf.GetString("TlsServerName", ""),
+			conf.GetBool("TlsInsecureSkipVerify", false))
+		if err != nil {
+			return err
+		}
+		if tlsConfig.ServerName == "" && !tlsConfig.InsecureSkipVerify {
+			tlsConfig.ServerName = host
+		}
+		cons.config.TLSConfig = tlsConfig
+	}
+
+	return nil
+}
+
+// pluginArgs returns the options of the START_REPLICATION command for the
+// configured plugin.
+func (cons *PostgresCDC) pluginArgs() []string {
+	if cons.plugin == postgresPluginWal2json {
+		return []string{`"format-version" '2'`, `"include-xids" '1'`, `"include-timestamp" '1'`}
+	}
+
+	names := make([]string, len(cons.publications))
+	for i, publication := range cons.publications {
+		names[i] = quotePostgresIdentifier(publication)
+	}
+	return []string{"proto_version '1'", "publication_names " + quotePostgresLiteral(strings.Join(names, ","))}
+}
+
+func (cons *PostgresCDC) connect() (*pgconn.PgConn, error) {
+	ctx, cancel := context.WithTimeout(cons.ctx, postgresTimeout)
+	defer cancel()
+
+	conn, err := pgconn.ConnectConfig(ctx, cons.config)
+	if err != nil {
+		return nil, err // ### return, connection failed ###
+	}
+
+	slot := quotePostgresIdentifier(cons.slot)
+	if cons.createSlot {
+		_, err := pglogrepl.CreateReplicationSlot(ctx, conn, slot, cons.plugin, pglogrepl.CreateReplicationSlotOptions{})
+		var pgErr *pgconn.PgError
+		if err != nil && (!errors.As(err, &pgErr) || pgErr.Code != postgresDuplicateCode) {
+			conn.Close(ctx)
+			return nil, fmt.Errorf("Failed to create slot %s: %s", cons.slot, err)
+		}
+		if err == nil {
+			Log.Note.Printf("PostgresCDC created replication slot %s", cons.slot)
+		}
+	}
+
+	options := pglogrepl.StartReplicationOptions{PluginArgs: cons.pluginArgs()}
+	if err := pglogrepl.StartReplication(ctx, conn, slot, pglogrepl.LSN(cons.confirmed), options); err != nil {
+		conn.Close(ctx)
+		return nil, err // ### return, replication failed ###
+	}
+	return conn, nil
+}
+
+// confirm marks all changes up to the given WAL position as delivered.
+func (cons *PostgresCDC) confirm(lsn uint64) {
+	if lsn > cons.confirmed {
+		cons.confirmed = lsn
+	}
+}
+
+func (cons *PostgresCDC) enqueue(change postgresChange) {
+	data, err := json.Marshal(change)
+	if err != nil {
+		Log.Error.Printf("PostgresCDC failed to encode change at %s: %s", change.LSN, err)
+		return
+	}
+
+	msg := core.NewMessage(cons, data, cons.sequence)
+	cons.sequence++
+	msg.SetMetadata(postgresMetadataLSN, change.LSN)
+	msg.SetMetadata(postgresMetadataTable, change.Schema+"."+change.Table)
+	cons.EnqueueMessage(msg)
+}
+
+// sendStatus reports the confirmed position to the server.
+func (cons *PostgresCDC) sendStatus(conn *pgconn.PgConn) error {
+	status := pglogrepl.StandbyStatusUpdate{WALWritePosition: pglogrepl.LSN(cons.confirmed)}
+	return pglogrepl.SendStandbyStatusUpdate(context.Background(), conn, status)
+}
+
+// process handles a message of the replication stream.
+func (cons *PostgresCDC) process(conn *pgconn.PgConn, decoder postgresDecoder, data []byte) error {
+	if len(data) == 0 {
+		return fmt.Errorf("Empty replication message")
+	}
+
+	switch data[0] {
+	case pglogrepl.XLogDataByteID:
+		xlog, err := pglogrepl.ParseXLogData(data[1:])
+		if err != nil {
+			return err
+		}
+		changes, commit, err := decoder.decode(uint64(xlog.WALStart), xlog.WALData)
+		if err != nil {
+			return fmt.Errorf("Failed to decode change at %s: %s", xlog.WALStart, err)
+		}
+
+		for _, change := range changes {
+			cons.WaitOnFuse()
+			cons.enqueue(change)
+		}
+		if commit {
+			cons.confirm(uint64(xlog.WALStart))
+		}
+
+	case pglogrepl.PrimaryKeepaliveMessageByteID:
+		keepalive, err := pglogrepl.ParsePrimaryKeepaliveMessage(data[1:])
+		if err != nil {
+			return err
+		}
+		if !decoder.inTransaction() {
+			cons.confirm(uint64(keepalive.ServerWALEnd))
+		}
+		if keepalive.ReplyRequested {
+			return cons.sendStatus(conn)
+		}
+	}
+	return nil
+}
+
+// readChanges reads the replication stream until the connection is lost or
+// the consumer is stopped. The confirmed position is sent every
+// statusInterval.
+func (cons *PostgresCDC) readChanges(conn *pgconn.PgConn) error {
+	decoder := newPostgresDecoder(cons.plugin)
+	nextStatus := time.Now().Add(cons.statusInterval)
+	for {
+		if !time.Now().Before(nextStatus) {
+			if err := cons.sendStatus(conn); err != nil {
+				return err // ### return, connection lost ###
+			}
+			nextStatus = time.Now().Add(cons.statusInterval)
+		}
+
+		ctx, cancel := context.WithDeadline(cons.ctx, nextStatus)
+		msg, err := conn.ReceiveMessage(ctx)
+		cancel()
+		switch {
+		case err == nil:
+		case pgconn.Timeout(err):
+			continue // ### continue, status update due ###
+		case cons.ctx.Err() != nil:
+			return nil // ### return, stopping ###
+		default:
+			return err // ### return, connection lost ###
+		}
+
+		switch msg := msg.(type) {
+		case *pgproto3.CopyData:
+			if err := cons.process(conn, decoder, msg.Data); err != nil {
+				return err
+			}
+
+		case *pgproto3.ErrorResponse:
+			return pgconn.ErrorResponseToPgError(msg)
+
+		case *pgproto3.CopyDone:
+			return fmt.Errorf("Replication stream ended by server")
+		}
+	}
+}
+
+func (cons *PostgresCDC) consume() {
+	defer cons.WorkerDone()
+
+	for cons.IsActive() {
+		conn, err := cons.connect()
+		if err == nil {
+			err = cons.readChanges(conn)
+			cons.sendStatus(conn)
+
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			conn.Close(ctx)
+			cancel()
+		}
+
+		if !cons.IsActive() {
+			return // ### return, stopping ###
+		}
+		Log.Error.Printf("PostgresCDC connection to %s failed: %s", cons.address, err)
+
+		select {
+		case <-cons.ctx.Done():
+		case <-time.After(cons.retryDelay):
+		}
+	}
+}
+
+func (cons *PostgresCDC) close() {
+	cons.cancel()
+}
+
+// Consume starts streaming changes from the configured slot.
+func (cons *PostgresCDC) Consume(workers *sync.WaitGroup) {
+	cons.SetWorkerWaitGroup(workers)
+	cons.SetStopCallback(cons.close)
+
+	cons.AddWorker()
+	go shared.DontPanic(cons.consume)
+
+	cons.ControlLoop()
+}
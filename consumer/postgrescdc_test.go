@@ -0,0 +1,317 @@
+// Copyright 2015-2016 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumer
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/jackc/pgio"
+	"github.com/jackc/pgx/v5/pgproto3"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/shared"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func pgoutputTestString(message []byte, value string) []byte {
+	return append(append(message, value...), 0)
+}
+
+func pgoutputTestRelation() []byte {
+	message := []byte{'R'}
+	message = pgio.AppendUint32(message, 16384)
+	message = pgoutputTestString(message, "public")
+	message = pgoutputTestString(message, "users")
+	message = append(message, 'd')
+	message = pgio.AppendInt16(message, 3)
+	for _, column := range []struct {
+		name    string
+		typeOID uint32
+	}{{"id", postgresOIDInt4}, {"name", 25}, {"data", postgresOIDJSONB}} {
+		message = append(message, 0)
+		message = pgoutputTestString(message, column.name)
+		message = pgio.AppendUint32(message, column.typeOID)
+		message = pgio.AppendInt32(message, -1)
+	}
+	return message
+}
+
+func pgoutputTestTuple(message []byte, values ...interface{}) []byte {
+	message = pgio.AppendInt16(message, int16(len(values)))
+	for _, value := range values {
+		switch value := value.(type) {
+		case nil:
+			message = append(message, 'n')
+		case bool:
+			message = append(message, 'u')
+		case string:
+			message = append(message, 't')
+			message = pgio.AppendInt32(message, int32(len(value)))
+			message = append(message, value...)
+		}
+	}
+	return message
+}
+
+func pgoutputTestBegin(xid uint32) []byte {
+	epoch := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+	message := []byte{'B'}
+	message = pgio.AppendUint64(message, 0x20)
+	message = pgio.AppendInt64(message, int64(time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC).Sub(epoch)/time.Microsecond))
+	message = pgio.AppendUint32(message, xid)
+	return message
+}
+
+func pgoutputTestCommit() []byte {
+	message := []byte{'C', 0}
+	message = pgio.AppendUint64(message, 0x10)
+	message = pgio.AppendUint64(message, 0x20)
+	message = pgio.AppendInt64(message, 0)
+	return message
+}
+
+func TestPostgresPluginArgs(t *testing.T) {
+	expect := shared.NewExpect(t)
+
+	expect.Equal(`"my ""slot"""`, quotePostgresIdentifier(`my "slot"`))
+	expect.Equal(`'it''s'`, quotePostgresLiteral("it's"))
+
+	cons := PostgresCDC{plugin: postgresPluginPgoutput, publications: []string{"a", "it's"}}
+	expect.Equal([]string{"proto_version '1'", `publication_names '"a","it''s"'`}, cons.pluginArgs())
+
+	cons.plugin = postgresPluginWal2json
+	expect.Equal(3, len(cons.pluginArgs()))
+}
+
+func TestPgoutputDecoder(t *testing.T) {
+	expect := shared.NewExpect(t)
+	decoder := newPostgresDecoder(postgresPluginPgoutput)
+
+	_, _, err := decoder.decode(1, pgoutputTestRelation())
+	expect.NoError(err)
+	_, _, err = decoder.decode(2, pgoutputTestBegin(490))
+	expect.NoError(err)
+	expect.True(decoder.inTransaction())
+
+	insert := pgio.AppendUint32([]byte{'I'}, 16384)
+	insert = pgoutputTestTuple(append(insert, 'N'), "1", "alice", `{"a":1}`)
+	changes, commit, err := decoder.decode(3, insert)
+	expect.NoError(err)
+	expect.False(commit)
+	expect.Equal(1, len(changes))
+	expect.Equal("0/3", changes[0].LSN)
+	expect.Equal(uint32(490), changes[0].XID)
+	expect.Equal("2016-01-01T00:00:00Z", changes[0].CommitTime)
+	expect.Equal("insert", changes[0].Op)
+	expect.Equal(int64(1), changes[0].New["id"])
+	expect.Equal("alice", changes[0].New["name"])
+	expect.Equal(json.RawMessage(`{"a":1}`), changes[0].New["data"])
+	expect.Nil(changes[0].Old)
+
+	update := pgio.AppendUint32([]byte{'U'}, 16384)
+	update = pgoutputTestTuple(append(update, 'K'), "1", nil, nil)
+	update = pgoutputTestTuple(append(update, 'N'), "1", "bob", true)
+	changes, _, err = decoder.decode(4, update)
+	expect.NoError(err)
+	expect.Equal("update", changes[0].Op)
+	expect.Equal(map[string]interface{}{"id": int64(1)}, changes[0].Old)
+	expect.Equal(map[string]interface{}{"id": int64(1), "name": "bob"}, changes[0].New)
+
+	remove := pgio.AppendUint32([]byte{'D'}, 16384)
+	remove = pgoutputTestTuple(append(remove, 'O'), "1", "bob", nil)
+	changes, _, err = decoder.decode(5, remove)
+	expect.NoError(err)
+	expect.Equal("delete", changes[0].Op)
+	expect.Equal(map[string]interface{}{"id": int64(1), "name": "bob", "data": nil}, changes[0].Old)
+	expect.Nil(changes[0].New)
+
+	truncate := pgio.AppendUint32([]byte{'T'}, 1)
+	truncate = pgio.AppendUint32(append(truncate, 0), 16384)
+	changes, _, err = decoder.decode(6, truncate)
+	expect.NoError(err)
+	expect.Equal("truncate", changes[0].Op)
+	expect.Equal("users", changes[0].Table)
+
+	changes, commit, err = decoder.decode(7, pgoutputTestCommit())
+	expect.NoError(err)
+	expect.True(commit)
+	expect.Equal(0, len(changes))
+	expect.False(decoder.inTransaction())
+
+	unknown := pgio.AppendUint32([]byte{'I'}, 1)
+	unknown = pgoutputTestTuple(append(unknown, 'N'))
+	_, _, err = decoder.decode(8, unknown)
+	expect.NotNil(err)
+}
+
+func TestWal2jsonDecoder(t *testing.T) {
+	expect := shared.NewExpect(t)
+	decoder := newPostgresDecoder(postgresPluginWal2json)
+
+	_, _, err := decoder.decode(1, []byte(`{"action":"B","xid":491,"timestamp":"2016-01-01 00:00:00+00"}`))
+	expect.NoError(err)
+	expect.True(decoder.inTransaction())
+
+	changes, _, err := decoder.decode(2, []byte(`{"action":"U","schema":"public","table":"users",`+
+		`"columns":[{"name":"id","type":"integer","value":1},{"name":"name","type":"text","value":"bob"}],`+
+		`"identity":[{"name":"id","type":"integer","value":1}]}`))
+	expect.NoError(err)
+	expect.Equal(1, len(changes))
+	expect.Equal("update", changes[0].Op)
+	expect.Equal(uint32(491), changes[0].XID)
+	expect.Equal("2016-01-01 00:00:00+00", changes[0].CommitTime)
+	expect.Equal(map[string]interface{}{"id": json.Number("1")}, changes[0].Old)
+	expect.Equal(map[string]interface{}{"id": json.Number("1"), "name": "bob"}, changes[0].New)
+
+	changes, commit, err := decoder.decode(3, []byte(`{"action":"C"}`))
+	expect.NoError(err)
+	expect.True(commit)
+	expect.Equal(0, len(changes))
+
+	_, _, err = decoder.decode(4, []byte(`{"action":"X"}`))
+	expect.NotNil(err)
+}
+
+// fakePostgres accepts a single replication connection, authenticates it
+// with MD5, streams the given messages and records the confirmed positions.
+func fakePostgres(expect shared.Expect, messages [][]byte, confirmed chan<- uint64) net.Listener {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	expect.NoError(err)
+
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		backend := pgproto3.NewBackend(conn, conn)
+
+		if _, err := backend.ReceiveStartupMessage(); err != nil {
+			return
+		}
+		backend.Send(&pgproto3.AuthenticationMD5Password{Salt: [4]byte{'s', 'a', 'l', 't'}})
+		backend.Flush()
+		backend.SetAuthType(pgproto3.AuthTypeMD5Password)
+		msg, _ := backend.Receive()
+		inner := md5.Sum([]byte("secretgollum"))
+		outer := md5.Sum([]byte(hex.EncodeToString(inner[:]) + "salt"))
+		if password, isPassword := msg.(*pgproto3.PasswordMessage); !isPassword || password.Password != "md5"+hex.EncodeToString(outer[:]) {
+			backend.Send(&pgproto3.ErrorResponse{Severity: "FATAL", Code: "28P01", Message: "password authentication failed"})
+			backend.Flush()
+			return
+		}
+		backend.Send(&pgproto3.AuthenticationOk{})
+		backend.Send(&pgproto3.ReadyForQuery{TxStatus: 'I'})
+		backend.Flush()
+
+		// CREATE_REPLICATION_SLOT fails as the slot exists
+		backend.Receive()
+		backend.Send(&pgproto3.ErrorResponse{Severity: "ERROR", Code: "42710", Message: `replication slot "gollum" already exists`})
+		backend.Send(&pgproto3.ReadyForQuery{TxStatus: 'I'})
+		backend.Flush()
+
+		// START_REPLICATION
+		msg, _ = backend.Receive()
+		if query, isQuery := msg.(*pgproto3.Query); !isQuery || query.String != `START_REPLICATION SLOT "gollum" LOGICAL 0/0 (proto_version '1', publication_names '"gollum"')` {
+			backend.Send(&pgproto3.ErrorResponse{Severity: "ERROR", Code: "42601", Message: "syntax error"})
+			backend.Flush()
+			return
+		}
+		backend.Send(&pgproto3.CopyBothResponse{})
+
+		for i, message := range messages {
+			data := pgio.AppendUint64([]byte{'w'}, uint64(0x100+i))
+			data = pgio.AppendUint64(data, uint64(0x100+i))
+			data = pgio.AppendInt64(data, 0)
+			backend.Send(&pgproto3.CopyData{Data: append(data, message...)})
+		}
+		backend.Flush()
+
+		for {
+			msg, err := backend.Receive()
+			if err != nil {
+				return
+			}
+			switch msg := msg.(type) {
+			case *pgproto3.Terminate:
+				return
+			case *pgproto3.CopyData:
+				if msg.Data[0] == 'r' {
+					confirmed <- binary.BigEndian.Uint64(msg.Data[9:17])
+				}
+			}
+		}
+	}()
+	return listener
+}
+
+func TestPostgresCDC(t *testing.T) {
+	expect := shared.NewExpect(t)
+
+	insert := pgio.AppendUint32([]byte{'I'}, 16384)
+	insert = pgoutputTestTuple(append(insert, 'N'), "1", "alice", nil)
+
+	confirmed := make(chan uint64, 100)
+	listener := fakePostgres(expect, [][]byte{
+		pgoutputTestRelation(),
+		pgoutputTestBegin(490),
+		insert,
+		pgoutputTestCommit(),
+	}, confirmed)
+	defer listener.Close()
+
+	stream := &mockHTTPStream{}
+	core.StreamRegistry.Register(stream, core.GetStreamID("postgres"))
+	conf := core.NewPluginConfig("")
+	conf.Stream = []string{"postgres"}
+	conf.Override("Address", listener.Addr().String())
+	conf.Override("User", "gollum")
+	conf.Override("Password", "secret")
+	conf.Override("StatusIntervalSec", 1)
+	plugin, err := core.NewPluginWithType("consumer.PostgresCDC", conf)
+	expect.NoError(err)
+	cons, casted := plugin.(*PostgresCDC)
+	expect.True(casted)
+
+	workers := new(sync.WaitGroup)
+	go cons.Consume(workers)
+
+	expect.NonBlocking(5*time.Second, func() {
+		for lsn := range confirmed {
+			if lsn == 0x103 {
+				return
+			}
+		}
+	})
+
+	cons.Control() <- core.PluginControlStopConsumer
+	expect.NonBlocking(2*time.Second, workers.Wait)
+
+	expect.Equal(1, stream.count())
+	msg := stream.messages[0]
+	expect.Equal("0/102", msg.Metadata[postgresMetadataLSN])
+	expect.Equal("public.users", msg.Metadata[postgresMetadataTable])
+
+	change := map[string]interface{}{}
+	expect.NoError(json.Unmarshal(msg.Data, &change))
+	expect.Equal("insert", change["op"])
+	expect.Equal(float64(490), change["xid"])
+	expect.Equal(map[string]interface{}{"id": float64(1), "name": "alice", "data": nil}, change["new"])
+	expect.Nil(change["old"])
+}
@@ -0,0 +1,319 @@
+// Copyright 2015-2016 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumer
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/jackc/pglogrepl"
+	"strconv"
+	"time"
+)
+
+// Output plugins supported by the PostgresCDC consumer
+const (
+	postgresPluginPgoutput = "pgoutput"
+	postgresPluginWal2json = "wal2json"
+)
+
+// Type OIDs converted to JSON types other than strings
+const (
+	postgresOIDBool    = 16
+	postgresOIDInt8    = 20
+	postgresOIDInt2    = 21
+	postgresOIDInt4    = 23
+	postgresOIDOID     = 26
+	postgresOIDJSON    = 114
+	postgresOIDFloat4  = 700
+	postgresOIDFloat8  = 701
+	postgresOIDNumeric = 1700
+	postgresOIDJSONB   = 3802
+)
+
+// postgresChange is a single row change emitted by the PostgresCDC consumer.
+// Old is only set for updates and deletes if the replica identity of the
+// table provides the old values.
+type postgresChange struct {
+	LSN        string                 `json:"lsn"`
+	XID        uint32                 `json:"xid"`
+	CommitTime string                 `json:"commit_time,omitempty"`
+	Schema     string                 `json:"schema"`
+	Table      string                 `json:"table"`
+	Op         string                 `json:"op"`
+	Old        map[string]interface{} `json:"old"`
+	New        map[string]interface{} `json:"new"`
+}
+
+// postgresDecoder decodes the messages of a logical decoding output plugin.
+// decode returns the changes contained in a message and whether the message
+// completed a transaction.
+type postgresDecoder interface {
+	decode(lsn uint64, data []byte) ([]postgresChange, bool, error)
+	inTransaction() bool
+}
+
+// pgoutputDecoder decodes messages of the pgoutput plugin (protocol
+// version 1) built into PostgreSQL 10 and newer.
+type pgoutputDecoder struct {
+	relations  map[uint32]*pglogrepl.RelationMessage
+	xid        uint32
+	commitTime time.Time
+	active     bool
+}
+
+// wal2jsonDecoder decodes messages of the wal2json plugin using
+// format-version 2, i.e. one JSON document per change.
+type wal2jsonDecoder struct {
+	xid        uint32
+	commitTime string
+	active     bool
+}
+
+func newPostgresDecoder(plugin string) postgresDecoder {
+	if plugin == postgresPluginWal2json {
+		return &wal2jsonDecoder{}
+	}
+	return &pgoutputDecoder{relations: make(map[uint32]*pglogrepl.RelationMessage)}
+}
+
+// postgresValue converts the text representation of a value to a JSON
+// compatible value based on its type.
+func postgresValue(typeOID uint32, value string) interface{} {
+	switch typeOID {
+	case postgresOIDBool:
+		return value == "t"
+
+	case postgresOIDInt2, postgresOIDInt4, postgresOIDInt8, postgresOIDOID:
+		if number, err := strconv.ParseInt(value, 10, 64); err == nil {
+			return number
+		}
+
+	case postgresOIDFloat4, postgresOIDFloat8, postgresOIDNumeric:
+		// NaN and Infinity cannot be represented as JSON numbers
+		if _, err := strconv.ParseFloat(value, 64); err == nil {
+			return json.Number(value)
+		}
+
+	case postgresOIDJSON, postgresOIDJSONB:
+		if json.Valid([]byte(value)) {
+			return json.RawMessage(value)
+		}
+	}
+	return value
+}
+
+func (decoder *pgoutputDecoder) inTransaction() bool {
+	return decoder.active
+}
+
+// tuple converts a TupleData structure. Unchanged TOAST values are not
+// included. If keysOnly is set, NULL values are skipped as they denote
+// columns that are not part of the replica identity.
+func (decoder *pgoutputDecoder) tuple(data *pglogrepl.TupleData, relation *pglogrepl.RelationMessage, keysOnly bool) (map[string]interface{}, error) {
+	values := make(map[string]interface{})
+	for i, value := range data.Columns {
+		column := &pglogrepl.RelationMessageColumn{Name: fmt.Sprintf("column%d", i)}
+		if i < len(relation.Columns) {
+			column = relation.Columns[i]
+		}
+
+		switch value.DataType {
+		case pglogrepl.TupleDataTypeNull:
+			if !keysOnly {
+				values[column.Name] = nil
+			}
+		case pglogrepl.TupleDataTypeToast:
+			// Unchanged TOAST value, not sent by the server
+		case pglogrepl.TupleDataTypeText:
+			values[column.Name] = postgresValue(column.DataType, string(value.Data))
+		case pglogrepl.TupleDataTypeBinary:
+			values[column.Name] = append([]byte(nil), value.Data...)
+		default:
+			return nil, fmt.Errorf("Unknown tuple data kind %c", value.DataType)
+		}
+	}
+	return values, nil
+}
+
+// row creates the change of an insert, update or delete. Old values are
+// only converted if the message carries them.
+func (decoder *pgoutputDecoder) row(change postgresChange, relationID uint32, op string, oldType uint8, oldTuple, newTuple *pglogrepl.TupleData) ([]postgresChange, error) {
+	relation, known := decoder.relations[relationID]
+	if !known {
+		return nil, fmt.Errorf("Change for unknown relation")
+	}
+	change.Schema, change.Table, change.Op = relation.Namespace, relation.RelationName, op
+
+	var err error
+	if oldTuple != nil {
+		keysOnly := oldType == pglogrepl.UpdateMessageTupleTypeKey
+		if change.Old, err = decoder.tuple(oldTuple, relation, keysOnly); err != nil {
+			return nil, err
+		}
+	}
+	if newTuple != nil {
+		if change.New, err = decoder.tuple(newTuple, relation, false); err != nil {
+			return nil, err
+		}
+	}
+	return []postgresChange{change}, nil
+}
+
+func (decoder *pgoutputDecoder) decode(lsn uint64, data []byte) ([]postgresChange, bool, error) {
+	if len(data) == 0 {
+		return nil, false, fmt.Errorf("Empty pgoutput message")
+	}
+	message, err := pglogrepl.Parse(data)
+	if err != nil {
+		return nil, false, err
+	}
+
+	change := postgresChange{
+		LSN: pglogrepl.LSN(lsn).String(),
+		XID: decoder.xid,
+	}
+	if !decoder.commitTime.IsZero() {
+		change.CommitTime = decoder.commitTime.Format(time.RFC3339Nano)
+	}
+
+	switch message := message.(type) {
+	case *pglogrepl.BeginMessage:
+		decoder.commitTime = message.CommitTime.UTC()
+		decoder.xid = message.Xid
+		decoder.active = true
+
+	case *pglogrepl.CommitMessage:
+		decoder.active = false
+		decoder.xid = 0
+		decoder.commitTime = time.Time{}
+		return nil, true, nil
+
+	case *pglogrepl.RelationMessage:
+		decoder.relations[message.RelationID] = message
+
+	case *pglogrepl.InsertMessage:
+		changes, err := decoder.row(change, message.RelationID, "insert", 0, nil, message.Tuple)
+		return changes, false, err
+
+	case *pglogrepl.UpdateMessage:
+		changes, err := decoder.row(change, message.RelationID, "update", message.OldTupleType, message.OldTuple, message.NewTuple)
+		return changes, false, err
+
+	case *pglogrepl.DeleteMessage:
+		changes, err := decoder.row(change, message.RelationID, "delete", message.OldTupleType, message.OldTuple, nil)
+		return changes, false, err
+
+	case *pglogrepl.TruncateMessage:
+		var changes []postgresChange
+		for _, relationID := range message.RelationIDs {
+			relation, known := decoder.relations[relationID]
+			if !known {
+				return nil, false, fmt.Errorf("Truncate of unknown relation")
+			}
+			change.Schema, change.Table, change.Op = relation.Namespace, relation.RelationName, "truncate"
+			changes = append(changes, change)
+		}
+		return changes, false, nil
+
+	default:
+		// Origin, type and logical decoding messages are not emitted
+	}
+
+	return nil, false, nil
+}
+
+func (decoder *wal2jsonDecoder) inTransaction() bool {
+	return decoder.active
+}
+
+func (decoder *wal2jsonDecoder) decode(lsn uint64, message []byte) ([]postgresChange, bool, error) {
+	type wal2jsonColumn struct {
+		Name  string      `json:"name"`
+		Value interface{} `json:"value"`
+	}
+	document := struct {
+		Action    string           `json:"action"`
+		XID       uint32           `json:"xid"`
+		Timestamp string           `json:"timestamp"`
+		Schema    string           `json:"schema"`
+		Table     string           `json:"table"`
+		Columns   []wal2jsonColumn `json:"columns"`
+		Identity  []wal2jsonColumn `json:"identity"`
+	}{}
+
+	parser := json.NewDecoder(bytes.NewReader(message))
+	parser.UseNumber()
+	if err := parser.Decode(&document); err != nil {
+		return nil, false, err
+	}
+
+	values := func(columns []wal2jsonColumn) map[string]interface{} {
+		if columns == nil {
+			return nil
+		}
+		result := make(map[string]interface{}, len(columns))
+		for _, column := range columns {
+			result[column.Name] = column.Value
+		}
+		return result
+	}
+
+	change := postgresChange{
+		LSN:        pglogrepl.LSN(lsn).String(),
+		XID:        decoder.xid,
+		CommitTime: decoder.commitTime,
+		Schema:     document.Schema,
+		Table:      document.Table,
+	}
+
+	switch document.Action {
+	case "B":
+		decoder.xid = document.XID
+		decoder.commitTime = document.Timestamp
+		decoder.active = true
+		return nil, false, nil
+
+	case "C":
+		decoder.xid = 0
+		decoder.commitTime = ""
+		decoder.active = false
+		return nil, true, nil
+
+	case "I":
+		change.Op = "insert"
+		change.New = values(document.Columns)
+
+	case "U":
+		change.Op = "update"
+		change.Old = values(document.Identity)
+		change.New = values(document.Columns)
+
+	case "D":
+		change.Op = "delete"
+		change.Old = values(document.Identity)
+
+	case "T":
+		change.Op = "truncate"
+
+	case "M":
+		return nil, false, nil // ### return, logical decoding message ###
+
+	default:
+		return nil, false, fmt.Errorf("Unknown wal2json action %s", document.Action)
+	}
+
+	return []postgresChange{change}, false, nil
+}
@@ -0,0 +1,246 @@
+// Copyright 2015-2016 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumer
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/trivago/gollum/shared"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+const (
+	prometheusLabelAddress     = "__address__"
+	prometheusLabelScheme      = "__scheme__"
+	prometheusLabelMetricsPath = "__metrics_path__"
+	prometheusLabelParamPrefix = "__param_"
+	prometheusLabelJob         = "job"
+	prometheusLabelInstance    = "instance"
+)
+
+// prometheusRelabelRule is a relabeling step of a scrape target, following
+// the relabel_configs of Prometheus.
+type prometheusRelabelRule struct {
+	sourceLabels []string
+	separator    string
+	regex        *regexp.Regexp
+	targetLabel  string
+	replacement  string
+	action       string
+}
+
+// parsePrometheusRelabelRules parses a list of relabel rules. Each rule is a
+// map with the keys "SourceLabels", "Separator", "Regex", "TargetLabel",
+// "Replacement" and "Action".
+func parsePrometheusRelabelRules(value interface{}) ([]prometheusRelabelRule, error) {
+	entries, isList := value.([]interface{})
+	if !isList {
+		return nil, fmt.Errorf("Relabel must be a list")
+	}
+
+	rules := []prometheusRelabelRule{}
+	for i, entry := range entries {
+		options, err := shared.MarshalMap{"entry": entry}.MarshalMap("entry")
+		if err != nil {
+			return nil, fmt.Errorf("Relabel rule %d must be a map", i)
+		}
+		option := func(key, defaultValue string) string {
+			if value, err := options.String(key); err == nil {
+				return value
+			}
+			return defaultValue
+		}
+
+		rule := prometheusRelabelRule{
+			separator:   option("Separator", ";"),
+			targetLabel: option("TargetLabel", ""),
+			replacement: option("Replacement", "$1"),
+			action:      strings.ToLower(option("Action", "replace")),
+		}
+		if _, exists := options["SourceLabels"]; exists {
+			if rule.sourceLabels, err = options.StringArray("SourceLabels"); err != nil {
+				return nil, fmt.Errorf("SourceLabels of relabel rule %d must be a list", i)
+			}
+		}
+		if rule.regex, err = regexp.Compile("^(?:" + option("Regex", "(.*)") + ")$"); err != nil {
+			return nil, fmt.Errorf("Invalid regex in relabel rule %d: %s", i, err)
+		}
+
+		switch rule.action {
+		case "replace":
+			if rule.targetLabel == "" {
+				return nil, fmt.Errorf("Relabel rule %d requires a TargetLabel", i)
+			}
+		case "keep", "drop", "labelmap", "labeldrop", "labelkeep":
+		default:
+			return nil, fmt.Errorf("Unknown relabel action: %s", rule.action)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// apply modifies the given labels and returns false if the target is
+// dropped.
+func (rule prometheusRelabelRule) apply(labels map[string]string) bool {
+	values := make([]string, len(rule.sourceLabels))
+	for i, name := range rule.sourceLabels {
+		values[i] = labels[name]
+	}
+	value := strings.Join(values, rule.separator)
+
+	switch rule.action {
+	case "keep":
+		return rule.regex.MatchString(value)
+
+	case "drop":
+		return !rule.regex.MatchString(value)
+
+	case "replace":
+		match := rule.regex.FindStringSubmatchIndex(value)
+		if match == nil {
+			return true // ### return, no match ###
+		}
+		target := string(rule.regex.ExpandString(nil, rule.targetLabel, value, match))
+		result := string(rule.regex.ExpandString(nil, rule.replacement, value, match))
+		if result == "" {
+			delete(labels, target)
+		} else {
+			labels[target] = result
+		}
+
+	case "labelmap":
+		mapped := make(map[string]string)
+		for name, value := range labels {
+			if match := rule.regex.FindStringSubmatchIndex(name); match != nil {
+				mapped[string(rule.regex.ExpandString(nil, rule.replacement, name, match))] = value
+			}
+		}
+		for name, value := range mapped {
+			labels[name] = value
+		}
+
+	case "labeldrop", "labelkeep":
+		for name := range labels {
+			if rule.regex.MatchString(name) == (rule.action == "labeldrop") {
+				delete(labels, name)
+			}
+		}
+	}
+	return true
+}
+
+// relabelPrometheusTarget applies all rules to the labels of a target. False
+// is returned if the target is dropped.
+func relabelPrometheusTarget(labels map[string]string, rules []prometheusRelabelRule) bool {
+	for _, rule := range rules {
+		if !rule.apply(labels) {
+			return false // ### return, target dropped ###
+		}
+	}
+	return true
+}
+
+// escapePrometheusLabelValue escapes a label value of the text exposition
+// format.
+func escapePrometheusLabelValue(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+// injectPrometheusLabels adds the given labels to all samples of an
+// exposition in the text format. Labels of a sample that conflict with an
+// added label are renamed to "exported_<name>", like Prometheus does.
+func injectPrometheusLabels(exposition []byte, labels map[string]string) []byte {
+	if len(labels) == 0 {
+		return exposition // ### return, nothing to add ###
+	}
+
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	added := make([]string, len(names))
+	for i, name := range names {
+		added[i] = name + `="` + escapePrometheusLabelValue(labels[name]) + `"`
+	}
+
+	result := bytes.NewBuffer(make([]byte, 0, len(exposition)+len(exposition)/2))
+	for _, line := range bytes.SplitAfter(exposition, []byte("\n")) {
+		trimmed := bytes.TrimLeft(line, " \t")
+		if len(bytes.TrimSpace(trimmed)) == 0 || trimmed[0] == '#' {
+			result.Write(line)
+			continue // ### continue, not a sample ###
+		}
+
+		nameEnd := bytes.IndexAny(trimmed, "{ \t")
+		if nameEnd < 0 {
+			result.Write(line)
+			continue // ### continue, malformed sample ###
+		}
+
+		sampleLabels, rest := []string{}, trimmed[nameEnd:]
+		if trimmed[nameEnd] == '{' {
+			var valid bool
+			if sampleLabels, rest, valid = splitPrometheusLabels(trimmed[nameEnd+1:]); !valid {
+				result.Write(line)
+				continue // ### continue, malformed labels ###
+			}
+			for i, label := range sampleLabels {
+				name := strings.TrimSpace(label[:strings.Index(label, "=")])
+				if _, conflicts := labels[name]; conflicts {
+					sampleLabels[i] = "exported_" + strings.TrimSpace(label)
+				}
+			}
+		}
+
+		result.Write(trimmed[:nameEnd])
+		result.WriteByte('{')
+		result.WriteString(strings.Join(append(sampleLabels, added...), ","))
+		result.WriteByte('}')
+		result.Write(rest)
+	}
+	return result.Bytes()
+}
+
+// splitPrometheusLabels splits the labels of a sample, starting after the
+// opening brace. The labels and the remainder after the closing brace are
+// returned.
+func splitPrometheusLabels(data []byte) ([]string, []byte, bool) {
+	labels := []string{}
+	start, quoted := 0, false
+	for i := 0; i < len(data); i++ {
+		switch {
+		case quoted && data[i] == '\\':
+			i++
+		case data[i] == '"':
+			quoted = !quoted
+		case !quoted && (data[i] == ',' || data[i] == '}'):
+			if label := strings.TrimSpace(string(data[start:i])); label != "" {
+				if !strings.Contains(label, "=") {
+					return nil, nil, false // ### return, missing value ###
+				}
+				labels = append(labels, label)
+			}
+			if data[i] == '}' {
+				return labels, data[i+1:], true // ### return, end of labels ###
+			}
+			start = i + 1
+		}
+	}
+	return nil, nil, false
+}
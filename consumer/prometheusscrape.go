@@ -0,0 +1,396 @@
+// Copyright 2015-2016 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumer
+
+import (
+	"context"
+	"fmt"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/core/log"
+	"github.com/trivago/gollum/shared"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	prometheusMetadataTarget      = "prometheus_target"
+	prometheusMetadataLabelPrefix = "prometheus_label_"
+	prometheusAcceptHeader        = "text/plain;version=0.0.4;q=1,*/*;q=0.1"
+)
+
+// PrometheusScrape consumer plugin
+// The PrometheusScrape consumer periodically scrapes metrics endpoints in the
+// Prometheus text exposition format and emits the exposition of each scrape
+// as one message.
+// Targets are configured like the static_configs and relabel_configs of a
+// Prometheus scrape job. Each target starts with the labels "__address__",
+// "__scheme__", "__metrics_path__" and "job" as well as the labels of its
+// group. Relabel rules can then modify these labels or drop targets. After
+// relabeling, the URL of a target is built from the address, scheme and
+// metrics path labels, labels starting with "__param_" are added as URL
+// parameters and "instance" is set to the address unless defined. Labels
+// starting with "__" are removed afterwards.
+// The URL of the target is attached to each message as "prometheus_target"
+// metadata. Each remaining label is attached as "prometheus_label_<name>".
+// When attached to a fuse, this consumer will stop scraping in case that
+// fuse is burned.
+// Configuration example
+//
+//  - "consumer.PrometheusScrape":
+//    Targets:
+//      - "localhost:9100"
+//    TargetGroups:
+//      - {Targets: ["db1:9104", "db2:9104"], Labels: {job: "mysql"}}
+//    Relabel:
+//      - {SourceLabels: ["__address__"], Regex: "([^:]+):.*", TargetLabel: "host"}
+//    Job: "gollum"
+//    Scheme: "http"
+//    MetricsPath: "/metrics"
+//    IntervalSec: 60
+//    TimeoutSec: 10
+//    InjectLabels: false
+//    MaxBodySizeByte: 10485760
+//    TlsKeyLocation: ""
+//    TlsCertificateLocation: ""
+//    TlsCaLocation: ""
+//    TlsServerName: ""
+//    TlsInsecureSkipVerify: false
+//
+// Targets defines a list of targets to scrape. Each target is either given
+// as "host:port" or as a URL including scheme and path, which overrides
+// Scheme and MetricsPath. By default this list is empty.
+//
+// TargetGroups defines a list of target groups. Each group is a map with the
+// keys "Targets" (a list of targets as above) and "Labels" (a map of labels
+// added to all targets of the group). By default this list is empty.
+//
+// Relabel defines a list of relabel rules applied to the labels of each
+// target in order. Each rule is a map with the following keys.
+// "Action" can be "replace", "keep", "drop", "labelmap", "labeldrop" or
+// "labelkeep" and is set to "replace" by default.
+// "SourceLabels" defines the labels whose values are joined by "Separator"
+// (";" by default) and matched against "Regex" ("(.*)" by default).
+// "TargetLabel" and "Replacement" ("$1" by default) define the label set
+// by replace rules, which may refer to capture groups of the regex.
+// By default this list is empty.
+//
+// Job defines the default value of the "job" label. By default this is set
+// to "gollum".
+//
+// Scheme defines the default scheme of targets. By default this is set to
+// "http".
+//
+// MetricsPath defines the default path of the metrics endpoint. By default
+// this is set to "/metrics".
+//
+// IntervalSec defines the number of seconds between two scrapes of a target.
+// By default this is set to 60.
+//
+// TimeoutSec defines the number of seconds after which a scrape is aborted.
+// The value is limited to IntervalSec. By default this is set to 10.
+//
+// InjectLabels can be set to true to add the labels of a target to all
+// samples of the exposition, like Prometheus does when storing them.
+// Conflicting labels of a sample are renamed to "exported_<name>".
+// By default this is set to false.
+//
+// MaxBodySizeByte defines the maximum size of an exposition. Scrapes of
+// larger expositions fail and are not sent. By default this is set to
+// 10485760 (10 MB).
+//
+// TlsKeyLocation defines the path to the client's private key (PEM) used
+// for authentication at https targets. By default this is set to "".
+//
+// TlsCertificateLocation defines the path to the client's public key (PEM)
+// used for authentication at https targets. By default this is set to "".
+//
+// TlsCaLocation defines the path to CA certificate(s) for verifying the
+// certificates of https targets. By default this is set to "", which uses
+// the certificate authorities of the system.
+//
+// TlsServerName is used to verify the hostname on the certificates of https
+// targets unless TlsInsecureSkipVerify is true. By default this is set to
+// "", which uses the host of each target.
+//
+// TlsInsecureSkipVerify controls whether to verify the certificate chain
+// and host name of https targets. By default this is set to false.
+type PrometheusScrape struct {
+	core.ConsumerBase
+	targets      []prometheusTarget
+	interval     time.Duration
+	timeout      time.Duration
+	injectLabels bool
+	maxBodySize  int
+	client       *http.Client
+	ctx          context.Context
+	cancel       context.CancelFunc
+	sequence     uint64
+}
+
+// prometheusTarget is a scrape target after relabeling.
+type prometheusTarget struct {
+	url    string
+	labels map[string]string
+}
+
+func init() {
+	shared.TypeRegistry.Register(PrometheusScrape{})
+}
+
+// Configure initializes this consumer with values from a plugin config.
+func (cons *PrometheusScrape) Configure(conf core.PluginConfig) error {
+	err := cons.ConsumerBase.Configure(conf)
+	if err != nil {
+		return err
+	}
+
+	cons.interval = time.Duration(shared.MaxI(conf.GetInt("IntervalSec", 60), 1)) * time.Second
+	cons.timeout = time.Duration(shared.MaxI(conf.GetInt("TimeoutSec", 10), 1)) * time.Second
+	if cons.timeout > cons.interval {
+		cons.timeout = cons.interval
+	}
+	cons.injectLabels = conf.GetBool("InjectLabels", false)
+	cons.maxBodySize = shared.MaxI(conf.GetInt("MaxBodySizeByte", 10485760), 1)
+
+	rules, err := parsePrometheusRelabelRules(conf.GetValue("Relabel", []interface{}{}))
+	if err != nil {
+		return err
+	}
+
+	defaults := map[string]string{
+		prometheusLabelJob:         conf.GetString("Job", "gollum"),
+		prometheusLabelScheme:      conf.GetString("Scheme", "http"),
+		prometheusLabelMetricsPath: conf.GetString("MetricsPath", "/metrics"),
+	}
+	groups := []prometheusTargetGroup{{targets: conf.GetStringArray("Targets", []string{})}}
+	moreGroups, err := parsePrometheusTargetGroups(conf.GetValue("TargetGroups", []interface{}{}))
+	if err != nil {
+		return err
+	}
+
+	for _, group := range append(groups, moreGroups...) {
+		for _, address := range group.targets {
+			labels, err := prometheusTargetLabels(address, defaults, group.labels)
+			if err != nil {
+				return err
+			}
+			if !relabelPrometheusTarget(labels, rules) {
+				continue // ### continue, target dropped ###
+			}
+			target, err := newPrometheusTarget(labels)
+			if err != nil {
+				return err
+			}
+			cons.targets = append(cons.targets, target)
+		}
+	}
+
+	tlsConfig, err := shared.NewClientTLSConfig(
+		conf.GetString("TlsCertificateLocation", ""),
+		conf.GetString("TlsKeyLocation", ""),
+		conf.GetString("TlsCaLocation", ""),
+		conf.GetString("TlsServerName", ""),
+		conf.GetBool("TlsInsecureSkipVerify", false))
+	if err != nil {
+		return err
+	}
+	cons.client = &http.Client{
+		Timeout:   cons.timeout,
+		Transport: &http.Transport{TLSClientConfig: tlsConfig, Proxy: http.ProxyFromEnvironment},
+	}
+
+	cons.ctx, cons.cancel = context.WithCancel(context.Background())
+	return nil
+}
+
+// prometheusTargetGroup is a list of targets sharing the same labels.
+type prometheusTargetGroup struct {
+	targets []string
+	labels  map[string]string
+}
+
+func parsePrometheusTargetGroups(value interface{}) ([]prometheusTargetGroup, error) {
+	entries, isList := value.([]interface{})
+	if !isList {
+		return nil, fmt.Errorf("TargetGroups must be a list")
+	}
+
+	groups := []prometheusTargetGroup{}
+	for i, entry := range entries {
+		options, err := shared.MarshalMap{"entry": entry}.MarshalMap("entry")
+		if err != nil {
+			return nil, fmt.Errorf("Target group %d must be a map", i)
+		}
+		group := prometheusTargetGroup{labels: map[string]string{}}
+		if group.targets, err = options.StringArray("Targets"); err != nil {
+			return nil, fmt.Errorf("Target group %d requires a list of Targets", i)
+		}
+		if _, exists := options["Labels"]; exists {
+			if group.labels, err = options.StringMap("Labels"); err != nil {
+				return nil, fmt.Errorf("Labels of target group %d must be a map", i)
+			}
+		}
+		groups = append(groups, group)
+	}
+	return groups, nil
+}
+
+// prometheusTargetLabels returns the labels of a target before relabeling.
+func prometheusTargetLabels(address string, defaults, groupLabels map[string]string) (map[string]string, error) {
+	labels := make(map[string]string)
+	for name, value := range defaults {
+		labels[name] = value
+	}
+	for name, value := range groupLabels {
+		labels[name] = value
+	}
+
+	if !strings.Contains(address, "://") {
+		labels[prometheusLabelAddress] = address
+		return labels, nil // ### return, host and port ###
+	}
+
+	targetURL, err := url.Parse(address)
+	if err != nil || targetURL.Host == "" {
+		return nil, fmt.Errorf("Invalid target %s", address)
+	}
+	labels[prometheusLabelAddress] = targetURL.Host
+	labels[prometheusLabelScheme] = targetURL.Scheme
+	if targetURL.Path != "" {
+		labels[prometheusLabelMetricsPath] = targetURL.Path
+	}
+	for name, values := range targetURL.Query() {
+		labels[prometheusLabelParamPrefix+name] = values[0]
+	}
+	return labels, nil
+}
+
+// newPrometheusTarget builds the URL of a target from its relabeled labels
+// and removes all internal labels.
+func newPrometheusTarget(labels map[string]string) (prometheusTarget, error) {
+	address := labels[prometheusLabelAddress]
+	if address == "" {
+		return prometheusTarget{}, fmt.Errorf("Target without %s label", prometheusLabelAddress)
+	}
+
+	targetURL := url.URL{
+		Scheme: labels[prometheusLabelScheme],
+		Host:   address,
+		Path:   labels[prometheusLabelMetricsPath],
+	}
+	params := url.Values{}
+	for name, value := range labels {
+		if strings.HasPrefix(name, prometheusLabelParamPrefix) {
+			params.Set(strings.TrimPrefix(name, prometheusLabelParamPrefix), value)
+		}
+		if strings.HasPrefix(name, "__") {
+			delete(labels, name)
+		}
+	}
+	targetURL.RawQuery = params.Encode()
+
+	if _, exists := labels[prometheusLabelInstance]; !exists {
+		labels[prometheusLabelInstance] = address
+	}
+	return prometheusTarget{url: targetURL.String(), labels: labels}, nil
+}
+
+func (cons *PrometheusScrape) scrape(target prometheusTarget) error {
+	req, err := http.NewRequest("GET", target.url, nil)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(cons.ctx)
+	req.Header.Set("Accept", prometheusAcceptHeader)
+	req.Header.Set("X-Prometheus-Scrape-Timeout-Seconds", strconv.FormatFloat(cons.timeout.Seconds(), 'f', -1, 64))
+
+	response, err := cons.client.Do(req)
+	if err != nil {
+		return err // ### return, request failed ###
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		message, _ := ioutil.ReadAll(io.LimitReader(response.Body, 1024))
+		return fmt.Errorf("Scrape returned %s: %s", response.Status, strings.TrimSpace(string(message)))
+	}
+	exposition, err := ioutil.ReadAll(io.LimitReader(response.Body, int64(cons.maxBodySize)+1))
+	if err != nil {
+		return err
+	}
+	if len(exposition) > cons.maxBodySize {
+		return fmt.Errorf("Exposition exceeds %d bytes", cons.maxBodySize)
+	}
+
+	if cons.injectLabels {
+		exposition = injectPrometheusLabels(exposition, target.labels)
+	}
+
+	msg := core.NewMessage(cons, exposition, atomic.AddUint64(&cons.sequence, 1))
+	msg.SetMetadata(prometheusMetadataTarget, target.url)
+	for name, value := range target.labels {
+		msg.SetMetadata(prometheusMetadataLabelPrefix+name, value)
+	}
+	cons.EnqueueMessage(msg)
+	return nil
+}
+
+func (cons *PrometheusScrape) run(target prometheusTarget) {
+	defer cons.WorkerDone()
+
+	ticker := time.NewTicker(cons.interval)
+	defer ticker.Stop()
+	for {
+		cons.WaitOnFuse()
+		if err := cons.scrape(target); err != nil && cons.ctx.Err() == nil {
+			Log.Warning.Printf("PrometheusScrape failed to scrape %s: %s", target.url, err)
+		}
+
+		select {
+		case <-cons.ctx.Done():
+			return // ### return, stopped ###
+		case <-ticker.C:
+		}
+	}
+}
+
+func (cons *PrometheusScrape) close() {
+	cons.cancel()
+}
+
+// Consume starts scraping all targets.
+func (cons *PrometheusScrape) Consume(workers *sync.WaitGroup) {
+	cons.SetWorkerWaitGroup(workers)
+	cons.SetStopCallback(cons.close)
+
+	if len(cons.targets) == 0 {
+		Log.Warning.Print("PrometheusScrape has no targets to scrape")
+	}
+
+	for _, target := range cons.targets {
+		cons.AddWorker()
+		target := target
+		go shared.DontPanic(func() { cons.run(target) })
+	}
+
+	cons.ControlLoop()
+}
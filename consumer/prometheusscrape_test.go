@@ -0,0 +1,163 @@
+// Copyright 2015-2016 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumer
+
+import (
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/shared"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPrometheusRelabel(t *testing.T) {
+	expect := shared.NewExpect(t)
+
+	rules, err := parsePrometheusRelabelRules([]interface{}{
+		map[interface{}]interface{}{
+			"SourceLabels": []interface{}{"__address__"},
+			"Regex":        "([^:]+):.*",
+			"TargetLabel":  "host",
+		},
+		map[interface{}]interface{}{
+			"Action":       "drop",
+			"SourceLabels": []interface{}{"job", "host"},
+			"Regex":        "node;db.*",
+		},
+		map[interface{}]interface{}{
+			"Action":      "labelmap",
+			"Regex":       "meta_(.+)",
+			"Replacement": "${1}_label",
+		},
+		map[interface{}]interface{}{
+			"Action": "labeldrop",
+			"Regex":  "meta_.*",
+		},
+	})
+	expect.NoError(err)
+
+	labels := map[string]string{"__address__": "web1:9100", "job": "node", "meta_zone": "eu"}
+	expect.True(relabelPrometheusTarget(labels, rules))
+	expect.Equal(map[string]string{"__address__": "web1:9100", "job": "node", "host": "web1", "zone_label": "eu"}, labels)
+
+	labels = map[string]string{"__address__": "db1:9100", "job": "node"}
+	expect.False(relabelPrometheusTarget(labels, rules))
+
+	_, err = parsePrometheusRelabelRules([]interface{}{map[interface{}]interface{}{"Action": "replace"}})
+	expect.NotNil(err)
+	_, err = parsePrometheusRelabelRules([]interface{}{map[interface{}]interface{}{"Action": "hashmod"}})
+	expect.NotNil(err)
+	_, err = parsePrometheusRelabelRules([]interface{}{map[interface{}]interface{}{"Action": "keep", "Regex": "("}})
+	expect.NotNil(err)
+}
+
+func TestPrometheusInjectLabels(t *testing.T) {
+	expect := shared.NewExpect(t)
+
+	exposition := "# HELP up Target state\n# TYPE up gauge\nup 1\n" +
+		"http_requests_total{code=\"200\",job=\"app\"} 1027 1395066363000\n" +
+		"msg{text=\"a } , \\\" b\",} 1\n\n"
+	labels := map[string]string{"job": "node", "instance": "web1:9100"}
+
+	expect.Equal("# HELP up Target state\n# TYPE up gauge\nup{instance=\"web1:9100\",job=\"node\"} 1\n"+
+		"http_requests_total{code=\"200\",exported_job=\"app\",instance=\"web1:9100\",job=\"node\"} 1027 1395066363000\n"+
+		"msg{text=\"a } , \\\" b\",instance=\"web1:9100\",job=\"node\"} 1\n\n",
+		string(injectPrometheusLabels([]byte(exposition), labels)))
+
+	expect.Equal("broken{a=\"1\" 2\n", string(injectPrometheusLabels([]byte("broken{a=\"1\" 2\n"), labels)))
+}
+
+func TestPrometheusScrape(t *testing.T) {
+	expect := shared.NewExpect(t)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/probe" || r.URL.Query().Get("module") != "http" || !strings.HasPrefix(r.Header.Get("Accept"), "text/plain") {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte("# TYPE up gauge\nup 1\n"))
+	}))
+	defer server.Close()
+	address := strings.TrimPrefix(server.URL, "http://")
+
+	stream := &mockHTTPStream{}
+	core.StreamRegistry.Register(stream, core.GetStreamID("prometheus"))
+	conf := core.NewPluginConfig("")
+	conf.Stream = []string{"prometheus"}
+	conf.Override("Targets", []string{server.URL + "/probe?module=http"})
+	conf.Override("TargetGroups", []interface{}{
+		map[interface{}]interface{}{
+			"Targets": []interface{}{address, "dropped:9100"},
+			"Labels":  map[interface{}]interface{}{"job": "blackbox"},
+		},
+	})
+	conf.Override("Relabel", []interface{}{
+		map[interface{}]interface{}{"Action": "drop", "SourceLabels": []interface{}{"__address__"}, "Regex": "dropped:.*"},
+		map[interface{}]interface{}{"SourceLabels": []interface{}{"job"}, "Regex": "blackbox", "TargetLabel": "__metrics_path__", "Replacement": "/probe"},
+		map[interface{}]interface{}{"Regex": ".*", "TargetLabel": "__param_module", "Replacement": "http"},
+	})
+	conf.Override("InjectLabels", true)
+	plugin, err := core.NewPluginWithType("consumer.PrometheusScrape", conf)
+	expect.NoError(err)
+	cons := plugin.(*PrometheusScrape)
+	expect.Equal(2, len(cons.targets))
+
+	workers := new(sync.WaitGroup)
+	go cons.Consume(workers)
+
+	expect.NonBlocking(5*time.Second, func() {
+		for stream.count() < 2 {
+			time.Sleep(10 * time.Millisecond)
+		}
+	})
+	cons.Control() <- core.PluginControlStopConsumer
+	expect.NonBlocking(2*time.Second, workers.Wait)
+
+	stream.guard.Lock()
+	defer stream.guard.Unlock()
+	jobs := map[string]string{}
+	for _, msg := range stream.messages {
+		expect.Equal(server.URL+"/probe?module=http", msg.Metadata[prometheusMetadataTarget])
+		expect.Equal(address, msg.Metadata[prometheusMetadataLabelPrefix+"instance"])
+		jobs[msg.Metadata[prometheusMetadataLabelPrefix+"job"]] = string(msg.Data)
+	}
+	expect.Equal(map[string]string{
+		"gollum":   "# TYPE up gauge\nup{instance=\"" + address + "\",job=\"gollum\"} 1\n",
+		"blackbox": "# TYPE up gauge\nup{instance=\"" + address + "\",job=\"blackbox\"} 1\n",
+	}, jobs)
+}
+
+func TestPrometheusScrapeMaxBodySize(t *testing.T) {
+	expect := shared.NewExpect(t)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("# TYPE up gauge\nup 1\n"))
+	}))
+	defer server.Close()
+
+	conf := core.NewPluginConfig("")
+	conf.Override("Targets", []string{server.URL})
+	conf.Override("MaxBodySizeByte", 21)
+	plugin, err := core.NewPluginWithType("consumer.PrometheusScrape", conf)
+	expect.NoError(err)
+	cons := plugin.(*PrometheusScrape)
+	expect.NoError(cons.scrape(cons.targets[0]))
+
+	cons.maxBodySize = 20
+	expect.NotNil(cons.scrape(cons.targets[0]))
+}
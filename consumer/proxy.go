@@ -15,18 +15,29 @@
 package consumer
 
 import (
+	"crypto/tls"
 	"fmt"
 	"github.com/trivago/gollum/core"
 	"github.com/trivago/gollum/core/log"
 	"github.com/trivago/gollum/shared"
-	"io"
 	"net"
+	"os"
+	"regexp"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 )
 
 type proxyPartitioner int
 
+const (
+	proxyMetricConnections = "Proxy:Connections-"
+	proxyMetricRejected    = "Proxy:Rejected-"
+	proxyMetricThrottled   = "Proxy:Throttled-"
+	proxyMetricTimeouts    = "Proxy:Timeouts-"
+)
+
 const (
 	proxyPartDelimiter = proxyPartitioner(iota)
 	proxyPartBinary    = proxyPartitioner(iota)
@@ -44,15 +55,56 @@ const (
 //
 //  - "consumer.Proxy":
 //    Address: ":5880"
+//    SocketPermissions: "0770"
+//    SocketOwner: ""
+//    SocketGroup: ""
+//    RemoveOldSocket: true
 //    Partitioner: "delimiter"
 //    Delimiter: "\n"
+//    Pattern: ""
 //    Offset: 0
 //    Size: 1
+//    Certificate: ""
+//    PrivateKey: ""
+//    ClientCA: ""
+//    ClientStreams:
+//      "billing-service": "billing"
+//    SNIStreams:
+//      "app1.example.com": "app1"
+//      "*.example.com": "apps"
+//    AcceptProxyProtocol: false
+//    MaxConnections: 0
+//    MaxConnectionsPerIP: 0
+//    BytesPerSecondPerConnection: 0
+//    IdleTimeoutSec: 0
+//    ReadTimeoutSec: 0
+//    KeepAliveSec: 0
+//    AllowedOrigins: []
+//    MaxMessageSizeByte: 1048576
 //
 // Address defines the protocol, host and port or socket to bind to.
 // This can either be any ip address and port like "localhost:5880" or a file
 // like "unix:///var/gollum.socket". By default this is set to ":5880".
-// UDP is not supported.
+// A list of addresses can be given to accept connections on all of them, e.g.
+// [":5880", "[::1]:5881"]. All other settings apply to all addresses.
+// Sockets in the Linux abstract namespace can be used by prefixing the name
+// with "@", e.g. "unix://@gollum".
+// UDP is not supported, use consumer.UDPSocket instead.
+//
+// SocketPermissions sets the file permissions for "unix://" based connections
+// as an four digit octal number string. By default this is set to "0770".
+//
+// SocketOwner sets the user owning the socket file of "unix://" based
+// connections. Users can be given by name or numeric id. By default this is
+// set to "" which keeps the user running gollum.
+//
+// SocketGroup sets the group owning the socket file of "unix://" based
+// connections. Groups can be given by name or numeric id. By default this is
+// set to "" which keeps the primary group of the user running gollum.
+//
+// RemoveOldSocket toggles removing stale socket files with the same name as the
+// socket (unix://<path>) prior to connecting. Sockets still in use by another
+// process and files that are not sockets are never removed. Enabled by default.
 //
 // Partitioner defines the algorithm used to read messages from the stream.
 // The messages will be sent as a whole, no cropping or removal will take place.
@@ -64,25 +116,143 @@ const (
 //  * "binary" reads a binary number at a given offset and size.
 //  * "binary_le" is an alias for "binary".
 //  * "binary_be" is the same as "binary" but uses big endian encoding.
+//  * "varint" reads an unsigned varint (as used by protocol buffers) at a given
+//    offset.
 //  * "fixed" assumes fixed size messages.
+//  * "regex" starts a new message whenever the regular expression given by
+//    Pattern matches. A message is complete once the start of the next message
+//    has been received or the connection is closed.
+//  * "websocket" expects clients to connect via WebSocket. The HTTP upgrade
+//    handshake is done by the consumer (any path is accepted) and each
+//    WebSocket message is treated as one message. Responses are sent as
+//    WebSocket messages of the same type as the last message received.
+//    ReadTimeoutSec applies to the upgrade handshake only.
 //
 // Delimiter defines the delimiter used by the text and delimiter partitioner.
 // By default this is set to "\n".
 //
-// Offset defines the offset used by the binary and text partitioner.
+// Pattern defines the regular expression used by the regex partitioner to
+// find the start of a message, e.g. ^<\d+>\w{3} \d. The expression is
+// matched in multi-line mode, i.e. "^" matches the start of any line, and
+// must not match across lines. This setting is mandatory for the regex
+// partitioner.
+//
+// Offset defines the offset used by the binary, varint and text partitioner.
 // By default this is set to 0. This setting is ignored by the fixed partitioner.
 //
 // Size defines the size in bytes used by the binary or fixed partitioner.
 // For binary this can be set to 1,2,4 or 8. By default 4 is chosen.
 // For fixed this defines the size of a message. By default 1 is chosen.
+//
+// Certificate defines a path to a PEM encoded certificate file to make this
+// consumer accept TLS connections only. Left empty by default (disabled).
+// If a Certificate is given, a PrivateKey must be given, too.
+//
+// PrivateKey defines a path to the PEM encoded private key used for TLS
+// connections. Left empty by default (disabled).
+//
+// ClientCA defines a path to a PEM encoded file containing the certificate
+// authorities used to verify client certificates. If set, clients have to
+// present a valid certificate signed by one of these authorities (mutual TLS).
+// Requires Certificate and PrivateKey to be set. Left empty by default.
+// The common name and the subject alternative names of verified client
+// certificates are attached to each message as "client_cn" and "client_san"
+// metadata. Multiple alternative names are separated by comma.
+//
+// ClientStreams maps identities of verified client certificates to streams.
+// The common name is checked first, followed by all DNS names, email addresses
+// and URIs of the certificate. Messages from matching clients are sent to the
+// mapped stream instead of the streams set by Stream. This setting has
+// precedence over SNIStreams. Requires ClientCA to be set. Empty by default.
+//
+// SNIStreams maps TLS server names as sent by the client (SNI) to streams.
+// Messages from connections using a listed server name are sent to the
+// mapped stream instead of the streams set by Stream. A leading "*." matches
+// any server name one level below the given domain. Server names are not case
+// sensitive. Connections without a matching server name use Stream.
+// Requires Certificate and PrivateKey to be set. Empty by default.
+//
+// AcceptProxyProtocol can be set to true to expect a PROXY protocol header
+// (version 1 or 2) at the start of each connection as sent by e.g. HAProxy or
+// AWS ELB. The source address transmitted by this header is attached to each
+// message as "source_address" metadata instead of the address of the
+// connecting load balancer. Connections without a valid header are closed.
+// By default this is set to false.
+//
+// MaxConnections defines the maximum number of connections accepted at the
+// same time. Additional connections are closed directly after being accepted.
+// By default this is set to 0 which disables the limit.
+//
+// MaxConnectionsPerIP defines the maximum number of connections accepted from
+// the same remote IP address at the same time. Note that this limit refers to
+// the connecting host, i.e. the load balancer when using AcceptProxyProtocol.
+// By default this is set to 0 which disables the limit.
+//
+// BytesPerSecondPerConnection limits the number of bytes read per second from
+// each connection. Clients sending faster will be slowed down by delaying
+// reads. By default this is set to 0 which disables throttling.
+//
+// IdleTimeoutSec defines the number of seconds a connection may stay open
+// without any data being received. Idle connections are closed.
+// By default this is set to 0 which disables the timeout.
+//
+// ReadTimeoutSec defines the number of seconds a client may take to complete
+// a message once it has started sending it. The same timeout applies to the
+// PROXY protocol header and the TLS handshake. Connections exceeding this
+// timeout are closed. By default this is set to 0 which disables the timeout.
+//
+// KeepAliveSec defines the interval in seconds used for TCP keepalive probes.
+// Connections to hosts not answering these probes are closed by the operating
+// system. Set to -1 to disable keepalive probes.
+// By default this is set to 0 which keeps the system defaults.
+//
+// AllowedOrigins defines the values of the Origin header that are accepted
+// by the "websocket" partitioner, e.g. "https://example.com". "*" accepts all
+// origins. Requests without Origin header, i.e. from clients other than
+// browsers, are always accepted. By default this is set to an empty list,
+// which only accepts requests with an origin matching the requested host.
+//
+// MaxMessageSizeByte defines the maximum size of a message read by the
+// "websocket" partitioner. Connections exceeding this limit are closed.
+// By default this is set to 1048576 (1 MB).
+//
+// The number of open, rejected, throttled and timed out connections is tracked
+// by the metrics "Proxy:Connections-<address>", "Proxy:Rejected-<address>",
+// "Proxy:Throttled-<address>" and "Proxy:Timeouts-<address>". If multiple
+// addresses are given, these metrics are tracked for each address.
 type Proxy struct {
 	core.ConsumerBase
-	listen    io.Closer
-	protocol  string
-	address   string
-	flags     shared.BufferedReaderFlags
-	delimiter string
-	offset    int
+	listen           []net.Listener
+	addresses        []proxyAddress
+	flags            shared.BufferedReaderFlags
+	delimiter        string
+	offset           int
+	tlsConfig        *tls.Config
+	sniStreams       map[string][]core.MappedStream
+	clientStreams    map[string][]core.MappedStream
+	fileFlags        os.FileMode
+	fileOwner        string
+	fileGroup        string
+	connGuard        *sync.Mutex
+	connPerIP        map[string]int
+	connPerAddress   map[string]int
+	connCount        int
+	maxConn          int
+	maxConnPerIP     int
+	bytesPerSec      int64
+	idleTimeout      time.Duration
+	readTimeout      time.Duration
+	keepAlive        time.Duration
+	useProxyProtocol bool
+	clearSocket      bool
+	websocket        bool
+	allowedOrigins   []string
+	maxMessageSize   int64
+}
+
+type proxyAddress struct {
+	protocol string
+	address  string
 }
 
 func init() {
@@ -96,10 +266,68 @@ func (cons *Proxy) Configure(conf core.PluginConfig) error {
 		return err
 	}
 
-	cons.address, cons.protocol = shared.ParseAddress(conf.GetString("Address", ":5880"))
-	if cons.protocol == "udp" {
-		return fmt.Errorf("Proxy does not support UDP")
+	cons.addresses = []proxyAddress{}
+	for _, addressString := range conf.GetStringArray("Address", []string{":5880"}) {
+		address, protocol := shared.ParseAddress(addressString)
+		if strings.HasPrefix(protocol, "udp") {
+			return fmt.Errorf("Proxy does not support UDP, use consumer.UDPSocket instead")
+		}
+		cons.addresses = append(cons.addresses, proxyAddress{protocol, address})
+
+		shared.Metric.New(proxyMetricConnections + address)
+		shared.Metric.New(proxyMetricRejected + address)
+		shared.Metric.New(proxyMetricThrottled + address)
+		shared.Metric.New(proxyMetricTimeouts + address)
+	}
+	if len(cons.addresses) == 0 {
+		return fmt.Errorf("Proxy requires at least one Address")
+	}
+
+	flags, err := strconv.ParseInt(conf.GetString("SocketPermissions", "0770"), 8, 32)
+	if err != nil {
+		return err
 	}
+	cons.fileFlags = os.FileMode(flags)
+	cons.fileOwner = conf.GetString("SocketOwner", "")
+	cons.fileGroup = conf.GetString("SocketGroup", "")
+	cons.clearSocket = conf.GetBool("RemoveOldSocket", true)
+
+	cons.tlsConfig, err = shared.NewServerTLSConfig(
+		conf.GetString("Certificate", ""),
+		conf.GetString("PrivateKey", ""),
+		conf.GetString("ClientCA", ""))
+	if err != nil {
+		return err
+	}
+
+	cons.sniStreams = make(map[string][]core.MappedStream)
+	for serverName, streamName := range conf.GetStringMap("SNIStreams", map[string]string{}) {
+		cons.sniStreams[strings.ToLower(serverName)] = core.NewMappedStreams([]string{streamName})
+	}
+	if len(cons.sniStreams) > 0 && cons.tlsConfig == nil {
+		return fmt.Errorf("SNIStreams requires Certificate and PrivateKey to be set")
+	}
+
+	cons.clientStreams = make(map[string][]core.MappedStream)
+	for identity, streamName := range conf.GetStringMap("ClientStreams", map[string]string{}) {
+		cons.clientStreams[identity] = core.NewMappedStreams([]string{streamName})
+	}
+	if len(cons.clientStreams) > 0 && (cons.tlsConfig == nil || cons.tlsConfig.ClientCAs == nil) {
+		return fmt.Errorf("ClientStreams requires ClientCA to be set")
+	}
+
+	cons.useProxyProtocol = conf.GetBool("AcceptProxyProtocol", false)
+	cons.maxConn = conf.GetInt("MaxConnections", 0)
+	cons.maxConnPerIP = conf.GetInt("MaxConnectionsPerIP", 0)
+	cons.bytesPerSec = int64(conf.GetInt("BytesPerSecondPerConnection", 0))
+	cons.idleTimeout = time.Duration(conf.GetInt("IdleTimeoutSec", 0)) * time.Second
+	cons.readTimeout = time.Duration(conf.GetInt("ReadTimeoutSec", 0)) * time.Second
+	cons.keepAlive = time.Duration(conf.GetInt("KeepAliveSec", 0)) * time.Second
+	cons.allowedOrigins = conf.GetStringArray("AllowedOrigins", []string{})
+	cons.maxMessageSize = int64(conf.GetInt("MaxMessageSizeByte", 1<<20))
+	cons.connGuard = new(sync.Mutex)
+	cons.connPerIP = make(map[string]int)
+	cons.connPerAddress = make(map[string]int)
 
 	cons.delimiter = shared.Unescape(conf.GetString("Delimiter", "\n"))
 	cons.offset = conf.GetInt("Offset", 0)
@@ -125,6 +353,9 @@ func (cons *Proxy) Configure(conf core.PluginConfig) error {
 			return fmt.Errorf("Size only supports the value 1,2,4 and 8")
 		}
 
+	case "varint":
+		cons.flags |= shared.BufferedReaderFlagMLEVarint
+
 	case "fixed":
 		cons.flags |= shared.BufferedReaderFlagMLEFixed
 		cons.offset = conf.GetInt("Size", 1)
@@ -132,6 +363,15 @@ func (cons *Proxy) Configure(conf core.PluginConfig) error {
 	case "ascii":
 		cons.flags |= shared.BufferedReaderFlagMLE
 
+	case "websocket":
+		cons.websocket = true
+
+	case "regex":
+		cons.flags |= shared.BufferedReaderFlagRegex
+		if cons.delimiter, err = compileStartPattern(conf); err != nil {
+			return err
+		}
+
 	case "delimiter":
 		// Nothing to add
 
@@ -142,10 +382,116 @@ func (cons *Proxy) Configure(conf core.PluginConfig) error {
 	return err
 }
 
-func (cons *Proxy) accept() {
+// compileStartPattern reads and validates the "Pattern" setting used by the
+// regex partitioner.
+func compileStartPattern(conf core.PluginConfig) (string, error) {
+	pattern := conf.GetString("Pattern", "")
+	if pattern == "" {
+		return "", fmt.Errorf("The regex partitioner requires a Pattern")
+	}
+	if _, err := regexp.Compile("(?m)" + pattern); err != nil {
+		return "", err
+	}
+	return pattern, nil
+}
+
+// streamsForServerName returns the streams mapped to the given TLS server
+// name by SNIStreams or nil if the default streams should be used.
+func (cons *Proxy) streamsForServerName(serverName string) []core.MappedStream {
+	if serverName == "" || len(cons.sniStreams) == 0 {
+		return nil // ### return, no mapping ###
+	}
+
+	serverName = strings.ToLower(serverName)
+	if streams, exists := cons.sniStreams[serverName]; exists {
+		return streams // ### return, exact match ###
+	}
+	if dotIdx := strings.Index(serverName, "."); dotIdx > 0 {
+		return cons.sniStreams["*"+serverName[dotIdx:]]
+	}
+	return nil
+}
+
+// streamsForClient returns the streams mapped to the first matching identity
+// by ClientStreams or nil if the default streams should be used.
+func (cons *Proxy) streamsForClient(identities []string) []core.MappedStream {
+	for _, identity := range identities {
+		if streams, exists := cons.clientStreams[identity]; exists {
+			return streams // ### return, match ###
+		}
+	}
+	return nil
+}
+
+// remoteHost returns the host part of the connection's remote address or the
+// full address if it does not contain a port (e.g. unix sockets).
+func remoteHost(conn net.Conn) string {
+	remoteAddr := conn.RemoteAddr().String()
+	if host, _, err := net.SplitHostPort(remoteAddr); err == nil {
+		return host
+	}
+	return remoteAddr
+}
+
+// addConnection registers a new connection accepted on the given listen
+// address and returns false if the connection exceeds one of the configured
+// connection limits.
+func (cons *Proxy) addConnection(conn net.Conn, address string) bool {
+	host := remoteHost(conn)
+
+	cons.connGuard.Lock()
+	defer cons.connGuard.Unlock()
+
+	if cons.maxConn > 0 && cons.connCount >= cons.maxConn {
+		return false // ### return, too many connections ###
+	}
+	if cons.maxConnPerIP > 0 && cons.connPerIP[host] >= cons.maxConnPerIP {
+		return false // ### return, too many connections for this host ###
+	}
+
+	cons.connCount++
+	cons.connPerIP[host]++
+	cons.connPerAddress[address]++
+	shared.Metric.SetI(proxyMetricConnections+address, cons.connPerAddress[address])
+	return true
+}
+
+// removeConnection unregisters a connection registered by addConnection.
+func (cons *Proxy) removeConnection(conn net.Conn, address string) {
+	host := remoteHost(conn)
+
+	cons.connGuard.Lock()
+	defer cons.connGuard.Unlock()
+
+	cons.connCount--
+	if cons.connPerIP[host] <= 1 {
+		delete(cons.connPerIP, host)
+	} else {
+		cons.connPerIP[host]--
+	}
+	cons.connPerAddress[address]--
+	shared.Metric.SetI(proxyMetricConnections+address, cons.connPerAddress[address])
+}
+
+// setKeepAlive applies KeepAliveSec to TCP connections.
+func (cons *Proxy) setKeepAlive(conn net.Conn) {
+	tcpConn, isTCP := conn.(*net.TCPConn)
+	if !isTCP {
+		return // ### return, no TCP connection ###
+	}
+
+	switch {
+	case cons.keepAlive < 0:
+		tcpConn.SetKeepAlive(false)
+	case cons.keepAlive > 0:
+		tcpConn.SetKeepAlive(true)
+		tcpConn.SetKeepAlivePeriod(cons.keepAlive)
+	}
+}
+
+func (cons *Proxy) accept(listener net.Listener, address string) {
 	defer cons.WorkerDone()
 
-	listener := cons.listen.(net.Listener)
 	for cons.IsActive() {
 		cons.WaitOnFuse()
 
@@ -157,24 +503,67 @@ func (cons *Proxy) accept() {
 			break // ### break ###
 		}
 
-		go listenToProxyClient(client, cons)
+		if !cons.addConnection(client, address) {
+			Log.Warning.Print("Proxy rejected connection from ", client.RemoteAddr(), ": connection limit reached")
+			shared.Metric.Inc(proxyMetricRejected + address)
+			client.Close()
+			continue // ### continue, rejected ###
+		}
+
+		cons.setKeepAlive(client)
+		go listenToProxyClient(client, cons, address)
 	}
 }
 
+func (cons *Proxy) listenTo(address proxyAddress) (net.Listener, error) {
+	if address.protocol != "unix" {
+		return net.Listen(address.protocol, address.address)
+	}
+
+	if cons.clearSocket {
+		if err := shared.RemoveStaleUnixSocket(address.address); err != nil {
+			Log.Warning.Print("Could not remove existing socket: ", err)
+		}
+	}
+
+	listener, err := net.Listen(address.protocol, address.address)
+	if err != nil {
+		return nil, err // ### return, could not bind ###
+	}
+
+	if err := shared.SetUnixSocketPermissions(address.address, cons.fileFlags, cons.fileOwner, cons.fileGroup); err != nil {
+		listener.Close()
+		return nil, err // ### return, could not set permissions ###
+	}
+	return listener, nil
+}
+
+func (cons *Proxy) closeAll() {
+	for _, listener := range cons.listen {
+		listener.Close()
+	}
+	cons.listen = cons.listen[:0]
+}
+
 // Consume listens to a given socket.
 func (cons *Proxy) Consume(workers *sync.WaitGroup) {
-	var err error
+	cons.SetWorkerWaitGroup(workers)
+	defer cons.closeAll()
 
-	if cons.listen, err = net.Listen(cons.protocol, cons.address); err != nil {
-		Log.Error.Print("Proxy connection error: ", err)
-		return
+	for _, address := range cons.addresses {
+		listener, err := cons.listenTo(address)
+		if err != nil {
+			Log.Error.Print("Proxy connection error: ", err)
+			return // ### return, could not bind ###
+		}
+		cons.listen = append(cons.listen, listener)
 	}
 
-	go shared.DontPanic(func() {
-		cons.AddMainWorker(workers)
-		cons.accept()
-	})
+	for i, listener := range cons.listen {
+		listener, address := listener, cons.addresses[i].address // copy for closure
+		cons.AddWorker()
+		go shared.DontPanic(func() { cons.accept(listener, address) })
+	}
 
-	defer cons.listen.Close()
 	cons.ControlLoop()
 }
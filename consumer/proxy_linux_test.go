@@ -0,0 +1,65 @@
+// Copyright 2015-2016 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumer
+
+import (
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/shared"
+	"net"
+	"syscall"
+	"testing"
+)
+
+// getTestSockopt returns the value of a socket option of a TCP connection.
+func getTestSockopt(expect shared.Expect, conn net.Conn, level, option int) int {
+	rawConn, err := conn.(*net.TCPConn).SyscallConn()
+	expect.NoError(err)
+
+	var value int
+	var sockErr error
+	expect.NoError(rawConn.Control(func(fd uintptr) {
+		value, sockErr = syscall.GetsockoptInt(int(fd), level, option)
+	}))
+	expect.NoError(sockErr)
+	return value
+}
+
+func TestProxyKeepAlive(t *testing.T) {
+	expect := shared.NewExpect(t)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	expect.NoError(err)
+	defer listener.Close()
+
+	client, err := net.Dial("tcp", listener.Addr().String())
+	expect.NoError(err)
+	defer client.Close()
+	conn, err := listener.Accept()
+	expect.NoError(err)
+	defer conn.Close()
+
+	for keepAliveSec, enabled := range map[int]bool{-1: false, 42: true} {
+		conf := core.NewPluginConfig("")
+		conf.Override("KeepAliveSec", keepAliveSec)
+		plugin, err := core.NewPluginWithType("consumer.Proxy", conf)
+		expect.NoError(err)
+
+		plugin.(*Proxy).setKeepAlive(conn)
+		expect.Equal(enabled, getTestSockopt(expect, conn, syscall.SOL_SOCKET, syscall.SO_KEEPALIVE) != 0)
+		if enabled {
+			expect.Equal(keepAliveSec, getTestSockopt(expect, conn, syscall.IPPROTO_TCP, syscall.TCP_KEEPIDLE))
+		}
+	}
+}
@@ -0,0 +1,468 @@
+// Copyright 2015-2016 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumer
+
+import (
+	"bytes"
+	"crypto/tls"
+	"github.com/gorilla/websocket"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/shared"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testRemoteConn is a net.Conn with a fixed remote address
+type testRemoteConn struct {
+	net.Conn
+	remoteAddr net.Addr
+}
+
+func (conn testRemoteConn) RemoteAddr() net.Addr {
+	return conn.remoteAddr
+}
+
+func newTestRemoteConn(ip string) net.Conn {
+	return testRemoteConn{remoteAddr: &net.TCPAddr{IP: net.ParseIP(ip), Port: 1234}}
+}
+
+func getFreeTestAddress(expect shared.Expect) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	expect.NoError(err)
+	defer listener.Close()
+	return listener.Addr().String()
+}
+
+func newTestProxy(expect shared.Expect, streamName string, settings map[string]interface{}) (*Proxy, *mockHTTPStream) {
+	stream := &mockHTTPStream{}
+	core.StreamRegistry.Register(stream, core.GetStreamID(streamName))
+	conf := core.NewPluginConfig("")
+	conf.Stream = []string{streamName}
+	for key, value := range settings {
+		conf.Override(key, value)
+	}
+	plugin, err := core.NewPluginWithType("consumer.Proxy", conf)
+	expect.NoError(err)
+	return plugin.(*Proxy), stream
+}
+
+func getTestProxyMetric(expect shared.Expect, name string) int64 {
+	value, err := shared.Metric.Get(name)
+	expect.NoError(err)
+	return value
+}
+
+// dialTestProxy connects to the given address as soon as it accepts
+// connections.
+func dialTestProxy(expect shared.Expect, address string) net.Conn {
+	var conn net.Conn
+	expect.NonBlocking(2*time.Second, func() {
+		for {
+			var err error
+			if conn, err = net.Dial("tcp", address); err == nil {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	})
+	return conn
+}
+
+// startTestProxy runs Consume and returns the first connection accepted on
+// the given address.
+func startTestProxy(expect shared.Expect, cons *Proxy, address string) (*sync.WaitGroup, net.Conn) {
+	workers := new(sync.WaitGroup)
+	go cons.Consume(workers)
+	return workers, dialTestProxy(expect, address)
+}
+
+// expectTestConnClosed reads from conn until the connection is closed by the
+// remote side.
+func expectTestConnClosed(expect shared.Expect, conn net.Conn) {
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, err := ioutil.ReadAll(conn)
+	expect.NoError(err)
+}
+
+func TestProxyWebsocket(t *testing.T) {
+	expect := shared.NewExpect(t)
+
+	conf := core.NewPluginConfig("")
+	conf.Override("Partitioner", "websocket")
+	conf.Override("AllowedOrigins", []string{"https://example.com"})
+	conf.Override("MaxMessageSizeByte", 8)
+	plugin, err := core.NewPluginWithType("consumer.Proxy", conf)
+	expect.NoError(err)
+	cons, casted := plugin.(*Proxy)
+	expect.True(casted)
+
+	for origin, accepted := range map[string]bool{"https://example.com": true, "https://other.com": false} {
+		serverConn, clientConn := net.Pipe()
+		client := &proxyClient{proxy: cons, conn: serverConn, reader: serverConn}
+		upgraded := make(chan error, 1)
+		go func() {
+			err := client.upgradeWebsocket()
+			if err != nil {
+				serverConn.Close()
+			}
+			upgraded <- err
+		}()
+
+		dialer := websocket.Dialer{NetDial: func(string, string) (net.Conn, error) { return clientConn, nil }}
+		conn, resp, err := dialer.Dial("ws://gollum/", http.Header{"Origin": []string{origin}})
+		expect.Equal(accepted, <-upgraded == nil)
+		if !accepted {
+			expect.NotNil(err)
+			expect.Equal(http.StatusForbidden, resp.StatusCode)
+			continue // ### continue, rejected ###
+		}
+		expect.NoError(err)
+
+		go func() {
+			conn.WriteMessage(websocket.TextMessage, []byte("0123456789"))
+			conn.ReadMessage() // close frame
+		}()
+		_, _, err = client.websocket.ReadMessage()
+		expect.Equal(websocket.ErrReadLimit, err)
+		client.websocket.Close()
+		conn.Close()
+	}
+}
+
+func TestProxyConnectionLimits(t *testing.T) {
+	expect := shared.NewExpect(t)
+
+	conf := core.NewPluginConfig("")
+	conf.Override("Address", []string{"127.0.0.1:5880", "127.0.0.1:5881"})
+	conf.Override("MaxConnections", 3)
+	conf.Override("MaxConnectionsPerIP", 2)
+	plugin, err := core.NewPluginWithType("consumer.Proxy", conf)
+	expect.NoError(err)
+	cons := plugin.(*Proxy)
+	address, other := cons.addresses[0].address, cons.addresses[1].address
+
+	hostA1 := newTestRemoteConn("10.0.0.1")
+	hostA2 := newTestRemoteConn("10.0.0.1")
+	hostB := newTestRemoteConn("10.0.0.2")
+	hostC := newTestRemoteConn("10.0.0.3")
+
+	// The per IP limit rejects connections while the global limit is not
+	// reached yet.
+	expect.True(cons.addConnection(hostA1, address))
+	expect.True(cons.addConnection(hostA2, address))
+	expect.False(cons.addConnection(newTestRemoteConn("10.0.0.1"), address))
+	expect.Equal(2, cons.connCount)
+
+	// The global limit rejects connections from hosts below the per IP limit.
+	// Limits apply to all addresses.
+	expect.True(cons.addConnection(hostB, other))
+	expect.False(cons.addConnection(hostC, address))
+	expect.False(cons.addConnection(hostC, other))
+	expect.Equal(3, cons.connCount)
+	expect.Equal(int64(2), getTestProxyMetric(expect, proxyMetricConnections+address))
+	expect.Equal(int64(1), getTestProxyMetric(expect, proxyMetricConnections+other))
+
+	cons.removeConnection(hostA1, address)
+	expect.MapEqual(cons.connPerIP, "10.0.0.1", 1)
+	expect.True(cons.addConnection(hostC, address))
+	expect.False(cons.addConnection(hostA1, address))
+
+	cons.removeConnection(hostA2, address)
+	cons.removeConnection(hostB, other)
+	cons.removeConnection(hostC, address)
+	expect.Equal(0, cons.connCount)
+	expect.Equal(0, len(cons.connPerIP))
+	expect.Equal(int64(0), getTestProxyMetric(expect, proxyMetricConnections+address))
+	expect.Equal(int64(0), getTestProxyMetric(expect, proxyMetricConnections+other))
+}
+
+func TestProxyRejectConnection(t *testing.T) {
+	expect := shared.NewExpect(t)
+
+	address := getFreeTestAddress(expect)
+	cons, stream := newTestProxy(expect, "proxyReject", map[string]interface{}{
+		"Address":        address,
+		"MaxConnections": 1,
+	})
+	workers, accepted := startTestProxy(expect, cons, address)
+	defer accepted.Close()
+	rejected := getTestProxyMetric(expect, proxyMetricRejected+address)
+
+	accepted.Write([]byte("accepted\n"))
+	waitForTestMessages(expect, stream, 1)
+
+	// The second connection is closed right after being accepted
+	conn, err := net.Dial("tcp", address)
+	expect.NoError(err)
+	expectTestConnClosed(expect, conn)
+	conn.Close()
+	expect.Equal(rejected+1, getTestProxyMetric(expect, proxyMetricRejected+address))
+	expect.Equal(int64(1), getTestProxyMetric(expect, proxyMetricConnections+address))
+
+	cons.Control() <- core.PluginControlStopConsumer
+	expect.NonBlocking(2*time.Second, workers.Wait)
+}
+
+func TestProxyThrottle(t *testing.T) {
+	expect := shared.NewExpect(t)
+
+	throttleCount := 0
+	data := bytes.Repeat([]byte("x"), 1500)
+	reader := &throttledReader{
+		reader:      bytes.NewReader(data),
+		bytesPerSec: 1000,
+		windowStart: time.Now(),
+		onThrottle:  func() { throttleCount++ },
+	}
+
+	buffer := make([]byte, 4096)
+	start := time.Now()
+	total := 0
+	for {
+		size, err := reader.Read(buffer)
+		expect.Leq(size, 1000)
+		total += size
+		if err == io.EOF {
+			break
+		}
+		expect.NoError(err)
+	}
+	elapsed := time.Since(start)
+
+	expect.Equal(len(data), total)
+	expect.Greater(throttleCount, 0)
+	expect.Geq(elapsed.Seconds(), 1.4)
+	expect.Leq(float64(total)/elapsed.Seconds(), 1100.0)
+
+	// Throttled connections are counted once
+	address := getFreeTestAddress(expect)
+	cons, stream := newTestProxy(expect, "proxyThrottle", map[string]interface{}{
+		"Address":                     address,
+		"BytesPerSecondPerConnection": 4,
+	})
+	workers, conn := startTestProxy(expect, cons, address)
+	defer conn.Close()
+	throttled := getTestProxyMetric(expect, proxyMetricThrottled+address)
+
+	start = time.Now()
+	conn.Write([]byte("ab\ncd\nef\n"))
+	waitForTestMessages(expect, stream, 3)
+	expect.Geq(time.Since(start).Seconds(), 1.0)
+	expect.Equal(throttled+1, getTestProxyMetric(expect, proxyMetricThrottled+address))
+
+	cons.Control() <- core.PluginControlStopConsumer
+	expect.NonBlocking(2*time.Second, workers.Wait)
+}
+
+func TestProxyTimeouts(t *testing.T) {
+	expect := shared.NewExpect(t)
+
+	address := getFreeTestAddress(expect)
+	cons, stream := newTestProxy(expect, "proxyIdleTimeout", map[string]interface{}{
+		"Address":        address,
+		"IdleTimeoutSec": 1,
+	})
+	workers, conn := startTestProxy(expect, cons, address)
+	timeouts := getTestProxyMetric(expect, proxyMetricTimeouts+address)
+
+	// The idle timeout is reset by every message
+	conn.Write([]byte("a\n"))
+	waitForTestMessages(expect, stream, 1)
+	start := time.Now()
+	expectTestConnClosed(expect, conn)
+	conn.Close()
+	expect.Geq(time.Since(start).Seconds(), 0.9)
+	expect.Equal(timeouts+1, getTestProxyMetric(expect, proxyMetricTimeouts+address))
+
+	cons.Control() <- core.PluginControlStopConsumer
+	expect.NonBlocking(2*time.Second, workers.Wait)
+
+	address = getFreeTestAddress(expect)
+	cons, stream = newTestProxy(expect, "proxyReadTimeout", map[string]interface{}{
+		"Address":        address,
+		"ReadTimeoutSec": 1,
+	})
+	workers, conn = startTestProxy(expect, cons, address)
+	defer conn.Close()
+	timeouts = getTestProxyMetric(expect, proxyMetricTimeouts+address)
+
+	// Idle connections are kept open if only ReadTimeoutSec is set
+	conn.SetReadDeadline(time.Now().Add(1500 * time.Millisecond))
+	_, err := conn.Read(make([]byte, 1))
+	expect.True(isTimeoutError(err))
+
+	// Partial messages have to be completed within ReadTimeoutSec
+	conn.Write([]byte("a\nincomplete"))
+	waitForTestMessages(expect, stream, 1)
+	expectTestConnClosed(expect, conn)
+	expect.Equal(1, stream.count())
+	expect.Equal(timeouts+1, getTestProxyMetric(expect, proxyMetricTimeouts+address))
+
+	cons.Control() <- core.PluginControlStopConsumer
+	expect.NonBlocking(2*time.Second, workers.Wait)
+}
+
+func TestProxyRegexFlush(t *testing.T) {
+	expect := shared.NewExpect(t)
+
+	address := getFreeTestAddress(expect)
+	cons, stream := newTestProxy(expect, "proxyRegex", map[string]interface{}{
+		"Address":     address,
+		"Partitioner": "regex",
+		"Pattern":     `^<\d+>`,
+	})
+	workers, conn := startTestProxy(expect, cons, address)
+
+	conn.Write([]byte("<1>first\n line\n<2>last\n line\n"))
+	waitForTestMessages(expect, stream, 1)
+
+	// The last message is sent when the connection is closed
+	conn.Close()
+	payloads := waitForTestPayloads(expect, stream, 2)
+	expect.Equal([]string{"<1>first\n line\n", "<2>last\n line\n"}, payloads)
+
+	cons.Control() <- core.PluginControlStopConsumer
+	expect.NonBlocking(2*time.Second, workers.Wait)
+}
+
+func TestProxyMultipleAddresses(t *testing.T) {
+	expect := shared.NewExpect(t)
+
+	addresses := []string{getFreeTestAddress(expect), getFreeTestAddress(expect)}
+	cons, stream := newTestProxy(expect, "proxyAddresses", map[string]interface{}{
+		"Address": addresses,
+	})
+	workers, first := startTestProxy(expect, cons, addresses[0])
+	defer first.Close()
+	second := dialTestProxy(expect, addresses[1])
+	defer second.Close()
+
+	first.Write([]byte("first\n"))
+	waitForTestMessages(expect, stream, 1)
+	second.Write([]byte("second\n"))
+	payloads := waitForTestPayloads(expect, stream, 2)
+	expect.Equal([]string{"first\n", "second\n"}, payloads)
+
+	// Metrics are tracked per address
+	expect.Equal(int64(1), getTestProxyMetric(expect, proxyMetricConnections+addresses[0]))
+	expect.Equal(int64(1), getTestProxyMetric(expect, proxyMetricConnections+addresses[1]))
+
+	third := dialTestProxy(expect, addresses[1])
+	third.Write([]byte("third\n"))
+	waitForTestMessages(expect, stream, 3)
+	expect.Equal(int64(1), getTestProxyMetric(expect, proxyMetricConnections+addresses[0]))
+	expect.Equal(int64(2), getTestProxyMetric(expect, proxyMetricConnections+addresses[1]))
+
+	third.Close()
+	expect.NonBlocking(2*time.Second, func() {
+		for getTestProxyMetric(expect, proxyMetricConnections+addresses[1]) != 1 {
+			time.Sleep(10 * time.Millisecond)
+		}
+	})
+
+	// Stopping the consumer closes all listeners
+	cons.Control() <- core.PluginControlStopConsumer
+	expect.NonBlocking(2*time.Second, workers.Wait)
+	for _, address := range addresses {
+		_, err := net.Dial("tcp", address)
+		expect.NotNil(err)
+	}
+}
+
+func TestProxyStreamsForServerName(t *testing.T) {
+	expect := shared.NewExpect(t)
+
+	dir, err := ioutil.TempDir("", "gollum_proxy")
+	expect.NoError(err)
+	defer os.RemoveAll(dir)
+	certFile, keyFile := writeTestSyslogCertificate(expect, dir)
+
+	conf := core.NewPluginConfig("")
+	conf.Override("Certificate", certFile)
+	conf.Override("PrivateKey", keyFile)
+	conf.Override("SNIStreams", map[string]string{
+		"app1.example.com": "sniApp1",
+		"*.example.com":    "sniApps",
+		"*.Example.ORG":    "sniOrg",
+	})
+	plugin, err := core.NewPluginWithType("consumer.Proxy", conf)
+	expect.NoError(err)
+	cons := plugin.(*Proxy)
+
+	for serverName, streamName := range map[string]string{
+		"app1.example.com":   "sniApp1",
+		"APP1.Example.COM":   "sniApp1",
+		"app2.example.com":   "sniApps",
+		"App2.EXAMPLE.com":   "sniApps",
+		"www.example.org":    "sniOrg",
+		"a.app1.example.com": "",
+		"example.com":        "",
+		"other.org":          "",
+		"localhost":          "",
+		"":                   "",
+	} {
+		streams := cons.streamsForServerName(serverName)
+		if streamName == "" {
+			expect.Nil(streams)
+			continue // ### continue, default streams ###
+		}
+		if expect.Equal(1, len(streams)) {
+			expect.Equal(core.GetStreamID(streamName), streams[0].StreamID)
+		}
+	}
+}
+
+func TestProxyTLSServerName(t *testing.T) {
+	expect := shared.NewExpect(t)
+
+	dir, err := ioutil.TempDir("", "gollum_proxy")
+	expect.NoError(err)
+	defer os.RemoveAll(dir)
+	certFile, keyFile := writeTestSyslogCertificate(expect, dir)
+
+	appStream := &mockHTTPStream{}
+	core.StreamRegistry.Register(appStream, core.GetStreamID("proxySNIApp"))
+	address := getFreeTestAddress(expect)
+	cons, defaultStream := newTestProxy(expect, "proxySNIDefault", map[string]interface{}{
+		"Address":     address,
+		"Certificate": certFile,
+		"PrivateKey":  keyFile,
+		"SNIStreams":  map[string]string{"*.example.com": "proxySNIApp"},
+	})
+	workers, conn := startTestProxy(expect, cons, address)
+	conn.Close()
+
+	for serverName, stream := range map[string]*mockHTTPStream{
+		"app.example.com": appStream,
+		"localhost":       defaultStream,
+	} {
+		conn, err := tls.Dial("tcp", address, &tls.Config{ServerName: serverName, InsecureSkipVerify: true})
+		expect.NoError(err)
+		conn.Write([]byte(serverName + "\n"))
+		conn.Close()
+
+		payloads := waitForTestPayloads(expect, stream, 1)
+		expect.Equal([]string{serverName + "\n"}, payloads)
+	}
+
+	cons.Control() <- core.PluginControlStopConsumer
+	expect.NonBlocking(2*time.Second, workers.Wait)
+}
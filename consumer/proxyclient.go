@@ -15,11 +15,18 @@
 package consumer
 
 import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"github.com/gorilla/websocket"
 	"github.com/trivago/gollum/core"
 	"github.com/trivago/gollum/core/log"
 	"github.com/trivago/gollum/shared"
 	"io"
 	"net"
+	"net/http"
+	"strings"
 	"syscall"
 	"time"
 )
@@ -31,21 +38,225 @@ const (
 type proxyClient struct {
 	core.AsyncMessageSource
 
-	proxy     *Proxy
-	conn      net.Conn
-	connected bool
+	proxy         *Proxy
+	listenAddress string
+	conn          net.Conn
+	reader        io.Reader
+	sourceAddress string
+	streams       []core.MappedStream
+	clientCN      string
+	clientSAN     string
+	websocket     *websocket.Conn
+	messageType   int
+	connected     bool
 }
 
-func listenToProxyClient(conn net.Conn, proxy *Proxy) {
+// readerConn is a net.Conn that reads from a given reader instead of the
+// connection itself.
+type readerConn struct {
+	net.Conn
+	reader io.Reader
+}
+
+func (conn readerConn) Read(data []byte) (int, error) {
+	return conn.reader.Read(data)
+}
+
+// handshakeWriter is a minimal http.ResponseWriter and http.Hijacker on top of
+// a plain connection. It is used to process WebSocket upgrade requests without
+// running a HTTP server.
+type handshakeWriter struct {
+	conn          net.Conn
+	header        http.Header
+	headerWritten bool
+}
+
+func (writer *handshakeWriter) Header() http.Header {
+	return writer.header
+}
+
+func (writer *handshakeWriter) WriteHeader(status int) {
+	if writer.headerWritten {
+		return // ### return, already written ###
+	}
+	writer.headerWritten = true
+	writer.header.Set("Connection", "close")
+
+	fmt.Fprintf(writer.conn, "HTTP/1.1 %d %s\r\n", status, http.StatusText(status))
+	writer.header.Write(writer.conn)
+	io.WriteString(writer.conn, "\r\n")
+}
+
+func (writer *handshakeWriter) Write(data []byte) (int, error) {
+	writer.WriteHeader(http.StatusOK)
+	return writer.conn.Write(data)
+}
+
+func (writer *handshakeWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	readWriter := bufio.NewReadWriter(bufio.NewReader(writer.conn), bufio.NewWriter(writer.conn))
+	return writer.conn, readWriter, nil
+}
+
+// throttledReader delays reads from a reader so that a given number of bytes
+// per second is not exceeded.
+type throttledReader struct {
+	reader      io.Reader
+	bytesPerSec int64
+	bytesRead   int64
+	windowStart time.Time
+	onThrottle  func()
+}
+
+func (throttle *throttledReader) Read(data []byte) (int, error) {
+	if int64(len(data)) > throttle.bytesPerSec {
+		data = data[:throttle.bytesPerSec]
+	}
+
+	size, err := throttle.reader.Read(data)
+	throttle.bytesRead += int64(size)
+
+	expected := time.Duration(throttle.bytesRead * int64(time.Second) / throttle.bytesPerSec)
+	if delay := expected - time.Since(throttle.windowStart); delay > 0 {
+		throttle.onThrottle()
+		time.Sleep(delay)
+	}
+
+	// Start a new window every second so that idle times don't allow bursts
+	if time.Since(throttle.windowStart) >= time.Second {
+		throttle.windowStart = time.Now()
+		throttle.bytesRead = 0
+	}
+
+	return size, err
+}
+
+// deadlineReader sets a read deadline on a connection before each read.
+// The readTimeout is used while a message is partially received, the
+// idleTimeout otherwise.
+type deadlineReader struct {
+	reader      io.Reader
+	conn        net.Conn
+	buffer      *shared.BufferedReader
+	idleTimeout time.Duration
+	readTimeout time.Duration
+}
+
+func (deadline *deadlineReader) Read(data []byte) (int, error) {
+	timeout := deadline.idleTimeout
+	if deadline.readTimeout > 0 && deadline.buffer.Buffered() > 0 {
+		timeout = deadline.readTimeout
+	}
+
+	if timeout > 0 {
+		deadline.conn.SetReadDeadline(time.Now().Add(timeout))
+	} else {
+		deadline.conn.SetReadDeadline(time.Time{})
+	}
+	return deadline.reader.Read(data)
+}
+
+func isTimeoutError(err error) bool {
+	netErr, isNetErr := err.(net.Error)
+	return isNetErr && netErr.Timeout()
+}
+
+func listenToProxyClient(conn net.Conn, proxy *Proxy, listenAddress string) {
 	defer shared.RecoverShutdown()
+	defer proxy.removeConnection(conn, listenAddress)
 	defer conn.Close()
 
+	sourceAddress := conn.RemoteAddr().String()
+	serverName := ""
+	var clientCert *x509.Certificate
+	if proxy.readTimeout > 0 {
+		conn.SetDeadline(time.Now().Add(proxy.readTimeout))
+	} else {
+		conn.SetDeadline(time.Time{})
+	}
+
+	// The PROXY protocol header is always sent before a TLS handshake
+	if proxy.useProxyProtocol {
+		header, err := shared.ReadProxyProtocolHeader(conn)
+		if err != nil {
+			Log.Error.Print("Proxy failed to read PROXY protocol header from ", sourceAddress, ": ", err)
+			if isTimeoutError(err) {
+				shared.Metric.Inc(proxyMetricTimeouts + listenAddress)
+			}
+			return // ### return, invalid header ###
+		}
+		if header.Source != nil {
+			sourceAddress = header.Source.String()
+		}
+	}
+
+	if proxy.tlsConfig != nil {
+		tlsConn := tls.Server(conn, proxy.tlsConfig)
+		if err := tlsConn.Handshake(); err != nil {
+			Log.Error.Print("Proxy TLS handshake failed: ", err)
+			if isTimeoutError(err) {
+				shared.Metric.Inc(proxyMetricTimeouts + listenAddress)
+			}
+			return // ### return, handshake failed ###
+		}
+		conn = tlsConn
+		defer tlsConn.Close()
+
+		state := tlsConn.ConnectionState()
+		serverName = state.ServerName
+		if len(state.VerifiedChains) > 0 && len(state.VerifiedChains[0]) > 0 {
+			clientCert = state.VerifiedChains[0][0]
+		}
+	}
+
 	conn.SetDeadline(time.Time{})
 
 	client := proxyClient{
-		proxy:     proxy,
-		conn:      conn,
-		connected: true,
+		proxy:         proxy,
+		listenAddress: listenAddress,
+		conn:          conn,
+		reader:        conn,
+		sourceAddress: sourceAddress,
+		streams:       proxy.streamsForServerName(serverName),
+		connected:     true,
+	}
+
+	if clientCert != nil {
+		identities := shared.CertificateIdentities(clientCert)
+		client.clientCN = clientCert.Subject.CommonName
+		client.clientSAN = strings.Join(identities[1:], ",")
+		if streams := proxy.streamsForClient(identities); streams != nil {
+			client.streams = streams
+		}
+	}
+
+	if proxy.bytesPerSec > 0 {
+		throttledConn := &throttledReader{
+			reader:      conn,
+			bytesPerSec: proxy.bytesPerSec,
+			windowStart: time.Now(),
+		}
+
+		throttled := false
+		throttledConn.onThrottle = func() {
+			if !throttled {
+				throttled = true
+				shared.Metric.Inc(proxyMetricThrottled + listenAddress)
+			}
+		}
+		client.reader = throttledConn
+	}
+
+	if proxy.websocket {
+		if err := client.upgradeWebsocket(); err != nil {
+			Log.Error.Print("Proxy WebSocket handshake with ", sourceAddress, " failed: ", err)
+			if isTimeoutError(err) {
+				shared.Metric.Inc(proxyMetricTimeouts + listenAddress)
+			}
+			return // ### return, handshake failed ###
+		}
+		defer client.websocket.Close()
+		client.readWebsocket()
+		return // ### return, connection closed ###
 	}
 
 	client.read()
@@ -69,6 +280,14 @@ func (client *proxyClient) hasDisconnected(err error) bool {
 }
 
 func (client *proxyClient) EnqueueResponse(msg core.Message) {
+	if client.websocket != nil {
+		if err := client.websocket.WriteMessage(client.messageType, msg.Data); err != nil {
+			client.connected = false
+			Log.Error.Print("Proxy write failed: ", err)
+		}
+		return // ### return, websocket response ###
+	}
+
 	_, err := client.conn.Write(msg.Data)
 	if err != nil && err != io.EOF {
 		if client.hasDisconnected(err) {
@@ -80,20 +299,113 @@ func (client *proxyClient) EnqueueResponse(msg core.Message) {
 
 func (client *proxyClient) sendMessage(data []byte, seq uint64) {
 	msg := core.NewMessage(client, data, seq)
-	client.proxy.EnqueueMessage(msg)
+	msg.SetMetadata(core.MetadataSourceAddress, client.sourceAddress)
+	if client.clientCN != "" {
+		msg.SetMetadata(core.MetadataClientCommonName, client.clientCN)
+	}
+	if client.clientSAN != "" {
+		msg.SetMetadata(core.MetadataClientSAN, client.clientSAN)
+	}
+	if client.streams != nil {
+		client.proxy.EnqueueMessageTo(msg, client.streams)
+	} else {
+		client.proxy.EnqueueMessage(msg)
+	}
+}
+
+// upgradeWebsocket reads the HTTP upgrade request from the connection and
+// upgrades the connection to the WebSocket protocol.
+func (client *proxyClient) upgradeWebsocket() error {
+	if client.proxy.readTimeout > 0 {
+		client.conn.SetReadDeadline(time.Now().Add(client.proxy.readTimeout))
+		defer client.conn.SetReadDeadline(time.Time{})
+	}
+
+	// Data following the request is kept in the bufio reader so the
+	// connection passed to the upgrader has to read from there.
+	reader := bufio.NewReader(client.reader)
+	request, err := http.ReadRequest(reader)
+	if err != nil {
+		return err // ### return, no HTTP request ###
+	}
+
+	writer := &handshakeWriter{
+		conn:   readerConn{Conn: client.conn, reader: reader},
+		header: make(http.Header),
+	}
+
+	upgrader := websocket.Upgrader{
+		CheckOrigin: func(req *http.Request) bool {
+			return isAllowedOrigin(req, client.proxy.allowedOrigins)
+		},
+	}
+
+	client.websocket, err = upgrader.Upgrade(writer, request, nil)
+	if err != nil {
+		return err // ### return, handshake failed ###
+	}
+	client.websocket.SetReadLimit(client.proxy.maxMessageSize)
+	client.messageType = websocket.TextMessage
+	return nil
+}
+
+func (client *proxyClient) readWebsocket() {
+	var sequence uint64
+	for client.proxy.IsActive() && client.connected && !client.proxy.IsFuseBurned() {
+		if client.proxy.idleTimeout > 0 {
+			client.websocket.SetReadDeadline(time.Now().Add(client.proxy.idleTimeout))
+		}
+
+		messageType, data, err := client.websocket.ReadMessage()
+		switch {
+		case err == nil:
+		case isTimeoutError(err):
+			Log.Warning.Print("Proxy closed connection from ", client.sourceAddress, ": ", err)
+			shared.Metric.Inc(proxyMetricTimeouts + client.listenAddress)
+			return // ### return, connection timed out ###
+		case websocket.IsUnexpectedCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway):
+			Log.Error.Print("Proxy read failed: ", err)
+			return // ### return, connection broken ###
+		default:
+			return // ### return, connection closed ###
+		}
+
+		client.messageType = messageType
+		client.sendMessage(data, sequence)
+		sequence++
+	}
 }
 
 func (client *proxyClient) read() {
 	buffer := shared.NewBufferedReader(proxyClientBufferGrowSize, client.proxy.flags, client.proxy.offset, client.proxy.delimiter)
+	defer buffer.Flush(client.sendMessage)
+
+	reader := client.reader
+	if client.proxy.idleTimeout > 0 || client.proxy.readTimeout > 0 {
+		reader = &deadlineReader{
+			reader:      client.reader,
+			conn:        client.conn,
+			buffer:      buffer,
+			idleTimeout: client.proxy.idleTimeout,
+			readTimeout: client.proxy.readTimeout,
+		}
+	}
 
 	for client.proxy.IsActive() && client.connected && !client.proxy.IsFuseBurned() {
-		err := buffer.ReadAll(client.conn, client.sendMessage)
+		err := buffer.ReadAll(reader, client.sendMessage)
 
 		// Handle read errors
-		if err != nil && err != io.EOF {
-			if client.hasDisconnected(err) {
-				return // ### return, connection closed ###
-			}
+		switch {
+		case err == nil:
+		case err == io.EOF:
+			return // ### return, connection closed by client ###
+		case isTimeoutError(err):
+			Log.Warning.Print("Proxy closed connection from ", client.sourceAddress, ": ", err)
+			shared.Metric.Inc(proxyMetricTimeouts + client.listenAddress)
+			return // ### return, connection timed out ###
+		case client.hasDisconnected(err):
+			return // ### return, connection closed ###
+		default:
 			Log.Error.Print("Proxy read failed: ", err)
 		}
 	}
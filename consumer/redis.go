@@ -0,0 +1,468 @@
+// Copyright 2015-2016 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumer
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/core/log"
+	"github.com/trivago/gollum/shared"
+	"gopkg.in/redis.v4"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	redisModeList   = "list"
+	redisModePubSub = "pubsub"
+	redisModeStream = "stream"
+)
+
+const (
+	redisMetadataKey     = "redis_key"
+	redisMetadataPattern = "redis_pattern"
+	redisMetadataID      = "redis_id"
+	redisMetadataField   = "redis_field."
+)
+
+// Redis consumer plugin
+// The Redis consumer reads messages from a redis server. Messages can be
+// popped from lists, received from pub/sub channels or read from streams
+// using a consumer group. This consumer does not implement support for
+// redis 3.0 cluster.
+// The list, channel or stream a message has been read from is attached as
+// "redis_key" metadata. Messages received through a pattern subscription
+// store the pattern as "redis_pattern". Stream entries store their id as
+// "redis_id" and all fields except StreamField as "redis_field.<name>".
+// When attached to a fuse, this consumer will stop reading in case that fuse
+// is burned.
+// Configuration example
+//
+//  - "consumer.Redis":
+//    Address: ":6379"
+//    Password: ""
+//    Database: 0
+//    Mode: "list"
+//    Keys:
+//      - "default"
+//    BlockTimeoutMs: 1000
+//    Group: "gollum"
+//    ConsumerName: ""
+//    CreateGroup: true
+//    GroupStartID: "$"
+//    StreamField: "message"
+//    BatchSize: 100
+//    RetryDelayMs: 3000
+//
+// Address stores the identifier to connect to.
+// This can either be any ip address and port like "localhost:6379" or a file
+// like "unix:///var/redis.socket". By default this is set to ":6379".
+//
+// Password defines the password used to authenticate. By default this is set
+// to "".
+//
+// Database defines the redis database to connect to.
+// By default this is set to 0.
+//
+// Mode defines how messages are read. By default this is set to "list".
+//  * "list" pops messages from the given lists using BLPOP. A message is
+//    removed from the list as soon as it has been read.
+//  * "pubsub" subscribes to the given channels. Keys containing one of the
+//    characters "*", "?" or "[" are subscribed to as patterns.
+//  * "stream" reads from the given streams with XREADGROUP and acknowledges
+//    each entry with XACK after it has been enqueued. Entries that have been
+//    delivered to this consumer but were not acknowledged, e.g. because
+//    gollum was stopped, are read again on startup. Requires redis 5.0.
+//
+// Keys defines the lists, channels or streams to read from.
+// By default this is set to ["default"].
+//
+// BlockTimeoutMs defines the number of milliseconds a BLPOP or XREADGROUP
+// call waits for new messages before it is repeated. By default this is set
+// to 1000.
+//
+// Group defines the consumer group used in "stream" mode. By default this is
+// set to "gollum".
+//
+// ConsumerName defines the name of this consumer inside the consumer group.
+// Unacknowledged entries are tied to this name, so it should be stable across
+// restarts. By default this is set to "", which uses the hostname.
+//
+// CreateGroup can be set to false to not create the consumer group (and the
+// stream) if it does not exist. By default this is set to true.
+//
+// GroupStartID defines the id the consumer group starts reading from when it
+// is created. Use "0" to read the whole stream or "$" to read only new
+// entries. By default this is set to "$".
+//
+// StreamField defines the field of a stream entry that contains the message.
+// If set to "" or if an entry does not contain this field, all fields are sent
+// as a JSON object. By default this is set to "message".
+//
+// BatchSize defines the maximum number of stream entries read per
+// XREADGROUP call. By default this is set to 100.
+//
+// RetryDelayMs defines the number of milliseconds to wait before retrying
+// after a redis command has failed. By default this is set to 3000.
+type Redis struct {
+	core.ConsumerBase
+	address      string
+	protocol     string
+	password     string
+	database     int
+	mode         string
+	keys         []string
+	blockTimeout time.Duration
+	group        string
+	consumerName string
+	createGroup  bool
+	groupStartID string
+	streamField  string
+	batchSize    int
+	retryDelay   time.Duration
+	client       *redis.Client
+	pubsub       *redis.PubSub
+	guard        *sync.Mutex
+	sequence     uint64
+}
+
+func init() {
+	shared.TypeRegistry.Register(Redis{})
+}
+
+// Configure initializes this consumer with values from a plugin config.
+func (cons *Redis) Configure(conf core.PluginConfig) error {
+	err := cons.ConsumerBase.Configure(conf)
+	if err != nil {
+		return err
+	}
+
+	cons.address, cons.protocol = shared.ParseAddress(conf.GetString("Address", ":6379"))
+	cons.password = conf.GetString("Password", "")
+	cons.database = conf.GetInt("Database", 0)
+
+	cons.mode = strings.ToLower(conf.GetString("Mode", redisModeList))
+	switch cons.mode {
+	case redisModeList, redisModePubSub, redisModeStream:
+	default:
+		return fmt.Errorf("Unknown redis mode: %s", cons.mode)
+	}
+
+	cons.keys = conf.GetStringArray("Keys", []string{"default"})
+	if len(cons.keys) == 0 {
+		return fmt.Errorf("Redis requires at least one key")
+	}
+
+	cons.blockTimeout = time.Duration(shared.MaxI(conf.GetInt("BlockTimeoutMs", 1000), 1)) * time.Millisecond
+	cons.group = conf.GetString("Group", "gollum")
+	cons.consumerName = conf.GetString("ConsumerName", "")
+	if cons.consumerName == "" {
+		cons.consumerName, _ = os.Hostname()
+	}
+	cons.createGroup = conf.GetBool("CreateGroup", true)
+	cons.groupStartID = conf.GetString("GroupStartID", "$")
+	cons.streamField = conf.GetString("StreamField", "message")
+	cons.batchSize = shared.MaxI(conf.GetInt("BatchSize", 100), 1)
+	cons.retryDelay = time.Duration(conf.GetInt("RetryDelayMs", 3000)) * time.Millisecond
+	cons.guard = new(sync.Mutex)
+
+	return nil
+}
+
+func (cons *Redis) sendMessage(data string, metadata core.MessageMetadata) {
+	msg := core.NewMessage(cons, []byte(data), cons.sequence)
+	cons.sequence++
+	for key, value := range metadata {
+		msg.SetMetadata(key, value)
+	}
+	cons.EnqueueMessage(msg)
+}
+
+// retry logs the given error and waits for RetryDelayMs. False is returned
+// if the consumer is stopping.
+func (cons *Redis) retry(err error) bool {
+	if !cons.IsActive() {
+		return false // ### return, stopping ###
+	}
+	Log.Error.Print("Redis: ", err)
+	time.Sleep(cons.retryDelay)
+	return cons.IsActive()
+}
+
+func isRedisTimeout(err error) bool {
+	netErr, isNetErr := err.(net.Error)
+	return isNetErr && netErr.Timeout()
+}
+
+func (cons *Redis) readLists() {
+	for cons.IsActive() {
+		cons.WaitOnFuse()
+		result, err := cons.client.BLPop(cons.blockTimeout, cons.keys...).Result()
+		switch {
+		case err == redis.Nil:
+			continue // ### continue, timeout ###
+		case err != nil:
+			if !cons.retry(err) {
+				return // ### return, stopping ###
+			}
+		case len(result) == 2:
+			cons.sendMessage(result[1], core.MessageMetadata{redisMetadataKey: result[0]})
+		}
+	}
+}
+
+func (cons *Redis) subscribe() (*redis.PubSub, error) {
+	channels, patterns := []string{}, []string{}
+	for _, key := range cons.keys {
+		if strings.ContainsAny(key, "*?[") {
+			patterns = append(patterns, key)
+		} else {
+			channels = append(channels, key)
+		}
+	}
+
+	var pubsub *redis.PubSub
+	var err error
+	if len(channels) > 0 {
+		if pubsub, err = cons.client.Subscribe(channels...); err == nil && len(patterns) > 0 {
+			err = pubsub.PSubscribe(patterns...)
+		}
+	} else {
+		pubsub, err = cons.client.PSubscribe(patterns...)
+	}
+
+	if err != nil {
+		pubsub.Close()
+		return nil, err // ### return, subscribe failed ###
+	}
+
+	cons.guard.Lock()
+	defer cons.guard.Unlock()
+	if !cons.IsActive() {
+		pubsub.Close()
+		return nil, fmt.Errorf("Redis consumer is stopping")
+	}
+	cons.pubsub = pubsub
+	return pubsub, nil
+}
+
+func (cons *Redis) readPubSub() {
+	for cons.IsActive() {
+		pubsub, err := cons.subscribe()
+		if err != nil {
+			if !cons.retry(err) {
+				return // ### return, stopping ###
+			}
+			continue // ### continue, retry ###
+		}
+
+		for cons.IsActive() {
+			var received interface{}
+			if received, err = pubsub.ReceiveTimeout(cons.blockTimeout); err != nil {
+				if isRedisTimeout(err) {
+					err = nil
+					continue // ### continue, no message ###
+				}
+				break // ### break, reconnect ###
+			}
+
+			if msg, isMessage := received.(*redis.Message); isMessage {
+				metadata := core.MessageMetadata{redisMetadataKey: msg.Channel}
+				if msg.Pattern != "" {
+					metadata[redisMetadataPattern] = msg.Pattern
+				}
+				cons.WaitOnFuse()
+				cons.sendMessage(msg.Payload, metadata)
+			}
+		}
+
+		pubsub.Close()
+		if err != nil && !cons.retry(err) {
+			return // ### return, stopping ###
+		}
+	}
+}
+
+// createGroups creates the consumer group for all streams. Groups that
+// already exist are ignored.
+func (cons *Redis) createGroups() error {
+	for _, key := range cons.keys {
+		cmd := redis.NewStatusCmd("XGROUP", "CREATE", key, cons.group, cons.groupStartID, "MKSTREAM")
+		cons.client.Process(cmd)
+		if err := cmd.Err(); err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+			return err // ### return, group could not be created ###
+		}
+	}
+	return nil
+}
+
+// streamEntryData returns the message data of a stream entry and the
+// metadata that stores all other fields.
+func (cons *Redis) streamEntryData(fields []interface{}) (string, core.MessageMetadata) {
+	values := make(map[string]string)
+	for i := 0; i+1 < len(fields); i += 2 {
+		values[fmt.Sprint(fields[i])] = fmt.Sprint(fields[i+1])
+	}
+
+	metadata := core.MessageMetadata{}
+	data, hasField := values[cons.streamField]
+	if !hasField || cons.streamField == "" {
+		encoded, _ := json.Marshal(values)
+		return string(encoded), metadata // ### return, no message field ###
+	}
+
+	for name, value := range values {
+		if name != cons.streamField {
+			metadata[redisMetadataField+name] = value
+		}
+	}
+	return data, metadata
+}
+
+// readStreamBatch reads entries from all streams starting at the given ids.
+// The ids map is updated with the id of the last entry read from each stream
+// while reading pending entries. Streams without pending entries switch to
+// ">", i.e. new entries.
+func (cons *Redis) readStreamBatch(ids map[string]string) error {
+	args := []interface{}{"XREADGROUP", "GROUP", cons.group, cons.consumerName,
+		"COUNT", cons.batchSize, "BLOCK", int64(cons.blockTimeout / time.Millisecond), "STREAMS"}
+	for _, key := range cons.keys {
+		args = append(args, key)
+	}
+	for _, key := range cons.keys {
+		args = append(args, ids[key])
+	}
+
+	cmd := redis.NewSliceCmd(args...)
+	cons.client.Process(cmd)
+	streams, err := cmd.Result()
+	if err == redis.Nil {
+		return nil // ### return, timeout ###
+	}
+	if err != nil {
+		return err
+	}
+
+	received := make(map[string]bool)
+	for _, stream := range streams {
+		stream, isStream := stream.([]interface{})
+		if !isStream || len(stream) != 2 {
+			continue // ### continue, malformed reply ###
+		}
+		key := fmt.Sprint(stream[0])
+		entries, _ := stream[1].([]interface{})
+
+		for _, entry := range entries {
+			entry, isEntry := entry.([]interface{})
+			if !isEntry || len(entry) != 2 {
+				continue // ### continue, malformed reply ###
+			}
+			id := fmt.Sprint(entry[0])
+			received[key] = true
+			if ids[key] != ">" {
+				ids[key] = id
+			}
+
+			// Pending entries that have been deleted are returned without fields
+			if fields, hasFields := entry[1].([]interface{}); hasFields {
+				data, metadata := cons.streamEntryData(fields)
+				metadata[redisMetadataKey] = key
+				metadata[redisMetadataID] = id
+				cons.WaitOnFuse()
+				cons.sendMessage(data, metadata)
+			}
+
+			if err := cons.client.Process(redis.NewIntCmd("XACK", key, cons.group, id)); err != nil {
+				return err // ### return, ack failed ###
+			}
+		}
+	}
+
+	for _, key := range cons.keys {
+		if !received[key] {
+			ids[key] = ">"
+		}
+	}
+	return nil
+}
+
+func (cons *Redis) readStreams() {
+	for cons.IsActive() {
+		if cons.createGroup {
+			if err := cons.createGroups(); err != nil {
+				if !cons.retry(err) {
+					return // ### return, stopping ###
+				}
+				continue // ### continue, retry ###
+			}
+		}
+
+		// Start with the entries delivered to this consumer before
+		ids := make(map[string]string)
+		for _, key := range cons.keys {
+			ids[key] = "0"
+		}
+
+		var err error
+		for cons.IsActive() && err == nil {
+			err = cons.readStreamBatch(ids)
+		}
+		if err != nil && !cons.retry(err) {
+			return // ### return, stopping ###
+		}
+	}
+}
+
+func (cons *Redis) close() {
+	cons.guard.Lock()
+	defer cons.guard.Unlock()
+	if cons.pubsub != nil {
+		cons.pubsub.Close()
+	}
+}
+
+// Consume starts reading from the configured keys.
+func (cons *Redis) Consume(workers *sync.WaitGroup) {
+	cons.client = redis.NewClient(&redis.Options{
+		Addr:        cons.address,
+		Network:     cons.protocol,
+		Password:    cons.password,
+		DB:          cons.database,
+		ReadTimeout: cons.blockTimeout + 3*time.Second,
+	})
+	defer cons.client.Close()
+
+	cons.SetWorkerWaitGroup(workers)
+	cons.SetStopCallback(cons.close)
+
+	cons.AddWorker()
+	go shared.DontPanic(func() {
+		defer cons.WorkerDone()
+		switch cons.mode {
+		case redisModePubSub:
+			cons.readPubSub()
+		case redisModeStream:
+			cons.readStreams()
+		default:
+			cons.readLists()
+		}
+	})
+
+	cons.ControlLoop()
+}
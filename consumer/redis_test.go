@@ -0,0 +1,256 @@
+// Copyright 2015-2016 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumer
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/shared"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeRedisServer answers redis commands with the RESP encoded replies
+// returned by handler.
+func fakeRedisServer(expect shared.Expect, handler func(args []string) string) net.Listener {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	expect.NoError(err)
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				reader := bufio.NewReader(conn)
+				for {
+					args, err := readRedisCommand(reader)
+					if err != nil {
+						return
+					}
+					io.WriteString(conn, handler(args))
+				}
+			}()
+		}
+	}()
+	return listener
+}
+
+func readRedisCommand(reader *bufio.Reader) ([]string, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	count, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+	args := make([]string, 0, count)
+	for i := 0; i < count; i++ {
+		if _, err := reader.ReadString('\n'); err != nil {
+			return nil, err
+		}
+		arg, err := reader.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, strings.TrimSuffix(arg, "\r\n"))
+	}
+	return args, nil
+}
+
+func respArray(items ...string) string {
+	return fmt.Sprintf("*%d\r\n%s", len(items), strings.Join(items, ""))
+}
+
+func respBulk(value string) string {
+	return fmt.Sprintf("$%d\r\n%s\r\n", len(value), value)
+}
+
+func runTestRedisConsumer(expect shared.Expect, cons *Redis, stream *mockHTTPStream, count int) {
+	workers := new(sync.WaitGroup)
+	go cons.Consume(workers)
+
+	expect.NonBlocking(2*time.Second, func() {
+		for stream.count() < count {
+			time.Sleep(10 * time.Millisecond)
+		}
+	})
+
+	cons.Control() <- core.PluginControlStopConsumer
+	expect.NonBlocking(2*time.Second, workers.Wait)
+}
+
+func TestRedisList(t *testing.T) {
+	expect := shared.NewExpect(t)
+
+	guard := new(sync.Mutex)
+	values := []string{"first", "second"}
+	listener := fakeRedisServer(expect, func(args []string) string {
+		guard.Lock()
+		defer guard.Unlock()
+		if args[0] != "blpop" || len(values) == 0 {
+			return "*-1\r\n"
+		}
+		value := values[0]
+		values = values[1:]
+		return respArray(respBulk(args[1]), respBulk(value))
+	})
+	defer listener.Close()
+
+	stream := &mockHTTPStream{}
+	core.StreamRegistry.Register(stream, core.GetStreamID("redisList"))
+	conf := core.NewPluginConfig("")
+	conf.Stream = []string{"redisList"}
+	conf.Override("Address", listener.Addr().String())
+	conf.Override("BlockTimeoutMs", 50)
+	conf.Override("RetryDelayMs", 10)
+	conf.Override("Keys", []string{"jobs", "other"})
+	plugin, err := core.NewPluginWithType("consumer.Redis", conf)
+	expect.NoError(err)
+	cons, casted := plugin.(*Redis)
+	expect.True(casted)
+
+	runTestRedisConsumer(expect, cons, stream, 2)
+
+	expect.Equal("first", string(stream.messages[0].Data))
+	expect.Equal("second", string(stream.messages[1].Data))
+	expect.Equal("jobs", stream.messages[0].Metadata["redis_key"])
+}
+
+func TestRedisPubSub(t *testing.T) {
+	expect := shared.NewExpect(t)
+
+	listener := fakeRedisServer(expect, func(args []string) string {
+		switch strings.ToUpper(args[0]) {
+		case "SUBSCRIBE":
+			return respArray(respBulk("subscribe"), respBulk(args[1]), ":1\r\n") +
+				respArray(respBulk("message"), respBulk(args[1]), respBulk("hello"))
+		case "PSUBSCRIBE":
+			return respArray(respBulk("psubscribe"), respBulk(args[1]), ":2\r\n") +
+				respArray(respBulk("pmessage"), respBulk(args[1]), respBulk("events.login"), respBulk("world"))
+		default:
+			return "+PONG\r\n"
+		}
+	})
+	defer listener.Close()
+
+	stream := &mockHTTPStream{}
+	core.StreamRegistry.Register(stream, core.GetStreamID("redisPubSub"))
+	conf := core.NewPluginConfig("")
+	conf.Stream = []string{"redisPubSub"}
+	conf.Override("Address", listener.Addr().String())
+	conf.Override("BlockTimeoutMs", 50)
+	conf.Override("RetryDelayMs", 10)
+	conf.Override("Mode", "pubsub")
+	conf.Override("Keys", []string{"news", "events.*"})
+	plugin, err := core.NewPluginWithType("consumer.Redis", conf)
+	expect.NoError(err)
+	cons, casted := plugin.(*Redis)
+	expect.True(casted)
+
+	runTestRedisConsumer(expect, cons, stream, 2)
+
+	messages := map[string]core.MessageMetadata{}
+	for _, msg := range stream.messages {
+		messages[string(msg.Data)] = msg.Metadata
+	}
+	expect.Equal(core.MessageMetadata{"redis_key": "news"}, messages["hello"])
+	expect.Equal(core.MessageMetadata{"redis_key": "events.login", "redis_pattern": "events.*"}, messages["world"])
+}
+
+func TestRedisStream(t *testing.T) {
+	expect := shared.NewExpect(t)
+
+	guard := new(sync.Mutex)
+	commands := []string{}
+	listener := fakeRedisServer(expect, func(args []string) string {
+		guard.Lock()
+		defer guard.Unlock()
+
+		switch strings.ToUpper(args[0]) {
+		case "XGROUP":
+			commands = append(commands, strings.Join(args, " "))
+			return "-BUSYGROUP Consumer Group name already exists\r\n"
+
+		case "XACK":
+			commands = append(commands, strings.Join(args, " "))
+			return ":1\r\n"
+
+		case "XREADGROUP":
+			id := args[len(args)-1]
+			commands = append(commands, "XREADGROUP "+id)
+			switch id {
+			case "0":
+				// One pending entry and one deleted pending entry
+				return respArray(respArray(respBulk("events"), respArray(
+					respArray(respBulk("1-0"), respArray(respBulk("message"), respBulk("pending"), respBulk("host"), respBulk("web-1"))),
+					respArray(respBulk("2-0"), "*-1\r\n"))))
+			case "2-0":
+				return respArray(respArray(respBulk("events"), "*0\r\n"))
+			case ">":
+				if len(commands) < 10 {
+					return respArray(respArray(respBulk("events"), respArray(
+						respArray(respBulk("3-0"), respArray(respBulk("level"), respBulk("info"))))))
+				}
+			}
+			return "*-1\r\n"
+		}
+		return "+OK\r\n"
+	})
+	defer listener.Close()
+
+	stream := &mockHTTPStream{}
+	core.StreamRegistry.Register(stream, core.GetStreamID("redisStream"))
+	conf := core.NewPluginConfig("")
+	conf.Stream = []string{"redisStream"}
+	conf.Override("Address", listener.Addr().String())
+	conf.Override("BlockTimeoutMs", 50)
+	conf.Override("RetryDelayMs", 10)
+	conf.Override("Mode", "stream")
+	conf.Override("Keys", []string{"events"})
+	conf.Override("ConsumerName", "worker")
+	plugin, err := core.NewPluginWithType("consumer.Redis", conf)
+	expect.NoError(err)
+	cons, casted := plugin.(*Redis)
+	expect.True(casted)
+
+	runTestRedisConsumer(expect, cons, stream, 2)
+
+	expect.Equal("pending", string(stream.messages[0].Data))
+	expect.Equal(core.MessageMetadata{
+		"redis_key":        "events",
+		"redis_id":         "1-0",
+		"redis_field.host": "web-1",
+	}, stream.messages[0].Metadata)
+	expect.Equal(`{"level":"info"}`, string(stream.messages[1].Data))
+
+	guard.Lock()
+	defer guard.Unlock()
+	expect.Equal([]string{
+		"XGROUP CREATE events gollum $ MKSTREAM",
+		"XREADGROUP 0",
+		"XACK events gollum 1-0",
+		"XACK events gollum 2-0",
+		"XREADGROUP 2-0",
+		"XREADGROUP >",
+		"XACK events gollum 3-0",
+	}, commands[:7])
+}
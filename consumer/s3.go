@@ -0,0 +1,449 @@
+// Copyright 2015-2016 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumer
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/core/log"
+	"github.com/trivago/gollum/shared"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	s3CredentialEnv    = "environment"
+	s3CredentialStatic = "static"
+	s3CredentialShared = "shared"
+	s3CredentialNone   = "none"
+	s3MetadataBucket   = "s3_bucket"
+	s3MetadataKey      = "s3_key"
+)
+
+// S3 consumer plugin
+// This consumer reads objects from AWS S3 buckets that are announced by S3
+// event notifications sent to an SQS queue. Notifications can be sent to the
+// queue directly or through an SNS topic. Each created object is downloaded
+// and split into messages by the configured partitioner. Objects compressed
+// with gzip are decompressed automatically.
+// A notification is deleted from the queue only after all objects listed in
+// it have been read completely. If reading fails, the notification becomes
+// visible again after the visibility timeout and is processed again, i.e.
+// messages are delivered at least once. Notifications that cannot be parsed
+// and objects that do not exist anymore are skipped.
+// The name of the bucket and the key of the object are attached to each
+// message as "s3_bucket" and "s3_key" metadata.
+// When attached to a fuse, this consumer will stop processing notifications in
+// case that fuse is burned.
+// Configuration example
+//
+//  - "consumer.S3":
+//    Queue: "default"
+//    Region: "eu-west-1"
+//    SQSEndpoint: ""
+//    S3Endpoint: ""
+//    S3ForcePathStyle: false
+//    CredentialType: "none"
+//    CredentialId: ""
+//    CredentialToken: ""
+//    CredentialSecret: ""
+//    CredentialFile: ""
+//    CredentialProfile: ""
+//    Partitioner: "delimiter"
+//    Delimiter: "\n"
+//    Offset: 0
+//    Size: 1
+//    Compression: "auto"
+//    MaxObjectSizeByte: 67108864
+//    Workers: 1
+//    MaxNotifications: 10
+//    WaitTimeSec: 20
+//    VisibilityTimeoutSec: 300
+//    RetryDelayMs: 3000
+//
+// Queue defines the name or the URL of the SQS queue receiving the
+// notifications. By default this is set to "default".
+//
+// Region defines the amazon region of the queue and the buckets.
+// By default this is set to "eu-west-1".
+//
+// SQSEndpoint defines the amazon endpoint for SQS. By default this is set to
+// "", which uses the default endpoint of Region.
+//
+// S3Endpoint defines the amazon endpoint for S3. By default this is set to
+// "", which uses the default endpoint of Region.
+//
+// S3ForcePathStyle can be set to true to add the bucket name to the path
+// instead of the host name. This is required by some S3 compatible services.
+// By default this is set to false.
+//
+// CredentialType defines the credentials that are to be used when
+// connecting to SQS and S3. This can be one of the following: environment,
+// static, shared, none.
+// Static enables the parameters CredentialId, CredentialToken and
+// CredentialSecret, shared enables the parameters CredentialFile and
+// CredentialProfile. None will not use any credentials and environment
+// will pull the credentials from environmental settings.
+// By default this is set to none.
+//
+// Partitioner defines the algorithm used to read messages from an object.
+// By default this is set to "delimiter".
+//  * "delimiter" separates messages by looking for a delimiter string.
+//    The delimiter is removed from the message. A missing delimiter at the
+//    end of an object is tolerated.
+//  * "object" treats each object as exactly one message.
+//  * "ascii" reads an ASCII number at a given offset until a given delimiter is found.
+//    Everything to the right of and including the delimiter is removed from the message.
+//  * "binary" reads a binary number at a given offset and size.
+//  * "binary_le" is an alias for "binary".
+//  * "binary_be" is the same as "binary" but uses big endian encoding.
+//  * "varint" reads an unsigned varint (as used by protocol buffers) at a given
+//    offset.
+//    The offset and the varint are removed from the message.
+//  * "fixed" assumes fixed size messages.
+//
+// Delimiter defines the delimiter used by the text and delimiter partitioner.
+// By default this is set to "\n".
+//
+// Offset defines the offset used by the binary, varint and text partitioner.
+// By default this is set to 0. This setting is ignored by the fixed partitioner.
+//
+// Size defines the size in bytes used by the binary or fixed partitioner.
+// For binary this can be set to 1,2,4 or 8. By default 4 is chosen.
+// For fixed this defines the size of a message. By default 1 is chosen.
+//
+// Compression defines how objects are decompressed. "auto" decompresses
+// objects starting with the gzip magic bytes, "gzip" expects all objects to
+// be compressed and "none" disables decompression.
+// By default this is set to "auto".
+//
+// MaxObjectSizeByte defines the maximum size of objects read by the "object"
+// partitioner after decompression. Larger objects are not sent and reading them
+// fails. By default this is set to 67108864 (64 MB).
+//
+// Workers defines the number of notifications processed in parallel.
+// By default this is set to 1.
+//
+// MaxNotifications defines the maximum number of notifications received per
+// request. Valid values are 1 to 10. By default this is set to 10.
+//
+// WaitTimeSec defines the time in seconds a request waits for notifications
+// (long polling). Valid values are 0 to 20. By default this is set to 20.
+//
+// VisibilityTimeoutSec defines the time in seconds a received notification is
+// hidden from other consumers. This should be larger than the time it takes
+// to read all objects of a notification. By default this is set to 300.
+//
+// RetryDelayMs defines the time in milliseconds to wait after a request
+// failed. By default this is set to 3000.
+type S3 struct {
+	core.ConsumerBase
+	sqsClient         *sqs.SQS
+	s3Client          *s3.S3
+	queue             string
+	queueURL          string
+	queueGuard        *sync.Mutex
+	reader            *objectReader
+	workers           int
+	maxNotifications  int64
+	waitTime          int64
+	visibilityTimeout int64
+	retryDelay        time.Duration
+	stop              chan struct{}
+	sequence          uint64
+}
+
+// s3Notification is the body of an S3 event notification. Notifications
+// sent through SNS are wrapped into an SNS message.
+type s3Notification struct {
+	Type    string `json:"Type"`
+	Message string `json:"Message"`
+	Event   string `json:"Event"`
+	Records []struct {
+		EventName string `json:"eventName"`
+		S3        struct {
+			Bucket struct {
+				Name string `json:"name"`
+			} `json:"bucket"`
+			Object struct {
+				Key string `json:"key"`
+			} `json:"object"`
+		} `json:"s3"`
+	} `json:"Records"`
+}
+
+// s3Object identifies an object announced by a notification.
+type s3Object struct {
+	bucket string
+	key    string
+}
+
+func init() {
+	shared.TypeRegistry.Register(S3{})
+}
+
+// Configure initializes this consumer with values from a plugin config.
+func (cons *S3) Configure(conf core.PluginConfig) error {
+	err := cons.ConsumerBase.Configure(conf)
+	if err != nil {
+		return err
+	}
+
+	cons.queue = conf.GetString("Queue", "default")
+	cons.queueGuard = new(sync.Mutex)
+	cons.workers = shared.MaxI(conf.GetInt("Workers", 1), 1)
+	cons.maxNotifications = int64(shared.MaxI(shared.MinI(conf.GetInt("MaxNotifications", 10), 10), 1))
+	cons.waitTime = int64(shared.MaxI(shared.MinI(conf.GetInt("WaitTimeSec", 20), 20), 0))
+	cons.visibilityTimeout = int64(shared.MaxI(conf.GetInt("VisibilityTimeoutSec", 300), 0))
+	cons.retryDelay = time.Duration(conf.GetInt("RetryDelayMs", 3000)) * time.Millisecond
+	cons.stop = make(chan struct{})
+
+	if cons.reader, err = newObjectReader(conf); err != nil {
+		return err
+	}
+
+	// Config
+	config := aws.NewConfig()
+	if region := conf.GetString("Region", "eu-west-1"); region != "" {
+		config.WithRegion(region)
+	}
+
+	// Credentials
+	credentialType := strings.ToLower(conf.GetString("CredentialType", s3CredentialNone))
+	switch credentialType {
+	case s3CredentialEnv:
+		config.WithCredentials(credentials.NewEnvCredentials())
+
+	case s3CredentialStatic:
+		id := conf.GetString("CredentialId", "")
+		token := conf.GetString("CredentialToken", "")
+		secret := conf.GetString("CredentialSecret", "")
+		config.WithCredentials(credentials.NewStaticCredentials(id, secret, token))
+
+	case s3CredentialShared:
+		filename := conf.GetString("CredentialFile", "")
+		profile := conf.GetString("CredentialProfile", "")
+		config.WithCredentials(credentials.NewSharedCredentials(filename, profile))
+
+	case s3CredentialNone:
+		// Nothing
+
+	default:
+		return fmt.Errorf("Unknown CredentialType: %s", credentialType)
+	}
+
+	// Endpoints are service specific, so the config is copied for S3
+	s3Config := config.Copy()
+	if endpoint := conf.GetString("S3Endpoint", ""); endpoint != "" {
+		s3Config.WithEndpoint(endpoint)
+	}
+	s3Config.WithS3ForcePathStyle(conf.GetBool("S3ForcePathStyle", false))
+	if endpoint := conf.GetString("SQSEndpoint", ""); endpoint != "" {
+		config.WithEndpoint(endpoint)
+	}
+
+	cons.sqsClient = sqs.New(session.New(config))
+	cons.s3Client = s3.New(session.New(s3Config))
+	return nil
+}
+
+// parseS3Notification returns all objects created according to the given
+// notification.
+func parseS3Notification(body string) ([]s3Object, error) {
+	notification := s3Notification{}
+	if err := json.Unmarshal([]byte(body), &notification); err != nil {
+		return nil, err
+	}
+
+	if notification.Type == "Notification" && notification.Message != "" {
+		return parseS3Notification(notification.Message) // ### return, SNS message ###
+	}
+
+	objects := []s3Object{}
+	for _, record := range notification.Records {
+		if !strings.HasPrefix(record.EventName, "ObjectCreated:") {
+			continue // ### continue, not a new object ###
+		}
+		key, err := url.QueryUnescape(record.S3.Object.Key)
+		if err != nil {
+			return nil, err
+		}
+		objects = append(objects, s3Object{bucket: record.S3.Bucket.Name, key: key})
+	}
+
+	if len(objects) == 0 && len(notification.Records) == 0 && notification.Event == "" {
+		return nil, fmt.Errorf("not an S3 event notification")
+	}
+	return objects, nil
+}
+
+func (cons *S3) sleep(duration time.Duration) bool {
+	select {
+	case <-cons.stop:
+		return false
+	case <-time.After(duration):
+		return true
+	}
+}
+
+// getQueueURL returns the URL of the queue. Queue names are resolved on first
+// use.
+func (cons *S3) getQueueURL() (string, error) {
+	cons.queueGuard.Lock()
+	defer cons.queueGuard.Unlock()
+
+	if cons.queueURL != "" {
+		return cons.queueURL, nil
+	}
+	if strings.HasPrefix(cons.queue, "https://") || strings.HasPrefix(cons.queue, "http://") {
+		cons.queueURL = cons.queue
+		return cons.queueURL, nil
+	}
+
+	req, out := cons.sqsClient.GetQueueUrlRequest(&sqs.GetQueueUrlInput{
+		QueueName: aws.String(cons.queue),
+	})
+	req.HTTPRequest.Cancel = cons.stop
+	if err := req.Send(); err != nil {
+		return "", err
+	}
+	cons.queueURL = aws.StringValue(out.QueueUrl)
+	return cons.queueURL, nil
+}
+
+func (cons *S3) readObject(object s3Object) error {
+	req, out := cons.s3Client.GetObjectRequest(&s3.GetObjectInput{
+		Bucket: aws.String(object.bucket),
+		Key:    aws.String(object.key),
+	})
+	req.HTTPRequest.Cancel = cons.stop
+	if err := req.Send(); err != nil {
+		return err
+	}
+	defer out.Body.Close()
+
+	err := cons.reader.read(out.Body, func(data []byte) {
+		msg := core.NewMessage(cons, data, atomic.AddUint64(&cons.sequence, 1))
+		msg.SetMetadata(s3MetadataBucket, object.bucket)
+		msg.SetMetadata(s3MetadataKey, object.key)
+		cons.EnqueueMessage(msg)
+	})
+	if err == shared.BufferDataInvalid {
+		Log.Warning.Printf("S3 failed to parse parts of s3://%s/%s", object.bucket, object.key)
+		return nil
+	}
+	return err
+}
+
+// processNotification reads all objects of a notification. If an error is
+// returned the notification is not deleted.
+func (cons *S3) processNotification(message *sqs.Message) error {
+	objects, err := parseS3Notification(aws.StringValue(message.Body))
+	if err != nil {
+		Log.Warning.Print("S3 discarded invalid notification ", aws.StringValue(message.MessageId), ": ", err)
+		return nil // ### return, cannot be processed ###
+	}
+
+	for _, object := range objects {
+		err := cons.readObject(object)
+		if awsErr, isAWSErr := err.(awserr.Error); isAWSErr && awsErr.Code() == "NoSuchKey" {
+			Log.Warning.Printf("S3 skipped s3://%s/%s: object does not exist", object.bucket, object.key)
+			continue // ### continue, object has been deleted ###
+		}
+		if err != nil {
+			return fmt.Errorf("s3://%s/%s: %s", object.bucket, object.key, err)
+		}
+	}
+	return nil
+}
+
+func (cons *S3) receive() {
+	defer cons.WorkerDone()
+
+	for cons.IsActive() {
+		if cons.IsFuseBurned() {
+			cons.sleep(time.Second)
+			continue // ### continue, fuse burned ###
+		}
+
+		queueURL, err := cons.getQueueURL()
+		if err != nil {
+			if cons.IsActive() {
+				Log.Error.Print("S3 failed to resolve queue ", cons.queue, ": ", err)
+				cons.sleep(cons.retryDelay)
+			}
+			continue // ### continue, retry ###
+		}
+
+		req, out := cons.sqsClient.ReceiveMessageRequest(&sqs.ReceiveMessageInput{
+			QueueUrl:            aws.String(queueURL),
+			MaxNumberOfMessages: aws.Int64(cons.maxNotifications),
+			WaitTimeSeconds:     aws.Int64(cons.waitTime),
+			VisibilityTimeout:   aws.Int64(cons.visibilityTimeout),
+		})
+		req.HTTPRequest.Cancel = cons.stop
+		if err := req.Send(); err != nil {
+			if cons.IsActive() {
+				Log.Error.Print("S3 failed to receive notifications: ", err)
+				cons.sleep(cons.retryDelay)
+			}
+			continue // ### continue, retry ###
+		}
+
+		for _, message := range out.Messages {
+			if err := cons.processNotification(message); err != nil {
+				if cons.IsActive() {
+					Log.Error.Print("S3 failed to read ", err)
+				}
+				continue // ### continue, notification will be received again ###
+			}
+
+			_, err := cons.sqsClient.DeleteMessage(&sqs.DeleteMessageInput{
+				QueueUrl:      aws.String(queueURL),
+				ReceiptHandle: message.ReceiptHandle,
+			})
+			if err != nil {
+				Log.Error.Print("S3 failed to delete notification: ", err)
+			}
+		}
+	}
+}
+
+func (cons *S3) close() {
+	close(cons.stop)
+}
+
+// Consume starts reading notifications from the queue.
+func (cons *S3) Consume(workers *sync.WaitGroup) {
+	cons.SetWorkerWaitGroup(workers)
+	cons.SetStopCallback(cons.close)
+
+	for i := 0; i < cons.workers; i++ {
+		cons.AddWorker()
+		go shared.DontPanic(cons.receive)
+	}
+
+	cons.ControlLoop()
+}
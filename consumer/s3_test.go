@@ -0,0 +1,208 @@
+// Copyright 2015-2016 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumer
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/shared"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+func s3TestNotification(bucket string, keys ...string) string {
+	records := []interface{}{}
+	for _, key := range keys {
+		records = append(records, map[string]interface{}{
+			"eventName": "ObjectCreated:Put",
+			"s3": map[string]interface{}{
+				"bucket": map[string]string{"name": bucket},
+				"object": map[string]string{"key": key},
+			},
+		})
+	}
+	body, _ := json.Marshal(map[string]interface{}{"Records": records})
+	return string(body)
+}
+
+func s3TestXMLEscape(data string) string {
+	buffer := new(bytes.Buffer)
+	xml.EscapeText(buffer, []byte(data))
+	return buffer.String()
+}
+
+func TestS3Notification(t *testing.T) {
+	expect := shared.NewExpect(t)
+
+	objects, err := parseS3Notification(s3TestNotification("bucket", "dir/a+b%2B.log", "c.log"))
+	expect.NoError(err)
+	expect.Equal([]s3Object{{"bucket", "dir/a b+.log"}, {"bucket", "c.log"}}, objects)
+
+	sns, _ := json.Marshal(map[string]string{
+		"Type":    "Notification",
+		"Message": s3TestNotification("other", "d.log"),
+	})
+	objects, err = parseS3Notification(string(sns))
+	expect.NoError(err)
+	expect.Equal([]s3Object{{"other", "d.log"}}, objects)
+
+	objects, err = parseS3Notification(`{"Records":[{"eventName":"ObjectRemoved:Delete","s3":{"bucket":{"name":"b"},"object":{"key":"k"}}}]}`)
+	expect.NoError(err)
+	expect.Equal(0, len(objects))
+
+	objects, err = parseS3Notification(`{"Service":"Amazon S3","Event":"s3:TestEvent","Bucket":"b"}`)
+	expect.NoError(err)
+	expect.Equal(0, len(objects))
+
+	_, err = parseS3Notification(`{"foo":"bar"}`)
+	expect.NotNil(err)
+
+	_, err = parseS3Notification(`not json`)
+	expect.NotNil(err)
+}
+
+func TestS3(t *testing.T) {
+	expect := shared.NewExpect(t)
+
+	compressed := new(bytes.Buffer)
+	gzipWriter := gzip.NewWriter(compressed)
+	gzipWriter.Write([]byte("gzip 1\ngzip 2\n"))
+	gzipWriter.Close()
+
+	objects := map[string][]byte{
+		"/bucket/plain.log":    []byte("plain 1\nplain 2"),
+		"/bucket/archive.gz":   compressed.Bytes(),
+		"/other/dir/sns a.log": []byte("sns 1\n"),
+	}
+
+	sns, _ := json.Marshal(map[string]string{
+		"Type":    "Notification",
+		"Message": s3TestNotification("other", "dir/sns+a.log"),
+	})
+	notifications := []string{
+		s3TestNotification("bucket", "plain.log", "archive.gz"),
+		string(sns),
+		s3TestNotification("bucket", "missing.log"),
+		"invalid",
+	}
+
+	guard := new(sync.Mutex)
+	deleted := []string{}
+
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, req *http.Request) {
+		guard.Lock()
+		defer guard.Unlock()
+
+		if req.Method == "GET" {
+			data, exists := objects[req.URL.Path]
+			if !exists {
+				writer.WriteHeader(http.StatusNotFound)
+				fmt.Fprint(writer, "<Error><Code>NoSuchKey</Code><Message>not found</Message></Error>")
+				return
+			}
+			writer.Write(data)
+			return
+		}
+
+		req.ParseForm()
+		switch req.Form.Get("Action") {
+		case "GetQueueUrl":
+			fmt.Fprintf(writer, "<GetQueueUrlResponse><GetQueueUrlResult><QueueUrl>%s/queue/%s</QueueUrl></GetQueueUrlResult></GetQueueUrlResponse>",
+				server.URL, req.Form.Get("QueueName"))
+
+		case "ReceiveMessage":
+			response := "<ReceiveMessageResponse><ReceiveMessageResult>"
+			for i, body := range notifications {
+				sum := md5.Sum([]byte(body))
+				response += fmt.Sprintf("<Message><MessageId>%d</MessageId><ReceiptHandle>handle-%d</ReceiptHandle><MD5OfBody>%s</MD5OfBody><Body>%s</Body></Message>",
+					i, i, hex.EncodeToString(sum[:]), s3TestXMLEscape(body))
+			}
+			notifications = nil
+			response += "</ReceiveMessageResult></ReceiveMessageResponse>"
+			fmt.Fprint(writer, response)
+
+		case "DeleteMessage":
+			deleted = append(deleted, req.Form.Get("QueueUrl")+" "+req.Form.Get("ReceiptHandle"))
+			fmt.Fprint(writer, "<DeleteMessageResponse></DeleteMessageResponse>")
+
+		default:
+			writer.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	defer server.Close()
+
+	stream := &mockHTTPStream{}
+	core.StreamRegistry.Register(stream, core.GetStreamID("s3"))
+	conf := core.NewPluginConfig("")
+	conf.Stream = []string{"s3"}
+	conf.Override("Queue", "notifications")
+	conf.Override("SQSEndpoint", server.URL)
+	conf.Override("S3Endpoint", server.URL)
+	conf.Override("S3ForcePathStyle", true)
+	conf.Override("CredentialType", "static")
+	conf.Override("CredentialId", "id")
+	conf.Override("CredentialSecret", "secret")
+	conf.Override("WaitTimeSec", 0)
+	plugin, err := core.NewPluginWithType("consumer.S3", conf)
+	expect.NoError(err)
+	cons := plugin.(*S3)
+
+	workers := new(sync.WaitGroup)
+	go cons.Consume(workers)
+
+	expect.NonBlocking(5*time.Second, func() {
+		for {
+			guard.Lock()
+			done := len(deleted) == 4
+			guard.Unlock()
+			if done {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	})
+
+	cons.Control() <- core.PluginControlStopConsumer
+	expect.NonBlocking(2*time.Second, workers.Wait)
+
+	guard.Lock()
+	sort.Strings(deleted)
+	queueURL := server.URL + "/queue/notifications"
+	expect.Equal([]string{queueURL + " handle-0", queueURL + " handle-1", queueURL + " handle-2", queueURL + " handle-3"}, deleted)
+	guard.Unlock()
+
+	messages := []string{}
+	for _, msg := range stream.messages {
+		messages = append(messages, msg.Metadata[s3MetadataBucket]+" "+msg.Metadata[s3MetadataKey]+" "+string(msg.Data))
+	}
+	expect.Equal([]string{
+		"bucket plain.log plain 1",
+		"bucket plain.log plain 2",
+		"bucket archive.gz gzip 1",
+		"bucket archive.gz gzip 2",
+		"other dir/sns a.log sns 1",
+	}, messages)
+}
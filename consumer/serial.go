@@ -0,0 +1,354 @@
+// Copyright 2015-2016 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumer
+
+import (
+	"context"
+	"fmt"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/core/log"
+	"github.com/trivago/gollum/shared"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	serialBufferGrowSize  = 256
+	serialMetadataDevice  = "serial_device"
+	serialParityNone      = "none"
+	serialParityOdd       = "odd"
+	serialParityEven      = "even"
+	serialFlowNone        = "none"
+	serialFlowHardware    = "hardware"
+	serialFlowSoftware    = "software"
+	serialDefaultBaudRate = 9600
+)
+
+// Serial consumer plugin
+// The Serial consumer reads messages from a serial port or any other TTY
+// device, e.g. to collect logs from embedded devices or lab equipment.
+// The port is switched to raw mode, i.e. all bytes are passed as-is and
+// messages are separated from the stream by using a specific partitioner
+// method. If the device disappears (e.g. a USB adapter is unplugged) it is
+// reopened until the consumer is stopped. When attached to a fuse, this
+// consumer will stop reading from the device in case that fuse is burned.
+// The device path is attached to each message as "serial_device" metadata.
+// This consumer is currently only supported on Linux, except on MIPS and
+// PowerPC systems.
+// Configuration example
+//
+//  - "consumer.Serial":
+//    Device: "/dev/ttyUSB0"
+//    BaudRate: 9600
+//    DataBits: 8
+//    Parity: "none"
+//    StopBits: 1
+//    FlowControl: "none"
+//    Partitioner: "delimiter"
+//    Delimiter: "\n"
+//    Pattern: ""
+//    Offset: 0
+//    Size: 1
+//    ReconnectAfterSec: 2
+//
+// Device defines the serial port or TTY device to read from.
+// By default this is set to "/dev/ttyUSB0".
+//
+// BaudRate defines the speed of the serial port in bits per second. Only
+// standard rates like 9600, 19200, 38400, 57600 or 115200 are supported.
+// By default this is set to 9600.
+//
+// DataBits defines the number of data bits per character. This can be set to
+// 5, 6, 7 or 8. By default this is set to 8.
+//
+// Parity defines the parity check used by the port. This can be set to "none",
+// "odd" or "even". By default this is set to "none".
+//
+// StopBits defines the number of stop bits. This can be set to 1 or 2.
+// By default this is set to 1.
+//
+// FlowControl defines how the device is throttled. This can be set to "none",
+// "hardware" (RTS/CTS) or "software" (XON/XOFF). By default this is set to
+// "none".
+//
+// Partitioner defines the algorithm used to read messages from the device.
+// By default this is set to "delimiter".
+//  * "delimiter" separates messages by looking for a delimiter string.
+//    The delimiter is removed from the message.
+//  * "ascii" reads an ASCII number at a given offset until a given delimiter is found.
+//    Everything to the right of and including the delimiter is removed from the message.
+//  * "binary" reads a binary number at a given offset and size.
+//  * "binary_le" is an alias for "binary".
+//  * "binary_be" is the same as "binary" but uses big endian encoding.
+//  * "varint" reads an unsigned varint (as used by protocol buffers) at a given
+//    offset.
+//    The offset and the varint are removed from the message.
+//  * "fixed" assumes fixed size messages.
+//  * "regex" starts a new message whenever the regular expression given by
+//    Pattern matches. A message is complete once the start of the next message
+//    has been received or the device hangs up.
+//
+// Delimiter defines the delimiter used by the text and delimiter partitioner.
+// Many devices terminate lines with "\r\n". By default this is set to "\n".
+//
+// Pattern defines the regular expression used by the regex partitioner to
+// find the start of a message. The expression is matched in multi-line mode,
+// i.e. "^" matches the start of any line, and must not match across lines.
+// This setting is mandatory for the regex partitioner.
+//
+// Offset defines the offset used by the binary, varint and text partitioner.
+// By default this is set to 0. This setting is ignored by the fixed partitioner.
+//
+// Size defines the size in bytes used by the binary or fixed partitioner.
+// For binary this can be set to 1,2,4 or 8. By default 4 is chosen.
+// For fixed this defines the size of a message. By default 1 is chosen.
+//
+// ReconnectAfterSec defines the number of seconds to wait before the device
+// is tried to be reopened after an error. By default this is set to 2.
+type Serial struct {
+	core.ConsumerBase
+	device         string
+	settings       serialSettings
+	delimiter      string
+	flags          shared.BufferedReaderFlags
+	offset         int
+	reconnectDelay time.Duration
+	port           *os.File
+	guard          *sync.Mutex
+	ctx            context.Context
+	cancel         context.CancelFunc
+}
+
+// serialSettings holds the line settings of a serial port
+type serialSettings struct {
+	baudRate    int
+	dataBits    int
+	parity      string
+	stopBits    int
+	flowControl string
+}
+
+func init() {
+	shared.TypeRegistry.Register(Serial{})
+}
+
+// Configure initializes this consumer with values from a plugin config.
+func (cons *Serial) Configure(conf core.PluginConfig) error {
+	err := cons.ConsumerBase.Configure(conf)
+	if err != nil {
+		return err
+	}
+
+	cons.device = conf.GetString("Device", "/dev/ttyUSB0")
+	cons.reconnectDelay = time.Duration(conf.GetInt("ReconnectAfterSec", 2)) * time.Second
+	cons.guard = new(sync.Mutex)
+	cons.ctx, cons.cancel = context.WithCancel(context.Background())
+
+	cons.settings = serialSettings{
+		baudRate:    conf.GetInt("BaudRate", serialDefaultBaudRate),
+		dataBits:    conf.GetInt("DataBits", 8),
+		parity:      strings.ToLower(conf.GetString("Parity", serialParityNone)),
+		stopBits:    conf.GetInt("StopBits", 1),
+		flowControl: strings.ToLower(conf.GetString("FlowControl", serialFlowNone)),
+	}
+	if err := cons.settings.validate(); err != nil {
+		return err
+	}
+
+	cons.delimiter = shared.Unescape(conf.GetString("Delimiter", "\n"))
+	cons.offset = conf.GetInt("Offset", 0)
+	cons.flags = 0
+
+	partitioner := strings.ToLower(conf.GetString("Partitioner", "delimiter"))
+	switch partitioner {
+	case "binary_be":
+		cons.flags |= shared.BufferedReaderFlagBigEndian
+		fallthrough
+
+	case "binary", "binary_le":
+		cons.flags |= shared.BufferedReaderFlagEverything
+		switch conf.GetInt("Size", 4) {
+		case 1:
+			cons.flags |= shared.BufferedReaderFlagMLE8
+		case 2:
+			cons.flags |= shared.BufferedReaderFlagMLE16
+		case 4:
+			cons.flags |= shared.BufferedReaderFlagMLE32
+		case 8:
+			cons.flags |= shared.BufferedReaderFlagMLE64
+		default:
+			return fmt.Errorf("Size only supports the value 1,2,4 and 8")
+		}
+
+	case "varint":
+		cons.flags |= shared.BufferedReaderFlagMLEVarint
+
+	case "fixed":
+		cons.flags |= shared.BufferedReaderFlagMLEFixed
+		cons.offset = conf.GetInt("Size", 1)
+
+	case "ascii":
+		cons.flags |= shared.BufferedReaderFlagMLE
+
+	case "regex":
+		cons.flags |= shared.BufferedReaderFlagRegex
+		if cons.delimiter, err = compileStartPattern(conf); err != nil {
+			return err
+		}
+
+	case "delimiter":
+		// Nothing to add
+
+	default:
+		return fmt.Errorf("Unknown partitioner: %s", partitioner)
+	}
+
+	return nil
+}
+
+// validate checks the line settings for values not supported by any port.
+// Baud rates are checked by the platform dependent code when opening a port.
+func (settings serialSettings) validate() error {
+	if settings.baudRate <= 0 {
+		return fmt.Errorf("BaudRate must be a positive number")
+	}
+	if settings.dataBits < 5 || settings.dataBits > 8 {
+		return fmt.Errorf("DataBits only supports the values 5,6,7 and 8")
+	}
+	switch settings.parity {
+	case serialParityNone, serialParityOdd, serialParityEven:
+	default:
+		return fmt.Errorf("Unknown Parity: %s", settings.parity)
+	}
+	if settings.stopBits != 1 && settings.stopBits != 2 {
+		return fmt.Errorf("StopBits only supports the values 1 and 2")
+	}
+	switch settings.flowControl {
+	case serialFlowNone, serialFlowHardware, serialFlowSoftware:
+	default:
+		return fmt.Errorf("Unknown FlowControl: %s", settings.flowControl)
+	}
+	return nil
+}
+
+func (cons *Serial) sleep(duration time.Duration) {
+	select {
+	case <-cons.ctx.Done():
+	case <-time.After(duration):
+	}
+}
+
+func (cons *Serial) enqueue(data []byte, sequence uint64) {
+	msg := core.NewMessage(cons, data, sequence)
+	msg.SetMetadata(serialMetadataDevice, cons.device)
+	cons.EnqueueMessage(msg)
+}
+
+// connect opens the device. The port is kept so that it can be closed when
+// the consumer is stopped.
+func (cons *Serial) connect() (*os.File, error) {
+	port, err := openSerialPort(cons.device, cons.settings)
+	if err != nil {
+		return nil, err // ### return, could not open device ###
+	}
+
+	cons.guard.Lock()
+	defer cons.guard.Unlock()
+	if !cons.IsActive() {
+		port.Close()
+		return nil, io.EOF // ### return, consumer stopped ###
+	}
+	cons.port = port
+	return port, nil
+}
+
+func (cons *Serial) disconnect() {
+	cons.guard.Lock()
+	defer cons.guard.Unlock()
+	if cons.port != nil {
+		cons.port.Close()
+		cons.port = nil
+	}
+}
+
+func (cons *Serial) readPort(port *os.File) {
+	buffer := shared.NewBufferedReader(serialBufferGrowSize, cons.flags, cons.offset, cons.delimiter)
+	defer buffer.Flush(cons.enqueue)
+
+	for cons.IsActive() {
+		cons.WaitOnFuse()
+		err := buffer.ReadAll(port, cons.enqueue)
+		switch {
+		case err == nil:
+			continue // ### continue, all is well ###
+
+		case !cons.IsActive():
+			return // ### return, consumer stopped ###
+
+		case err == shared.BufferDataInvalid:
+			Log.Error.Print("Serial failed to parse data from ", cons.device, ": ", err)
+			continue // ### continue, parser errors do not close the device ###
+
+		case err == io.EOF:
+			Log.Warning.Print("Serial device ", cons.device, " hung up")
+			return // ### return, reopen device ###
+
+		default:
+			Log.Error.Print("Serial read from ", cons.device, " failed: ", err)
+			return // ### return, reopen device ###
+		}
+	}
+}
+
+func (cons *Serial) read() {
+	defer cons.WorkerDone()
+
+	for cons.IsActive() {
+		port, err := cons.connect()
+		if err != nil {
+			if cons.IsActive() {
+				Log.Error.Print("Serial failed to open ", cons.device, ": ", err)
+				cons.sleep(cons.reconnectDelay)
+			}
+			continue // ### continue, retry ###
+		}
+
+		cons.readPort(port)
+		cons.disconnect()
+
+		if cons.IsActive() {
+			cons.sleep(cons.reconnectDelay)
+		}
+	}
+}
+
+func (cons *Serial) close() {
+	cons.cancel()
+	cons.disconnect()
+}
+
+// Consume starts reading from the serial device.
+func (cons *Serial) Consume(workers *sync.WaitGroup) {
+	cons.SetWorkerWaitGroup(workers)
+	cons.SetStopCallback(cons.close)
+
+	cons.AddWorker()
+	go shared.DontPanic(cons.read)
+
+	cons.ControlLoop()
+}
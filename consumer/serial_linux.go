@@ -0,0 +1,180 @@
+// Copyright 2015-2016 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build linux && !mips && !mipsle && !mips64 && !mips64le && !ppc64 && !ppc64le
+// +build linux,!mips,!mipsle,!mips64,!mips64le,!ppc64,!ppc64le
+
+package consumer
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// Constants of asm-generic/ioctls.h and asm-generic/termbits.h that are not
+// part of the frozen syscall package on all architectures. MIPS and PowerPC
+// use different values and are not supported.
+const (
+	serialTCGETS   = 0x5401
+	serialTCSETS   = 0x5402
+	serialTCFLSH   = 0x540b
+	serialTCIFLUSH = 0
+
+	serialIGNBRK = 0x1
+	serialBRKINT = 0x2
+	serialPARMRK = 0x8
+	serialINPCK  = 0x10
+	serialISTRIP = 0x20
+	serialINLCR  = 0x40
+	serialIGNCR  = 0x80
+	serialICRNL  = 0x100
+	serialIXON   = 0x400
+	serialIXANY  = 0x800
+	serialIXOFF  = 0x1000
+
+	serialOPOST = 0x1
+
+	serialCBAUD   = 0x100f
+	serialCSIZE   = 0x30
+	serialCS5     = 0x0
+	serialCS6     = 0x10
+	serialCS7     = 0x20
+	serialCS8     = 0x30
+	serialCSTOPB  = 0x40
+	serialCREAD   = 0x80
+	serialPARENB  = 0x100
+	serialPARODD  = 0x200
+	serialCLOCAL  = 0x800
+	serialCRTSCTS = 0x80000000
+
+	serialISIG   = 0x1
+	serialICANON = 0x2
+	serialECHO   = 0x8
+	serialECHONL = 0x40
+	serialIEXTEN = 0x8000
+
+	serialVTIME = 5
+	serialVMIN  = 6
+)
+
+var serialBaudRates = map[int]uint32{
+	50:      0x1,
+	75:      0x2,
+	110:     0x3,
+	134:     0x4,
+	150:     0x5,
+	200:     0x6,
+	300:     0x7,
+	600:     0x8,
+	1200:    0x9,
+	1800:    0xa,
+	2400:    0xb,
+	4800:    0xc,
+	9600:    0xd,
+	19200:   0xe,
+	38400:   0xf,
+	57600:   0x1001,
+	115200:  0x1002,
+	230400:  0x1003,
+	460800:  0x1004,
+	500000:  0x1005,
+	576000:  0x1006,
+	921600:  0x1007,
+	1000000: 0x1008,
+	1152000: 0x1009,
+	1500000: 0x100a,
+	2000000: 0x100b,
+	2500000: 0x100c,
+	3000000: 0x100d,
+	3500000: 0x100e,
+	4000000: 0x100f,
+}
+
+var serialDataBits = map[int]uint32{
+	5: serialCS5,
+	6: serialCS6,
+	7: serialCS7,
+	8: serialCS8,
+}
+
+func serialIoctl(fd int, request uintptr, arg unsafe.Pointer) error {
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), request, uintptr(arg)); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// openSerialPort opens the given device and switches it to raw mode using
+// the given line settings. The device is opened in non-blocking mode so that
+// reads can be interrupted by closing the returned file.
+func openSerialPort(device string, settings serialSettings) (*os.File, error) {
+	speed, supported := serialBaudRates[settings.baudRate]
+	if !supported {
+		return nil, fmt.Errorf("BaudRate %d is not supported", settings.baudRate)
+	}
+
+	fd, err := syscall.Open(device, syscall.O_RDWR|syscall.O_NOCTTY|syscall.O_NONBLOCK|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: device, Err: err}
+	}
+
+	var term syscall.Termios
+	if err := serialIoctl(fd, serialTCGETS, unsafe.Pointer(&term)); err != nil {
+		syscall.Close(fd)
+		return nil, fmt.Errorf("%s is not a terminal: %s", device, err)
+	}
+
+	term.Iflag &^= serialIGNBRK | serialBRKINT | serialPARMRK | serialISTRIP |
+		serialINLCR | serialIGNCR | serialICRNL | serialIXON | serialIXANY | serialIXOFF | serialINPCK
+	term.Oflag &^= serialOPOST
+	term.Lflag &^= serialECHO | serialECHONL | serialICANON | serialISIG | serialIEXTEN
+	term.Cflag &^= serialCBAUD | serialCSIZE | serialCSTOPB | serialPARENB | serialPARODD | serialCRTSCTS
+	term.Cflag |= speed | serialDataBits[settings.dataBits] | serialCREAD | serialCLOCAL
+
+	switch settings.parity {
+	case serialParityOdd:
+		term.Cflag |= serialPARENB | serialPARODD
+		term.Iflag |= serialINPCK
+	case serialParityEven:
+		term.Cflag |= serialPARENB
+		term.Iflag |= serialINPCK
+	}
+
+	if settings.stopBits == 2 {
+		term.Cflag |= serialCSTOPB
+	}
+
+	switch settings.flowControl {
+	case serialFlowHardware:
+		term.Cflag |= serialCRTSCTS
+	case serialFlowSoftware:
+		term.Iflag |= serialIXON | serialIXOFF
+	}
+
+	term.Ispeed = speed
+	term.Ospeed = speed
+	term.Cc[serialVMIN] = 1
+	term.Cc[serialVTIME] = 0
+
+	if err := serialIoctl(fd, serialTCSETS, unsafe.Pointer(&term)); err != nil {
+		syscall.Close(fd)
+		return nil, fmt.Errorf("Failed to configure %s: %s", device, err)
+	}
+
+	// Discard everything received before the port was configured
+	syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), serialTCFLSH, serialTCIFLUSH)
+	return os.NewFile(uintptr(fd), device), nil
+}
@@ -0,0 +1,132 @@
+// Copyright 2015-2016 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build linux && !mips && !mipsle && !mips64 && !mips64le && !ppc64 && !ppc64le
+// +build linux,!mips,!mipsle,!mips64,!mips64le,!ppc64,!ppc64le
+
+package consumer
+
+import (
+	"fmt"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/shared"
+	"os"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+	"unsafe"
+)
+
+// openTestPty returns the master of a new pseudo terminal and the path of its
+// slave device.
+func openTestPty() (*os.File, string, error) {
+	master, err := os.OpenFile("/dev/ptmx", os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		return nil, "", err
+	}
+
+	unlock := int32(0)
+	if err := serialIoctl(int(master.Fd()), 0x40045431, unsafe.Pointer(&unlock)); err != nil { // TIOCSPTLCK
+		master.Close()
+		return nil, "", err
+	}
+	number := uint32(0)
+	if err := serialIoctl(int(master.Fd()), 0x80045430, unsafe.Pointer(&number)); err != nil { // TIOCGPTN
+		master.Close()
+		return nil, "", err
+	}
+	return master, fmt.Sprintf("/dev/pts/%d", number), nil
+}
+
+func TestSerialPort(t *testing.T) {
+	expect := shared.NewExpect(t)
+
+	master, device, err := openTestPty()
+	if err != nil {
+		t.Skip("requires a pseudo terminal: ", err)
+	}
+	defer master.Close()
+
+	port, err := openSerialPort(device, serialSettings{115200, 7, serialParityOdd, 2, serialFlowSoftware})
+	expect.NoError(err)
+	defer port.Close()
+
+	var term syscall.Termios
+	expect.NoError(serialIoctl(int(port.Fd()), serialTCGETS, unsafe.Pointer(&term)))
+	expect.Equal(uint32(0x1002), term.Cflag&serialCBAUD)
+	// Pseudo terminals always use CS8 without PARENB
+	expect.Equal(uint32(serialPARODD|serialCSTOPB), term.Cflag&(serialPARODD|serialCSTOPB))
+	expect.Equal(uint32(0), term.Lflag&serialICANON)
+	expect.Equal(uint32(serialIXON|serialIXOFF), term.Iflag&(serialIXON|serialIXOFF))
+
+	_, err = openSerialPort(device, serialSettings{1234, 8, serialParityNone, 1, serialFlowNone})
+	expect.NotNil(err)
+	_, err = openSerialPort("/dev/null", serialSettings{9600, 8, serialParityNone, 1, serialFlowNone})
+	expect.NotNil(err)
+}
+
+func TestSerial(t *testing.T) {
+	expect := shared.NewExpect(t)
+
+	master, device, err := openTestPty()
+	if err != nil {
+		t.Skip("requires a pseudo terminal: ", err)
+	}
+	defer master.Close()
+
+	stream := &mockHTTPStream{}
+	core.StreamRegistry.Register(stream, core.GetStreamID("serial"))
+	conf := core.NewPluginConfig("")
+	conf.Stream = []string{"serial"}
+	conf.Override("Device", device)
+	conf.Override("BaudRate", 115200)
+	conf.Override("Delimiter", "\\r\\n")
+	plugin, err := core.NewPluginWithType("consumer.Serial", conf)
+	expect.NoError(err)
+	cons := plugin.(*Serial)
+
+	workers := new(sync.WaitGroup)
+	go cons.Consume(workers)
+
+	expect.NonBlocking(2*time.Second, func() {
+		for {
+			cons.guard.Lock()
+			opened := cons.port != nil
+			cons.guard.Unlock()
+			if opened {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	})
+
+	_, err = master.Write([]byte("boot ok\r\ntemp=42\r\n"))
+	expect.NoError(err)
+
+	expect.NonBlocking(2*time.Second, func() {
+		for stream.count() < 2 {
+			time.Sleep(10 * time.Millisecond)
+		}
+	})
+
+	cons.Control() <- core.PluginControlStopConsumer
+	expect.NonBlocking(2*time.Second, workers.Wait)
+
+	stream.guard.Lock()
+	defer stream.guard.Unlock()
+	expect.Equal("boot ok", string(stream.messages[0].Data))
+	expect.Equal("temp=42", string(stream.messages[1].Data))
+	expect.Equal(device, stream.messages[0].Metadata[serialMetadataDevice])
+}
@@ -0,0 +1,54 @@
+// Copyright 2015-2016 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumer
+
+import (
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/shared"
+	"testing"
+)
+
+func TestSerialConfigure(t *testing.T) {
+	expect := shared.NewExpect(t)
+
+	conf := core.NewPluginConfig("")
+	plugin, err := core.NewPluginWithType("consumer.Serial", conf)
+	expect.NoError(err)
+	cons := plugin.(*Serial)
+	expect.Equal("/dev/ttyUSB0", cons.device)
+	expect.Equal(serialSettings{9600, 8, serialParityNone, 1, serialFlowNone}, cons.settings)
+
+	conf.Override("Parity", "Even")
+	conf.Override("StopBits", 2)
+	conf.Override("FlowControl", "hardware")
+	plugin, err = core.NewPluginWithType("consumer.Serial", conf)
+	expect.NoError(err)
+	expect.Equal(serialSettings{9600, 8, serialParityEven, 2, serialFlowHardware}, plugin.(*Serial).settings)
+
+	invalid := map[string]interface{}{
+		"BaudRate":    0,
+		"DataBits":    9,
+		"Parity":      "mark",
+		"StopBits":    3,
+		"FlowControl": "dtr",
+		"Partitioner": "regex",
+	}
+	for key, value := range invalid {
+		conf := core.NewPluginConfig("")
+		conf.Override(key, value)
+		_, err := core.NewPluginWithType("consumer.Serial", conf)
+		expect.NotNil(err)
+	}
+}
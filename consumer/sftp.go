@@ -0,0 +1,695 @@
+// Copyright 2015-2016 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumer
+
+import (
+	"context"
+	"crypto/sha1"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"github.com/pkg/sftp"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/core/log"
+	"github.com/trivago/gollum/shared"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+	"io/ioutil"
+	"net"
+	"net/textproto"
+	"net/url"
+	"os"
+	"os/user"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	sftpMetadataServer = "sftp_server"
+	sftpAfterKeep      = "keep"
+	sftpAfterDelete    = "delete"
+	sftpAfterMove      = "move"
+	sftpOffsetNewest   = "newest"
+	sftpOffsetOldest   = "oldest"
+)
+
+// SFTP consumer plugin
+// The SFTP consumer polls a directory on an SFTP or FTP server for new files,
+// downloads them and splits them into messages by the configured
+// partitioner. Files compressed with gzip are decompressed automatically.
+// Files are downloaded to a local directory first. Interrupted downloads are
+// resumed from the last byte received, so large files do not have to be
+// transferred again after a connection failure or a restart.
+// Once a file has been read completely it can be deleted or moved to another
+// remote directory. The size and modification time of each file read are
+// stored, so files that are kept are only read again after they changed.
+// Files are read at least once, i.e. messages of a file may be sent again
+// if gollum is stopped before the file has been marked as read.
+// The remote path of the file and the address of the server are attached to
+// each message as "file_name" and "sftp_server" metadata.
+// When attached to a fuse, this consumer will stop polling in case that fuse
+// is burned.
+// Configuration example
+//
+//  - "consumer.SFTP":
+//    Address: "sftp://localhost:22"
+//    User: ""
+//    Password: ""
+//    PrivateKeyFile: ""
+//    PrivateKeyPassphrase: ""
+//    KnownHostsFile: ""
+//    HostKeyFingerprint: ""
+//    InsecureIgnoreHostKey: false
+//    Directory: "."
+//    Pattern: "*"
+//    MinFileAgeSec: 0
+//    PollIntervalSec: 60
+//    After: "keep"
+//    MoveToDirectory: ""
+//    DefaultOffset: "oldest"
+//    StateFile: ""
+//    DownloadDirectory: ""
+//    Partitioner: "delimiter"
+//    Delimiter: "\n"
+//    Offset: 0
+//    Size: 1
+//    Compression: "auto"
+//    MaxObjectSizeByte: 67108864
+//    TimeoutSec: 30
+//    RetryDelayMs: 3000
+//    TlsKeyLocation: ""
+//    TlsCertificateLocation: ""
+//    TlsCaLocation: ""
+//    TlsServerName: ""
+//    TlsInsecureSkipVerify: false
+//
+// Address defines the server to connect to as URL. The scheme "sftp" uses the
+// SSH file transfer protocol, "ftp" uses plain FTP and "ftps" uses FTP with
+// explicit TLS (AUTH TLS). If no port is given, 22 is used for "sftp" and 21
+// for "ftp" and "ftps". By default this is set to "sftp://localhost:22".
+//
+// User defines the name of the user to log in as. By default this is set to
+// "" which uses the user running gollum for SFTP and "anonymous" for FTP.
+//
+// Password defines the password to log in with. For SFTP the password is
+// only used if authentication by PrivateKeyFile fails or no key is given.
+// By default this is set to "".
+//
+// PrivateKeyFile defines the path to the private key used to authenticate
+// against an SFTP server. Ed25519, ECDSA and RSA keys in OpenSSH or PEM format
+// are supported. By default this is set to "".
+//
+// PrivateKeyPassphrase defines the passphrase of an encrypted private key
+// in OpenSSH format. By default this is set to "".
+//
+// KnownHostsFile defines the OpenSSH known_hosts file used to verify the host
+// key of an SFTP server. Entries with hashed host names are supported.
+// By default this is set to "" which uses ~/.ssh/known_hosts of the user
+// running gollum.
+//
+// HostKeyFingerprint can be set to a comma separated list of SHA256
+// fingerprints as printed by "ssh-keygen -l", e.g.
+// "SHA256:47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU". If set, host keys are
+// verified against this list instead of KnownHostsFile.
+// By default this is set to "".
+//
+// InsecureIgnoreHostKey can be set to true to accept any host key. This
+// should only be used for testing. By default this is set to false.
+//
+// Directory defines the remote directory to poll. Relative paths are
+// relative to the login directory. By default this is set to ".".
+//
+// Pattern defines a shell pattern that the name of a file has to match to
+// be read, e.g. "*.csv". By default this is set to "*".
+//
+// MinFileAgeSec defines the number of seconds since the last modification
+// of a file before it is read. This prevents reading files that are still
+// being uploaded. By default this is set to 0.
+//
+// PollIntervalSec defines the number of seconds between two listings of the
+// directory. By default this is set to 60.
+//
+// After defines what happens to a file once it has been read.
+// By default this is set to "keep".
+//  * "keep" leaves the file untouched.
+//  * "delete" removes the file from the server.
+//  * "move" moves the file to MoveToDirectory.
+//
+// MoveToDirectory defines the remote directory files are moved to if After
+// is set to "move". By default this is set to "".
+//
+// DefaultOffset defines which files are read when no state is known. If set
+// to "oldest" all files are read, if set to "newest" only files that
+// appear or change after the first listing are read. By default this is set
+// to "oldest".
+//
+// StateFile defines the path to a file storing the size and modification time
+// of all files read. If no file is given, the state is only kept in memory and
+// kept files are read again after a restart. By default this is set to "".
+//
+// DownloadDirectory defines a local directory to store partial downloads in.
+// By default this is set to "" which uses a temporary directory that is
+// removed when gollum stops. In this case downloads are not resumed after
+// a restart.
+//
+// Partitioner defines the algorithm used to read messages from a file.
+// By default this is set to "delimiter".
+//  * "delimiter" separates messages by looking for a delimiter string.
+//    The delimiter is removed from the message. A missing delimiter at the
+//    end of a file is tolerated.
+//  * "object" treats each file as exactly one message.
+//  * "ascii" reads an ASCII number at a given offset until a given delimiter is found.
+//    Everything to the right of and including the delimiter is removed from the message.
+//  * "binary" reads a binary number at a given offset and size.
+//  * "binary_le" is an alias for "binary".
+//  * "binary_be" is the same as "binary" but uses big endian encoding.
+//  * "varint" reads an unsigned varint (as used by protocol buffers) at a given
+//    offset.
+//    The offset and the varint are removed from the message.
+//  * "fixed" assumes fixed size messages.
+//
+// Delimiter defines the delimiter used by the text and delimiter partitioner.
+// By default this is set to "\n".
+//
+// Offset defines the offset used by the binary, varint and text partitioner.
+// By default this is set to 0. This setting is ignored by the fixed partitioner.
+//
+// Size defines the size in bytes used by the binary or fixed partitioner.
+// For binary this can be set to 1,2,4 or 8. By default 4 is chosen.
+// For fixed this defines the size of a message. By default 1 is chosen.
+//
+// Compression defines how files are decompressed. "auto" decompresses
+// files starting with the gzip magic bytes, "gzip" expects all files to
+// be compressed and "none" disables decompression.
+// By default this is set to "auto".
+//
+// MaxObjectSizeByte defines the maximum size of files read by the "object"
+// partitioner after decompression. Larger files are not sent and reading them
+// fails. By default this is set to 67108864 (64 MB).
+//
+// TimeoutSec defines the number of seconds to wait for the server to
+// respond before the connection is closed. By default this is set to 30.
+//
+// RetryDelayMs defines the number of milliseconds to wait before connecting
+// again after an error. By default this is set to 3000.
+//
+// TlsKeyLocation defines the path to the client's private key (PEM) used
+// for "ftps" connections. By default this is set to "".
+//
+// TlsCertificateLocation defines the path to the client's public key (PEM)
+// used for "ftps" connections. By default this is set to "".
+//
+// TlsCaLocation defines the path to CA certificate(s) for verifying the
+// server's certificate of "ftps" connections. By default this is set to ""
+// which uses the system's root CAs.
+//
+// TlsServerName is used to verify the hostname on the server's certificate
+// unless TlsInsecureSkipVerify is true. By default this is set to "", which
+// uses the host of Address.
+//
+// TlsInsecureSkipVerify controls whether to verify the server's certificate
+// chain and host name. By default this is set to false.
+type SFTP struct {
+	core.ConsumerBase
+	scheme         string
+	address        string
+	user           string
+	password       string
+	sshSigner      ssh.Signer
+	knownHostsFile string
+	fingerprints   []string
+	ignoreHostKey  bool
+	tlsConfig      *tls.Config
+	directory      string
+	pattern        string
+	minFileAge     time.Duration
+	pollInterval   time.Duration
+	after          string
+	moveTo         string
+	downloadDir    string
+	timeout        time.Duration
+	retryDelay     time.Duration
+	skipExisting   bool
+	reader         *objectReader
+	state          *fileCheckpointStore
+	client         remoteFileClient
+	guard          *sync.Mutex
+	ctx            context.Context
+	cancel         context.CancelFunc
+	sequence       uint64
+}
+
+func init() {
+	shared.TypeRegistry.Register(SFTP{})
+}
+
+// Configure initializes this consumer with values from a plugin config.
+func (cons *SFTP) Configure(conf core.PluginConfig) error {
+	err := cons.ConsumerBase.Configure(conf)
+	if err != nil {
+		return err
+	}
+
+	if cons.reader, err = newObjectReader(conf); err != nil {
+		return err
+	}
+	if cons.state, err = newFileCheckpointStore(conf.GetString("StateFile", "")); err != nil {
+		return err
+	}
+
+	address := conf.GetString("Address", "sftp://localhost:22")
+	if !strings.Contains(address, "://") {
+		address = "sftp://" + address
+	}
+	serverURL, err := url.Parse(address)
+	if err != nil {
+		return err
+	}
+	cons.scheme = strings.ToLower(serverURL.Scheme)
+	port := serverURL.Port()
+	switch cons.scheme {
+	case "sftp":
+		if port == "" {
+			port = "22"
+		}
+	case "ftp", "ftps":
+		if port == "" {
+			port = "21"
+		}
+	default:
+		return fmt.Errorf("Unsupported scheme %s, use sftp, ftp or ftps", cons.scheme)
+	}
+	if serverURL.Hostname() == "" {
+		return fmt.Errorf("Address must contain a host")
+	}
+	cons.address = net.JoinHostPort(serverURL.Hostname(), port)
+
+	cons.user = conf.GetString("User", "")
+	cons.password = conf.GetString("Password", "")
+	if cons.user == "" && cons.scheme == "sftp" {
+		if currentUser, err := user.Current(); err == nil {
+			cons.user = currentUser.Username
+		}
+	}
+
+	if keyFile := conf.GetString("PrivateKeyFile", ""); keyFile != "" {
+		keyData, err := ioutil.ReadFile(keyFile)
+		if err != nil {
+			return err
+		}
+		if passphrase := conf.GetString("PrivateKeyPassphrase", ""); passphrase != "" {
+			cons.sshSigner, err = ssh.ParsePrivateKeyWithPassphrase(keyData, []byte(passphrase))
+		} else {
+			cons.sshSigner, err = ssh.ParsePrivateKey(keyData)
+		}
+		if err != nil {
+			return fmt.Errorf("Failed to load %s: %s", keyFile, err)
+		}
+	}
+
+	cons.knownHostsFile = conf.GetString("KnownHostsFile", "")
+	if cons.knownHostsFile == "" {
+		if currentUser, err := user.Current(); err == nil {
+			cons.knownHostsFile = filepath.Join(currentUser.HomeDir, ".ssh", "known_hosts")
+		}
+	}
+	for _, fingerprint := range strings.Split(conf.GetString("HostKeyFingerprint", ""), ",") {
+		if fingerprint = strings.TrimSpace(fingerprint); fingerprint != "" {
+			cons.fingerprints = append(cons.fingerprints, fingerprint)
+		}
+	}
+	cons.ignoreHostKey = conf.GetBool("InsecureIgnoreHostKey", false)
+
+	if cons.scheme == "ftps" {
+		cons.tlsConfig, err = shared.NewClientTLSConfig(
+			conf.GetString("TlsCertificateLocation", ""),
+			conf.GetString("TlsKeyLocation", ""),
+			conf.GetString("TlsCaLocation", ""),
+			conf.GetString("TlsServerName", ""),
+			conf.GetBool("TlsInsecureSkipVerify", false))
+		if err != nil {
+			return err
+		}
+	}
+
+	cons.directory = conf.GetString("Directory", ".")
+	cons.pattern = conf.GetString("Pattern", "*")
+	if _, err := path.Match(cons.pattern, ""); err != nil {
+		return fmt.Errorf("Invalid Pattern: %s", err)
+	}
+
+	cons.minFileAge = time.Duration(conf.GetInt("MinFileAgeSec", 0)) * time.Second
+	cons.pollInterval = time.Duration(shared.MaxI(conf.GetInt("PollIntervalSec", 60), 1)) * time.Second
+	cons.timeout = time.Duration(conf.GetInt("TimeoutSec", 30)) * time.Second
+	cons.retryDelay = time.Duration(conf.GetInt("RetryDelayMs", 3000)) * time.Millisecond
+	cons.downloadDir = conf.GetString("DownloadDirectory", "")
+
+	cons.after = strings.ToLower(conf.GetString("After", sftpAfterKeep))
+	cons.moveTo = conf.GetString("MoveToDirectory", "")
+	switch cons.after {
+	case sftpAfterKeep, sftpAfterDelete:
+	case sftpAfterMove:
+		if cons.moveTo == "" {
+			return fmt.Errorf("After \"move\" requires MoveToDirectory")
+		}
+	default:
+		return fmt.Errorf("Unknown After: %s", cons.after)
+	}
+
+	switch offset := strings.ToLower(conf.GetString("DefaultOffset", sftpOffsetOldest)); offset {
+	case sftpOffsetOldest, sftpOffsetNewest:
+		cons.skipExisting = offset == sftpOffsetNewest
+	default:
+		return fmt.Errorf("DefaultOffset must be \"%s\" or \"%s\"", sftpOffsetNewest, sftpOffsetOldest)
+	}
+
+	cons.guard = new(sync.Mutex)
+	cons.ctx, cons.cancel = context.WithCancel(context.Background())
+	return nil
+}
+
+func (cons *SFTP) sleep(duration time.Duration) {
+	select {
+	case <-cons.ctx.Done():
+	case <-time.After(duration):
+	}
+}
+
+// checkFingerprint verifies the host key of an SFTP server against
+// HostKeyFingerprint.
+func (cons *SFTP) checkFingerprint(hostname string, remote net.Addr, key ssh.PublicKey) error {
+	fingerprint := ssh.FingerprintSHA256(key)
+	for _, expected := range cons.fingerprints {
+		if expected == fingerprint {
+			return nil // ### return, known fingerprint ###
+		}
+	}
+	return fmt.Errorf("Host key %s does not match HostKeyFingerprint", fingerprint)
+}
+
+// configureHostKey sets the host key verification of an SFTP connection.
+func (cons *SFTP) configureHostKey(config *ssh.ClientConfig) error {
+	switch {
+	case cons.ignoreHostKey:
+		config.HostKeyCallback = ssh.InsecureIgnoreHostKey()
+	case len(cons.fingerprints) > 0:
+		config.HostKeyCallback = cons.checkFingerprint
+	default:
+		callback, err := knownhosts.New(cons.knownHostsFile)
+		if err != nil {
+			return err
+		}
+		config.HostKeyCallback = callback
+		config.HostKeyAlgorithms = sshHostKeyAlgorithms(callback, cons.address)
+	}
+	return nil
+}
+
+func (cons *SFTP) dial() (remoteFileClient, error) {
+	if cons.scheme != "sftp" {
+		return dialFTP(cons.address, cons.user, cons.password, cons.tlsConfig, cons.timeout)
+	}
+
+	config := &ssh.ClientConfig{
+		User:    cons.user,
+		Timeout: cons.timeout,
+	}
+	if cons.sshSigner != nil {
+		config.Auth = append(config.Auth, ssh.PublicKeys(cons.sshSigner))
+	}
+	if cons.password != "" || cons.sshSigner == nil {
+		config.Auth = append(config.Auth, ssh.Password(cons.password))
+	}
+	if err := cons.configureHostKey(config); err != nil {
+		return nil, err
+	}
+	return dialSFTP(cons.address, config, cons.timeout)
+}
+
+// connect opens a new connection. The connection is kept so that it can be
+// closed when the consumer is stopped.
+func (cons *SFTP) connect() (remoteFileClient, error) {
+	client, err := cons.dial()
+	if err != nil {
+		return nil, err
+	}
+
+	cons.guard.Lock()
+	defer cons.guard.Unlock()
+	if !cons.IsActive() {
+		client.close()
+		return nil, fmt.Errorf("Consumer stopped")
+	}
+	cons.client = client
+	return client, nil
+}
+
+func (cons *SFTP) disconnect() {
+	cons.guard.Lock()
+	defer cons.guard.Unlock()
+	if cons.client != nil {
+		cons.client.close()
+		cons.client = nil
+	}
+}
+
+// fileState returns the state stored for a file once it has been read.
+func (cons *SFTP) fileState(file remoteFile) string {
+	return strconv.FormatInt(file.size, 10) + ":" + strconv.FormatInt(file.modTime.Unix(), 10)
+}
+
+func (cons *SFTP) markRead(file remoteFile) {
+	if err := cons.state.store(file.path, cons.fileState(file)); err != nil {
+		Log.Error.Print("SFTP failed to store state: ", err)
+	}
+}
+
+// downloadPath returns the local path of a partial download. Paths depend
+// on the size and modification time, so changed files are not resumed.
+func (cons *SFTP) downloadPath(file remoteFile) string {
+	digest := sha1.Sum([]byte(cons.scheme + "://" + cons.address + "/" + file.path + "@" + cons.fileState(file)))
+	return filepath.Join(cons.downloadDir, fmt.Sprintf("%x.part", digest))
+}
+
+// download fetches a file to the download directory or resumes a previously
+// interrupted download. The path of the local file is returned.
+func (cons *SFTP) download(client remoteFileClient, file remoteFile) (string, error) {
+	localPath := cons.downloadPath(file)
+	local, err := os.OpenFile(localPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return "", err
+	}
+	defer local.Close()
+
+	info, err := local.Stat()
+	if err != nil {
+		return "", err
+	}
+	offset := info.Size()
+	if offset > file.size {
+		if err := local.Truncate(0); err != nil {
+			return "", err
+		}
+		offset = 0
+	}
+
+	if offset < file.size {
+		if offset > 0 {
+			Log.Note.Printf("SFTP resumes download of %s at byte %d", file.path, offset)
+		}
+		if err := client.download(file.path, offset, local); err != nil {
+			return "", err
+		}
+		if info, err = local.Stat(); err != nil {
+			return "", err
+		}
+		if info.Size() < file.size {
+			return "", fmt.Errorf("Incomplete download, received %d of %d bytes", info.Size(), file.size)
+		}
+	}
+	return localPath, nil
+}
+
+// processFile downloads a file, enqueues its messages and removes or moves
+// the remote file if configured.
+func (cons *SFTP) processFile(client remoteFileClient, file remoteFile) error {
+	localPath, err := cons.download(client, file)
+	if err != nil {
+		return err
+	}
+
+	local, err := os.Open(localPath)
+	if err != nil {
+		return err
+	}
+	err = cons.reader.read(local, func(data []byte) {
+		msg := core.NewMessage(cons, data, atomic.AddUint64(&cons.sequence, 1))
+		msg.SetMetadata(core.MetadataFileName, file.path)
+		msg.SetMetadata(sftpMetadataServer, cons.address)
+		cons.EnqueueMessage(msg)
+	})
+	local.Close()
+
+	switch err {
+	case nil:
+	case shared.BufferDataInvalid:
+		Log.Warning.Print("SFTP failed to parse parts of ", file.path)
+	default:
+		return err
+	}
+
+	cons.markRead(file)
+	if err := os.Remove(localPath); err != nil {
+		Log.Warning.Print("SFTP failed to remove download: ", err)
+	}
+
+	switch cons.after {
+	case sftpAfterDelete:
+		err = client.remove(file.path)
+	case sftpAfterMove:
+		err = client.rename(file.path, path.Join(cons.moveTo, file.name))
+	}
+	if err != nil {
+		Log.Warning.Printf("SFTP failed to %s %s: %s", cons.after, file.path, err)
+	}
+	return nil
+}
+
+// isFileError returns true if the given error only affects a single file,
+// i.e. the connection is still usable.
+func isFileError(err error) bool {
+	var (
+		statusErr *sftp.StatusError
+		protoErr  *textproto.Error
+		pathErr   *os.PathError
+	)
+	return errors.As(err, &statusErr) || errors.As(err, &protoErr) || errors.As(err, &pathErr) ||
+		errors.Is(err, os.ErrNotExist) || errors.Is(err, os.ErrPermission)
+}
+
+// pollDirectory lists the remote directory and reads all new files, oldest
+// first.
+func (cons *SFTP) pollDirectory(client remoteFileClient, skipExisting *bool) error {
+	files, err := client.list(cons.directory)
+	if err != nil {
+		return err
+	}
+
+	state, _ := cons.state.checkpoints()
+	candidates := []remoteFile{}
+	for _, file := range files {
+		if matched, _ := path.Match(cons.pattern, file.name); !matched {
+			continue // ### continue, ignored file ###
+		}
+		if cons.minFileAge > 0 && !file.modTime.IsZero() && time.Since(file.modTime) < cons.minFileAge {
+			continue // ### continue, file might still be written ###
+		}
+		if state[file.path] == cons.fileState(file) {
+			continue // ### continue, already read ###
+		}
+		candidates = append(candidates, file)
+	}
+
+	if *skipExisting && len(state) == 0 {
+		for _, file := range candidates {
+			cons.markRead(file)
+		}
+		candidates = nil
+	}
+	*skipExisting = false
+
+	sort.Slice(candidates, func(i, j int) bool {
+		if !candidates[i].modTime.Equal(candidates[j].modTime) {
+			return candidates[i].modTime.Before(candidates[j].modTime)
+		}
+		return candidates[i].name < candidates[j].name
+	})
+
+	for _, file := range candidates {
+		if !cons.IsActive() || cons.IsFuseBurned() {
+			return nil // ### return, continue with next listing ###
+		}
+		if err := cons.processFile(client, file); err != nil {
+			if !isFileError(err) {
+				return err // ### return, connection failed ###
+			}
+			Log.Error.Printf("SFTP failed to read %s: %s", file.path, err)
+		}
+	}
+	return nil
+}
+
+// poll connects to the server periodically and reads all new files.
+func (cons *SFTP) poll() {
+	defer cons.WorkerDone()
+
+	skipExisting := cons.skipExisting
+	for cons.IsActive() {
+		if cons.IsFuseBurned() {
+			cons.sleep(time.Second)
+			continue // ### continue, fuse burned ###
+		}
+
+		client, err := cons.connect()
+		if err == nil {
+			err = cons.pollDirectory(client, &skipExisting)
+			cons.disconnect()
+		}
+
+		if err != nil {
+			if cons.IsActive() {
+				Log.Error.Printf("SFTP failed to poll %s://%s/%s: %s", cons.scheme, cons.address, cons.directory, err)
+				cons.sleep(cons.retryDelay)
+			}
+			continue // ### continue, retry ###
+		}
+		cons.sleep(cons.pollInterval)
+	}
+}
+
+func (cons *SFTP) close() {
+	cons.cancel()
+	cons.disconnect()
+}
+
+// Consume starts polling the remote directory.
+func (cons *SFTP) Consume(workers *sync.WaitGroup) {
+	if cons.downloadDir == "" {
+		tempDir, err := ioutil.TempDir("", "gollum_sftp")
+		if err != nil {
+			Log.Error.Print("SFTP failed to create download directory: ", err)
+			return // ### return, no download directory ###
+		}
+		cons.downloadDir = tempDir
+		defer os.RemoveAll(tempDir)
+	} else if err := os.MkdirAll(cons.downloadDir, 0700); err != nil {
+		Log.Error.Print("SFTP failed to create download directory: ", err)
+		return // ### return, no download directory ###
+	}
+
+	cons.SetWorkerWaitGroup(workers)
+	cons.SetStopCallback(cons.close)
+
+	cons.AddWorker()
+	go shared.DontPanic(cons.poll)
+
+	cons.ControlLoop()
+}
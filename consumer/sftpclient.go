@@ -0,0 +1,212 @@
+// Copyright 2015-2016 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumer
+
+import (
+	"fmt"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+	"io"
+	"net"
+	"path"
+	"time"
+)
+
+// remoteFile describes a regular file found on a remote server.
+type remoteFile struct {
+	path    string
+	name    string
+	size    int64
+	modTime time.Time
+}
+
+// remoteFileClient is a connection to a server like SFTP or FTP that
+// provides access to remote files.
+type remoteFileClient interface {
+	// list returns all regular files in the given directory.
+	list(directory string) ([]remoteFile, error)
+
+	// download writes the contents of the given file starting at offset to
+	// writer.
+	download(filePath string, offset int64, writer io.Writer) error
+
+	// remove deletes the given file.
+	remove(filePath string) error
+
+	// rename moves the given file.
+	rename(filePath, newPath string) error
+
+	// close closes the connection. It can be called from any go routine to
+	// interrupt blocking calls.
+	close() error
+}
+
+// sftpClient provides access to an SFTP server.
+type sftpClient struct {
+	ssh  *ssh.Client
+	sftp *sftp.Client
+	done chan struct{}
+}
+
+// dialSFTP connects to an SSH server and starts the SFTP subsystem.
+func dialSFTP(address string, config *ssh.ClientConfig, timeout time.Duration) (*sftpClient, error) {
+	conn, err := net.DialTimeout("tcp", address, timeout)
+	if err != nil {
+		return nil, err
+	}
+	if timeout > 0 {
+		conn.SetDeadline(time.Now().Add(timeout))
+	}
+	sshConn, channels, requests, err := ssh.NewClientConn(conn, address, config)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+
+	client := &sftpClient{
+		ssh:  ssh.NewClient(sshConn, channels, requests),
+		done: make(chan struct{}),
+	}
+	go func() {
+		client.ssh.Wait()
+		close(client.done)
+	}()
+
+	if client.sftp, err = sftp.NewClient(client.ssh); err != nil {
+		client.ssh.Close()
+		return nil, err
+	}
+	if timeout > 0 {
+		go client.keepAlive(timeout)
+	}
+	return client, nil
+}
+
+// keepAlive closes the connection if the server does not answer a keepalive
+// request within the timeout. SSH connections are read continuously, so a
+// read deadline cannot be used to detect a stalled server.
+func (client *sftpClient) keepAlive(timeout time.Duration) {
+	for {
+		select {
+		case <-client.done:
+			return // ### return, connection closed ###
+		case <-time.After(timeout / 2):
+		}
+
+		timer := time.AfterFunc(timeout, func() { client.close() })
+		_, _, err := client.ssh.SendRequest("keepalive@openssh.com", true, nil)
+		timer.Stop()
+		if err != nil {
+			return // ### return, connection closed ###
+		}
+	}
+}
+
+func (client *sftpClient) list(directory string) ([]remoteFile, error) {
+	infos, err := client.sftp.ReadDir(directory)
+	if err != nil {
+		return nil, err
+	}
+
+	files := []remoteFile{}
+	for _, info := range infos {
+		if info.Mode().IsRegular() {
+			files = append(files, remoteFile{
+				path:    path.Join(directory, info.Name()),
+				name:    info.Name(),
+				size:    info.Size(),
+				modTime: info.ModTime(),
+			})
+		}
+	}
+	return files, nil
+}
+
+func (client *sftpClient) download(filePath string, offset int64, writer io.Writer) error {
+	file, err := client.sftp.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+	_, err = file.WriteTo(writer)
+	return err
+}
+
+func (client *sftpClient) remove(filePath string) error {
+	return client.sftp.Remove(filePath)
+}
+
+func (client *sftpClient) rename(filePath, newPath string) error {
+	return client.sftp.Rename(filePath, newPath)
+}
+
+func (client *sftpClient) close() error {
+	return client.ssh.Close()
+}
+
+// sshProbeKey is a host key that is never known. Checking it against a
+// known_hosts file returns all keys known for a host.
+type sshProbeKey struct{}
+
+func (sshProbeKey) Type() string {
+	return "probe"
+}
+
+func (sshProbeKey) Marshal() []byte {
+	return []byte("probe")
+}
+
+func (sshProbeKey) Verify(data []byte, signature *ssh.Signature) error {
+	return fmt.Errorf("Probe key cannot verify signatures")
+}
+
+// sshHostKeyAlgorithms returns the host key algorithms to negotiate with the
+// given server. Algorithms of keys known for the server are preferred, so
+// that the server does not present a key of another type that cannot be
+// verified. Nil is returned if no key is known.
+func sshHostKeyAlgorithms(callback ssh.HostKeyCallback, address string) []string {
+	err := callback(address, &net.TCPAddr{IP: net.IPv4zero}, sshProbeKey{})
+	keyErr, isKeyErr := err.(*knownhosts.KeyError)
+	if !isKeyErr || len(keyErr.Want) == 0 {
+		return nil // ### return, no known key ###
+	}
+
+	algorithms := []string{}
+	known := map[string]bool{}
+	for _, want := range keyErr.Want {
+		keyAlgorithms := []string{want.Key.Type()}
+		if want.Key.Type() == ssh.KeyAlgoRSA {
+			keyAlgorithms = []string{ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256, ssh.KeyAlgoRSA}
+		}
+		for _, algorithm := range keyAlgorithms {
+			if !known[algorithm] {
+				known[algorithm] = true
+				algorithms = append(algorithms, algorithm)
+			}
+		}
+	}
+	for _, algorithm := range ssh.SupportedAlgorithms().HostKeys {
+		if !known[algorithm] {
+			algorithms = append(algorithms, algorithm)
+		}
+	}
+	return algorithms
+}
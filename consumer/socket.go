@@ -43,22 +43,38 @@ const (
 //
 //  - "consumer.Socket":
 //    Address: ":5880"
-//    Permissions: "0770"
+//    SocketPermissions: "0770"
+//    SocketOwner: ""
+//    SocketGroup: ""
+//    RemoveOldSocket: true
 //    Acknowledge: ""
 //    Partitioner: "delimiter"
 //    Delimiter: "\n"
+//    Pattern: ""
 //    Offset: 0
 //    Size: 1
 //    ReconnectAfterSec: 2
 //    AckTimoutSec: 2
 //    ReadTimeoutSec: 5
+//    AcceptProxyProtocol: false
 //
 // Address defines the protocol, host and port or socket to bind to.
 // This can either be any ip address and port like "localhost:5880" or a file
 // like "unix:///var/gollum.socket". By default this is set to ":5880".
+// Sockets in the Linux abstract namespace can be used by prefixing the name
+// with "@", e.g. "unix://@gollum".
 //
-// Permissions sets the file permissions for "unix://" based connections as an
-// four digit octal number string. By default this is set to "0770".
+// SocketPermissions sets the file permissions for "unix://" based connections
+// as an four digit octal number string. By default this is set to "0770".
+// The old name "Permissions" is still supported.
+//
+// SocketOwner sets the user owning the socket file of "unix://" based
+// connections. Users can be given by name or numeric id. By default this is
+// set to "" which keeps the user running gollum.
+//
+// SocketGroup sets the group owning the socket file of "unix://" based
+// connections. Groups can be given by name or numeric id. By default this is
+// set to "" which keeps the primary group of the user running gollum.
 //
 // Acknowledge can be set to a non-empty value to inform the writer on success
 // or error. On success the given string is send. Any error will close the
@@ -76,12 +92,24 @@ const (
 //  * "binary" reads a binary number at a given offset and size.
 //  * "binary_le" is an alias for "binary".
 //  * "binary_be" is the same as "binary" but uses big endian encoding.
+//  * "varint" reads an unsigned varint (as used by protocol buffers) at a given
+//    offset.
+//    The offset and the varint are removed from the message.
 //  * "fixed" assumes fixed size messages.
+//  * "regex" starts a new message whenever the regular expression given by
+//    Pattern matches. A message is complete once the start of the next message
+//    has been received or the connection is closed.
 //
 // Delimiter defines the delimiter used by the text and delimiter partitioner.
 // By default this is set to "\n".
 //
-// Offset defines the offset used by the binary and text partitioner.
+// Pattern defines the regular expression used by the regex partitioner to
+// find the start of a message, e.g. ^<\d+>\w{3} \d. The expression is
+// matched in multi-line mode, i.e. "^" matches the start of any line, and
+// must not match across lines. This setting is mandatory for the regex
+// partitioner.
+//
+// Offset defines the offset used by the binary, varint and text partitioner.
 // By default this is set to 0. This setting is ignored by the fixed partitioner.
 //
 // Size defines the size in bytes used by the binary or fixed partitioner.
@@ -97,8 +125,16 @@ const (
 // ReadTimoutSec defines the number of seconds that waited for data to be
 // received. Set to 5 by default.
 //
-// RemoveOldSocket toggles removing exisiting files with the same name as the
-// socket (unix://<path>) prior to connecting. Enabled by default.
+// RemoveOldSocket toggles removing stale socket files with the same name as the
+// socket (unix://<path>) prior to connecting. Sockets still in use by another
+// process and files that are not sockets are never removed. Enabled by default.
+//
+// AcceptProxyProtocol can be set to true to expect a PROXY protocol header
+// (version 1 or 2) at the start of each TCP or unix socket connection as sent
+// by e.g. HAProxy or AWS ELB. The source address transmitted by this header is
+// attached to each message as "source_address" metadata instead of the address
+// of the connecting load balancer. Connections without a valid header are
+// closed. This setting is ignored for UDP. By default this is set to false.
 type Socket struct {
 	core.ConsumerBase
 	listen        io.Closer
@@ -113,8 +149,11 @@ type Socket struct {
 	readTimeout   time.Duration
 	flags         shared.BufferedReaderFlags
 	fileFlags     os.FileMode
+	fileOwner     string
+	fileGroup     string
 	offset        int
 	clearSocket   bool
+	proxyProtocol bool
 }
 
 func init() {
@@ -128,11 +167,13 @@ func (cons *Socket) Configure(conf core.PluginConfig) error {
 		return err
 	}
 
-	flags, err := strconv.ParseInt(conf.GetString("Permissions", "0770"), 8, 32)
+	flags, err := strconv.ParseInt(conf.GetString("SocketPermissions", conf.GetString("Permissions", "0770")), 8, 32)
 	cons.fileFlags = os.FileMode(flags)
 	if err != nil {
 		return err
 	}
+	cons.fileOwner = conf.GetString("SocketOwner", "")
+	cons.fileGroup = conf.GetString("SocketGroup", "")
 
 	cons.clients = list.New()
 	cons.clientLock = new(sync.Mutex)
@@ -142,6 +183,7 @@ func (cons *Socket) Configure(conf core.PluginConfig) error {
 	cons.ackTimeout = time.Duration(conf.GetInt("AckTimoutSec", 2)) * time.Second
 	cons.readTimeout = time.Duration(conf.GetInt("ReadTimoutSec", 5)) * time.Second
 	cons.clearSocket = conf.GetBool("RemoveOldSocket", true)
+	cons.proxyProtocol = conf.GetBool("AcceptProxyProtocol", false)
 
 	if cons.protocol != "unix" {
 		if cons.acknowledge != "" {
@@ -176,6 +218,9 @@ func (cons *Socket) Configure(conf core.PluginConfig) error {
 			return fmt.Errorf("Size only supports the value 1,2,4 and 8")
 		}
 
+	case "varint":
+		cons.flags |= shared.BufferedReaderFlagMLEVarint
+
 	case "fixed":
 		cons.flags |= shared.BufferedReaderFlagMLEFixed
 		cons.offset = conf.GetInt("Size", 1)
@@ -183,6 +228,12 @@ func (cons *Socket) Configure(conf core.PluginConfig) error {
 	case "ascii":
 		cons.flags |= shared.BufferedReaderFlagMLE
 
+	case "regex":
+		cons.flags |= shared.BufferedReaderFlagRegex
+		if cons.delimiter, err = compileStartPattern(conf); err != nil {
+			return err
+		}
+
 	case "delimiter":
 		// Nothing to add
 
@@ -213,10 +264,35 @@ func (cons *Socket) processConnection(conn net.Conn) {
 	defer conn.Close()
 
 	buffer := shared.NewBufferedReader(socketBufferGrowSize, cons.flags, cons.offset, cons.delimiter)
+	enqueue := cons.Enqueue
+
+	// Listening UDP sockets don't have a remote address
+	if remoteAddr := conn.RemoteAddr(); remoteAddr != nil {
+		sourceAddress := remoteAddr.String()
+
+		if cons.proxyProtocol {
+			conn.SetReadDeadline(time.Now().Add(cons.readTimeout))
+			header, err := shared.ReadProxyProtocolHeader(conn)
+			if err != nil {
+				Log.Error.Print("Socket failed to read PROXY protocol header from ", sourceAddress, ": ", err)
+				return // ### return, invalid header ###
+			}
+			if header.Source != nil {
+				sourceAddress = header.Source.String()
+			}
+		}
 
+		enqueue = func(data []byte, sequence uint64) {
+			msg := core.NewMessage(cons, data, sequence)
+			msg.SetMetadata(core.MetadataSourceAddress, sourceAddress)
+			cons.EnqueueMessage(msg)
+		}
+	}
+
+	defer buffer.Flush(enqueue)
 	for cons.IsActive() && !cons.IsFuseBurned() {
 		conn.SetReadDeadline(time.Now().Add(cons.readTimeout))
-		err := buffer.ReadAll(conn, cons.Enqueue)
+		err := buffer.ReadAll(conn, enqueue)
 		if err == nil {
 			if err = cons.sendAck(conn, true); err == nil {
 				continue // ### continue, all is well ###
@@ -289,36 +365,24 @@ func (cons *Socket) tcpAccept() {
 
 		// (re)open a tcp connection
 		for cons.listen == nil {
+			// Clear socket if necessary
+			if cons.protocol == "unix" && cons.clearSocket {
+				if err := shared.RemoveStaleUnixSocket(cons.address); err != nil {
+					Log.Warning.Print("Could not remove existing socket: ", err)
+				}
+			}
+
 			listener, err := net.Listen(cons.protocol, cons.address)
 			if cons.protocol == "unix" && err == nil {
-				err = os.Chmod(cons.address, cons.fileFlags)
+				if err = shared.SetUnixSocketPermissions(cons.address, cons.fileFlags, cons.fileOwner, cons.fileGroup); err != nil {
+					listener.Close()
+				}
 			}
 
 			if err == nil {
 				cons.listen = listener
 			} else {
 				Log.Error.Print("Socket connection error: ", err)
-
-				// Clear socket if necessary
-				if cons.protocol == "unix" && cons.clearSocket {
-					// Try to create the socket file to check if it exists
-					if socketFile, err := os.Create(cons.address); os.IsExist(err) {
-						Log.Warning.Print("Found existing socket ", cons.address, ". Removing.")
-
-						if err := os.Remove(cons.address); err != nil {
-							Log.Error.Print("Could not remove existing socket ", cons.address)
-						} else {
-							Log.Error.Printf("Socket %s cleared", cons.address)
-						}
-					} else {
-						Log.Error.Printf("Existing socket %s was removed by third party", cons.address)
-						socketFile.Close()
-						if err := os.Remove(cons.address); err != nil {
-							Log.Error.Print("Could not remove test socket ", cons.address)
-						}
-					}
-				}
-
 				time.Sleep(cons.reconnectTime)
 			}
 		}
@@ -0,0 +1,610 @@
+// Copyright 2015-2016 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumer
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/core/log"
+	"github.com/trivago/gollum/shared"
+	"math"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	statsdCounter      = "counter"
+	statsdGauge        = "gauge"
+	statsdTimer        = "timer"
+	statsdHistogram    = "histogram"
+	statsdDistribution = "distribution"
+	statsdSet          = "set"
+)
+
+// Statsd consumer plugin
+// The Statsd consumer receives metrics in the statsd line protocol via UDP or
+// TCP and converts them to JSON messages, so that metrics can be passed to any
+// producer. Each line has the form "<name>:<value>|<type>[|@<rate>][|#<tags>]".
+// Supported types are counters ("c"), gauges ("g"), timers ("ms"), histograms
+// ("h"), distributions ("d") and sets ("s"). Tags use the DogStatsD format
+// "#key:value,otherkey:value". Gauge values starting with "+" or "-" modify
+// the current value of the gauge. Invalid lines are logged and discarded.
+// By default metrics are aggregated and one message per metric is generated
+// for every flush interval, similar to the original statsd daemon.
+// Each of these messages contains the fields "name", "type", "timestamp" and
+// "tags" (if set). Counters contain the sum of all values as "value" and the
+// value per second as "rate". Gauges contain their current value as "value"
+// and sets contain the number of unique values as "value". Timers, histograms
+// and distributions contain the fields "count", "count_ps", "min", "max",
+// "sum", "mean", "median", "stddev" and an "upper_<p>" and "mean_<p>" field
+// for each configured percentile. Metrics that did not receive any values
+// during an interval are not sent, except for gauges.
+// If aggregation is disabled each metric is sent as soon as it has been
+// received. These messages contain the fields "name", "type", "value",
+// "sample_rate" (if not 1), "relative" (for relative gauge updates) and "tags"
+// (if set). Set values are passed as a string. The address of the sender is attached
+// to these messages as "source_address" metadata.
+// When attached to a fuse, this consumer will discard all incoming metrics in
+// case that fuse is burned.
+// Configuration example
+//
+//  - "consumer.Statsd":
+//    Address: "udp://:8125"
+//    FlushIntervalSec: 10
+//    Percentiles: [90]
+//    DeleteGauges: false
+//    MaxDatagramSize: 65507
+//
+// Address defines the host and port to bind to. The protocol prefix can be
+// set to "udp://" or "tcp://" (including the 4 and 6 variants) to select the
+// transport. UDP is used if no prefix is given. By default this is set to
+// "udp://:8125".
+//
+// FlushIntervalSec defines the interval in seconds in which aggregated metrics
+// are sent. If set to 0 metrics are not aggregated but sent directly.
+// By default this is set to 10.
+//
+// Percentiles defines the percentiles calculated for timers, histograms and
+// distributions. A percentile of 99.9 is reported as "upper_99_9".
+// By default this is set to [90].
+//
+// DeleteGauges can be set to true to only send gauges that have been updated
+// during the last interval. By default this is set to false, i.e. the last
+// value of each gauge is sent after every interval.
+//
+// MaxDatagramSize defines the maximum number of bytes read per datagram or
+// line. Larger datagrams are truncated, longer lines close the TCP
+// connection. By default this is set to 65507.
+type Statsd struct {
+	core.ConsumerBase
+	protocol        string
+	address         string
+	udpConn         *net.UDPConn
+	tcpListener     net.Listener
+	connections     map[net.Conn]struct{}
+	connGuard       *sync.Mutex
+	aggregates      map[string]*statsdAggregate
+	guard           *sync.Mutex
+	percentiles     []float64
+	flushInterval   time.Duration
+	lastFlush       time.Time
+	stop            chan struct{}
+	maxDatagramSize int
+	sequence        uint64
+	deleteGauges    bool
+}
+
+type statsdMetric struct {
+	name       string
+	kind       string
+	value      float64
+	setValue   string
+	sampleRate float64
+	relative   bool
+	tags       map[string]string
+}
+
+type statsdAggregate struct {
+	name   string
+	kind   string
+	tags   map[string]string
+	value  float64
+	count  float64
+	values []float64
+	set    map[string]struct{}
+}
+
+func init() {
+	shared.TypeRegistry.Register(Statsd{})
+}
+
+// Configure initializes this consumer with values from a plugin config.
+func (cons *Statsd) Configure(conf core.PluginConfig) error {
+	err := cons.ConsumerBase.Configure(conf)
+	if err != nil {
+		return err
+	}
+
+	address := conf.GetString("Address", "udp://:8125")
+	cons.address, cons.protocol = shared.ParseAddress(address)
+	if !strings.Contains(address, "://") {
+		cons.protocol = "udp"
+	}
+	switch cons.protocol {
+	case "udp", "udp4", "udp6", "tcp", "tcp4", "tcp6":
+	default:
+		return fmt.Errorf("Statsd does not support %s", cons.protocol)
+	}
+
+	cons.percentiles = []float64{}
+	switch percentiles := conf.GetValue("Percentiles", []interface{}{90}).(type) {
+	case []interface{}:
+		for _, value := range percentiles {
+			percentile, err := strconv.ParseFloat(fmt.Sprint(value), 64)
+			if err != nil || percentile <= 0 || percentile > 100 {
+				return fmt.Errorf("Statsd percentile %v is not a number between 0 and 100", value)
+			}
+			cons.percentiles = append(cons.percentiles, percentile)
+		}
+	default:
+		return fmt.Errorf("Percentiles must be a list")
+	}
+
+	cons.flushInterval = time.Duration(shared.MaxI(conf.GetInt("FlushIntervalSec", 10), 0)) * time.Second
+	cons.deleteGauges = conf.GetBool("DeleteGauges", false)
+	cons.maxDatagramSize = shared.MaxI(conf.GetInt("MaxDatagramSize", 65507), 1)
+	cons.aggregates = make(map[string]*statsdAggregate)
+	cons.guard = new(sync.Mutex)
+	cons.connections = make(map[net.Conn]struct{})
+	cons.connGuard = new(sync.Mutex)
+	cons.stop = make(chan struct{})
+	return nil
+}
+
+// parseStatsdLine parses a single line of the statsd protocol.
+func parseStatsdLine(line string) (statsdMetric, error) {
+	metric := statsdMetric{sampleRate: 1}
+
+	nameEnd := strings.Index(line, ":")
+	if nameEnd <= 0 {
+		return metric, fmt.Errorf("missing metric name")
+	}
+	metric.name = line[:nameEnd]
+
+	sections := strings.Split(line[nameEnd+1:], "|")
+	if len(sections) < 2 {
+		return metric, fmt.Errorf("missing metric type")
+	}
+
+	switch sections[1] {
+	case "c":
+		metric.kind = statsdCounter
+	case "g":
+		metric.kind = statsdGauge
+	case "ms":
+		metric.kind = statsdTimer
+	case "h":
+		metric.kind = statsdHistogram
+	case "d":
+		metric.kind = statsdDistribution
+	case "s":
+		metric.kind = statsdSet
+	default:
+		return metric, fmt.Errorf("unknown metric type %q", sections[1])
+	}
+
+	value := sections[0]
+	if metric.kind == statsdSet {
+		if value == "" {
+			return metric, fmt.Errorf("missing set value")
+		}
+		metric.setValue = value
+	} else {
+		number, err := strconv.ParseFloat(value, 64)
+		if err != nil || math.IsNaN(number) || math.IsInf(number, 0) {
+			return metric, fmt.Errorf("invalid value %q", value)
+		}
+		metric.value = number
+		metric.relative = metric.kind == statsdGauge && (value[0] == '+' || value[0] == '-')
+	}
+
+	for _, section := range sections[2:] {
+		switch {
+		case strings.HasPrefix(section, "@"):
+			rate, err := strconv.ParseFloat(section[1:], 64)
+			if err != nil || rate <= 0 || rate > 1 {
+				return metric, fmt.Errorf("invalid sample rate %q", section)
+			}
+			metric.sampleRate = rate
+
+		case strings.HasPrefix(section, "#"):
+			metric.tags = make(map[string]string)
+			for _, tag := range strings.Split(section[1:], ",") {
+				if tag == "" {
+					continue // ### continue, empty tag ###
+				}
+				if sep := strings.Index(tag, ":"); sep >= 0 {
+					metric.tags[tag[:sep]] = tag[sep+1:]
+				} else {
+					metric.tags[tag] = ""
+				}
+			}
+		}
+	}
+
+	return metric, nil
+}
+
+// key returns a string that is unique for each combination of metric name,
+// type and tags.
+func (metric statsdMetric) key() string {
+	tags := make([]string, 0, len(metric.tags))
+	for name, value := range metric.tags {
+		tags = append(tags, name+":"+value)
+	}
+	sort.Strings(tags)
+	return metric.name + "|" + metric.kind + "|" + strings.Join(tags, ",")
+}
+
+// record returns the JSON representation of a metric that is sent when
+// aggregation is disabled.
+func (metric statsdMetric) record() map[string]interface{} {
+	record := map[string]interface{}{
+		"name": metric.name,
+		"type": metric.kind,
+	}
+	if metric.kind == statsdSet {
+		record["value"] = metric.setValue
+	} else {
+		record["value"] = metric.value
+	}
+	if metric.sampleRate != 1 {
+		record["sample_rate"] = metric.sampleRate
+	}
+	if metric.relative {
+		record["relative"] = true
+	}
+	if len(metric.tags) > 0 {
+		record["tags"] = metric.tags
+	}
+	return record
+}
+
+func (agg *statsdAggregate) add(metric statsdMetric) {
+	switch metric.kind {
+	case statsdCounter:
+		agg.value += metric.value / metric.sampleRate
+	case statsdGauge:
+		if metric.relative {
+			agg.value += metric.value
+		} else {
+			agg.value = metric.value
+		}
+	case statsdSet:
+		agg.set[metric.setValue] = struct{}{}
+	default:
+		agg.count += 1 / metric.sampleRate
+		agg.values = append(agg.values, metric.value)
+	}
+}
+
+// record returns the JSON representation of an aggregated metric.
+func (agg *statsdAggregate) record(interval float64, percentiles []float64, now time.Time) map[string]interface{} {
+	record := map[string]interface{}{
+		"name":      agg.name,
+		"type":      agg.kind,
+		"timestamp": now.Unix(),
+	}
+	if len(agg.tags) > 0 {
+		record["tags"] = agg.tags
+	}
+
+	switch agg.kind {
+	case statsdCounter:
+		record["value"] = agg.value
+		record["rate"] = agg.value / interval
+	case statsdGauge:
+		record["value"] = agg.value
+	case statsdSet:
+		record["value"] = len(agg.set)
+	default:
+		values := agg.values
+		sort.Float64s(values)
+		sum := 0.0
+		for _, value := range values {
+			sum += value
+		}
+		mean := sum / float64(len(values))
+		variance := 0.0
+		for _, value := range values {
+			variance += (value - mean) * (value - mean)
+		}
+
+		mid := len(values) / 2
+		median := values[mid]
+		if len(values)%2 == 0 {
+			median = (values[mid-1] + values[mid]) / 2
+		}
+
+		record["count"] = agg.count
+		record["count_ps"] = agg.count / interval
+		record["min"] = values[0]
+		record["max"] = values[len(values)-1]
+		record["sum"] = sum
+		record["mean"] = mean
+		record["median"] = median
+		record["stddev"] = math.Sqrt(variance / float64(len(values)))
+
+		for _, percentile := range percentiles {
+			numInThreshold := int(math.Floor(percentile/100*float64(len(values)) + 0.5))
+			if numInThreshold == 0 {
+				continue // ### continue, not enough values ###
+			}
+			thresholdSum := 0.0
+			for _, value := range values[:numInThreshold] {
+				thresholdSum += value
+			}
+			suffix := strings.Replace(strconv.FormatFloat(percentile, 'f', -1, 64), ".", "_", -1)
+			record["upper_"+suffix] = values[numInThreshold-1]
+			record["mean_"+suffix] = thresholdSum / float64(numInThreshold)
+		}
+	}
+	return record
+}
+
+func (cons *Statsd) sendRecord(record map[string]interface{}, sourceAddress string) {
+	data, err := json.Marshal(record)
+	if err != nil {
+		Log.Error.Print("Statsd failed to encode metric: ", err)
+		return // ### return, invalid record ###
+	}
+
+	msg := core.NewMessage(cons, data, atomic.AddUint64(&cons.sequence, 1))
+	if sourceAddress != "" {
+		msg.SetMetadata(core.MetadataSourceAddress, sourceAddress)
+	}
+	cons.EnqueueMessage(msg)
+}
+
+// processLines parses all metrics in data, which may contain multiple lines.
+func (cons *Statsd) processLines(data []byte, sourceAddress string) {
+	for _, line := range bytes.Split(data, []byte{'\n'}) {
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 {
+			continue // ### continue, empty line ###
+		}
+
+		metric, err := parseStatsdLine(string(line))
+		if err != nil {
+			Log.Debug.Printf("Statsd discarded metric %q from %s: %s", line, sourceAddress, err)
+			continue // ### continue, invalid metric ###
+		}
+
+		if cons.flushInterval == 0 {
+			cons.sendRecord(metric.record(), sourceAddress)
+			continue // ### continue, no aggregation ###
+		}
+		cons.aggregate(metric)
+	}
+}
+
+func (cons *Statsd) aggregate(metric statsdMetric) {
+	cons.guard.Lock()
+	defer cons.guard.Unlock()
+
+	key := metric.key()
+	agg, exists := cons.aggregates[key]
+	if !exists {
+		agg = &statsdAggregate{
+			name: metric.name,
+			kind: metric.kind,
+			tags: metric.tags,
+		}
+		if metric.kind == statsdSet {
+			agg.set = make(map[string]struct{})
+		}
+		cons.aggregates[key] = agg
+	}
+	agg.add(metric)
+}
+
+// flush sends all aggregated metrics and resets them.
+func (cons *Statsd) flush() {
+	cons.guard.Lock()
+	now := time.Now()
+	interval := now.Sub(cons.lastFlush).Seconds()
+	cons.lastFlush = now
+
+	keys := make([]string, 0, len(cons.aggregates))
+	for key := range cons.aggregates {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	records := make([]map[string]interface{}, 0, len(keys))
+	for _, key := range keys {
+		agg := cons.aggregates[key]
+		records = append(records, agg.record(interval, cons.percentiles, now))
+		if agg.kind != statsdGauge || cons.deleteGauges {
+			delete(cons.aggregates, key)
+		}
+	}
+	cons.guard.Unlock()
+
+	for _, record := range records {
+		cons.sendRecord(record, "")
+	}
+}
+
+func (cons *Statsd) flushLoop() {
+	defer cons.WorkerDone()
+	ticker := time.NewTicker(cons.flushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			cons.flush()
+		case <-cons.stop:
+			cons.flush()
+			return // ### return, stopped ###
+		}
+	}
+}
+
+func (cons *Statsd) readUDP() {
+	defer cons.WorkerDone()
+	datagram := make([]byte, cons.maxDatagramSize)
+
+	for cons.IsActive() {
+		size, sender, err := cons.udpConn.ReadFromUDP(datagram)
+		if err != nil {
+			if !cons.IsActive() || shared.IsDisconnectedError(err) {
+				return // ### return, socket closed ###
+			}
+			Log.Error.Print("Statsd read failed: ", err)
+			continue // ### continue, skip datagram ###
+		}
+
+		if size == 0 || cons.IsFuseBurned() {
+			continue // ### continue, nothing to do ###
+		}
+		cons.processLines(datagram[:size], sender.String())
+	}
+}
+
+func (cons *Statsd) acceptTCP() {
+	defer cons.WorkerDone()
+
+	for cons.IsActive() {
+		conn, err := cons.tcpListener.Accept()
+		if err != nil {
+			if !cons.IsActive() || shared.IsDisconnectedError(err) {
+				return // ### return, listener closed ###
+			}
+			Log.Error.Print("Statsd accept failed: ", err)
+			continue // ### continue, try again ###
+		}
+
+		cons.connGuard.Lock()
+		if !cons.IsActive() {
+			cons.connGuard.Unlock()
+			conn.Close()
+			return // ### return, stopped during accept ###
+		}
+		cons.connections[conn] = struct{}{}
+		cons.connGuard.Unlock()
+
+		cons.AddWorker()
+		go shared.DontPanic(func() { cons.readTCP(conn) })
+	}
+}
+
+func (cons *Statsd) readTCP(conn net.Conn) {
+	defer cons.WorkerDone()
+	defer func() {
+		cons.connGuard.Lock()
+		delete(cons.connections, conn)
+		cons.connGuard.Unlock()
+		conn.Close()
+	}()
+
+	sourceAddress := conn.RemoteAddr().String()
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(make([]byte, 0, shared.MinI(cons.maxDatagramSize, 4096)), cons.maxDatagramSize)
+
+	for scanner.Scan() {
+		if !cons.IsFuseBurned() {
+			cons.processLines(scanner.Bytes(), sourceAddress)
+		}
+	}
+
+	if err := scanner.Err(); err != nil && cons.IsActive() && !shared.IsDisconnectedError(err) {
+		Log.Error.Print("Statsd read from ", sourceAddress, " failed: ", err)
+	}
+}
+
+func (cons *Statsd) listen() error {
+	if strings.HasPrefix(cons.protocol, "tcp") {
+		listener, err := net.Listen(cons.protocol, cons.address)
+		if err != nil {
+			return err
+		}
+		cons.tcpListener = listener
+		return nil
+	}
+
+	addr, err := net.ResolveUDPAddr(cons.protocol, cons.address)
+	if err != nil {
+		return err
+	}
+	conn, err := net.ListenUDP(cons.protocol, addr)
+	if err != nil {
+		return err
+	}
+	cons.udpConn = conn
+	return nil
+}
+
+func (cons *Statsd) close() {
+	if cons.udpConn != nil {
+		cons.udpConn.Close()
+	}
+	if cons.tcpListener != nil {
+		cons.tcpListener.Close()
+	}
+
+	cons.connGuard.Lock()
+	for conn := range cons.connections {
+		conn.Close()
+	}
+	cons.connGuard.Unlock()
+
+	close(cons.stop)
+}
+
+// Consume listens to the configured socket.
+func (cons *Statsd) Consume(workers *sync.WaitGroup) {
+	cons.SetWorkerWaitGroup(workers)
+
+	if err := cons.listen(); err != nil {
+		Log.Error.Print("Statsd connection error: ", err)
+		return // ### return, could not bind ###
+	}
+	cons.SetStopCallback(cons.close)
+
+	cons.AddWorker()
+	if cons.tcpListener != nil {
+		go shared.DontPanic(cons.acceptTCP)
+	} else {
+		go shared.DontPanic(cons.readUDP)
+	}
+
+	if cons.flushInterval > 0 {
+		cons.lastFlush = time.Now()
+		cons.AddWorker()
+		go shared.DontPanic(cons.flushLoop)
+	}
+
+	cons.ControlLoop()
+}
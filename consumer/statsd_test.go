@@ -0,0 +1,152 @@
+// Copyright 2015-2016 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumer
+
+import (
+	"encoding/json"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/shared"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestStatsdParse(t *testing.T) {
+	expect := shared.NewExpect(t)
+
+	metric, err := parseStatsdLine("api.requests:2|c|@0.5|#host:a,canary")
+	expect.NoError(err)
+	expect.Equal("api.requests", metric.name)
+	expect.Equal(statsdCounter, metric.kind)
+	expect.Equal(2.0, metric.value)
+	expect.Equal(0.5, metric.sampleRate)
+	expect.Equal(map[string]string{"host": "a", "canary": ""}, metric.tags)
+
+	metric, err = parseStatsdLine("queue.size:-3|g")
+	expect.NoError(err)
+	expect.Equal(statsdGauge, metric.kind)
+	expect.Equal(-3.0, metric.value)
+	expect.True(metric.relative)
+
+	metric, err = parseStatsdLine("users:alice|s")
+	expect.NoError(err)
+	expect.Equal(statsdSet, metric.kind)
+	expect.Equal("alice", metric.setValue)
+
+	metric, err = parseStatsdLine("latency:-3|ms")
+	expect.NoError(err)
+	expect.False(metric.relative)
+
+	for _, line := range []string{"latency", ":1|c", "latency:1", "latency:a|ms", "latency:1|x", "latency:1|c|@2", "users:|s"} {
+		_, err = parseStatsdLine(line)
+		expect.NotNil(err)
+	}
+}
+
+func TestStatsdAggregate(t *testing.T) {
+	expect := shared.NewExpect(t)
+
+	stream := &mockHTTPStream{}
+	core.StreamRegistry.Register(stream, core.GetStreamID("statsdAggregate"))
+	conf := core.NewPluginConfig("")
+	conf.Stream = []string{"statsdAggregate"}
+	conf.Override("Percentiles", []interface{}{50, 99.9})
+	plugin, err := core.NewPluginWithType("consumer.Statsd", conf)
+	expect.NoError(err)
+	cons := plugin.(*Statsd)
+
+	cons.lastFlush = time.Now().Add(-10 * time.Second)
+	cons.processLines([]byte("requests:1|c|#host:a\nrequests:2|c|@0.5|#host:a\nrequests:1|c\n"+
+		"latency:4|ms\nlatency:1|ms\nlatency:3|ms\nlatency:2|ms|@0.5\n"+
+		"queue:10|g\nqueue:-4|g\nusers:a|s\nusers:b|s\nusers:a|s\ninvalid\n"), "")
+	cons.flush()
+
+	records := map[string]map[string]interface{}{}
+	for _, msg := range stream.messages {
+		record := map[string]interface{}{}
+		expect.NoError(json.Unmarshal(msg.Data, &record))
+		key := record["type"].(string) + ":" + record["name"].(string)
+		if tags, hasTags := record["tags"]; hasTags {
+			key += ":" + tags.(map[string]interface{})["host"].(string)
+		}
+		records[key] = record
+	}
+	expect.Equal(5, len(records))
+
+	expect.Equal(5.0, records["counter:requests:a"]["value"])
+	expect.True(records["counter:requests:a"]["rate"].(float64) < 0.6)
+	expect.Equal(1.0, records["counter:requests"]["value"])
+	expect.Equal(6.0, records["gauge:queue"]["value"])
+	expect.Equal(2.0, records["set:users"]["value"])
+
+	timer := records["timer:latency"]
+	expect.Equal(5.0, timer["count"])
+	expect.Equal(1.0, timer["min"])
+	expect.Equal(4.0, timer["max"])
+	expect.Equal(10.0, timer["sum"])
+	expect.Equal(2.5, timer["mean"])
+	expect.Equal(2.5, timer["median"])
+	expect.Equal(2.0, timer["upper_50"])
+	expect.Equal(1.5, timer["mean_50"])
+	expect.Equal(4.0, timer["upper_99_9"])
+
+	// Only gauges are kept after a flush
+	count := stream.count()
+	cons.flush()
+	expect.Equal(count+1, stream.count())
+}
+
+func TestStatsd(t *testing.T) {
+	expect := shared.NewExpect(t)
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	expect.NoError(err)
+	address := conn.LocalAddr().String()
+	conn.Close()
+
+	stream := &mockHTTPStream{}
+	core.StreamRegistry.Register(stream, core.GetStreamID("statsd"))
+	conf := core.NewPluginConfig("")
+	conf.Stream = []string{"statsd"}
+	conf.Override("Address", address)
+	conf.Override("FlushIntervalSec", 0)
+	plugin, err := core.NewPluginWithType("consumer.Statsd", conf)
+	expect.NoError(err)
+	cons := plugin.(*Statsd)
+
+	workers := new(sync.WaitGroup)
+	go cons.Consume(workers)
+
+	client, err := net.Dial("udp", address)
+	expect.NoError(err)
+	defer client.Close()
+
+	expect.NonBlocking(2*time.Second, func() {
+		for stream.count() == 0 {
+			client.Write([]byte("requests:1|c|@0.5\nqueue:+2|g|#host:a"))
+			time.Sleep(50 * time.Millisecond)
+		}
+	})
+	cons.Control() <- core.PluginControlStopConsumer
+	expect.NonBlocking(2*time.Second, workers.Wait)
+
+	stream.guard.Lock()
+	defer stream.guard.Unlock()
+	expect.True(len(stream.messages) >= 2)
+	expect.Equal(`{"name":"requests","sample_rate":0.5,"type":"counter","value":1}`, string(stream.messages[0].Data))
+	expect.Equal(`{"name":"queue","relative":true,"tags":{"host":"a"},"type":"gauge","value":2}`, string(stream.messages[1].Data))
+	expect.Equal(client.LocalAddr().String(), stream.messages[0].Metadata[core.MetadataSourceAddress])
+}
@@ -15,17 +15,45 @@
 package consumer
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
 	"fmt"
 	"github.com/trivago/gollum/core"
 	"github.com/trivago/gollum/core/log"
 	"github.com/trivago/gollum/shared"
 	"gopkg.in/mcuadros/go-syslog.v2"
 	"gopkg.in/mcuadros/go-syslog.v2/format"
+	"net"
+	"os"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	syslogMaxFrameLengthDigits = 10
+	syslogPeerSeparator        = "\n"
 )
 
 // Syslogd consumer plugin
 // The syslogd consumer accepts messages from a syslogd comaptible socket.
+// The syslog header fields of each message are attached as metadata:
+// "syslog_facility", "syslog_severity" and "syslog_priority" hold the numeric
+// codes, "syslog_hostname" and "syslog_app_name" (the tag for RFC3164) hold
+// the sender. RFC5424 messages also set "syslog_proc_id" and "syslog_msg_id"
+// and every parameter of the structured data is stored as
+// "syslog_sd.<SD-ID>.<PARAM-NAME>", e.g. "syslog_sd.origin.ip". Repeated
+// parameters are separated by comma. The address of the sender is stored as
+// "source_address".
+// Unix addresses bind a datagram socket, so gollum can replace the local
+// syslog daemon by binding "/dev/log". On Linux the process id, user id and
+// group id of the sending process are reported by the kernel and attached as
+// "client_pid", "client_uid" and "client_gid" metadata. Unlike the header
+// fields these cannot be forged by the sender.
 // When attached to a fuse, this consumer will stop the syslogd service in case
 // that fuse is burned.
 // Configuration example
@@ -33,27 +61,111 @@ import (
 //  - "consumer.Syslogd":
 //    Address: "udp://0.0.0.0:514"
 //    Format: "RFC6587"
+//    Certificate: ""
+//    PrivateKey: ""
+//    ClientCA: ""
+//    SocketPermissions: "0666"
+//    SocketOwner: ""
+//    SocketGroup: ""
+//    RemoveOldSocket: true
+//    RateLimitBurst: 0
+//    RateLimitIntervalSec: 30
+//    ReconnectAfterSec: 2
 //
 // Address defines the protocol, host and port or socket to bind to.
 // This can either be any ip address and port like "localhost:5880" or a file
-// like "unix:///var/gollum.socket". By default this is set to "udp://0.0.0.0:514".
+// like "unix:///dev/log". By default this is set to "udp://0.0.0.0:514".
+// Sockets in the Linux abstract namespace can be used by prefixing the name
+// with "@", e.g. "unix://@gollum".
 // The protocol can be defined along with the address, e.g. "tcp://..." but
 // this may be ignored if a certain protocol format does not support the desired
 // transport protocol.
 //
 // Format defines the syslog standard to expect for message encoding.
 // Three standards are currently supported, by default this is set to "RFC6587".
-//  * RFC3164 (https://tools.ietf.org/html/rfc3164) udp only.
-//  * RFC5424 (https://tools.ietf.org/html/rfc5424) udp only.
-//  * RFC6587 (https://tools.ietf.org/html/rfc6587) tcp or udp.
+//  * RFC3164 (https://tools.ietf.org/html/rfc3164) udp or unix. Messages
+//    received on unix sockets may omit the hostname as done by syslog(3).
+//    The local hostname is used in that case. Use this format for "/dev/log".
+//  * RFC5424 (https://tools.ietf.org/html/rfc5424) udp, tcp connections use
+//    the framing of RFC6587.
+//  * RFC6587 (https://tools.ietf.org/html/rfc6587) tcp or udp. Frames can
+//    either use octet counting ("<length> <message>") or be separated by
+//    newlines. Both methods can be mixed on the same connection.
+//
+// Certificate defines a path to a PEM encoded certificate file to make this
+// consumer accept TLS connections only (RFC5425). This requires a tcp
+// address and the RFC5424 or RFC6587 format. Left empty by default (disabled).
+// If a Certificate is given, a PrivateKey must be given, too.
+//
+// PrivateKey defines a path to the PEM encoded private key used for TLS
+// connections. Left empty by default (disabled).
+//
+// ClientCA defines a path to a PEM encoded file containing the certificate
+// authorities used to verify client certificates. If set, clients have to
+// present a valid certificate signed by one of these authorities.
+// Requires Certificate and PrivateKey to be set. Left empty by default.
+// The common name and the subject alternative names of verified client
+// certificates are attached to each message as "client_cn" and "client_san"
+// metadata. Multiple alternative names are separated by comma.
+//
+// SocketPermissions sets the file permissions for "unix://" based sockets as
+// a four digit octal number string. By default this is set to "0666" which
+// allows all local users to log, like "/dev/log" does.
+//
+// SocketOwner sets the user owning the socket file of "unix://" based
+// sockets. Users can be given by name or numeric id. By default this is set
+// to "" which keeps the user running gollum.
+//
+// SocketGroup sets the group owning the socket file of "unix://" based
+// sockets. Groups can be given by name or numeric id. By default this is set
+// to "" which keeps the primary group of the user running gollum.
+//
+// RemoveOldSocket toggles removing stale socket files with the same name as
+// the socket (unix://<path>) prior to binding. Sockets still in use by another
+// process and files that are not sockets are never removed. Note that
+// "/dev/log" is a symbolic link on systems running systemd-journald, which has
+// to be disabled first. Enabled by default.
+//
+// RateLimitBurst defines the number of messages a single process may send to
+// a "unix://" based socket within RateLimitIntervalSec. Further messages of
+// that process are dropped until the interval is over and the number of
+// dropped messages is logged. Processes are told apart by their process id on
+// Linux. On other platforms only senders bound to an address can be told
+// apart, all others share the same limit. By default this is set to 0 which
+// disables rate limiting.
+//
+// RateLimitIntervalSec defines the length of the rate limit interval in
+// seconds. By default this is set to 30.
+//
+// ReconnectAfterSec defines the number of seconds to wait before a
+// "unix://" based socket is tried to be bound again after an error.
+// By default this is set to 2.
 type Syslogd struct {
 	core.ConsumerBase
-	format   format.Format // RFC3164, RFC5424 or RFC6587?
-	protocol string
-	address  string
-	sequence *uint64
+	format         format.Format // RFC3164, RFC5424 or RFC6587?
+	isRFC3164      bool
+	protocol       string
+	address        string
+	tlsConfig      *tls.Config
+	sequence       *uint64
+	fileFlags      os.FileMode
+	fileOwner      string
+	fileGroup      string
+	clearSocket    bool
+	rateBurst      int
+	rateInterval   time.Duration
+	rateLimits     map[string]*syslogRateLimit
+	rateCleanup    time.Time
+	reconnectDelay time.Duration
+	conn           *net.UnixConn
+	guard          *sync.Mutex
+	ctx            context.Context
+	cancel         context.CancelFunc
 }
 
+// syslogFramedFormat parses RFC5424 messages sent with RFC6587 framing.
+type syslogFramedFormat struct{}
+
 func init() {
 	shared.TypeRegistry.Register(Syslogd{})
 }
@@ -78,29 +190,191 @@ func (cons *Syslogd) Configure(conf core.PluginConfig) error {
 	// http://www.ietf.org/rfc/rfc3164.txt
 	case "RFC3164":
 		cons.format = syslog.RFC3164
-		if cons.protocol == "tcp" {
+		cons.isRFC3164 = true
+		switch cons.protocol {
+		case "tcp":
 			Log.Warning.Print("Syslog: RFC3164 demands UDP")
 			cons.protocol = "udp"
+		case "unix":
+			hostname, _ := os.Hostname()
+			cons.format = &syslogLocalFormat{hostname: hostname}
 		}
 
 	// https://tools.ietf.org/html/rfc5424
 	case "RFC5424":
 		cons.format = syslog.RFC5424
 		if cons.protocol == "tcp" {
-			Log.Warning.Print("Syslog: RFC5424 demands UDP")
-			cons.protocol = "udp"
+			cons.format = new(syslogFramedFormat)
 		}
 
 	// https://tools.ietf.org/html/rfc6587
 	case "RFC6587":
-		cons.format = syslog.RFC6587
+		cons.format = new(syslogFramedFormat)
 
 	default:
-		err = fmt.Errorf("Syslog: Format %s is not supported", format)
+		return fmt.Errorf("Syslog: Format %s is not supported", format)
+	}
+
+	cons.tlsConfig, err = shared.NewServerTLSConfig(
+		conf.GetString("Certificate", ""),
+		conf.GetString("PrivateKey", ""),
+		conf.GetString("ClientCA", ""))
+	if err != nil {
+		return err
+	}
+	if cons.tlsConfig != nil && cons.protocol != "tcp" {
+		return fmt.Errorf("Syslog: TLS requires a tcp address")
 	}
 
+	flags, err := strconv.ParseInt(conf.GetString("SocketPermissions", "0666"), 8, 32)
+	if err != nil {
+		return fmt.Errorf("Syslog: invalid SocketPermissions: %s", err)
+	}
+	cons.fileFlags = os.FileMode(flags)
+	cons.fileOwner = conf.GetString("SocketOwner", "")
+	cons.fileGroup = conf.GetString("SocketGroup", "")
+	cons.clearSocket = conf.GetBool("RemoveOldSocket", true)
+	cons.rateBurst = conf.GetInt("RateLimitBurst", 0)
+	cons.rateInterval = time.Duration(conf.GetInt("RateLimitIntervalSec", 30)) * time.Second
+	if cons.rateBurst > 0 && cons.rateInterval <= 0 {
+		return fmt.Errorf("Syslog: RateLimitIntervalSec must be positive")
+	}
+	cons.rateLimits = make(map[string]*syslogRateLimit)
+	cons.reconnectDelay = time.Duration(conf.GetInt("ReconnectAfterSec", 2)) * time.Second
+	cons.guard = new(sync.Mutex)
+	cons.ctx, cons.cancel = context.WithCancel(context.Background())
+
 	cons.sequence = new(uint64)
-	return err
+	return nil
+}
+
+// GetParser returns a RFC5424 parser for the given frame.
+func (f *syslogFramedFormat) GetParser(line []byte) format.LogParser {
+	return syslog.RFC5424.GetParser(line)
+}
+
+// GetSplitFunc returns a split function for RFC6587 framing.
+func (f *syslogFramedFormat) GetSplitFunc() bufio.SplitFunc {
+	return splitSyslogFrame
+}
+
+// splitSyslogFrame splits a stream into RFC6587 frames. Octet counted frames
+// start with their length, non-transparent frames start with "<" and end at
+// the next newline.
+func splitSyslogFrame(data []byte, atEOF bool) (int, []byte, error) {
+	skip := 0
+	for skip < len(data) && (data[skip] == '\n' || data[skip] == '\r' || data[skip] == ' ') {
+		skip++
+	}
+	if skip > 0 || len(data) == 0 {
+		return skip, nil, nil // ### return, skip whitespace between frames ###
+	}
+
+	if data[0] == '<' {
+		if end := bytes.IndexByte(data, '\n'); end >= 0 {
+			return end + 1, bytes.TrimRight(data[:end], "\r"), nil // ### return, non-transparent frame ###
+		}
+		if atEOF {
+			return len(data), data, nil // ### return, last frame ###
+		}
+		return 0, nil, nil // ### return, request more data ###
+	}
+
+	lengthEnd := bytes.IndexByte(data, ' ')
+	if lengthEnd < 0 {
+		if atEOF || len(data) > syslogMaxFrameLengthDigits {
+			return 0, nil, fmt.Errorf("Syslog: invalid frame")
+		}
+		return 0, nil, nil // ### return, request more data ###
+	}
+
+	length, err := strconv.Atoi(string(data[:lengthEnd]))
+	if err != nil || length <= 0 {
+		return 0, nil, fmt.Errorf("Syslog: invalid frame length %s", string(data[:lengthEnd]))
+	}
+
+	end := lengthEnd + 1 + length
+	if len(data) < end {
+		if atEOF {
+			return 0, nil, fmt.Errorf("Syslog: incomplete frame")
+		}
+		return 0, nil, nil // ### return, request more data ###
+	}
+	return end, data[lengthEnd+1 : end], nil
+}
+
+// parseSyslogStructuredData parses RFC5424 structured data like
+// [id param="value"][id2 param="value"] into a map of "id.param" to value.
+func parseSyslogStructuredData(data string) (map[string]string, error) {
+	params := make(map[string]string)
+	if data == "" || data == "-" {
+		return params, nil // ### return, no structured data ###
+	}
+
+	readName := func(pos int, terminators string) (string, int) {
+		start := pos
+		for pos < len(data) && strings.IndexByte(terminators, data[pos]) < 0 && data[pos] > ' ' && data[pos] != '"' {
+			pos++
+		}
+		return data[start:pos], pos
+	}
+
+	for pos := 0; pos < len(data); {
+		if data[pos] != '[' {
+			return params, fmt.Errorf("Syslog: structured data element expected at %d", pos)
+		}
+
+		var id string
+		id, pos = readName(pos+1, "]=")
+		if id == "" {
+			return params, fmt.Errorf("Syslog: structured data element without id")
+		}
+
+		for pos < len(data) && data[pos] == ' ' {
+			name, end := readName(pos+1, "]=")
+			if name == "" || end+1 >= len(data) || data[end] != '=' || data[end+1] != '"' {
+				return params, fmt.Errorf("Syslog: invalid parameter in structured data element %s", id)
+			}
+
+			value := make([]byte, 0, 16)
+			for pos = end + 2; pos < len(data) && data[pos] != '"'; pos++ {
+				if data[pos] == '\\' && pos+1 < len(data) && strings.IndexByte("\"\\]", data[pos+1]) >= 0 {
+					pos++
+				}
+				value = append(value, data[pos])
+			}
+			if pos >= len(data) {
+				return params, fmt.Errorf("Syslog: unterminated parameter value in structured data element %s", id)
+			}
+			pos++
+
+			key := id + "." + name
+			if previous, exists := params[key]; exists {
+				params[key] = previous + "," + string(value)
+			} else {
+				params[key] = string(value)
+			}
+		}
+
+		if pos >= len(data) || data[pos] != ']' {
+			return params, fmt.Errorf("Syslog: unterminated structured data element %s", id)
+		}
+		pos++
+	}
+
+	return params, nil
+}
+
+// tlsPeer returns the identities of a verified client certificate separated
+// by syslogPeerSeparator. Connections are never rejected here as the
+// certificate has already been verified during the handshake.
+func (cons *Syslogd) tlsPeer(conn *tls.Conn) (string, bool) {
+	state := conn.ConnectionState()
+	if len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return "", true // ### return, no client certificate ###
+	}
+	identities := shared.CertificateIdentities(state.VerifiedChains[0][0])
+	return strings.Join(identities, syslogPeerSeparator), true
 }
 
 // Handle implements the syslog handle interface
@@ -108,13 +382,10 @@ func (cons *Syslogd) Handle(parts format.LogParts, code int64, err error) {
 	content := ""
 	isString := false
 
-	switch cons.format {
-	case syslog.RFC3164:
+	if cons.isRFC3164 {
 		content, isString = parts["content"].(string)
-	case syslog.RFC5424, syslog.RFC6587:
+	} else {
 		content, isString = parts["message"].(string)
-	default:
-		Log.Error.Print("Could not determine the format to retrieve message/content")
 	}
 
 	if !isString {
@@ -122,28 +393,86 @@ func (cons *Syslogd) Handle(parts format.LogParts, code int64, err error) {
 		return
 	}
 
-	cons.Enqueue([]byte(content), *cons.sequence)
-	*cons.sequence++
+	msg := core.NewMessage(cons, []byte(content), atomic.AddUint64(cons.sequence, 1)-1)
+	for key, value := range parts {
+		switch key {
+		case "facility", "severity", "priority":
+			if code, isInt := value.(int); isInt {
+				msg.SetMetadata("syslog_"+key, strconv.Itoa(code))
+			}
+
+		case "hostname", "app_name", "proc_id", "msg_id":
+			if field, isString := value.(string); isString && field != "" && field != "-" {
+				msg.SetMetadata("syslog_"+key, field)
+			}
+
+		case "tag":
+			if tag, isString := value.(string); isString && tag != "" {
+				msg.SetMetadata("syslog_app_name", tag)
+			}
+
+		case "client_pid", "client_uid", "client_gid":
+			if id, isInt := value.(int); isInt {
+				msg.SetMetadata(key, strconv.Itoa(id))
+			}
+
+		case "client":
+			if client, isString := value.(string); isString && client != "" {
+				msg.SetMetadata(core.MetadataSourceAddress, client)
+			}
+
+		case "tls_peer":
+			if peer, isString := value.(string); isString && peer != "" {
+				identities := strings.Split(peer, syslogPeerSeparator)
+				msg.SetMetadata(core.MetadataClientCommonName, identities[0])
+				msg.SetMetadata(core.MetadataClientSAN, strings.Join(identities[1:], ","))
+			}
+
+		case "structured_data":
+			data, _ := value.(string)
+			params, err := parseSyslogStructuredData(data)
+			if err != nil {
+				Log.Warning.Print(err)
+			}
+			for name, param := range params {
+				msg.SetMetadata("syslog_sd."+name, param)
+			}
+		}
+	}
+
+	cons.EnqueueMessage(msg)
 }
 
 // Consume opens a new syslog socket.
 // Messages are expected to be separated by \n.
 func (cons *Syslogd) Consume(workers *sync.WaitGroup) {
+	if cons.protocol == "unix" {
+		cons.SetWorkerWaitGroup(workers)
+		cons.SetStopCallback(cons.close)
+
+		cons.AddWorker()
+		go shared.DontPanic(cons.readUnixgram)
+
+		cons.ControlLoop()
+		return // ### return, unix sockets are read directly ###
+	}
+
 	server := syslog.NewServer()
 	server.SetFormat(cons.format)
 	server.SetHandler(cons)
+	server.SetTlsPeerNameFunc(cons.tlsPeer)
 
 	switch cons.protocol {
-	case "unix":
-		if err := server.ListenUnixgram(cons.address); err != nil {
-			Log.Error.Print("Syslog: Failed to open unix://", cons.address)
-		}
 	case "udp":
 		if err := server.ListenUDP(cons.address); err != nil {
 			Log.Error.Print("Syslog: Failed to open udp://", cons.address)
 		}
 	case "tcp":
-		if err := server.ListenTCP(cons.address); err != nil {
+		if cons.tlsConfig != nil {
+			if err := server.ListenTCPTLS(cons.address, cons.tlsConfig); err != nil {
+				Log.Error.Print("Syslog: Failed to open tls://", cons.address)
+			}
+		} else if err := server.ListenTCP(cons.address); err != nil {
 			Log.Error.Print("Syslog: Failed to open tcp://", cons.address)
 		}
 	}
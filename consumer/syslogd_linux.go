@@ -0,0 +1,60 @@
+// Copyright 2015-2016 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build linux
+// +build linux
+
+package consumer
+
+import (
+	"net"
+	"syscall"
+)
+
+// syslogCredentialsSize is the size of the control message carrying the
+// credentials of the sender.
+var syslogCredentialsSize = syscall.CmsgSpace(syscall.SizeofUcred)
+
+// enableSyslogCredentials sets SO_PASSCRED so that the kernel attaches the
+// credentials of the sending process to each datagram. SO_PEERCRED cannot
+// be used as datagram sockets are not connected to a single peer.
+func enableSyslogCredentials(conn *net.UnixConn) error {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var sockErr error
+	err = raw.Control(func(fd uintptr) {
+		sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_PASSCRED, 1)
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
+
+// parseSyslogCredentials reads the SCM_CREDENTIALS control message.
+func parseSyslogCredentials(oob []byte) (syslogCredentials, bool) {
+	messages, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return syslogCredentials{}, false
+	}
+	for i := range messages {
+		if ucred, err := syscall.ParseUnixCredentials(&messages[i]); err == nil {
+			return syslogCredentials{pid: int(ucred.Pid), uid: int(ucred.Uid), gid: int(ucred.Gid)}, true
+		}
+	}
+	return syslogCredentials{}, false
+}
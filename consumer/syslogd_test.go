@@ -0,0 +1,339 @@
+// Copyright 2015-2016 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumer
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/shared"
+	"gopkg.in/mcuadros/go-syslog.v2"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSyslogFrameSplit(t *testing.T) {
+	expect := shared.NewExpect(t)
+
+	stream := "11 <14>1 - a b\n<14>1 - c\r\n11 <14>1 - d\ne"
+	scanner := bufio.NewScanner(bytes.NewBufferString(stream))
+	scanner.Split(splitSyslogFrame)
+
+	frames := []string{}
+	for scanner.Scan() {
+		frames = append(frames, scanner.Text())
+	}
+	expect.NoError(scanner.Err())
+	expect.Equal([]string{"<14>1 - a b", "<14>1 - c", "<14>1 - d\ne"}, frames)
+
+	scanner = bufio.NewScanner(bytes.NewBufferString("x <14>1"))
+	scanner.Split(splitSyslogFrame)
+	expect.False(scanner.Scan())
+	expect.NotNil(scanner.Err())
+}
+
+func TestSyslogStructuredData(t *testing.T) {
+	expect := shared.NewExpect(t)
+
+	params, err := parseSyslogStructuredData(`[exampleSDID@32473 iut="3" eventSource="Appli\"cation\]"][origin ip="10.0.0.1" ip="10.0.0.2"]`)
+	expect.NoError(err)
+	expect.Equal(map[string]string{
+		"exampleSDID@32473.iut":         "3",
+		"exampleSDID@32473.eventSource": `Appli"cation]`,
+		"origin.ip":                     "10.0.0.1,10.0.0.2",
+	}, params)
+
+	params, err = parseSyslogStructuredData("-")
+	expect.NoError(err)
+	expect.Equal(0, len(params))
+
+	_, err = parseSyslogStructuredData(`[id a="1"`)
+	expect.NotNil(err)
+	_, err = parseSyslogStructuredData(`[id a=1]`)
+	expect.NotNil(err)
+}
+
+func TestSyslogdHandle(t *testing.T) {
+	expect := shared.NewExpect(t)
+
+	stream := &mockHTTPStream{}
+	core.StreamRegistry.Register(stream, core.GetStreamID("syslogdHandle"))
+	conf := core.NewPluginConfig("")
+	conf.Stream = []string{"syslogdHandle"}
+	conf.Override("Address", "tcp://127.0.0.1:5514")
+	plugin, err := core.NewPluginWithType("consumer.Syslogd", conf)
+	expect.NoError(err)
+	cons := plugin.(*Syslogd)
+
+	line := []byte(`<165>1 2003-10-11T22:14:15.003Z host.example.com evntslog 42 ID47 [origin ip="10.0.0.1"] An application event`)
+	parser := cons.format.GetParser(line)
+	parseErr := parser.Parse()
+	parts := parser.Dump()
+	parts["client"] = "10.0.0.1:1234"
+	cons.Handle(parts, int64(len(line)), parseErr)
+
+	expect.Equal(1, len(stream.messages))
+	msg := stream.messages[0]
+	expect.Equal("An application event", string(msg.Data))
+	expect.Equal(core.MessageMetadata{
+		"syslog_priority":     "165",
+		"syslog_facility":     "20",
+		"syslog_severity":     "5",
+		"syslog_hostname":     "host.example.com",
+		"syslog_app_name":     "evntslog",
+		"syslog_proc_id":      "42",
+		"syslog_msg_id":       "ID47",
+		"syslog_sd.origin.ip": "10.0.0.1",
+		"source_address":      "10.0.0.1:1234",
+	}, msg.Metadata)
+}
+
+func writeTestSyslogCertificate(expect shared.Expect, dir string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	expect.NoError(err)
+
+	template := x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "gollum"},
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	expect.NoError(err)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	expect.NoError(err)
+
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	expect.NoError(ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	expect.NoError(ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600))
+	return certFile, keyFile
+}
+
+func TestSyslogdTLS(t *testing.T) {
+	expect := shared.NewExpect(t)
+
+	dir, err := ioutil.TempDir("", "gollum_syslogd")
+	expect.NoError(err)
+	defer os.RemoveAll(dir)
+	certFile, keyFile := writeTestSyslogCertificate(expect, dir)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	expect.NoError(err)
+	address := listener.Addr().String()
+	listener.Close()
+
+	stream := &mockHTTPStream{}
+	core.StreamRegistry.Register(stream, core.GetStreamID("syslogdTLS"))
+	conf := core.NewPluginConfig("")
+	conf.Stream = []string{"syslogdTLS"}
+	conf.Override("Address", "tcp://"+address)
+	conf.Override("Format", "RFC5424")
+	conf.Override("Certificate", certFile)
+	conf.Override("PrivateKey", keyFile)
+	conf.Override("ClientCA", certFile)
+	plugin, err := core.NewPluginWithType("consumer.Syslogd", conf)
+	expect.NoError(err)
+	cons := plugin.(*Syslogd)
+
+	server := syslog.NewServer()
+	server.SetFormat(cons.format)
+	server.SetHandler(cons)
+	server.SetTlsPeerNameFunc(cons.tlsPeer)
+	expect.NoError(server.ListenTCPTLS(address, cons.tlsConfig))
+	expect.NoError(server.Boot())
+	defer server.Kill()
+
+	clientCert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	expect.NoError(err)
+	roots := x509.NewCertPool()
+	pemData, err := ioutil.ReadFile(certFile)
+	expect.NoError(err)
+	roots.AppendCertsFromPEM(pemData)
+
+	// Clients without a certificate are rejected
+	conn, err := tls.Dial("tcp", address, &tls.Config{RootCAs: roots})
+	if err == nil {
+		_, err = conn.Write([]byte("20 <14>1 - - - - - fail"))
+		if err == nil {
+			_, err = conn.Read(make([]byte, 1))
+		}
+		conn.Close()
+	}
+	expect.NotNil(err)
+
+	conn, err = tls.Dial("tcp", address, &tls.Config{RootCAs: roots, Certificates: []tls.Certificate{clientCert}})
+	expect.NoError(err)
+	_, err = conn.Write([]byte("25 <14>1 - - app - - - first26 <14>1 - - app - - - second"))
+	expect.NoError(err)
+	conn.Close()
+
+	expect.NonBlocking(2*time.Second, func() {
+		for stream.count() < 2 {
+			time.Sleep(10 * time.Millisecond)
+		}
+	})
+	expect.Equal(2, len(stream.messages))
+	expect.Equal("first", string(stream.messages[0].Data))
+	expect.Equal("second", string(stream.messages[1].Data))
+	expect.Equal("app", stream.messages[0].Metadata["syslog_app_name"])
+	expect.Equal("gollum", stream.messages[0].Metadata[core.MetadataClientCommonName])
+	expect.Equal("localhost", stream.messages[0].Metadata[core.MetadataClientSAN])
+}
+
+func TestSyslogLocalFormat(t *testing.T) {
+	expect := shared.NewExpect(t)
+	localFormat := &syslogLocalFormat{hostname: "localhost"}
+
+	parser := localFormat.GetParser([]byte("<13>Oct  4 10:00:00 myapp[123]: hello world"))
+	expect.NoError(parser.Parse())
+	parts := parser.Dump()
+	expect.Equal(13, parts["priority"])
+	expect.Equal(1, parts["facility"])
+	expect.Equal(5, parts["severity"])
+	expect.Equal("localhost", parts["hostname"])
+	expect.Equal("myapp", parts["tag"])
+	expect.Equal("123", parts["proc_id"])
+	expect.Equal("hello world", parts["content"])
+
+	parser = localFormat.GetParser([]byte("<14>Oct 14 10:00:00 web01 cron: job done"))
+	expect.NoError(parser.Parse())
+	parts = parser.Dump()
+	expect.Equal("web01", parts["hostname"])
+	expect.Equal("cron", parts["tag"])
+	expect.Equal("", parts["proc_id"])
+	expect.Equal("job done", parts["content"])
+
+	parser = localFormat.GetParser([]byte("<14>no tag here"))
+	expect.NoError(parser.Parse())
+	parts = parser.Dump()
+	expect.Equal("localhost", parts["hostname"])
+	expect.Equal(nil, parts["tag"])
+	expect.Equal("no tag here", parts["content"])
+
+	parser = localFormat.GetParser([]byte("plain text"))
+	expect.NotNil(parser.Parse())
+	expect.Equal("plain text", parser.Dump()["content"])
+}
+
+func TestSyslogdRateLimit(t *testing.T) {
+	expect := shared.NewExpect(t)
+
+	conf := core.NewPluginConfig("")
+	conf.Override("Address", "unix:///tmp/gollum_test.socket")
+	conf.Override("RateLimitBurst", 2)
+	conf.Override("RateLimitIntervalSec", 10)
+	plugin, err := core.NewPluginWithType("consumer.Syslogd", conf)
+	expect.NoError(err)
+	cons := plugin.(*Syslogd)
+
+	now := time.Now()
+	expect.True(cons.allowMessage("process 1", now))
+	expect.True(cons.allowMessage("process 1", now))
+	expect.False(cons.allowMessage("process 1", now))
+	expect.True(cons.allowMessage("process 2", now))
+	expect.Equal(1, cons.rateLimits["process 1"].suppressed)
+
+	later := now.Add(11 * time.Second)
+	expect.True(cons.allowMessage("process 1", later))
+	expect.Equal(0, cons.rateLimits["process 1"].suppressed)
+	_, exists := cons.rateLimits["process 2"]
+	expect.False(exists)
+}
+
+func TestSyslogdUnixgram(t *testing.T) {
+	expect := shared.NewExpect(t)
+
+	dir, err := ioutil.TempDir("", "gollum_syslogd")
+	expect.NoError(err)
+	defer os.RemoveAll(dir)
+	socketPath := filepath.Join(dir, "log")
+
+	stream := &mockHTTPStream{}
+	core.StreamRegistry.Register(stream, core.GetStreamID("syslogdUnixgram"))
+	conf := core.NewPluginConfig("")
+	conf.Stream = []string{"syslogdUnixgram"}
+	conf.Override("Address", "unix://"+socketPath)
+	conf.Override("Format", "RFC3164")
+	conf.Override("SocketPermissions", "0660")
+	conf.Override("RateLimitBurst", 2)
+	plugin, err := core.NewPluginWithType("consumer.Syslogd", conf)
+	expect.NoError(err)
+	cons := plugin.(*Syslogd)
+
+	workers := new(sync.WaitGroup)
+	go cons.Consume(workers)
+
+	var conn net.Conn
+	expect.NonBlocking(2*time.Second, func() {
+		for conn == nil {
+			conn, _ = net.Dial("unixgram", socketPath)
+			time.Sleep(10 * time.Millisecond)
+		}
+	})
+	defer conn.Close()
+
+	stat, err := os.Stat(socketPath)
+	expect.NoError(err)
+	expect.Equal(os.FileMode(0660), stat.Mode().Perm())
+
+	for _, line := range []string{"<13>Oct 14 10:00:00 test[1]: first\n", "<13>second\x00", "<13>dropped"} {
+		_, err = conn.Write([]byte(line))
+		expect.NoError(err)
+	}
+
+	waitForTestMessages(expect, stream, 2)
+	stream.guard.Lock()
+	expect.Equal(2, len(stream.messages))
+	expect.Equal("first", string(stream.messages[0].Data))
+	expect.Equal("second", string(stream.messages[1].Data))
+	metadata := stream.messages[0].Metadata
+	stream.guard.Unlock()
+
+	expect.Equal("test", metadata["syslog_app_name"])
+	expect.Equal("1", metadata["syslog_proc_id"])
+	if runtime.GOOS == "linux" {
+		expect.Equal(strconv.Itoa(os.Getpid()), metadata["client_pid"])
+		expect.Equal(strconv.Itoa(os.Getuid()), metadata["client_uid"])
+		expect.Equal(strconv.Itoa(os.Getgid()), metadata["client_gid"])
+	}
+
+	cons.Control() <- core.PluginControlStopConsumer
+	expect.NonBlocking(2*time.Second, workers.Wait)
+
+	_, err = os.Stat(socketPath)
+	expect.True(os.IsNotExist(err))
+}
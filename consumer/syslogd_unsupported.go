@@ -0,0 +1,36 @@
+// Copyright 2015-2016 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !linux
+// +build !linux
+
+package consumer
+
+import (
+	"net"
+)
+
+// syslogCredentialsSize is 0 as credentials are not supported on this
+// platform
+const syslogCredentialsSize = 0
+
+// enableSyslogCredentials is not supported on this platform
+func enableSyslogCredentials(conn *net.UnixConn) error {
+	return nil
+}
+
+// parseSyslogCredentials is not supported on this platform
+func parseSyslogCredentials(oob []byte) (syslogCredentials, bool) {
+	return syslogCredentials{}, false
+}
@@ -0,0 +1,333 @@
+// Copyright 2015-2016 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumer
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"github.com/trivago/gollum/core/log"
+	"github.com/trivago/gollum/shared"
+	"gopkg.in/mcuadros/go-syslog.v2/format"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+const syslogMaxDatagramSize = 65536
+
+// syslogCredentials holds the identity of a local sending process as
+// reported by the kernel.
+type syslogCredentials struct {
+	pid int
+	uid int
+	gid int
+}
+
+// syslogRateLimit counts the messages of one sender within the current rate
+// limit interval.
+type syslogRateLimit struct {
+	start      time.Time
+	count      int
+	suppressed int
+}
+
+// syslogLocalFormat parses RFC3164 messages sent to a local socket. Clients
+// like syslog(3) of glibc omit the hostname, so a hostname is only expected
+// if the first word after the timestamp is not a tag.
+type syslogLocalFormat struct {
+	hostname string
+}
+
+type syslogLocalParser struct {
+	line     []byte
+	hostname string
+	parts    format.LogParts
+}
+
+// GetParser returns a parser for messages with an optional hostname.
+func (f *syslogLocalFormat) GetParser(line []byte) format.LogParser {
+	return &syslogLocalParser{line: line, hostname: f.hostname}
+}
+
+// GetSplitFunc returns nil as every datagram holds exactly one message.
+func (f *syslogLocalFormat) GetSplitFunc() bufio.SplitFunc {
+	return nil
+}
+
+// Location is ignored as timestamps are not evaluated.
+func (p *syslogLocalParser) Location(location *time.Location) {
+}
+
+// Dump returns the fields parsed by Parse.
+func (p *syslogLocalParser) Dump() format.LogParts {
+	return p.parts
+}
+
+// parseSyslogTag parses a tag like "name[pid]:" at the start of text.
+func parseSyslogTag(text []byte) (tag string, pid string, rest []byte, isTag bool) {
+	word := text
+	if space := bytes.IndexByte(text, ' '); space >= 0 {
+		word, rest = text[:space], text[space+1:]
+	}
+	if len(word) < 2 || word[len(word)-1] != ':' {
+		return "", "", text, false // ### return, no tag ###
+	}
+
+	word = word[:len(word)-1]
+	if open := bytes.IndexByte(word, '['); open > 0 && word[len(word)-1] == ']' {
+		return string(word[:open]), string(word[open+1 : len(word)-1]), rest, true // ### return, tag with pid ###
+	}
+	return string(word), "", rest, true
+}
+
+// Parse reads priority, timestamp, hostname and tag. The message is kept
+// as content if the priority is missing.
+func (p *syslogLocalParser) Parse() error {
+	line := p.line
+	p.parts = format.LogParts{
+		"hostname": p.hostname,
+		"content":  string(line),
+	}
+
+	end := bytes.IndexByte(line, '>')
+	if len(line) < 3 || line[0] != '<' || end < 2 || end > 4 {
+		return fmt.Errorf("Syslog: message without priority")
+	}
+	priority, err := strconv.Atoi(string(line[1:end]))
+	if err != nil || priority > 191 {
+		return fmt.Errorf("Syslog: invalid priority %s", string(line[1:end]))
+	}
+	p.parts["priority"] = priority
+	p.parts["facility"] = priority / 8
+	p.parts["severity"] = priority % 8
+	line = line[end+1:]
+
+	for _, layout := range []string{time.Stamp, "Jan 02 15:04:05"} {
+		if len(line) > len(layout) && line[len(layout)] == ' ' {
+			if _, err := time.Parse(layout, string(line[:len(layout)])); err == nil {
+				line = line[len(layout)+1:]
+				break // ### break, timestamp found ###
+			}
+		}
+	}
+
+	tag, pid, rest, isTag := parseSyslogTag(line)
+	if space := bytes.IndexByte(line, ' '); !isTag && space > 0 {
+		if tag, pid, rest, isTag = parseSyslogTag(line[space+1:]); isTag {
+			p.parts["hostname"] = string(line[:space])
+		}
+	}
+	if isTag {
+		p.parts["tag"] = tag
+		p.parts["proc_id"] = pid
+		line = rest
+	}
+
+	p.parts["content"] = string(bytes.TrimSpace(line))
+	return nil
+}
+
+func (cons *Syslogd) sleep(duration time.Duration) {
+	select {
+	case <-cons.ctx.Done():
+	case <-time.After(duration):
+	}
+}
+
+// allowMessage returns false if the given sender exceeded the rate limit.
+// The number of suppressed messages is logged once a new interval starts.
+// Senders idle for a whole interval are forgotten.
+func (cons *Syslogd) allowMessage(sender string, now time.Time) bool {
+	if cons.rateBurst <= 0 {
+		return true // ### return, rate limit disabled ###
+	}
+
+	if now.Sub(cons.rateCleanup) >= cons.rateInterval {
+		for name, limit := range cons.rateLimits {
+			if now.Sub(limit.start) >= cons.rateInterval {
+				cons.logSuppressed(name, limit)
+				delete(cons.rateLimits, name)
+			}
+		}
+		cons.rateCleanup = now
+	}
+
+	limit, exists := cons.rateLimits[sender]
+	switch {
+	case !exists:
+		limit = &syslogRateLimit{start: now}
+		cons.rateLimits[sender] = limit
+	case now.Sub(limit.start) >= cons.rateInterval:
+		cons.logSuppressed(sender, limit)
+		limit.start, limit.count, limit.suppressed = now, 0, 0
+	}
+
+	if limit.count >= cons.rateBurst {
+		limit.suppressed++
+		return false // ### return, rate limit exceeded ###
+	}
+	limit.count++
+	return true
+}
+
+func (cons *Syslogd) logSuppressed(sender string, limit *syslogRateLimit) {
+	if limit.suppressed > 0 {
+		Log.Warning.Printf("Syslog: Suppressed %d messages from %s", limit.suppressed, sender)
+	}
+}
+
+// handleDatagram parses a message received on a unix datagram socket.
+func (cons *Syslogd) handleDatagram(data []byte, address string, credentials syslogCredentials, hasCredentials bool) {
+	// Ignore trailing newlines and NULs
+	for len(data) > 0 && data[len(data)-1] < ' ' {
+		data = data[:len(data)-1]
+	}
+	if len(data) == 0 {
+		return // ### return, empty message ###
+	}
+
+	sender := "unknown process"
+	switch {
+	case hasCredentials:
+		sender = "process " + strconv.Itoa(credentials.pid)
+	case address != "":
+		sender = address
+	}
+	if !cons.allowMessage(sender, time.Now()) {
+		return // ### return, message dropped ###
+	}
+
+	if split := cons.format.GetSplitFunc(); split != nil {
+		_, token, err := split(data, true)
+		if err != nil {
+			Log.Warning.Print(err)
+			return // ### return, invalid frame ###
+		}
+		data = token
+	}
+
+	parser := cons.format.GetParser(data)
+	err := parser.Parse()
+	parts := parser.Dump()
+	parts["client"] = address
+	if hasCredentials {
+		parts["client_pid"] = credentials.pid
+		parts["client_uid"] = credentials.uid
+		parts["client_gid"] = credentials.gid
+	}
+	cons.Handle(parts, int64(len(data)), err)
+}
+
+// connectUnixgram binds the datagram socket. The socket is kept so that it
+// can be closed when the consumer is stopped.
+func (cons *Syslogd) connectUnixgram() (*net.UnixConn, error) {
+	if cons.clearSocket {
+		if err := shared.RemoveStaleUnixSocket(cons.address); err != nil {
+			return nil, err // ### return, socket in use ###
+		}
+	}
+
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: cons.address, Net: "unixgram"})
+	if err != nil {
+		return nil, err // ### return, could not bind ###
+	}
+	if err := shared.SetUnixSocketPermissions(cons.address, cons.fileFlags, cons.fileOwner, cons.fileGroup); err != nil {
+		cons.closeUnixgram(conn)
+		return nil, err // ### return, could not set permissions ###
+	}
+	if err := enableSyslogCredentials(conn); err != nil {
+		Log.Warning.Print("Syslog: Failed to enable credentials on unix://", cons.address, ": ", err)
+	}
+
+	cons.guard.Lock()
+	defer cons.guard.Unlock()
+	if !cons.IsActive() {
+		cons.closeUnixgram(conn)
+		return nil, io.EOF // ### return, consumer stopped ###
+	}
+	cons.conn = conn
+	return conn, nil
+}
+
+// closeUnixgram closes the socket and removes its file, as datagram sockets
+// are not unlinked on close.
+func (cons *Syslogd) closeUnixgram(conn *net.UnixConn) {
+	conn.Close()
+	if !shared.IsAbstractUnixSocket(cons.address) {
+		os.Remove(cons.address)
+	}
+}
+
+func (cons *Syslogd) disconnectUnixgram() {
+	cons.guard.Lock()
+	defer cons.guard.Unlock()
+	if cons.conn != nil {
+		cons.closeUnixgram(cons.conn)
+		cons.conn = nil
+	}
+}
+
+func (cons *Syslogd) receiveUnixgram(conn *net.UnixConn) {
+	buffer := make([]byte, syslogMaxDatagramSize)
+	oob := make([]byte, syslogCredentialsSize)
+
+	for cons.IsActive() {
+		cons.WaitOnFuse()
+		size, oobSize, _, addr, err := conn.ReadMsgUnix(buffer, oob)
+		if err != nil {
+			if cons.IsActive() {
+				Log.Error.Print("Syslog: Failed to read from unix://", cons.address, ": ", err)
+			}
+			return // ### return, reopen socket ###
+		}
+
+		address := ""
+		if addr != nil {
+			address = addr.Name
+		}
+		credentials, hasCredentials := parseSyslogCredentials(oob[:oobSize])
+		cons.handleDatagram(buffer[:size], address, credentials, hasCredentials)
+	}
+}
+
+func (cons *Syslogd) readUnixgram() {
+	defer cons.WorkerDone()
+
+	for cons.IsActive() {
+		conn, err := cons.connectUnixgram()
+		if err != nil {
+			if cons.IsActive() {
+				Log.Error.Print("Syslog: Failed to open unix://", cons.address, ": ", err)
+				cons.sleep(cons.reconnectDelay)
+			}
+			continue // ### continue, retry ###
+		}
+
+		cons.receiveUnixgram(conn)
+		cons.disconnectUnixgram()
+
+		if cons.IsActive() {
+			cons.sleep(cons.reconnectDelay)
+		}
+	}
+}
+
+func (cons *Syslogd) close() {
+	cons.cancel()
+	cons.disconnectUnixgram()
+}
@@ -0,0 +1,302 @@
+// Copyright 2015-2016 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumer
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/core/log"
+	"github.com/trivago/gollum/shared"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// UDPSocket consumer plugin
+// The UDPSocket consumer reads datagrams from a given UDP socket.
+// By default each datagram is treated as one message. Alternatively the
+// standard partitioners can be used to extract multiple messages from a single
+// datagram. Incomplete messages at the end of a datagram are discarded.
+// When attached to a fuse, this consumer will discard all incoming datagrams
+// in case that fuse is burned.
+// The address of the sender is attached to each message as "source_address"
+// metadata.
+// Configuration example
+//
+//  - "consumer.UDPSocket":
+//    Address: ":5880"
+//    Partitioner: "datagram"
+//    Delimiter: "\n"
+//    Offset: 0
+//    Size: 1
+//    MaxDatagramSize: 65507
+//    ReadBufferSize: 0
+//    Workers: 1
+//    ReusePort: false
+//
+// Address defines the host and port to bind to, e.g. "localhost:5880".
+// The protocol prefix "udp://", "udp4://" or "udp6://" is optional.
+// By default this is set to ":5880".
+//
+// Partitioner defines the algorithm used to read messages from a datagram.
+// By default this is set to "datagram".
+//  * "datagram" treats each datagram as exactly one message.
+//  * "delimiter" separates messages by looking for a delimiter string.
+//    The delimiter is removed from the message. A missing delimiter at the
+//    end of a datagram is tolerated.
+//  * "ascii" reads an ASCII number at a given offset until a given delimiter is found.
+//    Everything to the right of and including the delimiter is removed from the message.
+//  * "binary" reads a binary number at a given offset and size.
+//  * "binary_le" is an alias for "binary".
+//  * "binary_be" is the same as "binary" but uses big endian encoding.
+//  * "varint" reads an unsigned varint (as used by protocol buffers) at a given
+//    offset.
+//    The offset and the varint are removed from the message.
+//  * "fixed" assumes fixed size messages.
+//
+// Delimiter defines the delimiter used by the text and delimiter partitioner.
+// By default this is set to "\n".
+//
+// Offset defines the offset used by the binary, varint and text partitioner.
+// By default this is set to 0. This setting is ignored by the fixed partitioner.
+//
+// Size defines the size in bytes used by the binary or fixed partitioner.
+// For binary this can be set to 1,2,4 or 8. By default 4 is chosen.
+// For fixed this defines the size of a message. By default 1 is chosen.
+//
+// MaxDatagramSize defines the maximum number of bytes read per datagram.
+// Larger datagrams are truncated. By default this is set to 65507.
+//
+// ReadBufferSize sets the size of the operating system's receive buffer
+// (SO_RCVBUF) in bytes. Larger buffers help to compensate bursts without the
+// kernel dropping datagrams. By default this is set to 0, which keeps the
+// system default.
+//
+// Workers defines the number of go routines reading from the socket.
+// By default this is set to 1.
+//
+// ReusePort can be set to true to open one socket per worker that are all
+// bound to the same address using SO_REUSEPORT. This allows the kernel to
+// distribute datagrams between the workers. If set to false all workers share
+// the same socket. This option is only supported on Linux and BSD systems.
+// By default this is set to false.
+type UDPSocket struct {
+	core.ConsumerBase
+	listen          []*net.UDPConn
+	listenGuard     *sync.Mutex
+	protocol        string
+	address         string
+	delimiter       string
+	flags           shared.BufferedReaderFlags
+	offset          int
+	maxDatagramSize int
+	readBufferSize  int
+	workers         int
+	sequence        uint64
+	datagramMode    bool
+	reusePort       bool
+}
+
+func init() {
+	shared.TypeRegistry.Register(UDPSocket{})
+}
+
+// Configure initializes this consumer with values from a plugin config.
+func (cons *UDPSocket) Configure(conf core.PluginConfig) error {
+	err := cons.ConsumerBase.Configure(conf)
+	if err != nil {
+		return err
+	}
+
+	cons.address, cons.protocol = shared.ParseAddress(conf.GetString("Address", ":5880"))
+	switch cons.protocol {
+	case "tcp":
+		cons.protocol = "udp" // default returned by ParseAddress
+	case "udp", "udp4", "udp6":
+	default:
+		return fmt.Errorf("UDPSocket does not support %s", cons.protocol)
+	}
+
+	cons.listenGuard = new(sync.Mutex)
+	cons.maxDatagramSize = conf.GetInt("MaxDatagramSize", 65507)
+	cons.readBufferSize = conf.GetInt("ReadBufferSize", 0)
+	cons.workers = shared.MaxI(conf.GetInt("Workers", 1), 1)
+	cons.reusePort = conf.GetBool("ReusePort", false)
+
+	cons.delimiter = shared.Unescape(conf.GetString("Delimiter", "\n"))
+	cons.offset = conf.GetInt("Offset", 0)
+	cons.flags = 0
+
+	partitioner := strings.ToLower(conf.GetString("Partitioner", "datagram"))
+	switch partitioner {
+	case "datagram":
+		cons.datagramMode = true
+
+	case "binary_be":
+		cons.flags |= shared.BufferedReaderFlagBigEndian
+		fallthrough
+
+	case "binary", "binary_le":
+		cons.flags |= shared.BufferedReaderFlagEverything
+		switch conf.GetInt("Size", 4) {
+		case 1:
+			cons.flags |= shared.BufferedReaderFlagMLE8
+		case 2:
+			cons.flags |= shared.BufferedReaderFlagMLE16
+		case 4:
+			cons.flags |= shared.BufferedReaderFlagMLE32
+		case 8:
+			cons.flags |= shared.BufferedReaderFlagMLE64
+		default:
+			return fmt.Errorf("Size only supports the value 1,2,4 and 8")
+		}
+
+	case "varint":
+		cons.flags |= shared.BufferedReaderFlagMLEVarint
+
+	case "fixed":
+		cons.flags |= shared.BufferedReaderFlagMLEFixed
+		cons.offset = conf.GetInt("Size", 1)
+
+	case "ascii":
+		cons.flags |= shared.BufferedReaderFlagMLE
+
+	case "delimiter":
+		// Nothing to add
+
+	default:
+		return fmt.Errorf("Unknown partitioner: %s", partitioner)
+	}
+
+	return err
+}
+
+func (cons *UDPSocket) sendMessage(data []byte, sourceAddress string) {
+	msg := core.NewMessage(cons, data, atomic.AddUint64(&cons.sequence, 1))
+	msg.SetMetadata(core.MetadataSourceAddress, sourceAddress)
+	cons.EnqueueMessage(msg)
+}
+
+func (cons *UDPSocket) listenUDP() (*net.UDPConn, error) {
+	var conn *net.UDPConn
+	var err error
+
+	if cons.reusePort {
+		conn, err = listenUDPReusePort(cons.protocol, cons.address)
+	} else {
+		var addr *net.UDPAddr
+		if addr, err = net.ResolveUDPAddr(cons.protocol, cons.address); err == nil {
+			conn, err = net.ListenUDP(cons.protocol, addr)
+		}
+	}
+
+	if err != nil {
+		return nil, err // ### return, could not bind ###
+	}
+
+	if cons.readBufferSize > 0 {
+		if err := conn.SetReadBuffer(cons.readBufferSize); err != nil {
+			Log.Warning.Print("UDPSocket could not set read buffer size: ", err)
+		}
+	}
+
+	cons.listenGuard.Lock()
+	cons.listen = append(cons.listen, conn)
+	cons.listenGuard.Unlock()
+	return conn, nil
+}
+
+func (cons *UDPSocket) processDatagrams(conn *net.UDPConn) {
+	defer cons.WorkerDone()
+
+	datagram := make([]byte, cons.maxDatagramSize)
+	buffer := shared.NewBufferedReader(cons.maxDatagramSize, cons.flags, cons.offset, cons.delimiter)
+	needsDelimiter := !cons.datagramMode && cons.flags&shared.BufferedReaderFlagMaskMLE == 0
+
+	for cons.IsActive() {
+		size, sender, err := conn.ReadFromUDP(datagram)
+		if err != nil {
+			if !cons.IsActive() || shared.IsDisconnectedError(err) {
+				return // ### return, socket closed ###
+			}
+			Log.Error.Print("UDPSocket read failed: ", err)
+			continue // ### continue, skip datagram ###
+		}
+
+		if size == 0 || cons.IsFuseBurned() {
+			continue // ### continue, nothing to do ###
+		}
+
+		sourceAddress := sender.String()
+		if cons.datagramMode {
+			data := make([]byte, size)
+			copy(data, datagram[:size])
+			cons.sendMessage(data, sourceAddress)
+			continue // ### continue, one message per datagram ###
+		}
+
+		data := datagram[:size]
+		if needsDelimiter && !bytes.HasSuffix(data, []byte(cons.delimiter)) {
+			data = append(data, cons.delimiter...)
+		}
+
+		buffer.Reset(0)
+		err = buffer.ReadAll(bytes.NewReader(data), func(msg []byte, seq uint64) {
+			cons.sendMessage(msg, sourceAddress)
+		})
+		if err != nil && err != io.EOF {
+			Log.Error.Print("UDPSocket failed to parse datagram: ", err)
+		}
+	}
+}
+
+func (cons *UDPSocket) closeAll() {
+	cons.listenGuard.Lock()
+	defer cons.listenGuard.Unlock()
+
+	for _, conn := range cons.listen {
+		conn.Close()
+	}
+	cons.listen = cons.listen[:0]
+}
+
+// Consume listens to a given socket.
+func (cons *UDPSocket) Consume(workers *sync.WaitGroup) {
+	cons.SetWorkerWaitGroup(workers)
+	defer cons.closeAll()
+
+	var sharedConn *net.UDPConn
+	for i := 0; i < cons.workers; i++ {
+		conn := sharedConn
+		if conn == nil {
+			var err error
+			if conn, err = cons.listenUDP(); err != nil {
+				Log.Error.Print("UDPSocket connection error: ", err)
+				return // ### return, could not bind ###
+			}
+			if !cons.reusePort {
+				sharedConn = conn
+			}
+		}
+
+		cons.AddWorker()
+		go shared.DontPanic(func() { cons.processDatagrams(conn) })
+	}
+
+	cons.ControlLoop()
+}
@@ -0,0 +1,235 @@
+// Copyright 2015-2016 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumer
+
+import (
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/shared"
+	"net"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newTestUDPSocket(expect shared.Expect, streamName string, settings map[string]interface{}) (*UDPSocket, *mockHTTPStream, string) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	expect.NoError(err)
+	address := conn.LocalAddr().String()
+	conn.Close()
+
+	stream := &mockHTTPStream{}
+	core.StreamRegistry.Register(stream, core.GetStreamID(streamName))
+	conf := core.NewPluginConfig("")
+	conf.Stream = []string{streamName}
+	conf.Override("Address", address)
+	for key, value := range settings {
+		conf.Override(key, value)
+	}
+	plugin, err := core.NewPluginWithType("consumer.UDPSocket", conf)
+	expect.NoError(err)
+	return plugin.(*UDPSocket), stream, address
+}
+
+func (cons *UDPSocket) numListeners() int {
+	cons.listenGuard.Lock()
+	defer cons.listenGuard.Unlock()
+	return len(cons.listen)
+}
+
+// startTestUDPSocket runs Consume and waits until the given number of sockets
+// is bound.
+func startTestUDPSocket(expect shared.Expect, cons *UDPSocket, sockets int) *sync.WaitGroup {
+	workers := new(sync.WaitGroup)
+	go cons.Consume(workers)
+	expect.NonBlocking(2*time.Second, func() {
+		for cons.numListeners() < sockets {
+			time.Sleep(10 * time.Millisecond)
+		}
+	})
+	return workers
+}
+
+func stopTestUDPSocket(expect shared.Expect, cons *UDPSocket, workers *sync.WaitGroup) {
+	cons.Control() <- core.PluginControlStopConsumer
+	expect.NonBlocking(2*time.Second, workers.Wait)
+}
+
+// waitForTestPayloads waits for count messages and returns all payloads
+// received so far.
+func waitForTestPayloads(expect shared.Expect, stream *mockHTTPStream, count int) []string {
+	waitForTestMessages(expect, stream, count)
+
+	stream.guard.Lock()
+	defer stream.guard.Unlock()
+	payloads := []string{}
+	for _, msg := range stream.messages {
+		payloads = append(payloads, string(msg.Data))
+	}
+	return payloads
+}
+
+func TestUDPSocketConfigure(t *testing.T) {
+	expect := shared.NewExpect(t)
+
+	conf := core.NewPluginConfig("")
+	conf.Override("Address", "unix:///tmp/gollum.sock")
+	_, err := core.NewPluginWithType("consumer.UDPSocket", conf)
+	expect.NotNil(err)
+
+	conf = core.NewPluginConfig("")
+	conf.Override("Partitioner", "unknown")
+	_, err = core.NewPluginWithType("consumer.UDPSocket", conf)
+	expect.NotNil(err)
+
+	conf = core.NewPluginConfig("")
+	conf.Override("Partitioner", "binary")
+	conf.Override("Size", 3)
+	_, err = core.NewPluginWithType("consumer.UDPSocket", conf)
+	expect.NotNil(err)
+}
+
+func TestUDPSocketDatagram(t *testing.T) {
+	expect := shared.NewExpect(t)
+
+	cons, stream, address := newTestUDPSocket(expect, "udpDatagram", map[string]interface{}{
+		"MaxDatagramSize": 8,
+	})
+	workers := startTestUDPSocket(expect, cons, 1)
+
+	client, err := net.Dial("udp", address)
+	expect.NoError(err)
+	defer client.Close()
+
+	client.Write([]byte("a\nb"))
+	client.Write([]byte("0123456789"))
+
+	payloads := waitForTestPayloads(expect, stream, 2)
+	stopTestUDPSocket(expect, cons, workers)
+
+	expect.Equal([]string{"a\nb", "01234567"}, payloads)
+	expect.Equal(client.LocalAddr().String(), stream.messages[0].Metadata[core.MetadataSourceAddress])
+}
+
+func TestUDPSocketPartitioner(t *testing.T) {
+	expect := shared.NewExpect(t)
+
+	cons, stream, address := newTestUDPSocket(expect, "udpDelimiter", map[string]interface{}{
+		"Partitioner": "delimiter",
+		"Delimiter":   ";",
+	})
+	workers := startTestUDPSocket(expect, cons, 1)
+
+	client, err := net.Dial("udp", address)
+	expect.NoError(err)
+
+	// The delimiter at the end of a datagram is optional and messages never
+	// span datagrams.
+	client.Write([]byte("a;b;"))
+	client.Write([]byte("c;d"))
+	payloads := waitForTestPayloads(expect, stream, 4)
+	stopTestUDPSocket(expect, cons, workers)
+	client.Close()
+
+	expect.Equal([]string{"a", "b", "c", "d"}, payloads)
+	expect.Equal(client.LocalAddr().String(), stream.messages[3].Metadata[core.MetadataSourceAddress])
+
+	cons, stream, address = newTestUDPSocket(expect, "udpBinary", map[string]interface{}{
+		"Partitioner": "binary",
+		"Size":        1,
+	})
+	workers = startTestUDPSocket(expect, cons, 1)
+
+	client, err = net.Dial("udp", address)
+	expect.NoError(err)
+	defer client.Close()
+
+	// The last message of the first datagram is incomplete and discarded
+	client.Write([]byte("\x02ab\x01c\x05xx"))
+	client.Write([]byte("\x01d"))
+	payloads = waitForTestPayloads(expect, stream, 3)
+	stopTestUDPSocket(expect, cons, workers)
+
+	// Like consumer.Socket the binary partitioner keeps the length prefix
+	expect.Equal([]string{"\x02ab", "\x01c", "\x01d"}, payloads)
+}
+
+func TestUDPSocketReusePort(t *testing.T) {
+	expect := shared.NewExpect(t)
+	switch runtime.GOOS {
+	case "linux", "darwin", "dragonfly", "freebsd", "netbsd", "openbsd":
+	default:
+		t.Skip("ReusePort is not supported on " + runtime.GOOS)
+	}
+
+	cons, stream, address := newTestUDPSocket(expect, "udpReusePort", map[string]interface{}{
+		"Workers":   2,
+		"ReusePort": true,
+	})
+	workers := startTestUDPSocket(expect, cons, 2)
+
+	// The kernel distributes datagrams by sender, so use several senders
+	clients := []net.Conn{}
+	for i := 0; i < 8; i++ {
+		client, err := net.Dial("udp", address)
+		expect.NoError(err)
+		defer client.Close()
+		clients = append(clients, client)
+		client.Write([]byte{byte('a' + i)})
+	}
+
+	payloads := waitForTestPayloads(expect, stream, len(clients))
+	expect.Equal(2, cons.numListeners())
+	stopTestUDPSocket(expect, cons, workers)
+
+	expect.Equal(len(clients), len(payloads))
+	expect.Equal(0, cons.numListeners())
+}
+
+func TestUDPSocketShutdown(t *testing.T) {
+	expect := shared.NewExpect(t)
+
+	cons, _, address := newTestUDPSocket(expect, "udpShutdown", map[string]interface{}{
+		"Workers": 4,
+	})
+	workers := startTestUDPSocket(expect, cons, 1)
+
+	// All workers share one socket if ReusePort is not set
+	expect.Equal(1, cons.numListeners())
+	stopTestUDPSocket(expect, cons, workers)
+	expect.Equal(0, cons.numListeners())
+
+	// The address can be bound again after the consumer stopped
+	conn, err := net.ListenPacket("udp", address)
+	expect.NoError(err)
+	conn.Close()
+
+	// Consume returns if the address is already in use
+	conn, err = net.ListenPacket("udp", address)
+	expect.NoError(err)
+	defer conn.Close()
+
+	cons, _, _ = newTestUDPSocket(expect, "udpShutdown", map[string]interface{}{
+		"Address": address,
+	})
+	workers = new(sync.WaitGroup)
+	done := make(chan struct{})
+	go func() {
+		cons.Consume(workers)
+		close(done)
+	}()
+	expect.NonBlocking(2*time.Second, func() { <-done })
+	expect.Equal(0, cons.numListeners())
+}
@@ -0,0 +1,660 @@
+// Copyright 2015-2016 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumer
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/jmespath/go-jmespath"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/core/log"
+	"github.com/trivago/gollum/shared"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	webhookMetadataPath  = "webhook_path"
+	webhookMetadataEvent = "webhook_event"
+
+	webhookSignatureNone   = "none"
+	webhookSignatureGitHub = "github"
+	webhookSignatureStripe = "stripe"
+	webhookSignatureSlack  = "slack"
+	webhookSignatureHMAC   = "hmac"
+	webhookSignatureToken  = "token"
+)
+
+// Webhook consumer plugin
+// The Webhook consumer opens an HTTP server that receives webhooks as sent
+// by services like GitHub, Stripe or Slack. The signature of each request is
+// verified with a secret shared with the sending service before the payload
+// is accepted. Each request creates one message containing either the
+// request body or a JSON object of fields extracted from it.
+// Each URL path can be configured as endpoint with its own secret,
+// signature scheme, field extraction and target stream.
+// The address of the client, the request path and the event type (see
+// EventHeader) are attached to each message as "source_address",
+// "webhook_path" and "webhook_event" metadata.
+// Requests are answered with status 200 if the message has been accepted,
+// 400 if fields cannot be extracted from the body, 401 if the signature is
+// missing, invalid or too old, 404 if the path is not a configured endpoint,
+// 405 if the method is not POST, 413 if the body is too large and 503 if the
+// fuse is burned.
+// Slack's "url_verification" requests are answered with the challenge sent.
+// Configuration example
+//
+//  - "consumer.Webhook":
+//    Address: ":8080"
+//    ReadTimeoutSec: 3
+//    MaxBodySizeByte: 1048576
+//    ToleranceSec: 300
+//    Signature: "none"
+//    Secret: ""
+//    SecretFile: ""
+//    SignatureHeader: "X-Signature"
+//    SignaturePrefix: ""
+//    SignatureEncoding: "hex"
+//    EventHeader: ""
+//    Expression: ""
+//    Fields: {}
+//    Endpoints:
+//      "/github": {Stream: "github", Signature: "github", SecretFile: "/etc/gollum/github.secret"}
+//      "/stripe": {Stream: "payments", Signature: "stripe", Fields: {"type": "type", "id": "data.object.id"}}
+//    Certificate: ""
+//    PrivateKey: ""
+//    ClientCA: ""
+//
+// Address defines the host and port to bind to, e.g. "localhost:8080".
+// By default this is set to ":8080".
+//
+// ReadTimeoutSec specifies the maximum duration in seconds before timing out
+// the HTTP read request. By default this is set to 3 seconds.
+//
+// MaxBodySizeByte defines the maximum size of a request body. Larger requests
+// are rejected. By default this is set to 1048576 (1 MB).
+//
+// ToleranceSec defines the maximum age in seconds of the timestamp signed by
+// the "stripe" and "slack" schemes. Older requests are rejected to prevent
+// replay attacks. Set to 0 to disable this check. By default this is set to
+// 300.
+//
+// Signature defines the scheme used to verify requests.
+// By default this is set to "none".
+//  * "none" accepts all requests.
+//  * "github" expects the header "X-Hub-Signature-256" to contain
+//    "sha256=" followed by the hex encoded HMAC-SHA256 of the body.
+//  * "stripe" expects the header "Stripe-Signature" as sent by Stripe, i.e.
+//    a timestamp and one or more HMAC-SHA256 signatures of the timestamp and
+//    the body.
+//  * "slack" expects the headers "X-Slack-Request-Timestamp" and
+//    "X-Slack-Signature" as sent by Slack.
+//  * "hmac" expects the header SignatureHeader to contain SignaturePrefix
+//    followed by the HMAC-SHA256 of the body encoded as SignatureEncoding.
+//  * "token" expects the header SignatureHeader to contain the secret, e.g.
+//    "X-Gitlab-Token" for GitLab.
+//
+// Secret defines the secret shared with the sending service. Required by all
+// schemes except "none". By default this is set to "".
+//
+// SecretFile defines a file to read the secret from instead. A trailing line
+// break is ignored. By default this is set to "".
+//
+// SignatureHeader defines the header holding the signature for the "hmac"
+// and "token" schemes. By default this is set to "X-Signature".
+//
+// SignaturePrefix defines a prefix of the signature for the "hmac" scheme,
+// e.g. "sha256=". By default this is set to "".
+//
+// SignatureEncoding defines the encoding of the signature for the "hmac"
+// scheme, either "hex" or "base64". By default this is set to "hex".
+//
+// EventHeader defines a header holding the type of an event, which is stored
+// as "webhook_event" metadata. By default this is set to "", which uses
+// "X-GitHub-Event" for the "github" scheme and does not set the metadata for
+// all other schemes.
+//
+// Expression defines a JMESPath expression evaluated against the JSON body
+// of a request, e.g. "data.object". Strings are written as is, all other
+// values as JSON. This option is ignored if Fields is set. By default this is
+// set to "", which passes the body on unchanged.
+//
+// Fields defines a map of keys to JMESPath expressions. The message is a JSON
+// object with one field per key. Fields evaluating to null are omitted.
+// Form encoded bodies as sent by Slack slash commands are converted to a JSON
+// object before Expression or Fields are evaluated. By default this map is
+// empty.
+//
+// Endpoints maps URL paths to endpoint settings. All options from Signature
+// to Fields can be set per endpoint and default to the values set for the
+// consumer. The additional option Stream sends messages of an endpoint to the
+// given stream instead of the streams set for the consumer. If set, requests
+// to other paths are rejected. If empty, all paths are accepted using the
+// settings of the consumer. Empty by default.
+//
+// Certificate defines a path to a PEM encoded certificate file to make this
+// consumer accept TLS connections only. Left empty by default (disabled).
+// If a Certificate is given, a PrivateKey must be given, too.
+//
+// PrivateKey defines a path to the PEM encoded private key used for TLS
+// connections. Left empty by default (disabled).
+//
+// ClientCA defines a path to a PEM encoded file containing the certificate
+// authorities used to verify client certificates. If set, clients have to
+// present a valid certificate signed by one of these authorities.
+// Requires Certificate and PrivateKey to be set. Left empty by default.
+type Webhook struct {
+	core.ConsumerBase
+	listen         *shared.StopListener
+	address        string
+	readTimeoutSec time.Duration
+	maxBodySize    int64
+	tolerance      time.Duration
+	defaults       *webhookEndpoint
+	endpoints      map[string]*webhookEndpoint
+	tlsConfig      *tls.Config
+	sequence       uint64
+}
+
+// webhookSettings holds the options of an endpoint.
+type webhookSettings struct {
+	stream            string
+	signature         string
+	secret            string
+	secretFile        string
+	signatureHeader   string
+	signaturePrefix   string
+	signatureEncoding string
+	eventHeader       string
+	expression        string
+	fields            map[string]string
+}
+
+// webhookEndpoint holds the verification and extraction settings of a path.
+type webhookEndpoint struct {
+	streams           []core.MappedStream
+	signature         string
+	secret            []byte
+	signatureHeader   string
+	signaturePrefix   string
+	signatureEncoding string
+	eventHeader       string
+	expression        *jmespath.JMESPath
+	fields            []webhookField
+}
+
+type webhookField struct {
+	key        string
+	expression *jmespath.JMESPath
+}
+
+func init() {
+	shared.TypeRegistry.Register(Webhook{})
+}
+
+// Configure initializes this consumer with values from a plugin config.
+func (cons *Webhook) Configure(conf core.PluginConfig) error {
+	err := cons.ConsumerBase.Configure(conf)
+	if err != nil {
+		return err
+	}
+
+	cons.address = conf.GetString("Address", ":8080")
+	cons.readTimeoutSec = time.Duration(conf.GetInt("ReadTimeoutSec", 3)) * time.Second
+	cons.maxBodySize = int64(conf.GetInt("MaxBodySizeByte", 1<<20))
+	cons.tolerance = time.Duration(conf.GetInt("ToleranceSec", 300)) * time.Second
+
+	settings := webhookSettings{
+		signature:         strings.ToLower(conf.GetString("Signature", webhookSignatureNone)),
+		secret:            conf.GetString("Secret", ""),
+		secretFile:        conf.GetString("SecretFile", ""),
+		signatureHeader:   conf.GetString("SignatureHeader", "X-Signature"),
+		signaturePrefix:   conf.GetString("SignaturePrefix", ""),
+		signatureEncoding: strings.ToLower(conf.GetString("SignatureEncoding", "hex")),
+		eventHeader:       conf.GetString("EventHeader", ""),
+		expression:        conf.GetString("Expression", ""),
+		fields:            conf.GetStringMap("Fields", map[string]string{}),
+	}
+	if cons.defaults, err = newWebhookEndpoint(settings); err != nil {
+		return err
+	}
+
+	endpoints, err := shared.MarshalMap{"endpoints": conf.GetValue("Endpoints", map[string]interface{}{})}.MarshalMap("endpoints")
+	if err != nil {
+		return fmt.Errorf("Endpoints must be a map")
+	}
+	cons.endpoints = make(map[string]*webhookEndpoint)
+	for path := range endpoints {
+		options := shared.NewMarshalMap()
+		if endpoints[path] != nil {
+			if options, err = endpoints.MarshalMap(path); err != nil {
+				return fmt.Errorf("Endpoint %s must be a map", path)
+			}
+		}
+		endpointSettings, err := settings.override(options)
+		if err != nil {
+			return fmt.Errorf("Endpoint %s: %s", path, err)
+		}
+		if cons.endpoints[path], err = newWebhookEndpoint(endpointSettings); err != nil {
+			return fmt.Errorf("Endpoint %s: %s", path, err)
+		}
+	}
+
+	cons.tlsConfig, err = shared.NewServerTLSConfig(
+		conf.GetString("Certificate", ""),
+		conf.GetString("PrivateKey", ""),
+		conf.GetString("ClientCA", ""))
+	return err
+}
+
+// override returns a copy of the settings with the options of an endpoint
+// applied.
+func (settings webhookSettings) override(options shared.MarshalMap) (webhookSettings, error) {
+	stringOptions := map[string]*string{
+		"Stream":            &settings.stream,
+		"Signature":         &settings.signature,
+		"Secret":            &settings.secret,
+		"SecretFile":        &settings.secretFile,
+		"SignatureHeader":   &settings.signatureHeader,
+		"SignaturePrefix":   &settings.signaturePrefix,
+		"SignatureEncoding": &settings.signatureEncoding,
+		"EventHeader":       &settings.eventHeader,
+		"Expression":        &settings.expression,
+	}
+
+	for key := range options {
+		var err error
+		if target, isString := stringOptions[key]; isString {
+			*target, err = options.String(key)
+		} else if key == "Fields" {
+			settings.fields, err = options.StringMap(key)
+		} else {
+			return settings, fmt.Errorf("Unknown option %s", key)
+		}
+		if err != nil {
+			return settings, fmt.Errorf("Invalid %s: %s", key, err)
+		}
+	}
+
+	// A secret set for the endpoint replaces a secret file set for the
+	// consumer and vice versa
+	_, hasSecret := options["Secret"]
+	_, hasSecretFile := options["SecretFile"]
+	switch {
+	case hasSecret && !hasSecretFile:
+		settings.secretFile = ""
+	case hasSecretFile && !hasSecret:
+		settings.secret = ""
+	}
+	return settings, nil
+}
+
+func newWebhookEndpoint(settings webhookSettings) (*webhookEndpoint, error) {
+	endpoint := &webhookEndpoint{
+		signature:         strings.ToLower(settings.signature),
+		secret:            []byte(settings.secret),
+		signatureHeader:   settings.signatureHeader,
+		signaturePrefix:   settings.signaturePrefix,
+		signatureEncoding: strings.ToLower(settings.signatureEncoding),
+		eventHeader:       settings.eventHeader,
+	}
+
+	if settings.stream != "" {
+		endpoint.streams = core.NewMappedStreams([]string{settings.stream})
+	}
+
+	if settings.secretFile != "" {
+		if settings.secret != "" {
+			return nil, fmt.Errorf("Secret and SecretFile cannot be used together")
+		}
+		secret, err := ioutil.ReadFile(settings.secretFile)
+		if err != nil {
+			return nil, err
+		}
+		endpoint.secret = bytes.TrimRight(secret, "\r\n")
+	}
+
+	switch endpoint.signature {
+	case webhookSignatureNone:
+	case webhookSignatureGitHub, webhookSignatureStripe, webhookSignatureSlack, webhookSignatureHMAC, webhookSignatureToken:
+		if len(endpoint.secret) == 0 {
+			return nil, fmt.Errorf("Signature %s requires a Secret or SecretFile", endpoint.signature)
+		}
+	default:
+		return nil, fmt.Errorf("Unknown Signature: %s", endpoint.signature)
+	}
+
+	switch endpoint.signatureEncoding {
+	case "hex", "base64":
+	default:
+		return nil, fmt.Errorf("SignatureEncoding must be \"hex\" or \"base64\"")
+	}
+
+	if endpoint.eventHeader == "" && endpoint.signature == webhookSignatureGitHub {
+		endpoint.eventHeader = "X-GitHub-Event"
+	}
+
+	keys := make([]string, 0, len(settings.fields))
+	for key := range settings.fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		expression, err := jmespath.Compile(settings.fields[key])
+		if err != nil {
+			return nil, fmt.Errorf("Field %s: %s", key, err)
+		}
+		endpoint.fields = append(endpoint.fields, webhookField{key: key, expression: expression})
+	}
+
+	if settings.expression != "" && len(endpoint.fields) == 0 {
+		var err error
+		if endpoint.expression, err = jmespath.Compile(settings.expression); err != nil {
+			return nil, fmt.Errorf("Expression: %s", err)
+		}
+	}
+	return endpoint, nil
+}
+
+// computeHMAC returns the HMAC-SHA256 of all given parts.
+func (endpoint *webhookEndpoint) computeHMAC(parts ...[]byte) []byte {
+	digest := hmac.New(sha256.New, endpoint.secret)
+	for _, part := range parts {
+		digest.Write(part)
+	}
+	return digest.Sum(nil)
+}
+
+// matchesHexHMAC returns true if signature is the hex encoded HMAC of parts.
+func (endpoint *webhookEndpoint) matchesHexHMAC(signature string, parts ...[]byte) bool {
+	decoded, err := hex.DecodeString(signature)
+	return err == nil && hmac.Equal(decoded, endpoint.computeHMAC(parts...))
+}
+
+// checkWebhookTimestamp returns an error if a signed unix timestamp is invalid or
+// older than the given tolerance.
+func checkWebhookTimestamp(timestamp string, tolerance time.Duration) error {
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid timestamp %q", timestamp)
+	}
+	if age := time.Since(time.Unix(seconds, 0)); tolerance > 0 && (age > tolerance || age < -tolerance) {
+		return fmt.Errorf("timestamp is %s old", age.Truncate(time.Second))
+	}
+	return nil
+}
+
+// verify returns an error if the signature of a request is missing or
+// invalid.
+func (endpoint *webhookEndpoint) verify(header http.Header, body []byte, tolerance time.Duration) error {
+	switch endpoint.signature {
+	case webhookSignatureGitHub:
+		signature := header.Get("X-Hub-Signature-256")
+		if !strings.HasPrefix(signature, "sha256=") || !endpoint.matchesHexHMAC(signature[7:], body) {
+			return fmt.Errorf("invalid X-Hub-Signature-256")
+		}
+
+	case webhookSignatureStripe:
+		timestamp, signatures := "", []string{}
+		for _, item := range strings.Split(header.Get("Stripe-Signature"), ",") {
+			keyValue := strings.SplitN(strings.TrimSpace(item), "=", 2)
+			switch {
+			case len(keyValue) != 2:
+			case keyValue[0] == "t":
+				timestamp = keyValue[1]
+			case keyValue[0] == "v1":
+				signatures = append(signatures, keyValue[1])
+			}
+		}
+		if err := checkWebhookTimestamp(timestamp, tolerance); err != nil {
+			return err
+		}
+		for _, signature := range signatures {
+			if endpoint.matchesHexHMAC(signature, []byte(timestamp+"."), body) {
+				return nil // ### return, valid signature ###
+			}
+		}
+		return fmt.Errorf("invalid Stripe-Signature")
+
+	case webhookSignatureSlack:
+		timestamp := header.Get("X-Slack-Request-Timestamp")
+		if err := checkWebhookTimestamp(timestamp, tolerance); err != nil {
+			return err
+		}
+		signature := header.Get("X-Slack-Signature")
+		if !strings.HasPrefix(signature, "v0=") || !endpoint.matchesHexHMAC(signature[3:], []byte("v0:"+timestamp+":"), body) {
+			return fmt.Errorf("invalid X-Slack-Signature")
+		}
+
+	case webhookSignatureHMAC:
+		signature := header.Get(endpoint.signatureHeader)
+		if !strings.HasPrefix(signature, endpoint.signaturePrefix) {
+			return fmt.Errorf("invalid %s", endpoint.signatureHeader)
+		}
+		signature = signature[len(endpoint.signaturePrefix):]
+		if endpoint.signatureEncoding == "hex" {
+			if !endpoint.matchesHexHMAC(signature, body) {
+				return fmt.Errorf("invalid %s", endpoint.signatureHeader)
+			}
+		} else if decoded, err := base64.StdEncoding.DecodeString(signature); err != nil || !hmac.Equal(decoded, endpoint.computeHMAC(body)) {
+			return fmt.Errorf("invalid %s", endpoint.signatureHeader)
+		}
+
+	case webhookSignatureToken:
+		if subtle.ConstantTimeCompare([]byte(header.Get(endpoint.signatureHeader)), endpoint.secret) != 1 {
+			return fmt.Errorf("invalid %s", endpoint.signatureHeader)
+		}
+	}
+	return nil
+}
+
+// parseWebhookBody returns the JSON document sent in a request. Form encoded
+// bodies are converted to an object using the first value of each field.
+func parseWebhookBody(contentType string, body []byte) (interface{}, error) {
+	if mediaType, _, _ := mime.ParseMediaType(contentType); mediaType == "application/x-www-form-urlencoded" {
+		values, err := url.ParseQuery(string(body))
+		if err != nil {
+			return nil, err
+		}
+		fields := make(map[string]interface{}, len(values))
+		for key := range values {
+			fields[key] = values.Get(key)
+		}
+		return fields, nil // ### return, form ###
+	}
+
+	var document interface{}
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	if err := decoder.Decode(&document); err != nil {
+		return nil, err
+	}
+	return document, nil
+}
+
+// extract returns the message generated from a request body.
+func (endpoint *webhookEndpoint) extract(contentType string, body []byte) ([]byte, error) {
+	if endpoint.expression == nil && len(endpoint.fields) == 0 {
+		return body, nil // ### return, passthrough ###
+	}
+
+	document, err := parseWebhookBody(contentType, body)
+	if err != nil {
+		return nil, err
+	}
+
+	if endpoint.expression != nil {
+		result, err := endpoint.expression.Search(document)
+		if err != nil {
+			return nil, err
+		}
+		if text, isString := result.(string); isString {
+			return []byte(text), nil // ### return, plain string ###
+		}
+		return json.Marshal(result)
+	}
+
+	object := make(map[string]interface{}, len(endpoint.fields))
+	for _, field := range endpoint.fields {
+		result, err := field.expression.Search(document)
+		if err != nil {
+			return nil, fmt.Errorf("field %s: %s", field.key, err)
+		}
+		if result != nil {
+			object[field.key] = result
+		}
+	}
+	return json.Marshal(object)
+}
+
+// slackChallenge returns the challenge of a Slack "url_verification"
+// request.
+func slackChallenge(body []byte) (string, bool) {
+	request := struct {
+		Type      string `json:"type"`
+		Challenge string `json:"challenge"`
+	}{}
+	if err := json.Unmarshal(body, &request); err != nil || request.Type != "url_verification" {
+		return "", false
+	}
+	return request.Challenge, true
+}
+
+func (cons *Webhook) handle(resp http.ResponseWriter, req *http.Request) {
+	endpoint := cons.defaults
+	if len(cons.endpoints) > 0 {
+		var exists bool
+		if endpoint, exists = cons.endpoints[req.URL.Path]; !exists {
+			resp.WriteHeader(http.StatusNotFound)
+			return // ### return, unknown endpoint ###
+		}
+	}
+
+	if req.Method != http.MethodPost {
+		resp.Header().Set("Allow", http.MethodPost)
+		resp.WriteHeader(http.StatusMethodNotAllowed)
+		return // ### return, no webhook ###
+	}
+
+	if cons.IsFuseBurned() {
+		resp.WriteHeader(http.StatusServiceUnavailable)
+		return // ### return, service is down ###
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(req.Body, cons.maxBodySize+1))
+	switch {
+	case err != nil:
+		resp.WriteHeader(http.StatusBadRequest)
+		return // ### return, read error ###
+	case int64(len(body)) > cons.maxBodySize:
+		resp.WriteHeader(http.StatusRequestEntityTooLarge)
+		return // ### return, body too large ###
+	}
+
+	if err := endpoint.verify(req.Header, body, cons.tolerance); err != nil {
+		Log.Debug.Printf("Webhook rejected request to %s: %s", req.URL.Path, err)
+		resp.WriteHeader(http.StatusUnauthorized)
+		return // ### return, not authorized ###
+	}
+
+	if endpoint.signature == webhookSignatureSlack {
+		if challenge, isChallenge := slackChallenge(body); isChallenge {
+			resp.Header().Set("Content-Type", "text/plain")
+			resp.Write([]byte(challenge))
+			return // ### return, url verification ###
+		}
+	}
+
+	data, err := endpoint.extract(req.Header.Get("Content-Type"), body)
+	if err != nil {
+		Log.Debug.Printf("Webhook failed to extract fields from request to %s: %s", req.URL.Path, err)
+		resp.WriteHeader(http.StatusBadRequest)
+		return // ### return, invalid body ###
+	}
+
+	msg := core.NewMessage(cons, data, atomic.AddUint64(&cons.sequence, 1))
+	msg.SetMetadata(core.MetadataSourceAddress, req.RemoteAddr)
+	msg.SetMetadata(webhookMetadataPath, req.URL.Path)
+	if endpoint.eventHeader != "" {
+		if event := req.Header.Get(endpoint.eventHeader); event != "" {
+			msg.SetMetadata(webhookMetadataEvent, event)
+		}
+	}
+
+	if endpoint.streams != nil {
+		cons.EnqueueMessageTo(msg, endpoint.streams)
+	} else {
+		cons.EnqueueMessage(msg)
+	}
+	resp.WriteHeader(http.StatusOK)
+}
+
+func (cons *Webhook) serve() {
+	defer cons.WorkerDone()
+
+	var listener net.Listener = cons.listen
+	if cons.tlsConfig != nil {
+		listener = tls.NewListener(listener, cons.tlsConfig)
+	}
+
+	srv := http.Server{
+		Handler:     http.HandlerFunc(cons.handle),
+		ReadTimeout: cons.readTimeoutSec,
+	}
+	err := srv.Serve(listener)
+	if _, isStopRequest := err.(shared.StopRequestError); err != nil && !isStopRequest && cons.IsActive() {
+		Log.Error.Print("Webhook: ", err)
+	}
+}
+
+func (cons *Webhook) close() {
+	cons.listen.Close()
+}
+
+// Consume opens a new http server listening for webhooks on the configured
+// address.
+func (cons *Webhook) Consume(workers *sync.WaitGroup) {
+	listen, err := shared.NewStopListener(cons.address)
+	if err != nil {
+		Log.Error.Print("Webhook: ", err)
+		return // ### return, could not bind ###
+	}
+
+	cons.listen = listen
+	cons.SetWorkerWaitGroup(workers)
+	cons.SetStopCallback(cons.close)
+
+	cons.AddWorker()
+	go shared.DontPanic(cons.serve)
+
+	cons.ControlLoop()
+}
@@ -0,0 +1,220 @@
+// Copyright 2015-2016 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumer
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/shared"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func webhookTestHMAC(secret, data string) []byte {
+	digest := hmac.New(sha256.New, []byte(secret))
+	digest.Write([]byte(data))
+	return digest.Sum(nil)
+}
+
+func sendTestWebhook(cons *Webhook, method, path, body string, header http.Header) (int, string) {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	recorder := httptest.NewRecorder()
+	cons.handle(recorder, req)
+	return recorder.Code, recorder.Body.String()
+}
+
+func TestWebhookSignatures(t *testing.T) {
+	expect := shared.NewExpect(t)
+
+	dir, err := ioutil.TempDir("", "gollum_webhook")
+	expect.NoError(err)
+	defer os.RemoveAll(dir)
+	secretFile := filepath.Join(dir, "secret")
+	expect.NoError(ioutil.WriteFile(secretFile, []byte("stripe-secret\n"), 0600))
+
+	githubStream := &mockHTTPStream{}
+	core.StreamRegistry.Register(githubStream, core.GetStreamID("webhookGitHub"))
+	otherStream := &mockHTTPStream{}
+	core.StreamRegistry.Register(otherStream, core.GetStreamID("webhookOther"))
+
+	conf := core.NewPluginConfig("")
+	conf.Override("Secret", "secret")
+	conf.Override("Endpoints", map[interface{}]interface{}{
+		"/github": map[interface{}]interface{}{"Stream": "webhookGitHub", "Signature": "github"},
+		"/stripe": map[interface{}]interface{}{"Stream": "webhookOther", "Signature": "stripe", "SecretFile": secretFile},
+		"/slack":  map[interface{}]interface{}{"Stream": "webhookOther", "Signature": "slack"},
+		"/hmac": map[interface{}]interface{}{
+			"Stream":            "webhookOther",
+			"Signature":         "hmac",
+			"SignatureHeader":   "X-Custom-Signature",
+			"SignaturePrefix":   "hmac ",
+			"SignatureEncoding": "base64",
+		},
+		"/gitlab": map[interface{}]interface{}{"Stream": "webhookOther", "Signature": "token", "SignatureHeader": "X-Gitlab-Token"},
+	})
+	plugin, err := core.NewPluginWithType("consumer.Webhook", conf)
+	expect.NoError(err)
+	cons, casted := plugin.(*Webhook)
+	expect.True(casted)
+
+	body := `{"action":"opened"}`
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	old := strconv.FormatInt(time.Now().Add(-time.Hour).Unix(), 10)
+	githubSignature := "sha256=" + hex.EncodeToString(webhookTestHMAC("secret", body))
+
+	requests := []struct {
+		path   string
+		header http.Header
+		status int
+	}{
+		{"/github", http.Header{"X-Hub-Signature-256": {githubSignature}, "X-Github-Event": {"pull_request"}}, http.StatusOK},
+		{"/github", http.Header{"X-Hub-Signature-256": {"sha256=00"}}, http.StatusUnauthorized},
+		{"/github", nil, http.StatusUnauthorized},
+		{"/other", http.Header{"X-Hub-Signature-256": {githubSignature}}, http.StatusNotFound},
+		{"/stripe", http.Header{"Stripe-Signature": {"t=" + now + ",v1=00,v1=" + hex.EncodeToString(webhookTestHMAC("stripe-secret", now+"."+body))}}, http.StatusOK},
+		{"/stripe", http.Header{"Stripe-Signature": {"t=" + now + ",v1=" + hex.EncodeToString(webhookTestHMAC("secret", now+"."+body))}}, http.StatusUnauthorized},
+		{"/stripe", http.Header{"Stripe-Signature": {"t=" + old + ",v1=" + hex.EncodeToString(webhookTestHMAC("stripe-secret", old+"."+body))}}, http.StatusUnauthorized},
+		{"/slack", http.Header{
+			"X-Slack-Request-Timestamp": {now},
+			"X-Slack-Signature":         {"v0=" + hex.EncodeToString(webhookTestHMAC("secret", "v0:"+now+":"+body))},
+		}, http.StatusOK},
+		{"/slack", http.Header{
+			"X-Slack-Request-Timestamp": {old},
+			"X-Slack-Signature":         {"v0=" + hex.EncodeToString(webhookTestHMAC("secret", "v0:"+old+":"+body))},
+		}, http.StatusUnauthorized},
+		{"/hmac", http.Header{"X-Custom-Signature": {"hmac " + base64.StdEncoding.EncodeToString(webhookTestHMAC("secret", body))}}, http.StatusOK},
+		{"/hmac", http.Header{"X-Custom-Signature": {base64.StdEncoding.EncodeToString(webhookTestHMAC("secret", body))}}, http.StatusUnauthorized},
+		{"/gitlab", http.Header{"X-Gitlab-Token": {"secret"}}, http.StatusOK},
+		{"/gitlab", http.Header{"X-Gitlab-Token": {"wrong"}}, http.StatusUnauthorized},
+	}
+	for i, request := range requests {
+		status, _ := sendTestWebhook(cons, http.MethodPost, request.path, body, request.header)
+		expect.Equal(fmt.Sprintf("%d %d", i, request.status), fmt.Sprintf("%d %d", i, status))
+	}
+
+	status, _ := sendTestWebhook(cons, http.MethodGet, "/github", "", nil)
+	expect.Equal(http.StatusMethodNotAllowed, status)
+
+	expect.Equal(1, githubStream.count())
+	expect.Equal(4, otherStream.count())
+	msg := githubStream.messages[0]
+	expect.Equal(body, string(msg.Data))
+	expect.Equal("/github", msg.Metadata[webhookMetadataPath])
+	expect.Equal("pull_request", msg.Metadata[webhookMetadataEvent])
+}
+
+func TestWebhookExtraction(t *testing.T) {
+	expect := shared.NewExpect(t)
+
+	stream := &mockHTTPStream{}
+	core.StreamRegistry.Register(stream, core.GetStreamID("webhookFields"))
+	conf := core.NewPluginConfig("")
+	conf.Stream = []string{"webhookFields"}
+	conf.Override("Fields", map[string]string{
+		"id":   "data.object.id",
+		"type": "type",
+		"none": "missing",
+	})
+	conf.Override("Endpoints", map[interface{}]interface{}{
+		"/fields":     nil,
+		"/expression": map[interface{}]interface{}{"Expression": "data.object", "Fields": map[interface{}]interface{}{}},
+		"/slack":      map[interface{}]interface{}{"Signature": "slack", "Secret": "secret", "Fields": map[interface{}]interface{}{"command": "command", "text": "text"}},
+	})
+	plugin, err := core.NewPluginWithType("consumer.Webhook", conf)
+	expect.NoError(err)
+	cons, casted := plugin.(*Webhook)
+	expect.True(casted)
+
+	status, _ := sendTestWebhook(cons, http.MethodPost, "/fields", `{"type":"charge.succeeded","data":{"object":{"id":"ch_1","amount":2000}}}`, nil)
+	expect.Equal(http.StatusOK, status)
+	status, _ = sendTestWebhook(cons, http.MethodPost, "/fields", `not json`, nil)
+	expect.Equal(http.StatusBadRequest, status)
+	status, _ = sendTestWebhook(cons, http.MethodPost, "/expression", `{"data":{"object":{"id":"ch_2","amount":12.50}}}`, nil)
+	expect.Equal(http.StatusOK, status)
+
+	slackHeader := func(body string) http.Header {
+		now := strconv.FormatInt(time.Now().Unix(), 10)
+		return http.Header{
+			"Content-Type":              {"application/x-www-form-urlencoded"},
+			"X-Slack-Request-Timestamp": {now},
+			"X-Slack-Signature":         {"v0=" + hex.EncodeToString(webhookTestHMAC("secret", "v0:"+now+":"+body))},
+		}
+	}
+	command := "command=%2Fdeploy&text=production&token=ignored"
+	status, _ = sendTestWebhook(cons, http.MethodPost, "/slack", command, slackHeader(command))
+	expect.Equal(http.StatusOK, status)
+
+	challenge := `{"type":"url_verification","challenge":"abc123"}`
+	status, response := sendTestWebhook(cons, http.MethodPost, "/slack", challenge, slackHeader(challenge))
+	expect.Equal(http.StatusOK, status)
+	expect.Equal("abc123", response)
+
+	expect.Equal(3, stream.count())
+	expect.Equal(`{"id":"ch_1","type":"charge.succeeded"}`, string(stream.messages[0].Data))
+	expect.Equal(`{"amount":12.50,"id":"ch_2"}`, string(stream.messages[1].Data))
+	expect.Equal(`{"command":"/deploy","text":"production"}`, string(stream.messages[2].Data))
+}
+
+func TestWebhookConfigure(t *testing.T) {
+	expect := shared.NewExpect(t)
+
+	stream := &mockHTTPStream{}
+	core.StreamRegistry.Register(stream, core.GetStreamID("webhookDefault"))
+	conf := core.NewPluginConfig("")
+	conf.Stream = []string{"webhookDefault"}
+	plugin, err := core.NewPluginWithType("consumer.Webhook", conf)
+	expect.NoError(err)
+	cons, casted := plugin.(*Webhook)
+	expect.True(casted)
+
+	status, _ := sendTestWebhook(cons, http.MethodPost, "/any/path", "data", nil)
+	expect.Equal(http.StatusOK, status)
+	expect.Equal(1, stream.count())
+
+	cons.maxBodySize = 2
+	status, _ = sendTestWebhook(cons, http.MethodPost, "/any/path", "data", nil)
+	expect.Equal(http.StatusRequestEntityTooLarge, status)
+
+	for _, options := range []map[string]interface{}{
+		{"Signature": "github"},
+		{"Signature": "unknown"},
+		{"Signature": "hmac", "Secret": "secret", "SignatureEncoding": "base32"},
+		{"Fields": map[string]string{"a": "[invalid"}},
+		{"Endpoints": map[interface{}]interface{}{"/a": map[interface{}]interface{}{"Unknown": "value"}}},
+		{"Endpoints": map[interface{}]interface{}{"/a": map[interface{}]interface{}{"Secret": "a", "SecretFile": "b"}}},
+		{"Endpoints": []string{"/a"}},
+	} {
+		conf := core.NewPluginConfig("")
+		for key, value := range options {
+			conf.Override(key, value)
+		}
+		_, err := core.NewPluginWithType("consumer.Webhook", conf)
+		expect.NotNil(err)
+	}
+}
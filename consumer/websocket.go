@@ -0,0 +1,367 @@
+// Copyright 2015-2016 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumer
+
+import (
+	"crypto/tls"
+	"github.com/gorilla/websocket"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/core/log"
+	"github.com/trivago/gollum/shared"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	websocketMetadataMessageType = "websocket_message_type"
+	websocketMetadataPath        = "websocket_path"
+)
+
+// Websocket consumer plugin
+// The Websocket consumer accepts WebSocket connections and turns each text
+// or binary message received into a message. This allows browsers and other
+// HTTP clients to stream events directly to gollum.
+// The address of the client is attached to each message as
+// "source_address" metadata. The type of the received message ("text" or
+// "binary") and the request path are stored as "websocket_message_type" and
+// "websocket_path".
+// Upgrade requests are answered with status 401 if the token is missing or
+// invalid, 403 if the origin is not allowed, 404 if the path is not a
+// configured endpoint and 503 if the fuse is burned.
+// When attached to a fuse, this consumer will stop reading from open
+// connections in case that fuse is burned.
+// Configuration example
+//
+//  - "consumer.Websocket":
+//    Address: ":8080"
+//    Endpoints: {}
+//    Tokens: []
+//    TokenParameter: "token"
+//    AllowedOrigins: []
+//    MaxMessageSizeByte: 1048576
+//    PingIntervalSec: 30
+//    Certificate: ""
+//    PrivateKey: ""
+//    ClientCA: ""
+//
+// Address defines the host and port to bind to, e.g. "localhost:8080".
+// By default this is set to ":8080".
+//
+// Endpoints maps URL paths to streams, e.g. "/logs": "logs". Messages
+// received by connections to a mapped path are sent to the mapped stream
+// instead of the streams set by Stream. If set, requests to other paths are
+// rejected. Empty by default.
+//
+// Tokens defines a list of tokens that are accepted for authentication. As
+// browsers cannot set headers on WebSocket requests, the token can either be
+// passed as "Authorization: Bearer <token>" header or as query parameter
+// given by TokenParameter. By default this is set to an empty list, which
+// disables authentication.
+//
+// TokenParameter defines the name of the query parameter holding the token.
+// By default this is set to "token".
+//
+// AllowedOrigins defines the values of the Origin header that are accepted,
+// e.g. "https://example.com". "*" accepts all origins. Requests without
+// Origin header, i.e. from clients other than browsers, are always accepted.
+// By default this is set to an empty list, which only accepts requests with
+// an origin matching the requested host.
+//
+// MaxMessageSizeByte defines the maximum size of a message. Connections
+// exceeding this limit are closed. By default this is set to 1048576 (1 MB).
+//
+// PingIntervalSec defines the interval in seconds in which pings are sent to
+// clients. Connections are closed if nothing has been received for two
+// intervals. Set to 0 to disable pings. By default this is set to 30.
+//
+// Certificate defines a path to a PEM encoded certificate file to make this
+// consumer accept TLS connections only. Left empty by default (disabled).
+// If a Certificate is given, a PrivateKey must be given, too.
+//
+// PrivateKey defines a path to the PEM encoded private key used for TLS
+// connections. Left empty by default (disabled).
+//
+// ClientCA defines a path to a PEM encoded file containing the certificate
+// authorities used to verify client certificates. If set, clients have to
+// present a valid certificate signed by one of these authorities.
+// Requires Certificate and PrivateKey to be set. Left empty by default.
+type Websocket struct {
+	core.ConsumerBase
+	listen         *shared.StopListener
+	address        string
+	endpoints      map[string][]core.MappedStream
+	tokens         []string
+	tokenParameter string
+	allowedOrigins []string
+	maxMessageSize int64
+	pingInterval   time.Duration
+	tlsConfig      *tls.Config
+	upgrader       websocket.Upgrader
+	conns          map[*websocket.Conn]struct{}
+	connGuard      *sync.Mutex
+	connWorkers    *sync.WaitGroup
+	sequence       uint64
+}
+
+func init() {
+	shared.TypeRegistry.Register(Websocket{})
+}
+
+// Configure initializes this consumer with values from a plugin config.
+func (cons *Websocket) Configure(conf core.PluginConfig) error {
+	err := cons.ConsumerBase.Configure(conf)
+	if err != nil {
+		return err
+	}
+
+	cons.address = conf.GetString("Address", ":8080")
+	cons.endpoints = make(map[string][]core.MappedStream)
+	for path, streamName := range conf.GetStringMap("Endpoints", map[string]string{}) {
+		cons.endpoints[path] = core.NewMappedStreams([]string{streamName})
+	}
+
+	cons.tokens = conf.GetStringArray("Tokens", []string{})
+	cons.tokenParameter = conf.GetString("TokenParameter", "token")
+	cons.allowedOrigins = conf.GetStringArray("AllowedOrigins", []string{})
+	cons.maxMessageSize = int64(conf.GetInt("MaxMessageSizeByte", 1<<20))
+	cons.pingInterval = time.Duration(conf.GetInt("PingIntervalSec", 30)) * time.Second
+
+	cons.tlsConfig, err = shared.NewServerTLSConfig(
+		conf.GetString("Certificate", ""),
+		conf.GetString("PrivateKey", ""),
+		conf.GetString("ClientCA", ""))
+	if err != nil {
+		return err
+	}
+
+	cons.upgrader = websocket.Upgrader{CheckOrigin: cons.checkOrigin}
+	cons.conns = make(map[*websocket.Conn]struct{})
+	cons.connGuard = new(sync.Mutex)
+	cons.connWorkers = new(sync.WaitGroup)
+	return nil
+}
+
+// checkOrigin returns true if the Origin header of a request is allowed.
+func (cons *Websocket) checkOrigin(req *http.Request) bool {
+	return isAllowedOrigin(req, cons.allowedOrigins)
+}
+
+// isAllowedOrigin returns true if the Origin header of a request is listed
+// in allowedOrigins. If the list is empty, only the requested host is allowed.
+func isAllowedOrigin(req *http.Request, allowedOrigins []string) bool {
+	origin := req.Header.Get("Origin")
+	if origin == "" {
+		return true // ### return, no browser ###
+	}
+
+	if len(allowedOrigins) == 0 {
+		originURL, err := url.Parse(origin)
+		return err == nil && strings.EqualFold(originURL.Host, req.Host)
+	}
+	for _, allowed := range allowedOrigins {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// isAuthorized returns true if a request contains one of the configured
+// tokens or if authentication is disabled.
+func (cons *Websocket) isAuthorized(req *http.Request) bool {
+	if len(cons.tokens) == 0 {
+		return true // ### return, no authentication ###
+	}
+
+	token := req.URL.Query().Get(cons.tokenParameter)
+	if authorization := req.Header.Get("Authorization"); strings.HasPrefix(authorization, "Bearer ") {
+		token = strings.TrimPrefix(authorization, "Bearer ")
+	}
+	return token != "" && containsAPIKey(cons.tokens, token)
+}
+
+func (cons *Websocket) sendMessage(data []byte, messageType int, req *http.Request, streams []core.MappedStream) {
+	msg := core.NewMessage(cons, data, atomic.AddUint64(&cons.sequence, 1))
+	msg.SetMetadata(core.MetadataSourceAddress, req.RemoteAddr)
+	msg.SetMetadata(websocketMetadataPath, req.URL.Path)
+	if messageType == websocket.BinaryMessage {
+		msg.SetMetadata(websocketMetadataMessageType, "binary")
+	} else {
+		msg.SetMetadata(websocketMetadataMessageType, "text")
+	}
+
+	if streams != nil {
+		cons.EnqueueMessageTo(msg, streams)
+	} else {
+		cons.EnqueueMessage(msg)
+	}
+}
+
+// sendPings pings the client until done is closed.
+func (cons *Websocket) sendPings(conn *websocket.Conn, done chan struct{}) {
+	ticker := time.NewTicker(cons.pingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return // ### return, connection closed ###
+		case <-ticker.C:
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(cons.pingInterval)); err != nil {
+				return // ### return, connection broken ###
+			}
+		}
+	}
+}
+
+func (cons *Websocket) read(conn *websocket.Conn, req *http.Request, streams []core.MappedStream) {
+	conn.SetReadLimit(cons.maxMessageSize)
+	extendDeadline := func() {
+		if cons.pingInterval > 0 {
+			conn.SetReadDeadline(time.Now().Add(2 * cons.pingInterval))
+		}
+	}
+
+	if cons.pingInterval > 0 {
+		extendDeadline()
+		conn.SetPongHandler(func(string) error {
+			extendDeadline()
+			return nil
+		})
+		done := make(chan struct{})
+		defer close(done)
+		go cons.sendPings(conn, done)
+	}
+
+	for cons.IsActive() {
+		messageType, data, err := conn.ReadMessage()
+		if err != nil {
+			if cons.IsActive() && websocket.IsUnexpectedCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				Log.Warning.Print("Websocket connection from ", req.RemoteAddr, " failed: ", err)
+			}
+			return // ### return, connection closed ###
+		}
+		extendDeadline()
+
+		cons.WaitOnFuse()
+		cons.sendMessage(data, messageType, req, streams)
+	}
+}
+
+// handle upgrades a request to the WebSocket protocol and reads from the
+// connection until it is closed.
+func (cons *Websocket) handle(resp http.ResponseWriter, req *http.Request) {
+	var streams []core.MappedStream
+	if len(cons.endpoints) > 0 {
+		var exists bool
+		if streams, exists = cons.endpoints[req.URL.Path]; !exists {
+			resp.WriteHeader(http.StatusNotFound)
+			return // ### return, unknown endpoint ###
+		}
+	}
+
+	if !cons.isAuthorized(req) {
+		resp.WriteHeader(http.StatusUnauthorized)
+		return // ### return, not authorized ###
+	}
+
+	if cons.IsFuseBurned() {
+		resp.WriteHeader(http.StatusServiceUnavailable)
+		return // ### return, service is down ###
+	}
+
+	conn, err := cons.upgrader.Upgrade(resp, req, nil)
+	if err != nil {
+		Log.Debug.Print("Websocket handshake with ", req.RemoteAddr, " failed: ", err)
+		return // ### return, handshake failed, response has been sent ###
+	}
+
+	cons.connGuard.Lock()
+	if !cons.IsActive() {
+		cons.connGuard.Unlock()
+		conn.Close()
+		return // ### return, stopping ###
+	}
+	cons.conns[conn] = struct{}{}
+	cons.connWorkers.Add(1)
+	cons.connGuard.Unlock()
+
+	defer func() {
+		cons.connGuard.Lock()
+		delete(cons.conns, conn)
+		cons.connGuard.Unlock()
+		conn.Close()
+		cons.connWorkers.Done()
+	}()
+
+	cons.read(conn, req, streams)
+}
+
+func (cons *Websocket) closeAll() {
+	cons.connGuard.Lock()
+	defer cons.connGuard.Unlock()
+
+	closeMessage := websocket.FormatCloseMessage(websocket.CloseGoingAway, "")
+	for conn := range cons.conns {
+		conn.WriteControl(websocket.CloseMessage, closeMessage, time.Now().Add(time.Second))
+		conn.Close()
+	}
+}
+
+func (cons *Websocket) close() {
+	cons.listen.Close()
+	cons.closeAll()
+}
+
+func (cons *Websocket) serve() {
+	defer cons.WorkerDone()
+
+	var listener net.Listener = cons.listen
+	if cons.tlsConfig != nil {
+		listener = tls.NewListener(listener, cons.tlsConfig)
+	}
+
+	srv := http.Server{
+		Handler: http.HandlerFunc(cons.handle),
+	}
+	err := srv.Serve(listener)
+	if _, isStopRequest := err.(shared.StopRequestError); err != nil && !isStopRequest && cons.IsActive() {
+		Log.Error.Print("Websocket: ", err)
+	}
+	cons.connWorkers.Wait()
+}
+
+// Consume opens a new http server listening for WebSocket connections on
+// the configured address.
+func (cons *Websocket) Consume(workers *sync.WaitGroup) {
+	listen, err := shared.NewStopListener(cons.address)
+	if err != nil {
+		Log.Error.Print("Websocket: ", err)
+		return // ### return, could not bind ###
+	}
+
+	cons.listen = listen
+	cons.SetWorkerWaitGroup(workers)
+	cons.SetStopCallback(cons.close)
+
+	cons.AddWorker()
+	go shared.DontPanic(cons.serve)
+
+	cons.ControlLoop()
+}
@@ -0,0 +1,108 @@
+// Copyright 2015-2016 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumer
+
+import (
+	"github.com/gorilla/websocket"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/shared"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func dialTestWebsocket(expect shared.Expect, url string, header http.Header) (*websocket.Conn, int) {
+	conn, resp, err := websocket.DefaultDialer.Dial(url, header)
+	if err != nil {
+		expect.NotNil(resp)
+		return nil, resp.StatusCode
+	}
+	return conn, resp.StatusCode
+}
+
+func TestWebsocket(t *testing.T) {
+	expect := shared.NewExpect(t)
+
+	stream := &mockHTTPStream{}
+	core.StreamRegistry.Register(stream, core.GetStreamID("websocketLogs"))
+
+	conf := core.NewPluginConfig("")
+	conf.Override("Endpoints", map[string]string{"/logs": "websocketLogs"})
+	conf.Override("Tokens", []string{"secret"})
+	conf.Override("AllowedOrigins", []string{"https://example.com"})
+
+	plugin, err := core.NewPluginWithType("consumer.Websocket", conf)
+	expect.NoError(err)
+	cons, casted := plugin.(*Websocket)
+	expect.True(casted)
+
+	server := httptest.NewServer(http.HandlerFunc(cons.handle))
+	defer server.Close()
+	url := "ws" + strings.TrimPrefix(server.URL, "http")
+
+	_, status := dialTestWebsocket(expect, url+"/logs", nil)
+	expect.Equal(http.StatusUnauthorized, status)
+	_, status = dialTestWebsocket(expect, url+"/other?token=secret", nil)
+	expect.Equal(http.StatusNotFound, status)
+	_, status = dialTestWebsocket(expect, url+"/logs", http.Header{
+		"Authorization": {"Bearer secret"},
+		"Origin":        {"https://evil.com"},
+	})
+	expect.Equal(http.StatusForbidden, status)
+
+	conn, status := dialTestWebsocket(expect, url+"/logs?token=secret", http.Header{"Origin": {"https://example.com"}})
+	expect.Equal(http.StatusSwitchingProtocols, status)
+	defer conn.Close()
+
+	expect.NoError(conn.WriteMessage(websocket.TextMessage, []byte("hello")))
+	expect.NoError(conn.WriteMessage(websocket.BinaryMessage, []byte{0, 1}))
+	expect.NonBlocking(2*time.Second, func() {
+		for stream.count() < 2 {
+			time.Sleep(10 * time.Millisecond)
+		}
+	})
+
+	// Stopping closes all connections
+	cons.closeAll()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, _, err = conn.ReadMessage()
+	expect.True(websocket.IsCloseError(err, websocket.CloseGoingAway))
+
+	stream.guard.Lock()
+	defer stream.guard.Unlock()
+	expect.Equal("hello", string(stream.messages[0].Data))
+	expect.Equal("text", stream.messages[0].Metadata[websocketMetadataMessageType])
+	expect.Equal("/logs", stream.messages[0].Metadata[websocketMetadataPath])
+	expect.Equal([]byte{0, 1}, stream.messages[1].Data)
+	expect.Equal("binary", stream.messages[1].Metadata[websocketMetadataMessageType])
+}
+
+func TestWebsocketCheckOrigin(t *testing.T) {
+	expect := shared.NewExpect(t)
+
+	cons := Websocket{}
+	req, _ := http.NewRequest("GET", "http://gollum.local/", nil)
+	expect.True(cons.checkOrigin(req))
+
+	req.Header.Set("Origin", "http://gollum.local")
+	expect.True(cons.checkOrigin(req))
+	req.Header.Set("Origin", "http://example.com")
+	expect.False(cons.checkOrigin(req))
+
+	cons.allowedOrigins = []string{"*"}
+	expect.True(cons.checkOrigin(req))
+}
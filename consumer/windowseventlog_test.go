@@ -0,0 +1,82 @@
+// Copyright 2015-2016 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumer
+
+import (
+	"github.com/trivago/gollum/shared"
+	"testing"
+)
+
+func TestWindowsEventParse(t *testing.T) {
+	expect := shared.NewExpect(t)
+
+	record, err := parseWindowsEvent(`<Event xmlns="http://schemas.microsoft.com/win/2004/08/events/event">
+		<System>
+			<Provider Name="Microsoft-Windows-Security-Auditing" Guid="{54849625-5478-4994-A5BA-3E3B0328C30D}"/>
+			<EventID>4624</EventID>
+			<Version>2</Version>
+			<Level>0</Level>
+			<Task>12544</Task>
+			<Opcode>0</Opcode>
+			<Keywords>0x8020000000000000</Keywords>
+			<TimeCreated SystemTime="2016-08-01T10:00:00.000000000Z"/>
+			<EventRecordID>1234</EventRecordID>
+			<Correlation ActivityID="{D5B2D4E1-1A2B-0001-0000-000000000000}"/>
+			<Execution ProcessID="612" ThreadID="2716"/>
+			<Channel>Security</Channel>
+			<Computer>host.example.com</Computer>
+			<Security/>
+		</System>
+		<EventData>
+			<Data Name="SubjectUserSid">S-1-5-18</Data>
+			<Data Name="LogonType">5</Data>
+			<Data>unnamed</Data>
+		</EventData>
+		<RenderingInfo Culture="en-US">
+			<Message>An account was successfully logged on.</Message>
+			<Level>Information</Level>
+			<Task>Logon</Task>
+			<Keywords><Keyword>Audit Success</Keyword></Keywords>
+		</RenderingInfo>
+	</Event>`)
+	expect.NoError(err)
+
+	expect.Equal("Security", record["channel"])
+	expect.Equal("host.example.com", record["computer"])
+	expect.Equal("Microsoft-Windows-Security-Auditing", record["provider_name"])
+	expect.Equal("{54849625-5478-4994-A5BA-3E3B0328C30D}", record["provider_guid"])
+	expect.Equal(uint64(4624), record["event_id"])
+	expect.Equal(uint64(1234), record["record_id"])
+	expect.Equal(uint64(612), record["process_id"])
+	expect.Equal("2016-08-01T10:00:00.000000000Z", record["time_created"])
+	expect.Equal("0x8020000000000000", record["keywords"])
+	expect.Equal("An account was successfully logged on.", record["message"])
+	expect.Equal("Information", record["level_text"])
+	expect.Equal([]string{"Audit Success"}, record["keywords_text"])
+	expect.Equal(map[string]string{"SubjectUserSid": "S-1-5-18", "LogonType": "5", "param3": "unnamed"}, record["event_data"])
+	_, hasUserID := record["user_id"]
+	expect.False(hasUserID)
+
+	record, err = parseWindowsEvent(`<Event><System><EventID>1102</EventID><Channel>Security</Channel></System>
+		<UserData><LogFileCleared><SubjectUserName>admin</SubjectUserName></LogFileCleared></UserData></Event>`)
+	expect.NoError(err)
+	expect.Equal("LogFileCleared", record["user_data_type"])
+	expect.Equal(map[string]string{"SubjectUserName": "admin"}, record["user_data"])
+
+	_, err = parseWindowsEvent("<Bookmark/>")
+	expect.NotNil(err)
+	_, err = parseWindowsEvent("<Event>")
+	expect.NotNil(err)
+}
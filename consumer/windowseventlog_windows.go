@@ -0,0 +1,331 @@
+// Copyright 2015-2016 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build windows
+// +build windows
+
+package consumer
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/core/log"
+	"github.com/trivago/gollum/shared"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+const (
+	windowsEventLogOffsetNewest = "newest"
+	windowsEventLogOffsetOldest = "oldest"
+
+	windowsEventLogMetadataChannel  = "eventlog_channel"
+	windowsEventLogMetadataProvider = "eventlog_provider"
+)
+
+// WindowsEventLog consumer plugin
+// The WindowsEventLog consumer reads events from the Windows event log using
+// the EvtSubscribe API. This consumer is only available on Windows.
+// Each event is converted to one message. By default events are rendered to
+// a JSON object containing the fields of the System section, e.g. "channel",
+// "provider_name", "event_id", "level", "record_id" or "time_created", the
+// values of EventData as "event_data" and the values of UserData as
+// "user_data". If RenderMessage is enabled the localized message is added as
+// "message", together with "level_text", "task_text", "opcode_text" and
+// "keywords_text".
+// The position of the last event read from each channel is stored as a
+// bookmark. If a bookmark file is set, no events are lost or read twice when
+// gollum is restarted.
+// The name of the channel and the provider are attached to each message as
+// "eventlog_channel" and "eventlog_provider" metadata.
+// When attached to a fuse, this consumer will stop reading events in case
+// that fuse is burned. Reading continues once the fuse is active again.
+// Configuration example
+//
+//  - "consumer.WindowsEventLog":
+//    Channels:
+//      - "Application"
+//      - "System"
+//    Query: "*"
+//    DefaultOffset: "Newest"
+//    BookmarkFile: ""
+//    Format: "json"
+//    RenderMessage: true
+//    BatchSize: 100
+//    RetryDelayMs: 3000
+//
+// Channels defines the list of event log channels to subscribe to, e.g.
+// "Security" or "Microsoft-Windows-Sysmon/Operational".
+// By default this is set to ["Application"].
+//
+// Query defines an XPath filter that is applied to all channels, e.g.
+// "*[System[(Level=1 or Level=2) and EventID!=1000]]".
+// By default this is set to "*", i.e. all events are read.
+//
+// DefaultOffset defines the event to start reading from if no bookmark has
+// been stored for a channel. Valid values are "Newest" and "Oldest".
+// By default this is set to "Newest".
+//
+// BookmarkFile defines a file to store the bookmark of each channel.
+// By default this is set to "", i.e. bookmarks are only kept in memory.
+// If a file is set and found reading will start after the stored bookmarks.
+//
+// Format defines how events are converted to messages. Valid values are
+// "json" and "xml". XML passes the event as rendered by Windows.
+// By default this is set to "json".
+//
+// RenderMessage can be set to false to not add the localized message and
+// descriptions to events. Rendering messages requires the message files of
+// the event provider to be installed. By default this is set to true.
+//
+// BatchSize defines the maximum number of events read at once.
+// By default this is set to 100.
+//
+// RetryDelayMs defines the time in milliseconds to wait before subscribing
+// to a channel again after an error. By default this is set to 3000.
+type WindowsEventLog struct {
+	core.ConsumerBase
+	channels       []string
+	query          string
+	store          *fileCheckpointStore
+	publishers     map[string]evtHandle
+	publisherGuard *sync.Mutex
+	subscribeFlags uint32
+	batchSize      int
+	retryDelay     time.Duration
+	sequence       uint64
+	renderMessage  bool
+	xmlFormat      bool
+}
+
+// windowsEventLogReader holds the render buffers of a subscription.
+type windowsEventLogReader struct {
+	channel      string
+	renderBuffer []byte
+	formatBuffer []uint16
+}
+
+func init() {
+	shared.TypeRegistry.Register(WindowsEventLog{})
+}
+
+// Configure initializes this consumer with values from a plugin config.
+func (cons *WindowsEventLog) Configure(conf core.PluginConfig) error {
+	err := cons.ConsumerBase.Configure(conf)
+	if err != nil {
+		return err
+	}
+
+	cons.channels = conf.GetStringArray("Channels", []string{"Application"})
+	if len(cons.channels) == 0 {
+		return fmt.Errorf("WindowsEventLog requires at least one channel")
+	}
+	cons.query = conf.GetString("Query", "*")
+
+	switch offset := strings.ToLower(conf.GetString("DefaultOffset", windowsEventLogOffsetNewest)); offset {
+	case windowsEventLogOffsetNewest:
+		cons.subscribeFlags = evtSubscribeToFutureEvents
+	case windowsEventLogOffsetOldest:
+		cons.subscribeFlags = evtSubscribeStartAtOldestRecord
+	default:
+		return fmt.Errorf("Unknown DefaultOffset: %s", offset)
+	}
+
+	switch format := strings.ToLower(conf.GetString("Format", "json")); format {
+	case "json":
+	case "xml":
+		cons.xmlFormat = true
+	default:
+		return fmt.Errorf("Unknown format: %s", format)
+	}
+
+	if cons.store, err = newFileCheckpointStore(conf.GetString("BookmarkFile", "")); err != nil {
+		return err
+	}
+
+	cons.renderMessage = conf.GetBool("RenderMessage", true)
+	cons.batchSize = shared.MaxI(conf.GetInt("BatchSize", 100), 1)
+	cons.retryDelay = time.Duration(conf.GetInt("RetryDelayMs", 3000)) * time.Millisecond
+	cons.publishers = make(map[string]evtHandle)
+	cons.publisherGuard = new(sync.Mutex)
+	return nil
+}
+
+// publisher returns the metadata handle of an event provider. Handles are
+// kept open for the lifetime of the consumer. A handle of 0 is returned if
+// the provider metadata cannot be opened.
+func (cons *WindowsEventLog) publisher(provider string) evtHandle {
+	cons.publisherGuard.Lock()
+	defer cons.publisherGuard.Unlock()
+
+	handle, known := cons.publishers[provider]
+	if !known {
+		var err error
+		if handle, err = evtOpenPublisherMetadata(provider); err != nil {
+			Log.Debug.Printf("WindowsEventLog cannot render messages of %s: %s", provider, err)
+		}
+		cons.publishers[provider] = handle
+	}
+	return handle
+}
+
+func (cons *WindowsEventLog) processEvent(reader *windowsEventLogReader, event evtHandle) error {
+	xmlData, buffer, err := evtRender(event, evtRenderEventXML, reader.renderBuffer)
+	reader.renderBuffer = buffer
+	if err != nil {
+		return err
+	}
+
+	record, err := parseWindowsEvent(xmlData)
+	if err != nil {
+		return err
+	}
+	provider, _ := record["provider_name"].(string)
+
+	if cons.renderMessage && provider != "" {
+		if publisher := cons.publisher(provider); publisher != 0 {
+			formatted, buffer, err := evtFormatXML(publisher, event, reader.formatBuffer)
+			reader.formatBuffer = buffer
+			if err == nil {
+				xmlData = formatted
+				if formattedRecord, err := parseWindowsEvent(formatted); err == nil {
+					record = formattedRecord
+				}
+			}
+		}
+	}
+
+	payload := []byte(xmlData)
+	if !cons.xmlFormat {
+		if payload, err = json.Marshal(record); err != nil {
+			return err
+		}
+	}
+
+	msg := core.NewMessage(cons, payload, atomic.AddUint64(&cons.sequence, 1))
+	msg.SetMetadata(windowsEventLogMetadataChannel, reader.channel)
+	msg.SetMetadata(windowsEventLogMetadataProvider, provider)
+	cons.EnqueueMessage(msg)
+	return nil
+}
+
+// subscribe reads events from a channel until the consumer is stopped or an
+// error occurs.
+func (cons *WindowsEventLog) subscribe(reader *windowsEventLogReader, signal syscall.Handle) error {
+	bookmarks, err := cons.store.checkpoints()
+	if err != nil {
+		return err
+	}
+
+	bookmark, err := evtCreateBookmark(bookmarks[reader.channel])
+	if err != nil {
+		return err
+	}
+	defer evtClose(bookmark)
+
+	flags := cons.subscribeFlags
+	if bookmarks[reader.channel] != "" {
+		flags = evtSubscribeStartAfterBookmark
+	}
+
+	subscription, err := evtSubscribe(signal, reader.channel, cons.query, bookmark, flags)
+	if err != nil {
+		return err
+	}
+	defer evtClose(subscription)
+
+	events := make([]evtHandle, cons.batchSize)
+	for cons.IsActive() {
+		if cons.IsFuseBurned() {
+			time.Sleep(windowsEventWaitTimeMs * time.Millisecond)
+			continue // ### continue, fuse burned ###
+		}
+
+		count, err := evtNext(subscription, events)
+		switch err {
+		case nil:
+		case errorNoMoreItems:
+			syscall.WaitForSingleObject(signal, windowsEventWaitTimeMs)
+			continue // ### continue, wait for new events ###
+		default:
+			return err // ### return, subscription failed ###
+		}
+
+		for _, event := range events[:count] {
+			if err := cons.processEvent(reader, event); err != nil {
+				Log.Error.Print("WindowsEventLog failed to render event from ", reader.channel, ": ", err)
+			}
+			if err := evtUpdateBookmark(bookmark, event); err != nil {
+				Log.Warning.Print("WindowsEventLog failed to update bookmark: ", err)
+			}
+			evtClose(event)
+		}
+
+		xmlData, buffer, err := evtRender(bookmark, evtRenderBookmark, reader.renderBuffer)
+		reader.renderBuffer = buffer
+		if err == nil {
+			err = cons.store.store(reader.channel, xmlData)
+		}
+		if err != nil {
+			Log.Warning.Print("WindowsEventLog failed to store bookmark of ", reader.channel, ": ", err)
+		}
+	}
+	return nil
+}
+
+func (cons *WindowsEventLog) readChannel(channel string) {
+	defer cons.WorkerDone()
+
+	signal, err := createEvent()
+	if err != nil {
+		Log.Error.Print("WindowsEventLog failed to create event: ", err)
+		return // ### return, cannot wait for events ###
+	}
+	defer syscall.CloseHandle(signal)
+
+	reader := &windowsEventLogReader{
+		channel:      channel,
+		renderBuffer: make([]byte, 4096),
+		formatBuffer: make([]uint16, 4096),
+	}
+
+	for cons.IsActive() {
+		err := cons.subscribe(reader, signal)
+		if err != nil && cons.IsActive() {
+			if err == errorEvtQueryStale {
+				Log.Warning.Print("WindowsEventLog bookmark of ", channel, " is stale, events may have been lost")
+			} else {
+				Log.Error.Print("WindowsEventLog failed to read from ", channel, ": ", err)
+			}
+			time.Sleep(cons.retryDelay)
+		}
+	}
+}
+
+// Consume subscribes to all configured channels.
+func (cons *WindowsEventLog) Consume(workers *sync.WaitGroup) {
+	cons.SetWorkerWaitGroup(workers)
+
+	for _, channel := range cons.channels {
+		channel := channel
+		cons.AddWorker()
+		go shared.DontPanic(func() { cons.readChannel(channel) })
+	}
+
+	cons.ControlLoop()
+}
@@ -0,0 +1,180 @@
+// Copyright 2015-2016 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build windows
+// +build windows
+
+package consumer
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+const (
+	evtSubscribeToFutureEvents      = 1
+	evtSubscribeStartAtOldestRecord = 2
+	evtSubscribeStartAfterBookmark  = 3
+
+	evtRenderEventXML = 1
+	evtRenderBookmark = 2
+
+	evtFormatMessageXML = 9
+
+	errorNoMoreItems       = syscall.Errno(259)
+	errorInsufficientBuf   = syscall.Errno(122)
+	errorEvtQueryStale     = syscall.Errno(15011)
+	waitObject0            = 0
+	waitTimeout            = 0x102
+	windowsEventWaitTimeMs = 1000
+)
+
+var (
+	wevtapi                      = syscall.NewLazyDLL("wevtapi.dll")
+	procEvtSubscribe             = wevtapi.NewProc("EvtSubscribe")
+	procEvtNext                  = wevtapi.NewProc("EvtNext")
+	procEvtRender                = wevtapi.NewProc("EvtRender")
+	procEvtCreateBookmark        = wevtapi.NewProc("EvtCreateBookmark")
+	procEvtUpdateBookmark        = wevtapi.NewProc("EvtUpdateBookmark")
+	procEvtOpenPublisherMetadata = wevtapi.NewProc("EvtOpenPublisherMetadata")
+	procEvtFormatMessage         = wevtapi.NewProc("EvtFormatMessage")
+	procEvtClose                 = wevtapi.NewProc("EvtClose")
+
+	kernel32        = syscall.NewLazyDLL("kernel32.dll")
+	procCreateEvent = kernel32.NewProc("CreateEventW")
+)
+
+// evtHandle is a handle returned by the Windows Event Log API.
+type evtHandle uintptr
+
+// evtResult converts the result of a LazyProc call. Pointer arguments have
+// to be converted in the call expression itself, so this is applied to the
+// result of the call.
+func evtResult(result, _ uintptr, err error) (uintptr, error) {
+	if result == 0 {
+		if errno, isErrno := err.(syscall.Errno); !isErrno || errno != 0 {
+			return 0, err
+		}
+		return 0, syscall.EINVAL
+	}
+	return result, nil
+}
+
+func createEvent() (syscall.Handle, error) {
+	handle, err := evtResult(procCreateEvent.Call(0, 0, 0, 0))
+	return syscall.Handle(handle), err
+}
+
+func evtSubscribe(signal syscall.Handle, channel, query string, bookmark evtHandle, flags uint32) (evtHandle, error) {
+	channelPtr, err := syscall.UTF16PtrFromString(channel)
+	if err != nil {
+		return 0, err
+	}
+	queryPtr, err := syscall.UTF16PtrFromString(query)
+	if err != nil {
+		return 0, err
+	}
+	handle, err := evtResult(procEvtSubscribe.Call(0, uintptr(signal),
+		uintptr(unsafe.Pointer(channelPtr)), uintptr(unsafe.Pointer(queryPtr)),
+		uintptr(bookmark), 0, 0, uintptr(flags)))
+	return evtHandle(handle), err
+}
+
+// evtNext returns up to len(events) events of a subscription. The error
+// errorNoMoreItems is returned if no events are available.
+func evtNext(subscription evtHandle, events []evtHandle) (int, error) {
+	returned := uint32(0)
+	_, err := evtResult(procEvtNext.Call(uintptr(subscription), uintptr(len(events)),
+		uintptr(unsafe.Pointer(&events[0])), 0, 0, uintptr(unsafe.Pointer(&returned))))
+	return int(returned), err
+}
+
+// evtRender renders an event or bookmark as XML.
+func evtRender(fragment evtHandle, flags uint32, buffer []byte) (string, []byte, error) {
+	for {
+		used, count := uint32(0), uint32(0)
+		_, err := evtResult(procEvtRender.Call(0, uintptr(fragment), uintptr(flags),
+			uintptr(len(buffer)), uintptr(unsafe.Pointer(&buffer[0])),
+			uintptr(unsafe.Pointer(&used)), uintptr(unsafe.Pointer(&count))))
+
+		switch err {
+		case nil:
+			return utf16BytesToString(buffer[:used]), buffer, nil
+		case errorInsufficientBuf:
+			buffer = make([]byte, used)
+		default:
+			return "", buffer, err
+		}
+	}
+}
+
+// evtFormatXML renders an event as XML including the localized message and
+// the names of level, task, opcode and keywords.
+func evtFormatXML(publisher, event evtHandle, buffer []uint16) (string, []uint16, error) {
+	for {
+		used := uint32(0)
+		_, err := evtResult(procEvtFormatMessage.Call(uintptr(publisher), uintptr(event), 0, 0, 0,
+			evtFormatMessageXML, uintptr(len(buffer)), uintptr(unsafe.Pointer(&buffer[0])),
+			uintptr(unsafe.Pointer(&used))))
+
+		switch err {
+		case nil:
+			return syscall.UTF16ToString(buffer[:used]), buffer, nil
+		case errorInsufficientBuf:
+			buffer = make([]uint16, used)
+		default:
+			return "", buffer, err
+		}
+	}
+}
+
+func evtCreateBookmark(xml string) (evtHandle, error) {
+	var xmlPtr *uint16
+	if xml != "" {
+		var err error
+		if xmlPtr, err = syscall.UTF16PtrFromString(xml); err != nil {
+			return 0, err
+		}
+	}
+	handle, err := evtResult(procEvtCreateBookmark.Call(uintptr(unsafe.Pointer(xmlPtr))))
+	return evtHandle(handle), err
+}
+
+func evtUpdateBookmark(bookmark, event evtHandle) error {
+	_, err := evtResult(procEvtUpdateBookmark.Call(uintptr(bookmark), uintptr(event)))
+	return err
+}
+
+func evtOpenPublisherMetadata(provider string) (evtHandle, error) {
+	providerPtr, err := syscall.UTF16PtrFromString(provider)
+	if err != nil {
+		return 0, err
+	}
+	handle, err := evtResult(procEvtOpenPublisherMetadata.Call(0, uintptr(unsafe.Pointer(providerPtr)), 0, 0, 0))
+	return evtHandle(handle), err
+}
+
+func evtClose(handle evtHandle) {
+	if handle != 0 {
+		procEvtClose.Call(uintptr(handle))
+	}
+}
+
+func utf16BytesToString(data []byte) string {
+	chars := make([]uint16, len(data)/2)
+	for i := range chars {
+		chars[i] = uint16(data[2*i]) | uint16(data[2*i+1])<<8
+	}
+	return syscall.UTF16ToString(chars)
+}
@@ -0,0 +1,158 @@
+// Copyright 2015-2016 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumer
+
+import (
+	"encoding/xml"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// windowsEvent is the XML representation of a Windows event as returned by
+// EvtRender and EvtFormatMessage.
+type windowsEvent struct {
+	System struct {
+		Provider struct {
+			Name string `xml:"Name,attr"`
+			GUID string `xml:"Guid,attr"`
+		}
+		EventID     string
+		Version     string
+		Level       string
+		Task        string
+		Opcode      string
+		Keywords    string
+		TimeCreated struct {
+			SystemTime string `xml:"SystemTime,attr"`
+		}
+		EventRecordID string
+		Correlation   struct {
+			ActivityID        string `xml:"ActivityID,attr"`
+			RelatedActivityID string `xml:"RelatedActivityID,attr"`
+		}
+		Execution struct {
+			ProcessID string `xml:"ProcessID,attr"`
+			ThreadID  string `xml:"ThreadID,attr"`
+		}
+		Channel  string
+		Computer string
+		Security struct {
+			UserID string `xml:"UserID,attr"`
+		}
+	}
+	EventData struct {
+		Data []windowsEventValue `xml:"Data"`
+	}
+	UserData struct {
+		Element struct {
+			XMLName xml.Name
+			Values  []windowsEventValue `xml:",any"`
+		} `xml:",any"`
+	}
+	RenderingInfo struct {
+		Message  string
+		Level    string
+		Task     string
+		Opcode   string
+		Keywords []string `xml:"Keywords>Keyword"`
+	}
+}
+
+type windowsEventValue struct {
+	XMLName xml.Name
+	Name    string `xml:"Name,attr"`
+	Value   string `xml:",chardata"`
+}
+
+// parseWindowsEvent converts the XML representation of a Windows event to a
+// flat record. Unnamed values of EventData are named "param1", "param2", ...
+func parseWindowsEvent(data string) (map[string]interface{}, error) {
+	event := windowsEvent{}
+	if err := xml.Unmarshal([]byte(data), &event); err != nil {
+		return nil, err
+	}
+
+	system := event.System
+	if system.Channel == "" && system.EventID == "" {
+		return nil, fmt.Errorf("not a Windows event")
+	}
+
+	record := map[string]interface{}{
+		"channel":       system.Channel,
+		"computer":      system.Computer,
+		"provider_name": system.Provider.Name,
+		"time_created":  system.TimeCreated.SystemTime,
+	}
+
+	numbers := map[string]string{
+		"event_id":   system.EventID,
+		"version":    system.Version,
+		"level":      system.Level,
+		"task":       system.Task,
+		"opcode":     system.Opcode,
+		"record_id":  system.EventRecordID,
+		"process_id": system.Execution.ProcessID,
+		"thread_id":  system.Execution.ThreadID,
+	}
+	for key, value := range numbers {
+		if number, err := strconv.ParseUint(strings.TrimSpace(value), 10, 64); err == nil {
+			record[key] = number
+		}
+	}
+
+	strs := map[string]string{
+		"provider_guid":       system.Provider.GUID,
+		"keywords":            system.Keywords,
+		"activity_id":         system.Correlation.ActivityID,
+		"related_activity_id": system.Correlation.RelatedActivityID,
+		"user_id":             system.Security.UserID,
+		"message":             strings.TrimSpace(event.RenderingInfo.Message),
+		"level_text":          event.RenderingInfo.Level,
+		"task_text":           event.RenderingInfo.Task,
+		"opcode_text":         event.RenderingInfo.Opcode,
+	}
+	for key, value := range strs {
+		if value != "" {
+			record[key] = value
+		}
+	}
+	if keywords := event.RenderingInfo.Keywords; len(keywords) > 0 {
+		record["keywords_text"] = keywords
+	}
+
+	if len(event.EventData.Data) > 0 {
+		eventData := make(map[string]string)
+		for i, value := range event.EventData.Data {
+			name := value.Name
+			if name == "" {
+				name = fmt.Sprintf("param%d", i+1)
+			}
+			eventData[name] = value.Value
+		}
+		record["event_data"] = eventData
+	}
+
+	if element := event.UserData.Element; element.XMLName.Local != "" {
+		userData := make(map[string]string)
+		for _, value := range element.Values {
+			userData[value.XMLName.Local] = value.Value
+		}
+		record["user_data"] = userData
+		record["user_data_type"] = element.XMLName.Local
+	}
+
+	return record, nil
+}
@@ -0,0 +1,477 @@
+// Copyright 2015-2016 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package native
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"github.com/miekg/pcap"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/core/log"
+	"github.com/trivago/gollum/shared"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	pcapMetadataInterface = "pcap_interface"
+	pcapReadTimeoutMs     = 500
+
+	// Link types not defined by github.com/miekg/pcap
+	pcapLinkTypeRaw   = 101
+	pcapDLTRaw        = 12
+	pcapDLTRawOpenBSD = 14
+
+	// pcapSLLOutgoing is the packet type of sent packets in a Linux
+	// "cooked" header
+	pcapSLLOutgoing = 4
+)
+
+// pcapTCPFlags names the TCP flags starting with the lowest bit.
+var pcapTCPFlags = []string{"FIN", "SYN", "RST", "PSH", "ACK", "URG", "ECE", "CWR"}
+
+// PcapConsumer consumer plugin
+// This plugin utilizes libpcap to capture network packets on one or all
+// interfaces and emits either the captured frames or a JSON summary of their
+// headers. As it uses a CGO based library it will break cross platform builds
+// (i.e. you will have to compile it on the correct platform).
+// Summaries contain the fields "timestamp", "interface", "length" and
+// "captured" as well as an object for each decoded layer: "eth" (Ethernet
+// including VLAN tags), "arp", "ip" (IPv4 and IPv6), "tcp", "udp" and "icmp"
+// (ICMP and ICMPv6). Packets captured on the "any" device also contain the
+// field "direction" ("in" or "out").
+// The name of the interface is attached to each message as "pcap_interface"
+// metadata unless packets are captured on the "any" device.
+// When attached to a fuse, this consumer will discard all captured packets
+// in case that fuse is burned.
+// NOTICE: This consumer is not included in standard builds. To enable it
+// you need to trigger a custom build with native plugins enabled.
+// Configuration example
+//
+//   - "native.PcapConsumer":
+//     Interface: "any"
+//     Filter: ""
+//     Promiscuous: false
+//     SnapLen: 65535
+//     Format: "summary"
+//     ReadBufferSize: 0
+//
+// Interface defines the network interface to capture packets on. By default
+// this is set to "any", which captures on all interfaces.
+//
+// Filter defines a libpcap filter for the captured packages. You can filter
+// for specific ports, protocols, ips, etc.. The documentation can be found
+// here: http://www.tcpdump.org/manpages/pcap-filter.7.txt (manpage).
+// By default this is set to "", which captures all packets.
+//
+// Promiscuous can be set to true to put the interface into promiscuous mode
+// to capture packets not addressed to this host. This requires Interface to
+// be set to a specific interface. By default this is set to false.
+//
+// SnapLen defines the maximum number of bytes captured per packet. Longer
+// packets are truncated. By default this is set to 65535.
+//
+// Format defines the message format. This can be "summary" to emit a JSON
+// summary of the packet headers or "raw" to emit the captured frames as is,
+// starting with the link layer header. By default this is set to "summary".
+//
+// ReadBufferSize sets the size of the capture buffer in bytes. Larger
+// buffers help to compensate bursts without the kernel dropping packets.
+// By default this is set to 0, which keeps the libpcap default.
+type PcapConsumer struct {
+	core.ConsumerBase
+	netInterface string
+	filter       string
+	promiscuous  bool
+	snapLen      int
+	bufferSize   int
+	summary      bool
+	seqNum       uint64
+}
+
+// pcapFrame is a packet captured by libpcap.
+type pcapFrame struct {
+	data      []byte
+	length    int
+	iface     string
+	linkType  int
+	timestamp time.Time
+}
+
+type pcapSummary struct {
+	Timestamp string        `json:"timestamp"`
+	Interface string        `json:"interface,omitempty"`
+	Direction string        `json:"direction,omitempty"`
+	Length    int           `json:"length"`
+	Captured  int           `json:"captured"`
+	Ethernet  *pcapEthernet `json:"eth,omitempty"`
+	ARP       *pcapARP      `json:"arp,omitempty"`
+	IP        *pcapIP       `json:"ip,omitempty"`
+	TCP       *pcapTCP      `json:"tcp,omitempty"`
+	UDP       *pcapUDP      `json:"udp,omitempty"`
+	ICMP      *pcapICMP     `json:"icmp,omitempty"`
+}
+
+type pcapEthernet struct {
+	Src  string   `json:"src"`
+	Dst  string   `json:"dst"`
+	Type uint16   `json:"type"`
+	VLAN []uint16 `json:"vlan,omitempty"`
+}
+
+type pcapARP struct {
+	Op        uint16 `json:"op"`
+	SenderMAC string `json:"sender_mac"`
+	SenderIP  string `json:"sender_ip"`
+	TargetMAC string `json:"target_mac"`
+	TargetIP  string `json:"target_ip"`
+}
+
+type pcapIP struct {
+	Version  int    `json:"version"`
+	Src      string `json:"src"`
+	Dst      string `json:"dst"`
+	Protocol uint8  `json:"protocol"`
+	TTL      uint8  `json:"ttl"`
+	Length   int    `json:"length"`
+	Fragment bool   `json:"fragment,omitempty"`
+}
+
+type pcapTCP struct {
+	SrcPort uint16 `json:"src_port"`
+	DstPort uint16 `json:"dst_port"`
+	Seq     uint32 `json:"seq"`
+	Ack     uint32 `json:"ack"`
+	Flags   string `json:"flags"`
+	Window  uint16 `json:"window"`
+}
+
+type pcapUDP struct {
+	SrcPort uint16 `json:"src_port"`
+	DstPort uint16 `json:"dst_port"`
+	Length  uint16 `json:"length"`
+}
+
+type pcapICMP struct {
+	Type uint8 `json:"type"`
+	Code uint8 `json:"code"`
+}
+
+func init() {
+	shared.TypeRegistry.Register(PcapConsumer{})
+}
+
+// Configure initializes this consumer with values from a plugin config.
+func (cons *PcapConsumer) Configure(conf core.PluginConfig) error {
+	err := cons.ConsumerBase.Configure(conf)
+	if err != nil {
+		return err
+	}
+
+	cons.netInterface = conf.GetString("Interface", "any")
+	cons.filter = conf.GetString("Filter", "")
+	cons.promiscuous = conf.GetBool("Promiscuous", false)
+	cons.snapLen = shared.MaxI(conf.GetInt("SnapLen", 65535), 64)
+	cons.bufferSize = conf.GetInt("ReadBufferSize", 0)
+
+	if cons.promiscuous && cons.netInterface == "any" {
+		return fmt.Errorf("Promiscuous mode requires an interface")
+	}
+
+	format := strings.ToLower(conf.GetString("Format", "summary"))
+	switch format {
+	case "summary", "raw":
+		cons.summary = format == "summary"
+	default:
+		return fmt.Errorf("Unknown format: %s", format)
+	}
+
+	return nil
+}
+
+// summarizePcapFrame decodes the headers of a captured frame. Decoding stops
+// at the first layer that is unknown or truncated.
+func summarizePcapFrame(frame pcapFrame) pcapSummary {
+	summary := pcapSummary{
+		Timestamp: frame.timestamp.UTC().Format(time.RFC3339Nano),
+		Interface: frame.iface,
+		Length:    frame.length,
+		Captured:  len(frame.data),
+	}
+
+	data := frame.data
+	etherType := uint16(0)
+	switch frame.linkType {
+	case pcap.LINKTYPE_ETHERNET:
+		if len(data) < 14 {
+			return summary // ### return, truncated ###
+		}
+		eth := &pcapEthernet{
+			Dst: net.HardwareAddr(data[0:6]).String(),
+			Src: net.HardwareAddr(data[6:12]).String(),
+		}
+		etherType, data = binary.BigEndian.Uint16(data[12:14]), data[14:]
+		for (etherType == 0x8100 || etherType == 0x88a8) && len(data) >= 4 {
+			eth.VLAN = append(eth.VLAN, binary.BigEndian.Uint16(data[0:2])&0x0fff)
+			etherType, data = binary.BigEndian.Uint16(data[2:4]), data[4:]
+		}
+		eth.Type = etherType
+		summary.Ethernet = eth
+
+	case pcap.LINKTYPE_LINUX_SLL:
+		// Used when capturing on the "any" device
+		if len(data) < 16 {
+			return summary // ### return, truncated ###
+		}
+		summary.Direction = "in"
+		if binary.BigEndian.Uint16(data[0:2]) == pcapSLLOutgoing {
+			summary.Direction = "out"
+		}
+		etherType, data = binary.BigEndian.Uint16(data[14:16]), data[16:]
+
+	case pcapLinkTypeRaw, pcapDLTRaw, pcapDLTRawOpenBSD:
+		// Interfaces without link layer header start with the IP header
+		if len(data) > 0 {
+			switch data[0] >> 4 {
+			case 4:
+				etherType = 0x0800
+			case 6:
+				etherType = 0x86dd
+			}
+		}
+	}
+
+	protocol := uint8(0)
+	switch etherType {
+	case 0x0806:
+		if len(data) >= 28 && data[4] == 6 && data[5] == 4 {
+			summary.ARP = &pcapARP{
+				Op:        binary.BigEndian.Uint16(data[6:8]),
+				SenderMAC: net.HardwareAddr(data[8:14]).String(),
+				SenderIP:  net.IP(data[14:18]).String(),
+				TargetMAC: net.HardwareAddr(data[18:24]).String(),
+				TargetIP:  net.IP(data[24:28]).String(),
+			}
+		}
+		return summary
+
+	case 0x0800:
+		headerSize := 0
+		if len(data) >= 20 {
+			headerSize = int(data[0]&0x0f) * 4
+		}
+		if headerSize < 20 || len(data) < headerSize {
+			return summary // ### return, truncated ###
+		}
+		flags := binary.BigEndian.Uint16(data[6:8])
+		protocol = data[9]
+		summary.IP = &pcapIP{
+			Version:  4,
+			Src:      net.IP(data[12:16]).String(),
+			Dst:      net.IP(data[16:20]).String(),
+			Protocol: protocol,
+			TTL:      data[8],
+			Length:   int(binary.BigEndian.Uint16(data[2:4])),
+			Fragment: flags&0x2000 != 0 || flags&0x1fff != 0,
+		}
+		if flags&0x1fff != 0 {
+			return summary // ### return, no transport header in fragment ###
+		}
+		data = data[headerSize:]
+
+	case 0x86dd:
+		if len(data) < 40 {
+			return summary // ### return, truncated ###
+		}
+		summary.IP = &pcapIP{
+			Version: 6,
+			Src:     net.IP(data[8:24]).String(),
+			Dst:     net.IP(data[24:40]).String(),
+			TTL:     data[7],
+			Length:  int(binary.BigEndian.Uint16(data[4:6])) + 40,
+		}
+		protocol, data = data[6], data[40:]
+
+		// Skip extension headers
+		for {
+			switch protocol {
+			case 0, 43, 60:
+				if len(data) < 8 || len(data) < int(data[1]+1)*8 {
+					return summary // ### return, truncated ###
+				}
+				protocol, data = data[0], data[int(data[1]+1)*8:]
+				continue // ### continue, next header ###
+			case 44:
+				if len(data) < 8 {
+					return summary // ### return, truncated ###
+				}
+				summary.IP.Fragment = true
+				if binary.BigEndian.Uint16(data[2:4])&0xfff8 != 0 {
+					summary.IP.Protocol = data[0]
+					return summary // ### return, no transport header in fragment ###
+				}
+				protocol, data = data[0], data[8:]
+				continue // ### continue, next header ###
+			}
+			break
+		}
+		summary.IP.Protocol = protocol
+
+	default:
+		return summary
+	}
+
+	switch protocol {
+	case 6:
+		if len(data) >= 20 {
+			flags := []string{}
+			for bit, name := range pcapTCPFlags {
+				if data[13]&(1<<uint(bit)) != 0 {
+					flags = append(flags, name)
+				}
+			}
+			summary.TCP = &pcapTCP{
+				SrcPort: binary.BigEndian.Uint16(data[0:2]),
+				DstPort: binary.BigEndian.Uint16(data[2:4]),
+				Seq:     binary.BigEndian.Uint32(data[4:8]),
+				Ack:     binary.BigEndian.Uint32(data[8:12]),
+				Flags:   strings.Join(flags, ","),
+				Window:  binary.BigEndian.Uint16(data[14:16]),
+			}
+		}
+
+	case 17:
+		if len(data) >= 8 {
+			summary.UDP = &pcapUDP{
+				SrcPort: binary.BigEndian.Uint16(data[0:2]),
+				DstPort: binary.BigEndian.Uint16(data[2:4]),
+				Length:  binary.BigEndian.Uint16(data[4:6]),
+			}
+		}
+
+	case 1, 58:
+		if len(data) >= 2 {
+			summary.ICMP = &pcapICMP{Type: data[0], Code: data[1]}
+		}
+	}
+	return summary
+}
+
+func (cons *PcapConsumer) enqueue(frame pcapFrame) {
+	data := frame.data
+	if cons.summary {
+		var err error
+		if data, err = json.Marshal(summarizePcapFrame(frame)); err != nil {
+			Log.Error.Print("PcapConsumer failed to encode summary: ", err)
+			return
+		}
+	}
+
+	msg := core.NewMessage(cons, data, atomic.AddUint64(&cons.seqNum, 1))
+	if frame.iface != "" {
+		msg.SetMetadata(pcapMetadataInterface, frame.iface)
+	}
+	cons.EnqueueMessage(msg)
+}
+
+// activate applies the configured options to a capture handle, starts the
+// capture and sets the filter expression.
+func (cons *PcapConsumer) activate(handle *pcap.Pcap) error {
+	if err := handle.SetSnapLen(int32(cons.snapLen)); err != nil {
+		return err
+	}
+	if err := handle.SetPromisc(cons.promiscuous); err != nil {
+		return err
+	}
+	if err := handle.SetReadTimeout(pcapReadTimeoutMs); err != nil {
+		return err
+	}
+	if cons.bufferSize > 0 {
+		if err := handle.SetBufferSize(int32(cons.bufferSize)); err != nil {
+			return err
+		}
+	}
+	if err := handle.Activate(); err != nil {
+		return err
+	}
+	if cons.filter != "" {
+		return handle.SetFilter(cons.filter)
+	}
+	return nil
+}
+
+func (cons *PcapConsumer) capture(handle *pcap.Pcap) {
+	defer func() {
+		handle.Close()
+		cons.WorkerDone()
+	}()
+
+	iface := cons.netInterface
+	if iface == "any" {
+		iface = ""
+	}
+	linkType := handle.Datalink()
+
+	for cons.IsActive() {
+		pkt, resultCode := handle.NextEx()
+
+		switch resultCode {
+		case pcapNextExOk:
+		case pcapNextExTimeout:
+			continue // ### continue, no packet ###
+		case pcapNextExEOF:
+			return // ### return, capture ended ###
+		default:
+			Log.Error.Print("PcapConsumer: ", handle.Geterror())
+			return // ### return, capture failed ###
+		}
+
+		if cons.IsFuseBurned() {
+			continue // ### continue, discard packet ###
+		}
+		cons.enqueue(pcapFrame{
+			data:      pkt.Data,
+			length:    int(pkt.Len),
+			iface:     iface,
+			linkType:  linkType,
+			timestamp: pkt.Time,
+		})
+	}
+}
+
+// Consume starts capturing packets.
+func (cons *PcapConsumer) Consume(workers *sync.WaitGroup) {
+	handle, err := pcap.Create(cons.netInterface)
+	if err != nil {
+		Log.Error.Print("PcapConsumer: ", err)
+		return // ### return, could not open device ###
+	}
+	if err := cons.activate(handle); err != nil {
+		handle.Close()
+		Log.Error.Print("PcapConsumer: ", err)
+		return // ### return, could not start capture ###
+	}
+
+	// The handle is closed by the capture worker, as libpcap handles must
+	// not be closed while a read is in progress
+	cons.AddMainWorker(workers)
+	go shared.DontPanic(func() { cons.capture(handle) })
+
+	cons.ControlLoop()
+}
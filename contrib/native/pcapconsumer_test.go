@@ -0,0 +1,70 @@
+// Copyright 2015-2016 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package native
+
+import (
+	"github.com/miekg/pcap"
+	"github.com/trivago/gollum/shared"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestPcapSummary(t *testing.T) {
+	expect := shared.NewExpect(t)
+	timestamp := time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	// Ethernet with VLAN tag, IPv4 and TCP SYN/ACK
+	frame := []byte{
+		0x02, 0, 0, 0, 0, 0x02, 0x02, 0, 0, 0, 0, 0x01, 0x81, 0x00, 0x00, 0x2a, 0x08, 0x00,
+		0x45, 0, 0, 40, 0, 1, 0x40, 0, 64, 6, 0, 0, 10, 0, 0, 1, 10, 0, 0, 2,
+		0x1f, 0x90, 0xc3, 0x50, 0, 0, 0, 1, 0, 0, 0, 2, 0x50, 0x12, 0xff, 0xff, 0, 0, 0, 0,
+	}
+	summary := summarizePcapFrame(pcapFrame{data: frame, length: 100, iface: "eth0", linkType: pcap.LINKTYPE_ETHERNET, timestamp: timestamp})
+	expect.Equal("2016-01-01T00:00:00Z", summary.Timestamp)
+	expect.Equal("", summary.Direction)
+	expect.Equal(100, summary.Length)
+	expect.Equal(len(frame), summary.Captured)
+	expect.Equal(pcapEthernet{Src: "02:00:00:00:00:01", Dst: "02:00:00:00:00:02", Type: 0x0800, VLAN: []uint16{42}}, *summary.Ethernet)
+	expect.Equal(pcapIP{Version: 4, Src: "10.0.0.1", Dst: "10.0.0.2", Protocol: 6, TTL: 64, Length: 40}, *summary.IP)
+	expect.Equal(pcapTCP{SrcPort: 8080, DstPort: 50000, Seq: 1, Ack: 2, Flags: "SYN,ACK", Window: 0xffff}, *summary.TCP)
+	expect.Nil(summary.UDP)
+
+	// IPv6 with hop-by-hop options and UDP, captured on the "any" device
+	frame = []byte{0, 4, 0, 1, 0, 6, 2, 0, 0, 0, 0, 1, 0, 0, 0x86, 0xdd}
+	frame = append(frame, 0x60, 0, 0, 0, 0, 16, 0, 255)
+	frame = append(frame, net.ParseIP("fe80::1")...)
+	frame = append(frame, net.ParseIP("ff02::fb")...)
+	frame = append(frame, 17, 0, 0, 0, 0, 0, 0, 0)
+	frame = append(frame, 0x14, 0xe9, 0x14, 0xe9, 0, 8, 0, 0)
+	summary = summarizePcapFrame(pcapFrame{data: frame, length: len(frame), linkType: pcap.LINKTYPE_LINUX_SLL, timestamp: timestamp})
+	expect.Equal("out", summary.Direction)
+	expect.Nil(summary.Ethernet)
+	expect.Equal(pcapIP{Version: 6, Src: "fe80::1", Dst: "ff02::fb", Protocol: 17, TTL: 255, Length: 56}, *summary.IP)
+	expect.Equal(pcapUDP{SrcPort: 5353, DstPort: 5353, Length: 8}, *summary.UDP)
+
+	// ARP request
+	frame = []byte{
+		0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x02, 0, 0, 0, 0, 0x01, 0x08, 0x06,
+		0, 1, 0x08, 0, 6, 4, 0, 1, 0x02, 0, 0, 0, 0, 0x01, 10, 0, 0, 1, 0, 0, 0, 0, 0, 0, 10, 0, 0, 2,
+	}
+	summary = summarizePcapFrame(pcapFrame{data: frame, length: len(frame), linkType: pcap.LINKTYPE_ETHERNET, timestamp: timestamp})
+	expect.Equal(pcapARP{Op: 1, SenderMAC: "02:00:00:00:00:01", SenderIP: "10.0.0.1", TargetMAC: "00:00:00:00:00:00", TargetIP: "10.0.0.2"}, *summary.ARP)
+	expect.Nil(summary.IP)
+
+	// Truncated IPv4 header on an interface without link layer
+	summary = summarizePcapFrame(pcapFrame{data: []byte{0x45, 0, 0}, length: 60, linkType: pcapDLTRaw, timestamp: timestamp})
+	expect.Nil(summary.IP)
+}
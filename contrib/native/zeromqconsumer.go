@@ -0,0 +1,449 @@
+// Copyright 2015-2016 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package native
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	zmq "github.com/pebbe/zmq4"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/core/log"
+	"github.com/trivago/gollum/shared"
+	"io/ioutil"
+	"net"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+const (
+	zeromqMetadataTopic = "zmq_topic"
+	zeromqReadTimeout   = 500 * time.Millisecond
+
+	zeromqMultipartJoin  = "join"
+	zeromqMultipartSplit = "split"
+	zeromqMultipartTopic = "topic"
+)
+
+var (
+	zeromqZCertSecretKey = regexp.MustCompile(`(?m)^\s*secret-key\s*=\s*"([^"]+)"`)
+
+	// The ZAP handler of github.com/pebbe/zmq4 is shared by all sockets of
+	// the process. Each CURVE server uses its own ZAP domain.
+	zeromqAuthStart   = new(sync.Once)
+	zeromqAuthError   error
+	zeromqDomainCount uint64
+)
+
+// ZeroMQConsumer consumer plugin
+// This plugin utilizes libzmq to receive messages as a ZeroMQ SUB or PULL
+// socket. As it uses a CGO based library it will break cross platform
+// builds (i.e. you will have to compile it on the correct platform).
+// Like ZeroMQ sockets it can connect to several endpoints and bind to
+// several endpoints at the same time. Lost connections are reestablished
+// automatically.
+// Connections can be encrypted and authenticated with CurveZMQ. Either the
+// consumer acts as CURVE client and verifies the key of the server, or it
+// acts as CURVE server and optionally only accepts clients with known keys.
+// The IP address of the peer is attached to each message as
+// "source_address" metadata if it is known.
+// When attached to a fuse, this consumer will stop reading messages in case
+// that fuse is burned.
+// NOTICE: This consumer is not included in standard builds. To enable it
+// you need to trigger a custom build with native plugins enabled.
+// Configuration example
+//
+//  - "native.ZeroMQConsumer":
+//    Connect:
+//      - "tcp://localhost:5556"
+//    Bind: []
+//    Socket: "sub"
+//    Subscribe:
+//      - ""
+//    Multipart: "join"
+//    Separator: ""
+//    MaxMessageSizeByte: 67108864
+//    RetryDelayMs: 1000
+//    CurveServer: false
+//    CurveServerKey: ""
+//    CurveSecretKey: ""
+//    CurveSecretKeyFile: ""
+//    CurveClientKeys: []
+//
+// Connect defines a list of endpoints to connect to. The transports "tcp://"
+// (e.g. "tcp://localhost:5556") and "ipc://" (e.g. "ipc:///tmp/feed") are
+// supported. By default this is set to ["tcp://localhost:5556"] if Bind is
+// empty and to [] otherwise.
+//
+// Bind defines a list of endpoints to listen on. Peers connecting to these
+// endpoints are handled like peers connected to. Use "*" as host to listen
+// on all interfaces, e.g. "tcp://*:5556". By default this list is empty.
+//
+// Socket defines the type of socket to act as. "sub" receives messages
+// published by PUB or XPUB sockets, "pull" receives messages sent by PUSH
+// sockets. By default this is set to "sub".
+//
+// Subscribe defines a list of topic prefixes to subscribe to. A message is
+// received if its first part starts with one of these prefixes, all other
+// messages are dropped. This setting is only used for "sub" sockets.
+// By default this is set to [""], which receives all messages.
+//
+// Multipart defines how messages consisting of several parts are handled.
+// By default this is set to "join".
+//  * "join" creates one message of all parts, separated by Separator.
+//  * "split" creates one message per part.
+//  * "topic" stores the first part as "zmq_topic" metadata and creates one
+//    message of all other parts, separated by Separator.
+//
+// Separator defines the bytes inserted between the parts of a message by
+// the "join" and "topic" modes. By default this is set to "".
+//
+// MaxMessageSizeByte defines the maximum size of a single message part.
+// Connections sending larger parts are closed. By default this is set to
+// 67108864 (64 MB).
+//
+// RetryDelayMs defines the number of milliseconds to wait before
+// reconnecting after a connection has been lost or before listening again
+// after a bind failed. By default this is set to 1000.
+//
+// CurveServer can be set to true to act as CURVE server. This requires
+// CurveSecretKey or CurveSecretKeyFile to be set to the secret key of the
+// server. Peers have to be configured with the matching public key as
+// server key. By default this is set to false.
+//
+// CurveServerKey defines the public key of the CURVE server to connect to.
+// If set, the consumer acts as CURVE client. Keys are given as 40 Z85
+// characters (as written by zmq_curve_keypair) or 64 hex digits. By default
+// this is set to "", which disables CURVE unless CurveServer is set.
+//
+// CurveSecretKey defines the secret key of the consumer. For CURVE clients
+// this setting is optional. If not set, a new key is generated on startup,
+// which works for servers accepting all clients. By default this is set to
+// "".
+//
+// CurveSecretKeyFile defines a file to read the secret key from instead. The
+// file may either contain the key only or be a secret certificate as written
+// by zcert. By default this is set to "".
+//
+// CurveClientKeys defines a list of public keys of clients allowed to
+// connect if CurveServer is set. Clients are authenticated by a ZAP handler,
+// using a separate ZAP domain for each consumer. By default this list is
+// empty, which allows all clients knowing the public key of the server.
+type ZeroMQConsumer struct {
+	core.ConsumerBase
+	connect        []string
+	bind           []string
+	socketType     zmq.Type
+	subscriptions  []string
+	multipart      string
+	separator      []byte
+	maxMessageSize int
+	retryDelay     time.Duration
+	curveServer    bool
+	curveServerKey string
+	curvePublicKey string
+	curveSecretKey string
+	curveDomain    string
+	sequence       uint64
+}
+
+func init() {
+	shared.TypeRegistry.Register(ZeroMQConsumer{})
+}
+
+// Configure initializes this consumer with values from a plugin config.
+func (cons *ZeroMQConsumer) Configure(conf core.PluginConfig) error {
+	err := cons.ConsumerBase.Configure(conf)
+	if err != nil {
+		return err
+	}
+
+	cons.bind = conf.GetStringArray("Bind", []string{})
+	defaultConnect := []string{"tcp://localhost:5556"}
+	if len(cons.bind) > 0 {
+		defaultConnect = []string{}
+	}
+	cons.connect = conf.GetStringArray("Connect", defaultConnect)
+	if len(cons.connect)+len(cons.bind) == 0 {
+		return fmt.Errorf("ZeroMQConsumer requires at least one endpoint to connect or bind to")
+	}
+	for _, endpoint := range append(append([]string{}, cons.connect...), cons.bind...) {
+		if err := checkZeroMQEndpoint(endpoint); err != nil {
+			return err
+		}
+	}
+
+	switch socketType := strings.ToLower(conf.GetString("Socket", "sub")); socketType {
+	case "sub":
+		cons.socketType = zmq.SUB
+		cons.subscriptions = conf.GetStringArray("Subscribe", []string{""})
+	case "pull":
+		cons.socketType = zmq.PULL
+	default:
+		return fmt.Errorf("Unsupported ZeroMQ socket type: %s", socketType)
+	}
+
+	switch cons.multipart = strings.ToLower(conf.GetString("Multipart", zeromqMultipartJoin)); cons.multipart {
+	case zeromqMultipartJoin, zeromqMultipartSplit, zeromqMultipartTopic:
+	default:
+		return fmt.Errorf("Unknown multipart mode: %s", cons.multipart)
+	}
+	cons.separator = []byte(conf.GetString("Separator", ""))
+	cons.maxMessageSize = shared.MaxI(conf.GetInt("MaxMessageSizeByte", 67108864), 1)
+	cons.retryDelay = time.Duration(conf.GetInt("RetryDelayMs", 1000)) * time.Millisecond
+
+	return cons.configureCurve(conf)
+}
+
+func (cons *ZeroMQConsumer) configureCurve(conf core.PluginConfig) error {
+	cons.curveServer = conf.GetBool("CurveServer", false)
+	serverKey := conf.GetString("CurveServerKey", "")
+	secretKey := conf.GetString("CurveSecretKey", "")
+	secretKeyFile := conf.GetString("CurveSecretKeyFile", "")
+	clientKeys := conf.GetStringArray("CurveClientKeys", []string{})
+
+	if !cons.curveServer && serverKey == "" {
+		return nil // ### return, CURVE disabled ###
+	}
+
+	var err error
+	switch {
+	case secretKey != "":
+		cons.curveSecretKey, err = parseZeroMQCurveKey(secretKey)
+	case secretKeyFile != "":
+		cons.curveSecretKey, err = loadZeroMQCurveSecretKey(secretKeyFile)
+	case cons.curveServer:
+		return fmt.Errorf("CurveServer requires CurveSecretKey or CurveSecretKeyFile to be set")
+	default:
+		cons.curvePublicKey, cons.curveSecretKey, err = zmq.NewCurveKeypair()
+	}
+	if err != nil {
+		return fmt.Errorf("Invalid CURVE secret key: %s", err)
+	}
+	if cons.curvePublicKey == "" {
+		if cons.curvePublicKey, err = zmq.AuthCurvePublic(cons.curveSecretKey); err != nil {
+			return err
+		}
+	}
+
+	if !cons.curveServer {
+		if cons.curveServerKey, err = parseZeroMQCurveKey(serverKey); err != nil {
+			return fmt.Errorf("Invalid CURVE server key: %s", err)
+		}
+		return nil
+	}
+
+	allowed := []string{zmq.CURVE_ALLOW_ANY}
+	if len(clientKeys) > 0 {
+		allowed = make([]string, 0, len(clientKeys))
+		for _, clientKey := range clientKeys {
+			key, err := parseZeroMQCurveKey(clientKey)
+			if err != nil {
+				return fmt.Errorf("Invalid CURVE client key %s: %s", clientKey, err)
+			}
+			allowed = append(allowed, key)
+		}
+	}
+
+	// Keys are registered before the ZAP handler is started in Consume, as
+	// github.com/pebbe/zmq4 does not guard its key lists.
+	cons.curveDomain = fmt.Sprintf("gollum.%d", atomic.AddUint64(&zeromqDomainCount, 1))
+	zmq.AuthCurveAdd(cons.curveDomain, allowed...)
+	return nil
+}
+
+// checkZeroMQEndpoint returns an error if the given endpoint does not use a
+// supported transport.
+func checkZeroMQEndpoint(endpoint string) error {
+	address, protocol := shared.ParseAddress(endpoint)
+	switch {
+	case protocol == "ipc" && address != "":
+		return nil
+	case protocol != "tcp" || !strings.Contains(endpoint, "://"):
+		return fmt.Errorf("Unsupported ZeroMQ endpoint %s, use tcp:// or ipc://", endpoint)
+	}
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		return fmt.Errorf("Invalid ZeroMQ endpoint %s: %s", endpoint, err)
+	}
+	return nil
+}
+
+// parseZeroMQCurveKey returns the Z85 encoding of a key given as Z85 text or
+// as hex digits.
+func parseZeroMQCurveKey(text string) (string, error) {
+	text = strings.TrimSpace(text)
+	switch len(text) {
+	case 40:
+		if zmq.Z85encode(zmq.Z85decode(text)) != text {
+			return "", fmt.Errorf("Invalid Z85 data")
+		}
+		return text, nil
+	case 64:
+		key, err := hex.DecodeString(text)
+		if err != nil {
+			return "", err
+		}
+		return zmq.Z85encode(string(key)), nil
+	default:
+		return "", fmt.Errorf("Keys must be 40 Z85 characters or 64 hex digits")
+	}
+}
+
+// loadZeroMQCurveSecretKey reads a secret key from a file containing either
+// the key only or a zcert secret certificate.
+func loadZeroMQCurveSecretKey(fileName string) (string, error) {
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return "", err
+	}
+	if match := zeromqZCertSecretKey.FindSubmatch(data); match != nil {
+		return parseZeroMQCurveKey(string(match[1]))
+	}
+	return parseZeroMQCurveKey(string(data))
+}
+
+func (cons *ZeroMQConsumer) enqueue(data []byte, sourceAddress string, topic []byte) {
+	msg := core.NewMessage(cons, data, atomic.AddUint64(&cons.sequence, 1)-1)
+	if sourceAddress != "" {
+		msg.SetMetadata(core.MetadataSourceAddress, sourceAddress)
+	}
+	if topic != nil {
+		msg.SetMetadata(zeromqMetadataTopic, string(topic))
+	}
+	cons.EnqueueMessage(msg)
+}
+
+// sendMessage creates messages from the parts of a ZeroMQ message according
+// to the multipart mode.
+func (cons *ZeroMQConsumer) sendMessage(parts [][]byte, sourceAddress string) {
+	switch cons.multipart {
+	case zeromqMultipartSplit:
+		for _, part := range parts {
+			cons.enqueue(part, sourceAddress, nil)
+		}
+	case zeromqMultipartTopic:
+		cons.enqueue(bytes.Join(parts[1:], cons.separator), sourceAddress, parts[0])
+	default:
+		cons.enqueue(bytes.Join(parts, cons.separator), sourceAddress, nil)
+	}
+}
+
+// newSocket creates a socket with the configured options and connects it to
+// all endpoints. Binding is done by bindTo.
+func (cons *ZeroMQConsumer) newSocket() (*zmq.Socket, error) {
+	socket, err := zmq.NewSocket(cons.socketType)
+	if err != nil {
+		return nil, err
+	}
+
+	options := []func() error{
+		func() error { return socket.SetLinger(0) },
+		func() error { return socket.SetRcvtimeo(zeromqReadTimeout) },
+		func() error { return socket.SetMaxmsgsize(int64(cons.maxMessageSize)) },
+		func() error { return socket.SetReconnectIvl(cons.retryDelay) },
+	}
+	switch {
+	case cons.curveServer:
+		options = append(options, func() error { return socket.ServerAuthCurve(cons.curveDomain, cons.curveSecretKey) })
+	case cons.curveServerKey != "":
+		options = append(options, func() error {
+			return socket.ClientAuthCurve(cons.curveServerKey, cons.curvePublicKey, cons.curveSecretKey)
+		})
+	}
+	for _, topic := range cons.subscriptions {
+		topic := topic
+		options = append(options, func() error { return socket.SetSubscribe(topic) })
+	}
+	for _, endpoint := range cons.connect {
+		endpoint := endpoint
+		options = append(options, func() error { return socket.Connect(endpoint) })
+	}
+
+	for _, option := range options {
+		if err := option(); err != nil {
+			socket.Close()
+			return nil, err
+		}
+	}
+	return socket, nil
+}
+
+// bindTo binds the socket to all given endpoints and returns the endpoints
+// that failed.
+func (cons *ZeroMQConsumer) bindTo(socket *zmq.Socket, endpoints []string) []string {
+	failed := []string{}
+	for _, endpoint := range endpoints {
+		if err := socket.Bind(endpoint); err != nil {
+			Log.Error.Printf("ZeroMQConsumer failed to bind to %s: %s", endpoint, err)
+			failed = append(failed, endpoint)
+		}
+	}
+	return failed
+}
+
+// receive reads messages until the consumer stops. ZeroMQ sockets must not
+// be shared between goroutines, so the socket is only used here.
+func (cons *ZeroMQConsumer) receive() {
+	defer cons.WorkerDone()
+
+	socket, err := cons.newSocket()
+	if err != nil {
+		Log.Error.Print("ZeroMQConsumer: ", err)
+		return // ### return, could not create socket ###
+	}
+	defer socket.Close()
+
+	unbound := cons.bindTo(socket, cons.bind)
+	nextBind := time.Now().Add(cons.retryDelay)
+
+	for cons.IsActive() {
+		cons.WaitOnFuse()
+		if len(unbound) > 0 && time.Now().After(nextBind) {
+			unbound = cons.bindTo(socket, unbound)
+			nextBind = time.Now().Add(cons.retryDelay)
+		}
+
+		parts, metadata, err := socket.RecvMessageBytesWithMetadata(0, "Peer-Address")
+		switch {
+		case err == nil:
+			cons.sendMessage(parts, metadata["Peer-Address"])
+		case zmq.AsErrno(err) == zmq.Errno(syscall.EAGAIN):
+			// Read timeout, check for stop or bind retries
+		default:
+			Log.Error.Print("ZeroMQConsumer: ", err)
+			return // ### return, socket failed ###
+		}
+	}
+}
+
+// Consume connects and binds to the configured endpoints.
+func (cons *ZeroMQConsumer) Consume(workers *sync.WaitGroup) {
+	if cons.curveServer {
+		zeromqAuthStart.Do(func() { zeromqAuthError = zmq.AuthStart() })
+		if zeromqAuthError != nil {
+			Log.Error.Print("ZeroMQConsumer failed to start authentication: ", zeromqAuthError)
+			return // ### return, clients cannot be verified ###
+		}
+	}
+
+	cons.AddMainWorker(workers)
+	go shared.DontPanic(cons.receive)
+
+	cons.ControlLoop()
+}
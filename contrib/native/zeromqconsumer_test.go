@@ -0,0 +1,312 @@
+// Copyright 2015-2016 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package native
+
+import (
+	"encoding/hex"
+	zmq "github.com/pebbe/zmq4"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/shared"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Keys used in the examples of the ZeroMQ guide
+const (
+	zeromqTestServerPublic = "rq:rM>}U?@Lns47E1%kR.o@n%FcmmsL/@{H8]yf7"
+	zeromqTestServerSecret = "JTKVSB%%)wK0E.X)V>+}o?pNmC{O&4W4b!Ni{Lh6"
+	zeromqTestClientPublic = "Yne@$w-vo<fVvi]a<NY6T1ed:M$fCG*[IaLV{hID"
+	zeromqTestClientSecret = "D:)Q[IlAW!ahhC2ac:9*A}h:p?([4%wOTJ%JR%cs"
+)
+
+type mockZeroMQStream struct {
+	messages []core.Message
+	guard    sync.Mutex
+}
+
+func (stream *mockZeroMQStream) GetBoundStreamID() core.MessageStreamID { return 0 }
+func (stream *mockZeroMQStream) Pause(capacity int)                     {}
+func (stream *mockZeroMQStream) Resume()                                {}
+func (stream *mockZeroMQStream) Flush()                                 {}
+func (stream *mockZeroMQStream) AddProducer(producers ...core.Producer) {}
+func (stream *mockZeroMQStream) GetProducers() []core.Producer          { return nil }
+
+func (stream *mockZeroMQStream) Enqueue(msg core.Message) {
+	stream.guard.Lock()
+	defer stream.guard.Unlock()
+	stream.messages = append(stream.messages, msg)
+}
+
+// wait blocks until the given number of messages has been received and
+// returns their payloads prefixed by the zmq_topic metadata.
+func (stream *mockZeroMQStream) wait(expect shared.Expect, count int) []string {
+	expect.NonBlocking(5*time.Second, func() {
+		for {
+			stream.guard.Lock()
+			received := len(stream.messages)
+			stream.guard.Unlock()
+			if received >= count {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	})
+
+	stream.guard.Lock()
+	defer stream.guard.Unlock()
+	payloads := []string{}
+	for _, msg := range stream.messages {
+		payloads = append(payloads, msg.Metadata[zeromqMetadataTopic]+" "+string(msg.Data))
+	}
+	return payloads
+}
+
+func TestZeroMQConsumerSub(t *testing.T) {
+	expect := shared.NewExpect(t)
+
+	pub, err := zmq.NewSocket(zmq.XPUB)
+	expect.NoError(err)
+	defer pub.Close()
+	pub.SetLinger(0)
+	pub.SetRcvtimeo(5 * time.Second)
+	expect.NoError(pub.Bind("tcp://127.0.0.1:*"))
+	endpoint, err := pub.GetLastEndpoint()
+	expect.NoError(err)
+
+	stream := &mockZeroMQStream{}
+	core.StreamRegistry.Register(stream, core.GetStreamID("zeromqSub"))
+	conf := core.NewPluginConfig("")
+	conf.Stream = []string{"zeromqSub"}
+	conf.Override("Connect", []string{endpoint})
+	conf.Override("Subscribe", []string{"sensor.", "status"})
+	conf.Override("Multipart", "topic")
+	conf.Override("Separator", ",")
+	conf.Override("RetryDelayMs", 10)
+	plugin, err := core.NewPluginWithType("native.ZeroMQConsumer", conf)
+	expect.NoError(err)
+	cons, casted := plugin.(*ZeroMQConsumer)
+	expect.True(casted)
+
+	workers := new(sync.WaitGroup)
+	go cons.Consume(workers)
+
+	subscriptions := []string{}
+	for len(subscriptions) < 2 {
+		subscription, err := pub.Recv(0)
+		expect.NoError(err)
+		if err != nil {
+			break
+		}
+		subscriptions = append(subscriptions, subscription)
+	}
+	expect.Equal([]string{"\x01sensor.", "\x01status"}, subscriptions)
+
+	long := strings.Repeat("x", 300)
+	_, err = pub.SendMessage("sensor.a", "1", "2")
+	expect.NoError(err)
+	_, err = pub.SendMessage("other", "dropped")
+	expect.NoError(err)
+	_, err = pub.SendMessage("status", long)
+	expect.NoError(err)
+
+	expect.Equal([]string{"sensor.a 1,2", "status " + long}, stream.wait(expect, 2))
+	expect.Equal("127.0.0.1", stream.messages[0].Metadata[core.MetadataSourceAddress])
+
+	cons.Control() <- core.PluginControlStopConsumer
+	expect.NonBlocking(2*time.Second, workers.Wait)
+}
+
+func TestZeroMQConsumerPull(t *testing.T) {
+	expect := shared.NewExpect(t)
+
+	dir, err := ioutil.TempDir("", "gollum_zeromq")
+	expect.NoError(err)
+	defer os.RemoveAll(dir)
+	endpoint := "ipc://" + filepath.Join(dir, "pull.sock")
+
+	stream := &mockZeroMQStream{}
+	core.StreamRegistry.Register(stream, core.GetStreamID("zeromqPull"))
+	conf := core.NewPluginConfig("")
+	conf.Stream = []string{"zeromqPull"}
+	conf.Override("Bind", []string{endpoint})
+	conf.Override("Socket", "pull")
+	conf.Override("Multipart", "split")
+	plugin, err := core.NewPluginWithType("native.ZeroMQConsumer", conf)
+	expect.NoError(err)
+	cons, casted := plugin.(*ZeroMQConsumer)
+	expect.True(casted)
+
+	workers := new(sync.WaitGroup)
+	go cons.Consume(workers)
+
+	push, err := zmq.NewSocket(zmq.PUSH)
+	expect.NoError(err)
+	defer push.Close()
+	push.SetLinger(0)
+	expect.NoError(push.Connect(endpoint))
+	_, err = push.SendMessage("a", "b")
+	expect.NoError(err)
+	_, err = push.SendMessage("c")
+	expect.NoError(err)
+
+	expect.Equal([]string{" a", " b", " c"}, stream.wait(expect, 3))
+
+	cons.Control() <- core.PluginControlStopConsumer
+	expect.NonBlocking(2*time.Second, workers.Wait)
+}
+
+func TestZeroMQConsumerCurve(t *testing.T) {
+	expect := shared.NewExpect(t)
+
+	dir, err := ioutil.TempDir("", "gollum_zeromq")
+	expect.NoError(err)
+	defer os.RemoveAll(dir)
+	serverEndpoint := "ipc://" + filepath.Join(dir, "server.sock")
+	clientEndpoint := "ipc://" + filepath.Join(dir, "client.sock")
+	certificate := filepath.Join(dir, "server.key_secret")
+	expect.NoError(ioutil.WriteFile(certificate, []byte("#   ZeroMQ CURVE **Secret** Certificate\n"+
+		"metadata\ncurve\n    public-key = \""+zeromqTestServerPublic+"\"\n    secret-key = \""+zeromqTestServerSecret+"\"\n"), 0600))
+
+	// The consumer acts as CURVE server and only accepts the test client
+	serverStream := &mockZeroMQStream{}
+	core.StreamRegistry.Register(serverStream, core.GetStreamID("zeromqCurveServer"))
+	conf := core.NewPluginConfig("")
+	conf.Stream = []string{"zeromqCurveServer"}
+	conf.Override("Bind", []string{serverEndpoint})
+	conf.Override("Socket", "pull")
+	conf.Override("CurveServer", true)
+	conf.Override("CurveSecretKeyFile", certificate)
+	conf.Override("CurveClientKeys", []string{zeromqTestClientPublic})
+	plugin, err := core.NewPluginWithType("native.ZeroMQConsumer", conf)
+	expect.NoError(err)
+	server, casted := plugin.(*ZeroMQConsumer)
+	expect.True(casted)
+	expect.Equal(zeromqTestServerPublic, server.curvePublicKey)
+
+	// The consumer acts as CURVE client with a generated key
+	clientStream := &mockZeroMQStream{}
+	core.StreamRegistry.Register(clientStream, core.GetStreamID("zeromqCurveClient"))
+	conf = core.NewPluginConfig("")
+	conf.Stream = []string{"zeromqCurveClient"}
+	conf.Override("Connect", []string{clientEndpoint})
+	conf.Override("Socket", "pull")
+	conf.Override("CurveServerKey", zeromqTestServerPublic)
+	conf.Override("RetryDelayMs", 10)
+	plugin, err = core.NewPluginWithType("native.ZeroMQConsumer", conf)
+	expect.NoError(err)
+	client, casted := plugin.(*ZeroMQConsumer)
+	expect.True(casted)
+
+	zmq.AuthCurveAdd("gollum.test", zmq.CURVE_ALLOW_ANY)
+	workers := new(sync.WaitGroup)
+	go server.Consume(workers)
+	go client.Consume(workers)
+
+	push, err := zmq.NewSocket(zmq.PUSH)
+	expect.NoError(err)
+	defer push.Close()
+	push.SetLinger(0)
+	expect.NoError(push.ClientAuthCurve(zeromqTestServerPublic, zeromqTestClientPublic, zeromqTestClientSecret))
+	expect.NoError(push.Connect(serverEndpoint))
+	_, err = push.SendMessage("hello", " world")
+	expect.NoError(err)
+
+	// Unknown clients and clients without encryption are rejected
+	unknownPublic, unknownSecret, err := zmq.NewCurveKeypair()
+	expect.NoError(err)
+	unknown, err := zmq.NewSocket(zmq.PUSH)
+	expect.NoError(err)
+	defer unknown.Close()
+	unknown.SetLinger(0)
+	expect.NoError(unknown.ClientAuthCurve(zeromqTestServerPublic, unknownPublic, unknownSecret))
+	expect.NoError(unknown.Connect(serverEndpoint))
+	_, err = unknown.SendMessage("unknown")
+	expect.NoError(err)
+
+	plain, err := zmq.NewSocket(zmq.PUSH)
+	expect.NoError(err)
+	defer plain.Close()
+	plain.SetLinger(0)
+	expect.NoError(plain.Connect(serverEndpoint))
+	_, err = plain.SendMessage("plain")
+	expect.NoError(err)
+
+	pusher, err := zmq.NewSocket(zmq.PUSH)
+	expect.NoError(err)
+	defer pusher.Close()
+	pusher.SetLinger(0)
+	expect.NoError(pusher.ServerAuthCurve("gollum.test", zeromqTestServerSecret))
+	expect.NoError(pusher.Bind(clientEndpoint))
+	_, err = pusher.SendMessage("secret")
+	expect.NoError(err)
+
+	expect.Equal([]string{" secret"}, clientStream.wait(expect, 1))
+
+	// Give rejected clients time to deliver their messages
+	time.Sleep(100 * time.Millisecond)
+	expect.Equal([]string{" hello world"}, serverStream.wait(expect, 1))
+
+	server.Control() <- core.PluginControlStopConsumer
+	client.Control() <- core.PluginControlStopConsumer
+	expect.NonBlocking(2*time.Second, workers.Wait)
+}
+
+func TestZeroMQConsumerConfigure(t *testing.T) {
+	expect := shared.NewExpect(t)
+
+	plugin, err := core.NewPluginWithType("native.ZeroMQConsumer", core.NewPluginConfig(""))
+	expect.NoError(err)
+	cons, casted := plugin.(*ZeroMQConsumer)
+	expect.True(casted)
+	expect.Equal([]string{"tcp://localhost:5556"}, cons.connect)
+	expect.Equal(zmq.SUB, cons.socketType)
+	expect.Equal([]string{""}, cons.subscriptions)
+	expect.Equal("", cons.curveSecretKey)
+
+	conf := core.NewPluginConfig("")
+	conf.Override("Bind", []string{"tcp://*:5557"})
+	conf.Override("CurveServerKey", hex.EncodeToString([]byte(zmq.Z85decode(zeromqTestServerPublic))))
+	plugin, err = core.NewPluginWithType("native.ZeroMQConsumer", conf)
+	expect.NoError(err)
+	cons, casted = plugin.(*ZeroMQConsumer)
+	expect.True(casted)
+	expect.Equal(0, len(cons.connect))
+	expect.Equal(zeromqTestServerPublic, cons.curveServerKey)
+	expect.Equal(40, len(cons.curveSecretKey))
+
+	for _, options := range []map[string]interface{}{
+		{"Socket": "req"},
+		{"Connect": []string{"udp://localhost:5556"}},
+		{"Connect": []string{"localhost:5556"}},
+		{"Connect": []string{"tcp://localhost"}},
+		{"Multipart": "merge"},
+		{"CurveServer": true},
+		{"CurveServerKey": "invalid"},
+		{"CurveServerKey": strings.Repeat("~", 40)},
+		{"CurveServer": true, "CurveSecretKey": zeromqTestServerSecret, "CurveClientKeys": []string{"invalid"}},
+	} {
+		conf := core.NewPluginConfig("")
+		for key, value := range options {
+			conf.Override(key, value)
+		}
+		_, err := core.NewPluginWithType("native.ZeroMQConsumer", conf)
+		expect.NotNil(err)
+	}
+}
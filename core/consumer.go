@@ -86,13 +86,7 @@ func (cons *ConsumerBase) Configure(conf PluginConfig) error {
 	cons.onRoll = nil
 	cons.onStop = nil
 
-	for _, streamName := range conf.Stream {
-		streamID := StreamRegistry.GetStreamID(streamName)
-		cons.streams = append(cons.streams, MappedStream{
-			StreamID: streamID,
-			Stream:   StreamRegistry.GetStreamOrFallback(streamID),
-		})
-	}
+	cons.streams = append(cons.streams, NewMappedStreams(conf.Stream)...)
 
 	fuseName := conf.GetString("Fuse", "")
 	if fuseName != "" {
@@ -209,10 +203,23 @@ func (cons *ConsumerBase) EnqueueCopy(data []byte, sequence uint64) {
 // EnqueueMessage passes a given message  to all streams.
 // Only the StreamID of the message is modified, everything else is passed as-is.
 func (cons *ConsumerBase) EnqueueMessage(msg Message) {
-	for _, mapping := range cons.streams {
-		msg.StreamID = mapping.StreamID
-		msg.PrevStreamID = msg.StreamID
-		mapping.Stream.Enqueue(msg)
+	cons.EnqueueMessageTo(msg, cons.streams)
+}
+
+// EnqueueMessageTo passes a given message to the given streams instead of the
+// streams configured for this consumer. This allows consumers to route
+// messages based on e.g. connection properties.
+// Only the StreamID of the message is modified, everything else is passed as-is.
+func (cons *ConsumerBase) EnqueueMessageTo(msg Message, streams []MappedStream) {
+	lastIdx := len(streams) - 1
+	for i, mapping := range streams {
+		streamMsg := msg
+		if i < lastIdx {
+			streamMsg = msg.CloneMetadata()
+		}
+		streamMsg.StreamID = mapping.StreamID
+		streamMsg.PrevStreamID = streamMsg.StreamID
+		mapping.Stream.Enqueue(streamMsg)
 	}
 }
 
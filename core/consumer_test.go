@@ -82,6 +82,27 @@ func TestConsumerEnqueueCopy(t *testing.T) {
 
 }
 
+func TestConsumerEnqueueMessageTo(t *testing.T) {
+	expect := shared.NewExpect(t)
+	mockC := getMockConsumer()
+	mockC.streams = []MappedStream{}
+
+	mockStream := getMockStream()
+	mockP := getMockProducer()
+	mockStream.AddProducer(&mockP)
+	mockStreamID := StreamRegistry.GetStreamID("mockStream")
+	StreamRegistry.Register(&mockStream, mockStreamID)
+
+	received := 0
+	mockStream.distribute = func(msg Message) {
+		expect.Equal(mockStreamID, msg.StreamID)
+		received++
+	}
+
+	mockC.EnqueueMessageTo(NewMessage(nil, []byte("test"), 0), NewMappedStreams([]string{"mockStream"}))
+	expect.Equal(1, received)
+}
+
 func TestConsumerStreams(t *testing.T) {
 	expect := shared.NewExpect(t)
 	mockC := getMockConsumer()
@@ -14,8 +14,120 @@
 
 package core
 
+import (
+	"fmt"
+	"strings"
+)
+
 // Filter allows custom message filtering for ProducerBase derived plugins.
 // Producers not deriving from ProducerBase might utilize this one, too.
 type Filter interface {
 	Accepts(msg Message) bool
 }
+
+// ReasonFilter extends the Filter interface for filters that can explain why
+// a message has been rejected.
+type ReasonFilter interface {
+	Filter
+
+	// AcceptsWithReason works like Accepts but returns a short description of
+	// the cause if the message is rejected.
+	AcceptsWithReason(msg Message) (bool, string)
+}
+
+// FilterName returns the plugin name of a filter, e.g. "filter.JSON".
+func FilterName(filter Filter) string {
+	return strings.TrimPrefix(fmt.Sprintf("%T", filter), "*")
+}
+
+// AcceptsWithReason calls AcceptsWithReason on ReasonFilters and Accepts on
+// all other filters. If the message is rejected the name of the rejecting
+// filter and the reason are returned. The reason defaults to "rejected".
+func AcceptsWithReason(filter Filter, msg Message) (bool, string, string) {
+	if explaining, isReasonFilter := filter.(ReasonFilter); isReasonFilter {
+		if accepted, reason := explaining.AcceptsWithReason(msg); !accepted {
+			return false, FilterName(filter), reason // ### return, rejected with reason ###
+		}
+		return true, "", ""
+	}
+
+	if !filter.Accepts(msg) {
+		return false, FilterName(filter), "rejected"
+	}
+	return true, "", ""
+}
+
+// RouteFiltered sends a rejected message to the given stream. The name of the
+// filter and the reason are stored in the metadata fields "filter" and
+// "filter_reason". Nothing is done if streamID is InvalidStreamID.
+func RouteFiltered(msg Message, streamID MessageStreamID, filterName string, reason string) {
+	if streamID == InvalidStreamID {
+		return // ### return, not configured ###
+	}
+	msg = msg.CloneMetadata()
+	msg.SetMetadata(MetadataFilter, filterName)
+	msg.SetMetadata(MetadataFilterReason, reason)
+	msg.Route(streamID)
+}
+
+// RollableFilter extends the Filter interface for filters that need to reload
+// external resources, e.g. files, when a roll is requested via SIGHUP.
+type RollableFilter interface {
+	Filter
+
+	// Roll is called when a roll is requested
+	Roll()
+}
+
+// RollFilter calls Roll if the given filter is a RollableFilter.
+func RollFilter(filter Filter) {
+	if rollable, isRollable := filter.(RollableFilter); isRollable {
+		rollable.Roll()
+	}
+}
+
+// NewFilterList creates the filters listed in the given option of a plugin
+// config. Each entry can either be the name of a filter or a map of one filter
+// name to a map of options. These options override the options of the host
+// plugin for this filter only. A list given by key is not passed on to the
+// listed filters.
+func NewFilterList(conf PluginConfig, key string) ([]Filter, error) {
+	entries := conf.GetValue(key, []interface{}{})
+	entryList, isList := entries.([]interface{})
+	if !isList {
+		if names, isStringList := entries.([]string); isStringList {
+			for _, name := range names {
+				entryList = append(entryList, name)
+			}
+		} else {
+			return nil, fmt.Errorf("%s must be a list", key)
+		}
+	}
+
+	filters := make([]Filter, 0, len(entryList))
+	for _, entry := range entryList {
+		name, options, err := parsePluginListEntry(key, entry)
+		if err != nil {
+			return nil, err
+		}
+
+		// Nested lists have to be set explicitly to prevent endless recursion
+		entryConf := overridePluginConfig(conf, options)
+		if _, exists := options[key]; !exists {
+			delete(entryConf.Settings, key)
+		}
+
+		plugin, err := NewPluginWithType(name, entryConf)
+		if err != nil {
+			return nil, err // ### return, plugin load error ###
+		}
+		warnUnknownPluginListKeys(conf, name, options)
+
+		filter, isFilter := plugin.(Filter)
+		if !isFilter {
+			return nil, fmt.Errorf("%s is not a filter", name)
+		}
+		filters = append(filters, filter)
+	}
+	return filters, nil
+}
@@ -14,6 +14,11 @@
 
 package core
 
+import (
+	"github.com/trivago/gollum/shared"
+	"testing"
+)
+
 type mockFilter struct {
 }
 
@@ -24,3 +29,33 @@ func (mf *mockFilter) Accepts(msg Message) bool {
 func (mf *mockFilter) Configure(conf PluginConfig) error {
 	return nil
 }
+
+type mockRejectFilter struct {
+}
+
+func (mf *mockRejectFilter) Accepts(msg Message) bool {
+	return false
+}
+
+func (mf *mockRejectFilter) Configure(conf PluginConfig) error {
+	return nil
+}
+
+func (mf *mockRejectFilter) AcceptsWithReason(msg Message) (bool, string) {
+	return false, "mock reason"
+}
+
+func TestFilterAcceptsWithReason(t *testing.T) {
+	expect := shared.NewExpect(t)
+	msg := NewMessage(nil, []byte("test"), 0)
+
+	accepted, name, reason := AcceptsWithReason(&mockFilter{}, msg)
+	expect.True(accepted)
+	expect.Equal("", name)
+	expect.Equal("", reason)
+
+	accepted, name, reason = AcceptsWithReason(&mockRejectFilter{}, msg)
+	expect.False(accepted)
+	expect.Equal("core.mockRejectFilter", name)
+	expect.Equal("mock reason", reason)
+}
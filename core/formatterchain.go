@@ -0,0 +1,185 @@
+// Copyright 2015-2016 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"fmt"
+	"github.com/trivago/gollum/core/log"
+	"github.com/trivago/gollum/shared"
+)
+
+// FormatterChain is a formatter that applies a list of formatters in order.
+// Each formatter receives the payload and stream returned by the previous one.
+type FormatterChain struct {
+	steps []formatterChainStep
+}
+
+type formatterChainStep struct {
+	formatter     Formatter
+	stopOnReroute bool
+}
+
+// NewFormatter creates the formatter defined by the "Formatter" and
+// "Formatters" options of a plugin config. If "Formatters" is not set, the
+// plugin given by "Formatter" is returned. Otherwise a FormatterChain is
+// created that applies "Formatter" (if set) followed by all formatters listed
+// in "Formatters".
+// Each entry of "Formatters" can either be the name of a formatter or a map of
+// one formatter name to a map of options. These options override the options
+// of the host plugin for this formatter only. The additional option
+// "StopOnReroute" can be set to true to skip all following formatters if the
+// formatter changes the stream of a message, e.g. after routing the message to
+// an error stream.
+func NewFormatter(conf PluginConfig) (Formatter, error) {
+	steps := conf.GetValue("Formatters", nil)
+	if steps == nil {
+		return newFormatterStep(conf.GetString("Formatter", "format.Forward"), conf)
+	}
+
+	stepList, isList := steps.([]interface{})
+	if !isList {
+		return nil, fmt.Errorf("Formatters must be a list")
+	}
+
+	chain := &FormatterChain{}
+	if conf.HasValue("Formatter") {
+		formatter, err := newFormatterStep(conf.GetString("Formatter", "format.Forward"), conf)
+		if err != nil {
+			return nil, err
+		}
+		chain.steps = append(chain.steps, formatterChainStep{formatter: formatter})
+	}
+
+	for _, step := range stepList {
+		name, options, err := parsePluginListEntry("Formatters", step)
+		if err != nil {
+			return nil, err
+		}
+
+		stopOnReroute := false
+		if _, exists := options["StopOnReroute"]; exists {
+			if stopOnReroute, err = options.Bool("StopOnReroute"); err != nil {
+				return nil, err
+			}
+		}
+
+		stepConf := overridePluginConfig(conf, options, "StopOnReroute")
+		formatter, err := newFormatterStep(name, stepConf)
+		if err != nil {
+			return nil, err
+		}
+		warnUnknownPluginListKeys(conf, name, options, "StopOnReroute")
+
+		chain.steps = append(chain.steps, formatterChainStep{
+			formatter:     formatter,
+			stopOnReroute: stopOnReroute,
+		})
+	}
+
+	return chain, nil
+}
+
+// parsePluginListEntry returns the plugin name and options of an entry of a
+// plugin list like "Formatters".
+func parsePluginListEntry(key string, entry interface{}) (string, shared.MarshalMap, error) {
+	switch value := entry.(type) {
+	case string:
+		return value, shared.NewMarshalMap(), nil
+
+	case map[interface{}]interface{}, map[string]interface{}:
+		wrapper, err := shared.MarshalMap{"entry": value}.MarshalMap("entry")
+		if err != nil || len(wrapper) != 1 {
+			return "", nil, fmt.Errorf("%s entries must contain exactly one plugin", key)
+		}
+		for name := range wrapper {
+			if wrapper[name] == nil {
+				return name, shared.NewMarshalMap(), nil // ### return, no options ###
+			}
+			options, err := wrapper.MarshalMap(name)
+			if err != nil {
+				return "", nil, fmt.Errorf("Options of %s entry %s must be a map", key, name)
+			}
+			return name, options, nil
+		}
+	}
+
+	return "", nil, fmt.Errorf("%s entries must be a plugin name or a map", key)
+}
+
+// overridePluginConfig returns a copy of conf with the given options applied.
+// Options listed in reserved are not copied.
+func overridePluginConfig(conf PluginConfig, options shared.MarshalMap, reserved ...string) PluginConfig {
+	entryConf := conf
+	entryConf.Settings = shared.NewMarshalMap()
+	for key, value := range conf.Settings {
+		entryConf.Settings[key] = value
+	}
+
+	for key, value := range options {
+		if !isReservedPluginListKey(key, reserved) {
+			entryConf.Settings[key] = value
+		}
+	}
+	return entryConf
+}
+
+// warnUnknownPluginListKeys prints a warning for all options of a plugin list
+// entry that have not been read by the plugin.
+func warnUnknownPluginListKeys(conf PluginConfig, name string, options shared.MarshalMap, reserved ...string) {
+	for key := range options {
+		if _, exists := conf.validKeys[key]; !exists && !isReservedPluginListKey(key, reserved) {
+			Log.Warning.Printf("Unknown configuration key in %s plugin %s: %s", conf.Typename, name, key)
+		}
+	}
+}
+
+func isReservedPluginListKey(key string, reserved []string) bool {
+	for _, reservedKey := range reserved {
+		if key == reservedKey {
+			return true
+		}
+	}
+	return false
+}
+
+func newFormatterStep(name string, conf PluginConfig) (Formatter, error) {
+	plugin, err := NewPluginWithType(name, conf)
+	if err != nil {
+		return nil, err // ### return, plugin load error ###
+	}
+	formatter, isFormatter := plugin.(Formatter)
+	if !isFormatter {
+		return nil, fmt.Errorf("%s is not a formatter", name)
+	}
+	return formatter, nil
+}
+
+// Format applies all formatters of the chain in order. Formatting stops if a
+// message is dropped or if a formatter set to StopOnReroute changes the
+// stream of a message.
+func (chain *FormatterChain) Format(msg Message) ([]byte, MessageStreamID) {
+	for _, step := range chain.steps {
+		data, streamID := step.formatter.Format(msg)
+		msg.Data = data
+		if streamID != msg.StreamID {
+			msg.PrevStreamID = msg.StreamID
+			msg.StreamID = streamID
+			if streamID == DroppedStreamID || step.stopOnReroute {
+				break // ### break, stop formatting ###
+			}
+		}
+	}
+	return msg.Data, msg.StreamID
+}
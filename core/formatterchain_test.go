@@ -0,0 +1,113 @@
+// Copyright 2015-2016 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"github.com/trivago/gollum/shared"
+	"testing"
+)
+
+type mockAppendFormatter struct {
+	suffix   string
+	streamID MessageStreamID
+}
+
+func (mock *mockAppendFormatter) Format(msg Message) ([]byte, MessageStreamID) {
+	data := append(append([]byte{}, msg.Data...), mock.suffix...)
+	if mock.streamID != InvalidStreamID {
+		return data, mock.streamID
+	}
+	return data, msg.StreamID
+}
+
+func (mock *mockAppendFormatter) Configure(conf PluginConfig) error {
+	mock.suffix = conf.GetString("MockSuffix", "")
+	mock.streamID = InvalidStreamID
+	if stream := conf.GetString("MockStream", ""); stream != "" {
+		mock.streamID = StreamRegistry.GetStreamID(stream)
+	}
+	return nil
+}
+
+func TestFormatterChain(t *testing.T) {
+	expect := shared.NewExpect(t)
+	shared.TypeRegistry.Register(mockAppendFormatter{})
+
+	conf := NewPluginConfig("")
+	conf.Override("Formatter", "core.mockAppendFormatter")
+	conf.Override("MockSuffix", "a")
+
+	formatter, err := NewFormatter(conf)
+	expect.NoError(err)
+	_, isChain := formatter.(*FormatterChain)
+	expect.False(isChain)
+
+	conf.Override("Formatters", []interface{}{
+		"core.mockAppendFormatter",
+		map[interface{}]interface{}{
+			"core.mockAppendFormatter": map[interface{}]interface{}{
+				"MockSuffix": "b",
+			},
+		},
+	})
+
+	formatter, err = NewFormatter(conf)
+	expect.NoError(err)
+
+	msg := NewMessage(nil, []byte("x"), 0)
+	msg.StreamID = StreamRegistry.GetStreamID("chainIn")
+	data, streamID := formatter.Format(msg)
+	expect.Equal("xaab", string(data))
+	expect.Equal(msg.StreamID, streamID)
+}
+
+func TestFormatterChainStopOnReroute(t *testing.T) {
+	expect := shared.NewExpect(t)
+	shared.TypeRegistry.Register(mockAppendFormatter{})
+
+	conf := NewPluginConfig("")
+	conf.Override("Formatters", []interface{}{
+		map[interface{}]interface{}{
+			"core.mockAppendFormatter": map[interface{}]interface{}{
+				"MockSuffix":    "a",
+				"MockStream":    "chainError",
+				"StopOnReroute": true,
+			},
+		},
+		map[interface{}]interface{}{
+			"core.mockAppendFormatter": map[interface{}]interface{}{
+				"MockSuffix": "b",
+			},
+		},
+	})
+
+	formatter, err := NewFormatter(conf)
+	expect.NoError(err)
+
+	msg := NewMessage(nil, []byte("x"), 0)
+	msg.StreamID = StreamRegistry.GetStreamID("chainIn")
+	data, streamID := formatter.Format(msg)
+	expect.Equal("xa", string(data))
+	expect.Equal(StreamRegistry.GetStreamID("chainError"), streamID)
+
+	conf.Override("Formatters", []interface{}{"core.mockFilter"})
+	shared.TypeRegistry.Register(mockFilter{})
+	_, err = NewFormatter(conf)
+	expect.NotNil(err)
+
+	conf.Override("Formatters", "core.mockAppendFormatter")
+	_, err = NewFormatter(conf)
+	expect.NotNil(err)
+}
@@ -17,6 +17,7 @@ package core
 import (
 	"github.com/golang/protobuf/proto"
 	"github.com/trivago/gollum/shared"
+	"sync/atomic"
 	"time"
 )
 
@@ -41,6 +42,33 @@ const (
 	MessageStateDiscard = MessageState(iota)
 )
 
+const (
+	// MetadataSourceAddress is the metadata key used by network based
+	// consumers to store the address of the client sending a message
+	MetadataSourceAddress = "source_address"
+
+	// MetadataClientCommonName is the metadata key used by TLS enabled
+	// consumers to store the common name of a verified client certificate
+	MetadataClientCommonName = "client_cn"
+
+	// MetadataClientSAN is the metadata key used by TLS enabled consumers to
+	// store the comma separated subject alternative names (DNS names, email
+	// addresses and URIs) of a verified client certificate
+	MetadataClientSAN = "client_san"
+
+	// MetadataFileName is the metadata key used by file based consumers to
+	// store the path of the file a message was read from
+	MetadataFileName = "file_name"
+
+	// MetadataFilter is the metadata key used to store the name of the filter
+	// that rejected a message passed to a DroppedToStream
+	MetadataFilter = "filter"
+
+	// MetadataFilterReason is the metadata key used to store why a message
+	// passed to a DroppedToStream was rejected
+	MetadataFilterReason = "filter_reason"
+)
+
 var (
 	// LogInternalStreamID is the ID of the "_GOLLUM_" stream
 	LogInternalStreamID = StreamRegistry.GetStreamID(LogInternalStream)
@@ -52,6 +80,9 @@ var (
 	InvalidStreamID = MessageStreamID(0)
 )
 
+// metadataWriters is set to 1 by RegisterMetadataWriter
+var metadataWriters int32
+
 // MessageSource defines methods that are common to all message sources.
 // Currently this is only a placeholder.
 type MessageSource interface {
@@ -93,10 +124,18 @@ type LinkableMessageSource interface {
 	IsLinked() bool
 }
 
+// MessageMetadata stores additional key/value pairs attached to a message,
+// e.g. the address of the sender or values extracted by a formatter.
+// Metadata is nil until the first value is written and is shared between
+// copies of a message. Plugins that pass a message to more than one receiver
+// have to pass a clone of the metadata to all but one of them.
+type MessageMetadata map[string]string
+
 // Message is a container used for storing the internal state of messages.
 // This struct is passed between consumers and producers.
 type Message struct {
 	Data         []byte
+	Metadata     MessageMetadata
 	StreamID     MessageStreamID
 	PrevStreamID MessageStreamID
 	Source       MessageSource
@@ -116,6 +155,51 @@ func NewMessage(source MessageSource, data []byte, sequence uint64) Message {
 	}
 }
 
+// RegisterMetadataWriter has to be called by filters and formatters that
+// write metadata to the messages passed to them, usually when configured.
+// Such plugins receive a copy of the message, so values written to
+// metadata that is still nil would be lost.
+func RegisterMetadataWriter() {
+	atomic.StoreInt32(&metadataWriters, 1)
+}
+
+// SetMetadata stores a metadata value and allocates the metadata if required.
+func (msg *Message) SetMetadata(key string, value string) {
+	if msg.Metadata == nil {
+		msg.Metadata = make(MessageMetadata)
+	}
+	msg.Metadata[key] = value
+}
+
+// PrepareMetadata allocates the metadata of a message if a plugin has called
+// RegisterMetadataWriter. This is done by streams and producers before a
+// message is passed to filters and formatters.
+func (msg *Message) PrepareMetadata() {
+	if msg.Metadata == nil && atomic.LoadInt32(&metadataWriters) != 0 {
+		msg.Metadata = make(MessageMetadata)
+	}
+}
+
+// Clone returns a copy of the metadata that can be modified independently.
+// Empty metadata is not copied, nil is returned instead.
+func (meta MessageMetadata) Clone() MessageMetadata {
+	if len(meta) == 0 {
+		return nil // ### return, nothing to copy ###
+	}
+	clone := make(MessageMetadata, len(meta))
+	for key, value := range meta {
+		clone[key] = value
+	}
+	return clone
+}
+
+// CloneMetadata returns a copy of the message with a copy of the metadata.
+// Use this function when passing the same message to multiple receivers.
+func (msg Message) CloneMetadata() Message {
+	msg.Metadata = msg.Metadata.Clone()
+	return msg
+}
+
 // String implements the stringer interface
 func (msg Message) String() string {
 	return string(msg.Data)
@@ -182,6 +266,7 @@ func (msg Message) Serialize() ([]byte, error) {
 		Timestamp:    proto.Int64(msg.Timestamp.UnixNano()),
 		Sequence:     proto.Uint64(msg.Sequence),
 		Data:         msg.Data,
+		Metadata:     msg.Metadata,
 	}
 
 	return proto.Marshal(serializable)
@@ -199,6 +284,7 @@ func DeserializeMessage(data []byte) (Message, error) {
 		Timestamp:    time.Unix(0, serializable.GetTimestamp()),
 		Sequence:     serializable.GetSequence(),
 		Data:         serializable.GetData(),
+		Metadata:     MessageMetadata(serializable.GetMetadata()),
 	}
 
 	return msg, err
@@ -22,12 +22,13 @@ var _ = proto.Marshal
 var _ = math.Inf
 
 type SerializedMessage struct {
-	StreamID         *uint64 `protobuf:"varint,1,req" json:"StreamID,omitempty"`
-	PrevStreamID     *uint64 `protobuf:"varint,2,req" json:"PrevStreamID,omitempty"`
-	Timestamp        *int64  `protobuf:"varint,3,req" json:"Timestamp,omitempty"`
-	Sequence         *uint64 `protobuf:"varint,4,req" json:"Sequence,omitempty"`
-	Data             []byte  `protobuf:"bytes,5,req" json:"Data,omitempty"`
-	XXX_unrecognized []byte  `json:"-"`
+	StreamID         *uint64           `protobuf:"varint,1,req" json:"StreamID,omitempty"`
+	PrevStreamID     *uint64           `protobuf:"varint,2,req" json:"PrevStreamID,omitempty"`
+	Timestamp        *int64            `protobuf:"varint,3,req" json:"Timestamp,omitempty"`
+	Sequence         *uint64           `protobuf:"varint,4,req" json:"Sequence,omitempty"`
+	Data             []byte            `protobuf:"bytes,5,req" json:"Data,omitempty"`
+	Metadata         map[string]string `protobuf:"bytes,6,rep" json:"Metadata,omitempty" protobuf_key:"bytes,1,opt,name=key" protobuf_val:"bytes,2,opt,name=value"`
+	XXX_unrecognized []byte            `json:"-"`
 }
 
 func (m *SerializedMessage) Reset()         { *m = SerializedMessage{} }
@@ -69,6 +70,13 @@ func (m *SerializedMessage) GetData() []byte {
 	return nil
 }
 
+func (m *SerializedMessage) GetMetadata() map[string]string {
+	if m != nil {
+		return m.Metadata
+	}
+	return nil
+}
+
 func init() {
 	shared.TypeRegistry.Register(SerializedMessage{})
 }
@@ -74,3 +74,20 @@ func TestMessageRoute(t *testing.T) {
 	msg.Route(1)
 
 }
+
+func TestMessageCloneMetadata(t *testing.T) {
+	expect := shared.NewExpect(t)
+	msg := NewMessage(nil, []byte("test"), 0)
+	expect.Nil(msg.Metadata)
+	expect.Nil(msg.CloneMetadata().Metadata)
+
+	msg.SetMetadata("key", "value")
+
+	clone := msg.CloneMetadata()
+	clone.Metadata["key"] = "changed"
+	clone.Metadata["other"] = "value"
+
+	expect.MapEqual(msg.Metadata, "key", "value")
+	expect.MapNotSet(msg.Metadata, "other")
+	expect.MapEqual(clone.Metadata, "key", "changed")
+}
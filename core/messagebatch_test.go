@@ -176,6 +176,7 @@ func TestMessageSerialize(t *testing.T) {
 		Timestamp:    now,
 		Sequence:     4,
 		Data:         []byte("This is a\nteststring"),
+		Metadata:     MessageMetadata{"key": "value"},
 	}
 
 	data, err := testMessage.Serialize()
@@ -198,7 +199,8 @@ func TestMessageSerialize(t *testing.T) {
 
 	expect.Equal(readMessage.StreamID, testMessage.StreamID)
 	expect.Equal(readMessage.PrevStreamID, testMessage.PrevStreamID)
-	expect.Equal(readMessage.Timestamp, testMessage.Timestamp)
+	expect.True(readMessage.Timestamp.Equal(testMessage.Timestamp))
 	expect.Equal(readMessage.Sequence, testMessage.Sequence)
 	expect.Equal(readMessage.Data, testMessage.Data)
+	expect.Equal(readMessage.Metadata, testMessage.Metadata)
 }
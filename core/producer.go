@@ -70,8 +70,14 @@ type Producer interface {
 //    ChannelTimeoutMs: 0
 //    ShutdownTimeoutMs: 3000
 //    Formatter: "format.Forward"
+//    Formatters:
+//      - "format.Envelope"
 //    Filter: "filter.All"
+//    Filters:
+//      - "filter.Severity":
+//          SeverityThreshold: "error"
 //    DropToStream: "_DROPPED_"
+//    DroppedToStream: ""
 //    Fuse: ""
 //    FuseTimeoutSec: 5
 //    Stream:
@@ -110,11 +116,29 @@ type Producer interface {
 // which can be set here, too. By default this is set to format.Forward.
 // Each producer decides if and when to use a Formatter.
 //
+// Formatters defines a list of formatters that are applied in order after
+// Formatter. Each entry is either a formatter name or a map of a formatter name
+// to its options, which override the producer's options for this formatter
+// only. Setting the option StopOnReroute to true skips all following
+// formatters if the formatter changes the stream of a message. By default this
+// list is empty.
+//
 // Filter sets a filter that is applied before formatting, i.e. before a message
 // is send to the message queue. If a producer requires filtering after
 // formatting it has to define a separate filter as the producer decides if
 // and where to format.
 //
+// Filters defines a list of filters that are applied after Filter. A message
+// has to pass all filters to be sent to the message queue. Each entry is
+// either a filter name or a map of a filter name to its options, which override
+// the producer's options for this filter only. By default this list is empty.
+//
+// DroppedToStream defines a stream that receives all messages rejected by
+// Filter or Filters, e.g. for auditing. The name of the filter and the reason
+// are stored in the metadata fields "filter" and "filter_reason". This is done
+// in addition to any drop stream configured for the filter itself.
+// By default this is set to "", which discards these messages.
+//
 // Fuse defines the name of a fuse to burn if e.g. the producer encounteres a
 // lost connection. Each producer defines its own fuse breaking logic if
 // necessary / applyable. Disable fuse behavior for a producer by setting an
@@ -128,6 +152,7 @@ type ProducerBase struct {
 	control          chan PluginControl
 	streams          []MessageStreamID
 	dropStreamID     MessageStreamID
+	filteredStreamID MessageStreamID
 	dependencies     []Producer
 	runState         *PluginRunState
 	timeout          time.Duration
@@ -146,11 +171,11 @@ type ProducerBase struct {
 // Configure initializes the standard producer config values.
 func (prod *ProducerBase) Configure(conf PluginConfig) error {
 	prod.runState = NewPluginRunState()
-	format, err := NewPluginWithType(conf.GetString("Formatter", "format.Forward"), conf)
+	format, err := NewFormatter(conf)
 	if err != nil {
 		return err // ### return, plugin load error ###
 	}
-	prod.format = format.(Formatter)
+	prod.format = format
 
 	filters := conf.GetStringArray("Filter", []string{})
 	for _, filterName := range filters {
@@ -165,6 +190,12 @@ func (prod *ProducerBase) Configure(conf PluginConfig) error {
 		prod.filters = append(prod.filters, filter)
 	}
 
+	listedFilters, err := NewFilterList(conf, "Filters")
+	if err != nil {
+		return err
+	}
+	prod.filters = append(prod.filters, listedFilters...)
+
 	prod.streams = make([]MessageStreamID, len(conf.Stream))
 	prod.control = make(chan PluginControl, 1)
 	prod.messages = make(chan Message, conf.GetInt("Channel", 8192))
@@ -173,6 +204,10 @@ func (prod *ProducerBase) Configure(conf PluginConfig) error {
 	prod.fuseTimeout = time.Duration(conf.GetInt("FuseTimeoutSec", 10)) * time.Second
 	prod.fuseName = conf.GetString("Fuse", "")
 	prod.dropStreamID = StreamRegistry.GetStreamID(conf.GetString("DropToStream", DroppedStream))
+	prod.filteredStreamID = InvalidStreamID
+	if droppedToStream := conf.GetString("DroppedToStream", ""); droppedToStream != "" {
+		prod.filteredStreamID = StreamRegistry.GetStreamID(droppedToStream)
+	}
 	prod.fuseControlGuard = new(sync.Mutex)
 
 	prod.onRoll = nil
@@ -339,12 +374,19 @@ func (prod *ProducerBase) GetFormatter() Formatter {
 
 // Accepts returns false if one filter in the list returns false
 func (prod *ProducerBase) Accepts(msg Message) bool {
+	accepted, _, _ := prod.acceptsWithReason(msg)
+	return accepted
+}
+
+// acceptsWithReason checks all filters and returns the name of the rejecting
+// filter and the reason if a message is rejected.
+func (prod *ProducerBase) acceptsWithReason(msg Message) (bool, string, string) {
 	for _, filter := range prod.filters {
-		if !filter.Accepts(msg) {
-			return false
+		if accepted, filterName, reason := AcceptsWithReason(filter, msg); !accepted {
+			return false, filterName, reason
 		}
 	}
-	return true
+	return true, "", ""
 }
 
 // GetFilter returns the first filter of this producer
@@ -403,10 +445,13 @@ func (prod *ProducerBase) Enqueue(msg Message, timeout *time.Duration) {
 		}
 	}()
 
+	msg.PrepareMetadata()
+
 	// Filtering happens before formatting. If fitering AFTER formatting is
 	// required, the producer has to do so as it decides where to format.
-	if !prod.Accepts(msg) {
+	if accepted, filterName, reason := prod.acceptsWithReason(msg); !accepted {
 		CountFilteredMessage()
+		RouteFiltered(msg, prod.filteredStreamID, filterName, reason)
 		return // ### return, filtered ###
 	}
 
@@ -567,6 +612,9 @@ func (prod *ProducerBase) ControlLoop() {
 
 		case PluginControlRoll:
 			Log.Debug.Print("Received roll command")
+			for _, filter := range prod.filters {
+				RollFilter(filter)
+			}
 			if prod.onRoll != nil {
 				prod.onRoll()
 			}
@@ -74,6 +74,37 @@ func TestProducerConfigure(t *testing.T) {
 	expect.NoError(err)
 }
 
+func TestProducerFilters(t *testing.T) {
+	expect := shared.NewExpect(t)
+
+	mockProducer := mockProducer{}
+
+	shared.TypeRegistry.Register(mockFormatter{})
+	shared.TypeRegistry.Register(mockFilter{})
+	shared.TypeRegistry.Register(mockRejectFilter{})
+	mockConf := NewPluginConfig("core.mockPlugin")
+	mockConf.Stream = []string{"testBoundStream"}
+	mockConf.Settings["Formatter"] = "core.mockFormatter"
+	mockConf.Settings["Filter"] = "core.mockFilter"
+	mockConf.Settings["Filters"] = []interface{}{
+		"core.mockFilter",
+		map[interface{}]interface{}{"core.mockRejectFilter": nil},
+	}
+
+	err := mockProducer.Configure(mockConf)
+	expect.NoError(err)
+	expect.Equal(3, len(mockProducer.filters))
+
+	accepted, filterName, reason := mockProducer.acceptsWithReason(NewMessage(nil, []byte("test"), 0))
+	expect.False(accepted)
+	expect.Equal("core.mockRejectFilter", filterName)
+	expect.Equal("mock reason", reason)
+
+	mockConf.Settings["Filters"] = "core.mockFilter"
+	err = mockProducer.Configure(mockConf)
+	expect.NotNil(err)
+}
+
 func TestProducerState(t *testing.T) {
 	expect := shared.NewExpect(t)
 
@@ -48,12 +48,45 @@ type Stream interface {
 	GetProducers() []Producer
 }
 
+// BatchedStream extends the Stream interface for streams that collect
+// messages before passing them on to the producers.
+type BatchedStream interface {
+	Stream
+
+	// FlushBatch passes all collected messages to the producers. This is
+	// called during shutdown after all consumers have been stopped.
+	FlushBatch()
+}
+
+// RollableStream extends the Stream interface for streams that pass roll
+// requests (SIGHUP) on to their filters.
+type RollableStream interface {
+	Stream
+
+	// Roll passes a roll request to the filter of this stream.
+	Roll()
+}
+
 // MappedStream holds a stream and the id the stream is assgined to
 type MappedStream struct {
 	StreamID MessageStreamID
 	Stream   Stream
 }
 
+// NewMappedStreams returns a list of mapped streams for the given stream names.
+// Streams that are not yet registered are handled by GetStreamOrFallback.
+func NewMappedStreams(streamNames []string) []MappedStream {
+	streams := make([]MappedStream, 0, len(streamNames))
+	for _, streamName := range streamNames {
+		streamID := StreamRegistry.GetStreamID(streamName)
+		streams = append(streams, MappedStream{
+			StreamID: streamID,
+			Stream:   StreamRegistry.GetStreamOrFallback(streamID),
+		})
+	}
+	return streams
+}
+
 // StreamBase plugin base type
 // This type defines the standard stream implementation. New stream types
 // should derive from this class.
@@ -66,7 +99,10 @@ type MappedStream struct {
 //    Enable: true
 //    Stream: "streamToConfigure"
 //    Formatter: "format.Forward"
+//    Formatters:
+//      - "format.Envelope"
 //    Filter: "filter.All"
+//    DroppedToStream: ""
 //    TimeoutMs: 0
 //
 // Enable can be set to false to disable this stream configuration but leave
@@ -78,22 +114,35 @@ type MappedStream struct {
 // Formatter defines the first formatter to apply to the messages passing through
 // this stream. By default this is set to "format.Forward".
 //
+// Formatters defines a list of formatters that are applied in order after
+// Formatter. Each entry is either a formatter name or a map of a formatter name
+// to its options, which override the stream's options for this formatter only.
+// Setting the option StopOnReroute to true skips all following formatters if
+// the formatter changes the stream of a message. By default this list is empty.
+//
 // Filter defines the filter to apply to the messages passing through this stream.
 // By default this is et to "filter.All".
 //
+// DroppedToStream defines a stream that receives all messages rejected by
+// Filter, e.g. for auditing. The name of the filter and the reason are stored
+// in the metadata fields "filter" and "filter_reason". This is done in
+// addition to any drop stream configured for the filter itself.
+// By default this is set to "", which discards these messages.
+//
 // TimeoutMs defines an optional timeout that can be used to wait for producers
 // attached to this stream to unblock. This setting overwrites the corresponding
 // producer setting for this (and only this) stream.
 type StreamBase struct {
-	Filter         Filter
-	Format         Formatter
-	Producers      []Producer
-	Timeout        *time.Duration
-	boundStreamID  MessageStreamID
-	distribute     Distributor
-	prevDistribute Distributor
-	paused         chan Message
-	resumeWorker   *sync.WaitGroup
+	Filter           Filter
+	Format           Formatter
+	Producers        []Producer
+	Timeout          *time.Duration
+	boundStreamID    MessageStreamID
+	filteredStreamID MessageStreamID
+	distribute       Distributor
+	prevDistribute   Distributor
+	paused           chan Message
+	resumeWorker     *sync.WaitGroup
 }
 
 // Distributor is a callback typedef for methods processing messages
@@ -101,18 +150,22 @@ type Distributor func(msg Message)
 
 // ConfigureStream sets up all values required by StreamBase.
 func (stream *StreamBase) ConfigureStream(conf PluginConfig, distribute Distributor) error {
-	plugin, err := NewPluginWithType(conf.GetString("Formatter", "format.Forward"), conf)
+	format, err := NewFormatter(conf)
 	if err != nil {
 		return err // ### return, plugin load error ###
 	}
-	stream.Format = plugin.(Formatter)
+	stream.Format = format
 
-	plugin, err = NewPluginWithType(conf.GetString("Filter", "filter.All"), conf)
+	plugin, err := NewPluginWithType(conf.GetString("Filter", "filter.All"), conf)
 	if err != nil {
 		return err // ### return, plugin load error ###
 	}
 
 	stream.Filter = plugin.(Filter)
+	stream.filteredStreamID = InvalidStreamID
+	if droppedToStream := conf.GetString("DroppedToStream", ""); droppedToStream != "" {
+		stream.filteredStreamID = StreamRegistry.GetStreamID(droppedToStream)
+	}
 	if len(conf.Stream) == 0 {
 		panic("No source stream configured.")
 	}
@@ -165,6 +218,12 @@ func (stream *StreamBase) GetBoundStreamID() MessageStreamID {
 	return stream.boundStreamID
 }
 
+// GetFilteredStreamID returns the id of the stream rejected messages are sent
+// to. InvalidStreamID is returned if no such stream is configured.
+func (stream *StreamBase) GetFilteredStreamID() MessageStreamID {
+	return stream.filteredStreamID
+}
+
 // Resume causes this stream to send messages again after Pause() had been
 // called. Any buffered messages will be sent by a separate go routine.
 // Calling Resume on a stream that is not paused is ignored.
@@ -192,6 +251,11 @@ func (stream *StreamBase) Flush() {
 	stream.resumeWorker.Wait()
 }
 
+// Roll passes a roll request to the filter of this stream
+func (stream *StreamBase) Roll() {
+	RollFilter(stream.Filter)
+}
+
 // stash is used as a distributor during pause
 func (stream *StreamBase) stash(msg Message) {
 	stream.paused <- msg
@@ -199,8 +263,13 @@ func (stream *StreamBase) stash(msg Message) {
 
 // Broadcast enqueues the given message to all producers attached to this stream.
 func (stream *StreamBase) Broadcast(msg Message) {
-	for _, prod := range stream.Producers {
-		prod.Enqueue(msg, stream.Timeout)
+	lastIdx := len(stream.Producers) - 1
+	for i, prod := range stream.Producers {
+		if i < lastIdx {
+			prod.Enqueue(msg.CloneMetadata(), stream.Timeout)
+		} else {
+			prod.Enqueue(msg, stream.Timeout)
+		}
 	}
 }
 
@@ -208,12 +277,14 @@ func (stream *StreamBase) Broadcast(msg Message) {
 // registered. Functions deriving from StreamBase can set the Distribute member
 // to hook into this function.
 func (stream *StreamBase) Enqueue(msg Message) {
-	if stream.Filter.Accepts(msg) {
+	msg.PrepareMetadata()
+	if accepted, filterName, reason := AcceptsWithReason(stream.Filter, msg); accepted {
 		var streamID MessageStreamID
 		msg.Data, streamID = stream.Format.Format(msg)
 		stream.Route(msg, streamID)
 	} else {
 		CountFilteredMessage()
+		RouteFiltered(msg, stream.filteredStreamID, filterName, reason)
 	}
 }
 
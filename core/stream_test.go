@@ -110,3 +110,29 @@ func TestStreamRoute(t *testing.T) {
 	mockStream.Route(msgToSend, 2)
 
 }
+
+func TestStreamDroppedToStream(t *testing.T) {
+	expect := shared.NewExpect(t)
+
+	droppedStream := getMockStream()
+	droppedStreamID := StreamRegistry.GetStreamID("testDroppedStream")
+	droppedStream.AddProducer(&mockProducer{})
+	StreamRegistry.Register(&droppedStream, droppedStreamID)
+
+	received := 0
+	droppedStream.distribute = func(msg Message) {
+		expect.Equal(droppedStreamID, msg.StreamID)
+		expect.Equal("core.mockRejectFilter", msg.Metadata[MetadataFilter])
+		expect.Equal("mock reason", msg.Metadata[MetadataFilterReason])
+		received++
+	}
+
+	mockStream := getMockStream()
+	mockStream.Filter = &mockRejectFilter{}
+	mockStream.filteredStreamID = droppedStreamID
+
+	msg := NewMessage(nil, []byte("test"), 0)
+	mockStream.Enqueue(msg)
+	expect.Equal(1, received)
+	expect.Equal(0, len(msg.Metadata))
+}
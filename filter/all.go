@@ -20,13 +20,24 @@ import (
 )
 
 // All filter plugin
-// This filter passes all messages.
+// This filter passes messages that are accepted by all of a list of filters.
+// If no filters are given, all messages are passed.
 // Configuration example
 //
 //   - "stream.Broadcast":
 //     Filter: "filter.All"
+//     AllFilter:
+//       - "filter.JSON"
+//       - "filter.RegExp":
+//           FilterExpression: "^ERROR"
 //
+// AllFilter defines a list of filters that all have to accept a message.
+// Filters are checked in order, and if a filter rejects a message no further
+// filters are checked. Each entry can either be the name of a filter or a map
+// of one filter name to a map of options that apply to this filter only.
+// By default this list is empty.
 type All struct {
+	filters []core.Filter
 }
 
 func init() {
@@ -35,10 +46,31 @@ func init() {
 
 // Configure initializes this filter with values from a plugin config.
 func (filter *All) Configure(conf core.PluginConfig) error {
-	return nil
+	var err error
+	filter.filters, err = core.NewFilterList(conf, "AllFilter")
+	return err
 }
 
-// Accepts allows all messages
+// Accepts allows messages accepted by all filters
 func (filter *All) Accepts(msg core.Message) bool {
-	return true
+	accepted, _ := filter.AcceptsWithReason(msg)
+	return accepted
+}
+
+// AcceptsWithReason works like Accepts and returns the name and reason of the
+// first filter rejecting a message.
+func (filter *All) AcceptsWithReason(msg core.Message) (bool, string) {
+	for _, f := range filter.filters {
+		if accepted, name, reason := core.AcceptsWithReason(f, msg); !accepted {
+			return false, name + ": " + reason
+		}
+	}
+	return true, ""
+}
+
+// Roll passes a roll request to all filters
+func (filter *All) Roll() {
+	for _, f := range filter.filters {
+		core.RollFilter(f)
+	}
 }
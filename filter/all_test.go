@@ -33,3 +33,50 @@ func TestFilterAll(t *testing.T) {
 	msg := core.NewMessage(nil, []byte{}, 0)
 	expect.True(filter.Accepts(msg))
 }
+
+func TestFilterAllNested(t *testing.T) {
+	expect := shared.NewExpect(t)
+	conf := core.NewPluginConfig("")
+
+	conf.Override("AllFilter", []interface{}{
+		"filter.RegExp",
+		map[interface{}]interface{}{
+			"filter.Not": map[interface{}]interface{}{
+				"NotFilter": []interface{}{
+					map[interface{}]interface{}{
+						"filter.RegExp": map[interface{}]interface{}{"FilterExpression": "debug"},
+					},
+				},
+			},
+		},
+	})
+	conf.Override("FilterExpression", "^ERROR")
+	plugin, err := core.NewPluginWithType("filter.All", conf)
+	expect.NoError(err)
+
+	filter, casted := plugin.(*All)
+	expect.True(casted)
+	expect.Equal(2, len(filter.filters))
+
+	expect.True(filter.Accepts(core.NewMessage(nil, []byte("ERROR timeout"), 0)))
+	expect.False(filter.Accepts(core.NewMessage(nil, []byte("ERROR debug"), 0)))
+	expect.False(filter.Accepts(core.NewMessage(nil, []byte("INFO timeout"), 0)))
+
+	conf.Override("AllFilter", []interface{}{"format.Forward"})
+	_, err = core.NewPluginWithType("filter.All", conf)
+	expect.NotNil(err)
+}
+
+func TestFilterAllReason(t *testing.T) {
+	expect := shared.NewExpect(t)
+	conf := core.NewPluginConfig("")
+
+	conf.Override("AllFilter", []string{"filter.All", "filter.None"})
+	plugin, err := core.NewPluginWithType("filter.All", conf)
+	expect.NoError(err)
+
+	accepted, name, reason := core.AcceptsWithReason(plugin.(core.Filter), core.NewMessage(nil, []byte{}, 0))
+	expect.False(accepted)
+	expect.Equal("filter.All", name)
+	expect.Equal("filter.None: rejected", reason)
+}
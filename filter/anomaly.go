@@ -0,0 +1,275 @@
+// Copyright 2015-2016 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filter
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/core/log"
+	"github.com/trivago/gollum/shared"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Anomaly filter plugin
+// This plugin tracks the message rate per stream and key and compares it to a
+// baseline, which is the exponentially weighted moving average (EWMA) of the
+// rate of previous time windows. Messages are only passed while the rate
+// deviates from the baseline, or synthetic alert messages are generated
+// instead.
+// Configuration example
+//
+//   - "stream.Broadcast":
+//     Filter: "filter.Anomaly"
+//     AnomalyKey: ""
+//     AnomalyMetadataKey: ""
+//     AnomalyWindowSec: 60
+//     AnomalyAlpha: 0.3
+//     AnomalyFactor: 3
+//     AnomalyMinCount: 10
+//     AnomalyWarmupWindows: 3
+//     AnomalyMaxKeys: 10000
+//     AnomalyMode: "pass"
+//     AnomalyAlertStream: ""
+//
+// AnomalyKey defines a field of a JSON payload used to track separate rates
+// per value of that field. Field paths can be defined in a format accepted by
+// shared.MarshalMap.Path. By default this is set to "".
+//
+// AnomalyMetadataKey defines a metadata key used like AnomalyKey. If both are
+// set, the metadata value is preferred. If neither is set, or a message does
+// not contain the key, one rate per stream is tracked. By default this is set
+// to "".
+//
+// AnomalyWindowSec defines the length of a time window in seconds. The rate is
+// the number of messages per window. By default this is set to 60.
+//
+// AnomalyAlpha defines the weight of the last window when updating the
+// baseline. Values close to 1 follow changes quickly. By default this is set
+// to 0.3.
+//
+// AnomalyFactor defines how much the rate has to deviate from the baseline.
+// A window with more than baseline * factor messages is a spike, a window with
+// less than baseline / factor messages is a drop. By default this is set to 3.
+//
+// AnomalyMinCount defines the minimum baseline required to report anomalies.
+// This prevents alerts for keys with very few messages. By default this is set
+// to 10.
+//
+// AnomalyWarmupWindows defines the number of windows used to build the baseline
+// before anomalies are reported. By default this is set to 3.
+//
+// AnomalyMaxKeys defines the maximum number of keys tracked. If this limit is
+// reached the least recently used key is removed. Set to 0 to disable this
+// limit.
+// By default this is set to 10000.
+//
+// AnomalyMode defines what happens if an anomaly is detected. By default this
+// is set to "pass".
+//  * "pass" passes messages while the current window is a spike and blocks
+//    all other messages. Drops are not reported in this mode.
+//  * "alert" blocks all messages and sends one alert message per spike or drop
+//    to AnomalyAlertStream. Alerts are JSON objects containing the fields
+//    "anomaly" ("spike" or "drop"), "stream", "key", "count", "baseline" and
+//    "window_sec". Drops are reported with the first message after the window.
+//
+// AnomalyAlertStream defines the stream alert messages are sent to. This is
+// required in "alert" mode. By default this is set to "".
+type Anomaly struct {
+	key           string
+	metadataKey   string
+	window        time.Duration
+	alpha         float64
+	factor        float64
+	minCount      float64
+	warmup        int
+	alertMode     bool
+	alertStreamID core.MessageStreamID
+	state         *shared.LRU
+	stateGuard    *sync.Mutex
+	now           func() time.Time
+}
+
+type anomalyKey struct {
+	streamID core.MessageStreamID
+	key      string
+}
+
+type anomalyState struct {
+	windowStart time.Time
+	count       float64
+	baseline    float64
+	windows     int
+	alerted     bool
+}
+
+type anomalyAlert struct {
+	Anomaly   string  `json:"anomaly"`
+	Stream    string  `json:"stream"`
+	Key       string  `json:"key"`
+	Count     float64 `json:"count"`
+	Baseline  float64 `json:"baseline"`
+	WindowSec float64 `json:"window_sec"`
+}
+
+// anomalyMaxCatchUp limits the number of empty windows applied to a baseline
+// after a key has been idle.
+const anomalyMaxCatchUp = 100
+
+func init() {
+	shared.TypeRegistry.Register(Anomaly{})
+}
+
+// Configure initializes this filter with values from a plugin config.
+func (filter *Anomaly) Configure(conf core.PluginConfig) error {
+	var err error
+	filter.key = conf.GetString("AnomalyKey", "")
+	filter.metadataKey = conf.GetString("AnomalyMetadataKey", "")
+	filter.window = time.Duration(conf.GetInt("AnomalyWindowSec", 60)) * time.Second
+	filter.minCount = float64(conf.GetInt("AnomalyMinCount", 10))
+	filter.warmup = conf.GetInt("AnomalyWarmupWindows", 3)
+	filter.state = shared.NewLRU(conf.GetInt("AnomalyMaxKeys", 10000), nil)
+	filter.stateGuard = new(sync.Mutex)
+	filter.now = time.Now
+
+	if filter.window <= 0 {
+		return fmt.Errorf("AnomalyWindowSec must be at least 1")
+	}
+	if filter.alpha, err = getFloat(conf, "AnomalyAlpha", 0.3); err != nil {
+		return err
+	}
+	if filter.alpha <= 0 || filter.alpha > 1 {
+		return fmt.Errorf("AnomalyAlpha must be between 0 and 1")
+	}
+	if filter.factor, err = getFloat(conf, "AnomalyFactor", 3); err != nil {
+		return err
+	}
+	if filter.factor <= 1 {
+		return fmt.Errorf("AnomalyFactor must be greater than 1")
+	}
+
+	mode := strings.ToLower(conf.GetString("AnomalyMode", "pass"))
+	switch mode {
+	case "pass":
+	case "alert":
+		filter.alertMode = true
+	default:
+		return fmt.Errorf("Unknown AnomalyMode: %s", mode)
+	}
+
+	filter.alertStreamID = core.InvalidStreamID
+	if alertStream := conf.GetString("AnomalyAlertStream", ""); alertStream != "" {
+		filter.alertStreamID = core.GetStreamID(alertStream)
+	} else if filter.alertMode {
+		return fmt.Errorf("AnomalyMode alert requires AnomalyAlertStream to be set")
+	}
+
+	return nil
+}
+
+// getState returns the state of a key. This function has to be called while
+// holding stateGuard.
+func (filter *Anomaly) getState(key anomalyKey, now time.Time) *anomalyState {
+	if state, known := filter.state.Get(key); known {
+		return state.(*anomalyState) // ### return, known key ###
+	}
+
+	state := &anomalyState{windowStart: now}
+	filter.state.Set(key, state)
+	return state
+}
+
+// isDetecting returns true if anomalies can be reported for the given state
+func (filter *Anomaly) isDetecting(state *anomalyState) bool {
+	return state.windows >= filter.warmup && state.baseline >= filter.minCount
+}
+
+// closeWindows updates the baseline with all windows that ended before now.
+// If the last window ended with a drop, the alert for that drop is returned.
+func (filter *Anomaly) closeWindows(state *anomalyState, now time.Time) *anomalyAlert {
+	var alert *anomalyAlert
+	for i := 0; i < anomalyMaxCatchUp && now.Sub(state.windowStart) >= filter.window; i++ {
+		if filter.isDetecting(state) && state.count < state.baseline/filter.factor {
+			alert = &anomalyAlert{Anomaly: "drop", Count: state.count, Baseline: state.baseline}
+		} else {
+			alert = nil
+		}
+
+		if state.windows == 0 {
+			state.baseline = state.count
+		} else {
+			state.baseline = filter.alpha*state.count + (1-filter.alpha)*state.baseline
+		}
+		state.windows++
+		state.count = 0
+		state.alerted = false
+		state.windowStart = state.windowStart.Add(filter.window)
+	}
+
+	if now.Sub(state.windowStart) >= filter.window {
+		state.windowStart = now // idle for too long, start over
+	}
+	return alert
+}
+
+func (filter *Anomaly) sendAlert(alert *anomalyAlert, key anomalyKey) {
+	alert.Stream = core.StreamRegistry.GetStreamName(key.streamID)
+	alert.Key = key.key
+	alert.WindowSec = filter.window.Seconds()
+
+	payload, err := json.Marshal(alert)
+	if err != nil {
+		Log.Error.Print("Anomaly filter failed to create alert: ", err)
+		return // ### return, cannot send ###
+	}
+	core.NewMessage(nil, payload, 0).Route(filter.alertStreamID)
+}
+
+// Accepts passes messages while their rate deviates from the baseline or
+// sends alerts.
+func (filter *Anomaly) Accepts(msg core.Message) bool {
+	now := filter.now()
+	key := anomalyKey{streamID: msg.StreamID}
+	key.key, _ = getMessageKey(msg, filter.metadataKey, filter.key)
+
+	filter.stateGuard.Lock()
+	state := filter.getState(key, now)
+	dropAlert := filter.closeWindows(state, now)
+
+	state.count++
+	isSpike := filter.isDetecting(state) && state.count > state.baseline*filter.factor
+
+	var spikeAlert *anomalyAlert
+	if isSpike && !state.alerted {
+		state.alerted = true
+		spikeAlert = &anomalyAlert{Anomaly: "spike", Count: state.count, Baseline: state.baseline}
+	}
+	filter.stateGuard.Unlock()
+
+	if !filter.alertMode {
+		return isSpike // ### return, pass mode ###
+	}
+
+	// Alerts are routed outside of the lock as routing may block
+	if dropAlert != nil {
+		filter.sendAlert(dropAlert, key)
+	}
+	if spikeAlert != nil {
+		filter.sendAlert(spikeAlert, key)
+	}
+	return false
+}
@@ -0,0 +1,130 @@
+// Copyright 2015-2016 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filter
+
+import (
+	"encoding/json"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/shared"
+	"testing"
+	"time"
+)
+
+type mockAlertStream struct {
+	messages []core.Message
+}
+
+func (stream *mockAlertStream) GetBoundStreamID() core.MessageStreamID { return 0 }
+func (stream *mockAlertStream) Pause(capacity int)                     {}
+func (stream *mockAlertStream) Resume()                                {}
+func (stream *mockAlertStream) Flush()                                 {}
+func (stream *mockAlertStream) AddProducer(producers ...core.Producer) {}
+func (stream *mockAlertStream) GetProducers() []core.Producer          { return nil }
+func (stream *mockAlertStream) Enqueue(msg core.Message) {
+	stream.messages = append(stream.messages, msg)
+}
+
+func TestFilterAnomalyPass(t *testing.T) {
+	expect := shared.NewExpect(t)
+	conf := core.NewPluginConfig("")
+
+	conf.Override("AnomalyWindowSec", 10)
+	conf.Override("AnomalyAlpha", 0.5)
+	conf.Override("AnomalyFactor", 2)
+	conf.Override("AnomalyMinCount", 5)
+	conf.Override("AnomalyWarmupWindows", 2)
+	plugin, err := core.NewPluginWithType("filter.Anomaly", conf)
+	expect.NoError(err)
+
+	filter, casted := plugin.(*Anomaly)
+	expect.True(casted)
+
+	now := time.Unix(1500000000, 0)
+	filter.now = func() time.Time { return now }
+	msg := core.NewMessage(nil, []byte{}, 0)
+
+	// Two windows with 10 messages each build a baseline of 10
+	for window := 0; window < 2; window++ {
+		for i := 0; i < 10; i++ {
+			expect.False(filter.Accepts(msg))
+		}
+		now = now.Add(10 * time.Second)
+	}
+
+	// Messages above baseline * factor pass
+	passed := 0
+	for i := 0; i < 30; i++ {
+		if filter.Accepts(msg) {
+			passed++
+		}
+	}
+	expect.Equal(10, passed)
+}
+
+func TestFilterAnomalyAlert(t *testing.T) {
+	expect := shared.NewExpect(t)
+
+	alerts := &mockAlertStream{}
+	core.StreamRegistry.Register(alerts, core.GetStreamID("anomalyAlerts"))
+
+	conf := core.NewPluginConfig("")
+	conf.Override("AnomalyKey", "app")
+	conf.Override("AnomalyWindowSec", 10)
+	conf.Override("AnomalyFactor", 2)
+	conf.Override("AnomalyMinCount", 5)
+	conf.Override("AnomalyWarmupWindows", 1)
+	conf.Override("AnomalyMode", "alert")
+	conf.Override("AnomalyAlertStream", "anomalyAlerts")
+	plugin, err := core.NewPluginWithType("filter.Anomaly", conf)
+	expect.NoError(err)
+
+	filter, casted := plugin.(*Anomaly)
+	expect.True(casted)
+
+	now := time.Unix(1500000000, 0)
+	filter.now = func() time.Time { return now }
+	msg := core.NewMessage(nil, []byte(`{"app":"web"}`), 0)
+
+	for i := 0; i < 10; i++ {
+		expect.False(filter.Accepts(msg))
+	}
+	now = now.Add(10 * time.Second)
+
+	// Spike in the second window: only one alert
+	for i := 0; i < 25; i++ {
+		expect.False(filter.Accepts(msg))
+	}
+	expect.Equal(1, len(alerts.messages))
+
+	alert := map[string]interface{}{}
+	expect.NoError(json.Unmarshal(alerts.messages[0].Data, &alert))
+	expect.Equal("spike", alert["anomaly"])
+	expect.Equal("web", alert["key"])
+	expect.Equal(21.0, alert["count"])
+	expect.Equal(10.0, alert["baseline"])
+
+	// Drop in the third window, reported with the first message afterwards
+	now = now.Add(10 * time.Second)
+	expect.False(filter.Accepts(msg))
+	now = now.Add(10 * time.Second)
+	expect.False(filter.Accepts(msg))
+	expect.Equal(2, len(alerts.messages))
+	expect.NoError(json.Unmarshal(alerts.messages[1].Data, &alert))
+	expect.Equal("drop", alert["anomaly"])
+
+	conf.Override("AnomalyAlertStream", "")
+	_, err = core.NewPluginWithType("filter.Anomaly", conf)
+	expect.NotNil(err)
+}
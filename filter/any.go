@@ -15,25 +15,26 @@
 package filter
 
 import (
-    "fmt"
 	"github.com/trivago/gollum/core"
 	"github.com/trivago/gollum/shared"
 )
 
 // Any filter plugin
-// This plugin blocks messages after a certain number of messages per second
-// has been reached.
+// This filter passes messages that are accepted by any of a list of filters.
 // Configuration example
 //
 //   - "stream.Broadcast":
-//	 Filter: "filter.Any"
-//	 AnyFilter:
-//	 - "filter.JSON"
-//	 - "filter.RegEx"
+//     Filter: "filter.Any"
+//     AnyFilter:
+//       - "filter.JSON"
+//       - "filter.RegExp":
+//           FilterExpression: "^ERROR"
 //
 // AnyFilter defines a list of filters that should be checked before dropping
 // a message. Filters are checked in order, and if the message passes
-// then no further filters are checked. By default this list is empty.
+// then no further filters are checked. Each entry can either be the name of a
+// filter or a map of one filter name to a map of options that apply to this
+// filter only. By default this list is empty.
 type Any struct {
 	filters []core.Filter
 }
@@ -44,27 +45,31 @@ func init() {
 
 // Configure initializes this filter with values from a plugin config.
 func (filter *Any) Configure(conf core.PluginConfig) error {
-	filters := conf.GetStringArray("AnyFilter", []string{})
-	for _, filterName := range filters {
-		plugin, err := core.NewPluginWithType(filterName, conf)
-		if err != nil {
-			return err
-		}
-		f, isFilter := plugin.(core.Filter)
-		if !isFilter {
-			return fmt.Errorf("%s is not a filter", filterName)
-		}
-		filter.filters = append(filter.filters, f)
-	}
-
-	return nil
+	var err error
+	filter.filters, err = core.NewFilterList(conf, "AnyFilter")
+	return err
 }
 
+// Accepts allows messages accepted by any filter
 func (filter *Any) Accepts(msg core.Message) bool {
+	accepted, _ := filter.AcceptsWithReason(msg)
+	return accepted
+}
+
+// AcceptsWithReason works like Accepts and returns a reason if a message is
+// rejected.
+func (filter *Any) AcceptsWithReason(msg core.Message) (bool, string) {
 	for _, f := range filter.filters {
 		if f.Accepts(msg) {
-			return true
+			return true, ""
 		}
 	}
-	return false
+	return false, "rejected by all filters"
+}
+
+// Roll passes a roll request to all filters
+func (filter *Any) Roll() {
+	for _, f := range filter.filters {
+		core.RollFilter(f)
+	}
 }
@@ -0,0 +1,200 @@
+// Copyright 2015-2016 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filter
+
+import (
+	"fmt"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/shared"
+	"hash/fnv"
+	"math"
+	"sync"
+	"time"
+)
+
+// Bloom filter plugin
+// This plugin blocks messages with a key that has been seen before. Keys are
+// stored in a bloom filter, so memory usage does not depend on the number of
+// keys but a small fraction of new keys is blocked as false positives.
+// Two generations of bloom filters are kept. A new generation is started after
+// a given interval or when the current generation is full. Keys are forgotten
+// after two generations.
+// Configuration example
+//
+//   - "stream.Broadcast":
+//     Filter: "filter.Bloom"
+//     BloomKey: ""
+//     BloomMetadataKey: ""
+//     BloomCapacity: 1000000
+//     BloomFalsePositiveRate: 0.001
+//     BloomRotateIntervalSec: 3600
+//     BloomDropToStream: ""
+//
+// BloomKey defines a field of a JSON payload used as key. Messages without this
+// field are passed. Field paths can be defined in a format accepted by
+// shared.MarshalMap.Path. By default this is set to "".
+//
+// BloomMetadataKey defines a metadata key used as key. If both BloomKey and
+// BloomMetadataKey are set, the metadata value is preferred. If neither is
+// set, the whole payload is used as key. By default this is set to "".
+//
+// BloomCapacity defines the number of keys stored per generation.
+// By default this is set to 1000000.
+//
+// BloomFalsePositiveRate defines the probability of a new key being reported
+// as seen before when a generation is full. Together with BloomCapacity this
+// defines the memory used, e.g. 1.8 MB per generation for the default values.
+// By default this is set to 0.001.
+//
+// BloomRotateIntervalSec defines the number of seconds after which a new
+// generation is started. Set to 0 to rotate only when a generation is full.
+// By default this is set to 3600.
+//
+// BloomDropToStream is an optional stream messages are sent to when they
+// are blocked. By default this is disabled and set to "".
+type Bloom struct {
+	key            string
+	metadataKey    string
+	capacity       int
+	numBits        uint64
+	numHashes      uint64
+	rotateInterval time.Duration
+	current        *bloomGeneration
+	previous       *bloomGeneration
+	guard          *sync.Mutex
+	dropStreamID   core.MessageStreamID
+	now            func() time.Time
+}
+
+type bloomGeneration struct {
+	bits    []uint64
+	count   int
+	started time.Time
+}
+
+func init() {
+	shared.TypeRegistry.Register(Bloom{})
+}
+
+// Configure initializes this filter with values from a plugin config.
+func (filter *Bloom) Configure(conf core.PluginConfig) error {
+	filter.key = conf.GetString("BloomKey", "")
+	filter.metadataKey = conf.GetString("BloomMetadataKey", "")
+	filter.capacity = conf.GetInt("BloomCapacity", 1000000)
+	filter.rotateInterval = time.Duration(conf.GetInt("BloomRotateIntervalSec", 3600)) * time.Second
+	filter.guard = new(sync.Mutex)
+	filter.now = time.Now
+
+	if filter.capacity < 1 {
+		return fmt.Errorf("BloomCapacity must be at least 1")
+	}
+
+	falsePositiveRate, err := getFloat(conf, "BloomFalsePositiveRate", 0.001)
+	if err != nil {
+		return err
+	}
+	if falsePositiveRate <= 0 || falsePositiveRate >= 1 {
+		return fmt.Errorf("BloomFalsePositiveRate must be between 0 and 1")
+	}
+
+	// m = -n*ln(p) / ln(2)^2, k = m/n * ln(2)
+	numBits := math.Ceil(-float64(filter.capacity) * math.Log(falsePositiveRate) / (math.Ln2 * math.Ln2))
+	filter.numBits = uint64(math.Max(numBits, 64))
+	filter.numHashes = uint64(math.Max(math.Round(numBits/float64(filter.capacity)*math.Ln2), 1))
+
+	filter.dropStreamID = core.InvalidStreamID
+	if dropToStream := conf.GetString("BloomDropToStream", ""); dropToStream != "" {
+		filter.dropStreamID = core.GetStreamID(dropToStream)
+	}
+
+	filter.current = filter.newGeneration(filter.now())
+	return nil
+}
+
+func (filter *Bloom) newGeneration(now time.Time) *bloomGeneration {
+	return &bloomGeneration{
+		bits:    make([]uint64, (filter.numBits+63)/64),
+		started: now,
+	}
+}
+
+// contains returns true if all bits of the given hashes are set
+func (filter *Bloom) contains(generation *bloomGeneration, h1, h2 uint64) bool {
+	for i := uint64(0); i < filter.numHashes; i++ {
+		bit := (h1 + i*h2) % filter.numBits
+		if generation.bits[bit/64]&(1<<(bit%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// add sets all bits of the given hashes
+func (filter *Bloom) add(generation *bloomGeneration, h1, h2 uint64) {
+	for i := uint64(0); i < filter.numHashes; i++ {
+		bit := (h1 + i*h2) % filter.numBits
+		generation.bits[bit/64] |= 1 << (bit % 64)
+	}
+	generation.count++
+}
+
+// seen adds a key to the bloom filter and returns true if the key has been
+// seen before.
+func (filter *Bloom) seen(key string) bool {
+	hash := fnv.New128a()
+	hash.Write([]byte(key))
+	sum := hash.Sum(nil)
+
+	var h1, h2 uint64
+	for i := 0; i < 8; i++ {
+		h1 = h1<<8 | uint64(sum[i])
+		h2 = h2<<8 | uint64(sum[i+8])
+	}
+	h2 |= 1 // make sure all hashes differ
+
+	filter.guard.Lock()
+	defer filter.guard.Unlock()
+
+	now := filter.now()
+	if filter.current.count >= filter.capacity ||
+		filter.rotateInterval > 0 && now.Sub(filter.current.started) >= filter.rotateInterval {
+		filter.previous = filter.current
+		filter.current = filter.newGeneration(now)
+	}
+
+	if filter.contains(filter.current, h1, h2) {
+		return true // ### return, seen in this generation ###
+	}
+
+	filter.add(filter.current, h1, h2)
+	return filter.previous != nil && filter.contains(filter.previous, h1, h2)
+}
+
+// Accepts blocks messages with keys that have been seen before
+func (filter *Bloom) Accepts(msg core.Message) bool {
+	key, hasKey := string(msg.Data), true
+	if filter.key != "" || filter.metadataKey != "" {
+		key, hasKey = getMessageKey(msg, filter.metadataKey, filter.key)
+	}
+
+	if hasKey && filter.seen(key) {
+		if filter.dropStreamID != core.InvalidStreamID {
+			msg.Route(filter.dropStreamID)
+		}
+		return false // ### return, filter ###
+	}
+
+	return true
+}
@@ -0,0 +1,81 @@
+// Copyright 2015-2016 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filter
+
+import (
+	"fmt"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/shared"
+	"testing"
+	"time"
+)
+
+func TestFilterBloom(t *testing.T) {
+	expect := shared.NewExpect(t)
+	conf := core.NewPluginConfig("")
+
+	conf.Override("BloomKey", "id")
+	conf.Override("BloomCapacity", 1000)
+	conf.Override("BloomFalsePositiveRate", 0.01)
+	plugin, err := core.NewPluginWithType("filter.Bloom", conf)
+	expect.NoError(err)
+
+	filter, casted := plugin.(*Bloom)
+	expect.True(casted)
+
+	now := time.Unix(1500000000, 0)
+	filter.now = func() time.Time { return now }
+	filter.current.started = now
+
+	accept := func(payload string) bool {
+		return filter.Accepts(core.NewMessage(nil, []byte(payload), 0))
+	}
+
+	expect.True(accept(`{"id":"a"}`))
+	expect.False(accept(`{"id":"a"}`))
+	expect.True(accept(`{"id":"b"}`))
+	expect.True(accept(`{"other":"a"}`))
+	expect.True(accept(`{"other":"a"}`))
+
+	// Keys survive one rotation and are forgotten after the second one
+	now = now.Add(time.Hour)
+	expect.False(accept(`{"id":"b"}`))
+	now = now.Add(time.Hour)
+	expect.False(accept(`{"id":"b"}`))
+	now = now.Add(2 * time.Hour)
+	expect.True(accept(`{"id":"a"}`))
+
+	falsePositives := 0
+	for i := 0; i < 1000; i++ {
+		if !accept(fmt.Sprintf(`{"id":"key-%d"}`, i)) {
+			falsePositives++
+		}
+	}
+	expect.True(falsePositives < 30)
+}
+
+func TestFilterBloomConfig(t *testing.T) {
+	expect := shared.NewExpect(t)
+	conf := core.NewPluginConfig("")
+
+	conf.Override("BloomFalsePositiveRate", 1)
+	_, err := core.NewPluginWithType("filter.Bloom", conf)
+	expect.NotNil(err)
+
+	conf.Override("BloomFalsePositiveRate", 0.5)
+	conf.Override("BloomCapacity", 0)
+	_, err = core.NewPluginWithType("filter.Bloom", conf)
+	expect.NotNil(err)
+}
@@ -0,0 +1,218 @@
+// Copyright 2015-2016 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filter
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/shared"
+	"hash"
+	"io/ioutil"
+	"strings"
+)
+
+// Checksum filter plugin
+// This plugin verifies a SHA-2 hash or HMAC attached to a message by
+// format.Hash and blocks messages that have been modified or corrupted.
+// The digest is not removed from passed messages.
+// Configuration example
+//
+//   - "stream.Broadcast":
+//     Filter: "filter.Checksum"
+//     ChecksumAlgorithm: "sha256"
+//     ChecksumKeyFile: ""
+//     ChecksumEncoding: "hex"
+//     ChecksumSource: "append"
+//     ChecksumSeparator: " "
+//     ChecksumMetadataKey: "hash"
+//     ChecksumQuarantineStream: ""
+//
+// ChecksumAlgorithm defines the algorithm used to compute the digest. Supported
+// values are the same as for format.Hash. By default this is set to "sha256".
+//  * "sha256" verifies a SHA-256 hash.
+//  * "sha512" verifies a SHA-512 hash.
+//  * "hmac-sha256" verifies an HMAC using SHA-256 and ChecksumKeyFile.
+//  * "hmac-sha512" verifies an HMAC using SHA-512 and ChecksumKeyFile.
+//
+// ChecksumKeyFile defines a file containing the secret key used by the HMAC
+// algorithms. A trailing line break is ignored. By default this is set to "".
+//
+// ChecksumEncoding defines how the digest is encoded, either "hex" or "base64".
+// By default this is set to "hex".
+//
+// ChecksumSource defines where the digest is read from. This has to match the
+// HashTarget setting of format.Hash. By default this is set to "append".
+//  * "append" reads the digest after the last ChecksumSeparator.
+//  * "metadata" reads the digest from the metadata key ChecksumMetadataKey.
+//  * "envelope" reads a JSON object as written by format.Hash. The algorithm
+//    stored in the envelope has to match ChecksumAlgorithm.
+//
+// ChecksumSeparator defines the string placed between message and digest when
+// ChecksumSource is set to "append". By default this is set to " ".
+//
+// ChecksumMetadataKey defines the metadata key used when ChecksumSource is set
+// to "metadata". By default this is set to "hash".
+//
+// ChecksumQuarantineStream is an optional stream messages are sent to when the
+// verification fails. By default this is disabled and set to "".
+type Checksum struct {
+	algorithm          string
+	newHash            func() hash.Hash
+	key                []byte
+	useBase64          bool
+	source             string
+	separator          []byte
+	metadataKey        string
+	quarantineStreamID core.MessageStreamID
+}
+
+type checksumEnvelope struct {
+	Algorithm     string  `json:"algorithm"`
+	Hash          string  `json:"hash"`
+	Payload       *string `json:"payload"`
+	PayloadBase64 *string `json:"payload_base64"`
+}
+
+func init() {
+	shared.TypeRegistry.Register(Checksum{})
+}
+
+// Configure initializes this filter with values from a plugin config.
+func (filter *Checksum) Configure(conf core.PluginConfig) error {
+	filter.algorithm = strings.ToLower(conf.GetString("ChecksumAlgorithm", "sha256"))
+	switch filter.algorithm {
+	case "sha256", "hmac-sha256":
+		filter.newHash = sha256.New
+	case "sha512", "hmac-sha512":
+		filter.newHash = sha512.New
+	default:
+		return fmt.Errorf("Unknown ChecksumAlgorithm: %s", filter.algorithm)
+	}
+
+	if strings.HasPrefix(filter.algorithm, "hmac-") {
+		keyFile := conf.GetString("ChecksumKeyFile", "")
+		if keyFile == "" {
+			return fmt.Errorf("ChecksumKeyFile is required for %s", filter.algorithm)
+		}
+		key, err := ioutil.ReadFile(keyFile)
+		if err != nil {
+			return err
+		}
+		if filter.key = bytes.TrimRight(key, "\r\n"); len(filter.key) == 0 {
+			return fmt.Errorf("ChecksumKeyFile %s is empty", keyFile)
+		}
+	}
+
+	encoding := strings.ToLower(conf.GetString("ChecksumEncoding", "hex"))
+	switch encoding {
+	case "hex":
+	case "base64":
+		filter.useBase64 = true
+	default:
+		return fmt.Errorf("Unknown ChecksumEncoding: %s", encoding)
+	}
+
+	filter.source = strings.ToLower(conf.GetString("ChecksumSource", "append"))
+	switch filter.source {
+	case "append", "metadata", "envelope":
+	default:
+		return fmt.Errorf("Unknown ChecksumSource: %s", filter.source)
+	}
+
+	filter.separator = []byte(shared.Unescape(conf.GetString("ChecksumSeparator", " ")))
+	filter.metadataKey = conf.GetString("ChecksumMetadataKey", "hash")
+
+	filter.quarantineStreamID = core.InvalidStreamID
+	if quarantineStream := conf.GetString("ChecksumQuarantineStream", ""); quarantineStream != "" {
+		filter.quarantineStreamID = core.GetStreamID(quarantineStream)
+	}
+	return nil
+}
+
+// split returns the payload and the encoded digest of a message
+func (filter *Checksum) split(msg core.Message) ([]byte, string, bool) {
+	switch filter.source {
+	case "metadata":
+		digest, exists := msg.Metadata[filter.metadataKey]
+		return msg.Data, digest, exists
+
+	case "envelope":
+		envelope := checksumEnvelope{}
+		if err := json.Unmarshal(msg.Data, &envelope); err != nil || envelope.Algorithm != filter.algorithm {
+			return nil, "", false // ### return, invalid envelope ###
+		}
+		switch {
+		case envelope.Payload != nil:
+			return []byte(*envelope.Payload), envelope.Hash, true
+		case envelope.PayloadBase64 != nil:
+			payload, err := base64.StdEncoding.DecodeString(*envelope.PayloadBase64)
+			return payload, envelope.Hash, err == nil
+		}
+		return nil, "", false
+
+	default:
+		idx := bytes.LastIndex(msg.Data, filter.separator)
+		if idx < 0 || len(filter.separator) == 0 {
+			return nil, "", false // ### return, no digest ###
+		}
+		return msg.Data[:idx], string(msg.Data[idx+len(filter.separator):]), true
+	}
+}
+
+// verify returns true if the digest matches the message
+func (filter *Checksum) verify(msg core.Message) bool {
+	payload, encodedDigest, found := filter.split(msg)
+	if !found {
+		return false // ### return, no digest ###
+	}
+
+	var digest []byte
+	var err error
+	if filter.useBase64 {
+		digest, err = base64.StdEncoding.DecodeString(encodedDigest)
+	} else {
+		digest, err = hex.DecodeString(encodedDigest)
+	}
+	if err != nil {
+		return false // ### return, invalid digest ###
+	}
+
+	var hasher hash.Hash
+	if filter.key != nil {
+		hasher = hmac.New(filter.newHash, filter.key)
+	} else {
+		hasher = filter.newHash()
+	}
+	hasher.Write(payload)
+	return hmac.Equal(hasher.Sum(nil), digest)
+}
+
+// Accepts passes messages with a valid digest
+func (filter *Checksum) Accepts(msg core.Message) bool {
+	if !filter.verify(msg) {
+		if filter.quarantineStreamID != core.InvalidStreamID {
+			msg.Route(filter.quarantineStreamID)
+		}
+		return false // ### return, verification failed ###
+	}
+	return true
+}
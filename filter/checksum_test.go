@@ -0,0 +1,88 @@
+// Copyright 2015-2016 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filter
+
+import (
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/shared"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFilterChecksum(t *testing.T) {
+	expect := shared.NewExpect(t)
+	conf := core.NewPluginConfig("")
+
+	plugin, err := core.NewPluginWithType("filter.Checksum", conf)
+	expect.NoError(err)
+
+	filter, casted := plugin.(*Checksum)
+	expect.True(casted)
+
+	// sha256("test")
+	digest := "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08"
+	expect.True(filter.Accepts(core.NewMessage(nil, []byte("test "+digest), 0)))
+	expect.False(filter.Accepts(core.NewMessage(nil, []byte("tost "+digest), 0)))
+	expect.False(filter.Accepts(core.NewMessage(nil, []byte("test"), 0)))
+	expect.False(filter.Accepts(core.NewMessage(nil, []byte("test nohex"), 0)))
+
+	conf.Override("ChecksumSource", "envelope")
+	plugin, err = core.NewPluginWithType("filter.Checksum", conf)
+	expect.NoError(err)
+	filter = plugin.(*Checksum)
+
+	expect.True(filter.Accepts(core.NewMessage(nil, []byte(`{"algorithm":"sha256","hash":"`+digest+`","payload":"test"}`), 0)))
+	expect.True(filter.Accepts(core.NewMessage(nil, []byte(`{"algorithm":"sha256","hash":"`+digest+`","payload_base64":"dGVzdA=="}`), 0)))
+	expect.False(filter.Accepts(core.NewMessage(nil, []byte(`{"algorithm":"sha512","hash":"`+digest+`","payload":"test"}`), 0)))
+	expect.False(filter.Accepts(core.NewMessage(nil, []byte(`{"algorithm":"sha256","hash":"`+digest+`"}`), 0)))
+}
+
+func TestFilterChecksumHMAC(t *testing.T) {
+	expect := shared.NewExpect(t)
+
+	dir, err := ioutil.TempDir("", "gollum_checksum")
+	expect.NoError(err)
+	defer os.RemoveAll(dir)
+
+	keyFile := filepath.Join(dir, "key")
+	expect.NoError(ioutil.WriteFile(keyFile, []byte("secret\n"), 0600))
+
+	conf := core.NewPluginConfig("")
+	conf.Override("ChecksumAlgorithm", "hmac-sha256")
+	conf.Override("ChecksumKeyFile", keyFile)
+	conf.Override("ChecksumEncoding", "base64")
+	conf.Override("ChecksumSource", "metadata")
+	plugin, err := core.NewPluginWithType("filter.Checksum", conf)
+	expect.NoError(err)
+
+	filter, casted := plugin.(*Checksum)
+	expect.True(casted)
+
+	msg := core.NewMessage(nil, []byte("test"), 0)
+	expect.False(filter.Accepts(msg))
+
+	// hmac-sha256("secret", "test")
+	msg.SetMetadata("hash", "Aymga2LNFrM+tnkr6MYLFY2Jou46h2/Omogeu0iMCRQ=")
+	expect.True(filter.Accepts(msg))
+
+	msg.Data = []byte("tost")
+	expect.False(filter.Accepts(msg))
+
+	conf.Override("ChecksumKeyFile", "")
+	_, err = core.NewPluginWithType("filter.Checksum", conf)
+	expect.NotNil(err)
+}
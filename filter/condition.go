@@ -0,0 +1,136 @@
+// Copyright 2015-2016 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filter
+
+import (
+	"fmt"
+	"github.com/trivago/gollum/shared"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// filterCondition is a single condition as used by the JSON and Metadata
+// filters.
+type filterCondition struct {
+	path     string
+	operator string
+	value    string
+	number   float64
+	exp      *regexp.Regexp
+	negate   bool
+}
+
+// newFilterConditions parses a list of conditions as given by e.g.
+// FilterAcceptConditions or FilterRejectConditions.
+func newFilterConditions(key string, value interface{}) ([]filterCondition, error) {
+	if value == nil {
+		return []filterCondition{}, nil // ### return, not set ###
+	}
+
+	list, isList := value.([]interface{})
+	if !isList {
+		return nil, fmt.Errorf("%s must be a list", key)
+	}
+
+	conditions := make([]filterCondition, 0, len(list))
+	for _, entry := range list {
+		settings, err := shared.MarshalMap{"condition": entry}.MarshalMap("condition")
+		if err != nil {
+			return nil, fmt.Errorf("%s entries must be maps", key)
+		}
+
+		condition := filterCondition{}
+		if condition.path, err = settings.String("Field"); err != nil {
+			return nil, err
+		}
+		if condition.operator, err = settings.String("Operator"); err != nil {
+			return nil, err
+		}
+		if _, exists := settings["Not"]; exists {
+			if condition.negate, err = settings.Bool("Not"); err != nil {
+				return nil, err
+			}
+		}
+
+		condition.operator = strings.ToLower(condition.operator)
+		if condition.operator != "exists" {
+			rawValue, exists := settings["Value"]
+			if !exists {
+				return nil, fmt.Errorf("%s condition on %s requires a value", key, condition.path)
+			}
+			condition.value = fmt.Sprint(rawValue)
+		}
+
+		switch condition.operator {
+		case "exists", "equals", "contains":
+		case "regex":
+			if condition.exp, err = regexp.Compile(condition.value); err != nil {
+				return nil, err
+			}
+		case "==", "!=", "<", "<=", ">", ">=":
+			if condition.number, err = strconv.ParseFloat(condition.value, 64); err != nil {
+				return nil, fmt.Errorf("%s condition on %s requires a numeric value", key, condition.path)
+			}
+		default:
+			return nil, fmt.Errorf("Unknown %s operator: %s", key, condition.operator)
+		}
+
+		conditions = append(conditions, condition)
+	}
+	return conditions, nil
+}
+
+// matches returns true if the condition is true for the given value.
+// Conditions on values that do not exist are false even if negated, except
+// for "exists".
+func (condition filterCondition) matches(value string, exists bool) bool {
+	if condition.operator == "exists" {
+		return exists != condition.negate // ### return, exists ###
+	}
+	if !exists {
+		return false // ### return, missing field ###
+	}
+
+	var result bool
+	switch condition.operator {
+	case "equals":
+		result = value == condition.value
+	case "contains":
+		result = strings.Contains(value, condition.value)
+	case "regex":
+		result = condition.exp.MatchString(value)
+	default:
+		number, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return false // ### return, not a number ###
+		}
+		switch condition.operator {
+		case "==":
+			result = number == condition.number
+		case "!=":
+			result = number != condition.number
+		case "<":
+			result = number < condition.number
+		case "<=":
+			result = number <= condition.number
+		case ">":
+			result = number > condition.number
+		case ">=":
+			result = number >= condition.number
+		}
+	}
+	return result != condition.negate
+}
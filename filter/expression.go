@@ -0,0 +1,461 @@
+// Copyright 2015-2016 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filter
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/shared"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"math"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Expression filter plugin
+// This plugin passes messages for which a boolean expression is true.
+// The expression is compiled once when the filter is configured.
+// Configuration example
+//
+//  - "stream.Broadcast":
+//    Filter: "filter.Expression"
+//    Expression: "level == \"error\" || (latency_ms > 500 && !internal)"
+//    ExpressionDropToStream: ""
+//
+// Expression defines the expression evaluated for each message. Messages are
+// passed if the result is true, a number other than 0, a non-empty string or
+// any other value except null. By default this is set to "true".
+// The syntax follows Go expressions:
+//  * Identifiers refer to fields of a JSON payload. Nested fields can be
+//    accessed with ".", e.g. "request.latency". Missing fields are null.
+//  * Literals are numbers, strings in double quotes, true, false and nil.
+//  * Operators are "||", "&&", "!", "==", "!=", "<", "<=", ">", ">=", "+",
+//    "-", "*", "/" and "%". Comparisons with values of a different type are
+//    false.
+//  * "field(path)" returns a field given in a format accepted by
+//    shared.MarshalMap.Path, e.g. for field names that are not identifiers.
+//  * "has(path)" returns true if a field exists.
+//  * "meta(key)" returns a metadata value or null.
+//  * "stream()" returns the name of the message's stream.
+//  * "size()" returns the size of the payload in bytes.
+//  * "contains(value, substring)" returns true if a string contains another.
+//  * "matches(value, regexp)" returns true if a regular expression matches.
+//
+// ExpressionDropToStream is an optional stream messages are sent to when they
+// are blocked. By default this is disabled and set to "".
+type Expression struct {
+	expression   expressionNode
+	dropStreamID core.MessageStreamID
+}
+
+type expressionNode func(ctx *expressionContext) interface{}
+
+type expressionContext struct {
+	msg    core.Message
+	values shared.MarshalMap
+	parsed bool
+}
+
+func init() {
+	shared.TypeRegistry.Register(Expression{})
+}
+
+// Configure initializes this filter with values from a plugin config.
+func (filter *Expression) Configure(conf core.PluginConfig) error {
+	source := conf.GetString("Expression", "true")
+	tree, err := parser.ParseExpr(source)
+	if err != nil {
+		return fmt.Errorf("Failed to parse expression %s: %s", source, err.Error())
+	}
+
+	if filter.expression, err = compileExpression(tree); err != nil {
+		return fmt.Errorf("Failed to compile expression %s: %s", source, err.Error())
+	}
+
+	filter.dropStreamID = core.InvalidStreamID
+	if dropToStream := conf.GetString("ExpressionDropToStream", ""); dropToStream != "" {
+		filter.dropStreamID = core.GetStreamID(dropToStream)
+	}
+
+	return nil
+}
+
+// field returns the value of a payload field. The payload is parsed on first
+// access.
+func (ctx *expressionContext) field(path string) (interface{}, bool) {
+	if !ctx.parsed {
+		ctx.parsed = true
+		ctx.values = shared.NewMarshalMap()
+		if err := json.Unmarshal(ctx.msg.Data, &ctx.values); err != nil {
+			ctx.values = shared.NewMarshalMap()
+		}
+	}
+	return ctx.values.Path(path)
+}
+
+// expressionTruthy converts an expression result to a boolean
+func expressionTruthy(value interface{}) bool {
+	switch typed := value.(type) {
+	case nil:
+		return false
+	case bool:
+		return typed
+	case float64:
+		return typed != 0
+	case string:
+		return typed != ""
+	default:
+		return true
+	}
+}
+
+// expressionPath converts an identifier or a chain of selectors into a field
+// path.
+func expressionPath(node ast.Expr) (string, bool) {
+	switch typed := node.(type) {
+	case *ast.Ident:
+		return typed.Name, true
+	case *ast.SelectorExpr:
+		if parent, isPath := expressionPath(typed.X); isPath {
+			return parent + "/" + typed.Sel.Name, true
+		}
+	}
+	return "", false
+}
+
+// expressionStringLiteral returns the value of a string literal argument
+func expressionStringLiteral(call *ast.CallExpr, name string) (string, error) {
+	if len(call.Args) != 1 {
+		return "", fmt.Errorf("%s expects exactly one argument", name)
+	}
+	literal, isLiteral := call.Args[0].(*ast.BasicLit)
+	if !isLiteral || literal.Kind != token.STRING {
+		return "", fmt.Errorf("%s expects a string literal", name)
+	}
+	return strconv.Unquote(literal.Value)
+}
+
+func compileExpression(node ast.Expr) (expressionNode, error) {
+	switch typed := node.(type) {
+	case *ast.ParenExpr:
+		return compileExpression(typed.X)
+
+	case *ast.BasicLit:
+		var value interface{}
+		var err error
+		switch typed.Kind {
+		case token.INT, token.FLOAT:
+			value, err = strconv.ParseFloat(typed.Value, 64)
+		case token.STRING:
+			value, err = strconv.Unquote(typed.Value)
+		default:
+			err = fmt.Errorf("unsupported literal %s", typed.Value)
+		}
+		if err != nil {
+			return nil, err
+		}
+		return func(*expressionContext) interface{} { return value }, nil
+
+	case *ast.Ident, *ast.SelectorExpr:
+		if ident, isIdent := typed.(*ast.Ident); isIdent {
+			switch ident.Name {
+			case "true":
+				return func(*expressionContext) interface{} { return true }, nil
+			case "false":
+				return func(*expressionContext) interface{} { return false }, nil
+			case "nil":
+				return func(*expressionContext) interface{} { return nil }, nil
+			}
+		}
+		path, isPath := expressionPath(node)
+		if !isPath {
+			return nil, fmt.Errorf("unsupported field access")
+		}
+		return func(ctx *expressionContext) interface{} {
+			value, _ := ctx.field(path)
+			return value
+		}, nil
+
+	case *ast.UnaryExpr:
+		return compileUnaryExpression(typed)
+
+	case *ast.BinaryExpr:
+		return compileBinaryExpression(typed)
+
+	case *ast.CallExpr:
+		return compileCallExpression(typed)
+	}
+
+	return nil, fmt.Errorf("unsupported expression at position %d", node.Pos())
+}
+
+func compileUnaryExpression(node *ast.UnaryExpr) (expressionNode, error) {
+	operand, err := compileExpression(node.X)
+	if err != nil {
+		return nil, err
+	}
+
+	switch node.Op {
+	case token.NOT:
+		return func(ctx *expressionContext) interface{} {
+			return !expressionTruthy(operand(ctx))
+		}, nil
+
+	case token.SUB:
+		return func(ctx *expressionContext) interface{} {
+			if number, isNumber := operand(ctx).(float64); isNumber {
+				return -number
+			}
+			return nil
+		}, nil
+	}
+
+	return nil, fmt.Errorf("unsupported operator %s", node.Op)
+}
+
+func compileBinaryExpression(node *ast.BinaryExpr) (expressionNode, error) {
+	left, err := compileExpression(node.X)
+	if err != nil {
+		return nil, err
+	}
+	right, err := compileExpression(node.Y)
+	if err != nil {
+		return nil, err
+	}
+
+	switch node.Op {
+	case token.LOR:
+		return func(ctx *expressionContext) interface{} {
+			return expressionTruthy(left(ctx)) || expressionTruthy(right(ctx))
+		}, nil
+
+	case token.LAND:
+		return func(ctx *expressionContext) interface{} {
+			return expressionTruthy(left(ctx)) && expressionTruthy(right(ctx))
+		}, nil
+
+	case token.EQL:
+		return func(ctx *expressionContext) interface{} {
+			return expressionEqual(left(ctx), right(ctx))
+		}, nil
+
+	case token.NEQ:
+		return func(ctx *expressionContext) interface{} {
+			return !expressionEqual(left(ctx), right(ctx))
+		}, nil
+
+	case token.LSS, token.LEQ, token.GTR, token.GEQ:
+		op := node.Op
+		return func(ctx *expressionContext) interface{} {
+			return expressionCompare(op, left(ctx), right(ctx))
+		}, nil
+
+	case token.ADD, token.SUB, token.MUL, token.QUO, token.REM:
+		op := node.Op
+		return func(ctx *expressionContext) interface{} {
+			return expressionArithmetic(op, left(ctx), right(ctx))
+		}, nil
+	}
+
+	return nil, fmt.Errorf("unsupported operator %s", node.Op)
+}
+
+func compileCallExpression(node *ast.CallExpr) (expressionNode, error) {
+	name, isIdent := node.Fun.(*ast.Ident)
+	if !isIdent {
+		return nil, fmt.Errorf("unsupported function call")
+	}
+
+	switch name.Name {
+	case "stream", "size":
+		if len(node.Args) != 0 {
+			return nil, fmt.Errorf("%s expects no arguments", name.Name)
+		}
+		if name.Name == "stream" {
+			return func(ctx *expressionContext) interface{} {
+				return core.StreamRegistry.GetStreamName(ctx.msg.StreamID)
+			}, nil
+		}
+		return func(ctx *expressionContext) interface{} {
+			return float64(len(ctx.msg.Data))
+		}, nil
+
+	case "field", "has", "meta":
+		arg, err := expressionStringLiteral(node, name.Name)
+		if err != nil {
+			return nil, err
+		}
+		switch name.Name {
+		case "field":
+			return func(ctx *expressionContext) interface{} {
+				value, _ := ctx.field(arg)
+				return value
+			}, nil
+		case "has":
+			return func(ctx *expressionContext) interface{} {
+				_, exists := ctx.field(arg)
+				return exists
+			}, nil
+		default:
+			return func(ctx *expressionContext) interface{} {
+				if value, exists := ctx.msg.Metadata[arg]; exists {
+					return value
+				}
+				return nil
+			}, nil
+		}
+
+	case "contains":
+		if len(node.Args) != 2 {
+			return nil, fmt.Errorf("contains expects exactly two arguments")
+		}
+		value, err := compileExpression(node.Args[0])
+		if err != nil {
+			return nil, err
+		}
+		substring, err := compileExpression(node.Args[1])
+		if err != nil {
+			return nil, err
+		}
+		return func(ctx *expressionContext) interface{} {
+			str, isString := value(ctx).(string)
+			sub, isSubString := substring(ctx).(string)
+			return isString && isSubString && strings.Contains(str, sub)
+		}, nil
+
+	case "matches":
+		if len(node.Args) != 2 {
+			return nil, fmt.Errorf("matches expects exactly two arguments")
+		}
+		value, err := compileExpression(node.Args[0])
+		if err != nil {
+			return nil, err
+		}
+		pattern, err := expressionStringLiteral(&ast.CallExpr{Args: node.Args[1:]}, "matches")
+		if err != nil {
+			return nil, err
+		}
+		exp, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, err
+		}
+		return func(ctx *expressionContext) interface{} {
+			str, isString := value(ctx).(string)
+			return isString && exp.MatchString(str)
+		}, nil
+	}
+
+	return nil, fmt.Errorf("unknown function %s", name.Name)
+}
+
+func expressionEqual(left interface{}, right interface{}) bool {
+	switch typed := left.(type) {
+	case nil, bool, float64, string:
+		return left == right
+	default:
+		return reflect.DeepEqual(typed, right)
+	}
+}
+
+func expressionCompare(op token.Token, left interface{}, right interface{}) bool {
+	var cmp int
+	switch typed := left.(type) {
+	case float64:
+		other, isNumber := right.(float64)
+		if !isNumber || math.IsNaN(typed) || math.IsNaN(other) {
+			return false // ### return, type mismatch ###
+		}
+		switch {
+		case typed < other:
+			cmp = -1
+		case typed > other:
+			cmp = 1
+		}
+
+	case string:
+		other, isString := right.(string)
+		if !isString {
+			return false // ### return, type mismatch ###
+		}
+		cmp = strings.Compare(typed, other)
+
+	default:
+		return false // ### return, not comparable ###
+	}
+
+	switch op {
+	case token.LSS:
+		return cmp < 0
+	case token.LEQ:
+		return cmp <= 0
+	case token.GTR:
+		return cmp > 0
+	default:
+		return cmp >= 0
+	}
+}
+
+func expressionArithmetic(op token.Token, left interface{}, right interface{}) interface{} {
+	if op == token.ADD {
+		if str, isString := left.(string); isString {
+			if other, isString := right.(string); isString {
+				return str + other // ### return, concatenation ###
+			}
+		}
+	}
+
+	number, isNumber := left.(float64)
+	other, isOtherNumber := right.(float64)
+	if !isNumber || !isOtherNumber {
+		return nil // ### return, type mismatch ###
+	}
+
+	switch op {
+	case token.ADD:
+		return number + other
+	case token.SUB:
+		return number - other
+	case token.MUL:
+		return number * other
+	case token.QUO:
+		if other == 0 {
+			return nil
+		}
+		return number / other
+	default:
+		if other == 0 {
+			return nil
+		}
+		return math.Mod(number, other)
+	}
+}
+
+// Accepts passes messages for which the expression is true
+func (filter *Expression) Accepts(msg core.Message) bool {
+	ctx := &expressionContext{msg: msg}
+	if !expressionTruthy(filter.expression(ctx)) {
+		if filter.dropStreamID != core.InvalidStreamID {
+			msg.Route(filter.dropStreamID)
+		}
+		return false // ### return, filter ###
+	}
+
+	return true
+}
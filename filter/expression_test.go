@@ -0,0 +1,78 @@
+// Copyright 2015-2016 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filter
+
+import (
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/shared"
+	"testing"
+)
+
+func TestFilterExpression(t *testing.T) {
+	expect := shared.NewExpect(t)
+	conf := core.NewPluginConfig("")
+
+	conf.Override("Expression", `level == "error" || (latency_ms > 500 && !internal)`)
+	plugin, err := core.NewPluginWithType("filter.Expression", conf)
+	expect.NoError(err)
+
+	filter, casted := plugin.(*Expression)
+	expect.True(casted)
+
+	accept := func(payload string) bool {
+		return filter.Accepts(core.NewMessage(nil, []byte(payload), 0))
+	}
+
+	expect.True(accept(`{"level":"error"}`))
+	expect.True(accept(`{"level":"info","latency_ms":501}`))
+	expect.False(accept(`{"level":"info","latency_ms":501,"internal":true}`))
+	expect.False(accept(`{"level":"info","latency_ms":500}`))
+	expect.False(accept(`{"level":"info","latency_ms":"slow"}`))
+	expect.False(accept(`not json`))
+}
+
+func TestFilterExpressionFunctions(t *testing.T) {
+	expect := shared.NewExpect(t)
+	conf := core.NewPluginConfig("")
+
+	conf.Override("Expression", `stream() == "expression" && size() < 100 && meta("client_cn") == "web" && `+
+		`has("request.id") && field("request-id") != nil && request.status % 100 == 4 && `+
+		`contains(message, "time" + "out") && matches(host, "^web\\d+$")`)
+	plugin, err := core.NewPluginWithType("filter.Expression", conf)
+	expect.NoError(err)
+
+	filter, casted := plugin.(*Expression)
+	expect.True(casted)
+
+	payload := `{"request":{"status":404},"request.id":1,"request-id":2,"message":"timeout","host":"web1"}`
+	msg := core.NewMessage(nil, []byte(payload), 0)
+	msg.StreamID = core.GetStreamID("expression")
+	msg.SetMetadata(core.MetadataClientCommonName, "web")
+	expect.True(filter.Accepts(msg))
+
+	msg.SetMetadata(core.MetadataClientCommonName, "db")
+	expect.False(filter.Accepts(msg))
+}
+
+func TestFilterExpressionErrors(t *testing.T) {
+	expect := shared.NewExpect(t)
+	conf := core.NewPluginConfig("")
+
+	for _, expression := range []string{`level ==`, `unknown()`, `meta(level)`, `matches(a, "(")`, `a[0]`, `'c'`} {
+		conf.Override("Expression", expression)
+		_, err := core.NewPluginWithType("filter.Expression", conf)
+		expect.NotNil(err)
+	}
+}
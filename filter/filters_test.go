@@ -23,6 +23,7 @@ import (
 
 func TestFilterInterface(t *testing.T) {
 	conf := core.NewPluginConfig(reflect.TypeOf(t).Name())
+	conf.Override("LuaFilterScript", "function filter() return true end")
 	filters := shared.TypeRegistry.GetRegistered("filter.")
 
 	if len(filters) == 0 {
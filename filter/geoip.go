@@ -0,0 +1,452 @@
+// Copyright 2015-2016 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filter
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/core/log"
+	"github.com/trivago/gollum/shared"
+	"io/ioutil"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// GeoIP filter plugin
+// This plugin accepts or rejects messages based on the country, ASN or any
+// other value stored for an IP address in a MaxMind database (.mmdb), e.g.
+// GeoLite2-Country or GeoLite2-ASN. The database is reloaded on SIGHUP.
+// Configuration example
+//
+//   - "stream.Broadcast":
+//     Filter: "filter.GeoIP"
+//     GeoIPDatabase: "/usr/share/GeoIP/GeoLite2-Country.mmdb"
+//     GeoIPKey: ""
+//     GeoIPMetadataKey: "source_address"
+//     GeoIPField: "country/iso_code"
+//     GeoIPAccept:
+//       - "DE"
+//       - "FR"
+//     GeoIPReject: []
+//     GeoIPRejectUnknown: false
+//     GeoIPDropToStream: ""
+//
+// GeoIPDatabase defines the path to the MaxMind database. If no database is
+// set, all addresses are unknown. By default this is set to "".
+//
+// GeoIPKey defines a field of a JSON payload that contains the IP address.
+// Field paths can be defined in a format accepted by shared.MarshalMap.Path.
+// By default this is set to "".
+//
+// GeoIPMetadataKey defines a metadata key that contains the IP address. If both
+// GeoIPKey and GeoIPMetadataKey are set, the metadata value is preferred.
+// A port appended to the address is ignored. By default this is set to
+// "source_address", which is set by network based consumers.
+//
+// GeoIPField defines the value of a database record to match, e.g.
+// "country/iso_code" for country databases or "autonomous_system_number" for
+// ASN databases. Field paths can be defined in a format accepted by
+// shared.MarshalMap.Path. By default this is set to "country/iso_code".
+//
+// GeoIPAccept defines a list of values to pass. If set, messages with other
+// values are blocked. By default this list is empty.
+//
+// GeoIPReject defines a list of values to block. By default this list is empty.
+//
+// GeoIPRejectUnknown can be set to true to block messages without an IP address
+// or with an address not found in the database. By default this is set to false.
+//
+// GeoIPDropToStream is an optional stream messages are sent to when they
+// are blocked. By default this is disabled and set to "".
+type GeoIP struct {
+	path          string
+	key           string
+	metadataKey   string
+	field         string
+	accept        map[string]bool
+	reject        map[string]bool
+	rejectUnknown bool
+	db            *maxMindDB
+	dbGuard       *sync.RWMutex
+	dropStreamID  core.MessageStreamID
+}
+
+func init() {
+	shared.TypeRegistry.Register(GeoIP{})
+}
+
+// Configure initializes this filter with values from a plugin config.
+func (filter *GeoIP) Configure(conf core.PluginConfig) error {
+	filter.path = conf.GetString("GeoIPDatabase", "")
+	filter.key = conf.GetString("GeoIPKey", "")
+	filter.metadataKey = conf.GetString("GeoIPMetadataKey", core.MetadataSourceAddress)
+	filter.field = conf.GetString("GeoIPField", "country/iso_code")
+	filter.rejectUnknown = conf.GetBool("GeoIPRejectUnknown", false)
+	filter.dbGuard = new(sync.RWMutex)
+
+	filter.accept = make(map[string]bool)
+	for _, value := range conf.GetStringArray("GeoIPAccept", []string{}) {
+		filter.accept[value] = true
+	}
+	filter.reject = make(map[string]bool)
+	for _, value := range conf.GetStringArray("GeoIPReject", []string{}) {
+		filter.reject[value] = true
+	}
+
+	filter.dropStreamID = core.InvalidStreamID
+	if dropToStream := conf.GetString("GeoIPDropToStream", ""); dropToStream != "" {
+		filter.dropStreamID = core.GetStreamID(dropToStream)
+	}
+
+	if filter.path == "" {
+		return nil // ### return, no database ###
+	}
+
+	db, err := openMaxMindDB(filter.path)
+	if err != nil {
+		return err
+	}
+	filter.db = db
+	return nil
+}
+
+// Roll reloads the database
+func (filter *GeoIP) Roll() {
+	if filter.path == "" {
+		return // ### return, no database ###
+	}
+
+	db, err := openMaxMindDB(filter.path)
+	if err != nil {
+		Log.Error.Print("GeoIP filter failed to reload database: ", err)
+		return // ### return, keep current database ###
+	}
+
+	filter.dbGuard.Lock()
+	filter.db = db
+	filter.dbGuard.Unlock()
+}
+
+// lookup returns the database value for the IP address of a message
+func (filter *GeoIP) lookup(msg core.Message) (string, bool) {
+	address, hasAddress := getMessageKey(msg, filter.metadataKey, filter.key)
+	if !hasAddress {
+		return "", false // ### return, no address ###
+	}
+	if host, _, err := net.SplitHostPort(address); err == nil {
+		address = host
+	}
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return "", false // ### return, invalid address ###
+	}
+
+	filter.dbGuard.RLock()
+	db := filter.db
+	filter.dbGuard.RUnlock()
+	if db == nil {
+		return "", false // ### return, no database ###
+	}
+
+	record, err := db.lookup(ip)
+	if err != nil {
+		Log.Warning.Print("GeoIP filter lookup failed: ", err)
+		return "", false // ### return, corrupt database ###
+	}
+	values, isMap := record.(map[string]interface{})
+	if !isMap {
+		return "", false // ### return, not found ###
+	}
+
+	switch value, _ := shared.MarshalMap(values).Path(filter.field); value.(type) {
+	case string:
+		return value.(string), true
+	case uint64:
+		return strconv.FormatUint(value.(uint64), 10), true
+	case int64:
+		return strconv.FormatInt(value.(int64), 10), true
+	case bool:
+		return strconv.FormatBool(value.(bool)), true
+	case float64:
+		return strconv.FormatFloat(value.(float64), 'f', -1, 64), true
+	}
+	return "", false
+}
+
+// Accepts checks the database value of a message's IP address
+func (filter *GeoIP) Accepts(msg core.Message) bool {
+	value, known := filter.lookup(msg)
+
+	accept := true
+	switch {
+	case !known:
+		accept = !filter.rejectUnknown
+	case filter.reject[value]:
+		accept = false
+	case len(filter.accept) > 0:
+		accept = filter.accept[value]
+	}
+
+	if !accept {
+		if filter.dropStreamID != core.InvalidStreamID {
+			msg.Route(filter.dropStreamID)
+		}
+		return false // ### return, filter ###
+	}
+
+	return true
+}
+
+// maxMindDB is a reader for the MaxMind DB file format as described at
+// https://maxmind.github.io/MaxMind-DB/
+type maxMindDB struct {
+	tree       []byte
+	data       []byte
+	nodeCount  uint
+	recordSize uint
+	ipv4Start  uint
+	ipVersion  uint
+}
+
+var maxMindDBMetadataMarker = []byte("\xAB\xCD\xEFMaxMind.com")
+
+func openMaxMindDB(path string) (*maxMindDB, error) {
+	buffer, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return newMaxMindDB(buffer)
+}
+
+func newMaxMindDB(buffer []byte) (*maxMindDB, error) {
+	markerIdx := bytes.LastIndex(buffer, maxMindDBMetadataMarker)
+	if markerIdx < 0 {
+		return nil, fmt.Errorf("Invalid MaxMind DB: metadata not found")
+	}
+
+	metadataBuffer := buffer[markerIdx+len(maxMindDBMetadataMarker):]
+	metadataValue, _, err := (&maxMindDB{data: metadataBuffer}).decode(0)
+	if err != nil {
+		return nil, err
+	}
+	metadata, isMap := metadataValue.(map[string]interface{})
+	if !isMap {
+		return nil, fmt.Errorf("Invalid MaxMind DB: metadata is not a map")
+	}
+
+	db := &maxMindDB{}
+	for key, target := range map[string]*uint{
+		"node_count":  &db.nodeCount,
+		"record_size": &db.recordSize,
+		"ip_version":  &db.ipVersion,
+	} {
+		value, isUint := metadata[key].(uint64)
+		if !isUint {
+			return nil, fmt.Errorf("Invalid MaxMind DB: %s is missing", key)
+		}
+		*target = uint(value)
+	}
+
+	if db.recordSize != 24 && db.recordSize != 28 && db.recordSize != 32 {
+		return nil, fmt.Errorf("Invalid MaxMind DB: unsupported record size %d", db.recordSize)
+	}
+
+	treeSize := db.nodeCount * db.recordSize / 4
+	if treeSize+16 > uint(markerIdx) {
+		return nil, fmt.Errorf("Invalid MaxMind DB: search tree is truncated")
+	}
+	db.tree = buffer[:treeSize]
+	db.data = buffer[treeSize+16 : markerIdx]
+
+	// IPv4 addresses are stored in the ::/96 subtree of IPv6 databases
+	if db.ipVersion == 6 {
+		for i := 0; i < 96 && db.ipv4Start < db.nodeCount; i++ {
+			db.ipv4Start = db.readRecord(db.ipv4Start, 0)
+		}
+	}
+	return db, nil
+}
+
+// readRecord returns the left (bit 0) or right (bit 1) record of a node
+func (db *maxMindDB) readRecord(node uint, bit uint) uint {
+	switch db.recordSize {
+	case 24:
+		offset := node*6 + bit*3
+		return uint(db.tree[offset])<<16 | uint(db.tree[offset+1])<<8 | uint(db.tree[offset+2])
+	case 28:
+		offset := node * 7
+		if bit == 0 {
+			return uint(db.tree[offset+3]&0xF0)<<20 | uint(db.tree[offset])<<16 | uint(db.tree[offset+1])<<8 | uint(db.tree[offset+2])
+		}
+		return uint(db.tree[offset+3]&0x0F)<<24 | uint(db.tree[offset+4])<<16 | uint(db.tree[offset+5])<<8 | uint(db.tree[offset+6])
+	default:
+		offset := node*8 + bit*4
+		return uint(binary.BigEndian.Uint32(db.tree[offset:]))
+	}
+}
+
+// lookup returns the record stored for an IP address or nil if the address
+// is not part of the database.
+func (db *maxMindDB) lookup(ip net.IP) (interface{}, error) {
+	node := uint(0)
+	if ip4 := ip.To4(); ip4 != nil {
+		ip, node = ip4, db.ipv4Start
+	} else if db.ipVersion == 4 {
+		return nil, nil // ### return, no IPv6 data ###
+	}
+
+	for i := uint(0); i < uint(len(ip))*8 && node < db.nodeCount; i++ {
+		node = db.readRecord(node, uint(ip[i/8]>>(7-i%8))&1)
+	}
+
+	if node <= db.nodeCount {
+		return nil, nil // ### return, not found ###
+	}
+
+	value, _, err := db.decode(node - db.nodeCount - 16)
+	return value, err
+}
+
+// decode reads a value from the data section at the given offset and returns
+// the value and the offset of the next value.
+func (db *maxMindDB) decode(offset uint) (interface{}, uint, error) {
+	if offset >= uint(len(db.data)) {
+		return nil, 0, fmt.Errorf("Invalid MaxMind DB: offset %d out of range", offset)
+	}
+
+	ctrl := db.data[offset]
+	offset++
+	dataType := uint(ctrl >> 5)
+
+	if dataType == 1 {
+		// Pointers use the size bits for the pointer value
+		size := uint(ctrl>>3) & 0x3
+		if offset+size+1 > uint(len(db.data)) {
+			return nil, 0, fmt.Errorf("Invalid MaxMind DB: pointer out of range")
+		}
+		pointer := uint(0)
+		if size < 3 {
+			pointer = uint(ctrl & 0x7)
+		}
+		for i := uint(0); i <= size; i++ {
+			pointer = pointer<<8 | uint(db.data[offset+i])
+		}
+		pointer += []uint{0, 2048, 526336, 0}[size]
+
+		value, _, err := db.decode(pointer)
+		return value, offset + size + 1, err
+	}
+
+	if dataType == 0 {
+		if offset >= uint(len(db.data)) {
+			return nil, 0, fmt.Errorf("Invalid MaxMind DB: extended type out of range")
+		}
+		dataType = 7 + uint(db.data[offset])
+		offset++
+	}
+
+	size := uint(ctrl & 0x1F)
+	if size >= 29 {
+		numBytes := size - 28
+		if offset+numBytes > uint(len(db.data)) {
+			return nil, 0, fmt.Errorf("Invalid MaxMind DB: size out of range")
+		}
+		extended := uint(0)
+		for i := uint(0); i < numBytes; i++ {
+			extended = extended<<8 | uint(db.data[offset+i])
+		}
+		size = []uint{29, 285, 65821}[numBytes-1] + extended
+		offset += numBytes
+	}
+
+	switch dataType {
+	case 7: // map
+		values := make(map[string]interface{}, size)
+		for i := uint(0); i < size; i++ {
+			key, next, err := db.decode(offset)
+			if err != nil {
+				return nil, 0, err
+			}
+			keyString, isString := key.(string)
+			if !isString {
+				return nil, 0, fmt.Errorf("Invalid MaxMind DB: map key is not a string")
+			}
+			if values[keyString], offset, err = db.decode(next); err != nil {
+				return nil, 0, err
+			}
+		}
+		return values, offset, nil
+
+	case 11: // array
+		values := make([]interface{}, size)
+		for i := range values {
+			var err error
+			if values[i], offset, err = db.decode(offset); err != nil {
+				return nil, 0, err
+			}
+		}
+		return values, offset, nil
+
+	case 14: // boolean
+		return size != 0, offset, nil
+	}
+
+	if offset+size > uint(len(db.data)) {
+		return nil, 0, fmt.Errorf("Invalid MaxMind DB: value out of range")
+	}
+	raw := db.data[offset : offset+size]
+	offset += size
+
+	switch dataType {
+	case 2: // utf-8 string
+		return string(raw), offset, nil
+	case 3: // double
+		if size != 8 {
+			return nil, 0, fmt.Errorf("Invalid MaxMind DB: invalid double")
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(raw)), offset, nil
+	case 4: // bytes
+		return raw, offset, nil
+	case 5, 6, 9: // uint16, uint32, uint64
+		value := uint64(0)
+		for _, b := range raw {
+			value = value<<8 | uint64(b)
+		}
+		return value, offset, nil
+	case 8: // int32
+		value := uint32(0)
+		for _, b := range raw {
+			value = value<<8 | uint32(b)
+		}
+		if size == 4 {
+			return int64(int32(value)), offset, nil
+		}
+		return int64(value), offset, nil
+	case 10: // uint128
+		return strings.TrimLeft(fmt.Sprintf("%x", raw), "0"), offset, nil
+	case 15: // float
+		if size != 4 {
+			return nil, 0, fmt.Errorf("Invalid MaxMind DB: invalid float")
+		}
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(raw))), offset, nil
+	}
+
+	return nil, 0, fmt.Errorf("Invalid MaxMind DB: unknown data type %d", dataType)
+}
@@ -0,0 +1,184 @@
+// Copyright 2015-2016 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filter
+
+import (
+	"bytes"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/shared"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+// mmdbEncode encodes strings, uint32 values and maps for the MaxMind DB data
+// section.
+func mmdbEncode(value interface{}) []byte {
+	switch typed := value.(type) {
+	case string:
+		return append([]byte{2<<5 | byte(len(typed))}, typed...)
+	case uint32:
+		return []byte{6<<5 | 4, byte(typed >> 24), byte(typed >> 16), byte(typed >> 8), byte(typed)}
+	case []byte: // pre-encoded value, e.g. a pointer
+		return typed
+	case map[string]interface{}:
+		keys := []string{}
+		for key := range typed {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		encoded := []byte{7<<5 | byte(len(typed))}
+		for _, key := range keys {
+			encoded = append(encoded, mmdbEncode(key)...)
+			encoded = append(encoded, mmdbEncode(typed[key])...)
+		}
+		return encoded
+	}
+	panic("unsupported type")
+}
+
+// mmdbBuild creates an IPv4 MaxMind DB with 24 bit records that maps each
+// network to an offset in the given data section.
+func mmdbBuild(networks map[string]int, data []byte) []byte {
+	const empty, leaf = -1, -2
+	type record struct{ kind, value int }
+	nodes := [][2]record{{{empty, 0}, {empty, 0}}}
+
+	for cidr, offset := range networks {
+		_, network, _ := net.ParseCIDR(cidr)
+		ones, _ := network.Mask.Size()
+		node := 0
+		for i := 0; i < ones; i++ {
+			bit := (network.IP.To4()[i/8] >> uint(7-i%8)) & 1
+			if i == ones-1 {
+				nodes[node][bit] = record{leaf, offset}
+				break
+			}
+			if nodes[node][bit].kind == empty {
+				nodes = append(nodes, [2]record{{empty, 0}, {empty, 0}})
+				nodes[node][bit] = record{len(nodes) - 1, 0}
+			}
+			node = nodes[node][bit].kind
+		}
+	}
+
+	buffer := bytes.NewBuffer(nil)
+	for _, node := range nodes {
+		for _, rec := range node {
+			value := rec.kind
+			switch rec.kind {
+			case empty:
+				value = len(nodes)
+			case leaf:
+				value = len(nodes) + 16 + rec.value
+			}
+			buffer.Write([]byte{byte(value >> 16), byte(value >> 8), byte(value)})
+		}
+	}
+	buffer.Write(make([]byte, 16))
+	buffer.Write(data)
+	buffer.Write(maxMindDBMetadataMarker)
+	buffer.Write(mmdbEncode(map[string]interface{}{
+		"node_count":  uint32(len(nodes)),
+		"record_size": uint32(24),
+		"ip_version":  uint32(4),
+	}))
+	return buffer.Bytes()
+}
+
+func writeTestGeoIPDatabase(expect shared.Expect, dir string) string {
+	germany := mmdbEncode(map[string]interface{}{"iso_code": "DE"})
+	data := mmdbEncode(map[string]interface{}{"country": germany})
+	usOffset := len(data)
+	// The US record references the country map of the first record via a
+	// pointer to test pointer decoding.
+	data = append(data, mmdbEncode(map[string]interface{}{
+		"autonomous_system_number": uint32(64512),
+		"country":                  mmdbEncode(map[string]interface{}{"iso_code": "US"}),
+	})...)
+	pointerOffset := len(data)
+	data = append(data, mmdbEncode(map[string]interface{}{
+		"country": []byte{1 << 5, byte(len(mmdbEncode("country")) + 1)},
+	})...)
+
+	path := filepath.Join(dir, "test.mmdb")
+	expect.NoError(ioutil.WriteFile(path, mmdbBuild(map[string]int{
+		"10.0.0.0/8":     0,
+		"192.168.0.0/16": usOffset,
+		"172.16.0.0/12":  pointerOffset,
+	}, data), 0600))
+	return path
+}
+
+func TestFilterGeoIP(t *testing.T) {
+	expect := shared.NewExpect(t)
+
+	dir, err := ioutil.TempDir("", "gollum_geoip")
+	expect.NoError(err)
+	defer os.RemoveAll(dir)
+
+	conf := core.NewPluginConfig("")
+	conf.Override("GeoIPDatabase", writeTestGeoIPDatabase(expect, dir))
+	conf.Override("GeoIPAccept", []string{"DE"})
+	plugin, err := core.NewPluginWithType("filter.GeoIP", conf)
+	expect.NoError(err)
+
+	filter, casted := plugin.(*GeoIP)
+	expect.True(casted)
+
+	accept := func(address string) bool {
+		msg := core.NewMessage(nil, []byte{}, 0)
+		if address != "" {
+			msg.SetMetadata(core.MetadataSourceAddress, address)
+		}
+		return filter.Accepts(msg)
+	}
+
+	expect.True(accept("10.1.2.3:5880"))
+	expect.False(accept("192.168.1.1"))
+	expect.True(accept("172.16.0.1"))
+	expect.True(accept("8.8.8.8"))
+	expect.True(accept(""))
+
+	value, known := filter.lookup(core.NewMessage(nil, []byte{}, 0))
+	expect.False(known)
+	expect.Equal("", value)
+
+	msg := core.NewMessage(nil, []byte{}, 0)
+	msg.SetMetadata(core.MetadataSourceAddress, "172.31.0.1")
+	value, known = filter.lookup(msg)
+	expect.True(known)
+	expect.Equal("DE", value)
+
+	conf.Override("GeoIPRejectUnknown", true)
+	conf.Override("GeoIPAccept", []string{})
+	conf.Override("GeoIPReject", []string{"64512"})
+	conf.Override("GeoIPField", "autonomous_system_number")
+	conf.Override("GeoIPKey", "ip")
+	plugin, err = core.NewPluginWithType("filter.GeoIP", conf)
+	expect.NoError(err)
+	filter = plugin.(*GeoIP)
+
+	expect.False(filter.Accepts(core.NewMessage(nil, []byte(`{"ip":"192.168.1.1"}`), 0)))
+	expect.False(filter.Accepts(core.NewMessage(nil, []byte(`{"ip":"10.1.2.3"}`), 0)))
+	expect.False(filter.Accepts(core.NewMessage(nil, []byte(`{"ip":"8.8.8.8"}`), 0)))
+
+	conf.Override("GeoIPDatabase", filepath.Join(dir, "missing.mmdb"))
+	_, err = core.NewPluginWithType("filter.GeoIP", conf)
+	expect.NotNil(err)
+}
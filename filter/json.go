@@ -36,6 +36,16 @@ import (
 //      "args/results[0]value" : "true"
 //      "args/results[1]" : "true"
 //      "command" : "state\d\..*"
+//    FilterRejectConditions:
+//      - Field: "internal"
+//        Operator: "exists"
+//    FilterAcceptConditions:
+//      - Field: "level"
+//        Operator: "equals"
+//        Value: "error"
+//      - Field: "latency_ms"
+//        Operator: ">"
+//        Value: 500
 //
 // FilterReject defines fields that will cause a message to be rejected if the
 // given regular expression matches. Rejects are checked before Accepts.
@@ -44,9 +54,29 @@ import (
 // FilterAccept defines fields that will cause a message to be rejected if the
 // given regular expression does not match.
 // Field paths can be defined in a format accepted by shared.MarshalMap.Path.
+//
+// FilterRejectConditions defines a list of conditions that will cause a message
+// to be rejected if any of them is true. These are checked after FilterReject.
+// Each condition consists of a "Field", an "Operator" and a "Value". Setting
+// "Not" to true negates a condition. Conditions on fields that do not exist
+// are false even if negated, except for "exists". Field paths can be defined
+// in a format accepted by shared.MarshalMap.Path.
+// Supported operators are:
+//  * "exists" is true if the field exists. No value is required.
+//  * "equals" is true if the field equals the value as a string.
+//  * "contains" is true if the field contains the value as a string.
+//  * "regex" is true if the regular expression given as value matches.
+//  * "==", "!=", "<", "<=", ">", ">=" compare the field numerically with the
+//    value. Fields that are not numbers are false.
+//
+// FilterAcceptConditions defines a list of conditions that will cause a message
+// to be rejected if any of them is false. These are checked after
+// FilterAccept. Conditions are defined like FilterRejectConditions.
 type JSON struct {
-	rejectValues map[string]*regexp.Regexp
-	acceptValues map[string]*regexp.Regexp
+	rejectValues     map[string]*regexp.Regexp
+	acceptValues     map[string]*regexp.Regexp
+	rejectConditions []filterCondition
+	acceptConditions []filterCondition
 }
 
 func init() {
@@ -78,6 +108,14 @@ func (filter *JSON) Configure(conf core.PluginConfig) error {
 		filter.acceptValues[key] = exp
 	}
 
+	var err error
+	if filter.rejectConditions, err = newFilterConditions("FilterRejectConditions", conf.GetValue("FilterRejectConditions", nil)); err != nil {
+		return err
+	}
+	if filter.acceptConditions, err = newFilterConditions("FilterAcceptConditions", conf.GetValue("FilterAcceptConditions", nil)); err != nil {
+		return err
+	}
+
 	return nil
 }
 
@@ -98,6 +136,17 @@ func (filter *JSON) getValue(key string, values shared.MarshalMap) (string, bool
 	return "", false
 }
 
+// matches returns true if the condition is true for the given values
+func (filter *JSON) matches(condition filterCondition, values shared.MarshalMap) bool {
+	if condition.operator == "exists" {
+		_, exists := values.Path(condition.path)
+		return condition.matches("", exists) // ### return, exists ###
+	}
+
+	value, exists := filter.getValue(condition.path, values)
+	return condition.matches(value, exists)
+}
+
 // Accepts checks JSON field values and rejects messages after testing a
 // blacklist and a whitelist.
 func (filter *JSON) Accepts(msg core.Message) bool {
@@ -115,6 +164,12 @@ func (filter *JSON) Accepts(msg core.Message) bool {
 		}
 	}
 
+	for _, condition := range filter.rejectConditions {
+		if filter.matches(condition, values) {
+			return false
+		}
+	}
+
 	// Check accepts
 	for key, exp := range filter.acceptValues {
 		if value, exists := filter.getValue(key, values); exists {
@@ -124,5 +179,11 @@ func (filter *JSON) Accepts(msg core.Message) bool {
 		}
 	}
 
+	for _, condition := range filter.acceptConditions {
+		if !filter.matches(condition, values) {
+			return false
+		}
+	}
+
 	return true
 }
@@ -59,3 +59,48 @@ func TestFilterJSON(t *testing.T) {
 	expect.True(filter.Accepts(msg2))
 	expect.False(filter.Accepts(msg3))
 }
+
+func TestFilterJSONConditions(t *testing.T) {
+	expect := shared.NewExpect(t)
+	conf := core.NewPluginConfig("")
+
+	conf.Override("FilterRejectConditions", []interface{}{
+		map[interface{}]interface{}{"Field": "internal", "Operator": "exists"},
+	})
+	conf.Override("FilterAcceptConditions", []interface{}{
+		map[interface{}]interface{}{"Field": "level", "Operator": "equals", "Value": "error"},
+		map[interface{}]interface{}{"Field": "request/latency", "Operator": ">", "Value": 500},
+		map[interface{}]interface{}{"Field": "message", "Operator": "contains", "Value": "debug", "Not": true},
+		map[interface{}]interface{}{"Field": "host", "Operator": "regex", "Value": "^web\\d+$"},
+	})
+	plugin, err := core.NewPluginWithType("filter.JSON", conf)
+	expect.NoError(err)
+
+	filter, casted := plugin.(*JSON)
+	expect.True(casted)
+
+	accept := func(payload string) bool {
+		return filter.Accepts(core.NewMessage(nil, []byte(payload), 0))
+	}
+
+	expect.True(accept(`{"level":"error","request":{"latency":501},"message":"timeout","host":"web1"}`))
+	expect.False(accept(`{"level":"error","request":{"latency":501},"message":"timeout","host":"web1","internal":false}`))
+	expect.False(accept(`{"level":"info","request":{"latency":501},"message":"timeout","host":"web1"}`))
+	expect.False(accept(`{"level":"error","request":{"latency":500},"message":"timeout","host":"web1"}`))
+	expect.False(accept(`{"level":"error","request":{"latency":"slow"},"message":"timeout","host":"web1"}`))
+	expect.False(accept(`{"level":"error","request":{"latency":501},"message":"debug timeout","host":"web1"}`))
+	expect.False(accept(`{"level":"error","request":{"latency":501},"message":"timeout","host":"db1"}`))
+	expect.False(accept(`{"level":"error","request":{"latency":501},"host":"web1"}`))
+
+	conf.Override("FilterAcceptConditions", []interface{}{
+		map[interface{}]interface{}{"Field": "latency", "Operator": "<", "Value": "fast"},
+	})
+	_, err = core.NewPluginWithType("filter.JSON", conf)
+	expect.NotNil(err)
+
+	conf.Override("FilterAcceptConditions", []interface{}{
+		map[interface{}]interface{}{"Field": "latency", "Operator": "like", "Value": 1},
+	})
+	_, err = core.NewPluginWithType("filter.JSON", conf)
+	expect.NotNil(err)
+}
@@ -0,0 +1,346 @@
+// Copyright 2015-2016 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filter
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/core/log"
+	"github.com/trivago/gollum/shared"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// List filter plugin
+// This plugin matches a message against allow and deny lists loaded from
+// files. Each line of a file defines one entry. Empty lines and lines starting
+// with "#" are ignored. Files are reloaded when they change or when gollum
+// receives SIGHUP.
+// Configuration example
+//
+//   - "stream.Broadcast":
+//     Filter: "filter.List"
+//     ListAllowFile: ""
+//     ListDenyFile: "/etc/gollum/blocklist.txt"
+//     ListMode: "exact"
+//     ListKey: ""
+//     ListMetadataKey: ""
+//     ListReloadIntervalMs: 10000
+//     ListDropToStream: ""
+//
+// ListAllowFile defines a file of entries to pass. If set, messages that do
+// not match any entry are blocked. By default this is set to "".
+//
+// ListDenyFile defines a file of entries to block. The deny list is checked
+// before the allow list. By default this is set to "".
+//
+// ListMode defines how entries are matched. By default this is set to "exact".
+//  * "exact" matches if the value equals an entry.
+//  * "prefix" matches if the value starts with an entry.
+//  * "cidr" matches if the value is an IP address within a network given in
+//    CIDR notation, e.g. "10.0.0.0/8". Plain addresses match themselves.
+//
+// ListKey defines a field of a JSON payload to match against the lists.
+// Field paths can be defined in a format accepted by shared.MarshalMap.Path.
+// By default this is set to "".
+//
+// ListMetadataKey defines a metadata key to match against the lists. If both
+// ListKey and ListMetadataKey are set, the metadata value is preferred. If
+// neither is set, the whole payload is matched. Messages without the given key
+// are blocked if an allow list is set and passed otherwise.
+// By default this is set to "".
+//
+// ListReloadIntervalMs defines the interval in milliseconds in which the files
+// are checked for changes. Set to 0 to reload only on SIGHUP.
+// By default this is set to 10000.
+//
+// ListDropToStream is an optional stream messages are sent to when they
+// are blocked. By default this is disabled and set to "".
+type List struct {
+	allow          *listFile
+	deny           *listFile
+	mode           int
+	key            string
+	metadataKey    string
+	reloadInterval time.Duration
+	dropStreamID   core.MessageStreamID
+}
+
+const (
+	listModeExact = iota
+	listModePrefix
+	listModeCIDR
+)
+
+type listFile struct {
+	path    string
+	mode    int
+	modTime time.Time
+	size    int64
+	entries *listEntries
+	guard   *sync.RWMutex
+}
+
+type listEntries struct {
+	values   map[string]struct{}
+	networks map[listNetworkMask]map[string]struct{}
+}
+
+type listNetworkMask struct {
+	ones int
+	bits int
+}
+
+func init() {
+	shared.TypeRegistry.Register(List{})
+}
+
+// Configure initializes this filter with values from a plugin config.
+func (filter *List) Configure(conf core.PluginConfig) error {
+	filter.key = conf.GetString("ListKey", "")
+	filter.metadataKey = conf.GetString("ListMetadataKey", "")
+	filter.reloadInterval = time.Duration(conf.GetInt("ListReloadIntervalMs", 10000)) * time.Millisecond
+
+	mode := strings.ToLower(conf.GetString("ListMode", "exact"))
+	switch mode {
+	case "exact":
+		filter.mode = listModeExact
+	case "prefix":
+		filter.mode = listModePrefix
+	case "cidr":
+		filter.mode = listModeCIDR
+	default:
+		return fmt.Errorf("Unknown ListMode: %s", mode)
+	}
+
+	var err error
+	if filter.allow, err = filter.newListFile(conf.GetString("ListAllowFile", "")); err != nil {
+		return err
+	}
+	if filter.deny, err = filter.newListFile(conf.GetString("ListDenyFile", "")); err != nil {
+		return err
+	}
+
+	filter.dropStreamID = core.InvalidStreamID
+	if dropToStream := conf.GetString("ListDropToStream", ""); dropToStream != "" {
+		filter.dropStreamID = core.GetStreamID(dropToStream)
+	}
+
+	if filter.reloadInterval > 0 && (filter.allow != nil || filter.deny != nil) {
+		time.AfterFunc(filter.reloadInterval, filter.reloadOnChange)
+	}
+	return nil
+}
+
+func (filter *List) newListFile(path string) (*listFile, error) {
+	if path == "" {
+		return nil, nil // ### return, not set ###
+	}
+
+	list := &listFile{
+		path:  path,
+		mode:  filter.mode,
+		guard: new(sync.RWMutex),
+	}
+	if err := list.load(); err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+// load reads all entries from the list file and replaces the current entries
+func (list *listFile) load() error {
+	file, err := os.Open(list.path)
+	if err != nil {
+		return err // ### return, cannot open ###
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return err // ### return, cannot stat ###
+	}
+
+	entries := newListEntries()
+	scanner := bufio.NewScanner(file)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue // ### continue, comment ###
+		}
+		if list.mode != listModeCIDR {
+			entries.values[line] = struct{}{}
+			continue // ### continue, value added ###
+		}
+		if err := entries.addNetwork(line); err != nil {
+			return fmt.Errorf("%s:%d: %s", list.path, lineNum, err.Error())
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	list.guard.Lock()
+	list.entries = entries
+	list.modTime = info.ModTime()
+	list.size = info.Size()
+	list.guard.Unlock()
+	return nil
+}
+
+// changed returns true if the list file has been modified since last loaded
+func (list *listFile) changed() bool {
+	info, err := os.Stat(list.path)
+	if err != nil {
+		return false // ### return, keep current entries ###
+	}
+
+	list.guard.RLock()
+	defer list.guard.RUnlock()
+	return !info.ModTime().Equal(list.modTime) || info.Size() != list.size
+}
+
+func newListEntries() *listEntries {
+	return &listEntries{
+		values:   make(map[string]struct{}),
+		networks: make(map[listNetworkMask]map[string]struct{}),
+	}
+}
+
+// addNetwork adds an entry in CIDR notation or a plain IP address
+func (entries *listEntries) addNetwork(entry string) error {
+	if !strings.Contains(entry, "/") {
+		ip := net.ParseIP(entry)
+		if ip == nil {
+			return fmt.Errorf("Invalid IP address %s", entry)
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			entry += "/32"
+		} else {
+			entry += "/128"
+		}
+	}
+
+	_, network, err := net.ParseCIDR(entry)
+	if err != nil {
+		return err
+	}
+
+	ones, bits := network.Mask.Size()
+	mask := listNetworkMask{ones: ones, bits: bits}
+	if _, known := entries.networks[mask]; !known {
+		entries.networks[mask] = make(map[string]struct{})
+	}
+	entries.networks[mask][string(network.IP)] = struct{}{}
+	return nil
+}
+
+// containsIP returns true if the given address is part of a network
+func (entries *listEntries) containsIP(ip net.IP) bool {
+	bits := 128
+	if ip4 := ip.To4(); ip4 != nil {
+		ip, bits = ip4, 32
+	}
+	for mask, networks := range entries.networks {
+		if mask.bits != bits {
+			continue // ### continue, other address family ###
+		}
+		if _, exists := networks[string(ip.Mask(net.CIDRMask(mask.ones, mask.bits)))]; exists {
+			return true
+		}
+	}
+	return false
+}
+
+// matches returns true if the given value matches an entry of the list
+func (list *listFile) matches(value string) bool {
+	list.guard.RLock()
+	defer list.guard.RUnlock()
+
+	switch list.mode {
+	case listModePrefix:
+		for i := 0; i <= len(value); i++ {
+			if _, exists := list.entries.values[value[:i]]; exists {
+				return true
+			}
+		}
+		return false
+
+	case listModeCIDR:
+		ip := net.ParseIP(value)
+		if ip == nil {
+			return false // ### return, no IP ###
+		}
+		return list.entries.containsIP(ip)
+
+	default:
+		_, exists := list.entries.values[value]
+		return exists
+	}
+}
+
+func (filter *List) reload(onlyChanged bool) {
+	for _, list := range []*listFile{filter.allow, filter.deny} {
+		if list == nil || onlyChanged && !list.changed() {
+			continue // ### continue, nothing to reload ###
+		}
+		if err := list.load(); err != nil {
+			Log.Error.Print("List filter failed to reload: ", err)
+		} else {
+			Log.Note.Print("List filter reloaded ", list.path)
+		}
+	}
+}
+
+func (filter *List) reloadOnChange() {
+	filter.reload(true)
+	time.AfterFunc(filter.reloadInterval, filter.reloadOnChange)
+}
+
+// Roll reloads all list files
+func (filter *List) Roll() {
+	filter.reload(false)
+}
+
+// Accepts checks a message against the deny and allow list
+func (filter *List) Accepts(msg core.Message) bool {
+	value, hasValue := string(msg.Data), true
+	if filter.key != "" || filter.metadataKey != "" {
+		value, hasValue = getMessageKey(msg, filter.metadataKey, filter.key)
+	}
+
+	accept := true
+	switch {
+	case !hasValue:
+		accept = filter.allow == nil
+	case filter.deny != nil && filter.deny.matches(value):
+		accept = false
+	case filter.allow != nil:
+		accept = filter.allow.matches(value)
+	}
+
+	if !accept {
+		if filter.dropStreamID != core.InvalidStreamID {
+			msg.Route(filter.dropStreamID)
+		}
+		return false // ### return, filter ###
+	}
+
+	return true
+}
@@ -0,0 +1,117 @@
+// Copyright 2015-2016 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filter
+
+import (
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/shared"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFilterList(t *testing.T) {
+	expect := shared.NewExpect(t)
+
+	dir, err := ioutil.TempDir("", "gollum_list")
+	expect.NoError(err)
+	defer os.RemoveAll(dir)
+
+	allowFile := filepath.Join(dir, "allow.txt")
+	denyFile := filepath.Join(dir, "deny.txt")
+	expect.NoError(ioutil.WriteFile(allowFile, []byte("# services\nweb\n\napi\n"), 0600))
+	expect.NoError(ioutil.WriteFile(denyFile, []byte("api\n"), 0600))
+
+	conf := core.NewPluginConfig("")
+	conf.Override("ListAllowFile", allowFile)
+	conf.Override("ListDenyFile", denyFile)
+	conf.Override("ListKey", "app")
+	conf.Override("ListReloadIntervalMs", 0)
+	plugin, err := core.NewPluginWithType("filter.List", conf)
+	expect.NoError(err)
+
+	filter, casted := plugin.(*List)
+	expect.True(casted)
+
+	accept := func(payload string) bool {
+		return filter.Accepts(core.NewMessage(nil, []byte(payload), 0))
+	}
+
+	expect.True(accept(`{"app":"web"}`))
+	expect.False(accept(`{"app":"api"}`))
+	expect.False(accept(`{"app":"db"}`))
+	expect.False(accept(`{"service":"web"}`))
+
+	expect.NoError(ioutil.WriteFile(denyFile, []byte("web\n"), 0600))
+	filter.Roll()
+
+	expect.False(accept(`{"app":"web"}`))
+	expect.True(accept(`{"app":"api"}`))
+
+	conf.Override("ListAllowFile", filepath.Join(dir, "missing.txt"))
+	_, err = core.NewPluginWithType("filter.List", conf)
+	expect.NotNil(err)
+}
+
+func TestFilterListModes(t *testing.T) {
+	expect := shared.NewExpect(t)
+
+	dir, err := ioutil.TempDir("", "gollum_list")
+	expect.NoError(err)
+	defer os.RemoveAll(dir)
+
+	denyFile := filepath.Join(dir, "deny.txt")
+	expect.NoError(ioutil.WriteFile(denyFile, []byte("10.0.0.0/8\n192.168.1.1\n2001:db8::/32\n"), 0600))
+
+	conf := core.NewPluginConfig("")
+	conf.Override("ListDenyFile", denyFile)
+	conf.Override("ListMode", "cidr")
+	conf.Override("ListMetadataKey", core.MetadataSourceAddress)
+	conf.Override("ListReloadIntervalMs", 0)
+	plugin, err := core.NewPluginWithType("filter.List", conf)
+	expect.NoError(err)
+
+	filter, casted := plugin.(*List)
+	expect.True(casted)
+
+	accept := func(address string) bool {
+		msg := core.NewMessage(nil, []byte{}, 0)
+		msg.SetMetadata(core.MetadataSourceAddress, address)
+		return filter.Accepts(msg)
+	}
+
+	expect.False(accept("10.1.2.3"))
+	expect.False(accept("192.168.1.1"))
+	expect.True(accept("192.168.1.2"))
+	expect.False(accept("2001:db8::1"))
+	expect.True(accept("2001:db9::1"))
+	expect.True(accept("no address"))
+
+	expect.NoError(ioutil.WriteFile(denyFile, []byte("/var/log/\n"), 0600))
+	conf.Override("ListMode", "prefix")
+	conf.Override("ListMetadataKey", "")
+	plugin, err = core.NewPluginWithType("filter.List", conf)
+	expect.NoError(err)
+	filter = plugin.(*List)
+
+	expect.False(filter.Accepts(core.NewMessage(nil, []byte("/var/log/syslog"), 0)))
+	expect.True(filter.Accepts(core.NewMessage(nil, []byte("/var/lib/foo"), 0)))
+
+	expect.NoError(ioutil.WriteFile(denyFile, []byte("not a network\n"), 0600))
+	conf.Override("ListMode", "cidr")
+	_, err = core.NewPluginWithType("filter.List", conf)
+	expect.NotNil(err)
+}
@@ -0,0 +1,204 @@
+// Copyright 2015-2016 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filter
+
+import (
+	"fmt"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/core/log"
+	"github.com/trivago/gollum/shared"
+	"github.com/yuin/gopher-lua"
+	"sync"
+	"time"
+)
+
+// Lua filter plugin
+// This plugin passes each message to a function of a Lua script that decides
+// whether the message is accepted. The function is called with the payload
+// (string), the message metadata (table), the name of the message stream
+// (string) and a state table. The state table is kept between calls and there
+// is one table per stream, e.g. to count messages or to remember values seen.
+// The function returns true to accept a message and false or nil to reject
+// it. A string can be returned as second value to describe why the message
+// has been rejected. If the name of a stream is returned instead of a boolean,
+// the message is routed to this stream and rejected on the current one.
+// Changes to the metadata table are written back to the message.
+// All messages are passed to the same Lua state, so the script is run for one
+// message at a time. Only the base, table, string and math libraries are
+// available.
+// Configuration example
+//
+//   - "stream.Broadcast":
+//     Filter: "filter.Lua"
+//     LuaFilterScript: |
+//       function filter(payload, metadata, stream, state)
+//         state.count = (state.count or 0) + 1
+//         if string.find(payload, "debug") then
+//           return false, "debug message"
+//         end
+//         return true
+//       end
+//     LuaFilterScriptFile: ""
+//     LuaFilterFunction: "filter"
+//     LuaFilterTimeoutMs: 100
+//     LuaFilterInstructionLimit: 1000000
+//     LuaFilterCallStackSize: 256
+//     LuaFilterAcceptOnError: false
+//
+// LuaFilterScript defines the script to run. By default this is set to "".
+//
+// LuaFilterScriptFile defines a file to read the script from. If set, this
+// option overrides LuaFilterScript. By default this is set to "".
+//
+// LuaFilterFunction defines the name of the global function to call for each
+// message. By default this is set to "filter".
+//
+// LuaFilterTimeoutMs defines the maximum wall-clock time in milliseconds a
+// single call may take. Scripts exceeding this limit are aborted. Set to 0 to
+// disable. By default this is set to 100.
+//
+// LuaFilterInstructionLimit defines the maximum number of Lua instructions a
+// single call may execute. Scripts exceeding this limit are aborted. Set to 0
+// to disable. By default this is set to 1000000.
+//
+// LuaFilterCallStackSize defines the maximum depth of the Lua call stack.
+// By default this is set to 256.
+//
+// LuaFilterAcceptOnError can be set to true to accept messages if the script
+// fails or exceeds one of its limits. By default this is set to false, i.e.
+// these messages are rejected and a warning is logged.
+type Lua struct {
+	function      string
+	timeout       time.Duration
+	maxInstr      int
+	acceptOnError bool
+	state         *lua.LState
+	streamStates  map[core.MessageStreamID]*lua.LTable
+	stateGuard    *sync.Mutex
+}
+
+func init() {
+	shared.TypeRegistry.Register(Lua{})
+}
+
+// Configure initializes this filter with values from a plugin config.
+func (filter *Lua) Configure(conf core.PluginConfig) error {
+	script := conf.GetString("LuaFilterScript", "")
+	scriptFile := conf.GetString("LuaFilterScriptFile", "")
+	if script == "" && scriptFile == "" {
+		return fmt.Errorf("Lua requires LuaFilterScript or LuaFilterScriptFile to be set")
+	}
+	proto, err := shared.CompileLua(script, scriptFile)
+	if err != nil {
+		return err
+	}
+
+	filter.function = conf.GetString("LuaFilterFunction", "filter")
+	filter.timeout = time.Duration(conf.GetInt("LuaFilterTimeoutMs", 100)) * time.Millisecond
+	filter.maxInstr = conf.GetInt("LuaFilterInstructionLimit", 1000000)
+	filter.acceptOnError = conf.GetBool("LuaFilterAcceptOnError", false)
+	callStackSize := shared.MaxI(conf.GetInt("LuaFilterCallStackSize", 256), 16)
+
+	if filter.state, err = shared.NewLuaState(proto, filter.function, callStackSize); err != nil {
+		return err
+	}
+	filter.streamStates = make(map[core.MessageStreamID]*lua.LTable)
+	filter.stateGuard = new(sync.Mutex)
+
+	core.RegisterMetadataWriter()
+	return nil
+}
+
+// call runs the script function for the given message and returns whether
+// the message has been accepted and the reason or stream name returned.
+// stateGuard has to be locked.
+func (filter *Lua) call(msg core.Message) (lua.LValue, lua.LValue, error) {
+	streamState, exists := filter.streamStates[msg.StreamID]
+	if !exists {
+		streamState = filter.state.NewTable()
+		filter.streamStates[msg.StreamID] = streamState
+	}
+
+	metadata := filter.state.NewTable()
+	for key, value := range msg.Metadata {
+		metadata.RawSetString(key, lua.LString(value))
+	}
+
+	done := shared.LimitLuaState(filter.state, filter.timeout, filter.maxInstr)
+	defer done()
+
+	err := filter.state.CallByParam(lua.P{
+		Fn:      filter.state.GetGlobal(filter.function),
+		NRet:    2,
+		Protect: true,
+	}, lua.LString(msg.Data), metadata, lua.LString(core.StreamRegistry.GetStreamName(msg.StreamID)), streamState)
+	if err != nil {
+		return lua.LNil, lua.LNil, err
+	}
+
+	result := filter.state.Get(-2)
+	reason := filter.state.Get(-1)
+	filter.state.Pop(2)
+
+	for key := range msg.Metadata {
+		delete(msg.Metadata, key)
+	}
+	metadata.ForEach(func(key lua.LValue, value lua.LValue) {
+		msg.SetMetadata(key.String(), value.String())
+	})
+	return result, reason, nil
+}
+
+// Accepts returns true if the script accepts the message
+func (filter *Lua) Accepts(msg core.Message) bool {
+	accepted, _ := filter.AcceptsWithReason(msg)
+	return accepted
+}
+
+// AcceptsWithReason works like Accepts and returns the reason returned by the
+// script if a message is rejected.
+func (filter *Lua) AcceptsWithReason(msg core.Message) (bool, string) {
+	filter.stateGuard.Lock()
+	result, reason, err := filter.call(msg)
+	filter.stateGuard.Unlock()
+
+	if err != nil {
+		if filter.acceptOnError {
+			return true, "" // ### return, accept on error ###
+		}
+		Log.Warning.Print("Lua filter failed: ", err)
+		return false, "script failed" // ### return, reject on error ###
+	}
+
+	switch result.Type() {
+	case lua.LTString:
+		streamName := result.String()
+		msg.Route(core.StreamRegistry.GetStreamID(streamName))
+		return false, "routed to " + streamName
+
+	case lua.LTNil, lua.LTBool:
+		if lua.LVAsBool(result) {
+			return true, ""
+		}
+		if reason.Type() != lua.LTNil {
+			return false, reason.String()
+		}
+		return false, "rejected by script"
+
+	default:
+		Log.Warning.Print("Lua filter script returned ", result.Type(), " instead of a boolean or stream name")
+		return filter.acceptOnError, "invalid script result"
+	}
+}
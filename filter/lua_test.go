@@ -0,0 +1,129 @@
+// Copyright 2015-2016 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filter
+
+import (
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/shared"
+	"testing"
+)
+
+func TestFilterLua(t *testing.T) {
+	expect := shared.NewExpect(t)
+	conf := core.NewPluginConfig("")
+
+	routed := &mockAlertStream{}
+	core.StreamRegistry.Register(routed, core.GetStreamID("luaRouted"))
+
+	conf.Override("LuaFilterScript", `
+function filter(payload, metadata, stream, state)
+  state.count = (state.count or 0) + 1
+  metadata["count"] = tostring(state.count)
+  if payload == "route" then
+    return "luaRouted"
+  end
+  if payload == "reject" then
+    return false, "rejected " .. stream
+  end
+  return payload ~= "drop"
+end`)
+	plugin, err := core.NewPluginWithType("filter.Lua", conf)
+	expect.NoError(err)
+
+	filter, casted := plugin.(*Lua)
+	expect.True(casted)
+
+	msg := core.NewMessage(nil, []byte("test"), 0)
+	msg.StreamID = core.StreamRegistry.GetStreamID("luaA")
+	msg.PrepareMetadata()
+	expect.True(filter.Accepts(msg))
+	expect.MapEqual(msg.Metadata, "count", "1")
+
+	msg.Data = []byte("drop")
+	accepted, reason := filter.AcceptsWithReason(msg)
+	expect.False(accepted)
+	expect.Equal("rejected by script", reason)
+
+	msg.Data = []byte("reject")
+	accepted, reason = filter.AcceptsWithReason(msg)
+	expect.False(accepted)
+	expect.Equal("rejected luaA", reason)
+	expect.MapEqual(msg.Metadata, "count", "3")
+
+	msg.Data = []byte("route")
+	accepted, reason = filter.AcceptsWithReason(msg)
+	expect.False(accepted)
+	expect.Equal("routed to luaRouted", reason)
+	expect.Equal(1, len(routed.messages))
+
+	// Each stream has its own state table
+	msg = core.NewMessage(nil, []byte("test"), 0)
+	msg.StreamID = core.StreamRegistry.GetStreamID("luaB")
+	msg.PrepareMetadata()
+	expect.True(filter.Accepts(msg))
+	expect.MapEqual(msg.Metadata, "count", "1")
+}
+
+func TestFilterLuaLimits(t *testing.T) {
+	expect := shared.NewExpect(t)
+	conf := core.NewPluginConfig("")
+
+	conf.Override("LuaFilterScript", `
+function filter(payload, metadata, stream, state)
+  if payload == "loop" then
+    while true do end
+  end
+  if payload == "fail" then
+    error("failed")
+  end
+  if payload == "table" then
+    return {}
+  end
+  return true
+end`)
+	conf.Override("LuaFilterTimeoutMs", 0)
+	conf.Override("LuaFilterInstructionLimit", 1000)
+	plugin, err := core.NewPluginWithType("filter.Lua", conf)
+	expect.NoError(err)
+
+	filter, casted := plugin.(*Lua)
+	expect.True(casted)
+
+	for _, payload := range []string{"loop", "fail", "table"} {
+		expect.False(filter.Accepts(core.NewMessage(nil, []byte(payload), 0)))
+	}
+	expect.True(filter.Accepts(core.NewMessage(nil, []byte("ok"), 0)))
+
+	conf.Override("LuaFilterTimeoutMs", 50)
+	conf.Override("LuaFilterInstructionLimit", 0)
+	conf.Override("LuaFilterAcceptOnError", true)
+	plugin, err = core.NewPluginWithType("filter.Lua", conf)
+	expect.NoError(err)
+
+	filter, casted = plugin.(*Lua)
+	expect.True(casted)
+
+	expect.True(filter.Accepts(core.NewMessage(nil, []byte("loop"), 0)))
+	expect.True(filter.Accepts(core.NewMessage(nil, []byte("ok"), 0)))
+
+	conf = core.NewPluginConfig("")
+	conf.Override("LuaFilterScript", "function other() end")
+	_, err = core.NewPluginWithType("filter.Lua", conf)
+	expect.NotNil(err)
+
+	conf = core.NewPluginConfig("")
+	_, err = core.NewPluginWithType("filter.Lua", conf)
+	expect.NotNil(err)
+}
@@ -0,0 +1,165 @@
+// Copyright 2015-2016 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filter
+
+import (
+	"fmt"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/shared"
+	"regexp"
+)
+
+// Metadata filter plugin
+// This plugin filters messages by looking at metadata set by consumers or
+// formatters, e.g. the "source_address" of network based consumers or fields
+// extracted by format.JSONParse. As the payload is not parsed, this is a lot
+// cheaper than filter.JSON.
+// Configuration example
+//
+//   - "stream.Broadcast":
+//     Filter: "filter.Metadata"
+//     MetadataReject:
+//       "source_address": "^10\.0\.0\.1:"
+//     MetadataAccept:
+//       "client_cn": "^service-.*$"
+//     MetadataRejectConditions:
+//       - Field: "debug"
+//         Operator: "exists"
+//     MetadataAcceptConditions:
+//       - Field: "partition"
+//         Operator: "<"
+//         Value: 4
+//     MetadataDropToStream: ""
+//
+// MetadataReject defines metadata keys that will cause a message to be
+// rejected if the given regular expression matches. Rejects are checked before
+// accepts.
+//
+// MetadataAccept defines metadata keys that will cause a message to be
+// rejected if the given regular expression does not match. Messages without
+// one of these keys are rejected, too.
+//
+// MetadataRejectConditions defines a list of conditions that will cause a
+// message to be rejected if any of them is true. "Field" names a metadata key.
+// The supported operators are the same as for the FilterRejectConditions of
+// filter.JSON. These are checked after MetadataReject.
+//
+// MetadataAcceptConditions defines a list of conditions that will cause a
+// message to be rejected if any of them is false. These are checked after
+// MetadataAccept. Conditions are defined like MetadataRejectConditions.
+//
+// MetadataDropToStream is an optional stream messages are sent to when they
+// are rejected. By default this is disabled and set to "".
+type Metadata struct {
+	rejectValues     map[string]*regexp.Regexp
+	acceptValues     map[string]*regexp.Regexp
+	rejectConditions []filterCondition
+	acceptConditions []filterCondition
+	dropStreamID     core.MessageStreamID
+}
+
+func init() {
+	shared.TypeRegistry.Register(Metadata{})
+}
+
+// Configure initializes this filter with values from a plugin config.
+func (filter *Metadata) Configure(conf core.PluginConfig) error {
+	var err error
+	if filter.rejectValues, err = compileMetadataValues(conf.GetStringMap("MetadataReject", make(map[string]string))); err != nil {
+		return err
+	}
+	if filter.acceptValues, err = compileMetadataValues(conf.GetStringMap("MetadataAccept", make(map[string]string))); err != nil {
+		return err
+	}
+	if filter.rejectConditions, err = newFilterConditions("MetadataRejectConditions", conf.GetValue("MetadataRejectConditions", nil)); err != nil {
+		return err
+	}
+	if filter.acceptConditions, err = newFilterConditions("MetadataAcceptConditions", conf.GetValue("MetadataAcceptConditions", nil)); err != nil {
+		return err
+	}
+
+	filter.dropStreamID = core.InvalidStreamID
+	if dropToStream := conf.GetString("MetadataDropToStream", ""); dropToStream != "" {
+		filter.dropStreamID = core.GetStreamID(dropToStream)
+	}
+	return nil
+}
+
+func compileMetadataValues(values map[string]string) (map[string]*regexp.Regexp, error) {
+	expressions := make(map[string]*regexp.Regexp)
+	for key, val := range values {
+		exp, err := regexp.Compile(val)
+		if err != nil {
+			return nil, err
+		}
+		expressions[key] = exp
+	}
+	return expressions, nil
+}
+
+// check returns an empty string if the message passes or the reason why it
+// was rejected.
+func (filter *Metadata) check(msg core.Message) string {
+	for key, exp := range filter.rejectValues {
+		if value, exists := msg.Metadata[key]; exists && exp.MatchString(value) {
+			return fmt.Sprintf("%s matches %s", key, exp) // ### return, reject ###
+		}
+	}
+
+	for _, condition := range filter.rejectConditions {
+		value, exists := msg.Metadata[condition.path]
+		if condition.matches(value, exists) {
+			return fmt.Sprintf("%s %s condition is true", condition.path, condition.operator) // ### return, reject ###
+		}
+	}
+
+	for key, exp := range filter.acceptValues {
+		value, exists := msg.Metadata[key]
+		if !exists {
+			return fmt.Sprintf("%s is not set", key) // ### return, reject ###
+		}
+		if !exp.MatchString(value) {
+			return fmt.Sprintf("%s does not match %s", key, exp) // ### return, reject ###
+		}
+	}
+
+	for _, condition := range filter.acceptConditions {
+		value, exists := msg.Metadata[condition.path]
+		if !condition.matches(value, exists) {
+			return fmt.Sprintf("%s %s condition is false", condition.path, condition.operator) // ### return, reject ###
+		}
+	}
+
+	return ""
+}
+
+// AcceptsWithReason checks the metadata of a message and returns why it was
+// rejected.
+func (filter *Metadata) AcceptsWithReason(msg core.Message) (bool, string) {
+	if reason := filter.check(msg); reason != "" {
+		if filter.dropStreamID != core.InvalidStreamID {
+			msg.Route(filter.dropStreamID)
+		}
+		return false, reason // ### return, filter ###
+	}
+	return true, ""
+}
+
+// Accepts checks the metadata of a message against a blacklist and a
+// whitelist.
+func (filter *Metadata) Accepts(msg core.Message) bool {
+	accept, _ := filter.AcceptsWithReason(msg)
+	return accept
+}
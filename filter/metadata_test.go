@@ -0,0 +1,89 @@
+// Copyright 2015-2016 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filter
+
+import (
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/shared"
+	"testing"
+)
+
+func TestFilterMetadata(t *testing.T) {
+	expect := shared.NewExpect(t)
+	conf := core.NewPluginConfig("")
+
+	conf.Override("MetadataReject", map[string]string{"source_address": "^10\\.0\\.0\\.1:"})
+	conf.Override("MetadataAccept", map[string]string{"client_cn": "^service-"})
+	plugin, err := core.NewPluginWithType("filter.Metadata", conf)
+	expect.NoError(err)
+
+	filter, casted := plugin.(*Metadata)
+	expect.True(casted)
+
+	msg := core.NewMessage(nil, []byte("test"), 0)
+	expect.False(filter.Accepts(msg))
+
+	msg.SetMetadata("client_cn", "service-a")
+	expect.True(filter.Accepts(msg))
+
+	msg.SetMetadata("source_address", "10.0.0.1:1234")
+	accept, reason := filter.AcceptsWithReason(msg)
+	expect.False(accept)
+	expect.Equal("source_address matches ^10\\.0\\.0\\.1:", reason)
+
+	msg.SetMetadata("source_address", "10.0.0.2:1234")
+	expect.True(filter.Accepts(msg))
+
+	msg.SetMetadata("client_cn", "user-a")
+	accept, reason = filter.AcceptsWithReason(msg)
+	expect.False(accept)
+	expect.Equal("client_cn does not match ^service-", reason)
+}
+
+func TestFilterMetadataConditions(t *testing.T) {
+	expect := shared.NewExpect(t)
+	conf := core.NewPluginConfig("")
+
+	conf.Override("MetadataRejectConditions", []interface{}{
+		map[interface{}]interface{}{"Field": "debug", "Operator": "exists"},
+	})
+	conf.Override("MetadataAcceptConditions", []interface{}{
+		map[interface{}]interface{}{"Field": "partition", "Operator": "<", "Value": 4},
+	})
+	plugin, err := core.NewPluginWithType("filter.Metadata", conf)
+	expect.NoError(err)
+
+	filter, casted := plugin.(*Metadata)
+	expect.True(casted)
+
+	msg := core.NewMessage(nil, []byte("test"), 0)
+	expect.False(filter.Accepts(msg))
+
+	msg.SetMetadata("partition", "3")
+	expect.True(filter.Accepts(msg))
+
+	msg.SetMetadata("partition", "4")
+	expect.False(filter.Accepts(msg))
+
+	msg.SetMetadata("partition", "0")
+	msg.SetMetadata("debug", "")
+	expect.False(filter.Accepts(msg))
+
+	conf.Override("MetadataAcceptConditions", []interface{}{
+		map[interface{}]interface{}{"Field": "partition", "Operator": "like", "Value": 4},
+	})
+	_, err = core.NewPluginWithType("filter.Metadata", conf)
+	expect.NotNil(err)
+}
@@ -0,0 +1,75 @@
+// Copyright 2015-2016 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filter
+
+import (
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/shared"
+)
+
+// Not filter plugin
+// This filter passes messages that are rejected by all of a list of filters.
+// If no filters are given, all messages are passed.
+// Configuration example
+//
+//   - "stream.Broadcast":
+//     Filter: "filter.Not"
+//     NotFilter:
+//       - "filter.RegExp":
+//           FilterExpression: "^DEBUG"
+//
+// NotFilter defines a list of filters that all have to reject a message.
+// Filters are checked in order, and if a filter accepts a message no further
+// filters are checked. Each entry can either be the name of a filter or a map
+// of one filter name to a map of options that apply to this filter only.
+// By default this list is empty.
+type Not struct {
+	filters []core.Filter
+}
+
+func init() {
+	shared.TypeRegistry.Register(Not{})
+}
+
+// Configure initializes this filter with values from a plugin config.
+func (filter *Not) Configure(conf core.PluginConfig) error {
+	var err error
+	filter.filters, err = core.NewFilterList(conf, "NotFilter")
+	return err
+}
+
+// Accepts allows messages rejected by all filters
+func (filter *Not) Accepts(msg core.Message) bool {
+	accepted, _ := filter.AcceptsWithReason(msg)
+	return accepted
+}
+
+// AcceptsWithReason works like Accepts and returns the name of the first
+// filter accepting a message.
+func (filter *Not) AcceptsWithReason(msg core.Message) (bool, string) {
+	for _, f := range filter.filters {
+		if f.Accepts(msg) {
+			return false, "accepted by " + core.FilterName(f)
+		}
+	}
+	return true, ""
+}
+
+// Roll passes a roll request to all filters
+func (filter *Not) Roll() {
+	for _, f := range filter.filters {
+		core.RollFilter(f)
+	}
+}
@@ -0,0 +1,217 @@
+// Copyright 2015-2016 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filter
+
+import (
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/shared"
+	"math"
+	"sync"
+	"time"
+)
+
+// RateLimit filter plugin
+// This plugin limits the number of messages and bytes per second using a
+// token bucket. Limits are enforced per stream and optionally per key, e.g.
+// per application name. Messages exceeding the limit are dropped or routed
+// to an overflow stream. The number of throttled messages is counted per
+// stream in the metric "RateLimitThrottled-<stream>".
+// Configuration example
+//
+//   - "stream.Broadcast":
+//     Filter: "filter.RateLimit"
+//     RateLimitMessagesPerSec: 100
+//     RateLimitBytesPerSec: 0
+//     RateLimitBurstMessages: 0
+//     RateLimitBurstBytes: 0
+//     RateLimitKey: ""
+//     RateLimitMetadataKey: ""
+//     RateLimitMaxKeys: 10000
+//     RateLimitOverflowStream: ""
+//
+// RateLimitMessagesPerSec defines the number of messages per second allowed
+// to pass through this filter. Set to 0 to disable this limit.
+// By default this is set to 100.
+//
+// RateLimitBytesPerSec defines the number of payload bytes per second allowed
+// to pass through this filter. Set to 0 to disable this limit.
+// By default this is set to 0.
+//
+// RateLimitBurstMessages defines the size of the message bucket, i.e. the
+// number of messages that may pass at once after a period of inactivity.
+// By default this is set to 0, which uses RateLimitMessagesPerSec.
+//
+// RateLimitBurstBytes defines the size of the byte bucket like
+// RateLimitBurstMessages. Messages larger than this value are always
+// throttled. By default this is set to 0, which uses RateLimitBytesPerSec.
+//
+// RateLimitKey defines a field of a JSON payload used to apply separate limits
+// per value of that field. Messages without this field share one limit.
+// Field paths can be defined in a format accepted by shared.MarshalMap.Path.
+// By default this is set to "", which applies one limit per stream.
+//
+// RateLimitMetadataKey defines a metadata key used like RateLimitKey. If both
+// are set, the metadata value is preferred. By default this is set to "".
+//
+// RateLimitMaxKeys defines the maximum number of buckets kept in memory.
+// If this limit is reached the least recently used bucket is removed if it has
+// been refilled completely. Otherwise all new keys share one additional bucket
+// until a bucket can be removed. Set to 0 to disable this limit.
+// By default this is set to 10000.
+//
+// RateLimitOverflowStream is an optional stream messages are sent to when
+// the limit is reached. By default this is disabled and set to "".
+type RateLimit struct {
+	messageRate      float64
+	byteRate         float64
+	messageBurst     float64
+	byteBurst        float64
+	key              string
+	metadataKey      string
+	overflowStreamID core.MessageStreamID
+	buckets          *shared.LRU
+	fallback         *rateLimitBucket
+	streams          map[core.MessageStreamID]string
+	bucketGuard      *sync.Mutex
+	now              func() time.Time
+}
+
+const metricRateLimitThrottled = "RateLimitThrottled-"
+
+type rateLimitBucketKey struct {
+	streamID core.MessageStreamID
+	key      string
+}
+
+type rateLimitBucket struct {
+	messages float64
+	bytes    float64
+	updated  time.Time
+}
+
+func init() {
+	shared.TypeRegistry.Register(RateLimit{})
+}
+
+// Configure initializes this filter with values from a plugin config.
+func (filter *RateLimit) Configure(conf core.PluginConfig) error {
+	filter.messageRate = float64(shared.MaxI(conf.GetInt("RateLimitMessagesPerSec", 100), 0))
+	filter.byteRate = float64(shared.MaxI(conf.GetInt("RateLimitBytesPerSec", 0), 0))
+	filter.messageBurst = float64(conf.GetInt("RateLimitBurstMessages", 0))
+	filter.byteBurst = float64(conf.GetInt("RateLimitBurstBytes", 0))
+	filter.key = conf.GetString("RateLimitKey", "")
+	filter.metadataKey = conf.GetString("RateLimitMetadataKey", "")
+	filter.buckets = shared.NewLRU(conf.GetInt("RateLimitMaxKeys", 10000), filter.canEvict)
+	filter.streams = make(map[core.MessageStreamID]string)
+	filter.bucketGuard = new(sync.Mutex)
+	filter.now = time.Now
+
+	if filter.messageBurst <= 0 {
+		filter.messageBurst = filter.messageRate
+	}
+	if filter.byteBurst <= 0 {
+		filter.byteBurst = filter.byteRate
+	}
+	filter.fallback = filter.newBucket(time.Time{})
+
+	filter.overflowStreamID = core.InvalidStreamID
+	if overflowStream := conf.GetString("RateLimitOverflowStream", ""); overflowStream != "" {
+		filter.overflowStreamID = core.GetStreamID(overflowStream)
+	}
+
+	return nil
+}
+
+// newBucket returns a full bucket
+func (filter *RateLimit) newBucket(now time.Time) *rateLimitBucket {
+	return &rateLimitBucket{
+		messages: filter.messageBurst,
+		bytes:    filter.byteBurst,
+		updated:  now,
+	}
+}
+
+// refill adds the tokens gained since the last update to the given bucket.
+func (filter *RateLimit) refill(bucket *rateLimitBucket, now time.Time) {
+	elapsed := now.Sub(bucket.updated).Seconds()
+	if elapsed > 0 {
+		bucket.messages = math.Min(filter.messageBurst, bucket.messages+elapsed*filter.messageRate)
+		bucket.bytes = math.Min(filter.byteBurst, bucket.bytes+elapsed*filter.byteRate)
+		bucket.updated = now
+	}
+}
+
+// canEvict allows a bucket to be removed if it is full, i.e. if recreating it
+// does not grant any additional tokens.
+func (filter *RateLimit) canEvict(key interface{}, value interface{}) bool {
+	bucket := value.(*rateLimitBucket)
+	filter.refill(bucket, filter.now())
+	return bucket.messages >= filter.messageBurst && bucket.bytes >= filter.byteBurst
+}
+
+// getBucket returns the bucket for the given key. Buckets are created full.
+// If no bucket can be created the fallback bucket is returned.
+// This function has to be called while holding bucketGuard.
+func (filter *RateLimit) getBucket(key rateLimitBucketKey, now time.Time) *rateLimitBucket {
+	if bucket, known := filter.buckets.Get(key); known {
+		return bucket.(*rateLimitBucket) // ### return, known bucket ###
+	}
+
+	if _, known := filter.streams[key.streamID]; !known {
+		streamName := core.StreamRegistry.GetStreamName(key.streamID)
+		filter.streams[key.streamID] = streamName
+		shared.Metric.New(metricRateLimitThrottled + streamName)
+	}
+
+	bucket := filter.newBucket(now)
+	if !filter.buckets.Set(key, bucket) {
+		return filter.fallback // ### return, too many keys ###
+	}
+	return bucket
+}
+
+// Accepts passes messages as long as the bucket of a message's stream and
+// key holds enough tokens.
+func (filter *RateLimit) Accepts(msg core.Message) bool {
+	now := filter.now()
+	key := rateLimitBucketKey{streamID: msg.StreamID}
+	key.key, _ = getMessageKey(msg, filter.metadataKey, filter.key)
+	size := float64(len(msg.Data))
+
+	filter.bucketGuard.Lock()
+	bucket := filter.getBucket(key, now)
+
+	filter.refill(bucket, now)
+
+	accept := (filter.messageRate == 0 || bucket.messages >= 1) &&
+		(filter.byteRate == 0 || bucket.bytes >= size)
+
+	if accept {
+		bucket.messages--
+		bucket.bytes -= size
+	}
+	streamName := filter.streams[key.streamID]
+	filter.bucketGuard.Unlock()
+
+	if !accept {
+		shared.Metric.Inc(metricRateLimitThrottled + streamName)
+		if filter.overflowStreamID != core.InvalidStreamID {
+			msg.Route(filter.overflowStreamID)
+		}
+		return false // ### return, throttled ###
+	}
+
+	return true
+}
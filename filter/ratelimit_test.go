@@ -0,0 +1,147 @@
+// Copyright 2015-2016 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filter
+
+import (
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/shared"
+	"testing"
+	"time"
+)
+
+func TestFilterRateLimit(t *testing.T) {
+	expect := shared.NewExpect(t)
+	conf := core.NewPluginConfig("")
+
+	conf.Override("RateLimitMessagesPerSec", 10)
+	plugin, err := core.NewPluginWithType("filter.RateLimit", conf)
+	expect.NoError(err)
+
+	filter, casted := plugin.(*RateLimit)
+	expect.True(casted)
+
+	now := time.Unix(1500000000, 0)
+	filter.now = func() time.Time { return now }
+
+	msg1 := core.NewMessage(nil, []byte("foo"), 0)
+	msg2 := core.NewMessage(nil, []byte("foo"), 0)
+	msg1.StreamID = core.GetStreamID("ratelimit1")
+	msg2.StreamID = core.GetStreamID("ratelimit2")
+
+	for i := 0; i < 12; i++ {
+		expect.Equal(i < 10, filter.Accepts(msg1))
+		expect.Equal(i < 10, filter.Accepts(msg2))
+	}
+
+	metric, err := shared.Metric.Get(metricRateLimitThrottled + "ratelimit1")
+	expect.NoError(err)
+	expect.Equal(int64(2), metric)
+
+	// Half a second refills half of the bucket
+	now = now.Add(500 * time.Millisecond)
+	for i := 0; i < 6; i++ {
+		expect.Equal(i < 5, filter.Accepts(msg1))
+	}
+}
+
+func TestFilterRateLimitBytes(t *testing.T) {
+	expect := shared.NewExpect(t)
+	conf := core.NewPluginConfig("")
+
+	conf.Override("RateLimitMessagesPerSec", 0)
+	conf.Override("RateLimitBytesPerSec", 10)
+	plugin, err := core.NewPluginWithType("filter.RateLimit", conf)
+	expect.NoError(err)
+
+	filter, casted := plugin.(*RateLimit)
+	expect.True(casted)
+
+	now := time.Unix(1500000000, 0)
+	filter.now = func() time.Time { return now }
+
+	msg := core.NewMessage(nil, []byte("abcd"), 0)
+	msg.StreamID = 1
+
+	expect.True(filter.Accepts(msg))
+	expect.True(filter.Accepts(msg))
+	expect.False(filter.Accepts(msg))
+
+	now = now.Add(200 * time.Millisecond)
+	expect.True(filter.Accepts(msg))
+}
+
+func TestFilterRateLimitKey(t *testing.T) {
+	expect := shared.NewExpect(t)
+	conf := core.NewPluginConfig("")
+
+	conf.Override("RateLimitMessagesPerSec", 1)
+	conf.Override("RateLimitKey", "app")
+	plugin, err := core.NewPluginWithType("filter.RateLimit", conf)
+	expect.NoError(err)
+
+	filter, casted := plugin.(*RateLimit)
+	expect.True(casted)
+
+	now := time.Unix(1500000000, 0)
+	filter.now = func() time.Time { return now }
+
+	msgA := core.NewMessage(nil, []byte(`{"app":"a"}`), 0)
+	msgB := core.NewMessage(nil, []byte(`{"app":"b"}`), 0)
+	msgA.StreamID = 1
+	msgB.StreamID = 1
+
+	expect.True(filter.Accepts(msgA))
+	expect.True(filter.Accepts(msgB))
+	expect.False(filter.Accepts(msgA))
+	expect.False(filter.Accepts(msgB))
+}
+
+func TestFilterRateLimitMaxKeys(t *testing.T) {
+	expect := shared.NewExpect(t)
+	conf := core.NewPluginConfig("")
+
+	conf.Override("RateLimitMessagesPerSec", 1)
+	conf.Override("RateLimitKey", "app")
+	conf.Override("RateLimitMaxKeys", 1)
+	plugin, err := core.NewPluginWithType("filter.RateLimit", conf)
+	expect.NoError(err)
+
+	filter, casted := plugin.(*RateLimit)
+	expect.True(casted)
+
+	now := time.Unix(1500000000, 0)
+	filter.now = func() time.Time { return now }
+
+	msgA := core.NewMessage(nil, []byte(`{"app":"a"}`), 0)
+	msgB := core.NewMessage(nil, []byte(`{"app":"b"}`), 0)
+	msgC := core.NewMessage(nil, []byte(`{"app":"c"}`), 0)
+	msgA.StreamID = 1
+	msgB.StreamID = 1
+	msgC.StreamID = 1
+
+	// The bucket of "a" is empty and cannot be removed, so "b" and "c" share
+	// the fallback bucket. Rotating keys does not bypass the limit.
+	expect.True(filter.Accepts(msgA))
+	expect.True(filter.Accepts(msgB))
+	expect.False(filter.Accepts(msgC))
+	expect.False(filter.Accepts(msgA))
+	expect.False(filter.Accepts(msgB))
+
+	// After a second the bucket of "a" is full again and can be replaced
+	now = now.Add(time.Second)
+	expect.True(filter.Accepts(msgC))
+	expect.False(filter.Accepts(msgC))
+	expect.Equal(1, filter.buckets.Len())
+}
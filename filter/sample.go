@@ -15,23 +15,41 @@
 package filter
 
 import (
+	"encoding/json"
+	"fmt"
 	"github.com/trivago/gollum/core"
 	"github.com/trivago/gollum/shared"
+	"hash/fnv"
+	"math/rand"
+	"strconv"
+	"strings"
 	"sync/atomic"
 )
 
 // Sample filter plugin
-// This plugin blocks messages after a certain number of messages per second
-// has been reached.
+// This plugin passes only a fraction of all messages, e.g. to ship debug
+// messages at a reduced volume.
 // Configuration example
 //
 //   - "stream.Broadcast":
-//	 Filter: "filter.Sample"
-//	 SampleRatePerGroup: 1
-//	 SampleGroupSize: 1
-//	 SampleDropToStream: ""
-//	 SampleRateIgnore:
-//	   - "foo"
+//     Filter: "filter.Sample"
+//     SampleMode: "group"
+//     SampleRatePerGroup: 1
+//     SampleGroupSize: 1
+//     SampleRate: 10
+//     SampleProbability: 0.1
+//     SampleKey: ""
+//     SampleMetadataKey: ""
+//     SampleDropToStream: ""
+//     SampleIgnore:
+//       - "foo"
+//
+// SampleMode defines how messages are selected. By default this is set to
+// "group".
+//  * "group" passes SampleRatePerGroup messages out of every SampleGroupSize
+//    messages.
+//  * "rate" passes 1 out of every SampleRate messages.
+//  * "probability" passes each message with a probability of SampleProbability.
 //
 // SampleRatePerGroup defines how many messages are passed through the filter
 // in each group. By default this is set to 1.
@@ -39,20 +57,48 @@ import (
 // SampleGroupSize defines how many messages make up a group. Messages over
 // SampleRatePerGroup within a group are dropped. By default this is set to 1.
 //
+// SampleRate defines N when passing 1 out of N messages in "rate" mode.
+// By default this is set to 10.
+//
+// SampleProbability defines the probability of a message being passed in
+// "probability" mode as a number between 0 and 1. By default this is set to 0.1.
+//
+// SampleKey defines a field of a JSON payload used for consistent sampling in
+// "rate" and "probability" mode. Messages sharing the same key value are
+// either all passed or all dropped, e.g. all messages of one request or trace.
+// Messages without this field are sampled like messages without key.
+// Field paths can be defined in a format accepted by shared.MarshalMap.Path.
+// By default this is set to "", which disables consistent sampling.
+//
+// SampleMetadataKey defines a metadata key used for consistent sampling like
+// SampleKey. If both are set, the metadata value is preferred.
+// By default this is set to "".
+//
 // SampleDropToStream is an optional stream messages are sent to when they
 // are sampled. By default this is disabled and set to "".
 //
-// SampleRateIgnore defines a list of streams that should not be affected by
+// SampleIgnore defines a list of streams that should not be affected by
 // sampling. This is useful for e.g. producers listeing to "*".
 // By default this list is empty.
 type Sample struct {
-	rate		 int64
-	group		int64
-	count		*int64
+	mode         int
+	rate         int64
+	group        int64
+	sampleRate   uint64
+	probability  float64
+	count        *int64
+	key          string
+	metadataKey  string
 	dropStreamID core.MessageStreamID
-	ignore	   map[core.MessageStreamID]bool
+	ignore       map[core.MessageStreamID]bool
 }
 
+const (
+	sampleModeGroup = iota
+	sampleModeRate
+	sampleModeProbability
+)
+
 func init() {
 	shared.TypeRegistry.Register(Sample{})
 }
@@ -61,9 +107,37 @@ func init() {
 func (filter *Sample) Configure(conf core.PluginConfig) error {
 	filter.rate = int64(conf.GetInt("SampleRatePerGroup", 1))
 	filter.group = int64(conf.GetInt("SampleGroupSize", 1))
+	filter.key = conf.GetString("SampleKey", "")
+	filter.metadataKey = conf.GetString("SampleMetadataKey", "")
 	filter.dropStreamID = core.InvalidStreamID
 	filter.count = new(int64)
 
+	mode := strings.ToLower(conf.GetString("SampleMode", "group"))
+	switch mode {
+	case "group":
+		filter.mode = sampleModeGroup
+	case "rate":
+		filter.mode = sampleModeRate
+	case "probability":
+		filter.mode = sampleModeProbability
+	default:
+		return fmt.Errorf("Unknown SampleMode: %s", mode)
+	}
+
+	var err error
+	sampleRate := conf.GetInt("SampleRate", 10)
+	if sampleRate < 1 {
+		return fmt.Errorf("SampleRate must be at least 1")
+	}
+	filter.sampleRate = uint64(sampleRate)
+
+	if filter.probability, err = getFloat(conf, "SampleProbability", 0.1); err != nil {
+		return err
+	}
+	if filter.probability < 0 || filter.probability > 1 {
+		return fmt.Errorf("SampleProbability must be between 0 and 1")
+	}
+
 	dropToStream := conf.GetString("SampleDropToStream", "")
 	if dropToStream != "" {
 		filter.dropStreamID = core.GetStreamID(dropToStream)
@@ -78,26 +152,113 @@ func (filter *Sample) Configure(conf core.PluginConfig) error {
 	return nil
 }
 
-func (filter *Sample) Accepts(msg core.Message) bool {
-	// Ignore based on StreamID
-	if ignore, known := filter.ignore[msg.StreamID]; known && ignore {
-		return true // ### return, do not limit ###
+// getFloat reads a numeric value from a plugin config. Integer values are
+// converted to float64.
+func getFloat(conf core.PluginConfig, key string, defaultValue float64) (float64, error) {
+	switch value := conf.GetValue(key, defaultValue).(type) {
+	case float64:
+		return value, nil
+	case int:
+		return float64(value), nil
+	default:
+		return 0, fmt.Errorf("%s must be a number", key)
+	}
+}
+
+// getMessageKey returns the value of the given metadata key or, if not set,
+// the value of the given JSON field of the payload.
+func getMessageKey(msg core.Message, metadataKey string, jsonPath string) (string, bool) {
+	if metadataKey != "" {
+		if value, exists := msg.Metadata[metadataKey]; exists {
+			return value, true // ### return, metadata key ###
+		}
+	}
+
+	if jsonPath == "" {
+		return "", false // ### return, no key ###
 	}
 
+	values := shared.NewMarshalMap()
+	if err := json.Unmarshal(msg.Data, &values); err != nil {
+		return "", false // ### return, no JSON ###
+	}
+
+	switch value, _ := values.Path(jsonPath); value.(type) {
+	case string:
+		return value.(string), true
+	case bool:
+		return strconv.FormatBool(value.(bool)), true
+	case float64:
+		return strconv.FormatFloat(value.(float64), 'f', -1, 64), true
+	}
+	return "", false
+}
+
+// acceptsGroup implements the "group" mode
+func (filter *Sample) acceptsGroup() bool {
 	// Check if count needs to be reset
 	count := atomic.AddInt64(filter.count, 1)
 	if count > filter.group {
-		if count % filter.group == 1 {
+		if count%filter.group == 1 {
 			// make sure we never overflow filter.count
 			count = atomic.AddInt64(filter.count, -(filter.group))
 		} else {
 			// range from 1 to filter.group
-			count = (count - 1) % filter.group + 1
+			count = (count-1)%filter.group + 1
+		}
+	}
+	return count <= filter.rate
+}
+
+// sampleMix applies the 64 bit finalizer of MurmurHash3 to distribute keys
+// that differ only slightly (e.g. sequential ids) evenly.
+func sampleMix(h uint64) uint64 {
+	h ^= h >> 33
+	h *= 0xff51afd7ed558ccd
+	h ^= h >> 33
+	h *= 0xc4ceb9fe1a85ec53
+	h ^= h >> 33
+	return h
+}
+
+// acceptsSampled implements the "rate" and "probability" mode
+func (filter *Sample) acceptsSampled(msg core.Message) bool {
+	key, hasKey := getMessageKey(msg, filter.metadataKey, filter.key)
+
+	if !hasKey {
+		if filter.mode == sampleModeProbability {
+			return rand.Float64() < filter.probability // ### return, random ###
 		}
+		count := uint64(atomic.AddInt64(filter.count, 1))
+		return (count-1)%filter.sampleRate == 0
+	}
+
+	hash := fnv.New64a()
+	hash.Write([]byte(key))
+	sum := sampleMix(hash.Sum64())
+
+	if filter.mode == sampleModeProbability {
+		return float64(sum>>11)/float64(1<<53) < filter.probability
+	}
+	return sum%filter.sampleRate == 0
+}
+
+// Accepts passes a fraction of all messages as configured by SampleMode
+func (filter *Sample) Accepts(msg core.Message) bool {
+	// Ignore based on StreamID
+	if ignore, known := filter.ignore[msg.StreamID]; known && ignore {
+		return true // ### return, do not limit ###
+	}
+
+	var accept bool
+	if filter.mode == sampleModeGroup {
+		accept = filter.acceptsGroup()
+	} else {
+		accept = filter.acceptsSampled(msg)
 	}
 
 	// Check if to be filtered
-	if count > filter.rate {
+	if !accept {
 		if filter.dropStreamID != core.InvalidStreamID {
 			msg.Route(filter.dropStreamID)
 		}
@@ -15,6 +15,7 @@
 package filter
 
 import (
+	"fmt"
 	"github.com/trivago/gollum/core"
 	"github.com/trivago/gollum/shared"
 	"testing"
@@ -105,3 +106,103 @@ func TestFilterSampleIgnore(t *testing.T) {
 	expect.Equal(accept2, 5)
 	expect.Equal(deny2, 5)
 }
+
+func TestFilterSampleRate(t *testing.T) {
+	expect := shared.NewExpect(t)
+	msg := core.NewMessage(nil, []byte{}, 0)
+	msg.StreamID = 1
+
+	conf := core.NewPluginConfig("")
+	conf.Override("SampleMode", "rate")
+	conf.Override("SampleRate", 4)
+	plugin, err := core.NewPluginWithType("filter.Sample", conf)
+	expect.NoError(err)
+
+	filter, casted := plugin.(*Sample)
+	expect.True(casted)
+
+	accept := 0
+	for i := 0; i < 20; i++ {
+		if filter.Accepts(msg) {
+			accept++
+		}
+	}
+	expect.Equal(5, accept)
+
+	conf.Override("SampleRate", 0)
+	_, err = core.NewPluginWithType("filter.Sample", conf)
+	expect.NotNil(err)
+}
+
+func TestFilterSampleProbability(t *testing.T) {
+	expect := shared.NewExpect(t)
+	msg := core.NewMessage(nil, []byte{}, 0)
+	msg.StreamID = 1
+
+	conf := core.NewPluginConfig("")
+	conf.Override("SampleMode", "probability")
+	conf.Override("SampleProbability", 1)
+	plugin, err := core.NewPluginWithType("filter.Sample", conf)
+	expect.NoError(err)
+
+	filter, casted := plugin.(*Sample)
+	expect.True(casted)
+	for i := 0; i < 10; i++ {
+		expect.True(filter.Accepts(msg))
+	}
+
+	conf.Override("SampleProbability", 0.0)
+	plugin, err = core.NewPluginWithType("filter.Sample", conf)
+	expect.NoError(err)
+	filter = plugin.(*Sample)
+	for i := 0; i < 10; i++ {
+		expect.False(filter.Accepts(msg))
+	}
+
+	conf.Override("SampleProbability", 1.5)
+	_, err = core.NewPluginWithType("filter.Sample", conf)
+	expect.NotNil(err)
+}
+
+func TestFilterSampleConsistent(t *testing.T) {
+	expect := shared.NewExpect(t)
+
+	conf := core.NewPluginConfig("")
+	conf.Override("SampleMode", "probability")
+	conf.Override("SampleProbability", 0.5)
+	conf.Override("SampleKey", "trace/id")
+	plugin, err := core.NewPluginWithType("filter.Sample", conf)
+	expect.NoError(err)
+
+	filter, casted := plugin.(*Sample)
+	expect.True(casted)
+
+	accept := 0
+	for i := 0; i < 100; i++ {
+		payload := fmt.Sprintf(`{"trace":{"id":"trace-%d"}}`, i)
+		msg := core.NewMessage(nil, []byte(payload), 0)
+		result := filter.Accepts(msg)
+		for j := 0; j < 5; j++ {
+			expect.Equal(result, filter.Accepts(msg))
+		}
+		if result {
+			accept++
+		}
+	}
+	expect.True(accept > 20 && accept < 80)
+
+	conf = core.NewPluginConfig("")
+	conf.Override("SampleMode", "rate")
+	conf.Override("SampleRate", 3)
+	conf.Override("SampleMetadataKey", "request")
+	plugin, err = core.NewPluginWithType("filter.Sample", conf)
+	expect.NoError(err)
+	filter = plugin.(*Sample)
+
+	for i := 0; i < 20; i++ {
+		msg := core.NewMessage(nil, []byte{}, 0)
+		msg.SetMetadata("request", fmt.Sprintf("request-%d", i))
+		result := filter.Accepts(msg)
+		expect.Equal(result, filter.Accepts(msg))
+	}
+}
@@ -0,0 +1,222 @@
+// Copyright 2015-2016 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filter
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/core/log"
+	"github.com/trivago/gollum/shared"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Sequence filter plugin
+// This plugin tracks a monotonically increasing sequence number per stream and
+// key to detect lost or duplicated messages. Messages are tagged or synthetic
+// alert messages are generated when a number is skipped or repeated.
+// Messages without a valid sequence number are passed as-is.
+// Configuration example
+//
+//   - "stream.Broadcast":
+//     Filter: "filter.Sequence"
+//     SequenceKey: "sequence"
+//     SequenceMetadataKey: ""
+//     SequenceGroupKey: ""
+//     SequenceGroupMetadataKey: ""
+//     SequenceMode: "tag"
+//     SequenceAlertStream: ""
+//     SequenceDropRepeated: false
+//     SequenceMaxKeys: 10000
+//
+// SequenceKey defines a field of a JSON payload holding the sequence number.
+// Field paths can be defined in a format accepted by shared.MarshalMap.Path.
+// By default this is set to "sequence".
+//
+// SequenceMetadataKey defines a metadata key holding the sequence number. If
+// both SequenceKey and SequenceMetadataKey are set, the metadata value is
+// preferred. By default this is set to "".
+//
+// SequenceGroupKey defines a field of a JSON payload used to track separate
+// sequences per value of that field, e.g. the name of a host. Field paths can
+// be defined in a format accepted by shared.MarshalMap.Path.
+// By default this is set to "".
+//
+// SequenceGroupMetadataKey defines a metadata key used like SequenceGroupKey.
+// If both are set, the metadata value is preferred. If neither is set, or a
+// message does not contain the key, one sequence per stream is tracked.
+// By default this is set to "".
+//
+// SequenceMode defines how gaps and repeated numbers are reported. By default
+// this is set to "tag".
+//  * "tag" sets the metadata field "sequence_status" to "gap" or "repeat" and
+//    "sequence_expected" to the number that was expected.
+//  * "alert" sends one alert message per gap or repeated number to
+//    SequenceAlertStream. Alerts are JSON objects containing the fields
+//    "sequence" ("gap" or "repeat"), "stream", "key", "expected", "received"
+//    and "missing".
+//
+// SequenceAlertStream defines the stream alert messages are sent to. This is
+// required in "alert" mode. By default this is set to "".
+//
+// SequenceDropRepeated can be set to true to block messages with a number
+// that is not greater than the highest number seen so far.
+// By default this is set to false.
+//
+// SequenceMaxKeys defines the maximum number of keys tracked. If this limit is
+// reached the least recently used key is removed. Set to 0 to disable this
+// limit.
+// By default this is set to 10000.
+type Sequence struct {
+	key           string
+	metadataKey   string
+	groupKey      string
+	groupMetaKey  string
+	alertMode     bool
+	alertStreamID core.MessageStreamID
+	dropRepeated  bool
+	last          *shared.LRU
+	lastGuard     *sync.Mutex
+}
+
+type sequenceKey struct {
+	streamID core.MessageStreamID
+	key      string
+}
+
+type sequenceAlert struct {
+	Sequence string `json:"sequence"`
+	Stream   string `json:"stream"`
+	Key      string `json:"key"`
+	Expected uint64 `json:"expected"`
+	Received uint64 `json:"received"`
+	Missing  uint64 `json:"missing"`
+}
+
+const (
+	// sequenceStatusMetadata is the metadata key set in "tag" mode
+	sequenceStatusMetadata = "sequence_status"
+	// sequenceExpectedMetadata is the metadata key holding the expected number
+	sequenceExpectedMetadata = "sequence_expected"
+)
+
+func init() {
+	shared.TypeRegistry.Register(Sequence{})
+}
+
+// Configure initializes this filter with values from a plugin config.
+func (filter *Sequence) Configure(conf core.PluginConfig) error {
+	filter.key = conf.GetString("SequenceKey", "sequence")
+	filter.metadataKey = conf.GetString("SequenceMetadataKey", "")
+	filter.groupKey = conf.GetString("SequenceGroupKey", "")
+	filter.groupMetaKey = conf.GetString("SequenceGroupMetadataKey", "")
+	filter.dropRepeated = conf.GetBool("SequenceDropRepeated", false)
+	filter.last = shared.NewLRU(conf.GetInt("SequenceMaxKeys", 10000), nil)
+	filter.lastGuard = new(sync.Mutex)
+
+	if filter.key == "" && filter.metadataKey == "" {
+		return fmt.Errorf("SequenceKey or SequenceMetadataKey has to be set")
+	}
+
+	mode := strings.ToLower(conf.GetString("SequenceMode", "tag"))
+	switch mode {
+	case "tag":
+		core.RegisterMetadataWriter()
+	case "alert":
+		filter.alertMode = true
+	default:
+		return fmt.Errorf("Unknown SequenceMode: %s", mode)
+	}
+
+	filter.alertStreamID = core.InvalidStreamID
+	if alertStream := conf.GetString("SequenceAlertStream", ""); alertStream != "" {
+		filter.alertStreamID = core.GetStreamID(alertStream)
+	} else if filter.alertMode {
+		return fmt.Errorf("SequenceMode alert requires SequenceAlertStream to be set")
+	}
+
+	return nil
+}
+
+// check updates the highest number seen for a key and returns an alert if
+// the number was not the expected one.
+func (filter *Sequence) check(key sequenceKey, number uint64) *sequenceAlert {
+	filter.lastGuard.Lock()
+	defer filter.lastGuard.Unlock()
+
+	stored, known := filter.last.Get(key)
+	if !known {
+		filter.last.Set(key, number)
+		return nil // ### return, new key ###
+	}
+	last := stored.(uint64)
+
+	expected := last + 1
+	switch {
+	case number == expected:
+		filter.last.Set(key, number)
+		return nil
+
+	case number > expected:
+		filter.last.Set(key, number)
+		return &sequenceAlert{Sequence: "gap", Expected: expected, Received: number, Missing: number - expected}
+
+	default:
+		return &sequenceAlert{Sequence: "repeat", Expected: expected, Received: number}
+	}
+}
+
+func (filter *Sequence) sendAlert(alert *sequenceAlert, key sequenceKey) {
+	alert.Stream = core.StreamRegistry.GetStreamName(key.streamID)
+	alert.Key = key.key
+
+	payload, err := json.Marshal(alert)
+	if err != nil {
+		Log.Error.Print("Sequence filter failed to create alert: ", err)
+		return // ### return, cannot send ###
+	}
+	core.NewMessage(nil, payload, 0).Route(filter.alertStreamID)
+}
+
+// Accepts passes all messages and reports gaps or repeated numbers
+func (filter *Sequence) Accepts(msg core.Message) bool {
+	value, hasValue := getMessageKey(msg, filter.metadataKey, filter.key)
+	if !hasValue {
+		return true // ### return, no sequence number ###
+	}
+	number, err := strconv.ParseUint(value, 10, 64)
+	if err != nil {
+		return true // ### return, invalid sequence number ###
+	}
+
+	key := sequenceKey{streamID: msg.StreamID}
+	key.key, _ = getMessageKey(msg, filter.groupMetaKey, filter.groupKey)
+
+	alert := filter.check(key, number)
+	if alert == nil {
+		return true // ### return, expected number ###
+	}
+
+	if filter.alertMode {
+		filter.sendAlert(alert, key)
+	} else {
+		msg.SetMetadata(sequenceStatusMetadata, alert.Sequence)
+		msg.SetMetadata(sequenceExpectedMetadata, strconv.FormatUint(alert.Expected, 10))
+	}
+
+	return !filter.dropRepeated || alert.Sequence != "repeat"
+}
@@ -0,0 +1,107 @@
+// Copyright 2015-2016 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filter
+
+import (
+	"encoding/json"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/shared"
+	"testing"
+)
+
+func TestFilterSequenceTag(t *testing.T) {
+	expect := shared.NewExpect(t)
+	conf := core.NewPluginConfig("")
+
+	conf.Override("SequenceKey", "seq")
+	conf.Override("SequenceGroupMetadataKey", "host")
+	conf.Override("SequenceDropRepeated", true)
+	plugin, err := core.NewPluginWithType("filter.Sequence", conf)
+	expect.NoError(err)
+
+	filter, casted := plugin.(*Sequence)
+	expect.True(casted)
+
+	send := func(host string, seq string) core.Message {
+		msg := core.NewMessage(nil, []byte(`{"seq":`+seq+`}`), 0)
+		msg.SetMetadata("host", host)
+		filter.Accepts(msg)
+		return msg
+	}
+
+	for _, seq := range []string{"1", "2", "3"} {
+		msg := send("a", seq)
+		_, tagged := msg.Metadata[sequenceStatusMetadata]
+		expect.False(tagged)
+	}
+
+	msg := send("a", "6")
+	expect.Equal("gap", msg.Metadata[sequenceStatusMetadata])
+	expect.Equal("4", msg.Metadata[sequenceExpectedMetadata])
+
+	msg = send("b", "100")
+	_, tagged := msg.Metadata[sequenceStatusMetadata]
+	expect.False(tagged)
+
+	msg = core.NewMessage(nil, []byte(`{"seq":5}`), 0)
+	msg.SetMetadata("host", "a")
+	expect.False(filter.Accepts(msg))
+	expect.Equal("repeat", msg.Metadata[sequenceStatusMetadata])
+	expect.Equal("7", msg.Metadata[sequenceExpectedMetadata])
+
+	expect.True(filter.Accepts(core.NewMessage(nil, []byte(`{"seq":"invalid"}`), 0)))
+
+	conf.Override("SequenceKey", "")
+	_, err = core.NewPluginWithType("filter.Sequence", conf)
+	expect.NotNil(err)
+}
+
+func TestFilterSequenceAlert(t *testing.T) {
+	expect := shared.NewExpect(t)
+
+	alerts := &mockAlertStream{}
+	core.StreamRegistry.Register(alerts, core.GetStreamID("sequenceAlerts"))
+
+	conf := core.NewPluginConfig("")
+	conf.Override("SequenceMetadataKey", "seq")
+	conf.Override("SequenceMode", "alert")
+	conf.Override("SequenceAlertStream", "sequenceAlerts")
+	plugin, err := core.NewPluginWithType("filter.Sequence", conf)
+	expect.NoError(err)
+
+	filter, casted := plugin.(*Sequence)
+	expect.True(casted)
+
+	for _, seq := range []string{"1", "2", "4", "4"} {
+		msg := core.NewMessage(nil, []byte("test"), 0)
+		msg.SetMetadata("seq", seq)
+		expect.True(filter.Accepts(msg))
+	}
+
+	expect.Equal(2, len(alerts.messages))
+	alert := sequenceAlert{}
+	expect.NoError(json.Unmarshal(alerts.messages[0].Data, &alert))
+	expect.Equal(sequenceAlert{Sequence: "gap", Stream: "*", Expected: 3, Received: 4, Missing: 1}, alert)
+
+	alert = sequenceAlert{}
+	expect.NoError(json.Unmarshal(alerts.messages[1].Data, &alert))
+	expect.Equal("repeat", alert.Sequence)
+	expect.Equal(uint64(5), alert.Expected)
+	expect.Equal(uint64(4), alert.Received)
+
+	conf.Override("SequenceAlertStream", "")
+	_, err = core.NewPluginWithType("filter.Sequence", conf)
+	expect.NotNil(err)
+}
@@ -0,0 +1,230 @@
+// Copyright 2015-2016 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filter
+
+import (
+	"fmt"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/core/log"
+	"github.com/trivago/gollum/shared"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// severityCodes maps severity names to syslog severities
+var severityCodes = map[string]int{
+	"emerg": 0, "emergency": 0, "panic": 0, "alert": 1, "crit": 2,
+	"critical": 2, "fatal": 2, "err": 3, "error": 3, "warning": 4, "warn": 4,
+	"notice": 5, "info": 6, "informational": 6, "debug": 7, "trace": 7,
+}
+
+// Severity filter plugin
+// This plugin blocks messages with a syslog severity below a given threshold.
+// The severity is read from the syslog PRI at the start of a message, e.g.
+// "<14>", or from a field holding a severity name like "warning" or number.
+// The threshold can be lowered temporarily by writing a severity into an
+// override file, e.g. to get debug messages during an incident.
+// Configuration example
+//
+//   - "stream.Broadcast":
+//     Filter: "filter.Severity"
+//     SeverityThreshold: "info"
+//     SeverityKey: ""
+//     SeverityMetadataKey: ""
+//     SeverityAcceptUnknown: true
+//     SeverityOverrideFile: ""
+//     SeverityOverrideTimeoutSec: 3600
+//     SeverityOverrideIntervalMs: 5000
+//     SeverityDropToStream: ""
+//
+// SeverityThreshold defines the least severe severity that is passed, given by
+// name or syslog number. Messages with a higher syslog number, i.e. a lower
+// severity, are blocked. By default this is set to "info".
+//
+// SeverityKey defines a field to read the severity from. Field paths can be
+// defined in a format accepted by shared.MarshalMap.Path.
+// By default this is set to "".
+//
+// SeverityMetadataKey defines a metadata key to read the severity from. If both
+// SeverityKey and SeverityMetadataKey are set, the metadata value is
+// preferred. If neither is set, the syslog PRI of the message is parsed.
+// By default this is set to "".
+//
+// SeverityAcceptUnknown can be set to false to block messages without a valid
+// severity. By default this is set to true.
+//
+// SeverityOverrideFile defines a file containing a severity that is used
+// instead of SeverityThreshold while the file exists. Removing the file
+// restores SeverityThreshold. By default this is set to "".
+//
+// SeverityOverrideTimeoutSec defines the number of seconds after the last
+// modification of SeverityOverrideFile after which the override is ignored.
+// This makes sure forgotten overrides expire. Set to 0 to never expire.
+// By default this is set to 3600.
+//
+// SeverityOverrideIntervalMs defines the interval in milliseconds in which
+// SeverityOverrideFile is checked. The file is checked on SIGHUP, too.
+// By default this is set to 5000.
+//
+// SeverityDropToStream is an optional stream messages are sent to when they
+// are blocked. By default this is disabled and set to "".
+type Severity struct {
+	threshold        int32
+	activeThreshold  int32
+	key              string
+	metadataKey      string
+	acceptUnknown    bool
+	overrideFile     string
+	overrideTimeout  time.Duration
+	overrideInterval time.Duration
+	dropStreamID     core.MessageStreamID
+	now              func() time.Time
+}
+
+func init() {
+	shared.TypeRegistry.Register(Severity{})
+}
+
+// Configure initializes this filter with values from a plugin config.
+func (filter *Severity) Configure(conf core.PluginConfig) error {
+	threshold := conf.GetString("SeverityThreshold", "info")
+	code := severityCode(threshold)
+	if code < 0 {
+		return fmt.Errorf("Unknown SeverityThreshold: %s", threshold)
+	}
+
+	filter.threshold = int32(code)
+	filter.activeThreshold = filter.threshold
+	filter.key = conf.GetString("SeverityKey", "")
+	filter.metadataKey = conf.GetString("SeverityMetadataKey", "")
+	filter.acceptUnknown = conf.GetBool("SeverityAcceptUnknown", true)
+	filter.overrideFile = conf.GetString("SeverityOverrideFile", "")
+	filter.overrideTimeout = time.Duration(conf.GetInt("SeverityOverrideTimeoutSec", 3600)) * time.Second
+	filter.overrideInterval = time.Duration(conf.GetInt("SeverityOverrideIntervalMs", 5000)) * time.Millisecond
+	filter.now = time.Now
+
+	filter.dropStreamID = core.InvalidStreamID
+	if dropToStream := conf.GetString("SeverityDropToStream", ""); dropToStream != "" {
+		filter.dropStreamID = core.GetStreamID(dropToStream)
+	}
+
+	if filter.overrideFile != "" {
+		filter.checkOverride()
+		if filter.overrideInterval > 0 {
+			time.AfterFunc(filter.overrideInterval, filter.checkOverrideLoop)
+		}
+	}
+	return nil
+}
+
+// severityCode returns the syslog severity of a name or number. -1 is returned
+// for unknown values.
+func severityCode(value string) int {
+	value = strings.ToLower(strings.TrimSpace(value))
+	if code, exists := severityCodes[value]; exists {
+		return code
+	}
+	if code, err := strconv.Atoi(value); err == nil && code >= 0 && code <= 7 {
+		return code
+	}
+	return -1
+}
+
+// parseSyslogSeverity returns the severity encoded in a syslog PRI at the
+// start of data. -1 is returned if no valid PRI is found.
+func parseSyslogSeverity(data []byte) int {
+	if len(data) < 3 || data[0] != '<' {
+		return -1 // ### return, no PRI ###
+	}
+
+	pri := 0
+	for i := 1; i < len(data) && i <= 4; i++ {
+		switch {
+		case data[i] == '>' && i > 1:
+			if pri > 191 {
+				return -1 // ### return, invalid PRI ###
+			}
+			return pri % 8
+		case data[i] >= '0' && data[i] <= '9':
+			pri = pri*10 + int(data[i]-'0')
+		default:
+			return -1 // ### return, invalid PRI ###
+		}
+	}
+	return -1
+}
+
+// checkOverride updates the active threshold from the override file
+func (filter *Severity) checkOverride() {
+	threshold := filter.threshold
+	if info, err := os.Stat(filter.overrideFile); err == nil {
+		if filter.overrideTimeout <= 0 || filter.now().Sub(info.ModTime()) < filter.overrideTimeout {
+			content, err := ioutil.ReadFile(filter.overrideFile)
+			switch code := severityCode(string(content)); {
+			case err != nil:
+				Log.Error.Print("Severity filter failed to read override: ", err)
+			case code < 0:
+				Log.Error.Printf("Severity filter override %s contains an unknown severity", filter.overrideFile)
+			default:
+				threshold = int32(code)
+			}
+		}
+	}
+
+	if previous := atomic.SwapInt32(&filter.activeThreshold, threshold); previous != threshold {
+		Log.Note.Printf("Severity filter threshold changed from %d to %d", previous, threshold)
+	}
+}
+
+func (filter *Severity) checkOverrideLoop() {
+	filter.checkOverride()
+	time.AfterFunc(filter.overrideInterval, filter.checkOverrideLoop)
+}
+
+// Roll checks the override file
+func (filter *Severity) Roll() {
+	if filter.overrideFile != "" {
+		filter.checkOverride()
+	}
+}
+
+// Accepts blocks messages with a severity below the active threshold
+func (filter *Severity) Accepts(msg core.Message) bool {
+	severity := -1
+	if filter.key != "" || filter.metadataKey != "" {
+		if value, hasValue := getMessageKey(msg, filter.metadataKey, filter.key); hasValue {
+			severity = severityCode(value)
+		}
+	} else {
+		severity = parseSyslogSeverity(msg.Data)
+	}
+
+	accept := filter.acceptUnknown
+	if severity >= 0 {
+		accept = int32(severity) <= atomic.LoadInt32(&filter.activeThreshold)
+	}
+
+	if !accept {
+		if filter.dropStreamID != core.InvalidStreamID {
+			msg.Route(filter.dropStreamID)
+		}
+		return false // ### return, filter ###
+	}
+	return true
+}
@@ -0,0 +1,98 @@
+// Copyright 2015-2016 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filter
+
+import (
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/shared"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFilterSeverity(t *testing.T) {
+	expect := shared.NewExpect(t)
+	conf := core.NewPluginConfig("")
+
+	conf.Override("SeverityThreshold", "warning")
+	plugin, err := core.NewPluginWithType("filter.Severity", conf)
+	expect.NoError(err)
+
+	filter, casted := plugin.(*Severity)
+	expect.True(casted)
+
+	expect.True(filter.Accepts(core.NewMessage(nil, []byte("<11>error"), 0)))
+	expect.True(filter.Accepts(core.NewMessage(nil, []byte("<12>warning"), 0)))
+	expect.False(filter.Accepts(core.NewMessage(nil, []byte("<14>info"), 0)))
+	expect.False(filter.Accepts(core.NewMessage(nil, []byte("<191>debug"), 0)))
+	expect.True(filter.Accepts(core.NewMessage(nil, []byte("<192>invalid"), 0)))
+	expect.True(filter.Accepts(core.NewMessage(nil, []byte("no pri"), 0)))
+
+	conf.Override("SeverityKey", "level")
+	conf.Override("SeverityAcceptUnknown", false)
+	plugin, err = core.NewPluginWithType("filter.Severity", conf)
+	expect.NoError(err)
+	filter = plugin.(*Severity)
+
+	expect.True(filter.Accepts(core.NewMessage(nil, []byte(`{"level":"ERROR"}`), 0)))
+	expect.False(filter.Accepts(core.NewMessage(nil, []byte(`{"level":"debug"}`), 0)))
+	expect.False(filter.Accepts(core.NewMessage(nil, []byte(`{"level":"unknown"}`), 0)))
+	expect.False(filter.Accepts(core.NewMessage(nil, []byte("<11>error"), 0)))
+
+	conf.Override("SeverityThreshold", "verbose")
+	_, err = core.NewPluginWithType("filter.Severity", conf)
+	expect.NotNil(err)
+}
+
+func TestFilterSeverityOverride(t *testing.T) {
+	expect := shared.NewExpect(t)
+
+	dir, err := ioutil.TempDir("", "gollum_severity")
+	expect.NoError(err)
+	defer os.RemoveAll(dir)
+	overrideFile := filepath.Join(dir, "override")
+
+	conf := core.NewPluginConfig("")
+	conf.Override("SeverityMetadataKey", "level")
+	conf.Override("SeverityOverrideFile", overrideFile)
+	conf.Override("SeverityOverrideIntervalMs", 0)
+	plugin, err := core.NewPluginWithType("filter.Severity", conf)
+	expect.NoError(err)
+
+	filter, casted := plugin.(*Severity)
+	expect.True(casted)
+
+	msg := core.NewMessage(nil, []byte("test"), 0)
+	msg.SetMetadata("level", "debug")
+	expect.False(filter.Accepts(msg))
+
+	expect.NoError(ioutil.WriteFile(overrideFile, []byte("debug\n"), 0600))
+	filter.Roll()
+	expect.True(filter.Accepts(msg))
+
+	filter.now = func() time.Time { return time.Now().Add(2 * time.Hour) }
+	filter.Roll()
+	expect.False(filter.Accepts(msg))
+
+	filter.now = time.Now
+	filter.Roll()
+	expect.True(filter.Accepts(msg))
+
+	expect.NoError(os.Remove(overrideFile))
+	filter.Roll()
+	expect.False(filter.Accepts(msg))
+}
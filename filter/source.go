@@ -0,0 +1,139 @@
+// Copyright 2015-2016 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filter
+
+import (
+	"fmt"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/shared"
+	"net"
+)
+
+// Source filter plugin
+// This plugin filters messages by the address of the client that sent them,
+// as recorded by network based consumers like consumer.Socket, consumer.Proxy
+// or consumer.Http.
+// Configuration example
+//
+//   - "stream.Broadcast":
+//     Filter: "filter.Source"
+//     SourceAllow:
+//       - "10.0.0.0/8"
+//       - "fd00::/8"
+//     SourceDeny:
+//       - "10.0.0.1"
+//     SourceMetadataKey: "source_address"
+//     SourceDropToStream: ""
+//
+// SourceAllow defines a list of networks in CIDR notation or single IP
+// addresses that may send messages. If set, messages from all other addresses
+// are blocked. By default this list is empty.
+//
+// SourceDeny defines a list of networks in CIDR notation or single IP
+// addresses whose messages are blocked. Denied addresses are checked before
+// allowed addresses. By default this list is empty.
+//
+// SourceMetadataKey defines the metadata key holding the client address.
+// A port appended to the address is ignored. Messages without a valid address
+// are blocked if SourceAllow is set and passed otherwise.
+// By default this is set to "source_address".
+//
+// SourceDropToStream is an optional stream messages are sent to when they
+// are blocked. By default this is disabled and set to "".
+type Source struct {
+	allow        *listEntries
+	deny         *listEntries
+	metadataKey  string
+	dropStreamID core.MessageStreamID
+}
+
+func init() {
+	shared.TypeRegistry.Register(Source{})
+}
+
+// Configure initializes this filter with values from a plugin config.
+func (filter *Source) Configure(conf core.PluginConfig) error {
+	var err error
+	if filter.allow, err = newSourceNetworks("SourceAllow", conf.GetStringArray("SourceAllow", []string{})); err != nil {
+		return err
+	}
+	if filter.deny, err = newSourceNetworks("SourceDeny", conf.GetStringArray("SourceDeny", []string{})); err != nil {
+		return err
+	}
+	filter.metadataKey = conf.GetString("SourceMetadataKey", core.MetadataSourceAddress)
+
+	filter.dropStreamID = core.InvalidStreamID
+	if dropToStream := conf.GetString("SourceDropToStream", ""); dropToStream != "" {
+		filter.dropStreamID = core.GetStreamID(dropToStream)
+	}
+	return nil
+}
+
+func newSourceNetworks(key string, values []string) (*listEntries, error) {
+	if len(values) == 0 {
+		return nil, nil // ### return, not set ###
+	}
+
+	entries := newListEntries()
+	for _, value := range values {
+		if err := entries.addNetwork(value); err != nil {
+			return nil, fmt.Errorf("%s: %s", key, err.Error())
+		}
+	}
+	return entries, nil
+}
+
+// sourceIP returns the client address of a message
+func (filter *Source) sourceIP(msg core.Message) net.IP {
+	address, exists := msg.Metadata[filter.metadataKey]
+	if !exists {
+		return nil // ### return, no address ###
+	}
+	if host, _, err := net.SplitHostPort(address); err == nil {
+		address = host
+	}
+	return net.ParseIP(address)
+}
+
+// AcceptsWithReason checks the client address of a message and returns why it
+// was rejected.
+func (filter *Source) AcceptsWithReason(msg core.Message) (bool, string) {
+	reason := ""
+	switch ip := filter.sourceIP(msg); {
+	case ip == nil:
+		if filter.allow != nil {
+			reason = "no source address"
+		}
+	case filter.deny != nil && filter.deny.containsIP(ip):
+		reason = fmt.Sprintf("%s is denied", ip)
+	case filter.allow != nil && !filter.allow.containsIP(ip):
+		reason = fmt.Sprintf("%s is not allowed", ip)
+	}
+
+	if reason != "" {
+		if filter.dropStreamID != core.InvalidStreamID {
+			msg.Route(filter.dropStreamID)
+		}
+		return false, reason // ### return, filter ###
+	}
+	return true, ""
+}
+
+// Accepts checks the client address of a message against the deny and allow
+// list.
+func (filter *Source) Accepts(msg core.Message) bool {
+	accept, _ := filter.AcceptsWithReason(msg)
+	return accept
+}
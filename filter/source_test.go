@@ -0,0 +1,65 @@
+// Copyright 2015-2016 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filter
+
+import (
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/shared"
+	"testing"
+)
+
+func TestFilterSource(t *testing.T) {
+	expect := shared.NewExpect(t)
+	conf := core.NewPluginConfig("")
+
+	plugin, err := core.NewPluginWithType("filter.Source", conf)
+	expect.NoError(err)
+
+	filter, casted := plugin.(*Source)
+	expect.True(casted)
+
+	msg := core.NewMessage(nil, []byte("test"), 0)
+	expect.True(filter.Accepts(msg))
+
+	conf.Override("SourceAllow", []string{"10.0.0.0/8", "fd00::/8"})
+	conf.Override("SourceDeny", []string{"10.0.0.1"})
+	plugin, err = core.NewPluginWithType("filter.Source", conf)
+	expect.NoError(err)
+	filter = plugin.(*Source)
+
+	accept, reason := filter.AcceptsWithReason(msg)
+	expect.False(accept)
+	expect.Equal("no source address", reason)
+
+	msg.SetMetadata(core.MetadataSourceAddress, "10.1.2.3:5880")
+	expect.True(filter.Accepts(msg))
+
+	msg.SetMetadata(core.MetadataSourceAddress, "[fd00::1]:5880")
+	expect.True(filter.Accepts(msg))
+
+	msg.SetMetadata(core.MetadataSourceAddress, "10.0.0.1:5880")
+	accept, reason = filter.AcceptsWithReason(msg)
+	expect.False(accept)
+	expect.Equal("10.0.0.1 is denied", reason)
+
+	msg.SetMetadata(core.MetadataSourceAddress, "192.168.0.1")
+	accept, reason = filter.AcceptsWithReason(msg)
+	expect.False(accept)
+	expect.Equal("192.168.0.1 is not allowed", reason)
+
+	conf.Override("SourceDeny", []string{"10.0.0.0/33"})
+	_, err = core.NewPluginWithType("filter.Source", conf)
+	expect.NotNil(err)
+}
@@ -0,0 +1,374 @@
+// Copyright 2015-2016 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package format
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/core/log"
+	"github.com/trivago/gollum/shared"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Avro formatter plugin
+// Avro is a formatter that converts Avro binary encoded messages to JSON and
+// vice versa. Schemas can be given directly or fetched from a Confluent
+// Schema Registry. In the latter case messages use the Confluent wire format,
+// i.e. a zero byte and the 4 byte big endian schema ID followed by the Avro
+// encoded data. Schemas fetched from the registry are cached.
+// Unions are written as plain values when decoding. When encoding, the first
+// matching type of a union is used; the Avro JSON encoding of unions, i.e.
+// {"type": value}, is accepted, too. Bytes and fixed values are base64
+// encoded. Logical types are handled as their underlying type.
+// Configuration example
+//
+//  - "stream.Broadcast":
+//    Formatter: "format.Avro"
+//    AvroDataFormatter: "format.Forward"
+//    AvroDirection: "decode"
+//    AvroSchema: ""
+//    AvroSchemaFile: ""
+//    AvroWireFormat: "confluent"
+//    AvroSchemaRegistry: "http://localhost:8081"
+//    AvroSubject: ""
+//    AvroSchemaID: 0
+//    AvroRegistryTimeoutSec: 5
+//    AvroErrorStream: ""
+//
+// AvroDataFormatter defines a formatter that is applied before the message is
+// converted. By default this is set to "format.Forward".
+//
+// AvroDirection defines the direction of the conversion.
+// By default this is set to "decode".
+//  * "decode" converts Avro encoded messages to JSON.
+//  * "encode" converts JSON objects to Avro encoded messages.
+//
+// AvroSchema defines the schema to use as JSON string. By default this is
+// set to "".
+//
+// AvroSchemaFile defines a file to read the schema from. If set, AvroSchema is
+// ignored. By default this is set to "".
+//
+// AvroWireFormat defines the framing of Avro encoded messages.
+// By default this is set to "confluent".
+//  * "confluent" uses the Confluent wire format. When decoding, the schema is
+//    fetched from the registry by the ID stored in the message. If no
+//    registry is set, the configured schema is used for all IDs.
+//  * "plain" uses Avro encoded data without any header. This requires a
+//    configured schema.
+//
+// AvroSchemaRegistry defines the URL of the Confluent Schema Registry.
+// Set to "" to disable registry access. By default this is set to
+// "http://localhost:8081".
+//
+// AvroSubject defines the registry subject used when encoding messages in the
+// Confluent wire format. If a schema is configured, it is registered for this
+// subject to obtain its ID. Otherwise the latest schema of the subject is
+// used. By default this is set to "".
+//
+// AvroSchemaID defines a fixed schema ID used when encoding messages in the
+// Confluent wire format. If no schema is configured, the schema is fetched
+// from the registry. This setting takes precedence over AvroSubject.
+// By default this is set to 0, i.e. disabled.
+//
+// AvroRegistryTimeoutSec defines the timeout for requests to the registry.
+// By default this is set to 5.
+//
+// AvroErrorStream defines a stream that messages which cannot be converted
+// are routed to. These messages are passed on unchanged.
+// By default this is set to "", i.e. a warning is logged and the message stays
+// on its stream.
+type Avro struct {
+	base          core.Formatter
+	schema        *avroSchema
+	schemaJSON    string
+	encode        bool
+	confluent     bool
+	registry      *avroRegistry
+	subject       string
+	schemaID      uint32
+	writerGuard   *sync.Mutex
+	errorStreamID core.MessageStreamID
+}
+
+// avroRegistry is a caching client for the Confluent Schema Registry API.
+type avroRegistry struct {
+	url     string
+	client  *http.Client
+	schemas map[uint32]*avroSchema
+	guard   *sync.Mutex
+}
+
+const avroMagicByte = 0
+
+func init() {
+	shared.TypeRegistry.Register(Avro{})
+}
+
+// Configure initializes this formatter with values from a plugin config.
+func (format *Avro) Configure(conf core.PluginConfig) error {
+	plugin, err := core.NewPluginWithType(conf.GetString("AvroDataFormatter", "format.Forward"), conf)
+	if err != nil {
+		return err
+	}
+	format.base = plugin.(core.Formatter)
+	format.writerGuard = new(sync.Mutex)
+
+	direction := strings.ToLower(conf.GetString("AvroDirection", "decode"))
+	switch direction {
+	case "decode":
+	case "encode":
+		format.encode = true
+	default:
+		return fmt.Errorf("Unknown AvroDirection: %s", direction)
+	}
+
+	format.schemaJSON = conf.GetString("AvroSchema", "")
+	if schemaFile := conf.GetString("AvroSchemaFile", ""); schemaFile != "" {
+		content, err := ioutil.ReadFile(schemaFile)
+		if err != nil {
+			return err
+		}
+		format.schemaJSON = string(content)
+	}
+	if format.schemaJSON != "" {
+		if format.schema, err = parseAvroSchema(format.schemaJSON); err != nil {
+			return err
+		}
+	}
+
+	wireFormat := strings.ToLower(conf.GetString("AvroWireFormat", "confluent"))
+	switch wireFormat {
+	case "confluent":
+		format.confluent = true
+	case "plain":
+	default:
+		return fmt.Errorf("Unknown AvroWireFormat: %s", wireFormat)
+	}
+
+	if registryURL := conf.GetString("AvroSchemaRegistry", "http://localhost:8081"); registryURL != "" {
+		format.registry = &avroRegistry{
+			url:     strings.TrimRight(registryURL, "/"),
+			client:  &http.Client{Timeout: time.Duration(conf.GetInt("AvroRegistryTimeoutSec", 5)) * time.Second},
+			schemas: make(map[uint32]*avroSchema),
+			guard:   new(sync.Mutex),
+		}
+	}
+
+	format.subject = conf.GetString("AvroSubject", "")
+	format.schemaID = uint32(conf.GetInt("AvroSchemaID", 0))
+
+	switch {
+	case !format.confluent && format.schema == nil:
+		return fmt.Errorf("AvroWireFormat \"plain\" requires AvroSchema or AvroSchemaFile to be set")
+	case format.confluent && format.registry == nil && format.schema == nil:
+		return fmt.Errorf("AvroWireFormat \"confluent\" requires AvroSchemaRegistry or a schema to be set")
+	case format.encode && format.confluent && format.schemaID == 0 && format.subject == "":
+		return fmt.Errorf("Encoding to AvroWireFormat \"confluent\" requires AvroSchemaID or AvroSubject to be set")
+	case format.encode && format.confluent && format.registry == nil && (format.schemaID == 0 || format.schema == nil):
+		return fmt.Errorf("Encoding to AvroWireFormat \"confluent\" without AvroSchemaRegistry requires AvroSchemaID and a schema to be set")
+	}
+
+	format.errorStreamID = core.InvalidStreamID
+	if errorStream := conf.GetString("AvroErrorStream", ""); errorStream != "" {
+		format.errorStreamID = core.StreamRegistry.GetStreamID(errorStream)
+	}
+
+	return nil
+}
+
+// request sends a request to the registry and decodes the JSON response.
+func (registry *avroRegistry) request(method string, path string, body interface{}, response interface{}) error {
+	var requestBody *bytes.Reader
+	if body != nil {
+		encoded, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		requestBody = bytes.NewReader(encoded)
+	} else {
+		requestBody = bytes.NewReader(nil)
+	}
+
+	request, err := http.NewRequest(method, registry.url+path, requestBody)
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/vnd.schemaregistry.v1+json")
+	request.Header.Set("Accept", "application/vnd.schemaregistry.v1+json, application/json")
+
+	resp, err := registry.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	content, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Schema registry returned %s: %s", resp.Status, strings.TrimSpace(string(content)))
+	}
+	return json.Unmarshal(content, response)
+}
+
+// schemaByID returns the schema registered for the given ID.
+func (registry *avroRegistry) schemaByID(id uint32) (*avroSchema, error) {
+	registry.guard.Lock()
+	defer registry.guard.Unlock()
+
+	if schema, cached := registry.schemas[id]; cached {
+		return schema, nil // ### return, cached ###
+	}
+
+	response := struct {
+		Schema string `json:"schema"`
+	}{}
+	if err := registry.request("GET", fmt.Sprintf("/schemas/ids/%d", id), nil, &response); err != nil {
+		return nil, err
+	}
+
+	schema, err := parseAvroSchema(response.Schema)
+	if err != nil {
+		return nil, err
+	}
+	registry.schemas[id] = schema
+	return schema, nil
+}
+
+// register registers a schema for the given subject and returns its ID. If
+// the schema is already registered the existing ID is returned.
+func (registry *avroRegistry) register(subject string, schemaJSON string) (uint32, error) {
+	response := struct {
+		ID uint32 `json:"id"`
+	}{}
+	body := map[string]string{"schema": schemaJSON}
+	err := registry.request("POST", "/subjects/"+url.PathEscape(subject)+"/versions", body, &response)
+	return response.ID, err
+}
+
+// latest returns the ID and schema of the latest version of a subject.
+func (registry *avroRegistry) latest(subject string) (uint32, *avroSchema, error) {
+	response := struct {
+		ID     uint32 `json:"id"`
+		Schema string `json:"schema"`
+	}{}
+	if err := registry.request("GET", "/subjects/"+url.PathEscape(subject)+"/versions/latest", nil, &response); err != nil {
+		return 0, nil, err
+	}
+
+	schema, err := parseAvroSchema(response.Schema)
+	return response.ID, schema, err
+}
+
+// writerSchema returns the schema and schema ID used for encoding. Registry
+// lookups are done on first use and retried until they succeed.
+func (format *Avro) writerSchema() (*avroSchema, uint32, error) {
+	format.writerGuard.Lock()
+	defer format.writerGuard.Unlock()
+
+	if !format.confluent || (format.schema != nil && format.schemaID != 0) {
+		return format.schema, format.schemaID, nil // ### return, known schema ###
+	}
+
+	var err error
+	switch {
+	case format.schemaID != 0:
+		format.schema, err = format.registry.schemaByID(format.schemaID)
+	case format.schema != nil:
+		format.schemaID, err = format.registry.register(format.subject, format.schemaJSON)
+	default:
+		var schemaID uint32
+		if schemaID, format.schema, err = format.registry.latest(format.subject); err == nil {
+			format.schemaID = schemaID
+		}
+	}
+	return format.schema, format.schemaID, err
+}
+
+// readerSchema returns the schema used to decode the given message and the
+// Avro encoded part of the message.
+func (format *Avro) readerSchema(data []byte) (*avroSchema, []byte, error) {
+	if !format.confluent {
+		return format.schema, data, nil // ### return, plain data ###
+	}
+
+	if len(data) < 5 || data[0] != avroMagicByte {
+		return nil, nil, fmt.Errorf("Avro: message is not in Confluent wire format")
+	}
+	if format.registry == nil {
+		return format.schema, data[5:], nil // ### return, no registry ###
+	}
+
+	schema, err := format.registry.schemaByID(binary.BigEndian.Uint32(data[1:5]))
+	return schema, data[5:], err
+}
+
+// convert converts the message data in the configured direction.
+func (format *Avro) convert(data []byte) ([]byte, error) {
+	if format.encode {
+		schema, schemaID, err := format.writerSchema()
+		if err != nil {
+			return nil, err
+		}
+		value, err := avroDecodeJSON(data)
+		if err != nil {
+			return nil, err
+		}
+
+		buffer := []byte{}
+		if format.confluent {
+			buffer = append(buffer, avroMagicByte, 0, 0, 0, 0)
+			binary.BigEndian.PutUint32(buffer[1:], schemaID)
+		}
+		return schema.encode(buffer, value)
+	}
+
+	schema, encoded, err := format.readerSchema(data)
+	if err != nil {
+		return nil, err
+	}
+
+	reader := avroReader{data: encoded}
+	value, err := reader.decode(schema)
+	if err != nil {
+		return nil, err
+	}
+	return (&splitToJSONNode{value: value}).MarshalJSON()
+}
+
+// Format converts the message between Avro and JSON encoding
+func (format *Avro) Format(msg core.Message) ([]byte, core.MessageStreamID) {
+	data, streamID := format.base.Format(msg)
+
+	converted, err := format.convert(data)
+	if err != nil {
+		if format.errorStreamID != core.InvalidStreamID {
+			return data, format.errorStreamID // ### return, route to error stream ###
+		}
+		Log.Warning.Print("Avro failed to convert a message: ", err)
+		return data, streamID // ### return, conversion failed ###
+	}
+	return converted, streamID
+}
@@ -0,0 +1,207 @@
+// Copyright 2015-2016 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package format
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/shared"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+const testAvroSchema = `{
+	"type": "record", "name": "Event", "namespace": "test",
+	"fields": [
+		{"name": "id", "type": "long"},
+		{"name": "name", "type": "string"},
+		{"name": "tags", "type": {"type": "array", "items": "string"}},
+		{"name": "level", "type": {"type": "enum", "name": "Level", "symbols": ["INFO", "WARN"]}},
+		{"name": "extra", "type": ["null", {"type": "map", "values": "int"}], "default": null},
+		{"name": "score", "type": "double", "default": 1.5},
+		{"name": "next", "type": ["null", "Event"], "default": null}
+	]
+}`
+
+func TestAvroPlain(t *testing.T) {
+	expect := shared.NewExpect(t)
+
+	config := core.NewPluginConfig("")
+	config.Override("AvroSchema", testAvroSchema)
+	config.Override("AvroWireFormat", "plain")
+	config.Override("AvroDirection", "encode")
+	pluginEncode, err := core.NewPluginWithType("format.Avro", config)
+	expect.NoError(err)
+	config.Override("AvroDirection", "decode")
+	pluginDecode, err := core.NewPluginWithType("format.Avro", config)
+	expect.NoError(err)
+
+	encoder, castedEncoder := pluginEncode.(*Avro)
+	expect.True(castedEncoder)
+	decoder, castedDecoder := pluginDecode.(*Avro)
+	expect.True(castedDecoder)
+
+	msg := core.NewMessage(nil, []byte(`{"id":1,"name":"a","tags":[],"level":"WARN"}`), 0)
+	result, _ := encoder.Format(msg)
+	expect.Equal([]byte{0x02, 0x02, 'a', 0x00, 0x02, 0x00, 0, 0, 0, 0, 0, 0, 0xf8, 0x3f, 0x00}, result)
+
+	msg.Data = result
+	result, _ = decoder.Format(msg)
+	expect.Equal(`{"id":1,"name":"a","tags":[],"level":"WARN","extra":null,"score":1.5,"next":null}`, string(result))
+
+	payload := `{"id":-5,"name":"b","tags":["x","y"],"level":"INFO","extra":{"a":1,"b":2},"score":0.25,` +
+		`"next":{"id":6,"name":"c","tags":[],"level":"INFO","extra":null,"score":2,"next":null}}`
+	msg = core.NewMessage(nil, []byte(payload), 0)
+	msg.Data, _ = encoder.Format(msg)
+	result, _ = decoder.Format(msg)
+	expect.Equal(payload, string(result))
+}
+
+func TestAvroErrors(t *testing.T) {
+	expect := shared.NewExpect(t)
+
+	config := core.NewPluginConfig("")
+	config.Override("AvroWireFormat", "plain")
+	_, err := core.NewPluginWithType("format.Avro", config)
+	expect.NotNil(err)
+
+	config = core.NewPluginConfig("")
+	config.Override("AvroDirection", "encode")
+	_, err = core.NewPluginWithType("format.Avro", config)
+	expect.NotNil(err)
+
+	config = core.NewPluginConfig("")
+	config.Override("AvroSchema", `{"type": "record", "name": "A", "fields": [{"name": "b", "type": "Unknown"}]}`)
+	_, err = core.NewPluginWithType("format.Avro", config)
+	expect.NotNil(err)
+
+	config = core.NewPluginConfig("")
+	config.Override("AvroSchema", testAvroSchema)
+	config.Override("AvroWireFormat", "plain")
+	config.Override("AvroDirection", "encode")
+	config.Override("AvroErrorStream", "error")
+	plugin, err := core.NewPluginWithType("format.Avro", config)
+	expect.NoError(err)
+	encoder, casted := plugin.(*Avro)
+	expect.True(casted)
+
+	msg := core.NewMessage(nil, []byte(`{"id":"1"}`), 0)
+	result, streamID := encoder.Format(msg)
+	expect.Equal(`{"id":"1"}`, string(result))
+	expect.Equal(core.StreamRegistry.GetStreamID("error"), streamID)
+}
+
+func TestAvroBlockCount(t *testing.T) {
+	expect := shared.NewExpect(t)
+
+	newDecoder := func(schema string) *Avro {
+		config := core.NewPluginConfig("")
+		config.Override("AvroSchema", schema)
+		config.Override("AvroWireFormat", "plain")
+		config.Override("AvroDirection", "decode")
+		config.Override("AvroErrorStream", "error")
+		plugin, err := core.NewPluginWithType("format.Avro", config)
+		expect.NoError(err)
+		decoder, casted := plugin.(*Avro)
+		expect.True(casted)
+		return decoder
+	}
+
+	nullArray := newDecoder(`{"type": "array", "items": "null"}`)
+	emptyArray := newDecoder(`{"type": "array", "items": {"type": "record", "name": "Empty", "fields": []}}`)
+	nullMap := newDecoder(`{"type": "map", "values": "null"}`)
+	longArray := newDecoder(`{"type": "array", "items": "long"}`)
+
+	// Zero width items are limited by the remaining data
+	msg := core.NewMessage(nil, []byte{0x06, 0x00, 0x00, 0x00, 0x00}, 0)
+	result, streamID := nullArray.Format(msg)
+	expect.Equal("[null,null,null]", string(result))
+	expect.Equal(core.WildcardStreamID, streamID)
+
+	for _, decoder := range []*Avro{nullArray, emptyArray, nullMap, longArray} {
+		// Block counts of 2^62 and -2^62 with a block size
+		for _, data := range [][]byte{
+			{0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x01, 0x00},
+			{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x7f, 0x00, 0x00},
+		} {
+			msg = core.NewMessage(nil, data, 0)
+			_, streamID = decoder.Format(msg)
+			expect.Equal(core.StreamRegistry.GetStreamID("error"), streamID)
+		}
+	}
+
+	// Block count of -2^63 cannot be negated
+	msg = core.NewMessage(nil, []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01, 0x00}, 0)
+	_, streamID = nullArray.Format(msg)
+	expect.Equal(core.StreamRegistry.GetStreamID("error"), streamID)
+}
+
+func TestAvroSchemaRegistry(t *testing.T) {
+	expect := shared.NewExpect(t)
+
+	requests := 0
+	registry := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		schemaJSON, _ := json.Marshal(`"string"`)
+		switch {
+		case r.Method == "POST" && r.URL.Path == "/subjects/test-value/versions":
+			fmt.Fprint(w, `{"id":42}`)
+		case r.Method == "GET" && r.URL.Path == "/schemas/ids/42":
+			fmt.Fprintf(w, `{"schema":%s}`, schemaJSON)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer registry.Close()
+
+	config := core.NewPluginConfig("")
+	config.Override("AvroSchema", `"string"`)
+	config.Override("AvroSchemaRegistry", registry.URL)
+	config.Override("AvroSubject", "test-value")
+	config.Override("AvroDirection", "encode")
+	pluginEncode, err := core.NewPluginWithType("format.Avro", config)
+	expect.NoError(err)
+
+	config = core.NewPluginConfig("")
+	config.Override("AvroSchemaRegistry", registry.URL)
+	config.Override("AvroErrorStream", "error")
+	pluginDecode, err := core.NewPluginWithType("format.Avro", config)
+	expect.NoError(err)
+
+	encoder, castedEncoder := pluginEncode.(*Avro)
+	expect.True(castedEncoder)
+	decoder, castedDecoder := pluginDecode.(*Avro)
+	expect.True(castedDecoder)
+
+	msg := core.NewMessage(nil, []byte(`"hello"`), 0)
+	result, _ := encoder.Format(msg)
+	expect.Equal([]byte{0, 0, 0, 0, 42, 10, 'h', 'e', 'l', 'l', 'o'}, result)
+
+	msg.Data = result
+	result, _ = decoder.Format(msg)
+	expect.Equal(`"hello"`, string(result))
+	result, _ = decoder.Format(msg)
+	expect.Equal(`"hello"`, string(result))
+
+	result, _ = encoder.Format(core.NewMessage(nil, []byte(`"x"`), 0))
+	expect.Equal(7, len(result))
+	expect.Equal(2, requests) // register and schema lookup are cached
+
+	msg.Data = []byte{0, 0, 0, 0, 7, 2, 'x'}
+	_, streamID := decoder.Format(msg)
+	expect.Equal(core.StreamRegistry.GetStreamID("error"), streamID)
+}
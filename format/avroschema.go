@@ -0,0 +1,649 @@
+// Copyright 2015-2016 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package format
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// avroSchema is a parsed Avro schema. Logical types are handled as their
+// underlying primitive type.
+type avroSchema struct {
+	kind     string
+	name     string
+	fields   []avroField
+	symbols  []string
+	items    *avroSchema
+	branches []*avroSchema
+	size     int
+}
+
+// avroField is a field of an Avro record.
+type avroField struct {
+	name         string
+	schema       *avroSchema
+	defaultValue interface{}
+	hasDefault   bool
+}
+
+// avroSchemaParser resolves named types while parsing a schema.
+type avroSchemaParser struct {
+	named map[string]*avroSchema
+}
+
+// parseAvroSchema parses the JSON representation of an Avro schema.
+func parseAvroSchema(schemaJSON string) (*avroSchema, error) {
+	var definition interface{}
+	decoder := json.NewDecoder(strings.NewReader(schemaJSON))
+	decoder.UseNumber()
+	if err := decoder.Decode(&definition); err != nil {
+		return nil, fmt.Errorf("Avro schema: %s", err)
+	}
+
+	parser := avroSchemaParser{named: make(map[string]*avroSchema)}
+	return parser.parse(definition, "")
+}
+
+// fullName returns the full name of a named type within a namespace.
+func (parser *avroSchemaParser) fullName(name string, namespace string) string {
+	if strings.Contains(name, ".") || namespace == "" {
+		return name
+	}
+	return namespace + "." + name
+}
+
+// parse converts a decoded JSON schema definition to an avroSchema.
+func (parser *avroSchemaParser) parse(definition interface{}, namespace string) (*avroSchema, error) {
+	switch typed := definition.(type) {
+	case string:
+		switch typed {
+		case "null", "boolean", "int", "long", "float", "double", "bytes", "string":
+			return &avroSchema{kind: typed}, nil
+		}
+		if named, exists := parser.named[parser.fullName(typed, namespace)]; exists {
+			return named, nil
+		}
+		if named, exists := parser.named[typed]; exists {
+			return named, nil
+		}
+		return nil, fmt.Errorf("Avro schema: unknown type %s", typed)
+
+	case []interface{}:
+		union := &avroSchema{kind: "union"}
+		for _, branch := range typed {
+			branchSchema, err := parser.parse(branch, namespace)
+			if err != nil {
+				return nil, err
+			}
+			union.branches = append(union.branches, branchSchema)
+		}
+		return union, nil
+
+	case map[string]interface{}:
+		return parser.parseComplex(typed, namespace)
+	}
+	return nil, fmt.Errorf("Avro schema: invalid type definition %v", definition)
+}
+
+// parseComplex parses a schema given as JSON object.
+func (parser *avroSchemaParser) parseComplex(definition map[string]interface{}, namespace string) (*avroSchema, error) {
+	kind, isString := definition["type"].(string)
+	if !isString {
+		return parser.parse(definition["type"], namespace) // ### return, nested definition ###
+	}
+
+	name, _ := definition["name"].(string)
+	if ns, hasNamespace := definition["namespace"].(string); hasNamespace {
+		namespace = ns
+	}
+	if name != "" {
+		name = parser.fullName(name, namespace)
+		if idx := strings.LastIndex(name, "."); idx >= 0 {
+			namespace = name[:idx]
+		}
+	}
+
+	switch kind {
+	case "record", "error":
+		record := &avroSchema{kind: "record", name: name}
+		parser.named[name] = record // register first to allow recursive types
+
+		fields, _ := definition["fields"].([]interface{})
+		for _, fieldDefinition := range fields {
+			fieldMap, isMap := fieldDefinition.(map[string]interface{})
+			if !isMap {
+				return nil, fmt.Errorf("Avro schema: invalid field in record %s", name)
+			}
+			fieldName, _ := fieldMap["name"].(string)
+			fieldSchema, err := parser.parse(fieldMap["type"], namespace)
+			if err != nil {
+				return nil, err
+			}
+			defaultValue, hasDefault := fieldMap["default"]
+			record.fields = append(record.fields, avroField{
+				name:         fieldName,
+				schema:       fieldSchema,
+				defaultValue: defaultValue,
+				hasDefault:   hasDefault,
+			})
+		}
+		return record, nil
+
+	case "enum":
+		enum := &avroSchema{kind: "enum", name: name}
+		symbols, _ := definition["symbols"].([]interface{})
+		for _, symbol := range symbols {
+			symbolName, _ := symbol.(string)
+			enum.symbols = append(enum.symbols, symbolName)
+		}
+		parser.named[name] = enum
+		return enum, nil
+
+	case "fixed":
+		size, err := strconv.Atoi(fmt.Sprint(definition["size"]))
+		if err != nil || size < 0 {
+			return nil, fmt.Errorf("Avro schema: invalid size for fixed %s", name)
+		}
+		fixed := &avroSchema{kind: "fixed", name: name, size: size}
+		parser.named[name] = fixed
+		return fixed, nil
+
+	case "array", "map":
+		itemKey := "items"
+		if kind == "map" {
+			itemKey = "values"
+		}
+		items, err := parser.parse(definition[itemKey], namespace)
+		if err != nil {
+			return nil, err
+		}
+		return &avroSchema{kind: kind, items: items}, nil
+	}
+
+	return parser.parse(kind, namespace) // primitive, possibly with logical type
+}
+
+// zeroWidth returns true if values of this schema can be encoded without
+// consuming any bytes, e.g. "null" or records of such types.
+func (schema *avroSchema) zeroWidth(visited map[*avroSchema]bool) bool {
+	switch schema.kind {
+	case "null":
+		return true
+
+	case "fixed":
+		return schema.size == 0
+
+	case "record":
+		if visited[schema] {
+			return false // ### return, recursive record ###
+		}
+		visited[schema] = true
+		for _, field := range schema.fields {
+			if !field.schema.zeroWidth(visited) {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// typeName returns the name used for a schema inside a JSON encoded union.
+func (schema *avroSchema) typeName() string {
+	if schema.name != "" {
+		return schema.name
+	}
+	return schema.kind
+}
+
+// avroReader reads Avro binary encoded data.
+type avroReader struct {
+	data []byte
+}
+
+func (reader *avroReader) long() (int64, error) {
+	value, size := binary.Varint(reader.data)
+	if size <= 0 {
+		return 0, fmt.Errorf("Avro: invalid long value")
+	}
+	reader.data = reader.data[size:]
+	return value, nil
+}
+
+func (reader *avroReader) fixed(size int) ([]byte, error) {
+	if size < 0 || size > len(reader.data) {
+		return nil, fmt.Errorf("Avro: unexpected end of data")
+	}
+	value := reader.data[:size]
+	reader.data = reader.data[size:]
+	return value, nil
+}
+
+func (reader *avroReader) bytes() ([]byte, error) {
+	size, err := reader.long()
+	if err != nil {
+		return nil, err
+	}
+	if size > int64(len(reader.data)) {
+		return nil, fmt.Errorf("Avro: unexpected end of data")
+	}
+	return reader.fixed(int(size))
+}
+
+// blockCount reads the item count of an array or map block. Blocks with a
+// negative count are followed by their size in bytes, which is skipped.
+// As the count is not bound by the size of the data for zero width items,
+// the count may not exceed the number of remaining bytes in that case.
+func (reader *avroReader) blockCount(zeroWidth bool) (int64, error) {
+	count, err := reader.long()
+	if err != nil {
+		return 0, err
+	}
+	if count < 0 {
+		if count == math.MinInt64 {
+			return 0, fmt.Errorf("Avro: invalid block count")
+		}
+		count = -count
+		if _, err := reader.long(); err != nil {
+			return 0, err
+		}
+	}
+	if zeroWidth && count > int64(len(reader.data)) {
+		return 0, fmt.Errorf("Avro: block count %d exceeds remaining data", count)
+	}
+	return count, nil
+}
+
+// decode reads a value of the given schema and returns it as JSON value.
+// Records and maps are returned as ordered objects, bytes and fixed values
+// are base64 encoded.
+func (reader *avroReader) decode(schema *avroSchema) (interface{}, error) {
+	switch schema.kind {
+	case "null":
+		return nil, nil
+
+	case "boolean":
+		value, err := reader.fixed(1)
+		if err != nil {
+			return nil, err
+		}
+		return value[0] != 0, nil
+
+	case "int", "long":
+		return reader.long()
+
+	case "float":
+		value, err := reader.fixed(4)
+		if err != nil {
+			return nil, err
+		}
+		return jsonFloatValue(float64(math.Float32frombits(binary.LittleEndian.Uint32(value))), 32), nil
+
+	case "double":
+		value, err := reader.fixed(8)
+		if err != nil {
+			return nil, err
+		}
+		return jsonFloatValue(math.Float64frombits(binary.LittleEndian.Uint64(value)), 64), nil
+
+	case "string":
+		value, err := reader.bytes()
+		return string(value), err
+
+	case "bytes":
+		value, err := reader.bytes()
+		return base64.StdEncoding.EncodeToString(value), err
+
+	case "fixed":
+		value, err := reader.fixed(schema.size)
+		return base64.StdEncoding.EncodeToString(value), err
+
+	case "enum":
+		index, err := reader.long()
+		if err != nil {
+			return nil, err
+		}
+		if index < 0 || index >= int64(len(schema.symbols)) {
+			return nil, fmt.Errorf("Avro: invalid symbol index %d for enum %s", index, schema.name)
+		}
+		return schema.symbols[index], nil
+
+	case "union":
+		index, err := reader.long()
+		if err != nil {
+			return nil, err
+		}
+		if index < 0 || index >= int64(len(schema.branches)) {
+			return nil, fmt.Errorf("Avro: invalid union index %d", index)
+		}
+		return reader.decode(schema.branches[index])
+
+	case "record":
+		record := &splitToJSONNode{children: []*splitToJSONNode{}}
+		for _, field := range schema.fields {
+			value, err := reader.decode(field.schema)
+			if err != nil {
+				return nil, err
+			}
+			record.set([]string{field.name}, value)
+		}
+		return record, nil
+
+	case "array":
+		array := []interface{}{}
+		zeroWidth := schema.items.zeroWidth(map[*avroSchema]bool{})
+		for {
+			count, err := reader.blockCount(zeroWidth)
+			if err != nil {
+				return nil, err
+			}
+			if count == 0 {
+				return array, nil // ### return, last block ###
+			}
+			for ; count > 0; count-- {
+				value, err := reader.decode(schema.items)
+				if err != nil {
+					return nil, err
+				}
+				array = append(array, value)
+			}
+		}
+
+	case "map":
+		object := &splitToJSONNode{children: []*splitToJSONNode{}}
+		for {
+			count, err := reader.blockCount(true) // each key takes at least one byte
+			if err != nil {
+				return nil, err
+			}
+			if count == 0 {
+				return object, nil // ### return, last block ###
+			}
+			for ; count > 0; count-- {
+				key, err := reader.bytes()
+				if err != nil {
+					return nil, err
+				}
+				value, err := reader.decode(schema.items)
+				if err != nil {
+					return nil, err
+				}
+				object.set([]string{string(key)}, value)
+			}
+		}
+	}
+	return nil, fmt.Errorf("Avro: unsupported type %s", schema.kind)
+}
+
+// avroAppendLong appends a zigzag encoded long.
+func avroAppendLong(buffer []byte, value int64) []byte {
+	var encoded [binary.MaxVarintLen64]byte
+	size := binary.PutVarint(encoded[:], value)
+	return append(buffer, encoded[:size]...)
+}
+
+// avroAppendBytes appends a length prefixed byte sequence.
+func avroAppendBytes(buffer []byte, value []byte) []byte {
+	return append(avroAppendLong(buffer, int64(len(value))), value...)
+}
+
+// avroParseFloat parses a JSON number or one of the strings used for NaN and
+// infinity.
+func avroParseFloat(value interface{}, bits int) (float64, error) {
+	switch number := value.(type) {
+	case json.Number:
+		return strconv.ParseFloat(string(number), bits)
+	case string:
+		switch number {
+		case "NaN":
+			return math.NaN(), nil
+		case "Infinity":
+			return math.Inf(1), nil
+		case "-Infinity":
+			return math.Inf(-1), nil
+		}
+	}
+	return 0, fmt.Errorf("Avro: %v is not a number", value)
+}
+
+// matches returns true if the given JSON value can be encoded by the schema.
+// This is used to select the branch of a union.
+func (schema *avroSchema) matches(value interface{}) bool {
+	switch typed := value.(type) {
+	case nil:
+		return schema.kind == "null"
+	case bool:
+		return schema.kind == "boolean"
+	case json.Number:
+		switch schema.kind {
+		case "int":
+			_, err := strconv.ParseInt(string(typed), 10, 32)
+			return err == nil
+		case "long":
+			_, err := strconv.ParseInt(string(typed), 10, 64)
+			return err == nil
+		case "float", "double":
+			return true
+		}
+	case string:
+		switch schema.kind {
+		case "string", "bytes", "fixed":
+			return true
+		case "enum":
+			for _, symbol := range schema.symbols {
+				if symbol == typed {
+					return true
+				}
+			}
+		}
+	case []interface{}:
+		return schema.kind == "array"
+	case map[string]interface{}:
+		switch schema.kind {
+		case "map":
+			return true
+		case "record":
+			for key := range typed {
+				found := false
+				for _, field := range schema.fields {
+					found = found || field.name == key
+				}
+				if !found {
+					return false
+				}
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// encode appends the binary encoding of a JSON value as decoded with
+// json.Decoder.UseNumber.
+func (schema *avroSchema) encode(buffer []byte, value interface{}) ([]byte, error) {
+	switch schema.kind {
+	case "null":
+		if value != nil {
+			return nil, fmt.Errorf("Avro: expected null, got %v", value)
+		}
+		return buffer, nil
+
+	case "boolean":
+		flag, isBool := value.(bool)
+		if !isBool {
+			return nil, fmt.Errorf("Avro: expected boolean, got %v", value)
+		}
+		if flag {
+			return append(buffer, 1), nil
+		}
+		return append(buffer, 0), nil
+
+	case "int", "long":
+		bits := 64
+		if schema.kind == "int" {
+			bits = 32
+		}
+		number, isNumber := value.(json.Number)
+		if !isNumber {
+			return nil, fmt.Errorf("Avro: expected %s, got %v", schema.kind, value)
+		}
+		parsed, err := strconv.ParseInt(string(number), 10, bits)
+		if err != nil {
+			return nil, fmt.Errorf("Avro: %s", err)
+		}
+		return avroAppendLong(buffer, parsed), nil
+
+	case "float":
+		number, err := avroParseFloat(value, 32)
+		if err != nil {
+			return nil, err
+		}
+		var encoded [4]byte
+		binary.LittleEndian.PutUint32(encoded[:], math.Float32bits(float32(number)))
+		return append(buffer, encoded[:]...), nil
+
+	case "double":
+		number, err := avroParseFloat(value, 64)
+		if err != nil {
+			return nil, err
+		}
+		var encoded [8]byte
+		binary.LittleEndian.PutUint64(encoded[:], math.Float64bits(number))
+		return append(buffer, encoded[:]...), nil
+
+	case "string":
+		str, isString := value.(string)
+		if !isString {
+			return nil, fmt.Errorf("Avro: expected string, got %v", value)
+		}
+		return avroAppendBytes(buffer, []byte(str)), nil
+
+	case "bytes", "fixed":
+		str, isString := value.(string)
+		if !isString {
+			return nil, fmt.Errorf("Avro: expected base64 string, got %v", value)
+		}
+		data, err := base64.StdEncoding.DecodeString(str)
+		if err != nil {
+			return nil, fmt.Errorf("Avro: %s", err)
+		}
+		if schema.kind == "bytes" {
+			return avroAppendBytes(buffer, data), nil
+		}
+		if len(data) != schema.size {
+			return nil, fmt.Errorf("Avro: fixed %s requires %d bytes", schema.name, schema.size)
+		}
+		return append(buffer, data...), nil
+
+	case "enum":
+		symbol, _ := value.(string)
+		for i, candidate := range schema.symbols {
+			if candidate == symbol {
+				return avroAppendLong(buffer, int64(i)), nil
+			}
+		}
+		return nil, fmt.Errorf("Avro: %v is not a symbol of enum %s", value, schema.name)
+
+	case "union":
+		for i, branch := range schema.branches {
+			if branch.matches(value) {
+				return branch.encode(avroAppendLong(buffer, int64(i)), value)
+			}
+		}
+		// Values may use the JSON encoding of unions, i.e. {"type": value}
+		if wrapped, isMap := value.(map[string]interface{}); isMap && len(wrapped) == 1 {
+			for i, branch := range schema.branches {
+				if inner, exists := wrapped[branch.typeName()]; exists {
+					return branch.encode(avroAppendLong(buffer, int64(i)), inner)
+				}
+			}
+		}
+		return nil, fmt.Errorf("Avro: %v does not match any type of the union", value)
+
+	case "record":
+		object, isMap := value.(map[string]interface{})
+		if !isMap {
+			return nil, fmt.Errorf("Avro: expected record %s, got %v", schema.name, value)
+		}
+		var err error
+		for _, field := range schema.fields {
+			fieldValue, exists := object[field.name]
+			if !exists && field.hasDefault {
+				fieldValue = field.defaultValue
+			}
+			if buffer, err = field.schema.encode(buffer, fieldValue); err != nil {
+				return nil, fmt.Errorf("%s (field %s.%s)", err, schema.name, field.name)
+			}
+		}
+		return buffer, nil
+
+	case "array":
+		array, isArray := value.([]interface{})
+		if !isArray {
+			return nil, fmt.Errorf("Avro: expected array, got %v", value)
+		}
+		if len(array) > 0 {
+			buffer = avroAppendLong(buffer, int64(len(array)))
+			var err error
+			for _, item := range array {
+				if buffer, err = schema.items.encode(buffer, item); err != nil {
+					return nil, err
+				}
+			}
+		}
+		return avroAppendLong(buffer, 0), nil
+
+	case "map":
+		object, isMap := value.(map[string]interface{})
+		if !isMap {
+			return nil, fmt.Errorf("Avro: expected map, got %v", value)
+		}
+		if len(object) > 0 {
+			keys := make([]string, 0, len(object))
+			for key := range object {
+				keys = append(keys, key)
+			}
+			sort.Strings(keys)
+
+			buffer = avroAppendLong(buffer, int64(len(keys)))
+			var err error
+			for _, key := range keys {
+				buffer = avroAppendBytes(buffer, []byte(key))
+				if buffer, err = schema.items.encode(buffer, object[key]); err != nil {
+					return nil, err
+				}
+			}
+		}
+		return avroAppendLong(buffer, 0), nil
+	}
+	return nil, fmt.Errorf("Avro: unsupported type %s", schema.kind)
+}
+
+// avroDecodeJSON decodes a JSON document with numbers kept as json.Number.
+func avroDecodeJSON(data []byte) (interface{}, error) {
+	var value interface{}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	err := decoder.Decode(&value)
+	return value, err
+}
@@ -41,3 +41,61 @@ func TestBase64(t *testing.T) {
 
 	expect.Equal("test", string(result))
 }
+
+func TestBase64DecodeErrorStream(t *testing.T) {
+	expect := shared.NewExpect(t)
+
+	config := core.NewPluginConfig("")
+	config.Override("Base64ErrorStream", "error")
+	plugin, err := core.NewPluginWithType("format.Base64Decode", config)
+	expect.NoError(err)
+
+	decoder, casted := plugin.(*Base64Decode)
+	expect.True(casted)
+
+	msg := core.NewMessage(nil, []byte("dGVzdA=="), 0)
+	result, streamID := decoder.Format(msg)
+	expect.Equal("test", string(result))
+	expect.Equal(msg.StreamID, streamID)
+
+	msg = core.NewMessage(nil, []byte("not base64!"), 0)
+	result, streamID = decoder.Format(msg)
+	expect.Equal("not base64!", string(result))
+	expect.Equal(core.StreamRegistry.GetStreamID("error"), streamID)
+}
+
+func TestBase64EncodeAlphabet(t *testing.T) {
+	expect := shared.NewExpect(t)
+
+	config := core.NewPluginConfig("")
+	config.Override("Base64Alphabet", "url")
+	config.Override("Base64Padding", false)
+	plugin, err := core.NewPluginWithType("format.Base64Encode", config)
+	expect.NoError(err)
+
+	encoder, casted := plugin.(*Base64Encode)
+	expect.True(casted)
+
+	msg := core.NewMessage(nil, []byte{0xfb, 0xff}, 0)
+	result, _ := encoder.Format(msg)
+	expect.Equal("-_8", string(result))
+
+	plugin, err = core.NewPluginWithType("format.Base64Decode", config)
+	expect.NoError(err)
+	decoder, casted := plugin.(*Base64Decode)
+	expect.True(casted)
+
+	msg.Data = result
+	result, _ = decoder.Format(msg)
+	expect.Equal([]byte{0xfb, 0xff}, result)
+
+	config = core.NewPluginConfig("")
+	config.Override("Base64Dictionary", "abc")
+	_, err = core.NewPluginWithType("format.Base64Encode", config)
+	expect.NotNil(err)
+
+	config = core.NewPluginConfig("")
+	config.Override("Base64Alphabet", "foo")
+	_, err = core.NewPluginWithType("format.Base64Encode", config)
+	expect.NotNil(err)
+}
@@ -16,7 +16,6 @@ package format
 
 import (
 	"encoding/base64"
-	"fmt"
 	"github.com/trivago/gollum/core"
 	"github.com/trivago/gollum/core/log"
 	"github.com/trivago/gollum/shared"
@@ -25,22 +24,40 @@ import (
 // Base64Decode formatter plugin
 // Base64Decode is a formatter that decodes a base64 message.
 // If a message is not or only partly base64 encoded an error will be logged
-// and the decoded part is returned. RFC 4648 is expected.
+// and the message is passed on without being decoded. RFC 4648 is expected.
 // Configuration example
 //
 //  - "stream.Broadcast":
 //    Formatter: "format.Base64Decode"
 //    Base64Formatter: "format.Forward"
-//    Base64Dictionary: "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz01234567890+/"
+//    Base64Alphabet: "std"
+//    Base64Padding: true
+//    Base64Dictionary: ""
+//    Base64ErrorStream: ""
 //
-// Base64Dictionary defines the 64-character base64 lookup dictionary to use. When
-// left empty a dictionary as defined by RFC4648 is used. This is the default.
+// Base64Alphabet selects one of the alphabets defined by RFC 4648.
+// By default this is set to "std".
+//  * "std" uses the standard alphabet with "+" and "/".
+//  * "url" uses the URL and filename safe alphabet with "-" and "_".
+//
+// Base64Padding can be set to false to decode messages without trailing "="
+// padding characters. By default this is set to true.
+//
+// Base64Dictionary defines a custom 64-character base64 lookup dictionary to
+// use. If set, this option overrides Base64Alphabet. By default this is set
+// to "".
 //
 // Base64DataFormatter defines a formatter that is applied before the base64
 // decoding takes place. By default this is set to "format.Forward"
+//
+// Base64ErrorStream defines a stream that messages which cannot be decoded
+// are routed to. These messages are passed on unchanged and no error is
+// logged. By default this is set to "", i.e. errors are logged and the
+// message stays on its stream.
 type Base64Decode struct {
-	base       core.Formatter
-	dictionary *base64.Encoding
+	base          core.Formatter
+	dictionary    *base64.Encoding
+	errorStreamID core.MessageStreamID
 }
 
 func init() {
@@ -55,14 +72,13 @@ func (format *Base64Decode) Configure(conf core.PluginConfig) error {
 	}
 	format.base = plugin.(core.Formatter)
 
-	dict := conf.GetString("Base64Dictionary", "")
-	if dict == "" {
-		format.dictionary = base64.StdEncoding
-	} else {
-		if len(dict) != 64 {
-			return fmt.Errorf("Base64 dictionary must contain 64 characters.")
-		}
-		format.dictionary = base64.NewEncoding(dict)
+	if format.dictionary, err = newBase64Encoding(conf); err != nil {
+		return err
+	}
+
+	format.errorStreamID = core.InvalidStreamID
+	if errorStream := conf.GetString("Base64ErrorStream", ""); errorStream != "" {
+		format.errorStreamID = core.StreamRegistry.GetStreamID(errorStream)
 	}
 	return nil
 }
@@ -71,8 +87,11 @@ func (format *Base64Decode) Configure(conf core.PluginConfig) error {
 func (format *Base64Decode) Format(msg core.Message) ([]byte, core.MessageStreamID) {
 	data, streamID := format.base.Format(msg)
 	decoded := make([]byte, format.dictionary.DecodedLen(len(data)))
-	size, err := format.dictionary.Decode(decoded, msg.Data)
+	size, err := format.dictionary.Decode(decoded, data)
 	if err != nil {
+		if format.errorStreamID != core.InvalidStreamID {
+			return data, format.errorStreamID // ### return, route to error stream ###
+		}
 		Log.Error.Print("Base64Decode: ", err)
 		return data, streamID
 	}
@@ -19,19 +19,33 @@ import (
 	"fmt"
 	"github.com/trivago/gollum/core"
 	"github.com/trivago/gollum/shared"
+	"strings"
 )
 
 // Base64Encode formatter plugin
 // Base64Encode is a formatter that encodes a message as base64.
+// This is the counterpart of format.Base64Decode and can be used to embed
+// binary data into line based protocols.
 // Configuration example
 //
 //  - "stream.Broadcast":
 //    Formatter: "format.Base64Encode"
-//    Base64Formatter: "format.Forward"
-//    Base64Dictionary: "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz01234567890+/"
+//    Base64DataFormatter: "format.Forward"
+//    Base64Alphabet: "std"
+//    Base64Padding: true
+//    Base64Dictionary: ""
 //
-// Base64Dictionary defines the 64-character base64 lookup dictionary to use.
-// When left empty a dictionary as defined by RFC4648 is used. This is the default.
+// Base64Alphabet selects one of the alphabets defined by RFC 4648.
+// By default this is set to "std".
+//  * "std" uses the standard alphabet with "+" and "/".
+//  * "url" uses the URL and filename safe alphabet with "-" and "_".
+//
+// Base64Padding can be set to false to strip the trailing "=" padding
+// characters from the encoded message. By default this is set to true.
+//
+// Base64Dictionary defines a custom 64-character base64 lookup dictionary to
+// use. If set, this option overrides Base64Alphabet. By default this is set
+// to "".
 //
 // Base64DataFormatter defines a formatter that is applied before the base64
 // encoding takes place. By default this is set to "format.Forward"
@@ -52,16 +66,36 @@ func (format *Base64Encode) Configure(conf core.PluginConfig) error {
 	}
 	format.base = plugin.(core.Formatter)
 
-	dict := conf.GetString("Base64Formatter", "")
-	if dict == "" {
-		format.dictionary = base64.StdEncoding
-	} else {
+	format.dictionary, err = newBase64Encoding(conf)
+	return err
+}
+
+// newBase64Encoding creates the encoding defined by the Base64Alphabet,
+// Base64Dictionary and Base64Padding options.
+func newBase64Encoding(conf core.PluginConfig) (*base64.Encoding, error) {
+	var encoding *base64.Encoding
+
+	if dict := conf.GetString("Base64Dictionary", ""); dict != "" {
 		if len(dict) != 64 {
-			return fmt.Errorf("Base64 dictionary must contain 64 characters.")
+			return nil, fmt.Errorf("Base64 dictionary must contain 64 characters.")
+		}
+		encoding = base64.NewEncoding(dict)
+	} else {
+		alphabet := strings.ToLower(conf.GetString("Base64Alphabet", "std"))
+		switch alphabet {
+		case "std":
+			encoding = base64.StdEncoding
+		case "url":
+			encoding = base64.URLEncoding
+		default:
+			return nil, fmt.Errorf("Unknown base64 alphabet: %s", alphabet)
 		}
-		format.dictionary = base64.NewEncoding(dict)
 	}
-	return nil
+
+	if !conf.GetBool("Base64Padding", true) {
+		encoding = encoding.WithPadding(base64.NoPadding)
+	}
+	return encoding, nil
 }
 
 // Format returns the original message payload
@@ -0,0 +1,289 @@
+// Copyright 2015-2016 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package format
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/core/log"
+	"github.com/trivago/gollum/shared"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var (
+	cefHeaderEscape    = strings.NewReplacer("\\", "\\\\", "|", "\\|", "\r", " ", "\n", " ")
+	cefExtensionEscape = strings.NewReplacer("\\", "\\\\", "=", "\\=", "\r", "\\r", "\n", "\\n")
+	cefInvalidKeyChars = regexp.MustCompile("[^a-zA-Z0-9_]")
+)
+
+// CEF formatter plugin
+// CEF is a formatter that converts JSON messages to the ArcSight Common Event
+// Format (CEF) as accepted by most SIEM systems, e.g.
+// "CEF:0|trivago|gollum|1.0|100|user login|3|src=10.0.0.1 suser=alice".
+// Header values and extension values are escaped as required by the format.
+// Configuration example
+//
+//  - "stream.Broadcast":
+//    Formatter: "format.CEF"
+//    CEFDataFormatter: "format.Forward"
+//    CEFVendor: "trivago"
+//    CEFProduct: "gollum"
+//    CEFDeviceVersion: ""
+//    CEFSignatureIDField: "event_id"
+//    CEFSignatureID: "0"
+//    CEFNameField: "message"
+//    CEFName: "event"
+//    CEFSeverityField: "level"
+//    CEFSeverity: "5"
+//    CEFSeverityMap:
+//      "error": "8"
+//    CEFExtensions:
+//      "src": "client/ip"
+//      "suser": "user/name"
+//    CEFTimestampKey: "rt"
+//    CEFErrorStream: ""
+//
+// CEFDataFormatter defines a formatter that is applied before the message is
+// converted. By default this is set to "format.Forward".
+//
+// CEFVendor defines the device vendor of the CEF header.
+// By default this is set to "trivago".
+//
+// CEFProduct defines the device product of the CEF header.
+// By default this is set to "gollum".
+//
+// CEFDeviceVersion defines the device version of the CEF header.
+// By default this is set to "".
+//
+// CEFSignatureIDField defines the field holding the signature ID of an event.
+// By default this is set to "event_id".
+//
+// CEFSignatureID defines the signature ID used if CEFSignatureIDField does not
+// exist. By default this is set to "0".
+//
+// CEFNameField defines the field holding the human readable name of an event.
+// By default this is set to "message".
+//
+// CEFName defines the name used if CEFNameField does not exist.
+// By default this is set to "event".
+//
+// CEFSeverityField defines the field holding the severity of an event.
+// Numbers from 0 to 10 are used as is, other values are translated by
+// CEFSeverityMap. By default this is set to "level".
+//
+// CEFSeverity defines the severity used if CEFSeverityField does not exist or
+// its value cannot be mapped. By default this is set to "5".
+//
+// CEFSeverityMap maps field values (case insensitive) to CEF severities.
+// By default "debug", "info", "notice", "warning", "error", "critical", "alert"
+// and "emergency" are mapped to 1, 3, 4, 6, 8, 9, 10 and 10.
+//
+// CEFExtensions maps CEF extension keys to field paths. Nested fields can be
+// accessed by using "/" as a separator, array elements by using "[<index>]".
+// Fields that do not exist are omitted. If no extensions are set all top level
+// fields not used in the header are written as extensions, ordered by key.
+// Characters not allowed in extension keys are replaced by "_".
+// Non-string values are written as JSON. By default this map is empty.
+//
+// CEFTimestampKey defines the extension key the message timestamp is written to
+// in milliseconds since epoch. Set to "" to disable. By default this is set
+// to "rt".
+//
+// CEFErrorStream defines a stream that messages which are not a JSON object
+// are routed to. These messages are passed on unchanged.
+// By default this is set to "", i.e. a warning is logged and the message stays
+// on its stream.
+type CEF struct {
+	base           core.Formatter
+	header         string
+	signatureField string
+	signatureID    string
+	nameField      string
+	name           string
+	severityField  string
+	severity       string
+	severityMap    map[string]string
+	extensions     map[string]string
+	extensionKeys  []string
+	timestampKey   string
+	errorStreamID  core.MessageStreamID
+}
+
+func init() {
+	shared.TypeRegistry.Register(CEF{})
+}
+
+// Configure initializes this formatter with values from a plugin config.
+func (format *CEF) Configure(conf core.PluginConfig) error {
+	plugin, err := core.NewPluginWithType(conf.GetString("CEFDataFormatter", "format.Forward"), conf)
+	if err != nil {
+		return err
+	}
+	format.base = plugin.(core.Formatter)
+
+	format.header = "CEF:0|" + cefHeaderEscape.Replace(conf.GetString("CEFVendor", "trivago")) +
+		"|" + cefHeaderEscape.Replace(conf.GetString("CEFProduct", "gollum")) +
+		"|" + cefHeaderEscape.Replace(conf.GetString("CEFDeviceVersion", "")) + "|"
+
+	format.signatureField = conf.GetString("CEFSignatureIDField", "event_id")
+	format.signatureID = conf.GetString("CEFSignatureID", "0")
+	format.nameField = conf.GetString("CEFNameField", "message")
+	format.name = conf.GetString("CEFName", "event")
+	format.severityField = conf.GetString("CEFSeverityField", "level")
+	format.timestampKey = conf.GetString("CEFTimestampKey", "rt")
+
+	if format.severity = conf.GetString("CEFSeverity", "5"); !isCEFSeverity(format.severity) {
+		return fmt.Errorf("CEFSeverity must be a number from 0 to 10")
+	}
+
+	format.severityMap = make(map[string]string)
+	severityMap := conf.GetStringMap("CEFSeverityMap", map[string]string{
+		"debug":     "1",
+		"info":      "3",
+		"notice":    "4",
+		"warning":   "6",
+		"error":     "8",
+		"critical":  "9",
+		"alert":     "10",
+		"emergency": "10",
+	})
+	for value, severity := range severityMap {
+		if !isCEFSeverity(severity) {
+			return fmt.Errorf("CEFSeverityMap value for %s must be a number from 0 to 10", value)
+		}
+		format.severityMap[strings.ToLower(value)] = severity
+	}
+
+	format.extensions = conf.GetStringMap("CEFExtensions", map[string]string{})
+	format.extensionKeys = make([]string, 0, len(format.extensions))
+	for key := range format.extensions {
+		if cefInvalidKeyChars.MatchString(key) {
+			return fmt.Errorf("CEFExtensions key %s contains invalid characters", key)
+		}
+		format.extensionKeys = append(format.extensionKeys, key)
+	}
+	sort.Strings(format.extensionKeys)
+
+	format.errorStreamID = core.InvalidStreamID
+	if errorStream := conf.GetString("CEFErrorStream", ""); errorStream != "" {
+		format.errorStreamID = core.StreamRegistry.GetStreamID(errorStream)
+	}
+
+	return nil
+}
+
+func isCEFSeverity(value string) bool {
+	severity, err := strconv.Atoi(value)
+	return err == nil && severity >= 0 && severity <= 10
+}
+
+// headerField returns the escaped string value of the given field or the
+// given default if the field does not exist.
+func (format *CEF) headerField(values shared.MarshalMap, path string, defaultValue string) string {
+	if value, exists := values.Path(path); exists && value != nil {
+		if str, err := jsonValueString(value); err == nil {
+			return cefHeaderEscape.Replace(str)
+		}
+	}
+	return cefHeaderEscape.Replace(defaultValue)
+}
+
+// eventSeverity returns the CEF severity of the given event.
+func (format *CEF) eventSeverity(values shared.MarshalMap) string {
+	value, exists := values.Path(format.severityField)
+	if !exists || value == nil {
+		return format.severity // ### return, no severity given ###
+	}
+
+	str, _ := jsonValueString(value)
+	if isCEFSeverity(str) {
+		return str
+	}
+	if severity, exists := format.severityMap[strings.ToLower(str)]; exists {
+		return severity
+	}
+	return format.severity
+}
+
+func (format *CEF) appendExtension(buffer *bytes.Buffer, key string, value interface{}) {
+	str, err := jsonValueString(value)
+	if err != nil {
+		return // ### return, unsupported value ###
+	}
+	if buffer.Len() > 0 {
+		buffer.WriteByte(' ')
+	}
+	buffer.WriteString(key)
+	buffer.WriteByte('=')
+	buffer.WriteString(cefExtensionEscape.Replace(str))
+}
+
+// Format returns the message as CEF record
+func (format *CEF) Format(msg core.Message) ([]byte, core.MessageStreamID) {
+	data, streamID := format.base.Format(msg)
+
+	values := shared.NewMarshalMap()
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(&values); err != nil {
+		if format.errorStreamID != core.InvalidStreamID {
+			return data, format.errorStreamID // ### return, route to error stream ###
+		}
+		Log.Warning.Print("CEF failed to unmarshal a message: ", err)
+		return data, streamID // ### return, malformed data ###
+	}
+
+	extensions := bytes.NewBuffer(nil)
+	if format.timestampKey != "" {
+		format.appendExtension(extensions, format.timestampKey, msg.Timestamp.UnixNano()/1000000)
+	}
+
+	if len(format.extensionKeys) > 0 {
+		for _, key := range format.extensionKeys {
+			if value, exists := values.Path(format.extensions[key]); exists && value != nil {
+				format.appendExtension(extensions, key, value)
+			}
+		}
+	} else {
+		keys := make([]string, 0, len(values))
+		for key := range values {
+			if key != format.signatureField && key != format.nameField && key != format.severityField && key != format.timestampKey {
+				keys = append(keys, key)
+			}
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			if values[key] != nil {
+				format.appendExtension(extensions, cefInvalidKeyChars.ReplaceAllString(key, "_"), values[key])
+			}
+		}
+	}
+
+	record := bytes.NewBufferString(format.header)
+	record.WriteString(format.headerField(values, format.signatureField, format.signatureID))
+	record.WriteByte('|')
+	record.WriteString(format.headerField(values, format.nameField, format.name))
+	record.WriteByte('|')
+	record.WriteString(format.eventSeverity(values))
+	record.WriteByte('|')
+	record.Write(extensions.Bytes())
+
+	return record.Bytes(), streamID
+}
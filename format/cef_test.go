@@ -0,0 +1,81 @@
+// Copyright 2015-2016 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package format
+
+import (
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/shared"
+	"testing"
+	"time"
+)
+
+func TestCEF(t *testing.T) {
+	expect := shared.NewExpect(t)
+
+	config := core.NewPluginConfig("")
+	config.Override("CEFVendor", "tri|vago")
+	config.Override("CEFDeviceVersion", "1.0")
+	config.Override("CEFTimestampKey", "")
+	plugin, err := core.NewPluginWithType("format.CEF", config)
+	expect.NoError(err)
+	formatter, casted := plugin.(*CEF)
+	expect.True(casted)
+
+	msg := core.NewMessage(nil, []byte(`{"event_id":100,"message":"user login","level":"Error","src":"10.0.0.1","user name":"a=b\\c","n":null,"tags":["x"]}`), 0)
+	result, streamID := formatter.Format(msg)
+	expect.Equal(`CEF:0|tri\|vago|gollum|1.0|100|user login|8|src=10.0.0.1 tags=["x"] user_name=a\=b\\c`, string(result))
+	expect.Equal(msg.StreamID, streamID)
+
+	msg = core.NewMessage(nil, []byte(`{"level":2}`), 0)
+	result, _ = formatter.Format(msg)
+	expect.Equal(`CEF:0|tri\|vago|gollum|1.0|0|event|2|`, string(result))
+
+	msg = core.NewMessage(nil, []byte(`no json`), 0)
+	result, streamID = formatter.Format(msg)
+	expect.Equal(`no json`, string(result))
+	expect.Equal(msg.StreamID, streamID)
+}
+
+func TestCEFExtensions(t *testing.T) {
+	expect := shared.NewExpect(t)
+
+	config := core.NewPluginConfig("")
+	config.Override("CEFExtensions", map[interface{}]interface{}{
+		"src":   "client/ip",
+		"suser": "user[0]name",
+		"msg":   "missing",
+	})
+	config.Override("CEFSeverity", "1")
+	config.Override("CEFSeverityMap", map[interface{}]interface{}{})
+	config.Override("CEFErrorStream", "error")
+	plugin, err := core.NewPluginWithType("format.CEF", config)
+	expect.NoError(err)
+	formatter, casted := plugin.(*CEF)
+	expect.True(casted)
+
+	msg := core.NewMessage(nil, []byte(`{"client":{"ip":"10.0.0.1"},"user":[{"name":"line1\nline2"}],"level":"error"}`), 0)
+	msg.Timestamp = time.Unix(1476441600, 0)
+	result, _ := formatter.Format(msg)
+	expect.Equal(`CEF:0|trivago|gollum||0|event|1|rt=1476441600000 src=10.0.0.1 suser=line1\nline2`, string(result))
+
+	msg = core.NewMessage(nil, []byte(`no json`), 0)
+	_, streamID := formatter.Format(msg)
+	expect.Equal(core.StreamRegistry.GetStreamID("error"), streamID)
+
+	config = core.NewPluginConfig("")
+	config.Override("CEFSeverity", "11")
+	_, err = core.NewPluginWithType("format.CEF", config)
+	expect.NotNil(err)
+}
@@ -0,0 +1,158 @@
+// Copyright 2015-2016 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package format
+
+import (
+	"fmt"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/shared"
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/encoding/japanese"
+	"strings"
+	"unicode/utf8"
+)
+
+// Charset formatter plugin
+// Charset is a formatter that converts messages from a given character set to
+// UTF-8, e.g. to pass logs of legacy applications on to JSON based formatters.
+// Configuration example
+//
+//  - "stream.Broadcast":
+//    Formatter: "format.Charset"
+//    CharsetDataFormatter: "format.Forward"
+//    CharsetFrom: "utf-8"
+//    CharsetInvalid: "replace"
+//    CharsetErrorStream: ""
+//
+// CharsetDataFormatter defines a formatter that is applied before the message
+// is converted. By default this is set to "format.Forward".
+//
+// CharsetFrom defines the character set of incoming messages. Messages that are
+// already UTF-8 are checked for invalid byte sequences. By default this is set
+// to "utf-8".
+//  * "utf-8"
+//  * "iso-8859-1" or "latin-1"
+//  * "iso-8859-15" or "latin-9"
+//  * "windows-1252" or "cp1252"
+//  * "shift-jis" or "sjis"
+//
+// CharsetInvalid defines how bytes that are not valid in the given character
+// set are handled. By default this is set to "replace".
+//  * "replace" writes the unicode replacement character U+FFFD.
+//  * "drop" removes the byte.
+//  * "route" passes the message unchanged to CharsetErrorStream.
+//
+// CharsetErrorStream defines the stream messages with invalid bytes are routed
+// to by the "route" policy. This setting is required for this policy.
+// By default this is set to "".
+type Charset struct {
+	base          core.Formatter
+	charset       encoding.Encoding
+	policy        string
+	errorStreamID core.MessageStreamID
+}
+
+func init() {
+	shared.TypeRegistry.Register(Charset{})
+}
+
+// Configure initializes this formatter with values from a plugin config.
+func (format *Charset) Configure(conf core.PluginConfig) error {
+	plugin, err := core.NewPluginWithType(conf.GetString("CharsetDataFormatter", "format.Forward"), conf)
+	if err != nil {
+		return err
+	}
+	format.base = plugin.(core.Formatter)
+
+	charset := strings.ToLower(conf.GetString("CharsetFrom", "utf-8"))
+	switch charset {
+	case "utf-8", "utf8":
+		format.charset = nil
+	case "iso-8859-1", "latin-1", "latin1":
+		format.charset = charmap.ISO8859_1
+	case "iso-8859-15", "latin-9", "latin9":
+		format.charset = charmap.ISO8859_15
+	case "windows-1252", "cp1252":
+		format.charset = charmap.Windows1252
+	case "shift-jis", "shift_jis", "sjis":
+		format.charset = japanese.ShiftJIS
+	default:
+		return fmt.Errorf("Unsupported CharsetFrom: %s", charset)
+	}
+
+	format.policy = strings.ToLower(conf.GetString("CharsetInvalid", "replace"))
+	switch format.policy {
+	case "replace", "drop":
+	case "route":
+		errorStream := conf.GetString("CharsetErrorStream", "")
+		if errorStream == "" {
+			return fmt.Errorf("CharsetInvalid route requires CharsetErrorStream to be set")
+		}
+		format.errorStreamID = core.StreamRegistry.GetStreamID(errorStream)
+	default:
+		return fmt.Errorf("Unknown CharsetInvalid: %s", format.policy)
+	}
+
+	return nil
+}
+
+// convert returns data as UTF-8. False is returned if invalid bytes were found
+// and the policy is set to "route".
+func (format *Charset) convert(data []byte) ([]byte, bool) {
+	decoded := data
+	if format.charset != nil {
+		// The decoders write U+FFFD for every invalid byte sequence. None of the
+		// supported character sets can encode U+FFFD, so it always marks an
+		// invalid byte sequence in the decoded data.
+		var err error
+		if decoded, err = format.charset.NewDecoder().Bytes(data); err != nil {
+			return data, format.policy != "route" // ### return, not decodable ###
+		}
+	}
+
+	result := make([]byte, 0, len(decoded))
+	for i := 0; i < len(decoded); {
+		char, size := utf8.DecodeRune(decoded[i:])
+		chunk := decoded[i : i+size]
+		i += size
+
+		if char == utf8.RuneError && (size <= 1 || format.charset != nil) {
+			switch format.policy {
+			case "route":
+				return data, false // ### return, invalid byte ###
+			case "drop":
+				continue // ### continue, skip byte ###
+			default:
+				chunk = []byte(string(utf8.RuneError))
+			}
+		}
+
+		result = append(result, chunk...)
+	}
+
+	return result, true
+}
+
+// Format returns the message converted to UTF-8
+func (format *Charset) Format(msg core.Message) ([]byte, core.MessageStreamID) {
+	data, streamID := format.base.Format(msg)
+
+	result, valid := format.convert(data)
+	if !valid {
+		return data, format.errorStreamID // ### return, route to error stream ###
+	}
+	return result, streamID
+}
@@ -0,0 +1,75 @@
+// Copyright 2015-2016 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package format
+
+import (
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/shared"
+	"testing"
+)
+
+func TestCharset(t *testing.T) {
+	expect := shared.NewExpect(t)
+	errorStreamID := core.StreamRegistry.GetStreamID("error")
+
+	testCases := []struct {
+		charset  string
+		policy   string
+		payload  string
+		result   string
+		rerouted bool
+	}{
+		{"latin-1", "replace", "gr\xfc\xdfe \xa4", "grüße ¤", false},
+		{"iso-8859-15", "replace", "gr\xfc\xdfe \xa4", "grüße €", false},
+		{"windows-1252", "replace", "\x93quoted\x94 \x80\x81", "“quoted” €�", false},
+		{"cp1252", "drop", "\x93quoted\x94 \x80\x81", "“quoted” €", false},
+		{"cp1252", "route", "\x93quoted\x94 \x80\x81", "\x93quoted\x94 \x80\x81", true},
+		{"shift-jis", "replace", "\x93\xfa\x96\x7b\x8c\xea \xb1", "日本語 ｱ", false},
+		{"sjis", "drop", "ok \x81\x20 \xa0", "ok   ", false},
+		{"sjis", "route", "ok \xa0", "ok \xa0", true},
+		{"utf-8", "replace", "ok � \xff\xe2\x82", "ok � ���", false},
+		{"utf-8", "drop", "ok � \xff\xe2\x82", "ok � ", false},
+	}
+
+	for _, testCase := range testCases {
+		config := core.NewPluginConfig("")
+		config.Override("CharsetFrom", testCase.charset)
+		config.Override("CharsetInvalid", testCase.policy)
+		config.Override("CharsetErrorStream", "error")
+		plugin, err := core.NewPluginWithType("format.Charset", config)
+		expect.NoError(err)
+		formatter, casted := plugin.(*Charset)
+		expect.True(casted)
+
+		msg := core.NewMessage(nil, []byte(testCase.payload), 0)
+		result, streamID := formatter.Format(msg)
+		expect.Equal(testCase.result, string(result))
+		expect.Equal(testCase.rerouted, streamID == errorStreamID)
+	}
+}
+
+func TestCharsetConfig(t *testing.T) {
+	expect := shared.NewExpect(t)
+
+	config := core.NewPluginConfig("")
+	config.Override("CharsetFrom", "ebcdic")
+	_, err := core.NewPluginWithType("format.Charset", config)
+	expect.NotNil(err)
+
+	config = core.NewPluginConfig("")
+	config.Override("CharsetInvalid", "route")
+	_, err = core.NewPluginWithType("format.Charset", config)
+	expect.NotNil(err)
+}
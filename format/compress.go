@@ -0,0 +1,153 @@
+// Copyright 2015-2016 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package format
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4/v4"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/core/log"
+	"github.com/trivago/gollum/shared"
+	"strings"
+)
+
+// Compress formatter plugin
+// Compress is a formatter that compresses messages with a selectable
+// algorithm. Each message is compressed on its own, so that it can be
+// decompressed without any context by format.Decompress.
+// Configuration example
+//
+//  - "stream.Broadcast":
+//    Formatter: "format.Compress"
+//    CompressDataFormatter: "format.Forward"
+//    CompressAlgorithm: "gzip"
+//    CompressLevel: -1
+//
+// CompressDataFormatter defines a formatter that is applied before the message
+// is compressed. By default this is set to "format.Forward".
+//
+// CompressAlgorithm defines the compression algorithm to use.
+// By default this is set to "gzip".
+//  * "gzip" writes a gzip stream as defined by RFC 1952.
+//  * "zlib" writes a zlib stream as defined by RFC 1950.
+//  * "deflate" writes a raw deflate stream as defined by RFC 1951.
+//  * "snappy" writes a snappy block without framing.
+//  * "lz4" writes an LZ4 frame.
+//  * "zstd" writes a Zstandard frame.
+//
+// CompressLevel defines the compression level used by gzip, zlib, deflate and
+// zstd. Valid values range from 1 (best speed) to 9 (best compression), 0
+// disables compression and -1 selects the default level of the algorithm.
+// Zstandard uses the closest of its four speed settings, 0 selects the fastest
+// one. By default this is set to -1.
+type Compress struct {
+	base      core.Formatter
+	algorithm string
+	level     int
+	zstd      *zstd.Encoder
+}
+
+func init() {
+	shared.TypeRegistry.Register(Compress{})
+}
+
+// Configure initializes this formatter with values from a plugin config.
+func (format *Compress) Configure(conf core.PluginConfig) error {
+	plugin, err := core.NewPluginWithType(conf.GetString("CompressDataFormatter", "format.Forward"), conf)
+	if err != nil {
+		return err
+	}
+	format.base = plugin.(core.Formatter)
+
+	format.algorithm = strings.ToLower(conf.GetString("CompressAlgorithm", "gzip"))
+	switch format.algorithm {
+	case "gzip", "zlib", "deflate", "snappy", "lz4", "zstd":
+	default:
+		return fmt.Errorf("Unknown CompressAlgorithm: %s", format.algorithm)
+	}
+
+	format.level = conf.GetInt("CompressLevel", flate.DefaultCompression)
+	if format.level < flate.DefaultCompression || format.level > flate.BestCompression {
+		return fmt.Errorf("CompressLevel must be between -1 and 9")
+	}
+
+	if format.algorithm == "zstd" {
+		level := zstd.SpeedDefault
+		if format.level != flate.DefaultCompression {
+			level = zstd.EncoderLevelFromZstd(format.level)
+		}
+		if format.zstd, err = zstd.NewWriter(nil, zstd.WithEncoderLevel(level)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// compress compresses data with the configured algorithm and level.
+func (format *Compress) compress(data []byte) ([]byte, error) {
+	switch format.algorithm {
+	case "snappy":
+		return snappy.Encode(nil, data), nil
+	case "zstd":
+		return format.zstd.EncodeAll(data, make([]byte, 0, len(data)/2)), nil
+	}
+
+	buffer := bytes.NewBuffer(make([]byte, 0, len(data)/2))
+	var writer interface {
+		Write([]byte) (int, error)
+		Close() error
+	}
+	var err error
+
+	switch format.algorithm {
+	case "gzip":
+		writer, err = gzip.NewWriterLevel(buffer, format.level)
+	case "zlib":
+		writer, err = zlib.NewWriterLevel(buffer, format.level)
+	case "lz4":
+		writer = lz4.NewWriter(buffer)
+	default:
+		writer, err = flate.NewWriter(buffer, format.level)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := writer.Write(data); err != nil {
+		return nil, err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+// Format returns the compressed message payload
+func (format *Compress) Format(msg core.Message) ([]byte, core.MessageStreamID) {
+	data, streamID := format.base.Format(msg)
+	compressed, err := format.compress(data)
+	if err != nil {
+		Log.Warning.Print("Compress failed to compress a message: ", err)
+		return data, streamID // ### return, send uncompressed ###
+	}
+	return compressed, streamID
+}
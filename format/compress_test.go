@@ -0,0 +1,200 @@
+// Copyright 2015-2016 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package format
+
+import (
+	"bytes"
+	"compress/gzip"
+	"github.com/golang/snappy"
+	"github.com/pierrec/lz4/v4"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/shared"
+	"testing"
+)
+
+func TestCompress(t *testing.T) {
+	expect := shared.NewExpect(t)
+	payload := bytes.Repeat([]byte(`{"message":"gollum"}`), 100)
+
+	for _, algorithm := range []string{"gzip", "zlib", "deflate", "snappy", "lz4", "zstd"} {
+		config := core.NewPluginConfig("")
+		config.Override("CompressAlgorithm", algorithm)
+		config.Override("CompressLevel", 9)
+		config.Override("DecompressAlgorithm", algorithm)
+		pluginCompress, err := core.NewPluginWithType("format.Compress", config)
+		expect.NoError(err)
+		pluginDecompress, err := core.NewPluginWithType("format.Decompress", config)
+		expect.NoError(err)
+
+		compress, castedCompress := pluginCompress.(*Compress)
+		expect.True(castedCompress)
+		decompress, castedDecompress := pluginDecompress.(*Decompress)
+		expect.True(castedDecompress)
+
+		msg := core.NewMessage(nil, payload, 0)
+		compressed, _ := compress.Format(msg)
+		expect.Less(len(compressed), len(payload))
+
+		msg.Data = compressed
+		result, streamID := decompress.Format(msg)
+		expect.Equal(string(payload), string(result))
+		expect.Equal(msg.StreamID, streamID)
+	}
+}
+
+func TestDecompressAuto(t *testing.T) {
+	expect := shared.NewExpect(t)
+	payload := []byte("gollum gollum gollum gollum")
+
+	config := core.NewPluginConfig("")
+	config.Override("DecompressAlgorithm", "auto")
+	plugin, err := core.NewPluginWithType("format.Decompress", config)
+	expect.NoError(err)
+	decompress, casted := plugin.(*Decompress)
+	expect.True(casted)
+
+	for _, algorithm := range []string{"gzip", "zlib", "lz4", "zstd"} {
+		config := core.NewPluginConfig("")
+		config.Override("CompressAlgorithm", algorithm)
+		plugin, err := core.NewPluginWithType("format.Compress", config)
+		expect.NoError(err)
+		compress, casted := plugin.(*Compress)
+		expect.True(casted)
+
+		msg := core.NewMessage(nil, payload, 0)
+		msg.Data, _ = compress.Format(msg)
+		result, _ := decompress.Format(msg)
+		expect.Equal(string(payload), string(result))
+	}
+
+	msg := core.NewMessage(nil, payload, 0)
+	result, streamID := decompress.Format(msg)
+	expect.Equal(string(payload), string(result))
+	expect.Equal(msg.StreamID, streamID)
+}
+
+func TestDecompressErrorStream(t *testing.T) {
+	expect := shared.NewExpect(t)
+
+	config := core.NewPluginConfig("")
+	config.Override("DecompressErrorStream", "error")
+	plugin, err := core.NewPluginWithType("format.Decompress", config)
+	expect.NoError(err)
+	decompress, casted := plugin.(*Decompress)
+	expect.True(casted)
+
+	msg := core.NewMessage(nil, []byte("not compressed"), 0)
+	result, streamID := decompress.Format(msg)
+	expect.Equal("not compressed", string(result))
+	expect.Equal(core.StreamRegistry.GetStreamID("error"), streamID)
+}
+
+func TestDecompressMaxSize(t *testing.T) {
+	expect := shared.NewExpect(t)
+	payload := bytes.Repeat([]byte("a"), 4096)
+
+	for _, algorithm := range []string{"gzip", "zlib", "deflate", "snappy", "lz4", "zstd"} {
+		config := core.NewPluginConfig("")
+		config.Override("CompressAlgorithm", algorithm)
+		config.Override("DecompressAlgorithm", algorithm)
+		config.Override("DecompressErrorStream", "error")
+		plugin, err := core.NewPluginWithType("format.Compress", config)
+		expect.NoError(err)
+		compress, casted := plugin.(*Compress)
+		expect.True(casted)
+
+		msg := core.NewMessage(nil, payload, 0)
+		msg.Data, _ = compress.Format(msg)
+
+		for maxSize, expectedStream := range map[int]string{4095: "error", 4096: core.WildcardStream} {
+			config.Override("DecompressMaxSizeByte", maxSize)
+			plugin, err := core.NewPluginWithType("format.Decompress", config)
+			expect.NoError(err)
+			decompress, casted := plugin.(*Decompress)
+			expect.True(casted)
+
+			result, streamID := decompress.Format(msg)
+			expect.Equal(core.StreamRegistry.GetStreamID(expectedStream), streamID)
+			if expectedStream != "error" {
+				expect.Equal(string(payload), string(result))
+			}
+		}
+	}
+
+	// Reading stops at the limit, i.e. large streams are not decompressed
+	compressed := bytes.NewBuffer(nil)
+	writer := gzip.NewWriter(compressed)
+	writer.Write(make([]byte, 8<<20))
+	writer.Close()
+
+	config := core.NewPluginConfig("")
+	config.Override("DecompressMaxSizeByte", 1024)
+	plugin, err := core.NewPluginWithType("format.Decompress", config)
+	expect.NoError(err)
+	decompress, casted := plugin.(*Decompress)
+	expect.True(casted)
+
+	_, err = decompress.decompress("gzip", compressed.Bytes())
+	expect.NotNil(err)
+	_, err = decompress.decompress("snappy", snappy.Encode(nil, make([]byte, 2048)))
+	expect.NotNil(err)
+}
+
+func TestDecompressLZ4Checksums(t *testing.T) {
+	expect := shared.NewExpect(t)
+	payload := bytes.Repeat([]byte("gollum "), 100)
+
+	compressed := bytes.NewBuffer(nil)
+	writer := lz4.NewWriter(compressed)
+	expect.NoError(writer.Apply(lz4.BlockChecksumOption(true), lz4.ChecksumOption(false)))
+	writer.Write(payload)
+	writer.Close()
+	data := compressed.Bytes()
+
+	config := core.NewPluginConfig("")
+	config.Override("DecompressAlgorithm", "lz4")
+	plugin, err := core.NewPluginWithType("format.Decompress", config)
+	expect.NoError(err)
+	decompress, casted := plugin.(*Decompress)
+	expect.True(casted)
+
+	result, err := decompress.decompress("lz4", data)
+	expect.NoError(err)
+	expect.Equal(string(payload), string(result))
+
+	// The block checksum is followed by the 4 byte end mark
+	data[len(data)-5] ^= 0xFF
+	_, err = decompress.decompress("lz4", data)
+	expect.NotNil(err)
+}
+
+func TestCompressInvalidConfig(t *testing.T) {
+	expect := shared.NewExpect(t)
+
+	config := core.NewPluginConfig("")
+	config.Override("CompressAlgorithm", "brotli")
+	_, err := core.NewPluginWithType("format.Compress", config)
+	expect.NotNil(err)
+
+	config = core.NewPluginConfig("")
+	config.Override("CompressLevel", 10)
+	_, err = core.NewPluginWithType("format.Compress", config)
+	expect.NotNil(err)
+
+	config = core.NewPluginConfig("")
+	config.Override("DecompressAlgorithm", "brotli")
+	_, err = core.NewPluginWithType("format.Decompress", config)
+	expect.NotNil(err)
+}
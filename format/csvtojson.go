@@ -0,0 +1,196 @@
+// Copyright 2015-2016 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package format
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/core/log"
+	"github.com/trivago/gollum/shared"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// CSVToJSON formatter plugin
+// CSVToJSON is a formatter that converts a CSV or TSV record to a JSON object.
+// Each message is expected to contain exactly one record. Column names are
+// either given by configuration or read from the first record of each stream.
+// Configuration example
+//
+//  - "stream.Broadcast":
+//    Formatter: "format.CSVToJSON"
+//    CSVToJSONDataFormatter: "format.Forward"
+//    CSVToJSONDelimiter: ","
+//    CSVToJSONQuoteChar: "\""
+//    CSVToJSONEscapeChar: ""
+//    CSVToJSONColumns:
+//      - "id"
+//      - "name"
+//    CSVToJSONHeader: false
+//    CSVToJSONTypes:
+//      - "int"
+//      - "string"
+//    CSVToJSONInferTypes: false
+//
+// CSVToJSONDataFormatter defines a formatter that is applied before the record
+// is converted. By default this is set to "format.Forward".
+//
+// CSVToJSONDelimiter defines the string separating the values of a record.
+// Set this to "\t" to read TSV data. By default this is set to ",".
+//
+// CSVToJSONQuoteChar defines the character used to quote values containing
+// the delimiter. Two consecutive quote characters inside a quoted value are
+// read as one literal quote character. Set to "" to disable quoting.
+// By default this is set to "\"".
+//
+// CSVToJSONEscapeChar defines a character used to escape the following
+// character. By default this is set to "" which disables escaping.
+//
+// CSVToJSONColumns defines the column names used as keys of the generated
+// object. Values without a column name use their index as key. Columns
+// without a value are omitted. By default this list is empty.
+//
+// CSVToJSONHeader can be set to true to read the column names from the first
+// record of each stream. This record is routed to the "_DROPPED_" stream.
+// CSVToJSONColumns is ignored if this option is enabled.
+// By default this is set to false.
+//
+// CSVToJSONTypes defines an array of value types applied to the values by
+// index. The same types as for SplitToJSONTypes are supported, i.e. "string",
+// "int", "float", "bool" and "auto". By default this list is empty.
+//
+// CSVToJSONInferTypes can be set to true to use "auto" for all values without
+// a type set in CSVToJSONTypes, i.e. numbers and booleans are written as such.
+// By default this is set to false, which writes these values as strings.
+type CSVToJSON struct {
+	base        core.Formatter
+	splitter    SplitToJSON // used for tokenizing only
+	columns     []string
+	types       []string
+	defaultType string
+	readHeader  bool
+	headers     map[core.MessageStreamID][]string
+	headerGuard *sync.Mutex
+}
+
+func init() {
+	shared.TypeRegistry.Register(CSVToJSON{})
+}
+
+// Configure initializes this formatter with values from a plugin config.
+func (format *CSVToJSON) Configure(conf core.PluginConfig) error {
+	plugin, err := core.NewPluginWithType(conf.GetString("CSVToJSONDataFormatter", "format.Forward"), conf)
+	if err != nil {
+		return err
+	}
+	format.base = plugin.(core.Formatter)
+
+	delimiter := shared.Unescape(conf.GetString("CSVToJSONDelimiter", ","))
+	quote := shared.Unescape(conf.GetString("CSVToJSONQuoteChar", "\""))
+	escape := shared.Unescape(conf.GetString("CSVToJSONEscapeChar", ""))
+	switch {
+	case len(delimiter) == 0:
+		return fmt.Errorf("CSVToJSONDelimiter must not be empty")
+	case len(quote) > 1 || len(escape) > 1:
+		return fmt.Errorf("CSVToJSONQuoteChar and CSVToJSONEscapeChar must be a single character")
+	}
+
+	format.splitter.token = []byte(delimiter)
+	if len(quote) == 1 {
+		format.splitter.quote = quote[0]
+	}
+	if len(escape) == 1 {
+		format.splitter.escape = escape[0]
+	}
+
+	format.columns = conf.GetStringArray("CSVToJSONColumns", []string{})
+	format.readHeader = conf.GetBool("CSVToJSONHeader", false)
+	format.headers = make(map[core.MessageStreamID][]string)
+	format.headerGuard = new(sync.Mutex)
+
+	format.defaultType = "string"
+	if conf.GetBool("CSVToJSONInferTypes", false) {
+		format.defaultType = "auto"
+	}
+
+	format.types = conf.GetStringArray("CSVToJSONTypes", []string{})
+	for i, valueType := range format.types {
+		format.types[i] = strings.ToLower(valueType)
+		switch format.types[i] {
+		case "string", "int", "float", "bool", "auto":
+		default:
+			return fmt.Errorf("Unknown CSVToJSONTypes value: %s", valueType)
+		}
+	}
+
+	return nil
+}
+
+// columnsFor returns the column names to use for the given stream. If headers
+// are read from the data and the stream has no header yet, the given values
+// are stored as header and nil is returned.
+func (format *CSVToJSON) columnsFor(streamID core.MessageStreamID, values [][]byte) []string {
+	if !format.readHeader {
+		return format.columns // ### return, static columns ###
+	}
+
+	format.headerGuard.Lock()
+	defer format.headerGuard.Unlock()
+
+	if header, exists := format.headers[streamID]; exists {
+		return header // ### return, known header ###
+	}
+
+	header := make([]string, len(values))
+	for i, value := range values {
+		header[i] = strings.TrimSpace(string(value))
+	}
+	format.headers[streamID] = header
+	return nil
+}
+
+// Format returns the CSV record as JSON object
+func (format *CSVToJSON) Format(msg core.Message) ([]byte, core.MessageStreamID) {
+	data, streamID := format.base.Format(msg)
+
+	values := format.splitter.split(bytes.TrimRight(data, "\r\n"))
+	columns := format.columnsFor(msg.StreamID, values)
+	if format.readHeader && columns == nil {
+		return data, core.DroppedStreamID // ### return, header record ###
+	}
+
+	root := &splitToJSONNode{children: []*splitToJSONNode{}}
+	for i, value := range values {
+		key := strconv.Itoa(i)
+		if i < len(columns) {
+			key = columns[i]
+		}
+
+		valueType := format.defaultType
+		if i < len(format.types) {
+			valueType = format.types[i]
+		}
+		root.set([]string{key}, typedJSONValue(valueType, value))
+	}
+
+	jsonData, err := root.MarshalJSON()
+	if err != nil {
+		Log.Error.Print("CSVToJSON: ", err)
+		return data, streamID
+	}
+	return jsonData, streamID
+}
@@ -0,0 +1,80 @@
+// Copyright 2015-2016 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package format
+
+import (
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/shared"
+	"testing"
+)
+
+func TestCSVToJSONColumns(t *testing.T) {
+	expect := shared.NewExpect(t)
+
+	config := core.NewPluginConfig("")
+	config.Override("CSVToJSONColumns", []interface{}{"id", "name", "score"})
+	config.Override("CSVToJSONTypes", []interface{}{"int"})
+	config.Override("CSVToJSONInferTypes", true)
+
+	plugin, err := core.NewPluginWithType("format.CSVToJSON", config)
+	expect.NoError(err)
+	formatter, casted := plugin.(*CSVToJSON)
+	expect.True(casted)
+
+	msg := core.NewMessage(nil, []byte("1,\"Doe, \"\"John\"\"\",2.5,true\r\n"), 0)
+	result, _ := formatter.Format(msg)
+	expect.Equal(`{"id":1,"name":"Doe, \"John\"","score":2.5,"3":true}`, string(result))
+
+	msg = core.NewMessage(nil, []byte("x,bob"), 0)
+	result, _ = formatter.Format(msg)
+	expect.Equal(`{"id":null,"name":"bob"}`, string(result))
+}
+
+func TestCSVToJSONHeader(t *testing.T) {
+	expect := shared.NewExpect(t)
+
+	config := core.NewPluginConfig("")
+	config.Override("CSVToJSONDelimiter", "\\t")
+	config.Override("CSVToJSONHeader", true)
+
+	plugin, err := core.NewPluginWithType("format.CSVToJSON", config)
+	expect.NoError(err)
+	formatter, casted := plugin.(*CSVToJSON)
+	expect.True(casted)
+
+	streamA := core.StreamRegistry.GetStreamID("csvA")
+	streamB := core.StreamRegistry.GetStreamID("csvB")
+
+	msg := core.NewMessage(nil, []byte("host\tstatus"), 0)
+	msg.StreamID = streamA
+	_, streamID := formatter.Format(msg)
+	expect.Equal(core.DroppedStreamID, streamID)
+
+	msg = core.NewMessage(nil, []byte("name\tid"), 0)
+	msg.StreamID = streamB
+	_, streamID = formatter.Format(msg)
+	expect.Equal(core.DroppedStreamID, streamID)
+
+	msg = core.NewMessage(nil, []byte("web01\t200"), 0)
+	msg.StreamID = streamA
+	result, streamID := formatter.Format(msg)
+	expect.Equal(`{"host":"web01","status":"200"}`, string(result))
+	expect.Equal(streamA, streamID)
+
+	msg = core.NewMessage(nil, []byte("bob\t7"), 0)
+	msg.StreamID = streamB
+	result, _ = formatter.Format(msg)
+	expect.Equal(`{"name":"bob","id":"7"}`, string(result))
+}
@@ -0,0 +1,122 @@
+// Copyright 2015-2016 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package format
+
+import (
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/shared"
+)
+
+// Decolorize formatter plugin
+// Decolorize is a formatter that removes ANSI escape sequences like colors or
+// cursor movements from a message, e.g. from logs captured from a terminal or
+// container output. Control sequences (CSI, "ESC ["), operating system
+// commands (OSC, "ESC ]") and all other two byte escape sequences are removed.
+// Configuration example
+//
+//  - "stream.Broadcast":
+//    Formatter: "format.Decolorize"
+//    DecolorizeDataFormatter: "format.Forward"
+//    DecolorizeControlChars: false
+//
+// DecolorizeDataFormatter defines a formatter that is applied before the
+// escape sequences are removed. By default this is set to "format.Forward".
+//
+// DecolorizeControlChars can be set to true to remove all other ASCII control
+// characters except tab and newline, too. By default this is set to false.
+type Decolorize struct {
+	base         core.Formatter
+	controlChars bool
+}
+
+func init() {
+	shared.TypeRegistry.Register(Decolorize{})
+}
+
+// Configure initializes this formatter with values from a plugin config.
+func (format *Decolorize) Configure(conf core.PluginConfig) error {
+	plugin, err := core.NewPluginWithType(conf.GetString("DecolorizeDataFormatter", "format.Forward"), conf)
+	if err != nil {
+		return err
+	}
+	format.base = plugin.(core.Formatter)
+	format.controlChars = conf.GetBool("DecolorizeControlChars", false)
+	return nil
+}
+
+// escapeSequenceLength returns the length of the escape sequence at the start
+// of data. Data has to start with ESC.
+func escapeSequenceLength(data []byte) int {
+	if len(data) < 2 {
+		return len(data) // ### return, incomplete sequence ###
+	}
+
+	switch data[1] {
+	case '[':
+		// CSI: parameter and intermediate bytes followed by a final byte
+		for i := 2; i < len(data); i++ {
+			if data[i] >= 0x40 && data[i] <= 0x7E {
+				return i + 1 // ### return, final byte ###
+			}
+			if data[i] < 0x20 || data[i] > 0x3F && data[i] != 0x7F {
+				return i // ### return, malformed sequence ###
+			}
+		}
+		return len(data)
+
+	case ']', 'P', '^', '_':
+		// OSC, DCS, PM and APC: string terminated by BEL or ESC \
+		for i := 2; i < len(data); i++ {
+			switch {
+			case data[i] == 0x07:
+				return i + 1 // ### return, BEL ###
+			case data[i] == 0x1B && i+1 < len(data) && data[i+1] == '\\':
+				return i + 2 // ### return, string terminator ###
+			}
+		}
+		return len(data)
+
+	default:
+		// Intermediate bytes (e.g. charset selection) followed by a final byte
+		i := 1
+		for i < len(data)-1 && data[i] >= 0x20 && data[i] <= 0x2F {
+			i++
+		}
+		return i + 1
+	}
+}
+
+// Format returns the message without escape sequences
+func (format *Decolorize) Format(msg core.Message) ([]byte, core.MessageStreamID) {
+	data, streamID := format.base.Format(msg)
+
+	result := make([]byte, 0, len(data))
+	for i := 0; i < len(data); {
+		switch char := data[i]; {
+		case char == 0x1B:
+			i += escapeSequenceLength(data[i:])
+			continue // ### continue, skip sequence ###
+
+		case format.controlChars && (char < 0x20 || char == 0x7F) && char != '\t' && char != '\n':
+			i++
+			continue // ### continue, skip control char ###
+		}
+
+		result = append(result, data[i])
+		i++
+	}
+
+	return result, streamID
+}
@@ -0,0 +1,48 @@
+// Copyright 2015-2016 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package format
+
+import (
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/shared"
+	"testing"
+)
+
+func TestDecolorize(t *testing.T) {
+	expect := shared.NewExpect(t)
+
+	config := core.NewPluginConfig("")
+	plugin, err := core.NewPluginWithType("format.Decolorize", config)
+	expect.NoError(err)
+	formatter, casted := plugin.(*Decolorize)
+	expect.True(casted)
+
+	msg := core.NewMessage(nil, []byte("\x1b[1;31mERROR\x1b[0m \x1b]0;title\x07done\x1b[2K\x1b(B\r\n"), 0)
+	result, _ := formatter.Format(msg)
+	expect.Equal("ERROR done\r\n", string(result))
+
+	msg = core.NewMessage(nil, []byte("grün \x1b]8;;http://x\x1b\\link\x1b]8;;\x1b\\ \x1b["), 0)
+	result, _ = formatter.Format(msg)
+	expect.Equal("grün link ", string(result))
+
+	config.Override("DecolorizeControlChars", true)
+	plugin, err = core.NewPluginWithType("format.Decolorize", config)
+	expect.NoError(err)
+	formatter = plugin.(*Decolorize)
+
+	msg = core.NewMessage(nil, []byte("a\x1b[32mb\rc\x08\td\n"), 0)
+	result, _ = formatter.Format(msg)
+	expect.Equal("abc\td\n", string(result))
+}
@@ -0,0 +1,205 @@
+// Copyright 2015-2016 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package format
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4/v4"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/core/log"
+	"github.com/trivago/gollum/shared"
+	"io"
+	"io/ioutil"
+	"strings"
+)
+
+// Decompress formatter plugin
+// Decompress is a formatter that decompresses messages written by
+// format.Compress or any other message based compressor.
+// Configuration example
+//
+//  - "stream.Broadcast":
+//    Formatter: "format.Decompress"
+//    DecompressDataFormatter: "format.Forward"
+//    DecompressAlgorithm: "gzip"
+//    DecompressMaxSizeByte: 67108864
+//    DecompressErrorStream: ""
+//
+// DecompressDataFormatter defines a formatter that is applied before the
+// message is decompressed. By default this is set to "format.Forward".
+//
+// DecompressAlgorithm defines the compression algorithm of the messages.
+// The algorithms "gzip", "zlib", "deflate", "snappy", "lz4" and "zstd" are
+// supported as described for format.Compress. Checksums of LZ4 frames and
+// blocks are verified if present.
+// If set to "auto" gzip, zlib, lz4 and zstd messages are detected by their
+// header and all other messages are passed on unchanged.
+// By default this is set to "gzip".
+//
+// DecompressMaxSizeByte defines the maximum size of a decompressed message.
+// Messages that would exceed this size are treated as messages that cannot be
+// decompressed. By default this is set to 67108864 (64 MB).
+//
+// DecompressErrorStream defines a stream that messages which cannot be
+// decompressed are routed to. These messages are passed on unchanged.
+// By default this is set to "", i.e. a warning is logged and the message stays
+// on its stream.
+type Decompress struct {
+	base          core.Formatter
+	algorithm     string
+	maxSize       int
+	errorStreamID core.MessageStreamID
+	zstd          *zstd.Decoder
+}
+
+func init() {
+	shared.TypeRegistry.Register(Decompress{})
+}
+
+// Configure initializes this formatter with values from a plugin config.
+func (format *Decompress) Configure(conf core.PluginConfig) error {
+	plugin, err := core.NewPluginWithType(conf.GetString("DecompressDataFormatter", "format.Forward"), conf)
+	if err != nil {
+		return err
+	}
+	format.base = plugin.(core.Formatter)
+
+	format.algorithm = strings.ToLower(conf.GetString("DecompressAlgorithm", "gzip"))
+	switch format.algorithm {
+	case "auto", "gzip", "zlib", "deflate", "snappy", "lz4", "zstd":
+	default:
+		return fmt.Errorf("Unknown DecompressAlgorithm: %s", format.algorithm)
+	}
+
+	format.maxSize = shared.MaxI(conf.GetInt("DecompressMaxSizeByte", 64<<20), 1)
+	if format.algorithm == "zstd" || format.algorithm == "auto" {
+		format.zstd, err = zstd.NewReader(nil, zstd.WithDecoderMaxMemory(uint64(format.maxSize)))
+		if err != nil {
+			return err
+		}
+	}
+
+	format.errorStreamID = core.InvalidStreamID
+	if errorStream := conf.GetString("DecompressErrorStream", ""); errorStream != "" {
+		format.errorStreamID = core.StreamRegistry.GetStreamID(errorStream)
+	}
+
+	return nil
+}
+
+// detectCompression returns the algorithm used to compress data or "" if no
+// known header was found.
+func detectCompression(data []byte) string {
+	switch {
+	case len(data) >= 2 && data[0] == 0x1f && data[1] == 0x8b:
+		return "gzip"
+	case len(data) >= 4 && binary.LittleEndian.Uint32(data) == 0x184D2204: // LZ4 frame magic
+		return "lz4"
+	case len(data) >= 4 && binary.LittleEndian.Uint32(data) == 0xFD2FB528: // Zstandard frame magic
+		return "zstd"
+	case len(data) >= 2 && data[0]&0x0F == 8 && binary.BigEndian.Uint16(data)%31 == 0:
+		return "zlib"
+	default:
+		return ""
+	}
+}
+
+// readAll reads the decompressed message from reader and fails if it exceeds
+// the maximum size.
+func (format *Decompress) readAll(reader io.Reader) ([]byte, error) {
+	data, err := ioutil.ReadAll(io.LimitReader(reader, int64(format.maxSize)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > format.maxSize {
+		return nil, fmt.Errorf("Decompressed message exceeds %d bytes", format.maxSize)
+	}
+	return data, nil
+}
+
+// decompress decompresses data with the given algorithm.
+func (format *Decompress) decompress(algorithm string, data []byte) ([]byte, error) {
+	switch algorithm {
+	case "gzip":
+		reader, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		defer reader.Close()
+		return format.readAll(reader)
+
+	case "zlib":
+		reader, err := zlib.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		defer reader.Close()
+		return format.readAll(reader)
+
+	case "deflate":
+		reader := flate.NewReader(bytes.NewReader(data))
+		defer reader.Close()
+		return format.readAll(reader)
+
+	case "snappy":
+		size, err := snappy.DecodedLen(data)
+		if err != nil {
+			return nil, err
+		}
+		if size > format.maxSize {
+			return nil, fmt.Errorf("Decompressed message exceeds %d bytes", format.maxSize)
+		}
+		return snappy.Decode(nil, data)
+
+	case "lz4":
+		return format.readAll(lz4.NewReader(bytes.NewReader(data)))
+
+	case "zstd":
+		return format.zstd.DecodeAll(data, nil)
+
+	default:
+		return nil, fmt.Errorf("Unknown compression algorithm: %s", algorithm)
+	}
+}
+
+// Format returns the decompressed message payload
+func (format *Decompress) Format(msg core.Message) ([]byte, core.MessageStreamID) {
+	data, streamID := format.base.Format(msg)
+
+	algorithm := format.algorithm
+	if algorithm == "auto" {
+		if algorithm = detectCompression(data); algorithm == "" {
+			return data, streamID // ### return, not compressed ###
+		}
+	}
+
+	decompressed, err := format.decompress(algorithm, data)
+	if err != nil {
+		if format.errorStreamID != core.InvalidStreamID {
+			return data, format.errorStreamID // ### return, route to error stream ###
+		}
+		Log.Warning.Print("Decompress failed to decompress a message: ", err)
+		return data, streamID
+	}
+
+	return decompressed, streamID
+}
@@ -0,0 +1,121 @@
+// Copyright 2015-2016 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package format
+
+import (
+	"crypto/cipher"
+	"fmt"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/core/log"
+	"github.com/trivago/gollum/shared"
+)
+
+// Decrypt formatter plugin
+// Decrypt is a formatter that decrypts messages written by format.Encrypt.
+// The key used for decryption is selected by the key ID stored in each
+// message, so messages encrypted with different keys can be mixed.
+// Configuration example
+//
+//  - "stream.Broadcast":
+//    Formatter: "format.Decrypt"
+//    DecryptDataFormatter: "format.Forward"
+//    DecryptKeys:
+//      "2016-09": "/etc/gollum/keys/2016-09.key"
+//      "2016-10": "/etc/gollum/keys/2016-10.key"
+//    DecryptErrorStream: ""
+//
+// DecryptDataFormatter defines a formatter that is applied before the message
+// is decrypted. By default this is set to "format.Forward".
+//
+// DecryptKeys maps key IDs to files containing a 256 bit key as described
+// for format.Encrypt. By default no keys are set.
+//
+// DecryptErrorStream defines a stream that messages which cannot be decrypted
+// are routed to. These messages are passed on unchanged.
+// By default this is set to "", i.e. the message is dropped and a warning is
+// logged.
+type Decrypt struct {
+	base          core.Formatter
+	keys          map[string]cipher.AEAD
+	errorStreamID core.MessageStreamID
+}
+
+func init() {
+	shared.TypeRegistry.Register(Decrypt{})
+}
+
+// Configure initializes this formatter with values from a plugin config.
+func (format *Decrypt) Configure(conf core.PluginConfig) error {
+	plugin, err := core.NewPluginWithType(conf.GetString("DecryptDataFormatter", "format.Forward"), conf)
+	if err != nil {
+		return err
+	}
+	format.base = plugin.(core.Formatter)
+
+	if format.keys, err = loadEncryptionKeys(conf.GetStringMap("DecryptKeys", map[string]string{})); err != nil {
+		return err
+	}
+	if len(format.keys) == 0 {
+		Log.Warning.Print("Decrypt has no keys configured. No message can be decrypted.")
+	}
+
+	format.errorStreamID = core.InvalidStreamID
+	if errorStream := conf.GetString("DecryptErrorStream", ""); errorStream != "" {
+		format.errorStreamID = core.StreamRegistry.GetStreamID(errorStream)
+	}
+
+	return nil
+}
+
+func (format *Decrypt) decrypt(data []byte) ([]byte, error) {
+	if len(data) < 2 || data[0] != encryptEnvelopeVersion {
+		return nil, fmt.Errorf("Unknown envelope format")
+	}
+
+	headerSize := 2 + int(data[1])
+	if len(data) < headerSize {
+		return nil, fmt.Errorf("Envelope too short")
+	}
+
+	keyID := string(data[2:headerSize])
+	cipher, exists := format.keys[keyID]
+	if !exists {
+		return nil, fmt.Errorf("Unknown key ID %s", keyID)
+	}
+
+	nonceSize := cipher.NonceSize()
+	if len(data) < headerSize+nonceSize+cipher.Overhead() {
+		return nil, fmt.Errorf("Envelope too short")
+	}
+
+	nonce := data[headerSize : headerSize+nonceSize]
+	return cipher.Open(nil, nonce, data[headerSize+nonceSize:], data[:headerSize])
+}
+
+// Format returns the decrypted message payload
+func (format *Decrypt) Format(msg core.Message) ([]byte, core.MessageStreamID) {
+	data, streamID := format.base.Format(msg)
+
+	decrypted, err := format.decrypt(data)
+	if err != nil {
+		if format.errorStreamID != core.InvalidStreamID {
+			return data, format.errorStreamID // ### return, route to error stream ###
+		}
+		Log.Warning.Print("Decrypt failed to decrypt a message: ", err)
+		return nil, core.DroppedStreamID
+	}
+
+	return decrypted, streamID
+}
@@ -0,0 +1,232 @@
+// Copyright 2015-2016 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package format
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/core/log"
+	"github.com/trivago/gollum/shared"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Diff formatter plugin
+// Diff is a formatter that passes on JSON messages only if selected fields
+// changed compared to the last message with the same key, e.g. to reduce
+// periodically polled device states to actual state changes. Messages without
+// changes are dropped. The first message of each key is always passed on.
+// Configuration example
+//
+//  - "stream.Broadcast":
+//    Formatter: "format.Diff"
+//    DiffDataFormatter: "format.Forward"
+//    DiffKey: "device/id"
+//    DiffFields:
+//      - "state"
+//      - "sensors/temperature"
+//    DiffEmitDelta: false
+//    DiffMaxKeys: 10000
+//    DiffErrorStream: ""
+//
+// DiffDataFormatter defines a formatter that is applied before the message is
+// compared. By default this is set to "format.Forward".
+//
+// DiffKey defines the path of the field that identifies the entity a message
+// belongs to. Nested fields can be accessed by using "/" as a separator, array
+// elements by using "[<index>]". Messages without this field are handled as
+// errors. By default this is set to "", i.e. all messages share the same key.
+//
+// DiffFields defines a list of field paths to compare. By default this list is
+// empty and all top-level fields except DiffKey are compared.
+//
+// DiffEmitDelta can be set to true to replace the message by a JSON object
+// that only contains DiffKey and the fields that changed. Fields that have been
+// removed are set to null. By default this is set to false, i.e. the message is
+// passed on unchanged.
+//
+// DiffMaxKeys defines the maximum number of keys to remember. If this limit is
+// reached, the least recently used key is forgotten. Set to 0 to disable the
+// limit.
+// By default this is set to 10000.
+//
+// DiffErrorStream defines a stream that messages which are not a JSON object or
+// that do not contain DiffKey are routed to. These messages are passed on
+// unchanged. By default this is set to "", i.e. a warning is logged and the
+// message stays on its stream.
+type Diff struct {
+	base          core.Formatter
+	keyPath       string
+	fields        []string
+	emitDelta     bool
+	errorStreamID core.MessageStreamID
+	last          *shared.LRU
+	lastGuard     *sync.Mutex
+}
+
+func init() {
+	shared.TypeRegistry.Register(Diff{})
+}
+
+// Configure initializes this formatter with values from a plugin config.
+func (format *Diff) Configure(conf core.PluginConfig) error {
+	plugin, err := core.NewPluginWithType(conf.GetString("DiffDataFormatter", "format.Forward"), conf)
+	if err != nil {
+		return err
+	}
+	format.base = plugin.(core.Formatter)
+
+	format.keyPath = conf.GetString("DiffKey", "")
+	format.fields = conf.GetStringArray("DiffFields", []string{})
+	format.emitDelta = conf.GetBool("DiffEmitDelta", false)
+	format.last = shared.NewLRU(conf.GetInt("DiffMaxKeys", 10000), nil)
+	format.lastGuard = new(sync.Mutex)
+
+	format.errorStreamID = core.InvalidStreamID
+	if errorStream := conf.GetString("DiffErrorStream", ""); errorStream != "" {
+		format.errorStreamID = core.StreamRegistry.GetStreamID(errorStream)
+	}
+
+	return nil
+}
+
+// fieldValues returns the JSON encoded values of all compared fields.
+// Fields that do not exist are not part of the result.
+func (format *Diff) fieldValues(values shared.MarshalMap) (map[string]string, error) {
+	fields := format.fields
+	if len(fields) == 0 {
+		fields = make([]string, 0, len(values))
+		for key := range values {
+			if key != format.keyPath {
+				fields = append(fields, key)
+			}
+		}
+	}
+
+	result := make(map[string]string, len(fields))
+	for _, path := range fields {
+		if value, exists := values.Path(path); exists {
+			encoded, err := json.Marshal(value)
+			if err != nil {
+				return nil, err
+			}
+			result[path] = string(encoded)
+		}
+	}
+	return result, nil
+}
+
+// changedFields stores the given field values for key and returns the paths of
+// all fields that differ from the values stored before.
+func (format *Diff) changedFields(key string, current map[string]string) []string {
+	format.lastGuard.Lock()
+	defer format.lastGuard.Unlock()
+
+	var previous map[string]string
+	stored, known := format.last.Get(key)
+	if known {
+		previous = stored.(map[string]string)
+	}
+	format.last.Set(key, current)
+
+	changed := []string{}
+	for path, value := range current {
+		if oldValue, exists := previous[path]; !known || !exists || oldValue != value {
+			changed = append(changed, path)
+		}
+	}
+	for path := range previous {
+		if _, exists := current[path]; !exists {
+			changed = append(changed, path)
+		}
+	}
+
+	sort.Strings(changed)
+	return changed
+}
+
+// delta returns a JSON object holding the key and all changed fields.
+func (format *Diff) delta(values shared.MarshalMap, changed []string) ([]byte, error) {
+	root := &splitToJSONNode{children: []*splitToJSONNode{}}
+	if format.keyPath != "" {
+		value, _ := values.Path(format.keyPath)
+		root.set(strings.Split(format.keyPath, "/"), value)
+	}
+	for _, path := range changed {
+		value, _ := values.Path(path)
+		root.set(strings.Split(path, "/"), value)
+	}
+	return root.MarshalJSON()
+}
+
+// compare returns the payload to pass on or nil if nothing changed.
+func (format *Diff) compare(data []byte) ([]byte, error) {
+	values := shared.NewMarshalMap()
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(&values); err != nil {
+		return nil, err
+	}
+
+	key := ""
+	if format.keyPath != "" {
+		value, exists := values.Path(format.keyPath)
+		if !exists {
+			return nil, fmt.Errorf("Message does not contain %s", format.keyPath)
+		}
+		var err error
+		if key, err = jsonValueString(value); err != nil {
+			return nil, err
+		}
+	}
+
+	current, err := format.fieldValues(values)
+	if err != nil {
+		return nil, err
+	}
+
+	changed := format.changedFields(key, current)
+	switch {
+	case len(changed) == 0:
+		return nil, nil
+	case format.emitDelta:
+		return format.delta(values, changed)
+	default:
+		return data, nil
+	}
+}
+
+// Format drops messages that did not change
+func (format *Diff) Format(msg core.Message) ([]byte, core.MessageStreamID) {
+	data, streamID := format.base.Format(msg)
+
+	result, err := format.compare(data)
+	switch {
+	case err != nil:
+		if format.errorStreamID != core.InvalidStreamID {
+			return data, format.errorStreamID // ### return, route to error stream ###
+		}
+		Log.Warning.Print("Diff failed to compare a message: ", err)
+		return data, streamID
+
+	case result == nil:
+		return data, core.DroppedStreamID // ### return, nothing changed ###
+	}
+
+	return result, streamID
+}
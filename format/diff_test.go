@@ -0,0 +1,84 @@
+// Copyright 2015-2016 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package format
+
+import (
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/shared"
+	"testing"
+)
+
+func TestDiff(t *testing.T) {
+	expect := shared.NewExpect(t)
+
+	config := core.NewPluginConfig("")
+	config.Override("DiffKey", "device/id")
+	config.Override("DiffFields", []string{"state", "sensors/temp"})
+	config.Override("DiffErrorStream", "error")
+	plugin, err := core.NewPluginWithType("format.Diff", config)
+	expect.NoError(err)
+	formatter, casted := plugin.(*Diff)
+	expect.True(casted)
+
+	msg := core.NewMessage(nil, []byte(`{"device":{"id":"a"},"state":"on","sensors":{"temp":20},"ts":1}`), 0)
+	result, streamID := formatter.Format(msg)
+	expect.Equal(string(msg.Data), string(result))
+	expect.Equal(msg.StreamID, streamID)
+
+	msg = core.NewMessage(nil, []byte(`{"device":{"id":"a"},"state":"on","sensors":{"temp":20},"ts":2}`), 0)
+	_, streamID = formatter.Format(msg)
+	expect.Equal(core.DroppedStreamID, streamID)
+
+	msg = core.NewMessage(nil, []byte(`{"device":{"id":"b"},"state":"on","sensors":{"temp":20},"ts":2}`), 0)
+	_, streamID = formatter.Format(msg)
+	expect.Equal(msg.StreamID, streamID)
+
+	msg = core.NewMessage(nil, []byte(`{"device":{"id":"a"},"state":"on","sensors":{"temp":21},"ts":3}`), 0)
+	result, streamID = formatter.Format(msg)
+	expect.Equal(string(msg.Data), string(result))
+	expect.Equal(msg.StreamID, streamID)
+
+	msg = core.NewMessage(nil, []byte(`{"state":"on"}`), 0)
+	_, streamID = formatter.Format(msg)
+	expect.Equal(core.StreamRegistry.GetStreamID("error"), streamID)
+}
+
+func TestDiffEmitDelta(t *testing.T) {
+	expect := shared.NewExpect(t)
+
+	config := core.NewPluginConfig("")
+	config.Override("DiffKey", "id")
+	config.Override("DiffEmitDelta", true)
+	config.Override("DiffMaxKeys", 1)
+	plugin, err := core.NewPluginWithType("format.Diff", config)
+	expect.NoError(err)
+	formatter := plugin.(*Diff)
+
+	msg := core.NewMessage(nil, []byte(`{"id":1,"a":1,"b":{"c":true}}`), 0)
+	result, _ := formatter.Format(msg)
+	expect.Equal(`{"id":1,"a":1,"b":{"c":true}}`, string(result))
+
+	msg = core.NewMessage(nil, []byte(`{"id":1,"a":2,"c":"x"}`), 0)
+	result, _ = formatter.Format(msg)
+	expect.Equal(`{"id":1,"a":2,"b":null,"c":"x"}`, string(result))
+
+	msg = core.NewMessage(nil, []byte(`{"id":2,"a":2}`), 0)
+	formatter.Format(msg)
+	expect.Equal(1, formatter.last.Len())
+
+	msg = core.NewMessage(nil, []byte(`{"id":1,"a":2,"c":"x"}`), 0)
+	result, _ = formatter.Format(msg)
+	expect.Equal(`{"id":1,"a":2,"c":"x"}`, string(result))
+}
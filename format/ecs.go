@@ -0,0 +1,221 @@
+// Copyright 2015-2016 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package format
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/core/log"
+	"github.com/trivago/gollum/shared"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ecsDefaultMapping maps commonly used field names to ECS fields
+var ecsDefaultMapping = map[string]string{
+	"@timestamp":  "@timestamp",
+	"timestamp":   "@timestamp",
+	"message":     "message",
+	"level":       "log.level",
+	"ip":          "client.ip",
+	"client_ip":   "client.ip",
+	"remote_addr": "client.ip",
+	"user_agent":  "user_agent.original",
+	"agent":       "user_agent.original",
+	"url":         "url.original",
+	"uri":         "url.original",
+	"method":      "http.request.method",
+	"status":      "http.response.status_code",
+	"status_code": "http.response.status_code",
+	"bytes":       "http.response.body.bytes",
+	"latency":     "event.duration",
+	"duration":    "event.duration",
+	"host":        "host.name",
+	"hostname":    "host.name",
+	"user":        "user.name",
+}
+
+// ECS formatter plugin
+// ECS is a formatter that maps fields of a JSON object to the Elastic Common
+// Schema and adds the field "ecs.version", so that documents indexed into
+// Elasticsearch can be used by Kibana apps. ECS fields are written as nested
+// objects, e.g. "client.ip" is written as {"client":{"ip":...}}.
+// Configuration example
+//
+//  - "stream.Broadcast":
+//    Formatter: "format.ECS"
+//    ECSDataFormatter: "format.Forward"
+//    ECSMapping:
+//      "remote_addr": "client.ip"
+//      "request/duration": "event.duration"
+//    ECSDurationUnit: "ms"
+//    ECSVersion: "8.11.0"
+//    ECSKeepUnmapped: true
+//    ECSErrorStream: ""
+//
+// ECSDataFormatter defines a formatter that is applied before the message is
+// mapped. By default this is set to "format.Forward".
+//
+// ECSMapping defines a map of field paths to ECS field names. Nested fields can
+// be accessed by using "/" as a separator. If more than one field is mapped to
+// the same ECS field, the first existing field in order of their paths is used.
+// By default a mapping for common top-level fields like "ip", "user_agent",
+// "url", "status", "latency", "host" or "level" is used.
+//
+// ECSDurationUnit defines the unit of the field mapped to "event.duration" as
+// "s", "ms", "us" or "ns". The value is converted to nanoseconds as required
+// by ECS. By default this is set to "ms".
+//
+// ECSVersion defines the value of the field "ecs.version".
+// By default this is set to "8.11.0".
+//
+// ECSKeepUnmapped can be set to false to remove all fields that are not
+// mapped. By default this is set to true.
+//
+// ECSErrorStream defines a stream that messages which are not a JSON object are
+// routed to. These messages are passed on unchanged.
+// By default this is set to "", i.e. a warning is logged and the message stays
+// on its stream.
+type ECS struct {
+	base          core.Formatter
+	mapping       []ecsField
+	durationUnit  time.Duration
+	version       string
+	keepUnmapped  bool
+	errorStreamID core.MessageStreamID
+}
+
+type ecsField struct {
+	source []string
+	target []string
+}
+
+func init() {
+	shared.TypeRegistry.Register(ECS{})
+}
+
+// Configure initializes this formatter with values from a plugin config.
+func (format *ECS) Configure(conf core.PluginConfig) error {
+	plugin, err := core.NewPluginWithType(conf.GetString("ECSDataFormatter", "format.Forward"), conf)
+	if err != nil {
+		return err
+	}
+	format.base = plugin.(core.Formatter)
+
+	mapping := conf.GetStringMap("ECSMapping", ecsDefaultMapping)
+	paths := make([]string, 0, len(mapping))
+	for path := range mapping {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	format.mapping = make([]ecsField, 0, len(paths))
+	for _, path := range paths {
+		format.mapping = append(format.mapping, ecsField{
+			source: strings.Split(path, "/"),
+			target: strings.Split(mapping[path], "."),
+		})
+	}
+
+	unit := strings.ToLower(conf.GetString("ECSDurationUnit", "ms"))
+	var known bool
+	if format.durationUnit, known = influxLineUnits[unit]; !known {
+		return fmt.Errorf("Unknown ECSDurationUnit: %s", unit)
+	}
+
+	format.version = conf.GetString("ECSVersion", "8.11.0")
+	format.keepUnmapped = conf.GetBool("ECSKeepUnmapped", true)
+	format.errorStreamID = core.InvalidStreamID
+	if errorStream := conf.GetString("ECSErrorStream", ""); errorStream != "" {
+		format.errorStreamID = core.StreamRegistry.GetStreamID(errorStream)
+	}
+
+	return nil
+}
+
+// convertDuration converts the value of "event.duration" to nanoseconds.
+func (format *ECS) convertDuration(root *splitToJSONNode) {
+	parent, idx := root.find([]string{"event", "duration"})
+	if parent == nil {
+		return // ### return, no duration ###
+	}
+
+	node := parent.children[idx]
+	raw, isRaw := node.value.(json.RawMessage)
+	if !isRaw {
+		return // ### return, no plain value ###
+	}
+	duration, err := strconv.ParseFloat(strings.Trim(string(raw), "\""), 64)
+	if err != nil {
+		return // ### return, no number ###
+	}
+	node.value = int64(duration * float64(format.durationUnit))
+}
+
+// mapFields returns the given JSON object with all fields mapped to ECS.
+func (format *ECS) mapFields(data []byte) ([]byte, error) {
+	trimmed := bytes.TrimSpace(data)
+	if len(trimmed) == 0 || trimmed[0] != '{' || !json.Valid(trimmed) {
+		return nil, fmt.Errorf("Message is not a JSON object")
+	}
+
+	root, err := parseJSONNode(trimmed)
+	if err != nil {
+		return nil, err
+	}
+
+	result := root
+	if !format.keepUnmapped {
+		result = &splitToJSONNode{children: []*splitToJSONNode{}}
+	}
+
+	mapped := make(map[string]bool)
+	for _, field := range format.mapping {
+		target := strings.Join(field.target, ".")
+		parent, idx := root.find(field.source)
+		if parent == nil || mapped[target] {
+			continue // ### continue, nothing to map ###
+		}
+
+		node := parent.children[idx]
+		parent.children = append(parent.children[:idx], parent.children[idx+1:]...)
+		result.setNode(field.target, node)
+		mapped[target] = true
+	}
+
+	format.convertDuration(result)
+	result.setNode([]string{"ecs", "version"}, &splitToJSONNode{value: format.version})
+	return result.MarshalJSON()
+}
+
+// Format returns the message mapped to ECS fields
+func (format *ECS) Format(msg core.Message) ([]byte, core.MessageStreamID) {
+	data, streamID := format.base.Format(msg)
+
+	result, err := format.mapFields(data)
+	if err != nil {
+		if format.errorStreamID != core.InvalidStreamID {
+			return data, format.errorStreamID // ### return, route to error stream ###
+		}
+		Log.Warning.Print("ECS failed to map a message: ", err)
+		return data, streamID
+	}
+
+	return result, streamID
+}
@@ -0,0 +1,62 @@
+// Copyright 2015-2016 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package format
+
+import (
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/shared"
+	"testing"
+)
+
+func TestECSDefaultMapping(t *testing.T) {
+	expect := shared.NewExpect(t)
+
+	config := core.NewPluginConfig("")
+	config.Override("ECSErrorStream", "error")
+	plugin, err := core.NewPluginWithType("format.ECS", config)
+	expect.NoError(err)
+	formatter, casted := plugin.(*ECS)
+	expect.True(casted)
+
+	msg := core.NewMessage(nil, []byte(`{"ip":"10.0.0.1","remote_addr":"10.0.0.2","status":404,"latency":1.5,"host":"web1","extra":true}`), 0)
+	result, streamID := formatter.Format(msg)
+	expect.Equal(`{"remote_addr":"10.0.0.2","extra":true,"host":{"name":"web1"},"client":{"ip":"10.0.0.1"},`+
+		`"event":{"duration":1500000},"http":{"response":{"status_code":404}},"ecs":{"version":"8.11.0"}}`, string(result))
+	expect.Equal(msg.StreamID, streamID)
+
+	msg = core.NewMessage(nil, []byte(`[1]`), 0)
+	_, streamID = formatter.Format(msg)
+	expect.Equal(core.StreamRegistry.GetStreamID("error"), streamID)
+}
+
+func TestECSCustomMapping(t *testing.T) {
+	expect := shared.NewExpect(t)
+
+	config := core.NewPluginConfig("")
+	config.Override("ECSMapping", map[interface{}]interface{}{
+		"request/agent": "user_agent.original",
+		"took":          "event.duration",
+	})
+	config.Override("ECSDurationUnit", "s")
+	config.Override("ECSKeepUnmapped", false)
+	config.Override("ECSVersion", "1.12.0")
+	plugin, err := core.NewPluginWithType("format.ECS", config)
+	expect.NoError(err)
+	formatter := plugin.(*ECS)
+
+	msg := core.NewMessage(nil, []byte(`{"request":{"agent":"curl","id":1},"took":2,"other":"x"}`), 0)
+	result, _ := formatter.Format(msg)
+	expect.Equal(`{"user_agent":{"original":"curl"},"event":{"duration":2000000000},"ecs":{"version":"1.12.0"}}`, string(result))
+}
@@ -0,0 +1,192 @@
+// Copyright 2015-2016 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package format
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/core/log"
+	"github.com/trivago/gollum/shared"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+)
+
+const (
+	encryptEnvelopeVersion = 1
+	encryptKeySize         = 32
+)
+
+// Encrypt formatter plugin
+// Encrypt is a formatter that encrypts messages with AES-256-GCM so that they
+// can be decrypted by format.Decrypt. Each message is written as an envelope
+// of a version byte (1), the length of the key ID (1 byte), the key ID, a
+// random 12 byte nonce and the sealed payload. The envelope header is
+// authenticated, too.
+// Keys are identified by an ID so that keys can be rotated: add the new key to
+// all decrypting instances first, then change the key ID used for encryption.
+// If no key is configured all messages are dropped, i.e. messages are never
+// sent unencrypted.
+// Configuration example
+//
+//  - "stream.Broadcast":
+//    Formatter: "format.Encrypt"
+//    EncryptDataFormatter: "format.Forward"
+//    EncryptKeyID: "2016-10"
+//    EncryptKeys:
+//      "2016-10": "/etc/gollum/keys/2016-10.key"
+//
+// EncryptDataFormatter defines a formatter that is applied before the message
+// is encrypted. By default this is set to "format.Forward".
+//
+// EncryptKeys maps key IDs to files containing a 256 bit key. A key file can
+// contain the 32 raw key bytes or the key encoded as hex or base64 string.
+// Key IDs can be up to 255 characters long. By default no keys are set.
+//
+// EncryptKeyID defines the ID of the key used for encryption. This setting may
+// be omitted if only one key is configured. By default this is set to "".
+type Encrypt struct {
+	base   core.Formatter
+	keyID  string
+	cipher cipher.AEAD
+}
+
+func init() {
+	shared.TypeRegistry.Register(Encrypt{})
+}
+
+// Configure initializes this formatter with values from a plugin config.
+func (format *Encrypt) Configure(conf core.PluginConfig) error {
+	plugin, err := core.NewPluginWithType(conf.GetString("EncryptDataFormatter", "format.Forward"), conf)
+	if err != nil {
+		return err
+	}
+	format.base = plugin.(core.Formatter)
+
+	keys, err := loadEncryptionKeys(conf.GetStringMap("EncryptKeys", map[string]string{}))
+	if err != nil {
+		return err
+	}
+
+	format.keyID = conf.GetString("EncryptKeyID", "")
+	if format.keyID == "" {
+		switch len(keys) {
+		case 0:
+			Log.Warning.Print("Encrypt has no keys configured. All messages will be dropped.")
+			return nil // ### return, no keys ###
+		case 1:
+			for keyID := range keys {
+				format.keyID = keyID
+			}
+		default:
+			return fmt.Errorf("EncryptKeyID must be set if more than one key is configured")
+		}
+	}
+
+	cipher, exists := keys[format.keyID]
+	if !exists {
+		return fmt.Errorf("EncryptKeyID %s is not configured in EncryptKeys", format.keyID)
+	}
+	format.cipher = cipher
+	return nil
+}
+
+// loadEncryptionKeys reads the key files of the given key ID to file map and
+// creates an AES-GCM cipher for each key.
+func loadEncryptionKeys(keyFiles map[string]string) (map[string]cipher.AEAD, error) {
+	keys := make(map[string]cipher.AEAD)
+	keyIDs := make([]string, 0, len(keyFiles))
+	for keyID := range keyFiles {
+		keyIDs = append(keyIDs, keyID)
+	}
+	sort.Strings(keyIDs)
+
+	for _, keyID := range keyIDs {
+		if len(keyID) == 0 || len(keyID) > 255 {
+			return nil, fmt.Errorf("Key ID %s must be 1 to 255 characters long", keyID)
+		}
+
+		data, err := ioutil.ReadFile(keyFiles[keyID])
+		if err != nil {
+			return nil, err
+		}
+
+		key, err := parseEncryptionKey(data)
+		if err != nil {
+			return nil, fmt.Errorf("Key %s: %s", keyID, err.Error())
+		}
+
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		if keys[keyID], err = cipher.NewGCM(block); err != nil {
+			return nil, err
+		}
+	}
+	return keys, nil
+}
+
+// parseEncryptionKey returns the 256 bit key stored as raw bytes, hex or
+// base64 in the given data.
+func parseEncryptionKey(data []byte) ([]byte, error) {
+	if len(data) == encryptKeySize {
+		return data, nil // ### return, raw key ###
+	}
+
+	text := strings.TrimSpace(string(data))
+	if key, err := hex.DecodeString(text); err == nil && len(key) == encryptKeySize {
+		return key, nil // ### return, hex key ###
+	}
+	if key, err := base64.StdEncoding.DecodeString(text); err == nil && len(key) == encryptKeySize {
+		return key, nil // ### return, base64 key ###
+	}
+	return nil, fmt.Errorf("Key must be 32 bytes, 64 hex characters or 44 base64 characters")
+}
+
+// encryptionHeader returns the envelope header for the given key ID, which is
+// also used as additional authenticated data.
+func encryptionHeader(keyID string) []byte {
+	header := make([]byte, 0, len(keyID)+2)
+	header = append(header, encryptEnvelopeVersion, byte(len(keyID)))
+	return append(header, keyID...)
+}
+
+// Format returns the encrypted message payload
+func (format *Encrypt) Format(msg core.Message) ([]byte, core.MessageStreamID) {
+	data, streamID := format.base.Format(msg)
+	if format.cipher == nil {
+		return nil, core.DroppedStreamID // ### return, no key configured ###
+	}
+
+	header := encryptionHeader(format.keyID)
+	nonceSize := format.cipher.NonceSize()
+	envelope := make([]byte, len(header)+nonceSize, len(header)+nonceSize+len(data)+format.cipher.Overhead())
+	copy(envelope, header)
+
+	nonce := envelope[len(header):]
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		Log.Error.Print("Encrypt failed to generate a nonce: ", err)
+		return nil, core.DroppedStreamID // ### return, never send unencrypted ###
+	}
+
+	return format.cipher.Seal(envelope, nonce, data, header), streamID
+}
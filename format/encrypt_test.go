@@ -0,0 +1,126 @@
+// Copyright 2015-2016 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package format
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/shared"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeEncryptTestKeys(expect shared.Expect, dir string) map[interface{}]interface{} {
+	oldKey := bytes.Repeat([]byte{0x01}, 32)
+	newKey := bytes.Repeat([]byte{0x02}, 32)
+	rawKey := bytes.Repeat([]byte{0x03}, 32)
+
+	expect.NoError(ioutil.WriteFile(filepath.Join(dir, "old.key"), []byte(hex.EncodeToString(oldKey)+"\n"), 0600))
+	expect.NoError(ioutil.WriteFile(filepath.Join(dir, "new.key"), []byte(base64.StdEncoding.EncodeToString(newKey)), 0600))
+	expect.NoError(ioutil.WriteFile(filepath.Join(dir, "raw.key"), rawKey, 0600))
+
+	return map[interface{}]interface{}{
+		"old": filepath.Join(dir, "old.key"),
+		"new": filepath.Join(dir, "new.key"),
+		"raw": filepath.Join(dir, "raw.key"),
+	}
+}
+
+func TestEncryptDecrypt(t *testing.T) {
+	expect := shared.NewExpect(t)
+
+	dir, err := ioutil.TempDir("", "gollum_encrypt")
+	expect.NoError(err)
+	defer os.RemoveAll(dir)
+	keys := writeEncryptTestKeys(expect, dir)
+
+	config := core.NewPluginConfig("")
+	config.Override("DecryptKeys", keys)
+	config.Override("DecryptErrorStream", "error")
+	plugin, err := core.NewPluginWithType("format.Decrypt", config)
+	expect.NoError(err)
+	decrypt, casted := plugin.(*Decrypt)
+	expect.True(casted)
+
+	for _, keyID := range []string{"old", "new", "raw"} {
+		config := core.NewPluginConfig("")
+		config.Override("EncryptKeys", keys)
+		config.Override("EncryptKeyID", keyID)
+		plugin, err := core.NewPluginWithType("format.Encrypt", config)
+		expect.NoError(err)
+		encrypt, casted := plugin.(*Encrypt)
+		expect.True(casted)
+
+		msg := core.NewMessage(nil, []byte("secret"), 0)
+		encrypted, streamID := encrypt.Format(msg)
+		expect.Equal(msg.StreamID, streamID)
+		expect.Equal(keyID, string(encrypted[2:2+len(keyID)]))
+		expect.False(bytes.Contains(encrypted, []byte("secret")))
+
+		msg.Data = encrypted
+		result, streamID := decrypt.Format(msg)
+		expect.Equal("secret", string(result))
+		expect.Equal(msg.StreamID, streamID)
+
+		// Changing the key ID must break authentication
+		tampered := append([]byte{}, encrypted...)
+		tampered[2] = 'x'
+		msg.Data = tampered
+		result, streamID = decrypt.Format(msg)
+		expect.Equal(string(tampered), string(result))
+		expect.Equal(core.StreamRegistry.GetStreamID("error"), streamID)
+	}
+
+	msg := core.NewMessage(nil, []byte("not encrypted"), 0)
+	_, streamID := decrypt.Format(msg)
+	expect.Equal(core.StreamRegistry.GetStreamID("error"), streamID)
+}
+
+func TestEncryptConfig(t *testing.T) {
+	expect := shared.NewExpect(t)
+
+	dir, err := ioutil.TempDir("", "gollum_encrypt")
+	expect.NoError(err)
+	defer os.RemoveAll(dir)
+	keys := writeEncryptTestKeys(expect, dir)
+
+	config := core.NewPluginConfig("")
+	config.Override("EncryptKeys", keys)
+	_, err = core.NewPluginWithType("format.Encrypt", config)
+	expect.NotNil(err) // key ID required
+
+	config.Override("EncryptKeyID", "unknown")
+	_, err = core.NewPluginWithType("format.Encrypt", config)
+	expect.NotNil(err)
+
+	expect.NoError(ioutil.WriteFile(filepath.Join(dir, "short.key"), []byte("abcd"), 0600))
+	config = core.NewPluginConfig("")
+	config.Override("EncryptKeys", map[interface{}]interface{}{"short": filepath.Join(dir, "short.key")})
+	_, err = core.NewPluginWithType("format.Encrypt", config)
+	expect.NotNil(err)
+
+	// Without keys all messages are dropped
+	plugin, err := core.NewPluginWithType("format.Encrypt", core.NewPluginConfig(""))
+	expect.NoError(err)
+	encrypt, casted := plugin.(*Encrypt)
+	expect.True(casted)
+
+	_, streamID := encrypt.Format(core.NewMessage(nil, []byte("secret"), 0))
+	expect.Equal(core.DroppedStreamID, streamID)
+}
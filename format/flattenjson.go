@@ -0,0 +1,172 @@
+// Copyright 2015-2016 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package format
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/core/log"
+	"github.com/trivago/gollum/shared"
+	"strconv"
+)
+
+// FlattenJSON formatter plugin
+// FlattenJSON is a formatter that converts nested JSON objects and arrays into
+// a flat JSON object. The keys of nested values are joined by a separator,
+// array elements are addressed by their index, e.g. {"a":{"b":[{"c":1}]}}
+// becomes {"a.b[0].c":1}. The order of keys is preserved. Empty objects and
+// arrays are kept as values.
+// Configuration example
+//
+//  - "stream.Broadcast":
+//    Formatter: "format.FlattenJSON"
+//    FlattenJSONDataFormatter: "format.Forward"
+//    FlattenJSONSeparator: "."
+//    FlattenJSONMaxDepth: 0
+//    FlattenJSONErrorStream: ""
+//
+// FlattenJSONDataFormatter defines a formatter that is applied before the
+// message is flattened. By default this is set to "format.Forward".
+//
+// FlattenJSONSeparator defines the string used to join the keys of nested
+// objects. By default this is set to ".".
+//
+// FlattenJSONMaxDepth defines the maximum number of keys and indexes joined
+// into one flat key. Values nested deeper are written unchanged, e.g. a value
+// of 2 converts {"a":{"b":{"c":1}}} to {"a.b":{"c":1}}. By default this is set
+// to 0, i.e. there is no limit.
+//
+// FlattenJSONErrorStream defines a stream that messages which are not a JSON
+// object are routed to. These messages are passed on unchanged.
+// By default this is set to "", i.e. a warning is logged and the message stays
+// on its stream.
+type FlattenJSON struct {
+	base          core.Formatter
+	separator     string
+	maxDepth      int
+	errorStreamID core.MessageStreamID
+}
+
+func init() {
+	shared.TypeRegistry.Register(FlattenJSON{})
+}
+
+// Configure initializes this formatter with values from a plugin config.
+func (format *FlattenJSON) Configure(conf core.PluginConfig) error {
+	plugin, err := core.NewPluginWithType(conf.GetString("FlattenJSONDataFormatter", "format.Forward"), conf)
+	if err != nil {
+		return err
+	}
+	format.base = plugin.(core.Formatter)
+
+	format.separator = conf.GetString("FlattenJSONSeparator", ".")
+	format.maxDepth = conf.GetInt("FlattenJSONMaxDepth", 0)
+	if format.maxDepth < 0 {
+		return fmt.Errorf("FlattenJSONMaxDepth must not be negative")
+	}
+
+	format.errorStreamID = core.InvalidStreamID
+	if errorStream := conf.GetString("FlattenJSONErrorStream", ""); errorStream != "" {
+		format.errorStreamID = core.StreamRegistry.GetStreamID(errorStream)
+	}
+
+	return nil
+}
+
+// flatten writes all leaves of value to buffer. Objects and arrays are
+// expanded until maxDepth is reached. The root object is passed with depth 0.
+func (format *FlattenJSON) flatten(buffer *bytes.Buffer, key string, value json.RawMessage, depth int) error {
+	canExpand := format.maxDepth == 0 || depth < format.maxDepth
+	value = bytes.TrimSpace(value)
+
+	if canExpand && len(value) > 0 && (value[0] == '{' || value[0] == '[') {
+		expanded := false
+		decoder := json.NewDecoder(bytes.NewReader(value))
+		decoder.UseNumber()
+		if _, err := decoder.Token(); err != nil {
+			return err
+		}
+
+		for index := 0; decoder.More(); index++ {
+			var childKey string
+			if value[0] == '{' {
+				token, err := decoder.Token()
+				if err != nil {
+					return err
+				}
+				childKey = token.(string)
+				if depth > 0 {
+					childKey = key + format.separator + childKey
+				}
+			} else {
+				childKey = key + "[" + strconv.Itoa(index) + "]"
+			}
+
+			var child json.RawMessage
+			if err := decoder.Decode(&child); err != nil {
+				return err
+			}
+			if err := format.flatten(buffer, childKey, child, depth+1); err != nil {
+				return err
+			}
+			expanded = true
+		}
+
+		if expanded || depth == 0 {
+			return nil // ### return, children written ###
+		}
+	}
+
+	if buffer.Len() > 1 {
+		buffer.WriteByte(',')
+	}
+	keyJSON, _ := json.Marshal(key)
+	buffer.Write(keyJSON)
+	buffer.WriteByte(':')
+	return json.Compact(buffer, value)
+}
+
+// flattenMessage returns the given JSON object as flat JSON object.
+func (format *FlattenJSON) flattenMessage(data []byte) ([]byte, error) {
+	trimmed := bytes.TrimSpace(data)
+	if len(trimmed) == 0 || trimmed[0] != '{' || !json.Valid(trimmed) {
+		return nil, fmt.Errorf("Message is not a JSON object")
+	}
+
+	buffer := bytes.NewBufferString("{")
+	if err := format.flatten(buffer, "", trimmed, 0); err != nil {
+		return nil, err
+	}
+	buffer.WriteByte('}')
+	return buffer.Bytes(), nil
+}
+
+// Format returns the flattened JSON object
+func (format *FlattenJSON) Format(msg core.Message) ([]byte, core.MessageStreamID) {
+	data, streamID := format.base.Format(msg)
+
+	flat, err := format.flattenMessage(data)
+	if err != nil {
+		if format.errorStreamID != core.InvalidStreamID {
+			return data, format.errorStreamID // ### return, route to error stream ###
+		}
+		Log.Warning.Print("FlattenJSON failed to flatten a message: ", err)
+		return data, streamID
+	}
+
+	return flat, streamID
+}
@@ -0,0 +1,66 @@
+// Copyright 2015-2016 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package format
+
+import (
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/shared"
+	"testing"
+)
+
+func TestFlattenJSON(t *testing.T) {
+	expect := shared.NewExpect(t)
+
+	config := core.NewPluginConfig("")
+	config.Override("FlattenJSONErrorStream", "error")
+	plugin, err := core.NewPluginWithType("format.FlattenJSON", config)
+	expect.NoError(err)
+	formatter, casted := plugin.(*FlattenJSON)
+	expect.True(casted)
+
+	msg := core.NewMessage(nil, []byte(`{"z":1, "a":{"b":[{"c":"x"},2,[true]]}, "e":{}, "f":[], "n":null}`), 0)
+	result, streamID := formatter.Format(msg)
+	expect.Equal(`{"z":1,"a.b[0].c":"x","a.b[1]":2,"a.b[2][0]":true,"e":{},"f":[],"n":null}`, string(result))
+	expect.Equal(msg.StreamID, streamID)
+
+	msg = core.NewMessage(nil, []byte(`{}`), 0)
+	result, _ = formatter.Format(msg)
+	expect.Equal(`{}`, string(result))
+
+	msg = core.NewMessage(nil, []byte(`[1,2]`), 0)
+	result, streamID = formatter.Format(msg)
+	expect.Equal(`[1,2]`, string(result))
+	expect.Equal(core.StreamRegistry.GetStreamID("error"), streamID)
+
+	msg = core.NewMessage(nil, []byte(`{"a":`), 0)
+	_, streamID = formatter.Format(msg)
+	expect.Equal(core.StreamRegistry.GetStreamID("error"), streamID)
+}
+
+func TestFlattenJSONMaxDepth(t *testing.T) {
+	expect := shared.NewExpect(t)
+
+	config := core.NewPluginConfig("")
+	config.Override("FlattenJSONSeparator", "_")
+	config.Override("FlattenJSONMaxDepth", 2)
+	plugin, err := core.NewPluginWithType("format.FlattenJSON", config)
+	expect.NoError(err)
+	formatter, casted := plugin.(*FlattenJSON)
+	expect.True(casted)
+
+	msg := core.NewMessage(nil, []byte(`{"a":{"b":{"c":1}},"d":[{"e":2}],"f":3}`), 0)
+	result, _ := formatter.Format(msg)
+	expect.Equal(`{"a_b":{"c":1},"d[0]":{"e":2},"f":3}`, string(result))
+}
@@ -0,0 +1,317 @@
+// Copyright 2015-2016 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package format
+
+import (
+	"fmt"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/core/log"
+	"github.com/trivago/gollum/shared"
+	"io/ioutil"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Grok formatter plugin
+// Grok is a formatter that parses unstructured messages by using grok
+// patterns as known from Logstash. A grok pattern is a regular expression
+// that may reference other patterns by using the syntax
+// %{PATTERN:field:type}. The field name and type are optional. Only patterns
+// with a field name are extracted. Supported types are "int", "float" and
+// "bool"; values that cannot be converted are stored as null. Named groups
+// of the regular expression, e.g. (?P<field>...), are extracted, too.
+// A library of common patterns like COMBINEDAPACHELOG, SYSLOGLINE, IPORHOST
+// or TIMESTAMP_ISO8601 is bundled. As Go does not support lookarounds or
+// atomic groups these patterns are slightly less strict than the Logstash
+// originals. Messages that do not match any pattern are passed on unchanged.
+// Configuration example
+//
+//  - "stream.Broadcast":
+//    Formatter: "format.Grok"
+//    GrokDataFormatter: "format.Forward"
+//    GrokPattern:
+//      - "%{COMBINEDAPACHELOG}"
+//    GrokPatternFiles:
+//      - "/etc/gollum/patterns"
+//    GrokTarget: "json"
+//    GrokErrorStream: ""
+//
+// GrokDataFormatter defines a formatter that is applied before the message is
+// parsed. By default this is set to "format.Forward".
+//
+// GrokPattern defines a list of patterns to match against the message. The
+// patterns are tested in the given order and the first matching pattern is
+// used. By default this is set to "%{GREEDYDATA:message}".
+//
+// GrokPatternFiles defines a list of files containing additional patterns.
+// Each line of a file contains the name of a pattern followed by a space and
+// the pattern itself. Empty lines and lines starting with "#" are ignored.
+// Patterns with the same name as a bundled pattern replace the bundled one.
+// By default this list is empty.
+//
+// GrokTarget defines where extracted fields are stored.
+// By default this is set to "json".
+//  * "json" replaces the message by a JSON object containing the fields.
+//  * "metadata" stores the fields as message metadata and leaves the message
+//    unchanged. Field types are ignored in this mode.
+//
+// GrokErrorStream defines a stream that messages not matching any pattern are
+// routed to. By default this is set to "", i.e. these messages stay on their
+// stream.
+type Grok struct {
+	base          core.Formatter
+	expressions   []*regexp.Regexp
+	fields        [][]grokField
+	toMetadata    bool
+	errorStreamID core.MessageStreamID
+}
+
+// grokField maps a group of a compiled expression to a field.
+// Unnamed groups have an empty name.
+type grokField struct {
+	name      string
+	valueType string
+}
+
+// grokCompiler expands grok patterns into regular expressions.
+type grokCompiler struct {
+	patterns map[string]string
+	fields   map[string]grokField
+}
+
+const grokMaxDepth = 32
+
+var grokReference = regexp.MustCompile(`%\{(\w+)(?::([^:}]+))?(?::(\w+))?\}`)
+
+func init() {
+	shared.TypeRegistry.Register(Grok{})
+}
+
+// Configure initializes this formatter with values from a plugin config.
+func (format *Grok) Configure(conf core.PluginConfig) error {
+	plugin, err := core.NewPluginWithType(conf.GetString("GrokDataFormatter", "format.Forward"), conf)
+	if err != nil {
+		return err
+	}
+	format.base = plugin.(core.Formatter)
+
+	compiler := grokCompiler{
+		patterns: make(map[string]string, len(grokPatterns)),
+	}
+	for name, pattern := range grokPatterns {
+		compiler.patterns[name] = pattern
+	}
+	for _, file := range conf.GetStringArray("GrokPatternFiles", []string{}) {
+		if err := compiler.loadPatternFile(file); err != nil {
+			return err
+		}
+	}
+
+	patterns := conf.GetStringArray("GrokPattern", []string{"%{GREEDYDATA:message}"})
+	if len(patterns) == 0 {
+		return fmt.Errorf("Grok requires at least one pattern")
+	}
+
+	for _, pattern := range patterns {
+		expression, fields, err := compiler.compile(pattern)
+		if err != nil {
+			return err
+		}
+		format.expressions = append(format.expressions, expression)
+		format.fields = append(format.fields, fields)
+	}
+
+	target := strings.ToLower(conf.GetString("GrokTarget", "json"))
+	switch target {
+	case "json":
+	case "metadata":
+		format.toMetadata = true
+		core.RegisterMetadataWriter()
+	default:
+		return fmt.Errorf("Unknown grok target: %s", target)
+	}
+
+	format.errorStreamID = core.InvalidStreamID
+	if errorStream := conf.GetString("GrokErrorStream", ""); errorStream != "" {
+		format.errorStreamID = core.StreamRegistry.GetStreamID(errorStream)
+	}
+
+	return nil
+}
+
+// loadPatternFile adds all patterns from a grok pattern file.
+func (compiler *grokCompiler) loadPatternFile(path string) error {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	for lineNum, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || line[0] == '#' {
+			continue // ### continue, empty line or comment ###
+		}
+		split := strings.IndexAny(line, " \t")
+		if split < 0 {
+			return fmt.Errorf("%s:%d: grok pattern definition without pattern", path, lineNum+1)
+		}
+		compiler.patterns[line[:split]] = strings.TrimSpace(line[split:])
+	}
+	return nil
+}
+
+// compile expands the given grok pattern and compiles it. For each group of
+// the resulting expression the field it maps to is returned.
+func (compiler *grokCompiler) compile(pattern string) (*regexp.Regexp, []grokField, error) {
+	compiler.fields = make(map[string]grokField)
+	expanded, err := compiler.expand(pattern, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	expression, err := regexp.Compile(expanded)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Grok pattern %s: %s", pattern, err)
+	}
+
+	names := expression.SubexpNames()
+	fields := make([]grokField, len(names))
+	for i, name := range names {
+		if field, isGenerated := compiler.fields[name]; isGenerated {
+			fields[i] = field
+		} else {
+			fields[i] = grokField{name: name}
+		}
+	}
+	return expression, fields, nil
+}
+
+// expand recursively replaces all pattern references. Referenced patterns
+// with a field name are replaced by a named group with a generated name as
+// field names may contain characters not allowed in group names.
+func (compiler *grokCompiler) expand(pattern string, depth int) (string, error) {
+	if depth > grokMaxDepth {
+		return "", fmt.Errorf("Grok pattern %s is nested too deep or recursive", pattern)
+	}
+
+	var expandErr error
+	expanded := grokReference.ReplaceAllStringFunc(pattern, func(reference string) string {
+		match := grokReference.FindStringSubmatch(reference)
+		name, field, valueType := match[1], match[2], strings.ToLower(match[3])
+
+		subPattern, exists := compiler.patterns[name]
+		if !exists {
+			expandErr = fmt.Errorf("Unknown grok pattern: %s", name)
+			return ""
+		}
+
+		switch valueType {
+		case "", "string", "int", "float", "bool":
+		default:
+			expandErr = fmt.Errorf("Unknown grok type: %s", match[3])
+			return ""
+		}
+
+		subExpression, err := compiler.expand(subPattern, depth+1)
+		if err != nil {
+			expandErr = err
+			return ""
+		}
+
+		if field == "" {
+			return "(?:" + subExpression + ")"
+		}
+
+		groupName := fmt.Sprintf("grok%d", len(compiler.fields))
+		compiler.fields[groupName] = grokField{name: field, valueType: valueType}
+		return "(?P<" + groupName + ">" + subExpression + ")"
+	})
+
+	return expanded, expandErr
+}
+
+// typedValue converts the given string to the type of the field. Invalid
+// values are returned as nil.
+func (field grokField) typedValue(value string) interface{} {
+	switch field.valueType {
+	case "int":
+		if number, err := strconv.ParseInt(value, 10, 64); err == nil {
+			return number
+		}
+		return nil
+
+	case "float":
+		if number, err := strconv.ParseFloat(value, 64); err == nil && !math.IsNaN(number) && !math.IsInf(number, 0) {
+			return number
+		}
+		return nil
+
+	case "bool":
+		if flag, err := strconv.ParseBool(value); err == nil {
+			return flag
+		}
+		return nil
+	}
+
+	return value
+}
+
+// Format matches the message against the configured patterns and returns
+// the extracted fields
+func (format *Grok) Format(msg core.Message) ([]byte, core.MessageStreamID) {
+	data, streamID := format.base.Format(msg)
+
+	for exprIdx, expression := range format.expressions {
+		match := expression.FindSubmatchIndex(data)
+		if match == nil {
+			continue // ### continue, try next pattern ###
+		}
+
+		fields := format.fields[exprIdx]
+		root := &splitToJSONNode{children: []*splitToJSONNode{}}
+
+		for i, field := range fields {
+			start, end := match[2*i], match[2*i+1]
+			if field.name == "" || start < 0 {
+				continue // ### continue, unnamed or not matched ###
+			}
+
+			value := string(data[start:end])
+			if format.toMetadata {
+				msg.SetMetadata(field.name, value)
+			} else {
+				root.set([]string{field.name}, field.typedValue(value))
+			}
+		}
+
+		if format.toMetadata {
+			return data, streamID // ### return, fields stored as metadata ###
+		}
+
+		jsonData, err := root.MarshalJSON()
+		if err != nil {
+			Log.Error.Print("Grok: ", err)
+			return data, streamID
+		}
+		return jsonData, streamID
+	}
+
+	if format.errorStreamID != core.InvalidStreamID {
+		return data, format.errorStreamID
+	}
+	return data, streamID
+}
@@ -0,0 +1,130 @@
+// Copyright 2015-2016 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package format
+
+import (
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/shared"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestGrokApache(t *testing.T) {
+	expect := shared.NewExpect(t)
+
+	config := core.NewPluginConfig("")
+	config.Override("GrokPattern", "%{COMBINEDAPACHELOG}")
+	plugin, err := core.NewPluginWithType("format.Grok", config)
+	expect.NoError(err)
+	formatter, casted := plugin.(*Grok)
+	expect.True(casted)
+
+	msg := core.NewMessage(nil, []byte(`127.0.0.1 - frank [10/Oct/2000:13:55:36 -0700] "GET /apache_pb.gif HTTP/1.0" 200 2326 "http://www.example.com/start.html" "Mozilla/4.08 [en] (Win98; I ;Nav)"`), 0)
+	result, _ := formatter.Format(msg)
+
+	expect.Equal(`{"clientip":"127.0.0.1","ident":"-","auth":"frank","timestamp":"10/Oct/2000:13:55:36 -0700",`+
+		`"verb":"GET","request":"/apache_pb.gif","httpversion":"1.0","response":"200","bytes":"2326",`+
+		`"referrer":"\"http://www.example.com/start.html\"","agent":"\"Mozilla/4.08 [en] (Win98; I ;Nav)\""}`, string(result))
+}
+
+func TestGrokSyslog(t *testing.T) {
+	expect := shared.NewExpect(t)
+
+	config := core.NewPluginConfig("")
+	config.Override("GrokPattern", "%{SYSLOGLINE}")
+	config.Override("GrokTarget", "metadata")
+	plugin, err := core.NewPluginWithType("format.Grok", config)
+	expect.NoError(err)
+	formatter, casted := plugin.(*Grok)
+	expect.True(casted)
+
+	payload := "Oct 11 22:14:15 mymachine su[230]: 'su root' failed for lonvick on /dev/pts/8"
+	msg := core.NewMessage(nil, []byte(payload), 0)
+	msg.PrepareMetadata()
+	result, _ := formatter.Format(msg)
+
+	expect.Equal(payload, string(result))
+	expect.Equal("Oct 11 22:14:15", msg.Metadata["timestamp"])
+	expect.Equal("mymachine", msg.Metadata["logsource"])
+	expect.Equal("su", msg.Metadata["program"])
+	expect.Equal("230", msg.Metadata["pid"])
+	expect.Equal("'su root' failed for lonvick on /dev/pts/8", msg.Metadata["message"])
+}
+
+func TestGrokTypesAndCustomPatterns(t *testing.T) {
+	expect := shared.NewExpect(t)
+
+	file, err := ioutil.TempFile("", "gollum_grok")
+	expect.NoError(err)
+	defer os.Remove(file.Name())
+
+	_, err = file.WriteString("# custom patterns\n\nDURATION %{NUMBER}ms\n")
+	expect.NoError(err)
+	file.Close()
+
+	config := core.NewPluginConfig("")
+	config.Override("GrokPatternFiles", file.Name())
+	config.Override("GrokPattern", []interface{}{
+		`^%{WORD:level} took %{DURATION:duration} \(%{INT:count:int} items, ok=%{WORD:ok:bool}, (?P<rest>.*)\)$`,
+		`^%{IPV4:ip}$`,
+	})
+	config.Override("GrokErrorStream", "error")
+	plugin, err := core.NewPluginWithType("format.Grok", config)
+	expect.NoError(err)
+	formatter, casted := plugin.(*Grok)
+	expect.True(casted)
+
+	msg := core.NewMessage(nil, []byte("INFO took 12.5ms (3 items, ok=yes, done)"), 0)
+	result, streamID := formatter.Format(msg)
+	expect.Equal(`{"level":"INFO","duration":"12.5ms","count":3,"ok":null,"rest":"done"}`, string(result))
+	expect.Equal(msg.StreamID, streamID)
+
+	msg = core.NewMessage(nil, []byte("10.0.0.100"), 0)
+	result, _ = formatter.Format(msg)
+	expect.Equal(`{"ip":"10.0.0.100"}`, string(result))
+
+	msg = core.NewMessage(nil, []byte("no match"), 0)
+	result, streamID = formatter.Format(msg)
+	expect.Equal("no match", string(result))
+	expect.Equal(core.StreamRegistry.GetStreamID("error"), streamID)
+}
+
+func TestGrokInvalidPatterns(t *testing.T) {
+	expect := shared.NewExpect(t)
+
+	config := core.NewPluginConfig("")
+	config.Override("GrokPattern", "%{DOESNOTEXIST}")
+	_, err := core.NewPluginWithType("format.Grok", config)
+	expect.NotNil(err)
+
+	config.Override("GrokPattern", "%{INT:foo:date}")
+	_, err = core.NewPluginWithType("format.Grok", config)
+	expect.NotNil(err)
+
+	config.Override("GrokPattern", "(unbalanced")
+	_, err = core.NewPluginWithType("format.Grok", config)
+	expect.NotNil(err)
+}
+
+func TestGrokBundledPatterns(t *testing.T) {
+	expect := shared.NewExpect(t)
+	compiler := grokCompiler{patterns: grokPatterns}
+
+	for name := range grokPatterns {
+		_, _, err := compiler.compile("%{" + name + "}")
+		expect.NoError(err)
+	}
+}
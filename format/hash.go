@@ -0,0 +1,196 @@
+// Copyright 2015-2016 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package format
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/shared"
+	"hash"
+	"io/ioutil"
+	"strings"
+	"unicode/utf8"
+)
+
+// Hash formatter plugin
+// Hash is a formatter that computes a SHA-2 hash or HMAC of a message to make
+// modifications of messages detectable, e.g. for audit logs.
+// Configuration example
+//
+//  - "stream.Broadcast":
+//    Formatter: "format.Hash"
+//    HashDataFormatter: "format.Forward"
+//    HashAlgorithm: "sha256"
+//    HashKeyFile: ""
+//    HashEncoding: "hex"
+//    HashTarget: "append"
+//    HashSeparator: " "
+//    HashMetadataKey: "hash"
+//
+// HashDataFormatter defines a formatter that is applied before the hash is
+// computed. By default this is set to "format.Forward".
+//
+// HashAlgorithm defines the algorithm to use. By default this is set to
+// "sha256".
+//  * "sha256" computes a SHA-256 hash.
+//  * "sha512" computes a SHA-512 hash.
+//  * "hmac-sha256" computes an HMAC using SHA-256 and HashKeyFile.
+//  * "hmac-sha512" computes an HMAC using SHA-512 and HashKeyFile.
+//
+// HashKeyFile defines a file containing the secret key used by the HMAC
+// algorithms. A trailing line break is ignored. By default this is set to "".
+//
+// HashEncoding defines how the digest is written, either "hex" or "base64".
+// By default this is set to "hex".
+//
+// HashTarget defines where the digest is written to. By default this is set
+// to "append".
+//  * "append" appends HashSeparator and the digest to the message.
+//  * "metadata" stores the digest as metadata HashMetadataKey.
+//  * "envelope" replaces the message by a JSON object of the form
+//    {"algorithm":"sha256","hash":"<digest>","payload":"<message>"}. Messages
+//    that are not valid UTF-8 are stored base64 encoded as "payload_base64".
+//
+// HashSeparator defines the string placed between message and digest when
+// HashTarget is set to "append". By default this is set to " ".
+//
+// HashMetadataKey defines the metadata key used when HashTarget is set to
+// "metadata". By default this is set to "hash".
+type Hash struct {
+	base        core.Formatter
+	algorithm   string
+	newHash     func() hash.Hash
+	key         []byte
+	useBase64   bool
+	target      string
+	separator   string
+	metadataKey string
+}
+
+func init() {
+	shared.TypeRegistry.Register(Hash{})
+}
+
+// Configure initializes this formatter with values from a plugin config.
+func (format *Hash) Configure(conf core.PluginConfig) error {
+	plugin, err := core.NewPluginWithType(conf.GetString("HashDataFormatter", "format.Forward"), conf)
+	if err != nil {
+		return err
+	}
+	format.base = plugin.(core.Formatter)
+
+	format.algorithm = strings.ToLower(conf.GetString("HashAlgorithm", "sha256"))
+	switch format.algorithm {
+	case "sha256", "hmac-sha256":
+		format.newHash = sha256.New
+	case "sha512", "hmac-sha512":
+		format.newHash = sha512.New
+	default:
+		return fmt.Errorf("Unknown HashAlgorithm: %s", format.algorithm)
+	}
+
+	if strings.HasPrefix(format.algorithm, "hmac-") {
+		keyFile := conf.GetString("HashKeyFile", "")
+		if keyFile == "" {
+			return fmt.Errorf("HashKeyFile is required for %s", format.algorithm)
+		}
+		key, err := ioutil.ReadFile(keyFile)
+		if err != nil {
+			return err
+		}
+		if format.key = bytes.TrimRight(key, "\r\n"); len(format.key) == 0 {
+			return fmt.Errorf("HashKeyFile %s is empty", keyFile)
+		}
+	}
+
+	encoding := strings.ToLower(conf.GetString("HashEncoding", "hex"))
+	switch encoding {
+	case "hex":
+	case "base64":
+		format.useBase64 = true
+	default:
+		return fmt.Errorf("Unknown HashEncoding: %s", encoding)
+	}
+
+	format.target = strings.ToLower(conf.GetString("HashTarget", "append"))
+	switch format.target {
+	case "append", "metadata", "envelope":
+	default:
+		return fmt.Errorf("Unknown HashTarget: %s", format.target)
+	}
+
+	format.separator = shared.Unescape(conf.GetString("HashSeparator", " "))
+	format.metadataKey = conf.GetString("HashMetadataKey", "hash")
+	if format.target == "metadata" {
+		core.RegisterMetadataWriter()
+	}
+	return nil
+}
+
+// digest returns the encoded hash or HMAC of data.
+func (format *Hash) digest(data []byte) string {
+	var hasher hash.Hash
+	if format.key != nil {
+		hasher = hmac.New(format.newHash, format.key)
+	} else {
+		hasher = format.newHash()
+	}
+	hasher.Write(data)
+	sum := hasher.Sum(nil)
+
+	if format.useBase64 {
+		return base64.StdEncoding.EncodeToString(sum)
+	}
+	return hex.EncodeToString(sum)
+}
+
+// Format returns the message with its digest attached
+func (format *Hash) Format(msg core.Message) ([]byte, core.MessageStreamID) {
+	data, streamID := format.base.Format(msg)
+	digest := format.digest(data)
+
+	switch format.target {
+	case "metadata":
+		msg.SetMetadata(format.metadataKey, digest)
+		return data, streamID
+
+	case "envelope":
+		buffer := bytes.NewBufferString(`{"algorithm":`)
+		writeJSONString(buffer, format.algorithm)
+		buffer.WriteString(`,"hash":`)
+		writeJSONString(buffer, digest)
+		if utf8.Valid(data) {
+			buffer.WriteString(`,"payload":`)
+			writeJSONString(buffer, string(data))
+		} else {
+			buffer.WriteString(`,"payload_base64":`)
+			writeJSONString(buffer, base64.StdEncoding.EncodeToString(data))
+		}
+		buffer.WriteByte('}')
+		return buffer.Bytes(), streamID
+
+	default:
+		payload := make([]byte, 0, len(data)+len(format.separator)+len(digest))
+		payload = append(payload, data...)
+		payload = append(payload, format.separator...)
+		return append(payload, digest...), streamID
+	}
+}
@@ -0,0 +1,86 @@
+// Copyright 2015-2016 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package format
+
+import (
+	"encoding/json"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/shared"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestHash(t *testing.T) {
+	expect := shared.NewExpect(t)
+
+	config := core.NewPluginConfig("")
+	plugin, err := core.NewPluginWithType("format.Hash", config)
+	expect.NoError(err)
+	formatter, casted := plugin.(*Hash)
+	expect.True(casted)
+
+	msg := core.NewMessage(nil, []byte("abc"), 0)
+	result, _ := formatter.Format(msg)
+	expect.Equal("abc ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad", string(result))
+
+	config.Override("HashAlgorithm", "sha512")
+	config.Override("HashEncoding", "base64")
+	config.Override("HashTarget", "metadata")
+	config.Override("HashMetadataKey", "sha")
+	plugin, err = core.NewPluginWithType("format.Hash", config)
+	expect.NoError(err)
+	formatter, casted = plugin.(*Hash)
+	expect.True(casted)
+
+	msg.PrepareMetadata()
+	result, _ = formatter.Format(msg)
+	expect.Equal("abc", string(result))
+	expect.MapEqual(msg.Metadata, "sha", "3a81oZNherrMQXNJriBBMRLm+k6JqX6iCp7u5ktV05ohkpkqJ0/BqDa6PCOj/uu9RU1EI2Q86A4qmslPpUyknw==")
+}
+
+func TestHashHMAC(t *testing.T) {
+	expect := shared.NewExpect(t)
+
+	keyFile, err := ioutil.TempFile("", "gollum_hash")
+	expect.NoError(err)
+	defer os.Remove(keyFile.Name())
+	keyFile.WriteString("key\n")
+	keyFile.Close()
+
+	config := core.NewPluginConfig("")
+	config.Override("HashAlgorithm", "hmac-sha256")
+	config.Override("HashKeyFile", keyFile.Name())
+	config.Override("HashTarget", "envelope")
+	plugin, err := core.NewPluginWithType("format.Hash", config)
+	expect.NoError(err)
+	formatter, casted := plugin.(*Hash)
+	expect.True(casted)
+
+	msg := core.NewMessage(nil, []byte("The quick brown fox jumps over the lazy dog"), 0)
+	result, _ := formatter.Format(msg)
+	expect.Equal(`{"algorithm":"hmac-sha256","hash":"f7bc83f430538424b13298e6aa6fb143ef4d59a14946175997479dbc2d1a3cd8","payload":"The quick brown fox jumps over the lazy dog"}`, string(result))
+
+	msg = core.NewMessage(nil, []byte{0xff, 0xfe}, 0)
+	result, _ = formatter.Format(msg)
+	envelope := make(map[string]string)
+	expect.NoError(json.Unmarshal(result, &envelope))
+	expect.Equal("//4=", envelope["payload_base64"])
+
+	config = core.NewPluginConfig("")
+	config.Override("HashAlgorithm", "hmac-sha512")
+	_, err = core.NewPluginWithType("format.Hash", config)
+	expect.NotNil(err)
+}
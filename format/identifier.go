@@ -15,38 +15,68 @@
 package format
 
 import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
 	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/core/log"
 	"github.com/trivago/gollum/shared"
 	"hash/fnv"
 	"strconv"
 	"strings"
 )
 
+// crockfordBase32 is the alphabet used by ULIDs
+const crockfordBase32 = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
 // Identifier formatter plugin
 // Identifier is a formatter that will generate a (mostly) unique 64 bit
 // identifier number from the message timestamp and sequence number. The message
-// payload will not be encoded.
+// payload will not be encoded. Alternatively random UUIDs or ULIDs can be
+// generated and added to the message instead of replacing it.
 // Configuration example
 //
 //  - "stream.Broadcast":
 //    Formatter: "format.Identifier"
 //    IdentifierType: "hash"
 //    IdentifierDataFormatter: "format.Forward"
+//    IdentifierTarget: "payload"
+//    IdentifierKey: "id"
 //
 // IdentifierType defines the algorithm used to generate the message id.
-// This my be one of the following: "hash", "time", "seq", "seqhex".
-// By default this is set to "time".
+// This my be one of the following: "hash", "time", "seq", "seqhex", "uuid4",
+// "uuid7", "ulid". "uuidv4" and "uuidv7" are accepted as aliases of "uuid4"
+// and "uuid7". By default this is set to "time".
 //  * When using "hash" the message payload will be hashed using fnv1a and returned as hex.
 //  * When using "time" the id will be formatted YYMMDDHHmmSSxxxxxxx where x denotes the sequence number modulo 10000000.
 //    I.e. 10mil messages per second are possible before there is a collision.
 //  * When using "seq" the id will be returned as the integer representation of the sequence number.
 //  * When using "seqhex" the id will be returned as the hex representation of the sequence number.
+//  * When using "uuid4" a random UUID version 4 will be returned.
+//  * When using "uuid7" a UUID version 7 based on the message timestamp will be returned.
+//    These UUIDs are sortable by time.
+//  * When using "ulid" a ULID based on the message timestamp will be returned.
 //
 // IdentifierDataFormatter defines the formatter for the data that is used to
 // build the identifier from. By default this is set to "format.Forward"
+//
+// IdentifierTarget defines where the identifier is stored.
+// By default this is set to "payload".
+//  * "payload" replaces the message by the identifier.
+//  * "metadata" stores the identifier as metadata named IdentifierKey.
+//  * "json" stores the identifier in the field IdentifierKey of a JSON object.
+//    Messages that are no JSON object are passed on unchanged.
+//
+// IdentifierKey defines the metadata key or JSON field used by the "metadata"
+// and "json" targets. By default this is set to "id".
 type Identifier struct {
-	base core.Formatter
-	hash func(msg core.Message) []byte
+	base   core.Formatter
+	hash   func(msg core.Message) []byte
+	target string
+	key    string
 }
 
 func init() {
@@ -68,10 +98,26 @@ func (format *Identifier) Configure(conf core.PluginConfig) error {
 		format.hash = format.idSeq
 	case "seqhex":
 		format.hash = format.idSeqHex
-	default:
-		fallthrough
+	case "uuid4", "uuidv4":
+		format.hash = format.idUUID4
+	case "uuid7", "uuidv7":
+		format.hash = format.idUUID7
+	case "ulid":
+		format.hash = format.idULID
 	case "time":
 		format.hash = format.idTime
+	default:
+		return fmt.Errorf("Unknown IdentifierType: %s", conf.GetString("IdentifierType", "time"))
+	}
+
+	format.key = conf.GetString("IdentifierKey", "id")
+	format.target = strings.ToLower(conf.GetString("IdentifierTarget", "payload"))
+	switch format.target {
+	case "payload", "json":
+	case "metadata":
+		core.RegisterMetadataWriter()
+	default:
+		return fmt.Errorf("Unknown IdentifierTarget: %s", format.target)
 	}
 	return nil
 }
@@ -94,9 +140,96 @@ func (format *Identifier) idSeqHex(msg core.Message) []byte {
 	return []byte(strconv.FormatUint(msg.Sequence, 16))
 }
 
+// formatUUID writes 16 bytes as UUID string after setting version and variant.
+func formatUUID(uuid []byte, version byte) []byte {
+	uuid[6] = (uuid[6] & 0x0F) | version<<4
+	uuid[8] = (uuid[8] & 0x3F) | 0x80
+
+	result := make([]byte, 36)
+	hex.Encode(result[0:8], uuid[0:4])
+	result[8] = '-'
+	hex.Encode(result[9:13], uuid[4:6])
+	result[13] = '-'
+	hex.Encode(result[14:18], uuid[6:8])
+	result[18] = '-'
+	hex.Encode(result[19:23], uuid[8:10])
+	result[23] = '-'
+	hex.Encode(result[24:], uuid[10:])
+	return result
+}
+
+// timestampedRandom returns 16 bytes starting with the 48 bit unix timestamp
+// of the message in milliseconds followed by random bytes.
+func timestampedRandom(msg core.Message) []byte {
+	data := make([]byte, 16)
+	rand.Read(data[6:])
+
+	millis := make([]byte, 8)
+	binary.BigEndian.PutUint64(millis, uint64(msg.Timestamp.UnixNano()/1000000))
+	copy(data[:6], millis[2:])
+	return data
+}
+
+func (format *Identifier) idUUID4(msg core.Message) []byte {
+	uuid := make([]byte, 16)
+	rand.Read(uuid)
+	return formatUUID(uuid, 4)
+}
+
+func (format *Identifier) idUUID7(msg core.Message) []byte {
+	return formatUUID(timestampedRandom(msg), 7)
+}
+
+func (format *Identifier) idULID(msg core.Message) []byte {
+	data := timestampedRandom(msg)
+	high := binary.BigEndian.Uint64(data[:8])
+	low := binary.BigEndian.Uint64(data[8:])
+
+	// 128 bits are encoded as 26 characters of 5 bits each, starting with 3 bits
+	result := make([]byte, 26)
+	for i := 25; i >= 0; i-- {
+		result[i] = crockfordBase32[low&0x1F]
+		low = low>>5 | high<<59
+		high >>= 5
+	}
+	return result
+}
+
+// addToJSON stores the identifier in the given JSON object.
+func (format *Identifier) addToJSON(data []byte, id []byte) ([]byte, error) {
+	trimmed := bytes.TrimSpace(data)
+	if len(trimmed) == 0 || trimmed[0] != '{' || !json.Valid(trimmed) {
+		return nil, fmt.Errorf("Message is not a JSON object")
+	}
+
+	root, err := parseJSONNode(trimmed)
+	if err != nil {
+		return nil, err
+	}
+	root.setNode([]string{format.key}, &splitToJSONNode{value: string(id)})
+	return root.MarshalJSON()
+}
+
 // Format generates a unique identifier from the message contents or metadata.
 func (format *Identifier) Format(msg core.Message) ([]byte, core.MessageStreamID) {
 	dataMsg := msg
 	dataMsg.Data, dataMsg.StreamID = format.base.Format(msg)
-	return format.hash(dataMsg), dataMsg.StreamID
+	id := format.hash(dataMsg)
+
+	switch format.target {
+	case "metadata":
+		msg.SetMetadata(format.key, string(id))
+		return dataMsg.Data, dataMsg.StreamID
+
+	case "json":
+		result, err := format.addToJSON(dataMsg.Data, id)
+		if err != nil {
+			Log.Warning.Print("Identifier failed to add an identifier: ", err)
+			return dataMsg.Data, dataMsg.StreamID // ### return, no JSON object ###
+		}
+		return result, dataMsg.StreamID
+
+	default:
+		return id, dataMsg.StreamID
+	}
 }
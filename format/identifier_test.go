@@ -0,0 +1,95 @@
+// Copyright 2015-2016 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package format
+
+import (
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/shared"
+	"regexp"
+	"testing"
+	"time"
+)
+
+func TestIdentifierUUID(t *testing.T) {
+	expect := shared.NewExpect(t)
+	msg := core.NewMessage(nil, []byte("test"), 10)
+	msg.Timestamp = time.Unix(1500000000, 0)
+
+	patterns := map[string]string{
+		"uuid4":  `^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`,
+		"uuidv4": `^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`,
+		"uuid7":  `^015d3ef7-9800-7[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`,
+		"uuidv7": `^015d3ef7-9800-7[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`,
+		"ulid":   `^01BMZFF600[0-9A-HJKMNP-TV-Z]{16}$`,
+	}
+
+	for idType, pattern := range patterns {
+		config := core.NewPluginConfig("")
+		config.Override("IdentifierType", idType)
+		config.Override("IdentifierTarget", "payload")
+		plugin, err := core.NewPluginWithType("format.Identifier", config)
+		expect.NoError(err)
+		formatter, casted := plugin.(*Identifier)
+		expect.True(casted)
+
+		result, _ := formatter.Format(msg)
+		expect.True(regexp.MustCompile(pattern).Match(result))
+	}
+}
+
+func TestIdentifierType(t *testing.T) {
+	expect := shared.NewExpect(t)
+
+	config := core.NewPluginConfig("")
+	config.Override("IdentifierType", "uuid")
+	_, err := core.NewPluginWithType("format.Identifier", config)
+	expect.NotNil(err)
+
+	config.Override("IdentifierType", "TIME")
+	_, err = core.NewPluginWithType("format.Identifier", config)
+	expect.NoError(err)
+}
+
+func TestIdentifierTarget(t *testing.T) {
+	expect := shared.NewExpect(t)
+	msg := core.NewMessage(nil, []byte(`{"a":1}`), 10)
+
+	config := core.NewPluginConfig("")
+	config.Override("IdentifierType", "seq")
+	config.Override("IdentifierTarget", "metadata")
+	plugin, err := core.NewPluginWithType("format.Identifier", config)
+	expect.NoError(err)
+	formatter, casted := plugin.(*Identifier)
+	expect.True(casted)
+
+	msg.PrepareMetadata()
+	result, _ := formatter.Format(msg)
+	expect.Equal(`{"a":1}`, string(result))
+	expect.Equal("10", msg.Metadata["id"])
+
+	config.Override("IdentifierType", "seqhex")
+	config.Override("IdentifierTarget", "json")
+	plugin, err = core.NewPluginWithType("format.Identifier", config)
+	expect.NoError(err)
+	formatter, casted = plugin.(*Identifier)
+	expect.True(casted)
+
+	result, _ = formatter.Format(msg)
+	expect.Equal(`{"a":1,"id":"a"}`, string(result))
+
+	msg = core.NewMessage(nil, []byte(`no json`), 10)
+	result, _ = formatter.Format(msg)
+	expect.Equal(`no json`, string(result))
+}
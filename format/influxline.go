@@ -0,0 +1,301 @@
+// Copyright 2015-2016 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package format
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/core/log"
+	"github.com/trivago/gollum/shared"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// InfluxLine formatter plugin
+// InfluxLine is a formatter that converts a JSON object into one line of the
+// InfluxDB line protocol, e.g. to write metrics extracted from logs to
+// InfluxDB or Telegraf. Nested fields can be accessed by using "/" as a
+// separator, array elements by using "[<index>]".
+// Configuration example
+//
+//  - "stream.Broadcast":
+//    Formatter: "format.InfluxLine"
+//    InfluxLineDataFormatter: "format.Forward"
+//    InfluxLineMeasurement: "gollum"
+//    InfluxLineMeasurementField: ""
+//    InfluxLineTags:
+//      "host": "host"
+//    InfluxLineFields:
+//      "response/time": "latency"
+//    InfluxLineIntegers: false
+//    InfluxLineTimestampField: ""
+//    InfluxLineTimestampFormat: "ms"
+//    InfluxLinePrecision: "ns"
+//    InfluxLineErrorStream: ""
+//
+// InfluxLineDataFormatter defines a formatter that is applied before the
+// message is converted. By default this is set to "format.Forward".
+//
+// InfluxLineMeasurement defines the name of the measurement. By default this is
+// set to "gollum".
+//
+// InfluxLineMeasurementField defines a field to read the measurement name from.
+// If the field does not exist, InfluxLineMeasurement is used. By default this
+// is set to "".
+//
+// InfluxLineTags defines a map of field paths to tag keys. Tags are written in
+// order of their keys. Fields that do not exist are not written. By default
+// this map is empty.
+//
+// InfluxLineFields defines a map of field paths to field keys. Numbers,
+// booleans and strings are supported. By default this map is empty and all
+// top-level fields with a supported type that are not used otherwise are
+// written.
+//
+// InfluxLineIntegers can be set to true to write numbers without decimal
+// places as integers. By default this is set to false, i.e. all numbers are
+// written as floats.
+//
+// InfluxLineTimestampField defines a field to read the timestamp from. If the
+// field does not exist, the message timestamp is used. By default this is set
+// to "".
+//
+// InfluxLineTimestampFormat defines the format of InfluxLineTimestampField.
+// Numbers can be given in "s", "ms", "us" or "ns". All other values are used
+// as Go time layout, e.g. "2006-01-02T15:04:05Z07:00". By default this is set
+// to "ms".
+//
+// InfluxLinePrecision defines the precision of the written timestamp as "s",
+// "ms", "us" or "ns". This has to match the precision configured for writing
+// to InfluxDB. By default this is set to "ns".
+//
+// InfluxLineErrorStream defines a stream that messages are routed to if they
+// are not a JSON object, do not contain any field or have an invalid
+// timestamp. These messages are passed on unchanged. By default this is set to
+// "", i.e. a warning is logged and the message stays on its stream.
+type InfluxLine struct {
+	base             core.Formatter
+	measurement      string
+	measurementField string
+	tags             []influxLineKey
+	fields           []influxLineKey
+	integers         bool
+	timestampField   string
+	timestampFormat  string
+	precision        time.Duration
+	errorStreamID    core.MessageStreamID
+	measureEscape    *strings.Replacer
+	keyEscape        *strings.Replacer
+	stringEscape     *strings.Replacer
+}
+
+type influxLineKey struct {
+	path string
+	key  string
+}
+
+// influxLineUnits maps precision names to durations
+var influxLineUnits = map[string]time.Duration{
+	"s":  time.Second,
+	"ms": time.Millisecond,
+	"us": time.Microsecond,
+	"ns": time.Nanosecond,
+}
+
+func init() {
+	shared.TypeRegistry.Register(InfluxLine{})
+}
+
+// Configure initializes this formatter with values from a plugin config.
+func (format *InfluxLine) Configure(conf core.PluginConfig) error {
+	plugin, err := core.NewPluginWithType(conf.GetString("InfluxLineDataFormatter", "format.Forward"), conf)
+	if err != nil {
+		return err
+	}
+	format.base = plugin.(core.Formatter)
+
+	format.measurement = conf.GetString("InfluxLineMeasurement", "gollum")
+	format.measurementField = conf.GetString("InfluxLineMeasurementField", "")
+	format.tags = newInfluxLineKeys(conf.GetStringMap("InfluxLineTags", map[string]string{}))
+	format.fields = newInfluxLineKeys(conf.GetStringMap("InfluxLineFields", map[string]string{}))
+	format.integers = conf.GetBool("InfluxLineIntegers", false)
+	format.timestampField = conf.GetString("InfluxLineTimestampField", "")
+	format.timestampFormat = conf.GetString("InfluxLineTimestampFormat", "ms")
+
+	precision := strings.ToLower(conf.GetString("InfluxLinePrecision", "ns"))
+	var known bool
+	if format.precision, known = influxLineUnits[precision]; !known {
+		return fmt.Errorf("Unknown InfluxLinePrecision: %s", precision)
+	}
+
+	format.errorStreamID = core.InvalidStreamID
+	if errorStream := conf.GetString("InfluxLineErrorStream", ""); errorStream != "" {
+		format.errorStreamID = core.StreamRegistry.GetStreamID(errorStream)
+	}
+
+	format.measureEscape = strings.NewReplacer("\\", "\\\\", ",", "\\,", " ", "\\ ", "\n", "\\n")
+	format.keyEscape = strings.NewReplacer("\\", "\\\\", ",", "\\,", "=", "\\=", " ", "\\ ", "\n", "\\n")
+	format.stringEscape = strings.NewReplacer("\\", "\\\\", "\"", "\\\"")
+	return nil
+}
+
+// newInfluxLineKeys converts a map of paths to keys to a list sorted by key.
+func newInfluxLineKeys(keys map[string]string) []influxLineKey {
+	result := make([]influxLineKey, 0, len(keys))
+	for path, key := range keys {
+		result = append(result, influxLineKey{path: path, key: key})
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].key < result[j].key })
+	return result
+}
+
+// timestamp returns the timestamp in the configured precision.
+func (format *InfluxLine) timestamp(values shared.MarshalMap, msgTime time.Time) (int64, error) {
+	value, exists := values.Path(format.timestampField)
+	if format.timestampField == "" || !exists {
+		return msgTime.UnixNano() / int64(format.precision), nil // ### return, message time ###
+	}
+
+	if unit, isNumeric := influxLineUnits[format.timestampFormat]; isNumeric {
+		number, err := strconv.ParseFloat(fmt.Sprint(value), 64)
+		if err != nil {
+			return 0, fmt.Errorf("Invalid timestamp %v", value)
+		}
+		return int64(number * float64(unit) / float64(format.precision)), nil
+	}
+
+	timeString, isString := value.(string)
+	if !isString {
+		return 0, fmt.Errorf("Invalid timestamp %v", value)
+	}
+	parsed, err := time.Parse(format.timestampFormat, timeString)
+	if err != nil {
+		return 0, err
+	}
+	return parsed.UnixNano() / int64(format.precision), nil
+}
+
+// appendField writes a field value. False is returned if the value type is
+// not supported.
+func (format *InfluxLine) appendField(buffer *bytes.Buffer, key string, value interface{}) bool {
+	var encoded string
+	switch typed := value.(type) {
+	case json.Number:
+		encoded = typed.String()
+		if format.integers && !strings.ContainsAny(encoded, ".eE") {
+			encoded += "i"
+		} else if _, err := strconv.ParseFloat(encoded, 64); err != nil {
+			return false
+		}
+	case bool:
+		encoded = strconv.FormatBool(typed)
+	case string:
+		encoded = "\"" + format.stringEscape.Replace(typed) + "\""
+	default:
+		return false
+	}
+
+	if buffer.Len() > 0 {
+		buffer.WriteByte(',')
+	}
+	buffer.WriteString(format.keyEscape.Replace(key))
+	buffer.WriteByte('=')
+	buffer.WriteString(encoded)
+	return true
+}
+
+// convert returns the line protocol representation of a JSON object.
+func (format *InfluxLine) convert(data []byte, msgTime time.Time) ([]byte, error) {
+	values := shared.NewMarshalMap()
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(&values); err != nil {
+		return nil, err
+	}
+
+	measurement := format.measurement
+	if format.measurementField != "" {
+		if value, exists := values.Path(format.measurementField); exists {
+			measurement = fmt.Sprint(value)
+		}
+	}
+
+	line := bytes.NewBufferString(format.measureEscape.Replace(measurement))
+	used := map[string]bool{format.measurementField: true, format.timestampField: true}
+	for _, tag := range format.tags {
+		used[tag.path] = true
+		if value, exists := values.Path(tag.path); exists {
+			tagValue, err := jsonValueString(value)
+			if err != nil || tagValue == "" {
+				continue // ### continue, empty tags are not allowed ###
+			}
+			line.WriteByte(',')
+			line.WriteString(format.keyEscape.Replace(tag.key))
+			line.WriteByte('=')
+			line.WriteString(format.keyEscape.Replace(tagValue))
+		}
+	}
+
+	fields := format.fields
+	if len(fields) == 0 {
+		for key := range values {
+			if !used[key] {
+				fields = append(fields, influxLineKey{path: key, key: key})
+			}
+		}
+		sort.Slice(fields, func(i, j int) bool { return fields[i].key < fields[j].key })
+	}
+
+	fieldSet := bytes.NewBuffer(nil)
+	for _, field := range fields {
+		if value, exists := values.Path(field.path); exists {
+			format.appendField(fieldSet, field.key, value)
+		}
+	}
+	if fieldSet.Len() == 0 {
+		return nil, fmt.Errorf("Message does not contain any field")
+	}
+
+	timestamp, err := format.timestamp(values, msgTime)
+	if err != nil {
+		return nil, err
+	}
+
+	line.WriteByte(' ')
+	line.Write(fieldSet.Bytes())
+	line.WriteByte(' ')
+	line.WriteString(strconv.FormatInt(timestamp, 10))
+	return line.Bytes(), nil
+}
+
+// Format returns the message as line protocol
+func (format *InfluxLine) Format(msg core.Message) ([]byte, core.MessageStreamID) {
+	data, streamID := format.base.Format(msg)
+
+	result, err := format.convert(data, msg.Timestamp)
+	if err != nil {
+		if format.errorStreamID != core.InvalidStreamID {
+			return data, format.errorStreamID // ### return, route to error stream ###
+		}
+		Log.Warning.Print("InfluxLine failed to convert a message: ", err)
+		return data, streamID
+	}
+
+	return result, streamID
+}
@@ -0,0 +1,76 @@
+// Copyright 2015-2016 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package format
+
+import (
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/shared"
+	"testing"
+	"time"
+)
+
+func TestInfluxLine(t *testing.T) {
+	expect := shared.NewExpect(t)
+
+	config := core.NewPluginConfig("")
+	config.Override("InfluxLineMeasurementField", "metric")
+	config.Override("InfluxLineTags", map[interface{}]interface{}{
+		"host":        "host",
+		"request/dc":  "data center",
+		"request/foo": "missing",
+	})
+	config.Override("InfluxLineIntegers", true)
+	config.Override("InfluxLineTimestampField", "ts")
+	config.Override("InfluxLineTimestampFormat", "s")
+	config.Override("InfluxLinePrecision", "ms")
+	config.Override("InfluxLineErrorStream", "error")
+	plugin, err := core.NewPluginWithType("format.InfluxLine", config)
+	expect.NoError(err)
+	formatter, casted := plugin.(*InfluxLine)
+	expect.True(casted)
+
+	msg := core.NewMessage(nil, []byte(`{"metric":"http requests","host":"web,1","request":{"dc":"eu"},"status":200,"latency":0.25,"ok":true,"path":"/a \"b\"","ts":1500000000}`), 0)
+	result, streamID := formatter.Format(msg)
+	expect.Equal(`http\ requests,data\ center=eu,host=web\,1 latency=0.25,ok=true,path="/a \"b\"",status=200i 1500000000000`, string(result))
+	expect.Equal(msg.StreamID, streamID)
+
+	msg = core.NewMessage(nil, []byte(`{"host":"web1"}`), 0)
+	_, streamID = formatter.Format(msg)
+	expect.Equal(core.StreamRegistry.GetStreamID("error"), streamID)
+}
+
+func TestInfluxLineFields(t *testing.T) {
+	expect := shared.NewExpect(t)
+
+	config := core.NewPluginConfig("")
+	config.Override("InfluxLineFields", map[interface{}]interface{}{
+		"response/time": "latency",
+		"status":        "status",
+	})
+	config.Override("InfluxLineTimestampField", "time")
+	config.Override("InfluxLineTimestampFormat", "2006-01-02T15:04:05Z07:00")
+	plugin, err := core.NewPluginWithType("format.InfluxLine", config)
+	expect.NoError(err)
+	formatter := plugin.(*InfluxLine)
+
+	msg := core.NewMessage(nil, []byte(`{"status":200,"response":{"time":12},"other":1,"time":"2017-07-14T02:40:00Z"}`), 0)
+	result, _ := formatter.Format(msg)
+	expect.Equal(`gollum latency=12,status=200 1500000000000000000`, string(result))
+
+	msg = core.NewMessage(nil, []byte(`{"status":200}`), 0)
+	msg.Timestamp = time.Unix(10, 0)
+	result, _ = formatter.Format(msg)
+	expect.Equal(`gollum status=200 10000000000`, string(result))
+}
@@ -0,0 +1,166 @@
+// Copyright 2015-2016 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package format
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/shared"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+var (
+	jsonEnvelopeInstanceID   string
+	jsonEnvelopeInstanceOnce sync.Once
+)
+
+// JSONEnvelope formatter plugin
+// JSONEnvelope is a formatter that wraps messages into a JSON object that
+// allows detecting message loss and reordering downstream, e.g.
+// {"host":"web1","instance":"3f2a...","stream":"access","sequence":42,
+// "received":"2016-10-14T12:00:00.123456789Z","payload":"..."}.
+// The sequence number is counted per stream and formatter and starts at 1.
+// Together with the instance ID, which changes on every restart of gollum,
+// gaps in the sequence indicate lost messages.
+// This formatter is not to be confused with format.Envelope, which adds a
+// prefix and postfix to messages.
+// Configuration example
+//
+//  - "stream.Broadcast":
+//    Formatter: "format.JSONEnvelope"
+//    JSONEnvelopeDataFormatter: "format.Forward"
+//    JSONEnvelopeInstanceID: ""
+//    JSONEnvelopeEmbedJSON: true
+//    JSONEnvelopeMetadata: false
+//
+// JSONEnvelopeDataFormatter defines a formatter that is applied before the
+// message is wrapped. By default this is set to "format.Forward".
+//
+// JSONEnvelopeInstanceID defines the ID written as "instance". By default this
+// is set to "", which uses a random ID generated when gollum starts.
+//
+// JSONEnvelopeEmbedJSON can be set to false to always write the message as
+// string. If set to true messages that are valid JSON are embedded as is.
+// Messages that are not valid UTF-8 are always written base64 encoded as
+// "payload_base64". By default this is set to true.
+//
+// JSONEnvelopeMetadata can be set to true to add the metadata of the message
+// as object "metadata". By default this is set to false.
+type JSONEnvelope struct {
+	base          core.Formatter
+	hostname      string
+	instanceID    string
+	embedJSON     bool
+	addMetadata   bool
+	sequence      map[core.MessageStreamID]uint64
+	sequenceGuard *sync.Mutex
+}
+
+func init() {
+	shared.TypeRegistry.Register(JSONEnvelope{})
+}
+
+// Configure initializes this formatter with values from a plugin config.
+func (format *JSONEnvelope) Configure(conf core.PluginConfig) error {
+	plugin, err := core.NewPluginWithType(conf.GetString("JSONEnvelopeDataFormatter", "format.Forward"), conf)
+	if err != nil {
+		return err
+	}
+	format.base = plugin.(core.Formatter)
+
+	format.hostname, _ = os.Hostname()
+	format.instanceID = conf.GetString("JSONEnvelopeInstanceID", "")
+	if format.instanceID == "" {
+		jsonEnvelopeInstanceOnce.Do(func() {
+			id := make([]byte, 8)
+			rand.Read(id)
+			jsonEnvelopeInstanceID = hex.EncodeToString(id)
+		})
+		format.instanceID = jsonEnvelopeInstanceID
+	}
+
+	format.embedJSON = conf.GetBool("JSONEnvelopeEmbedJSON", true)
+	format.addMetadata = conf.GetBool("JSONEnvelopeMetadata", false)
+	format.sequence = make(map[core.MessageStreamID]uint64)
+	format.sequenceGuard = new(sync.Mutex)
+	return nil
+}
+
+// nextSequence returns the next sequence number of the given stream.
+func (format *JSONEnvelope) nextSequence(streamID core.MessageStreamID) uint64 {
+	format.sequenceGuard.Lock()
+	defer format.sequenceGuard.Unlock()
+	format.sequence[streamID]++
+	return format.sequence[streamID]
+}
+
+// Format returns the message wrapped into a JSON envelope
+func (format *JSONEnvelope) Format(msg core.Message) ([]byte, core.MessageStreamID) {
+	data, streamID := format.base.Format(msg)
+
+	buffer := bytes.NewBufferString(`{"host":`)
+	writeJSONString(buffer, format.hostname)
+	buffer.WriteString(`,"instance":`)
+	writeJSONString(buffer, format.instanceID)
+	buffer.WriteString(`,"stream":`)
+	writeJSONString(buffer, core.StreamRegistry.GetStreamName(msg.StreamID))
+	buffer.WriteString(`,"sequence":`)
+	buffer.WriteString(strconv.FormatUint(format.nextSequence(msg.StreamID), 10))
+	buffer.WriteString(`,"received":`)
+	writeJSONString(buffer, msg.Timestamp.UTC().Format(time.RFC3339Nano))
+
+	if format.addMetadata {
+		keys := make([]string, 0, len(msg.Metadata))
+		for key := range msg.Metadata {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		buffer.WriteString(`,"metadata":{`)
+		for i, key := range keys {
+			if i > 0 {
+				buffer.WriteByte(',')
+			}
+			writeJSONString(buffer, key)
+			buffer.WriteByte(':')
+			writeJSONString(buffer, msg.Metadata[key])
+		}
+		buffer.WriteByte('}')
+	}
+
+	switch {
+	case format.embedJSON && json.Valid(data):
+		buffer.WriteString(`,"payload":`)
+		json.Compact(buffer, data)
+	case utf8.Valid(data):
+		buffer.WriteString(`,"payload":`)
+		writeJSONString(buffer, string(data))
+	default:
+		buffer.WriteString(`,"payload_base64":`)
+		writeJSONString(buffer, base64.StdEncoding.EncodeToString(data))
+	}
+
+	buffer.WriteByte('}')
+	return buffer.Bytes(), streamID
+}
@@ -0,0 +1,87 @@
+// Copyright 2015-2016 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package format
+
+import (
+	"encoding/json"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/shared"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestJSONEnvelope(t *testing.T) {
+	expect := shared.NewExpect(t)
+
+	config := core.NewPluginConfig("")
+	config.Override("JSONEnvelopeInstanceID", "test")
+	config.Override("JSONEnvelopeMetadata", true)
+	plugin, err := core.NewPluginWithType("format.JSONEnvelope", config)
+	expect.NoError(err)
+	formatter, casted := plugin.(*JSONEnvelope)
+	expect.True(casted)
+
+	hostname, _ := os.Hostname()
+	hostJSON, _ := json.Marshal(hostname)
+
+	msg := core.NewMessage(nil, []byte(`{ "a": 1 }`), 0)
+	msg.StreamID = core.StreamRegistry.GetStreamID("access")
+	msg.Timestamp = time.Date(2016, 10, 14, 12, 0, 0, 5, time.UTC)
+	msg.SetMetadata("b", "2")
+	msg.SetMetadata("a", "1")
+
+	result, streamID := formatter.Format(msg)
+	expect.Equal(`{"host":`+string(hostJSON)+`,"instance":"test","stream":"access","sequence":1,"received":"2016-10-14T12:00:00.000000005Z","metadata":{"a":"1","b":"2"},"payload":{"a":1}}`, string(result))
+	expect.Equal(msg.StreamID, streamID)
+
+	envelope := make(map[string]interface{})
+	result, _ = formatter.Format(msg)
+	expect.NoError(json.Unmarshal(result, &envelope))
+	expect.Equal(float64(2), envelope["sequence"])
+
+	msg.StreamID = core.StreamRegistry.GetStreamID("other")
+	msg.Data = []byte("text")
+	result, _ = formatter.Format(msg)
+	expect.NoError(json.Unmarshal(result, &envelope))
+	expect.Equal(float64(1), envelope["sequence"])
+	expect.Equal("text", envelope["payload"])
+
+	msg.Data = []byte{0xff}
+	result, _ = formatter.Format(msg)
+	expect.NoError(json.Unmarshal(result, &envelope))
+	expect.Equal("/w==", envelope["payload_base64"])
+}
+
+func TestJSONEnvelopeInstanceID(t *testing.T) {
+	expect := shared.NewExpect(t)
+
+	config := core.NewPluginConfig("")
+	config.Override("JSONEnvelopeEmbedJSON", false)
+	plugin1, err := core.NewPluginWithType("format.JSONEnvelope", config)
+	expect.NoError(err)
+	plugin2, err := core.NewPluginWithType("format.JSONEnvelope", config)
+	expect.NoError(err)
+
+	formatter1 := plugin1.(*JSONEnvelope)
+	formatter2 := plugin2.(*JSONEnvelope)
+	expect.Equal(16, len(formatter1.instanceID))
+	expect.Equal(formatter1.instanceID, formatter2.instanceID)
+
+	envelope := make(map[string]interface{})
+	result, _ := formatter1.Format(core.NewMessage(nil, []byte(`{"a":1}`), 0))
+	expect.NoError(json.Unmarshal(result, &envelope))
+	expect.Equal(`{"a":1}`, envelope["payload"])
+}
@@ -0,0 +1,155 @@
+// Copyright 2015-2016 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package format
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/core/log"
+	"github.com/trivago/gollum/shared"
+	"strings"
+)
+
+// JSONParse formatter plugin
+// JSONParse is a formatter that parses a JSON message and stores selected
+// fields as message metadata. This allows subsequent formatters, filters and
+// producers to access these fields without parsing the message again.
+// Optionally the message can be replaced by a JSON object containing only a
+// subset of the fields.
+// Messages that are not a valid JSON object are passed on unchanged.
+// Configuration example
+//
+//  - "stream.Broadcast":
+//    Formatter: "format.JSONParse"
+//    JSONParseDataFormatter: "format.Forward"
+//    JSONParseMetadata:
+//      "user/name": "user"
+//      "status": "status"
+//    JSONParseFields:
+//      - "user/name"
+//      - "status"
+//    JSONParseErrorStream: ""
+//
+// JSONParseDataFormatter defines a formatter that is applied before the
+// message is parsed. By default this is set to "format.Forward".
+//
+// JSONParseMetadata defines a map of field paths to metadata keys. Nested
+// fields can be accessed by using "/" as a separator, array elements by using
+// "[<index>]", e.g. "users[0]name". String values are stored as is, all other
+// values are stored as JSON. Fields that do not exist are not stored.
+// By default this map is empty.
+//
+// JSONParseFields defines a list of field paths to keep in the message. If set,
+// the message is replaced by a JSON object that contains only these fields in
+// the given order. Nested fields are stored as nested objects. Fields that do
+// not exist are omitted. By default this list is empty and the message is
+// passed on unchanged.
+//
+// JSONParseErrorStream defines a stream that messages which cannot be parsed
+// are routed to. By default this is set to "", i.e. a warning is logged and
+// the message stays on its stream.
+type JSONParse struct {
+	base          core.Formatter
+	metadata      map[string]string
+	fields        []string
+	errorStreamID core.MessageStreamID
+}
+
+func init() {
+	shared.TypeRegistry.Register(JSONParse{})
+}
+
+// Configure initializes this formatter with values from a plugin config.
+func (format *JSONParse) Configure(conf core.PluginConfig) error {
+	plugin, err := core.NewPluginWithType(conf.GetString("JSONParseDataFormatter", "format.Forward"), conf)
+	if err != nil {
+		return err
+	}
+
+	format.base = plugin.(core.Formatter)
+	format.metadata = conf.GetStringMap("JSONParseMetadata", map[string]string{})
+	if len(format.metadata) > 0 {
+		core.RegisterMetadataWriter()
+	}
+	format.fields = conf.GetStringArray("JSONParseFields", []string{})
+
+	format.errorStreamID = core.InvalidStreamID
+	if errorStream := conf.GetString("JSONParseErrorStream", ""); errorStream != "" {
+		format.errorStreamID = core.StreamRegistry.GetStreamID(errorStream)
+	}
+
+	return nil
+}
+
+// jsonValueString converts a parsed JSON value to a string. Strings are
+// returned as is, all other values as JSON.
+func jsonValueString(value interface{}) (string, error) {
+	if str, isString := value.(string); isString {
+		return str, nil // ### return, plain string ###
+	}
+
+	buffer := bytes.NewBuffer(nil)
+	encoder := json.NewEncoder(buffer)
+	encoder.SetEscapeHTML(false)
+	err := encoder.Encode(value)
+	return strings.TrimRight(buffer.String(), "\n"), err
+}
+
+// Format stores the configured fields as metadata and optionally replaces the
+// payload by a projection of the parsed JSON object
+func (format *JSONParse) Format(msg core.Message) ([]byte, core.MessageStreamID) {
+	data, streamID := format.base.Format(msg)
+
+	values := shared.NewMarshalMap()
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(&values); err != nil {
+		if format.errorStreamID != core.InvalidStreamID {
+			return data, format.errorStreamID // ### return, route to error stream ###
+		}
+		Log.Warning.Print("JSONParse failed to unmarshal a message: ", err)
+		return data, streamID // ### return, malformed data ###
+	}
+
+	for path, key := range format.metadata {
+		if value, exists := values.Path(path); exists {
+			metaValue, err := jsonValueString(value)
+			if err != nil {
+				Log.Warning.Print("JSONParse failed to convert field ", path, ": ", err)
+				continue // ### continue, unsupported value ###
+			}
+			msg.SetMetadata(key, metaValue)
+		}
+	}
+
+	if len(format.fields) == 0 {
+		return data, streamID // ### return, no projection ###
+	}
+
+	root := &splitToJSONNode{children: []*splitToJSONNode{}}
+	for _, path := range format.fields {
+		if value, exists := values.Path(path); exists {
+			root.set(strings.Split(path, "/"), value)
+		}
+	}
+
+	projection, err := root.MarshalJSON()
+	if err != nil {
+		Log.Error.Print("JSONParse: ", err)
+		return data, streamID
+	}
+	return projection, streamID
+}
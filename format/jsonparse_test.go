@@ -0,0 +1,91 @@
+// Copyright 2015-2016 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package format
+
+import (
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/shared"
+	"testing"
+)
+
+func TestJSONParseMetadata(t *testing.T) {
+	expect := shared.NewExpect(t)
+
+	config := core.NewPluginConfig("")
+	config.Override("JSONParseMetadata", map[interface{}]interface{}{
+		"user/name": "user",
+		"status":    "status",
+		"tags":      "tags",
+		"missing":   "missing",
+		"ok":        "ok",
+		"items[1]n": "item",
+	})
+
+	plugin, err := core.NewPluginWithType("format.JSONParse", config)
+	expect.NoError(err)
+	formatter, casted := plugin.(*JSONParse)
+	expect.True(casted)
+
+	payload := `{"user":{"name":"bob"},"status":200,"tags":["a","b"],"ok":true,"items":[{"n":1},{"n":2.5}]}`
+	msg := core.NewMessage(nil, []byte(payload), 0)
+	msg.PrepareMetadata()
+	result, streamID := formatter.Format(msg)
+
+	expect.Equal(payload, string(result))
+	expect.Equal(msg.StreamID, streamID)
+	expect.Equal("bob", msg.Metadata["user"])
+	expect.Equal("200", msg.Metadata["status"])
+	expect.Equal(`["a","b"]`, msg.Metadata["tags"])
+	expect.Equal("true", msg.Metadata["ok"])
+	expect.Equal("2.5", msg.Metadata["item"])
+
+	_, exists := msg.Metadata["missing"]
+	expect.False(exists)
+}
+
+func TestJSONParseFields(t *testing.T) {
+	expect := shared.NewExpect(t)
+
+	config := core.NewPluginConfig("")
+	config.Override("JSONParseFields", []interface{}{"status", "user/name", "missing"})
+
+	plugin, err := core.NewPluginWithType("format.JSONParse", config)
+	expect.NoError(err)
+	formatter, casted := plugin.(*JSONParse)
+	expect.True(casted)
+
+	msg := core.NewMessage(nil, []byte(`{"user":{"name":"bob","id":1},"status":200,"url":"/a?b&c"}`), 0)
+	result, _ := formatter.Format(msg)
+
+	expect.Equal(`{"status":200,"user":{"name":"bob"}}`, string(result))
+}
+
+func TestJSONParseErrorStream(t *testing.T) {
+	expect := shared.NewExpect(t)
+
+	config := core.NewPluginConfig("")
+	config.Override("JSONParseErrorStream", "error")
+
+	plugin, err := core.NewPluginWithType("format.JSONParse", config)
+	expect.NoError(err)
+	formatter, casted := plugin.(*JSONParse)
+	expect.True(casted)
+
+	msg := core.NewMessage(nil, []byte(`{"broken"`), 0)
+	result, streamID := formatter.Format(msg)
+
+	expect.Equal(`{"broken"`, string(result))
+	expect.Equal(core.StreamRegistry.GetStreamID("error"), streamID)
+}
@@ -0,0 +1,185 @@
+// Copyright 2015-2016 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package format
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/jmespath/go-jmespath"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/core/log"
+	"github.com/trivago/gollum/shared"
+	"sort"
+	"strings"
+)
+
+// JSONPath formatter plugin
+// JSONPath is a formatter that evaluates JMESPath expressions against a JSON
+// payload and replaces the payload by the result. Either a single expression
+// can be given to extract one value or a set of fields to build a new object.
+// Simple JSONPath expressions like "$.user.name" or "$.items[0]" are accepted,
+// too, as the leading "$" is removed before the expression is compiled.
+// Numbers are evaluated as floating point values.
+// Configuration example
+//
+//  - "stream.Broadcast":
+//    Formatter: "format.JSONPath"
+//    JSONPathDataFormatter: "format.Forward"
+//    JSONPathExpression: "@"
+//    JSONPathFields:
+//      "user.name": "request.user.name"
+//      "status": "response.status"
+//    JSONPathKeepNull: false
+//    JSONPathErrorStream: ""
+//
+// JSONPathDataFormatter defines a formatter that is applied before the
+// expressions are evaluated. By default this is set to "format.Forward".
+//
+// JSONPathExpression defines the expression used to extract a single value.
+// Strings are written as is, all other values as JSON. This option is ignored
+// if JSONPathFields is set. By default this is set to "@", i.e. the whole
+// document is passed on.
+//
+// JSONPathFields defines a map of output keys to expressions. The result is a
+// JSON object with one field per key, sorted by key. Dots in a key create nested
+// objects. By default this map is empty.
+//
+// JSONPathKeepNull can be set to true to write fields that evaluate to null.
+// By default this is set to false, i.e. these fields are omitted.
+//
+// JSONPathErrorStream defines a stream that messages are routed to if they are
+// not valid JSON or if JSONPathExpression does not yield a value. These messages
+// are passed on unchanged. By default this is set to "", i.e. a warning is
+// logged and the message stays on its stream.
+type JSONPath struct {
+	base          core.Formatter
+	expression    *jmespath.JMESPath
+	fields        []jsonPathField
+	keepNull      bool
+	errorStreamID core.MessageStreamID
+}
+
+type jsonPathField struct {
+	key        []string
+	expression *jmespath.JMESPath
+}
+
+func init() {
+	shared.TypeRegistry.Register(JSONPath{})
+}
+
+// Configure initializes this formatter with values from a plugin config.
+func (format *JSONPath) Configure(conf core.PluginConfig) error {
+	plugin, err := core.NewPluginWithType(conf.GetString("JSONPathDataFormatter", "format.Forward"), conf)
+	if err != nil {
+		return err
+	}
+	format.base = plugin.(core.Formatter)
+
+	fields := conf.GetStringMap("JSONPathFields", map[string]string{})
+	keys := make([]string, 0, len(fields))
+	for key := range fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	format.fields = make([]jsonPathField, 0, len(keys))
+	for _, key := range keys {
+		expression, err := compileJSONPath(fields[key])
+		if err != nil {
+			return fmt.Errorf("JSONPath field %s: %s", key, err.Error())
+		}
+		format.fields = append(format.fields, jsonPathField{
+			key:        strings.Split(key, "."),
+			expression: expression,
+		})
+	}
+
+	if len(format.fields) == 0 {
+		expression := conf.GetString("JSONPathExpression", "@")
+		if format.expression, err = compileJSONPath(expression); err != nil {
+			return fmt.Errorf("JSONPathExpression: %s", err.Error())
+		}
+	}
+
+	format.keepNull = conf.GetBool("JSONPathKeepNull", false)
+	format.errorStreamID = core.InvalidStreamID
+	if errorStream := conf.GetString("JSONPathErrorStream", ""); errorStream != "" {
+		format.errorStreamID = core.StreamRegistry.GetStreamID(errorStream)
+	}
+
+	return nil
+}
+
+// compileJSONPath compiles a JMESPath expression. A leading "$" as used by
+// JSONPath is removed.
+func compileJSONPath(expression string) (*jmespath.JMESPath, error) {
+	expression = strings.TrimSpace(expression)
+	if strings.HasPrefix(expression, "$") {
+		expression = strings.TrimPrefix(expression[1:], ".")
+		if expression == "" {
+			expression = "@"
+		}
+	}
+	return jmespath.Compile(expression)
+}
+
+// evaluate returns the payload generated from the given JSON document.
+func (format *JSONPath) evaluate(data []byte) ([]byte, error) {
+	var document interface{}
+	if err := json.Unmarshal(data, &document); err != nil {
+		return nil, err
+	}
+
+	if format.expression != nil {
+		value, err := format.expression.Search(document)
+		if err != nil {
+			return nil, err
+		}
+		if value == nil {
+			return nil, fmt.Errorf("Expression did not yield a value")
+		}
+		result, err := jsonValueString(value)
+		return []byte(result), err
+	}
+
+	root := &splitToJSONNode{children: []*splitToJSONNode{}}
+	for _, field := range format.fields {
+		value, err := field.expression.Search(document)
+		if err != nil {
+			return nil, err
+		}
+		if value != nil || format.keepNull {
+			root.set(field.key, value)
+		}
+	}
+	return root.MarshalJSON()
+}
+
+// Format replaces the payload by the extracted value or object
+func (format *JSONPath) Format(msg core.Message) ([]byte, core.MessageStreamID) {
+	data, streamID := format.base.Format(msg)
+
+	result, err := format.evaluate(data)
+	if err != nil {
+		if format.errorStreamID != core.InvalidStreamID {
+			return data, format.errorStreamID // ### return, route to error stream ###
+		}
+		Log.Warning.Print("JSONPath failed to evaluate a message: ", err)
+		return data, streamID
+	}
+
+	return result, streamID
+}
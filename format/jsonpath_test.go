@@ -0,0 +1,88 @@
+// Copyright 2015-2016 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package format
+
+import (
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/shared"
+	"testing"
+)
+
+const jsonPathTestDocument = `{"request":{"user":{"name":"bob","id":12}},"items":[{"sku":"a","price":3},{"sku":"b","price":7}]}`
+
+func TestJSONPathExpression(t *testing.T) {
+	expect := shared.NewExpect(t)
+
+	config := core.NewPluginConfig("")
+	config.Override("JSONPathExpression", "$.request.user.name")
+	config.Override("JSONPathErrorStream", "error")
+	plugin, err := core.NewPluginWithType("format.JSONPath", config)
+	expect.NoError(err)
+	formatter, casted := plugin.(*JSONPath)
+	expect.True(casted)
+
+	msg := core.NewMessage(nil, []byte(jsonPathTestDocument), 0)
+	result, streamID := formatter.Format(msg)
+	expect.Equal("bob", string(result))
+	expect.Equal(msg.StreamID, streamID)
+
+	config.Override("JSONPathExpression", "items[?price > `5`].sku")
+	plugin, err = core.NewPluginWithType("format.JSONPath", config)
+	expect.NoError(err)
+	formatter = plugin.(*JSONPath)
+
+	result, _ = formatter.Format(msg)
+	expect.Equal(`["b"]`, string(result))
+
+	msg = core.NewMessage(nil, []byte(`{"items":1}`), 0)
+	result, streamID = formatter.Format(msg)
+	expect.Equal(`{"items":1}`, string(result))
+	expect.Equal(core.StreamRegistry.GetStreamID("error"), streamID)
+
+	msg = core.NewMessage(nil, []byte(`not json`), 0)
+	_, streamID = formatter.Format(msg)
+	expect.Equal(core.StreamRegistry.GetStreamID("error"), streamID)
+
+	config.Override("JSONPathExpression", "items[")
+	_, err = core.NewPluginWithType("format.JSONPath", config)
+	expect.NotNil(err)
+}
+
+func TestJSONPathFields(t *testing.T) {
+	expect := shared.NewExpect(t)
+
+	config := core.NewPluginConfig("")
+	config.Override("JSONPathFields", map[interface{}]interface{}{
+		"user.name": "request.user.name",
+		"user.id":   "$.request.user.id",
+		"total":     "sum(items[].price)",
+		"missing":   "request.foo",
+	})
+	plugin, err := core.NewPluginWithType("format.JSONPath", config)
+	expect.NoError(err)
+	formatter := plugin.(*JSONPath)
+
+	msg := core.NewMessage(nil, []byte(jsonPathTestDocument), 0)
+	result, _ := formatter.Format(msg)
+	expect.Equal(`{"total":10,"user":{"id":12,"name":"bob"}}`, string(result))
+
+	config.Override("JSONPathKeepNull", true)
+	plugin, err = core.NewPluginWithType("format.JSONPath", config)
+	expect.NoError(err)
+	formatter = plugin.(*JSONPath)
+
+	result, _ = formatter.Format(msg)
+	expect.Equal(`{"missing":null,"total":10,"user":{"id":12,"name":"bob"}}`, string(result))
+}
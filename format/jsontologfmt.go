@@ -0,0 +1,178 @@
+// Copyright 2015-2016 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package format
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/core/log"
+	"github.com/trivago/gollum/shared"
+	"strconv"
+	"strings"
+)
+
+// JSONToLogfmt formatter plugin
+// JSONToLogfmt is a formatter that converts JSON objects into logfmt records,
+// i.e. space separated key=value pairs. Nested objects and arrays are
+// flattened as done by format.FlattenJSON. Values containing spaces, quotes,
+// "=" or control characters are quoted, null values are written as empty
+// value. Characters not allowed in keys are replaced by "_". The order of
+// keys is preserved.
+// This is the counterpart of format.LogfmtToJSON.
+// Configuration example
+//
+//  - "stream.Broadcast":
+//    Formatter: "format.JSONToLogfmt"
+//    JSONToLogfmtDataFormatter: "format.Forward"
+//    JSONToLogfmtSeparator: "."
+//    JSONToLogfmtErrorStream: ""
+//
+// JSONToLogfmtDataFormatter defines a formatter that is applied before the
+// message is converted. By default this is set to "format.Forward".
+//
+// JSONToLogfmtSeparator defines the string used to join the keys of nested
+// objects. By default this is set to ".".
+//
+// JSONToLogfmtErrorStream defines a stream that messages which are not a JSON
+// object are routed to. These messages are passed on unchanged.
+// By default this is set to "", i.e. a warning is logged and the message stays
+// on its stream.
+type JSONToLogfmt struct {
+	base          core.Formatter
+	flattener     FlattenJSON // used for flattening only
+	errorStreamID core.MessageStreamID
+}
+
+var logfmtKeyReplacer = strings.NewReplacer("=", "_", "\"", "_")
+
+func init() {
+	shared.TypeRegistry.Register(JSONToLogfmt{})
+}
+
+// Configure initializes this formatter with values from a plugin config.
+func (format *JSONToLogfmt) Configure(conf core.PluginConfig) error {
+	plugin, err := core.NewPluginWithType(conf.GetString("JSONToLogfmtDataFormatter", "format.Forward"), conf)
+	if err != nil {
+		return err
+	}
+	format.base = plugin.(core.Formatter)
+	format.flattener.separator = conf.GetString("JSONToLogfmtSeparator", ".")
+
+	format.errorStreamID = core.InvalidStreamID
+	if errorStream := conf.GetString("JSONToLogfmtErrorStream", ""); errorStream != "" {
+		format.errorStreamID = core.StreamRegistry.GetStreamID(errorStream)
+	}
+
+	return nil
+}
+
+// logfmtKey replaces all characters not allowed in logfmt keys by "_".
+func logfmtKey(key string) string {
+	key = logfmtKeyReplacer.Replace(key)
+	return strings.Map(func(char rune) rune {
+		if char <= ' ' || char == 0x7f {
+			return '_'
+		}
+		return char
+	}, key)
+}
+
+// logfmtValue returns the given string, quoted if necessary.
+func logfmtValue(value string) string {
+	needsQuotes := false
+	for _, char := range value {
+		if char <= ' ' || char == '=' || char == '"' || char == 0x7f || char == '\\' {
+			needsQuotes = true
+			break
+		}
+	}
+	if needsQuotes {
+		return strconv.Quote(value)
+	}
+	return value
+}
+
+// convert writes the given flat JSON object as logfmt record.
+func (format *JSONToLogfmt) convert(flat []byte) ([]byte, error) {
+	decoder := json.NewDecoder(bytes.NewReader(flat))
+	decoder.UseNumber()
+	if _, err := decoder.Token(); err != nil {
+		return nil, err
+	}
+
+	record := bytes.NewBuffer(nil)
+	for decoder.More() {
+		keyToken, err := decoder.Token()
+		if err != nil {
+			return nil, err
+		}
+		valueToken, err := decoder.Token()
+		if err != nil {
+			return nil, err
+		}
+
+		if record.Len() > 0 {
+			record.WriteByte(' ')
+		}
+		record.WriteString(logfmtKey(keyToken.(string)))
+		record.WriteByte('=')
+
+		switch value := valueToken.(type) {
+		case nil:
+		case string:
+			record.WriteString(logfmtValue(value))
+		case json.Number:
+			record.WriteString(value.String())
+		case bool:
+			record.WriteString(strconv.FormatBool(value))
+		case json.Delim:
+			// Empty objects or arrays, consume the closing delimiter
+			if _, err := decoder.Token(); err != nil {
+				return nil, err
+			}
+			if value == '{' {
+				record.WriteString("{}")
+			} else {
+				record.WriteString("[]")
+			}
+		default:
+			return nil, fmt.Errorf("Unexpected value %v", value)
+		}
+	}
+
+	return record.Bytes(), nil
+}
+
+// Format returns the JSON object as logfmt record
+func (format *JSONToLogfmt) Format(msg core.Message) ([]byte, core.MessageStreamID) {
+	data, streamID := format.base.Format(msg)
+
+	var record []byte
+	flat, err := format.flattener.flattenMessage(data)
+	if err == nil {
+		record, err = format.convert(flat)
+	}
+
+	if err != nil {
+		if format.errorStreamID != core.InvalidStreamID {
+			return data, format.errorStreamID // ### return, route to error stream ###
+		}
+		Log.Warning.Print("JSONToLogfmt failed to convert a message: ", err)
+		return data, streamID
+	}
+	return record, streamID
+}
@@ -0,0 +1,59 @@
+// Copyright 2015-2016 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package format
+
+import (
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/shared"
+	"testing"
+)
+
+func TestJSONToLogfmt(t *testing.T) {
+	expect := shared.NewExpect(t)
+
+	config := core.NewPluginConfig("")
+	config.Override("JSONToLogfmtErrorStream", "error")
+	plugin, err := core.NewPluginWithType("format.JSONToLogfmt", config)
+	expect.NoError(err)
+	formatter, casted := plugin.(*JSONToLogfmt)
+	expect.True(casted)
+
+	msg := core.NewMessage(nil, []byte(`{"level":"info","msg":"user \"bob\" logged in","id":42,"ok":true,"user":{"name":"bob","roles":["a"]},"none":null,"tags":[],"my key":"a=b"}`), 0)
+	result, streamID := formatter.Format(msg)
+	expect.Equal(`level=info msg="user \"bob\" logged in" id=42 ok=true user.name=bob user.roles[0]=a none= tags=[] my_key="a=b"`, string(result))
+	expect.Equal(msg.StreamID, streamID)
+
+	msg = core.NewMessage(nil, []byte(`no json`), 0)
+	result, streamID = formatter.Format(msg)
+	expect.Equal(`no json`, string(result))
+	expect.Equal(core.StreamRegistry.GetStreamID("error"), streamID)
+}
+
+func TestJSONToLogfmtRoundtrip(t *testing.T) {
+	expect := shared.NewExpect(t)
+
+	config := core.NewPluginConfig("")
+	config.Override("LogfmtToJSONInferTypes", true)
+	toJSON, err := core.NewPluginWithType("format.LogfmtToJSON", config)
+	expect.NoError(err)
+	toLogfmt, err := core.NewPluginWithType("format.JSONToLogfmt", config)
+	expect.NoError(err)
+
+	record := `level=warn msg="line1\nline2" count=3 path=/var/log`
+	msg := core.NewMessage(nil, []byte(record), 0)
+	msg.Data, _ = toJSON.(core.Formatter).Format(msg)
+	result, _ := toLogfmt.(core.Formatter).Format(msg)
+	expect.Equal(record, string(result))
+}
@@ -0,0 +1,227 @@
+// Copyright 2015-2016 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package format
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/core/log"
+	"github.com/trivago/gollum/shared"
+	"strings"
+)
+
+// KeyValue formatter plugin
+// KeyValue is a formatter that parses key/value pairs like
+// `src=10.0.0.1 dst=10.0.0.2 action="accept"` as written by many firewalls
+// and appliances and converts them into a JSON object. Tokens that do not
+// contain a key/value separator are ignored. The order of keys is preserved.
+// Configuration example
+//
+//  - "stream.Broadcast":
+//    Formatter: "format.KeyValue"
+//    KeyValueDataFormatter: "format.Forward"
+//    KeyValuePairSeparator: " "
+//    KeyValueSeparator: "="
+//    KeyValueQuoteChars: "\"'"
+//    KeyValueDuplicates: "last"
+//    KeyValueInferTypes: false
+//    KeyValueErrorStream: ""
+//
+// KeyValueDataFormatter defines a formatter that is applied before the
+// message is parsed. By default this is set to "format.Forward".
+//
+// KeyValuePairSeparator defines the string separating two pairs. Consecutive
+// separators are treated as one. By default this is set to " ".
+//
+// KeyValueSeparator defines the string separating a key from its value, e.g.
+// ":". By default this is set to "=".
+//
+// KeyValueQuoteChars defines the characters that can be used to quote values
+// containing separators. Inside quoted values a backslash escapes the
+// following character. Set to "" to disable quoting.
+// By default this is set to "\"'".
+//
+// KeyValueDuplicates defines how keys that appear more than once are handled.
+// By default this is set to "last".
+//  * "first" keeps the first value.
+//  * "last" keeps the last value.
+//  * "array" collects all values of a key in an array.
+//
+// KeyValueInferTypes can be set to true to write unquoted numbers and booleans
+// as such. By default this is set to false, which writes all values as
+// strings.
+//
+// KeyValueErrorStream defines a stream that messages without any key/value
+// pair are routed to. These messages are passed on unchanged.
+// By default this is set to "", i.e. a warning is logged and the message stays
+// on its stream.
+type KeyValue struct {
+	base          core.Formatter
+	pairSeparator []byte
+	separator     []byte
+	quoteChars    string
+	duplicates    string
+	valueType     string
+	errorStreamID core.MessageStreamID
+}
+
+func init() {
+	shared.TypeRegistry.Register(KeyValue{})
+}
+
+// Configure initializes this formatter with values from a plugin config.
+func (format *KeyValue) Configure(conf core.PluginConfig) error {
+	plugin, err := core.NewPluginWithType(conf.GetString("KeyValueDataFormatter", "format.Forward"), conf)
+	if err != nil {
+		return err
+	}
+	format.base = plugin.(core.Formatter)
+
+	format.pairSeparator = []byte(shared.Unescape(conf.GetString("KeyValuePairSeparator", " ")))
+	format.separator = []byte(shared.Unescape(conf.GetString("KeyValueSeparator", "=")))
+	format.quoteChars = shared.Unescape(conf.GetString("KeyValueQuoteChars", "\"'"))
+	if len(format.pairSeparator) == 0 || len(format.separator) == 0 {
+		return fmt.Errorf("KeyValuePairSeparator and KeyValueSeparator must not be empty")
+	}
+	if bytes.Equal(format.pairSeparator, format.separator) {
+		return fmt.Errorf("KeyValuePairSeparator and KeyValueSeparator must differ")
+	}
+
+	format.duplicates = strings.ToLower(conf.GetString("KeyValueDuplicates", "last"))
+	switch format.duplicates {
+	case "first", "last", "array":
+	default:
+		return fmt.Errorf("Unknown KeyValueDuplicates: %s", format.duplicates)
+	}
+
+	format.valueType = "string"
+	if conf.GetBool("KeyValueInferTypes", false) {
+		format.valueType = "auto"
+	}
+
+	format.errorStreamID = core.InvalidStreamID
+	if errorStream := conf.GetString("KeyValueErrorStream", ""); errorStream != "" {
+		format.errorStreamID = core.StreamRegistry.GetStreamID(errorStream)
+	}
+
+	return nil
+}
+
+// readValue reads a possibly quoted value starting at data[0] and returns the
+// value, whether it was quoted and the number of bytes consumed.
+func (format *KeyValue) readValue(data []byte) ([]byte, bool, int) {
+	if len(data) > 0 && strings.IndexByte(format.quoteChars, data[0]) >= 0 {
+		quote := data[0]
+		value := make([]byte, 0, len(data))
+		for pos := 1; pos < len(data); pos++ {
+			switch {
+			case data[pos] == '\\' && pos+1 < len(data):
+				pos++
+				value = append(value, data[pos])
+			case data[pos] == quote:
+				return value, true, pos + 1 // ### return, closing quote ###
+			default:
+				value = append(value, data[pos])
+			}
+		}
+		// No closing quote, read as unquoted value
+	}
+
+	end := bytes.Index(data, format.pairSeparator)
+	if end < 0 {
+		end = len(data)
+	}
+	return data[:end], false, end
+}
+
+// addValue stores a value according to the duplicate key handling.
+func (format *KeyValue) addValue(keys *[]string, values map[string]interface{}, key string, value interface{}) {
+	existing, exists := values[key]
+	switch {
+	case !exists:
+		*keys = append(*keys, key)
+		if format.duplicates == "array" {
+			values[key] = []interface{}{value}
+		} else {
+			values[key] = value
+		}
+	case format.duplicates == "last":
+		values[key] = value
+	case format.duplicates == "array":
+		values[key] = append(existing.([]interface{}), value)
+	}
+}
+
+// Format returns the key/value pairs as JSON object
+func (format *KeyValue) Format(msg core.Message) ([]byte, core.MessageStreamID) {
+	data, streamID := format.base.Format(msg)
+
+	keys := []string{}
+	values := make(map[string]interface{})
+	remain := bytes.TrimRight(data, "\r\n")
+
+	for len(remain) > 0 {
+		if bytes.HasPrefix(remain, format.pairSeparator) {
+			remain = remain[len(format.pairSeparator):]
+			continue // ### continue, skip separators ###
+		}
+
+		pairEnd := bytes.Index(remain, format.pairSeparator)
+		if pairEnd < 0 {
+			pairEnd = len(remain)
+		}
+		keyEnd := bytes.Index(remain[:pairEnd], format.separator)
+		if keyEnd <= 0 {
+			remain = remain[pairEnd:]
+			continue // ### continue, not a key/value pair ###
+		}
+
+		key := string(bytes.TrimSpace(remain[:keyEnd]))
+		remain = remain[keyEnd+len(format.separator):]
+		if key == "" {
+			continue // ### continue, empty key ###
+		}
+
+		value, quoted, consumed := format.readValue(remain)
+		remain = remain[consumed:]
+		if quoted {
+			format.addValue(&keys, values, key, string(value))
+		} else {
+			format.addValue(&keys, values, key, typedJSONValue(format.valueType, value))
+		}
+	}
+
+	var err error
+	if len(keys) == 0 {
+		err = fmt.Errorf("No key/value pairs found")
+	} else {
+		root := &splitToJSONNode{children: []*splitToJSONNode{}}
+		for _, key := range keys {
+			root.set([]string{key}, values[key])
+		}
+
+		var jsonData []byte
+		if jsonData, err = root.MarshalJSON(); err == nil {
+			return jsonData, streamID // ### return, converted ###
+		}
+	}
+
+	if format.errorStreamID != core.InvalidStreamID {
+		return data, format.errorStreamID // ### return, route to error stream ###
+	}
+	Log.Warning.Print("KeyValue failed to convert a message: ", err)
+	return data, streamID
+}
@@ -0,0 +1,77 @@
+// Copyright 2015-2016 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package format
+
+import (
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/shared"
+	"testing"
+)
+
+func TestKeyValue(t *testing.T) {
+	expect := shared.NewExpect(t)
+
+	config := core.NewPluginConfig("")
+	config.Override("KeyValueErrorStream", "error")
+	plugin, err := core.NewPluginWithType("format.KeyValue", config)
+	expect.NoError(err)
+	formatter, casted := plugin.(*KeyValue)
+	expect.True(casted)
+
+	msg := core.NewMessage(nil, []byte(`date=2016-10-14  src=10.0.0.1 msg="user \"bob\" denied" standalone url=http://x?a=b name='o k' src=10.0.0.2`+"\n"), 0)
+	result, streamID := formatter.Format(msg)
+	expect.Equal(`{"date":"2016-10-14","src":"10.0.0.2","msg":"user \"bob\" denied","url":"http://x?a=b","name":"o k"}`, string(result))
+	expect.Equal(msg.StreamID, streamID)
+
+	msg = core.NewMessage(nil, []byte(`no pairs here`), 0)
+	result, streamID = formatter.Format(msg)
+	expect.Equal(`no pairs here`, string(result))
+	expect.Equal(core.StreamRegistry.GetStreamID("error"), streamID)
+}
+
+func TestKeyValueOptions(t *testing.T) {
+	expect := shared.NewExpect(t)
+
+	config := core.NewPluginConfig("")
+	config.Override("KeyValuePairSeparator", ", ")
+	config.Override("KeyValueSeparator", ":")
+	config.Override("KeyValueDuplicates", "array")
+	config.Override("KeyValueInferTypes", true)
+	plugin, err := core.NewPluginWithType("format.KeyValue", config)
+	expect.NoError(err)
+	formatter, casted := plugin.(*KeyValue)
+	expect.True(casted)
+
+	msg := core.NewMessage(nil, []byte(`port:443, tag:a, ok:true, tag:"b, c", unterminated:"x`), 0)
+	result, _ := formatter.Format(msg)
+	expect.Equal(`{"port":[443],"tag":["a","b, c"],"ok":[true],"unterminated":["\"x"]}`, string(result))
+
+	config = core.NewPluginConfig("")
+	config.Override("KeyValueDuplicates", "first")
+	config.Override("KeyValueQuoteChars", "")
+	plugin, err = core.NewPluginWithType("format.KeyValue", config)
+	expect.NoError(err)
+	formatter, casted = plugin.(*KeyValue)
+	expect.True(casted)
+
+	msg = core.NewMessage(nil, []byte(`a=1 a=2 b="x`), 0)
+	result, _ = formatter.Format(msg)
+	expect.Equal(`{"a":"1","b":"\"x"}`, string(result))
+
+	config = core.NewPluginConfig("")
+	config.Override("KeyValueDuplicates", "merge")
+	_, err = core.NewPluginWithType("format.KeyValue", config)
+	expect.NotNil(err)
+}
@@ -0,0 +1,155 @@
+// Copyright 2015-2016 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package format
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/core/log"
+	"github.com/trivago/gollum/shared"
+	"strconv"
+)
+
+// LogfmtToJSON formatter plugin
+// LogfmtToJSON is a formatter that converts logfmt records, i.e. space
+// separated key=value pairs like `level=info msg="user login" id=42`, into
+// JSON objects. Keys without a value are written as true, quoted values may
+// contain the escape sequences known from Go strings. If a key is given twice
+// the last value is used. The order of keys is preserved.
+// This is the counterpart of format.JSONToLogfmt.
+// Configuration example
+//
+//  - "stream.Broadcast":
+//    Formatter: "format.LogfmtToJSON"
+//    LogfmtToJSONDataFormatter: "format.Forward"
+//    LogfmtToJSONInferTypes: false
+//    LogfmtToJSONErrorStream: ""
+//
+// LogfmtToJSONDataFormatter defines a formatter that is applied before the
+// record is converted. By default this is set to "format.Forward".
+//
+// LogfmtToJSONInferTypes can be set to true to write unquoted numbers and
+// booleans as such. By default this is set to false, which writes all values
+// as strings.
+//
+// LogfmtToJSONErrorStream defines a stream that malformed records are routed
+// to. These messages are passed on unchanged.
+// By default this is set to "", i.e. a warning is logged and the message stays
+// on its stream.
+type LogfmtToJSON struct {
+	base          core.Formatter
+	valueType     string
+	errorStreamID core.MessageStreamID
+}
+
+func init() {
+	shared.TypeRegistry.Register(LogfmtToJSON{})
+}
+
+// Configure initializes this formatter with values from a plugin config.
+func (format *LogfmtToJSON) Configure(conf core.PluginConfig) error {
+	plugin, err := core.NewPluginWithType(conf.GetString("LogfmtToJSONDataFormatter", "format.Forward"), conf)
+	if err != nil {
+		return err
+	}
+	format.base = plugin.(core.Formatter)
+
+	format.valueType = "string"
+	if conf.GetBool("LogfmtToJSONInferTypes", false) {
+		format.valueType = "auto"
+	}
+
+	format.errorStreamID = core.InvalidStreamID
+	if errorStream := conf.GetString("LogfmtToJSONErrorStream", ""); errorStream != "" {
+		format.errorStreamID = core.StreamRegistry.GetStreamID(errorStream)
+	}
+
+	return nil
+}
+
+// parse converts a logfmt record into an ordered JSON object.
+func (format *LogfmtToJSON) parse(data []byte) (*splitToJSONNode, error) {
+	root := &splitToJSONNode{children: []*splitToJSONNode{}}
+
+	for pos := 0; pos < len(data); {
+		if data[pos] <= ' ' {
+			pos++
+			continue // ### continue, skip whitespace ###
+		}
+
+		start := pos
+		for pos < len(data) && data[pos] > ' ' && data[pos] != '=' {
+			pos++
+		}
+		key := string(data[start:pos])
+		if key == "" {
+			return nil, fmt.Errorf("Missing key at offset %d", start)
+		}
+
+		if pos == len(data) || data[pos] != '=' {
+			root.set([]string{key}, true)
+			continue // ### continue, key without value ###
+		}
+		pos++ // skip '='
+
+		if pos < len(data) && data[pos] == '"' {
+			start := pos
+			for pos++; pos < len(data) && data[pos] != '"'; pos++ {
+				if data[pos] == '\\' {
+					pos++
+				}
+			}
+			if pos >= len(data) {
+				return nil, fmt.Errorf("Unterminated quoted value for key %s", key)
+			}
+			pos++ // skip closing '"'
+
+			value, err := strconv.Unquote(string(data[start:pos]))
+			if err != nil {
+				return nil, fmt.Errorf("Invalid quoted value for key %s", key)
+			}
+			root.set([]string{key}, value)
+			continue // ### continue, quoted value ###
+		}
+
+		start = pos
+		for pos < len(data) && data[pos] > ' ' {
+			pos++
+		}
+		root.set([]string{key}, typedJSONValue(format.valueType, data[start:pos]))
+	}
+
+	return root, nil
+}
+
+// Format returns the logfmt record as JSON object
+func (format *LogfmtToJSON) Format(msg core.Message) ([]byte, core.MessageStreamID) {
+	data, streamID := format.base.Format(msg)
+
+	root, err := format.parse(bytes.TrimSpace(data))
+	if err == nil {
+		var jsonData []byte
+		if jsonData, err = root.MarshalJSON(); err == nil {
+			return jsonData, streamID // ### return, converted ###
+		}
+	}
+
+	if format.errorStreamID != core.InvalidStreamID {
+		return data, format.errorStreamID // ### return, route to error stream ###
+	}
+	Log.Warning.Print("LogfmtToJSON failed to convert a message: ", err)
+	return data, streamID
+}
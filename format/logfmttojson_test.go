@@ -0,0 +1,61 @@
+// Copyright 2015-2016 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package format
+
+import (
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/shared"
+	"testing"
+)
+
+func TestLogfmtToJSON(t *testing.T) {
+	expect := shared.NewExpect(t)
+
+	config := core.NewPluginConfig("")
+	config.Override("LogfmtToJSONErrorStream", "error")
+	plugin, err := core.NewPluginWithType("format.LogfmtToJSON", config)
+	expect.NoError(err)
+	formatter, casted := plugin.(*LogfmtToJSON)
+	expect.True(casted)
+
+	msg := core.NewMessage(nil, []byte(`level=info msg="user \"bob\" logged in" id=42 debug empty= id=43`+"\n"), 0)
+	result, streamID := formatter.Format(msg)
+	expect.Equal(`{"level":"info","msg":"user \"bob\" logged in","id":"43","debug":true,"empty":""}`, string(result))
+	expect.Equal(msg.StreamID, streamID)
+
+	msg = core.NewMessage(nil, []byte(`msg="unterminated`), 0)
+	result, streamID = formatter.Format(msg)
+	expect.Equal(`msg="unterminated`, string(result))
+	expect.Equal(core.StreamRegistry.GetStreamID("error"), streamID)
+
+	msg = core.NewMessage(nil, []byte(`=value`), 0)
+	_, streamID = formatter.Format(msg)
+	expect.Equal(core.StreamRegistry.GetStreamID("error"), streamID)
+}
+
+func TestLogfmtToJSONInferTypes(t *testing.T) {
+	expect := shared.NewExpect(t)
+
+	config := core.NewPluginConfig("")
+	config.Override("LogfmtToJSONInferTypes", true)
+	plugin, err := core.NewPluginWithType("format.LogfmtToJSON", config)
+	expect.NoError(err)
+	formatter, casted := plugin.(*LogfmtToJSON)
+	expect.True(casted)
+
+	msg := core.NewMessage(nil, []byte(`id=42 took=1.5 ok=true quoted="42" name=bob`), 0)
+	result, _ := formatter.Format(msg)
+	expect.Equal(`{"id":42,"took":1.5,"ok":true,"quoted":"42","name":"bob"}`, string(result))
+}
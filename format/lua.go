@@ -0,0 +1,232 @@
+// Copyright 2015-2016 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package format
+
+import (
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/core/log"
+	"github.com/trivago/gollum/shared"
+	"github.com/yuin/gopher-lua"
+	"runtime"
+	"time"
+)
+
+// Lua formatter plugin
+// Lua is a formatter that passes each message to a function of a Lua script.
+// The function is called with the payload (string), the message metadata
+// (table) and the name of the message stream (string). It has to return the
+// new payload and may return the name of a stream to route the message to.
+// Returning nil as payload drops the message. Changes to the metadata table
+// are written back to the message.
+// Each script runs in one of a pool of Lua states so that messages can be
+// formatted in parallel. Only the base, table, string and math libraries are
+// available.
+// Configuration example
+//
+//  - "stream.Broadcast":
+//    Formatter: "format.Lua"
+//    LuaDataFormatter: "format.Forward"
+//    LuaScript: |
+//      function format(payload, metadata, stream)
+//        metadata["length"] = tostring(#payload)
+//        return string.upper(payload)
+//      end
+//    LuaScriptFile: ""
+//    LuaFunction: "format"
+//    LuaTimeoutMs: 100
+//    LuaInstructionLimit: 1000000
+//    LuaPoolSize: 0
+//    LuaCallStackSize: 256
+//    LuaErrorStream: ""
+//
+// LuaDataFormatter defines a formatter that is applied before the script is
+// called. By default this is set to "format.Forward".
+//
+// LuaScript defines the script to run. By default this is set to a script
+// returning the payload unchanged.
+//
+// LuaScriptFile defines a file to read the script from. If set, this option
+// overrides LuaScript. By default this is set to "".
+//
+// LuaFunction defines the name of the global function to call for each
+// message. By default this is set to "format".
+//
+// LuaTimeoutMs defines the maximum wall-clock time in milliseconds a single
+// call may take. Scripts exceeding this limit are aborted. Set to 0 to
+// disable. By default this is set to 100.
+//
+// LuaInstructionLimit defines the maximum number of Lua instructions a single
+// call may execute. Scripts exceeding this limit are aborted. Time spent in
+// library functions like string.rep is not limited by this setting. Set to 0
+// to disable. By default this is set to 1000000.
+//
+// LuaPoolSize defines the number of idle Lua states kept for reuse. By default
+// this is set to 0, which uses the number of CPUs.
+//
+// LuaCallStackSize defines the maximum depth of the Lua call stack.
+// By default this is set to 256.
+//
+// LuaErrorStream defines a stream that messages are routed to if the script
+// fails or exceeds one of its limits. These messages are passed on unchanged.
+// By default this is set to "", i.e. a warning is logged and the message stays
+// on its stream.
+type Lua struct {
+	base          core.Formatter
+	proto         *lua.FunctionProto
+	function      string
+	timeout       time.Duration
+	maxInstr      int
+	callStackSize int
+	pool          chan *lua.LState
+	errorStreamID core.MessageStreamID
+}
+
+func init() {
+	shared.TypeRegistry.Register(Lua{})
+}
+
+// Configure initializes this formatter with values from a plugin config.
+func (format *Lua) Configure(conf core.PluginConfig) error {
+	plugin, err := core.NewPluginWithType(conf.GetString("LuaDataFormatter", "format.Forward"), conf)
+	if err != nil {
+		return err
+	}
+	format.base = plugin.(core.Formatter)
+	core.RegisterMetadataWriter()
+
+	format.function = conf.GetString("LuaFunction", "format")
+	script := conf.GetString("LuaScript", "function "+format.function+"(payload) return payload end")
+	scriptFile := conf.GetString("LuaScriptFile", "")
+	if format.proto, err = shared.CompileLua(script, scriptFile); err != nil {
+		return err
+	}
+
+	format.timeout = time.Duration(conf.GetInt("LuaTimeoutMs", 100)) * time.Millisecond
+	format.maxInstr = conf.GetInt("LuaInstructionLimit", 1000000)
+	format.callStackSize = shared.MaxI(conf.GetInt("LuaCallStackSize", 256), 16)
+
+	poolSize := conf.GetInt("LuaPoolSize", 0)
+	if poolSize <= 0 {
+		poolSize = runtime.NumCPU()
+	}
+	format.pool = make(chan *lua.LState, poolSize)
+
+	format.errorStreamID = core.InvalidStreamID
+	if errorStream := conf.GetString("LuaErrorStream", ""); errorStream != "" {
+		format.errorStreamID = core.StreamRegistry.GetStreamID(errorStream)
+	}
+
+	// Create the first state to report script errors on startup
+	state, err := format.newState()
+	if err != nil {
+		return err
+	}
+	format.putState(state)
+	return nil
+}
+
+// newState creates a Lua state with the script executed.
+func (format *Lua) newState() (*lua.LState, error) {
+	return shared.NewLuaState(format.proto, format.function, format.callStackSize)
+}
+
+// getState returns an idle Lua state or creates a new one.
+func (format *Lua) getState() (*lua.LState, error) {
+	select {
+	case state := <-format.pool:
+		return state, nil
+	default:
+		return format.newState()
+	}
+}
+
+// putState returns a Lua state to the pool or closes it if the pool is full.
+func (format *Lua) putState(state *lua.LState) {
+	select {
+	case format.pool <- state:
+	default:
+		state.Close()
+	}
+}
+
+// call runs the script function for the given message and returns the new
+// payload (nil to drop) and stream name ("" to keep the stream).
+func (format *Lua) call(state *lua.LState, data []byte, msg core.Message, streamID core.MessageStreamID) ([]byte, string, error) {
+	metadata := state.NewTable()
+	for key, value := range msg.Metadata {
+		metadata.RawSetString(key, lua.LString(value))
+	}
+
+	done := shared.LimitLuaState(state, format.timeout, format.maxInstr)
+	defer done()
+
+	err := state.CallByParam(lua.P{
+		Fn:      state.GetGlobal(format.function),
+		NRet:    2,
+		Protect: true,
+	}, lua.LString(data), metadata, lua.LString(core.StreamRegistry.GetStreamName(streamID)))
+	if err != nil {
+		return nil, "", err
+	}
+
+	payload := state.Get(-2)
+	stream := state.Get(-1)
+	state.Pop(2)
+
+	for key := range msg.Metadata {
+		delete(msg.Metadata, key)
+	}
+	metadata.ForEach(func(key lua.LValue, value lua.LValue) {
+		msg.SetMetadata(key.String(), value.String())
+	})
+
+	streamName := ""
+	if stream != lua.LNil {
+		streamName = stream.String()
+	}
+	if payload == lua.LNil {
+		return nil, streamName, nil
+	}
+	return []byte(payload.String()), streamName, nil
+}
+
+// Format returns the message as transformed by the script
+func (format *Lua) Format(msg core.Message) ([]byte, core.MessageStreamID) {
+	data, streamID := format.base.Format(msg)
+
+	state, err := format.getState()
+	if err == nil {
+		var result []byte
+		var streamName string
+		if result, streamName, err = format.call(state, data, msg, streamID); err == nil {
+			format.putState(state)
+			switch {
+			case result == nil:
+				return nil, core.DroppedStreamID // ### return, dropped by script ###
+			case streamName != "":
+				return result, core.StreamRegistry.GetStreamID(streamName)
+			default:
+				return result, streamID
+			}
+		}
+		state.Close() // state may be left in an undefined state
+	}
+
+	if format.errorStreamID != core.InvalidStreamID {
+		return data, format.errorStreamID // ### return, route to error stream ###
+	}
+	Log.Warning.Print("Lua failed to format a message: ", err)
+	return data, streamID
+}
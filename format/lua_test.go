@@ -0,0 +1,133 @@
+// Copyright 2015-2016 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package format
+
+import (
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/shared"
+	"testing"
+)
+
+func TestLua(t *testing.T) {
+	expect := shared.NewExpect(t)
+	config := core.NewPluginConfig("")
+	config.Override("LuaScript", `
+function format(payload, metadata, stream)
+  metadata["length"] = tostring(#payload)
+  metadata["remove"] = nil
+  if payload == "drop" then
+    return nil
+  end
+  if payload == "route" then
+    return payload, "routed"
+  end
+  return string.upper(payload) .. " " .. stream
+end`)
+	plugin, err := core.NewPluginWithType("format.Lua", config)
+	expect.NoError(err)
+	formatter, casted := plugin.(*Lua)
+	expect.True(casted)
+
+	msg := core.NewMessage(nil, []byte("test"), 0)
+	msg.StreamID = core.StreamRegistry.GetStreamID("input")
+	msg.SetMetadata("remove", "me")
+	result, streamID := formatter.Format(msg)
+	expect.Equal("TEST input", string(result))
+	expect.Equal(msg.StreamID, streamID)
+	expect.MapEqual(msg.Metadata, "length", "4")
+	expect.MapNotSet(msg.Metadata, "remove")
+
+	_, streamID = formatter.Format(core.NewMessage(nil, []byte("drop"), 0))
+	expect.Equal(core.DroppedStreamID, streamID)
+
+	result, streamID = formatter.Format(core.NewMessage(nil, []byte("route"), 0))
+	expect.Equal("route", string(result))
+	expect.Equal(core.StreamRegistry.GetStreamID("routed"), streamID)
+}
+
+func TestLuaDefault(t *testing.T) {
+	expect := shared.NewExpect(t)
+
+	plugin, err := core.NewPluginWithType("format.Lua", core.NewPluginConfig(""))
+	expect.NoError(err)
+	formatter, casted := plugin.(*Lua)
+	expect.True(casted)
+
+	msg := core.NewMessage(nil, []byte("test"), 0)
+	msg.StreamID = core.StreamRegistry.GetStreamID("input")
+	msg.SetMetadata("keep", "me")
+	result, streamID := formatter.Format(msg)
+	expect.Equal("test", string(result))
+	expect.Equal(msg.StreamID, streamID)
+	expect.MapEqual(msg.Metadata, "keep", "me")
+}
+
+func TestLuaLimits(t *testing.T) {
+	expect := shared.NewExpect(t)
+	config := core.NewPluginConfig("")
+	config.Override("LuaScript", `
+function format(payload, metadata, stream)
+  if payload == "loop" then
+    while true do end
+  end
+  if payload == "count" then
+    for i = 1, 1000 do end
+  end
+  if payload == "fail" then
+    error("failed")
+  end
+  return payload
+end`)
+	config.Override("LuaTimeoutMs", 50)
+	config.Override("LuaErrorStream", "error")
+	plugin, err := core.NewPluginWithType("format.Lua", config)
+	expect.NoError(err)
+	formatter, casted := plugin.(*Lua)
+	expect.True(casted)
+
+	for _, payload := range []string{"loop", "fail"} {
+		result, streamID := formatter.Format(core.NewMessage(nil, []byte(payload), 0))
+		expect.Equal(payload, string(result))
+		expect.Equal(core.StreamRegistry.GetStreamID("error"), streamID)
+	}
+
+	result, _ := formatter.Format(core.NewMessage(nil, []byte("ok"), 0))
+	expect.Equal("ok", string(result))
+
+	// Instruction limit without time limit
+	config.Override("LuaTimeoutMs", 0)
+	config.Override("LuaInstructionLimit", 1000)
+	plugin, err = core.NewPluginWithType("format.Lua", config)
+	expect.NoError(err)
+	formatter, casted = plugin.(*Lua)
+	expect.True(casted)
+
+	for _, payload := range []string{"loop", "count"} {
+		_, streamID := formatter.Format(core.NewMessage(nil, []byte(payload), 0))
+		expect.Equal(core.StreamRegistry.GetStreamID("error"), streamID)
+	}
+	result, streamID := formatter.Format(core.NewMessage(nil, []byte("ok"), 0))
+	expect.Equal("ok", string(result))
+	expect.Equal(core.WildcardStreamID, streamID)
+
+	config = core.NewPluginConfig("")
+	config.Override("LuaScript", "function other() end")
+	_, err = core.NewPluginWithType("format.Lua", config)
+	expect.NotNil(err)
+
+	config.Override("LuaScript", "function format(")
+	_, err = core.NewPluginWithType("format.Lua", config)
+	expect.NotNil(err)
+}
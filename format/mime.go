@@ -0,0 +1,309 @@
+// Copyright 2015-2016 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package format
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/core/log"
+	"github.com/trivago/gollum/shared"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/textproto"
+	"path"
+	"strings"
+	"unicode/utf8"
+)
+
+// MIME formatter plugin
+// MIME is a formatter that parses MIME encoded messages like emails or HTTP
+// multipart bodies and replaces the message by one of its parts. Nested
+// multipart messages are flattened, i.e. parts are numbered in order of
+// appearance. Base64 and quoted-printable encoded parts are decoded.
+// Messages may either start with MIME headers or directly with a multipart
+// boundary line ("--boundary").
+// As formatters cannot split messages, all parts can be written into a single
+// JSON array instead.
+// Configuration example
+//
+//  - "stream.Broadcast":
+//    Formatter: "format.MIME"
+//    MIMEDataFormatter: "format.Forward"
+//    MIMEPart: 0
+//    MIMEContentType: ""
+//    MIMEOutput: "part"
+//    MIMEMetadataKey: "content_type"
+//    MIMEErrorStream: ""
+//
+// MIMEDataFormatter defines a formatter that is applied before the message is
+// parsed. By default this is set to "format.Forward".
+//
+// MIMEPart defines the index of the part to select, starting with 0.
+// By default this is set to 0.
+//
+// MIMEContentType selects the first part with a matching content type instead
+// of using MIMEPart. Wildcards like "text/*" can be used. By default this is
+// set to "".
+//
+// MIMEOutput defines the generated message. By default this is set to "part".
+//  * "part" writes the body of the selected part.
+//  * "json" writes a JSON array with one object per part holding the fields
+//    "content_type", "filename", "name" and "body". Bodies that are not valid
+//    UTF-8 are written as base64 to "body_base64" instead.
+//
+// MIMEMetadataKey defines the metadata key used to store the content type of
+// the selected part or "application/json" for the "json" output. Set to "" to
+// disable. By default this is set to
+// "content_type".
+//
+// MIMEErrorStream defines a stream that messages which cannot be parsed or do
+// not contain the selected part are routed to. These messages are passed on
+// unchanged. By default this is set to "", i.e. a warning is logged and the
+// message stays on its stream.
+type MIME struct {
+	base          core.Formatter
+	part          int
+	contentType   string
+	jsonOutput    bool
+	metadataKey   string
+	errorStreamID core.MessageStreamID
+}
+
+type mimePart struct {
+	contentType string
+	filename    string
+	name        string
+	body        []byte
+}
+
+func init() {
+	shared.TypeRegistry.Register(MIME{})
+}
+
+// Configure initializes this formatter with values from a plugin config.
+func (format *MIME) Configure(conf core.PluginConfig) error {
+	plugin, err := core.NewPluginWithType(conf.GetString("MIMEDataFormatter", "format.Forward"), conf)
+	if err != nil {
+		return err
+	}
+	format.base = plugin.(core.Formatter)
+
+	format.part = conf.GetInt("MIMEPart", 0)
+	format.contentType = strings.ToLower(conf.GetString("MIMEContentType", ""))
+	format.metadataKey = conf.GetString("MIMEMetadataKey", "content_type")
+	if format.metadataKey != "" {
+		core.RegisterMetadataWriter()
+	}
+
+	output := strings.ToLower(conf.GetString("MIMEOutput", "part"))
+	switch output {
+	case "part":
+		format.jsonOutput = false
+	case "json":
+		format.jsonOutput = true
+	default:
+		return fmt.Errorf("Unknown MIMEOutput: %s", output)
+	}
+
+	format.errorStreamID = core.InvalidStreamID
+	if errorStream := conf.GetString("MIMEErrorStream", ""); errorStream != "" {
+		format.errorStreamID = core.StreamRegistry.GetStreamID(errorStream)
+	}
+
+	return nil
+}
+
+// parseMIMEMessage returns all leaf parts of a MIME message.
+func parseMIMEMessage(data []byte) ([]mimePart, error) {
+	if bytes.HasPrefix(data, []byte("--")) {
+		lineEnd := bytes.IndexAny(data, "\r\n")
+		if lineEnd < 0 {
+			return nil, fmt.Errorf("Missing multipart boundary")
+		}
+		boundary := string(bytes.TrimSpace(data[2:lineEnd]))
+		return parseMIMEMultipart(bytes.NewReader(data), boundary)
+	}
+
+	reader := textproto.NewReader(bufio.NewReader(bytes.NewReader(data)))
+	header, err := reader.ReadMIMEHeader()
+	if err != nil {
+		return nil, err
+	}
+	return parseMIMEEntity(header, reader.R)
+}
+
+// parseMIMEEntity returns the leaf parts of an entity with the given header.
+func parseMIMEEntity(header textproto.MIMEHeader, body io.Reader) ([]mimePart, error) {
+	contentType := header.Get("Content-Type")
+	if contentType == "" {
+		contentType = "text/plain"
+	}
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return nil, err
+	}
+
+	if strings.HasPrefix(mediaType, "multipart/") {
+		return parseMIMEMultipart(body, params["boundary"])
+	}
+
+	if strings.EqualFold(header.Get("Content-Transfer-Encoding"), "base64") {
+		body = base64.NewDecoder(base64.StdEncoding, &mimeBase64Reader{reader: body})
+	}
+	content, err := ioutil.ReadAll(body)
+	if err != nil {
+		return nil, err
+	}
+
+	part := mimePart{
+		contentType: mediaType,
+		body:        content,
+	}
+	if _, dispositionParams, err := mime.ParseMediaType(header.Get("Content-Disposition")); err == nil {
+		part.filename = dispositionParams["filename"]
+		part.name = dispositionParams["name"]
+	}
+	if part.filename == "" {
+		part.filename = params["name"]
+	}
+	return []mimePart{part}, nil
+}
+
+// parseMIMEMultipart returns the leaf parts of a multipart body.
+func parseMIMEMultipart(body io.Reader, boundary string) ([]mimePart, error) {
+	if boundary == "" {
+		return nil, fmt.Errorf("Missing multipart boundary")
+	}
+
+	parts := []mimePart{}
+	reader := multipart.NewReader(body, boundary)
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			return parts, nil // ### return, all parts read ###
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		leafParts, err := parseMIMEEntity(part.Header, part)
+		if err != nil {
+			return nil, err
+		}
+		parts = append(parts, leafParts...)
+	}
+}
+
+// mimeBase64Reader removes line breaks from base64 encoded bodies.
+type mimeBase64Reader struct {
+	reader io.Reader
+}
+
+func (wrapper *mimeBase64Reader) Read(data []byte) (int, error) {
+	size, err := wrapper.reader.Read(data)
+	filtered := 0
+	for _, char := range data[:size] {
+		if char != '\r' && char != '\n' && char != ' ' && char != '\t' {
+			data[filtered] = char
+			filtered++
+		}
+	}
+	return filtered, err
+}
+
+// selectPart returns the configured part or false if it does not exist.
+func (format *MIME) selectPart(parts []mimePart) (mimePart, bool) {
+	if format.contentType == "" {
+		if format.part < 0 || format.part >= len(parts) {
+			return mimePart{}, false // ### return, no such part ###
+		}
+		return parts[format.part], true
+	}
+
+	for _, part := range parts {
+		if matched, _ := path.Match(format.contentType, part.contentType); matched {
+			return part, true
+		}
+	}
+	return mimePart{}, false
+}
+
+// partsToJSON writes all parts as a JSON array.
+func partsToJSON(parts []mimePart) []byte {
+	buffer := bytes.NewBufferString("[")
+	for i, part := range parts {
+		if i > 0 {
+			buffer.WriteByte(',')
+		}
+		buffer.WriteString(`{"content_type":`)
+		writeJSONString(buffer, part.contentType)
+		buffer.WriteString(`,"filename":`)
+		writeJSONString(buffer, part.filename)
+		buffer.WriteString(`,"name":`)
+		writeJSONString(buffer, part.name)
+		if utf8.Valid(part.body) {
+			buffer.WriteString(`,"body":`)
+			writeJSONString(buffer, string(part.body))
+		} else {
+			buffer.WriteString(`,"body_base64":`)
+			writeJSONString(buffer, base64.StdEncoding.EncodeToString(part.body))
+		}
+		buffer.WriteByte('}')
+	}
+	buffer.WriteByte(']')
+	return buffer.Bytes()
+}
+
+// extract returns the payload generated from the given MIME message and the
+// content type of the selected part.
+func (format *MIME) extract(data []byte) ([]byte, string, error) {
+	parts, err := parseMIMEMessage(data)
+	if err != nil {
+		return nil, "", err
+	}
+	if format.jsonOutput {
+		return partsToJSON(parts), "application/json", nil // ### return, all parts ###
+	}
+
+	part, found := format.selectPart(parts)
+	if !found {
+		return nil, "", fmt.Errorf("Message does not contain the selected part")
+	}
+	return part.body, part.contentType, nil
+}
+
+// Format replaces the message by the selected part
+func (format *MIME) Format(msg core.Message) ([]byte, core.MessageStreamID) {
+	data, streamID := format.base.Format(msg)
+
+	result, contentType, err := format.extract(data)
+	if err != nil {
+		if format.errorStreamID != core.InvalidStreamID {
+			return data, format.errorStreamID // ### return, route to error stream ###
+		}
+		Log.Warning.Print("MIME failed to parse a message: ", err)
+		return data, streamID
+	}
+
+	if format.metadataKey != "" {
+		msg.SetMetadata(format.metadataKey, contentType)
+	}
+	return result, streamID
+}
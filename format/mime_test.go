@@ -0,0 +1,119 @@
+// Copyright 2015-2016 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package format
+
+import (
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/shared"
+	"strings"
+	"testing"
+)
+
+var mimeTestEmail = strings.Replace(`From: bob@example.com
+Subject: test
+MIME-Version: 1.0
+Content-Type: multipart/mixed; boundary="outer"
+
+--outer
+Content-Type: multipart/alternative; boundary="inner"
+
+--inner
+Content-Type: text/plain; charset=utf-8
+Content-Transfer-Encoding: quoted-printable
+
+caf=C3=A9
+--inner
+Content-Type: text/html
+
+<p>cafe</p>
+--inner--
+--outer
+Content-Type: application/octet-stream
+Content-Disposition: attachment; filename="data.bin"
+Content-Transfer-Encoding: base64
+
+AAEC
+/w==
+--outer--
+`, "\n", "\r\n", -1)
+
+func TestMIMEPart(t *testing.T) {
+	expect := shared.NewExpect(t)
+
+	config := core.NewPluginConfig("")
+	config.Override("MIMEErrorStream", "error")
+	plugin, err := core.NewPluginWithType("format.MIME", config)
+	expect.NoError(err)
+	formatter, casted := plugin.(*MIME)
+	expect.True(casted)
+
+	msg := core.NewMessage(nil, []byte(mimeTestEmail), 0)
+	msg.PrepareMetadata()
+	result, streamID := formatter.Format(msg)
+	expect.Equal("café", string(result))
+	expect.Equal("text/plain", msg.Metadata["content_type"])
+	expect.Equal(msg.StreamID, streamID)
+
+	config = core.NewPluginConfig("")
+	config.Override("MIMEContentType", "application/*")
+	plugin, err = core.NewPluginWithType("format.MIME", config)
+	expect.NoError(err)
+	formatter, casted = plugin.(*MIME)
+	expect.True(casted)
+
+	result, _ = formatter.Format(msg)
+	expect.Equal([]byte{0, 1, 2, 255}, result)
+
+	config = core.NewPluginConfig("")
+	config.Override("MIMEErrorStream", "error")
+	config.Override("MIMEPart", 3)
+	plugin, err = core.NewPluginWithType("format.MIME", config)
+	expect.NoError(err)
+	formatter, casted = plugin.(*MIME)
+	expect.True(casted)
+
+	result, streamID = formatter.Format(msg)
+	expect.Equal(mimeTestEmail, string(result))
+	expect.Equal(core.StreamRegistry.GetStreamID("error"), streamID)
+}
+
+func TestMIMEMultipartBody(t *testing.T) {
+	expect := shared.NewExpect(t)
+	body := strings.Replace(`--xyz
+Content-Disposition: form-data; name="field"
+
+value
+--xyz
+Content-Disposition: form-data; name="upload"; filename="a.txt"
+Content-Type: text/plain
+
+hello
+--xyz--
+`, "\n", "\r\n", -1)
+
+	config := core.NewPluginConfig("")
+	config.Override("MIMEOutput", "json")
+	plugin, err := core.NewPluginWithType("format.MIME", config)
+	expect.NoError(err)
+	formatter, casted := plugin.(*MIME)
+	expect.True(casted)
+
+	msg := core.NewMessage(nil, []byte(body), 0)
+	msg.PrepareMetadata()
+	result, _ := formatter.Format(msg)
+	expect.Equal(`[{"content_type":"text/plain","filename":"","name":"field","body":"value"},`+
+		`{"content_type":"text/plain","filename":"a.txt","name":"upload","body":"hello"}]`, string(result))
+	expect.Equal("application/json", msg.Metadata["content_type"])
+}
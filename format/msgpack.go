@@ -0,0 +1,487 @@
+// Copyright 2015-2016 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package format
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/core/log"
+	"github.com/trivago/gollum/shared"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// MsgPack formatter plugin
+// MsgPack is a formatter that converts MessagePack encoded messages to JSON
+// and vice versa. Each message has to contain exactly one value.
+// Binary data is written as base64 encoded string. Map keys that are not
+// strings are converted to their JSON representation. Extension types are
+// written as object {"type": <type>, "data": <base64 data>}.
+// The order of object keys is preserved in both directions.
+// Configuration example
+//
+//  - "stream.Broadcast":
+//    Formatter: "format.MsgPack"
+//    MsgPackDataFormatter: "format.Forward"
+//    MsgPackDirection: "decode"
+//    MsgPackErrorStream: ""
+//
+// MsgPackDataFormatter defines a formatter that is applied before the message
+// is converted. By default this is set to "format.Forward".
+//
+// MsgPackDirection defines the direction of the conversion.
+// By default this is set to "decode".
+//  * "decode" converts MessagePack encoded messages to JSON.
+//  * "encode" converts JSON messages to MessagePack. Integers are written
+//    using the smallest possible encoding, all other numbers as float 64.
+//
+// MsgPackErrorStream defines a stream that messages which cannot be converted
+// are routed to. These messages are passed on unchanged.
+// By default this is set to "", i.e. a warning is logged and the message stays
+// on its stream.
+type MsgPack struct {
+	base          core.Formatter
+	encode        bool
+	errorStreamID core.MessageStreamID
+}
+
+// msgPackReader reads MessagePack encoded data and writes it as JSON.
+type msgPackReader struct {
+	data []byte
+	json *bytes.Buffer
+}
+
+func init() {
+	shared.TypeRegistry.Register(MsgPack{})
+}
+
+// Configure initializes this formatter with values from a plugin config.
+func (format *MsgPack) Configure(conf core.PluginConfig) error {
+	plugin, err := core.NewPluginWithType(conf.GetString("MsgPackDataFormatter", "format.Forward"), conf)
+	if err != nil {
+		return err
+	}
+	format.base = plugin.(core.Formatter)
+
+	direction := strings.ToLower(conf.GetString("MsgPackDirection", "decode"))
+	switch direction {
+	case "decode":
+	case "encode":
+		format.encode = true
+	default:
+		return fmt.Errorf("Unknown MsgPackDirection: %s", direction)
+	}
+
+	format.errorStreamID = core.InvalidStreamID
+	if errorStream := conf.GetString("MsgPackErrorStream", ""); errorStream != "" {
+		format.errorStreamID = core.StreamRegistry.GetStreamID(errorStream)
+	}
+
+	return nil
+}
+
+func (reader *msgPackReader) next(size int) ([]byte, error) {
+	if size < 0 || size > len(reader.data) {
+		return nil, fmt.Errorf("MsgPack: unexpected end of data")
+	}
+	value := reader.data[:size]
+	reader.data = reader.data[size:]
+	return value, nil
+}
+
+// length reads a big endian length of 1, 2 or 4 bytes.
+func (reader *msgPackReader) length(size int) (int, error) {
+	value, err := reader.next(size)
+	if err != nil {
+		return 0, err
+	}
+	switch size {
+	case 1:
+		return int(value[0]), nil
+	case 2:
+		return int(binary.BigEndian.Uint16(value)), nil
+	default:
+		return int(binary.BigEndian.Uint32(value)), nil
+	}
+}
+
+// writeJSON writes the given value as JSON.
+func (reader *msgPackReader) writeJSON(value interface{}) error {
+	encoder := json.NewEncoder(reader.json)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(value); err != nil {
+		return err
+	}
+	reader.json.Truncate(reader.json.Len() - 1) // remove newline added by Encode
+	return nil
+}
+
+// readArray writes an array with the given number of elements.
+func (reader *msgPackReader) readArray(count int) error {
+	reader.json.WriteByte('[')
+	for i := 0; i < count; i++ {
+		if i > 0 {
+			reader.json.WriteByte(',')
+		}
+		if err := reader.read(); err != nil {
+			return err
+		}
+	}
+	reader.json.WriteByte(']')
+	return nil
+}
+
+// readMap writes a map with the given number of entries as JSON object.
+func (reader *msgPackReader) readMap(count int) error {
+	reader.json.WriteByte('{')
+	for i := 0; i < count; i++ {
+		if i > 0 {
+			reader.json.WriteByte(',')
+		}
+
+		// Keys are decoded separately as JSON only allows string keys
+		keyReader := msgPackReader{data: reader.data, json: bytes.NewBuffer(nil)}
+		if err := keyReader.read(); err != nil {
+			return err
+		}
+		reader.data = keyReader.data
+
+		key := keyReader.json.String()
+		if !strings.HasPrefix(key, "\"") {
+			if err := reader.writeJSON(key); err != nil {
+				return err
+			}
+		} else {
+			reader.json.WriteString(key)
+		}
+
+		reader.json.WriteByte(':')
+		if err := reader.read(); err != nil {
+			return err
+		}
+	}
+	reader.json.WriteByte('}')
+	return nil
+}
+
+// readExt writes an extension type of the given size.
+func (reader *msgPackReader) readExt(size int) error {
+	extType, err := reader.next(1)
+	if err != nil {
+		return err
+	}
+	data, err := reader.next(size)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(reader.json, `{"type":%d,"data":"%s"}`, int8(extType[0]), base64.StdEncoding.EncodeToString(data))
+	return nil
+}
+
+// readFloat writes a float. NaN and infinity are written as strings.
+func (reader *msgPackReader) readFloat(bits int) error {
+	value, err := reader.next(bits / 8)
+	if err != nil {
+		return err
+	}
+	if bits == 32 {
+		return reader.writeJSON(jsonFloatValue(float64(math.Float32frombits(binary.BigEndian.Uint32(value))), 32))
+	}
+	return reader.writeJSON(jsonFloatValue(math.Float64frombits(binary.BigEndian.Uint64(value)), 64))
+}
+
+// read converts the next value to JSON.
+func (reader *msgPackReader) read() error {
+	header, err := reader.next(1)
+	if err != nil {
+		return err
+	}
+
+	code := header[0]
+	switch {
+	case code <= 0x7f:
+		reader.json.WriteString(strconv.Itoa(int(code)))
+		return nil
+	case code >= 0xe0:
+		reader.json.WriteString(strconv.Itoa(int(int8(code))))
+		return nil
+	case code&0xf0 == 0x80:
+		return reader.readMap(int(code & 0x0f))
+	case code&0xf0 == 0x90:
+		return reader.readArray(int(code & 0x0f))
+	case code&0xe0 == 0xa0:
+		value, err := reader.next(int(code & 0x1f))
+		if err != nil {
+			return err
+		}
+		return reader.writeJSON(string(value))
+	}
+
+	switch code {
+	case 0xc0:
+		reader.json.WriteString("null")
+	case 0xc2:
+		reader.json.WriteString("false")
+	case 0xc3:
+		reader.json.WriteString("true")
+
+	case 0xc4, 0xc5, 0xc6: // bin 8, 16, 32
+		size, err := reader.length(1 << (code - 0xc4))
+		if err != nil {
+			return err
+		}
+		value, err := reader.next(size)
+		if err != nil {
+			return err
+		}
+		return reader.writeJSON(base64.StdEncoding.EncodeToString(value))
+
+	case 0xc7, 0xc8, 0xc9: // ext 8, 16, 32
+		size, err := reader.length(1 << (code - 0xc7))
+		if err != nil {
+			return err
+		}
+		return reader.readExt(size)
+
+	case 0xca:
+		return reader.readFloat(32)
+	case 0xcb:
+		return reader.readFloat(64)
+
+	case 0xcc, 0xcd, 0xce, 0xcf: // uint 8, 16, 32, 64
+		value, err := reader.next(1 << (code - 0xcc))
+		if err != nil {
+			return err
+		}
+		number := uint64(0)
+		for _, b := range value {
+			number = number<<8 | uint64(b)
+		}
+		reader.json.WriteString(strconv.FormatUint(number, 10))
+
+	case 0xd0, 0xd1, 0xd2, 0xd3: // int 8, 16, 32, 64
+		size := 1 << (code - 0xd0)
+		value, err := reader.next(size)
+		if err != nil {
+			return err
+		}
+		number := uint64(0)
+		for _, b := range value {
+			number = number<<8 | uint64(b)
+		}
+		shift := uint(64 - 8*size)
+		reader.json.WriteString(strconv.FormatInt(int64(number<<shift)>>shift, 10))
+
+	case 0xd4, 0xd5, 0xd6, 0xd7, 0xd8: // fixext 1, 2, 4, 8, 16
+		return reader.readExt(1 << (code - 0xd4))
+
+	case 0xd9, 0xda, 0xdb: // str 8, 16, 32
+		size, err := reader.length(1 << (code - 0xd9))
+		if err != nil {
+			return err
+		}
+		value, err := reader.next(size)
+		if err != nil {
+			return err
+		}
+		return reader.writeJSON(string(value))
+
+	case 0xdc, 0xdd: // array 16, 32
+		count, err := reader.length(2 << (code - 0xdc))
+		if err != nil {
+			return err
+		}
+		return reader.readArray(count)
+
+	case 0xde, 0xdf: // map 16, 32
+		count, err := reader.length(2 << (code - 0xde))
+		if err != nil {
+			return err
+		}
+		return reader.readMap(count)
+
+	default:
+		return fmt.Errorf("MsgPack: invalid type 0x%x", code)
+	}
+	return nil
+}
+
+// msgPackAppendHeader appends the type code and size of an array, map or str
+// value. Sizes below fixLimit use the fix variant, code8 is the 8 bit variant
+// or 0 if the type has none. The 32 bit variant has to follow code16.
+func msgPackAppendHeader(buffer []byte, size int, fixCode byte, fixLimit int, code8 byte, code16 byte) []byte {
+	switch {
+	case size < fixLimit:
+		return append(buffer, fixCode|byte(size))
+	case code8 != 0 && size <= math.MaxUint8:
+		return append(buffer, code8, byte(size))
+	case size <= math.MaxUint16:
+		return append(buffer, code16, byte(size>>8), byte(size))
+	default:
+		return append(buffer, code16+1, byte(size>>24), byte(size>>16), byte(size>>8), byte(size))
+	}
+}
+
+// msgPackAppendString appends a str value.
+func msgPackAppendString(buffer []byte, value string) []byte {
+	buffer = msgPackAppendHeader(buffer, len(value), 0xa0, 32, 0xd9, 0xda)
+	return append(buffer, value...)
+}
+
+// msgPackAppendNumber appends a JSON number by using the smallest integer
+// encoding possible or float 64.
+func msgPackAppendNumber(buffer []byte, number json.Number) ([]byte, error) {
+	if value, err := strconv.ParseInt(string(number), 10, 64); err == nil {
+		switch {
+		case value >= 0 && value <= 0x7f:
+			return append(buffer, byte(value)), nil
+		case value < 0 && value >= -32:
+			return append(buffer, byte(int8(value))), nil
+		case value >= math.MinInt8 && value <= math.MaxUint8:
+			if value < 0 {
+				return append(buffer, 0xd0, byte(int8(value))), nil
+			}
+			return append(buffer, 0xcc, byte(value)), nil
+		case value >= math.MinInt16 && value <= math.MaxUint16:
+			code := byte(0xcd)
+			if value < 0 {
+				code = 0xd1
+			}
+			return append(buffer, code, byte(value>>8), byte(value)), nil
+		case value >= math.MinInt32 && value <= math.MaxUint32:
+			code := byte(0xce)
+			if value < 0 {
+				code = 0xd2
+			}
+			return append(buffer, code, byte(value>>24), byte(value>>16), byte(value>>8), byte(value)), nil
+		default:
+			var encoded [8]byte
+			binary.BigEndian.PutUint64(encoded[:], uint64(value))
+			return append(append(buffer, 0xd3), encoded[:]...), nil
+		}
+	}
+
+	if value, err := strconv.ParseUint(string(number), 10, 64); err == nil {
+		var encoded [8]byte
+		binary.BigEndian.PutUint64(encoded[:], value)
+		return append(append(buffer, 0xcf), encoded[:]...), nil
+	}
+
+	value, err := strconv.ParseFloat(string(number), 64)
+	if err != nil {
+		return nil, err
+	}
+	var encoded [8]byte
+	binary.BigEndian.PutUint64(encoded[:], math.Float64bits(value))
+	return append(append(buffer, 0xcb), encoded[:]...), nil
+}
+
+// msgPackAppendJSON reads the next JSON value from the decoder and appends it
+// as MessagePack. Values are read token by token to keep the order of object
+// keys.
+func msgPackAppendJSON(buffer []byte, decoder *json.Decoder) ([]byte, error) {
+	token, err := decoder.Token()
+	if err != nil {
+		return nil, err
+	}
+
+	switch value := token.(type) {
+	case nil:
+		return append(buffer, 0xc0), nil
+	case bool:
+		if value {
+			return append(buffer, 0xc3), nil
+		}
+		return append(buffer, 0xc2), nil
+	case json.Number:
+		return msgPackAppendNumber(buffer, value)
+	case string:
+		return msgPackAppendString(buffer, value), nil
+
+	case json.Delim:
+		content := []byte{}
+		count := 0
+		for decoder.More() {
+			if value == '{' {
+				key, err := decoder.Token()
+				if err != nil {
+					return nil, err
+				}
+				content = msgPackAppendString(content, key.(string))
+			}
+			if content, err = msgPackAppendJSON(content, decoder); err != nil {
+				return nil, err
+			}
+			count++
+		}
+		if _, err := decoder.Token(); err != nil {
+			return nil, err // ### return, missing closing delimiter ###
+		}
+
+		if value == '{' {
+			buffer = msgPackAppendHeader(buffer, count, 0x80, 16, 0, 0xde)
+		} else {
+			buffer = msgPackAppendHeader(buffer, count, 0x90, 16, 0, 0xdc)
+		}
+		return append(buffer, content...), nil
+	}
+	return nil, fmt.Errorf("MsgPack: unexpected JSON token %v", token)
+}
+
+// convert converts the message data in the configured direction.
+func (format *MsgPack) convert(data []byte) ([]byte, error) {
+	if format.encode {
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.UseNumber()
+		encoded, err := msgPackAppendJSON([]byte{}, decoder)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := decoder.Token(); err != io.EOF {
+			return nil, fmt.Errorf("MsgPack: message contains more than one JSON value")
+		}
+		return encoded, nil
+	}
+
+	reader := msgPackReader{data: data, json: bytes.NewBuffer(nil)}
+	if err := reader.read(); err != nil {
+		return nil, err
+	}
+	if len(reader.data) > 0 {
+		return nil, fmt.Errorf("MsgPack: message contains more than one value")
+	}
+	return reader.json.Bytes(), nil
+}
+
+// Format converts the message between MessagePack and JSON encoding
+func (format *MsgPack) Format(msg core.Message) ([]byte, core.MessageStreamID) {
+	data, streamID := format.base.Format(msg)
+
+	converted, err := format.convert(data)
+	if err != nil {
+		if format.errorStreamID != core.InvalidStreamID {
+			return data, format.errorStreamID // ### return, route to error stream ###
+		}
+		Log.Warning.Print("MsgPack failed to convert a message: ", err)
+		return data, streamID // ### return, conversion failed ###
+	}
+	return converted, streamID
+}
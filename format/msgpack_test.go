@@ -0,0 +1,94 @@
+// Copyright 2015-2016 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package format
+
+import (
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/shared"
+	"strings"
+	"testing"
+)
+
+func TestMsgPackEncode(t *testing.T) {
+	expect := shared.NewExpect(t)
+
+	config := core.NewPluginConfig("")
+	config.Override("MsgPackDirection", "encode")
+	config.Override("MsgPackErrorStream", "error")
+	plugin, err := core.NewPluginWithType("format.MsgPack", config)
+	expect.NoError(err)
+	encoder, casted := plugin.(*MsgPack)
+	expect.True(casted)
+
+	msg := core.NewMessage(nil, []byte(`{"compact":true,"schema":0}`), 0)
+	result, _ := encoder.Format(msg)
+	expect.Equal([]byte("\x82\xa7compact\xc3\xa6schema\x00"), result)
+
+	msg = core.NewMessage(nil, []byte(`[-1,-33,200,-200,70000,1.5,null,"a"]`), 0)
+	result, _ = encoder.Format(msg)
+	expect.Equal([]byte("\x98\xff\xd0\xdf\xcc\xc8\xd1\xff\x38\xce\x00\x01\x11\x70\xcb\x3f\xf8\x00\x00\x00\x00\x00\x00\xc0\xa1a"), result)
+
+	msg = core.NewMessage(nil, []byte(`{"a":1} {"b":2}`), 0)
+	_, streamID := encoder.Format(msg)
+	expect.Equal(core.StreamRegistry.GetStreamID("error"), streamID)
+}
+
+func TestMsgPackRoundtrip(t *testing.T) {
+	expect := shared.NewExpect(t)
+
+	config := core.NewPluginConfig("")
+	config.Override("MsgPackDirection", "encode")
+	pluginEncode, err := core.NewPluginWithType("format.MsgPack", config)
+	expect.NoError(err)
+	config.Override("MsgPackDirection", "decode")
+	pluginDecode, err := core.NewPluginWithType("format.MsgPack", config)
+	expect.NoError(err)
+
+	encoder, castedEncoder := pluginEncode.(*MsgPack)
+	expect.True(castedEncoder)
+	decoder, castedDecoder := pluginDecode.(*MsgPack)
+	expect.True(castedDecoder)
+
+	long := strings.Repeat("x", 300)
+	payload := `{"z":1,"a":[true,false,null,-5,-128,-40000,4294967296,18446744073709551615,0.25],` +
+		`"nested":{"key":"value"},"long":"` + long + `"}`
+
+	msg := core.NewMessage(nil, []byte(payload), 0)
+	msg.Data, _ = encoder.Format(msg)
+	result, _ := decoder.Format(msg)
+	expect.Equal(payload, string(result))
+}
+
+func TestMsgPackDecode(t *testing.T) {
+	expect := shared.NewExpect(t)
+
+	config := core.NewPluginConfig("")
+	config.Override("MsgPackDirection", "decode")
+	config.Override("MsgPackErrorStream", "error")
+	plugin, err := core.NewPluginWithType("format.MsgPack", config)
+	expect.NoError(err)
+	decoder, casted := plugin.(*MsgPack)
+	expect.True(casted)
+
+	// {1: bin(0x01 0x02), "t": fixext4(type 0, 0xff 0xff 0xff 0xff), "f": float32(0.5)}
+	data := []byte("\x83\x01\xc4\x02\x01\x02\xa1t\xd6\x00\xff\xff\xff\xff\xa1f\xca\x3f\x00\x00\x00")
+	msg := core.NewMessage(nil, data, 0)
+	result, _ := decoder.Format(msg)
+	expect.Equal(`{"1":"AQI=","t":{"type":0,"data":"/////w=="},"f":0.5}`, string(result))
+
+	msg = core.NewMessage(nil, []byte("\x92\x01"), 0)
+	_, streamID := decoder.Format(msg)
+	expect.Equal(core.StreamRegistry.GetStreamID("error"), streamID)
+}
@@ -0,0 +1,289 @@
+// Copyright 2015-2016 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package format
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/shared"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// otlpSeverityNumbers maps severity names to OpenTelemetry severity numbers
+var otlpSeverityNumbers = map[string]uint64{
+	"trace":         1,
+	"debug":         5,
+	"info":          9,
+	"informational": 9,
+	"notice":        10,
+	"warn":          13,
+	"warning":       13,
+	"error":         17,
+	"err":           17,
+	"critical":      18,
+	"crit":          18,
+	"alert":         19,
+	"fatal":         21,
+	"emergency":     21,
+	"emerg":         21,
+}
+
+// OTLP formatter plugin
+// OTLP is a formatter that converts messages into OpenTelemetry log export
+// requests as accepted by the "/v1/logs" endpoint of OpenTelemetry collectors.
+// Each message is written as one ExportLogsServiceRequest containing a single
+// LogRecord. The payload is used as body, the message timestamp as time and
+// all metadata fields as attributes.
+// Configuration example
+//
+//  - "stream.Broadcast":
+//    Formatter: "format.OTLP"
+//    OTLPDataFormatter: "format.Forward"
+//    OTLPEncoding: "json"
+//    OTLPServiceName: "gollum"
+//    OTLPResourceAttributes:
+//      "deployment.environment": "production"
+//    OTLPScopeName: "gollum"
+//    OTLPSeverity: "info"
+//    OTLPSeverityMetadata: ""
+//    OTLPStreamAttribute: "gollum.stream"
+//
+// OTLPDataFormatter defines a formatter that is applied before the message is
+// converted. By default this is set to "format.Forward".
+//
+// OTLPEncoding defines the encoding of the request. By default this is set to
+// "json".
+//  * "json" writes the OTLP/JSON encoding (Content-Type "application/json").
+//  * "protobuf" writes the binary protocol buffer encoding (Content-Type
+//    "application/x-protobuf").
+//
+// OTLPServiceName defines the "service.name" resource attribute. Set to "" to
+// disable. By default this is set to "gollum".
+//
+// OTLPResourceAttributes defines a map of additional resource attributes.
+// By default this map is empty.
+//
+// OTLPScopeName defines the name of the instrumentation scope.
+// By default this is set to "gollum".
+//
+// OTLPSeverity defines the severity of all messages, e.g. "info" or "error".
+// The severity number is derived from this name. By default this is set to
+// "info".
+//
+// OTLPSeverityMetadata defines a metadata key to read the severity from. If the
+// key is not set for a message, OTLPSeverity is used. By default this is set to
+// "".
+//
+// OTLPStreamAttribute defines the attribute used to store the name of the
+// stream a message was sent to. Set to "" to disable. By default this is set
+// to "gollum.stream".
+type OTLP struct {
+	base             core.Formatter
+	protobuf         bool
+	resource         []otlpAttribute
+	scopeName        string
+	severity         string
+	severityMetadata string
+	streamAttribute  string
+}
+
+type otlpAttribute struct {
+	key   string
+	value string
+}
+
+type otlpLogRecord struct {
+	timeUnixNano         uint64
+	observedTimeUnixNano uint64
+	severityNumber       uint64
+	severityText         string
+	body                 []byte
+	attributes           []otlpAttribute
+}
+
+func init() {
+	shared.TypeRegistry.Register(OTLP{})
+}
+
+// Configure initializes this formatter with values from a plugin config.
+func (format *OTLP) Configure(conf core.PluginConfig) error {
+	plugin, err := core.NewPluginWithType(conf.GetString("OTLPDataFormatter", "format.Forward"), conf)
+	if err != nil {
+		return err
+	}
+	format.base = plugin.(core.Formatter)
+
+	encoding := strings.ToLower(conf.GetString("OTLPEncoding", "json"))
+	switch encoding {
+	case "json":
+		format.protobuf = false
+	case "protobuf":
+		format.protobuf = true
+	default:
+		return fmt.Errorf("Unknown OTLPEncoding: %s", encoding)
+	}
+
+	format.resource = []otlpAttribute{}
+	if serviceName := conf.GetString("OTLPServiceName", "gollum"); serviceName != "" {
+		format.resource = append(format.resource, otlpAttribute{"service.name", serviceName})
+	}
+	format.resource = append(format.resource, otlpSortedAttributes(conf.GetStringMap("OTLPResourceAttributes", map[string]string{}))...)
+
+	format.scopeName = conf.GetString("OTLPScopeName", "gollum")
+	format.severity = conf.GetString("OTLPSeverity", "info")
+	format.severityMetadata = conf.GetString("OTLPSeverityMetadata", "")
+	format.streamAttribute = conf.GetString("OTLPStreamAttribute", "gollum.stream")
+	return nil
+}
+
+// otlpSortedAttributes converts a map to a list of attributes sorted by key.
+func otlpSortedAttributes(values map[string]string) []otlpAttribute {
+	attributes := make([]otlpAttribute, 0, len(values))
+	for key, value := range values {
+		attributes = append(attributes, otlpAttribute{key, value})
+	}
+	sort.Slice(attributes, func(i, j int) bool { return attributes[i].key < attributes[j].key })
+	return attributes
+}
+
+// newLogRecord creates the log record for the given message and payload.
+func (format *OTLP) newLogRecord(msg core.Message, data []byte) otlpLogRecord {
+	record := otlpLogRecord{
+		timeUnixNano:         uint64(msg.Timestamp.UnixNano()),
+		observedTimeUnixNano: uint64(time.Now().UnixNano()),
+		severityText:         format.severity,
+		body:                 data,
+		attributes:           otlpSortedAttributes(msg.Metadata),
+	}
+
+	if format.severityMetadata != "" {
+		if severity, exists := msg.Metadata[format.severityMetadata]; exists {
+			record.severityText = severity
+		}
+	}
+	record.severityNumber = otlpSeverityNumbers[strings.ToLower(record.severityText)]
+
+	if format.streamAttribute != "" {
+		streamName := core.StreamRegistry.GetStreamName(msg.StreamID)
+		record.attributes = append(record.attributes, otlpAttribute{format.streamAttribute, streamName})
+	}
+	return record
+}
+
+// writeOTLPAttributes writes a list of attributes as OTLP/JSON KeyValue array.
+func writeOTLPAttributes(buffer *bytes.Buffer, attributes []otlpAttribute) {
+	buffer.WriteByte('[')
+	for i, attribute := range attributes {
+		if i > 0 {
+			buffer.WriteByte(',')
+		}
+		buffer.WriteString(`{"key":`)
+		writeJSONString(buffer, attribute.key)
+		buffer.WriteString(`,"value":{"stringValue":`)
+		writeJSONString(buffer, attribute.value)
+		buffer.WriteString(`}}`)
+	}
+	buffer.WriteByte(']')
+}
+
+// encodeJSON returns the record as OTLP/JSON export request.
+func (format *OTLP) encodeJSON(record otlpLogRecord) []byte {
+	buffer := bytes.NewBufferString(`{"resourceLogs":[{"resource":{"attributes":`)
+	writeOTLPAttributes(buffer, format.resource)
+	buffer.WriteString(`},"scopeLogs":[{"scope":{"name":`)
+	writeJSONString(buffer, format.scopeName)
+	buffer.WriteString(`},"logRecords":[{"timeUnixNano":"`)
+	buffer.WriteString(strconv.FormatUint(record.timeUnixNano, 10))
+	buffer.WriteString(`","observedTimeUnixNano":"`)
+	buffer.WriteString(strconv.FormatUint(record.observedTimeUnixNano, 10))
+	buffer.WriteString(`","severityNumber":`)
+	buffer.WriteString(strconv.FormatUint(record.severityNumber, 10))
+	buffer.WriteString(`,"severityText":`)
+	writeJSONString(buffer, record.severityText)
+
+	if utf8.Valid(record.body) {
+		buffer.WriteString(`,"body":{"stringValue":`)
+		writeJSONString(buffer, string(record.body))
+	} else {
+		buffer.WriteString(`,"body":{"bytesValue":`)
+		writeJSONString(buffer, base64.StdEncoding.EncodeToString(record.body))
+	}
+
+	buffer.WriteString(`},"attributes":`)
+	writeOTLPAttributes(buffer, record.attributes)
+	buffer.WriteString(`}]}]}]}`)
+	return buffer.Bytes()
+}
+
+// appendOTLPAttributes appends a list of attributes as KeyValue fields with
+// the given field number.
+func appendOTLPAttributes(buffer []byte, number uint64, attributes []otlpAttribute) []byte {
+	for _, attribute := range attributes {
+		value := protoAppendBytes(nil, 1, []byte(attribute.value)) // AnyValue.string_value
+		keyValue := protoAppendBytes(nil, 1, []byte(attribute.key))
+		keyValue = protoAppendBytes(keyValue, 2, value)
+		buffer = protoAppendBytes(buffer, number, keyValue)
+	}
+	return buffer
+}
+
+// encodeProtobuf returns the record as binary export request.
+func (format *OTLP) encodeProtobuf(record otlpLogRecord) []byte {
+	body := []byte{}
+	if utf8.Valid(record.body) {
+		body = protoAppendBytes(body, 1, record.body) // AnyValue.string_value
+	} else {
+		body = protoAppendBytes(body, 7, record.body) // AnyValue.bytes_value
+	}
+
+	logRecord := protoAppendTag(nil, 1, protoWireFixed64)
+	logRecord = protoAppendNumeric(logRecord, protoWireFixed64, record.timeUnixNano)
+	if record.severityNumber != 0 {
+		logRecord = protoAppendTag(logRecord, 2, protoWireVarint)
+		logRecord = protoAppendVarint(logRecord, record.severityNumber)
+	}
+	logRecord = protoAppendBytes(logRecord, 3, []byte(record.severityText))
+	logRecord = protoAppendBytes(logRecord, 5, body)
+	logRecord = appendOTLPAttributes(logRecord, 6, record.attributes)
+	logRecord = protoAppendTag(logRecord, 11, protoWireFixed64)
+	logRecord = protoAppendNumeric(logRecord, protoWireFixed64, record.observedTimeUnixNano)
+
+	scope := protoAppendBytes(nil, 1, []byte(format.scopeName))
+	scopeLogs := protoAppendBytes(nil, 1, scope)
+	scopeLogs = protoAppendBytes(scopeLogs, 2, logRecord)
+
+	resource := appendOTLPAttributes(nil, 1, format.resource)
+	resourceLogs := protoAppendBytes(nil, 1, resource)
+	resourceLogs = protoAppendBytes(resourceLogs, 2, scopeLogs)
+
+	return protoAppendBytes(nil, 1, resourceLogs)
+}
+
+// Format returns the message as OpenTelemetry log export request
+func (format *OTLP) Format(msg core.Message) ([]byte, core.MessageStreamID) {
+	data, streamID := format.base.Format(msg)
+	record := format.newLogRecord(msg, data)
+
+	if format.protobuf {
+		return format.encodeProtobuf(record), streamID
+	}
+	return format.encodeJSON(record), streamID
+}
@@ -0,0 +1,86 @@
+// Copyright 2015-2016 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package format
+
+import (
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/shared"
+	"regexp"
+	"testing"
+	"time"
+)
+
+func newOTLPTestMessage() core.Message {
+	msg := core.NewMessage(nil, []byte("hello"), 0)
+	msg.Timestamp = time.Unix(1500000000, 5)
+	msg.StreamID = core.StreamRegistry.GetStreamID("otlp")
+	msg.SetMetadata("level", "warning")
+	msg.SetMetadata("host", "web1")
+	return msg
+}
+
+func TestOTLPJSON(t *testing.T) {
+	expect := shared.NewExpect(t)
+
+	config := core.NewPluginConfig("")
+	config.Override("OTLPResourceAttributes", map[interface{}]interface{}{"env": "test"})
+	config.Override("OTLPSeverityMetadata", "level")
+	plugin, err := core.NewPluginWithType("format.OTLP", config)
+	expect.NoError(err)
+	formatter, casted := plugin.(*OTLP)
+	expect.True(casted)
+
+	result, _ := formatter.Format(newOTLPTestMessage())
+	expected := regexp.QuoteMeta(`{"resourceLogs":[{"resource":{"attributes":[`+
+		`{"key":"service.name","value":{"stringValue":"gollum"}},{"key":"env","value":{"stringValue":"test"}}]},`+
+		`"scopeLogs":[{"scope":{"name":"gollum"},"logRecords":[{"timeUnixNano":"1500000000000000005","observedTimeUnixNano":"`) +
+		`[0-9]+` + regexp.QuoteMeta(`","severityNumber":13,"severityText":"warning","body":{"stringValue":"hello"},"attributes":[`+
+		`{"key":"host","value":{"stringValue":"web1"}},{"key":"level","value":{"stringValue":"warning"}},`+
+		`{"key":"gollum.stream","value":{"stringValue":"otlp"}}]}]}]}]}`)
+	expect.True(regexp.MustCompile("^" + expected + "$").Match(result))
+}
+
+func TestOTLPProtobuf(t *testing.T) {
+	expect := shared.NewExpect(t)
+
+	config := core.NewPluginConfig("")
+	config.Override("OTLPEncoding", "protobuf")
+	config.Override("OTLPStreamAttribute", "")
+	plugin, err := core.NewPluginWithType("format.OTLP", config)
+	expect.NoError(err)
+	formatter := plugin.(*OTLP)
+
+	result, _ := formatter.Format(newOTLPTestMessage())
+	request, err := protoReadFields(result)
+	expect.NoError(err)
+	expect.Equal(1, len(request))
+
+	resourceLogs, err := protoReadFields(request[0].data)
+	expect.NoError(err)
+	expect.Equal(2, len(resourceLogs))
+
+	scopeLogs, err := protoReadFields(resourceLogs[1].data)
+	expect.NoError(err)
+	expect.Equal(2, len(scopeLogs))
+
+	record, err := protoReadFields(scopeLogs[1].data)
+	expect.NoError(err)
+	expect.Equal(7, len(record)) // time, severity number, text, body, 2 attributes, observed time
+	expect.Equal(uint64(1500000000000000005), record[0].value)
+	expect.Equal(uint64(9), record[1].value)
+	expect.Equal("info", string(record[2].data))
+	expect.Equal("\x0a\x05hello", string(record[3].data))
+	expect.Equal(uint64(11), record[6].number)
+}
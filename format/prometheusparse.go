@@ -0,0 +1,265 @@
+// Copyright 2015-2016 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package format
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/core/log"
+	"github.com/trivago/gollum/shared"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// prometheusSuffixes are appended to the name of histograms and summaries
+var prometheusSuffixes = []string{"_bucket", "_count", "_sum"}
+
+// PrometheusParse formatter plugin
+// PrometheusParse is a formatter that converts metrics in the Prometheus text
+// exposition format into JSON documents. One JSON object is written per sample
+// holding the fields "name", "labels", "value", "timestamp" and, if declared,
+// "type". Timestamps are given in milliseconds. Samples without a timestamp
+// use the message timestamp. The values NaN, +Inf and -Inf are written as
+// strings.
+// As formatters cannot split messages, all samples are written into the same
+// message.
+// Configuration example
+//
+//  - "stream.Broadcast":
+//    Formatter: "format.PrometheusParse"
+//    PrometheusParseDataFormatter: "format.Forward"
+//    PrometheusParseOutput: "lines"
+//    PrometheusParseErrorStream: ""
+//
+// PrometheusParseDataFormatter defines a formatter that is applied before the
+// message is parsed. By default this is set to "format.Forward".
+//
+// PrometheusParseOutput defines how samples are combined.
+// By default this is set to "lines".
+//  * "lines" writes one JSON object per line.
+//  * "array" writes a JSON array of all samples.
+//
+// PrometheusParseErrorStream defines a stream that messages containing invalid
+// lines are routed to. These messages are passed on unchanged.
+// By default this is set to "", i.e. a warning is logged and the message stays
+// on its stream.
+type PrometheusParse struct {
+	base          core.Formatter
+	array         bool
+	errorStreamID core.MessageStreamID
+}
+
+func init() {
+	shared.TypeRegistry.Register(PrometheusParse{})
+}
+
+// Configure initializes this formatter with values from a plugin config.
+func (format *PrometheusParse) Configure(conf core.PluginConfig) error {
+	plugin, err := core.NewPluginWithType(conf.GetString("PrometheusParseDataFormatter", "format.Forward"), conf)
+	if err != nil {
+		return err
+	}
+	format.base = plugin.(core.Formatter)
+
+	output := strings.ToLower(conf.GetString("PrometheusParseOutput", "lines"))
+	switch output {
+	case "lines":
+		format.array = false
+	case "array":
+		format.array = true
+	default:
+		return fmt.Errorf("Unknown PrometheusParseOutput: %s", output)
+	}
+
+	format.errorStreamID = core.InvalidStreamID
+	if errorStream := conf.GetString("PrometheusParseErrorStream", ""); errorStream != "" {
+		format.errorStreamID = core.StreamRegistry.GetStreamID(errorStream)
+	}
+
+	return nil
+}
+
+// parsePrometheusLabels parses a label set without the surrounding braces and
+// adds all labels to the given node.
+func parsePrometheusLabels(data string, labels *splitToJSONNode) error {
+	for data = strings.TrimSpace(data); data != ""; data = strings.TrimSpace(data) {
+		assign := strings.IndexByte(data, '=')
+		if assign <= 0 {
+			return fmt.Errorf("Invalid label set")
+		}
+		name := strings.TrimSpace(data[:assign])
+		data = strings.TrimSpace(data[assign+1:])
+		if len(data) == 0 || data[0] != '"' {
+			return fmt.Errorf("Label %s is not quoted", name)
+		}
+
+		value := bytes.NewBuffer(nil)
+		end := 1
+		for ; end < len(data) && data[end] != '"'; end++ {
+			if data[end] == '\\' && end+1 < len(data) {
+				end++
+				switch data[end] {
+				case 'n':
+					value.WriteByte('\n')
+				default:
+					value.WriteByte(data[end])
+				}
+				continue
+			}
+			value.WriteByte(data[end])
+		}
+		if end >= len(data) {
+			return fmt.Errorf("Label %s is not terminated", name)
+		}
+
+		labels.set([]string{name}, value.String())
+		data = strings.TrimPrefix(strings.TrimSpace(data[end+1:]), ",")
+	}
+	return nil
+}
+
+// parsePrometheusValue converts a sample value. Values that cannot be
+// represented in JSON are returned as string.
+func parsePrometheusValue(data string) (interface{}, error) {
+	value, err := strconv.ParseFloat(data, 64)
+	switch {
+	case err != nil:
+		return nil, fmt.Errorf("Invalid value %s", data)
+	case math.IsNaN(value):
+		return "NaN", nil
+	case math.IsInf(value, 1):
+		return "+Inf", nil
+	case math.IsInf(value, -1):
+		return "-Inf", nil
+	default:
+		return value, nil
+	}
+}
+
+// parseSample converts a sample line into a JSON object.
+func (format *PrometheusParse) parseSample(line string, types map[string]string, timestamp int64) ([]byte, error) {
+	sample := &splitToJSONNode{children: []*splitToJSONNode{}}
+	labels := &splitToJSONNode{key: "labels", children: []*splitToJSONNode{}}
+
+	nameEnd := strings.IndexAny(line, "{ \t")
+	if nameEnd <= 0 {
+		return nil, fmt.Errorf("Invalid sample: %s", line)
+	}
+	name := line[:nameEnd]
+	remain := line[nameEnd:]
+
+	if remain[0] == '{' {
+		labelEnd := strings.LastIndexByte(remain, '}')
+		if labelEnd < 0 {
+			return nil, fmt.Errorf("Invalid sample: %s", line)
+		}
+		if err := parsePrometheusLabels(remain[1:labelEnd], labels); err != nil {
+			return nil, err
+		}
+		remain = remain[labelEnd+1:]
+	}
+
+	fields := strings.Fields(remain)
+	if len(fields) < 1 || len(fields) > 2 {
+		return nil, fmt.Errorf("Invalid sample: %s", line)
+	}
+	value, err := parsePrometheusValue(fields[0])
+	if err != nil {
+		return nil, err
+	}
+	if len(fields) == 2 {
+		if timestamp, err = strconv.ParseInt(fields[1], 10, 64); err != nil {
+			return nil, fmt.Errorf("Invalid timestamp %s", fields[1])
+		}
+	}
+
+	sample.set([]string{"name"}, name)
+	sample.children = append(sample.children, labels)
+	sample.set([]string{"value"}, value)
+	sample.set([]string{"timestamp"}, timestamp)
+
+	metricType, known := types[name]
+	for _, suffix := range prometheusSuffixes {
+		if !known && strings.HasSuffix(name, suffix) {
+			metricType, known = types[strings.TrimSuffix(name, suffix)]
+		}
+	}
+	if known {
+		sample.set([]string{"type"}, metricType)
+	}
+	return sample.MarshalJSON()
+}
+
+// parse converts all samples of the given exposition payload.
+func (format *PrometheusParse) parse(data []byte, timestamp int64) ([]byte, error) {
+	buffer := bytes.NewBuffer(nil)
+	types := make(map[string]string)
+	samples := 0
+
+	if format.array {
+		buffer.WriteByte('[')
+	}
+
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case line == "":
+			continue // ### continue, empty line ###
+
+		case line[0] == '#':
+			if comment := strings.Fields(line[1:]); len(comment) == 3 && comment[0] == "TYPE" {
+				types[comment[1]] = comment[2]
+			}
+			continue // ### continue, comment ###
+		}
+
+		sample, err := format.parseSample(line, types, timestamp)
+		if err != nil {
+			return nil, err
+		}
+
+		switch {
+		case samples > 0 && format.array:
+			buffer.WriteByte(',')
+		case samples > 0:
+			buffer.WriteByte('\n')
+		}
+		buffer.Write(sample)
+		samples++
+	}
+
+	if format.array {
+		buffer.WriteByte(']')
+	}
+	return buffer.Bytes(), nil
+}
+
+// Format returns the samples of the message as JSON
+func (format *PrometheusParse) Format(msg core.Message) ([]byte, core.MessageStreamID) {
+	data, streamID := format.base.Format(msg)
+
+	result, err := format.parse(data, msg.Timestamp.UnixNano()/1000000)
+	if err != nil {
+		if format.errorStreamID != core.InvalidStreamID {
+			return data, format.errorStreamID // ### return, route to error stream ###
+		}
+		Log.Warning.Print("PrometheusParse failed to parse a message: ", err)
+		return data, streamID
+	}
+
+	return result, streamID
+}
@@ -0,0 +1,71 @@
+// Copyright 2015-2016 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package format
+
+import (
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/shared"
+	"testing"
+	"time"
+)
+
+const prometheusTestPayload = `# HELP http_requests_total The total number of HTTP requests.
+# TYPE http_requests_total counter
+http_requests_total{method="post",code="200"} 1027 1395066363000
+http_requests_total{method="post",path="/a\"b\\c"} 3
+
+# TYPE rpc_duration_seconds histogram
+rpc_duration_seconds_bucket{le="+Inf"} 17
+up NaN
+`
+
+func TestPrometheusParse(t *testing.T) {
+	expect := shared.NewExpect(t)
+
+	config := core.NewPluginConfig("")
+	config.Override("PrometheusParseErrorStream", "error")
+	plugin, err := core.NewPluginWithType("format.PrometheusParse", config)
+	expect.NoError(err)
+	formatter, casted := plugin.(*PrometheusParse)
+	expect.True(casted)
+
+	msg := core.NewMessage(nil, []byte(prometheusTestPayload), 0)
+	msg.Timestamp = time.Unix(1500000000, 0)
+	result, streamID := formatter.Format(msg)
+	expect.Equal(`{"name":"http_requests_total","labels":{"method":"post","code":"200"},"value":1027,"timestamp":1395066363000,"type":"counter"}`+"\n"+
+		`{"name":"http_requests_total","labels":{"method":"post","path":"/a\"b\\c"},"value":3,"timestamp":1500000000000,"type":"counter"}`+"\n"+
+		`{"name":"rpc_duration_seconds_bucket","labels":{"le":"+Inf"},"value":17,"timestamp":1500000000000,"type":"histogram"}`+"\n"+
+		`{"name":"up","labels":{},"value":"NaN","timestamp":1500000000000}`, string(result))
+	expect.Equal(msg.StreamID, streamID)
+
+	msg = core.NewMessage(nil, []byte("metric{a=b} 1"), 0)
+	result, streamID = formatter.Format(msg)
+	expect.Equal("metric{a=b} 1", string(result))
+	expect.Equal(core.StreamRegistry.GetStreamID("error"), streamID)
+}
+
+func TestPrometheusParseArray(t *testing.T) {
+	expect := shared.NewExpect(t)
+
+	config := core.NewPluginConfig("")
+	config.Override("PrometheusParseOutput", "array")
+	plugin, err := core.NewPluginWithType("format.PrometheusParse", config)
+	expect.NoError(err)
+	formatter := plugin.(*PrometheusParse)
+
+	msg := core.NewMessage(nil, []byte("a 1 10\nb 2.5 20\n"), 0)
+	result, _ := formatter.Format(msg)
+	expect.Equal(`[{"name":"a","labels":{},"value":1,"timestamp":10},{"name":"b","labels":{},"value":2.5,"timestamp":20}]`, string(result))
+}
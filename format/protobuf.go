@@ -0,0 +1,704 @@
+// Copyright 2015-2016 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package format
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/core/log"
+	"github.com/trivago/gollum/shared"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Protobuf formatter plugin
+// Protobuf is a formatter that converts binary protocol buffer messages to
+// JSON and vice versa. Message types are read from FileDescriptorSet files
+// as generated by "protoc --include_imports --descriptor_set_out=<file>", so
+// no generated code is required.
+// The JSON format follows the protocol buffer JSON mapping, i.e. 64-bit
+// integers are written as strings, bytes are base64 encoded and enums are
+// written by name. Fields with default values are not present in binary
+// proto3 messages and are therefore omitted. Groups are not supported.
+// Configuration example
+//
+//  - "stream.Broadcast":
+//    Formatter: "format.Protobuf"
+//    ProtobufDataFormatter: "format.Forward"
+//    ProtobufDescriptorFiles:
+//      - "/etc/gollum/events.desc"
+//    ProtobufType: "events.Event"
+//    ProtobufDirection: "decode"
+//    ProtobufOriginalNames: false
+//    ProtobufErrorStream: ""
+//
+// ProtobufDataFormatter defines a formatter that is applied before the message
+// is converted. By default this is set to "format.Forward".
+//
+// ProtobufDescriptorFiles defines a list of FileDescriptorSet files to read
+// message types from. All types referenced by ProtobufType have to be defined
+// in these files. By default this list is empty.
+//
+// ProtobufType defines the fully qualified name of the message type to
+// convert, e.g. "package.Message". If no type is set, messages are decoded
+// without a schema, similar to "protoc --decode_raw". In this case field
+// numbers are used as keys and the type of a value is guessed.
+// By default this is set to "".
+//
+// ProtobufDirection defines the direction of the conversion.
+// By default this is set to "decode".
+//  * "decode" converts binary protocol buffer messages to JSON.
+//  * "encode" converts JSON objects to binary protocol buffer messages. This
+//    requires ProtobufType to be set. Unknown fields are treated as error.
+//
+// ProtobufOriginalNames can be set to true to use the field names as defined
+// in the .proto file instead of their lowerCamelCase JSON names when decoding.
+// Both names are accepted when encoding. By default this is set to false.
+//
+// ProtobufErrorStream defines a stream that messages which cannot be
+// converted are routed to. These messages are passed on unchanged.
+// By default this is set to "", i.e. a warning is logged and the message stays
+// on its stream.
+type Protobuf struct {
+	base          core.Formatter
+	message       *protoMessageType
+	encode        bool
+	originalNames bool
+	errorStreamID core.MessageStreamID
+}
+
+func init() {
+	shared.TypeRegistry.Register(Protobuf{})
+}
+
+// Configure initializes this formatter with values from a plugin config.
+func (format *Protobuf) Configure(conf core.PluginConfig) error {
+	plugin, err := core.NewPluginWithType(conf.GetString("ProtobufDataFormatter", "format.Forward"), conf)
+	if err != nil {
+		return err
+	}
+	format.base = plugin.(core.Formatter)
+	format.originalNames = conf.GetBool("ProtobufOriginalNames", false)
+
+	direction := strings.ToLower(conf.GetString("ProtobufDirection", "decode"))
+	switch direction {
+	case "decode":
+	case "encode":
+		format.encode = true
+	default:
+		return fmt.Errorf("Unknown ProtobufDirection: %s", direction)
+	}
+
+	schema, err := newProtoSchema(conf.GetStringArray("ProtobufDescriptorFiles", []string{}))
+	if err != nil {
+		return err
+	}
+
+	if typeName := strings.TrimPrefix(conf.GetString("ProtobufType", ""), "."); typeName != "" {
+		if format.message = schema.messages[typeName]; format.message == nil {
+			return fmt.Errorf("Protobuf type %s is not defined by ProtobufDescriptorFiles", typeName)
+		}
+	} else if format.encode {
+		return fmt.Errorf("ProtobufDirection \"encode\" requires ProtobufType to be set")
+	}
+
+	format.errorStreamID = core.InvalidStreamID
+	if errorStream := conf.GetString("ProtobufErrorStream", ""); errorStream != "" {
+		format.errorStreamID = core.StreamRegistry.GetStreamID(errorStream)
+	}
+
+	return nil
+}
+
+// jsonFloatValue converts a float to a JSON value. NaN and infinity are not
+// valid JSON numbers and are written as strings.
+func jsonFloatValue(value float64, bits int) interface{} {
+	switch {
+	case math.IsNaN(value):
+		return "NaN"
+	case math.IsInf(value, 1):
+		return "Infinity"
+	case math.IsInf(value, -1):
+		return "-Infinity"
+	}
+	return json.Number(strconv.FormatFloat(value, 'g', -1, bits))
+}
+
+// fieldKey returns the JSON key used for the given field.
+func (format *Protobuf) fieldKey(field *protoField) string {
+	if format.originalNames {
+		return field.name
+	}
+	return field.jsonName
+}
+
+// decodeScalar converts a single non-repeated value to JSON.
+func (format *Protobuf) decodeScalar(field *protoField, value protoWireField) (interface{}, error) {
+	if value.wireType != protoWireTypeOf(field.kind) {
+		return nil, fmt.Errorf("Protobuf: unexpected wire type %d for field %s", value.wireType, field.name)
+	}
+
+	raw := value.value
+	switch field.kind {
+	case protoTypeDouble:
+		return jsonFloatValue(math.Float64frombits(raw), 64), nil
+	case protoTypeFloat:
+		return jsonFloatValue(protoFloat32(raw), 32), nil
+	case protoTypeInt64, protoTypeSfixed64:
+		return strconv.FormatInt(int64(raw), 10), nil
+	case protoTypeUint64, protoTypeFixed64:
+		return strconv.FormatUint(raw, 10), nil
+	case protoTypeSint64:
+		return strconv.FormatInt(int64(raw>>1)^-int64(raw&1), 10), nil
+	case protoTypeInt32, protoTypeSfixed32:
+		return int32(raw), nil
+	case protoTypeSint32:
+		return int32(uint32(raw)>>1) ^ -int32(raw&1), nil
+	case protoTypeUint32, protoTypeFixed32:
+		return uint32(raw), nil
+	case protoTypeBool:
+		return raw != 0, nil
+	case protoTypeEnum:
+		if name, exists := field.enum.byNumber[int32(raw)]; exists {
+			return name, nil
+		}
+		return int32(raw), nil
+	case protoTypeString:
+		return string(value.data), nil
+	case protoTypeBytes:
+		return base64.StdEncoding.EncodeToString(value.data), nil
+	case protoTypeMessage:
+		return format.decodeMessage(field.message, value.data)
+	}
+	return nil, fmt.Errorf("Protobuf: unsupported type %d for field %s", field.kind, field.name)
+}
+
+// decodeDefault returns the default value of a field as JSON. This is used
+// for map entries without key or value.
+func (format *Protobuf) decodeDefault(field *protoField) (interface{}, error) {
+	return format.decodeScalar(field, protoWireField{wireType: protoWireTypeOf(field.kind)})
+}
+
+// unpack splits a packed repeated field into its values.
+func (format *Protobuf) unpack(field *protoField, data []byte) ([]protoWireField, error) {
+	values := []protoWireField{}
+	wireType := protoWireTypeOf(field.kind)
+
+	for len(data) > 0 {
+		value := protoWireField{number: field.number, wireType: wireType}
+		switch wireType {
+		case protoWireVarint:
+			var size int
+			if value.value, size = binary.Uvarint(data); size <= 0 {
+				return nil, fmt.Errorf("Protobuf: invalid packed field %s", field.name)
+			}
+			data = data[size:]
+		case protoWireFixed32:
+			if len(data) < 4 {
+				return nil, fmt.Errorf("Protobuf: invalid packed field %s", field.name)
+			}
+			value.value = uint64(binary.LittleEndian.Uint32(data))
+			data = data[4:]
+		case protoWireFixed64:
+			if len(data) < 8 {
+				return nil, fmt.Errorf("Protobuf: invalid packed field %s", field.name)
+			}
+			value.value = binary.LittleEndian.Uint64(data)
+			data = data[8:]
+		}
+		values = append(values, value)
+	}
+	return values, nil
+}
+
+// decodeMapEntry converts a map entry to the key and value stored in the
+// JSON object representing the map.
+func (format *Protobuf) decodeMapEntry(entryType *protoMessageType, data []byte) (string, interface{}, error) {
+	wireFields, err := protoReadFields(data)
+	if err != nil {
+		return "", nil, err
+	}
+
+	keyField, valueField := entryType.byNumber[1], entryType.byNumber[2]
+	if keyField == nil || valueField == nil {
+		return "", nil, fmt.Errorf("Protobuf: invalid map entry type %s", entryType.name)
+	}
+
+	key, err := format.decodeDefault(keyField)
+	if err != nil {
+		return "", nil, err
+	}
+	value, err := format.decodeDefault(valueField)
+	if err != nil {
+		return "", nil, err
+	}
+
+	for _, wireField := range wireFields {
+		switch wireField.number {
+		case 1:
+			key, err = format.decodeScalar(keyField, wireField)
+		case 2:
+			value, err = format.decodeScalar(valueField, wireField)
+		}
+		if err != nil {
+			return "", nil, err
+		}
+	}
+	return fmt.Sprint(key), value, nil
+}
+
+// decodeMessage converts a binary message of the given type to a JSON object.
+// Fields are written in the order of their declaration, unknown fields are
+// ignored.
+func (format *Protobuf) decodeMessage(messageType *protoMessageType, data []byte) (*splitToJSONNode, error) {
+	wireFields, err := protoReadFields(data)
+	if err != nil {
+		return nil, err
+	}
+
+	values := make(map[uint64][]protoWireField)
+	for _, wireField := range wireFields {
+		field, known := messageType.byNumber[wireField.number]
+		switch {
+		case !known:
+			continue // ### continue, unknown field ###
+
+		case field.repeated && wireField.wireType == protoWireBytes && protoWireTypeOf(field.kind) != protoWireBytes:
+			unpacked, err := format.unpack(field, wireField.data)
+			if err != nil {
+				return nil, err
+			}
+			values[field.number] = append(values[field.number], unpacked...)
+
+		default:
+			values[field.number] = append(values[field.number], wireField)
+		}
+	}
+
+	root := &splitToJSONNode{children: []*splitToJSONNode{}}
+	for _, field := range messageType.fields {
+		fieldValues, exists := values[field.number]
+		if !exists {
+			continue // ### continue, field not set ###
+		}
+
+		key := format.fieldKey(field)
+		switch {
+		case field.repeated && field.message != nil && field.message.mapEntry:
+			entries := &splitToJSONNode{key: key, children: []*splitToJSONNode{}}
+			for _, fieldValue := range fieldValues {
+				entryKey, entryValue, err := format.decodeMapEntry(field.message, fieldValue.data)
+				if err != nil {
+					return nil, err
+				}
+				entries.set([]string{entryKey}, entryValue)
+			}
+			root.children = append(root.children, entries)
+
+		case field.repeated:
+			array := make([]interface{}, 0, len(fieldValues))
+			for _, fieldValue := range fieldValues {
+				value, err := format.decodeScalar(field, fieldValue)
+				if err != nil {
+					return nil, err
+				}
+				array = append(array, value)
+			}
+			root.set([]string{key}, array)
+
+		default:
+			value, err := format.decodeScalar(field, fieldValues[len(fieldValues)-1])
+			if err != nil {
+				return nil, err
+			}
+			root.set([]string{key}, value)
+		}
+	}
+	return root, nil
+}
+
+// protoIsText returns true if the given data looks like a printable string.
+func protoIsText(data []byte) bool {
+	if !utf8.Valid(data) {
+		return false
+	}
+	for _, char := range string(data) {
+		if !unicode.IsPrint(char) && !unicode.IsSpace(char) {
+			return false
+		}
+	}
+	return true
+}
+
+// decodeRaw converts a binary message without a known type to a JSON object
+// by using the field numbers as keys. Length delimited fields are written as
+// string if printable, as object if they can be parsed as message and as
+// base64 encoded bytes otherwise. Repeated fields are written as arrays.
+func (format *Protobuf) decodeRaw(data []byte) (*splitToJSONNode, error) {
+	wireFields, err := protoReadFields(data)
+	if err != nil {
+		return nil, err
+	}
+
+	numbers := []uint64{}
+	values := make(map[uint64][]interface{})
+	for _, wireField := range wireFields {
+		var value interface{}
+		switch wireField.wireType {
+		case protoWireBytes:
+			if protoIsText(wireField.data) {
+				value = string(wireField.data)
+			} else if nested, err := format.decodeRaw(wireField.data); err == nil {
+				value = nested
+			} else {
+				value = base64.StdEncoding.EncodeToString(wireField.data)
+			}
+		default:
+			value = wireField.value
+		}
+
+		if _, exists := values[wireField.number]; !exists {
+			numbers = append(numbers, wireField.number)
+		}
+		values[wireField.number] = append(values[wireField.number], value)
+	}
+
+	root := &splitToJSONNode{children: []*splitToJSONNode{}}
+	for _, number := range numbers {
+		key := strconv.FormatUint(number, 10)
+		if fieldValues := values[number]; len(fieldValues) == 1 {
+			root.set([]string{key}, fieldValues[0])
+		} else {
+			root.set([]string{key}, fieldValues)
+		}
+	}
+	return root, nil
+}
+
+// protoParseInt parses a JSON number or string as signed integer.
+func protoParseInt(field *protoField, value interface{}, bits int) (int64, error) {
+	switch number := value.(type) {
+	case json.Number:
+		return strconv.ParseInt(string(number), 10, bits)
+	case string:
+		return strconv.ParseInt(number, 10, bits)
+	}
+	return 0, fmt.Errorf("Protobuf: field %s requires an integer", field.name)
+}
+
+// protoParseUint parses a JSON number or string as unsigned integer.
+func protoParseUint(field *protoField, value interface{}, bits int) (uint64, error) {
+	switch number := value.(type) {
+	case json.Number:
+		return strconv.ParseUint(string(number), 10, bits)
+	case string:
+		return strconv.ParseUint(number, 10, bits)
+	}
+	return 0, fmt.Errorf("Protobuf: field %s requires an unsigned integer", field.name)
+}
+
+// protoParseFloat parses a JSON number or string as float.
+func protoParseFloat(field *protoField, value interface{}, bits int) (float64, error) {
+	switch number := value.(type) {
+	case json.Number:
+		return strconv.ParseFloat(string(number), bits)
+	case string:
+		switch number {
+		case "NaN":
+			return math.NaN(), nil
+		case "Infinity":
+			return math.Inf(1), nil
+		case "-Infinity":
+			return math.Inf(-1), nil
+		}
+		return strconv.ParseFloat(number, bits)
+	}
+	return 0, fmt.Errorf("Protobuf: field %s requires a number", field.name)
+}
+
+// encodeNumeric converts a JSON value to the raw value of a varint or fixed
+// size field.
+func (format *Protobuf) encodeNumeric(field *protoField, value interface{}) (uint64, error) {
+	switch field.kind {
+	case protoTypeBool:
+		if flag, isBool := value.(bool); isBool {
+			if flag {
+				return 1, nil
+			}
+			return 0, nil
+		}
+		return 0, fmt.Errorf("Protobuf: field %s requires a boolean", field.name)
+
+	case protoTypeEnum:
+		if name, isString := value.(string); isString {
+			if number, exists := field.enum.byName[name]; exists {
+				return uint64(int64(number)), nil
+			}
+			return 0, fmt.Errorf("Protobuf: unknown value %s for enum %s", name, field.enum.name)
+		}
+		number, err := protoParseInt(field, value, 32)
+		return uint64(number), err
+
+	case protoTypeDouble:
+		number, err := protoParseFloat(field, value, 64)
+		return math.Float64bits(number), err
+
+	case protoTypeFloat:
+		number, err := protoParseFloat(field, value, 32)
+		return uint64(math.Float32bits(float32(number))), err
+
+	case protoTypeInt32:
+		number, err := protoParseInt(field, value, 32)
+		return uint64(number), err
+
+	case protoTypeInt64, protoTypeSfixed64:
+		number, err := protoParseInt(field, value, 64)
+		return uint64(number), err
+
+	case protoTypeSfixed32:
+		number, err := protoParseInt(field, value, 32)
+		return uint64(uint32(int32(number))), err
+
+	case protoTypeSint32:
+		number, err := protoParseInt(field, value, 32)
+		return uint64(uint32((int32(number) << 1) ^ (int32(number) >> 31))), err
+
+	case protoTypeSint64:
+		number, err := protoParseInt(field, value, 64)
+		return uint64((number << 1) ^ (number >> 63)), err
+
+	case protoTypeUint32, protoTypeFixed32:
+		return protoParseUint(field, value, 32)
+
+	case protoTypeUint64, protoTypeFixed64:
+		return protoParseUint(field, value, 64)
+	}
+	return 0, fmt.Errorf("Protobuf: unsupported type %d for field %s", field.kind, field.name)
+}
+
+// protoAppendNumeric appends the raw value of a numeric field without tag.
+func protoAppendNumeric(buffer []byte, wireType uint64, value uint64) []byte {
+	switch wireType {
+	case protoWireFixed32:
+		var encoded [4]byte
+		binary.LittleEndian.PutUint32(encoded[:], uint32(value))
+		return append(buffer, encoded[:]...)
+	case protoWireFixed64:
+		var encoded [8]byte
+		binary.LittleEndian.PutUint64(encoded[:], value)
+		return append(buffer, encoded[:]...)
+	default:
+		return protoAppendVarint(buffer, value)
+	}
+}
+
+// encodeValue appends a single non-repeated value including its tag.
+func (format *Protobuf) encodeValue(buffer []byte, field *protoField, value interface{}) ([]byte, error) {
+	switch field.kind {
+	case protoTypeString:
+		str, isString := value.(string)
+		if !isString {
+			return nil, fmt.Errorf("Protobuf: field %s requires a string", field.name)
+		}
+		return protoAppendBytes(buffer, field.number, []byte(str)), nil
+
+	case protoTypeBytes:
+		str, isString := value.(string)
+		if !isString {
+			return nil, fmt.Errorf("Protobuf: field %s requires a base64 string", field.name)
+		}
+		data, err := base64.StdEncoding.DecodeString(str)
+		if err != nil {
+			if data, err = base64.URLEncoding.DecodeString(str); err != nil {
+				if data, err = base64.RawStdEncoding.DecodeString(str); err != nil {
+					return nil, fmt.Errorf("Protobuf: field %s: %s", field.name, err)
+				}
+			}
+		}
+		return protoAppendBytes(buffer, field.number, data), nil
+
+	case protoTypeMessage:
+		object, isObject := value.(map[string]interface{})
+		if !isObject {
+			return nil, fmt.Errorf("Protobuf: field %s requires an object", field.name)
+		}
+		data, err := format.encodeMessage(field.message, object)
+		if err != nil {
+			return nil, err
+		}
+		return protoAppendBytes(buffer, field.number, data), nil
+	}
+
+	raw, err := format.encodeNumeric(field, value)
+	if err != nil {
+		return nil, err
+	}
+	wireType := protoWireTypeOf(field.kind)
+	buffer = protoAppendTag(buffer, field.number, wireType)
+	return protoAppendNumeric(buffer, wireType, raw), nil
+}
+
+// encodeMap appends all entries of a map field. Entries are written in the
+// order of their keys.
+func (format *Protobuf) encodeMap(buffer []byte, field *protoField, value interface{}) ([]byte, error) {
+	object, isObject := value.(map[string]interface{})
+	if !isObject {
+		return nil, fmt.Errorf("Protobuf: field %s requires an object", field.name)
+	}
+
+	keyField, valueField := field.message.byNumber[1], field.message.byNumber[2]
+	if keyField == nil || valueField == nil {
+		return nil, fmt.Errorf("Protobuf: invalid map entry type %s", field.message.name)
+	}
+
+	keys := make([]string, 0, len(object))
+	for key := range object {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		var keyValue interface{} = json.Number(key)
+		switch keyField.kind {
+		case protoTypeString:
+			keyValue = key
+		case protoTypeBool:
+			keyValue = key == "true"
+		}
+
+		entry, err := format.encodeValue(nil, keyField, keyValue)
+		if err != nil {
+			return nil, err
+		}
+		if object[key] != nil {
+			if entry, err = format.encodeValue(entry, valueField, object[key]); err != nil {
+				return nil, err
+			}
+		}
+		buffer = protoAppendBytes(buffer, field.number, entry)
+	}
+	return buffer, nil
+}
+
+// encodeRepeated appends all values of a repeated field.
+func (format *Protobuf) encodeRepeated(buffer []byte, field *protoField, value interface{}) ([]byte, error) {
+	array, isArray := value.([]interface{})
+	if !isArray {
+		return nil, fmt.Errorf("Protobuf: field %s requires an array", field.name)
+	}
+
+	if !field.packed {
+		var err error
+		for _, item := range array {
+			if buffer, err = format.encodeValue(buffer, field, item); err != nil {
+				return nil, err
+			}
+		}
+		return buffer, nil // ### return, not packed ###
+	}
+
+	packed := []byte{}
+	wireType := protoWireTypeOf(field.kind)
+	for _, item := range array {
+		raw, err := format.encodeNumeric(field, item)
+		if err != nil {
+			return nil, err
+		}
+		packed = protoAppendNumeric(packed, wireType, raw)
+	}
+	return protoAppendBytes(buffer, field.number, packed), nil
+}
+
+// encodeMessage converts a JSON object to a binary message of the given type.
+func (format *Protobuf) encodeMessage(messageType *protoMessageType, object map[string]interface{}) ([]byte, error) {
+	for key := range object {
+		if _, known := messageType.byName[key]; !known {
+			return nil, fmt.Errorf("Protobuf: unknown field %s in message %s", key, messageType.name)
+		}
+	}
+
+	buffer := []byte{}
+	for _, field := range messageType.fields {
+		value, exists := object[field.jsonName]
+		if !exists {
+			value = object[field.name]
+		}
+		if value == nil {
+			continue // ### continue, field not set ###
+		}
+
+		var err error
+		switch {
+		case field.repeated && field.message != nil && field.message.mapEntry:
+			buffer, err = format.encodeMap(buffer, field, value)
+		case field.repeated:
+			buffer, err = format.encodeRepeated(buffer, field, value)
+		default:
+			buffer, err = format.encodeValue(buffer, field, value)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return buffer, nil
+}
+
+// convert converts the message data in the configured direction.
+func (format *Protobuf) convert(data []byte) ([]byte, error) {
+	if format.encode {
+		object := make(map[string]interface{})
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.UseNumber()
+		if err := decoder.Decode(&object); err != nil {
+			return nil, err
+		}
+		return format.encodeMessage(format.message, object)
+	}
+
+	var root *splitToJSONNode
+	var err error
+	if format.message == nil {
+		root, err = format.decodeRaw(data)
+	} else {
+		root, err = format.decodeMessage(format.message, data)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return root.MarshalJSON()
+}
+
+// Format converts the message between protocol buffer and JSON encoding
+func (format *Protobuf) Format(msg core.Message) ([]byte, core.MessageStreamID) {
+	data, streamID := format.base.Format(msg)
+
+	converted, err := format.convert(data)
+	if err != nil {
+		if format.errorStreamID != core.InvalidStreamID {
+			return data, format.errorStreamID // ### return, route to error stream ###
+		}
+		Log.Warning.Print("Protobuf failed to convert a message: ", err)
+		return data, streamID // ### return, conversion failed ###
+	}
+	return converted, streamID
+}
@@ -0,0 +1,189 @@
+// Copyright 2015-2016 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package format
+
+import (
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/shared"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func testProtoVarintField(buffer []byte, number uint64, value uint64) []byte {
+	buffer = protoAppendTag(buffer, number, protoWireVarint)
+	return protoAppendVarint(buffer, value)
+}
+
+func testProtoFieldDescriptor(name string, number uint64, label uint64, kind uint64, typeName string) []byte {
+	field := protoAppendBytes(nil, 1, []byte(name))
+	field = testProtoVarintField(field, 3, number)
+	field = testProtoVarintField(field, 4, label)
+	field = testProtoVarintField(field, 5, kind)
+	if typeName != "" {
+		field = protoAppendBytes(field, 6, []byte(typeName))
+	}
+	return field
+}
+
+// writeTestProtoDescriptor writes a FileDescriptorSet equivalent to
+//
+//  syntax = "proto3";
+//  package test;
+//  enum Level { UNKNOWN = 0; WARN = 1; }
+//  message Inner { string user_name = 1; }
+//  message Event {
+//    string name = 1;
+//    int64 id = 2;
+//    repeated int32 values = 3;
+//    Level level = 4;
+//    Inner inner = 5;
+//    map<string, int32> counts = 6;
+//    bytes payload = 7;
+//    double score = 8;
+//    sint32 delta = 9;
+//  }
+func writeTestProtoDescriptor(expect shared.Expect) string {
+	level := protoAppendBytes(nil, 1, []byte("Level"))
+	level = protoAppendBytes(level, 2, append(protoAppendBytes(nil, 1, []byte("UNKNOWN")), testProtoVarintField(nil, 2, 0)...))
+	level = protoAppendBytes(level, 2, append(protoAppendBytes(nil, 1, []byte("WARN")), testProtoVarintField(nil, 2, 1)...))
+
+	inner := protoAppendBytes(nil, 1, []byte("Inner"))
+	inner = protoAppendBytes(inner, 2, testProtoFieldDescriptor("user_name", 1, 1, protoTypeString, ""))
+
+	countsEntry := protoAppendBytes(nil, 1, []byte("CountsEntry"))
+	countsEntry = protoAppendBytes(countsEntry, 2, testProtoFieldDescriptor("key", 1, 1, protoTypeString, ""))
+	countsEntry = protoAppendBytes(countsEntry, 2, testProtoFieldDescriptor("value", 2, 1, protoTypeInt32, ""))
+	countsEntry = protoAppendBytes(countsEntry, 7, testProtoVarintField(nil, 7, 1))
+
+	event := protoAppendBytes(nil, 1, []byte("Event"))
+	event = protoAppendBytes(event, 2, testProtoFieldDescriptor("name", 1, 1, protoTypeString, ""))
+	event = protoAppendBytes(event, 2, testProtoFieldDescriptor("id", 2, 1, protoTypeInt64, ""))
+	event = protoAppendBytes(event, 2, testProtoFieldDescriptor("values", 3, 3, protoTypeInt32, ""))
+	event = protoAppendBytes(event, 2, testProtoFieldDescriptor("level", 4, 1, protoTypeEnum, ".test.Level"))
+	event = protoAppendBytes(event, 2, testProtoFieldDescriptor("inner", 5, 1, protoTypeMessage, ".test.Inner"))
+	event = protoAppendBytes(event, 2, testProtoFieldDescriptor("counts", 6, 3, protoTypeMessage, ".test.Event.CountsEntry"))
+	event = protoAppendBytes(event, 2, testProtoFieldDescriptor("payload", 7, 1, protoTypeBytes, ""))
+	event = protoAppendBytes(event, 2, testProtoFieldDescriptor("score", 8, 1, protoTypeDouble, ""))
+	event = protoAppendBytes(event, 2, testProtoFieldDescriptor("delta", 9, 1, protoTypeSint32, ""))
+	event = protoAppendBytes(event, 3, countsEntry)
+
+	file := protoAppendBytes(nil, 1, []byte("test.proto"))
+	file = protoAppendBytes(file, 2, []byte("test"))
+	file = protoAppendBytes(file, 4, inner)
+	file = protoAppendBytes(file, 4, event)
+	file = protoAppendBytes(file, 5, level)
+	file = protoAppendBytes(file, 12, []byte("proto3"))
+
+	descriptor, err := ioutil.TempFile("", "gollum_proto")
+	expect.NoError(err)
+	defer descriptor.Close()
+
+	_, err = descriptor.Write(protoAppendBytes(nil, 1, file))
+	expect.NoError(err)
+	return descriptor.Name()
+}
+
+func TestProtobufRoundtrip(t *testing.T) {
+	expect := shared.NewExpect(t)
+
+	descriptor := writeTestProtoDescriptor(expect)
+	defer os.Remove(descriptor)
+
+	config := core.NewPluginConfig("")
+	config.Override("ProtobufDescriptorFiles", descriptor)
+	config.Override("ProtobufType", "test.Event")
+	config.Override("ProtobufDirection", "encode")
+	pluginEncode, err := core.NewPluginWithType("format.Protobuf", config)
+	expect.NoError(err)
+	config.Override("ProtobufDirection", "decode")
+	pluginDecode, err := core.NewPluginWithType("format.Protobuf", config)
+	expect.NoError(err)
+
+	encoder, castedEncoder := pluginEncode.(*Protobuf)
+	expect.True(castedEncoder)
+	decoder, castedDecoder := pluginDecode.(*Protobuf)
+	expect.True(castedDecoder)
+
+	msg := core.NewMessage(nil, []byte(`{"name":"a"}`), 0)
+	result, _ := encoder.Format(msg)
+	expect.Equal([]byte{0x0a, 0x01, 'a'}, result)
+
+	payload := `{"name":"test","id":"-9007199254740993","values":[1,-2,300],"level":"WARN",` +
+		`"inner":{"userName":"bob"},"counts":{"a":1,"b":2},"payload":"AAEC","score":0.5,"delta":-3}`
+
+	msg = core.NewMessage(nil, []byte(payload), 0)
+	msg.Data, _ = encoder.Format(msg)
+	result, _ = decoder.Format(msg)
+	expect.Equal(payload, string(result))
+
+	msg = core.NewMessage(nil, []byte(`{"inner":{"user_name":"bob"},"level":1,"id":5}`), 0)
+	msg.Data, _ = encoder.Format(msg)
+	result, _ = decoder.Format(msg)
+	expect.Equal(`{"id":"5","level":"WARN","inner":{"userName":"bob"}}`, string(result))
+}
+
+func TestProtobufErrors(t *testing.T) {
+	expect := shared.NewExpect(t)
+
+	descriptor := writeTestProtoDescriptor(expect)
+	defer os.Remove(descriptor)
+
+	config := core.NewPluginConfig("")
+	config.Override("ProtobufDescriptorFiles", descriptor)
+	config.Override("ProtobufType", "test.Unknown")
+	_, err := core.NewPluginWithType("format.Protobuf", config)
+	expect.NotNil(err)
+
+	config = core.NewPluginConfig("")
+	config.Override("ProtobufDirection", "encode")
+	_, err = core.NewPluginWithType("format.Protobuf", config)
+	expect.NotNil(err)
+
+	config = core.NewPluginConfig("")
+	config.Override("ProtobufDescriptorFiles", descriptor)
+	config.Override("ProtobufType", "test.Event")
+	config.Override("ProtobufDirection", "encode")
+	config.Override("ProtobufErrorStream", "error")
+	plugin, err := core.NewPluginWithType("format.Protobuf", config)
+	expect.NoError(err)
+	encoder := plugin.(*Protobuf)
+
+	msg := core.NewMessage(nil, []byte(`{"unknown":1}`), 0)
+	result, streamID := encoder.Format(msg)
+	expect.Equal(`{"unknown":1}`, string(result))
+	expect.Equal(core.StreamRegistry.GetStreamID("error"), streamID)
+
+	msg = core.NewMessage(nil, []byte(`{"id":"abc"}`), 0)
+	_, streamID = encoder.Format(msg)
+	expect.Equal(core.StreamRegistry.GetStreamID("error"), streamID)
+}
+
+func TestProtobufRaw(t *testing.T) {
+	expect := shared.NewExpect(t)
+
+	plugin, err := core.NewPluginWithType("format.Protobuf", core.NewPluginConfig(""))
+	expect.NoError(err)
+	decoder := plugin.(*Protobuf)
+
+	data := protoAppendBytes(nil, 1, []byte("hello"))
+	data = testProtoVarintField(data, 2, 150)
+	data = testProtoVarintField(data, 2, 1)
+	data = protoAppendBytes(data, 3, testProtoVarintField(nil, 1, 7))
+
+	msg := core.NewMessage(nil, data, 0)
+	result, _ := decoder.Format(msg)
+	expect.Equal(`{"1":"hello","2":[150,1],"3":{"1":7}}`, string(result))
+}
@@ -0,0 +1,453 @@
+// Copyright 2015-2016 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package format
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"strings"
+)
+
+// Wire types as defined by the protocol buffer encoding
+const (
+	protoWireVarint  = 0
+	protoWireFixed64 = 1
+	protoWireBytes   = 2
+	protoWireFixed32 = 5
+)
+
+// Field types as defined by FieldDescriptorProto.Type
+const (
+	protoTypeDouble   = 1
+	protoTypeFloat    = 2
+	protoTypeInt64    = 3
+	protoTypeUint64   = 4
+	protoTypeInt32    = 5
+	protoTypeFixed64  = 6
+	protoTypeFixed32  = 7
+	protoTypeBool     = 8
+	protoTypeString   = 9
+	protoTypeGroup    = 10
+	protoTypeMessage  = 11
+	protoTypeBytes    = 12
+	protoTypeUint32   = 13
+	protoTypeEnum     = 14
+	protoTypeSfixed32 = 15
+	protoTypeSfixed64 = 16
+	protoTypeSint32   = 17
+	protoTypeSint64   = 18
+
+	protoLabelRepeated = 3
+)
+
+// protoSchema holds all message and enum types read from a set of
+// FileDescriptorSet files. Types are stored by their fully qualified name,
+// e.g. "package.Message.Nested".
+type protoSchema struct {
+	messages map[string]*protoMessageType
+	enums    map[string]*protoEnumType
+}
+
+// protoMessageType describes a message type read from a DescriptorProto.
+type protoMessageType struct {
+	name     string
+	fields   []*protoField
+	byNumber map[uint64]*protoField
+	byName   map[string]*protoField
+	mapEntry bool
+}
+
+// protoField describes a field read from a FieldDescriptorProto.
+type protoField struct {
+	name      string
+	jsonName  string
+	number    uint64
+	repeated  bool
+	packed    bool
+	kind      uint64
+	typeName  string
+	message   *protoMessageType
+	enum      *protoEnumType
+	hasPacked bool
+}
+
+// protoEnumType describes an enum type read from an EnumDescriptorProto.
+type protoEnumType struct {
+	name     string
+	byNumber map[int32]string
+	byName   map[string]int32
+}
+
+// protoWireField is a single field read from protocol buffer encoded data.
+// Value holds the value of varint and fixed size fields, data holds the
+// content of length delimited fields.
+type protoWireField struct {
+	number   uint64
+	wireType uint64
+	value    uint64
+	data     []byte
+}
+
+// protoReadFields splits protocol buffer encoded data into its fields.
+// Groups are not supported.
+func protoReadFields(data []byte) ([]protoWireField, error) {
+	fields := []protoWireField{}
+	for len(data) > 0 {
+		tag, size := binary.Uvarint(data)
+		if size <= 0 {
+			return nil, fmt.Errorf("Protobuf: invalid field tag")
+		}
+		data = data[size:]
+
+		field := protoWireField{number: tag >> 3, wireType: tag & 7}
+		if field.number == 0 {
+			return nil, fmt.Errorf("Protobuf: invalid field number 0")
+		}
+
+		switch field.wireType {
+		case protoWireVarint:
+			if field.value, size = binary.Uvarint(data); size <= 0 {
+				return nil, fmt.Errorf("Protobuf: invalid varint in field %d", field.number)
+			}
+
+		case protoWireFixed64:
+			if size = 8; len(data) < size {
+				return nil, fmt.Errorf("Protobuf: truncated field %d", field.number)
+			}
+			field.value = binary.LittleEndian.Uint64(data)
+
+		case protoWireFixed32:
+			if size = 4; len(data) < size {
+				return nil, fmt.Errorf("Protobuf: truncated field %d", field.number)
+			}
+			field.value = uint64(binary.LittleEndian.Uint32(data))
+
+		case protoWireBytes:
+			length, lengthSize := binary.Uvarint(data)
+			if lengthSize <= 0 || length > uint64(len(data)-lengthSize) {
+				return nil, fmt.Errorf("Protobuf: truncated field %d", field.number)
+			}
+			size = lengthSize + int(length)
+			field.data = data[lengthSize:size]
+
+		default:
+			return nil, fmt.Errorf("Protobuf: unsupported wire type %d in field %d", field.wireType, field.number)
+		}
+
+		data = data[size:]
+		fields = append(fields, field)
+	}
+	return fields, nil
+}
+
+// protoAppendTag appends the tag of a field to the given buffer.
+func protoAppendTag(buffer []byte, number uint64, wireType uint64) []byte {
+	return protoAppendVarint(buffer, number<<3|wireType)
+}
+
+// protoAppendVarint appends a varint to the given buffer.
+func protoAppendVarint(buffer []byte, value uint64) []byte {
+	var encoded [binary.MaxVarintLen64]byte
+	size := binary.PutUvarint(encoded[:], value)
+	return append(buffer, encoded[:size]...)
+}
+
+// protoAppendBytes appends a length delimited field to the given buffer.
+func protoAppendBytes(buffer []byte, number uint64, data []byte) []byte {
+	buffer = protoAppendTag(buffer, number, protoWireBytes)
+	buffer = protoAppendVarint(buffer, uint64(len(data)))
+	return append(buffer, data...)
+}
+
+// protoWireTypeOf returns the wire type used for the given field type.
+func protoWireTypeOf(kind uint64) uint64 {
+	switch kind {
+	case protoTypeDouble, protoTypeFixed64, protoTypeSfixed64:
+		return protoWireFixed64
+	case protoTypeFloat, protoTypeFixed32, protoTypeSfixed32:
+		return protoWireFixed32
+	case protoTypeString, protoTypeBytes, protoTypeMessage:
+		return protoWireBytes
+	default:
+		return protoWireVarint
+	}
+}
+
+// protoLowerCamelCase converts a field name to the JSON name protoc generates
+// if no json_name is given.
+func protoLowerCamelCase(name string) string {
+	result := make([]byte, 0, len(name))
+	upper := false
+	for i := 0; i < len(name); i++ {
+		switch char := name[i]; {
+		case char == '_':
+			upper = true
+		case upper && char >= 'a' && char <= 'z':
+			result = append(result, char-'a'+'A')
+			upper = false
+		default:
+			result = append(result, char)
+			upper = false
+		}
+	}
+	return string(result)
+}
+
+// newProtoSchema reads all types from the given FileDescriptorSet files as
+// generated by "protoc --include_imports --descriptor_set_out".
+func newProtoSchema(files []string) (*protoSchema, error) {
+	schema := &protoSchema{
+		messages: make(map[string]*protoMessageType),
+		enums:    make(map[string]*protoEnumType),
+	}
+
+	for _, file := range files {
+		content, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		if err := schema.addFileDescriptorSet(content); err != nil {
+			return nil, fmt.Errorf("%s: %s", file, err)
+		}
+	}
+
+	// Resolve type references after all files have been read as files may
+	// reference types defined in other files.
+	for _, message := range schema.messages {
+		for _, field := range message.fields {
+			typeName := strings.TrimPrefix(field.typeName, ".")
+			switch field.kind {
+			case protoTypeMessage:
+				if field.message = schema.messages[typeName]; field.message == nil {
+					return nil, fmt.Errorf("Protobuf: unknown message type %s", field.typeName)
+				}
+			case protoTypeEnum:
+				if field.enum = schema.enums[typeName]; field.enum == nil {
+					return nil, fmt.Errorf("Protobuf: unknown enum type %s", field.typeName)
+				}
+			}
+		}
+	}
+	return schema, nil
+}
+
+// addFileDescriptorSet reads all FileDescriptorProto entries from a
+// FileDescriptorSet.
+func (schema *protoSchema) addFileDescriptorSet(data []byte) error {
+	fields, err := protoReadFields(data)
+	if err != nil {
+		return err
+	}
+	for _, field := range fields {
+		if field.number == 1 && field.wireType == protoWireBytes {
+			if err := schema.addFile(field.data); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// addFile reads all types from a FileDescriptorProto.
+func (schema *protoSchema) addFile(data []byte) error {
+	fields, err := protoReadFields(data)
+	if err != nil {
+		return err
+	}
+
+	pkg := ""
+	proto3 := false
+	for _, field := range fields {
+		switch field.number {
+		case 2:
+			pkg = string(field.data)
+		case 12:
+			proto3 = string(field.data) == "proto3"
+		}
+	}
+
+	for _, field := range fields {
+		switch field.number {
+		case 4:
+			if err := schema.addMessage(pkg, field.data, proto3); err != nil {
+				return err
+			}
+		case 5:
+			if err := schema.addEnum(pkg, field.data); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// protoQualifiedName joins a scope and a type name.
+func protoQualifiedName(scope string, name string) string {
+	if scope == "" {
+		return name
+	}
+	return scope + "." + name
+}
+
+// addMessage reads a DescriptorProto including all nested types.
+func (schema *protoSchema) addMessage(scope string, data []byte, proto3 bool) error {
+	fields, err := protoReadFields(data)
+	if err != nil {
+		return err
+	}
+
+	message := &protoMessageType{
+		byNumber: make(map[uint64]*protoField),
+		byName:   make(map[string]*protoField),
+	}
+	for _, field := range fields {
+		if field.number == 1 {
+			message.name = protoQualifiedName(scope, string(field.data))
+		}
+	}
+
+	for _, field := range fields {
+		switch field.number {
+		case 2:
+			messageField, err := newProtoField(field.data, proto3)
+			if err != nil {
+				return err
+			}
+			message.fields = append(message.fields, messageField)
+			message.byNumber[messageField.number] = messageField
+			message.byName[messageField.name] = messageField
+			message.byName[messageField.jsonName] = messageField
+
+		case 3:
+			if err := schema.addMessage(message.name, field.data, proto3); err != nil {
+				return err
+			}
+
+		case 4:
+			if err := schema.addEnum(message.name, field.data); err != nil {
+				return err
+			}
+
+		case 7:
+			options, err := protoReadFields(field.data)
+			if err != nil {
+				return err
+			}
+			for _, option := range options {
+				if option.number == 7 {
+					message.mapEntry = option.value != 0
+				}
+			}
+		}
+	}
+
+	schema.messages[message.name] = message
+	return nil
+}
+
+// newProtoField reads a FieldDescriptorProto.
+func newProtoField(data []byte, proto3 bool) (*protoField, error) {
+	fields, err := protoReadFields(data)
+	if err != nil {
+		return nil, err
+	}
+
+	field := new(protoField)
+	for _, wireField := range fields {
+		switch wireField.number {
+		case 1:
+			field.name = string(wireField.data)
+		case 3:
+			field.number = wireField.value
+		case 4:
+			field.repeated = wireField.value == protoLabelRepeated
+		case 5:
+			field.kind = wireField.value
+		case 6:
+			field.typeName = string(wireField.data)
+		case 8:
+			options, err := protoReadFields(wireField.data)
+			if err != nil {
+				return nil, err
+			}
+			for _, option := range options {
+				if option.number == 2 {
+					field.packed = option.value != 0
+					field.hasPacked = true
+				}
+			}
+		case 10:
+			field.jsonName = string(wireField.data)
+		}
+	}
+
+	if field.kind == protoTypeGroup {
+		return nil, fmt.Errorf("Protobuf: groups are not supported (field %s)", field.name)
+	}
+	if field.jsonName == "" {
+		field.jsonName = protoLowerCamelCase(field.name)
+	}
+	if !field.hasPacked {
+		field.packed = proto3 && field.repeated && protoWireTypeOf(field.kind) != protoWireBytes
+	}
+	return field, nil
+}
+
+// addEnum reads an EnumDescriptorProto.
+func (schema *protoSchema) addEnum(scope string, data []byte) error {
+	fields, err := protoReadFields(data)
+	if err != nil {
+		return err
+	}
+
+	enum := &protoEnumType{
+		byNumber: make(map[int32]string),
+		byName:   make(map[string]int32),
+	}
+	for _, field := range fields {
+		switch field.number {
+		case 1:
+			enum.name = protoQualifiedName(scope, string(field.data))
+		case 2:
+			values, err := protoReadFields(field.data)
+			if err != nil {
+				return err
+			}
+			name, number := "", int32(0)
+			for _, value := range values {
+				switch value.number {
+				case 1:
+					name = string(value.data)
+				case 2:
+					number = int32(value.value)
+				}
+			}
+			if _, exists := enum.byNumber[number]; !exists {
+				enum.byNumber[number] = name // first name wins for aliases
+			}
+			enum.byName[name] = number
+		}
+	}
+
+	schema.enums[enum.name] = enum
+	return nil
+}
+
+// protoFloat32 converts the raw value of a fixed32 field to a float.
+func protoFloat32(value uint64) float64 {
+	return float64(math.Float32frombits(uint32(value)))
+}
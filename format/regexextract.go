@@ -0,0 +1,159 @@
+// Copyright 2015-2016 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package format
+
+import (
+	"fmt"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/core/log"
+	"github.com/trivago/gollum/shared"
+	"regexp"
+	"strings"
+)
+
+// RegexExtract formatter plugin
+// RegexExtract is a formatter that applies a regular expression to a message
+// and returns the values of all named groups, e.g. (?P<name>...), as a JSON
+// object. Alternatively the values can be stored as message metadata.
+// Groups that did not participate in the match are omitted.
+// Configuration example
+//
+//  - "stream.Broadcast":
+//    Formatter: "format.RegexExtract"
+//    RegexExtractDataFormatter: "format.Forward"
+//    RegexExtractExpression: "(?P<user>\\w+)@(?P<host>\\S+)"
+//    RegexExtractTarget: "json"
+//    RegexExtractOnMismatch: "passthrough"
+//    RegexExtractErrorStream: ""
+//
+// RegexExtractDataFormatter defines a formatter that is applied before the
+// expression is evaluated. By default this is set to "format.Forward".
+//
+// RegexExtractExpression defines the regular expression to apply. The
+// expression has to contain at least one named group.
+// By default this is set to "(?P<message>.*)".
+//
+// RegexExtractTarget defines where the captured values are stored.
+// By default this is set to "json".
+//  * "json" replaces the message by a JSON object containing the values.
+//  * "metadata" stores the values as message metadata and leaves the message
+//    unchanged.
+//
+// RegexExtractOnMismatch defines what happens to messages not matching the
+// expression. By default this is set to "passthrough".
+//  * "passthrough" passes the message on unchanged.
+//  * "drop" routes the message unchanged to the "_DROPPED_" stream.
+//  * "route" routes the message unchanged to RegexExtractErrorStream.
+//
+// RegexExtractErrorStream defines the stream used by the "route" mismatch
+// behavior. By default this is set to "".
+type RegexExtract struct {
+	base           core.Formatter
+	expression     *regexp.Regexp
+	toMetadata     bool
+	mismatchStream core.MessageStreamID
+}
+
+func init() {
+	shared.TypeRegistry.Register(RegexExtract{})
+}
+
+// Configure initializes this formatter with values from a plugin config.
+func (format *RegexExtract) Configure(conf core.PluginConfig) error {
+	plugin, err := core.NewPluginWithType(conf.GetString("RegexExtractDataFormatter", "format.Forward"), conf)
+	if err != nil {
+		return err
+	}
+	format.base = plugin.(core.Formatter)
+
+	expression := conf.GetString("RegexExtractExpression", "(?P<message>.*)")
+	if format.expression, err = regexp.Compile(expression); err != nil {
+		return err
+	}
+
+	hasNamedGroup := false
+	for _, name := range format.expression.SubexpNames() {
+		hasNamedGroup = hasNamedGroup || name != ""
+	}
+	if !hasNamedGroup {
+		return fmt.Errorf("RegexExtractExpression does not contain a named group")
+	}
+
+	target := strings.ToLower(conf.GetString("RegexExtractTarget", "json"))
+	switch target {
+	case "json":
+	case "metadata":
+		format.toMetadata = true
+		core.RegisterMetadataWriter()
+	default:
+		return fmt.Errorf("Unknown RegexExtractTarget: %s", target)
+	}
+
+	format.mismatchStream = core.InvalidStreamID
+	mismatch := strings.ToLower(conf.GetString("RegexExtractOnMismatch", "passthrough"))
+	switch mismatch {
+	case "passthrough":
+	case "drop":
+		format.mismatchStream = core.DroppedStreamID
+	case "route":
+		errorStream := conf.GetString("RegexExtractErrorStream", "")
+		if errorStream == "" {
+			return fmt.Errorf("RegexExtractOnMismatch \"route\" requires RegexExtractErrorStream to be set")
+		}
+		format.mismatchStream = core.StreamRegistry.GetStreamID(errorStream)
+	default:
+		return fmt.Errorf("Unknown RegexExtractOnMismatch: %s", mismatch)
+	}
+
+	return nil
+}
+
+// Format returns the named groups of the expression as JSON object
+func (format *RegexExtract) Format(msg core.Message) ([]byte, core.MessageStreamID) {
+	data, streamID := format.base.Format(msg)
+
+	match := format.expression.FindSubmatchIndex(data)
+	if match == nil {
+		if format.mismatchStream != core.InvalidStreamID {
+			return data, format.mismatchStream // ### return, route mismatch ###
+		}
+		return data, streamID // ### return, pass through ###
+	}
+
+	root := &splitToJSONNode{children: []*splitToJSONNode{}}
+	for i, name := range format.expression.SubexpNames() {
+		start, end := match[2*i], match[2*i+1]
+		if name == "" || start < 0 {
+			continue // ### continue, unnamed or not matched ###
+		}
+
+		if format.toMetadata {
+			msg.SetMetadata(name, string(data[start:end]))
+		} else {
+			root.set([]string{name}, string(data[start:end]))
+		}
+	}
+
+	if format.toMetadata {
+		return data, streamID // ### return, values stored as metadata ###
+	}
+
+	jsonData, err := root.MarshalJSON()
+	if err != nil {
+		Log.Error.Print("RegexExtract: ", err)
+		return data, streamID
+	}
+	return jsonData, streamID
+}
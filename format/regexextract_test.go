@@ -0,0 +1,91 @@
+// Copyright 2015-2016 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package format
+
+import (
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/shared"
+	"testing"
+)
+
+func TestRegexExtract(t *testing.T) {
+	expect := shared.NewExpect(t)
+
+	config := core.NewPluginConfig("")
+	config.Override("RegexExtractExpression", `(?P<user>\w+)@(?P<host>[\w.]+)(?::(?P<port>\d+))?`)
+
+	plugin, err := core.NewPluginWithType("format.RegexExtract", config)
+	expect.NoError(err)
+	formatter, casted := plugin.(*RegexExtract)
+	expect.True(casted)
+
+	msg := core.NewMessage(nil, []byte("login bob@example.com"), 0)
+	result, streamID := formatter.Format(msg)
+	expect.Equal(`{"user":"bob","host":"example.com"}`, string(result))
+	expect.Equal(msg.StreamID, streamID)
+
+	msg = core.NewMessage(nil, []byte("no address"), 0)
+	result, streamID = formatter.Format(msg)
+	expect.Equal("no address", string(result))
+	expect.Equal(msg.StreamID, streamID)
+}
+
+func TestRegexExtractMetadata(t *testing.T) {
+	expect := shared.NewExpect(t)
+
+	config := core.NewPluginConfig("")
+	config.Override("RegexExtractExpression", `(?P<user>\w+)@(?P<host>[\w.]+)`)
+	config.Override("RegexExtractTarget", "metadata")
+	config.Override("RegexExtractOnMismatch", "drop")
+
+	plugin, err := core.NewPluginWithType("format.RegexExtract", config)
+	expect.NoError(err)
+	formatter, casted := plugin.(*RegexExtract)
+	expect.True(casted)
+
+	msg := core.NewMessage(nil, []byte("bob@example.com"), 0)
+	msg.PrepareMetadata()
+	result, _ := formatter.Format(msg)
+	expect.Equal("bob@example.com", string(result))
+	expect.Equal("bob", msg.Metadata["user"])
+	expect.Equal("example.com", msg.Metadata["host"])
+
+	msg = core.NewMessage(nil, []byte("no address"), 0)
+	_, streamID := formatter.Format(msg)
+	expect.Equal(core.DroppedStreamID, streamID)
+}
+
+func TestRegexExtractConfig(t *testing.T) {
+	expect := shared.NewExpect(t)
+
+	config := core.NewPluginConfig("")
+	config.Override("RegexExtractExpression", `(?P<user>\w+)`)
+	config.Override("RegexExtractOnMismatch", "route")
+	_, err := core.NewPluginWithType("format.RegexExtract", config)
+	expect.NotNil(err)
+
+	config.Override("RegexExtractErrorStream", "error")
+	plugin, err := core.NewPluginWithType("format.RegexExtract", config)
+	expect.NoError(err)
+
+	msg := core.NewMessage(nil, []byte("!!!"), 0)
+	_, streamID := plugin.(*RegexExtract).Format(msg)
+	expect.Equal(core.StreamRegistry.GetStreamID("error"), streamID)
+
+	config = core.NewPluginConfig("")
+	config.Override("RegexExtractExpression", `(\w+)`)
+	_, err = core.NewPluginWithType("format.RegexExtract", config)
+	expect.NotNil(err)
+}
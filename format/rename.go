@@ -0,0 +1,282 @@
+// Copyright 2015-2016 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package format
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/core/log"
+	"github.com/trivago/gollum/shared"
+	"strings"
+)
+
+// Rename formatter plugin
+// Rename is a formatter that renames, moves, copies and deletes fields of a
+// JSON object. Nested fields are addressed by joining keys with a separator,
+// e.g. "request.user.name". The order of all other fields is preserved.
+// Configuration example
+//
+//  - "stream.Broadcast":
+//    Formatter: "format.Rename"
+//    RenameDataFormatter: "format.Forward"
+//    RenameDirectives:
+//      - "msg:rename:message"
+//      - "user.name:move:username"
+//      - "host:copy:source.host"
+//      - "password:delete"
+//    RenamePathSeparator: "."
+//    RenameErrorStream: ""
+//
+// RenameDataFormatter defines a formatter that is applied before the fields are
+// changed. By default this is set to "format.Forward".
+//
+// RenameDirectives defines the changes to apply in order of appearance. Each
+// directive has the form "source:operation:target". A colon inside a path can
+// be escaped as "\:". Directives with a missing source field are ignored.
+// Objects required by a target path are created and existing fields at the
+// target path are overwritten. By default this list is empty.
+//  * "rename" changes the key of a field without changing its position. The
+//    target is the new key, not a path.
+//  * "move" removes a field and stores it at the target path.
+//  * "copy" stores a copy of a field at the target path.
+//  * "delete" removes a field. This operation has no target.
+//
+// RenamePathSeparator defines the string used to separate the keys of nested
+// fields. By default this is set to ".".
+//
+// RenameErrorStream defines a stream that messages which are not a JSON object
+// are routed to. These messages are passed on unchanged.
+// By default this is set to "", i.e. a warning is logged and the message stays
+// on its stream.
+type Rename struct {
+	base          core.Formatter
+	directives    []renameDirective
+	errorStreamID core.MessageStreamID
+}
+
+type renameDirective struct {
+	source    []string
+	operation string
+	target    []string
+}
+
+func init() {
+	shared.TypeRegistry.Register(Rename{})
+}
+
+// Configure initializes this formatter with values from a plugin config.
+func (format *Rename) Configure(conf core.PluginConfig) error {
+	plugin, err := core.NewPluginWithType(conf.GetString("RenameDataFormatter", "format.Forward"), conf)
+	if err != nil {
+		return err
+	}
+	format.base = plugin.(core.Formatter)
+
+	separator := conf.GetString("RenamePathSeparator", ".")
+	if separator == "" {
+		return fmt.Errorf("RenamePathSeparator must not be empty")
+	}
+
+	directives := conf.GetStringArray("RenameDirectives", []string{})
+	format.directives = make([]renameDirective, 0, len(directives))
+	for _, directive := range directives {
+		parts := strings.Split(strings.Replace(directive, "\\:", "\r", -1), ":")
+		for i, part := range parts {
+			parts[i] = strings.Replace(part, "\r", ":", -1)
+		}
+
+		if len(parts) < 2 || parts[0] == "" {
+			return fmt.Errorf("Invalid RenameDirectives entry: %s", directive)
+		}
+		newDirective := renameDirective{
+			source:    strings.Split(parts[0], separator),
+			operation: strings.ToLower(parts[1]),
+		}
+
+		switch {
+		case newDirective.operation == "delete" && len(parts) == 2:
+		case newDirective.operation == "rename" && len(parts) == 3 && parts[2] != "":
+			newDirective.target = []string{parts[2]}
+		case (newDirective.operation == "move" || newDirective.operation == "copy") && len(parts) == 3 && parts[2] != "":
+			newDirective.target = strings.Split(parts[2], separator)
+		default:
+			return fmt.Errorf("Invalid RenameDirectives entry: %s", directive)
+		}
+		format.directives = append(format.directives, newDirective)
+	}
+
+	format.errorStreamID = core.InvalidStreamID
+	if errorStream := conf.GetString("RenameErrorStream", ""); errorStream != "" {
+		format.errorStreamID = core.StreamRegistry.GetStreamID(errorStream)
+	}
+
+	return nil
+}
+
+// parseJSONNode converts a JSON document into a tree of nodes that preserves
+// the order of object keys. Values other than objects are stored as raw JSON.
+func parseJSONNode(data []byte) (*splitToJSONNode, error) {
+	data = bytes.TrimSpace(data)
+	if len(data) == 0 || data[0] != '{' {
+		return &splitToJSONNode{value: json.RawMessage(data)}, nil // ### return, plain value ###
+	}
+
+	node := &splitToJSONNode{children: []*splitToJSONNode{}}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	if _, err := decoder.Token(); err != nil {
+		return nil, err
+	}
+
+	for decoder.More() {
+		token, err := decoder.Token()
+		if err != nil {
+			return nil, err
+		}
+		var raw json.RawMessage
+		if err := decoder.Decode(&raw); err != nil {
+			return nil, err
+		}
+		child, err := parseJSONNode(raw)
+		if err != nil {
+			return nil, err
+		}
+		node.setNode([]string{token.(string)}, child)
+	}
+	return node, nil
+}
+
+// find returns the parent of the node at the given path and the index of the
+// node inside the parent. Nil is returned if the path does not exist.
+func (node *splitToJSONNode) find(path []string) (*splitToJSONNode, int) {
+	for idx, child := range node.children {
+		if child.key != path[0] {
+			continue
+		}
+		if len(path) == 1 {
+			return node, idx // ### return, found ###
+		}
+		if child.children == nil {
+			return nil, -1 // ### return, no object ###
+		}
+		return child.find(path[1:])
+	}
+	return nil, -1
+}
+
+// setNode stores a copy of the given node at the given path, creating objects
+// on the way. Existing values at the same path are overwritten.
+func (node *splitToJSONNode) setNode(path []string, value *splitToJSONNode) {
+	var child *splitToJSONNode
+	for _, existing := range node.children {
+		if existing.key == path[0] {
+			child = existing
+			break
+		}
+	}
+
+	if child == nil {
+		child = &splitToJSONNode{key: path[0]}
+		node.children = append(node.children, child)
+	}
+
+	if len(path) == 1 {
+		child.value = value.value
+		child.children = value.children
+		return // ### return, stored ###
+	}
+
+	if child.children == nil {
+		child.value = nil
+		child.children = []*splitToJSONNode{}
+	}
+	child.setNode(path[1:], value)
+}
+
+// clone returns a deep copy of the node.
+func (node *splitToJSONNode) clone() *splitToJSONNode {
+	copied := &splitToJSONNode{key: node.key, value: node.value}
+	if node.children != nil {
+		copied.children = make([]*splitToJSONNode, 0, len(node.children))
+		for _, child := range node.children {
+			copied.children = append(copied.children, child.clone())
+		}
+	}
+	return copied
+}
+
+// apply executes a directive on the given document.
+func (directive renameDirective) apply(root *splitToJSONNode) {
+	parent, idx := root.find(directive.source)
+	if parent == nil {
+		return // ### return, source not found ###
+	}
+	node := parent.children[idx]
+
+	switch directive.operation {
+	case "rename":
+		for i, sibling := range parent.children {
+			if i != idx && sibling.key == directive.target[0] {
+				parent.children = append(parent.children[:i], parent.children[i+1:]...)
+				break
+			}
+		}
+		node.key = directive.target[0]
+
+	case "move":
+		parent.children = append(parent.children[:idx], parent.children[idx+1:]...)
+		root.setNode(directive.target, node)
+
+	case "copy":
+		root.setNode(directive.target, node.clone())
+
+	case "delete":
+		parent.children = append(parent.children[:idx], parent.children[idx+1:]...)
+	}
+}
+
+// renameFields returns the given JSON object with all directives applied.
+func (format *Rename) renameFields(data []byte) ([]byte, error) {
+	trimmed := bytes.TrimSpace(data)
+	if len(trimmed) == 0 || trimmed[0] != '{' || !json.Valid(trimmed) {
+		return nil, fmt.Errorf("Message is not a JSON object")
+	}
+
+	root, err := parseJSONNode(trimmed)
+	if err != nil {
+		return nil, err
+	}
+	for _, directive := range format.directives {
+		directive.apply(root)
+	}
+	return root.MarshalJSON()
+}
+
+// Format returns the message with all directives applied
+func (format *Rename) Format(msg core.Message) ([]byte, core.MessageStreamID) {
+	data, streamID := format.base.Format(msg)
+
+	result, err := format.renameFields(data)
+	if err != nil {
+		if format.errorStreamID != core.InvalidStreamID {
+			return data, format.errorStreamID // ### return, route to error stream ###
+		}
+		Log.Warning.Print("Rename failed to process a message: ", err)
+		return data, streamID
+	}
+
+	return result, streamID
+}
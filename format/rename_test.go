@@ -0,0 +1,74 @@
+// Copyright 2015-2016 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package format
+
+import (
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/shared"
+	"testing"
+)
+
+func TestRename(t *testing.T) {
+	expect := shared.NewExpect(t)
+
+	config := core.NewPluginConfig("")
+	config.Override("RenameDirectives", []string{
+		"msg:rename:message",
+		"user.name:move:username",
+		"host:copy:source.host",
+		"password:delete",
+		"missing:delete",
+		"a\\:b:rename:ab",
+	})
+	config.Override("RenameErrorStream", "error")
+	plugin, err := core.NewPluginWithType("format.Rename", config)
+	expect.NoError(err)
+	formatter, casted := plugin.(*Rename)
+	expect.True(casted)
+
+	msg := core.NewMessage(nil, []byte(`{"msg":"hi","user":{"name":"bob","id":1},"password":"x","host":"web1","a:b":[1, 2]}`), 0)
+	result, streamID := formatter.Format(msg)
+	expect.Equal(`{"message":"hi","user":{"id":1},"host":"web1","ab":[1,2],"username":"bob","source":{"host":"web1"}}`, string(result))
+	expect.Equal(msg.StreamID, streamID)
+
+	msg = core.NewMessage(nil, []byte(`["msg"]`), 0)
+	result, streamID = formatter.Format(msg)
+	expect.Equal(`["msg"]`, string(result))
+	expect.Equal(core.StreamRegistry.GetStreamID("error"), streamID)
+}
+
+func TestRenameOverwrite(t *testing.T) {
+	expect := shared.NewExpect(t)
+
+	config := core.NewPluginConfig("")
+	config.Override("RenameDirectives", []string{
+		"a:rename:b",
+		"c:copy:d.e",
+		"c.x:move:f",
+	})
+	plugin, err := core.NewPluginWithType("format.Rename", config)
+	expect.NoError(err)
+	formatter, casted := plugin.(*Rename)
+	expect.True(casted)
+
+	msg := core.NewMessage(nil, []byte(`{"a":1,"b":2,"c":{"x":true},"d":"text"}`), 0)
+	result, _ := formatter.Format(msg)
+	expect.Equal(`{"b":1,"c":{},"d":{"e":{"x":true}},"f":true}`, string(result))
+
+	config = core.NewPluginConfig("")
+	config.Override("RenameDirectives", []string{"a:move"})
+	_, err = core.NewPluginWithType("format.Rename", config)
+	expect.NotNil(err)
+}
@@ -16,9 +16,14 @@ package format
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/core/log"
 	"github.com/trivago/gollum/shared"
+	"math"
+	"strconv"
+	"strings"
 )
 
 // SplitToJSON formatter plugin
@@ -30,25 +35,81 @@ import (
 //    Formatter: "format.SplitToJSON"
 //    SplitToJSONDataFormatter: "format.Forward"
 //    SplitToJSONToken: "|"
+//    SplitToJSONQuoteChar: ""
+//    SplitToJSONEscapeChar: ""
 //    SplitToJSONKeys:
 //      - "timestamp"
 //      - "server"
 //      - "error"
+//    SplitToJSONTypes:
+//      - "int"
+//      - "string"
+//      - "string"
+//    SplitToJSONRemainderKey: ""
+//    SplitToJSONMissingAsNull: false
 //
 // SplitToJSONDataFormatter defines the formatter to apply before executing
 // this formatter. Set to "format.Forward" by default.
 //
 // SplitToJSONToken defines the separator character to use when processing a
-// message. By default this is set to "|".
+// message. By default this is set to "|". The token must not be empty.
+//
+// SplitToJSONQuoteChar defines a character used to quote tokens that contain
+// SplitToJSONToken, e.g. set to "\"" to read CSV style data. The quotes are
+// removed from the token. Two consecutive quote characters inside a quoted
+// token are read as one literal quote character.
+// By default this is set to "" which disables quoting.
+//
+// SplitToJSONEscapeChar defines a character used to escape the following
+// character, e.g. "\\". Escaped characters are never treated as token or
+// quote character. The escape character is removed from the token.
+// By default this is set to "" which disables escaping.
 //
 // SplitToJSONKeys defines an array of keys to apply to the tokens generated
 // by splitting a message by SplitToJSONToken. The keys listed here are
 // applied to the resulting token array by index.
+// Keys containing dots like "request.method" create nested objects, i.e.
+// {"request":{"method":"GET"}}.
 // This list is empty by default.
+//
+// SplitToJSONTypes defines an array of value types to apply to the tokens.
+// The types listed here are applied to the tokens by index, i.e. aligned with
+// SplitToJSONKeys. Tokens without a type are written as strings.
+// Tokens that cannot be converted to the requested type are written as null.
+// This list is empty by default.
+//  * "string" writes the token as JSON string.
+//  * "int" writes the token as JSON integer.
+//  * "float" writes the token as JSON number.
+//  * "bool" writes the token as JSON boolean.
+//  * "auto" writes the token as integer, number or boolean if it can be
+//    parsed as such. Everything else is written as string.
+//
+// SplitToJSONRemainderKey defines a key to store all tokens not covered by
+// SplitToJSONKeys as an array of strings. Dot notation is supported.
+// By default this is set to "" which discards these tokens.
+//
+// SplitToJSONMissingAsNull can be set to true to write null for all keys that
+// have no matching token because the message contains too few tokens.
+// By default this is set to false which omits these keys.
 type SplitToJSON struct {
-	base  core.Formatter
-	token []byte
-	keys  []string
+	base          core.Formatter
+	token         []byte
+	quote         byte
+	escape        byte
+	keys          []string
+	paths         [][]string
+	types         []string
+	remainderPath []string
+	missingAsNull bool
+}
+
+// splitToJSONNode is an object or value inside the generated JSON document.
+// Children are stored in the order of creation so that the generated document
+// follows the order given by SplitToJSONKeys.
+type splitToJSONNode struct {
+	key      string
+	value    interface{}
+	children []*splitToJSONNode
 }
 
 func init() {
@@ -63,36 +124,214 @@ func (format *SplitToJSON) Configure(conf core.PluginConfig) error {
 	}
 	format.base = plugin.(core.Formatter)
 	format.token = []byte(conf.GetString("SplitToJSONToken", "|"))
+	if len(format.token) == 0 {
+		return fmt.Errorf("SplitToJSONToken must not be empty")
+	}
+
+	quote := shared.Unescape(conf.GetString("SplitToJSONQuoteChar", ""))
+	escape := shared.Unescape(conf.GetString("SplitToJSONEscapeChar", ""))
+	if len(quote) > 1 || len(escape) > 1 {
+		return fmt.Errorf("SplitToJSONQuoteChar and SplitToJSONEscapeChar must be a single character")
+	}
+	if len(quote) == 1 {
+		format.quote = quote[0]
+	}
+	if len(escape) == 1 {
+		format.escape = escape[0]
+	}
 	format.keys = conf.GetStringArray("SplitToJSONKeys", []string{})
+	format.types = conf.GetStringArray("SplitToJSONTypes", []string{})
+	format.missingAsNull = conf.GetBool("SplitToJSONMissingAsNull", false)
+
+	format.paths = make([][]string, len(format.keys))
+	for i, key := range format.keys {
+		format.paths[i] = strings.Split(key, ".")
+	}
+
+	if remainderKey := conf.GetString("SplitToJSONRemainderKey", ""); remainderKey != "" {
+		format.remainderPath = strings.Split(remainderKey, ".")
+	}
+
+	for i, valueType := range format.types {
+		format.types[i] = strings.ToLower(valueType)
+		switch format.types[i] {
+		case "string", "int", "float", "bool", "auto":
+		default:
+			return fmt.Errorf("Unknown SplitToJSONTypes value: %s", valueType)
+		}
+	}
 	return nil
 }
 
+// split splits the data by the token while respecting quotes and escape
+// characters.
+func (format *SplitToJSON) split(data []byte) [][]byte {
+	if format.quote == 0 && format.escape == 0 {
+		return bytes.Split(data, format.token) // ### return, plain split ###
+	}
+
+	components := [][]byte{}
+	component := []byte{}
+	quoted := false
+
+	for i := 0; i < len(data); i++ {
+		switch {
+		case format.escape != 0 && format.escape != format.quote && data[i] == format.escape && i+1 < len(data):
+			i++
+			component = append(component, data[i])
+
+		case format.quote != 0 && data[i] == format.quote:
+			if quoted && i+1 < len(data) && data[i+1] == format.quote {
+				i++
+				component = append(component, format.quote)
+			} else {
+				quoted = !quoted
+			}
+
+		case !quoted && bytes.HasPrefix(data[i:], format.token):
+			components = append(components, component)
+			component = []byte{}
+			i += len(format.token) - 1
+
+		default:
+			component = append(component, data[i])
+		}
+	}
+
+	return append(components, component)
+}
+
+// set stores a value at the given path, creating objects on the way.
+// Existing values at the same path are overwritten.
+func (node *splitToJSONNode) set(path []string, value interface{}) {
+	var child *splitToJSONNode
+	for _, existing := range node.children {
+		if existing.key == path[0] {
+			child = existing
+			break
+		}
+	}
+
+	if child == nil {
+		child = &splitToJSONNode{key: path[0]}
+		node.children = append(node.children, child)
+	}
+
+	if len(path) == 1 {
+		child.value = value
+		child.children = nil
+	} else {
+		child.value = nil
+		child.set(path[1:], value)
+	}
+}
+
+// MarshalJSON writes the node as JSON object or value.
+func (node *splitToJSONNode) MarshalJSON() ([]byte, error) {
+	buffer := bytes.NewBuffer(nil)
+	encoder := json.NewEncoder(buffer)
+	encoder.SetEscapeHTML(false)
+
+	if node.children == nil {
+		err := encoder.Encode(node.value)
+		return bytes.TrimRight(buffer.Bytes(), "\n"), err // ### return, plain value ###
+	}
+
+	buffer.WriteByte('{')
+	for i, child := range node.children {
+		if i > 0 {
+			buffer.WriteByte(',')
+		}
+		if err := encoder.Encode(child.key); err != nil {
+			return nil, err // ### return, invalid key ###
+		}
+		buffer.Truncate(buffer.Len() - 1) // remove newline added by Encode
+		buffer.WriteByte(':')
+		if err := encoder.Encode(child); err != nil {
+			return nil, err // ### return, invalid value ###
+		}
+		buffer.Truncate(buffer.Len() - 1)
+	}
+	buffer.WriteByte('}')
+	return buffer.Bytes(), nil
+}
+
+// jsonValue converts the token at the given index to a value by using the type
+// configured for that index. Invalid values are returned as nil.
+func (format *SplitToJSON) jsonValue(idx int, data []byte) interface{} {
+	valueType := "string"
+	if idx < len(format.types) {
+		valueType = format.types[idx]
+	}
+	return typedJSONValue(valueType, data)
+}
+
+// typedJSONValue converts a token to a value of the given type as accepted by
+// SplitToJSONTypes. Invalid values are returned as nil.
+func typedJSONValue(valueType string, data []byte) interface{} {
+	token := strings.TrimSpace(string(data))
+	switch valueType {
+	case "int":
+		if value, err := strconv.ParseInt(token, 10, 64); err == nil {
+			return value
+		}
+		return nil
+
+	case "float":
+		if value, err := strconv.ParseFloat(token, 64); err == nil && !math.IsNaN(value) && !math.IsInf(value, 0) {
+			return value
+		}
+		return nil
+
+	case "bool":
+		if value, err := strconv.ParseBool(token); err == nil {
+			return value
+		}
+		return nil
+
+	case "auto":
+		if value, err := strconv.ParseInt(token, 10, 64); err == nil {
+			return value
+		}
+		if value, err := strconv.ParseFloat(token, 64); err == nil && !math.IsNaN(value) && !math.IsInf(value, 0) {
+			return value
+		}
+		if lowerToken := strings.ToLower(token); lowerToken == "true" || lowerToken == "false" {
+			return lowerToken == "true"
+		}
+	}
+
+	return string(data)
+}
+
 // Format returns the splitted message payload as json
 func (format *SplitToJSON) Format(msg core.Message) ([]byte, core.MessageStreamID) {
 	data, streamID := format.base.Format(msg)
 
-	components := bytes.Split(data, format.token)
-	maxIdx := shared.MinI(len(format.keys), len(components))
-	jsonData := ""
-
-	switch {
-	case maxIdx == 0:
-	case maxIdx == 1:
-		jsonData = fmt.Sprintf("{%s:\"%s\"}", format.keys[0], components[0])
-	default:
-		for i := 0; i < maxIdx; i++ {
-			key := shared.EscapeJSON(format.keys[i])
-			value := shared.EscapeJSON(string(components[i]))
-			switch {
-			case i == 0:
-				jsonData = fmt.Sprintf("{\"%s\":\"%s\"", key, value)
-			case i == maxIdx-1:
-				jsonData = fmt.Sprintf("%s,\"%s\":\"%s\"}", jsonData, key, value)
-			default:
-				jsonData = fmt.Sprintf("%s,\"%s\":\"%s\"", jsonData, key, value)
-			}
+	components := format.split(data)
+	root := &splitToJSONNode{children: []*splitToJSONNode{}}
+
+	for i, path := range format.paths {
+		switch {
+		case i < len(components):
+			root.set(path, format.jsonValue(i, components[i]))
+		case format.missingAsNull:
+			root.set(path, nil)
 		}
 	}
 
-	return []byte(jsonData), streamID
+	if format.remainderPath != nil {
+		remainder := []string{}
+		for i := len(format.keys); i < len(components); i++ {
+			remainder = append(remainder, string(components[i]))
+		}
+		root.set(format.remainderPath, remainder)
+	}
+
+	jsonData, err := root.MarshalJSON()
+	if err != nil {
+		Log.Error.Print("SplitToJSON: ", err)
+		return data, streamID
+	}
+	return jsonData, streamID
 }
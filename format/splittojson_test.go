@@ -95,3 +95,154 @@ func TestSplitToJSONTooMany(t *testing.T) {
 	expect.MapEqual(jsonData, "second", "test2")
 	expect.MapEqual(jsonData, "third", "test3")
 }
+
+func TestSplitToJSONTypes(t *testing.T) {
+	expect := shared.NewExpect(t)
+
+	config := core.NewPluginConfig("")
+	config.Override("SplitToJSONToken", ",")
+	config.Override("SplitToJSONKeys", []string{"int", "float", "bool", "auto", "auto2", "invalid", "string"})
+	config.Override("SplitToJSONTypes", []string{"int", "float", "bool", "auto", "auto", "int"})
+
+	plugin, err := core.NewPluginWithType("format.SplitToJSON", config)
+	expect.NoError(err)
+
+	formatter, casted := plugin.(*SplitToJSON)
+	expect.True(casted)
+
+	msg := core.NewMessage(nil, []byte("42,1.5,true,-7,foo,bar,10"), 10)
+	result, _ := formatter.Format(msg)
+
+	jsonData := shared.NewMarshalMap()
+	err = json.Unmarshal(result, &jsonData)
+	expect.NoError(err)
+
+	expect.MapEqual(jsonData, "int", float64(42))
+	expect.MapEqual(jsonData, "float", 1.5)
+	expect.MapEqual(jsonData, "bool", true)
+	expect.MapEqual(jsonData, "auto", float64(-7))
+	expect.MapEqual(jsonData, "auto2", "foo")
+	expect.MapEqual(jsonData, "invalid", nil)
+	expect.MapEqual(jsonData, "string", "10")
+
+	config.Override("SplitToJSONTypes", []string{"date"})
+	_, err = core.NewPluginWithType("format.SplitToJSON", config)
+	expect.NotNil(err)
+}
+
+func TestSplitToJSONNested(t *testing.T) {
+	expect := shared.NewExpect(t)
+
+	config := core.NewPluginConfig("")
+	config.Override("SplitToJSONToken", ",")
+	config.Override("SplitToJSONKeys", []string{"timestamp", "request.method", "request.latency", "request.path"})
+	config.Override("SplitToJSONTypes", []string{"string", "string", "int"})
+
+	plugin, err := core.NewPluginWithType("format.SplitToJSON", config)
+	expect.NoError(err)
+
+	formatter, casted := plugin.(*SplitToJSON)
+	expect.True(casted)
+
+	msg := core.NewMessage(nil, []byte("now,GET,12,/index.html"), 10)
+	result, _ := formatter.Format(msg)
+	expect.Equal(`{"timestamp":"now","request":{"method":"GET","latency":12,"path":"/index.html"}}`, string(result))
+}
+
+func TestSplitToJSONQuoted(t *testing.T) {
+	expect := shared.NewExpect(t)
+
+	config := core.NewPluginConfig("")
+	config.Override("SplitToJSONKeys", []string{"first", "second", "third", "fourth"})
+	config.Override("SplitToJSONQuoteChar", "\"")
+	config.Override("SplitToJSONEscapeChar", "\\")
+
+	plugin, err := core.NewPluginWithType("format.SplitToJSON", config)
+	expect.NoError(err)
+
+	formatter, casted := plugin.(*SplitToJSON)
+	expect.True(casted)
+
+	msg := core.NewMessage(nil, []byte(`test1|"a|b"|"say ""hi"""|c\|d`), 10)
+	result, _ := formatter.Format(msg)
+
+	jsonData := shared.NewMarshalMap()
+	err = json.Unmarshal(result, &jsonData)
+	expect.NoError(err)
+
+	expect.MapEqual(jsonData, "first", "test1")
+	expect.MapEqual(jsonData, "second", "a|b")
+	expect.MapEqual(jsonData, "third", `say "hi"`)
+	expect.MapEqual(jsonData, "fourth", "c|d")
+}
+
+func TestSplitToJSONSingleKey(t *testing.T) {
+	expect := shared.NewExpect(t)
+
+	config := core.NewPluginConfig("")
+	config.Override("SplitToJSONKeys", []string{"first"})
+
+	plugin, err := core.NewPluginWithType("format.SplitToJSON", config)
+	expect.NoError(err)
+
+	formatter, casted := plugin.(*SplitToJSON)
+	expect.True(casted)
+
+	msg := core.NewMessage(nil, []byte("<a href=\"test\">"), 10)
+	result, _ := formatter.Format(msg)
+	expect.Equal(`{"first":"<a href=\"test\">"}`, string(result))
+}
+
+func TestSplitToJSONRemainder(t *testing.T) {
+	expect := shared.NewExpect(t)
+
+	config := core.NewPluginConfig("")
+	config.Override("SplitToJSONToken", ",")
+	config.Override("SplitToJSONKeys", []string{"first", "second"})
+	config.Override("SplitToJSONRemainderKey", "rest")
+
+	plugin, err := core.NewPluginWithType("format.SplitToJSON", config)
+	expect.NoError(err)
+
+	formatter, casted := plugin.(*SplitToJSON)
+	expect.True(casted)
+
+	msg := core.NewMessage(nil, []byte("test1,test2,test3,test4"), 10)
+	result, _ := formatter.Format(msg)
+	expect.Equal(`{"first":"test1","second":"test2","rest":["test3","test4"]}`, string(result))
+
+	msg = core.NewMessage(nil, []byte("test1,test2"), 10)
+	result, _ = formatter.Format(msg)
+	expect.Equal(`{"first":"test1","second":"test2","rest":[]}`, string(result))
+}
+
+func TestSplitToJSONMissingAsNull(t *testing.T) {
+	expect := shared.NewExpect(t)
+
+	config := core.NewPluginConfig("")
+	config.Override("SplitToJSONToken", ",")
+	config.Override("SplitToJSONKeys", []string{"first", "second", "third"})
+	config.Override("SplitToJSONMissingAsNull", true)
+
+	plugin, err := core.NewPluginWithType("format.SplitToJSON", config)
+	expect.NoError(err)
+
+	formatter, casted := plugin.(*SplitToJSON)
+	expect.True(casted)
+
+	msg := core.NewMessage(nil, []byte("test1"), 10)
+	result, _ := formatter.Format(msg)
+	expect.Equal(`{"first":"test1","second":null,"third":null}`, string(result))
+}
+
+func TestSplitToJSONEmptyToken(t *testing.T) {
+	expect := shared.NewExpect(t)
+
+	config := core.NewPluginConfig("")
+	config.Override("SplitToJSONKeys", []string{"first", "second"})
+	config.Override("SplitToJSONToken", "")
+	config.Override("SplitToJSONQuoteChar", "\"")
+
+	_, err := core.NewPluginWithType("format.SplitToJSON", config)
+	expect.NotNil(err)
+}
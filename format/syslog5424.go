@@ -0,0 +1,287 @@
+// Copyright 2015-2016 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package format
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/shared"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var (
+	syslogFacilities = map[string]int{
+		"kern": 0, "user": 1, "mail": 2, "daemon": 3, "auth": 4, "syslog": 5,
+		"lpr": 6, "news": 7, "uucp": 8, "cron": 9, "authpriv": 10, "ftp": 11,
+		"ntp": 12, "security": 13, "console": 14, "solaris-cron": 15,
+		"local0": 16, "local1": 17, "local2": 18, "local3": 19,
+		"local4": 20, "local5": 21, "local6": 22, "local7": 23,
+	}
+	syslogSeverities = map[string]int{
+		"emerg": 0, "emergency": 0, "alert": 1, "crit": 2, "critical": 2,
+		"err": 3, "error": 3, "warning": 4, "warn": 4, "notice": 5,
+		"info": 6, "informational": 6, "debug": 7,
+	}
+	syslogParamEscape = strings.NewReplacer("\\", "\\\\", "\"", "\\\"", "]", "\\]")
+)
+
+// Syslog5424 formatter plugin
+// Syslog5424 is a formatter that prefixes messages with an RFC 5424 syslog
+// header, e.g. `<14>1 2016-10-14T12:00:00.000000Z host gollum 42 - - message`.
+// The message timestamp is used as syslog timestamp. Header fields are
+// truncated to the lengths allowed by the RFC, characters outside of
+// printable ASCII are replaced by "_" and empty fields are written as "-".
+// Configuration example
+//
+//  - "stream.Broadcast":
+//    Formatter: "format.Syslog5424"
+//    Syslog5424DataFormatter: "format.Forward"
+//    Syslog5424Facility: "user"
+//    Syslog5424Severity: "info"
+//    Syslog5424SeverityMetadata: ""
+//    Syslog5424Hostname: ""
+//    Syslog5424AppName: "gollum"
+//    Syslog5424ProcID: ""
+//    Syslog5424MsgID: ""
+//    Syslog5424StructuredData:
+//      "origin/software": "gollum"
+//    Syslog5424MetadataID: ""
+//    Syslog5424OctetCounting: false
+//
+// Syslog5424DataFormatter defines a formatter that is applied before the
+// header is added. By default this is set to "format.Forward".
+//
+// Syslog5424Facility defines the facility by name, e.g. "local0", or number.
+// By default this is set to "user".
+//
+// Syslog5424Severity defines the severity by name, e.g. "warning", or number.
+// By default this is set to "info".
+//
+// Syslog5424SeverityMetadata defines a metadata key that holds the severity of
+// a message by name or number, e.g. as extracted by format.JSONParse.
+// If the key is not set or holds an unknown value Syslog5424Severity is used.
+// By default this is set to "", which disables this feature.
+//
+// Syslog5424Hostname defines the HOSTNAME field. By default this is set to
+// "", which uses the hostname of the machine.
+//
+// Syslog5424AppName defines the APP-NAME field. By default this is set to
+// "gollum".
+//
+// Syslog5424ProcID defines the PROCID field. By default this is set to "",
+// which uses the process id of gollum.
+//
+// Syslog5424MsgID defines the MSGID field. By default this is set to "".
+//
+// Syslog5424StructuredData defines static structured data parameters as map of
+// "<SD-ID>/<PARAM-NAME>" to value. Elements are written ordered by SD-ID,
+// parameters ordered by name. By default this map is empty.
+//
+// Syslog5424MetadataID defines an SD-ID that is used to write all metadata of
+// a message as structured data element. By default this is set to "", which
+// disables this feature.
+//
+// Syslog5424OctetCounting can be set to true to prefix each message with its
+// length as defined by RFC 6587 octet counting framing, which is required for
+// most TCP based syslog receivers. By default this is set to false.
+type Syslog5424 struct {
+	base             core.Formatter
+	facility         int
+	severity         int
+	severityMetadata string
+	header           string
+	structuredData   string
+	metadataID       string
+	octetCounting    bool
+}
+
+func init() {
+	shared.TypeRegistry.Register(Syslog5424{})
+}
+
+// Configure initializes this formatter with values from a plugin config.
+func (format *Syslog5424) Configure(conf core.PluginConfig) error {
+	plugin, err := core.NewPluginWithType(conf.GetString("Syslog5424DataFormatter", "format.Forward"), conf)
+	if err != nil {
+		return err
+	}
+	format.base = plugin.(core.Formatter)
+
+	facility := conf.GetString("Syslog5424Facility", "user")
+	if format.facility = syslogCode(syslogFacilities, facility, 23); format.facility < 0 {
+		return fmt.Errorf("Unknown Syslog5424Facility: %s", facility)
+	}
+
+	severity := conf.GetString("Syslog5424Severity", "info")
+	if format.severity = syslogCode(syslogSeverities, severity, 7); format.severity < 0 {
+		return fmt.Errorf("Unknown Syslog5424Severity: %s", severity)
+	}
+	format.severityMetadata = conf.GetString("Syslog5424SeverityMetadata", "")
+
+	hostname := conf.GetString("Syslog5424Hostname", "")
+	if hostname == "" {
+		hostname, _ = os.Hostname()
+	}
+	procID := conf.GetString("Syslog5424ProcID", "")
+	if procID == "" {
+		procID = strconv.Itoa(os.Getpid())
+	}
+
+	format.header = syslogHeaderField(hostname, 255) + " " +
+		syslogHeaderField(conf.GetString("Syslog5424AppName", "gollum"), 48) + " " +
+		syslogHeaderField(procID, 128) + " " +
+		syslogHeaderField(conf.GetString("Syslog5424MsgID", ""), 32) + " "
+
+	elements := make(map[string]map[string]string)
+	for key, value := range conf.GetStringMap("Syslog5424StructuredData", map[string]string{}) {
+		parts := strings.SplitN(key, "/", 2)
+		if len(parts) != 2 || !isSyslogSDName(parts[0]) || !isSyslogSDName(parts[1]) {
+			return fmt.Errorf("Syslog5424StructuredData key %s must be a valid <SD-ID>/<PARAM-NAME>", key)
+		}
+		if _, exists := elements[parts[0]]; !exists {
+			elements[parts[0]] = make(map[string]string)
+		}
+		elements[parts[0]][parts[1]] = value
+	}
+
+	buffer := bytes.NewBuffer(nil)
+	ids := make([]string, 0, len(elements))
+	for id := range elements {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		writeSyslogSDElement(buffer, id, elements[id])
+	}
+	format.structuredData = buffer.String()
+
+	if format.metadataID = conf.GetString("Syslog5424MetadataID", ""); format.metadataID != "" && !isSyslogSDName(format.metadataID) {
+		return fmt.Errorf("Syslog5424MetadataID %s is not a valid SD-ID", format.metadataID)
+	}
+
+	format.octetCounting = conf.GetBool("Syslog5424OctetCounting", false)
+	return nil
+}
+
+// syslogCode returns the code of a facility or severity given by name or
+// number. -1 is returned for unknown values.
+func syslogCode(names map[string]int, value string, maxCode int) int {
+	value = strings.ToLower(strings.TrimSpace(value))
+	if code, exists := names[value]; exists {
+		return code
+	}
+	if code, err := strconv.Atoi(value); err == nil && code >= 0 && code <= maxCode {
+		return code
+	}
+	return -1
+}
+
+// syslogHeaderField converts a value to a valid header field of the given
+// maximum length.
+func syslogHeaderField(value string, maxLength int) string {
+	field := []byte(value)
+	if len(field) == 0 {
+		return "-"
+	}
+	if len(field) > maxLength {
+		field = field[:maxLength]
+	}
+	for i, char := range field {
+		if char < 33 || char > 126 {
+			field[i] = '_'
+		}
+	}
+	return string(field)
+}
+
+// isSyslogSDName returns true if name is a valid SD-NAME.
+func isSyslogSDName(name string) bool {
+	if len(name) == 0 || len(name) > 32 {
+		return false
+	}
+	for _, char := range []byte(name) {
+		if char < 33 || char > 126 || char == '=' || char == ']' || char == '"' || char == ' ' {
+			return false
+		}
+	}
+	return true
+}
+
+// writeSyslogSDElement writes a structured data element with parameters
+// ordered by name. Parameter names that are not valid SD-NAMEs are skipped.
+func writeSyslogSDElement(buffer *bytes.Buffer, id string, params map[string]string) {
+	names := make([]string, 0, len(params))
+	for name := range params {
+		if isSyslogSDName(name) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	buffer.WriteByte('[')
+	buffer.WriteString(id)
+	for _, name := range names {
+		buffer.WriteByte(' ')
+		buffer.WriteString(name)
+		buffer.WriteString(`="`)
+		buffer.WriteString(syslogParamEscape.Replace(params[name]))
+		buffer.WriteByte('"')
+	}
+	buffer.WriteByte(']')
+}
+
+// Format prepends the syslog header to the message.
+func (format *Syslog5424) Format(msg core.Message) ([]byte, core.MessageStreamID) {
+	data, streamID := format.base.Format(msg)
+
+	severity := format.severity
+	if format.severityMetadata != "" {
+		if value, exists := msg.Metadata[format.severityMetadata]; exists {
+			if code := syslogCode(syslogSeverities, value, 7); code >= 0 {
+				severity = code
+			}
+		}
+	}
+
+	buffer := bytes.NewBuffer(make([]byte, 0, len(data)+128))
+	buffer.WriteByte('<')
+	buffer.WriteString(strconv.Itoa(format.facility*8 + severity))
+	buffer.WriteString(">1 ")
+	buffer.WriteString(msg.Timestamp.UTC().Format("2006-01-02T15:04:05.000000Z07:00"))
+	buffer.WriteByte(' ')
+	buffer.WriteString(format.header)
+
+	buffer.WriteString(format.structuredData)
+	if format.metadataID != "" && len(msg.Metadata) > 0 {
+		writeSyslogSDElement(buffer, format.metadataID, msg.Metadata)
+	}
+	if buffer.Bytes()[buffer.Len()-1] == ' ' {
+		buffer.WriteByte('-') // no structured data
+	}
+
+	if len(data) > 0 {
+		buffer.WriteByte(' ')
+		buffer.Write(data)
+	}
+
+	if format.octetCounting {
+		return append([]byte(strconv.Itoa(buffer.Len())+" "), buffer.Bytes()...), streamID
+	}
+	return buffer.Bytes(), streamID
+}
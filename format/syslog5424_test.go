@@ -0,0 +1,82 @@
+// Copyright 2015-2016 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package format
+
+import (
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/shared"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestSyslog5424(t *testing.T) {
+	expect := shared.NewExpect(t)
+
+	config := core.NewPluginConfig("")
+	config.Override("Syslog5424Facility", "local0")
+	config.Override("Syslog5424Severity", "4")
+	config.Override("Syslog5424SeverityMetadata", "level")
+	config.Override("Syslog5424Hostname", "web 1")
+	config.Override("Syslog5424MsgID", "login")
+	config.Override("Syslog5424StructuredData", map[interface{}]interface{}{
+		"origin/software": "gollum",
+		"origin/ip":       "10.0.0.1",
+		"env@32473/name":  "pr\"od]",
+	})
+	plugin, err := core.NewPluginWithType("format.Syslog5424", config)
+	expect.NoError(err)
+	formatter, casted := plugin.(*Syslog5424)
+	expect.True(casted)
+
+	pid := strconv.Itoa(os.Getpid())
+	msg := core.NewMessage(nil, []byte("user logged in"), 0)
+	msg.Timestamp = time.Date(2016, 10, 14, 12, 0, 0, 123456000, time.UTC)
+	result, _ := formatter.Format(msg)
+	expect.Equal(`<132>1 2016-10-14T12:00:00.123456Z web_1 gollum `+pid+` login [env@32473 name="pr\"od\]"][origin ip="10.0.0.1" software="gollum"] user logged in`, string(result))
+
+	msg.SetMetadata("level", "error")
+	result, _ = formatter.Format(msg)
+	expect.Equal(`<131>1 `, string(result[:7]))
+}
+
+func TestSyslog5424Defaults(t *testing.T) {
+	expect := shared.NewExpect(t)
+
+	config := core.NewPluginConfig("")
+	config.Override("Syslog5424Hostname", "host")
+	config.Override("Syslog5424ProcID", "42")
+	config.Override("Syslog5424MetadataID", "meta")
+	config.Override("Syslog5424OctetCounting", true)
+	plugin, err := core.NewPluginWithType("format.Syslog5424", config)
+	expect.NoError(err)
+	formatter, casted := plugin.(*Syslog5424)
+	expect.True(casted)
+
+	msg := core.NewMessage(nil, []byte("test"), 0)
+	msg.Timestamp = time.Date(2016, 10, 14, 12, 0, 0, 0, time.UTC)
+	result, _ := formatter.Format(msg)
+	expect.Equal(`57 <14>1 2016-10-14T12:00:00.000000Z host gollum 42 - - test`, string(result))
+
+	msg.SetMetadata("user", "bob")
+	result, _ = formatter.Format(msg)
+	expect.Equal(`73 <14>1 2016-10-14T12:00:00.000000Z host gollum 42 - [meta user="bob"] test`, string(result))
+
+	config = core.NewPluginConfig("")
+	config.Override("Syslog5424Facility", "nope")
+	_, err = core.NewPluginWithType("format.Syslog5424", config)
+	expect.NotNil(err)
+}
@@ -0,0 +1,155 @@
+// Copyright 2015-2016 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package format
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/core/log"
+	"github.com/trivago/gollum/shared"
+	"io/ioutil"
+	"os"
+	"text/template"
+	"time"
+)
+
+// Template formatter plugin
+// Template is a formatter that renders a text/template for each message.
+// If the template fails to render, a warning is logged and the output of
+// TemplateDataFormatter is returned. The function "json" can be used to write
+// a value as JSON, e.g. {{ json .Payload }} writes a JSON string.
+// The following values can be accessed from within the template:
+//  * .Payload is the message as string.
+//  * .JSON is the message parsed as JSON object. The message is only parsed
+//    if this value is used. If the message is not a valid JSON object this is
+//    empty.
+//  * .Metadata is the map of metadata attached to the message.
+//  * .Stream is the name of the stream the message is in.
+//  * .Hostname is the name of the host gollum is running on.
+//  * .Timestamp is the time the message was created (a time.Time).
+//  * .Sequence is the sequence number of the message.
+// Configuration example
+//
+//  - "stream.Broadcast":
+//    Formatter: "format.Template"
+//    TemplateDataFormatter: "format.Forward"
+//    TemplateText: "{{ .Timestamp.Format \"2006-01-02\" }} {{ .Hostname }} {{ .Payload }}"
+//    TemplateFile: ""
+//
+// TemplateDataFormatter defines a formatter that is applied before the
+// template is rendered. By default this is set to "format.Forward".
+//
+// TemplateText defines the template to render. See the documentation of the
+// Go text/template package for the syntax. By default this is set to
+// "{{ .Payload }}".
+//
+// TemplateFile defines a file to read the template from. If set, TemplateText
+// is ignored. By default this is set to "".
+type Template struct {
+	base     core.Formatter
+	template *template.Template
+	hostname string
+}
+
+// templateData is the value passed to the template of a Template formatter.
+type templateData struct {
+	Payload   string
+	Metadata  core.MessageMetadata
+	Stream    string
+	Hostname  string
+	Timestamp time.Time
+	Sequence  uint64
+	data      []byte
+	json      shared.MarshalMap
+}
+
+func init() {
+	shared.TypeRegistry.Register(Template{})
+}
+
+// Configure initializes this formatter with values from a plugin config.
+func (format *Template) Configure(conf core.PluginConfig) error {
+	plugin, err := core.NewPluginWithType(conf.GetString("TemplateDataFormatter", "format.Forward"), conf)
+	if err != nil {
+		return err
+	}
+	format.base = plugin.(core.Formatter)
+
+	text := conf.GetString("TemplateText", "{{ .Payload }}")
+	if file := conf.GetString("TemplateFile", ""); file != "" {
+		content, err := ioutil.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		text = string(content)
+	}
+
+	functions := template.FuncMap{
+		"json": templateJSON,
+	}
+	if format.template, err = template.New("Template").Funcs(functions).Parse(text); err != nil {
+		return err
+	}
+
+	if format.hostname, err = os.Hostname(); err != nil {
+		Log.Warning.Print("Template could not get hostname: ", err)
+	}
+	return nil
+}
+
+// templateJSON writes the given value as JSON.
+func templateJSON(value interface{}) (string, error) {
+	buffer := bytes.NewBuffer(nil)
+	encoder := json.NewEncoder(buffer)
+	encoder.SetEscapeHTML(false)
+	err := encoder.Encode(value)
+	return string(bytes.TrimRight(buffer.Bytes(), "\n")), err
+}
+
+// JSON returns the payload parsed as JSON object. The payload is parsed on
+// first access only.
+func (values *templateData) JSON() shared.MarshalMap {
+	if values.json == nil {
+		values.json = shared.NewMarshalMap()
+		if err := json.Unmarshal(values.data, &values.json); err != nil {
+			values.json = shared.NewMarshalMap()
+		}
+	}
+	return values.json
+}
+
+// Format renders the template for the given message
+func (format *Template) Format(msg core.Message) ([]byte, core.MessageStreamID) {
+	data, streamID := format.base.Format(msg)
+
+	values := &templateData{
+		Payload:   string(data),
+		Metadata:  msg.Metadata,
+		Stream:    core.StreamRegistry.GetStreamName(streamID),
+		Hostname:  format.hostname,
+		Timestamp: msg.Timestamp,
+		Sequence:  msg.Sequence,
+		data:      data,
+	}
+
+	var output bytes.Buffer
+	if err := format.template.Execute(&output, values); err != nil {
+		Log.Warning.Print("Template failed to render a message: ", err)
+		return data, streamID // ### return, template error ###
+	}
+
+	return output.Bytes(), streamID
+}
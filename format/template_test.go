@@ -0,0 +1,60 @@
+// Copyright 2015-2016 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package format
+
+import (
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/shared"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestTemplate(t *testing.T) {
+	expect := shared.NewExpect(t)
+
+	config := core.NewPluginConfig("")
+	config.Override("TemplateText", `{{ .Stream }}|{{ .Metadata.user }}|{{ .JSON.status }}|{{ index .JSON "path" | json }}|{{ .Timestamp.Format "2006" }}|{{ .Sequence }}`)
+
+	plugin, err := core.NewPluginWithType("format.Template", config)
+	expect.NoError(err)
+	formatter, casted := plugin.(*Template)
+	expect.True(casted)
+
+	msg := core.NewMessage(nil, []byte(`{"status":200,"path":"/a<b>"}`), 42)
+	msg.StreamID = core.StreamRegistry.GetStreamID("templateStream")
+	msg.SetMetadata("user", "bob")
+	msg.Timestamp = time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	result, _ := formatter.Format(msg)
+	expect.Equal(`templateStream|bob|200|"/a<b>"|2016|42`, string(result))
+}
+
+func TestTemplatePlain(t *testing.T) {
+	expect := shared.NewExpect(t)
+
+	config := core.NewPluginConfig("")
+	config.Override("TemplateText", "{{ .Hostname }} {{ .Payload }}{{ with .JSON.foo }}!{{ end }}")
+
+	plugin, err := core.NewPluginWithType("format.Template", config)
+	expect.NoError(err)
+	formatter, casted := plugin.(*Template)
+	expect.True(casted)
+
+	hostname, _ := os.Hostname()
+	msg := core.NewMessage(nil, []byte("not json"), 0)
+	result, _ := formatter.Format(msg)
+	expect.Equal(hostname+" not json", string(result))
+}
@@ -0,0 +1,205 @@
+// Copyright 2015-2016 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package format
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/shared"
+	"strings"
+	"unicode/utf8"
+)
+
+// Truncate formatter plugin
+// Truncate is a formatter that enforces a maximum message size, e.g. to
+// match the limits of Kafka brokers or UDP datagrams. Messages within the
+// limit are passed on unchanged.
+// Configuration example
+//
+//  - "stream.Broadcast":
+//    Formatter: "format.Truncate"
+//    TruncateDataFormatter: "format.Forward"
+//    TruncateMaxBytes: 1048576
+//    TruncatePolicy: "utf8"
+//    TruncateMarker: "..."
+//    TruncateJSONMarkerKey: "_truncated"
+//    TruncateOversizeStream: ""
+//
+// TruncateDataFormatter defines a formatter that is applied before the size
+// is checked. By default this is set to "format.Forward".
+//
+// TruncateMaxBytes defines the maximum size of a message in bytes, including
+// any marker added. By default this is set to 1048576 (1 MB).
+//
+// TruncatePolicy defines how oversized messages are handled.
+// By default this is set to "utf8".
+//  * "truncate" cuts the message and appends TruncateMarker.
+//  * "utf8" works like "truncate" but does not split UTF-8 characters.
+//  * "json" removes fields from the end of a JSON object until it fits and
+//    adds the field TruncateJSONMarkerKey set to true. Messages that are no
+//    JSON object or that do not fit without any field are handled as "utf8".
+//  * "route" passes the message unchanged to TruncateOversizeStream.
+//  * "drop" drops the message.
+//
+// TruncateMarker defines the string appended to truncated messages.
+// By default this is set to "...".
+//
+// TruncateJSONMarkerKey defines the field added to JSON objects truncated by
+// the "json" policy. Set to "" to disable. By default this is set to
+// "_truncated".
+//
+// TruncateOversizeStream defines the stream oversized messages are routed to
+// by the "route" policy. This setting is required for this policy.
+// By default this is set to "".
+type Truncate struct {
+	base             core.Formatter
+	maxBytes         int
+	policy           string
+	marker           string
+	jsonMarkerKey    string
+	oversizeStreamID core.MessageStreamID
+}
+
+func init() {
+	shared.TypeRegistry.Register(Truncate{})
+}
+
+// Configure initializes this formatter with values from a plugin config.
+func (format *Truncate) Configure(conf core.PluginConfig) error {
+	plugin, err := core.NewPluginWithType(conf.GetString("TruncateDataFormatter", "format.Forward"), conf)
+	if err != nil {
+		return err
+	}
+	format.base = plugin.(core.Formatter)
+
+	format.maxBytes = conf.GetInt("TruncateMaxBytes", 1<<20)
+	format.marker = shared.Unescape(conf.GetString("TruncateMarker", "..."))
+	format.jsonMarkerKey = conf.GetString("TruncateJSONMarkerKey", "_truncated")
+	if format.maxBytes <= len(format.marker) {
+		return fmt.Errorf("TruncateMaxBytes must be larger than TruncateMarker")
+	}
+
+	format.policy = strings.ToLower(conf.GetString("TruncatePolicy", "utf8"))
+	switch format.policy {
+	case "truncate", "utf8", "json", "drop":
+	case "route":
+		oversizeStream := conf.GetString("TruncateOversizeStream", "")
+		if oversizeStream == "" {
+			return fmt.Errorf("TruncatePolicy route requires TruncateOversizeStream to be set")
+		}
+		format.oversizeStreamID = core.StreamRegistry.GetStreamID(oversizeStream)
+	default:
+		return fmt.Errorf("Unknown TruncatePolicy: %s", format.policy)
+	}
+
+	return nil
+}
+
+// truncate cuts data so that data and marker fit into maxBytes. If keepRunes
+// is set, UTF-8 characters are not split.
+func (format *Truncate) truncate(data []byte, keepRunes bool) []byte {
+	size := format.maxBytes - len(format.marker)
+	if keepRunes {
+		for size > 0 && !utf8.RuneStart(data[size]) {
+			size--
+		}
+	}
+
+	result := make([]byte, 0, size+len(format.marker))
+	result = append(result, data[:size]...)
+	return append(result, format.marker...)
+}
+
+// truncateJSON removes fields from the end of a JSON object until it fits
+// into maxBytes. False is returned if data is no JSON object or does not fit.
+func (format *Truncate) truncateJSON(data []byte) ([]byte, bool) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	if token, err := decoder.Token(); err != nil || token != json.Delim('{') {
+		return nil, false // ### return, no object ###
+	}
+
+	marker := []byte{}
+	if format.jsonMarkerKey != "" {
+		markerBuffer := bytes.NewBuffer(nil)
+		writeJSONString(markerBuffer, format.jsonMarkerKey)
+		markerBuffer.WriteString(":true")
+		marker = markerBuffer.Bytes()
+	}
+
+	buffer := bytes.NewBufferString("{")
+	for decoder.More() {
+		key, err := decoder.Token()
+		if err != nil {
+			return nil, false
+		}
+		var value json.RawMessage
+		if err := decoder.Decode(&value); err != nil {
+			return nil, false
+		}
+
+		field := bytes.NewBuffer(nil)
+		if buffer.Len() > 1 {
+			field.WriteByte(',')
+		}
+		writeJSONString(field, key.(string))
+		field.WriteByte(':')
+		if err := json.Compact(field, value); err != nil {
+			return nil, false
+		}
+
+		// Space for the field, the marker (plus comma) and the closing brace
+		if buffer.Len()+field.Len()+len(marker)+2 > format.maxBytes {
+			break
+		}
+		buffer.Write(field.Bytes())
+	}
+
+	if len(marker) > 0 {
+		if buffer.Len() > 1 {
+			buffer.WriteByte(',')
+		}
+		buffer.Write(marker)
+	}
+	buffer.WriteByte('}')
+
+	if buffer.Len() > format.maxBytes {
+		return nil, false // ### return, marker does not fit ###
+	}
+	return buffer.Bytes(), true
+}
+
+// Format returns the message limited to the configured size
+func (format *Truncate) Format(msg core.Message) ([]byte, core.MessageStreamID) {
+	data, streamID := format.base.Format(msg)
+	if len(data) <= format.maxBytes {
+		return data, streamID // ### return, small enough ###
+	}
+
+	switch format.policy {
+	case "route":
+		return data, format.oversizeStreamID
+	case "drop":
+		return data, core.DroppedStreamID
+	case "truncate":
+		return format.truncate(data, false), streamID
+	case "json":
+		if truncated, ok := format.truncateJSON(data); ok {
+			return truncated, streamID
+		}
+	}
+	return format.truncate(data, true), streamID
+}
@@ -0,0 +1,87 @@
+// Copyright 2015-2016 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package format
+
+import (
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/shared"
+	"testing"
+)
+
+func TestTruncate(t *testing.T) {
+	expect := shared.NewExpect(t)
+	msg := core.NewMessage(nil, []byte("abcäöü"), 0) // 9 bytes
+
+	testCases := []struct {
+		maxBytes int
+		policy   string
+		result   string
+		streamID core.MessageStreamID
+	}{
+		{9, "truncate", "abcäöü", msg.StreamID},
+		{7, "truncate", "abc\xc3...", msg.StreamID},
+		{7, "utf8", "abc...", msg.StreamID},
+		{8, "route", "abcäöü", core.StreamRegistry.GetStreamID("oversize")},
+		{8, "drop", "abcäöü", core.DroppedStreamID},
+	}
+
+	for _, testCase := range testCases {
+		config := core.NewPluginConfig("")
+		config.Override("TruncateMaxBytes", testCase.maxBytes)
+		config.Override("TruncatePolicy", testCase.policy)
+		config.Override("TruncateOversizeStream", "oversize")
+		plugin, err := core.NewPluginWithType("format.Truncate", config)
+		expect.NoError(err)
+		formatter, casted := plugin.(*Truncate)
+		expect.True(casted)
+
+		result, streamID := formatter.Format(msg)
+		expect.Equal(testCase.result, string(result))
+		expect.Equal(testCase.streamID, streamID)
+	}
+}
+
+func TestTruncateJSON(t *testing.T) {
+	expect := shared.NewExpect(t)
+
+	testCases := []struct {
+		maxBytes int
+		payload  string
+		result   string
+	}{
+		{26, `{"a": 1, "b": "long value", "c": 3}`, `{"a":1,"_truncated":true}`},
+		{45, `{"a":1,"b":"long value","c":3,"d":"another long value"}`, `{"a":1,"b":"long value","_truncated":true}`},
+		{10, `["not", "an", "object"]`, `["not",...`},
+	}
+
+	for _, testCase := range testCases {
+		config := core.NewPluginConfig("")
+		config.Override("TruncateMaxBytes", testCase.maxBytes)
+		config.Override("TruncatePolicy", "json")
+		plugin, err := core.NewPluginWithType("format.Truncate", config)
+		expect.NoError(err)
+		formatter, casted := plugin.(*Truncate)
+		expect.True(casted)
+
+		msg := core.NewMessage(nil, []byte(testCase.payload), 0)
+		result, _ := formatter.Format(msg)
+		expect.Equal(testCase.result, string(result))
+	}
+
+	config := core.NewPluginConfig("")
+	config.Override("TruncatePolicy", "route")
+	_, err := core.NewPluginWithType("format.Truncate", config)
+	expect.NotNil(err)
+}
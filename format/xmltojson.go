@@ -0,0 +1,279 @@
+// Copyright 2015-2016 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package format
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/core/log"
+	"github.com/trivago/gollum/shared"
+	"io"
+	"strings"
+)
+
+// XMLToJSON formatter plugin
+// XMLToJSON is a formatter that converts XML documents into JSON objects.
+// The root element becomes the only key of the object. Attributes are written
+// as keys with a configurable prefix, text is written as value if the element
+// has no attributes and no children, otherwise it is stored under a
+// configurable key. Repeated child elements are written as array. Text is
+// trimmed, comments and processing instructions are ignored. The order of
+// elements and attributes is preserved.
+// Configuration example
+//
+//  - "stream.Broadcast":
+//    Formatter: "format.XMLToJSON"
+//    XMLToJSONDataFormatter: "format.Forward"
+//    XMLToJSONAttributePrefix: "@"
+//    XMLToJSONTextKey: "#text"
+//    XMLToJSONArrays:
+//      - "Data"
+//    XMLToJSONStripNamespaces: false
+//    XMLToJSONErrorStream: ""
+//
+// XMLToJSONDataFormatter defines a formatter that is applied before the
+// message is converted. By default this is set to "format.Forward".
+//
+// XMLToJSONAttributePrefix defines the string prepended to attribute names.
+// By default this is set to "@".
+//
+// XMLToJSONTextKey defines the key used for the text of elements that also
+// have attributes or children. By default this is set to "#text".
+//
+// XMLToJSONArrays defines a list of element names that are always written as
+// array, even if they occur only once. This keeps the JSON structure stable
+// for consumers. By default this list is empty.
+//
+// XMLToJSONStripNamespaces can be set to true to remove namespace prefixes
+// from element and attribute names and to drop namespace declarations.
+// By default this is set to false, which writes names as "prefix:name".
+//
+// XMLToJSONErrorStream defines a stream that messages which are not valid XML
+// are routed to. These messages are passed on unchanged.
+// By default this is set to "", i.e. a warning is logged and the message stays
+// on its stream.
+type XMLToJSON struct {
+	base            core.Formatter
+	attributePrefix string
+	textKey         string
+	arrays          map[string]bool
+	stripNamespaces bool
+	errorStreamID   core.MessageStreamID
+}
+
+type xmlToJSONNode struct {
+	name       string
+	attributes []xml.Attr
+	children   []*xmlToJSONNode
+	text       bytes.Buffer
+}
+
+func init() {
+	shared.TypeRegistry.Register(XMLToJSON{})
+}
+
+// Configure initializes this formatter with values from a plugin config.
+func (format *XMLToJSON) Configure(conf core.PluginConfig) error {
+	plugin, err := core.NewPluginWithType(conf.GetString("XMLToJSONDataFormatter", "format.Forward"), conf)
+	if err != nil {
+		return err
+	}
+	format.base = plugin.(core.Formatter)
+
+	format.attributePrefix = conf.GetString("XMLToJSONAttributePrefix", "@")
+	format.textKey = conf.GetString("XMLToJSONTextKey", "#text")
+	format.stripNamespaces = conf.GetBool("XMLToJSONStripNamespaces", false)
+
+	format.arrays = make(map[string]bool)
+	for _, name := range conf.GetStringArray("XMLToJSONArrays", []string{}) {
+		format.arrays[name] = true
+	}
+
+	format.errorStreamID = core.InvalidStreamID
+	if errorStream := conf.GetString("XMLToJSONErrorStream", ""); errorStream != "" {
+		format.errorStreamID = core.StreamRegistry.GetStreamID(errorStream)
+	}
+
+	return nil
+}
+
+// xmlName returns the name of an element or attribute as written to JSON.
+func (format *XMLToJSON) xmlName(name xml.Name) string {
+	if name.Space == "" || format.stripNamespaces {
+		return name.Local
+	}
+	return name.Space + ":" + name.Local
+}
+
+// parse reads an XML document into a tree of nodes. RawToken is used so that
+// namespace prefixes are kept as written.
+func (format *XMLToJSON) parse(data []byte) (*xmlToJSONNode, error) {
+	decoder := xml.NewDecoder(bytes.NewReader(data))
+	decoder.Strict = true
+	decoder.CharsetReader = func(charset string, input io.Reader) (io.Reader, error) {
+		return input, nil // encoding declarations are ignored, data is read as is
+	}
+
+	var root *xmlToJSONNode
+	stack := []*xmlToJSONNode{}
+
+	for {
+		token, err := decoder.RawToken()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		switch element := token.(type) {
+		case xml.StartElement:
+			if root != nil && len(stack) == 0 {
+				return nil, fmt.Errorf("Multiple root elements")
+			}
+			node := &xmlToJSONNode{name: format.xmlName(element.Name)}
+			for _, attr := range element.Attr {
+				if format.stripNamespaces && (attr.Name.Space == "xmlns" || (attr.Name.Space == "" && attr.Name.Local == "xmlns")) {
+					continue // ### continue, namespace declaration ###
+				}
+				node.attributes = append(node.attributes, attr)
+			}
+
+			if len(stack) == 0 {
+				root = node
+			} else {
+				parent := stack[len(stack)-1]
+				parent.children = append(parent.children, node)
+			}
+			stack = append(stack, node)
+
+		case xml.EndElement:
+			if len(stack) == 0 || stack[len(stack)-1].name != format.xmlName(element.Name) {
+				return nil, fmt.Errorf("Unexpected end element %s", format.xmlName(element.Name))
+			}
+			stack = stack[:len(stack)-1]
+
+		case xml.CharData:
+			if len(stack) > 0 {
+				stack[len(stack)-1].text.Write(element)
+			} else if len(bytes.TrimSpace(element)) > 0 {
+				return nil, fmt.Errorf("Text outside of root element")
+			}
+		}
+	}
+
+	if root == nil || len(stack) > 0 {
+		return nil, fmt.Errorf("Incomplete XML document")
+	}
+	return root, nil
+}
+
+// writeJSONString writes value as JSON string without escaping HTML
+// characters.
+func writeJSONString(buffer *bytes.Buffer, value string) {
+	encoder := json.NewEncoder(buffer)
+	encoder.SetEscapeHTML(false)
+	encoder.Encode(value)
+	buffer.Truncate(buffer.Len() - 1) // remove newline added by Encode
+}
+
+// write writes the value of a node as JSON.
+func (format *XMLToJSON) write(buffer *bytes.Buffer, node *xmlToJSONNode) {
+	text := strings.TrimSpace(node.text.String())
+	if len(node.attributes) == 0 && len(node.children) == 0 {
+		writeJSONString(buffer, text)
+		return // ### return, text only ###
+	}
+
+	buffer.WriteByte('{')
+	first := true
+	writeKey := func(key string) {
+		if !first {
+			buffer.WriteByte(',')
+		}
+		first = false
+		writeJSONString(buffer, key)
+		buffer.WriteByte(':')
+	}
+
+	for _, attr := range node.attributes {
+		writeKey(format.attributePrefix + format.xmlName(attr.Name))
+		writeJSONString(buffer, attr.Value)
+	}
+
+	// Group children by name in order of their first occurrence
+	names := []string{}
+	groups := make(map[string][]*xmlToJSONNode)
+	for _, child := range node.children {
+		if _, exists := groups[child.name]; !exists {
+			names = append(names, child.name)
+		}
+		groups[child.name] = append(groups[child.name], child)
+	}
+
+	for _, name := range names {
+		writeKey(name)
+		group := groups[name]
+		if len(group) == 1 && !format.arrays[name] {
+			format.write(buffer, group[0])
+			continue // ### continue, single element ###
+		}
+
+		buffer.WriteByte('[')
+		for i, child := range group {
+			if i > 0 {
+				buffer.WriteByte(',')
+			}
+			format.write(buffer, child)
+		}
+		buffer.WriteByte(']')
+	}
+
+	if text != "" {
+		writeKey(format.textKey)
+		writeJSONString(buffer, text)
+	}
+	buffer.WriteByte('}')
+}
+
+// Format returns the XML document as JSON object
+func (format *XMLToJSON) Format(msg core.Message) ([]byte, core.MessageStreamID) {
+	data, streamID := format.base.Format(msg)
+
+	root, err := format.parse(data)
+	if err != nil {
+		if format.errorStreamID != core.InvalidStreamID {
+			return data, format.errorStreamID // ### return, route to error stream ###
+		}
+		Log.Warning.Print("XMLToJSON failed to convert a message: ", err)
+		return data, streamID
+	}
+
+	buffer := bytes.NewBufferString("{")
+	writeJSONString(buffer, root.name)
+	buffer.WriteByte(':')
+	if format.arrays[root.name] {
+		buffer.WriteByte('[')
+		format.write(buffer, root)
+		buffer.WriteByte(']')
+	} else {
+		format.write(buffer, root)
+	}
+	buffer.WriteByte('}')
+	return buffer.Bytes(), streamID
+}
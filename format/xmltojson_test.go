@@ -0,0 +1,81 @@
+// Copyright 2015-2016 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package format
+
+import (
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/shared"
+	"testing"
+)
+
+const xmlToJSONTestEvent = `<?xml version="1.0" encoding="UTF-16"?>
+<Event xmlns="http://schemas.microsoft.com/win/2004/08/events/event">
+  <System>
+    <Provider Name="Microsoft-Windows-Security-Auditing"/>
+    <EventID>4624</EventID>
+    <!-- comment -->
+  </System>
+  <EventData>
+    <Data Name="TargetUserName">bob</Data>
+    <Data Name="IpAddress"><![CDATA[10.0.0.1 & <local>]]></Data>
+  </EventData>
+  <ev:Note xmlns:ev="urn:ev" ev:level="1">text</ev:Note>
+</Event>`
+
+func TestXMLToJSON(t *testing.T) {
+	expect := shared.NewExpect(t)
+
+	config := core.NewPluginConfig("")
+	config.Override("XMLToJSONErrorStream", "error")
+	plugin, err := core.NewPluginWithType("format.XMLToJSON", config)
+	expect.NoError(err)
+	formatter, casted := plugin.(*XMLToJSON)
+	expect.True(casted)
+
+	msg := core.NewMessage(nil, []byte(xmlToJSONTestEvent), 0)
+	result, streamID := formatter.Format(msg)
+	expect.Equal(`{"Event":{"@xmlns":"http://schemas.microsoft.com/win/2004/08/events/event",`+
+		`"System":{"Provider":{"@Name":"Microsoft-Windows-Security-Auditing"},"EventID":"4624"},`+
+		`"EventData":{"Data":[{"@Name":"TargetUserName","#text":"bob"},{"@Name":"IpAddress","#text":"10.0.0.1 & <local>"}]},`+
+		`"ev:Note":{"@xmlns:ev":"urn:ev","@ev:level":"1","#text":"text"}}}`, string(result))
+	expect.Equal(msg.StreamID, streamID)
+
+	for _, invalid := range []string{`<a><b></a>`, `<a>`, `no xml`, `<a/><b/>`} {
+		msg = core.NewMessage(nil, []byte(invalid), 0)
+		result, streamID = formatter.Format(msg)
+		expect.Equal(invalid, string(result))
+		expect.Equal(core.StreamRegistry.GetStreamID("error"), streamID)
+	}
+}
+
+func TestXMLToJSONOptions(t *testing.T) {
+	expect := shared.NewExpect(t)
+
+	config := core.NewPluginConfig("")
+	config.Override("XMLToJSONAttributePrefix", "-")
+	config.Override("XMLToJSONTextKey", "value")
+	config.Override("XMLToJSONArrays", []interface{}{"EventID", "Data"})
+	config.Override("XMLToJSONStripNamespaces", true)
+	plugin, err := core.NewPluginWithType("format.XMLToJSON", config)
+	expect.NoError(err)
+	formatter, casted := plugin.(*XMLToJSON)
+	expect.True(casted)
+
+	msg := core.NewMessage(nil, []byte(xmlToJSONTestEvent), 0)
+	result, _ := formatter.Format(msg)
+	expect.Equal(`{"Event":{"System":{"Provider":{"-Name":"Microsoft-Windows-Security-Auditing"},"EventID":["4624"]},`+
+		`"EventData":{"Data":[{"-Name":"TargetUserName","value":"bob"},{"-Name":"IpAddress","value":"10.0.0.1 & <local>"}]},`+
+		`"Note":{"-level":"1","value":"text"}}}`, string(result))
+}
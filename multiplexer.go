@@ -339,6 +339,13 @@ func (plex *multiplexer) shutdown() {
 		core.StreamRegistry.ActivateAllFuses()
 		Log.Debug.Print("Waiting for consumers to close")
 		plex.consumerWorker.Wait()
+
+		core.StreamRegistry.ForEachStream(
+			func(streamID core.MessageStreamID, stream core.Stream) {
+				if batched, isBatched := stream.(core.BatchedStream); isBatched {
+					batched.FlushBatch()
+				}
+			})
 	}
 
 	// Make sure remaining warning / errors are written to stderr
@@ -464,6 +471,12 @@ func (plex multiplexer) run() {
 				for _, producer := range plex.producers {
 					producer.Control() <- core.PluginControlRoll
 				}
+				core.StreamRegistry.ForEachStream(
+					func(streamID core.MessageStreamID, stream core.Stream) {
+						if rollable, isRollable := stream.(core.RollableStream); isRollable {
+							rollable.Roll()
+						}
+					})
 
 			default:
 			}
@@ -18,6 +18,8 @@ import (
 	"bytes"
 	"encoding/binary"
 	"io"
+	"math"
+	"regexp"
 )
 
 // BufferedReaderFlags is an enum to configure a buffered reader
@@ -58,6 +60,11 @@ const (
 	// Only one MLE flag is supported at a time.
 	BufferedReaderFlagMLEFixed = BufferedReaderFlags(6)
 
+	// BufferedReaderFlagMLEVarint enables reading if length encoded messages.
+	// Runlength is read as unsigned varint as used by protocol buffers.
+	// Only one MLE flag is supported at a time.
+	BufferedReaderFlagMLEVarint = BufferedReaderFlags(7)
+
 	// BufferedReaderFlagMaskMLE is a bitmask to mask out everything but MLE flags
 	BufferedReaderFlagMaskMLE = BufferedReaderFlags(7)
 
@@ -67,6 +74,14 @@ const (
 	// BufferedReaderFlagEverything will keep MLE and/or delimiters when
 	// building a message.
 	BufferedReaderFlagEverything = BufferedReaderFlags(16)
+
+	// BufferedReaderFlagRegex enables reading for a regular expression that
+	// marks the start of a message. The delimiter string passed to the reader
+	// is used as the expression and is matched in multi-line mode, i.e. "^"
+	// matches the start of a line. A message is complete once the start of the
+	// next message has been found or Flush is called. Matches must not span
+	// multiple lines. This flag is ignored if an MLE flag is set.
+	BufferedReaderFlagRegex = BufferedReaderFlags(32)
 )
 
 type bufferError string
@@ -92,11 +107,13 @@ var BufferDataInvalid = bufferError("Invalid data")
 type BufferedReader struct {
 	data       []byte
 	delimiter  []byte
+	pattern    *regexp.Regexp
 	parse      func() ([]byte, int)
 	sequence   uint64
 	paramMLE   int
 	growSize   int
 	end        int
+	scanIdx    int
 	encoding   binary.ByteOrder
 	flags      BufferedReaderFlags
 	incomplete bool
@@ -110,7 +127,9 @@ type BufferedReader struct {
 // bufferSize defines the initial size / grow size of the buffer
 // flags configures the parsing method
 // offsetOrLength sets either the runlength offset or fixed message size
-// delimiter defines the delimiter used for textual message parsing
+// delimiter defines the delimiter used for textual message parsing or the
+// expression used when BufferedReaderFlagRegex is set. Invalid expressions
+// will cause a panic.
 func NewBufferedReader(bufferSize int, flags BufferedReaderFlags, offsetOrLength int, delimiter string) *BufferedReader {
 	buffer := BufferedReader{
 		data:       make([]byte, bufferSize),
@@ -128,9 +147,15 @@ func NewBufferedReader(bufferSize int, flags BufferedReaderFlags, offsetOrLength
 		buffer.encoding = binary.BigEndian
 	}
 
-	if flags&BufferedReaderFlagMaskMLE == 0 {
+	switch {
+	case flags&BufferedReaderFlagMaskMLE == 0 && flags&BufferedReaderFlagRegex != 0:
+		buffer.pattern = regexp.MustCompile("(?m)" + delimiter)
+		buffer.parse = buffer.parseRegex
+
+	case flags&BufferedReaderFlagMaskMLE == 0:
 		buffer.parse = buffer.parseDelimiter
-	} else {
+
+	default:
 		switch flags & BufferedReaderFlagMaskMLE {
 		default:
 			buffer.parse = buffer.parseMLEText
@@ -144,6 +169,8 @@ func NewBufferedReader(bufferSize int, flags BufferedReaderFlags, offsetOrLength
 			buffer.parse = buffer.parseMLE64
 		case BufferedReaderFlagMLEFixed:
 			buffer.parse = buffer.parseMLEFixed
+		case BufferedReaderFlagMLEVarint:
+			buffer.parse = buffer.parseMLEVarint
 		}
 	}
 
@@ -154,9 +181,31 @@ func NewBufferedReader(bufferSize int, flags BufferedReaderFlags, offsetOrLength
 func (buffer *BufferedReader) Reset(sequence uint64) {
 	buffer.sequence = sequence
 	buffer.end = 0
+	buffer.scanIdx = 0
 	buffer.incomplete = true
 }
 
+// Flush passes the partially received message to the given callback and
+// clears the buffer. Messages read by the regex partitioner are only complete
+// once the start of the next message has been received, so this has to be
+// called to send the last message of a stream. Incomplete messages of all
+// other partitioners are discarded.
+func (buffer *BufferedReader) Flush(callback BufferReadCallback) {
+	if buffer.pattern != nil && buffer.end > 0 && callback != nil {
+		data := make([]byte, buffer.end)
+		copy(data, buffer.data[:buffer.end])
+		callback(data, buffer.sequence)
+		buffer.sequence++
+	}
+	buffer.Reset(buffer.sequence)
+}
+
+// Buffered returns the number of bytes currently held by the buffer, i.e. the
+// size of a partially received message.
+func (buffer *BufferedReader) Buffered() int {
+	return buffer.end
+}
+
 // general message extraction part of all parser methods
 func (buffer *BufferedReader) extractMessage(messageLen int, msgStartIdx int) ([]byte, int) {
 	nextMsgIdx := msgStartIdx + messageLen
@@ -194,6 +243,29 @@ func (buffer *BufferedReader) parseDelimiter() ([]byte, int) {
 	return data, nextMsgIdx
 }
 
+// messages are started by a regular expression. All lines before scanIdx have
+// already been searched for the start of the next message. The search resumes
+// at the start of a line so that "^" keeps matching line starts only.
+func (buffer *BufferedReader) parseRegex() ([]byte, int) {
+	if buffer.scanIdx == 0 {
+		for _, match := range buffer.pattern.FindAllIndex(buffer.data[:buffer.end], 2) {
+			if match[0] > 0 {
+				return buffer.extractMessage(match[0], 0)
+			}
+		}
+	} else if match := buffer.pattern.FindIndex(buffer.data[buffer.scanIdx:buffer.end]); match != nil {
+		msgLen := buffer.scanIdx + match[0]
+		buffer.scanIdx = 0
+		return buffer.extractMessage(msgLen, 0)
+	}
+
+	// The last line may still be incomplete and is searched again
+	if lineIdx := bytes.LastIndexByte(buffer.data[buffer.scanIdx:buffer.end], '\n'); lineIdx >= 0 {
+		buffer.scanIdx += lineIdx + 1
+	}
+	return nil, 0 // ### return, incomplete ###
+}
+
 // messages are separeated length encoded by ASCII number and (an optional)
 // delimiter.
 func (buffer *BufferedReader) parseMLEText() ([]byte, int) {
@@ -261,6 +333,21 @@ func (buffer *BufferedReader) parseMLE64() ([]byte, int) {
 	return buffer.extractMessage(int(messageLen), buffer.paramMLE+8)
 }
 
+// messages are separated by a varint encoded length
+func (buffer *BufferedReader) parseMLEVarint() ([]byte, int) {
+	if buffer.paramMLE >= buffer.end {
+		return nil, 0 // ### return, incomplete ###
+	}
+	messageLen, headerLen := binary.Uvarint(buffer.data[buffer.paramMLE:buffer.end])
+	switch {
+	case headerLen == 0:
+		return nil, 0 // ### return, incomplete ###
+	case headerLen < 0 || messageLen > math.MaxInt32:
+		return nil, -1 // ### return, malformed ###
+	}
+	return buffer.extractMessage(int(messageLen), buffer.paramMLE+headerLen)
+}
+
 // ReadAll calls ReadOne as long as there are messages in the stream.
 // Messages will be send to the given write callback.
 // If callback is nil, data will be read and discarded.
@@ -308,6 +395,7 @@ func (buffer *BufferedReader) ReadOne(reader io.Reader) (data []byte, seq uint64
 
 	if nextMsgIdx == -1 {
 		buffer.end = 0
+		buffer.scanIdx = 0
 		buffer.incomplete = true
 		return nil, 0, true, BufferDataInvalid // ### return, invalid data ###
 	}
@@ -16,6 +16,7 @@ package shared
 
 import (
 	"bytes"
+	"encoding/binary"
 	"fmt"
 	"io"
 	"strings"
@@ -47,6 +48,7 @@ func TestBufferedReaderDelimiter(t *testing.T) {
 	err := reader.ReadAll(parseReader, data.write)
 	data.expect.Equal(io.EOF, err)
 	data.expect.Equal(2, data.parsed)
+	data.expect.Equal(len(data.tokens[2]), reader.Buffered())
 
 	msg, _, _, err := reader.ReadOne(parseReader)
 	data.expect.Equal(io.EOF, err)
@@ -201,6 +203,94 @@ func TestBufferedReaderMLE64(t *testing.T) {
 	data.expect.Nil(msg)
 }
 
+func TestBufferedReaderMLEVarint(t *testing.T) {
+	data := bufferedReaderTestData{
+		expect: NewExpect(t),
+		tokens: []string{"test1", strings.Repeat("test 2", 50), "test\t3"},
+		parsed: 0,
+	}
+
+	var parseData []byte
+	for _, s := range data.tokens {
+		header := make([]byte, binary.MaxVarintLen64)
+		headerLen := binary.PutUvarint(header, uint64(len(s)))
+		parseData = append(parseData, header[:headerLen]...)
+		parseData = append(parseData, s...)
+	}
+
+	parseReader := bytes.NewReader(parseData)
+	reader := NewBufferedReader(64, BufferedReaderFlagMLEVarint, 0, "")
+
+	err := reader.ReadAll(parseReader, data.write)
+	data.expect.NoError(err)
+	data.expect.Equal(3, data.parsed)
+
+	msg, _, _, err := reader.ReadOne(parseReader)
+	data.expect.Equal(io.EOF, err)
+	data.expect.Nil(msg)
+}
+
+func TestBufferedReaderRegex(t *testing.T) {
+	data := bufferedReaderTestData{
+		expect: NewExpect(t),
+		tokens: []string{"<1>Jan 1 test1\n", "<2>Feb 2 test\n 2\n", "<3>Mar 3 test3\n"},
+		parsed: 0,
+	}
+
+	parseData := strings.Join(data.tokens, "")
+	parseReader := strings.NewReader(parseData)
+	reader := NewBufferedReader(16, BufferedReaderFlagRegex, 0, `^<\d+>\w{3} \d`)
+
+	err := reader.ReadAll(parseReader, data.write)
+	data.expect.Equal(io.EOF, err)
+	data.expect.Equal(2, data.parsed)
+	data.expect.Equal(len(data.tokens[2]), reader.Buffered())
+
+	// The last message is sent by Flush
+	reader.Flush(data.write)
+	data.expect.Equal(3, data.parsed)
+	data.expect.Equal(0, reader.Buffered())
+	reader.Flush(data.write)
+	data.expect.Equal(3, data.parsed)
+
+	// Other partitioners discard incomplete messages
+	reader = NewBufferedReader(16, 0, 0, "\n")
+	reader.ReadAll(strings.NewReader("incomplete"), data.write)
+	reader.Flush(data.write)
+	data.expect.Equal(3, data.parsed)
+	data.expect.Equal(0, reader.Buffered())
+}
+
+func TestBufferedReaderRegexResume(t *testing.T) {
+	record := "<2>Feb 2 test\n" + strings.Repeat(" continued\n", 1000)
+	data := bufferedReaderTestData{
+		expect: NewExpect(t),
+		tokens: []string{"<1>Jan 1 test1\n", record, "<3>Mar 3 test3"},
+		parsed: 0,
+	}
+
+	reader := NewBufferedReader(16, BufferedReaderFlagRegex, 0, `^<\d+>\w{3} \d`)
+	reader.ReadAll(strings.NewReader(data.tokens[0]+data.tokens[1]), data.write)
+	data.expect.Equal(1, data.parsed)
+
+	// Lines already searched are not searched again
+	data.expect.Equal(len(data.tokens[1]), reader.Buffered())
+	data.expect.Equal(len(data.tokens[1]), reader.scanIdx)
+
+	// The start of the next message may be split between reads
+	parseReader := strings.NewReader(data.tokens[2])
+	reader.ReadAll(io.LimitReader(parseReader, 4), data.write)
+	data.expect.Equal(1, data.parsed)
+	data.expect.Equal(len(data.tokens[1]), reader.scanIdx)
+
+	reader.ReadAll(parseReader, data.write)
+	data.expect.Equal(2, data.parsed)
+	data.expect.Equal(0, reader.scanIdx)
+
+	reader.Flush(data.write)
+	data.expect.Equal(3, data.parsed)
+}
+
 func TestBufferedReaderMLE8EO(t *testing.T) {
 	data := bufferedReaderTestData{
 		expect: NewExpect(t),
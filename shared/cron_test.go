@@ -0,0 +1,65 @@
+// Copyright 2015-2016 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package shared
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseCronSchedule(t *testing.T) {
+	expect := NewExpect(t)
+
+	for _, spec := range []string{"* * * *", "60 * * * *", "* 24 * * *", "* * 0 * *", "* * * 13 *", "* * * * 8", "*/0 * * * *", "a * * * *", "5-1 * * * *"} {
+		_, err := ParseCronSchedule(spec)
+		expect.NotNil(err)
+	}
+
+	schedule, err := ParseCronSchedule("*/15 8-9,18 * * *")
+	expect.NoError(err)
+	expect.Equal(uint64(1|1<<15|1<<30|1<<45), schedule.minute)
+	expect.Equal(uint64(1<<8|1<<9|1<<18), schedule.hour)
+
+	schedule, err = ParseCronSchedule("5/20 * * * 7")
+	expect.NoError(err)
+	expect.Equal(uint64(1<<5|1<<25|1<<45), schedule.minute)
+	expect.Equal(uint64(1), schedule.dayOfWeek)
+}
+
+func TestCronScheduleNext(t *testing.T) {
+	expect := NewExpect(t)
+	start := time.Date(2016, 8, 1, 10, 7, 30, 0, time.UTC) // a monday
+
+	schedule, _ := ParseCronSchedule("*/15 * * * *")
+	expect.Equal(time.Date(2016, 8, 1, 10, 15, 0, 0, time.UTC), schedule.Next(start))
+
+	schedule, _ = ParseCronSchedule("@daily")
+	expect.Equal(time.Date(2016, 8, 2, 0, 0, 0, 0, time.UTC), schedule.Next(start))
+
+	schedule, _ = ParseCronSchedule("30 9 * * 6")
+	expect.Equal(time.Date(2016, 8, 6, 9, 30, 0, 0, time.UTC), schedule.Next(start))
+
+	// Day of month or day of week
+	schedule, _ = ParseCronSchedule("0 0 13 * 5")
+	expect.Equal(time.Date(2016, 8, 5, 0, 0, 0, 0, time.UTC), schedule.Next(start))
+	expect.Equal(time.Date(2016, 8, 12, 0, 0, 0, 0, time.UTC), schedule.Next(time.Date(2016, 8, 5, 0, 0, 0, 0, time.UTC)))
+	expect.Equal(time.Date(2016, 8, 13, 0, 0, 0, 0, time.UTC), schedule.Next(time.Date(2016, 8, 12, 0, 0, 0, 0, time.UTC)))
+
+	schedule, _ = ParseCronSchedule("0 12 29 2 *")
+	expect.Equal(time.Date(2020, 2, 29, 12, 0, 0, 0, time.UTC), schedule.Next(start))
+
+	schedule, _ = ParseCronSchedule("0 0 31 2 *")
+	expect.True(schedule.Next(start).IsZero())
+}
@@ -0,0 +1,88 @@
+// Copyright 2015-2016 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package shared
+
+import (
+	"container/list"
+)
+
+// LRU is a map holding a limited number of entries. If the limit is reached
+// the least recently used entry is removed to make room for a new one. An
+// optional callback can protect that entry from being removed, in which case
+// no new entries are accepted. LRU is not threadsafe.
+type LRU struct {
+	maxEntries int
+	canEvict   func(key interface{}, value interface{}) bool
+	entries    map[interface{}]*list.Element
+	order      *list.List
+}
+
+type lruEntry struct {
+	key   interface{}
+	value interface{}
+}
+
+// NewLRU creates a new LRU holding at most maxEntries entries. Set maxEntries
+// to 0 to disable the limit. If canEvict is not nil it is called with the
+// least recently used entry before that entry is removed. If it returns false
+// the entry is kept and the new entry is rejected.
+func NewLRU(maxEntries int, canEvict func(key interface{}, value interface{}) bool) *LRU {
+	return &LRU{
+		maxEntries: maxEntries,
+		canEvict:   canEvict,
+		entries:    make(map[interface{}]*list.Element),
+		order:      list.New(),
+	}
+}
+
+// Get returns the value stored for the given key and marks the entry as
+// recently used.
+func (lru *LRU) Get(key interface{}) (interface{}, bool) {
+	element, exists := lru.entries[key]
+	if !exists {
+		return nil, false // ### return, unknown key ###
+	}
+	lru.order.MoveToFront(element)
+	return element.Value.(*lruEntry).value, true
+}
+
+// Set stores a value for the given key and marks the entry as recently used.
+// False is returned if the key is new, the limit is reached and the least
+// recently used entry cannot be removed.
+func (lru *LRU) Set(key interface{}, value interface{}) bool {
+	if element, exists := lru.entries[key]; exists {
+		element.Value.(*lruEntry).value = value
+		lru.order.MoveToFront(element)
+		return true // ### return, updated ###
+	}
+
+	if lru.maxEntries > 0 && lru.order.Len() >= lru.maxEntries {
+		oldest := lru.order.Back()
+		entry := oldest.Value.(*lruEntry)
+		if lru.canEvict != nil && !lru.canEvict(entry.key, entry.value) {
+			return false // ### return, full ###
+		}
+		lru.order.Remove(oldest)
+		delete(lru.entries, entry.key)
+	}
+
+	lru.entries[key] = lru.order.PushFront(&lruEntry{key: key, value: value})
+	return true
+}
+
+// Len returns the number of entries stored
+func (lru *LRU) Len() int {
+	return lru.order.Len()
+}
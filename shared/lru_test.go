@@ -0,0 +1,65 @@
+// Copyright 2015-2016 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package shared
+
+import (
+	"testing"
+)
+
+func TestLRUEvictsLeastRecentlyUsed(t *testing.T) {
+	expect := NewExpect(t)
+	lru := NewLRU(2, nil)
+
+	expect.True(lru.Set("a", 1))
+	expect.True(lru.Set("b", 2))
+
+	_, exists := lru.Get("a")
+	expect.True(exists)
+
+	expect.True(lru.Set("c", 3))
+	expect.Equal(2, lru.Len())
+
+	_, exists = lru.Get("b")
+	expect.False(exists)
+
+	value, exists := lru.Get("a")
+	expect.True(exists)
+	expect.Equal(1, value)
+}
+
+func TestLRUCanEvict(t *testing.T) {
+	expect := NewExpect(t)
+	lru := NewLRU(1, func(key interface{}, value interface{}) bool {
+		return value.(int) == 0
+	})
+
+	expect.True(lru.Set("a", 1))
+	expect.False(lru.Set("b", 1))
+	expect.True(lru.Set("a", 0))
+	expect.True(lru.Set("b", 1))
+
+	_, exists := lru.Get("a")
+	expect.False(exists)
+}
+
+func TestLRUUnlimited(t *testing.T) {
+	expect := NewExpect(t)
+	lru := NewLRU(0, nil)
+
+	for i := 0; i < 100; i++ {
+		expect.True(lru.Set(i, i))
+	}
+	expect.Equal(100, lru.Len())
+}
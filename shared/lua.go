@@ -0,0 +1,149 @@
+// Copyright 2015-2016 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package shared
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/yuin/gopher-lua"
+	"github.com/yuin/gopher-lua/parse"
+	"io/ioutil"
+	"strings"
+	"time"
+)
+
+// ErrLuaInstructionLimit is returned by a Lua call that exceeded the
+// instruction limit set by LimitLuaState.
+var ErrLuaInstructionLimit = errors.New("instruction limit exceeded")
+
+// luaClosed is a closed channel returned by luaLimit once the limit has been
+// reached
+var luaClosed = make(chan struct{})
+
+// luaLimit is a context that is done after a given number of Lua instructions.
+// gopher-lua checks the context of a state before each instruction, so every
+// call to Done counts as one instruction.
+type luaLimit struct {
+	context.Context
+	remaining int
+}
+
+func init() {
+	close(luaClosed)
+}
+
+// Done returns a closed channel once the instruction limit has been reached.
+func (limit *luaLimit) Done() <-chan struct{} {
+	if limit.remaining <= 0 {
+		return luaClosed
+	}
+	limit.remaining--
+	return limit.Context.Done()
+}
+
+// Err returns ErrLuaInstructionLimit if the instruction limit has been
+// reached.
+func (limit *luaLimit) Err() error {
+	if limit.remaining <= 0 {
+		return ErrLuaInstructionLimit
+	}
+	return limit.Context.Err()
+}
+
+// CompileLua compiles a Lua script. If scriptFile is set the script is read
+// from the given file instead.
+func CompileLua(script string, scriptFile string) (*lua.FunctionProto, error) {
+	scriptName := "script"
+	if scriptFile != "" {
+		data, err := ioutil.ReadFile(scriptFile)
+		if err != nil {
+			return nil, err
+		}
+		script = string(data)
+		scriptName = scriptFile
+	}
+
+	chunk, err := parse.Parse(strings.NewReader(script), scriptName)
+	if err != nil {
+		return nil, err
+	}
+	return lua.Compile(chunk, scriptName)
+}
+
+// NewLuaState creates a Lua state, executes the given script and checks that
+// it defines the given global function. Only the base, table, string and
+// math libraries are available and functions accessing the file system are
+// removed.
+func NewLuaState(proto *lua.FunctionProto, function string, callStackSize int) (*lua.LState, error) {
+	state := lua.NewState(lua.Options{
+		SkipOpenLibs:  true,
+		CallStackSize: callStackSize,
+	})
+
+	for _, lib := range []struct {
+		name string
+		open lua.LGFunction
+	}{
+		{lua.BaseLibName, lua.OpenBase},
+		{lua.TabLibName, lua.OpenTable},
+		{lua.StringLibName, lua.OpenString},
+		{lua.MathLibName, lua.OpenMath},
+	} {
+		state.Push(state.NewFunction(lib.open))
+		state.Push(lua.LString(lib.name))
+		state.Call(1, 0)
+	}
+
+	for _, name := range []string{"dofile", "loadfile", "require"} {
+		state.SetGlobal(name, lua.LNil)
+	}
+
+	state.Push(state.NewFunctionFromProto(proto))
+	if err := state.PCall(0, lua.MultRet, nil); err != nil {
+		state.Close()
+		return nil, err
+	}
+
+	if state.GetGlobal(function).Type() != lua.LTFunction {
+		state.Close()
+		return nil, fmt.Errorf("Lua script does not define a function %s", function)
+	}
+	return state, nil
+}
+
+// LimitLuaState aborts calls on the given state that take longer than timeout
+// or execute more than maxInstructions instructions. A value of 0 disables
+// the respective limit. The returned function removes the limits and has to
+// be called once the call is done.
+func LimitLuaState(state *lua.LState, timeout time.Duration, maxInstructions int) func() {
+	if timeout <= 0 && maxInstructions <= 0 {
+		return func() {} // ### return, no limits ###
+	}
+
+	ctx, cancel := context.Background(), context.CancelFunc(func() {})
+	if timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+	}
+	if maxInstructions > 0 {
+		ctx = &luaLimit{Context: ctx, remaining: maxInstructions}
+	}
+	state.SetContext(ctx)
+
+	return func() {
+		state.RemoveContext()
+		cancel()
+	}
+}
@@ -0,0 +1,61 @@
+// Copyright 2015-2016 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package shared
+
+import (
+	"github.com/yuin/gopher-lua"
+	"testing"
+)
+
+func TestLuaState(t *testing.T) {
+	expect := NewExpect(t)
+
+	proto, err := CompileLua("function check() return dofile == nil and io == nil end", "")
+	expect.NoError(err)
+
+	_, err = NewLuaState(proto, "other", 16)
+	expect.NotNil(err)
+
+	state, err := NewLuaState(proto, "check", 16)
+	expect.NoError(err)
+	defer state.Close()
+
+	err = state.CallByParam(lua.P{Fn: state.GetGlobal("check"), NRet: 1, Protect: true})
+	expect.NoError(err)
+	expect.Equal(lua.LTrue, state.Get(-1))
+
+	_, err = CompileLua("function check(", "")
+	expect.NotNil(err)
+}
+
+func TestLuaLimit(t *testing.T) {
+	expect := NewExpect(t)
+
+	proto, err := CompileLua("function count(n) for i = 1, n do end end", "")
+	expect.NoError(err)
+	state, err := NewLuaState(proto, "count", 16)
+	expect.NoError(err)
+	defer state.Close()
+
+	call := func(n int) error {
+		done := LimitLuaState(state, 0, 1000)
+		defer done()
+		return state.CallByParam(lua.P{Fn: state.GetGlobal("count"), Protect: true}, lua.LNumber(n))
+	}
+
+	expect.NoError(call(10))
+	expect.NotNil(call(10000))
+	expect.NoError(call(10))
+}
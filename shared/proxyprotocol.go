@@ -0,0 +1,175 @@
+// Copyright 2015-2016 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package shared
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+const (
+	proxyProtocolV1MaxLength = 107
+	proxyProtocolV2HeaderLen = 16
+)
+
+var (
+	proxyProtocolV1Prefix    = []byte("PROXY ")
+	proxyProtocolV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+)
+
+// ProxyProtocolInvalid is returned when a PROXY protocol header could not be
+// parsed.
+var ProxyProtocolInvalid = bufferError("Invalid PROXY protocol header")
+
+// ProxyProtocolHeader holds the connection information transmitted by a
+// PROXY protocol (version 1 or 2) header as used by e.g. HAProxy or AWS ELB.
+// Source and Destination are nil if the sender did not transmit an address,
+// e.g. for health checks ("LOCAL" or "UNKNOWN" connections).
+type ProxyProtocolHeader struct {
+	Version     int
+	Source      net.Addr
+	Destination net.Addr
+}
+
+// ReadProxyProtocolHeader reads a PROXY protocol header from the given
+// reader. Data is read byte by byte or in exactly sized chunks so that no
+// payload following the header is consumed.
+// ProxyProtocolInvalid is returned if the data read is not a valid header.
+func ReadProxyProtocolHeader(reader io.Reader) (ProxyProtocolHeader, error) {
+	prefix := make([]byte, len(proxyProtocolV1Prefix))
+	if _, err := io.ReadFull(reader, prefix); err != nil {
+		return ProxyProtocolHeader{}, err // ### return, read error ###
+	}
+
+	switch {
+	case bytes.Equal(prefix, proxyProtocolV1Prefix):
+		return readProxyProtocolV1(reader)
+
+	case bytes.Equal(prefix, proxyProtocolV2Signature[:len(prefix)]):
+		header := make([]byte, proxyProtocolV2HeaderLen)
+		copy(header, prefix)
+		if _, err := io.ReadFull(reader, header[len(prefix):]); err != nil {
+			return ProxyProtocolHeader{}, err // ### return, read error ###
+		}
+		return readProxyProtocolV2(reader, header)
+
+	default:
+		return ProxyProtocolHeader{}, ProxyProtocolInvalid
+	}
+}
+
+// readProxyProtocolV1 parses the text based header, e.g.
+// "PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\r\n"
+func readProxyProtocolV1(reader io.Reader) (ProxyProtocolHeader, error) {
+	header := ProxyProtocolHeader{Version: 1}
+	line := make([]byte, 0, proxyProtocolV1MaxLength)
+	char := make([]byte, 1)
+
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) >= proxyProtocolV1MaxLength-len(proxyProtocolV1Prefix) {
+			return header, ProxyProtocolInvalid // ### return, header too long ###
+		}
+		if _, err := io.ReadFull(reader, char); err != nil {
+			return header, err // ### return, read error ###
+		}
+		line = append(line, char[0])
+	}
+
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	switch {
+	case fields[0] == "UNKNOWN":
+		return header, nil // ### return, no address given ###
+
+	case len(fields) != 5 || (fields[0] != "TCP4" && fields[0] != "TCP6"):
+		return header, ProxyProtocolInvalid // ### return, malformed ###
+	}
+
+	srcPort, srcErr := strconv.Atoi(fields[3])
+	dstPort, dstErr := strconv.Atoi(fields[4])
+	srcIP := net.ParseIP(fields[1])
+	dstIP := net.ParseIP(fields[2])
+
+	if srcErr != nil || dstErr != nil || srcIP == nil || dstIP == nil {
+		return header, ProxyProtocolInvalid // ### return, malformed ###
+	}
+
+	header.Source = &net.TCPAddr{IP: srcIP, Port: srcPort}
+	header.Destination = &net.TCPAddr{IP: dstIP, Port: dstPort}
+	return header, nil
+}
+
+// readProxyProtocolV2 parses the binary header. The given header slice has to
+// contain the first 16 bytes of the header.
+func readProxyProtocolV2(reader io.Reader, header []byte) (ProxyProtocolHeader, error) {
+	result := ProxyProtocolHeader{Version: 2}
+	if !bytes.Equal(header[:len(proxyProtocolV2Signature)], proxyProtocolV2Signature) || header[12]>>4 != 2 {
+		return result, ProxyProtocolInvalid // ### return, not a v2 header ###
+	}
+
+	payload := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	if _, err := io.ReadFull(reader, payload); err != nil {
+		return result, err // ### return, read error ###
+	}
+
+	command := header[12] & 0x0F
+	family := header[13] >> 4
+	transport := header[13] & 0x0F
+
+	switch {
+	case command == 0x00:
+		return result, nil // ### return, LOCAL command, no address given ###
+	case command != 0x01:
+		return result, ProxyProtocolInvalid // ### return, unknown command ###
+	}
+
+	newAddr := func(ip net.IP, port uint16) net.Addr {
+		if transport == 0x02 {
+			return &net.UDPAddr{IP: ip, Port: int(port)}
+		}
+		return &net.TCPAddr{IP: ip, Port: int(port)}
+	}
+
+	switch family {
+	case 0x01: // AF_INET
+		if len(payload) < 12 {
+			return result, ProxyProtocolInvalid // ### return, too short ###
+		}
+		result.Source = newAddr(net.IP(payload[0:4]), binary.BigEndian.Uint16(payload[8:10]))
+		result.Destination = newAddr(net.IP(payload[4:8]), binary.BigEndian.Uint16(payload[10:12]))
+
+	case 0x02: // AF_INET6
+		if len(payload) < 36 {
+			return result, ProxyProtocolInvalid // ### return, too short ###
+		}
+		result.Source = newAddr(net.IP(payload[0:16]), binary.BigEndian.Uint16(payload[32:34]))
+		result.Destination = newAddr(net.IP(payload[16:32]), binary.BigEndian.Uint16(payload[34:36]))
+
+	case 0x03: // AF_UNIX
+		if len(payload) < 216 {
+			return result, ProxyProtocolInvalid // ### return, too short ###
+		}
+		result.Source = &net.UnixAddr{Name: string(bytes.TrimRight(payload[0:108], "\x00")), Net: "unix"}
+		result.Destination = &net.UnixAddr{Name: string(bytes.TrimRight(payload[108:216], "\x00")), Net: "unix"}
+
+	default:
+		// AF_UNSPEC, no address given
+	}
+
+	return result, nil
+}
@@ -0,0 +1,72 @@
+// Copyright 2015-2016 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package shared
+
+import (
+	"bytes"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestProxyProtocolV1(t *testing.T) {
+	expect := NewExpect(t)
+
+	reader := strings.NewReader("PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\r\npayload")
+	header, err := ReadProxyProtocolHeader(reader)
+	expect.NoError(err)
+	expect.Equal(1, header.Version)
+	expect.Equal("192.168.0.1:56324", header.Source.String())
+	expect.Equal("192.168.0.11:443", header.Destination.String())
+
+	remain, _ := ioutil.ReadAll(reader)
+	expect.Equal("payload", string(remain))
+
+	header, err = ReadProxyProtocolHeader(strings.NewReader("PROXY UNKNOWN\r\n"))
+	expect.NoError(err)
+	expect.Nil(header.Source)
+
+	_, err = ReadProxyProtocolHeader(strings.NewReader("PROXY TCP4 foo bar 1 2\r\n"))
+	expect.Equal(ProxyProtocolInvalid, err)
+
+	_, err = ReadProxyProtocolHeader(strings.NewReader("GET / HTTP/1.1\r\n"))
+	expect.Equal(ProxyProtocolInvalid, err)
+}
+
+func TestProxyProtocolV2(t *testing.T) {
+	expect := NewExpect(t)
+
+	data := bytes.NewBuffer(nil)
+	data.Write(proxyProtocolV2Signature)
+	data.Write([]byte{0x21, 0x11, 0x00, 0x0C})   // v2 PROXY, TCP over IPv4, 12 bytes
+	data.Write([]byte{10, 0, 0, 1, 10, 0, 0, 2}) // src, dst
+	data.Write([]byte{0x1F, 0x90, 0x01, 0xBB})   // 8080, 443
+	data.WriteString("payload")
+
+	header, err := ReadProxyProtocolHeader(data)
+	expect.NoError(err)
+	expect.Equal(2, header.Version)
+	expect.Equal("10.0.0.1:8080", header.Source.String())
+	expect.Equal("10.0.0.2:443", header.Destination.String())
+	expect.Equal("payload", data.String())
+
+	data.Reset()
+	data.Write(proxyProtocolV2Signature)
+	data.Write([]byte{0x20, 0x00, 0x00, 0x00}) // v2 LOCAL
+
+	header, err = ReadProxyProtocolHeader(data)
+	expect.NoError(err)
+	expect.Nil(header.Source)
+}
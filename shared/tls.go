@@ -0,0 +1,121 @@
+// Copyright 2015-2016 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package shared
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+)
+
+// NewServerTLSConfig creates a TLS configuration for server side connections.
+// If certificateFile and keyFile are both empty, nil is returned, i.e. TLS is
+// disabled. Otherwise both files have to be given.
+// If clientCAFile is not empty, clients are required to present a certificate
+// that has been signed by one of the certificate authorities stored in that
+// file.
+func NewServerTLSConfig(certificateFile, keyFile, clientCAFile string) (*tls.Config, error) {
+	if certificateFile == "" && keyFile == "" {
+		if clientCAFile != "" {
+			return nil, fmt.Errorf("A client CA requires a certificate and a private key")
+		}
+		return nil, nil // ### return, TLS disabled ###
+	}
+
+	if certificateFile == "" || keyFile == "" {
+		return nil, fmt.Errorf("There must always be a certificate and a private key or none of both")
+	}
+
+	keypair, err := tls.LoadX509KeyPair(certificateFile, keyFile)
+	if err != nil {
+		return nil, err // ### return, invalid keypair ###
+	}
+
+	config := &tls.Config{
+		Certificates: []tls.Certificate{keypair},
+	}
+
+	if clientCAFile != "" {
+		caCert, err := ioutil.ReadFile(clientCAFile)
+		if err != nil {
+			return nil, err // ### return, CA not readable ###
+		}
+
+		caCertPool := x509.NewCertPool()
+		if !caCertPool.AppendCertsFromPEM(caCert) {
+			return nil, fmt.Errorf("No valid certificates found in %s", clientCAFile)
+		}
+
+		config.ClientCAs = caCertPool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return config, nil
+}
+
+// CertificateIdentities returns the identities stored in a certificate.
+// The first element is always the subject's common name (which may be empty)
+// followed by all DNS names, email addresses and URIs stored as subject
+// alternative names.
+func CertificateIdentities(cert *x509.Certificate) []string {
+	identities := []string{cert.Subject.CommonName}
+	identities = append(identities, cert.DNSNames...)
+	identities = append(identities, cert.EmailAddresses...)
+	for _, uri := range cert.URIs {
+		identities = append(identities, uri.String())
+	}
+	return identities
+}
+
+// NewClientTLSConfig creates a TLS configuration for client side connections.
+// If caFile is empty, the certificate authorities of the system are used to
+// verify the server. Otherwise only the authorities stored in that file are
+// accepted. A client certificate is sent if certificateFile and keyFile are
+// given. If serverName is not empty, it is used to verify the hostname of the
+// server certificate instead of the address the client connects to.
+func NewClientTLSConfig(certificateFile, keyFile, caFile, serverName string, insecureSkipVerify bool) (*tls.Config, error) {
+	config := &tls.Config{
+		ServerName:         serverName,
+		InsecureSkipVerify: insecureSkipVerify,
+	}
+
+	switch {
+	case certificateFile != "" && keyFile != "":
+		keypair, err := tls.LoadX509KeyPair(certificateFile, keyFile)
+		if err != nil {
+			return nil, err // ### return, invalid keypair ###
+		}
+		config.Certificates = []tls.Certificate{keypair}
+
+	case certificateFile != "" || keyFile != "":
+		return nil, fmt.Errorf("There must always be a certificate and a private key or none of both")
+	}
+
+	if caFile != "" {
+		caCert, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, err // ### return, CA not readable ###
+		}
+
+		caCertPool := x509.NewCertPool()
+		if !caCertPool.AppendCertsFromPEM(caCert) {
+			return nil, fmt.Errorf("No valid certificates found in %s", caFile)
+		}
+		config.RootCAs = caCertPool
+	}
+
+	return config, nil
+}
@@ -0,0 +1,133 @@
+// Copyright 2015-2016 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package shared
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeTestCertificate(expect Expect, dir string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	expect.NoError(err)
+
+	template := x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "gollum"},
+		DNSNames:              []string{"gollum.local"},
+		EmailAddresses:        []string{"gollum@example.com"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	expect.NoError(err)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	expect.NoError(err)
+
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+
+	expect.NoError(ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	expect.NoError(ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600))
+
+	return certFile, keyFile
+}
+
+func TestNewServerTLSConfig(t *testing.T) {
+	expect := NewExpect(t)
+
+	config, err := NewServerTLSConfig("", "", "")
+	expect.NoError(err)
+	expect.Nil(config)
+
+	_, err = NewServerTLSConfig("cert.pem", "", "")
+	expect.NotNil(err)
+
+	_, err = NewServerTLSConfig("", "", "ca.pem")
+	expect.NotNil(err)
+
+	dir, err := ioutil.TempDir("", "gollum_tls")
+	expect.NoError(err)
+	defer os.RemoveAll(dir)
+
+	certFile, keyFile := writeTestCertificate(expect, dir)
+
+	config, err = NewServerTLSConfig(certFile, keyFile, "")
+	expect.NoError(err)
+	expect.Equal(1, len(config.Certificates))
+	expect.Equal(tls.NoClientCert, config.ClientAuth)
+
+	config, err = NewServerTLSConfig(certFile, keyFile, certFile)
+	expect.NoError(err)
+	expect.Equal(tls.RequireAndVerifyClientCert, config.ClientAuth)
+	expect.NotNil(config.ClientCAs)
+}
+
+func TestNewClientTLSConfig(t *testing.T) {
+	expect := NewExpect(t)
+
+	config, err := NewClientTLSConfig("", "", "", "broker", false)
+	expect.NoError(err)
+	expect.Equal("broker", config.ServerName)
+	expect.Nil(config.RootCAs)
+
+	_, err = NewClientTLSConfig("cert.pem", "", "", "", false)
+	expect.NotNil(err)
+
+	dir, err := ioutil.TempDir("", "gollum_tls")
+	expect.NoError(err)
+	defer os.RemoveAll(dir)
+
+	certFile, keyFile := writeTestCertificate(expect, dir)
+
+	config, err = NewClientTLSConfig(certFile, keyFile, certFile, "", true)
+	expect.NoError(err)
+	expect.Equal(1, len(config.Certificates))
+	expect.NotNil(config.RootCAs)
+	expect.True(config.InsecureSkipVerify)
+
+	_, err = NewClientTLSConfig("", "", keyFile, "", false)
+	expect.NotNil(err)
+}
+
+func TestCertificateIdentities(t *testing.T) {
+	expect := NewExpect(t)
+
+	dir, err := ioutil.TempDir("", "gollum_tls")
+	expect.NoError(err)
+	defer os.RemoveAll(dir)
+
+	certFile, keyFile := writeTestCertificate(expect, dir)
+	keypair, err := tls.LoadX509KeyPair(certFile, keyFile)
+	expect.NoError(err)
+
+	cert, err := x509.ParseCertificate(keypair.Certificate[0])
+	expect.NoError(err)
+	expect.Equal([]string{"gollum", "gollum.local", "gollum@example.com"}, CertificateIdentities(cert))
+}
@@ -0,0 +1,103 @@
+// Copyright 2015-2016 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package shared
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// IsAbstractUnixSocket returns true if the given unix socket path denotes a
+// socket in the Linux abstract namespace, i.e. it starts with "@".
+// Abstract sockets are not backed by a file.
+func IsAbstractUnixSocket(path string) bool {
+	return strings.HasPrefix(path, "@")
+}
+
+// RemoveStaleUnixSocket removes a left over unix socket file at the given
+// path, e.g. after a crash. An error is returned if the file is not a socket
+// or if the socket is still in use by another process. Both stream and
+// datagram sockets are checked for being in use.
+// Nothing is done for abstract sockets or if the file does not exist.
+func RemoveStaleUnixSocket(path string) error {
+	if IsAbstractUnixSocket(path) {
+		return nil // ### return, no file ###
+	}
+
+	stat, err := os.Lstat(path)
+	switch {
+	case os.IsNotExist(err):
+		return nil // ### return, nothing to remove ###
+	case err != nil:
+		return err // ### return, stat failed ###
+	case stat.Mode()&os.ModeSocket == 0:
+		return fmt.Errorf("%s exists but is not a socket", path)
+	}
+
+	for _, network := range []string{"unix", "unixgram"} {
+		if conn, err := net.DialTimeout(network, path, time.Second); err == nil {
+			conn.Close()
+			return fmt.Errorf("Socket %s is still in use", path)
+		}
+	}
+
+	return os.Remove(path)
+}
+
+// SetUnixSocketPermissions applies the given file permissions and ownership to
+// a socket file. Owner and group may be given as names or numeric ids. Empty
+// strings leave the current owner or group untouched.
+// Nothing is done for abstract sockets.
+func SetUnixSocketPermissions(path string, permissions os.FileMode, owner, group string) error {
+	if IsAbstractUnixSocket(path) {
+		return nil // ### return, no file ###
+	}
+
+	if err := os.Chmod(path, permissions); err != nil {
+		return err // ### return, chmod failed ###
+	}
+
+	if owner == "" && group == "" {
+		return nil // ### return, keep ownership ###
+	}
+
+	uid, gid := -1, -1
+	if owner != "" {
+		if id, err := strconv.Atoi(owner); err == nil {
+			uid = id
+		} else if ownerUser, err := user.Lookup(owner); err != nil {
+			return err // ### return, unknown user ###
+		} else if uid, err = strconv.Atoi(ownerUser.Uid); err != nil {
+			return err // ### return, non-numeric uid ###
+		}
+	}
+
+	if group != "" {
+		if id, err := strconv.Atoi(group); err == nil {
+			gid = id
+		} else if ownerGroup, err := user.LookupGroup(group); err != nil {
+			return err // ### return, unknown group ###
+		} else if gid, err = strconv.Atoi(ownerGroup.Gid); err != nil {
+			return err // ### return, non-numeric gid ###
+		}
+	}
+
+	return os.Chown(path, uid, gid)
+}
@@ -0,0 +1,81 @@
+// Copyright 2015-2016 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package shared
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func TestRemoveStaleUnixSocket(t *testing.T) {
+	expect := NewExpect(t)
+
+	dir, err := ioutil.TempDir("", "gollum_unix")
+	expect.NoError(err)
+	defer os.RemoveAll(dir)
+
+	socketPath := filepath.Join(dir, "test.socket")
+	expect.NoError(RemoveStaleUnixSocket(socketPath))
+	expect.NoError(RemoveStaleUnixSocket("@gollum_test"))
+
+	listener, err := net.ListenUnix("unix", &net.UnixAddr{Name: socketPath, Net: "unix"})
+	expect.NoError(err)
+	expect.NotNil(RemoveStaleUnixSocket(socketPath))
+
+	listener.SetUnlinkOnClose(false)
+	listener.Close()
+	expect.NoError(RemoveStaleUnixSocket(socketPath))
+
+	_, err = os.Stat(socketPath)
+	expect.True(os.IsNotExist(err))
+
+	datagram, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socketPath, Net: "unixgram"})
+	expect.NoError(err)
+	expect.NotNil(RemoveStaleUnixSocket(socketPath))
+
+	datagram.Close()
+	expect.NoError(RemoveStaleUnixSocket(socketPath))
+
+	filePath := filepath.Join(dir, "test.file")
+	expect.NoError(ioutil.WriteFile(filePath, []byte("test"), 0600))
+	expect.NotNil(RemoveStaleUnixSocket(filePath))
+}
+
+func TestSetUnixSocketPermissions(t *testing.T) {
+	expect := NewExpect(t)
+
+	dir, err := ioutil.TempDir("", "gollum_unix")
+	expect.NoError(err)
+	defer os.RemoveAll(dir)
+
+	socketPath := filepath.Join(dir, "test.socket")
+	listener, err := net.Listen("unix", socketPath)
+	expect.NoError(err)
+	defer listener.Close()
+
+	gid := strconv.Itoa(os.Getgid())
+	expect.NoError(SetUnixSocketPermissions(socketPath, 0660, "", gid))
+
+	stat, err := os.Stat(socketPath)
+	expect.NoError(err)
+	expect.Equal(os.FileMode(0660), stat.Mode().Perm())
+
+	expect.True(SetUnixSocketPermissions(socketPath, 0660, "gollum_unknown_test_user", "") != nil)
+	expect.NoError(SetUnixSocketPermissions("@gollum_test", 0660, "", ""))
+}
@@ -0,0 +1,217 @@
+// Copyright 2015-2016 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stream
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/shared"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Batch stream plugin
+// Messages are collected and combined into one message that is sent to all
+// producers attached to this stream. A batch is sent as soon as one of the
+// configured limits is reached. The combined message carries the metadata of
+// the first message in the batch. Pending batches are sent during shutdown
+// after all consumers have been stopped.
+// Configuration example
+//
+//  - "stream.Batch":
+//    Stream: "foo"
+//    BatchMaxCount: 100
+//    BatchMaxBytes: 0
+//    BatchTimeoutMs: 1000
+//    BatchFormat: "delimiter"
+//    BatchDelimiter: "\n"
+//
+// BatchMaxCount defines the maximum number of messages per batch.
+// By default this is set to 100.
+//
+// BatchMaxBytes defines the maximum size of all payloads in a batch in bytes.
+// A message that would exceed this limit starts a new batch. Messages larger
+// than this limit are sent as a batch of their own. By default this is set to
+// 0, i.e. there is no limit.
+//
+// BatchTimeoutMs defines the maximum time in milliseconds a message waits for
+// its batch to be sent. Set to 0 to disable. By default this is set to 1000.
+//
+// BatchFormat defines how messages are combined. By default this is set to
+// "delimiter".
+//  * "delimiter" joins all payloads by BatchDelimiter.
+//  * "json" writes all payloads into a JSON array. Payloads that are not valid
+//    JSON are written as strings.
+//
+// BatchDelimiter defines the string written between two payloads by the
+// "delimiter" format. By default this is set to "\n".
+type Batch struct {
+	core.StreamBase
+	guard      *sync.Mutex
+	messages   []core.Message
+	size       int
+	generation uint64
+	timer      *time.Timer
+	maxCount   int
+	maxBytes   int
+	timeout    time.Duration
+	jsonArray  bool
+	delimiter  []byte
+}
+
+func init() {
+	shared.TypeRegistry.Register(Batch{})
+}
+
+// Configure initializes this distributor with values from a plugin config.
+func (stream *Batch) Configure(conf core.PluginConfig) error {
+	if err := stream.StreamBase.ConfigureStream(conf, stream.collect); err != nil {
+		return err // ### return, base stream error ###
+	}
+
+	stream.guard = new(sync.Mutex)
+	stream.maxCount = conf.GetInt("BatchMaxCount", 100)
+	stream.maxBytes = conf.GetInt("BatchMaxBytes", 0)
+	stream.timeout = time.Duration(conf.GetInt("BatchTimeoutMs", 1000)) * time.Millisecond
+	stream.delimiter = []byte(shared.Unescape(conf.GetString("BatchDelimiter", "\n")))
+
+	if stream.maxCount <= 0 {
+		return fmt.Errorf("BatchMaxCount must be larger than 0")
+	}
+
+	batchFormat := strings.ToLower(conf.GetString("BatchFormat", "delimiter"))
+	switch batchFormat {
+	case "delimiter":
+		stream.jsonArray = false
+	case "json":
+		stream.jsonArray = true
+	default:
+		return fmt.Errorf("Unknown BatchFormat: %s", batchFormat)
+	}
+
+	stream.messages = make([]core.Message, 0, stream.maxCount)
+	return nil
+}
+
+// collect adds a message to the current batch and sends all batches that are
+// complete.
+func (stream *Batch) collect(msg core.Message) {
+	var complete [][]core.Message
+
+	stream.guard.Lock()
+	if stream.maxBytes > 0 && len(stream.messages) > 0 && stream.size+len(msg.Data) > stream.maxBytes {
+		complete = append(complete, stream.takeBatch())
+	}
+
+	if len(stream.messages) == 0 && stream.timeout > 0 {
+		generation := stream.generation
+		stream.timer = time.AfterFunc(stream.timeout, func() { stream.flushGeneration(generation) })
+	}
+
+	stream.messages = append(stream.messages, msg)
+	stream.size += len(msg.Data)
+
+	if len(stream.messages) >= stream.maxCount || (stream.maxBytes > 0 && stream.size >= stream.maxBytes) {
+		complete = append(complete, stream.takeBatch())
+	}
+	stream.guard.Unlock()
+
+	for _, messages := range complete {
+		stream.send(messages)
+	}
+}
+
+// takeBatch returns the current batch and starts a new one. The guard has to
+// be locked when calling this function.
+func (stream *Batch) takeBatch() []core.Message {
+	if stream.timer != nil {
+		stream.timer.Stop()
+		stream.timer = nil
+	}
+
+	messages := stream.messages
+	stream.messages = make([]core.Message, 0, stream.maxCount)
+	stream.size = 0
+	stream.generation++
+	return messages
+}
+
+// flushGeneration sends the current batch if it is still the batch the
+// calling timer was started for.
+func (stream *Batch) flushGeneration(generation uint64) {
+	stream.guard.Lock()
+	if generation != stream.generation || len(stream.messages) == 0 {
+		stream.guard.Unlock()
+		return // ### return, batch already sent ###
+	}
+	messages := stream.takeBatch()
+	stream.guard.Unlock()
+
+	stream.send(messages)
+}
+
+// FlushBatch sends the current batch, regardless of its size.
+func (stream *Batch) FlushBatch() {
+	stream.guard.Lock()
+	messages := stream.takeBatch()
+	stream.guard.Unlock()
+
+	if len(messages) > 0 {
+		stream.send(messages)
+	}
+}
+
+// combine returns the payloads of all messages joined into one payload
+func (stream *Batch) combine(messages []core.Message) []byte {
+	buffer := bytes.NewBuffer(nil)
+	if stream.jsonArray {
+		buffer.WriteByte('[')
+	}
+
+	for i, msg := range messages {
+		if i > 0 && stream.jsonArray {
+			buffer.WriteByte(',')
+		} else if i > 0 {
+			buffer.Write(stream.delimiter)
+		}
+
+		if !stream.jsonArray {
+			buffer.Write(msg.Data)
+			continue // ### continue, plain payload ###
+		}
+
+		if payload := bytes.TrimSpace(msg.Data); len(payload) > 0 && json.Valid(payload) {
+			json.Compact(buffer, payload)
+		} else {
+			encoded, _ := json.Marshal(string(msg.Data))
+			buffer.Write(encoded)
+		}
+	}
+
+	if stream.jsonArray {
+		buffer.WriteByte(']')
+	}
+	return buffer.Bytes()
+}
+
+// send combines a batch into one message and sends it to all producers
+func (stream *Batch) send(messages []core.Message) {
+	batchMsg := messages[0]
+	batchMsg.Data = stream.combine(messages)
+	stream.Broadcast(batchMsg)
+}
@@ -0,0 +1,142 @@
+// Copyright 2015-2016 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stream
+
+import (
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/shared"
+	"sync"
+	"testing"
+	"time"
+)
+
+type mockProducer struct {
+	core.ProducerBase
+}
+
+func (prod *mockProducer) Produce(workers *sync.WaitGroup) {
+	// does nothing.
+}
+
+// received returns the payloads of all messages queued so far
+func (prod *mockProducer) received() []string {
+	payloads := []string{}
+	for prod.NextNonBlocking(func(msg core.Message) { payloads = append(payloads, string(msg.Data)) }) {
+	}
+	return payloads
+}
+
+func getMockProducer(expect shared.Expect) *mockProducer {
+	prod := new(mockProducer)
+	expect.NoError(prod.Configure(core.NewPluginConfig("")))
+	return prod
+}
+
+func TestBatchMaxCount(t *testing.T) {
+	expect := shared.NewExpect(t)
+
+	conf := core.NewPluginConfig("")
+	conf.Stream = []string{"batchTest"}
+	conf.Override("BatchMaxCount", 2)
+	conf.Override("BatchTimeoutMs", 0)
+	plugin, err := core.NewPluginWithType("stream.Batch", conf)
+	expect.NoError(err)
+	stream, casted := plugin.(*Batch)
+	expect.True(casted)
+
+	prod := getMockProducer(expect)
+	stream.AddProducer(prod)
+
+	stream.collect(core.NewMessage(nil, []byte("a"), 0))
+	expect.Equal(0, len(prod.received()))
+
+	stream.collect(core.NewMessage(nil, []byte("b"), 1))
+	expect.Equal([]string{"a\nb"}, prod.received())
+
+	stream.collect(core.NewMessage(nil, []byte("c"), 2))
+	expect.Equal(0, len(prod.received()))
+
+	stream.FlushBatch()
+	expect.Equal([]string{"c"}, prod.received())
+}
+
+func TestBatchMaxBytes(t *testing.T) {
+	expect := shared.NewExpect(t)
+
+	conf := core.NewPluginConfig("")
+	conf.Stream = []string{"batchTest"}
+	conf.Override("BatchMaxBytes", 4)
+	conf.Override("BatchTimeoutMs", 0)
+	plugin, err := core.NewPluginWithType("stream.Batch", conf)
+	expect.NoError(err)
+	stream, casted := plugin.(*Batch)
+	expect.True(casted)
+
+	prod := getMockProducer(expect)
+	stream.AddProducer(prod)
+
+	stream.collect(core.NewMessage(nil, []byte("abc"), 0))
+	stream.collect(core.NewMessage(nil, []byte("de"), 1))
+	expect.Equal([]string{"abc"}, prod.received())
+
+	stream.collect(core.NewMessage(nil, []byte("fg"), 2))
+	expect.Equal([]string{"de\nfg"}, prod.received())
+}
+
+func TestBatchTimeout(t *testing.T) {
+	expect := shared.NewExpect(t)
+
+	conf := core.NewPluginConfig("")
+	conf.Stream = []string{"batchTest"}
+	conf.Override("BatchTimeoutMs", 100)
+	plugin, err := core.NewPluginWithType("stream.Batch", conf)
+	expect.NoError(err)
+	stream, casted := plugin.(*Batch)
+	expect.True(casted)
+
+	prod := getMockProducer(expect)
+	stream.AddProducer(prod)
+
+	stream.collect(core.NewMessage(nil, []byte("a"), 0))
+	expect.Equal(0, len(prod.received()))
+
+	expect.NonBlocking(2*time.Second, func() {
+		msg, _ := prod.Next()
+		expect.Equal("a", string(msg.Data))
+	})
+}
+
+func TestBatchCombine(t *testing.T) {
+	expect := shared.NewExpect(t)
+	messages := []core.Message{
+		core.NewMessage(nil, []byte(`{"a": 1}`), 0),
+		core.NewMessage(nil, []byte(`text`), 1),
+	}
+
+	conf := core.NewPluginConfig("")
+	conf.Stream = []string{"batchTest"}
+	plugin, err := core.NewPluginWithType("stream.Batch", conf)
+	expect.NoError(err)
+	stream, casted := plugin.(*Batch)
+	expect.True(casted)
+	expect.Equal("{\"a\": 1}\ntext", string(stream.combine(messages)))
+
+	conf.Override("BatchFormat", "json")
+	plugin, err = core.NewPluginWithType("stream.Batch", conf)
+	expect.NoError(err)
+	stream, casted = plugin.(*Batch)
+	expect.True(casted)
+	expect.Equal(`[{"a":1},"text"]`, string(stream.combine(messages)))
+}
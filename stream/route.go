@@ -89,12 +89,17 @@ func (stream *Route) routeMessage(msg core.Message) {
 			}
 		}
 
+		// Every route but the last one receives its own copy of the metadata
+		routeMsg := msg
+		if i < len(stream.routes)-1 {
+			routeMsg = msg.CloneMetadata()
+		}
+
 		if target.id == stream.GetBoundStreamID() {
-			stream.StreamBase.Route(msg, stream.GetBoundStreamID())
+			stream.StreamBase.Route(routeMsg, stream.GetBoundStreamID())
 		} else {
-			msg := msg // copy to allow streamId changes and multiple routes
-			msg.StreamID = target.id
-			target.stream.Enqueue(msg)
+			routeMsg.StreamID = target.id // copy allows streamId changes and multiple routes
+			target.stream.Enqueue(routeMsg)
 		}
 	}
 }
@@ -102,20 +107,25 @@ func (stream *Route) routeMessage(msg core.Message) {
 // Enqueue overloads the standard Enqueue method to allow direct routing to
 // explicit stream targets
 func (stream *Route) Enqueue(msg core.Message) {
-	if stream.Filter.Accepts(msg) {
-		var streamID core.MessageStreamID
-		msg.Data, streamID = stream.Format.Format(msg)
+	msg.PrepareMetadata()
+	if accepted, filterName, reason := core.AcceptsWithReason(stream.Filter, msg); !accepted {
+		core.CountFilteredMessage()
+		core.RouteFiltered(msg, stream.GetFilteredStreamID(), filterName, reason)
+		return // ### return, filtered ###
+	}
 
-		if msg.StreamID != streamID {
-			stream.StreamBase.Route(msg, streamID)
-			return // ### return, routed by standard method ###
-		}
+	var streamID core.MessageStreamID
+	msg.Data, streamID = stream.Format.Format(msg)
 
-		stream.routeMessage(msg)
+	if msg.StreamID != streamID {
+		stream.StreamBase.Route(msg, streamID)
+		return // ### return, routed by standard method ###
+	}
 
-		if len(stream.routes) == 0 {
-			core.CountNoRouteForMessage()
-			return // ### return, no route to producer ###
-		}
+	stream.routeMessage(msg)
+
+	if len(stream.routes) == 0 {
+		core.CountNoRouteForMessage()
+		return // ### return, no route to producer ###
 	}
 }
@@ -0,0 +1,56 @@
+// Copyright 2015-2016 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stream
+
+import (
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/shared"
+	"testing"
+)
+
+func TestRouteDroppedToStream(t *testing.T) {
+	expect := shared.NewExpect(t)
+
+	droppedConf := core.NewPluginConfig("")
+	droppedConf.Stream = []string{"routeDropped"}
+	plugin, err := core.NewPluginWithType("stream.Broadcast", droppedConf)
+	expect.NoError(err)
+	dropped, casted := plugin.(*Broadcast)
+	expect.True(casted)
+
+	droppedProd := getMockProducer(expect)
+	dropped.AddProducer(droppedProd)
+	core.StreamRegistry.Register(dropped, core.StreamRegistry.GetStreamID("routeDropped"))
+
+	conf := core.NewPluginConfig("")
+	conf.Stream = []string{"routeSource"}
+	conf.Override("Routes", []string{"routeTarget"})
+	conf.Override("Filter", "filter.None")
+	conf.Override("DroppedToStream", "routeDropped")
+	plugin, err = core.NewPluginWithType("stream.Route", conf)
+	expect.NoError(err)
+	route, casted := plugin.(*Route)
+	expect.True(casted)
+
+	targetProd := getMockProducer(expect)
+	route.AddProducer(targetProd)
+
+	msg := core.NewMessage(nil, []byte("test"), 0)
+	msg.StreamID = core.StreamRegistry.GetStreamID("routeSource")
+	route.Enqueue(msg)
+
+	expect.Equal([]string{"test"}, droppedProd.received())
+	expect.Equal(0, len(targetProd.received()))
+}